@@ -0,0 +1,415 @@
+// Package admindb stores admin users, with roles limiting what they can do
+// through the admin web interface and the ctl socket.
+//
+// The admin password file configured in mox.conf remains the full admin. Admin
+// users are in addition, e.g. for giving helpdesk staff read-only access, or
+// letting someone manage the accounts and aliases of their own domains.
+package admindb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/text/secure/precis"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/totp"
+)
+
+var (
+	DBTypes = []any{User{}, AuditEntry{}}
+	DB      *bstore.DB
+)
+
+var ErrUnknownUser = errors.New("unknown admin user")
+
+// Role determines which operations an admin user is allowed to do.
+type Role string
+
+const (
+	// Full access, like the admin password.
+	RoleAdmin Role = "admin"
+
+	// Viewing configuration, queues and reports, but no changes.
+	RoleReadOnly Role = "readonly"
+
+	// Like readonly, and managing the queues: hold, reschedule, fail and drop
+	// messages and webhooks, and managing hold rules.
+	RoleQueue Role = "queue"
+
+	// Viewing and changing the domains listed in the Domains field of the user,
+	// and the accounts (based on their default domain), addresses and aliases of
+	// those domains. No access to other configuration.
+	RoleDomain Role = "domain"
+)
+
+// Permission is a kind of operation that requires a role that allows it.
+type Permission int
+
+const (
+	PermSession      Permission = iota // Managing own session and two-factor authentication, for all roles.
+	PermRead                           // Viewing global information, such as queues, reports and configuration.
+	PermQueue                          // Changing the queues.
+	PermAdmin                          // Changing configuration and other operations, only for full admins.
+	PermDomainRead                     // Viewing a domain, or its accounts/addresses/aliases. Domain admins must be checked for access to the domain.
+	PermDomainChange                   // Changing a domain, or its accounts/addresses/aliases. Domain admins must be checked for access to the domain.
+)
+
+// Allowed returns whether the role allows operations that require the
+// permission. For domain admins, the caller must also check access to the
+// domain for PermDomainRead and PermDomainChange.
+func (r Role) Allowed(p Permission) bool {
+	switch r {
+	case RoleAdmin:
+		return true
+	case RoleReadOnly:
+		return p == PermSession || p == PermRead || p == PermDomainRead
+	case RoleQueue:
+		return p == PermSession || p == PermRead || p == PermDomainRead || p == PermQueue
+	case RoleDomain:
+		return p == PermSession || p == PermDomainRead || p == PermDomainChange
+	}
+	return false
+}
+
+// User is an admin user that can log in to the admin web interface with a
+// password, and/or is the admin for connections to the ctl socket from a unix
+// user.
+type User struct {
+	Name    string    // Used for logging in.
+	Created time.Time `bstore:"default now"`
+	Role    Role      `bstore:"nonzero"`
+	Domains []string  // For role "domain", the domains the user manages, as unicode names.
+
+	// Optional unix user name. Connections to the ctl socket (e.g. "mox" commands)
+	// by this unix user are limited to the role of this admin user. Once any admin
+	// user has a unix user, connections by other unix users (except root and the
+	// unix user mox runs as) are denied. Peers can only be identified on Linux,
+	// other platforms deny all connections once a unix user is configured.
+	UnixUser string `bstore:"index"`
+
+	// Bcrypt hash. If empty, the user cannot log in to the admin web interface.
+	PasswordHash string `json:"-"`
+
+	// If set, logins to the admin web interface require a code from an
+	// authenticator app.
+	TOTPSecret      []byte `json:"-"`
+	TOTPLastCounter int64  `json:"-"` // Time step of last accepted code.
+}
+
+// HasPassword returns whether the user can log in to the admin web interface.
+func (u User) HasPassword() bool {
+	return u.PasswordHash != ""
+}
+
+// DomainAllowed returns whether the user has access to the domain.
+func (u User) DomainAllowed(d dns.Domain) bool {
+	return u.Role != RoleDomain || slices.Contains(u.Domains, d.Name())
+}
+
+// AccountAllowed returns whether the user has access to the account. Domain
+// admins have access to accounts with a default domain they manage.
+func (u User) AccountAllowed(accountName string) bool {
+	if u.Role != RoleDomain {
+		return true
+	}
+	acc, ok := mox.Conf.Account(accountName)
+	return ok && u.DomainAllowed(acc.DNSDomain)
+}
+
+// Init opens the database.
+func Init() error {
+	if DB != nil {
+		return fmt.Errorf("already initialized")
+	}
+
+	log := mlog.New("admindb", nil)
+	p := mox.DataDirPath("admin.db")
+	os.MkdirAll(filepath.Dir(p), 0770)
+	opts := bstore.Options{Timeout: 5 * time.Second, Perm: 0660, RegisterLogger: log.Logger}
+	var err error
+	DB, err = bstore.Open(mox.Shutdown, p, &opts, DBTypes...)
+	if err != nil {
+		return fmt.Errorf("opening admin db: %v", err)
+	}
+	return nil
+}
+
+// Close closes the database.
+func Close() error {
+	if err := DB.Close(); err != nil {
+		return fmt.Errorf("closing admin db: %w", err)
+	}
+	DB = nil
+	return nil
+}
+
+// checkUser validates the user, normalizing the domain names.
+func checkUser(u *User) error {
+	if u.Name == "" || strings.IndexFunc(u.Name, func(c rune) bool { return unicode.IsSpace(c) || unicode.IsControl(c) }) >= 0 {
+		return fmt.Errorf("%w: name must be non-empty without whitespace", mox.ErrRequest)
+	}
+	switch u.Role {
+	case RoleAdmin, RoleReadOnly, RoleQueue:
+		if len(u.Domains) > 0 {
+			return fmt.Errorf("%w: domains only apply to role %q", mox.ErrRequest, RoleDomain)
+		}
+	case RoleDomain:
+		if len(u.Domains) == 0 {
+			return fmt.Errorf("%w: role %q requires at least one domain", mox.ErrRequest, RoleDomain)
+		}
+		var domains []string
+		for _, s := range u.Domains {
+			d, err := dns.ParseDomain(s)
+			if err != nil {
+				return fmt.Errorf("%w: parsing domain %q: %v", mox.ErrRequest, s, err)
+			}
+			if _, ok := mox.Conf.Domain(d); !ok {
+				return fmt.Errorf("%w: unknown domain %q", mox.ErrRequest, s)
+			}
+			if !slices.Contains(domains, d.Name()) {
+				domains = append(domains, d.Name())
+			}
+		}
+		u.Domains = domains
+	default:
+		return fmt.Errorf("%w: unknown role %q", mox.ErrRequest, u.Role)
+	}
+	if strings.IndexFunc(u.UnixUser, func(c rune) bool { return unicode.IsSpace(c) || unicode.IsControl(c) }) >= 0 {
+		return fmt.Errorf("%w: unix user cannot have whitespace", mox.ErrRequest)
+	}
+	return nil
+}
+
+// passwordHash returns a bcrypt hash for the password, after precis
+// normalization. An empty password results in an empty hash, disabling logins.
+func passwordHash(password string) (string, error) {
+	if password == "" {
+		return "", nil
+	}
+	// ../rfc/8265:679
+	pw, err := precis.OpaqueString.String(password)
+	if err != nil {
+		return "", fmt.Errorf("%w: password does not meet precis requirements: %v", mox.ErrRequest, err)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(pw), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("generating password hash: %v", err)
+	}
+	return string(hash), nil
+}
+
+// UserList returns all admin users, sorted by name.
+func UserList(ctx context.Context) ([]User, error) {
+	return bstore.QueryDB[User](ctx, DB).SortAsc("Name").List()
+}
+
+// UserGet returns the admin user by name, or ErrUnknownUser.
+func UserGet(ctx context.Context, name string) (User, error) {
+	u := User{Name: name}
+	err := DB.Get(ctx, &u)
+	if err == bstore.ErrAbsent {
+		return User{}, ErrUnknownUser
+	}
+	return u, err
+}
+
+// UserByUnixUser returns the admin user for the unix user, or ErrUnknownUser.
+func UserByUnixUser(ctx context.Context, unixUser string) (User, error) {
+	u, err := bstore.QueryDB[User](ctx, DB).FilterNonzero(User{UnixUser: unixUser}).Limit(1).Get()
+	if err == bstore.ErrAbsent {
+		return User{}, ErrUnknownUser
+	}
+	return u, err
+}
+
+// UnixUsersConfigured returns whether any admin user is associated with a unix
+// user, i.e. whether connections to the ctl socket are limited.
+func UnixUsersConfigured(ctx context.Context) (bool, error) {
+	return bstore.QueryDB[User](ctx, DB).FilterFn(func(u User) bool { return u.UnixUser != "" }).Exists()
+}
+
+// UserAdd adds a new admin user. The password is optional.
+func UserAdd(ctx context.Context, u User, password string) (User, error) {
+	if err := checkUser(&u); err != nil {
+		return User{}, err
+	}
+	hash, err := passwordHash(password)
+	if err != nil {
+		return User{}, err
+	}
+	nu := User{Name: u.Name, Role: u.Role, Domains: u.Domains, UnixUser: u.UnixUser, PasswordHash: hash}
+	err = DB.Write(ctx, func(tx *bstore.Tx) error {
+		if exists, err := bstore.QueryTx[User](tx).FilterNonzero(User{Name: u.Name}).Exists(); err != nil {
+			return err
+		} else if exists {
+			return fmt.Errorf("%w: admin user already exists", mox.ErrRequest)
+		}
+		if err := checkUnixUser(tx, nu); err != nil {
+			return err
+		}
+		if err := tx.Insert(&nu); err != nil {
+			return err
+		}
+		return auditInsert(ctx, tx, AuditAdminUser, "admin user added: "+nu.describe(), "")
+	})
+	return nu, err
+}
+
+// checkUnixUser returns an error if the unix user is already associated with
+// another admin user.
+func checkUnixUser(tx *bstore.Tx, u User) error {
+	if u.UnixUser == "" {
+		return nil
+	}
+	exists, err := bstore.QueryTx[User](tx).FilterNonzero(User{UnixUser: u.UnixUser}).FilterNotEqual("Name", u.Name).Exists()
+	if err != nil {
+		return err
+	} else if exists {
+		return fmt.Errorf("%w: unix user already used by another admin user", mox.ErrRequest)
+	}
+	return nil
+}
+
+// UserSave changes the role, domains and unix user of an existing admin user.
+func UserSave(ctx context.Context, u User) error {
+	if err := checkUser(&u); err != nil {
+		return err
+	}
+	return DB.Write(ctx, func(tx *bstore.Tx) error {
+		ou := User{Name: u.Name}
+		if err := tx.Get(&ou); err == bstore.ErrAbsent {
+			return ErrUnknownUser
+		} else if err != nil {
+			return err
+		}
+		if err := checkUnixUser(tx, u); err != nil {
+			return err
+		}
+		ou.Role = u.Role
+		ou.Domains = u.Domains
+		ou.UnixUser = u.UnixUser
+		if err := tx.Update(&ou); err != nil {
+			return err
+		}
+		return auditInsert(ctx, tx, AuditAdminUser, "admin user changed: "+ou.describe(), "")
+	})
+}
+
+// UserSetPassword sets a new password for the admin user. An empty password
+// disables logins to the admin web interface.
+func UserSetPassword(ctx context.Context, name, password string) error {
+	hash, err := passwordHash(password)
+	if err != nil {
+		return err
+	}
+	details := fmt.Sprintf("password set for admin user %q", name)
+	if password == "" {
+		details = fmt.Sprintf("password cleared for admin user %q", name)
+	}
+	return userUpdate(ctx, name, func(tx *bstore.Tx, u *User) error {
+		u.PasswordHash = hash
+		return auditInsert(ctx, tx, AuditPassword, details, "")
+	})
+}
+
+// UserRemove removes an admin user.
+func UserRemove(ctx context.Context, name string) error {
+	return DB.Write(ctx, func(tx *bstore.Tx) error {
+		err := tx.Delete(&User{Name: name})
+		if err == bstore.ErrAbsent {
+			return ErrUnknownUser
+		} else if err != nil {
+			return err
+		}
+		return auditInsert(ctx, tx, AuditAdminUser, fmt.Sprintf("admin user removed: %q", name), "")
+	})
+}
+
+// describe returns the name, role, domains and unix user for the audit log.
+func (u User) describe() string {
+	s := fmt.Sprintf("%q, role %s", u.Name, u.Role)
+	if len(u.Domains) > 0 {
+		s += ", domains " + strings.Join(u.Domains, ", ")
+	}
+	if u.UnixUser != "" {
+		s += ", unix user " + u.UnixUser
+	}
+	return s
+}
+
+func userUpdate(ctx context.Context, name string, fn func(tx *bstore.Tx, u *User) error) error {
+	return DB.Write(ctx, func(tx *bstore.Tx) error {
+		u := User{Name: name}
+		if err := tx.Get(&u); err == bstore.ErrAbsent {
+			return ErrUnknownUser
+		} else if err != nil {
+			return err
+		}
+		if err := fn(tx, &u); err != nil {
+			return err
+		}
+		return tx.Update(&u)
+	})
+}
+
+// UserLogin checks the password of an admin user. The user is only returned
+// if the password is valid.
+func UserLogin(ctx context.Context, name, password string) (User, bool, error) {
+	u, err := UserGet(ctx, name)
+	if err == ErrUnknownUser {
+		return User{}, false, nil
+	} else if err != nil {
+		return User{}, false, err
+	}
+	if !u.HasPassword() {
+		return User{}, false, nil
+	}
+	// ../rfc/8265:679
+	if pw, err := precis.OpaqueString.String(password); err == nil {
+		password = pw
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)); err != nil {
+		return User{}, false, nil
+	}
+	return u, true, nil
+}
+
+// UserTOTPSet sets the TOTP secret for an admin user, with the time step of the
+// code used for confirmation. A nil secret disables TOTP for the user.
+func UserTOTPSet(ctx context.Context, name string, secret []byte, counter int64) error {
+	return userUpdate(ctx, name, func(tx *bstore.Tx, u *User) error {
+		u.TOTPSecret = secret
+		u.TOTPLastCounter = counter
+		return nil
+	})
+}
+
+// UserTOTPCheck checks a TOTP code for the admin user, rejecting codes that were
+// already used.
+func UserTOTPCheck(ctx context.Context, name, code string) (valid bool, rerr error) {
+	rerr = userUpdate(ctx, name, func(tx *bstore.Tx, u *User) error {
+		if u.TOTPSecret == nil {
+			return fmt.Errorf("two-factor authentication not enabled for admin user")
+		}
+		var counter int64
+		counter, valid = totp.Verify(u.TOTPSecret, code, time.Now(), u.TOTPLastCounter)
+		if valid {
+			u.TOTPLastCounter = counter
+		}
+		return nil
+	})
+	return valid, rerr
+}
@@ -0,0 +1,157 @@
+package admindb
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/totp"
+)
+
+var ctxbg = context.Background()
+
+func tcheck(t *testing.T, err error, msg string) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: %s", msg, err)
+	}
+}
+
+func TestAdminDB(t *testing.T) {
+	mox.Shutdown = ctxbg
+	mox.ConfigStaticPath = filepath.FromSlash("../testdata/admindb/mox.conf")
+	mox.ConfigDynamicPath = filepath.Join(filepath.Dir(mox.ConfigStaticPath), "domains.conf")
+	mox.MustLoadConfig(true, false)
+
+	os.Remove(mox.DataDirPath("admin.db"))
+	err := Init()
+	tcheck(t, err, "init")
+	defer func() {
+		err := Close()
+		tcheck(t, err, "close")
+	}()
+
+	_, err = UserAdd(ctxbg, User{Name: "", Role: RoleAdmin}, "")
+	if !errors.Is(err, mox.ErrRequest) {
+		t.Fatalf("got err %v, expected ErrRequest for empty name", err)
+	}
+	_, err = UserAdd(ctxbg, User{Name: "x", Role: "bogus"}, "")
+	if !errors.Is(err, mox.ErrRequest) {
+		t.Fatalf("got err %v, expected ErrRequest for unknown role", err)
+	}
+	_, err = UserAdd(ctxbg, User{Name: "x", Role: RoleAdmin, Domains: []string{"mox.example"}}, "")
+	if !errors.Is(err, mox.ErrRequest) {
+		t.Fatalf("got err %v, expected ErrRequest for domains without role domain", err)
+	}
+	_, err = UserAdd(ctxbg, User{Name: "x", Role: RoleDomain, Domains: []string{"bogus.example"}}, "")
+	if !errors.Is(err, mox.ErrRequest) {
+		t.Fatalf("got err %v, expected ErrRequest for unknown domain", err)
+	}
+
+	u, err := UserAdd(ctxbg, User{Name: "dom", Role: RoleDomain, Domains: []string{"MOX.example", "mox.example"}, UnixUser: "dom"}, "test1234")
+	tcheck(t, err, "add user")
+	if len(u.Domains) != 1 || u.Domains[0] != "mox.example" {
+		t.Fatalf("got domains %v, expected normalized single domain", u.Domains)
+	}
+	_, err = UserAdd(ctxbg, User{Name: "dom", Role: RoleAdmin}, "")
+	if !errors.Is(err, mox.ErrRequest) {
+		t.Fatalf("got err %v, expected ErrRequest for duplicate user", err)
+	}
+	_, err = UserAdd(ctxbg, User{Name: "ro", Role: RoleReadOnly, UnixUser: "dom"}, "")
+	if !errors.Is(err, mox.ErrRequest) {
+		t.Fatalf("got err %v, expected ErrRequest for duplicate unix user", err)
+	}
+	_, err = UserAdd(ctxbg, User{Name: "ro", Role: RoleReadOnly}, "")
+	tcheck(t, err, "add user")
+
+	// Access.
+	if !u.DomainAllowed(dns.Domain{ASCII: "mox.example"}) || u.DomainAllowed(dns.Domain{ASCII: "other.example"}) {
+		t.Fatalf("bad domain access for domain admin")
+	}
+	if !u.AccountAllowed("mjl") || u.AccountAllowed("other") || u.AccountAllowed("bogus") {
+		t.Fatalf("bad account access for domain admin")
+	}
+	ro, err := UserGet(ctxbg, "ro")
+	tcheck(t, err, "get user")
+	if !ro.DomainAllowed(dns.Domain{ASCII: "other.example"}) || !ro.AccountAllowed("other") {
+		t.Fatalf("bad access for readonly admin")
+	}
+	if !RoleAdmin.Allowed(PermAdmin) || RoleReadOnly.Allowed(PermQueue) || !RoleQueue.Allowed(PermQueue) || RoleQueue.Allowed(PermDomainChange) || !RoleDomain.Allowed(PermDomainChange) || RoleDomain.Allowed(PermRead) || Role("").Allowed(PermSession) {
+		t.Fatalf("bad permissions for roles")
+	}
+
+	// Login.
+	_, ok, err := UserLogin(ctxbg, "dom", "test1234")
+	tcheck(t, err, "login")
+	if !ok {
+		t.Fatalf("login failed")
+	}
+	_, ok, err = UserLogin(ctxbg, "dom", "bad")
+	tcheck(t, err, "login")
+	if ok {
+		t.Fatalf("login succeeded with bad password")
+	}
+	_, ok, err = UserLogin(ctxbg, "ro", "")
+	tcheck(t, err, "login")
+	if ok {
+		t.Fatalf("login succeeded without password")
+	}
+	_, ok, err = UserLogin(ctxbg, "bogus", "test1234")
+	tcheck(t, err, "login")
+	if ok {
+		t.Fatalf("login succeeded for unknown user")
+	}
+
+	// TOTP.
+	secret := []byte("0123456789abcdefghij")
+	cur := totp.Counter(time.Now())
+	err = UserTOTPSet(ctxbg, "dom", secret, cur)
+	tcheck(t, err, "set totp")
+	ok, err = UserTOTPCheck(ctxbg, "dom", totp.Code(secret, cur))
+	tcheck(t, err, "check totp")
+	if ok {
+		t.Fatalf("totp code reused")
+	}
+	ok, err = UserTOTPCheck(ctxbg, "dom", totp.Code(secret, cur+1))
+	tcheck(t, err, "check totp")
+	if !ok {
+		t.Fatalf("totp code not accepted")
+	}
+
+	// Changes.
+	err = UserSave(ctxbg, User{Name: "dom", Role: RoleQueue, UnixUser: "dom2"})
+	tcheck(t, err, "save user")
+	u, err = UserByUnixUser(ctxbg, "dom2")
+	tcheck(t, err, "get by unix user")
+	if u.Role != RoleQueue || len(u.Domains) != 0 || u.TOTPSecret == nil || !u.HasPassword() {
+		t.Fatalf("unexpected user after save: %#v", u)
+	}
+	err = UserSetPassword(ctxbg, "dom", "")
+	tcheck(t, err, "clear password")
+	_, ok, err = UserLogin(ctxbg, "dom", "test1234")
+	tcheck(t, err, "login")
+	if ok {
+		t.Fatalf("login succeeded after clearing password")
+	}
+	err = UserSave(ctxbg, User{Name: "bogus", Role: RoleAdmin})
+	if err != ErrUnknownUser {
+		t.Fatalf("got err %v, expected ErrUnknownUser", err)
+	}
+
+	err = UserRemove(ctxbg, "dom")
+	tcheck(t, err, "remove user")
+	err = UserRemove(ctxbg, "dom")
+	if err != ErrUnknownUser {
+		t.Fatalf("got err %v, expected ErrUnknownUser", err)
+	}
+	l, err := UserList(ctxbg)
+	tcheck(t, err, "list users")
+	if len(l) != 1 || l[0].Name != "ro" {
+		t.Fatalf("unexpected users %v", l)
+	}
+}
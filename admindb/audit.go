@@ -0,0 +1,295 @@
+package admindb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/sconf"
+)
+
+// AuditSource is the interface through which a change was made.
+type AuditSource string
+
+const (
+	AuditSourceNone       AuditSource = ""           // Not through ctl or a web interface. In filters, matches all sources.
+	AuditSourceCtl        AuditSource = "ctl"        // Through the ctl socket, typically the "mox" command-line.
+	AuditSourceWebadmin   AuditSource = "webadmin"   // Through the admin web interface.
+	AuditSourceWebaccount AuditSource = "webaccount" // Through the account web interface.
+)
+
+// AuditKind is the type of change recorded in the audit log.
+type AuditKind string
+
+const (
+	AuditKindAny   AuditKind = ""          // Only for filters, matching all kinds.
+	AuditConfig    AuditKind = "config"    // Change to the dynamic configuration file domains.conf, with a diff.
+	AuditQueue     AuditKind = "queue"     // Operation on the queues, e.g. dropping messages or changing hold rules.
+	AuditPassword  AuditKind = "password"  // Password change of an account or admin user.
+	AuditAdminUser AuditKind = "adminuser" // Admin user added, changed or removed.
+)
+
+// AuditActor describes who makes a change. It is added to the context by the
+// ctl socket and web interfaces, and recorded with audit log entries.
+type AuditActor struct {
+	Source AuditSource
+
+	// For webadmin, the admin user, empty for the admin password. For webaccount,
+	// the account. For ctl, the unix user connecting to the ctl socket, if known.
+	Name string
+
+	RemoteIP  string // For the web interfaces.
+	Operation string // API function or ctl command.
+}
+
+type auditActorCtxKey struct{}
+
+// ContextWithAuditActor returns a context with the actor, used for entries
+// added to the audit log for changes made with the context.
+func ContextWithAuditActor(ctx context.Context, a AuditActor) context.Context {
+	return context.WithValue(ctx, auditActorCtxKey{}, a)
+}
+
+func auditActor(ctx context.Context) AuditActor {
+	a, _ := ctx.Value(auditActorCtxKey{}).(AuditActor)
+	return a
+}
+
+// AuditEntry is a recorded change to the configuration, queues or passwords.
+type AuditEntry struct {
+	ID        int64
+	Time      time.Time   `bstore:"default now,index"`
+	Source    AuditSource `bstore:"index"`
+	Actor     string      `bstore:"index"`
+	RemoteIP  string
+	Operation string
+	Kind      AuditKind `bstore:"index"`
+	Details   string    // Human-readable description, e.g. the filter for queue operations.
+
+	// For config changes, the changed lines of domains.conf, prefixed with "-" for
+	// removed and "+" for added lines, with some unchanged lines (prefixed with a
+	// space) for context.
+	Diff string
+}
+
+// AuditAdd adds an entry to the audit log, with the actor from the context.
+// Failure to add an entry is logged, not returned: the change has already
+// been made.
+func AuditAdd(ctx context.Context, log mlog.Log, kind AuditKind, details string) {
+	auditAdd(ctx, log, kind, details, "")
+}
+
+func auditAdd(ctx context.Context, log mlog.Log, kind AuditKind, details, diff string) {
+	if DB == nil {
+		// Not initialized, e.g. in tests of other packages.
+		return
+	}
+	err := DB.Write(ctx, func(tx *bstore.Tx) error {
+		return auditInsert(ctx, tx, kind, details, diff)
+	})
+	log.Check(err, "adding audit log entry", slog.Any("kind", kind), slog.String("details", details))
+}
+
+// auditInsert adds an entry to the audit log in an existing transaction.
+func auditInsert(ctx context.Context, tx *bstore.Tx, kind AuditKind, details, diff string) error {
+	a := auditActor(ctx)
+	e := AuditEntry{
+		Source:    a.Source,
+		Actor:     a.Name,
+		RemoteIP:  a.RemoteIP,
+		Operation: a.Operation,
+		Kind:      kind,
+		Details:   details,
+		Diff:      diff,
+	}
+	return tx.Insert(&e)
+}
+
+// AuditFilter selects entries from the audit log. Zero values match all
+// entries.
+type AuditFilter struct {
+	Max       int // Maximum number of entries to return, for listing the newest first.
+	Source    AuditSource
+	Actor     string
+	Kind      AuditKind
+	Operation string
+	Start     *time.Time // Inclusive.
+	End       *time.Time // Exclusive.
+	Text      string     // Case-insensitive substring of details or diff.
+}
+
+func (f AuditFilter) apply(q *bstore.Query[AuditEntry]) {
+	if f.Source != "" || f.Actor != "" || f.Kind != "" || f.Operation != "" {
+		q.FilterNonzero(AuditEntry{Source: f.Source, Actor: f.Actor, Kind: f.Kind, Operation: f.Operation})
+	}
+	if f.Start != nil {
+		q.FilterGreaterEqual("Time", *f.Start)
+	}
+	if f.End != nil {
+		q.FilterLess("Time", *f.End)
+	}
+	if f.Text != "" {
+		text := strings.ToLower(f.Text)
+		q.FilterFn(func(e AuditEntry) bool {
+			return strings.Contains(strings.ToLower(e.Details), text) || strings.Contains(strings.ToLower(e.Diff), text)
+		})
+	}
+}
+
+// AuditList returns entries from the audit log matching the filter, newest
+// first.
+func AuditList(ctx context.Context, f AuditFilter) ([]AuditEntry, error) {
+	q := bstore.QueryDB[AuditEntry](ctx, DB)
+	f.apply(q)
+	q.SortDesc("ID")
+	if f.Max > 0 {
+		q.Limit(f.Max)
+	}
+	return q.List()
+}
+
+// AuditExport writes entries from the audit log matching the filter as JSON
+// lines, oldest first. Field Max of the filter is ignored.
+func AuditExport(ctx context.Context, w io.Writer, f AuditFilter) error {
+	q := bstore.QueryDB[AuditEntry](ctx, DB)
+	f.apply(q)
+	q.SortAsc("ID")
+	enc := json.NewEncoder(w)
+	return q.ForEach(func(e AuditEntry) error {
+		return enc.Encode(e)
+	})
+}
+
+func init() {
+	mox.AuditConfigChange = func(ctx context.Context, log mlog.Log, before, after config.Dynamic) {
+		diff, err := configDiff(before, after)
+		if err != nil {
+			log.Errorx("generating diff of config change for audit log", err)
+			diff = fmt.Sprintf("(generating diff: %v)", err)
+		}
+		auditAdd(ctx, log, AuditConfig, "", diff)
+	}
+}
+
+// configDiff returns the changed lines between the dynamic configs as written
+// to domains.conf.
+func configDiff(before, after config.Dynamic) (string, error) {
+	var ob, nb bytes.Buffer
+	if err := sconf.Write(&ob, before); err != nil {
+		return "", fmt.Errorf("writing old config: %v", err)
+	}
+	if err := sconf.Write(&nb, after); err != nil {
+		return "", fmt.Errorf("writing new config: %v", err)
+	}
+	olines := strings.Split(strings.TrimSuffix(ob.String(), "\n"), "\n")
+	nlines := strings.Split(strings.TrimSuffix(nb.String(), "\n"), "\n")
+	return lineDiff(olines, nlines, 3), nil
+}
+
+// lineDiff returns a diff between old and new, with up to ncontext unchanged
+// lines around each change. Skipped unchanged lines are indicated with "...".
+func lineDiff(old, new []string, ncontext int) string {
+	// Common prefix and suffix are unchanged, typically almost all of the file.
+	var pre, post int
+	for pre < len(old) && pre < len(new) && old[pre] == new[pre] {
+		pre++
+	}
+	for post < len(old)-pre && post < len(new)-pre && old[len(old)-1-post] == new[len(new)-1-post] {
+		post++
+	}
+	om := old[pre : len(old)-post]
+	nm := new[pre : len(new)-post]
+
+	type line struct {
+		op   byte // ' ', '-' or '+'.
+		text string
+	}
+	var lines []line
+	for _, s := range old[:pre] {
+		lines = append(lines, line{' ', s})
+	}
+
+	if len(om)*len(nm) > 1000*1000 {
+		// Too large for a longest common subsequence, show all as replaced.
+		for _, s := range om {
+			lines = append(lines, line{'-', s})
+		}
+		for _, s := range nm {
+			lines = append(lines, line{'+', s})
+		}
+	} else {
+		// Longest common subsequence of the remaining lines, lcs[i][j] is the length
+		// for om[i:] and nm[j:].
+		lcs := make([][]int32, len(om)+1)
+		for i := range lcs {
+			lcs[i] = make([]int32, len(nm)+1)
+		}
+		for i := len(om) - 1; i >= 0; i-- {
+			for j := len(nm) - 1; j >= 0; j-- {
+				if om[i] == nm[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else {
+					lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+				}
+			}
+		}
+		i, j := 0, 0
+		for i < len(om) || j < len(nm) {
+			if i < len(om) && j < len(nm) && om[i] == nm[j] {
+				lines = append(lines, line{' ', om[i]})
+				i++
+				j++
+			} else if j == len(nm) || i < len(om) && lcs[i+1][j] >= lcs[i][j+1] {
+				lines = append(lines, line{'-', om[i]})
+				i++
+			} else {
+				lines = append(lines, line{'+', nm[j]})
+				j++
+			}
+		}
+	}
+
+	for _, s := range old[len(old)-post:] {
+		lines = append(lines, line{' ', s})
+	}
+
+	// Only keep unchanged lines near changes.
+	keep := make([]bool, len(lines))
+	for i, l := range lines {
+		if l.op == ' ' {
+			continue
+		}
+		for j := max(0, i-ncontext); j < min(len(lines), i+ncontext+1); j++ {
+			keep[j] = true
+		}
+	}
+	var b strings.Builder
+	skipped := false
+	for i, l := range lines {
+		if !keep[i] {
+			skipped = true
+			continue
+		}
+		if skipped {
+			b.WriteString("...\n")
+		}
+		skipped = false
+		b.WriteByte(l.op)
+		b.WriteString(l.text)
+		b.WriteByte('\n')
+	}
+	if skipped && b.Len() > 0 {
+		b.WriteString("...\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,122 @@
+package admindb
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+func TestLineDiff(t *testing.T) {
+	test := func(old, new, exp string) {
+		t.Helper()
+		diff := lineDiff(strings.Split(old, "\n"), strings.Split(new, "\n"), 1)
+		if diff != exp {
+			t.Fatalf("got diff:\n%s\nexpected:\n%s", diff, exp)
+		}
+	}
+
+	test("a\nb\nc", "a\nb\nc", "")
+	test("a\nb\nc\nd\ne", "a\nb\nx\nd\ne", "...\n b\n-c\n+x\n d\n...\n")
+	test("a\nb", "a\nb\nc", "...\n b\n+c\n")
+	test("a\nb\nc\nd\ne\nf\ng", "b\nc\nd\ne\nf\nx\ng", "-a\n b\n...\n f\n+x\n g\n")
+}
+
+func TestAuditLog(t *testing.T) {
+	mox.Shutdown = ctxbg
+	mox.ConfigStaticPath = filepath.FromSlash("../testdata/admindb/mox.conf")
+	mox.ConfigDynamicPath = filepath.Join(filepath.Dir(mox.ConfigStaticPath), "domains.conf")
+	mox.MustLoadConfig(true, false)
+	log := mlog.New("admindb", nil)
+
+	os.Remove(mox.DataDirPath("admin.db"))
+	err := Init()
+	tcheck(t, err, "init")
+	defer func() {
+		err := Close()
+		tcheck(t, err, "close")
+	}()
+
+	ctx := ContextWithAuditActor(ctxbg, AuditActor{Source: AuditSourceWebadmin, Name: "ro", RemoteIP: "127.0.0.1", Operation: "AdminUserAdd"})
+	_, err = UserAdd(ctx, User{Name: "ro", Role: RoleReadOnly}, "")
+	tcheck(t, err, "add user")
+	err = UserSetPassword(ctx, "ro", "test1234")
+	tcheck(t, err, "set password")
+
+	// Config change, as done by mox- after writing domains.conf.
+	before := mox.Conf.DynamicConfig()
+	after := before
+	after.Accounts = map[string]config.Account{}
+	for name, acc := range before.Accounts {
+		after.Accounts[name] = acc
+	}
+	acc := after.Accounts["mjl"]
+	acc.FullName = "Test User"
+	after.Accounts["mjl"] = acc
+	ctlctx := ContextWithAuditActor(ctxbg, AuditActor{Source: AuditSourceCtl, Name: "root", Operation: "accountsettings"})
+	mox.AuditConfigChange(ctlctx, log, before, after)
+
+	AuditAdd(ctxbg, log, AuditQueue, "3 messages dropped")
+
+	l, err := AuditList(ctxbg, AuditFilter{})
+	tcheck(t, err, "list")
+	if len(l) != 4 {
+		t.Fatalf("got %d entries, expected 4", len(l))
+	}
+	if e := l[3]; e.Source != AuditSourceWebadmin || e.Actor != "ro" || e.RemoteIP != "127.0.0.1" || e.Operation != "AdminUserAdd" || e.Kind != AuditAdminUser {
+		t.Fatalf("unexpected first entry %#v", e)
+	}
+	if e := l[2]; e.Kind != AuditPassword || strings.Contains(e.Details, "test1234") {
+		t.Fatalf("unexpected password entry %#v", e)
+	}
+	if e := l[1]; e.Kind != AuditConfig || !strings.Contains(e.Diff, "+\t\tFullName: Test User\n") {
+		t.Fatalf("unexpected config entry %#v", e)
+	}
+	if e := l[0]; e.Source != AuditSourceNone || e.Kind != AuditQueue {
+		t.Fatalf("unexpected queue entry %#v", e)
+	}
+
+	testList := func(f AuditFilter, expIDs ...int64) {
+		t.Helper()
+		l, err := AuditList(ctxbg, f)
+		tcheck(t, err, "list")
+		var ids []int64
+		for _, e := range l {
+			ids = append(ids, e.ID)
+		}
+		if len(ids) != len(expIDs) {
+			t.Fatalf("got ids %v, expected %v", ids, expIDs)
+		}
+		for i := range ids {
+			if ids[i] != expIDs[i] {
+				t.Fatalf("got ids %v, expected %v", ids, expIDs)
+			}
+		}
+	}
+	testList(AuditFilter{Max: 2}, 4, 3)
+	testList(AuditFilter{Source: AuditSourceWebadmin}, 2, 1)
+	testList(AuditFilter{Actor: "root"}, 3)
+	testList(AuditFilter{Kind: AuditPassword}, 2)
+	testList(AuditFilter{Operation: "accountsettings"}, 3)
+	testList(AuditFilter{Text: "test user"}, 3)
+	future := time.Now().Add(time.Hour)
+	testList(AuditFilter{Start: &future})
+	testList(AuditFilter{End: &future}, 4, 3, 2, 1)
+
+	var b bytes.Buffer
+	err = AuditExport(ctxbg, &b, AuditFilter{Max: 1, Kind: AuditAdminUser})
+	tcheck(t, err, "export")
+	var e AuditEntry
+	err = json.Unmarshal(b.Bytes(), &e)
+	tcheck(t, err, "parse exported entry")
+	if e.ID != 1 || strings.Count(b.String(), "\n") != 1 {
+		t.Fatalf("unexpected export %q", b.String())
+	}
+}
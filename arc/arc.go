@@ -0,0 +1,627 @@
+// Package arc (Authenticated Received Chain, RFC 8617) verifies and adds ARC
+// sets to messages.
+//
+// Mail servers that forward messages, e.g. for aliases or mailing lists, often
+// break DKIM signatures (by modifying the message) and SPF (by sending from
+// their own IP). DMARC evaluation of a forwarded message can then fail. With
+// ARC, each intermediary adds a set of headers: the authentication results as
+// they evaluated them when the message came in (ARC-Authentication-Results), a
+// DKIM-like signature over the message (ARC-Message-Signature), and a seal over
+// all ARC headers of the chain (ARC-Seal). A receiving mail server that trusts
+// an intermediary can use its recorded authentication results to override a
+// DMARC failure.
+//
+// Keys for ARC signatures are looked up through DKIM DNS records.
+package arc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	cryptorand "crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mjl-/mox/dkim"
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/message"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/moxio"
+	"github.com/mjl-/mox/stub"
+)
+
+var (
+	MetricVerify stub.HistogramVec = stub.HistogramVecIgnore{}
+	MetricSeal   stub.CounterVec   = stub.CounterVecIgnore{}
+)
+
+var timeNow = time.Now // Replaced during tests.
+
+// Status is the result of validating an ARC chain, also used for the chain
+// validation status ("cv") in an ARC-Seal.
+type Status string
+
+// ../rfc/8617:1133
+
+const (
+	StatusNone Status = "none" // No ARC sets in message.
+	StatusPass Status = "pass" // All ARC sets are valid.
+	StatusFail Status = "fail" // Chain is invalid, or was marked invalid by an intermediary.
+)
+
+// MaxInstance is the maximum number of ARC sets in a message. ../rfc/8617:400
+const MaxInstance = 50
+
+// Errors during verification and sealing.
+var (
+	ErrHeaderMalformed  = errors.New("arc: mail message header is malformed")
+	ErrStructure        = errors.New("arc: invalid chain structure")
+	ErrChainFailed      = errors.New("arc: chain marked as failed by intermediary")
+	ErrTooManySets      = errors.New("arc: too many arc sets")
+	ErrAlgorithm        = errors.New("arc: unsupported algorithm")
+	ErrKey              = errors.New("arc: unusable public key")
+	ErrSigVerify        = errors.New("arc: signature verification failed")
+	ErrBodyhashMismatch = errors.New("arc: body hash does not match")
+)
+
+// Set is the parsed form of the three ARC headers with the same instance.
+type Set struct {
+	Instance    int
+	AuthResults message.AuthResults // From ARC-Authentication-Results, Hostname is the authserv-id.
+	Signature   *MessageSignature
+	Seal        *SealHeader
+
+	aar, ams, as header // Raw headers.
+}
+
+// Result is the outcome of validating the ARC chain of a message.
+type Result struct {
+	Status Status
+	Sets   []Set // Ordered by instance, oldest first. Only set when the chain has a valid structure.
+
+	// Lowest instance for which the ARC-Message-Signature still validates, 0 if all
+	// validate. Only set for StatusPass. ../rfc/8617:1020
+	OldestPass int
+
+	Err error // If Status is StatusFail, the reason.
+}
+
+// Sealers returns the domains that sealed the chain, most recent first. Only
+// for a passing chain.
+func (r Result) Sealers() []dns.Domain {
+	if r.Status != StatusPass {
+		return nil
+	}
+	var l []dns.Domain
+	for i := len(r.Sets) - 1; i >= 0; i-- {
+		l = append(l, r.Sets[i].Seal.Domain)
+	}
+	return l
+}
+
+// Verify validates the ARC chain in the message. ../rfc/8617:970
+//
+// An error is only returned if the message header cannot be parsed. Otherwise
+// the result status is "none" for messages without ARC headers, "pass" for a
+// valid chain, and "fail" otherwise, with Err set.
+func Verify(ctx context.Context, elog *slog.Logger, resolver dns.Resolver, msg io.ReaderAt) (result Result, rerr error) {
+	log := mlog.New("arc", elog)
+	start := timeNow()
+	defer func() {
+		if rerr == nil {
+			MetricVerify.ObserveLabels(float64(time.Since(start))/float64(time.Second), string(result.Status))
+		}
+		log.Debugx("arc verify result", rerr,
+			slog.Any("status", result.Status),
+			slog.Int("sets", len(result.Sets)),
+			slog.Int("oldestpass", result.OldestPass),
+			slog.Any("err", result.Err),
+			slog.Duration("duration", time.Since(start)))
+	}()
+
+	hdrs, bodyOffset, err := parseHeaders(bufio.NewReader(&moxio.AtReader{R: msg}))
+	if err != nil {
+		return Result{}, fmt.Errorf("%w: %s", ErrHeaderMalformed, err)
+	}
+
+	fail := func(err error) (Result, error) {
+		return Result{Status: StatusFail, Err: err}, nil
+	}
+
+	sets, err := parseSets(hdrs)
+	if err != nil {
+		return fail(err)
+	} else if len(sets) == 0 {
+		return Result{Status: StatusNone}, nil
+	}
+
+	// If the most recent intermediary found the chain to be invalid, it is invalid.
+	// ../rfc/8617:990
+	n := len(sets)
+	if sets[n-1].Seal.ChainValidation == StatusFail {
+		return fail(ErrChainFailed)
+	}
+	for _, s := range sets {
+		if s.Instance == 1 && s.Seal.ChainValidation != StatusNone || s.Instance > 1 && s.Seal.ChainValidation != StatusPass {
+			return fail(fmt.Errorf("%w: chain validation %q for instance %d", ErrStructure, s.Seal.ChainValidation, s.Instance))
+		}
+	}
+
+	bodyHashes := map[string][]byte{}
+
+	// The most recent message signature must be valid. ../rfc/8617:1009
+	if err := verifyMessageSignature(ctx, log, resolver, sets[n-1], hdrs, msg, bodyOffset, bodyHashes); err != nil {
+		return fail(err)
+	}
+
+	// Earlier message signatures only determine oldest-pass. ../rfc/8617:1020
+	var oldestPass int
+	for i := n - 2; i >= 0; i-- {
+		if err := verifyMessageSignature(ctx, log, resolver, sets[i], hdrs, msg, bodyOffset, bodyHashes); err != nil {
+			log.Debugx("earlier arc message signature does not validate", err, slog.Int("instance", sets[i].Instance))
+			oldestPass = sets[i].Instance + 1
+			break
+		}
+	}
+
+	// All seals must be valid. ../rfc/8617:1031
+	for i := n - 1; i >= 0; i-- {
+		if err := verifySeal(ctx, log, resolver, sets[:i+1]); err != nil {
+			return fail(err)
+		}
+	}
+
+	return Result{Status: StatusPass, Sets: sets, OldestPass: oldestPass}, nil
+}
+
+// parseSets parses the ARC headers into sets, ordered by instance, checking the
+// structure of the chain. ../rfc/8617:980
+func parseSets(hdrs []header) ([]Set, error) {
+	byInstance := map[int]*Set{}
+	get := func(i int) *Set {
+		s := byInstance[i]
+		if s == nil {
+			s = &Set{Instance: i}
+			byInstance[i] = s
+		}
+		return s
+	}
+	for _, h := range hdrs {
+		raw := strings.TrimSuffix(h.raw, "\r\n")
+		switch h.lkey {
+		case "arc-authentication-results":
+			i, ar, err := parseAuthResults(raw)
+			if err != nil {
+				return nil, fmt.Errorf("%w: parsing ARC-Authentication-Results: %v", ErrStructure, err)
+			}
+			s := get(i)
+			if s.aar.raw != "" {
+				return nil, fmt.Errorf("%w: multiple ARC-Authentication-Results for instance %d", ErrStructure, i)
+			}
+			s.AuthResults = ar
+			s.aar = h
+		case "arc-message-signature":
+			sig, _, err := parseMessageSignature(raw)
+			if err != nil {
+				return nil, fmt.Errorf("%w: parsing ARC-Message-Signature: %v", ErrStructure, err)
+			}
+			s := get(sig.Instance)
+			if s.Signature != nil {
+				return nil, fmt.Errorf("%w: multiple ARC-Message-Signature for instance %d", ErrStructure, sig.Instance)
+			}
+			s.Signature = sig
+			s.ams = h
+		case "arc-seal":
+			seal, _, err := parseSeal(raw)
+			if err != nil {
+				return nil, fmt.Errorf("%w: parsing ARC-Seal: %v", ErrStructure, err)
+			}
+			s := get(seal.Instance)
+			if s.Seal != nil {
+				return nil, fmt.Errorf("%w: multiple ARC-Seal for instance %d", ErrStructure, seal.Instance)
+			}
+			s.Seal = seal
+			s.as = h
+		}
+	}
+
+	sets := make([]Set, len(byInstance))
+	for i := range sets {
+		s, ok := byInstance[i+1]
+		if !ok {
+			return nil, fmt.Errorf("%w: missing instance %d", ErrStructure, i+1)
+		}
+		if s.aar.raw == "" || s.Signature == nil || s.Seal == nil {
+			return nil, fmt.Errorf("%w: incomplete arc set for instance %d", ErrStructure, i+1)
+		}
+		sets[i] = *s
+	}
+	return sets, nil
+}
+
+// checkAlgorithm returns the hash for an algorithm allowed for ARC. RFC 8617
+// only allows rsa-sha256. We also accept ed25519-sha256, like DKIM.
+func checkAlgorithm(sign, hash string) (crypto.Hash, error) {
+	if !strings.EqualFold(hash, "sha256") || !strings.EqualFold(sign, "rsa") && !strings.EqualFold(sign, "ed25519") {
+		return 0, fmt.Errorf("%w: %s-%s", ErrAlgorithm, sign, hash)
+	}
+	return crypto.SHA256, nil
+}
+
+// verifyKey looks up the public key for the selector and domain through DKIM
+// DNS records, and verifies the signature over the data hash.
+func verifyKey(ctx context.Context, log mlog.Log, resolver dns.Resolver, selector, domain dns.Domain, algSign string, hash crypto.Hash, dh, sig []byte) error {
+	_, record, _, _, err := dkim.Lookup(ctx, log.Logger, resolver, selector, domain)
+	if err != nil {
+		return fmt.Errorf("%w: looking up key: %v", ErrKey, err)
+	}
+	if !strings.EqualFold(record.Key, algSign) {
+		return fmt.Errorf("%w: dns record requires algorithm %q, signature has %q", ErrKey, record.Key, algSign)
+	}
+	if len(record.Hashes) > 0 && !slices.ContainsFunc(record.Hashes, func(h string) bool { return strings.EqualFold(h, "sha256") }) {
+		return fmt.Errorf("%w: dns record does not allow sha256", ErrKey)
+	}
+	if !record.ServiceAllowed("email") {
+		return fmt.Errorf("%w: dns record not allowed for email", ErrKey)
+	}
+
+	switch k := record.PublicKey.(type) {
+	case nil:
+		return fmt.Errorf("%w: key revoked", ErrKey)
+	case *rsa.PublicKey:
+		if k.N.BitLen() < 1024 {
+			return fmt.Errorf("%w: rsa key too weak", ErrKey)
+		}
+		if err := rsa.VerifyPKCS1v15(k, hash, dh, sig); err != nil {
+			return fmt.Errorf("%w: rsa verification: %s", ErrSigVerify, err)
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, dh, sig) {
+			return fmt.Errorf("%w: ed25519 verification", ErrSigVerify)
+		}
+	default:
+		return fmt.Errorf("%w: unrecognized key type %T", ErrKey, record.PublicKey)
+	}
+	return nil
+}
+
+// verifyMessageSignature verifies the ARC-Message-Signature of a set, including
+// its body hash. Body hashes are cached in bodyHashes, by canonicalization.
+func verifyMessageSignature(ctx context.Context, log mlog.Log, resolver dns.Resolver, s Set, hdrs []header, msg io.ReaderAt, bodyOffset int, bodyHashes map[string][]byte) error {
+	sig := s.Signature
+	hash, err := checkAlgorithm(sig.AlgorithmSign, sig.AlgorithmHash)
+	if err != nil {
+		return err
+	}
+	canonHeaderSimple, canonBodySimple, err := parseCanonicalization(sig.Canonicalization)
+	if err != nil {
+		return err
+	}
+	// The seal must not be signed in the message signature. ../rfc/8617:474
+	if slices.ContainsFunc(sig.SignedHeaders, func(h string) bool { return strings.EqualFold(h, "arc-seal") }) {
+		return fmt.Errorf("%w: ARC-Seal in signed headers of message signature", ErrStructure)
+	}
+
+	_, verifySig, err := parseMessageSignature(strings.TrimSuffix(s.ams.raw, "\r\n"))
+	if err != nil {
+		return fmt.Errorf("%w: parsing message signature: %v", ErrStructure, err)
+	}
+	dh, err := messageDataHash(hash.New(), canonHeaderSimple, sig.SignedHeaders, hdrs, verifySig)
+	if err != nil {
+		return err
+	}
+	if err := verifyKey(ctx, log, resolver, sig.Selector, sig.Domain, sig.AlgorithmSign, hash, dh, sig.Signature); err != nil {
+		return fmt.Errorf("message signature instance %d: %w", s.Instance, err)
+	}
+
+	key := fmt.Sprintf("%v", canonBodySimple)
+	bh, ok := bodyHashes[key]
+	if !ok {
+		br := bufio.NewReader(&moxio.AtReader{R: msg, Offset: int64(bodyOffset)})
+		bh, err = dkim.BodyHash(hash.New(), canonBodySimple, br)
+		if err != nil {
+			return fmt.Errorf("calculating body hash: %w", err)
+		}
+		bodyHashes[key] = bh
+	}
+	if !bytes.Equal(sig.BodyHash, bh) {
+		return fmt.Errorf("%w: instance %d", ErrBodyhashMismatch, s.Instance)
+	}
+	return nil
+}
+
+// verifySeal verifies the ARC-Seal of the last set, over all given sets.
+func verifySeal(ctx context.Context, log mlog.Log, resolver dns.Resolver, sets []Set) error {
+	s := sets[len(sets)-1]
+	hash, err := checkAlgorithm(s.Seal.AlgorithmSign, s.Seal.AlgorithmHash)
+	if err != nil {
+		return err
+	}
+	_, verifySeal, err := parseSeal(strings.TrimSuffix(s.as.raw, "\r\n"))
+	if err != nil {
+		return fmt.Errorf("%w: parsing seal: %v", ErrStructure, err)
+	}
+	var raws []string
+	for _, x := range sets[:len(sets)-1] {
+		raws = append(raws, x.aar.raw, x.ams.raw, x.as.raw)
+	}
+	raws = append(raws, s.aar.raw, s.ams.raw)
+	dh, err := sealDataHash(hash.New(), raws, verifySeal)
+	if err != nil {
+		return err
+	}
+	if err := verifyKey(ctx, log, resolver, s.Seal.Selector, s.Seal.Domain, s.Seal.AlgorithmSign, hash, dh, s.Seal.Signature); err != nil {
+		return fmt.Errorf("seal instance %d: %w", s.Instance, err)
+	}
+	return nil
+}
+
+// parseCanonicalization parses the header and body canonicalization, like DKIM.
+func parseCanonicalization(c string) (canonHeaderSimple, canonBodySimple bool, rerr error) {
+	h, b, ok := strings.Cut(strings.ToLower(c), "/")
+	if !ok {
+		b = "simple"
+	}
+	for i, v := range []string{h, b} {
+		switch v {
+		case "simple":
+			if i == 0 {
+				canonHeaderSimple = true
+			} else {
+				canonBodySimple = true
+			}
+		case "relaxed":
+		default:
+			return false, false, fmt.Errorf("%w: unknown canonicalization %q", ErrAlgorithm, c)
+		}
+	}
+	return
+}
+
+// messageDataHash calculates the data hash for an ARC-Message-Signature, like a
+// DKIM-Signature. verifySig is the message signature header with empty
+// signature, without trailing crlf.
+func messageDataHash(h hash.Hash, canonSimple bool, signedHeaders []string, hdrs []header, verifySig string) ([]byte, error) {
+	revHdrs := map[string][]header{}
+	for _, h := range hdrs {
+		revHdrs[h.lkey] = append([]header{h}, revHdrs[h.lkey]...)
+	}
+	for _, key := range signedHeaders {
+		lkey := strings.ToLower(key)
+		l := revHdrs[lkey]
+		if len(l) == 0 {
+			continue
+		}
+		revHdrs[lkey] = l[1:]
+		if canonSimple {
+			h.Write([]byte(l[0].raw))
+		} else {
+			ch, err := dkim.RelaxedCanonicalHeaderWithoutCRLF(l[0].raw)
+			if err != nil {
+				return nil, fmt.Errorf("%w: canonicalizing header: %v", ErrHeaderMalformed, err)
+			}
+			h.Write([]byte(ch + "\r\n"))
+		}
+	}
+	if canonSimple {
+		h.Write([]byte(verifySig))
+	} else {
+		ch, err := dkim.RelaxedCanonicalHeaderWithoutCRLF(verifySig)
+		if err != nil {
+			return nil, fmt.Errorf("%w: canonicalizing message signature: %v", ErrHeaderMalformed, err)
+		}
+		h.Write([]byte(ch))
+	}
+	return h.Sum(nil), nil
+}
+
+// sealDataHash calculates the data hash for an ARC-Seal over the ARC headers of
+// all sets, ordered by instance and within a set by ARC-Authentication-Results,
+// ARC-Message-Signature and ARC-Seal, always with relaxed canonicalization.
+// verifySeal is the seal being signed or verified with empty signature, without
+// trailing crlf. ../rfc/8617:649
+func sealDataHash(h hash.Hash, raws []string, verifySeal string) ([]byte, error) {
+	for _, raw := range raws {
+		ch, err := dkim.RelaxedCanonicalHeaderWithoutCRLF(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%w: canonicalizing arc header: %v", ErrHeaderMalformed, err)
+		}
+		h.Write([]byte(ch + "\r\n"))
+	}
+	ch, err := dkim.RelaxedCanonicalHeaderWithoutCRLF(verifySeal)
+	if err != nil {
+		return nil, fmt.Errorf("%w: canonicalizing seal: %v", ErrHeaderMalformed, err)
+	}
+	h.Write([]byte(ch))
+	return h.Sum(nil), nil
+}
+
+// Seal returns headers for a new ARC set for the message, to be prepended to the
+// message before forwarding it. ../rfc/8617:918
+//
+// The message signature and seal are made with the selector, which must have an
+// RSA key. The authentication results are those of the message when it came in,
+// the Hostname is used as authserv-id. Chain is the validation status of the
+// existing ARC chain in the message, from Verify when the message came in.
+//
+// Sealing fails with ErrChainFailed if the most recent existing seal has
+// marked the chain as failed, and with ErrTooManySets if the maximum number of
+// sets has been reached.
+func Seal(ctx context.Context, elog *slog.Logger, domain dns.Domain, selector dkim.Selector, authResults message.AuthResults, chain Status, msg io.ReaderAt) (headers string, rerr error) {
+	log := mlog.New("arc", elog)
+	start := timeNow()
+	defer func() {
+		log.Debugx("arc seal result", rerr,
+			slog.Any("domain", domain),
+			slog.Any("selector", selector.Domain),
+			slog.Any("chain", chain),
+			slog.Duration("duration", time.Since(start)))
+	}()
+
+	key, ok := selector.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return "", fmt.Errorf("%w: arc requires rsa key, selector %s has %T", ErrAlgorithm, selector.Domain, selector.PrivateKey)
+	}
+
+	hdrs, bodyOffset, err := parseHeaders(bufio.NewReader(&moxio.AtReader{R: msg}))
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrHeaderMalformed, err)
+	}
+
+	// Gather existing ARC headers. If the chain structure is broken, the chain must
+	// have failed validation, and we seal with cv=fail over the headers present.
+	var existing []string
+	cv := chain
+	sets, err := parseSets(hdrs)
+	if err != nil {
+		cv = StatusFail
+		var maxInstance int
+		for _, h := range hdrs {
+			switch h.lkey {
+			case "arc-authentication-results", "arc-message-signature", "arc-seal":
+				existing = append(existing, h.raw)
+				if i, _, err := parseAuthResults(strings.TrimSuffix(h.raw, "\r\n")); err == nil {
+					maxInstance = max(maxInstance, i)
+				}
+			}
+		}
+		if maxInstance == 0 {
+			return "", fmt.Errorf("%w: cannot determine instance: %v", ErrStructure, err)
+		}
+		sets = make([]Set, maxInstance)
+	} else {
+		for _, s := range sets {
+			existing = append(existing, s.aar.raw, s.ams.raw, s.as.raw)
+		}
+		if len(sets) > 0 && sets[len(sets)-1].Seal.ChainValidation == StatusFail {
+			return "", ErrChainFailed
+		}
+	}
+	instance := len(sets) + 1
+	if instance > MaxInstance {
+		return "", ErrTooManySets
+	}
+	if len(sets) == 0 {
+		cv = StatusNone
+	} else if cv != StatusPass {
+		cv = StatusFail
+	}
+
+	// ARC-Authentication-Results, with the instance before the authserv-id.
+	aar := "ARC-Authentication-Results: i=" + fmt.Sprint(instance) + ";" + strings.TrimPrefix(authResults.Header(), "Authentication-Results:")
+
+	// ARC-Message-Signature, like a DKIM-Signature but without the ARC headers.
+	sig := MessageSignature{
+		Instance:      instance,
+		AlgorithmSign: "rsa",
+		AlgorithmHash: "sha256",
+		Domain:        domain,
+		Selector:      selector.Domain,
+		SignTime:      timeNow().Unix(),
+	}
+	for _, h := range selector.Headers {
+		if !strings.HasPrefix(strings.ToLower(h), "arc-") {
+			sig.SignedHeaders = append(sig.SignedHeaders, h)
+		}
+	}
+	if len(sig.SignedHeaders) == 0 {
+		return "", fmt.Errorf("no headers to sign in selector %s", selector.Domain)
+	}
+	sig.Canonicalization = "simple/"
+	if selector.HeaderRelaxed {
+		sig.Canonicalization = "relaxed/"
+	}
+	if selector.BodyRelaxed {
+		sig.Canonicalization += "relaxed"
+	} else {
+		sig.Canonicalization += "simple"
+	}
+	br := bufio.NewReader(&moxio.AtReader{R: msg, Offset: int64(bodyOffset)})
+	sig.BodyHash, err = dkim.BodyHash(crypto.SHA256.New(), !selector.BodyRelaxed, br)
+	if err != nil {
+		return "", fmt.Errorf("calculating body hash: %w", err)
+	}
+	dh, err := messageDataHash(crypto.SHA256.New(), !selector.HeaderRelaxed, sig.SignedHeaders, hdrs, strings.TrimSuffix(sig.Header(), "\r\n"))
+	if err != nil {
+		return "", err
+	}
+	sig.Signature, err = key.Sign(cryptorand.Reader, dh, crypto.SHA256)
+	if err != nil {
+		return "", fmt.Errorf("signing message signature: %v", err)
+	}
+	ams := sig.Header()
+
+	// ARC-Seal over all ARC headers.
+	seal := SealHeader{
+		Instance:        instance,
+		AlgorithmSign:   "rsa",
+		AlgorithmHash:   "sha256",
+		ChainValidation: cv,
+		Domain:          domain,
+		Selector:        selector.Domain,
+		SignTime:        sig.SignTime,
+	}
+	raws := append(existing, aar, ams)
+	dh, err = sealDataHash(crypto.SHA256.New(), raws, strings.TrimSuffix(seal.Header(), "\r\n"))
+	if err != nil {
+		return "", err
+	}
+	seal.Signature, err = key.Sign(cryptorand.Reader, dh, crypto.SHA256)
+	if err != nil {
+		return "", fmt.Errorf("signing seal: %v", err)
+	}
+	MetricSeal.IncLabels(string(cv))
+
+	return seal.Header() + ams + aar, nil
+}
+
+// header is a single header in a message, possibly spanning multiple lines.
+type header struct {
+	lkey string // Key in lower-case.
+	raw  string // Full header including key and trailing crlf.
+}
+
+// parseHeaders returns the headers and the offset of the body.
+func parseHeaders(br *bufio.Reader) ([]header, int, error) {
+	var l []header
+	var o int
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, 0, err
+		}
+		o += len(line)
+		if !strings.HasSuffix(line, "\r\n") {
+			return nil, 0, fmt.Errorf("line without crlf")
+		}
+		if line == "\r\n" {
+			break
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(l) == 0 {
+				return nil, 0, fmt.Errorf("malformed message, starts with space/tab")
+			}
+			l[len(l)-1].raw += line
+			continue
+		}
+		k, _, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, 0, fmt.Errorf("malformed message, header without colon")
+		}
+		k = strings.TrimRight(k, " \t")
+		if k == "" {
+			return nil, 0, fmt.Errorf("empty header key")
+		}
+		l = append(l, header{strings.ToLower(k), line})
+	}
+	return l, o, nil
+}
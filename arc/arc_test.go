@@ -0,0 +1,233 @@
+package arc
+
+import (
+	"context"
+	"crypto/ed25519"
+	cryptorand "crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/mjl-/mox/dkim"
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/message"
+	"github.com/mjl-/mox/mlog"
+)
+
+var pkglog = mlog.New("arc", nil)
+
+var testMsg = strings.ReplaceAll(`From: <mjl@mox.example>
+To: <list@forward.example>
+Subject: test
+Date: Fri, 10 May 2024 10:00:00 +0200
+Message-ID: <test@mox.example>
+Content-Type: text/plain
+
+test
+`, "\n", "\r\n")
+
+func tcheck(t *testing.T, err error, msg string) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: %s", msg, err)
+	}
+}
+
+type sealer struct {
+	domain   dns.Domain
+	selector dkim.Selector
+}
+
+func newSealer(t *testing.T, resolver *dns.MockResolver, domain string) sealer {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(cryptorand.Reader, 1024)
+	tcheck(t, err, "generate key")
+	r := dkim.Record{
+		Version:   "DKIM1",
+		Key:       "rsa",
+		PublicKey: key.Public(),
+	}
+	txt, err := r.Record()
+	tcheck(t, err, "dkim record")
+	resolver.TXT["sel._domainkey."+domain+"."] = []string{txt}
+
+	return sealer{
+		dns.Domain{ASCII: domain},
+		dkim.Selector{
+			Hash:          "sha256",
+			PrivateKey:    key,
+			Headers:       []string{"From", "To", "Subject", "Date", "Message-ID", "Content-Type", "ARC-Seal"},
+			HeaderRelaxed: true,
+			BodyRelaxed:   true,
+			Domain:        dns.Domain{ASCII: "sel"},
+		},
+	}
+}
+
+func (s sealer) seal(t *testing.T, msg string, chain Status) string {
+	t.Helper()
+	ar := message.AuthResults{
+		Hostname: s.domain.ASCII,
+		Methods: []message.AuthMethod{
+			{Method: "spf", Result: "pass", Props: []message.AuthProp{message.MakeAuthProp("smtp", "mailfrom", "mox.example", false, "")}},
+		},
+	}
+	headers, err := Seal(context.Background(), pkglog.Logger, s.domain, s.selector, ar, chain, strings.NewReader(msg))
+	tcheck(t, err, "seal")
+	return headers + msg
+}
+
+func TestSealVerify(t *testing.T) {
+	resolver := dns.MockResolver{TXT: map[string][]string{}}
+	s1 := newSealer(t, &resolver, "forward.example")
+	s2 := newSealer(t, &resolver, "list.example")
+
+	verify := func(msg string, expStatus Status, expErr error) Result {
+		t.Helper()
+		result, err := Verify(context.Background(), pkglog.Logger, resolver, strings.NewReader(msg))
+		tcheck(t, err, "verify")
+		if result.Status != expStatus || (result.Err == nil) != (expErr == nil) || expErr != nil && !errors.Is(result.Err, expErr) {
+			t.Fatalf("verify: got status %q, err %v, expected %q, err %v", result.Status, result.Err, expStatus, expErr)
+		}
+		return result
+	}
+
+	// No ARC headers.
+	verify(testMsg, StatusNone, nil)
+
+	// Single set.
+	msg1 := s1.seal(t, testMsg, StatusNone)
+	result := verify(msg1, StatusPass, nil)
+	if len(result.Sets) != 1 || result.Sets[0].Seal.ChainValidation != StatusNone || result.Sets[0].AuthResults.Hostname != "forward.example" {
+		t.Fatalf("unexpected sets %#v", result.Sets)
+	}
+	if sealers := result.Sealers(); len(sealers) != 1 || sealers[0] != s1.domain {
+		t.Fatalf("unexpected sealers %v", sealers)
+	}
+
+	// A second intermediary that modifies a header we signed earlier.
+	msg1mod := strings.Replace(msg1, "Subject: test", "Subject: [list] test", 1)
+	msg2 := s2.seal(t, msg1mod, StatusPass)
+	result = verify(msg2, StatusPass, nil)
+	if len(result.Sets) != 2 || result.Sets[1].Seal.ChainValidation != StatusPass || result.OldestPass != 2 {
+		t.Fatalf("unexpected result, sets %d, oldest pass %d", len(result.Sets), result.OldestPass)
+	}
+	if sealers := result.Sealers(); len(sealers) != 2 || sealers[0] != s2.domain || sealers[1] != s1.domain {
+		t.Fatalf("unexpected sealers %v", sealers)
+	}
+
+	// Unmodified forward keeps oldest pass at 0.
+	result = verify(s2.seal(t, msg1, StatusPass), StatusPass, nil)
+	if result.OldestPass != 0 {
+		t.Fatalf("got oldest pass %d, expected 0", result.OldestPass)
+	}
+
+	// Modified body breaks the latest message signature.
+	verify(strings.Replace(msg2, "\r\ntest\r\n", "\r\nchanged\r\n", 1), StatusFail, ErrBodyhashMismatch)
+
+	// Modified arc headers break the seal.
+	verify(strings.Replace(msg2, "smtp.mailfrom=mox.example", "smtp.mailfrom=other.example", 1), StatusFail, ErrSigVerify)
+
+	// Removed header breaks the structure.
+	verify(strings.Replace(msg2, "ARC-Authentication-Results: i=1;", "X-Removed: i=1;", 1), StatusFail, ErrStructure)
+
+	// Instance 1 must have cv=none.
+	verify(strings.Replace(msg1, "cv=none", "cv=pass", 1), StatusFail, ErrStructure)
+
+	// Sealing a failed chain marks it as failed, after which it cannot be sealed again.
+	msgfail := s2.seal(t, msg1, StatusFail)
+	verify(msgfail, StatusFail, ErrChainFailed)
+	ar := message.AuthResults{Hostname: "forward.example"}
+	_, err := Seal(context.Background(), pkglog.Logger, s1.domain, s1.selector, ar, StatusFail, strings.NewReader(msgfail))
+	if !errors.Is(err, ErrChainFailed) {
+		t.Fatalf("seal of failed chain: got err %v, expected ErrChainFailed", err)
+	}
+
+	// Sealing a chain with broken structure seals with cv=fail.
+	broken := strings.Replace(msg1, "ARC-Seal: i=1;", "X-Removed: i=1;", 1)
+	msgbroken := s2.seal(t, broken, StatusPass)
+	if !strings.Contains(msgbroken, "cv=fail") {
+		t.Fatalf("expected cv=fail for broken chain")
+	}
+
+	// Missing key.
+	delete(resolver.TXT, "sel._domainkey.forward.example.")
+	verify(msg1, StatusFail, ErrKey)
+
+	// Ed25519 key cannot be used for sealing.
+	sel := s1.selector
+	sel.PrivateKey = ed25519.NewKeyFromSeed(make([]byte, 32))
+	_, err = Seal(context.Background(), pkglog.Logger, s1.domain, sel, ar, StatusNone, strings.NewReader(testMsg))
+	if !errors.Is(err, ErrAlgorithm) {
+		t.Fatalf("seal with ed25519 key: got err %v, expected ErrAlgorithm", err)
+	}
+}
+
+func TestParse(t *testing.T) {
+	sig := MessageSignature{
+		Instance:         3,
+		AlgorithmSign:    "rsa",
+		AlgorithmHash:    "sha256",
+		Signature:        []byte("signature"),
+		BodyHash:         []byte("bodyhash"),
+		Domain:           dns.Domain{ASCII: "mox.example"},
+		SignedHeaders:    []string{"From", "To", "Subject"},
+		Selector:         dns.Domain{ASCII: "sel"},
+		Canonicalization: "relaxed/simple",
+		SignTime:         1234,
+	}
+	nsig, _, err := parseMessageSignature(strings.TrimSuffix(sig.Header(), "\r\n"))
+	tcheck(t, err, "parse message signature")
+	if nsig.Header() != sig.Header() {
+		t.Fatalf("message signature roundtrip: got %q, expected %q", nsig.Header(), sig.Header())
+	}
+
+	seal := SealHeader{
+		Instance:        3,
+		AlgorithmSign:   "rsa",
+		AlgorithmHash:   "sha256",
+		Signature:       []byte("signature"),
+		ChainValidation: StatusPass,
+		Domain:          dns.Domain{ASCII: "mox.example"},
+		Selector:        dns.Domain{ASCII: "sel"},
+		SignTime:        -1,
+	}
+	nseal, verifySeal, err := parseSeal(strings.TrimSuffix(seal.Header(), "\r\n"))
+	tcheck(t, err, "parse seal")
+	if nseal.Header() != seal.Header() {
+		t.Fatalf("seal roundtrip: got %q, expected %q", nseal.Header(), seal.Header())
+	}
+	if !strings.HasSuffix(verifySeal, "b=") {
+		t.Fatalf("seal for verification still has signature: %q", verifySeal)
+	}
+
+	bad := []string{
+		"ARC-Seal: i=1; a=rsa-sha256; cv=none; d=mox.example; s=sel; b=",              // Missing signature.
+		"ARC-Seal: i=0; a=rsa-sha256; cv=none; d=mox.example; s=sel; b=YQ==",          // Bad instance.
+		"ARC-Seal: i=51; a=rsa-sha256; cv=none; d=mox.example; s=sel; b=YQ==",         // Bad instance.
+		"ARC-Seal: i=1; a=rsa-sha256; cv=bogus; d=mox.example; s=sel; b=YQ==",         // Bad cv.
+		"ARC-Seal: i=1; a=rsa-sha256; cv=none; d=mox.example; s=sel; h=From; b=YQ==",  // h= not allowed.
+		"ARC-Seal: i=1; i=1; a=rsa-sha256; cv=none; d=mox.example; s=sel; b=YQ==",     // Duplicate tag.
+		"ARC-Seal: i=1; a=rsa; cv=none; d=mox.example; s=sel; b=YQ==",                 // Bad algorithm.
+		"ARC-Seal: i=1; a=rsa-sha256; cv=none; d=mox.example; b=YQ==",                 // Missing selector.
+		"ARC-Seal: i=1; a=rsa-sha256; cv=none; d=mox.example; s=sel; t=x; b=YQ==",     // Bad time.
+		"ARC-Seal: i=1; a=rsa-sha256; cv=none; d=mox.example; s=sel; b=YQ==; ; t=1",   // Empty tag-spec.
+		"ARC-Message-Signature: i=1; a=rsa-sha256; cv=none; d=mox.example; s=sel; b=", // Wrong header.
+	}
+	for _, s := range bad {
+		if _, _, err := parseSeal(s); err == nil {
+			t.Fatalf("parse seal %q: expected error", s)
+		}
+	}
+
+	i, ar, err := parseAuthResults("ARC-Authentication-Results: i=2; mox.example; spf=pass smtp.mailfrom=mox.example")
+	tcheck(t, err, "parse arc auth results")
+	if i != 2 || ar.Hostname != "mox.example" || len(ar.Methods) != 1 || ar.Methods[0].Method != "spf" {
+		t.Fatalf("unexpected arc auth results, instance %d, %#v", i, ar)
+	}
+	if _, _, err := parseAuthResults("ARC-Authentication-Results: mox.example; spf=pass"); err == nil {
+		t.Fatalf("parse arc auth results without instance: expected error")
+	}
+}
@@ -0,0 +1,335 @@
+package arc
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/message"
+)
+
+// MessageSignature is an ARC-Message-Signature header. It is like a
+// DKIM-Signature header, but with an instance number instead of an agent
+// identifier, and without a version.
+//
+// String values must be compared case insensitively.
+type MessageSignature struct {
+	Instance         int        // Field "i", 1 to 50.
+	AlgorithmSign    string     // "rsa". Field "a".
+	AlgorithmHash    string     // "sha256". Field "a".
+	Signature        []byte     // Field "b".
+	BodyHash         []byte     // Field "bh".
+	Domain           dns.Domain // Field "d".
+	SignedHeaders    []string   // Duplicates are meaningful. Field "h".
+	Selector         dns.Domain // Field "s".
+	Canonicalization string     // Like DKIM, e.g. "relaxed/relaxed". Field "c".
+	SignTime         int64      // Unix epoch. -1 if unset. Field "t".
+}
+
+// SealHeader is an ARC-Seal header, signing the ARC headers of all instances up
+// to and including its own.
+type SealHeader struct {
+	Instance        int        // Field "i", 1 to 50.
+	AlgorithmSign   string     // "rsa". Field "a".
+	AlgorithmHash   string     // "sha256". Field "a".
+	Signature       []byte     // Field "b".
+	ChainValidation Status     // Validation status of the chain by the sealer when the message came in, for earlier instances. "none" for the first instance. Field "cv".
+	Domain          dns.Domain // Field "d".
+	Selector        dns.Domain // Field "s".
+	SignTime        int64      // Unix epoch. -1 if unset. Field "t".
+}
+
+// Algorithm returns an algorithm string for use in the "a" field, e.g. "rsa-sha256".
+func (s MessageSignature) Algorithm() string {
+	return s.AlgorithmSign + "-" + s.AlgorithmHash
+}
+
+// Algorithm returns an algorithm string for use in the "a" field, e.g. "rsa-sha256".
+func (s SealHeader) Algorithm() string {
+	return s.AlgorithmSign + "-" + s.AlgorithmHash
+}
+
+// Header returns the ARC-Message-Signature header in string form, including
+// field name and trailing \r\n.
+func (s MessageSignature) Header() string {
+	w := &message.HeaderWriter{}
+	w.Addf("", "ARC-Message-Signature: i=%d;", s.Instance)
+	w.Addf(" ", "a=%s;", s.Algorithm())
+	w.Addf(" ", "d=%s;", s.Domain.ASCII)
+	w.Addf(" ", "s=%s;", s.Selector.ASCII)
+	if s.Canonicalization != "" {
+		w.Addf(" ", "c=%s;", s.Canonicalization)
+	}
+	if s.SignTime >= 0 {
+		w.Addf(" ", "t=%d;", s.SignTime)
+	}
+	for i, v := range s.SignedHeaders {
+		sep := ""
+		if i == 0 {
+			v = "h=" + v
+			sep = " "
+		}
+		if i < len(s.SignedHeaders)-1 {
+			v += ":"
+		} else {
+			v += ";"
+		}
+		w.Addf(sep, "%s", v)
+	}
+	w.Addf(" ", "bh=%s;", base64.StdEncoding.EncodeToString(s.BodyHash))
+	w.Addf(" ", "b=")
+	if len(s.Signature) > 0 {
+		w.AddWrap([]byte(base64.StdEncoding.EncodeToString(s.Signature)))
+	}
+	w.Add("\r\n")
+	return w.String()
+}
+
+// Header returns the ARC-Seal header in string form, including field name and
+// trailing \r\n.
+func (s SealHeader) Header() string {
+	w := &message.HeaderWriter{}
+	w.Addf("", "ARC-Seal: i=%d;", s.Instance)
+	w.Addf(" ", "a=%s;", s.Algorithm())
+	w.Addf(" ", "cv=%s;", s.ChainValidation)
+	w.Addf(" ", "d=%s;", s.Domain.ASCII)
+	w.Addf(" ", "s=%s;", s.Selector.ASCII)
+	if s.SignTime >= 0 {
+		w.Addf(" ", "t=%d;", s.SignTime)
+	}
+	w.Addf(" ", "b=")
+	if len(s.Signature) > 0 {
+		w.AddWrap([]byte(base64.StdEncoding.EncodeToString(s.Signature)))
+	}
+	w.Add("\r\n")
+	return w.String()
+}
+
+var (
+	errTagSyntax     = errors.New("bad tag-list syntax")
+	errDuplicateTag  = errors.New("duplicate tag")
+	errMissingTag    = errors.New("missing required tag")
+	errBadInstance   = errors.New("instance must be a number from 1 to 50")
+	errBadAlgorithm  = errors.New("bad algorithm")
+	errBadBase64     = errors.New("bad base64")
+	errBadValidation = errors.New("unknown chain validation status")
+)
+
+// tag is a parsed tag=value pair in an ARC header. Start and end are the offsets
+// of the value in the header, used for removing the signature for verification.
+type tag struct {
+	name, value string
+	start, end  int
+}
+
+// parseTags parses the tag-list value of an ARC header. The raw header, without
+// trailing crlf, must start with name followed by a colon. ../rfc/6376:605
+func parseTags(raw, name string) (map[string]tag, error) {
+	k, _, ok := strings.Cut(raw, ":")
+	if !ok || !strings.EqualFold(strings.TrimRight(k, " \t"), name) {
+		return nil, fmt.Errorf("%w: not %s header", errTagSyntax, name)
+	}
+	o := len(k) + 1
+	tags := map[string]tag{}
+	for o < len(raw) {
+		n := strings.IndexByte(raw[o:], ';')
+		if n < 0 {
+			n = len(raw) - o
+		}
+		spec := raw[o : o+n]
+		if strings.TrimSpace(spec) == "" {
+			if o+n < len(raw) {
+				return nil, fmt.Errorf("%w: empty tag-spec", errTagSyntax)
+			}
+			break
+		}
+		tn, tv, ok := strings.Cut(spec, "=")
+		if !ok {
+			return nil, fmt.Errorf("%w: missing = in tag-spec", errTagSyntax)
+		}
+		tn = strings.ToLower(strings.TrimSpace(tn))
+		if tn == "" {
+			return nil, fmt.Errorf("%w: empty tag name", errTagSyntax)
+		}
+		if _, ok := tags[tn]; ok {
+			return nil, fmt.Errorf("%w: %q", errDuplicateTag, tn)
+		}
+		start := o + len(spec) - len(tv)
+		tags[tn] = tag{tn, strings.TrimSpace(tv), start, o + n}
+		o += n + 1
+	}
+	return tags, nil
+}
+
+// withoutSignature returns the raw header with the value of the "b" tag removed,
+// for use in calculating the data hash.
+func withoutSignature(raw string, tags map[string]tag) string {
+	b := tags["b"]
+	return raw[:b.start] + raw[b.end:]
+}
+
+func xtag(tags map[string]tag, name string) string {
+	t, ok := tags[name]
+	if !ok {
+		panic(fmt.Errorf("%w: %q", errMissingTag, name))
+	}
+	return t.value
+}
+
+func xinstance(tags map[string]tag) int {
+	v, err := strconv.Atoi(xtag(tags, "i"))
+	if err != nil || v < 1 || v > MaxInstance {
+		panic(errBadInstance)
+	}
+	return v
+}
+
+func xalgorithm(tags map[string]tag) (string, string) {
+	sign, hash, ok := strings.Cut(strings.ToLower(xtag(tags, "a")), "-")
+	if !ok || sign == "" || hash == "" {
+		panic(errBadAlgorithm)
+	}
+	return sign, hash
+}
+
+func xbase64(tags map[string]tag, name string) []byte {
+	s := strings.Map(func(c rune) rune {
+		if c == ' ' || c == '\t' || c == '\r' || c == '\n' {
+			return -1
+		}
+		return c
+	}, xtag(tags, name))
+	buf, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		panic(fmt.Errorf("%w: %s: %v", errBadBase64, name, err))
+	} else if len(buf) == 0 {
+		panic(fmt.Errorf("%w: empty %q", errMissingTag, name))
+	}
+	return buf
+}
+
+func xdomain(tags map[string]tag, name string) dns.Domain {
+	d, err := dns.ParseDomain(xtag(tags, name))
+	if err != nil {
+		panic(fmt.Errorf("parsing domain in %q: %w", name, err))
+	}
+	return d
+}
+
+func xtime(tags map[string]tag) int64 {
+	t, ok := tags["t"]
+	if !ok {
+		return -1
+	}
+	v, err := strconv.ParseInt(t.value, 10, 64)
+	if err != nil || v < 0 {
+		panic(fmt.Errorf("bad timestamp %q", t.value))
+	}
+	return v
+}
+
+func recoverParse(err *error) {
+	x := recover()
+	if x == nil {
+		return
+	}
+	xerr, ok := x.(error)
+	if !ok {
+		panic(x)
+	}
+	*err = xerr
+}
+
+// parseMessageSignature parses a raw ARC-Message-Signature header, without
+// trailing crlf. The header with empty signature is returned for verification.
+func parseMessageSignature(raw string) (sig *MessageSignature, verifySig string, rerr error) {
+	defer recoverParse(&rerr)
+
+	tags, err := parseTags(raw, "ARC-Message-Signature")
+	if err != nil {
+		return nil, "", err
+	}
+	sig = &MessageSignature{
+		Instance:         xinstance(tags),
+		Signature:        xbase64(tags, "b"),
+		BodyHash:         xbase64(tags, "bh"),
+		Domain:           xdomain(tags, "d"),
+		Selector:         xdomain(tags, "s"),
+		Canonicalization: "simple/simple",
+		SignTime:         xtime(tags),
+	}
+	sig.AlgorithmSign, sig.AlgorithmHash = xalgorithm(tags)
+	for _, h := range strings.Split(xtag(tags, "h"), ":") {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			panic(fmt.Errorf("%w: empty header name in h=", errTagSyntax))
+		}
+		sig.SignedHeaders = append(sig.SignedHeaders, h)
+	}
+	if c, ok := tags["c"]; ok {
+		sig.Canonicalization = c.value
+	}
+	return sig, withoutSignature(raw, tags), nil
+}
+
+// parseSeal parses a raw ARC-Seal header, without trailing crlf. The header with
+// empty signature is returned for verification.
+func parseSeal(raw string) (seal *SealHeader, verifySeal string, rerr error) {
+	defer recoverParse(&rerr)
+
+	tags, err := parseTags(raw, "ARC-Seal")
+	if err != nil {
+		return nil, "", err
+	}
+	// Header fields are not allowed in a seal. ../rfc/8617:541
+	if _, ok := tags["h"]; ok {
+		return nil, "", fmt.Errorf("%w: h= not allowed in ARC-Seal", errTagSyntax)
+	}
+	seal = &SealHeader{
+		Instance:        xinstance(tags),
+		Signature:       xbase64(tags, "b"),
+		ChainValidation: Status(strings.ToLower(xtag(tags, "cv"))),
+		Domain:          xdomain(tags, "d"),
+		Selector:        xdomain(tags, "s"),
+		SignTime:        xtime(tags),
+	}
+	seal.AlgorithmSign, seal.AlgorithmHash = xalgorithm(tags)
+	switch seal.ChainValidation {
+	case StatusNone, StatusPass, StatusFail:
+	default:
+		return nil, "", fmt.Errorf("%w: %q", errBadValidation, seal.ChainValidation)
+	}
+	return seal, withoutSignature(raw, tags), nil
+}
+
+// parseAuthResults parses a raw ARC-Authentication-Results header, without
+// trailing crlf, returning the instance and the authentication results.
+// ../rfc/8617:410
+func parseAuthResults(raw string) (instance int, ar message.AuthResults, rerr error) {
+	k, v, ok := strings.Cut(raw, ":")
+	if !ok || !strings.EqualFold(strings.TrimRight(k, " \t"), "ARC-Authentication-Results") {
+		return 0, ar, fmt.Errorf("%w: not ARC-Authentication-Results header", errTagSyntax)
+	}
+	iv, rest, ok := strings.Cut(v, ";")
+	if !ok {
+		return 0, ar, fmt.Errorf("%w: missing instance", errTagSyntax)
+	}
+	tn, tv, ok := strings.Cut(iv, "=")
+	if !ok || !strings.EqualFold(strings.TrimSpace(tn), "i") {
+		return 0, ar, fmt.Errorf("%w: missing instance", errTagSyntax)
+	}
+	instance, err := strconv.Atoi(strings.TrimSpace(tv))
+	if err != nil || instance < 1 || instance > MaxInstance {
+		return 0, ar, errBadInstance
+	}
+	// The authentication results are informational, we don't fail the chain if we
+	// cannot parse them.
+	ar, err = message.ParseAuthResults(rest + "\r\n")
+	if err != nil {
+		ar = message.AuthResults{}
+	}
+	return instance, ar, nil
+}
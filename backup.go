@@ -17,6 +17,7 @@ import (
 
 	"github.com/mjl-/bstore"
 
+	"github.com/mjl-/mox/admindb"
 	"github.com/mjl-/mox/dmarcdb"
 	"github.com/mjl-/mox/mox-"
 	"github.com/mjl-/mox/moxvar"
@@ -288,6 +289,7 @@ func backupctl(ctx context.Context, ctl *ctl) {
 	if err := os.WriteFile(filepath.Join(dstDataDir, "moxversion"), []byte(moxvar.Version), 0660); err != nil {
 		xerrx("writing moxversion", err)
 	}
+	backupDB(admindb.DB, "admin.db")
 	backupDB(dmarcdb.ReportsDB, "dmarcrpt.db")
 	backupDB(dmarcdb.EvalDB, "dmarceval.db")
 	backupDB(mtastsdb.DB, "mtasts.db")
@@ -347,6 +349,23 @@ func backupctl(ctx context.Context, ctl *ctl) {
 			}
 			return nil
 		})
+		if err == nil {
+			// Messages for mailing lists, held for moderation or pending for a digest.
+			err = bstore.QueryDB[queue.ListMsg](ctx, db).ForEach(func(m queue.ListMsg) error {
+				mp := filepath.Join("list", store.MessagePath(m.ID))
+				seen[mp] = struct{}{}
+				srcpath := filepath.Join(srcDataDir, "queue", mp)
+				dstpath := filepath.Join(dstDataDir, "queue", mp)
+				if linked, err := linkOrCopy(srcpath, dstpath); err != nil {
+					xerrx("linking/copying queue list message", err, slog.String("srcpath", srcpath), slog.String("dstpath", dstpath))
+				} else if linked {
+					nlinked++
+				} else {
+					ncopied++
+				}
+				return nil
+			})
+		}
 		if err != nil {
 			xerrx("processing queue messages (not backed up properly)", err, slog.Duration("duration", time.Since(tmMsgs)))
 		} else {
@@ -548,7 +567,7 @@ func backupctl(ctx context.Context, ctl *ctl) {
 		}
 
 		switch p {
-		case "dmarcrpt.db", "dmarceval.db", "mtasts.db", "tlsrpt.db", "tlsrptresult.db", "receivedid.key", "ctl":
+		case "admin.db", "dmarcrpt.db", "dmarceval.db", "mtasts.db", "tlsrpt.db", "tlsrptresult.db", "receivedid.key", "ctl":
 			// Already handled.
 			return nil
 		case "lastknownversion": // Optional file, not yet handled.
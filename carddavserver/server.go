@@ -0,0 +1,1075 @@
+// Package carddavserver implements a CardDAV server (RFC 6352), for synchronizing
+// the contacts in the address books of an account with phones and desktop
+// clients.
+//
+// Resources, relative to the configured path:
+//
+//   - / and /principal/, the principal for the authenticated account, with the
+//     address book home set.
+//   - /addressbooks/, the address book home, listing the address books.
+//   - /addressbooks/<name>/, an address book, with contacts as vCards.
+//   - /addressbooks/<name>/<contact>, a contact.
+//
+// Clients can discover the service through /.well-known/carddav (RFC 6764),
+// which is redirected to the configured path. Supported are PROPFIND, PROPPATCH,
+// (extended) MKCOL, GET, PUT and DELETE, and the REPORTs addressbook-multiget,
+// addressbook-query and sync-collection (RFC 6578). vCards are stored as
+// received, with the UID, FN and EMAIL properties also stored separately, e.g.
+// for completing recipient addresses in webmail.
+package carddavserver
+
+// todo: support param-filter in addressbook-query, currently ignored, matching more contacts than requested.
+// todo: remove old tombstones of contacts, and refuse old sync tokens.
+// todo: support address book sharing with other accounts.
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/metrics"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/store"
+	"github.com/mjl-/mox/webauth"
+)
+
+var pkglog = mlog.New("carddavserver", nil)
+
+var metricRequests = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mox_carddav_requests_total",
+		Help: "CardDAV HTTP requests by method and result.",
+	},
+	[]string{
+		"method", // propfind, report, get, put, etc.
+		"result", // ok, badauth, usererror, error
+	},
+)
+
+// Maximum size of XML request bodies.
+const maxRequestSize = 1024 * 1024
+
+func init() {
+	mox.NewCardDAVHandler = func(basePath string, isForwarded bool) http.Handler {
+		return NewServer(basePath, isForwarded)
+	}
+}
+
+// NewServer returns a new http.Handler for a CardDAV server. The handler expects
+// the path prefix to be stripped by the caller, i.e. the root is at "/". Path is
+// the configured path, used for absolute hrefs in responses.
+func NewServer(path string, isForwarded bool) http.Handler {
+	return server{path, isForwarded}
+}
+
+type server struct {
+	path        string // Path CardDAV is configured under, typically /carddav/.
+	isForwarded bool   // Whether incoming requests are reverse-proxied. Used for getting remote IPs for rate limiting.
+}
+
+type kind int
+
+const (
+	kindRoot kind = iota
+	kindPrincipal
+	kindHome
+	kindAddressBook
+	kindContact
+)
+
+// resource is a target of a request, or a resource in a response.
+type resource struct {
+	kind kind
+	ab   store.AddressBook // For kindAddressBook and kindContact.
+	c    store.Contact     // For kindContact.
+}
+
+// httpError is returned by request handlers for a non-success response.
+type httpError struct {
+	code int
+	msg  string
+	body string // Optional XML body, e.g. with a precondition.
+}
+
+func (e httpError) Error() string {
+	return fmt.Sprintf("%d - %s", e.code, e.msg)
+}
+
+func errorf(code int, format string, args ...any) httpError {
+	return httpError{code: code, msg: fmt.Sprintf(format, args...)}
+}
+
+// precondition returns an error for a failed precondition, with an XML body.
+func precondition(code int, name xml.Name, inner string) httpError {
+	return httpError{code, "precondition failed: " + name.Local, errorDocument(name, inner)}
+}
+
+// ServeHTTP implements http.Handler.
+func (s server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log := pkglog.WithContext(r.Context()) // Take cid from webserver.
+	method := strings.ToLower(r.Method)
+	log = log.With(slog.String("method", method), slog.String("path", r.URL.Path))
+
+	acc, ok := s.authenticate(log, w, r, method)
+	if !ok {
+		return
+	}
+	defer func() {
+		err := acc.Close()
+		log.Check(err, "closing account")
+	}()
+	log = log.With(slog.String("account", acc.Name))
+
+	result := "error"
+	defer func() {
+		metricRequests.WithLabelValues(method, result).Inc()
+	}()
+
+	var err error
+	func() {
+		defer func() {
+			x := recover()
+			if x == nil {
+				return
+			}
+			log.Error("unhandled panic in carddav request", slog.Any("x", x))
+			debug.PrintStack()
+			metrics.PanicInc(metrics.Carddavserver)
+			err = errors.New("unhandled error")
+		}()
+		err = s.serve(log, w, r, acc)
+	}()
+
+	var herr httpError
+	if err == nil {
+		result = "ok"
+		return
+	} else if errors.As(err, &herr) {
+		if herr.code >= 500 {
+			log.Errorx("carddav request", err)
+		} else {
+			result = "usererror"
+			log.Debugx("carddav request", err)
+		}
+	} else {
+		log.Errorx("carddav request", err)
+		herr = httpError{code: http.StatusInternalServerError, msg: "internal server error"}
+	}
+	if herr.body != "" {
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		w.WriteHeader(herr.code)
+		w.Write([]byte(herr.body))
+		return
+	}
+	http.Error(w, fmt.Sprintf("%d - %s - %s", herr.code, http.StatusText(herr.code), herr.msg), herr.code)
+}
+
+// authenticate checks the HTTP basic authentication credentials, returning an
+// open account on success. On failure, a response has been written.
+func (s server) authenticate(log mlog.Log, w http.ResponseWriter, r *http.Request, method string) (acc *store.Account, ok bool) {
+	email, password, aok := r.BasicAuth()
+	if !aok {
+		metricRequests.WithLabelValues(method, "badauth").Inc()
+		log.Debug("missing http basic authentication credentials")
+		w.Header().Set("WWW-Authenticate", `Basic realm="carddav"`)
+		http.Error(w, "401 - unauthorized - use http basic auth with email address as username", http.StatusUnauthorized)
+		return nil, false
+	}
+	log = log.With(slog.String("username", email))
+
+	t0 := time.Now()
+
+	// If remote IP/network resulted in too many authentication failures, refuse to serve.
+	remoteIP := webauth.RemoteIP(log, s.isForwarded, r)
+	if remoteIP == nil {
+		metricRequests.WithLabelValues(method, "error").Inc()
+		log.Debug("cannot find remote ip for rate limiter")
+		http.Error(w, "500 - internal server error - cannot find remote ip", http.StatusInternalServerError)
+		return nil, false
+	}
+	if !mox.LimiterFailedAuth.CanAdd(remoteIP, t0, 1) {
+		metrics.AuthenticationRatelimitedInc("carddav")
+		log.Debug("refusing connection due to many auth failures", slog.Any("remoteip", remoteIP))
+		http.Error(w, "429 - too many auth attempts", http.StatusTooManyRequests)
+		return nil, false
+	}
+
+	authResult := "error"
+	defer func() {
+		metrics.AuthenticationInc("carddav", "httpbasic", authResult)
+	}()
+
+	acc, err := store.OpenEmailAuth(log, email, password, "")
+	if err != nil {
+		mox.LimiterFailedAuth.Add(remoteIP, t0, 1)
+		if errors.Is(err, mox.ErrDomainNotFound) || errors.Is(err, mox.ErrAddressNotFound) || errors.Is(err, store.ErrUnknownCredentials) {
+			log.Debug("bad http basic authentication credentials")
+			metricRequests.WithLabelValues(method, "badauth").Inc()
+			authResult = "badcreds"
+			w.Header().Set("WWW-Authenticate", `Basic realm="carddav"`)
+			http.Error(w, "401 - unauthorized - use http basic auth with email address as username", http.StatusUnauthorized)
+			return nil, false
+		}
+		log.Errorx("open account", err)
+		metricRequests.WithLabelValues(method, "error").Inc()
+		http.Error(w, "500 - internal server error - error verifying credentials", http.StatusInternalServerError)
+		return nil, false
+	}
+	authResult = "ok"
+	mox.LimiterFailedAuth.Reset(remoteIP, t0)
+	return acc, true
+}
+
+// target is the parsed request path.
+type target struct {
+	kind        kind
+	addressBook string // For kindAddressBook and kindContact.
+	contact     string // For kindContact.
+}
+
+func parsePath(p string) (target, bool) {
+	p = strings.TrimPrefix(p, "/")
+	t := strings.Split(p, "/")
+	if len(t) > 1 && t[len(t)-1] == "" {
+		t = t[:len(t)-1]
+	}
+	switch {
+	case len(t) == 1 && t[0] == "":
+		return target{kind: kindRoot}, true
+	case len(t) == 1 && t[0] == "principal":
+		return target{kind: kindPrincipal}, true
+	case len(t) == 1 && t[0] == "addressbooks":
+		return target{kind: kindHome}, true
+	case len(t) == 2 && t[0] == "addressbooks" && t[1] != "":
+		return target{kind: kindAddressBook, addressBook: t[1]}, true
+	case len(t) == 3 && t[0] == "addressbooks" && t[1] != "" && t[2] != "" && !strings.HasSuffix(p, "/"):
+		return target{kindContact, t[1], t[2]}, true
+	}
+	return target{}, false
+}
+
+func (s server) serve(log mlog.Log, w http.ResponseWriter, r *http.Request, acc *store.Account) error {
+	tg, ok := parsePath(r.URL.Path)
+	if !ok {
+		return errorf(http.StatusNotFound, "no such resource")
+	}
+
+	switch r.Method {
+	case "OPTIONS":
+		// ../rfc/6352:440
+		w.Header().Set("DAV", "1, 3, extended-mkcol, addressbook")
+		w.Header().Set("Allow", "OPTIONS, GET, HEAD, PUT, DELETE, PROPFIND, PROPPATCH, MKCOL, REPORT")
+		w.WriteHeader(http.StatusOK)
+		return nil
+	case "PROPFIND":
+		return s.propfind(w, r, acc, tg)
+	case "PROPPATCH":
+		return s.proppatch(w, r, acc, tg)
+	case "MKCOL":
+		return s.mkcol(w, r, acc, tg)
+	case "REPORT":
+		return s.report(w, r, acc, tg)
+	case "GET", "HEAD":
+		return s.get(w, r, acc, tg)
+	case "PUT":
+		return s.put(w, r, acc, tg)
+	case "DELETE":
+		return s.delete(w, r, acc, tg)
+	}
+	return errorf(http.StatusMethodNotAllowed, "method not allowed")
+}
+
+// readXML parses an XML request body into v. If the body is empty and
+// allowEmpty is set, v is left unchanged.
+func readXML(r *http.Request, v any, allowEmpty bool) error {
+	buf, err := io.ReadAll(io.LimitReader(r.Body, maxRequestSize+1))
+	if err != nil {
+		return errorf(http.StatusBadRequest, "reading request body: %v", err)
+	}
+	if len(buf) > maxRequestSize {
+		return errorf(http.StatusRequestEntityTooLarge, "request body too large")
+	}
+	if len(strings.TrimSpace(string(buf))) == 0 {
+		if allowEmpty {
+			return nil
+		}
+		return errorf(http.StatusBadRequest, "missing request body")
+	}
+	if err := xml.Unmarshal(buf, v); err != nil {
+		return errorf(http.StatusBadRequest, "parsing xml request body: %v", err)
+	}
+	return nil
+}
+
+func writeMultistatus(w http.ResponseWriter, ms *multistatus, syncToken string) {
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	w.Write([]byte(ms.document(syncToken)))
+}
+
+// addressBookGet returns the address book for the target. The default address
+// book is created if the account does not have address books yet.
+func addressBookGet(tx *bstore.Tx, acc *store.Account, name string) (store.AddressBook, error) {
+	if _, err := store.AddressBookList(tx, acc); err != nil {
+		return store.AddressBook{}, err
+	}
+	ab, err := store.AddressBookGet(tx, name)
+	if err == store.ErrAddressBookUnknown {
+		return ab, errorf(http.StatusNotFound, "no such address book")
+	}
+	return ab, err
+}
+
+// href returns the absolute path for a resource.
+func (s server) href(res resource) string {
+	switch res.kind {
+	case kindRoot:
+		return s.path
+	case kindPrincipal:
+		return s.path + "principal/"
+	case kindHome:
+		return s.path + "addressbooks/"
+	case kindAddressBook:
+		return s.path + "addressbooks/" + url.PathEscape(res.ab.Name) + "/"
+	case kindContact:
+		return s.path + "addressbooks/" + url.PathEscape(res.ab.Name) + "/" + url.PathEscape(res.c.Name)
+	}
+	panic("missing case")
+}
+
+// syncToken returns the sync token for the current state of an address book.
+// Sync tokens must be URIs. ../rfc/6578:420
+func syncToken(ab store.AddressBook) string {
+	return fmt.Sprintf("urn:x-mox:carddav:sync:%d:%d", ab.ID, ab.ModSeq)
+}
+
+// parseSyncToken returns the modseq from a sync token for the address book.
+func parseSyncToken(ab store.AddressBook, token string) (store.ModSeq, bool) {
+	t := strings.Split(token, ":")
+	if len(t) != 6 || strings.Join(t[:4], ":") != "urn:x-mox:carddav:sync" || t[4] != fmt.Sprintf("%d", ab.ID) {
+		return 0, false
+	}
+	v, err := strconv.ParseInt(t[5], 10, 64)
+	if err != nil || v < 0 || store.ModSeq(v) > ab.ModSeq {
+		return 0, false
+	}
+	return store.ModSeq(v), true
+}
+
+func dav(local string) xml.Name {
+	return xml.Name{Space: nsDAV, Local: local}
+}
+
+func card(local string) xml.Name {
+	return xml.Name{Space: nsCardDAV, Local: local}
+}
+
+// allProps returns the names of properties returned for allprop and propname
+// requests for a resource.
+func allProps(k kind) []xml.Name {
+	l := []xml.Name{dav("resourcetype"), dav("displayname"), dav("current-user-principal")}
+	switch k {
+	case kindRoot:
+		l = append(l, card("addressbook-home-set"))
+	case kindPrincipal:
+		l = append(l, dav("principal-URL"), card("addressbook-home-set"))
+	case kindHome:
+		l = append(l, dav("owner"))
+	case kindAddressBook:
+		l = append(l, dav("owner"), dav("sync-token"), dav("supported-report-set"), dav("current-user-privilege-set"), card("addressbook-description"), card("supported-address-data"), card("max-resource-size"), xml.Name{Space: nsCS, Local: "getctag"})
+	case kindContact:
+		l = append(l, dav("getetag"), dav("getcontenttype"), dav("getcontentlength"), dav("getlastmodified"))
+	}
+	return l
+}
+
+// propValue returns the XML element for a property of a resource, or false if
+// the resource does not have the property.
+func (s server) propValue(acc *store.Account, res resource, name xml.Name) (string, bool) {
+	principal := "<d:href>" + xmlText(s.href(resource{kind: kindPrincipal})) + "</d:href>"
+	home := "<d:href>" + xmlText(s.href(resource{kind: kindHome})) + "</d:href>"
+
+	var v string
+	switch name {
+	case dav("resourcetype"):
+		switch res.kind {
+		case kindRoot, kindHome:
+			v = "<d:collection/>"
+		case kindPrincipal:
+			v = "<d:collection/><d:principal/>"
+		case kindAddressBook:
+			v = "<d:collection/><card:addressbook/>"
+		}
+	case dav("displayname"):
+		switch res.kind {
+		case kindRoot:
+			v = "mox"
+		case kindPrincipal:
+			v = xmlText(acc.Name)
+		case kindHome:
+			v = "Address books"
+		case kindAddressBook:
+			v = xmlText(res.ab.DisplayName)
+			if v == "" {
+				v = xmlText(res.ab.Name)
+			}
+		case kindContact:
+			v = xmlText(res.c.FormattedName)
+		}
+	case dav("current-user-principal"):
+		// ../rfc/5397:95
+		v = principal
+	case dav("principal-URL"):
+		if res.kind != kindPrincipal {
+			return "", false
+		}
+		v = principal
+	case dav("owner"):
+		if res.kind != kindHome && res.kind != kindAddressBook {
+			return "", false
+		}
+		v = principal
+	case card("addressbook-home-set"):
+		// ../rfc/6352:1961
+		if res.kind != kindRoot && res.kind != kindPrincipal {
+			return "", false
+		}
+		v = home
+	case dav("sync-token"), xml.Name{Space: nsCS, Local: "getctag"}:
+		if res.kind != kindAddressBook {
+			return "", false
+		}
+		if name.Local == "getctag" {
+			v = fmt.Sprintf("%d", res.ab.ModSeq)
+		} else {
+			v = xmlText(syncToken(res.ab))
+		}
+	case dav("supported-report-set"):
+		// ../rfc/3253:1386
+		if res.kind != kindAddressBook {
+			return "", false
+		}
+		for _, r := range []string{"<card:addressbook-multiget/>", "<card:addressbook-query/>", "<d:sync-collection/>"} {
+			v += "<d:supported-report><d:report>" + r + "</d:report></d:supported-report>"
+		}
+	case dav("current-user-privilege-set"):
+		// ../rfc/3744:1156
+		if res.kind != kindAddressBook && res.kind != kindHome {
+			return "", false
+		}
+		for _, p := range []string{"read", "write", "write-properties", "write-content", "bind", "unbind", "read-current-user-privilege-set"} {
+			v += "<d:privilege><d:" + p + "/></d:privilege>"
+		}
+	case card("addressbook-description"):
+		if res.kind != kindAddressBook {
+			return "", false
+		}
+		v = xmlText(res.ab.Description)
+	case card("supported-address-data"):
+		// We store vCards as is, so support all versions that clients send. ../rfc/6352:1076
+		if res.kind != kindAddressBook {
+			return "", false
+		}
+		v = `<card:address-data-type content-type="text/vcard" version="3.0"/><card:address-data-type content-type="text/vcard" version="4.0"/>`
+	case card("max-resource-size"):
+		if res.kind != kindAddressBook {
+			return "", false
+		}
+		v = fmt.Sprintf("%d", store.ContactMaxSize)
+	case dav("getetag"):
+		if res.kind != kindContact {
+			return "", false
+		}
+		v = xmlText(res.c.ETag())
+	case dav("getcontenttype"):
+		if res.kind != kindContact {
+			return "", false
+		}
+		v = "text/vcard; charset=utf-8"
+	case dav("getcontentlength"):
+		if res.kind != kindContact {
+			return "", false
+		}
+		v = fmt.Sprintf("%d", len(res.c.VCard))
+	case dav("getlastmodified"):
+		if res.kind != kindContact {
+			return "", false
+		}
+		v = res.c.Updated.UTC().Format(http.TimeFormat)
+	case card("address-data"):
+		// ../rfc/6352:1262
+		if res.kind != kindContact {
+			return "", false
+		}
+		v = xmlText(res.c.VCard)
+	default:
+		return "", false
+	}
+	return elemString(name, v), true
+}
+
+// addResponse adds a response for a resource with the requested properties. If
+// props is nil, all properties are returned. If nameOnly is set, only the names
+// of properties are returned.
+func (s server) addResponse(ms *multistatus, acc *store.Account, res resource, props []xml.Name, nameOnly bool) {
+	if props == nil {
+		props = allProps(res.kind)
+	}
+	var found []string
+	var missing []xml.Name
+	for _, name := range props {
+		if v, ok := s.propValue(acc, res, name); !ok {
+			missing = append(missing, name)
+		} else if nameOnly {
+			found = append(found, elemString(name, ""))
+		} else {
+			found = append(found, v)
+		}
+	}
+	ms.response(s.href(res), propstat{"200 OK", found}, propstat{"404 Not Found", names(missing)})
+}
+
+func propNameList(p *propNames) []xml.Name {
+	l := []xml.Name{}
+	for _, e := range p.Names {
+		l = append(l, e.XMLName)
+	}
+	return l
+}
+
+func (s server) propfind(w http.ResponseWriter, r *http.Request, acc *store.Account, tg target) error {
+	// ../rfc/4918:1917
+	var pf propfind
+	if err := readXML(r, &pf, true); err != nil {
+		return err
+	}
+	var props []xml.Name // Nil means all.
+	if pf.Prop != nil {
+		props = propNameList(pf.Prop)
+	}
+	nameOnly := pf.PropName != nil
+
+	// We treat depth infinity like depth 1, the hierarchy is shallow.
+	depth := r.Header.Get("Depth")
+	children := depth != "0"
+
+	var ms multistatus
+	err := acc.DB.Write(r.Context(), func(tx *bstore.Tx) error {
+		abs, err := store.AddressBookList(tx, acc)
+		if err != nil {
+			return err
+		}
+
+		switch tg.kind {
+		case kindRoot:
+			s.addResponse(&ms, acc, resource{kind: kindRoot}, props, nameOnly)
+			if children {
+				s.addResponse(&ms, acc, resource{kind: kindPrincipal}, props, nameOnly)
+				s.addResponse(&ms, acc, resource{kind: kindHome}, props, nameOnly)
+			}
+		case kindPrincipal:
+			s.addResponse(&ms, acc, resource{kind: kindPrincipal}, props, nameOnly)
+		case kindHome:
+			s.addResponse(&ms, acc, resource{kind: kindHome}, props, nameOnly)
+			if children {
+				for _, ab := range abs {
+					s.addResponse(&ms, acc, resource{kind: kindAddressBook, ab: ab}, props, nameOnly)
+				}
+			}
+		case kindAddressBook, kindContact:
+			ab, err := addressBookGet(tx, acc, tg.addressBook)
+			if err != nil {
+				return err
+			}
+			if tg.kind == kindContact {
+				c, err := store.ContactGet(tx, ab.ID, tg.contact)
+				if err == store.ErrContactUnknown {
+					return errorf(http.StatusNotFound, "no such contact")
+				} else if err != nil {
+					return err
+				}
+				s.addResponse(&ms, acc, resource{kindContact, ab, c}, props, nameOnly)
+				break
+			}
+			s.addResponse(&ms, acc, resource{kind: kindAddressBook, ab: ab}, props, nameOnly)
+			if children {
+				contacts, err := store.ContactList(tx, ab.ID)
+				if err != nil {
+					return err
+				}
+				for _, c := range contacts {
+					s.addResponse(&ms, acc, resource{kindContact, ab, c}, props, nameOnly)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	writeMultistatus(w, &ms, "")
+	return nil
+}
+
+// addressBookProps applies properties from PROPPATCH or MKCOL to an address
+// book. Properties that cannot be changed are returned.
+func addressBookProps(ab *store.AddressBook, set []propSet, remove []propSet) (applied, forbidden []xml.Name) {
+	for _, ps := range set {
+		for _, p := range ps.Prop.Props {
+			switch p.XMLName {
+			case dav("displayname"):
+				ab.DisplayName = p.Value
+			case card("addressbook-description"):
+				ab.Description = p.Value
+			case dav("resourcetype"):
+				// Set during extended MKCOL, we only create address books.
+			default:
+				forbidden = append(forbidden, p.XMLName)
+				continue
+			}
+			applied = append(applied, p.XMLName)
+		}
+	}
+	for _, ps := range remove {
+		for _, p := range ps.Prop.Props {
+			switch p.XMLName {
+			case dav("displayname"):
+				ab.DisplayName = ""
+			case card("addressbook-description"):
+				ab.Description = ""
+			default:
+				forbidden = append(forbidden, p.XMLName)
+				continue
+			}
+			applied = append(applied, p.XMLName)
+		}
+	}
+	return
+}
+
+func (s server) proppatch(w http.ResponseWriter, r *http.Request, acc *store.Account, tg target) error {
+	// ../rfc/4918:2031
+	if tg.kind != kindAddressBook {
+		return errorf(http.StatusForbidden, "properties can only be changed for address books")
+	}
+	var pu propertyupdate
+	if err := readXML(r, &pu, false); err != nil {
+		return err
+	}
+
+	var ms multistatus
+	err := acc.DB.Write(r.Context(), func(tx *bstore.Tx) error {
+		ab, err := addressBookGet(tx, acc, tg.addressBook)
+		if err != nil {
+			return err
+		}
+		applied, forbidden := addressBookProps(&ab, pu.Set, pu.Remove)
+		// Instructions are applied atomically. ../rfc/4918:2048
+		if len(forbidden) > 0 {
+			ms.response(s.href(resource{kind: kindAddressBook, ab: ab}), propstat{"403 Forbidden", names(forbidden)}, propstat{"424 Failed Dependency", names(applied)})
+			return nil
+		}
+		if err := store.AddressBookUpdate(tx, acc, &ab); err != nil {
+			return err
+		}
+		ms.response(s.href(resource{kind: kindAddressBook, ab: ab}), propstat{"200 OK", names(applied)})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	writeMultistatus(w, &ms, "")
+	return nil
+}
+
+func (s server) mkcol(w http.ResponseWriter, r *http.Request, acc *store.Account, tg target) error {
+	// ../rfc/6352:698 ../rfc/5689:155
+	if tg.kind != kindAddressBook {
+		return errorf(http.StatusForbidden, "address books can only be created in the address book home")
+	}
+	if err := store.CheckAddressBookName(tg.addressBook); err != nil {
+		return errorf(http.StatusForbidden, "%v", err)
+	}
+	var mc mkcol
+	if err := readXML(r, &mc, true); err != nil {
+		return err
+	}
+	err := acc.DB.Write(r.Context(), func(tx *bstore.Tx) error {
+		if _, err := store.AddressBookList(tx, acc); err != nil {
+			return err
+		}
+		var ab store.AddressBook
+		_, forbidden := addressBookProps(&ab, mc.Set, nil)
+		if len(forbidden) > 0 {
+			return errorf(http.StatusForbidden, "cannot set property %s %s", forbidden[0].Space, forbidden[0].Local)
+		}
+		_, err := store.AddressBookCreate(tx, acc, tg.addressBook, ab.DisplayName, ab.Description)
+		if err == store.ErrAddressBookExists {
+			// ../rfc/4918:2164
+			return errorf(http.StatusMethodNotAllowed, "address book already exists")
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+// matchFilter returns whether a vCard matches an addressbook-query filter.
+// ../rfc/6352:1535
+func matchFilter(vc *store.VCard, f *filter) bool {
+	if f == nil || len(f.PropFilters) == 0 {
+		return true
+	}
+	allOf := f.Test == "allof"
+	for _, pf := range f.PropFilters {
+		m := matchPropFilter(vc, pf)
+		if allOf && !m {
+			return false
+		} else if !allOf && m {
+			return true
+		}
+	}
+	return allOf
+}
+
+func matchPropFilter(vc *store.VCard, pf propFilter) bool {
+	values := vc.Values(strings.ToUpper(pf.Name))
+	if pf.IsNotDefined != nil {
+		return len(values) == 0
+	}
+	if len(pf.TextMatches) == 0 {
+		return len(values) > 0
+	}
+	allOf := pf.Test == "allof"
+	for _, tm := range pf.TextMatches {
+		var m bool
+		for _, v := range values {
+			if matchText(v, tm) {
+				m = true
+				break
+			}
+		}
+		if allOf && !m {
+			return false
+		} else if !allOf && m {
+			return true
+		}
+	}
+	return allOf
+}
+
+// matchText returns whether a text matches. ../rfc/6352:1668
+func matchText(v string, tm textMatch) bool {
+	text := tm.Text
+	if tm.Collation != "i;octet" {
+		v = strings.ToLower(v)
+		text = strings.ToLower(text)
+	}
+	var m bool
+	switch tm.MatchType {
+	case "equals":
+		m = v == text
+	case "starts-with":
+		m = strings.HasPrefix(v, text)
+	case "ends-with":
+		m = strings.HasSuffix(v, text)
+	default:
+		m = strings.Contains(v, text)
+	}
+	if tm.NegateCondition == "yes" {
+		m = !m
+	}
+	return m
+}
+
+func (s server) report(w http.ResponseWriter, r *http.Request, acc *store.Account, tg target) error {
+	if tg.kind != kindAddressBook {
+		return errorf(http.StatusForbidden, "reports only supported on address books")
+	}
+	var rep report
+	if err := readXML(r, &rep, false); err != nil {
+		return err
+	}
+	var props []xml.Name
+	if rep.Prop != nil && rep.AllProp == nil {
+		props = propNameList(rep.Prop)
+	}
+
+	var ms multistatus
+	var token string
+	err := acc.DB.Read(r.Context(), func(tx *bstore.Tx) error {
+		ab, err := store.AddressBookGet(tx, tg.addressBook)
+		if err == store.ErrAddressBookUnknown {
+			return errorf(http.StatusNotFound, "no such address book")
+		} else if err != nil {
+			return err
+		}
+
+		switch rep.XMLName {
+		case card("addressbook-multiget"):
+			// ../rfc/6352:1402
+			for _, href := range rep.Hrefs {
+				var name string
+				if u, err := url.Parse(strings.TrimSpace(href)); err == nil {
+					name, _ = strings.CutPrefix(u.Path, s.href(resource{kind: kindAddressBook, ab: ab}))
+				}
+				if name == "" || strings.Contains(name, "/") {
+					ms.status(href, "404 Not Found")
+					continue
+				}
+				c, err := store.ContactGet(tx, ab.ID, name)
+				if err == store.ErrContactUnknown {
+					ms.status(href, "404 Not Found")
+					continue
+				} else if err != nil {
+					return err
+				}
+				s.addResponse(&ms, acc, resource{kindContact, ab, c}, props, false)
+			}
+
+		case card("addressbook-query"):
+			// ../rfc/6352:1173
+			for _, pf := range rep.Filter.PropFiltersOrNil() {
+				if pf.Name == "" {
+					return precondition(http.StatusForbidden, card("supported-filter"), "")
+				}
+			}
+			contacts, err := store.ContactList(tx, ab.ID)
+			if err != nil {
+				return err
+			}
+			var n int
+			for _, c := range contacts {
+				vc, err := store.ParseVCard(c.VCard)
+				if err != nil || !matchFilter(vc, rep.Filter) {
+					continue
+				}
+				if rep.Limit != nil && rep.Limit.NResults > 0 && n >= rep.Limit.NResults {
+					// ../rfc/6352:1302
+					ms.status(s.href(resource{kind: kindAddressBook, ab: ab}), "507 Insufficient Storage")
+					break
+				}
+				n++
+				s.addResponse(&ms, acc, resource{kindContact, ab, c}, props, false)
+			}
+
+		case dav("sync-collection"):
+			// ../rfc/6578:309
+			if rep.SyncLevel != "" && rep.SyncLevel != "1" {
+				return errorf(http.StatusBadRequest, "only sync-level 1 supported")
+			}
+			var since store.ModSeq
+			initial := rep.SyncToken == ""
+			if !initial {
+				var ok bool
+				since, ok = parseSyncToken(ab, strings.TrimSpace(rep.SyncToken))
+				if !ok {
+					// ../rfc/6578:537
+					return precondition(http.StatusForbidden, dav("valid-sync-token"), "")
+				}
+			}
+			contacts, err := store.ContactChanges(tx, ab.ID, since)
+			if err != nil {
+				return err
+			}
+			for _, c := range contacts {
+				if c.Expunged {
+					// Removed contacts are not mentioned for an initial sync. ../rfc/6578:397
+					if !initial {
+						ms.status(s.href(resource{kindContact, ab, c}), "404 Not Found")
+					}
+					continue
+				}
+				s.addResponse(&ms, acc, resource{kindContact, ab, c}, props, false)
+			}
+			token = syncToken(ab)
+
+		default:
+			return precondition(http.StatusForbidden, dav("supported-report"), "")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	writeMultistatus(w, &ms, token)
+	return nil
+}
+
+// PropFiltersOrNil returns the prop filters, for a possibly nil filter.
+func (f *filter) PropFiltersOrNil() []propFilter {
+	if f == nil {
+		return nil
+	}
+	return f.PropFilters
+}
+
+func (s server) get(w http.ResponseWriter, r *http.Request, acc *store.Account, tg target) error {
+	if tg.kind != kindContact {
+		return errorf(http.StatusMethodNotAllowed, "only contacts can be retrieved")
+	}
+	var c store.Contact
+	err := acc.DB.Read(r.Context(), func(tx *bstore.Tx) error {
+		ab, err := store.AddressBookGet(tx, tg.addressBook)
+		if err == store.ErrAddressBookUnknown {
+			return errorf(http.StatusNotFound, "no such address book")
+		} else if err != nil {
+			return err
+		}
+		c, err = store.ContactGet(tx, ab.ID, tg.contact)
+		if err == store.ErrContactUnknown {
+			return errorf(http.StatusNotFound, "no such contact")
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	h := w.Header()
+	h.Set("Content-Type", "text/vcard; charset=utf-8")
+	h.Set("ETag", c.ETag())
+	h.Set("Last-Modified", c.Updated.UTC().Format(http.TimeFormat))
+	h.Set("Content-Length", fmt.Sprintf("%d", len(c.VCard)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != "HEAD" {
+		w.Write([]byte(c.VCard))
+	}
+	return nil
+}
+
+// checkConditions checks the If-Match and If-None-Match headers against the
+// current contact, which may not exist.
+func checkConditions(r *http.Request, exists bool, etag string) error {
+	if inm := strings.TrimSpace(r.Header.Get("If-None-Match")); inm != "" {
+		if exists && (inm == "*" || etagListMatch(inm, etag)) {
+			return errorf(http.StatusPreconditionFailed, "contact exists")
+		}
+	}
+	if im := strings.TrimSpace(r.Header.Get("If-Match")); im != "" {
+		if !exists || im != "*" && !etagListMatch(im, etag) {
+			return errorf(http.StatusPreconditionFailed, "contact does not exist or was changed")
+		}
+	}
+	return nil
+}
+
+func etagListMatch(l, etag string) bool {
+	for _, s := range strings.Split(l, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(s), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func (s server) put(w http.ResponseWriter, r *http.Request, acc *store.Account, tg target) error {
+	// ../rfc/6352:838
+	if tg.kind != kindContact {
+		return errorf(http.StatusMethodNotAllowed, "only contacts can be stored")
+	}
+	if err := store.CheckContactName(tg.contact); err != nil {
+		return errorf(http.StatusForbidden, "%v", err)
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		mt := strings.ToLower(strings.TrimSpace(strings.Split(ct, ";")[0]))
+		if mt != "text/vcard" && mt != "text/x-vcard" && mt != "text/directory" {
+			return precondition(http.StatusUnsupportedMediaType, card("supported-address-data"), "")
+		}
+	}
+	buf, err := io.ReadAll(io.LimitReader(r.Body, store.ContactMaxSize+1))
+	if err != nil {
+		return errorf(http.StatusBadRequest, "reading request body: %v", err)
+	}
+	if len(buf) > store.ContactMaxSize {
+		return precondition(http.StatusForbidden, card("max-resource-size"), "")
+	}
+
+	var c store.Contact
+	var created bool
+	err = acc.DB.Write(r.Context(), func(tx *bstore.Tx) error {
+		ab, err := addressBookGet(tx, acc, tg.addressBook)
+		if err != nil {
+			return err
+		}
+		oc, err := store.ContactGet(tx, ab.ID, tg.contact)
+		if err != nil && err != store.ErrContactUnknown {
+			return err
+		}
+		if err := checkConditions(r, err == nil, oc.ETag()); err != nil {
+			return err
+		}
+		c, created, err = store.ContactPut(tx, acc, &ab, tg.contact, string(buf))
+		if errors.Is(err, store.ErrVCard) {
+			return precondition(http.StatusForbidden, card("valid-address-data"), "")
+		} else if err == store.ErrContactUIDConflict {
+			// ../rfc/6352:866
+			vc, _ := store.ParseVCard(string(buf))
+			oc, err := store.ContactFindUID(tx, ab.ID, vc.Value("UID"))
+			if err != nil {
+				return err
+			}
+			href := "<d:href>" + xmlText(s.href(resource{kindContact, ab, oc})) + "</d:href>"
+			return precondition(http.StatusForbidden, card("no-uid-conflict"), href)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	w.Header().Set("ETag", c.ETag())
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+	return nil
+}
+
+func (s server) delete(w http.ResponseWriter, r *http.Request, acc *store.Account, tg target) error {
+	if tg.kind != kindContact && tg.kind != kindAddressBook {
+		return errorf(http.StatusForbidden, "only address books and contacts can be removed")
+	}
+	err := acc.DB.Write(r.Context(), func(tx *bstore.Tx) error {
+		ab, err := store.AddressBookGet(tx, tg.addressBook)
+		if err == store.ErrAddressBookUnknown {
+			return errorf(http.StatusNotFound, "no such address book")
+		} else if err != nil {
+			return err
+		}
+		if tg.kind == kindAddressBook {
+			return store.AddressBookRemove(tx, ab.Name)
+		}
+		c, err := store.ContactGet(tx, ab.ID, tg.contact)
+		if err == store.ErrContactUnknown {
+			return errorf(http.StatusNotFound, "no such contact")
+		} else if err != nil {
+			return err
+		}
+		if err := checkConditions(r, true, c.ETag()); err != nil {
+			return err
+		}
+		return store.ContactRemove(tx, acc, &ab, c.Name)
+	})
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
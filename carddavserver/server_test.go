@@ -0,0 +1,262 @@
+package carddavserver
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/store"
+)
+
+var ctxbg = context.Background()
+
+func tcheckf(t *testing.T, err error, format string, args ...any) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: %s", fmt.Sprintf(format, args...), err)
+	}
+}
+
+func tcompare(t *testing.T, got, expect any) {
+	t.Helper()
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("got:\n%#v\nexpected:\n%#v", got, expect)
+	}
+}
+
+const password = "test1234"
+
+func vcard(uid, fn, email string) string {
+	return strings.ReplaceAll(fmt.Sprintf(`BEGIN:VCARD
+VERSION:4.0
+UID:%s
+FN:%s
+EMAIL;TYPE=work:%s
+END:VCARD
+`, uid, fn, email), "\n", "\r\n")
+}
+
+// Parsed multistatus response.
+type msResponse struct {
+	Href      string `xml:"DAV: href"`
+	Status    string `xml:"DAV: status"`
+	Propstats []struct {
+		Prop struct {
+			Inner string `xml:",innerxml"`
+		} `xml:"DAV: prop"`
+		Status string `xml:"DAV: status"`
+	} `xml:"DAV: propstat"`
+}
+
+type msDoc struct {
+	Responses []msResponse `xml:"DAV: response"`
+	SyncToken string       `xml:"DAV: sync-token"`
+}
+
+type testServer struct {
+	t  *testing.T
+	hs *httptest.Server
+}
+
+// do makes an http request, checking the response status.
+func (ts testServer) do(method, path string, hdrs map[string]string, body string, expCode int) (http.Header, string) {
+	ts.t.Helper()
+	req, err := http.NewRequest(method, ts.hs.URL+path, strings.NewReader(body))
+	tcheckf(ts.t, err, "new request")
+	req.SetBasicAuth("mjl@mox.example", password)
+	for k, v := range hdrs {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	tcheckf(ts.t, err, "http request")
+	defer resp.Body.Close()
+	buf, err := io.ReadAll(resp.Body)
+	tcheckf(ts.t, err, "read response")
+	if resp.StatusCode != expCode {
+		ts.t.Fatalf("%s %s: got status %d, expected %d, body %q", method, path, resp.StatusCode, expCode, buf)
+	}
+	return resp.Header, string(buf)
+}
+
+// multistatus makes a request that must return a 207 response, and parses it.
+func (ts testServer) multistatus(method, path, depth, body string) msDoc {
+	ts.t.Helper()
+	hdrs := map[string]string{"Content-Type": "application/xml"}
+	if depth != "" {
+		hdrs["Depth"] = depth
+	}
+	_, buf := ts.do(method, path, hdrs, body, http.StatusMultiStatus)
+	var doc msDoc
+	err := xml.Unmarshal([]byte(buf), &doc)
+	tcheckf(ts.t, err, "parse multistatus %q", buf)
+	return doc
+}
+
+// hrefs returns the hrefs of responses with a 200 propstat, and with a 404
+// status.
+func (doc msDoc) hrefs() (found, removed []string) {
+	for _, r := range doc.Responses {
+		if strings.Contains(r.Status, "404") {
+			removed = append(removed, r.Href)
+		} else {
+			found = append(found, r.Href)
+		}
+	}
+	return
+}
+
+func TestServer(t *testing.T) {
+	mox.LimitersInit()
+	os.RemoveAll("../testdata/carddavserver/data")
+	mox.Context = ctxbg
+	mox.ConfigStaticPath = filepath.FromSlash("../testdata/carddavserver/mox.conf")
+	mox.MustLoadConfig(true, false)
+	defer store.Switchboard()()
+
+	log := mlog.New("carddavserver", nil)
+	acc, err := store.OpenAccount(log, "mjl")
+	tcheckf(t, err, "open account")
+	err = acc.SetPassword(log, password)
+	tcheckf(t, err, "set password")
+	defer func() {
+		err := acc.Close()
+		log.Check(err, "closing account")
+		acc.CheckClosed()
+	}()
+
+	hs := httptest.NewServer(http.StripPrefix("/carddav", NewServer("/carddav/", false)))
+	defer hs.Close()
+	ts := testServer{t, hs}
+
+	// Authentication is required.
+	resp, err := http.Get(hs.URL + "/carddav/")
+	tcheckf(t, err, "get without auth")
+	resp.Body.Close()
+	tcompare(t, resp.StatusCode, http.StatusUnauthorized)
+
+	h, _ := ts.do("OPTIONS", "/carddav/", nil, "", http.StatusOK)
+	if !strings.Contains(h.Get("DAV"), "addressbook") {
+		t.Fatalf("missing addressbook in dav header %q", h.Get("DAV"))
+	}
+	ts.do("PROPFIND", "/carddav/bogus/", nil, "", http.StatusNotFound)
+
+	// Discovery: principal and address book home.
+	doc := ts.multistatus("PROPFIND", "/carddav/", "0", `<d:propfind xmlns:d="DAV:"><d:prop><d:current-user-principal/></d:prop></d:propfind>`)
+	tcompare(t, len(doc.Responses), 1)
+	if !strings.Contains(doc.Responses[0].Propstats[0].Prop.Inner, "/carddav/principal/") {
+		t.Fatalf("missing principal: %q", doc.Responses[0].Propstats[0].Prop.Inner)
+	}
+	doc = ts.multistatus("PROPFIND", "/carddav/principal/", "0", `<d:propfind xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:carddav"><d:prop><c:addressbook-home-set/><d:bogus/></d:prop></d:propfind>`)
+	ps := doc.Responses[0].Propstats
+	tcompare(t, len(ps), 2)
+	if !strings.Contains(ps[0].Prop.Inner, "/carddav/addressbooks/") || !strings.Contains(ps[1].Status, "404") {
+		t.Fatalf("unexpected propstats %#v", ps)
+	}
+
+	// Default address book is created on first use.
+	doc = ts.multistatus("PROPFIND", "/carddav/addressbooks/", "1", "")
+	found, _ := doc.hrefs()
+	tcompare(t, found, []string{"/carddav/addressbooks/", "/carddav/addressbooks/contacts/"})
+
+	// Create address book with extended MKCOL, change its name.
+	ts.do("MKCOL", "/carddav/addressbooks/work/", nil, `<d:mkcol xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:carddav"><d:set><d:prop><d:resourcetype><d:collection/><c:addressbook/></d:resourcetype><d:displayname>Work</d:displayname></d:prop></d:set></d:mkcol>`, http.StatusCreated)
+	ts.do("MKCOL", "/carddav/addressbooks/work/", nil, "", http.StatusMethodNotAllowed)
+	ts.do("MKCOL", "/carddav/addressbooks/bad%20name/", nil, "", http.StatusForbidden)
+	doc = ts.multistatus("PROPPATCH", "/carddav/addressbooks/work/", "", `<d:propertyupdate xmlns:d="DAV:"><d:set><d:prop><d:displayname>Work contacts</d:displayname></d:prop></d:set></d:propertyupdate>`)
+	tcompare(t, strings.Contains(doc.Responses[0].Propstats[0].Status, "200"), true)
+	doc = ts.multistatus("PROPPATCH", "/carddav/addressbooks/work/", "", `<d:propertyupdate xmlns:d="DAV:"><d:set><d:prop><d:displayname>x</d:displayname><d:getetag>x</d:getetag></d:prop></d:set></d:propertyupdate>`)
+	tcompare(t, strings.Contains(doc.Responses[0].Propstats[0].Status, "403"), true)
+	doc = ts.multistatus("PROPFIND", "/carddav/addressbooks/work/", "0", `<d:propfind xmlns:d="DAV:"><d:prop><d:displayname/><d:sync-token/></d:prop></d:propfind>`)
+	if !strings.Contains(doc.Responses[0].Propstats[0].Prop.Inner, "Work contacts") {
+		t.Fatalf("displayname not changed: %q", doc.Responses[0].Propstats[0].Prop.Inner)
+	}
+
+	// Initial sync.
+	const sync = `<d:sync-collection xmlns:d="DAV:"><d:sync-token>%s</d:sync-token><d:sync-level>1</d:sync-level><d:prop><d:getetag/></d:prop></d:sync-collection>`
+	doc = ts.multistatus("REPORT", "/carddav/addressbooks/work/", "", fmt.Sprintf(sync, ""))
+	tcompare(t, len(doc.Responses), 0)
+	token := doc.SyncToken
+
+	// Add contacts.
+	vc1 := vcard("uid1", "Alice Example", "alice@example.org")
+	h, _ = ts.do("PUT", "/carddav/addressbooks/work/c1.vcf", map[string]string{"Content-Type": "text/vcard", "If-None-Match": "*"}, vc1, http.StatusCreated)
+	etag1 := h.Get("ETag")
+	ts.do("PUT", "/carddav/addressbooks/work/c1.vcf", map[string]string{"If-None-Match": "*"}, vc1, http.StatusPreconditionFailed)
+	ts.do("PUT", "/carddav/addressbooks/work/c2.vcf", nil, vcard("uid2", "Bob Example", "bob@example.org"), http.StatusCreated)
+	_, body := ts.do("PUT", "/carddav/addressbooks/work/c3.vcf", nil, vcard("uid1", "Alice again", "alice@example.org"), http.StatusForbidden)
+	if !strings.Contains(body, "no-uid-conflict") || !strings.Contains(body, "/carddav/addressbooks/work/c1.vcf") {
+		t.Fatalf("missing uid conflict precondition: %q", body)
+	}
+	ts.do("PUT", "/carddav/addressbooks/work/c3.vcf", nil, "not a vcard", http.StatusForbidden)
+	ts.do("PUT", "/carddav/addressbooks/work/c3.vcf", map[string]string{"Content-Type": "text/plain"}, vc1, http.StatusUnsupportedMediaType)
+	ts.do("PUT", "/carddav/addressbooks/absent/c3.vcf", nil, vc1, http.StatusNotFound)
+
+	h, body = ts.do("GET", "/carddav/addressbooks/work/c1.vcf", nil, "", http.StatusOK)
+	tcompare(t, body, vc1)
+	tcompare(t, h.Get("ETag"), etag1)
+	ts.do("GET", "/carddav/addressbooks/work/absent.vcf", nil, "", http.StatusNotFound)
+
+	// Update with matching and mismatching etag.
+	vc1b := vcard("uid1", "Alice Changed", "alice@example.org")
+	ts.do("PUT", "/carddav/addressbooks/work/c1.vcf", map[string]string{"If-Match": `"1"`}, vc1b, http.StatusPreconditionFailed)
+	ts.do("PUT", "/carddav/addressbooks/work/c1.vcf", map[string]string{"If-Match": etag1}, vc1b, http.StatusNoContent)
+
+	// Contacts are used for completing recipient addresses.
+	err = acc.DB.Read(ctxbg, func(tx *bstore.Tx) error {
+		l, more, err := store.ContactAddresses(tx, "alice", 10)
+		tcheckf(t, err, "contact addresses")
+		tcompare(t, more, false)
+		tcompare(t, len(l), 1)
+		tcompare(t, l[0].Name, "Alice Changed")
+		tcompare(t, l[0].Address.String(), "alice@example.org")
+		return nil
+	})
+	tcheckf(t, err, "read")
+
+	// Multiget and query.
+	doc = ts.multistatus("REPORT", "/carddav/addressbooks/work/", "", `<c:addressbook-multiget xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:carddav"><d:prop><d:getetag/><c:address-data/></d:prop><d:href>/carddav/addressbooks/work/c1.vcf</d:href><d:href>/carddav/addressbooks/work/absent.vcf</d:href></c:addressbook-multiget>`)
+	found, removed := doc.hrefs()
+	tcompare(t, found, []string{"/carddav/addressbooks/work/c1.vcf"})
+	tcompare(t, removed, []string{"/carddav/addressbooks/work/absent.vcf"})
+	if !strings.Contains(doc.Responses[0].Propstats[0].Prop.Inner, "Alice Changed") {
+		t.Fatalf("missing address data: %q", doc.Responses[0].Propstats[0].Prop.Inner)
+	}
+	doc = ts.multistatus("REPORT", "/carddav/addressbooks/work/", "", `<c:addressbook-query xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:carddav"><d:prop><d:getetag/></d:prop><c:filter><c:prop-filter name="EMAIL"><c:text-match match-type="starts-with">BOB@</c:text-match></c:prop-filter></c:filter></c:addressbook-query>`)
+	found, _ = doc.hrefs()
+	tcompare(t, found, []string{"/carddav/addressbooks/work/c2.vcf"})
+	doc = ts.multistatus("REPORT", "/carddav/addressbooks/work/", "", `<c:addressbook-query xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:carddav"><d:prop><d:getetag/></d:prop><c:filter><c:prop-filter name="FN"><c:text-match negate-condition="yes">bob</c:text-match></c:prop-filter></c:filter></c:addressbook-query>`)
+	found, _ = doc.hrefs()
+	tcompare(t, found, []string{"/carddav/addressbooks/work/c1.vcf"})
+
+	// Remove a contact, and sync the changes.
+	ts.do("DELETE", "/carddav/addressbooks/work/c2.vcf", nil, "", http.StatusNoContent)
+	ts.do("DELETE", "/carddav/addressbooks/work/c2.vcf", nil, "", http.StatusNotFound)
+	doc = ts.multistatus("REPORT", "/carddav/addressbooks/work/", "", fmt.Sprintf(sync, token))
+	found, removed = doc.hrefs()
+	tcompare(t, found, []string{"/carddav/addressbooks/work/c1.vcf"})
+	tcompare(t, removed, []string{"/carddav/addressbooks/work/c2.vcf"})
+	token2 := doc.SyncToken
+	doc = ts.multistatus("REPORT", "/carddav/addressbooks/work/", "", fmt.Sprintf(sync, token2))
+	tcompare(t, len(doc.Responses), 0)
+	tcompare(t, doc.SyncToken, token2)
+	_, body = ts.do("REPORT", "/carddav/addressbooks/work/", nil, fmt.Sprintf(sync, "urn:bogus"), http.StatusForbidden)
+	if !strings.Contains(body, "valid-sync-token") {
+		t.Fatalf("missing valid-sync-token precondition: %q", body)
+	}
+
+	// Remove the address book.
+	ts.do("DELETE", "/carddav/addressbooks/work/", nil, "", http.StatusNoContent)
+	ts.do("PROPFIND", "/carddav/addressbooks/work/", map[string]string{"Depth": "0"}, "", http.StatusNotFound)
+}
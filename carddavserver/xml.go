@@ -0,0 +1,177 @@
+package carddavserver
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+)
+
+// XML namespaces used in requests and responses.
+const (
+	nsDAV     = "DAV:"
+	nsCardDAV = "urn:ietf:params:xml:ns:carddav"
+	nsCS      = "http://calendarserver.org/ns/" // For getctag.
+)
+
+// Prefixes for namespaces in responses.
+var nsPrefixes = map[string]string{
+	nsDAV:     "d",
+	nsCardDAV: "card",
+	nsCS:      "cs",
+}
+
+// propNames is a list of property names, e.g. in a PROPFIND or REPORT request.
+type propNames struct {
+	Names []xmlElem `xml:",any"`
+}
+
+type xmlElem struct {
+	XMLName xml.Name
+}
+
+// propfind is a PROPFIND request body. ../rfc/4918:3248
+type propfind struct {
+	XMLName  xml.Name   `xml:"DAV: propfind"`
+	AllProp  *struct{}  `xml:"DAV: allprop"`
+	PropName *struct{}  `xml:"DAV: propname"`
+	Prop     *propNames `xml:"DAV: prop"`
+}
+
+// propValues holds properties with values, for PROPPATCH and extended MKCOL.
+type propValues struct {
+	Props []propValue `xml:",any"`
+}
+
+type propValue struct {
+	XMLName xml.Name
+	Value   string `xml:",chardata"`
+}
+
+type propSet struct {
+	Prop propValues `xml:"DAV: prop"`
+}
+
+// propertyupdate is a PROPPATCH request body. ../rfc/4918:3213
+type propertyupdate struct {
+	XMLName xml.Name  `xml:"DAV: propertyupdate"`
+	Set     []propSet `xml:"DAV: set"`
+	Remove  []propSet `xml:"DAV: remove"`
+}
+
+// mkcol is an extended MKCOL request body. ../rfc/5689:215
+type mkcol struct {
+	XMLName xml.Name  `xml:"DAV: mkcol"`
+	Set     []propSet `xml:"DAV: set"`
+}
+
+// report is a REPORT request body, for addressbook-multiget and
+// addressbook-query (../rfc/6352), and sync-collection (../rfc/6578).
+type report struct {
+	XMLName   xml.Name
+	AllProp   *struct{}  `xml:"DAV: allprop"`
+	Prop      *propNames `xml:"DAV: prop"`
+	Hrefs     []string   `xml:"DAV: href"`
+	SyncToken string     `xml:"DAV: sync-token"`
+	SyncLevel string     `xml:"DAV: sync-level"`
+	Filter    *filter    `xml:"urn:ietf:params:xml:ns:carddav filter"`
+	Limit     *struct {
+		NResults int `xml:"urn:ietf:params:xml:ns:carddav nresults"`
+	} `xml:"urn:ietf:params:xml:ns:carddav limit"`
+}
+
+// filter for addressbook-query. ../rfc/6352:1535
+type filter struct {
+	Test        string       `xml:"test,attr"` // "anyof" (default) or "allof".
+	PropFilters []propFilter `xml:"urn:ietf:params:xml:ns:carddav prop-filter"`
+}
+
+type propFilter struct {
+	Name         string      `xml:"name,attr"`
+	Test         string      `xml:"test,attr"`
+	IsNotDefined *struct{}   `xml:"urn:ietf:params:xml:ns:carddav is-not-defined"`
+	TextMatches  []textMatch `xml:"urn:ietf:params:xml:ns:carddav text-match"`
+	ParamFilters []xmlElem   `xml:"urn:ietf:params:xml:ns:carddav param-filter"`
+}
+
+type textMatch struct {
+	Collation       string `xml:"collation,attr"`
+	NegateCondition string `xml:"negate-condition,attr"`
+	MatchType       string `xml:"match-type,attr"`
+	Text            string `xml:",chardata"`
+}
+
+// xmlText returns s escaped for use as XML character data.
+func xmlText(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// elemString returns an empty element for name, with a namespace prefix for known
+// namespaces, or a namespace declaration otherwise.
+func elemString(name xml.Name, inner string) string {
+	if prefix, ok := nsPrefixes[name.Space]; ok {
+		if inner == "" {
+			return fmt.Sprintf("<%s:%s/>", prefix, name.Local)
+		}
+		return fmt.Sprintf("<%s:%s>%s</%s:%s>", prefix, name.Local, inner, prefix, name.Local)
+	}
+	if name.Space == "" {
+		return fmt.Sprintf("<%s>%s</%s>", name.Local, inner, name.Local)
+	}
+	if inner == "" {
+		return fmt.Sprintf(`<x:%s xmlns:x="%s"/>`, name.Local, xmlText(name.Space))
+	}
+	return fmt.Sprintf(`<x:%s xmlns:x="%s">%s</x:%s>`, name.Local, xmlText(name.Space), inner, name.Local)
+}
+
+// multistatus gathers responses for a 207 Multi-Status response. ../rfc/4918:3336
+type multistatus struct {
+	b strings.Builder
+}
+
+// propstat is a group of properties with the same status in a response. Props are
+// elements, with values if status is 200.
+type propstat struct {
+	status string // E.g. "200 OK".
+	props  []string
+}
+
+// names returns empty elements for property names, for use in a propstat.
+func names(l []xml.Name) (r []string) {
+	for _, n := range l {
+		r = append(r, elemString(n, ""))
+	}
+	return r
+}
+
+func (ms *multistatus) response(href string, stats ...propstat) {
+	ms.b.WriteString("<d:response><d:href>" + xmlText(href) + "</d:href>")
+	for _, ps := range stats {
+		if len(ps.props) == 0 {
+			continue
+		}
+		ms.b.WriteString("<d:propstat><d:prop>" + strings.Join(ps.props, "") + "</d:prop><d:status>HTTP/1.1 " + ps.status + "</d:status></d:propstat>")
+	}
+	ms.b.WriteString("</d:response>")
+}
+
+// status adds a response with just a status, e.g. for a removed resource.
+func (ms *multistatus) status(href, status string) {
+	ms.b.WriteString("<d:response><d:href>" + xmlText(href) + "</d:href><d:status>HTTP/1.1 " + status + "</d:status></d:response>")
+}
+
+// document returns the XML document, with syncToken if not empty.
+func (ms *multistatus) document(syncToken string) string {
+	var tok string
+	if syncToken != "" {
+		tok = "<d:sync-token>" + xmlText(syncToken) + "</d:sync-token>"
+	}
+	return xml.Header + `<d:multistatus xmlns:d="DAV:" xmlns:card="urn:ietf:params:xml:ns:carddav" xmlns:cs="http://calendarserver.org/ns/">` + ms.b.String() + tok + "</d:multistatus>\n"
+}
+
+// errorDocument returns an XML error body with a precondition element.
+// ../rfc/4918:3191
+func errorDocument(precondition xml.Name, inner string) string {
+	return xml.Header + `<d:error xmlns:d="DAV:" xmlns:card="urn:ietf:params:xml:ns:carddav">` + elemString(precondition, inner) + "</d:error>\n"
+}
@@ -53,6 +53,8 @@ type Static struct {
 	} `sconf:"optional" sconf-doc:"Global TLS configuration, e.g. for additional Certificate Authorities. Used for outgoing SMTP connections, HTTPS requests."`
 	ACME              map[string]ACME     `sconf:"optional" sconf-doc:"Automatic TLS configuration with ACME, e.g. through Let's Encrypt. The key is a name referenced in TLS configs, e.g. letsencrypt."`
 	AdminPasswordFile string              `sconf:"optional" sconf-doc:"File containing hash of admin password, for authentication in the web admin pages (if enabled)."`
+	ExternalAuth      *ExternalAuth       `sconf:"optional" sconf-doc:"Verify account passwords with an external authentication backend, such as an LDAP directory, instead of only with the passwords set in accounts. External authentication only works with authentication mechanisms that send the plain text password (PLAIN and LOGIN, and for the web interfaces and webapi), not with SCRAM-SHA-* or CRAM-MD5, which need a password set in the account. Successful authentications are cached for up to 15 minutes."`
+	OIDC              *OIDC               `sconf:"optional" sconf-doc:"Authenticate with OAuth 2.0 bearer tokens from an OpenID Connect identity provider, for single sign-on. Enables the OAUTHBEARER and XOAUTH2 authentication mechanisms for IMAP and SMTP submission, and if a ClientID is configured, logging in to webmail and the account web interface through the identity provider. Tokens must be JWTs signed by the identity provider."`
 	Listeners         map[string]Listener `sconf-doc:"Listeners are groups of IP addresses and services enabled on those IP addresses, such as SMTP/IMAP or internal endpoints for administration or Prometheus metrics. All listeners with SMTP/IMAP services enabled will serve all configured domains. If the listener is named 'public', it will get a few helpful additional configuration checks, for acme automatic tls certificates and monitoring of ips in dnsbls if those are configured."`
 	Postmaster        struct {
 		Account string
@@ -65,14 +67,17 @@ type Static struct {
 
 		ParsedLocalpart smtp.Localpart `sconf:"-"`
 	} `sconf:"optional" sconf-doc:"Destination for per-host TLS reports (TLSRPT). TLS reports can be per recipient domain (for MTA-STS), or per MX host (for DANE). The per-domain TLS reporting configuration is in domains.conf. This is the TLS reporting configuration for this host. If absent, no host-based TLSRPT address is configured, and no host TLSRPT DNS record is suggested."`
-	InitialMailboxes InitialMailboxes     `sconf:"optional" sconf-doc:"Mailboxes to create for new accounts. Inbox is always created. Mailboxes can be given a 'special-use' role, which are understood by most mail clients. If absent/empty, the following mailboxes are created: Sent, Archive, Trash, Drafts and Junk."`
-	DefaultMailboxes []string             `sconf:"optional" sconf-doc:"Deprecated in favor of InitialMailboxes. Mailboxes to create when adding an account. Inbox is always created. If no mailboxes are specified, the following are automatically created: Sent, Archive, Trash, Drafts and Junk."`
-	Transports       map[string]Transport `sconf:"optional" sconf-doc:"Transport are mechanisms for delivering messages. Transports can be referenced from Routes in accounts, domains and the global configuration. There is always an implicit/fallback delivery transport doing direct delivery with SMTP from the outgoing message queue. Transports are typically only configured when using smarthosts, i.e. when delivering through another SMTP server. Zero or one transport methods must be set in a transport, never multiple. When using an external party to send email for a domain, keep in mind you may have to add their IP address to your domain's SPF record, and possibly additional DKIM records."`
+	InitialMailboxes   InitialMailboxes             `sconf:"optional" sconf-doc:"Mailboxes to create for new accounts. Inbox is always created. Mailboxes can be given a 'special-use' role, which are understood by most mail clients. If absent/empty, the following mailboxes are created: Sent, Archive, Trash, Drafts and Junk."`
+	DefaultMailboxes   []string                     `sconf:"optional" sconf-doc:"Deprecated in favor of InitialMailboxes. Mailboxes to create when adding an account. Inbox is always created. If no mailboxes are specified, the following are automatically created: Sent, Archive, Trash, Drafts and Junk."`
+	Transports         map[string]Transport         `sconf:"optional" sconf-doc:"Transport are mechanisms for delivering messages. Transports can be referenced from Routes in accounts, domains and the global configuration. There is always an implicit/fallback delivery transport doing direct delivery with SMTP from the outgoing message queue. Transports are typically only configured when using smarthosts, i.e. when delivering through another SMTP server. Zero or one transport methods must be set in a transport, never multiple. When using an external party to send email for a domain, keep in mind you may have to add their IP address to your domain's SPF record, and possibly additional DKIM records."`
+	OutgoingRateLimits map[string]OutgoingRateLimit `sconf:"optional" sconf-doc:"Limits for deliveries from the queue, e.g. to prevent being throttled by large mail providers when sending many messages, or to gradually warm up new IPs. Each limit applies to recipient domains, MX hosts or source IPs. Messages that would exceed a limit stay in the queue and are attempted again when the limit allows, without counting as a failed delivery attempt. The key is a name for the limit, shown in the queue in the admin web interface."`
 	// Awkward naming of fields to get intended default behaviour for zero values.
-	NoOutgoingDMARCReports          bool  `sconf:"optional" sconf-doc:"Do not send DMARC reports (aggregate only). By default, aggregate reports on DMARC evaluations are sent to domains if their DMARC policy requests them. Reports are sent at whole hours, with a minimum of 1 hour and maximum of 24 hours, rounded up so a whole number of intervals cover 24 hours, aligned at whole days in UTC. Reports are sent from the postmaster@<mailhostname> address."`
-	NoOutgoingTLSReports            bool  `sconf:"optional" sconf-doc:"Do not send TLS reports. By default, reports about failed SMTP STARTTLS connections and related MTA-STS/DANE policies are sent to domains if their TLSRPT DNS record requests them. Reports covering a 24 hour UTC interval are sent daily. Reports are sent from the postmaster address of the configured domain the mailhostname is in. If there is no such domain, or it does not have DKIM configured, no reports are sent."`
-	OutgoingTLSReportsForAllSuccess bool  `sconf:"optional" sconf-doc:"Also send TLS reports if there were no SMTP STARTTLS connection failures. By default, reports are only sent when at least one failure occurred. If a report is sent, it does always include the successful connection counts as well."`
-	QuotaMessageSize                int64 `sconf:"optional" sconf-doc:"Default maximum total message size in bytes for each individual account, only applicable if greater than zero. Can be overridden per account. Attempting to add new messages to an account beyond its maximum total size will result in an error. Useful to prevent a single account from filling storage. The quota only applies to the email message files, not to any file system overhead and also not the message index database file (account for approximately 15% overhead)."`
+	NoOutgoingDMARCReports          bool         `sconf:"optional" sconf-doc:"Do not send DMARC reports (aggregate only). By default, aggregate reports on DMARC evaluations are sent to domains if their DMARC policy requests them. Reports are sent at whole hours, with a minimum of 1 hour and maximum of 24 hours, rounded up so a whole number of intervals cover 24 hours, aligned at whole days in UTC. Reports are sent from the postmaster@<mailhostname> address."`
+	NoOutgoingTLSReports            bool         `sconf:"optional" sconf-doc:"Do not send TLS reports. By default, reports about failed SMTP STARTTLS connections and related MTA-STS/DANE policies are sent to domains if their TLSRPT DNS record requests them. Reports covering a 24 hour UTC interval are sent daily. Reports are sent from the postmaster address of the configured domain the mailhostname is in. If there is no such domain, or it does not have DKIM configured, no reports are sent."`
+	OutgoingTLSReportsForAllSuccess bool         `sconf:"optional" sconf-doc:"Also send TLS reports if there were no SMTP STARTTLS connection failures. By default, reports are only sent when at least one failure occurred. If a report is sent, it does always include the successful connection counts as well."`
+	QuotaMessageSize                int64        `sconf:"optional" sconf-doc:"Default maximum total message size in bytes for each individual account, only applicable if greater than zero. Can be overridden per account. Attempting to add new messages to an account beyond its maximum total size will result in an error. Useful to prevent a single account from filling storage. The quota only applies to the email message files, not to any file system overhead and also not the message index database file (account for approximately 15% overhead)."`
+	TrustedARCSealers               []string     `sconf:"optional" sconf-doc:"Domains of intermediary mail servers, e.g. mailing lists and forwarding services, whose ARC seals are trusted. If an incoming message fails DMARC, but has a valid ARC chain most recently sealed by one of these domains, the DMARC policy is not applied, assuming the intermediary modified the message but verified the original authentication results. DKIM-verified domains recorded by a trusted sealer are also used for forwarded messages in rulesets. Independent of this option, messages redirected by Sieve scripts are ARC-sealed with the first configured DKIM selector of the domain that has an RSA key."`
+	TrustedARCSealerDomains         []dns.Domain `sconf:"-" json:"-"` // Parsed form of TrustedARCSealers.
 
 	// All IPs that were explicitly listened on for external SMTP. Only set when there
 	// are no unspecified external SMTP listeners and there is at most one for IPv4 and
@@ -88,6 +93,38 @@ type Static struct {
 	GID string `sconf:"-" json:"-"`
 }
 
+// ExternalAuth is an authentication backend for verifying account passwords.
+// Exactly one of LDAP and Exec must be set.
+type ExternalAuth struct {
+	LDAP           *LDAPAuth `sconf:"optional" sconf-doc:"Verify passwords with a simple bind to an LDAP server."`
+	Exec           *ExecAuth `sconf:"optional" sconf-doc:"Verify passwords by running a helper command."`
+	LocalPasswords bool      `sconf:"optional" sconf-doc:"Also accept the password set in an account, which is checked first. The SCRAM-SHA-* and CRAM-MD5 authentication mechanisms are only offered if local passwords are enabled. Useful for accounts that are not in the directory."`
+}
+
+type LDAPAuth struct {
+	URL      string        `sconf-doc:"URL of LDAP server, with scheme ldap or ldaps, e.g. ldaps://ldap.example.com. Default port is 389 for ldap and 636 for ldaps. Server certificates are verified against the system CA certificates, or those configured in TLS.CA."`
+	StartTLS bool          `sconf:"optional" sconf-doc:"For ldap URLs, switch to TLS with StartTLS before binding. Recommended if the LDAP server is not on the same machine."`
+	BindDN   string        `sconf-doc:"Template for the distinguished name to bind as. Placeholders {email}, {localpart}, {domain} and {account} are replaced with the (escaped) email address used for logging in, its localpart and domain, and the mox account name. Example: uid={localpart},ou=people,dc=example,dc=com. With Active Directory, the user principal name can often be used directly: {email}."`
+	Timeout  time.Duration `sconf:"optional" sconf-doc:"Timeout for connecting and binding. Default 10s."`
+}
+
+type ExecAuth struct {
+	Command []string      `sconf-doc:"Command and arguments to run for each authentication attempt. The email address and password are written to the standard input of the command, each followed by a newline. Environment variable MOX_ACCOUNT is set to the account name. Exit status 0 means the password is valid, exit status 1 that it is invalid. Other exit statuses are treated as temporary errors."`
+	Timeout time.Duration `sconf:"optional" sconf-doc:"Timeout for the command, it is killed when exceeded. Default 10s."`
+}
+
+// OIDC configures an OpenID Connect identity provider for token authentication.
+type OIDC struct {
+	Issuer       string        `sconf-doc:"Issuer of tokens, must match the \"iss\" claim. The issuer URL is also used to discover the JWKS and the endpoints for web login, at <issuer>/.well-known/openid-configuration."`
+	JWKSURL      string        `sconf:"optional" sconf-doc:"URL of the JSON Web Key Set with the keys for verifying token signatures. If not set, the URL is discovered through the issuer. Keys are refreshed hourly, and when a token with an unknown key ID is seen."`
+	JWKSFile     string        `sconf:"optional" sconf-doc:"File with the JSON Web Key Set, instead of fetching it from JWKSURL. Relative to the config directory. The file is read again when it changes. Useful for testing without an identity provider."`
+	Audience     string        `sconf:"optional" sconf-doc:"Value that must be present in the \"aud\" claim of tokens. Defaults to ClientID. Audience or ClientID is required."`
+	Claim        string        `sconf:"optional" sconf-doc:"Claim with the email address that is used to find the mox account. Default \"email\". If the claim is \"email\", the token must also have an \"email_verified\" claim that is true."`
+	ClientID     string        `sconf:"optional" sconf-doc:"OAuth client ID registered at the identity provider, for logging in to webmail and the account web interface with the authorization code flow. The redirect URI to register is the path of the web interface followed by \"oidc\", e.g. https://mail.example.org/webmail/oidc. Web login is only enabled if a client ID is configured."`
+	ClientSecret string        `sconf:"optional" sconf-doc:"OAuth client secret for ClientID, if the identity provider requires one."`
+	Timeout      time.Duration `sconf:"optional" sconf-doc:"Timeout for requests to the identity provider. Default 10s."`
+}
+
 // InitialMailboxes are mailboxes created for a new account.
 type InitialMailboxes struct {
 	SpecialUse SpecialUseMailboxes `sconf:"optional" sconf-doc:"Special-use roles to mailbox to create."`
@@ -158,8 +195,17 @@ type Listener struct {
 
 		FirstTimeSenderDelay *time.Duration `sconf:"optional" sconf-doc:"Delay before accepting a message from a first-time sender for the destination account. Default: 15s."`
 
+		Milters []Milter `sconf:"optional" sconf-doc:"Milters (mail filters, Sendmail milter protocol version 6) to pass incoming messages through, e.g. external spam/virus scanners such as rspamd, ClamAV, OpenDKIM. Milters are consulted in order at connect, HELO/EHLO, MAIL FROM, RCPT TO and at the end of the message data, before delivery. Milters can accept, reject, temporarily reject or discard messages, add and change header fields, and quarantine messages, which delivers them to the Junk mailbox."`
+
 		DNSBLZones []dns.Domain `sconf:"-"`
 	} `sconf:"optional"`
+	LMTP struct {
+		Enabled         bool
+		Port            int          `sconf:"optional" sconf-doc:"Default 24. Set to -1 to not listen on TCP, e.g. when only UnixSocket is used."`
+		UnixSocket      string       `sconf:"optional" sconf-doc:"If set, also listen on a unix domain socket at this path, relative to the data directory if not absolute. The socket is created with mode 0660."`
+		TrustedNetworks []string     `sconf:"optional" sconf-doc:"IP addresses or networks in CIDR notation allowed to connect over TCP. Default is loopback IPs only. Connections over the unix domain socket are always allowed."`
+		TrustedIPNets   []*net.IPNet `sconf:"-" json:"-"`
+	} `sconf:"optional" sconf-doc:"LMTP (RFC 2033) for final delivery of messages to local accounts by a trusted MTA, e.g. Postfix, or content filter. SPF, DKIM and DMARC are not evaluated and reputation is not used, the LMTP client is assumed to have done its checks. Sieve scripts, rulesets, junk filtering and quota still apply. After DATA, a response is sent for each accepted recipient."`
 	Submission struct {
 		Enabled           bool
 		Port              int  `sconf:"optional" sconf-doc:"Default 587."`
@@ -178,6 +224,20 @@ type Listener struct {
 		Enabled bool
 		Port    int `sconf:"optional" sconf-doc:"Default 993."`
 	} `sconf:"optional" sconf-doc:"IMAP over TLS for reading email, by email applications. Requires a TLS config."`
+	POP3 struct {
+		Enabled           bool
+		Port              int  `sconf:"optional" sconf-doc:"Default 110."`
+		NoRequireSTARTTLS bool `sconf:"optional" sconf-doc:"Enable this only when the connection is otherwise encrypted (e.g. through a VPN)."`
+	} `sconf:"optional" sconf-doc:"POP3 for retrieving email from the Inbox, by email applications and devices that don't support IMAP. Starts out in plain text, can be upgraded to TLS with the STLS command. Prefer using POP3S instead which is always a TLS connection."`
+	POP3S struct {
+		Enabled bool
+		Port    int `sconf:"optional" sconf-doc:"Default 995."`
+	} `sconf:"optional" sconf-doc:"POP3 over TLS for retrieving email from the Inbox, by email applications and devices that don't support IMAP. Requires a TLS config."`
+	ManageSieve struct {
+		Enabled           bool
+		Port              int  `sconf:"optional" sconf-doc:"Default 4190."`
+		NoRequireSTARTTLS bool `sconf:"optional" sconf-doc:"Enable this only when the connection is otherwise encrypted (e.g. through a VPN)."`
+	} `sconf:"optional" sconf-doc:"ManageSieve for managing Sieve scripts that filter incoming email, by email applications. Starts out in plain text, can be upgraded to TLS with the STARTTLS command."`
 	AccountHTTP  WebService `sconf:"optional" sconf-doc:"Account web interface, for email users wanting to change their accounts, e.g. set new password, set new delivery rulesets. Default path is /."`
 	AccountHTTPS WebService `sconf:"optional" sconf-doc:"Account web interface listener like AccountHTTP, but for HTTPS. Requires a TLS config."`
 	AdminHTTP    WebService `sconf:"optional" sconf-doc:"Admin web interface, for managing domains, accounts, etc. Default path is /admin/. Preferably only enable on non-public IPs. Hint: use 'ssh -L 8080:localhost:80 you@yourmachine' and open http://localhost:8080/admin/, or set up a tunnel (e.g. WireGuard) and add its IP to the mox 'internal' listener."`
@@ -186,6 +246,10 @@ type Listener struct {
 	WebmailHTTPS WebService `sconf:"optional" sconf-doc:"Webmail client, like WebmailHTTP, but for HTTPS. Requires a TLS config."`
 	WebAPIHTTP   WebService `sconf:"optional" sconf-doc:"Like WebAPIHTTP, but with plain HTTP, without TLS."`
 	WebAPIHTTPS  WebService `sconf:"optional" sconf-doc:"WebAPI, a simple HTTP/JSON-based API for email, with HTTPS (requires a TLS config). Default path is /webapi/."`
+	JMAPHTTP     WebService `sconf:"optional" sconf-doc:"Like JMAPHTTPS, but with plain HTTP, without TLS."`
+	JMAPHTTPS    WebService `sconf:"optional" sconf-doc:"JMAP, the JSON Meta Application Protocol for email (RFC 8620 and 8621), with HTTPS (requires a TLS config). Default path is /jmap/."`
+	CardDAVHTTP  WebService `sconf:"optional" sconf-doc:"Like CardDAVHTTPS, but with plain HTTP, without TLS."`
+	CardDAVHTTPS WebService `sconf:"optional" sconf-doc:"CardDAV server for synchronizing contacts in address books of accounts (RFC 6352), with HTTPS (requires a TLS config). Clients authenticate with HTTP basic authentication with an email address and password. Default path is /carddav/."`
 	MetricsHTTP  struct {
 		Enabled bool
 		Port    int `sconf:"optional" sconf-doc:"Default 8010."`
@@ -214,7 +278,7 @@ type Listener struct {
 	} `sconf:"optional" sconf-doc:"All configured WebHandlers will serve on an enabled listener. Either ACME must be configured, or for each WebHandler domain a TLS certificate must be configured."`
 }
 
-// WebService is an internal web interface: webmail, webaccount, webadmin, webapi.
+// WebService is an internal web interface: webmail, webaccount, webadmin, webapi, jmap, carddav.
 type WebService struct {
 	Enabled   bool
 	Port      int    `sconf:"optional" sconf-doc:"Default 80 for HTTP and 443 for HTTPS. See Hostname at Listener for hostname matching behaviour."`
@@ -222,6 +286,13 @@ type WebService struct {
 	Forwarded bool   `sconf:"optional" sconf-doc:"If set, X-Forwarded-* headers are used for the remote IP address for rate limiting and for the \"secure\" status of cookies."`
 }
 
+// Milter is a mail filter, see Listener.SMTP.Milters.
+type Milter struct {
+	Address string        `sconf-doc:"Address of the milter. Either unix:/path/to/socket for a unix domain socket, or inet:port@host, inet6:port@host or host:port for TCP."`
+	Timeout time.Duration `sconf:"optional" sconf-doc:"Timeout for connecting to the milter and for each command. Default 30s."`
+	OnError string        `sconf:"optional" sconf-doc:"What to do when the milter cannot be reached or returns an error: tempfail (default) temporarily rejects the SMTP command, accept continues as if the milter was not configured, reject permanently rejects the SMTP command."`
+}
+
 // Transport is a method to delivery a message. At most one of the fields can
 // be non-nil. The non-nil field represents the type of transport. For a
 // transport with all fields nil, regular email delivery is done.
@@ -268,12 +339,45 @@ type TransportSocks struct {
 }
 
 type TransportDirect struct {
-	DisableIPv4 bool `sconf:"optional" sconf-doc:"If set, outgoing SMTP connections will *NOT* use IPv4 addresses to connect to remote SMTP servers."`
-	DisableIPv6 bool `sconf:"optional" sconf-doc:"If set, outgoing SMTP connections will *NOT* use IPv6 addresses to connect to remote SMTP servers."`
+	DisableIPv4 bool              `sconf:"optional" sconf-doc:"If set, outgoing SMTP connections will *NOT* use IPv4 addresses to connect to remote SMTP servers."`
+	DisableIPv6 bool              `sconf:"optional" sconf-doc:"If set, outgoing SMTP connections will *NOT* use IPv6 addresses to connect to remote SMTP servers."`
+	IPPools     map[string]IPPool `sconf:"optional" sconf-doc:"Named pools of local IPs to make outgoing connections from, e.g. to keep transactional messages and newsletters apart, so complaints about one don't hurt delivery of the other. A pool is selected by a route with this transport, or with a webapi Send request for an account that lists the pool in its IPPools. Pool names must be unique over all transports. Without a selected pool, outgoing connections are made as with regular direct delivery."`
 
 	IPFamily string `sconf:"-" json:"-"`
 }
 
+// IPPool is a set of local IPs to make outgoing connections from, each with its
+// own hostname.
+type IPPool struct {
+	IPs []PoolIP `sconf-doc:"IPs to connect from. Connections are made from the IPs of the address family of the remote IP in turn, skipping IPs that are rate limited. Remote IPs of an address family without IPs in the pool are not used."`
+}
+
+type PoolIP struct {
+	IP       string `sconf-doc:"Local IP address, must be configured on this machine."`
+	Hostname string `sconf-doc:"Hostname used in SMTP EHLO for connections from this IP. The reverse DNS (PTR) record of the IP must resolve to this hostname, and the hostname must resolve to the IP. The hostname should be covered by the SPF records of the sending domains."`
+
+	ParsedIP       net.IP     `sconf:"-" json:"-"`
+	HostnameDomain dns.Domain `sconf:"-" json:"-"`
+}
+
+// OutgoingRateLimit limits the deliveries from the queue to recipient domains, to
+// MX hosts, or from source IPs. Exactly one of RecipientDomains, MXHosts and
+// SourceIPs must be set.
+type OutgoingRateLimit struct {
+	RecipientDomains     []string `sconf:"optional" sconf-doc:"Recipient domains the limit applies to, for all transports. If a domain starts with a dot, subdomains also match, e.g. .example.com matches example.com and mail.example.com."`
+	MXHosts              []string `sconf:"optional" sconf-doc:"Host names of MX targets the limit applies to, e.g. .google.com for all hosts under google.com. Only for direct delivery."`
+	SourceIPs            []string `sconf:"optional" sconf-doc:"Local IP addresses the limit applies to. Only for direct delivery, and only when the source IP of outgoing connections is known before connecting, i.e. when SMTP listeners are configured with specific IPs instead of 0.0.0.0 or ::."`
+	MessagesPerMinute    int      `sconf:"optional" sconf-doc:"Maximum number of messages delivered per minute, combined for all domains, hosts or IPs of the limit. Each recipient counts as a message. A delivery attempt for a message with more recipients than the limit is allowed when no messages were delivered in the past minute. Zero means no limit."`
+	MaxConnections       int      `sconf:"optional" sconf-doc:"Maximum number of concurrent outgoing connections, or concurrent delivery attempts for limits on recipient domains. Zero means no limit."`
+	WarmupStart          string   `sconf:"optional" sconf-doc:"Date the warm-up schedule starts, in the form YYYY-MM-DD. Typically used with SourceIPs for new IPs, to gradually build up reputation. Days are in UTC."`
+	WarmupMessagesPerDay []int    `sconf:"optional" sconf-doc:"Maximum number of messages per day during warm-up. The first value is for the day of WarmupStart, the next for the day after, etc. Before WarmupStart, the first value applies. After the last value, no daily limit applies. Example: 50, 100, 200, 400, 800, 1600, 3200."`
+
+	RecipientDomainsASCII []string  `sconf:"-" json:"-"`
+	MXHostsASCII          []string  `sconf:"-" json:"-"`
+	IPs                   []net.IP  `sconf:"-" json:"-"` // Parsed form of SourceIPs.
+	WarmupStartDay        time.Time `sconf:"-" json:"-"` // Parsed form of WarmupStart, in UTC.
+}
+
 type Domain struct {
 	Description                string           `sconf:"optional" sconf-doc:"Free-form description of domain."`
 	ClientSettingsDomain       string           `sconf:"optional" sconf-doc:"Hostname for client settings instead of the mail server hostname. E.g. mail.<domain>. For future migration to another mail operator without requiring all clients to update their settings, it is convenient to have client settings that reference a subdomain of the hosted domain instead of the hostname of the server where the mail is currently hosted. If empty, the hostname of the mail server is used for client configurations. Unicode name."`
@@ -295,19 +399,23 @@ type Domain struct {
 	ReportsOnly bool `sconf:"-" json:"-"`
 }
 
-// todo: allow external addresses as members of aliases. we would add messages for them to the queue for outgoing delivery. we should require an admin addresses to which delivery failures will be delivered (locally, and to use in smtp mail from, so dsns go there). also take care to evaluate smtputf8 (if external address requires utf8 and incoming transaction didn't).
 // todo: as alternative to PostPublic, allow specifying a list of addresses (dmarc-like verified) that are (the only addresses) allowed to post to the list. if msgfrom is an external address, require a valid dkim signature to prevent dmarc-policy-related issues when delivering to remote members.
 // todo: add option to require messages sent to an alias have that alias as From or Reply-To address?
 
 type Alias struct {
-	Addresses    []string `sconf-doc:"Expanded addresses to deliver to. These must currently be of addresses of local accounts. To prevent duplicate messages, a member address that is also an explicit recipient in the SMTP transaction will only have the message delivered once. If the address in the message From header is a member, that member also won't receive the message."`
-	PostPublic   bool     `sconf:"optional" sconf-doc:"If true, anyone can send messages to the list. Otherwise only members, based on message From address, which is assumed to be DMARC-like-verified."`
-	ListMembers  bool     `sconf:"optional" sconf-doc:"If true, members can see addresses of members."`
-	AllowMsgFrom bool     `sconf:"optional" sconf-doc:"If true, members are allowed to send messages with this alias address in the message From header."`
+	Addresses      []string      `sconf-doc:"Expanded addresses to deliver to. Addresses of local accounts, or, if ListOwner is set, also external addresses, for which messages are added to the queue for delivery. To prevent duplicate messages, a member address that is also an explicit recipient in the SMTP transaction will only have the message delivered once. If the address in the message From header is a member, that member also won't receive the message."`
+	PostPublic     bool          `sconf:"optional" sconf-doc:"If true, anyone can send messages to the list. Otherwise only members, based on message From address, which is assumed to be DMARC-like-verified."`
+	ListMembers    bool          `sconf:"optional" sconf-doc:"If true, members can see addresses of members."`
+	AllowMsgFrom   bool          `sconf:"optional" sconf-doc:"If true, members are allowed to send messages with this alias address in the message From header."`
+	ListOwner      string        `sconf:"optional" sconf-doc:"Address of a local account that manages the alias as mailing list. Required for external member addresses, subscriptions by email, moderation and digests. Messages to external members are sent with a per-member SMTP MAIL FROM address at the alias domain, localpart <alias>-bounces-<member>, so bounces can be matched to members, whose addresses are then added to the suppression list of the account of the list owner. Messages to external members get List-* headers, e.g. for unsubscribing. Messages sent to <alias>-owner are delivered to the list owner."`
+	Subscribe      bool          `sconf:"optional" sconf-doc:"If true, anyone can subscribe to the list by sending a message to <alias>-subscribe (or <alias>-subscribe-digest for digest mode), and unsubscribe by sending a message to <alias>-unsubscribe. Each request must be confirmed by replying to an email sent to the address. Requires ListOwner."`
+	Moderate       bool          `sconf:"optional" sconf-doc:"If true, messages from non-members to a list that doesn't allow public posting are held for moderation instead of rejected. The list owner is notified by email, and can approve or reject a message by sending a reply to the approve or reject address. Requires ListOwner."`
+	DigestInterval time.Duration `sconf:"optional" sconf-doc:"For members that subscribed in digest mode: Interval between digest messages that combine messages to the list. Default 24h."`
 
 	LocalpartStr    string         `sconf:"-"` // In encoded form.
 	Domain          dns.Domain     `sconf:"-"`
-	ParsedAddresses []AliasAddress `sconf:"-"` // Matches addresses.
+	ParsedAddresses []AliasAddress `sconf:"-"` // Matches addresses. AccountName is empty for external addresses.
+	ParsedListOwner AliasAddress   `sconf:"-"` // If ListOwner is set.
 }
 
 type AliasAddress struct {
@@ -375,6 +483,7 @@ type Route struct {
 	ToDomain        []string `sconf:"optional" sconf-doc:"Like FromDomain, but matching against the envelope to domain."`
 	MinimumAttempts int      `sconf:"optional" sconf-doc:"Matches if at least this many deliveries have already been attempted. This can be used to attempt sending through a smarthost when direct delivery has failed for several times."`
 	Transport       string   `sconf:"The transport used for delivering the message that matches requirements of the above fields."`
+	IPPool          string   `sconf:"optional" sconf-doc:"Name of an IP pool of the direct transport of this route, to make outgoing connections from. E.g. for routes of accounts or domains sending newsletters."`
 
 	// todo future: add ToMX, where we look up the MX record of the destination domain and check (the first, any, all?) mx host against the values in ToMX.
 
@@ -430,6 +539,8 @@ type Account struct {
 	MaxFirstTimeRecipientsPerDay int                    `sconf:"optional" sconf-doc:"Maximum number of first-time recipients in outgoing messages for this account in a 24 hour window. This limits the damage to recipients and the reputation of this mail server in case of account compromise. Default 200."`
 	NoFirstTimeSenderDelay       bool                   `sconf:"optional" sconf-doc:"Do not apply a delay to SMTP connections before accepting an incoming message from a first-time sender. Can be useful for accounts that sends automated responses and want instant replies."`
 	Routes                       []Route                `sconf:"optional" sconf-doc:"Routes for delivering outgoing messages through the queue. Each delivery attempt evaluates these account routes, domain routes and finally global routes. The transport of the first matching route is used in the delivery attempt. If no routes match, which is the default with no configured routes, messages are delivered directly from the queue."`
+	IPPools                      []string               `sconf:"optional" sconf-doc:"IP pools of direct transports that may be selected in webapi Send requests for messages from this account. Requests with other IP pools are rejected. Routes can use any IP pool, regardless of this list."`
+	EncryptMessages              bool                   `sconf:"optional" sconf-doc:"Encrypt messages at rest. New messages are encrypted with a key pair of the account, created at the next login with password or password change. The private key is protected with the account password, and is only available to mox after a login with the password in plain text, e.g. at the account or webmail web interface, or IMAP/SMTP with authentication mechanism PLAIN or LOGIN (not SCRAM-*, CRAM-MD5, app passwords or OAuth tokens). Until then, after each restart, messages can be delivered but not read. An administrator cannot set a new password for an account with encrypted messages unless the account is unlocked, the messages would become unreadable. Message files are encrypted, and in the account database the parsed message headers and structure. Message-ID and subject are stored as hashes, for matching threads. Encrypted messages are not added to the full-text index. The database is needed for deliveries while the account is locked, so other message metadata remains in plain text: SMTP envelope and From addresses, remote IPs and domains used for reputation, recipient addresses of sent messages, flags, sizes and times, and mailbox names. Messages delivered before the key was created can be encrypted with \"mox encryptmessages\". Cannot be used with ExternalAuth: passwords in the external backend can change, and the key would no longer be accessible. Disabling encryption stops encrypting new messages, their Message-ID and subject are still stored as hashes."`
 
 	DNSDomain                  dns.Domain     `sconf:"-"` // Parsed form of Domain.
 	JunkMailbox                *regexp.Regexp `sconf:"-" json:"-"`
@@ -480,8 +591,7 @@ type Ruleset struct {
 	HeadersRegexp      map[string]string `sconf:"optional" sconf-doc:"Matches if these header field/value regular expressions all match (substrings of) the message headers. Header fields and valuees are converted to lower case before matching. Whitespace is trimmed from the value before matching. A header field can occur multiple times in a message, only one instance has to match. For mailing lists, you could match on ^list-id$ with the value typically the mailing list address in angled brackets with @ replaced with a dot, e.g. <name\\.lists\\.example\\.org>."`
 	// todo: add a SMTPRcptTo check
 
-	// todo: once we implement ARC, we can use dkim domains that we cannot verify but that the arc-verified forwarding mail server was able to verify.
-	IsForward              bool   `sconf:"optional" sconf-doc:"Influences spam filtering only, this option does not change whether a message matches this ruleset. Can only be used together with SMTPMailFromRegexp and VerifiedDomain. SMTPMailFromRegexp must be set to the address used to deliver the forwarded message, e.g. '^user(|\\+.*)@forward\\.example$'. Changes to junk analysis: 1. Messages are not rejected for failing a DMARC policy, because a legitimate forwarded message without valid/intact/aligned DKIM signature would be rejected because any verified SPF domain will be 'unaligned', of the forwarding mail server. 2. The sending mail server IP address, and sending EHLO and MAIL FROM domains and matching DKIM domain aren't used in future reputation-based spam classifications (but other verified DKIM domains are) because the forwarding server is not a useful spam signal for future messages."`
+	IsForward              bool   `sconf:"optional" sconf-doc:"Influences spam filtering only, this option does not change whether a message matches this ruleset. Can only be used together with SMTPMailFromRegexp and VerifiedDomain. SMTPMailFromRegexp must be set to the address used to deliver the forwarded message, e.g. '^user(|\\+.*)@forward\\.example$'. Changes to junk analysis: 1. Messages are not rejected for failing a DMARC policy, because a legitimate forwarded message without valid/intact/aligned DKIM signature would be rejected because any verified SPF domain will be 'unaligned', of the forwarding mail server. 2. The sending mail server IP address, and sending EHLO and MAIL FROM domains and matching DKIM domain aren't used in future reputation-based spam classifications (but other verified DKIM domains are) because the forwarding server is not a useful spam signal for future messages. 3. If the forwarding mail server sealed the message with a valid ARC chain, the DKIM domains it verified are used in reputation-based spam classification as if verified by us."`
 	ListAllowDomain        string `sconf:"optional" sconf-doc:"Influences spam filtering only, this option does not change whether a message matches this ruleset. If this domain matches an SPF- and/or DKIM-verified (sub)domain, the message is accepted without further spam checks, such as a junk filter or DMARC reject evaluation. DMARC rejects should not apply for mailing lists that are not configured to rewrite the From-header of messages that don't have a passing DKIM signature of the From-domain. Otherwise, by rejecting messages, you may be automatically unsubscribed from the mailing list. The assumption is that mailing lists do their own spam filtering/moderation."`
 	AcceptRejectsToMailbox string `sconf:"optional" sconf-doc:"Influences spam filtering only, this option does not change whether a message matches this ruleset. If a message is classified as spam, it isn't rejected during the SMTP transaction (the normal behaviour), but accepted during the SMTP transaction and delivered to the specified mailbox. The specified mailbox is not automatically cleaned up like the account global Rejects mailbox, unless set to that Rejects mailbox."`
 
@@ -618,7 +728,7 @@ func (wf WebForward) equal(o WebForward) bool {
 
 type WebInternal struct {
 	BasePath string `sconf-doc:"Path to use as root of internal service, e.g. /webmail/."`
-	Service  string `sconf-doc:"Name of the service, values: admin, account, webmail, webapi."`
+	Service  string `sconf-doc:"Name of the service, values: admin, account, webmail, webapi, jmap, carddav."`
 
 	Handler http.Handler `sconf:"-" json:"-"`
 }
@@ -142,6 +142,101 @@ See https://pkg.go.dev/github.com/mjl-/sconf for details.
 	# pages (if enabled). (optional)
 	AdminPasswordFile:
 
+	# Verify account passwords with an external authentication backend, such as an
+	# LDAP directory, instead of only with the passwords set in accounts. External
+	# authentication only works with authentication mechanisms that send the plain
+	# text password (PLAIN and LOGIN, and for the web interfaces and webapi), not with
+	# SCRAM-SHA-* or CRAM-MD5, which need a password set in the account. Successful
+	# authentications are cached for up to 15 minutes. (optional)
+	ExternalAuth:
+
+		# Verify passwords with a simple bind to an LDAP server. (optional)
+		LDAP:
+
+			# URL of LDAP server, with scheme ldap or ldaps, e.g. ldaps://ldap.example.com.
+			# Default port is 389 for ldap and 636 for ldaps. Server certificates are verified
+			# against the system CA certificates, or those configured in TLS.CA.
+			URL:
+
+			# For ldap URLs, switch to TLS with StartTLS before binding. Recommended if the
+			# LDAP server is not on the same machine. (optional)
+			StartTLS: false
+
+			# Template for the distinguished name to bind as. Placeholders {email},
+			# {localpart}, {domain} and {account} are replaced with the (escaped) email
+			# address used for logging in, its localpart and domain, and the mox account name.
+			# Example: uid={localpart},ou=people,dc=example,dc=com. With Active Directory, the
+			# user principal name can often be used directly: {email}.
+			BindDN:
+
+			# Timeout for connecting and binding. Default 10s. (optional)
+			Timeout: 0s
+
+		# Verify passwords by running a helper command. (optional)
+		Exec:
+
+			# Command and arguments to run for each authentication attempt. The email address
+			# and password are written to the standard input of the command, each followed by
+			# a newline. Environment variable MOX_ACCOUNT is set to the account name. Exit
+			# status 0 means the password is valid, exit status 1 that it is invalid. Other
+			# exit statuses are treated as temporary errors.
+			Command:
+				-
+
+			# Timeout for the command, it is killed when exceeded. Default 10s. (optional)
+			Timeout: 0s
+
+		# Also accept the password set in an account, which is checked first. The
+		# SCRAM-SHA-* and CRAM-MD5 authentication mechanisms are only offered if local
+		# passwords are enabled. Useful for accounts that are not in the directory.
+		# (optional)
+		LocalPasswords: false
+
+	# Authenticate with OAuth 2.0 bearer tokens from an OpenID Connect identity
+	# provider, for single sign-on. Enables the OAUTHBEARER and XOAUTH2 authentication
+	# mechanisms for IMAP and SMTP submission, and if a ClientID is configured,
+	# logging in to webmail and the account web interface through the identity
+	# provider. Tokens must be JWTs signed by the identity provider. (optional)
+	OIDC:
+
+		# Issuer of tokens, must match the "iss" claim. The issuer URL is also used to
+		# discover the JWKS and the endpoints for web login, at
+		# <issuer>/.well-known/openid-configuration.
+		Issuer:
+
+		# URL of the JSON Web Key Set with the keys for verifying token signatures. If not
+		# set, the URL is discovered through the issuer. Keys are refreshed hourly, and
+		# when a token with an unknown key ID is seen. (optional)
+		JWKSURL:
+
+		# File with the JSON Web Key Set, instead of fetching it from JWKSURL. Relative to
+		# the config directory. The file is read again when it changes. Useful for testing
+		# without an identity provider. (optional)
+		JWKSFile:
+
+		# Value that must be present in the "aud" claim of tokens. Defaults to ClientID.
+		# Audience or ClientID is required. (optional)
+		Audience:
+
+		# Claim with the email address that is used to find the mox account. Default
+		# "email". If the claim is "email", the token must also have an "email_verified"
+		# claim that is true. (optional)
+		Claim:
+
+		# OAuth client ID registered at the identity provider, for logging in to webmail
+		# and the account web interface with the authorization code flow. The redirect URI
+		# to register is the path of the web interface followed by "oidc", e.g.
+		# https://mail.example.org/webmail/oidc. Web login is only enabled if a client ID
+		# is configured. (optional)
+		ClientID:
+
+		# OAuth client secret for ClientID, if the identity provider requires one.
+		# (optional)
+		ClientSecret:
+
+		# Timeout for requests to the identity provider. Default 10s. (optional)
+		Timeout: 0s
+
 	# Listeners are groups of IP addresses and services enabled on those IP addresses,
 	# such as SMTP/IMAP or internal endpoints for administration or Prometheus
 	# metrics. All listeners with SMTP/IMAP services enabled will serve all configured
@@ -259,6 +354,51 @@ See https://pkg.go.dev/github.com/mjl-/sconf for details.
 				# account. Default: 15s. (optional)
 				FirstTimeSenderDelay: 0s
 
+				# Milters (mail filters, Sendmail milter protocol version 6) to pass incoming
+				# messages through, e.g. external spam/virus scanners such as rspamd, ClamAV,
+				# OpenDKIM. Milters are consulted in order at connect, HELO/EHLO, MAIL FROM, RCPT
+				# TO and at the end of the message data, before delivery. Milters can accept,
+				# reject, temporarily reject or discard messages, add and change header fields,
+				# and quarantine messages, which delivers them to the Junk mailbox. (optional)
+				Milters:
+					-
+
+						# Address of the milter. Either unix:/path/to/socket for a unix domain socket, or
+						# inet:port@host, inet6:port@host or host:port for TCP.
+						Address:
+
+						# Timeout for connecting to the milter and for each command. Default 30s.
+						# (optional)
+						Timeout: 0s
+
+						# What to do when the milter cannot be reached or returns an error: tempfail
+						# (default) temporarily rejects the SMTP command, accept continues as if the
+						# milter was not configured, reject permanently rejects the SMTP command.
+						# (optional)
+						OnError:
+
+			# LMTP (RFC 2033) for final delivery of messages to local accounts by a trusted
+			# MTA, e.g. Postfix, or content filter. SPF, DKIM and DMARC are not evaluated and
+			# reputation is not used, the LMTP client is assumed to have done its checks.
+			# Sieve scripts, rulesets, junk filtering and quota still apply. After DATA, a
+			# response is sent for each accepted recipient. (optional)
+			LMTP:
+				Enabled: false
+
+				# Default 24. Set to -1 to not listen on TCP, e.g. when only UnixSocket is used.
+				# (optional)
+				Port: 0
+
+				# If set, also listen on a unix domain socket at this path, relative to the data
+				# directory if not absolute. The socket is created with mode 0660. (optional)
+				UnixSocket:
+
+				# IP addresses or networks in CIDR notation allowed to connect over TCP. Default
+				# is loopback IPs only. Connections over the unix domain socket are always
+				# allowed. (optional)
+				TrustedNetworks:
+					-
+
 			# SMTP for submitting email, e.g. by email applications. Starts out in plain text,
 			# can be upgraded to TLS with the STARTTLS command. Prefer using Submissions which
 			# is always a TLS connection. (optional)
@@ -301,6 +441,41 @@ See https://pkg.go.dev/github.com/mjl-/sconf for details.
 				# Default 993. (optional)
 				Port: 0
 
+			# POP3 for retrieving email from the Inbox, by email applications and devices that
+			# don't support IMAP. Starts out in plain text, can be upgraded to TLS with the
+			# STLS command. Prefer using POP3S instead which is always a TLS connection.
+			# (optional)
+			POP3:
+				Enabled: false
+
+				# Default 110. (optional)
+				Port: 0
+
+				# Enable this only when the connection is otherwise encrypted (e.g. through a
+				# VPN). (optional)
+				NoRequireSTARTTLS: false
+
+			# POP3 over TLS for retrieving email from the Inbox, by email applications and
+			# devices that don't support IMAP. Requires a TLS config. (optional)
+			POP3S:
+				Enabled: false
+
+				# Default 995. (optional)
+				Port: 0
+
+			# ManageSieve for managing Sieve scripts that filter incoming email, by email
+			# applications. Starts out in plain text, can be upgraded to TLS with the STARTTLS
+			# command. (optional)
+			ManageSieve:
+				Enabled: false
+
+				# Default 4190. (optional)
+				Port: 0
+
+				# Enable this only when the connection is otherwise encrypted (e.g. through a
+				# VPN). (optional)
+				NoRequireSTARTTLS: false
+
 			# Account web interface, for email users wanting to change their accounts, e.g.
 			# set new password, set new delivery rulesets. Default path is /. (optional)
 			AccountHTTP:
@@ -430,6 +605,70 @@ See https://pkg.go.dev/github.com/mjl-/sconf for details.
 				# limiting and for the "secure" status of cookies. (optional)
 				Forwarded: false
 
+			# Like JMAPHTTPS, but with plain HTTP, without TLS. (optional)
+			JMAPHTTP:
+				Enabled: false
+
+				# Default 80 for HTTP and 443 for HTTPS. See Hostname at Listener for hostname
+				# matching behaviour. (optional)
+				Port: 0
+
+				# Path to serve requests on. (optional)
+				Path:
+
+				# If set, X-Forwarded-* headers are used for the remote IP address for rate
+				# limiting and for the "secure" status of cookies. (optional)
+				Forwarded: false
+
+			# JMAP, the JSON Meta Application Protocol for email (RFC 8620 and 8621), with
+			# HTTPS (requires a TLS config). Default path is /jmap/. (optional)
+			JMAPHTTPS:
+				Enabled: false
+
+				# Default 80 for HTTP and 443 for HTTPS. See Hostname at Listener for hostname
+				# matching behaviour. (optional)
+				Port: 0
+
+				# Path to serve requests on. (optional)
+				Path:
+
+				# If set, X-Forwarded-* headers are used for the remote IP address for rate
+				# limiting and for the "secure" status of cookies. (optional)
+				Forwarded: false
+
+			# Like CardDAVHTTPS, but with plain HTTP, without TLS. (optional)
+			CardDAVHTTP:
+				Enabled: false
+
+				# Default 80 for HTTP and 443 for HTTPS. See Hostname at Listener for hostname
+				# matching behaviour. (optional)
+				Port: 0
+
+				# Path to serve requests on. (optional)
+				Path:
+
+				# If set, X-Forwarded-* headers are used for the remote IP address for rate
+				# limiting and for the "secure" status of cookies. (optional)
+				Forwarded: false
+
+			# CardDAV server for synchronizing contacts in address books of accounts (RFC
+			# 6352), with HTTPS (requires a TLS config). Clients authenticate with HTTP basic
+			# authentication with an email address and password. Default path is /carddav/.
+			# (optional)
+			CardDAVHTTPS:
+				Enabled: false
+
+				# Default 80 for HTTP and 443 for HTTPS. See Hostname at Listener for hostname
+				# matching behaviour. (optional)
+				Port: 0
+
+				# Path to serve requests on. (optional)
+				Path:
+
+				# If set, X-Forwarded-* headers are used for the remote IP address for rate
+				# limiting and for the "secure" status of cookies. (optional)
+				Forwarded: false
+
 			# Serve prometheus metrics, for monitoring. You should not enable this on a public
 			# IP. (optional)
 			MetricsHTTP:
@@ -694,6 +933,78 @@ See https://pkg.go.dev/github.com/mjl-/sconf for details.
 				# remote SMTP servers. (optional)
 				DisableIPv6: false
 
+				# Named pools of local IPs to make outgoing connections from, e.g. to keep
+				# transactional messages and newsletters apart, so complaints about one don't hurt
+				# delivery of the other. A pool is selected by a route with this transport, or
+				# with a webapi Send request for an account that lists the pool in its IPPools.
+				# Pool names must be unique over all transports. Without a selected pool, outgoing
+				# connections are made as with regular direct delivery. (optional)
+				IPPools:
+					x:
+
+						# IPs to connect from. Connections are made from the IPs of the address family of
+						# the remote IP in turn, skipping IPs that are rate limited. Remote IPs of an
+						# address family without IPs in the pool are not used.
+						IPs:
+							-
+
+								# Local IP address, must be configured on this machine.
+								IP:
+
+								# Hostname used in SMTP EHLO for connections from this IP. The reverse DNS (PTR)
+								# record of the IP must resolve to this hostname, and the hostname must resolve to
+								# the IP. The hostname should be covered by the SPF records of the sending
+								# domains.
+								Hostname:
+
+	# Limits for deliveries from the queue, e.g. to prevent being throttled by large
+	# mail providers when sending many messages, or to gradually warm up new IPs. Each
+	# limit applies to recipient domains, MX hosts or source IPs. Messages that would
+	# exceed a limit stay in the queue and are attempted again when the limit allows,
+	# without counting as a failed delivery attempt. The key is a name for the limit,
+	# shown in the queue in the admin web interface. (optional)
+	OutgoingRateLimits:
+		x:
+
+			# Recipient domains the limit applies to, for all transports. If a domain starts
+			# with a dot, subdomains also match, e.g. .example.com matches example.com and
+			# mail.example.com. (optional)
+			RecipientDomains:
+				-
+
+			# Host names of MX targets the limit applies to, e.g. .google.com for all hosts
+			# under google.com. Only for direct delivery. (optional)
+			MXHosts:
+				-
+
+			# Local IP addresses the limit applies to. Only for direct delivery, and only when
+			# the source IP of outgoing connections is known before connecting, i.e. when SMTP
+			# listeners are configured with specific IPs instead of 0.0.0.0 or ::. (optional)
+			SourceIPs:
+				-
+
+			# Maximum number of messages delivered per minute, combined for all domains, hosts
+			# or IPs of the limit. Each recipient counts as a message. A delivery attempt for
+			# a message with more recipients than the limit is allowed when no messages were
+			# delivered in the past minute. Zero means no limit. (optional)
+			MessagesPerMinute: 0
+
+			# Maximum number of concurrent outgoing connections, or concurrent delivery
+			# attempts for limits on recipient domains. Zero means no limit. (optional)
+			MaxConnections: 0
+
+			# Date the warm-up schedule starts, in the form YYYY-MM-DD. Typically used with
+			# SourceIPs for new IPs, to gradually build up reputation. Days are in UTC.
+			# (optional)
+			WarmupStart:
+
+			# Maximum number of messages per day during warm-up. The first value is for the
+			# day of WarmupStart, the next for the day after, etc. Before WarmupStart, the
+			# first value applies. After the last value, no daily limit applies. Example: 50,
+			# 100, 200, 400, 800, 1600, 3200. (optional)
+			WarmupMessagesPerDay:
+				- 0
+
 	# Do not send DMARC reports (aggregate only). By default, aggregate reports on
 	# DMARC evaluations are sent to domains if their DMARC policy requests them.
 	# Reports are sent at whole hours, with a minimum of 1 hour and maximum of 24
@@ -725,6 +1036,17 @@ See https://pkg.go.dev/github.com/mjl-/sconf for details.
 	# (optional)
 	QuotaMessageSize: 0
 
+	# Domains of intermediary mail servers, e.g. mailing lists and forwarding
+	# services, whose ARC seals are trusted. If an incoming message fails DMARC, but
+	# has a valid ARC chain most recently sealed by one of these domains, the DMARC
+	# policy is not applied, assuming the intermediary modified the message but
+	# verified the original authentication results. DKIM-verified domains recorded by
+	# a trusted sealer are also used for forwarded messages in rulesets. Independent
+	# of this option, messages redirected by Sieve scripts are ARC-sealed with the
+	# first configured DKIM selector of the domain that has an RSA key. (optional)
+	TrustedARCSealers:
+		-
+
 # domains.conf
 
 	# NOTE: This config file is in 'sconf' format. Indent with tabs. Comments must be
@@ -924,14 +1246,20 @@ See https://pkg.go.dev/github.com/mjl-/sconf for details.
 					MinimumAttempts: 0
 					Transport:
 
+					# Name of an IP pool of the direct transport of this route, to make outgoing
+					# connections from. E.g. for routes of accounts or domains sending newsletters.
+					# (optional)
+					IPPool:
+
 			# Aliases that cause messages to be delivered to one or more locally configured
 			# addresses. Keys are localparts (encoded, as they appear in email addresses).
 			# (optional)
 			Aliases:
 				x:
 
-					# Expanded addresses to deliver to. These must currently be of addresses of local
-					# accounts. To prevent duplicate messages, a member address that is also an
+					# Expanded addresses to deliver to. Addresses of local accounts, or, if ListOwner
+					# is set, also external addresses, for which messages are added to the queue for
+					# delivery. To prevent duplicate messages, a member address that is also an
 					# explicit recipient in the SMTP transaction will only have the message delivered
 					# once. If the address in the message From header is a member, that member also
 					# won't receive the message.
@@ -949,6 +1277,32 @@ See https://pkg.go.dev/github.com/mjl-/sconf for details.
 					# message From header. (optional)
 					AllowMsgFrom: false
 
+					# Address of a local account that manages the alias as mailing list. Required for
+					# external member addresses, subscriptions by email, moderation and digests.
+					# Messages to external members are sent with a per-member SMTP MAIL FROM address
+					# at the alias domain, localpart <alias>-bounces-<member>, so bounces can be
+					# matched to members, whose addresses are then added to the suppression list of
+					# the account of the list owner. Messages to external members get List-* headers,
+					# e.g. for unsubscribing. Messages sent to <alias>-owner are delivered to the list
+					# owner. (optional)
+					ListOwner:
+
+					# If true, anyone can subscribe to the list by sending a message to
+					# <alias>-subscribe (or <alias>-subscribe-digest for digest mode), and unsubscribe
+					# by sending a message to <alias>-unsubscribe. Each request must be confirmed by
+					# replying to an email sent to the address. Requires ListOwner. (optional)
+					Subscribe: false
+
+					# If true, messages from non-members to a list that doesn't allow public posting
+					# are held for moderation instead of rejected. The list owner is notified by
+					# email, and can approve or reject a message by sending a reply to the approve or
+					# reject address. Requires ListOwner. (optional)
+					Moderate: false
+
+					# For members that subscribed in digest mode: Interval between digest messages
+					# that combine messages to the list. Default 24h. (optional)
+					DigestInterval: 0s
+
 	# Accounts represent mox users, each with a password and email address(es) to
 	# which email can be delivered (possibly at different domains). Each account has
 	# its own on-disk directory holding its messages and index database. An account
@@ -1069,7 +1423,9 @@ See https://pkg.go.dev/github.com/mjl-/sconf for details.
 							# and MAIL FROM domains and matching DKIM domain aren't used in future
 							# reputation-based spam classifications (but other verified DKIM domains are)
 							# because the forwarding server is not a useful spam signal for future messages.
-							# (optional)
+							# 3. If the forwarding mail server sealed the message with a valid ARC chain, the
+							# DKIM domains it verified are used in reputation-based spam classification as if
+							# verified by us. (optional)
 							IsForward: false
 
 							# Influences spam filtering only, this option does not change whether a message
@@ -1231,6 +1587,39 @@ See https://pkg.go.dev/github.com/mjl-/sconf for details.
 					MinimumAttempts: 0
 					Transport:
 
+					# Name of an IP pool of the direct transport of this route, to make outgoing
+					# connections from. E.g. for routes of accounts or domains sending newsletters.
+					# (optional)
+					IPPool:
+
+			# IP pools of direct transports that may be selected in webapi Send requests for
+			# messages from this account. Requests with other IP pools are rejected. Routes
+			# can use any IP pool, regardless of this list. (optional)
+			IPPools:
+				-
+
+			# Encrypt messages at rest. New messages are encrypted with a key pair of the
+			# account, created at the next login with password or password change. The private
+			# key is protected with the account password, and is only available to mox after a
+			# login with the password in plain text, e.g. at the account or webmail web
+			# interface, or IMAP/SMTP with authentication mechanism PLAIN or LOGIN (not
+			# SCRAM-*, CRAM-MD5, app passwords or OAuth tokens). Until then, after each
+			# restart, messages can be delivered but not read. An administrator cannot set a
+			# new password for an account with encrypted messages unless the account is
+			# unlocked, the messages would become unreadable. Message files are encrypted, and
+			# in the account database the parsed message headers and structure. Message-ID and
+			# subject are stored as hashes, for matching threads. Encrypted messages are not
+			# added to the full-text index. The database is needed for deliveries while the
+			# account is locked, so other message metadata remains in plain text: SMTP
+			# envelope and From addresses, remote IPs and domains used for reputation,
+			# recipient addresses of sent messages, flags, sizes and times, and mailbox names.
+			# Messages delivered before the key was created can be encrypted with "mox
+			# encryptmessages". Cannot be used with ExternalAuth: passwords in the external
+			# backend can change, and the key would no longer be accessible. Disabling
+			# encryption stops encrypting new messages, their Message-ID and subject are still
+			# stored as hashes. (optional)
+			EncryptMessages: false
+
 	# Redirect all requests from domain (key) to domain (value). Always redirects to
 	# HTTPS. For plain HTTP redirects, use a WebHandler with a WebRedirect. (optional)
 	WebDomainRedirects:
@@ -1365,7 +1754,7 @@ See https://pkg.go.dev/github.com/mjl-/sconf for details.
 				# Path to use as root of internal service, e.g. /webmail/.
 				BasePath:
 
-				# Name of the service, values: admin, account, webmail, webapi.
+				# Name of the service, values: admin, account, webmail, webapi, jmap, carddav.
 				Service:
 
 	# Routes for delivering outgoing messages through the queue. Each delivery attempt
@@ -1392,6 +1781,11 @@ See https://pkg.go.dev/github.com/mjl-/sconf for details.
 			MinimumAttempts: 0
 			Transport:
 
+			# Name of an IP pool of the direct transport of this route, to make outgoing
+			# connections from. E.g. for routes of accounts or domains sending newsletters.
+			# (optional)
+			IPPool:
+
 	# DNS blocklists to periodically check with if IPs we send from are present,
 	# without using them for checking incoming deliveries.. Also see DNSBLs in SMTP
 	# listeners in mox.conf, which specifies DNSBLs to use both for incoming
@@ -12,6 +12,7 @@ import (
 	"maps"
 	"net"
 	"os"
+	"os/user"
 	"path/filepath"
 	"runtime/debug"
 	"sort"
@@ -21,6 +22,7 @@ import (
 
 	"github.com/mjl-/bstore"
 
+	"github.com/mjl-/mox/admindb"
 	"github.com/mjl-/mox/config"
 	"github.com/mjl-/mox/dns"
 	"github.com/mjl-/mox/message"
@@ -28,9 +30,11 @@ import (
 	"github.com/mjl-/mox/mlog"
 	"github.com/mjl-/mox/mox-"
 	"github.com/mjl-/mox/queue"
+	"github.com/mjl-/mox/sieve"
 	"github.com/mjl-/mox/smtp"
 	"github.com/mjl-/mox/store"
 	"github.com/mjl-/mox/webapi"
+	"github.com/mjl-/mox/webauth"
 )
 
 // ctl represents a connection to the ctl unix domain socket of a running mox instance.
@@ -41,6 +45,14 @@ type ctl struct {
 	r    *bufio.Reader // Set for first reader.
 	x    any           // If set, errors are handled by calling panic(x) instead of log.Fatal.
 	log  mlog.Log      // If set, along with x, logging is done here.
+
+	// For server-side, if set, the connection is from a unix user associated with this
+	// admin user, and commands are limited to its role. If nil, all commands are
+	// allowed.
+	admin *admindb.User
+
+	// For server-side, the unix user of the peer, if known. Recorded in the audit log.
+	unixUser string
 }
 
 // xctl opens a ctl connection.
@@ -274,12 +286,192 @@ func (s *ctlreader) xcheck(err error, msg string) {
 	}
 }
 
+// ctlPermissions is the permission an admin user needs for each ctl command. For
+// commands requiring PermDomainRead or PermDomainChange, the command checks access
+// to the domain, account or address for domain admins. Commands not listed cannot
+// be used by admin users.
+var ctlPermissions = map[string]admindb.Permission{
+	"stop":                     admindb.PermAdmin,
+	"deliver":                  admindb.PermAdmin,
+	"setaccountpassword":       admindb.PermDomainChange,
+	"queueholdruleslist":       admindb.PermRead,
+	"queueholdrulesadd":        admindb.PermQueue,
+	"queueholdrulesremove":     admindb.PermQueue,
+	"queuelist":                admindb.PermRead,
+	"queueholdset":             admindb.PermQueue,
+	"queueschedule":            admindb.PermQueue,
+	"queuetransport":           admindb.PermQueue,
+	"queuerequiretls":          admindb.PermQueue,
+	"queuefail":                admindb.PermQueue,
+	"queuedrop":                admindb.PermQueue,
+	"queuedump":                admindb.PermQueue,
+	"queueretiredlist":         admindb.PermRead,
+	"queueretiredprint":        admindb.PermRead,
+	"queuehooklist":            admindb.PermRead,
+	"queuehookschedule":        admindb.PermQueue,
+	"queuehookcancel":          admindb.PermQueue,
+	"queuehookprint":           admindb.PermRead,
+	"queuehookretiredlist":     admindb.PermRead,
+	"queuehookretiredprint":    admindb.PermRead,
+	"queuesuppresslist":        admindb.PermRead,
+	"queuesuppressadd":         admindb.PermQueue,
+	"queuesuppressremove":      admindb.PermQueue,
+	"queuesuppresslookup":      admindb.PermRead,
+	"importmaildir":            admindb.PermAdmin,
+	"importmbox":               admindb.PermAdmin,
+	"domainadd":                admindb.PermAdmin,
+	"domainrm":                 admindb.PermAdmin,
+	"accountadd":               admindb.PermDomainChange,
+	"accountrm":                admindb.PermDomainChange,
+	"addressadd":               admindb.PermDomainChange,
+	"addressrm":                admindb.PermDomainChange,
+	"aliaslist":                admindb.PermDomainRead,
+	"aliasprint":               admindb.PermDomainRead,
+	"aliasadd":                 admindb.PermDomainChange,
+	"aliasupdate":              admindb.PermDomainChange,
+	"aliasrm":                  admindb.PermDomainChange,
+	"aliasaddaddr":             admindb.PermDomainChange,
+	"aliasrmaddr":              admindb.PermDomainChange,
+	"loglevels":                admindb.PermRead,
+	"setloglevels":             admindb.PermAdmin,
+	"retrain":                  admindb.PermAdmin,
+	"recalculatemailboxcounts": admindb.PermAdmin,
+	"fixmsgsize":               admindb.PermAdmin,
+	"reparse":                  admindb.PermAdmin,
+	"reindex":                  admindb.PermAdmin,
+	"encryptmessages":          admindb.PermAdmin,
+	"reassignthreads":          admindb.PermAdmin,
+	"backup":                   admindb.PermAdmin,
+	"adminuserlist":            admindb.PermAdmin,
+	"adminuseradd":             admindb.PermAdmin,
+	"adminusersave":            admindb.PermAdmin,
+	"adminusersetpassword":     admindb.PermAdmin,
+	"adminusertotpdisable":     admindb.PermAdmin,
+	"adminuserrm":              admindb.PermAdmin,
+	"auditlog":                 admindb.PermRead,
+}
+
+// ctlAdmin returns the unix user of the process on the other side of the ctl
+// connection if known, and the admin user associated with it, limiting the
+// commands that can be executed. Connections by root and by the unix user mox
+// runs as are not limited, returning a nil admin user. For other peers, see
+// ctlUnmapped. Peers can currently only be identified on Linux.
+func ctlAdmin(ctx context.Context, log mlog.Log, conn net.Conn) (string, *admindb.User) {
+	uid, err := ctlPeerUID(conn)
+	if err != nil {
+		log.Debugx("determining uid of ctl peer", err)
+		return "", ctlUnmapped(ctx, log, "")
+	}
+	var unixUser string
+	if u, err := user.LookupId(fmt.Sprintf("%d", uid)); err != nil {
+		log.Debugx("looking up unix user for ctl peer", err, slog.Int("uid", uid))
+	} else {
+		unixUser = u.Username
+	}
+	if uid == 0 || uid == os.Getuid() || admindb.DB == nil {
+		return unixUser, nil
+	}
+	if unixUser == "" {
+		return "", ctlUnmapped(ctx, log, fmt.Sprintf("uid %d", uid))
+	}
+	u, err := admindb.UserByUnixUser(ctx, unixUser)
+	if err == admindb.ErrUnknownUser {
+		return unixUser, ctlUnmapped(ctx, log, unixUser)
+	} else if err != nil {
+		// Don't grant full access based on failures, an admin user without role cannot
+		// execute any commands.
+		log.Errorx("looking up admin user for ctl peer", err, slog.String("unixuser", unixUser))
+		return unixUser, &admindb.User{Name: unixUser}
+	}
+	return unixUser, &u
+}
+
+// ctlUnmapped returns the admin user for a ctl peer that could not be identified
+// or is not associated with an admin user. Once any admin user is associated with
+// a unix user, such peers get an admin user without role, which cannot execute
+// any commands. Before that, ctl connections are not limited and nil is
+// returned.
+func ctlUnmapped(ctx context.Context, log mlog.Log, peer string) *admindb.User {
+	if admindb.DB == nil {
+		return nil
+	}
+	if peer == "" {
+		peer = "(unknown)"
+	}
+	limited, err := admindb.UnixUsersConfigured(ctx)
+	if err != nil {
+		log.Errorx("checking for admin users with unix user", err, slog.String("peer", peer))
+		return &admindb.User{Name: peer}
+	} else if !limited {
+		return nil
+	}
+	log.Info("ctl peer not associated with admin user, denying commands", slog.String("peer", peer))
+	return &admindb.User{Name: peer}
+}
+
+// xdomainAccess fails if the connection is limited to an admin user with role
+// "domain" that doesn't manage the domain.
+func (c *ctl) xdomainAccess(d dns.Domain) {
+	if c.admin != nil && !c.admin.DomainAllowed(d) {
+		c.xerror(fmt.Sprintf("permission denied for domain %s", d))
+	}
+}
+
+// xaddressAccess is like xdomainAccess, for the domain of an address, which can
+// also be of the form "@domain" for a catchall address.
+func (c *ctl) xaddressAccess(address string) {
+	if c.admin == nil || c.admin.Role != admindb.RoleDomain {
+		return
+	}
+	var d dns.Domain
+	var err error
+	if i := strings.LastIndex(address, "@"); i < 0 {
+		err = errors.New("missing @")
+	} else {
+		d, err = dns.ParseDomain(address[i+1:])
+	}
+	if err != nil {
+		c.xerror(fmt.Sprintf("permission denied for address %q", address))
+	}
+	c.xdomainAccess(d)
+}
+
+// xaccountAccess fails if the connection is limited to an admin user with role
+// "domain" that doesn't manage the default domain of the account.
+func (c *ctl) xaccountAccess(account string) {
+	if c.admin != nil && !c.admin.AccountAllowed(account) {
+		c.xerror(fmt.Sprintf("permission denied for account %q", account))
+	}
+}
+
+// xpermissionDenied writes an error for a command the admin user is not allowed
+// to execute. The client may still be writing parameters for the command, so
+// we read and discard them until the client closes the connection after
+// reading the error, to prevent write errors from hiding the error message.
+func (c *ctl) xpermissionDenied(cmd string) {
+	c.log.Info("ctl command not allowed for admin user", slog.String("cmd", cmd), slog.String("adminuser", c.admin.Name), slog.Any("role", c.admin.Role))
+	err := c.conn.SetReadDeadline(time.Now().Add(time.Minute))
+	c.log.Check(err, "setting read deadline")
+	if c.admin.Role == "" {
+		c.xwrite(fmt.Sprintf("permission denied for command %q, ctl peer %q is not associated with an admin user", cmd, c.admin.Name))
+	} else {
+		c.xwrite(fmt.Sprintf("permission denied for command %q for admin user %q", cmd, c.admin.Name))
+	}
+	if c.r == nil {
+		c.r = bufio.NewReader(c.conn)
+	}
+	_, err = io.Copy(io.Discard, c.r)
+	c.log.Debugx("discarding parameters of command not allowed", err)
+	panic(c.x)
+}
+
 // servectl handles requests on the unix domain socket "ctl", e.g. for graceful shutdown, local mail delivery.
 func servectl(ctx context.Context, log mlog.Log, conn net.Conn, shutdown func()) {
 	log.Debug("ctl connection")
 
 	var stop = struct{}{} // Sentinel value for panic and recover.
 	ctl := &ctl{conn: conn, x: stop, log: log}
+	ctl.unixUser, ctl.admin = ctlAdmin(ctx, log, conn)
 	defer func() {
 		x := recover()
 		if x == nil || x == stop {
@@ -309,7 +501,15 @@ func servectlcmd(ctx context.Context, ctl *ctl, shutdown func()) {
 	log := ctl.log
 	cmd := ctl.xread()
 	ctl.cmd = cmd
-	log.Info("ctl command", slog.String("cmd", cmd))
+	if ctl.admin != nil {
+		log.Info("ctl command", slog.String("cmd", cmd), slog.String("adminuser", ctl.admin.Name))
+		if perm, ok := ctlPermissions[cmd]; !ok || !ctl.admin.Role.Allowed(perm) {
+			ctl.xpermissionDenied(cmd)
+		}
+	} else {
+		log.Info("ctl command", slog.String("cmd", cmd))
+	}
+	ctx = admindb.ContextWithAuditActor(ctx, admindb.AuditActor{Source: admindb.AuditSourceCtl, Name: ctl.unixUser, Operation: cmd})
 	switch cmd {
 	case "stop":
 		shutdown()
@@ -344,11 +544,21 @@ func servectlcmd(ctx context.Context, ctl *ctl, shutdown func()) {
 			Size:     mw.Size,
 		}
 
+		var sieveResult *sieve.Result
 		a.WithWLock(func() {
-			err := a.DeliverDestination(log, addr, &m, msgFile)
+			sieveResult, err = a.DeliverDestination(log, addr, &m, msgFile)
 			ctl.xcheck(err, "delivering message")
-			log.Info("message delivered through ctl", slog.Any("to", to))
 		})
+		if sieveResult != nil && sieveResult.Reject != nil {
+			ctl.xerror("message rejected by sieve script: " + sieveResult.Reject.ResponseText())
+		}
+		log.Info("message delivered through ctl", slog.Any("to", to))
+		if sieveResult != nil {
+			rcptTo, err := smtp.ParseAddress(to)
+			ctl.xcheck(err, "parsing destination address")
+			err = queue.SieveActions(ctx, log, a, rcptTo.Path(), &m, msgFile, sieveResult)
+			log.Check(err, "performing sieve actions for delivery through ctl")
+		}
 
 		err = a.Close()
 		ctl.xcheck(err, "closing account")
@@ -364,6 +574,7 @@ func servectlcmd(ctx context.Context, ctl *ctl, shutdown func()) {
 
 		account := ctl.xread()
 		pw := ctl.xread()
+		ctl.xaccountAccess(account)
 
 		acc, err := store.OpenAccount(log, account)
 		ctl.xcheck(err, "open account")
@@ -376,6 +587,7 @@ func servectlcmd(ctx context.Context, ctl *ctl, shutdown func()) {
 
 		err = acc.SetPassword(log, pw)
 		ctl.xcheck(err, "setting password")
+		admindb.AuditAdd(ctx, log, admindb.AuditPassword, fmt.Sprintf("password set for account %q", account))
 		err = acc.Close()
 		ctl.xcheck(err, "closing account")
 		acc = nil
@@ -999,6 +1211,7 @@ func servectlcmd(ctx context.Context, ctl *ctl, shutdown func()) {
 		*/
 		account := ctl.xread()
 		address := ctl.xread()
+		ctl.xaddressAccess(address)
 		err := mox.AccountAdd(ctx, account, address)
 		ctl.xcheck(err, "adding account")
 		ctl.xwriteok()
@@ -1010,6 +1223,7 @@ func servectlcmd(ctx context.Context, ctl *ctl, shutdown func()) {
 		< "ok" or error
 		*/
 		account := ctl.xread()
+		ctl.xaccountAccess(account)
 		err := mox.AccountRemove(ctx, account)
 		ctl.xcheck(err, "removing account")
 		ctl.xwriteok()
@@ -1023,6 +1237,8 @@ func servectlcmd(ctx context.Context, ctl *ctl, shutdown func()) {
 		*/
 		address := ctl.xread()
 		account := ctl.xread()
+		ctl.xaddressAccess(address)
+		ctl.xaccountAccess(account)
 		err := mox.AddressAdd(ctx, address, account)
 		ctl.xcheck(err, "adding address")
 		ctl.xwriteok()
@@ -1034,6 +1250,7 @@ func servectlcmd(ctx context.Context, ctl *ctl, shutdown func()) {
 		< "ok" or error
 		*/
 		address := ctl.xread()
+		ctl.xaddressAccess(address)
 		err := mox.AddressRemove(ctx, address)
 		ctl.xcheck(err, "removing address")
 		ctl.xwriteok()
@@ -1048,6 +1265,7 @@ func servectlcmd(ctx context.Context, ctl *ctl, shutdown func()) {
 		domain := ctl.xread()
 		d, err := dns.ParseDomain(domain)
 		ctl.xcheck(err, "parsing domain")
+		ctl.xdomainAccess(d)
 		dc, ok := mox.Conf.Domain(d)
 		if !ok {
 			ctl.xcheck(errors.New("no such domain"), "listing aliases")
@@ -1069,6 +1287,7 @@ func servectlcmd(ctx context.Context, ctl *ctl, shutdown func()) {
 		< stream
 		*/
 		address := ctl.xread()
+		ctl.xaddressAccess(address)
 		_, alias, ok := mox.Conf.AccountDestination(address)
 		if !ok {
 			ctl.xcheck(errors.New("no such address"), "looking up alias")
@@ -1097,6 +1316,7 @@ func servectlcmd(ctx context.Context, ctl *ctl, shutdown func()) {
 		line := ctl.xread()
 		addr, err := smtp.ParseAddress(address)
 		ctl.xcheck(err, "parsing address")
+		ctl.xdomainAccess(addr.Domain)
 		var alias config.Alias
 		xparseJSON(ctl, line, &alias)
 		err = mox.AliasAdd(ctx, addr, alias)
@@ -1118,6 +1338,7 @@ func servectlcmd(ctx context.Context, ctl *ctl, shutdown func()) {
 		allowmsgfrom := ctl.xread()
 		addr, err := smtp.ParseAddress(address)
 		ctl.xcheck(err, "parsing address")
+		ctl.xdomainAccess(addr.Domain)
 		err = mox.DomainSave(ctx, addr.Domain.Name(), func(d *config.Domain) error {
 			a, ok := d.Aliases[addr.Localpart.String()]
 			if !ok {
@@ -1159,6 +1380,7 @@ func servectlcmd(ctx context.Context, ctl *ctl, shutdown func()) {
 		address := ctl.xread()
 		addr, err := smtp.ParseAddress(address)
 		ctl.xcheck(err, "parsing address")
+		ctl.xdomainAccess(addr.Domain)
 		err = mox.AliasRemove(ctx, addr)
 		ctl.xcheck(err, "removing alias")
 		ctl.xwriteok()
@@ -1174,6 +1396,7 @@ func servectlcmd(ctx context.Context, ctl *ctl, shutdown func()) {
 		line := ctl.xread()
 		addr, err := smtp.ParseAddress(address)
 		ctl.xcheck(err, "parsing address")
+		ctl.xdomainAccess(addr.Domain)
 		var addresses []string
 		xparseJSON(ctl, line, &addresses)
 		err = mox.AliasAddressesAdd(ctx, addr, addresses)
@@ -1191,6 +1414,7 @@ func servectlcmd(ctx context.Context, ctl *ctl, shutdown func()) {
 		line := ctl.xread()
 		addr, err := smtp.ParseAddress(address)
 		ctl.xcheck(err, "parsing address")
+		ctl.xdomainAccess(addr.Domain)
 		var addresses []string
 		xparseJSON(ctl, line, &addresses)
 		err = mox.AliasAddressesRemove(ctx, addr, addresses)
@@ -1416,7 +1640,7 @@ func servectlcmd(ctx context.Context, ctl *ctl, shutdown func()) {
 							n++
 
 							p := acc.MessagePath(m.ID)
-							st, err := os.Stat(p)
+							filesize, err := store.MessageFileSize(p)
 							if err != nil {
 								mb := store.Mailbox{ID: m.MailboxID}
 								if xerr := tx.Get(&mb); xerr != nil {
@@ -1427,7 +1651,6 @@ func servectlcmd(ctx context.Context, ctl *ctl, shutdown func()) {
 								ctl.xcheck(werr, "write")
 								return nil
 							}
-							filesize := st.Size()
 							correctSize := int64(len(m.MsgPrefix)) + filesize
 							if m.Size == correctSize {
 								return nil
@@ -1461,9 +1684,9 @@ func servectlcmd(ctx context.Context, ctl *ctl, shutdown func()) {
 								_, werr := fmt.Fprintf(w, "parsing message %d again: %v (continuing)\n", m.ID, err)
 								ctl.xcheck(werr, "write")
 							}
-							m.ParsedBuf, err = json.Marshal(part)
+							m.ParsedBuf, err = acc.MarshalPart(tx, part)
 							if err != nil {
-								return fmt.Errorf("marshal parsed message: %v", err)
+								return err
 							}
 							total++
 							if err := tx.Update(&m); err != nil {
@@ -1550,9 +1773,12 @@ func servectlcmd(ctx context.Context, ctl *ctl, shutdown func()) {
 							_, err := fmt.Fprintf(w, "parsing message %d: %v (continuing)\n", m.ID, err)
 							ctl.xcheck(err, "write")
 						}
-						m.ParsedBuf, err = json.Marshal(p)
+						m.ParsedBuf, err = acc.MarshalPart(tx, p)
 						if err != nil {
-							return fmt.Errorf("marshal parsed message: %v", err)
+							return err
+						}
+						if err := store.TextIndexUpdate(log, tx, &m, &p); err != nil {
+							return err
 						}
 						total++
 						n++
@@ -1587,6 +1813,71 @@ func servectlcmd(ctx context.Context, ctl *ctl, shutdown func()) {
 		}
 		w.xclose()
 
+	case "reindex":
+		/* protocol:
+		> "reindex"
+		> account or empty
+		< "ok" or error
+		< stream
+		*/
+
+		accountOpt := ctl.xread()
+		ctl.xwriteok()
+		w := ctl.writer()
+
+		xreindexAccount := func(accName string) {
+			acc, err := store.OpenAccount(log, accName)
+			ctl.xcheck(err, "open account")
+			defer func() {
+				err := acc.Close()
+				log.Check(err, "closing account after reindexing messages")
+			}()
+
+			total, err := acc.ReindexMessages(ctx, log)
+			ctl.xcheck(err, "rebuilding full-text index")
+			_, err = fmt.Fprintf(w, "%d message(s) added to full-text index for account %s\n", total, accName)
+			ctl.xcheck(err, "write")
+		}
+
+		if accountOpt != "" {
+			xreindexAccount(accountOpt)
+		} else {
+			for i, accName := range mox.Conf.Accounts() {
+				var line string
+				if i > 0 {
+					line = "\n"
+				}
+				_, err := fmt.Fprintf(w, "%sReindexing account %s...\n", line, accName)
+				ctl.xcheck(err, "write")
+				xreindexAccount(accName)
+			}
+		}
+		w.xclose()
+
+	case "encryptmessages":
+		/* protocol:
+		> "encryptmessages"
+		> account
+		< "ok" or error
+		< stream
+		*/
+
+		accountName := ctl.xread()
+		acc, err := store.OpenAccount(log, accountName)
+		ctl.xcheck(err, "open account")
+		defer func() {
+			err := acc.Close()
+			log.Check(err, "closing account after encrypting message files")
+		}()
+
+		nfiles, nmessages, err := acc.EncryptMessages(ctx, log)
+		ctl.xcheck(err, "encrypting messages")
+		ctl.xwriteok()
+		w := ctl.writer()
+		_, err = fmt.Fprintf(w, "%d message file(s) encrypted, %d message(s) encrypted in database\n", nfiles, nmessages)
+		ctl.xcheck(err, "write")
+		w.xclose()
+
 	case "reassignthreads":
 		/* protocol:
 		> "reassignthreads"
@@ -1643,6 +1934,113 @@ func servectlcmd(ctx context.Context, ctl *ctl, shutdown func()) {
 		}
 		w.xclose()
 
+	case "adminuserlist":
+		/* protocol:
+		> "adminuserlist"
+		< "ok" or error
+		< stream
+		*/
+		users, err := admindb.UserList(ctx)
+		ctl.xcheck(err, "listing admin users")
+		ctl.xwriteok()
+		xw := ctl.writer()
+		for _, u := range users {
+			domains := strings.Join(u.Domains, ",")
+			if domains == "" {
+				domains = "-"
+			}
+			unixUser := u.UnixUser
+			if unixUser == "" {
+				unixUser = "-"
+			}
+			fmt.Fprintf(xw, "%s\t%s\t%s\t%s\tpassword=%v\n", u.Name, u.Role, domains, unixUser, u.HasPassword())
+		}
+		xw.xclose()
+
+	case "auditlog":
+		/* protocol:
+		> "auditlog"
+		> filter as json
+		< "ok" or error
+		< stream
+		*/
+		line := ctl.xread()
+		var f admindb.AuditFilter
+		xparseJSON(ctl, line, &f)
+		ctl.xwriteok()
+		xw := ctl.writer()
+		err := admindb.AuditExport(ctx, xw, f)
+		ctl.xcheck(err, "exporting audit log")
+		xw.xclose()
+
+	case "adminuseradd":
+		/* protocol:
+		> "adminuseradd"
+		> user as json
+		> password, can be empty
+		< "ok" or error
+		*/
+		line := ctl.xread()
+		pw := ctl.xread()
+		var u admindb.User
+		xparseJSON(ctl, line, &u)
+		_, err := admindb.UserAdd(ctx, u, pw)
+		ctl.xcheck(err, "adding admin user")
+		ctl.xwriteok()
+
+	case "adminusersave":
+		/* protocol:
+		> "adminusersave"
+		> user as json
+		< "ok" or error
+		*/
+		line := ctl.xread()
+		var u admindb.User
+		xparseJSON(ctl, line, &u)
+		err := admindb.UserSave(ctx, u)
+		ctl.xcheck(err, "saving admin user")
+		ctl.xwriteok()
+
+	case "adminusersetpassword":
+		/* protocol:
+		> "adminusersetpassword"
+		> name
+		> password, can be empty
+		< "ok" or error
+		*/
+		name := ctl.xread()
+		pw := ctl.xread()
+		err := admindb.UserSetPassword(ctx, name, pw)
+		ctl.xcheck(err, "setting password for admin user")
+		webauth.AdminSessionsRemove(name)
+		ctl.xwriteok()
+
+	case "adminusertotpdisable":
+		/* protocol:
+		> "adminusertotpdisable"
+		> name
+		< "ok" or error
+		*/
+		name := ctl.xread()
+		if name == "" {
+			ctl.xerror("admin user name required")
+		}
+		err := webauth.AdminTOTPDisable(ctx, name)
+		ctl.xcheck(err, "disabling two-factor authentication for admin user")
+		ctl.xwriteok()
+
+	case "adminuserrm":
+		/* protocol:
+		> "adminuserrm"
+		> name
+		< "ok" or error
+		*/
+		name := ctl.xread()
+		err := admindb.UserRemove(ctx, name)
+		ctl.xcheck(err, "removing admin user")
+		webauth.AdminSessionsRemove(name)
+		ctl.xwriteok()
+
 	case "backup":
 		backupctl(ctx, ctl)
 
@@ -9,9 +9,13 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/admindb"
 	"github.com/mjl-/mox/config"
 	"github.com/mjl-/mox/dmarcdb"
 	"github.com/mjl-/mox/dns"
@@ -34,6 +38,155 @@ func tcheck(t *testing.T, err error, errmsg string) {
 	}
 }
 
+// TestCtlAdmin tests managing admin users, and limiting ctl commands for
+// connections associated with admin users.
+func TestCtlAdmin(t *testing.T) {
+	os.RemoveAll("testdata/ctl/data")
+	mox.ConfigStaticPath = filepath.FromSlash("testdata/ctl/mox.conf")
+	mox.ConfigDynamicPath = filepath.FromSlash("testdata/ctl/domains.conf")
+	if errs := mox.LoadConfig(ctxbg, pkglog, true, false); len(errs) > 0 {
+		t.Fatalf("loading mox config: %v", errs)
+	}
+	defer store.Switchboard()()
+
+	err := admindb.Init()
+	tcheck(t, err, "admindb init")
+	defer func() {
+		err := admindb.Close()
+		tcheck(t, err, "admindb close")
+	}()
+
+	testctl := func(admin *admindb.User, fn func(clientctl *ctl)) {
+		t.Helper()
+
+		var stop = struct{}{}
+		cconn, sconn := net.Pipe()
+		clientctl := ctl{conn: cconn, log: pkglog}
+		serverctl := ctl{conn: sconn, log: pkglog, x: stop, admin: admin}
+		done := make(chan struct{})
+		go func() {
+			defer func() {
+				x := recover()
+				sconn.Close()
+				close(done)
+				if x != nil && x != stop {
+					panic(x)
+				}
+			}()
+			servectlcmd(ctxbg, &serverctl, func() {})
+		}()
+		fn(&clientctl)
+		cconn.Close()
+		<-done
+	}
+
+	// Commands not allowed are rejected after the command is read, or after the
+	// parameters are read when access to a domain/account/address is checked. With
+	// synchronous net.Pipe, we must not write parameters for commands rejected early.
+	denied := func(admin *admindb.User, cmd string, params ...string) {
+		t.Helper()
+		testctl(admin, func(ctl *ctl) {
+			ctl.xwrite(cmd)
+			for _, p := range params {
+				ctl.xwrite(p)
+			}
+			line := ctl.xread()
+			if !strings.HasPrefix(line, "permission denied") {
+				t.Fatalf("got response %q for %q, expected permission denied", line, cmd)
+			}
+		})
+	}
+
+	// Without admin users with a unix user, unidentified peers are not limited.
+	if u := ctlUnmapped(ctxbg, pkglog, "other"); u != nil {
+		t.Fatalf("got admin user %v for unmapped ctl peer without unix users configured, expected none", u)
+	}
+
+	// Without admin user, for root and the mox unix user, and users not associated
+	// with an admin user.
+	testctl(nil, func(ctl *ctl) {
+		ctlcmdAdminUserAdd(ctl, admindb.User{Name: "ro", Role: admindb.RoleReadOnly, UnixUser: "ro"}, "")
+	})
+	testctl(nil, func(ctl *ctl) {
+		ctlcmdAdminUserAdd(ctl, admindb.User{Name: "dom", Role: admindb.RoleDomain, Domains: []string{"mox.example"}}, "test1234")
+	})
+	testctl(nil, func(ctl *ctl) {
+		ctlcmdAdminUserUpdate(ctl, admindb.User{Name: "dom", Role: admindb.RoleDomain, Domains: []string{"mox.example"}, UnixUser: "dom"})
+	})
+	testctl(nil, func(ctl *ctl) {
+		ctlcmdAdminUserSetpassword(ctl, "ro", "test1234")
+	})
+	testctl(nil, func(ctl *ctl) {
+		ctlcmdAdminUserList(ctl)
+	})
+	ro, err := admindb.UserByUnixUser(ctxbg, "ro")
+	tcheck(t, err, "get admin user by unix user")
+	if !ro.HasPassword() {
+		t.Fatalf("admin user does not have password")
+	}
+	dom, err := admindb.UserByUnixUser(ctxbg, "dom")
+	tcheck(t, err, "get admin user by unix user")
+
+	// With admin users with a unix user, other peers cannot execute any commands.
+	unmapped := ctlUnmapped(ctxbg, pkglog, "other")
+	if unmapped == nil {
+		t.Fatalf("unmapped ctl peer not limited with unix users configured")
+	}
+	denied(unmapped, "loglevels")
+	denied(unmapped, "queuelist")
+
+	// Read-only admin.
+	testctl(&ro, func(ctl *ctl) {
+		ctlcmdLoglevels(ctl)
+	})
+	denied(&ro, "setloglevels")
+	denied(&ro, "queuedrop")
+	denied(&ro, "adminuserlist")
+	denied(&ro, "bogus")
+
+	// Domain admin.
+	testctl(&dom, func(ctl *ctl) {
+		ctlcmdConfigAddressAdd(ctl, "dom@mox.example", "mjl")
+	})
+	testctl(&dom, func(ctl *ctl) {
+		ctlcmdConfigAliasList(ctl, "mox.example")
+	})
+	testctl(&dom, func(ctl *ctl) {
+		ctlcmdConfigAddressRemove(ctl, "dom@mox.example")
+	})
+	denied(&dom, "stop")
+	denied(&dom, "loglevels")
+	denied(&dom, "accountadd", "other", "other@other.example")
+	other := admindb.User{Name: "other", Role: admindb.RoleDomain, Domains: []string{"other.example"}}
+	denied(&other, "setaccountpassword", "mjl", "test1234")
+	denied(&other, "addressrm", "mjl2@mox.example")
+	denied(&other, "aliaslist", "mox.example")
+
+	// Config changes by the domain admin are in the audit log, readable by read-only
+	// admins.
+	entries, err := admindb.AuditList(ctxbg, admindb.AuditFilter{Source: admindb.AuditSourceCtl, Kind: admindb.AuditConfig})
+	tcheck(t, err, "list audit log")
+	if len(entries) != 2 || entries[0].Operation != "addressrm" || entries[1].Operation != "addressadd" || !strings.Contains(entries[1].Diff, "dom@mox.example") {
+		t.Fatalf("unexpected audit log entries %#v", entries)
+	}
+	testctl(&ro, func(ctl *ctl) {
+		ctlcmdAdminAuditlog(ctl, admindb.AuditFilter{Kind: admindb.AuditAdminUser})
+	})
+	denied(&dom, "auditlog")
+
+	testctl(nil, func(ctl *ctl) {
+		ctlcmdAdminUserRemove(ctl, "ro")
+	})
+	testctl(nil, func(ctl *ctl) {
+		ctlcmdAdminUserRemove(ctl, "dom")
+	})
+	l, err := admindb.UserList(ctxbg)
+	tcheck(t, err, "list admin users")
+	if len(l) != 0 {
+		t.Fatalf("got %d admin users, expected 0", len(l))
+	}
+}
+
 // TestCtl executes commands through ctl. This tests at least the protocols (who
 // sends when/what) is tested. We often don't check the actual results, but
 // unhandled errors would cause a panic.
@@ -49,16 +202,37 @@ func TestCtl(t *testing.T) {
 	err := queue.Init()
 	tcheck(t, err, "queue init")
 
+	err = admindb.Init()
+	tcheck(t, err, "admindb init")
+	defer func() {
+		err := admindb.Close()
+		tcheck(t, err, "admindb close")
+	}()
+
+	// Commands are run to completion before the next, so deferred cleanup like
+	// closing an account doesn't race with later commands.
 	testctl := func(fn func(clientctl *ctl)) {
 		t.Helper()
 
+		var stop = struct{}{}
 		cconn, sconn := net.Pipe()
 		clientctl := ctl{conn: cconn, log: pkglog}
-		serverctl := ctl{conn: sconn, log: pkglog}
-		go servectlcmd(ctxbg, &serverctl, func() {})
+		serverctl := ctl{conn: sconn, log: pkglog, x: stop}
+		done := make(chan struct{})
+		go func() {
+			defer func() {
+				x := recover()
+				sconn.Close()
+				close(done)
+				if x != nil && x != stop {
+					panic(x)
+				}
+			}()
+			servectlcmd(ctxbg, &serverctl, func() {})
+		}()
 		fn(&clientctl)
 		cconn.Close()
-		sconn.Close()
+		<-done
 	}
 
 	// "deliver"
@@ -157,6 +331,21 @@ func TestCtl(t *testing.T) {
 		ctlcmdQueueDrop(ctl, queue.Filter{})
 	})
 
+	// Password and queue changes are in the audit log.
+	entries, err := admindb.AuditList(ctxbg, admindb.AuditFilter{Source: admindb.AuditSourceCtl, Kind: admindb.AuditPassword})
+	tcheck(t, err, "list audit log")
+	if len(entries) != 1 || entries[0].Operation != "setaccountpassword" {
+		t.Fatalf("unexpected audit log entries for passwords %#v", entries)
+	}
+	entries, err = admindb.AuditList(ctxbg, admindb.AuditFilter{Source: admindb.AuditSourceCtl, Kind: admindb.AuditQueue})
+	tcheck(t, err, "list audit log")
+	if len(entries) == 0 || entries[0].Operation != "queuedrop" {
+		t.Fatalf("unexpected audit log entries for queue %#v", entries)
+	}
+	testctl(func(ctl *ctl) {
+		ctlcmdAdminAuditlog(ctl, admindb.AuditFilter{Kind: admindb.AuditQueue})
+	})
+
 	// "queueholdruleslist"
 	testctl(func(ctl *ctl) {
 		ctlcmdQueueHoldrulesList(ctl)
@@ -415,6 +604,31 @@ func TestCtl(t *testing.T) {
 		ctlcmdReparse(ctl, "")
 	})
 
+	// "reindex"
+	testctl(func(ctl *ctl) {
+		ctlcmdReindex(ctl, "mjl")
+	})
+	testctl(func(ctl *ctl) {
+		ctlcmdReindex(ctl, "")
+	})
+
+	// The full-text index has postings for the messages in the account.
+	acc, err := store.OpenAccount(pkglog, "mjl")
+	tcheck(t, err, "open account")
+	nmsgs, err := bstore.QueryDB[store.Message](ctxbg, acc.DB).FilterEqual("Expunged", false).Count()
+	tcheck(t, err, "count messages")
+	nindexed := map[int64]struct{}{}
+	err = bstore.QueryDB[store.TextPosting](ctxbg, acc.DB).ForEach(func(tp store.TextPosting) error {
+		nindexed[tp.MessageID] = struct{}{}
+		return nil
+	})
+	tcheck(t, err, "list text postings")
+	if nmsgs == 0 || len(nindexed) == 0 {
+		t.Fatalf("got %d messages with postings in full-text index for %d messages, expected postings", len(nindexed), nmsgs)
+	}
+	err = acc.Close()
+	tcheck(t, err, "close account")
+
 	// "reassignthreads"
 	testctl(func(ctl *ctl) {
 		ctlcmdReassignthreads(ctl, "mjl")
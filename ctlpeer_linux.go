@@ -0,0 +1,34 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// ctlPeerUID returns the uid of the process on the other side of a ctl
+// connection.
+func ctlPeerUID(conn net.Conn) (int, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return -1, fmt.Errorf("not a unix domain socket connection")
+	}
+	rc, err := uc.SyscallConn()
+	if err != nil {
+		return -1, fmt.Errorf("raw connection: %v", err)
+	}
+	var cred *syscall.Ucred
+	var cerr error
+	err = rc.Control(func(fd uintptr) {
+		cred, cerr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return -1, fmt.Errorf("get peer credentials: %v", err)
+	}
+	return int(cred.Uid), nil
+}
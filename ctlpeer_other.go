@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// ctlPeerUID returns the uid of the process on the other side of a ctl
+// connection. Not implemented on this platform.
+func ctlPeerUID(conn net.Conn) (int, error) {
+	return -1, errors.ErrUnsupported
+}
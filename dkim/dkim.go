@@ -222,7 +222,7 @@ func Sign(ctx context.Context, elog *slog.Logger, localpart smtp.Localpart, doma
 			sig.BodyHash = bh
 		} else {
 			br := bufio.NewReader(&moxio.AtReader{R: msg, Offset: int64(bodyOffset)})
-			bh, err = bodyHash(h.New(), !sel.BodyRelaxed, br)
+			bh, err = BodyHash(h.New(), !sel.BodyRelaxed, br)
 			if err != nil {
 				return "", err
 			}
@@ -596,7 +596,7 @@ func verifySignatureRecord(r *Record, sig *Sig, hash crypto.Hash, canonHeaderSim
 		return StatusPermerror, fmt.Errorf("%w: unrecognized signature algorithm %q", ErrSigAlgorithmUnknown, r.Key)
 	}
 
-	bh, err := bodyHash(hash.New(), canonDataSimple, body)
+	bh, err := BodyHash(hash.New(), canonDataSimple, body)
 	if err != nil {
 		// Any error is likely some internal error, hence temporary error.
 		return StatusTemperror, fmt.Errorf("calculating body hash: %w", err)
@@ -617,8 +617,9 @@ func algHash(s string) (crypto.Hash, bool) {
 	return 0, false
 }
 
-// bodyHash calculates the hash over the body.
-func bodyHash(h hash.Hash, canonSimple bool, body *bufio.Reader) ([]byte, error) {
+// BodyHash calculates the hash over the body, with simple or relaxed
+// canonicalization. Also used for ARC message signatures.
+func BodyHash(h hash.Hash, canonSimple bool, body *bufio.Reader) ([]byte, error) {
 	// todo: take l= into account. we don't currently allow it for policy reasons.
 
 	var crlf = []byte("\r\n")
@@ -738,7 +739,7 @@ func dataHash(h hash.Hash, canonSimple bool, sig *Sig, hdrs []header, verifySig
 			// Add unmodified.
 			headers += s
 		} else {
-			ch, err := relaxedCanonicalHeaderWithoutCRLF(s)
+			ch, err := RelaxedCanonicalHeaderWithoutCRLF(s)
 			if err != nil {
 				return nil, fmt.Errorf("canonicalizing header: %w", err)
 			}
@@ -749,7 +750,7 @@ func dataHash(h hash.Hash, canonSimple bool, sig *Sig, hdrs []header, verifySig
 	h.Write([]byte(headers))
 	dkimSig := verifySig
 	if !canonSimple {
-		ch, err := relaxedCanonicalHeaderWithoutCRLF(string(verifySig))
+		ch, err := RelaxedCanonicalHeaderWithoutCRLF(string(verifySig))
 		if err != nil {
 			return nil, fmt.Errorf("canonicalizing DKIM-Signature header: %w", err)
 		}
@@ -759,8 +760,9 @@ func dataHash(h hash.Hash, canonSimple bool, sig *Sig, hdrs []header, verifySig
 	return h.Sum(nil), nil
 }
 
-// a single header, can be multiline.
-func relaxedCanonicalHeaderWithoutCRLF(s string) (string, error) {
+// RelaxedCanonicalHeaderWithoutCRLF returns the relaxed canonical form of a
+// single header, which can be multiline.
+func RelaxedCanonicalHeaderWithoutCRLF(s string) (string, error) {
 	// ../rfc/6376:831
 	t := strings.SplitN(s, ":", 2)
 	if len(t) != 2 {
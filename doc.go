@@ -24,6 +24,13 @@ any parameters. Followed by the help and usage information for each command.
 	mox stop
 	mox setaccountpassword account
 	mox setadminpassword
+	mox admin user list
+	mox admin user add [-password] -role role [-domains domain1,domain2] [-unixuser user] name
+	mox admin user update -role role [-domains domain1,domain2] [-unixuser user] name
+	mox admin user setpassword [-disable] name
+	mox admin user totpdisable name
+	mox admin user rm name
+	mox admin auditlog [-source source] [-actor actor] [-kind kind] [-operation operation] [-since duration] [-text text]
 	mox loglevels [level [pkg]]
 	mox queue holdrules list
 	mox queue holdrules add [ruleflags]
@@ -114,6 +121,8 @@ any parameters. Followed by the help and usage information for each command.
 	mox fixuidmeta account
 	mox fixmsgsize [account]
 	mox reparse [account]
+	mox reindex [account]
+	mox encryptmessages account
 	mox ensureparsed account
 	mox recalculatemailboxcounts account
 	mox message parse message.eml
@@ -209,8 +218,126 @@ Set a new admin password, for the web interface.
 The password is read from stdin. Its bcrypt hash is stored in a file named
 "adminpasswd" in the configuration directory.
 
+If two-factor authentication was enabled for the admin in the web interface, its
+secret is stored in "adminpasswd.totp". Remove that file to disable it, e.g.
+after losing the authenticator app.
+
+Additional admin users with their own password and a limited role can be added
+with "mox admin user add".
+
 	usage: mox setadminpassword
 
+# mox admin user list
+
+List admin users.
+
+Each line has the name, role, domains (for role "domain"), unix user and
+whether a password is set.
+
+	usage: mox admin user list
+
+# mox admin user add
+
+Add an admin user.
+
+Admin users can log in to the admin web interface with their own password, with
+access limited by their role:
+
+  - admin: full access, like the admin password.
+  - readonly: viewing configuration, queues and reports, but no changes.
+  - queue: like readonly, and managing the message and webhook queues.
+  - domain: viewing and changing only the domains given with -domains, and their
+    accounts (by default domain), addresses and aliases.
+
+The admin password remains valid for full admin access.
+
+With -password, a password for logging in to the admin web interface is read
+from stdin. Without password, the user can only be used through its unix user.
+
+With -unixuser, connections to the ctl socket (e.g. with mox commands such as
+"mox queue list") by the unix user are limited to the role of the admin user.
+Connections by root and the unix user mox runs as are not limited. Once any
+admin user has a unix user, connections by all other unix users that are not
+associated with an admin user are denied. Peers can only be identified on
+Linux: on other platforms, all ctl connections are denied once an admin user
+has a unix user.
+
+	usage: mox admin user add [-password] -role role [-domains domain1,domain2] [-unixuser user] name
+	  -domains string
+	    	comma-separated domains managed by an admin user with role domain
+	  -password
+	    	read password for admin web interface from stdin
+	  -role string
+	    	role of admin user: admin, readonly, queue or domain
+	  -unixuser string
+	    	unix user whose connections to the ctl socket, e.g. through mox commands, are limited to the role of the admin user
+
+# mox admin user update
+
+Update the role, domains and unix user of an admin user.
+
+All fields are replaced, so unspecified domains and unix user are cleared.
+
+	usage: mox admin user update -role role [-domains domain1,domain2] [-unixuser user] name
+	  -domains string
+	    	comma-separated domains managed by an admin user with role domain
+	  -role string
+	    	role of admin user: admin, readonly, queue or domain
+	  -unixuser string
+	    	unix user whose connections to the ctl socket, e.g. through mox commands, are limited to the role of the admin user
+
+# mox admin user setpassword
+
+Set a new password for an admin user, for the admin web interface.
+
+The password is read from stdin. Existing sessions of the admin user are ended.
+With -disable, the password is cleared and the user can no longer log in to the
+admin web interface.
+
+	usage: mox admin user setpassword [-disable] name
+	  -disable
+	    	clear password, disabling logins to the admin web interface
+
+# mox admin user totpdisable
+
+Disable two-factor authentication for an admin user.
+
+For example after the user lost the authenticator app. The user can set up
+two-factor authentication again after logging in.
+
+	usage: mox admin user totpdisable name
+
+# mox admin user rm
+
+Remove an admin user, ending its sessions.
+
+	usage: mox admin user rm name
+
+# mox admin auditlog
+
+Print entries from the audit log as JSON lines, oldest first.
+
+The audit log has changes to the configuration (domains.conf) with a diff,
+operations on the queues, and password changes, made through the admin and
+account web interfaces and through mox commands. Each entry has the source
+(ctl, webadmin or webaccount), the actor (admin user, account, or unix user for
+ctl), and the API function or ctl command. Changes to the admin password with
+"mox setadminpassword" are not recorded.
+
+	usage: mox admin auditlog [-source source] [-actor actor] [-kind kind] [-operation operation] [-since duration] [-text text]
+	  -actor string
+	    	only entries from actor: admin user, account, or unix user for ctl
+	  -kind string
+	    	only entries of kind: config, queue, password or adminuser
+	  -operation string
+	    	only entries for the API function or ctl command
+	  -since duration
+	    	only entries from this period until now, e.g. 24h
+	  -source string
+	    	only entries from source: ctl, webadmin or webaccount
+	  -text string
+	    	only entries with this case-insensitive text in their details or diff
+
 # mox loglevels
 
 Print the log levels, or set a new default log level, or a level for the given package.
@@ -733,6 +860,9 @@ database file directly. This may block if a running mox instance also has the
 database open, e.g. for IMAP connections. To export from a running instance, use
 the accounts web page or webmail.
 
+If the account has encrypted message files, the account password is read from
+stdin for decrypting them.
+
 	usage: mox export maildir [-single] dst-dir account-path [mailbox]
 	  -single
 	    	export single mailbox, without any children. disabled if mailbox isn't specified.
@@ -748,6 +878,9 @@ database file directly. This may block if a running mox instance also has the
 database open, e.g. for IMAP connections. To export from a running instance, use
 the accounts web page or webmail.
 
+If the account has encrypted message files, the account password is read from
+stdin for decrypting them.
+
 For mbox export, "mboxrd" is used where message lines starting with the magic
 "From " string are escaped by prepending a >. All ">*From " are escaped,
 otherwise reconstructing the original could lose a ">".
@@ -761,8 +894,8 @@ otherwise reconstructing the original could lose a ">".
 Start a local SMTP/IMAP server that accepts all messages, useful when testing/developing software that sends email.
 
 Localserve starts mox with a configuration suitable for local email-related
-software development/testing. It listens for SMTP/Submission(s), IMAP(s) and
-HTTP(s), on the regular port numbers + 1000.
+software development/testing. It listens for SMTP/Submission(s), IMAP(s),
+POP3(s) and HTTP(s), on the regular port numbers + 1000.
 
 Data is stored in the system user's configuration directory under
 "mox-localserve", e.g. $HOME/.config/mox-localserve/ on linux, but can be
@@ -821,6 +954,10 @@ increases the odds hardlinking succeeds: the default systemd service file
 specifically mounts the data directory, causing attempts to hardlink outside it
 to fail with an error about cross-device linking.
 
+Encrypted message files are stored as is. The key for decrypting them is in the
+account database, sealed with the account password, so a restored backup needs
+the account password at the time of the backup.
+
 All files in the data directory that aren't recognized (i.e. other than known
 database files, message files, an acme directory, the "tmp" directory, etc),
 are stored, but with a warning.
@@ -1476,6 +1613,42 @@ while reparsing all messages.
 
 	usage: mox reparse [account]
 
+# mox reindex
+
+Rebuild the full-text index of all messages in the account or all accounts.
+
+The full-text index is used to quickly find messages when searching for words,
+e.g. with IMAP SEARCH BODY/TEXT and in the webmail search. Messages are added
+to the index when delivered. Messages that could not be indexed, e.g. because
+of their size, are read while searching.
+
+Can be useful after upgrading mox with improved indexing, or to add messages
+delivered before the index existed. The index is first cleared, then messages
+are indexed in batches, so other access to the mailboxes/messages is not
+blocked while indexing. Searches while reindexing read messages that are not
+yet indexed.
+
+	usage: mox reindex [account]
+
+# mox encryptmessages
+
+Encrypt existing messages of an account.
+
+With EncryptMessages enabled for an account, new messages are stored encrypted.
+Messages delivered before are not. This command encrypts the remaining plain
+text message files, and the parsed messages in the account database. The
+Message-ID and base subject of messages, used for threading, are replaced with
+hashes, and the full-text index is removed. Until this command is run, new
+messages are not matched to threads of messages delivered before the key was
+created. The account must already have a key, which is created at the first
+login with password or password change after enabling encryption. Only the
+public key is needed, the account does not have to be unlocked.
+
+Messages are encrypted in small batches, so other access to the account is not
+blocked.
+
+	usage: mox encryptmessages account
+
 # mox ensureparsed
 
 Ensure messages in the database have a pre-parsed MIME form in the database.
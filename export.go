@@ -1,11 +1,17 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"fmt"
 	"log"
+	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
+	"golang.org/x/text/secure/precis"
+
 	"github.com/mjl-/bstore"
 
 	"github.com/mjl-/mox/store"
@@ -19,6 +25,9 @@ Export bypasses a running mox instance. It opens the account mailbox/message
 database file directly. This may block if a running mox instance also has the
 database open, e.g. for IMAP connections. To export from a running instance, use
 the accounts web page or webmail.
+
+If the account has encrypted message files, the account password is read from
+stdin for decrypting them.
 `
 	var single bool
 	c.flag.BoolVar(&single, "single", false, "export single mailbox, without any children. disabled if mailbox isn't specified.")
@@ -37,6 +46,9 @@ database file directly. This may block if a running mox instance also has the
 database open, e.g. for IMAP connections. To export from a running instance, use
 the accounts web page or webmail.
 
+If the account has encrypted message files, the account password is read from
+stdin for decrypting them.
+
 For mbox export, "mboxrd" is used where message lines starting with the magic
 "From " string are escaped by prepending a >. All ">*From " are escaped,
 otherwise reconstructing the original could lose a ">".
@@ -71,6 +83,20 @@ func xcmdExport(mbox, single bool, args []string, c *cmd) {
 		}
 	}()
 
+	// Encrypted message files can only be read with the private key of the account,
+	// which is sealed with the account password.
+	k, err := store.EncryptionKeyGet(context.Background(), db)
+	xcheckf(err, "get key for encrypted message files")
+	if k != nil {
+		fmt.Printf("account has encrypted message files, password: ")
+		pw, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		xcheckf(err, "reading password")
+		pw, err = precis.OpaqueString.String(strings.TrimRight(pw, "\r\n"))
+		xcheckf(err, `checking password with "precis" requirements`)
+		err = store.EncryptionKeyUnlock(*k, filepath.Base(accountDir), pw)
+		xcheckf(err, "unlocking key for encrypted message files")
+	}
+
 	a := store.DirArchiver{Dir: dst}
 	err = store.ExportMessages(context.Background(), c.log, db, accountDir, a, !mbox, mailbox, !single)
 	xcheckf(err, "exporting messages")
@@ -0,0 +1,39 @@
+package extauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// execHelper runs the command to verify the password. The email address and
+// password are written to its stdin, each followed by a newline, and the account
+// name is in environment variable MOX_ACCOUNT. Exit status 0 means the password
+// is valid, 1 that it is not. Anything else is an error.
+func execHelper(ctx context.Context, command []string, accountName, email, password string) (bool, error) {
+	if len(command) == 0 {
+		return false, fmt.Errorf("%w: no command configured", ErrBackend)
+	}
+	if strings.ContainsAny(email+password, "\r\n") {
+		return false, nil
+	}
+
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Stdin = strings.NewReader(email + "\n" + password + "\n")
+	cmd.Env = append(os.Environ(), "MOX_ACCOUNT="+accountName)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if err == nil {
+		return true, nil
+	} else if ctx.Err() != nil {
+		return false, fmt.Errorf("%w: running helper: %v", ErrBackend, ctx.Err())
+	} else if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return false, nil
+	}
+	return false, fmt.Errorf("%w: running helper: %v (stderr %q)", ErrBackend, err, strings.TrimSpace(stderr.String()))
+}
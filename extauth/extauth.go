@@ -0,0 +1,133 @@
+// Package extauth verifies account passwords with an external authentication
+// backend: an LDAP server (simple bind) or a helper command.
+//
+// External authentication only works with mechanisms that reveal the plain text
+// password to the server, such as SASL PLAIN and LOGIN. Successful
+// authentications are cached by the caller.
+package extauth
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/smtp"
+)
+
+var metricAuth = promauto.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "mox_extauth_duration_seconds",
+		Help:    "External authentication duration and result.",
+		Buckets: []float64{0.01, 0.05, 0.100, 0.5, 1, 5, 10, 20},
+	},
+	[]string{
+		"backend", // ldap, exec
+		"result",  // ok, badcreds, error
+	},
+)
+
+// ErrBackend is returned when the external authentication backend could not
+// give an answer, e.g. because it cannot be reached.
+var ErrBackend = errors.New("external authentication backend error")
+
+// DefaultTimeout is used when no timeout is configured for a backend.
+const DefaultTimeout = 10 * time.Second
+
+// Verify checks if password is valid for the email address of the account with
+// the configured backend. Empty passwords are never valid. Errors wrap ErrBackend.
+func Verify(ctx context.Context, log mlog.Log, conf config.ExternalAuth, rootCAs *x509.CertPool, accountName, email, password string) (ok bool, rerr error) {
+	log = log.WithPkg("extauth")
+
+	// An LDAP bind with empty password is an unauthenticated bind, which a server may
+	// accept. ../rfc/4513:610
+	if password == "" {
+		return false, nil
+	}
+
+	var backend string
+	start := time.Now()
+	defer func() {
+		result := "ok"
+		if rerr != nil {
+			result = "error"
+		} else if !ok {
+			result = "badcreds"
+		}
+		metricAuth.WithLabelValues(backend, result).Observe(float64(time.Since(start)) / float64(time.Second))
+		log.Debugx("external authentication result", rerr,
+			slog.String("backend", backend),
+			slog.String("email", email),
+			slog.Bool("ok", ok),
+			slog.Duration("duration", time.Since(start)))
+	}()
+
+	switch {
+	case conf.LDAP != nil:
+		backend = "ldap"
+		lc := conf.LDAP
+		timeout := lc.Timeout
+		if timeout == 0 {
+			timeout = DefaultTimeout
+		}
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return ldapBind(ctx, lc, rootCAs, bindDN(lc.BindDN, accountName, email), password)
+
+	case conf.Exec != nil:
+		backend = "exec"
+		timeout := conf.Exec.Timeout
+		if timeout == 0 {
+			timeout = DefaultTimeout
+		}
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return execHelper(ctx, conf.Exec.Command, accountName, email, password)
+	}
+	return false, nil
+}
+
+// bindDN returns the distinguished name from the template, with the placeholders
+// replaced by the escaped values for the login attempt.
+func bindDN(template, accountName, email string) string {
+	var localpart, domain string
+	if addr, err := smtp.ParseAddress(email); err == nil {
+		localpart = string(addr.Localpart)
+		domain = addr.Domain.Name()
+	}
+	r := strings.NewReplacer(
+		"{email}", escapeDN(email),
+		"{localpart}", escapeDN(localpart),
+		"{domain}", escapeDN(domain),
+		"{account}", escapeDN(accountName),
+	)
+	return r.Replace(template)
+}
+
+// escapeDN escapes s for use as attribute value in a distinguished name.
+// ../rfc/4514:339
+func escapeDN(s string) string {
+	var b strings.Builder
+	for i, c := range s {
+		switch {
+		case c == '"' || c == '+' || c == ',' || c == ';' || c == '<' || c == '>' || c == '\\' || c == '=':
+			b.WriteByte('\\')
+			b.WriteRune(c)
+		case c == 0:
+			b.WriteString(`\00`)
+		case (c == ' ' || c == '#') && i == 0, c == ' ' && i == len(s)-1:
+			b.WriteByte('\\')
+			b.WriteRune(c)
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,182 @@
+package extauth
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/mlog"
+)
+
+var ctxbg = context.Background()
+var pkglog = mlog.New("extauth", nil)
+
+func tcheck(t *testing.T, err error, msg string) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: %s", msg, err)
+	}
+}
+
+func tcompare(t *testing.T, got, exp any) {
+	t.Helper()
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("got:\n%#v\nexpected:\n%#v", got, exp)
+	}
+}
+
+func TestEscapeDN(t *testing.T) {
+	tcompare(t, escapeDN("mjl"), "mjl")
+	tcompare(t, escapeDN("a,b+c=d"), `a\,b\+c\=d`)
+	tcompare(t, escapeDN(" #x "), `\ #x\ `)
+	tcompare(t, escapeDN("#x"), `\#x`)
+	tcompare(t, escapeDN("a\x00b"), `a\00b`)
+
+	tcompare(t, bindDN("uid={localpart},ou={domain},o={account}", "acc,1", "mjl+x@mox.example"), `uid=mjl\+x,ou=mox.example,o=acc\,1`)
+	tcompare(t, bindDN("{email}", "mjl", "mjl@mox.example"), "mjl@mox.example")
+}
+
+func TestBER(t *testing.T) {
+	tcompare(t, berInt(3), []byte{0x02, 0x01, 0x03})
+	tcompare(t, berInt(128), []byte{0x02, 0x02, 0x00, 0x80})
+	tcompare(t, berInt(0), []byte{0x02, 0x01, 0x00})
+	tcompare(t, parseInt([]byte{0x00, 0x80}), 128)
+	tcompare(t, parseInt([]byte{0xff}), -1)
+
+	long := make([]byte, 300)
+	buf := berTLV(tagOctetString, long)
+	tcompare(t, buf[:4], []byte{tagOctetString, 0x82, 0x01, 0x2c})
+	tag, content, rest, err := parseTLV(append(buf, 1))
+	tcheck(t, err, "parse")
+	tcompare(t, tag, tagOctetString)
+	tcompare(t, len(content), 300)
+	tcompare(t, rest, []byte{1})
+
+	_, _, _, err = parseTLV([]byte{tagOctetString, 0x05, 1})
+	if !errors.Is(err, errProtocol) {
+		t.Fatalf("got err %v, expected errProtocol", err)
+	}
+}
+
+// serveLDAP is a minimal LDAP server that accepts binds for a single DN/password.
+func serveLDAP(ln net.Listener, dn, password string) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			br := bufio.NewReader(conn)
+			for {
+				tag, buf, err := readTLV(br)
+				if err != nil || tag != tagSequence {
+					return
+				}
+				_, msgID, buf, err := parseTLV(buf)
+				if err != nil {
+					return
+				}
+				tag, op, _, err := parseTLV(buf)
+				if err != nil || tag != tagBindRequest {
+					return
+				}
+				_, _, op, _ = parseTLV(op) // Version.
+				_, gotDN, op, _ := parseTLV(op)
+				_, gotPassword, _, _ := parseTLV(op)
+				code := resultInvalidCredentials
+				if string(gotDN) == dn && string(gotPassword) == password {
+					code = resultSuccess
+				}
+				resp := berTLV(tagSequence,
+					berTLV(tagInteger, msgID),
+					berTLV(tagBindResponse,
+						berTLV(tagEnumerated, []byte{byte(code)}),
+						berTLV(tagOctetString, nil),
+						berTLV(tagOctetString, []byte("diagnostic")),
+					),
+				)
+				if _, err := conn.Write(resp); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func TestLDAP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	tcheck(t, err, "listen")
+	defer ln.Close()
+	go serveLDAP(ln, "uid=mjl,dc=mox,dc=example", "test1234")
+
+	conf := config.ExternalAuth{
+		LDAP: &config.LDAPAuth{
+			URL:     "ldap://" + ln.Addr().String(),
+			BindDN:  "uid={localpart},dc=mox,dc=example",
+			Timeout: time.Second,
+		},
+	}
+
+	test := func(email, password string, expOK bool) {
+		t.Helper()
+		ok, err := Verify(ctxbg, pkglog, conf, nil, "mjl", email, password)
+		tcheck(t, err, "verify")
+		tcompare(t, ok, expOK)
+	}
+	test("mjl@mox.example", "test1234", true)
+	test("mjl@mox.example", "bad", false)
+	test("other@mox.example", "test1234", false)
+	test("mjl@mox.example", "", false)
+
+	// Unreachable server is an error.
+	badln, err := net.Listen("tcp", "127.0.0.1:0")
+	tcheck(t, err, "listen")
+	badln.Close()
+	conf.LDAP.URL = "ldap://" + badln.Addr().String()
+	_, err = Verify(ctxbg, pkglog, conf, nil, "mjl", "mjl@mox.example", "test1234")
+	if !errors.Is(err, ErrBackend) {
+		t.Fatalf("got err %v, expected ErrBackend", err)
+	}
+}
+
+func TestExec(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "auth.sh")
+	err := os.WriteFile(script, []byte(`#!/bin/sh
+read email
+read password
+if [ "$email" = "fail@mox.example" ]; then
+	exit 2
+fi
+if [ "$MOX_ACCOUNT" = "mjl" ] && [ "$email" = "mjl@mox.example" ] && [ "$password" = "test1234" ]; then
+	exit 0
+fi
+exit 1
+`), 0700)
+	tcheck(t, err, "write script")
+
+	conf := config.ExternalAuth{
+		Exec: &config.ExecAuth{Command: []string{"/bin/sh", script}, Timeout: 5 * time.Second},
+	}
+
+	test := func(account, email, password string, expOK bool, expErr error) {
+		t.Helper()
+		ok, err := Verify(ctxbg, pkglog, conf, nil, account, email, password)
+		if !errors.Is(err, expErr) {
+			t.Fatalf("got err %v, expected %v", err, expErr)
+		}
+		tcompare(t, ok, expOK)
+	}
+	test("mjl", "mjl@mox.example", "test1234", true, nil)
+	test("mjl", "mjl@mox.example", "bad", false, nil)
+	test("other", "mjl@mox.example", "test1234", false, nil)
+	test("mjl", "mjl@mox.example", "test1234\nmore", false, nil)
+	test("mjl", "fail@mox.example", "test1234", false, ErrBackend)
+}
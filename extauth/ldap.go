@@ -0,0 +1,296 @@
+package extauth
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+
+	"github.com/mjl-/mox/config"
+)
+
+// Minimal LDAP client, only for simple binds, optionally after StartTLS. Messages
+// are BER-encoded. ../rfc/4511:375
+
+const (
+	tagInteger     byte = 0x02
+	tagOctetString byte = 0x04
+	tagEnumerated  byte = 0x0a
+	tagSequence    byte = 0x30
+
+	tagBindRequest      byte = 0x60 // [APPLICATION 0], constructed.
+	tagBindResponse     byte = 0x61 // [APPLICATION 1], constructed.
+	tagUnbindRequest    byte = 0x42 // [APPLICATION 2], primitive.
+	tagExtendedRequest  byte = 0x77 // [APPLICATION 23], constructed.
+	tagExtendedResponse byte = 0x78 // [APPLICATION 24], constructed.
+
+	tagSimpleAuth  byte = 0x80 // [0] in BindRequest.
+	tagRequestName byte = 0x80 // [0] in ExtendedRequest.
+)
+
+// Result codes. ../rfc/4511:1578
+const (
+	resultSuccess            = 0
+	resultInvalidCredentials = 49
+)
+
+const startTLSOID = "1.3.6.1.4.1.1466.20037" // ../rfc/4511:2883
+
+// Maximum size of a response we read.
+const maxResponseSize = 64 * 1024
+
+var errProtocol = errors.New("ldap protocol error")
+
+// ldapBind connects to the LDAP server and does a simple bind for dn with
+// password. The bind fails with "invalid credentials" if the DN doesn't exist or
+// the password is wrong. ../rfc/4513:548
+func ldapBind(ctx context.Context, lc *config.LDAPAuth, rootCAs *x509.CertPool, dn, password string) (bool, error) {
+	u, err := url.Parse(lc.URL)
+	if err != nil {
+		return false, fmt.Errorf("%w: parsing ldap url: %v", ErrBackend, err)
+	}
+	port := u.Port()
+	if port == "" && u.Scheme == "ldaps" {
+		port = "636"
+	} else if port == "" {
+		port = "389"
+	}
+	tlsConfig := &tls.Config{
+		ServerName: u.Hostname(),
+		RootCAs:    rootCAs,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return false, fmt.Errorf("%w: dial ldap server: %v", ErrBackend, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return false, fmt.Errorf("%w: set deadline: %v", ErrBackend, err)
+		}
+	}
+
+	if u.Scheme == "ldaps" {
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return false, fmt.Errorf("%w: tls handshake: %v", ErrBackend, err)
+		}
+		conn = tlsConn
+	}
+
+	c := &ldapConn{conn: conn, br: bufio.NewReader(conn)}
+
+	if u.Scheme == "ldap" && lc.StartTLS {
+		// ../rfc/4511:2878
+		code, msg, err := c.request(berTLV(tagExtendedRequest, berTLV(tagRequestName, []byte(startTLSOID))), tagExtendedResponse)
+		if err != nil {
+			return false, fmt.Errorf("%w: starttls: %v", ErrBackend, err)
+		} else if code != resultSuccess {
+			return false, fmt.Errorf("%w: starttls: result code %d: %s", ErrBackend, code, msg)
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return false, fmt.Errorf("%w: tls handshake after starttls: %v", ErrBackend, err)
+		}
+		c.conn = tlsConn
+		c.br = bufio.NewReader(tlsConn)
+	}
+
+	// ../rfc/4511:1066
+	bind := berTLV(tagBindRequest,
+		berInt(3), // Version.
+		berTLV(tagOctetString, []byte(dn)),
+		berTLV(tagSimpleAuth, []byte(password)),
+	)
+	code, msg, err := c.request(bind, tagBindResponse)
+	if err != nil {
+		return false, fmt.Errorf("%w: bind: %v", ErrBackend, err)
+	}
+
+	// Unbind is just a signal to the server we are going away. ../rfc/4511:1235
+	c.msgID++
+	_, _ = c.conn.Write(berTLV(tagSequence, berInt(c.msgID), []byte{tagUnbindRequest, 0}))
+
+	switch code {
+	case resultSuccess:
+		return true, nil
+	case resultInvalidCredentials:
+		return false, nil
+	}
+	return false, fmt.Errorf("%w: bind: result code %d: %s", ErrBackend, code, msg)
+}
+
+type ldapConn struct {
+	conn  net.Conn
+	br    *bufio.Reader
+	msgID int
+}
+
+// request writes an LDAPMessage with op, and reads the response, which must be an
+// LDAPResult with tag expTag. The result code and diagnostic message are returned.
+func (c *ldapConn) request(op []byte, expTag byte) (code int, msg string, rerr error) {
+	// ../rfc/4511:383
+	c.msgID++
+	if _, err := c.conn.Write(berTLV(tagSequence, berInt(c.msgID), op)); err != nil {
+		return 0, "", fmt.Errorf("write request: %v", err)
+	}
+
+	tag, buf, err := readTLV(c.br)
+	if err != nil {
+		return 0, "", fmt.Errorf("read response: %w", err)
+	} else if tag != tagSequence {
+		return 0, "", fmt.Errorf("%w: got tag %#x for message, expected sequence", errProtocol, tag)
+	}
+
+	tag, content, buf, err := parseTLV(buf)
+	if err != nil {
+		return 0, "", err
+	} else if tag != tagInteger {
+		return 0, "", fmt.Errorf("%w: got tag %#x for message id, expected integer", errProtocol, tag)
+	} else if id := parseInt(content); id != c.msgID {
+		// Could be a notice of disconnection with message id 0. ../rfc/4511:595
+		return 0, "", fmt.Errorf("%w: got message id %d, expected %d", errProtocol, id, c.msgID)
+	}
+
+	tag, buf, _, err = parseTLV(buf)
+	if err != nil {
+		return 0, "", err
+	} else if tag != expTag {
+		return 0, "", fmt.Errorf("%w: got tag %#x for response, expected %#x", errProtocol, tag, expTag)
+	}
+
+	// LDAPResult: resultCode, matchedDN, diagnosticMessage. ../rfc/4511:516
+	tag, content, buf, err = parseTLV(buf)
+	if err != nil {
+		return 0, "", err
+	} else if tag != tagEnumerated {
+		return 0, "", fmt.Errorf("%w: got tag %#x for result code, expected enumerated", errProtocol, tag)
+	}
+	code = parseInt(content)
+	if _, _, buf, err = parseTLV(buf); err == nil {
+		if _, content, _, err := parseTLV(buf); err == nil {
+			msg = string(content)
+		}
+	}
+	return code, msg, nil
+}
+
+// berTLV returns a BER encoding of a value with tag and the concatenated contents.
+func berTLV(tag byte, contents ...[]byte) []byte {
+	var n int
+	for _, c := range contents {
+		n += len(c)
+	}
+	buf := []byte{tag}
+	if n < 0x80 {
+		buf = append(buf, byte(n))
+	} else {
+		var l []byte
+		for v := n; v > 0; v >>= 8 {
+			l = append([]byte{byte(v)}, l...)
+		}
+		buf = append(buf, 0x80|byte(len(l)))
+		buf = append(buf, l...)
+	}
+	for _, c := range contents {
+		buf = append(buf, c...)
+	}
+	return buf
+}
+
+// berInt returns a BER encoding of non-negative integer v.
+func berInt(v int) []byte {
+	var buf []byte
+	for {
+		buf = append([]byte{byte(v)}, buf...)
+		v >>= 8
+		if v == 0 {
+			break
+		}
+	}
+	if buf[0]&0x80 != 0 {
+		// Would be interpreted as negative.
+		buf = append([]byte{0}, buf...)
+	}
+	return berTLV(tagInteger, buf)
+}
+
+// parseInt parses the contents of a BER integer or enumerated.
+func parseInt(buf []byte) int {
+	var v int
+	for i, b := range buf {
+		if i == 0 && b&0x80 != 0 {
+			v = -1
+		}
+		v = v<<8 | int(b)
+	}
+	return v
+}
+
+// readTLV reads a single BER value, returning its tag and contents.
+func readTLV(br *bufio.Reader) (tag byte, content []byte, rerr error) {
+	tag, err := br.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, err := br.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	size := int(n)
+	if n&0x80 != 0 {
+		if n&0x7f == 0 || n&0x7f > 4 {
+			return 0, nil, fmt.Errorf("%w: unsupported length encoding", errProtocol)
+		}
+		size = 0
+		for i := 0; i < int(n&0x7f); i++ {
+			b, err := br.ReadByte()
+			if err != nil {
+				return 0, nil, err
+			}
+			size = size<<8 | int(b)
+		}
+	}
+	if size > maxResponseSize {
+		return 0, nil, fmt.Errorf("%w: response too large", errProtocol)
+	}
+	content = make([]byte, size)
+	if _, err := io.ReadFull(br, content); err != nil {
+		return 0, nil, err
+	}
+	return tag, content, nil
+}
+
+// parseTLV parses the first BER value from buf, returning its tag, contents and
+// the remaining data.
+func parseTLV(buf []byte) (tag byte, content, rest []byte, rerr error) {
+	if len(buf) < 2 {
+		return 0, nil, nil, fmt.Errorf("%w: short value", errProtocol)
+	}
+	tag = buf[0]
+	size := int(buf[1])
+	buf = buf[2:]
+	if size&0x80 != 0 {
+		nlen := size & 0x7f
+		if nlen == 0 || nlen > 4 || len(buf) < nlen {
+			return 0, nil, nil, fmt.Errorf("%w: bad length encoding", errProtocol)
+		}
+		size = 0
+		for _, b := range buf[:nlen] {
+			size = size<<8 | int(b)
+		}
+		buf = buf[nlen:]
+	}
+	if size > len(buf) {
+		return 0, nil, nil, fmt.Errorf("%w: value length %d beyond end of data", errProtocol, size)
+	}
+	return tag, buf[:size], buf[size:], nil
+}
@@ -28,8 +28,10 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"github.com/mjl-/mox/autotls"
+	"github.com/mjl-/mox/carddavserver"
 	"github.com/mjl-/mox/config"
 	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/jmapserver"
 	"github.com/mjl-/mox/mlog"
 	"github.com/mjl-/mox/mox-"
 	"github.com/mjl-/mox/ratelimit"
@@ -382,7 +384,7 @@ func (s *serve) SystemHandle(name string, hostMatch func(dns.IPDomain) bool, pat
 }
 
 // Like SystemHandle, but for internal services "admin", "account", "webmail",
-// "webapi" configured in the mox.conf Listener.
+// "webapi", "jmap", "carddav" configured in the mox.conf Listener.
 func (s *serve) ServiceHandle(name string, hostMatch func(dns.IPDomain) bool, path string, fn http.Handler) {
 	s.ServiceHandlers = append(s.ServiceHandlers, pathHandler{name, hostMatch, path, fn})
 }
@@ -510,6 +512,31 @@ func redirectToTrailingSlash(srv *serve, hostMatch func(dns.IPDomain) bool, name
 	}
 }
 
+// redirectWellKnownJMAP redirects requests for the well-known JMAP session
+// resource to the configured JMAP path, for autodiscovery by clients.
+// ../rfc/8620:813
+func redirectWellKnownJMAP(srv *serve, hostMatch func(dns.IPDomain) bool, path string) {
+	if path == "/.well-known/jmap/" {
+		return
+	}
+	handler := mox.SafeHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, path, http.StatusTemporaryRedirect)
+	}))
+	srv.ServiceHandle("jmap", hostMatch, "/.well-known/jmap", handler)
+}
+
+// redirectWellKnownCardDAV redirects requests for the well-known CardDAV path to
+// the configured CardDAV path, for autodiscovery by clients. ../rfc/6764:335
+func redirectWellKnownCardDAV(srv *serve, hostMatch func(dns.IPDomain) bool, path string) {
+	if path == "/.well-known/carddav/" {
+		return
+	}
+	handler := mox.SafeHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, path, http.StatusTemporaryRedirect)
+	}))
+	srv.ServiceHandle("carddav", hostMatch, "/.well-known/carddav", handler)
+}
+
 // Listen binds to sockets for HTTP listeners, including those required for ACME to
 // generate TLS certificates. It stores the listeners so Serve can start serving them.
 func Listen() {
@@ -575,7 +602,7 @@ func portServes(l config.Listener) map[int]*serve {
 		return s
 	}
 
-	if l.TLS != nil && l.TLS.ACME != "" && (l.SMTP.Enabled && !l.SMTP.NoSTARTTLS || l.Submissions.Enabled || l.IMAPS.Enabled) {
+	if l.TLS != nil && l.TLS.ACME != "" && (l.SMTP.Enabled && !l.SMTP.NoSTARTTLS || l.Submissions.Enabled || l.IMAPS.Enabled || l.POP3S.Enabled) {
 		port := config.Port(mox.Conf.Static.ACME[l.TLS.ACME].Port, 443)
 		ensureServe(true, port, "acme-tls-alpn-01")
 	}
@@ -654,6 +681,56 @@ func portServes(l config.Listener) map[int]*serve {
 		redirectToTrailingSlash(srv, accountHostMatch, "webapi", path)
 	}
 
+	if l.JMAPHTTP.Enabled {
+		port := config.Port(l.JMAPHTTP.Port, 80)
+		path := "/jmap/"
+		if l.JMAPHTTP.Path != "" {
+			path = l.JMAPHTTP.Path
+		}
+		srv := ensureServe(false, port, "jmap-http at "+path)
+		handler := mox.SafeHeaders(http.StripPrefix(path[:len(path)-1], jmapserver.NewServer(maxMsgSize, path, l.JMAPHTTP.Forwarded)))
+		srv.ServiceHandle("jmap", accountHostMatch, path, handler)
+		redirectToTrailingSlash(srv, accountHostMatch, "jmap", path)
+		redirectWellKnownJMAP(srv, accountHostMatch, path)
+	}
+	if l.JMAPHTTPS.Enabled {
+		port := config.Port(l.JMAPHTTPS.Port, 443)
+		path := "/jmap/"
+		if l.JMAPHTTPS.Path != "" {
+			path = l.JMAPHTTPS.Path
+		}
+		srv := ensureServe(true, port, "jmap-https at "+path)
+		handler := mox.SafeHeaders(http.StripPrefix(path[:len(path)-1], jmapserver.NewServer(maxMsgSize, path, l.JMAPHTTPS.Forwarded)))
+		srv.ServiceHandle("jmap", accountHostMatch, path, handler)
+		redirectToTrailingSlash(srv, accountHostMatch, "jmap", path)
+		redirectWellKnownJMAP(srv, accountHostMatch, path)
+	}
+
+	if l.CardDAVHTTP.Enabled {
+		port := config.Port(l.CardDAVHTTP.Port, 80)
+		path := "/carddav/"
+		if l.CardDAVHTTP.Path != "" {
+			path = l.CardDAVHTTP.Path
+		}
+		srv := ensureServe(false, port, "carddav-http at "+path)
+		handler := mox.SafeHeaders(http.StripPrefix(path[:len(path)-1], carddavserver.NewServer(path, l.CardDAVHTTP.Forwarded)))
+		srv.ServiceHandle("carddav", accountHostMatch, path, handler)
+		redirectToTrailingSlash(srv, accountHostMatch, "carddav", path)
+		redirectWellKnownCardDAV(srv, accountHostMatch, path)
+	}
+	if l.CardDAVHTTPS.Enabled {
+		port := config.Port(l.CardDAVHTTPS.Port, 443)
+		path := "/carddav/"
+		if l.CardDAVHTTPS.Path != "" {
+			path = l.CardDAVHTTPS.Path
+		}
+		srv := ensureServe(true, port, "carddav-https at "+path)
+		handler := mox.SafeHeaders(http.StripPrefix(path[:len(path)-1], carddavserver.NewServer(path, l.CardDAVHTTPS.Forwarded)))
+		srv.ServiceHandle("carddav", accountHostMatch, path, handler)
+		redirectToTrailingSlash(srv, accountHostMatch, "carddav", path)
+		redirectWellKnownCardDAV(srv, accountHostMatch, path)
+	}
+
 	if l.WebmailHTTP.Enabled {
 		port := config.Port(l.WebmailHTTP.Port, 80)
 		path := "/webmail/"
@@ -227,6 +227,32 @@ func (c *Conn) Append(mailbox string, flags []string, received *time.Time, messa
 	return c.Transactf("append %s (%s)%s {%d+}\r\n%s", astring(mailbox), strings.Join(flags, " "), date, len(message), message)
 }
 
+// SetACL sets the rights of identifier on mailbox. Rights can start with "+" or
+// "-" to add or remove rights.
+func (c *Conn) SetACL(mailbox, identifier, rights string) (untagged []Untagged, result Result, rerr error) {
+	defer c.recover(&rerr)
+	return c.Transactf("setacl %s %s %s", astring(mailbox), astring(identifier), astring(rights))
+}
+
+// DeleteACL removes the rights of identifier on mailbox.
+func (c *Conn) DeleteACL(mailbox, identifier string) (untagged []Untagged, result Result, rerr error) {
+	defer c.recover(&rerr)
+	return c.Transactf("deleteacl %s %s", astring(mailbox), astring(identifier))
+}
+
+// GetACL returns the access control list of mailbox in an UntaggedACL response.
+func (c *Conn) GetACL(mailbox string) (untagged []Untagged, result Result, rerr error) {
+	defer c.recover(&rerr)
+	return c.Transactf("getacl %s", astring(mailbox))
+}
+
+// MyRights returns the rights of the authenticated user on mailbox in an
+// UntaggedMyrights response.
+func (c *Conn) MyRights(mailbox string) (untagged []Untagged, result Result, rerr error) {
+	defer c.recover(&rerr)
+	return c.Transactf("myrights %s", astring(mailbox))
+}
+
 // note: No idle command. Idle is better implemented by writing the request and reading and handling the responses as they come in.
 
 // CloseMailbox closes the currently selected/active mailbox, permanently removing
@@ -443,6 +443,36 @@ func (c *Conn) xuntagged() Untagged {
 		c.xcrlf()
 		return r
 
+	case "SORT":
+		// ../rfc/5256
+		var nums []uint32
+		for c.take(' ') {
+			// ../rfc/7162:2557
+			if c.take('(') {
+				c.xtake("MODSEQ")
+				c.xspace()
+				modseq := c.xint64()
+				c.xtake(")")
+				c.xcrlf()
+				return UntaggedSortModSeq{nums, modseq}
+			}
+			nums = append(nums, c.xnzuint32())
+		}
+		r := UntaggedSort(nums)
+		c.xcrlf()
+		return r
+
+	case "THREAD":
+		// ../rfc/5256
+		var r UntaggedThread
+		if c.take(' ') {
+			for c.peek('(') {
+				r = append(r, c.xthreadList())
+			}
+		}
+		c.xcrlf()
+		return r
+
 	case "ESEARCH":
 		r := c.xesearchResponse()
 		c.xcrlf()
@@ -492,6 +522,44 @@ func (c *Conn) xuntagged() Untagged {
 		c.xcrlf()
 		return UntaggedVanished{earlier, NumSet{Ranges: uids}}
 
+	// ../rfc/4314:1452
+	case "ACL":
+		c.xspace()
+		mailbox := c.xastring()
+		var l []ACLEntry
+		for c.take(' ') {
+			id := c.xastring()
+			c.xspace()
+			rights := c.xastring()
+			l = append(l, ACLEntry{id, rights})
+		}
+		c.xcrlf()
+		return UntaggedACL{mailbox, l}
+
+	// ../rfc/4314:1465
+	case "LISTRIGHTS":
+		c.xspace()
+		mailbox := c.xastring()
+		c.xspace()
+		id := c.xastring()
+		c.xspace()
+		required := c.xastring()
+		var optional []string
+		for c.take(' ') {
+			optional = append(optional, c.xastring())
+		}
+		c.xcrlf()
+		return UntaggedListrights{mailbox, id, required, optional}
+
+	// ../rfc/4314:1470
+	case "MYRIGHTS":
+		c.xspace()
+		mailbox := c.xastring()
+		c.xspace()
+		rights := c.xastring()
+		c.xcrlf()
+		return UntaggedMyrights{mailbox, rights}
+
 	// ../rfc/9208:668 ../2087:242
 	case "QUOTAROOT":
 		c.xspace()
@@ -1168,6 +1236,34 @@ func (c *Conn) xneedDisabled(msg string, caps ...Capability) {
 	}
 }
 
+// ../rfc/5256
+func (c *Conn) xthreadList() ThreadNode {
+	c.xtake("(")
+	var r ThreadNode
+	if c.peek('(') {
+		// Dummy node, with only nested threads.
+		for c.peek('(') {
+			r.Children = append(r.Children, c.xthreadList())
+		}
+		c.xtake(")")
+		return r
+	}
+	r.Number = c.xnzuint32()
+	n := &r
+	for c.take(' ') {
+		if c.peek('(') {
+			for c.peek('(') {
+				n.Children = append(n.Children, c.xthreadList())
+			}
+			break
+		}
+		n.Children = []ThreadNode{{Number: c.xnzuint32()}}
+		n = &n.Children[0]
+	}
+	c.xtake(")")
+	return r
+}
+
 // ../rfc/9051:6546
 // Already consumed: "ESEARCH"
 func (c *Conn) xesearchResponse() (r UntaggedEsearch) {
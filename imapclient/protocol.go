@@ -222,6 +222,26 @@ type UntaggedSearchModSeq struct {
 	Nums   []uint32
 	ModSeq int64
 }
+
+// ../rfc/5256
+type UntaggedSort []uint32
+
+// ../rfc/7162:1101
+type UntaggedSortModSeq struct {
+	Nums   []uint32
+	ModSeq int64
+}
+
+// UntaggedThread holds the threads in a THREAD response. ../rfc/5256
+type UntaggedThread []ThreadNode
+
+// ThreadNode is a message in a thread, with its replies. Number is 0 for a dummy
+// node, which has at least two children.
+type ThreadNode struct {
+	Number   uint32
+	Children []ThreadNode
+}
+
 type UntaggedStatus struct {
 	Mailbox string
 	Attrs   map[StatusAttr]int64 // Upper case status attributes.
@@ -307,6 +327,34 @@ type QuotaResource struct {
 
 type UntaggedID map[string]string
 
+// UntaggedACL is the access control list of a mailbox. ../rfc/4314:1452
+type UntaggedACL struct {
+	Mailbox string
+	Entries []ACLEntry
+}
+
+// ACLEntry holds the rights for an identifier in an access control list.
+type ACLEntry struct {
+	Identifier string
+	Rights     string
+}
+
+// UntaggedListrights holds the rights that can be granted to an identifier on a
+// mailbox. ../rfc/4314:1465
+type UntaggedListrights struct {
+	Mailbox    string
+	Identifier string
+	Required   string   // Always granted.
+	Optional   []string // Groups of rights that can be granted.
+}
+
+// UntaggedMyrights holds the rights of the authenticated user on a mailbox.
+// ../rfc/4314:1470
+type UntaggedMyrights struct {
+	Mailbox string
+	Rights  string
+}
+
 // Extended data in an ESEARCH response.
 type EsearchDataExt struct {
 	Tag   string
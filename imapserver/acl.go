@@ -0,0 +1,564 @@
+package imapserver
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/store"
+)
+
+// Namespaces for mailboxes of other accounts, in addition to the personal
+// namespace without prefix. Mailboxes shared with an account explicitly are
+// visible as "Other Users/<account>/<mailbox>", mailboxes shared with all
+// accounts through the "anyone" identifier as "Shared/<account>/<mailbox>".
+// ../rfc/2342:170
+const (
+	nsOtherUsers = "Other Users"
+	nsShared     = "Shared"
+)
+
+// isSharedName returns whether name is in the namespace for mailboxes of other
+// accounts, including the namespace roots themselves.
+func isSharedName(name string) bool {
+	for _, ns := range []string{nsOtherUsers, nsShared} {
+		if name == ns || strings.HasPrefix(name, ns+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// xsharedName parses a mailbox name in the "Other Users" or "Shared" namespace
+// into the name of the account owning the mailbox and the name of the mailbox
+// within that account. Ok is false for names in the personal namespace.
+func xsharedName(name string) (accName, mbName string, ok bool) {
+	if !isSharedName(name) {
+		return "", "", false
+	}
+	t := strings.SplitN(name, "/", 3)
+	if len(t) != 3 || t[1] == "" || t[2] == "" {
+		xusercodeErrorf("NONEXISTENT", "%w", store.ErrUnknownMailbox)
+	}
+	mbName, _, err := store.CheckMailboxName(t[2], true)
+	if err != nil {
+		xusercodeErrorf("CANNOT", "%s", err)
+	}
+	return t[1], mbName, true
+}
+
+// authAccount returns the account of the authenticated user. While a mailbox of
+// another account is selected, c.account is that other account.
+func (c *conn) authAccount() *store.Account {
+	if c.loginAccount != nil {
+		return c.loginAccount
+	}
+	return c.account
+}
+
+// broadcastAccount broadcasts changes for acc, which may be an account other
+// than that of the selected mailbox.
+func (c *conn) broadcastAccount(acc *store.Account, changes []store.Change) {
+	if acc == c.account {
+		c.broadcast(changes)
+	} else if acc == c.loginAccount {
+		c.loginComm.Broadcast(changes)
+	} else {
+		store.BroadcastChanges(acc, changes)
+	}
+}
+
+// xsharedMailbox opens the account of a mailbox of another account, and looks up
+// the mailbox and the rights the authenticated account has on it. Mailboxes
+// without lookup and read rights are treated as nonexistent. The caller must close
+// the returned account.
+func (c *conn) xsharedMailbox(accName, mbName, missingErrCode string) (*store.Account, store.Mailbox, string) {
+	if accName == c.authAccount().Name {
+		xusercodeErrorf(missingErrCode, "%w", store.ErrUnknownMailbox)
+	}
+	acc, err := store.OpenAccount(c.log, accName)
+	if err != nil && errors.Is(err, store.ErrAccountUnknown) {
+		xusercodeErrorf(missingErrCode, "%w", store.ErrUnknownMailbox)
+	}
+	xcheckf(err, "open account")
+	ok := false
+	defer func() {
+		if !ok {
+			err := acc.Close()
+			c.xsanity(err, "closing account")
+		}
+	}()
+
+	var mb store.Mailbox
+	var rights string
+	acc.WithRLock(func() {
+		xdbreadAccount(acc, func(tx *bstore.Tx) {
+			mb = c.xmailbox(tx, mbName, missingErrCode)
+			rights, err = acc.MailboxRights(tx, mb.ID, c.authAccount().Name)
+			xcheckf(err, "get mailbox rights")
+		})
+	})
+	if !strings.ContainsAny(rights, "lr") {
+		xusercodeErrorf(missingErrCode, "%w", store.ErrUnknownMailbox)
+	}
+	ok = true
+	return acc, mb, rights
+}
+
+// xrequireRights checks that all of required are in rights.
+func xrequireRights(rights, required string) {
+	if !store.HasRights(rights, required) {
+		// ../rfc/4314:1362
+		xusercodeErrorf("NOPERM", "missing rights %q on mailbox", required)
+	}
+}
+
+// rightsFlags clears flags and keywords the rights do not allow setting, for
+// APPEND and COPY/MOVE into mailboxes of other accounts. ../rfc/4314:704
+func rightsFlags(rights string, flags store.Flags, keywords []string) (store.Flags, []string) {
+	if !strings.Contains(rights, "w") {
+		flags = store.Flags{Seen: flags.Seen, Deleted: flags.Deleted}
+		keywords = nil
+	}
+	if !strings.Contains(rights, "s") {
+		flags.Seen = false
+	}
+	if !strings.Contains(rights, "t") {
+		flags.Deleted = false
+	}
+	return flags, keywords
+}
+
+// xaclMailbox resolves name for the ACL commands, returning the account holding
+// the mailbox, the mailbox and the rights of the authenticated account. For
+// personal mailboxes, that's the authenticated account with all rights. The
+// returned function must be called to close the account.
+func (c *conn) xaclMailbox(name string) (*store.Account, store.Mailbox, string, func()) {
+	name = xcheckmailboxname(name, true)
+	if accName, mbName, ok := xsharedName(name); ok {
+		acc, mb, rights := c.xsharedMailbox(accName, mbName, "NONEXISTENT")
+		return acc, mb, rights, func() {
+			err := acc.Close()
+			c.xsanity(err, "closing account")
+		}
+	}
+
+	acc := c.authAccount()
+	var mb store.Mailbox
+	acc.WithRLock(func() {
+		xdbreadAccount(acc, func(tx *bstore.Tx) {
+			mb = c.xmailbox(tx, name, "NONEXISTENT")
+		})
+	})
+	return acc, mb, store.RightsAll, func() {}
+}
+
+// SETACL changes the rights of an identifier on a mailbox. Rights can be set,
+// added with a "+" prefix, or removed with a "-" prefix. Identifiers are account
+// names, or "anyone".
+//
+// State: Authenticated and selected.
+func (c *conn) cmdSetacl(tag, cmd string, p *parser) {
+	// Command: ../rfc/4314:633
+
+	// Request syntax: ../rfc/4314:1500
+	p.xspace()
+	name := p.xmailbox()
+	p.xspace()
+	identifier := p.xastring()
+	p.xspace()
+	modRights := p.xastring()
+	p.xempty()
+
+	var mod byte
+	if strings.HasPrefix(modRights, "+") || strings.HasPrefix(modRights, "-") {
+		mod = modRights[0]
+		modRights = modRights[1:]
+	}
+	rights, err := store.ParseRights(modRights)
+	if err != nil {
+		// ../rfc/4314:663
+		xsyntaxErrorf("%s", err)
+	}
+
+	acc, mb, myRights, closeAcc := c.xaclMailbox(name)
+	defer closeAcc()
+	xrequireRights(myRights, "a")
+
+	acc.WithWLock(func() {
+		xdbwriteAccount(acc, func(tx *bstore.Tx) {
+			if mod != 0 {
+				cur, err := store.MailboxACLList(tx, mb.ID)
+				xcheckf(err, "listing acl")
+				var have string
+				for _, acl := range cur {
+					if acl.Identifier == identifier {
+						have = acl.Rights
+					}
+				}
+				if mod == '+' {
+					rights = have + rights
+				} else {
+					rights = strings.Map(func(r rune) rune {
+						if strings.ContainsRune(rights, r) {
+							return -1
+						}
+						return r
+					}, have)
+				}
+			}
+			err := acc.MailboxACLSet(tx, mb.ID, identifier, rights)
+			if err != nil && errors.Is(err, store.ErrACLIdentifier) {
+				xuserErrorf("%s", err)
+			}
+			xcheckf(err, "setting acl")
+		})
+	})
+
+	c.ok(tag, cmd)
+}
+
+// DELETEACL removes the rights of an identifier on a mailbox.
+//
+// State: Authenticated and selected.
+func (c *conn) cmdDeleteacl(tag, cmd string, p *parser) {
+	// Command: ../rfc/4314:700
+
+	// Request syntax: ../rfc/4314:1480
+	p.xspace()
+	name := p.xmailbox()
+	p.xspace()
+	identifier := p.xastring()
+	p.xempty()
+
+	acc, mb, myRights, closeAcc := c.xaclMailbox(name)
+	defer closeAcc()
+	xrequireRights(myRights, "a")
+
+	acc.WithWLock(func() {
+		xdbwriteAccount(acc, func(tx *bstore.Tx) {
+			err := acc.MailboxACLSet(tx, mb.ID, identifier, "")
+			if err != nil && errors.Is(err, store.ErrACLIdentifier) {
+				xuserErrorf("%s", err)
+			}
+			xcheckf(err, "removing acl")
+		})
+	})
+
+	c.ok(tag, cmd)
+}
+
+// GETACL returns the access control list of a mailbox. The owner is always
+// included, with all rights.
+//
+// State: Authenticated and selected.
+func (c *conn) cmdGetacl(tag, cmd string, p *parser) {
+	// Command: ../rfc/4314:737
+
+	// Request syntax: ../rfc/4314:1484
+	p.xspace()
+	name := p.xmailbox()
+	p.xempty()
+
+	acc, mb, myRights, closeAcc := c.xaclMailbox(name)
+	defer closeAcc()
+	xrequireRights(myRights, "a")
+
+	var acls []store.MailboxACL
+	acc.WithRLock(func() {
+		xdbreadAccount(acc, func(tx *bstore.Tx) {
+			var err error
+			acls, err = store.MailboxACLList(tx, mb.ID)
+			xcheckf(err, "listing acl")
+		})
+	})
+
+	// Response syntax: ../rfc/4314:1452
+	l := []string{astring(c.encodeMailbox(name)).pack(c), astring(acc.Name).pack(c), store.RightsAll}
+	for _, acl := range acls {
+		l = append(l, astring(acl.Identifier).pack(c), astring(acl.Rights).pack(c))
+	}
+	c.bwritelinef("* ACL %s", strings.Join(l, " "))
+	c.ok(tag, cmd)
+}
+
+// LISTRIGHTS returns the rights that can be granted to an identifier on a
+// mailbox. The owner always has all rights, other identifiers can be given each
+// right individually.
+//
+// State: Authenticated and selected.
+func (c *conn) cmdListrights(tag, cmd string, p *parser) {
+	// Command: ../rfc/4314:771
+
+	// Request syntax: ../rfc/4314:1492
+	p.xspace()
+	name := p.xmailbox()
+	p.xspace()
+	identifier := p.xastring()
+	p.xempty()
+
+	acc, _, myRights, closeAcc := c.xaclMailbox(name)
+	defer closeAcc()
+	xrequireRights(myRights, "a")
+
+	// Response syntax: ../rfc/4314:1465
+	l := []string{astring(c.encodeMailbox(name)).pack(c), astring(identifier).pack(c)}
+	if identifier == acc.Name {
+		l = append(l, store.RightsAll)
+	} else {
+		l = append(l, `""`)
+		for _, r := range store.RightsAll {
+			l = append(l, string(r))
+		}
+	}
+	c.bwritelinef("* LISTRIGHTS %s", strings.Join(l, " "))
+	c.ok(tag, cmd)
+}
+
+// MYRIGHTS returns the rights of the authenticated account on a mailbox.
+//
+// State: Authenticated and selected.
+func (c *conn) cmdMyrights(tag, cmd string, p *parser) {
+	// Command: ../rfc/4314:826
+
+	// Request syntax: ../rfc/4314:1496
+	p.xspace()
+	name := p.xmailbox()
+	p.xempty()
+
+	_, _, myRights, closeAcc := c.xaclMailbox(name)
+	defer closeAcc()
+
+	// Response syntax: ../rfc/4314:1470
+	c.bwritelinef("* MYRIGHTS %s %s", astring(c.encodeMailbox(name)).pack(c), astring(myRights).pack(c))
+	c.ok(tag, cmd)
+}
+
+// xcopyAccount copies messages from the selected mailbox to a mailbox of
+// another account, e.g. from a shared mailbox to a personal mailbox. The messages
+// are delivered as new messages, with their files copied. Flags and keywords the
+// rights on the destination mailbox don't allow are not copied.
+func (c *conn) xcopyAccount(uids []store.UID, uidargs []any, dstAcc *store.Account, dstName, dstRights string) (mbDst store.Mailbox, newUIDs []store.UID) {
+	if len(uidargs) == 0 {
+		xuserErrorf("no matching messages to copy")
+	}
+
+	var msgs []store.Message
+	c.account.WithRLock(func() {
+		c.xdbread(func(tx *bstore.Tx) {
+			c.xmailboxID(tx, c.mailboxID) // Validate.
+
+			q := bstore.QueryTx[store.Message](tx)
+			q.FilterNonzero(store.Message{MailboxID: c.mailboxID})
+			q.FilterEqual("UID", uidargs...)
+			q.FilterEqual("Expunged", false)
+			q.SortAsc("UID")
+			var err error
+			msgs, err = q.List()
+			xcheckf(err, "fetching messages")
+		})
+	})
+	if len(msgs) != len(uids) {
+		xserverErrorf("uid and message mismatch")
+	}
+
+	// Copies of the message files, decrypted if needed: The other account may have a
+	// different key for encrypting message files.
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			store.CloseRemoveTempFile(c.log, f, "copy of message for other account")
+		}
+	}()
+	for _, m := range msgs {
+		f, err := c.account.MessageTempFile(c.log, m)
+		xcheckf(err, "copying message file")
+		files = append(files, f)
+	}
+
+	// Files that were created during the copy. Remove them if the operation fails.
+	var createdIDs []int64
+	defer func() {
+		x := recover()
+		if x == nil {
+			return
+		}
+		for _, id := range createdIDs {
+			p := dstAcc.MessagePath(id)
+			err := os.Remove(p)
+			c.xsanity(err, "cleaning up created file")
+		}
+		panic(x)
+	}()
+
+	dstAcc.WithWLock(func() {
+		var changes []store.Change
+		var mbKwChanged bool
+
+		xdbwriteAccount(dstAcc, func(tx *bstore.Tx) {
+			mbDst = c.xmailbox(tx, dstName, "TRYCREATE")
+
+			var totalSize int64
+			for _, m := range msgs {
+				totalSize += m.Size
+			}
+			if ok, maxSize, err := dstAcc.CanAddMessageSize(tx, totalSize); err != nil {
+				xcheckf(err, "checking quota")
+			} else if !ok {
+				// ../rfc/9051:5155 ../rfc/9208:472
+				xusercodeErrorf("OVERQUOTA", "account over maximum total message size %d", maxSize)
+			}
+
+			for i, om := range msgs {
+				flags, keywords := rightsFlags(dstRights, om.Flags, om.Keywords)
+				m := store.Message{
+					MailboxID:     mbDst.ID,
+					MailboxOrigID: mbDst.ID,
+					Received:      om.Received,
+					Flags:         flags,
+					Keywords:      keywords,
+					Size:          om.Size,
+					MsgPrefix:     om.MsgPrefix,
+				}
+
+				var kwChanged bool
+				mbDst.Keywords, kwChanged = store.MergeKeywords(mbDst.Keywords, keywords)
+				mbKwChanged = mbKwChanged || kwChanged
+				mbDst.Add(m.MailboxCounts())
+
+				// Update mailbox before delivering, which updates uidnext which we mustn't overwrite.
+				err := tx.Update(&mbDst)
+				xcheckf(err, "updating destination mailbox")
+
+				err = dstAcc.DeliverMessage(c.log, tx, &m, files[i], true, false, false, true)
+				xcheckf(err, "delivering message")
+				createdIDs = append(createdIDs, m.ID)
+
+				mbDst = c.xmailboxID(tx, mbDst.ID)
+				newUIDs = append(newUIDs, m.UID)
+				changes = append(changes, m.ChangeAddUID())
+			}
+		})
+
+		changes = append(changes, mbDst.ChangeCounts())
+		if mbKwChanged {
+			changes = append(changes, mbDst.ChangeKeywords())
+		}
+		c.broadcastAccount(dstAcc, changes)
+	})
+
+	// All good, prevent defer above from cleaning up copied files.
+	createdIDs = nil
+
+	return mbDst, newUIDs
+}
+
+// xmoveAccount moves messages from the selected mailbox to a mailbox in another
+// account. The messages are copied to the other account, then marked \Deleted
+// and expunged from the selected mailbox. Responses are written like for a move
+// within an account.
+func (c *conn) xmoveAccount(tag, cmd string, uids []store.UID, uidargs []any, dstAcc *store.Account, dstName, dstRights string) {
+	mbDst, newUIDs := c.xcopyAccount(uids, uidargs, dstAcc, dstName, dstRights)
+
+	c.account.WithWLock(func() {
+		c.xdbwrite(func(tx *bstore.Tx) {
+			mb := c.xmailboxID(tx, c.mailboxID)
+
+			q := bstore.QueryTx[store.Message](tx)
+			q.FilterNonzero(store.Message{MailboxID: c.mailboxID})
+			q.FilterEqual("UID", uidargs...)
+			q.FilterEqual("Expunged", false)
+			q.FilterEqual("Deleted", false)
+			err := q.ForEach(func(m store.Message) error {
+				mb.Sub(m.MailboxCounts())
+				m.Deleted = true
+				mb.Add(m.MailboxCounts())
+				return tx.Update(&m)
+			})
+			xcheckf(err, "marking messages as deleted")
+			err = tx.Update(&mb)
+			xcheckf(err, "updating mailbox counts")
+		})
+	})
+
+	var uidSet numSet
+	for _, uid := range uids {
+		uidSet.append(uint32(uid))
+	}
+	remove, modseq := c.xexpunge(&uidSet, false)
+
+	acc := c.account
+	defer func() {
+		for _, m := range remove {
+			p := acc.MessagePath(m.ID)
+			err := os.Remove(p)
+			c.xsanity(err, "removing message file for move")
+		}
+	}()
+
+	// ../rfc/9051:4708 ../rfc/6851:254
+	c.bwritelinef("* OK [COPYUID %d %s %s] moved", mbDst.UIDValidity, compactUIDSet(uids).String(), compactUIDSet(newUIDs).String())
+	qresync := c.enabled[capQresync]
+	var vanishedUIDs numSet
+	for _, m := range remove {
+		seq := c.xsequence(m.UID)
+		c.sequenceRemove(seq, m.UID)
+		if qresync {
+			vanishedUIDs.append(uint32(m.UID))
+		} else {
+			c.bwritelinef("* %d EXPUNGE", seq)
+		}
+	}
+	if !vanishedUIDs.empty() {
+		// VANISHED without EARLIER. ../rfc/7162:2004
+		for _, s := range vanishedUIDs.Strings(4*1024 - 32) {
+			c.bwritelinef("* VANISHED %s", s)
+		}
+	}
+
+	if qresync {
+		// ../rfc/9051:6744 ../rfc/7162:1334
+		c.writeresultf("%s OK [HIGHESTMODSEQ %d] move", tag, modseq.Client())
+	} else {
+		c.ok(tag, cmd)
+	}
+}
+
+// xcopyDestination resolves the destination mailbox of a COPY or MOVE to the
+// account holding it, the mailbox name in that account, and the rights on it. The
+// returned function must be called to close the account.
+func (c *conn) xcopyDestination(name string) (*store.Account, string, string, func()) {
+	accName, mbName, ok := xsharedName(name)
+	if !ok {
+		return c.authAccount(), name, store.RightsAll, func() {}
+	}
+	acc, _, rights := c.xsharedMailbox(accName, mbName, "TRYCREATE")
+	closeAcc := func() {
+		err := acc.Close()
+		c.xsanity(err, "closing account")
+	}
+	if !store.HasRights(rights, "i") {
+		closeAcc()
+		xrequireRights(rights, "i")
+	}
+	return acc, mbName, rights, closeAcc
+}
+
+func xdbwriteAccount(acc *store.Account, fn func(tx *bstore.Tx)) {
+	err := acc.DB.Write(context.TODO(), func(tx *bstore.Tx) error {
+		fn(tx)
+		return nil
+	})
+	xcheckf(err, "transaction")
+}
+
+func xdbreadAccount(acc *store.Account, fn func(tx *bstore.Tx)) {
+	err := acc.DB.Read(context.TODO(), func(tx *bstore.Tx) error {
+		fn(tx)
+		return nil
+	})
+	xcheckf(err, "transaction")
+}
@@ -0,0 +1,129 @@
+package imapserver
+
+import (
+	"testing"
+
+	"github.com/mjl-/mox/imapclient"
+)
+
+func TestACL(t *testing.T) {
+	tc := start(t)
+	defer tc.close()
+
+	tc.client.Login("mjl@mox.example", password0)
+
+	tc.transactf("ok", "create Support")
+	tc.transactf("ok", "append Support (\\Seen) {%d+}\r\n%s", len(exampleMsg), exampleMsg)
+
+	tc.transactf("ok", "namespace")
+	tc.xuntagged(imapclient.UntaggedNamespace{
+		Personal: []imapclient.NamespaceDescr{{Prefix: "", Separator: '/'}},
+		Other:    []imapclient.NamespaceDescr{{Prefix: "Other Users/", Separator: '/'}},
+		Shared:   []imapclient.NamespaceDescr{{Prefix: "Shared/", Separator: '/'}},
+	})
+
+	tc.transactf("bad", "myrights")                // Missing param.
+	tc.transactf("bad", "myrights Support bogus")  // Too many params.
+	tc.transactf("no", "myrights nonexistent")     // Unknown mailbox.
+	tc.transactf("bad", "setacl Support other")    // Missing rights.
+	tc.transactf("bad", "setacl Support other lz") // Unknown right.
+	tc.transactf("no", "setacl Support bogus lr")  // Unknown account.
+	tc.transactf("no", "setacl Support mjl lr")    // Owner always has all rights.
+	tc.transactf("bad", "getacl")                  // Missing param.
+
+	tc.transactf("ok", "myrights Support")
+	tc.xuntagged(imapclient.UntaggedMyrights{Mailbox: "Support", Rights: "lrswipkxtea"})
+
+	tc.transactf("ok", "setacl Support other lr")
+	tc.transactf("ok", "setacl Support other +ws")
+	tc.transactf("ok", "getacl Support")
+	tc.xuntagged(imapclient.UntaggedACL{Mailbox: "Support", Entries: []imapclient.ACLEntry{{Identifier: "mjl", Rights: "lrswipkxtea"}, {Identifier: "other", Rights: "lrsw"}}})
+
+	tc.transactf("ok", "listrights Support other")
+	tc.xuntagged(imapclient.UntaggedListrights{Mailbox: "Support", Identifier: "other", Required: "", Optional: []string{"l", "r", "s", "w", "i", "p", "k", "x", "t", "e", "a"}})
+	tc.transactf("ok", "listrights Support mjl")
+	tc.xuntagged(imapclient.UntaggedListrights{Mailbox: "Support", Identifier: "mjl", Required: "lrswipkxtea"})
+
+	tcother := startArgs(t, false, false, true, true, "other")
+	defer tcother.close()
+	tcother.client.Login("other@mox.example", password0)
+
+	tcother.transactf("ok", `list "" "Other Users*"`)
+	tcother.xuntagged(
+		imapclient.UntaggedList{Flags: []string{`\Noselect`}, Separator: '/', Mailbox: "Other Users"},
+		imapclient.UntaggedList{Flags: []string{`\Noselect`}, Separator: '/', Mailbox: "Other Users/mjl"},
+		imapclient.UntaggedList{Separator: '/', Mailbox: "Other Users/mjl/Support"},
+	)
+	tcother.transactf("ok", `list "" "Shared*"`)
+	tcother.xuntagged()
+
+	tcother.transactf("ok", "myrights \"Other Users/mjl/Support\"")
+	tcother.xuntagged(imapclient.UntaggedMyrights{Mailbox: "Other Users/mjl/Support", Rights: "lrsw"})
+	tcother.transactf("no", "getacl \"Other Users/mjl/Support\"") // Requires a right.
+	tcother.xcode("NOPERM")
+	tcother.transactf("no", "myrights \"Other Users/mjl/Inbox\"") // Not shared.
+	tcother.transactf("no", "create \"Other Users/mjl/Support/sub\"")
+	tcother.xcode("NOPERM")
+	tcother.transactf("no", "delete \"Other Users/mjl/Support\"")
+	tcother.xcode("NOPERM")
+
+	tcother.transactf("ok", "status \"Other Users/mjl/Support\" (messages)")
+	tcother.xuntagged(imapclient.UntaggedStatus{Mailbox: "Other Users/mjl/Support", Attrs: map[imapclient.StatusAttr]int64{imapclient.StatusMessages: 1}})
+
+	// Without insert right, append fails.
+	tcother.transactf("no", "append \"Other Users/mjl/Support\" {1}")
+	tcother.xcode("NOPERM")
+
+	tcother.transactf("ok", "select \"Other Users/mjl/Support\"")
+	tcother.xcode("READ-WRITE")
+
+	// Without t right, \Deleted is ignored. With w, keywords can be set.
+	tcother.transactf("ok", "store 1 flags (\\Seen \\Deleted $Forwarded)")
+	tcother.xuntagged(imapclient.UntaggedFetch{Seq: 1, Attrs: []imapclient.FetchAttr{imapclient.FetchUID(1), imapclient.FetchFlags{`\Seen`, `$Forwarded`}}})
+	tcother.transactf("no", "expunge")
+	tcother.xcode("NOPERM")
+	tcother.transactf("no", "move 1 Inbox")
+	tcother.xcode("NOPERM")
+
+	// Copy to own account.
+	tcother.transactf("ok", "copy 1 Inbox")
+	tcother.xcode("COPYUID")
+	tcother.transactf("ok", "status Inbox (messages)")
+	tcother.xuntagged(imapclient.UntaggedStatus{Mailbox: "Inbox", Attrs: map[imapclient.StatusAttr]int64{imapclient.StatusMessages: 1}})
+
+	// Back to own account.
+	tcother.transactf("ok", "select Inbox")
+	tcother.transactf("ok", "fetch 1 flags")
+	tcother.xuntagged(imapclient.UntaggedFetch{Seq: 1, Attrs: []imapclient.FetchAttr{imapclient.FetchUID(1), imapclient.FetchFlags{`\Seen`, `$Forwarded`}}})
+
+	// Copy from own account into shared mailbox after getting insert right.
+	tc.transactf("ok", "setacl Support other +i")
+	tcother.transactf("ok", "copy 1 \"Other Users/mjl/Support\"")
+	tcother.transactf("ok", "append \"Other Users/mjl/Support\" {%d+}\r\n%s", len(exampleMsg), exampleMsg)
+	tc.transactf("ok", "status Support (messages)")
+	tc.xuntagged(imapclient.UntaggedStatus{Mailbox: "Support", Attrs: map[imapclient.StatusAttr]int64{imapclient.StatusMessages: 3}})
+
+	// Removing rights hides the mailbox.
+	tc.transactf("ok", "deleteacl Support other")
+	tc.transactf("ok", "getacl Support")
+	tc.xuntagged(imapclient.UntaggedACL{Mailbox: "Support", Entries: []imapclient.ACLEntry{{Identifier: "mjl", Rights: "lrswipkxtea"}}})
+	tcother.transactf("no", "status \"Other Users/mjl/Support\" (messages)")
+	tcother.transactf("ok", `list "" "Other Users*"`)
+	tcother.xuntagged()
+
+	// Rights for anyone show up in the shared namespace, read-only without write rights.
+	tc.transactf("ok", "setacl Support anyone lr")
+	tcother.transactf("ok", `list "" "Shared*"`)
+	tcother.xuntagged(
+		imapclient.UntaggedList{Flags: []string{`\Noselect`}, Separator: '/', Mailbox: "Shared"},
+		imapclient.UntaggedList{Flags: []string{`\Noselect`}, Separator: '/', Mailbox: "Shared/mjl"},
+		imapclient.UntaggedList{Separator: '/', Mailbox: "Shared/mjl/Support"},
+	)
+	tcother.transactf("ok", "select Shared/mjl/Support")
+	tcother.xcode("READ-ONLY")
+	tcother.transactf("ok", "unselect")
+
+	// Deleting the mailbox removes its acl.
+	tc.transactf("ok", "delete Support")
+	tcother.transactf("no", "select Shared/mjl/Support")
+}
@@ -1,19 +1,27 @@
 package imapserver
 
 import (
+	"crypto/ed25519"
 	"crypto/hmac"
 	"crypto/md5"
+	"crypto/rand"
 	"crypto/sha1"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"hash"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"golang.org/x/text/secure/precis"
 
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/mox-"
 	"github.com/mjl-/mox/scram"
 )
 
@@ -210,3 +218,88 @@ func TestAuthenticateCRAMMD5(t *testing.T) {
 	auth("ok", "mo\u0301x@mox.example", password1)
 	tc.close()
 }
+
+// configOIDC configures an identity provider with a key in a local JWKS file, and
+// returns a function to create tokens for an email address.
+func configOIDC(t *testing.T) func(email string) string {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	tcheck(t, err, "generate key")
+	b64 := base64.RawURLEncoding.EncodeToString
+	jwks := fmt.Sprintf(`{"keys": [{"kty": "OKP", "crv": "Ed25519", "kid": "k1", "x": %q}]}`, b64(pub))
+	jwksPath := filepath.Join(t.TempDir(), "jwks.json")
+	err = os.WriteFile(jwksPath, []byte(jwks), 0660)
+	tcheck(t, err, "write jwks")
+
+	mox.Conf.Static.OIDC = &config.OIDC{Issuer: "https://id.mox.example", JWKSFile: jwksPath, Audience: "mox"}
+	t.Cleanup(func() { mox.Conf.Static.OIDC = nil })
+
+	return func(email string) string {
+		claims, err := json.Marshal(map[string]any{
+			"iss":            "https://id.mox.example",
+			"aud":            "mox",
+			"email":          email,
+			"email_verified": true,
+			"exp":            time.Now().Add(time.Hour).Unix(),
+		})
+		tcheck(t, err, "marshal claims")
+		data := b64([]byte(`{"alg":"EdDSA","kid":"k1"}`)) + "." + b64(claims)
+		return data + "." + b64(ed25519.Sign(priv, []byte(data)))
+	}
+}
+
+func TestAuthenticateOAUTHBEARER(t *testing.T) {
+	tc := start(t)
+	defer tc.close()
+
+	oauthbearer := func(authzid, token string) string {
+		return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("n,a=%s,\x01auth=Bearer %s\x01\x01", authzid, token)))
+	}
+
+	// Not configured.
+	tc.transactf("no", "authenticate oauthbearer %s", oauthbearer("", "x"))
+
+	token := configOIDC(t)
+
+	tc.transactf("bad", "authenticate oauthbearer %s", base64.StdEncoding.EncodeToString([]byte("bad")))
+
+	// Bad token, error is sent as challenge.
+	tc.cmdf("", "authenticate oauthbearer %s", oauthbearer("", "bad"))
+	tc.readprefixline("+ ")
+	tc.writelinef("%s", base64.StdEncoding.EncodeToString([]byte{0x01}))
+	tc.readstatus("no")
+	tc.xcode("AUTHENTICATIONFAILED")
+
+	// Authorization identity for other account.
+	tc.cmdf("", "authenticate oauthbearer %s", oauthbearer("other@mox.example", token("mjl@mox.example")))
+	tc.readprefixline("+ ")
+	tc.writelinef("%s", base64.StdEncoding.EncodeToString([]byte{0x01}))
+	tc.readstatus("no")
+
+	// Unknown address in token.
+	tc.cmdf("", "authenticate oauthbearer %s", oauthbearer("", token("unknown@mox.example")))
+	tc.readprefixline("+ ")
+	tc.writelinef("%s", base64.StdEncoding.EncodeToString([]byte{0x01}))
+	tc.readstatus("no")
+
+	// Authorization identity for same account is fine.
+	tc.transactf("ok", "authenticate oauthbearer %s", oauthbearer("m\u00f3x@mox.example", token("mjl@mox.example")))
+}
+
+func TestAuthenticateXOAUTH2(t *testing.T) {
+	tc := start(t)
+	defer tc.close()
+
+	token := configOIDC(t)
+
+	xoauth2 := func(user, token string) string {
+		return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("user=%s\x01auth=Bearer %s\x01\x01", user, token)))
+	}
+
+	tc.cmdf("", "authenticate xoauth2 %s", xoauth2("mjl@mox.example", "bad"))
+	tc.readprefixline("+ ")
+	tc.writelinef("")
+	tc.readstatus("no")
+	tc.xcode("AUTHENTICATIONFAILED")
+
+	tc.transactf("ok", "authenticate xoauth2 %s", xoauth2("mjl@mox.example", token("mjl@mox.example")))
+}
@@ -562,7 +562,8 @@ func xenvelope(p *message.Part) token {
 }
 
 func (cmd *fetchCmd) peekOrSeen(peek bool) {
-	if cmd.conn.readonly || peek {
+	// Without the seen right, the \Seen flag is not set. ../rfc/4314:895
+	if cmd.conn.readonly || peek || !strings.Contains(cmd.conn.mailboxRights, "s") {
 		return
 	}
 	m := cmd.xensureMessage()
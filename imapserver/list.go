@@ -1,8 +1,10 @@
 package imapserver
 
 import (
+	"context"
 	"fmt"
 	"path"
+	"slices"
 	"sort"
 	"strings"
 
@@ -11,7 +13,9 @@ import (
 )
 
 // LIST command, for listing mailboxes with various attributes, including about subscriptions and children.
-// We don't have flags Marked, Unmarked, NoSelect and NoInferiors and we don't have REMOTE mailboxes.
+// We don't have flags Marked, Unmarked and NoInferiors and we don't have REMOTE mailboxes.
+// Mailboxes of other accounts that we have the lookup right on are listed in the
+// "Other Users" and "Shared" namespaces, with NoSelect parent mailboxes.
 //
 // State: Authenticated and selected.
 func (c *conn) cmdList(tag, cmd string, p *parser) {
@@ -118,11 +122,26 @@ func (c *conn) cmdList(tag, cmd string, p *parser) {
 	re := xmailboxPatternMatcher(reference, patterns)
 	var responseLines []string
 
-	c.account.WithRLock(func() {
-		c.xdbread(func(tx *bstore.Tx) {
+	acc := c.authAccount()
+	shared, err := store.SharedMailboxes(context.TODO(), c.log, acc.Name)
+	xcheckf(err, "listing mailboxes of other accounts")
+
+	// Status of mailboxes of other accounts is gathered after reading from our own
+	// account, and inserted after the line at index.
+	type sharedStatus struct {
+		index  int
+		shared store.SharedMailbox
+		name   string
+	}
+	var sharedStatuses []sharedStatus
+
+	acc.WithRLock(func() {
+		xdbreadAccount(acc, func(tx *bstore.Tx) {
 			type info struct {
 				mailbox    *store.Mailbox
 				subscribed bool
+				noselect   bool
+				shared     *store.SharedMailbox
 			}
 			names := map[string]info{}
 			hasSubscribedChild := map[string]bool{}
@@ -140,6 +159,33 @@ func (c *conn) cmdList(tag, cmd string, p *parser) {
 			})
 			xcheckf(err, "listing mailboxes")
 
+			for _, sm := range shared {
+				sm := sm
+				var namespaces []string
+				if sm.Direct {
+					namespaces = append(namespaces, nsOtherUsers)
+				}
+				if sm.Anyone {
+					namespaces = append(namespaces, nsShared)
+				}
+				for _, ns := range namespaces {
+					name := ns + "/" + sm.Account + "/" + sm.Mailbox.Name
+					mb := sm.Mailbox
+					mb.Name = name
+					if _, ok := names[name]; !ok {
+						nameList = append(nameList, name)
+					}
+					names[name] = info{mailbox: &mb, noselect: !strings.Contains(sm.Rights, "r"), shared: &sm}
+					for p := path.Dir(name); p != "."; p = path.Dir(p) {
+						hasChild[p] = true
+						if _, ok := names[p]; !ok {
+							names[p] = info{noselect: true}
+							nameList = append(nameList, p)
+						}
+					}
+				}
+			}
+
 			qs := bstore.QueryTx[store.Subscription](tx)
 			err = qs.ForEach(func(sub store.Subscription) error {
 				info, ok := names[sub.Name]
@@ -174,9 +220,12 @@ func (c *conn) cmdList(tag, cmd string, p *parser) {
 						flags = append(flags, bare(`\NonExistent`))
 					}
 				}
-				if (info.mailbox == nil || listSubscribed) && flags == nil && extended == nil {
+				if (info.mailbox == nil && !info.noselect || listSubscribed) && flags == nil && extended == nil {
 					continue
 				}
+				if info.noselect {
+					flags = append(flags, bare(`\Noselect`))
+				}
 
 				if retChildren {
 					var f string
@@ -215,13 +264,30 @@ func (c *conn) cmdList(tag, cmd string, p *parser) {
 				line := fmt.Sprintf(`* LIST %s "/" %s%s`, flags.pack(c), astring(c.encodeMailbox(name)).pack(c), extStr)
 				responseLines = append(responseLines, line)
 
-				if retStatusAttrs != nil && info.mailbox != nil {
+				if retStatusAttrs != nil && info.shared != nil && !info.noselect {
+					sharedStatuses = append(sharedStatuses, sharedStatus{len(responseLines) - 1, *info.shared, name})
+				} else if retStatusAttrs != nil && info.mailbox != nil && info.shared == nil {
 					responseLines = append(responseLines, c.xstatusLine(tx, *info.mailbox, retStatusAttrs))
 				}
 			}
 		})
 	})
 
+	// Insert status lines for mailboxes of other accounts, starting at the end to
+	// keep the indices valid.
+	for i := len(sharedStatuses) - 1; i >= 0; i-- {
+		ss := sharedStatuses[i]
+		sacc, mb, _ := c.xsharedMailbox(ss.shared.Account, ss.shared.Mailbox.Name, "")
+		var line string
+		xdbreadAccount(sacc, func(tx *bstore.Tx) {
+			mb.Name = ss.name
+			line = c.xstatusLine(tx, mb, retStatusAttrs)
+		})
+		err := sacc.Close()
+		c.xsanity(err, "closing account")
+		responseLines = slices.Insert(responseLines, ss.index+1, line)
+	}
+
 	for _, line := range responseLines {
 		c.bwritelinef("%s", line)
 	}
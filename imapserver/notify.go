@@ -0,0 +1,488 @@
+package imapserver
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/store"
+)
+
+// notify holds the settings of a NOTIFY SET command, for sending changes of
+// mailboxes other than the selected mailbox as STATUS responses, and sending
+// changes while no command is in progress. ../rfc/5465
+type notify struct {
+	// Events for the selected mailbox. Nil if neither SELECTED nor SELECTED-DELAYED
+	// was specified, in which case changes to the selected mailbox are only sent
+	// along with command responses, as without NOTIFY.
+	Selected *eventGroup
+
+	// For SELECTED-DELAYED, expunges are only sent with command responses that allow
+	// them.
+	Delayed bool
+
+	// Event groups for other mailboxes, matched in order.
+	Groups []eventGroup
+}
+
+// eventGroup is a mailbox filter with events the client wants to be notified
+// about.
+type eventGroup struct {
+	Filter    string   // INBOXES, PERSONAL, SUBSCRIBED, SUBTREE or MAILBOXES. Empty for the selected mailbox.
+	Mailboxes []string // For SUBTREE and MAILBOXES.
+	Events    notifyEvents
+}
+
+type notifyEvents struct {
+	MessageNew         bool
+	MessageExpunge     bool
+	FlagChange         bool
+	MailboxName        bool
+	SubscriptionChange bool
+	FetchAtts          []fetchAtt // Attributes to send for new messages in the selected mailbox.
+}
+
+// Events we support, for the BADEVENT response code.
+const notifyEventsSupported = "MessageNew MessageExpunge FlagChange MailboxName SubscriptionChange"
+
+// Notify enables or disables sending notifications about changes to mailboxes,
+// also for mailboxes other than the selected mailbox, and while no command is in
+// progress.
+//
+// State: Authenticated and selected.
+func (c *conn) cmdNotify(tag, cmd string, p *parser) {
+	// Command: ../rfc/5465
+
+	// Request syntax: ../rfc/5465
+	p.xspace()
+	if p.take("NONE") {
+		p.xempty()
+		c.notify = nil
+		c.ok(tag, cmd)
+		return
+	}
+
+	p.xtake("SET")
+	status := p.take(" STATUS")
+	var n notify
+	var haveSelected bool
+	for {
+		p.xspace()
+		p.xtake("(")
+		var eg eventGroup
+		isSelected := false
+		switch w := p.xtakelist("SELECTED-DELAYED", "SELECTED", "INBOXES", "PERSONAL", "SUBSCRIBED", "SUBTREE ", "MAILBOXES "); w {
+		case "SELECTED-DELAYED", "SELECTED":
+			if haveSelected {
+				xsyntaxErrorf("duplicate selected mailbox filter")
+			}
+			haveSelected = true
+			isSelected = true
+			n.Delayed = w == "SELECTED-DELAYED"
+		case "SUBTREE ", "MAILBOXES ":
+			eg.Filter = strings.TrimSpace(w)
+			if p.take("(") {
+				for {
+					eg.Mailboxes = append(eg.Mailboxes, xcheckmailboxname(p.xmailbox(), true))
+					if p.take(")") {
+						break
+					}
+					p.xspace()
+				}
+			} else {
+				eg.Mailboxes = []string{xcheckmailboxname(p.xmailbox(), true)}
+			}
+		default:
+			eg.Filter = w
+		}
+		p.xspace()
+		if !p.take("NONE") {
+			eg.Events = p.xnotifyEvents(isSelected)
+		}
+		p.xtake(")")
+		if isSelected {
+			n.Selected = &eg
+		} else {
+			n.Groups = append(n.Groups, eg)
+		}
+		if p.empty() {
+			break
+		}
+	}
+
+	c.notify = &n
+
+	// Send current status for mailboxes with message events.
+	if status && c.loginAccount == nil {
+		var lines []string
+		c.account.WithRLock(func() {
+			c.xdbread(func(tx *bstore.Tx) {
+				subscribed := c.notifySubscribed(tx)
+				err := bstore.QueryTx[store.Mailbox](tx).ForEach(func(mb store.Mailbox) error {
+					if c.state == stateSelected && mb.ID == c.mailboxID {
+						return nil
+					}
+					eg := c.notifyGroup(mb.Name, subscribed)
+					if eg == nil || !eg.Events.MessageNew {
+						return nil
+					}
+					attrs := []string{"MESSAGES", "UIDNEXT", "UIDVALIDITY", "UNSEEN"}
+					if c.enabled[capCondstore] {
+						attrs = append(attrs, "HIGHESTMODSEQ")
+					}
+					lines = append(lines, c.xstatusLine(tx, mb, attrs))
+					return nil
+				})
+				xcheckf(err, "listing mailboxes")
+			})
+		})
+		for _, line := range lines {
+			c.bwritelinef("%s", line)
+		}
+	}
+
+	c.ok(tag, cmd)
+}
+
+// xnotifyEvents parses a list of events for a mailbox filter.
+func (p *parser) xnotifyEvents(isSelected bool) notifyEvents {
+	var ev notifyEvents
+	p.xtake("(")
+	for {
+		w := p.xatom()
+		switch strings.ToUpper(w) {
+		case "MESSAGENEW":
+			ev.MessageNew = true
+			if p.hasPrefix(" (") {
+				if !isSelected {
+					xsyntaxErrorf("fetch attributes only allowed for selected mailbox")
+				}
+				p.xspace()
+				ev.FetchAtts = p.xfetchAtts(false)
+				// Notifications must not change the \Seen flag.
+				for i := range ev.FetchAtts {
+					ev.FetchAtts[i].peek = true
+				}
+			}
+		case "MESSAGEEXPUNGE":
+			ev.MessageExpunge = true
+		case "FLAGCHANGE":
+			ev.FlagChange = true
+		case "MAILBOXNAME":
+			ev.MailboxName = true
+		case "SUBSCRIPTIONCHANGE":
+			ev.SubscriptionChange = true
+		default:
+			xusercodeErrorf("BADEVENT ("+notifyEventsSupported+")", "unsupported event %q", w)
+		}
+		if p.take(")") {
+			break
+		}
+		p.xspace()
+	}
+	// MessageNew and MessageExpunge go together, FlagChange needs both.
+	if ev.MessageNew != ev.MessageExpunge {
+		xsyntaxErrorf("MessageNew and MessageExpunge must both be present or absent")
+	}
+	if ev.FlagChange && !ev.MessageNew {
+		xsyntaxErrorf("FlagChange requires MessageNew and MessageExpunge")
+	}
+	return ev
+}
+
+// notifySubscribed returns a function to check if a mailbox is subscribed. The
+// subscriptions are only read from the database when needed.
+func (c *conn) notifySubscribed(tx *bstore.Tx) func(name string) bool {
+	var subscribed map[string]bool
+	return func(name string) bool {
+		if subscribed == nil {
+			subscribed = map[string]bool{}
+			read := func(tx *bstore.Tx) {
+				err := bstore.QueryTx[store.Subscription](tx).ForEach(func(sub store.Subscription) error {
+					subscribed[sub.Name] = true
+					return nil
+				})
+				xcheckf(err, "listing subscriptions")
+			}
+			if tx != nil {
+				read(tx)
+			} else {
+				c.xdbread(read)
+			}
+		}
+		return subscribed[name]
+	}
+}
+
+// notifyGroup returns the first event group of the NOTIFY settings whose mailbox
+// filter matches name, or nil.
+func (c *conn) notifyGroup(name string, subscribed func(name string) bool) *eventGroup {
+	for i, eg := range c.notify.Groups {
+		var match bool
+		switch eg.Filter {
+		case "INBOXES":
+			match = c.notifyInbox(name)
+		case "PERSONAL":
+			// All our mailboxes are in the personal namespace.
+			match = true
+		case "SUBSCRIBED":
+			match = subscribed(name)
+		case "SUBTREE":
+			for _, mbName := range eg.Mailboxes {
+				if name == mbName || strings.HasPrefix(name, mbName+"/") {
+					match = true
+					break
+				}
+			}
+		case "MAILBOXES":
+			for _, mbName := range eg.Mailboxes {
+				if name == mbName {
+					match = true
+					break
+				}
+			}
+		}
+		if match {
+			return &c.notify.Groups[i]
+		}
+	}
+	return nil
+}
+
+// notifyInbox returns whether mailbox name is a mailbox that incoming messages
+// can be delivered to: the Inbox and mailboxes in the delivery rules of the
+// account.
+func (c *conn) notifyInbox(name string) bool {
+	if name == "Inbox" {
+		return true
+	}
+	accConf, _ := c.account.Conf()
+	for _, dest := range accConf.Destinations {
+		if dest.Mailbox == name {
+			return true
+		}
+		for _, rs := range dest.Rulesets {
+			if rs.Mailbox == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// notifyFilter filters changes when NOTIFY is active. Changes to the selected
+// mailbox are kept, except flag changes the client did not ask for. For other
+// mailboxes, message changes are turned into STATUS responses, returned as
+// lines, and mailbox changes are only kept if the client asked for them.
+func (c *conn) notifyFilter(changes []store.Change) (kept []store.Change, statusLines []string) {
+	type mailboxStatus struct {
+		counts         *store.ChangeMailboxCounts
+		uidNext        store.UID
+		modseq         store.ModSeq
+		new, expunge   bool
+		flags          bool
+		mailboxChanges bool
+	}
+	var order []int64
+	statuses := map[int64]*mailboxStatus{}
+	status := func(mbID int64) *mailboxStatus {
+		st := statuses[mbID]
+		if st == nil {
+			st = &mailboxStatus{}
+			statuses[mbID] = st
+			order = append(order, mbID)
+		}
+		return st
+	}
+
+	subscribed := c.notifySubscribed(nil)
+	// Names of mailboxes of other accounts are not in our namespace.
+	otherAccount := c.loginAccount != nil
+	mailboxEvent := func(name string, subscription bool) bool {
+		if otherAccount {
+			return false
+		}
+		eg := c.notifyGroup(name, subscribed)
+		return eg != nil && (eg.Events.MailboxName || subscription && eg.Events.SubscriptionChange)
+	}
+
+	selected := func(mbID int64) bool {
+		return c.state == stateSelected && mbID == c.mailboxID
+	}
+
+	for _, change := range changes {
+		switch ch := change.(type) {
+		case store.ChangeAddUID:
+			if selected(ch.MailboxID) {
+				kept = append(kept, change)
+				continue
+			}
+			st := status(ch.MailboxID)
+			st.new = true
+			st.uidNext = max(st.uidNext, ch.UID+1)
+			st.modseq = max(st.modseq, ch.ModSeq)
+		case store.ChangeRemoveUIDs:
+			if selected(ch.MailboxID) {
+				kept = append(kept, change)
+				continue
+			}
+			st := status(ch.MailboxID)
+			st.expunge = true
+			st.modseq = max(st.modseq, ch.ModSeq)
+		case store.ChangeFlags:
+			if selected(ch.MailboxID) {
+				if c.notify.Selected == nil || c.notify.Selected.Events.FlagChange {
+					kept = append(kept, change)
+				}
+				continue
+			}
+			st := status(ch.MailboxID)
+			st.flags = true
+			st.modseq = max(st.modseq, ch.ModSeq)
+		case store.ChangeMailboxCounts:
+			if !selected(ch.MailboxID) {
+				st := status(ch.MailboxID)
+				st.counts = &ch
+			}
+		case store.ChangeRemoveMailbox:
+			if mailboxEvent(ch.Name, false) {
+				kept = append(kept, change)
+			}
+		case store.ChangeAddMailbox:
+			if mailboxEvent(ch.Mailbox.Name, false) {
+				kept = append(kept, change)
+			}
+		case store.ChangeRenameMailbox:
+			if mailboxEvent(ch.OldName, false) || mailboxEvent(ch.NewName, false) {
+				kept = append(kept, change)
+			}
+		case store.ChangeAddSubscription:
+			if mailboxEvent(ch.Name, true) {
+				kept = append(kept, change)
+			}
+		default:
+			kept = append(kept, change)
+		}
+	}
+
+	if otherAccount {
+		return kept, nil
+	}
+
+	// STATUS responses for other mailboxes, with the attributes for the events the
+	// client asked for. We need the mailbox counts for the name and number of
+	// messages.
+	for _, mbID := range order {
+		st := statuses[mbID]
+		if st.counts == nil {
+			continue
+		}
+		eg := c.notifyGroup(st.counts.MailboxName, subscribed)
+		if eg == nil || !(eg.Events.MessageNew && (st.new || st.expunge) || eg.Events.FlagChange && st.flags) {
+			continue
+		}
+		attrs := []string{"MESSAGES", fmt.Sprintf("%d", st.counts.Total+st.counts.Deleted)}
+		if st.new {
+			attrs = append(attrs, "UIDNEXT", fmt.Sprintf("%d", st.uidNext))
+		}
+		attrs = append(attrs, "UNSEEN", fmt.Sprintf("%d", st.counts.Unseen))
+		if c.enabled[capCondstore] && st.modseq > 0 {
+			attrs = append(attrs, "HIGHESTMODSEQ", fmt.Sprintf("%d", st.modseq.Client()))
+		}
+		statusLines = append(statusLines, fmt.Sprintf("* STATUS %s (%s)", astring(c.encodeMailbox(st.counts.MailboxName)).pack(c), strings.Join(attrs, " ")))
+	}
+	return kept, statusLines
+}
+
+// notifySplit splits changes into those that can be sent while no command is in
+// progress, and those that must be held until a command response. For the
+// selected mailbox, changes can only be sent if the client asked for message
+// events with SELECTED, and with SELECTED-DELAYED until the first expunge. Later
+// changes for the selected mailbox are held to keep them in order.
+func (c *conn) notifySplit(changes []store.Change) (now, held []store.Change) {
+	if c.state != stateSelected {
+		return changes, nil
+	}
+
+	sel := c.notify.Selected
+	holding := sel == nil || !sel.Events.MessageNew
+	for _, change := range changes {
+		var mbID int64
+		var expunge bool
+		switch ch := change.(type) {
+		case store.ChangeAddUID:
+			mbID = ch.MailboxID
+		case store.ChangeRemoveUIDs:
+			mbID, expunge = ch.MailboxID, true
+		case store.ChangeFlags:
+			mbID = ch.MailboxID
+		default:
+			now = append(now, change)
+			continue
+		}
+		if mbID != c.mailboxID {
+			now = append(now, change)
+			continue
+		}
+		holding = holding || expunge && c.notify.Delayed
+		if holding {
+			held = append(held, change)
+		} else {
+			now = append(now, change)
+		}
+	}
+	return now, held
+}
+
+// readlineNotify waits for the next command line while sending changes to the
+// client, for NOTIFY.
+func (c *conn) readlineNotify() lineErr {
+	for {
+		select {
+		case le := <-c.lineChan():
+			c.line = nil
+			return le
+		case <-c.comm.Pending:
+			changes := append(c.notifyHeld, c.comm.Get()...)
+			c.notifyHeld = nil
+			now, held := c.notifySplit(changes)
+			c.applyChanges(now, false)
+			c.notifyHeld = held
+			c.xflush()
+		case <-mox.Shutdown.Done():
+			// ../rfc/9051:5375
+			c.writelinef("* BYE shutting down")
+			panic(errIO)
+		}
+	}
+}
+
+// xnotifyFetch writes FETCH responses for new messages in the selected mailbox,
+// with the attributes the client asked for with NOTIFY. Messages that have
+// disappeared in the mean time are skipped.
+func (c *conn) xnotifyFetch(uids []store.UID, atts []fetchAtt) {
+	cmd := &fetchCmd{conn: c, mailboxID: c.mailboxID, isUID: true}
+	c.xdbread(func(tx *bstore.Tx) {
+		cmd.tx = tx
+		for _, uid := range uids {
+			cmd.uid = uid
+			func() {
+				defer func() {
+					x := recover()
+					if x == nil {
+						return
+					}
+					if err, ok := x.(userError); ok {
+						c.log.Debugx("fetching attributes for new message for notify", err, slog.Any("uid", uid))
+						return
+					}
+					panic(x)
+				}()
+				cmd.process(atts)
+			}()
+		}
+	})
+}
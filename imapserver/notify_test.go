@@ -0,0 +1,91 @@
+package imapserver
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mjl-/mox/imapclient"
+)
+
+// xreaduntagged reads untagged responses sent without a command in progress.
+func (tc *testconn) xreaduntagged(exps ...imapclient.Untagged) {
+	tc.t.Helper()
+	for _, exp := range exps {
+		u, err := tc.client.ReadUntagged()
+		tcheck(tc.t, err, "read untagged")
+		if !reflect.DeepEqual(u, exp) {
+			tc.t.Fatalf("got untagged\n\t%#v\nexpected\n\t%#v", u, exp)
+		}
+	}
+}
+
+func TestNotify(t *testing.T) {
+	tc := start(t)
+	defer tc.close()
+	tc.client.Login("mjl@mox.example", password0)
+	tc.client.Select("inbox")
+
+	tc2 := startNoSwitchboard(t)
+	defer tc2.close()
+	tc2.client.Login("mjl@mox.example", password0)
+
+	tc.transactf("bad", "notify")
+	tc.transactf("bad", "notify bogus")
+	tc.transactf("bad", "notify set")
+	tc.transactf("bad", "notify set (selected (messageNew))")                                                 // MessageExpunge missing.
+	tc.transactf("bad", "notify set (selected (flagChange))")                                                 // MessageNew and MessageExpunge missing.
+	tc.transactf("bad", "notify set (personal (messageNew (uid) messageExpunge))")                            // Fetch attributes only for selected.
+	tc.transactf("bad", "notify set (selected (messageNew messageExpunge)) (selected-delayed (mailboxName))") // Duplicate selected.
+	tc.transactf("no", "notify set (personal (annotationChange))")
+	tc.xcode("BADEVENT")
+
+	tc.transactf("ok", "notify set status (selected (messageNew (uid rfc822.size) messageExpunge flagChange)) (mailboxes (Archive Junk) (messageNew messageExpunge flagChange mailboxName))")
+	if len(tc.lastUntagged) != 2 {
+		t.Fatalf("got %v, expected status for Archive and Junk", tc.lastUntagged)
+	}
+
+	// New message in selected mailbox, with requested attributes.
+	tc2.transactf("ok", "append inbox () {%d+}\r\n%s", len(exampleMsg), exampleMsg)
+	tc.xreaduntagged(
+		imapclient.UntaggedExists(1),
+		imapclient.UntaggedFetch{Seq: 1, Attrs: []imapclient.FetchAttr{imapclient.FetchUID(1), imapclient.FetchRFC822Size(len(exampleMsg))}},
+	)
+
+	// Flag change in selected mailbox.
+	tc2.client.Select("inbox")
+	tc2.transactf("ok", "store 1 +flags (\\Seen)")
+	tc.xreaduntagged(imapclient.UntaggedFetch{Seq: 1, Attrs: []imapclient.FetchAttr{imapclient.FetchUID(1), imapclient.FetchFlags{`\Seen`}}})
+
+	// New message and flag change in other mailbox, as status.
+	tc2.transactf("ok", "append Archive () {%d+}\r\n%s", len(exampleMsg), exampleMsg)
+	tc.xreaduntagged(imapclient.UntaggedStatus{Mailbox: "Archive", Attrs: map[imapclient.StatusAttr]int64{imapclient.StatusMessages: 1, imapclient.StatusUIDNext: 2, imapclient.StatusUnseen: 1}})
+	tc2.client.Select("Archive")
+	tc2.transactf("ok", "store 1 +flags (\\Seen)")
+	tc.xreaduntagged(imapclient.UntaggedStatus{Mailbox: "Archive", Attrs: map[imapclient.StatusAttr]int64{imapclient.StatusMessages: 1, imapclient.StatusUnseen: 0}})
+
+	// Mailboxes not matching a filter don't result in notifications.
+	tc2.transactf("ok", "append Sent () {%d+}\r\n%s", len(exampleMsg), exampleMsg)
+	tc2.transactf("ok", "create Other")
+	tc.transactf("ok", "noop")
+	tc.xuntagged()
+
+	// Mailbox name changes, with OLDNAME.
+	tc2.transactf("ok", "rename Junk Spam")
+	tc.xreaduntagged(imapclient.UntaggedList{Separator: '/', Mailbox: "Spam", OldName: "Junk"})
+
+	// With SELECTED-DELAYED, expunges are sent with the next command response.
+	tc.transactf("ok", "notify set (selected-delayed (messageNew messageExpunge)) (personal (mailboxName subscriptionChange))")
+	tc2.client.Select("inbox")
+	tc2.transactf("ok", "store 1 +flags (\\Deleted)")
+	tc2.transactf("ok", "expunge")
+	tc2.transactf("ok", "subscribe Nonexistent")
+	tc.xreaduntagged(imapclient.UntaggedList{Separator: '/', Mailbox: "Nonexistent", Flags: []string{`\Subscribed`, `\NonExistent`}})
+	tc.transactf("ok", "noop")
+	tc.xuntagged(imapclient.UntaggedExpunge(1))
+
+	// After NOTIFY NONE, no changes for other mailboxes.
+	tc.transactf("ok", "notify none")
+	tc2.transactf("ok", "append Archive () {%d+}\r\n%s", len(exampleMsg), exampleMsg)
+	tc.transactf("ok", "noop")
+	tc.xuntagged()
+}
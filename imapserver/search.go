@@ -21,100 +21,21 @@ func (c *conn) cmdxSearch(isUID bool, tag, cmd string, p *parser) {
 	// Syntax: ../rfc/9051:6918 ../rfc/4466:611 ../rfc/3501:4954
 
 	// We will respond with ESEARCH instead of SEARCH if "RETURN" is present or for IMAP4rev2.
-	var eargs map[string]bool // Options except SAVE. Nil means old-style SEARCH response.
-	var save bool             // For SAVE option. Kept separately for easier handling of MIN/MAX later.
-
-	// IMAP4rev2 always returns ESEARCH, even with absent RETURN.
-	if c.enabled[capIMAP4rev2] {
-		eargs = map[string]bool{}
-	}
-	// ../rfc/9051:6967
-	if p.take(" RETURN (") {
-		eargs = map[string]bool{}
-
-		for !p.take(")") {
-			if len(eargs) > 0 || save {
-				p.xspace()
-			}
-			if w, ok := p.takelist("MIN", "MAX", "ALL", "COUNT", "SAVE"); ok {
-				if w == "SAVE" {
-					save = true
-				} else {
-					eargs[w] = true
-				}
-			} else {
-				// ../rfc/4466:378 ../rfc/9051:3745
-				xsyntaxErrorf("ESEARCH result option %q not supported", w)
-			}
-		}
-	}
-	// ../rfc/4731:149 ../rfc/9051:3737
-	if eargs != nil && len(eargs) == 0 && !save {
-		eargs["ALL"] = true
-	}
+	eargs, save, partial := p.xsearchReturn(c.enabled[capIMAP4rev2])
 
 	// If UTF8=ACCEPT is enabled, we should not accept any charset. We are a bit more
 	// relaxed (reasonable?) and still allow US-ASCII and UTF-8. ../rfc/6855:198
 	if p.take(" CHARSET ") {
-		charset := strings.ToUpper(p.xastring())
-		if charset != "US-ASCII" && charset != "UTF-8" {
-			// ../rfc/3501:2771 ../rfc/9051:3836
-			xusercodeErrorf("BADCHARSET", "only US-ASCII and UTF-8 supported")
-		}
+		p.xsearchCharset()
 	}
 	p.xspace()
-	sk := &searchKey{
-		searchKeys: []searchKey{*p.xsearchKey()},
-	}
-	for !p.empty() {
-		p.xspace()
-		sk.searchKeys = append(sk.searchKeys, *p.xsearchKey())
-	}
+	sk, bodySearch, textSearch := p.xsearchKeys()
 
 	// Even in case of error, we ensure search result is changed.
 	if save {
 		c.searchResult = []store.UID{}
 	}
 
-	// We gather word and not-word searches from the top-level, turn them
-	// into a WordSearch for a more efficient search.
-	// todo optimize: also gather them out of AND searches.
-	var textWords, textNotWords, bodyWords, bodyNotWords []string
-	n := 0
-	for _, xsk := range sk.searchKeys {
-		switch xsk.op {
-		case "BODY":
-			bodyWords = append(bodyWords, xsk.astring)
-			continue
-		case "TEXT":
-			textWords = append(textWords, xsk.astring)
-			continue
-		case "NOT":
-			switch xsk.searchKey.op {
-			case "BODY":
-				bodyNotWords = append(bodyNotWords, xsk.searchKey.astring)
-				continue
-			case "TEXT":
-				textNotWords = append(textNotWords, xsk.searchKey.astring)
-				continue
-			}
-		}
-		sk.searchKeys[n] = xsk
-		n++
-	}
-	// We may be left with an empty but non-nil sk.searchKeys, which is important for
-	// matching.
-	sk.searchKeys = sk.searchKeys[:n]
-	var bodySearch, textSearch *store.WordSearch
-	if len(bodyWords) > 0 || len(bodyNotWords) > 0 {
-		ws := store.PrepareWordSearch(bodyWords, bodyNotWords)
-		bodySearch = &ws
-	}
-	if len(textWords) > 0 || len(textNotWords) > 0 {
-		ws := store.PrepareWordSearch(textWords, textNotWords)
-		textSearch = &ws
-	}
-
 	// Note: we only hold the account rlock for verifying the mailbox at the start.
 	c.account.RLock()
 	runlock := c.account.RUnlock
@@ -142,6 +63,8 @@ func (c *conn) cmdxSearch(isUID bool, tag, cmd string, p *parser) {
 		runlock()
 		runlock = func() {}
 
+		xsearchUseIndex(tx, bodySearch, textSearch)
+
 		// Normal forward search when we don't have MAX only.
 		var lastIndex = -1
 		if eargs == nil || max == 0 || len(eargs) != 1 {
@@ -209,8 +132,6 @@ func (c *conn) cmdxSearch(isUID bool, tag, cmd string, p *parser) {
 			uids = uids[n:]
 		}
 	} else {
-		// New-style ESEARCH response syntax: ../rfc/9051:6546 ../rfc/4466:522
-
 		if save {
 			// ../rfc/9051:3784 ../rfc/5182:13
 			c.searchResult = uids
@@ -219,58 +140,207 @@ func (c *conn) cmdxSearch(isUID bool, tag, cmd string, p *parser) {
 			}
 		}
 
-		// No untagged ESEARCH response if nothing was requested. ../rfc/9051:4160
-		if len(eargs) > 0 {
-			// The tag was originally a string, became an astring in IMAP4rev2, better stick to
-			// string. ../rfc/4466:707 ../rfc/5259:1163 ../rfc/9051:7087
-			resp := fmt.Sprintf(`* ESEARCH (TAG "%s")`, tag)
-			if isUID {
-				resp += " UID"
-			}
+		c.xsearchUpdateStart(tag, isUID, eargs, *sk, bodySearch, textSearch, nil, uids)
 
-			// NOTE: we are converting UIDs to msgseq in the uids slice (if needed) while
-			// keeping the "uids" name!
-			if !isUID {
-				// If searchResult is hanging on to the slice, we need to work on a copy.
-				if save {
-					nuids := make([]store.UID, len(uids))
-					copy(nuids, uids)
-					uids = nuids
-				}
-				for i, uid := range uids {
-					uids[i] = store.UID(c.xsequence(uid))
-				}
-			}
+		c.writeEsearch(tag, isUID, eargs, partial, uids, sk.hasModseq(), maxModSeq)
+	}
+	if expungeIssued {
+		// ../rfc/9051:5102
+		c.writeresultf("%s OK [EXPUNGEISSUED] done", tag)
+	} else {
+		c.ok(tag, cmd)
+	}
+}
 
-			// If no matches, then no MIN/MAX response. ../rfc/4731:98 ../rfc/9051:3758
-			if eargs["MIN"] && len(uids) > 0 {
-				resp += fmt.Sprintf(" MIN %d", uids[0])
-			}
-			if eargs["MAX"] && len(uids) > 0 {
-				resp += fmt.Sprintf(" MAX %d", uids[len(uids)-1])
+// xsearchReturn parses the optional RETURN options for SEARCH and SORT. If
+// rev2 is set, eargs is non-nil even without RETURN: IMAP4rev2 always responds
+// with ESEARCH. Returned eargs holds all options except SAVE, with nil meaning an
+// old-style SEARCH/SORT response.
+func (p *parser) xsearchReturn(rev2 bool) (eargs map[string]bool, save bool, partial [2]uint32) {
+	if rev2 {
+		eargs = map[string]bool{}
+	}
+	// ../rfc/9051:6967 ../rfc/5267
+	if p.take(" RETURN (") {
+		eargs = map[string]bool{}
+
+		for !p.take(")") {
+			if len(eargs) > 0 || save {
+				p.xspace()
 			}
-			if eargs["COUNT"] {
-				resp += fmt.Sprintf(" COUNT %d", len(uids))
+			if w, ok := p.takelist("MIN", "MAX", "ALL", "COUNT", "SAVE", "PARTIAL", "UPDATE"); ok {
+				switch w {
+				case "SAVE":
+					save = true
+				case "PARTIAL":
+					// ../rfc/5267
+					p.xspace()
+					partial[0] = p.xnznumber()
+					p.xtake(":")
+					partial[1] = p.xnznumber()
+					if partial[0] > partial[1] {
+						partial[0], partial[1] = partial[1], partial[0]
+					}
+					eargs[w] = true
+				default:
+					eargs[w] = true
+				}
+			} else {
+				// ../rfc/4466:378 ../rfc/9051:3745
+				xsyntaxErrorf("ESEARCH result option %q not supported", w)
 			}
-			if eargs["ALL"] && len(uids) > 0 {
-				resp += fmt.Sprintf(" ALL %s", compactUIDSet(uids).String())
+		}
+	}
+	// We don't keep track of the lowest/highest message for updates, only of the
+	// full result.
+	if eargs["UPDATE"] && (eargs["MIN"] || eargs["MAX"]) {
+		xsyntaxErrorf("UPDATE cannot be combined with MIN or MAX")
+	}
+	// ../rfc/4731:149 ../rfc/9051:3737
+	if eargs != nil && !eargs["MIN"] && !eargs["MAX"] && !eargs["ALL"] && !eargs["COUNT"] && !eargs["PARTIAL"] && (!save || eargs["UPDATE"]) {
+		eargs["ALL"] = true
+	}
+	return
+}
+
+// xsearchCharset parses a charset for SEARCH, SORT or THREAD.
+func (p *parser) xsearchCharset() {
+	charset := strings.ToUpper(p.xastring())
+	if charset != "US-ASCII" && charset != "UTF-8" {
+		// ../rfc/3501:2771 ../rfc/9051:3836
+		xusercodeErrorf("BADCHARSET", "only US-ASCII and UTF-8 supported")
+	}
+}
+
+// xsearchKeys parses the search criteria until the end of the command.
+//
+// We gather word and not-word searches from the top-level, turn them into a
+// WordSearch for a more efficient search.
+func (p *parser) xsearchKeys() (sk *searchKey, bodySearch, textSearch *store.WordSearch) {
+	sk = &searchKey{
+		searchKeys: []searchKey{*p.xsearchKey()},
+	}
+	for !p.empty() {
+		p.xspace()
+		sk.searchKeys = append(sk.searchKeys, *p.xsearchKey())
+	}
+
+	// todo optimize: also gather them out of AND searches.
+	var textWords, textNotWords, bodyWords, bodyNotWords []string
+	n := 0
+	for _, xsk := range sk.searchKeys {
+		switch xsk.op {
+		case "BODY":
+			bodyWords = append(bodyWords, xsk.astring)
+			continue
+		case "TEXT":
+			textWords = append(textWords, xsk.astring)
+			continue
+		case "NOT":
+			switch xsk.searchKey.op {
+			case "BODY":
+				bodyNotWords = append(bodyNotWords, xsk.searchKey.astring)
+				continue
+			case "TEXT":
+				textNotWords = append(textNotWords, xsk.searchKey.astring)
+				continue
 			}
+		}
+		sk.searchKeys[n] = xsk
+		n++
+	}
+	// We may be left with an empty but non-nil sk.searchKeys, which is important for
+	// matching.
+	sk.searchKeys = sk.searchKeys[:n]
+	if len(bodyWords) > 0 || len(bodyNotWords) > 0 {
+		ws := store.PrepareWordSearch(bodyWords, bodyNotWords)
+		bodySearch = &ws
+	}
+	if len(textWords) > 0 || len(textNotWords) > 0 {
+		ws := store.PrepareWordSearch(textWords, textNotWords)
+		textSearch = &ws
+	}
+	return
+}
 
-			// Interaction between ESEARCH and CONDSTORE: ../rfc/7162:1211 ../rfc/4731:273
-			// Summary: send the highest modseq of the returned messages.
-			if sk.hasModseq() && len(uids) > 0 {
-				resp += fmt.Sprintf(" MODSEQ %d", maxModSeq.Client())
+// xsearchUIDs returns the UIDs of all messages in the session that match the
+// search criteria, in UID order.
+func (c *conn) xsearchUIDs(tx *bstore.Tx, sk searchKey, bodySearch, textSearch *store.WordSearch, expungeIssued *bool) (uids []store.UID, maxModSeq store.ModSeq) {
+	xsearchUseIndex(tx, bodySearch, textSearch)
+	for i, uid := range c.uids {
+		if match, modseq := c.searchMatch(tx, msgseq(i+1), uid, sk, bodySearch, textSearch, expungeIssued); match {
+			uids = append(uids, uid)
+			if modseq > maxModSeq {
+				maxModSeq = modseq
 			}
+		}
+	}
+	return
+}
+
+// writeEsearch writes an untagged ESEARCH response for SEARCH and SORT with the
+// options in eargs. Uids are in the order of the result, i.e. sorted for SORT.
+func (c *conn) writeEsearch(tag string, isUID bool, eargs map[string]bool, partial [2]uint32, uids []store.UID, hasModseq bool, maxModSeq store.ModSeq) {
+	// New-style ESEARCH response syntax: ../rfc/9051:6546 ../rfc/4466:522
+
+	// No untagged ESEARCH response if nothing was requested. ../rfc/9051:4160
+	if len(eargs) == 0 {
+		return
+	}
+
+	// The tag was originally a string, became an astring in IMAP4rev2, better stick to
+	// string. ../rfc/4466:707 ../rfc/5259:1163 ../rfc/9051:7087
+	resp := fmt.Sprintf(`* ESEARCH (TAG "%s")`, tag)
+	if isUID {
+		resp += " UID"
+	}
 
-			c.bwritelinef("%s", resp)
+	// NOTE: we are converting UIDs to msgseq in the uids slice (if needed) while
+	// keeping the "uids" name! We work on a copy, the search result or an update
+	// context may be hanging on to the slice.
+	if !isUID {
+		nuids := make([]store.UID, len(uids))
+		for i, uid := range uids {
+			nuids[i] = store.UID(c.xsequence(uid))
 		}
+		uids = nuids
 	}
-	if expungeIssued {
-		// ../rfc/9051:5102
-		c.writeresultf("%s OK [EXPUNGEISSUED] done", tag)
-	} else {
-		c.ok(tag, cmd)
+
+	// If no matches, then no MIN/MAX response. ../rfc/4731:98 ../rfc/9051:3758
+	// For SORT, MIN and MAX are the first and last message in the sort order. ../rfc/5267
+	if eargs["MIN"] && len(uids) > 0 {
+		resp += fmt.Sprintf(" MIN %d", uids[0])
+	}
+	if eargs["MAX"] && len(uids) > 0 {
+		resp += fmt.Sprintf(" MAX %d", uids[len(uids)-1])
+	}
+	if eargs["COUNT"] {
+		resp += fmt.Sprintf(" COUNT %d", len(uids))
+	}
+	// For SORT, compactUIDSet keeps the order, only joining ascending ranges.
+	if eargs["ALL"] && len(uids) > 0 {
+		resp += fmt.Sprintf(" ALL %s", compactUIDSet(uids).String())
+	}
+	if eargs["PARTIAL"] {
+		// ../rfc/5267
+		var l []store.UID
+		if int(partial[0]) <= len(uids) {
+			l = uids[partial[0]-1 : min(int(partial[1]), len(uids))]
+		}
+		set := "NIL"
+		if len(l) > 0 {
+			set = compactUIDSet(l).String()
+		}
+		resp += fmt.Sprintf(" PARTIAL (%d:%d %s)", partial[0], partial[1], set)
 	}
+
+	// Interaction between ESEARCH and CONDSTORE: ../rfc/7162:1211 ../rfc/4731:273
+	// Summary: send the highest modseq of the returned messages.
+	if hasModseq && len(uids) > 0 {
+		resp += fmt.Sprintf(" MODSEQ %d", maxModSeq.Client())
+	}
+
+	c.bwritelinef("%s", resp)
 }
 
 type search struct {
@@ -285,6 +355,19 @@ type search struct {
 	hasModseq     bool
 }
 
+// xsearchUseIndex looks up the candidate messages for the word searches in the
+// full-text index, so messages that cannot match don't have to be read.
+func xsearchUseIndex(tx *bstore.Tx, bodySearch, textSearch *store.WordSearch) {
+	if bodySearch != nil {
+		err := bodySearch.UseIndex(tx, false)
+		xcheckf(err, "looking up body search words in index")
+	}
+	if textSearch != nil {
+		err := textSearch.UseIndex(tx, true)
+		xcheckf(err, "looking up text search words in index")
+	}
+}
+
 func (c *conn) searchMatch(tx *bstore.Tx, seq msgseq, uid store.UID, sk searchKey, bodySearch, textSearch *store.WordSearch, expungeIssued *bool) (bool, store.ModSeq) {
 	s := search{c: c, tx: tx, seq: seq, uid: uid, expungeIssued: expungeIssued, hasModseq: sk.hasModseq()}
 	defer func() {
@@ -310,6 +393,13 @@ func (s *search) match(sk searchKey, bodySearch, textSearch *store.WordSearch) (
 	}()
 
 	match = s.match0(sk)
+	// The full-text index can tell us a message won't match without reading it.
+	if match && (bodySearch != nil || textSearch != nil) {
+		if !s.xensureMessage() || bodySearch != nil && bodySearch.IndexMiss(s.m) || textSearch != nil && textSearch.IndexMiss(s.m) {
+			match = false
+			return
+		}
+	}
 	if match && bodySearch != nil {
 		if !s.xensurePart() {
 			match = false
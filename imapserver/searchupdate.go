@@ -0,0 +1,152 @@
+package imapserver
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/store"
+)
+
+// Maximum number of SEARCH/SORT results per connection that we keep up to date
+// with RETURN (UPDATE). ../rfc/5267
+const maxSearchUpdates = 10
+
+// searchUpdate is a SEARCH or SORT with RETURN (UPDATE), for which we send
+// changes to the result as ESEARCH responses with ADDTO and REMOVEFROM, while the
+// mailbox stays selected. ../rfc/5267
+type searchUpdate struct {
+	tag        string
+	isUID      bool
+	sk         searchKey
+	bodySearch *store.WordSearch
+	textSearch *store.WordSearch
+	criteria   []sortCriterion // Nil for SEARCH.
+	uids       []store.UID     // Current result, in sort order for SORT.
+}
+
+// xsearchUpdateStart registers a search with RETURN (UPDATE) for sending updates.
+// If we are already keeping too many results up to date, an untagged NOUPDATE is
+// written instead.
+func (c *conn) xsearchUpdateStart(tag string, isUID bool, eargs map[string]bool, sk searchKey, bodySearch, textSearch *store.WordSearch, criteria []sortCriterion, uids []store.UID) {
+	if !eargs["UPDATE"] {
+		return
+	}
+
+	// A new command with the same tag replaces an earlier one.
+	c.searchUpdates = slices.DeleteFunc(c.searchUpdates, func(su searchUpdate) bool {
+		return su.tag == tag
+	})
+	if len(c.searchUpdates) >= maxSearchUpdates {
+		// ../rfc/5267
+		c.bwritelinef(`* NO [NOUPDATE "%s"] too many searches with updates`, tag)
+		return
+	}
+	c.searchUpdates = append(c.searchUpdates, searchUpdate{tag, isUID, sk, bodySearch, textSearch, criteria, slices.Clone(uids)})
+}
+
+// Cancelupdate stops sending updates for searches started with RETURN (UPDATE).
+//
+// State: Selected
+func (c *conn) cmdCancelupdate(tag, cmd string, p *parser) {
+	// Command: ../rfc/5267
+	// Syntax: ../rfc/5267
+
+	var tags []string
+	for {
+		p.xspace()
+		tags = append(tags, p.xstring())
+		if p.empty() {
+			break
+		}
+	}
+
+	// Unknown tags are not an error, the search may have been replaced or not been
+	// registered due to NOUPDATE.
+	c.searchUpdates = slices.DeleteFunc(c.searchUpdates, func(su searchUpdate) bool {
+		return slices.Contains(tags, su.tag)
+	})
+	c.ok(tag, cmd)
+}
+
+// xsearchUpdatesSend evaluates the searches with RETURN (UPDATE) again after
+// changes to the selected mailbox, and writes the differences as ADDTO and
+// REMOVEFROM. Called from applyChanges, after the session state is updated.
+// Expunged messages are not mentioned, the EXPUNGE/VANISHED already tells the
+// client. todo: only evaluate the changed messages, not the whole mailbox.
+func (c *conn) xsearchUpdatesSend() {
+	// We ignore expunged messages when matching, they will be removed from the session
+	// later.
+	var expungeIssued bool
+	results := make([][]store.UID, len(c.searchUpdates))
+	c.xdbread(func(tx *bstore.Tx) {
+		for i, su := range c.searchUpdates {
+			uids, _ := c.xsearchUIDs(tx, su.sk, su.bodySearch, su.textSearch, &expungeIssued)
+			if su.criteria != nil {
+				uids = c.xsortUIDs(tx, uids, su.criteria, &expungeIssued)
+			}
+			results[i] = uids
+		}
+	})
+
+	for i := range c.searchUpdates {
+		su := &c.searchUpdates[i]
+		nuids := results[i]
+
+		number := func(uid store.UID) uint32 {
+			if su.isUID {
+				return uint32(uid)
+			}
+			return uint32(c.xsequence(uid))
+		}
+
+		resp := fmt.Sprintf(`* ESEARCH (TAG "%s")`, su.tag)
+		if su.isUID {
+			resp += " UID"
+		}
+
+		// Removals are sent first, so the positions for additions apply to the result
+		// with removals applied. We don't send the position of removed messages, the
+		// client can look them up.
+		oldUIDs := map[store.UID]bool{}
+		for _, uid := range su.uids {
+			oldUIDs[uid] = true
+		}
+		newUIDs := map[store.UID]bool{}
+		for _, uid := range nuids {
+			newUIDs[uid] = true
+		}
+
+		var removed numSet
+		for _, uid := range su.uids {
+			if !newUIDs[uid] && c.sequence(uid) > 0 {
+				removed.append(number(uid))
+			}
+		}
+		if !removed.empty() {
+			c.bwritelinef("%s REMOVEFROM (0 %s)", resp, removed.String())
+		}
+
+		// For SEARCH, positions are not meaningful and we use 0. For SORT, additions are
+		// in order of their position in the new result, so each is inserted at its final
+		// position.
+		var added []string
+		for j, uid := range nuids {
+			if oldUIDs[uid] {
+				continue
+			}
+			pos := 0
+			if su.criteria != nil {
+				pos = j + 1
+			}
+			added = append(added, fmt.Sprintf("%d %d", pos, number(uid)))
+		}
+		if len(added) > 0 {
+			c.bwritelinef("%s ADDTO (%s)", resp, strings.Join(added, " "))
+		}
+
+		su.uids = nuids
+	}
+}
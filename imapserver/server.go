@@ -9,7 +9,7 @@ extensions sometimes include features not in IMAP4rev2. We want IMAP4rev1-only
 implementations to use extensions, so we implement the full feature set of the
 extension and announce it as capability. The extensions: LITERAL+, IDLE,
 NAMESPACE, BINARY, UNSELECT, UIDPLUS, ESEARCH, SEARCHRES, SASL-IR, ENABLE,
-LIST-EXTENDED, SPECIAL-USE, MOVE, UTF8=ONLY.
+LIST-EXTENDED, SPECIAL-USE, MOVE, UTF8=ONLY, ACL, ESORT.
 
 We take a liberty with UTF8=ONLY. We are supposed to wait for ENABLE of
 UTF8=ACCEPT or IMAP4rev2 before we respond with quoted strings that contain
@@ -21,6 +21,7 @@ non-ASCII UTF-8. Until that's enabled, we do use UTF-7 for mailbox names. See
 - When handling commands that modify the selected mailbox, always check that the mailbox is not opened readonly. And always revalidate the selected mailbox, another session may have deleted the mailbox.
 - After making changes to an account/mailbox/message, you must broadcast changes. You must do this with the account lock held. Otherwise, other later changes (e.g. message deliveries) may be made and broadcast before changes that were made earlier. Make sure to commit changes in the database first, because the commit may fail.
 - Mailbox hierarchies are slash separated, no leading slash. We keep the case, except INBOX is renamed to Inbox, also for submailboxes in INBOX. We don't allow existence of a child where its parent does not exist. We have no \NoInferiors or \NoSelect. Newly created mailboxes are automatically subscribed.
+- Mailboxes of other accounts that an account has been given rights to through an ACL are in the "Other Users/<account>/" and "Shared/<account>/" namespaces. When such a mailbox is selected, c.account and c.comm are set to the other account for the duration of the selection, so the commands for the selected state work unchanged. Commands for the authenticated state must use c.authAccount(). The rights on the selected mailbox are checked for changes, they are all rights for own mailboxes.
 - For CONDSTORE and QRESYNC support, we set "modseq" for each change/expunge. Once expunged, a modseq doesn't change anymore. We don't yet remove old expunged records. The records aren't too big. Next step may be to let an admin reclaim space manually.
 */
 
@@ -28,7 +29,7 @@ non-ASCII UTF-8. Until that's enabled, we do use UTF-7 for mailbox names. See
 - todo: do not return binary data for a fetch body. at least not for imap4rev1. we should be encoding it as base64?
 - todo: on expunge we currently remove the message even if other sessions still have a reference to the uid. if they try to query the uid, they'll get an error. we could be nicer and only actually remove the message when the last reference has gone. we could add a new flag to store.Message marking the message as expunged, not give new session access to such messages, and make store remove them at startup, and clean them when the last session referencing the session goes. however, it will get much more complicated. renaming messages would need special handling. and should we do the same for removed mailboxes?
 - todo: try to recover from syntax errors when the last command line ends with a }, i.e. a literal. we currently abort the entire connection. we may want to read some amount of literal data and continue with a next command.
-- todo future: more extensions: OBJECTID, MULTISEARCH, REPLACE, NOTIFY, CATENATE, MULTIAPPEND, SORT, THREAD, CREATE-SPECIAL-USE.
+- todo future: more extensions: OBJECTID, MULTISEARCH, REPLACE, CATENATE, MULTIAPPEND, CREATE-SPECIAL-USE.
 */
 
 import (
@@ -72,6 +73,7 @@ import (
 	"github.com/mjl-/mox/mox-"
 	"github.com/mjl-/mox/moxio"
 	"github.com/mjl-/mox/moxvar"
+	"github.com/mjl-/mox/oidc"
 	"github.com/mjl-/mox/ratelimit"
 	"github.com/mjl-/mox/scram"
 	"github.com/mjl-/mox/store"
@@ -155,12 +157,17 @@ var authFailDelay = time.Second  // After authentication failure.
 // QRESYNC: ../rfc/7162:1323
 // STATUS=SIZE: ../rfc/8438 ../rfc/9051:8024
 // QUOTA QUOTA=RES-STORAGE: ../rfc/9208:111
+// ACL RIGHTS=texk: ../rfc/4314:1098
+// NOTIFY: ../rfc/5465
+// SORT THREAD=ORDEREDSUBJECT THREAD=REFERENCES: ../rfc/5256
+// SORT=DISPLAY: ../rfc/5957
+// ESORT CONTEXT=SEARCH CONTEXT=SORT: ../rfc/5267
 //
 // We always announce support for SCRAM PLUS-variants, also on connections without
 // TLS. The client should not be selecting PLUS variants on non-TLS connections,
 // instead opting to do the bare SCRAM variant without indicating the server claims
 // to support the PLUS variant (skipping the server downgrade detection check).
-const serverCapabilities = "IMAP4rev2 IMAP4rev1 ENABLE LITERAL+ IDLE SASL-IR BINARY UNSELECT UIDPLUS ESEARCH SEARCHRES MOVE UTF8=ACCEPT LIST-EXTENDED SPECIAL-USE LIST-STATUS AUTH=SCRAM-SHA-256-PLUS AUTH=SCRAM-SHA-256 AUTH=SCRAM-SHA-1-PLUS AUTH=SCRAM-SHA-1 AUTH=CRAM-MD5 ID APPENDLIMIT=9223372036854775807 CONDSTORE QRESYNC STATUS=SIZE QUOTA QUOTA=RES-STORAGE"
+const serverCapabilities = "IMAP4rev2 IMAP4rev1 ENABLE LITERAL+ IDLE SASL-IR BINARY UNSELECT UIDPLUS ESEARCH SEARCHRES MOVE UTF8=ACCEPT LIST-EXTENDED SPECIAL-USE LIST-STATUS ID APPENDLIMIT=9223372036854775807 CONDSTORE QRESYNC STATUS=SIZE QUOTA QUOTA=RES-STORAGE ACL RIGHTS=texk NOTIFY SORT SORT=DISPLAY THREAD=ORDEREDSUBJECT THREAD=REFERENCES ESORT CONTEXT=SEARCH CONTEXT=SORT"
 
 type conn struct {
 	cid               int64
@@ -199,9 +206,27 @@ type conn struct {
 	account    *store.Account
 	comm       *store.Comm // For sending/receiving changes on mailboxes in account, e.g. from messages incoming on smtp, or another imap client.
 
-	mailboxID int64       // Only for StateSelected.
-	readonly  bool        // If opened mailbox is readonly.
-	uids      []store.UID // UIDs known in this session, sorted. todo future: store more space-efficiently, as ranges.
+	// When a mailbox of another account is selected, account and comm are that of
+	// the other account, and the authenticated account and its comm are kept here.
+	// Restored on unselect.
+	loginAccount *store.Account
+	loginComm    *store.Comm
+
+	mailboxID     int64       // Only for StateSelected.
+	mailboxRights string      // Rights on selected mailbox, all rights for own mailboxes.
+	readonly      bool        // If opened mailbox is readonly.
+	uids          []store.UID // UIDs known in this session, sorted. todo future: store more space-efficiently, as ranges.
+
+	// Set by NOTIFY SET, nil if not active or after NOTIFY NONE. With NOTIFY, changes
+	// are also sent while waiting for the next command. Changes to the selected
+	// mailbox that could not yet be sent are kept in notifyHeld, for the next command
+	// response.
+	notify     *notify
+	notifyHeld []store.Change
+
+	// Results of SEARCH/SORT with RETURN (UPDATE) for the selected mailbox, kept up to
+	// date with ESEARCH ADDTO/REMOVEFROM responses. Cleared on unselect.
+	searchUpdates []searchUpdate
 }
 
 // capability for use with ENABLED and CAPABILITY. We always keep this upper case,
@@ -240,8 +265,8 @@ func stateCommands(cmds ...string) map[string]struct{} {
 var (
 	commandsStateAny              = stateCommands("capability", "noop", "logout", "id")
 	commandsStateNotAuthenticated = stateCommands("starttls", "authenticate", "login")
-	commandsStateAuthenticated    = stateCommands("enable", "select", "examine", "create", "delete", "rename", "subscribe", "unsubscribe", "list", "namespace", "status", "append", "idle", "lsub", "getquotaroot", "getquota")
-	commandsStateSelected         = stateCommands("close", "unselect", "expunge", "search", "fetch", "store", "copy", "move", "uid expunge", "uid search", "uid fetch", "uid store", "uid copy", "uid move")
+	commandsStateAuthenticated    = stateCommands("enable", "select", "examine", "create", "delete", "rename", "subscribe", "unsubscribe", "list", "namespace", "status", "append", "idle", "lsub", "getquotaroot", "getquota", "setacl", "deleteacl", "getacl", "listrights", "myrights", "notify")
+	commandsStateSelected         = stateCommands("close", "unselect", "expunge", "search", "fetch", "store", "copy", "move", "sort", "thread", "cancelupdate", "uid expunge", "uid search", "uid fetch", "uid store", "uid copy", "uid move", "uid sort", "uid thread")
 )
 
 var commands = map[string]func(c *conn, tag, cmd string, p *parser){
@@ -273,23 +298,34 @@ var commands = map[string]func(c *conn, tag, cmd string, p *parser){
 	"idle":         (*conn).cmdIdle,
 	"getquotaroot": (*conn).cmdGetquotaroot,
 	"getquota":     (*conn).cmdGetquota,
+	"setacl":       (*conn).cmdSetacl,
+	"deleteacl":    (*conn).cmdDeleteacl,
+	"getacl":       (*conn).cmdGetacl,
+	"listrights":   (*conn).cmdListrights,
+	"myrights":     (*conn).cmdMyrights,
+	"notify":       (*conn).cmdNotify,
 
 	// Selected.
-	"check":       (*conn).cmdCheck,
-	"close":       (*conn).cmdClose,
-	"unselect":    (*conn).cmdUnselect,
-	"expunge":     (*conn).cmdExpunge,
-	"uid expunge": (*conn).cmdUIDExpunge,
-	"search":      (*conn).cmdSearch,
-	"uid search":  (*conn).cmdUIDSearch,
-	"fetch":       (*conn).cmdFetch,
-	"uid fetch":   (*conn).cmdUIDFetch,
-	"store":       (*conn).cmdStore,
-	"uid store":   (*conn).cmdUIDStore,
-	"copy":        (*conn).cmdCopy,
-	"uid copy":    (*conn).cmdUIDCopy,
-	"move":        (*conn).cmdMove,
-	"uid move":    (*conn).cmdUIDMove,
+	"check":        (*conn).cmdCheck,
+	"close":        (*conn).cmdClose,
+	"unselect":     (*conn).cmdUnselect,
+	"expunge":      (*conn).cmdExpunge,
+	"uid expunge":  (*conn).cmdUIDExpunge,
+	"search":       (*conn).cmdSearch,
+	"uid search":   (*conn).cmdUIDSearch,
+	"fetch":        (*conn).cmdFetch,
+	"uid fetch":    (*conn).cmdUIDFetch,
+	"store":        (*conn).cmdStore,
+	"uid store":    (*conn).cmdUIDStore,
+	"copy":         (*conn).cmdCopy,
+	"uid copy":     (*conn).cmdUIDCopy,
+	"move":         (*conn).cmdMove,
+	"uid move":     (*conn).cmdUIDMove,
+	"sort":         (*conn).cmdSort,
+	"uid sort":     (*conn).cmdUIDSort,
+	"thread":       (*conn).cmdThread,
+	"uid thread":   (*conn).cmdUIDThread,
+	"cancelupdate": (*conn).cmdCancelupdate,
 }
 
 var errIO = errors.New("io error")             // For read/write errors and errors that should close the connection.
@@ -396,19 +432,11 @@ func (c *conn) encodeMailbox(s string) string {
 }
 
 func (c *conn) xdbwrite(fn func(tx *bstore.Tx)) {
-	err := c.account.DB.Write(context.TODO(), func(tx *bstore.Tx) error {
-		fn(tx)
-		return nil
-	})
-	xcheckf(err, "transaction")
+	xdbwriteAccount(c.account, fn)
 }
 
 func (c *conn) xdbread(fn func(tx *bstore.Tx)) {
-	err := c.account.DB.Read(context.TODO(), func(tx *bstore.Tx) error {
-		fn(tx)
-		return nil
-	})
-	xcheckf(err, "transaction")
+	xdbreadAccount(c.account, fn)
 }
 
 // Closes the currently selected/active mailbox, setting state from selected to authenticated.
@@ -418,7 +446,18 @@ func (c *conn) unselect() {
 		c.state = stateAuthenticated
 	}
 	c.mailboxID = 0
+	c.mailboxRights = ""
 	c.uids = nil
+	c.notifyHeld = nil
+	c.searchUpdates = nil
+
+	if c.loginAccount != nil {
+		c.comm.Unregister()
+		err := c.account.Close()
+		c.xsanity(err, "closing account of shared mailbox")
+		c.account, c.comm = c.loginAccount, c.loginComm
+		c.loginAccount, c.loginComm = nil, nil
+	}
 }
 
 func (c *conn) setSlow(on bool) {
@@ -512,6 +551,9 @@ func (c *conn) readline(readCmd bool) string {
 		le := <-c.line
 		c.line = nil
 		line, err = le.line, le.err
+	} else if readCmd && c.notify != nil && c.comm != nil {
+		le := c.readlineNotify()
+		line, err = le.line, le.err
 	} else {
 		line, err = c.readline0()
 	}
@@ -552,8 +594,8 @@ func (c *conn) writeresultf(format string, args ...any) {
 // write buffered tagged command response, but first write pending changes.
 func (c *conn) bwriteresultf(format string, args ...any) {
 	switch c.cmd {
-	case "fetch", "store", "search":
-		// ../rfc/9051:5862 ../rfc/7162:2033
+	case "fetch", "store", "search", "sort", "thread":
+		// ../rfc/9051:5862 ../rfc/7162:2033 ../rfc/5256
 	default:
 		if c.comm != nil {
 			c.applyChanges(c.comm.Get(), false)
@@ -690,6 +732,7 @@ func serve(listenerName string, cid int64, tlsConfig *tls.Config, nc net.Conn, x
 		c.conn.Close()
 
 		if c.account != nil {
+			c.unselect()
 			c.comm.Unregister()
 			err := c.account.Close()
 			c.xsanity(err, "close account")
@@ -1199,6 +1242,10 @@ func (c *conn) xmailboxID(tx *bstore.Tx, id int64) store.Mailbox {
 // Should not be called while holding locks, as changes are written to client connections, which can block.
 // Does not flush output.
 func (c *conn) applyChanges(changes []store.Change, initial bool) {
+	if len(c.notifyHeld) > 0 {
+		changes = append(c.notifyHeld, changes...)
+		c.notifyHeld = nil
+	}
 	if len(changes) == 0 {
 		return
 	}
@@ -1208,6 +1255,18 @@ func (c *conn) applyChanges(changes []store.Change, initial bool) {
 
 	c.log.Debug("applying changes", slog.Any("changes", changes))
 
+	// With NOTIFY, changes to other mailboxes are sent as STATUS responses, after the
+	// changes for the selected mailbox.
+	var statusLines []string
+	if c.notify != nil {
+		changes, statusLines = c.notifyFilter(changes)
+		defer func() {
+			for _, line := range statusLines {
+				c.bwritelinef("%s", line)
+			}
+		}()
+	}
+
 	// Only keep changes for the selected mailbox, and changes that are always relevant.
 	var n []store.Change
 	for _, change := range changes {
@@ -1220,7 +1279,10 @@ func (c *conn) applyChanges(changes []store.Change, initial bool) {
 		case store.ChangeFlags:
 			mbID = ch.MailboxID
 		case store.ChangeRemoveMailbox, store.ChangeAddMailbox, store.ChangeRenameMailbox, store.ChangeAddSubscription:
-			n = append(n, change)
+			// Names of mailboxes in another account are not in our namespace.
+			if c.loginAccount == nil {
+				n = append(n, change)
+			}
 			continue
 		case store.ChangeMailboxCounts, store.ChangeMailboxSpecialUse, store.ChangeMailboxKeywords, store.ChangeThread:
 		default:
@@ -1235,6 +1297,21 @@ func (c *conn) applyChanges(changes []store.Change, initial bool) {
 	qresync := c.enabled[capQresync]
 	condstore := c.enabled[capCondstore]
 
+	// Results of searches with RETURN (UPDATE) are evaluated again after changes to
+	// messages, after the EXISTS/EXPUNGE/FETCH responses.
+	if len(c.searchUpdates) > 0 && !initial {
+		var messagesChanged bool
+		for _, change := range changes {
+			switch change.(type) {
+			case store.ChangeAddUID, store.ChangeRemoveUIDs, store.ChangeFlags:
+				messagesChanged = true
+			}
+		}
+		if messagesChanged {
+			defer c.xsearchUpdatesSend()
+		}
+	}
+
 	i := 0
 	for i < len(changes) {
 		// First process all new uids. So we only send a single EXISTS.
@@ -1259,6 +1336,14 @@ func (c *conn) applyChanges(changes []store.Change, initial bool) {
 			// long enough after the EXISTS to see these messages, and doesn't request them
 			// again with a FETCH.
 			c.bwritelinef("* %d EXISTS", len(c.uids))
+			if c.notify != nil && c.notify.Selected != nil && len(c.notify.Selected.Events.FetchAtts) > 0 {
+				uids := make([]store.UID, len(adds))
+				for j, add := range adds {
+					uids[j] = add.UID
+				}
+				c.xnotifyFetch(uids, c.notify.Selected.Events.FetchAtts)
+				continue
+			}
 			for _, add := range adds {
 				seq := c.xsequence(add.UID)
 				var modseqStr string
@@ -1318,7 +1403,7 @@ func (c *conn) applyChanges(changes []store.Change, initial bool) {
 			// Only announce \NonExistent to modern clients, otherwise they may ignore the
 			// unrecognized \NonExistent and interpret this as a newly created mailbox, while
 			// the goal was to remove it...
-			if c.enabled[capIMAP4rev2] {
+			if c.enabled[capIMAP4rev2] || c.notify != nil {
 				c.bwritelinef(`* LIST (\NonExistent) "/" %s`, astring(c.encodeMailbox(ch.Name)).pack(c))
 			}
 		case store.ChangeAddMailbox:
@@ -1326,7 +1411,7 @@ func (c *conn) applyChanges(changes []store.Change, initial bool) {
 		case store.ChangeRenameMailbox:
 			// OLDNAME only with IMAP4rev2 or NOTIFY ../rfc/9051:2726 ../rfc/5465:628
 			var oldname string
-			if c.enabled[capIMAP4rev2] {
+			if c.enabled[capIMAP4rev2] || c.notify != nil {
 				oldname = fmt.Sprintf(` ("OLDNAME" (%s))`, string0(c.encodeMailbox(ch.OldName)).pack(c))
 			}
 			c.bwritelinef(`* LIST (%s) "/" %s%s`, strings.Join(ch.Flags, " "), astring(c.encodeMailbox(ch.NewName)).pack(c), oldname)
@@ -1359,6 +1444,9 @@ func (c *conn) cmdCapability(tag, cmd string, p *parser) {
 // For use in cmdCapability and untagged OK responses on connection start, login and authenticate.
 func (c *conn) capabilities() string {
 	caps := serverCapabilities
+	if store.PasswordHashMechanisms() {
+		caps += " AUTH=SCRAM-SHA-256-PLUS AUTH=SCRAM-SHA-256 AUTH=SCRAM-SHA-1-PLUS AUTH=SCRAM-SHA-1 AUTH=CRAM-MD5"
+	}
 	// ../rfc/9051:1238
 	// We only allow starting without TLS when explicitly configured, in violation of RFC.
 	if !c.tls && c.tlsConfig != nil {
@@ -1366,6 +1454,9 @@ func (c *conn) capabilities() string {
 	}
 	if c.tls || c.noRequireSTARTTLS {
 		caps += " AUTH=PLAIN"
+		if mox.Conf.Static.OIDC != nil {
+			caps += " AUTH=OAUTHBEARER AUTH=XOAUTH2"
+		}
 	} else {
 		caps += " LOGINDISABLED"
 	}
@@ -1595,7 +1686,7 @@ func (c *conn) cmdAuthenticate(tag, cmd string, p *parser) {
 			xusercodeErrorf("AUTHORIZATIONFAILED", "cannot assume role")
 		}
 
-		acc, err := store.OpenEmailAuth(c.log, authc, password)
+		acc, err := store.OpenEmailAuth(c.log, authc, password, store.AppProtocolIMAP)
 		if err != nil {
 			if errors.Is(err, store.ErrUnknownCredentials) {
 				authResult = "badcreds"
@@ -1608,6 +1699,9 @@ func (c *conn) cmdAuthenticate(tag, cmd string, p *parser) {
 		c.username = authc
 
 	case "CRAM-MD5":
+		if !store.PasswordHashMechanisms() {
+			xuserErrorf("method not supported")
+		}
 		authVariant = strings.ToLower(authType)
 
 		// ../rfc/9051:1462
@@ -1677,6 +1771,9 @@ func (c *conn) cmdAuthenticate(tag, cmd string, p *parser) {
 		c.username = addr
 
 	case "SCRAM-SHA-256-PLUS", "SCRAM-SHA-256", "SCRAM-SHA-1-PLUS", "SCRAM-SHA-1":
+		if !store.PasswordHashMechanisms() {
+			xuserErrorf("method not supported")
+		}
 		// todo: improve handling of errors during scram. e.g. invalid parameters. should we abort the imap command, or continue until the end and respond with a scram-level error?
 		// todo: use single implementation between ../imapserver/server.go and ../smtpserver/server.go
 
@@ -1776,6 +1873,56 @@ func (c *conn) cmdAuthenticate(tag, cmd string, p *parser) {
 		acc = nil // Cancel cleanup.
 		c.username = ss.Authentication
 
+	case "OAUTHBEARER", "XOAUTH2":
+		oidcConf := mox.Conf.Static.OIDC
+		if oidcConf == nil {
+			xuserErrorf("method not supported")
+		}
+		authVariant = strings.ToLower(authType)
+
+		if !c.noRequireSTARTTLS && !c.tls {
+			// ../rfc/7628
+			xusercodeErrorf("PRIVACYREQUIRED", "tls required for login")
+		}
+
+		// Bearer tokens are credentials, mark as traceauth.
+		defer c.xtrace(mlog.LevelTraceauth)()
+		buf := xreadInitial()
+		c.xtrace(mlog.LevelTrace) // Restore.
+		var authz, token string
+		var err error
+		if authVariant == "oauthbearer" {
+			authz, token, err = oidc.ParseOAUTHBEARER(buf)
+		} else {
+			authz, token, err = oidc.ParseXOAUTH2(buf)
+		}
+		if err != nil {
+			xsyntaxErrorf("%s", err)
+		}
+
+		acc, username, err := store.OpenEmailToken(context.TODO(), c.log, authz, token)
+		if err != nil {
+			if errors.Is(err, store.ErrUnknownCredentials) {
+				authResult = "badcreds"
+				c.log.Infox("authentication failed", err, slog.String("username", authz))
+				// The error is sent as challenge. The client responds, and only then we fail.
+				// ../rfc/7628
+				var chal []byte
+				if authVariant == "oauthbearer" {
+					chal = oidc.ErrorOAUTHBEARER(oidcConf.Issuer)
+				} else {
+					chal = oidc.ErrorXOAUTH2()
+				}
+				c.writelinef("+ %s", base64.StdEncoding.EncodeToString(chal))
+				xreadContinuation()
+				xusercodeErrorf("AUTHENTICATIONFAILED", "bad credentials")
+			}
+			c.log.Errorx("verifying bearer token", err)
+			xusercodeErrorf("UNAVAILABLE", "cannot verify token at this time")
+		}
+		c.account = acc
+		c.username = username
+
 	default:
 		xuserErrorf("method not supported")
 	}
@@ -1826,7 +1973,7 @@ func (c *conn) cmdLogin(tag, cmd string, p *parser) {
 		}
 	}()
 
-	acc, err := store.OpenEmailAuth(c.log, userid, password)
+	acc, err := store.OpenEmailAuth(c.log, userid, password, store.AppProtocolIMAP)
 	if err != nil {
 		authResult = "badcreds"
 		var code string
@@ -2006,6 +2153,24 @@ func (c *conn) cmdSelectExamine(isselect bool, tag, cmd string, p *parser) {
 
 	name = xcheckmailboxname(name, true)
 
+	// For a mailbox of another account, we switch to that account for the duration
+	// of the selection. If the select fails, unselect switches back.
+	listName := name
+	rights := store.RightsAll
+	if accName, mbName, ok := xsharedName(name); ok {
+		var acc *store.Account
+		acc, _, rights = c.xsharedMailbox(accName, mbName, "")
+		c.loginAccount, c.loginComm = c.account, c.comm
+		c.account, c.comm = acc, store.RegisterComm(acc)
+		defer func() {
+			if c.state != stateSelected {
+				c.unselect()
+			}
+		}()
+		name = mbName
+		xrequireRights(rights, "r")
+	}
+
 	var highestModSeq store.ModSeq
 	var highDeletedModSeq store.ModSeq
 	var firstUnseen msgseq = 0
@@ -2063,7 +2228,7 @@ func (c *conn) cmdSelectExamine(isselect bool, tag, cmd string, p *parser) {
 	}
 	c.bwritelinef(`* OK [UIDVALIDITY %d] x`, mb.UIDValidity)
 	c.bwritelinef(`* OK [UIDNEXT %d] x`, mb.UIDNext)
-	c.bwritelinef(`* LIST () "/" %s`, astring(c.encodeMailbox(mb.Name)).pack(c))
+	c.bwritelinef(`* LIST () "/" %s`, astring(c.encodeMailbox(listName)).pack(c))
 	if c.enabled[capCondstore] {
 		// ../rfc/7162:417
 		// ../rfc/7162-eid5055 ../rfc/7162:484 ../rfc/7162:1167
@@ -2209,7 +2374,8 @@ func (c *conn) cmdSelectExamine(isselect bool, tag, cmd string, p *parser) {
 		}
 	}
 
-	if isselect {
+	// Without rights to make changes, a mailbox is opened readonly. ../rfc/4314:866
+	if isselect && strings.ContainsAny(rights, "swte") {
 		c.bwriteresultf("%s OK [READ-WRITE] x", tag)
 		c.readonly = false
 	} else {
@@ -2217,6 +2383,7 @@ func (c *conn) cmdSelectExamine(isselect bool, tag, cmd string, p *parser) {
 		c.readonly = true
 	}
 	c.mailboxID = mb.ID
+	c.mailboxRights = rights
 	c.state = stateSelected
 	c.searchResult = nil
 	c.xflush()
@@ -2238,15 +2405,19 @@ func (c *conn) cmdCreate(tag, cmd string, p *parser) {
 	origName := name
 	name = strings.TrimRight(name, "/") // ../rfc/9051:1930
 	name = xcheckmailboxname(name, false)
+	if isSharedName(name) {
+		xusercodeErrorf("NOPERM", "cannot create mailboxes in namespace for other accounts")
+	}
 
 	var changes []store.Change
 	var created []string // Created mailbox names.
 
-	c.account.WithWLock(func() {
-		c.xdbwrite(func(tx *bstore.Tx) {
+	acc := c.authAccount()
+	acc.WithWLock(func() {
+		xdbwriteAccount(acc, func(tx *bstore.Tx) {
 			var exists bool
 			var err error
-			changes, created, exists, err = c.account.MailboxCreate(tx, name)
+			changes, created, exists, err = acc.MailboxCreate(tx, name)
 			if exists {
 				// ../rfc/9051:1914
 				xuserErrorf("mailbox already exists")
@@ -2254,7 +2425,7 @@ func (c *conn) cmdCreate(tag, cmd string, p *parser) {
 			xcheckf(err, "creating mailbox")
 		})
 
-		c.broadcast(changes)
+		c.broadcastAccount(acc, changes)
 	})
 
 	for _, n := range created {
@@ -2282,31 +2453,35 @@ func (c *conn) cmdDelete(tag, cmd string, p *parser) {
 	p.xempty()
 
 	name = xcheckmailboxname(name, false)
+	if isSharedName(name) {
+		xusercodeErrorf("NOPERM", "cannot delete mailboxes of other accounts")
+	}
 
 	// Messages to remove after having broadcasted the removal of messages.
 	var removeMessageIDs []int64
 
-	c.account.WithWLock(func() {
+	acc := c.authAccount()
+	acc.WithWLock(func() {
 		var mb store.Mailbox
 		var changes []store.Change
 
-		c.xdbwrite(func(tx *bstore.Tx) {
+		xdbwriteAccount(acc, func(tx *bstore.Tx) {
 			mb = c.xmailbox(tx, name, "NONEXISTENT")
 
 			var hasChildren bool
 			var err error
-			changes, removeMessageIDs, hasChildren, err = c.account.MailboxDelete(context.TODO(), c.log, tx, mb)
+			changes, removeMessageIDs, hasChildren, err = acc.MailboxDelete(context.TODO(), c.log, tx, mb)
 			if hasChildren {
 				xusercodeErrorf("HASCHILDREN", "mailbox has a child, only leaf mailboxes can be deleted")
 			}
 			xcheckf(err, "deleting mailbox")
 		})
 
-		c.broadcast(changes)
+		c.broadcastAccount(acc, changes)
 	})
 
 	for _, mID := range removeMessageIDs {
-		p := c.account.MessagePath(mID)
+		p := acc.MessagePath(mID)
 		err := os.Remove(p)
 		c.log.Check(err, "removing message file for mailbox delete", slog.String("path", p))
 	}
@@ -2334,11 +2509,15 @@ func (c *conn) cmdRename(tag, cmd string, p *parser) {
 
 	src = xcheckmailboxname(src, true)
 	dst = xcheckmailboxname(dst, false)
+	if isSharedName(src) || isSharedName(dst) {
+		xusercodeErrorf("NOPERM", "cannot rename mailboxes of other accounts")
+	}
 
-	c.account.WithWLock(func() {
+	acc := c.authAccount()
+	acc.WithWLock(func() {
 		var changes []store.Change
 
-		c.xdbwrite(func(tx *bstore.Tx) {
+		xdbwriteAccount(acc, func(tx *bstore.Tx) {
 			srcMB := c.xmailbox(tx, src, "NONEXISTENT")
 
 			// Inbox is very special. Unlike other mailboxes, its children are not moved. And
@@ -2346,7 +2525,7 @@ func (c *conn) cmdRename(tag, cmd string, p *parser) {
 			// indeed create a new destination mailbox and actually move the messages.
 			// ../rfc/9051:2101
 			if src == "Inbox" {
-				exists, err := c.account.MailboxExists(tx, dst)
+				exists, err := acc.MailboxExists(tx, dst)
 				xcheckf(err, "checking if destination mailbox exists")
 				if exists {
 					xusercodeErrorf("ALREADYEXISTS", "destination mailbox %q already exists", dst)
@@ -2355,7 +2534,7 @@ func (c *conn) cmdRename(tag, cmd string, p *parser) {
 					xuserErrorf("cannot move inbox to itself")
 				}
 
-				uidval, err := c.account.NextUIDValidity(tx)
+				uidval, err := acc.NextUIDValidity(tx)
 				xcheckf(err, "next uid validity")
 
 				dstMB := store.Mailbox{
@@ -2368,7 +2547,7 @@ func (c *conn) cmdRename(tag, cmd string, p *parser) {
 				err = tx.Insert(&dstMB)
 				xcheckf(err, "create new destination mailbox")
 
-				modseq, err := c.account.NextModSeq(tx)
+				modseq, err := acc.NextModSeq(tx)
 				xcheckf(err, "assigning next modseq")
 
 				changes = make([]store.Change, 2) // Placeholders filled in below.
@@ -2429,7 +2608,7 @@ func (c *conn) cmdRename(tag, cmd string, p *parser) {
 
 			var notExists, alreadyExists bool
 			var err error
-			changes, _, notExists, alreadyExists, err = c.account.MailboxRename(tx, srcMB, dst)
+			changes, _, notExists, alreadyExists, err = acc.MailboxRename(tx, srcMB, dst)
 			if notExists {
 				// ../rfc/9051:5140
 				xusercodeErrorf("NONEXISTENT", "%s", err)
@@ -2438,7 +2617,7 @@ func (c *conn) cmdRename(tag, cmd string, p *parser) {
 			}
 			xcheckf(err, "renaming mailbox")
 		})
-		c.broadcast(changes)
+		c.broadcastAccount(acc, changes)
 	})
 
 	c.ok(tag, cmd)
@@ -2460,16 +2639,25 @@ func (c *conn) cmdSubscribe(tag, cmd string, p *parser) {
 
 	name = xcheckmailboxname(name, true)
 
-	c.account.WithWLock(func() {
+	// Mailboxes of other accounts must be visible to be subscribed. The subscription
+	// is stored in our account with the full name.
+	if accName, mbName, ok := xsharedName(name); ok {
+		sacc, _, _ := c.xsharedMailbox(accName, mbName, "NONEXISTENT")
+		err := sacc.Close()
+		c.xsanity(err, "closing account")
+	}
+
+	acc := c.authAccount()
+	acc.WithWLock(func() {
 		var changes []store.Change
 
-		c.xdbwrite(func(tx *bstore.Tx) {
+		xdbwriteAccount(acc, func(tx *bstore.Tx) {
 			var err error
-			changes, err = c.account.SubscriptionEnsure(tx, name)
+			changes, err = acc.SubscriptionEnsure(tx, name)
 			xcheckf(err, "ensuring subscription")
 		})
 
-		c.broadcast(changes)
+		c.broadcastAccount(acc, changes)
 	})
 
 	c.ok(tag, cmd)
@@ -2489,12 +2677,16 @@ func (c *conn) cmdUnsubscribe(tag, cmd string, p *parser) {
 
 	name = xcheckmailboxname(name, true)
 
-	c.account.WithWLock(func() {
-		c.xdbwrite(func(tx *bstore.Tx) {
+	acc := c.authAccount()
+	acc.WithWLock(func() {
+		xdbwriteAccount(acc, func(tx *bstore.Tx) {
 			// It's OK if not currently subscribed, ../rfc/9051:2215
 			err := tx.Delete(&store.Subscription{Name: name})
 			if err == bstore.ErrAbsent {
-				exists, err := c.account.MailboxExists(tx, name)
+				if isSharedName(name) {
+					return
+				}
+				exists, err := acc.MailboxExists(tx, name)
 				xcheckf(err, "checking if mailbox exists")
 				if !exists {
 					xuserErrorf("mailbox does not exist")
@@ -2528,7 +2720,8 @@ func (c *conn) cmdLsub(tag, cmd string, p *parser) {
 	re := xmailboxPatternMatcher(ref, []string{pattern})
 
 	var lines []string
-	c.xdbread(func(tx *bstore.Tx) {
+	acc := c.authAccount()
+	xdbreadAccount(acc, func(tx *bstore.Tx) {
 		q := bstore.QueryTx[store.Subscription](tx)
 		q.SortAsc("Name")
 		subscriptions, err := q.List()
@@ -2577,8 +2770,9 @@ func (c *conn) cmdLsub(tag, cmd string, p *parser) {
 	c.ok(tag, cmd)
 }
 
-// The namespace command returns the mailbox path separator. We only implement
-// the personal mailbox hierarchy, no shared/other.
+// The namespace command returns the mailbox path separator and the namespaces.
+// Besides the personal namespace, mailboxes of other accounts that have been
+// shared through an ACL are in the "Other Users" and "Shared" namespaces.
 //
 // In IMAP4rev2, it was an extension before.
 //
@@ -2590,7 +2784,7 @@ func (c *conn) cmdNamespace(tag, cmd string, p *parser) {
 	p.xempty()
 
 	// Response syntax: ../rfc/9051:6778 ../rfc/2342:415
-	c.bwritelinef(`* NAMESPACE (("" "/")) NIL NIL`)
+	c.bwritelinef(`* NAMESPACE (("" "/")) ((%s "/")) ((%s "/"))`, string0(nsOtherUsers+"/").pack(c), string0(nsShared+"/").pack(c))
 	c.ok(tag, cmd)
 }
 
@@ -2617,12 +2811,26 @@ func (c *conn) cmdStatus(tag, cmd string, p *parser) {
 
 	name = xcheckmailboxname(name, true)
 
+	acc := c.authAccount()
+	mbName := name
+	if accName, sharedName, ok := xsharedName(name); ok {
+		var rights string
+		acc, _, rights = c.xsharedMailbox(accName, sharedName, "")
+		defer func() {
+			err := acc.Close()
+			c.xsanity(err, "closing account")
+		}()
+		xrequireRights(rights, "r")
+		mbName = sharedName
+	}
+
 	var mb store.Mailbox
 
 	var responseLine string
-	c.account.WithRLock(func() {
-		c.xdbread(func(tx *bstore.Tx) {
-			mb = c.xmailbox(tx, name, "")
+	acc.WithRLock(func() {
+		xdbreadAccount(acc, func(tx *bstore.Tx) {
+			mb = c.xmailbox(tx, mbName, "")
+			mb.Name = name // For the response, includes the namespace prefix for other accounts.
 			responseLine = c.xstatusLine(tx, mb, attrs)
 		})
 	})
@@ -2732,8 +2940,21 @@ func (c *conn) cmdAppend(tag, cmd string, p *parser) {
 	size, sync := p.xliteralSize(0, utf8)
 
 	name = xcheckmailboxname(name, true)
-	c.xdbread(func(tx *bstore.Tx) {
-		c.xmailbox(tx, name, "TRYCREATE")
+	acc := c.authAccount()
+	mbName := name
+	if accName, sharedName, ok := xsharedName(name); ok {
+		var rights string
+		acc, _, rights = c.xsharedMailbox(accName, sharedName, "TRYCREATE")
+		defer func() {
+			err := acc.Close()
+			c.xsanity(err, "closing account")
+		}()
+		xrequireRights(rights, "i")
+		mbName = sharedName
+		storeFlags, keywords = rightsFlags(rights, storeFlags, keywords)
+	}
+	xdbreadAccount(acc, func(tx *bstore.Tx) {
+		c.xmailbox(tx, mbName, "TRYCREATE")
 	})
 	if sync {
 		c.writelinef("+ ")
@@ -2772,18 +2993,15 @@ func (c *conn) cmdAppend(tag, cmd string, p *parser) {
 		np.xempty()
 	}
 	p.xempty()
-	if !sync {
-		name = xcheckmailboxname(name, true)
-	}
 
 	var mb store.Mailbox
 	var m store.Message
 	var pendingChanges []store.Change
 
-	c.account.WithWLock(func() {
+	acc.WithWLock(func() {
 		var changes []store.Change
-		c.xdbwrite(func(tx *bstore.Tx) {
-			mb = c.xmailbox(tx, name, "TRYCREATE")
+		xdbwriteAccount(acc, func(tx *bstore.Tx) {
+			mb = c.xmailbox(tx, mbName, "TRYCREATE")
 
 			// Ensure keywords are stored in mailbox.
 			var mbKwChanged bool
@@ -2801,7 +3019,7 @@ func (c *conn) cmdAppend(tag, cmd string, p *parser) {
 				Size:          mw.Size,
 			}
 
-			ok, maxSize, err := c.account.CanAddMessageSize(tx, m.Size)
+			ok, maxSize, err := acc.CanAddMessageSize(tx, m.Size)
 			xcheckf(err, "checking quota")
 			if !ok {
 				// ../rfc/9051:5155 ../rfc/9208:472
@@ -2814,21 +3032,21 @@ func (c *conn) cmdAppend(tag, cmd string, p *parser) {
 			err = tx.Update(&mb)
 			xcheckf(err, "updating mailbox counts")
 
-			err = c.account.DeliverMessage(c.log, tx, &m, msgFile, true, false, false, true)
+			err = acc.DeliverMessage(c.log, tx, &m, msgFile, true, false, false, true)
 			xcheckf(err, "delivering message")
 		})
 
 		// Fetch pending changes, possibly with new UIDs, so we can apply them before adding our own new UID.
-		if c.comm != nil {
+		if c.comm != nil && acc == c.account {
 			pendingChanges = c.comm.Get()
 		}
 
 		// Broadcast the change to other connections.
 		changes = append(changes, m.ChangeAddUID(), mb.ChangeCounts())
-		c.broadcast(changes)
+		c.broadcastAccount(acc, changes)
 	})
 
-	if c.mailboxID == mb.ID {
+	if c.mailboxID == mb.ID && acc == c.account {
 		c.applyChanges(pendingChanges, false)
 		c.uidAppend(m.UID)
 		// todo spec: with condstore/qresync, is there a mechanism to the client know the modseq for the appended uid? in theory an untagged fetch with the modseq after the OK APPENDUID could make sense, but this probably isn't allowed.
@@ -2900,12 +3118,21 @@ func (c *conn) cmdGetquotaroot(tag, cmd string, p *parser) {
 	// ../rfc/9208:295
 	name = xcheckmailboxname(name, true)
 
+	// Mailboxes of other accounts don't count towards our quota, and we don't show
+	// the quota of other accounts.
+	if isSharedName(name) {
+		c.bwritelinef(`* QUOTAROOT %s`, astring(name).pack(c))
+		c.ok(tag, cmd)
+		return
+	}
+
 	// Get current usage for account.
 	var quota, size int64 // Account only has a quota if > 0.
-	c.account.WithRLock(func() {
-		quota = c.account.QuotaMessageSize()
+	acc := c.authAccount()
+	acc.WithRLock(func() {
+		quota = acc.QuotaMessageSize()
 		if quota >= 0 {
-			c.xdbread(func(tx *bstore.Tx) {
+			xdbreadAccount(acc, func(tx *bstore.Tx) {
 				du := store.DiskUsage{ID: 1}
 				err := tx.Get(&du)
 				xcheckf(err, "gather used quota")
@@ -2944,10 +3171,11 @@ func (c *conn) cmdGetquota(tag, cmd string, p *parser) {
 	}
 
 	var quota, size int64
-	c.account.WithRLock(func() {
-		quota = c.account.QuotaMessageSize()
+	acc := c.authAccount()
+	acc.WithRLock(func() {
+		quota = acc.QuotaMessageSize()
 		if quota > 0 {
-			c.xdbread(func(tx *bstore.Tx) {
+			xdbreadAccount(acc, func(tx *bstore.Tx) {
 				du := store.DiskUsage{ID: 1}
 				err := tx.Get(&du)
 				xcheckf(err, "gather used quota")
@@ -2993,7 +3221,8 @@ func (c *conn) cmdClose(tag, cmd string, p *parser) {
 	// Request syntax: ../rfc/9051:6476 ../rfc/3501:4679
 	p.xempty()
 
-	if c.readonly {
+	// Without the expunge right, messages are not removed. ../rfc/4314:911
+	if c.readonly || !strings.Contains(c.mailboxRights, "e") {
 		c.unselect()
 		c.ok(tag, cmd)
 		return
@@ -3001,9 +3230,10 @@ func (c *conn) cmdClose(tag, cmd string, p *parser) {
 
 	remove, _ := c.xexpunge(nil, true)
 
+	acc := c.account // Before unselect, which may switch back to our own account.
 	defer func() {
 		for _, m := range remove {
-			p := c.account.MessagePath(m.ID)
+			p := acc.MessagePath(m.ID)
 			err := os.Remove(p)
 			c.xsanity(err, "removing message file for expunge for close")
 		}
@@ -3077,6 +3307,9 @@ func (c *conn) xexpunge(uidSet *numSet, missingMailboxOK bool) (remove []store.M
 			_, err = qmr.Delete()
 			xcheckf(err, "removing message recipients")
 
+			err = store.TextIndexRemove(tx, removeIDs...)
+			xcheckf(err, "removing messages from full-text index")
+
 			qm = bstore.QueryTx[store.Message](tx)
 			qm.FilterIDs(removeIDs)
 			n, err := qm.UpdateNonzero(store.Message{Expunged: true, ModSeq: modseq})
@@ -3146,6 +3379,7 @@ func (c *conn) cmdExpunge(tag, cmd string, p *parser) {
 	if c.readonly {
 		xuserErrorf("mailbox open in read-only mode")
 	}
+	xrequireRights(c.mailboxRights, "e")
 
 	c.cmdxExpunge(tag, cmd, nil)
 }
@@ -3165,6 +3399,7 @@ func (c *conn) cmdUIDExpunge(tag, cmd string, p *parser) {
 	if c.readonly {
 		xuserErrorf("mailbox open in read-only mode")
 	}
+	xrequireRights(c.mailboxRights, "e")
 
 	c.cmdxExpunge(tag, cmd, &uidSet)
 }
@@ -3221,6 +3456,26 @@ func (c *conn) cmdUIDSearch(tag, cmd string, p *parser) {
 	c.cmdxSearch(true, tag, cmd, p)
 }
 
+// State: Selected
+func (c *conn) cmdSort(tag, cmd string, p *parser) {
+	c.cmdxSort(false, tag, cmd, p)
+}
+
+// State: Selected
+func (c *conn) cmdUIDSort(tag, cmd string, p *parser) {
+	c.cmdxSort(true, tag, cmd, p)
+}
+
+// State: Selected
+func (c *conn) cmdThread(tag, cmd string, p *parser) {
+	c.cmdxThread(false, tag, cmd, p)
+}
+
+// State: Selected
+func (c *conn) cmdUIDThread(tag, cmd string, p *parser) {
+	c.cmdxThread(true, tag, cmd, p)
+}
+
 // State: Selected
 func (c *conn) cmdFetch(tag, cmd string, p *parser) {
 	c.cmdxFetch(false, tag, cmd, p)
@@ -3297,6 +3552,14 @@ func (c *conn) cmdxCopy(isUID bool, tag, cmd string, p *parser) {
 
 	uids, uidargs := c.gatherCopyMoveUIDs(isUID, nums)
 
+	dstAcc, name, dstRights, closeAcc := c.xcopyDestination(name)
+	defer closeAcc()
+	if dstAcc != c.account {
+		mbDst, newUIDs := c.xcopyAccount(uids, uidargs, dstAcc, name, dstRights)
+		c.writeresultf("%s OK [COPYUID %d %s %s] copied", tag, mbDst.UIDValidity, compactUIDSet(uids).String(), compactUIDSet(newUIDs).String())
+		return
+	}
+
 	// Files that were created during the copy. Remove them if the operation fails.
 	var createdIDs []int64
 	defer func() {
@@ -3397,6 +3660,7 @@ func (c *conn) cmdxCopy(isUID bool, tag, cmd string, p *parser) {
 					m.IsReject = false
 				}
 				m.TrainedJunk = nil
+				m.Flags, m.Keywords = rightsFlags(dstRights, m.Flags, m.Keywords)
 				m.JunkFlagsForMailbox(mbDst, conf)
 				err := tx.Insert(&m)
 				xcheckf(err, "inserting message")
@@ -3422,6 +3686,9 @@ func (c *conn) cmdxCopy(isUID bool, tag, cmd string, p *parser) {
 					xcheckf(err, "inserting message recipient")
 				}
 
+				err = store.TextIndexCopy(tx, origID, m.ID)
+				xcheckf(err, "copying message in full-text index")
+
 				mbDst.Add(m.MailboxCounts())
 			}
 
@@ -3493,9 +3760,18 @@ func (c *conn) cmdxMove(isUID bool, tag, cmd string, p *parser) {
 	if c.readonly {
 		xuserErrorf("mailbox open in read-only mode")
 	}
+	// ../rfc/4314:1015
+	xrequireRights(c.mailboxRights, "te")
 
 	uids, uidargs := c.gatherCopyMoveUIDs(isUID, nums)
 
+	dstAcc, name, dstRights, closeAcc := c.xcopyDestination(name)
+	defer closeAcc()
+	if dstAcc != c.account {
+		c.xmoveAccount(tag, cmd, uids, uidargs, dstAcc, name, dstRights)
+		return
+	}
+
 	var mbSrc, mbDst store.Mailbox
 	var changes []store.Change
 	var newUIDs []store.UID
@@ -3698,6 +3974,20 @@ func (c *conn) cmdxStore(isUID bool, tag, cmd string, p *parser) {
 		mask = store.FlagsAll
 	}
 
+	// Flags that the rights on the mailbox don't allow changing are left alone.
+	// ../rfc/4314:950
+	keepKeywords := !strings.Contains(c.mailboxRights, "w")
+	if keepKeywords {
+		mask = store.Flags{Seen: mask.Seen, Deleted: mask.Deleted}
+		keywords = nil
+	}
+	if !strings.Contains(c.mailboxRights, "s") {
+		mask.Seen = false
+	}
+	if !strings.Contains(c.mailboxRights, "t") {
+		mask.Deleted = false
+	}
+
 	var mb, origmb store.Mailbox
 	var updated []store.Message
 	var changed []store.Message // ModSeq more recent than unchangedSince, will be in MODIFIED response code, and we will send untagged fetch responses so client is up to date.
@@ -3742,7 +4032,8 @@ func (c *conn) cmdxStore(isUID bool, tag, cmd string, p *parser) {
 				origFlags := m.Flags
 				m.Flags = m.Flags.Set(mask, flags)
 				oldKeywords := append([]string{}, m.Keywords...)
-				if minus {
+				if keepKeywords {
+				} else if minus {
 					m.Keywords, _ = store.RemoveKeywords(m.Keywords, keywords)
 				} else if plus {
 					m.Keywords, _ = store.MergeKeywords(m.Keywords, keywords)
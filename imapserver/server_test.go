@@ -16,6 +16,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/mjl-/bstore"
+
 	"github.com/mjl-/mox/imapclient"
 	"github.com/mjl-/mox/mlog"
 	"github.com/mjl-/mox/mox-"
@@ -429,6 +431,26 @@ func TestLogin(t *testing.T) {
 	tc.transactf("ok", "logout")
 }
 
+// Test login with an app password, only valid for IMAP.
+func TestLoginAppPassword(t *testing.T) {
+	tc := start(t)
+	defer tc.close()
+
+	var imapPassword, webapiPassword string
+	err := tc.account.DB.Write(ctxbg, func(tx *bstore.Tx) error {
+		var err error
+		_, imapPassword, err = store.AppPasswordAdd(tx, "imap", []string{store.AppProtocolIMAP}, time.Time{})
+		if err == nil {
+			_, webapiPassword, err = store.AppPasswordAdd(tx, "webapi", []string{store.AppProtocolWebAPI}, time.Time{})
+		}
+		return err
+	})
+	tcheck(t, err, "add app passwords")
+
+	tc.transactf("no", `login mjl@mox.example "%s"`, webapiPassword)
+	tc.transactf("ok", `login mjl@mox.example "%s"`, imapPassword)
+}
+
 // Test that commands don't work in the states they are not supposed to.
 func TestState(t *testing.T) {
 	tc := start(t)
@@ -0,0 +1,472 @@
+package imapserver
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/message"
+	"github.com/mjl-/mox/store"
+)
+
+// sortCriterion is a sort key for SORT, with optional REVERSE.
+type sortCriterion struct {
+	key     string // Upper case, e.g. ARRIVAL, DATE, FROM, SUBJECT, SIZE, CC, TO, DISPLAYFROM, DISPLAYTO.
+	reverse bool
+}
+
+// ../rfc/5256 ../rfc/5957
+func (p *parser) xsortCriteria() (l []sortCriterion) {
+	p.xtake("(")
+	for {
+		var sc sortCriterion
+		if p.take("REVERSE ") {
+			sc.reverse = true
+		}
+		sc.key = p.xtakelist("ARRIVAL", "CC", "DATE", "FROM", "SIZE", "SUBJECT", "TO", "DISPLAYFROM", "DISPLAYTO")
+		l = append(l, sc)
+		if p.take(")") {
+			return
+		}
+		p.xspace()
+	}
+}
+
+// Sort returns the matching messages, sorted by criteria. With RETURN options
+// (ESORT), the result is returned in an ESEARCH response, like a search.
+//
+// State: Selected
+func (c *conn) cmdxSort(isUID bool, tag, cmd string, p *parser) {
+	// Command: ../rfc/5256 ../rfc/5267 ../rfc/5957
+	// Syntax: ../rfc/5256 ../rfc/5267
+
+	// RETURN indicates ESORT. Unlike SEARCH, we still return a SORT response with IMAP4rev2.
+	eargs, save, partial := p.xsearchReturn(false)
+	p.xspace()
+	criteria := p.xsortCriteria()
+	p.xspace()
+	p.xsearchCharset() // Required for SORT.
+	p.xspace()
+	sk, bodySearch, textSearch := p.xsearchKeys()
+
+	// Even in case of error, we ensure search result is changed.
+	if save {
+		c.searchResult = []store.UID{}
+	}
+
+	var expungeIssued bool
+	var maxModSeq store.ModSeq
+	var uids []store.UID
+
+	// Note: we only hold the account rlock for verifying the mailbox at the start.
+	c.account.RLock()
+	runlock := c.account.RUnlock
+	// Note: in a defer because we replace it below.
+	defer func() {
+		runlock()
+	}()
+
+	c.xdbread(func(tx *bstore.Tx) {
+		c.xmailboxID(tx, c.mailboxID) // Validate.
+		runlock()
+		runlock = func() {}
+
+		uids, maxModSeq = c.xsearchUIDs(tx, *sk, bodySearch, textSearch, &expungeIssued)
+		uids = c.xsortUIDs(tx, uids, criteria, &expungeIssued)
+	})
+
+	if eargs == nil {
+		// SORT response is a single line, with all numbers. ../rfc/5256
+		var b strings.Builder
+		b.WriteString("* SORT")
+		for _, uid := range uids {
+			v := uint32(uid)
+			if !isUID {
+				v = uint32(c.xsequence(uid))
+			}
+			fmt.Fprintf(&b, " %d", v)
+		}
+		if sk.hasModseq() {
+			// ../rfc/7162:2557
+			fmt.Fprintf(&b, " (MODSEQ %d)", maxModSeq.Client())
+		}
+		c.bwritelinef("%s", b.String())
+	} else {
+		if save {
+			// The saved result is a set, we keep it in UID order. ../rfc/5182
+			c.searchResult = slices.Clone(uids)
+			slices.Sort(c.searchResult)
+			if sanityChecks {
+				checkUIDs(c.searchResult)
+			}
+		}
+
+		c.xsearchUpdateStart(tag, isUID, eargs, *sk, bodySearch, textSearch, criteria, uids)
+
+		c.writeEsearch(tag, isUID, eargs, partial, uids, sk.hasModseq(), maxModSeq)
+	}
+
+	if expungeIssued {
+		// ../rfc/9051:5102
+		c.writeresultf("%s OK [EXPUNGEISSUED] done", tag)
+	} else {
+		c.ok(tag, cmd)
+	}
+}
+
+// sortMessage holds a message with its sort keys, for SORT and THREAD.
+type sortMessage struct {
+	seq  int // Index in session, tie-breaker for messages that compare equal.
+	m    store.Message
+	env  *message.Envelope // Parsed on first use, empty if message has no envelope.
+	keys map[string]any
+}
+
+// date returns the sent date, falling back to the received date if the message
+// has no valid date. ../rfc/5256
+func (sm *sortMessage) date() time.Time {
+	if env := sm.envelope(); !env.Date.IsZero() {
+		return env.Date
+	}
+	return sm.m.Received
+}
+
+func (sm *sortMessage) envelope() *message.Envelope {
+	if sm.env != nil {
+		return sm.env
+	}
+	sm.env = &message.Envelope{}
+	if sm.m.ParsedBuf != nil {
+		if p, err := sm.m.LoadPart(nil); err == nil && p.Envelope != nil {
+			sm.env = p.Envelope
+		}
+	}
+	return sm.env
+}
+
+// key returns the value to compare for a sort key, calculating it on first use.
+func (sm *sortMessage) key(k string) any {
+	if v, ok := sm.keys[k]; ok {
+		return v
+	}
+
+	// Address comparisons are on the localpart of the first address, with
+	// i;ascii-casemap collation. ../rfc/5256
+	firstAddr := func(l []message.Address) string {
+		if len(l) == 0 {
+			return ""
+		}
+		return strings.ToUpper(l[0].User)
+	}
+
+	// Display name if present, otherwise the address. ../rfc/5957
+	firstDisplay := func(l []message.Address) string {
+		if len(l) == 0 {
+			return ""
+		}
+		s := l[0].Name
+		if s == "" {
+			s = l[0].User + "@" + l[0].Host
+		}
+		return strings.ToUpper(s)
+	}
+
+	var v any
+	switch k {
+	case "ARRIVAL":
+		v = sm.m.Received
+	case "DATE":
+		v = sm.date()
+	case "SIZE":
+		v = sm.m.Size
+	case "SUBJECT":
+		// Base subject, like for threading. Not from SubjectBase, which is a hash for
+		// accounts with encryption. ../rfc/5256
+		subject, _ := message.ThreadSubject(sm.envelope().Subject, false)
+		v = strings.ToUpper(subject)
+	case "FROM":
+		v = firstAddr(sm.envelope().From)
+	case "TO":
+		v = firstAddr(sm.envelope().To)
+	case "CC":
+		v = firstAddr(sm.envelope().CC)
+	case "DISPLAYFROM":
+		v = firstDisplay(sm.envelope().From)
+	case "DISPLAYTO":
+		v = firstDisplay(sm.envelope().To)
+	default:
+		panic("unknown sort key " + k)
+	}
+	if sm.keys == nil {
+		sm.keys = map[string]any{}
+	}
+	sm.keys[k] = v
+	return v
+}
+
+func compareSortKeys(a, b any) int {
+	switch va := a.(type) {
+	case time.Time:
+		return va.Compare(b.(time.Time))
+	case int64:
+		vb := b.(int64)
+		if va < vb {
+			return -1
+		} else if va > vb {
+			return 1
+		}
+		return 0
+	case string:
+		return strings.Compare(va, b.(string))
+	}
+	panic(fmt.Sprintf("unknown sort key type %T", a))
+}
+
+// xsortMessages loads the messages for uids, which must be in session order. If
+// a message is no longer present, expungeIssued is set and it is skipped.
+func (c *conn) xsortMessages(tx *bstore.Tx, uids []store.UID, expungeIssued *bool) []*sortMessage {
+	if len(uids) == 0 {
+		return nil
+	}
+
+	uidArgs := make([]any, len(uids))
+	for i, uid := range uids {
+		uidArgs[i] = uid
+	}
+	byUID := map[store.UID]store.Message{}
+	q := bstore.QueryTx[store.Message](tx)
+	q.FilterNonzero(store.Message{MailboxID: c.mailboxID})
+	q.FilterEqual("UID", uidArgs...)
+	q.FilterEqual("Expunged", false)
+	err := q.ForEach(func(m store.Message) error {
+		byUID[m.UID] = m
+		return nil
+	})
+	xcheckf(err, "looking up messages")
+
+	l := make([]*sortMessage, 0, len(uids))
+	for _, uid := range uids {
+		m, ok := byUID[uid]
+		if !ok {
+			// ../rfc/2180:607
+			*expungeIssued = true
+			continue
+		}
+		l = append(l, &sortMessage{seq: int(c.xsequence(uid)), m: m})
+	}
+	return l
+}
+
+// xsortUIDs returns uids sorted by criteria. Messages that compare equal are kept
+// in session order. ../rfc/5256
+func (c *conn) xsortUIDs(tx *bstore.Tx, uids []store.UID, criteria []sortCriterion, expungeIssued *bool) []store.UID {
+	msgs := c.xsortMessages(tx, uids, expungeIssued)
+	slices.SortFunc(msgs, func(a, b *sortMessage) int {
+		for _, sc := range criteria {
+			r := compareSortKeys(a.key(sc.key), b.key(sc.key))
+			if sc.reverse {
+				r = -r
+			}
+			if r != 0 {
+				return r
+			}
+		}
+		return a.seq - b.seq
+	})
+	l := make([]store.UID, len(msgs))
+	for i, sm := range msgs {
+		l[i] = sm.m.UID
+	}
+	return l
+}
+
+// threadNode is a message in a thread response. Dummy nodes have a nil msg, they
+// have at least two children.
+type threadNode struct {
+	msg      *sortMessage
+	children []*threadNode
+}
+
+// date is the date used for sorting threads and siblings. For dummy nodes, it is
+// the date of the first child. ../rfc/5256
+func (n *threadNode) date() (time.Time, int) {
+	if n.msg == nil {
+		return n.children[0].date()
+	}
+	return n.msg.date(), n.msg.seq
+}
+
+// sortThreadNodes sorts nodes (recursively) by sent date, and session order for
+// messages with the same date.
+func sortThreadNodes(l []*threadNode) {
+	for _, n := range l {
+		sortThreadNodes(n.children)
+	}
+	slices.SortFunc(l, func(a, b *threadNode) int {
+		da, sa := a.date()
+		db, sb := b.date()
+		if r := da.Compare(db); r != 0 {
+			return r
+		}
+		return sa - sb
+	})
+}
+
+// Thread returns the matching messages as threads, with either the ORDEREDSUBJECT
+// or REFERENCES algorithm.
+//
+// State: Selected
+func (c *conn) cmdxThread(isUID bool, tag, cmd string, p *parser) {
+	// Command: ../rfc/5256
+	// Syntax: ../rfc/5256
+
+	p.xspace()
+	algorithm := p.xtakelist("ORDEREDSUBJECT", "REFERENCES")
+	p.xspace()
+	p.xsearchCharset() // Required for THREAD.
+	p.xspace()
+	sk, bodySearch, textSearch := p.xsearchKeys()
+
+	var expungeIssued bool
+	var threads []*threadNode
+
+	// Note: we only hold the account rlock for verifying the mailbox at the start.
+	c.account.RLock()
+	runlock := c.account.RUnlock
+	// Note: in a defer because we replace it below.
+	defer func() {
+		runlock()
+	}()
+
+	c.xdbread(func(tx *bstore.Tx) {
+		c.xmailboxID(tx, c.mailboxID) // Validate.
+		runlock()
+		runlock = func() {}
+
+		uids, _ := c.xsearchUIDs(tx, *sk, bodySearch, textSearch, &expungeIssued)
+		msgs := c.xsortMessages(tx, uids, &expungeIssued)
+		if algorithm == "ORDEREDSUBJECT" {
+			threads = threadOrderedSubject(msgs)
+		} else {
+			threads = threadReferences(msgs)
+		}
+	})
+
+	// Each thread is a parenthesized list, starting with the root. A single child
+	// follows its parent, multiple children are each a parenthesized list. Dummy
+	// nodes have no number, only their children. ../rfc/5256
+	var b strings.Builder
+	var writeNode func(n *threadNode)
+	writeNode = func(n *threadNode) {
+		if n.msg != nil {
+			v := uint32(n.msg.m.UID)
+			if !isUID {
+				v = uint32(n.msg.seq)
+			}
+			fmt.Fprintf(&b, "%d", v)
+		}
+		if len(n.children) == 1 {
+			b.WriteString(" ")
+			writeNode(n.children[0])
+			return
+		}
+		if len(n.children) > 1 && n.msg != nil {
+			b.WriteString(" ")
+		}
+		for _, ch := range n.children {
+			b.WriteString("(")
+			writeNode(ch)
+			b.WriteString(")")
+		}
+	}
+	b.WriteString("* THREAD")
+	if len(threads) > 0 {
+		b.WriteString(" ")
+	}
+	for _, n := range threads {
+		b.WriteString("(")
+		writeNode(n)
+		b.WriteString(")")
+	}
+	c.bwritelinef("%s", b.String())
+
+	if expungeIssued {
+		// ../rfc/9051:5102
+		c.writeresultf("%s OK [EXPUNGEISSUED] done", tag)
+	} else {
+		c.ok(tag, cmd)
+	}
+}
+
+// threadOrderedSubject groups messages by base subject. The first message by
+// sent date is the parent of all other messages with that subject. ../rfc/5256
+func threadOrderedSubject(msgs []*sortMessage) []*threadNode {
+	var threads []*threadNode
+	bySubject := map[string]*threadNode{}
+	for _, sm := range msgs {
+		n := &threadNode{msg: sm}
+		if root, ok := bySubject[sm.m.SubjectBase]; ok {
+			root.children = append(root.children, n)
+		} else {
+			bySubject[sm.m.SubjectBase] = n
+			threads = append(threads, n)
+		}
+	}
+	// The root must be the earliest message, the others are its children.
+	for i, n := range threads {
+		l := append([]*threadNode{{msg: n.msg}}, n.children...)
+		sortThreadNodes(l)
+		l[0].children = l[1:]
+		threads[i] = l[0]
+	}
+	sortThreadNodes(threads)
+	return threads
+}
+
+// threadReferences builds threads from the thread information assigned to
+// messages on delivery, instead of recalculating it from the References and
+// In-Reply-To headers of all messages. A message becomes the child of its
+// nearest ancestor among the matching messages. Messages of the same thread
+// without such ancestor become siblings under a dummy root node, like the
+// REFERENCES algorithm does for messages referencing a missing common parent.
+// ../rfc/5256
+func threadReferences(msgs []*sortMessage) []*threadNode {
+	byID := map[int64]*threadNode{}
+	for _, sm := range msgs {
+		byID[sm.m.ID] = &threadNode{msg: sm}
+	}
+
+	var threadIDs []int64
+	roots := map[int64][]*threadNode{} // By ThreadID.
+	for _, sm := range msgs {
+		n := byID[sm.m.ID]
+		var parent *threadNode
+		for _, id := range sm.m.ThreadParentIDs {
+			if parent = byID[id]; parent != nil {
+				break
+			}
+		}
+		if parent != nil {
+			parent.children = append(parent.children, n)
+			continue
+		}
+		if _, ok := roots[sm.m.ThreadID]; !ok {
+			threadIDs = append(threadIDs, sm.m.ThreadID)
+		}
+		roots[sm.m.ThreadID] = append(roots[sm.m.ThreadID], n)
+	}
+
+	threads := make([]*threadNode, len(threadIDs))
+	for i, tid := range threadIDs {
+		if l := roots[tid]; len(l) == 1 {
+			threads[i] = l[0]
+		} else {
+			threads[i] = &threadNode{children: l}
+		}
+	}
+	sortThreadNodes(threads)
+	return threads
+}
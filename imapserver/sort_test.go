@@ -0,0 +1,216 @@
+package imapserver
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mjl-/mox/imapclient"
+)
+
+func sortMsg(date, from, to, subject, msgID, references, body string) string {
+	s := fmt.Sprintf("Date: %s\nFrom: %s\n", date, from)
+	if to != "" {
+		s += fmt.Sprintf("To: %s\n", to)
+	}
+	s += fmt.Sprintf("Subject: %s\nMessage-Id: %s\n", subject, msgID)
+	if references != "" {
+		refs := strings.Split(references, " ")
+		s += fmt.Sprintf("In-Reply-To: %s\nReferences: %s\n", refs[len(refs)-1], references)
+	}
+	s += "\n" + body + "\n"
+	return strings.ReplaceAll(s, "\n", "\r\n")
+}
+
+// esearchExt returns an ESEARCH extension with a parenthesized list, like for
+// ADDTO, REMOVEFROM and PARTIAL.
+func esearchExt(tag string, words ...string) imapclient.EsearchDataExt {
+	var comps []imapclient.TaggedExtComp
+	for _, w := range words {
+		comps = append(comps, imapclient.TaggedExtComp{String: w})
+	}
+	return imapclient.EsearchDataExt{Tag: tag, Value: imapclient.TaggedExtVal{Comp: &imapclient.TaggedExtComp{Comps: comps}}}
+}
+
+func TestSort(t *testing.T) {
+	tc := start(t)
+	defer tc.close()
+	tc.client.Login("mjl@mox.example", password0)
+	tc.client.Select("inbox")
+
+	uint32ptr := func(v uint32) *uint32 { return &v }
+
+	msgs := []struct {
+		received time.Time
+		msg      string
+	}{
+		{
+			time.Date(2022, 2, 3, 0, 0, 0, 0, time.UTC),
+			sortMsg("Mon, 3 Jan 2022 10:00:00 +0000", `"Zed" <alice@mox.example>`, "<bob@mox.example>", "hello", "<m1@mox.example>", "", strings.Repeat("x", 1000)),
+		},
+		{
+			time.Date(2022, 2, 1, 0, 0, 0, 0, time.UTC),
+			sortMsg("Sun, 2 Jan 2022 10:00:00 +0000", `"Alice B" <bob@mox.example>`, "<alice@mox.example>", "Re: hello", "<m2@mox.example>", "<m1@mox.example>", strings.Repeat("x", 500)),
+		},
+		{
+			time.Date(2022, 2, 2, 0, 0, 0, 0, time.UTC),
+			sortMsg("Sat, 1 Jan 2022 10:00:00 +0000", "<carol@mox.example>", "<xyz@mox.example>", "other", "<m3@mox.example>", "", strings.Repeat("x", 2000)),
+		},
+		{
+			time.Date(2022, 2, 4, 0, 0, 0, 0, time.UTC),
+			sortMsg("Tue, 4 Jan 2022 10:00:00 +0000", "<dave@mox.example>", "", "Re: hello", "<m4@mox.example>", "<m1@mox.example> <m2@mox.example>", "x"),
+		},
+	}
+	for _, m := range msgs {
+		tc.client.Append("inbox", nil, &m.received, []byte(m.msg))
+	}
+
+	tc.transactf("bad", "sort")
+	tc.transactf("bad", "sort (date)")               // Charset required.
+	tc.transactf("bad", "sort (bogus) utf-8 all")    // Unknown sort key.
+	tc.transactf("bad", "sort (reverse) utf-8 all")  // Missing sort key.
+	tc.transactf("bad", "sort () utf-8 all")         // Empty criteria.
+	tc.transactf("bad", "sort (date) utf-8")         // Missing search criteria.
+	tc.transactf("bad", "thread bogus utf-8 all")    // Unknown algorithm.
+	tc.transactf("bad", "thread references utf-8")   // Missing search criteria.
+	tc.transactf("no", "sort (date) iso-8859-2 all") // Unsupported charset.
+	tc.xcode("BADCHARSET")
+	tc.transactf("bad", "sort return (min update) (date) utf-8 all")
+
+	tc.transactf("ok", "sort (arrival) utf-8 all")
+	tc.xuntagged(imapclient.UntaggedSort{2, 3, 1, 4})
+	tc.transactf("ok", "sort (date) utf-8 all")
+	tc.xuntagged(imapclient.UntaggedSort{3, 2, 1, 4})
+	tc.transactf("ok", "sort (reverse date) utf-8 all")
+	tc.xuntagged(imapclient.UntaggedSort{4, 1, 2, 3})
+	tc.transactf("ok", "sort (from) utf-8 all")
+	tc.xuntagged(imapclient.UntaggedSort{1, 2, 3, 4})
+	tc.transactf("ok", "sort (reverse from) utf-8 all")
+	tc.xuntagged(imapclient.UntaggedSort{4, 3, 2, 1})
+	tc.transactf("ok", "sort (displayfrom) utf-8 all")
+	tc.xuntagged(imapclient.UntaggedSort{2, 3, 4, 1})
+	tc.transactf("ok", "sort (displayto) utf-8 all")
+	tc.xuntagged(imapclient.UntaggedSort{4, 2, 1, 3})
+	tc.transactf("ok", "sort (to) utf-8 all")
+	tc.xuntagged(imapclient.UntaggedSort{4, 2, 1, 3})
+	tc.transactf("ok", "sort (cc) utf-8 all") // All equal, session order.
+	tc.xuntagged(imapclient.UntaggedSort{1, 2, 3, 4})
+	tc.transactf("ok", "sort (size) utf-8 all")
+	tc.xuntagged(imapclient.UntaggedSort{4, 2, 1, 3})
+	tc.transactf("ok", "sort (subject) utf-8 all")
+	tc.xuntagged(imapclient.UntaggedSort{1, 2, 4, 3})
+	tc.transactf("ok", "sort (subject reverse date) utf-8 all")
+	tc.xuntagged(imapclient.UntaggedSort{4, 1, 2, 3})
+	tc.transactf("ok", "sort (date) utf-8 subject hello")
+	tc.xuntagged(imapclient.UntaggedSort{2, 1, 4})
+	tc.transactf("ok", "uid sort (date) us-ascii 2:4")
+	tc.xuntagged(imapclient.UntaggedSort{3, 2, 4})
+	tc.transactf("ok", "sort (date) utf-8 subject nothing")
+	tc.xuntagged(imapclient.UntaggedSort(nil))
+
+	// ESORT.
+	tc.transactf("ok", "sort return (min max count all) (date) utf-8 all")
+	tc.xesearch(imapclient.UntaggedEsearch{Min: 3, Max: 4, Count: uint32ptr(4), All: esearchall0("3,2,1,4")})
+	tc.transactf("ok", "uid sort return () (reverse date) utf-8 all")
+	tc.xesearch(imapclient.UntaggedEsearch{UID: true, All: esearchall0("4,1:3")})
+	tc.transactf("ok", "sort return (partial 2:3) (date) utf-8 all")
+	tc.xesearch(imapclient.UntaggedEsearch{Exts: []imapclient.EsearchDataExt{esearchExt("PARTIAL", "2:3", "2,1")}})
+	tc.transactf("ok", "sort return (partial 5:10) (date) utf-8 all")
+	tc.xesearch(imapclient.UntaggedEsearch{Exts: []imapclient.EsearchDataExt{esearchExt("PARTIAL", "5:10", "NIL")}})
+	tc.transactf("ok", "search return (partial 1:2) all")
+	tc.xesearch(imapclient.UntaggedEsearch{Exts: []imapclient.EsearchDataExt{esearchExt("PARTIAL", "1:2", "1:2")}})
+
+	// SAVE keeps the result as set.
+	tc.transactf("ok", "sort return (save) (reverse date) utf-8 subject hello")
+	tc.xuntagged()
+	tc.transactf("ok", "search $")
+	tc.xsearch(1, 2, 4)
+
+	// Threads.
+	tc.client.Append("inbox", nil, nil, []byte(sortMsg("Wed, 5 Jan 2022 10:00:00 +0000", "<erin@mox.example>", "", "Re: hello", "<m5@mox.example>", "<m1@mox.example>", "x")))
+
+	thread := func(nodes ...imapclient.ThreadNode) imapclient.UntaggedThread {
+		return imapclient.UntaggedThread(nodes)
+	}
+	node := func(num uint32, children ...imapclient.ThreadNode) imapclient.ThreadNode {
+		return imapclient.ThreadNode{Number: num, Children: children}
+	}
+
+	tc.transactf("ok", "thread references utf-8 all")
+	tc.xuntagged(thread(node(3), node(1, node(2, node(4)), node(5))))
+	tc.transactf("ok", "uid thread references utf-8 all")
+	tc.xuntagged(thread(node(3), node(1, node(2, node(4)), node(5))))
+	tc.transactf("ok", "thread references utf-8 not 2")
+	tc.xuntagged(thread(node(3), node(1, node(4), node(5))))
+	// Without their common parent, 2 and 5 are siblings under a dummy.
+	tc.transactf("ok", "thread references utf-8 2:5")
+	tc.xuntagged(thread(node(3), node(0, node(2, node(4)), node(5))))
+	tc.transactf("ok", "thread orderedsubject utf-8 all")
+	tc.xuntagged(thread(node(3), node(2, node(1), node(4), node(5))))
+	tc.transactf("ok", "thread orderedsubject utf-8 subject nothing")
+	tc.xuntagged(thread())
+}
+
+func TestSortUpdate(t *testing.T) {
+	tc := start(t)
+	defer tc.close()
+	tc.client.Login("mjl@mox.example", password0)
+	tc.client.Select("inbox")
+
+	uint32ptr := func(v uint32) *uint32 { return &v }
+
+	tc2 := startNoSwitchboard(t)
+	defer tc2.close()
+	tc2.client.Login("mjl@mox.example", password0)
+	tc2.client.Select("inbox")
+
+	tc.client.Append("inbox", nil, nil, []byte(sortMsg("Mon, 3 Jan 2022 10:00:00 +0000", "<alice@mox.example>", "", "hello", "<m1@mox.example>", "", "x")))
+	tc.client.Append("inbox", nil, nil, []byte(sortMsg("Tue, 4 Jan 2022 10:00:00 +0000", "<bob@mox.example>", "", "hello", "<m2@mox.example>", "", "x")))
+	tc2.transactf("ok", "noop")
+
+	tc.transactf("ok", "uid sort return (update) (date) utf-8 subject hello")
+	sortTag := tc.client.LastTag
+	tc.xesearch(imapclient.UntaggedEsearch{UID: true, All: esearchall0("1:2")})
+
+	tc.transactf("ok", "uid search return (update count) unseen")
+	searchTag := tc.client.LastTag
+	tc.xesearch(imapclient.UntaggedEsearch{UID: true, Count: uint32ptr(2)})
+
+	// New message sorts first.
+	tc2.client.Append("inbox", nil, nil, []byte(sortMsg("Sun, 2 Jan 2022 10:00:00 +0000", "<carol@mox.example>", "", "hello", "<m3@mox.example>", "", "x")))
+	tc.transactf("ok", "noop")
+	tc.xuntagged(
+		imapclient.UntaggedExists(3),
+		imapclient.UntaggedFetch{Seq: 3, Attrs: []imapclient.FetchAttr{imapclient.FetchUID(3), imapclient.FetchFlags(nil)}},
+		imapclient.UntaggedEsearch{Correlator: sortTag, UID: true, Exts: []imapclient.EsearchDataExt{esearchExt("ADDTO", "1", "3")}},
+		imapclient.UntaggedEsearch{Correlator: searchTag, UID: true, Exts: []imapclient.EsearchDataExt{esearchExt("ADDTO", "0", "3")}},
+	)
+
+	// Flag change removes from search result.
+	tc2.transactf("ok", "store 1 +flags (\\Seen)")
+	tc.transactf("ok", "noop")
+	tc.xuntagged(
+		imapclient.UntaggedFetch{Seq: 1, Attrs: []imapclient.FetchAttr{imapclient.FetchUID(1), imapclient.FetchFlags{`\Seen`}}},
+		imapclient.UntaggedEsearch{Correlator: searchTag, UID: true, Exts: []imapclient.EsearchDataExt{esearchExt("REMOVEFROM", "0", "1")}},
+	)
+
+	// Expunges are not repeated as REMOVEFROM.
+	tc2.transactf("ok", "store 2 +flags (\\Deleted)")
+	tc2.transactf("ok", "expunge")
+	tc.transactf("ok", "noop")
+	tc.xuntagged(
+		imapclient.UntaggedFetch{Seq: 2, Attrs: []imapclient.FetchAttr{imapclient.FetchUID(2), imapclient.FetchFlags{`\Deleted`}}},
+		imapclient.UntaggedExpunge(2),
+	)
+
+	// No more updates after cancelupdate.
+	tc.transactf("bad", "cancelupdate")
+	tc.transactf("ok", `cancelupdate "%s" "%s"`, sortTag, searchTag)
+	tc2.client.Append("inbox", nil, nil, []byte(sortMsg("Sun, 2 Jan 2022 10:00:00 +0000", "<carol@mox.example>", "", "hello", "<m4@mox.example>", "", "x")))
+	tc.transactf("ok", "noop")
+	tc.xuntagged(
+		imapclient.UntaggedExists(3),
+		imapclient.UntaggedFetch{Seq: 3, Attrs: []imapclient.FetchAttr{imapclient.FetchUID(4), imapclient.FetchFlags(nil)}},
+	)
+}
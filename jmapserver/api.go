@@ -0,0 +1,706 @@
+package jmapserver
+
+import (
+	"bytes"
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/metrics"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/moxio"
+	"github.com/mjl-/mox/store"
+)
+
+// request is a JMAP API request. ../rfc/8620:870
+type request struct {
+	Using       []string          `json:"using"`
+	MethodCalls []invocation      `json:"methodCalls"`
+	CreatedIDs  map[string]string `json:"createdIds"`
+}
+
+// invocation is a method call, or a method response. In JSON, an array of
+// three elements: name, arguments and call id. ../rfc/8620:840
+type invocation struct {
+	Name   string
+	Args   json.RawMessage
+	CallID string
+
+	value any // Generic parsed Args of responses, for evaluating result references.
+}
+
+func (inv *invocation) UnmarshalJSON(buf []byte) error {
+	var l []json.RawMessage
+	if err := json.Unmarshal(buf, &l); err != nil {
+		return err
+	}
+	if len(l) != 3 {
+		return fmt.Errorf("invocation must be an array with 3 elements, got %d", len(l))
+	}
+	if err := json.Unmarshal(l[0], &inv.Name); err != nil {
+		return fmt.Errorf("method name: %v", err)
+	}
+	var args map[string]json.RawMessage
+	if err := json.Unmarshal(l[1], &args); err != nil || args == nil {
+		return fmt.Errorf("arguments must be an object")
+	}
+	inv.Args = l[1]
+	if err := json.Unmarshal(l[2], &inv.CallID); err != nil {
+		return fmt.Errorf("method call id: %v", err)
+	}
+	return nil
+}
+
+func (inv invocation) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]any{inv.Name, inv.Args, inv.CallID})
+}
+
+// response is a JMAP API response. ../rfc/8620:930
+type response struct {
+	MethodResponses []invocation      `json:"methodResponses"`
+	CreatedIDs      map[string]string `json:"createdIds,omitempty"`
+	SessionState    string            `json:"sessionState"`
+}
+
+// methodError is a method-level error, returned as "error" response. ../rfc/8620:1305
+type methodError struct {
+	Type        string `json:"type"`
+	Description string `json:"description,omitempty"`
+}
+
+func (e methodError) Error() string {
+	if e.Description == "" {
+		return e.Type
+	}
+	return e.Type + ": " + e.Description
+}
+
+func xmethodErrorf(typ, format string, args ...any) {
+	panic(methodError{typ, fmt.Sprintf(format, args...)})
+}
+
+// setError is an error for a single object in a /set call. ../rfc/8620:2040
+type setError struct {
+	Type        string   `json:"type"`
+	Description string   `json:"description,omitempty"`
+	Properties  []string `json:"properties,omitempty"` // For invalidProperties.
+}
+
+func (e setError) Error() string {
+	if e.Description == "" {
+		return e.Type
+	}
+	return e.Type + ": " + e.Description
+}
+
+func xsetErrorf(typ, format string, args ...any) {
+	panic(setError{Type: typ, Description: fmt.Sprintf(format, args...)})
+}
+
+func xinvalidProperties(descr string, props ...string) {
+	panic(setError{Type: "invalidProperties", Description: descr, Properties: props})
+}
+
+// serverError is an unexpected error, returned to the client as serverFail.
+type serverError struct{ err error }
+
+func (e serverError) Error() string { return e.err.Error() }
+func (e serverError) Unwrap() error { return e.err }
+
+func xcheckf(err error, format string, args ...any) {
+	if err != nil {
+		panic(serverError{fmt.Errorf("%s: %w", fmt.Sprintf(format, args...), err)})
+	}
+}
+
+func xrandomID(n int) string {
+	buf := make([]byte, n)
+	x, err := cryptorand.Read(buf)
+	if err != nil {
+		panic("read random")
+	} else if x != n {
+		panic("short random read")
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// call is the state for executing the method calls of a single API request.
+type call struct {
+	ctx          context.Context
+	log          mlog.Log
+	s            server
+	r            *http.Request
+	acc          *store.Account
+	accountID    string
+	loginAddress string
+
+	using      []string
+	createdIDs map[string]string // Creation id (without "#") to id.
+	responses  []invocation      // Earlier responses, for result references.
+	extra      []invocation      // Additional responses for the current method call, e.g. implicit Email/set after EmailSubmission/set.
+	callID     string
+}
+
+type methodHandler struct {
+	Capability string
+	Fn         func(c *call, args json.RawMessage) any
+}
+
+var methods map[string]methodHandler
+
+func init() {
+	// Initialized in init to prevent initialization cycles.
+	methods = map[string]methodHandler{
+		"Core/echo": {capCore, func(c *call, args json.RawMessage) any { return args }},
+
+		"Mailbox/get":          {capMail, (*call).mailboxGet},
+		"Mailbox/changes":      {capMail, (*call).mailboxChanges},
+		"Mailbox/query":        {capMail, (*call).mailboxQuery},
+		"Mailbox/queryChanges": {capMail, (*call).queryChanges},
+		"Mailbox/set":          {capMail, (*call).mailboxSet},
+
+		"Thread/get":     {capMail, (*call).threadGet},
+		"Thread/changes": {capMail, (*call).threadChanges},
+
+		"Email/get":          {capMail, (*call).emailGet},
+		"Email/changes":      {capMail, (*call).emailChanges},
+		"Email/query":        {capMail, (*call).emailQuery},
+		"Email/queryChanges": {capMail, (*call).queryChanges},
+		"Email/set":          {capMail, (*call).emailSet},
+		"Email/import":       {capMail, (*call).emailImport},
+
+		"Identity/get":     {capSubmission, (*call).identityGet},
+		"Identity/changes": {capSubmission, (*call).identityChanges},
+
+		"EmailSubmission/get": {capSubmission, (*call).emailSubmissionGet},
+		"EmailSubmission/set": {capSubmission, (*call).emailSubmissionSet},
+	}
+}
+
+func (s server) serveAPI(log mlog.Log, w http.ResponseWriter, r *http.Request, acc *store.Account, loginAddress string) {
+	buf, err := io.ReadAll(io.LimitReader(r.Body, maxSizeRequest+1))
+	if err != nil {
+		metricRequests.WithLabelValues("api", "error").Inc()
+		http.Error(w, "400 - bad request - reading request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(buf) > maxSizeRequest {
+		metricRequests.WithLabelValues("api", "error").Inc()
+		writeProblem(log, w, http.StatusBadRequest, "urn:ietf:params:jmap:error:limit", "request too large, see maxSizeRequest")
+		return
+	}
+
+	// ../rfc/8620:1225
+	var req request
+	if !json.Valid(buf) {
+		metricRequests.WithLabelValues("api", "error").Inc()
+		writeProblem(log, w, http.StatusBadRequest, "urn:ietf:params:jmap:error:notJSON", "request is not valid json")
+		return
+	}
+	if err := json.Unmarshal(buf, &req); err != nil || req.Using == nil || req.MethodCalls == nil {
+		metricRequests.WithLabelValues("api", "error").Inc()
+		msg := "using and methodCalls are required"
+		if err != nil {
+			msg = err.Error()
+		}
+		writeProblem(log, w, http.StatusBadRequest, "urn:ietf:params:jmap:error:notRequest", msg)
+		return
+	}
+	for _, u := range req.Using {
+		if u != capCore && u != capMail && u != capSubmission {
+			metricRequests.WithLabelValues("api", "error").Inc()
+			writeProblem(log, w, http.StatusBadRequest, "urn:ietf:params:jmap:error:unknownCapability", fmt.Sprintf("unknown capability %q", u))
+			return
+		}
+	}
+	if len(req.MethodCalls) > maxCallsInRequest {
+		metricRequests.WithLabelValues("api", "error").Inc()
+		writeProblem(log, w, http.StatusBadRequest, "urn:ietf:params:jmap:error:limit", "too many method calls, see maxCallsInRequest")
+		return
+	}
+
+	c := &call{
+		ctx:          r.Context(),
+		log:          log,
+		s:            s,
+		r:            r,
+		acc:          acc,
+		accountID:    accountID(acc.Name),
+		loginAddress: loginAddress,
+		using:        req.Using,
+		createdIDs:   map[string]string{},
+	}
+	for k, v := range req.CreatedIDs {
+		c.createdIDs[k] = v
+	}
+
+	for _, inv := range req.MethodCalls {
+		c.execute(inv)
+	}
+
+	resp := response{
+		MethodResponses: c.responses,
+		SessionState:    s.session(r, acc, loginAddress).State,
+	}
+	if req.CreatedIDs != nil {
+		resp.CreatedIDs = c.createdIDs
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	err = enc.Encode(resp)
+	if err != nil && !moxio.IsClosed(err) {
+		log.Infox("writing api response", err)
+	}
+	metricRequests.WithLabelValues("api", "ok").Inc()
+}
+
+// execute runs a single method call, adding the response(s) to c.responses.
+func (c *call) execute(inv invocation) {
+	log := c.log.With(slog.String("method", inv.Name), slog.String("callid", inv.CallID))
+
+	c.callID = inv.CallID
+	c.extra = nil
+
+	addResponse := func(name string, v any) {
+		buf, err := json.Marshal(v)
+		if err != nil {
+			panic(fmt.Sprintf("marshal response: %v", err))
+		}
+		var gen any
+		err = json.Unmarshal(buf, &gen)
+		if err != nil {
+			panic(fmt.Sprintf("unmarshal response: %v", err))
+		}
+		c.responses = append(c.responses, invocation{name, buf, inv.CallID, gen})
+	}
+
+	defer func() {
+		x := recover()
+		if x == nil {
+			return
+		}
+		var merr methodError
+		if err, ok := x.(methodError); ok {
+			merr = err
+			log.Debugx("method error", err)
+		} else if err, ok := x.(serverError); ok {
+			log.Errorx("server error during method call", err)
+			merr = methodError{"serverFail", err.Error()}
+		} else {
+			log.Error("unhandled panic in jmap method call", slog.Any("x", x))
+			metrics.PanicInc(metrics.Jmapserver)
+			debug.PrintStack()
+			merr = methodError{"serverFail", "unhandled error"}
+		}
+		metricMethods.WithLabelValues(inv.Name, merr.Type).Inc()
+		addResponse("error", merr)
+	}()
+
+	mh, ok := methods[inv.Name]
+	if !ok || !slices.Contains(c.using, mh.Capability) {
+		xmethodErrorf("unknownMethod", "unknown method %q, or capability not in using", inv.Name)
+	}
+
+	args := c.xresolveReferences(inv.Args)
+	result := mh.Fn(c, args)
+	metricMethods.WithLabelValues(inv.Name, "ok").Inc()
+	addResponse(inv.Name, result)
+	for _, e := range c.extra {
+		addResponse(e.Name, e.value)
+	}
+}
+
+// resultReference references the result of an earlier method call in the same
+// request. ../rfc/8620:1010
+type resultReference struct {
+	ResultOf string `json:"resultOf"`
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+}
+
+// xresolveReferences replaces arguments starting with "#" with the result of
+// evaluating the result reference.
+func (c *call) xresolveReferences(args json.RawMessage) json.RawMessage {
+	var m map[string]json.RawMessage
+	err := json.Unmarshal(args, &m)
+	xcheckf(err, "parsing arguments")
+
+	var changed bool
+	for k, v := range m {
+		if !strings.HasPrefix(k, "#") {
+			continue
+		}
+		name := k[1:]
+		if _, ok := m[name]; ok {
+			xmethodErrorf("invalidArguments", "both %q and %q present", name, k)
+		}
+		var ref resultReference
+		dec := json.NewDecoder(bytes.NewReader(v))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&ref); err != nil {
+			xmethodErrorf("invalidResultReference", "parsing result reference %q: %v", k, err)
+		}
+		i := slices.IndexFunc(c.responses, func(inv invocation) bool { return inv.CallID == ref.ResultOf })
+		if i < 0 {
+			xmethodErrorf("invalidResultReference", "no response for call id %q", ref.ResultOf)
+		}
+		resp := c.responses[i]
+		if resp.Name != ref.Name {
+			xmethodErrorf("invalidResultReference", "response for call id %q is %q, not %q", ref.ResultOf, resp.Name, ref.Name)
+		}
+		result, err := evalPointer(resp.value, ref.Path)
+		if err != nil {
+			xmethodErrorf("invalidResultReference", "evaluating path %q: %v", ref.Path, err)
+		}
+		buf, err := json.Marshal(result)
+		xcheckf(err, "marshal result reference value")
+		delete(m, k)
+		m[name] = buf
+		changed = true
+	}
+	if !changed {
+		return args
+	}
+	buf, err := json.Marshal(m)
+	xcheckf(err, "marshal arguments")
+	return buf
+}
+
+// evalPointer evaluates a JSON pointer (RFC 6901) with the JMAP extension that
+// "*" maps over an array, flattening arrays in the results. ../rfc/8620:1035
+func evalPointer(v any, path string) (any, error) {
+	if path == "" {
+		return v, nil
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, errors.New("path must start with a slash")
+	}
+	path = path[1:]
+	token, rest, more := strings.Cut(path, "/")
+	token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	if more {
+		rest = "/" + rest
+	}
+
+	switch x := v.(type) {
+	case []any:
+		if token == "*" {
+			r := []any{}
+			for _, e := range x {
+				ev, err := evalPointer(e, rest)
+				if err != nil {
+					return nil, err
+				}
+				if l, ok := ev.([]any); ok {
+					r = append(r, l...)
+				} else {
+					r = append(r, ev)
+				}
+			}
+			return r, nil
+		}
+		i, err := strconv.ParseUint(token, 10, 31)
+		if err != nil || int(i) >= len(x) {
+			return nil, fmt.Errorf("bad index %q for array", token)
+		}
+		return evalPointer(x[i], rest)
+	case map[string]any:
+		e, ok := x[token]
+		if !ok {
+			return nil, fmt.Errorf("no key %q", token)
+		}
+		return evalPointer(e, rest)
+	}
+	return nil, fmt.Errorf("cannot evaluate %q on non-object non-array", token)
+}
+
+// xparseArgs parses the arguments into v, which must be a pointer to a struct.
+// Unknown arguments result in an invalidArguments error.
+func (c *call) xparseArgs(args json.RawMessage, v any) {
+	dec := json.NewDecoder(bytes.NewReader(args))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		xmethodErrorf("invalidArguments", "%v", err)
+	}
+}
+
+// xcheckAccount checks the accountId argument matches the authenticated account.
+func (c *call) xcheckAccount(accID string) {
+	if accID != c.accountID {
+		xmethodErrorf("accountNotFound", "unknown account id %q", accID)
+	}
+}
+
+// resolveID returns the id for a creation id reference ("#" followed by the
+// creation id), or id itself if not a reference.
+func (c *call) resolveID(id string) string {
+	if strings.HasPrefix(id, "#") {
+		if v, ok := c.createdIDs[id[1:]]; ok {
+			return v
+		}
+	}
+	return id
+}
+
+// xdbread runs fn in a read-only transaction.
+func (c *call) xdbread(fn func(tx *bstore.Tx)) {
+	err := c.acc.DB.Read(c.ctx, func(tx *bstore.Tx) error {
+		fn(tx)
+		return nil
+	})
+	xcheckf(err, "transaction")
+}
+
+// xdbwrite runs fn in a writable transaction.
+func (c *call) xdbwrite(fn func(tx *bstore.Tx)) {
+	err := c.acc.DB.Write(c.ctx, func(tx *bstore.Tx) error {
+		fn(tx)
+		return nil
+	})
+	xcheckf(err, "transaction")
+}
+
+// Ids of objects are a single letter for the type, followed by the database ID.
+func parseID(prefix byte, s string) (int64, bool) {
+	if len(s) < 2 || s[0] != prefix {
+		return 0, false
+	}
+	v, err := strconv.ParseInt(s[1:], 10, 64)
+	if err != nil || v <= 0 || s[1] == '0' {
+		return 0, false
+	}
+	return v, true
+}
+
+func mailboxID(id int64) string { return fmt.Sprintf("m%d", id) }
+func emailID(id int64) string   { return fmt.Sprintf("e%d", id) }
+func threadID(id int64) string  { return fmt.Sprintf("t%d", id) }
+
+// Blob ids for messages are "b" followed by the message id, optionally followed by
+// "_" and indices into the (nested) multipart subparts, each separated by "_".
+func blobID(msgID int64, path []int) string {
+	s := fmt.Sprintf("b%d", msgID)
+	for _, i := range path {
+		s += fmt.Sprintf("_%d", i)
+	}
+	return s
+}
+
+func parseBlobID(s string) (msgID int64, path []int, ok bool) {
+	t := strings.Split(s, "_")
+	msgID, ok = parseID('b', t[0])
+	if !ok {
+		return 0, nil, false
+	}
+	for _, e := range t[1:] {
+		v, err := strconv.ParseUint(e, 10, 16)
+		if err != nil || e != fmt.Sprintf("%d", v) {
+			return 0, nil, false
+		}
+		path = append(path, int(v))
+	}
+	return msgID, path, true
+}
+
+// queryChanges implements Mailbox/queryChanges and Email/queryChanges. We don't
+// keep the history of query results, so we cannot calculate changes.
+func (c *call) queryChanges(args json.RawMessage) any {
+	var req struct {
+		AccountID string `json:"accountId"`
+	}
+	var m map[string]json.RawMessage
+	err := json.Unmarshal(args, &m)
+	xcheckf(err, "parsing arguments")
+	if v, ok := m["accountId"]; ok {
+		err := json.Unmarshal(v, &req.AccountID)
+		if err != nil {
+			xmethodErrorf("invalidArguments", "parsing accountId: %v", err)
+		}
+	}
+	c.xcheckAccount(req.AccountID)
+	xmethodErrorf("cannotCalculateChanges", "query changes not supported, query again")
+	return nil
+}
+
+// changesResponse is the response for /changes methods. ../rfc/8620:1680
+type changesResponse struct {
+	AccountID      string   `json:"accountId"`
+	OldState       string   `json:"oldState"`
+	NewState       string   `json:"newState"`
+	HasMoreChanges bool     `json:"hasMoreChanges"`
+	Created        []string `json:"created"`
+	Updated        []string `json:"updated"`
+	Destroyed      []string `json:"destroyed"`
+}
+
+// changesArgs are the arguments for /changes methods.
+type changesArgs struct {
+	AccountID  string `json:"accountId"`
+	SinceState string `json:"sinceState"`
+	MaxChanges *int   `json:"maxChanges"`
+}
+
+// getArgs are the standard arguments for /get methods.
+type getArgs struct {
+	AccountID  string    `json:"accountId"`
+	IDs        *[]string `json:"ids"`
+	Properties *[]string `json:"properties"`
+}
+
+func (c *call) xcheckGetArgs(a getArgs) {
+	c.xcheckAccount(a.AccountID)
+	if a.IDs != nil && len(*a.IDs) > maxObjectsInGet {
+		xmethodErrorf("requestTooLarge", "too many ids, max %d", maxObjectsInGet)
+	}
+}
+
+// properties returns the requested properties, or the default properties if
+// none were specified. The "id" property is always included.
+func properties(l *[]string, defaults []string, known []string) []string {
+	if l == nil {
+		return defaults
+	}
+	var r []string
+	if !slices.Contains(*l, "id") {
+		r = append(r, "id")
+	}
+	for _, p := range *l {
+		if !slices.Contains(known, p) && !strings.HasPrefix(p, "header:") {
+			xmethodErrorf("invalidArguments", "unknown property %q", p)
+		}
+	}
+	return append(r, *l...)
+}
+
+// setArgs are the standard arguments for /set methods.
+type setArgs struct {
+	AccountID string                     `json:"accountId"`
+	IfInState *string                    `json:"ifInState"`
+	Create    map[string]json.RawMessage `json:"create"`
+	Update    map[string]json.RawMessage `json:"update"`
+	Destroy   []string                   `json:"destroy"`
+}
+
+func (c *call) xcheckSetArgs(a setArgs) {
+	c.xcheckAccount(a.AccountID)
+	if len(a.Create)+len(a.Update)+len(a.Destroy) > maxObjectsInSet {
+		xmethodErrorf("requestTooLarge", "too many objects, max %d", maxObjectsInSet)
+	}
+}
+
+// setResponse is the response for /set methods. ../rfc/8620:1990
+type setResponse struct {
+	AccountID    string              `json:"accountId"`
+	OldState     *string             `json:"oldState"`
+	NewState     string              `json:"newState"`
+	Created      map[string]any      `json:"created"`
+	Updated      map[string]any      `json:"updated"`
+	Destroyed    []string            `json:"destroyed"`
+	NotCreated   map[string]setError `json:"notCreated"`
+	NotUpdated   map[string]setError `json:"notUpdated"`
+	NotDestroyed map[string]setError `json:"notDestroyed"`
+}
+
+// trySet calls fn, returning a setError if fn panics with one. Other panics are
+// propagated.
+func trySet(fn func()) (rerr *setError) {
+	defer func() {
+		x := recover()
+		if x == nil {
+			return
+		}
+		if err, ok := x.(setError); ok {
+			rerr = &err
+			return
+		}
+		panic(x)
+	}()
+	fn()
+	return nil
+}
+
+// addNotCreated and similar functions add an error for an object to the response.
+func (r *setResponse) addNotCreated(id string, err setError) {
+	if r.NotCreated == nil {
+		r.NotCreated = map[string]setError{}
+	}
+	r.NotCreated[id] = err
+}
+
+func (r *setResponse) addNotUpdated(id string, err setError) {
+	if r.NotUpdated == nil {
+		r.NotUpdated = map[string]setError{}
+	}
+	r.NotUpdated[id] = err
+}
+
+func (r *setResponse) addNotDestroyed(id string, err setError) {
+	if r.NotDestroyed == nil {
+		r.NotDestroyed = map[string]setError{}
+	}
+	r.NotDestroyed[id] = err
+}
+
+func (r *setResponse) addCreated(id string, v any) {
+	if r.Created == nil {
+		r.Created = map[string]any{}
+	}
+	r.Created[id] = v
+}
+
+func (r *setResponse) addUpdated(id string, v any) {
+	if r.Updated == nil {
+		r.Updated = map[string]any{}
+	}
+	r.Updated[id] = v
+}
+
+// patch is a PatchObject, with paths to properties as keys. ../rfc/8620:1895
+type patch map[string]json.RawMessage
+
+// xparsePatch parses a patch object, returning for each top-level property either
+// the full replacement value or the changes for sub-paths.
+func xparsePatch(buf json.RawMessage) (full map[string]json.RawMessage, sub map[string]map[string]json.RawMessage) {
+	var p patch
+	if err := json.Unmarshal(buf, &p); err != nil || p == nil {
+		xsetErrorf("invalidPatch", "patch must be an object")
+	}
+	full = map[string]json.RawMessage{}
+	sub = map[string]map[string]json.RawMessage{}
+	for k, v := range p {
+		k = strings.TrimPrefix(k, "/")
+		prop, rest, ok := strings.Cut(k, "/")
+		rest = strings.ReplaceAll(strings.ReplaceAll(rest, "~1", "/"), "~0", "~")
+		if !ok {
+			if _, ok := sub[prop]; ok {
+				xsetErrorf("invalidPatch", "both full value and patch for property %q", prop)
+			}
+			full[prop] = v
+			continue
+		}
+		if _, ok := full[prop]; ok {
+			xsetErrorf("invalidPatch", "both full value and patch for property %q", prop)
+		}
+		if strings.Contains(rest, "/") {
+			xsetErrorf("invalidPatch", "patching of nested path %q not supported", k)
+		}
+		if sub[prop] == nil {
+			sub[prop] = map[string]json.RawMessage{}
+		}
+		sub[prop][rest] = v
+	}
+	return
+}
@@ -0,0 +1,1463 @@
+package jmapserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/mail"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/text/encoding/ianaindex"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/message"
+	"github.com/mjl-/mox/store"
+)
+
+var emailProperties = []string{
+	"id", "blobId", "threadId", "mailboxIds", "keywords", "size", "receivedAt",
+	"messageId", "inReplyTo", "references", "sender", "from", "to", "cc", "bcc", "replyTo", "subject", "sentAt",
+	"hasAttachment", "preview",
+	"bodyValues", "textBody", "htmlBody", "attachments",
+}
+
+var emailKnownProperties = append(slices.Clone(emailProperties), "headers", "bodyStructure")
+
+var bodyProperties = []string{"partId", "blobId", "size", "name", "type", "charset", "disposition", "cid", "language", "location"}
+
+var bodyKnownProperties = append(slices.Clone(bodyProperties), "headers", "subParts")
+
+// Properties emails can be sorted on in Email/query. ../rfc/8621:2480
+var emailSortProperties = []string{"receivedAt", "sentAt", "size", "subject", "from", "to", "hasKeyword"}
+
+var wordDecoder = mime.WordDecoder{
+	CharsetReader: func(charset string, r io.Reader) (io.Reader, error) {
+		switch strings.ToLower(charset) {
+		case "", "us-ascii", "utf-8":
+			return r, nil
+		}
+		enc, _ := ianaindex.MIME.Encoding(charset)
+		if enc == nil {
+			enc, _ = ianaindex.IANA.Encoding(charset)
+		}
+		if enc == nil {
+			return r, fmt.Errorf("unknown charset %q", charset)
+		}
+		return enc.NewDecoder().Reader(r), nil
+	},
+}
+
+// xemailState returns the state for emails and threads: the last modseq of the
+// account.
+func xemailState(tx *bstore.Tx) string {
+	ss := store.SyncState{ID: 1}
+	err := tx.Get(&ss)
+	if err == bstore.ErrAbsent {
+		return "0"
+	}
+	xcheckf(err, "get sync state")
+	return fmt.Sprintf("%d", ss.LastModSeq)
+}
+
+// xparseEmailState parses a state string as returned by xemailState, and checks if
+// changes since that state can be calculated.
+func xparseEmailState(tx *bstore.Tx, state string) store.ModSeq {
+	v, err := strconv.ParseInt(state, 10, 64)
+	if err != nil || v < 0 || state != fmt.Sprintf("%d", v) {
+		xmethodErrorf("cannotCalculateChanges", "invalid state")
+	}
+	since := store.ModSeq(v)
+	ss := store.SyncState{ID: 1}
+	err = tx.Get(&ss)
+	if err == bstore.ErrAbsent {
+		if since != 0 {
+			xmethodErrorf("cannotCalculateChanges", "unknown state")
+		}
+		return since
+	}
+	xcheckf(err, "get sync state")
+	if since < ss.HighestDeletedModSeq || since > ss.LastModSeq {
+		xmethodErrorf("cannotCalculateChanges", "state too old or unknown, resynchronize")
+	}
+	return since
+}
+
+// Keywords for system flags. Other keywords are stored as-is. ../rfc/8621:1025
+var flagKeywords = []struct {
+	keyword string
+	field   func(f *store.Flags) *bool
+}{
+	{"$seen", func(f *store.Flags) *bool { return &f.Seen }},
+	{"$answered", func(f *store.Flags) *bool { return &f.Answered }},
+	{"$flagged", func(f *store.Flags) *bool { return &f.Flagged }},
+	{"$draft", func(f *store.Flags) *bool { return &f.Draft }},
+	{"$forwarded", func(f *store.Flags) *bool { return &f.Forwarded }},
+	{"$junk", func(f *store.Flags) *bool { return &f.Junk }},
+	{"$notjunk", func(f *store.Flags) *bool { return &f.Notjunk }},
+	{"$phishing", func(f *store.Flags) *bool { return &f.Phishing }},
+	{"$mdnsent", func(f *store.Flags) *bool { return &f.MDNSent }},
+}
+
+// messageKeywords returns the JMAP keywords for a message. The \Deleted flag is
+// not exposed.
+func messageKeywords(m store.Message) map[string]bool {
+	r := map[string]bool{}
+	for _, fk := range flagKeywords {
+		if *fk.field(&m.Flags) {
+			r[fk.keyword] = true
+		}
+	}
+	for _, kw := range m.Keywords {
+		r[kw] = true
+	}
+	return r
+}
+
+// hasKeyword returns whether the message has the keyword, which must be in lower case.
+func hasKeyword(m store.Message, kw string) bool {
+	for _, fk := range flagKeywords {
+		if fk.keyword == kw {
+			return *fk.field(&m.Flags)
+		}
+	}
+	return slices.Contains(m.Keywords, kw)
+}
+
+// xsetKeywords sets flag or keyword kw on flags/keywords.
+func xsetKeyword(flags *store.Flags, keywords []string, kw string, set bool) []string {
+	kw = strings.ToLower(kw)
+	for _, fk := range flagKeywords {
+		if fk.keyword == kw {
+			*fk.field(flags) = set
+			return keywords
+		}
+	}
+	if err := store.CheckKeyword(kw); err != nil {
+		xinvalidProperties(fmt.Sprintf("bad keyword %q: %v", kw, err), "keywords")
+	}
+	if set {
+		keywords, _ = store.MergeKeywords(keywords, []string{kw})
+	} else {
+		keywords, _ = store.RemoveKeywords(keywords, []string{kw})
+	}
+	return keywords
+}
+
+// xparseKeywords parses a JMAP keywords object into flags and keywords.
+func xparseKeywords(buf json.RawMessage) (store.Flags, []string) {
+	var kws map[string]bool
+	if err := json.Unmarshal(buf, &kws); err != nil {
+		xinvalidProperties("keywords must be an object with true values", "keywords")
+	}
+	var flags store.Flags
+	var keywords []string
+	for kw, v := range kws {
+		if !v {
+			xinvalidProperties("keyword values must be true", "keywords")
+		}
+		keywords = xsetKeyword(&flags, keywords, kw, true)
+	}
+	return flags, keywords
+}
+
+// EmailAddress is an address in an email header. ../rfc/8621:1290
+type EmailAddress struct {
+	Name  *string `json:"name"`
+	Email string  `json:"email"`
+}
+
+func emailAddresses(l []message.Address) []EmailAddress {
+	if len(l) == 0 {
+		return nil
+	}
+	r := make([]EmailAddress, len(l))
+	for i, a := range l {
+		var name *string
+		if a.Name != "" {
+			name = &a.Name
+		}
+		email := a.User
+		if a.Host != "" {
+			email += "@" + a.Host
+		}
+		r[i] = EmailAddress{name, email}
+	}
+	return r
+}
+
+// headerField is a raw header field.
+type headerField struct {
+	Name  string `json:"name"`
+	Value string `json:"value"` // Raw, after the colon, including leading whitespace and folding.
+}
+
+// parseHeaderFields parses header fields from a message or part header section.
+// Malformed lines are skipped.
+func parseHeaderFields(r io.Reader) []headerField {
+	var l []headerField
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if line == "" && err != nil {
+			break
+		}
+		line = strings.TrimSuffix(line, "\n")
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" {
+			break
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(l) > 0 {
+				l[len(l)-1].Value += "\r\n" + line
+			}
+			continue
+		}
+		k, v, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		l = append(l, headerField{strings.TrimRight(k, " \t"), v})
+		if err != nil {
+			break
+		}
+	}
+	return l
+}
+
+func unfold(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "\r\n", ""), "\n", "")
+}
+
+// headerText returns the Text form of a header value. ../rfc/8621:1180
+func headerText(raw string) string {
+	s := strings.TrimSpace(unfold(raw))
+	if d, err := wordDecoder.DecodeHeader(s); err == nil {
+		s = d
+	}
+	return s
+}
+
+// headerAddresses returns the Addresses form of a header value.
+func headerAddresses(raw string) []EmailAddress {
+	p := mail.AddressParser{WordDecoder: &wordDecoder}
+	l, err := p.ParseList(unfold(raw))
+	if err != nil {
+		return []EmailAddress{}
+	}
+	r := make([]EmailAddress, len(l))
+	for i, a := range l {
+		var name *string
+		if a.Name != "" {
+			name = &a.Name
+		}
+		r[i] = EmailAddress{name, a.Address}
+	}
+	return r
+}
+
+// headerMessageIDs returns the MessageIds form of a header value, the message-ids
+// without <>. Nil if none could be found.
+func headerMessageIDs(raw string) []string {
+	var r []string
+	s := unfold(raw)
+	for {
+		i := strings.Index(s, "<")
+		if i < 0 {
+			break
+		}
+		j := strings.Index(s[i:], ">")
+		if j < 0 {
+			break
+		}
+		if id := strings.TrimSpace(s[i+1 : i+j]); id != "" {
+			r = append(r, id)
+		}
+		s = s[i+j+1:]
+	}
+	return r
+}
+
+// headerDate returns the Date form of a header value, nil if it cannot be parsed.
+func headerDate(raw string) *string {
+	t, err := mail.ParseDate(strings.TrimSpace(unfold(raw)))
+	if err != nil {
+		return nil
+	}
+	s := t.Format(time.RFC3339)
+	return &s
+}
+
+// headerURLs returns the URLs form of a header value.
+func headerURLs(raw string) []string {
+	return headerMessageIDs(raw)
+}
+
+// xheaderProperty parses a "header:" property into the header name, form and
+// whether all instances are requested. ../rfc/8621:1245
+func xheaderProperty(prop string) (name, form string, all bool) {
+	t := strings.Split(prop, ":")
+	if len(t) < 2 || len(t) > 4 || t[0] != "header" || t[1] == "" {
+		xmethodErrorf("invalidArguments", "bad header property %q", prop)
+	}
+	name = t[1]
+	form = "asRaw"
+	t = t[2:]
+	if len(t) > 0 && t[len(t)-1] == "all" {
+		all = true
+		t = t[:len(t)-1]
+	}
+	if len(t) == 1 {
+		form = t[0]
+	} else if len(t) > 1 {
+		xmethodErrorf("invalidArguments", "bad header property %q", prop)
+	}
+	switch form {
+	case "asRaw", "asText", "asAddresses", "asGroupedAddresses", "asMessageIds", "asDate", "asURLs":
+	default:
+		xmethodErrorf("invalidArguments", "unknown header form %q", form)
+	}
+	return
+}
+
+// headerValue returns the value for a "header:" property.
+func headerValue(fields []headerField, prop string) any {
+	name, form, all := xheaderProperty(prop)
+	conv := func(raw string) any {
+		switch form {
+		case "asText":
+			return headerText(raw)
+		case "asAddresses":
+			return headerAddresses(raw)
+		case "asGroupedAddresses":
+			return []any{map[string]any{"name": nil, "addresses": headerAddresses(raw)}}
+		case "asMessageIds":
+			return headerMessageIDs(raw)
+		case "asDate":
+			return headerDate(raw)
+		case "asURLs":
+			return headerURLs(raw)
+		}
+		return raw
+	}
+	var l []any
+	for _, f := range fields {
+		if strings.EqualFold(f.Name, name) {
+			l = append(l, conv(f.Value))
+		}
+	}
+	if all {
+		if l == nil {
+			return []any{}
+		}
+		return l
+	}
+	if len(l) == 0 {
+		return nil
+	}
+	return l[len(l)-1]
+}
+
+// firstHeader returns the raw value of the first header field with name, and
+// whether it was present.
+func firstHeader(fields []headerField, name string) (string, bool) {
+	for _, f := range fields {
+		if strings.EqualFold(f.Name, name) {
+			return f.Value, true
+		}
+	}
+	return "", false
+}
+
+// partID returns the JMAP partId for a path of subpart indices. The top-level part
+// is "0", subparts are numbered from 1, separated by dots, like in IMAP.
+func partID(path []int) string {
+	if len(path) == 0 {
+		return "0"
+	}
+	var l []string
+	for _, i := range path {
+		l = append(l, fmt.Sprintf("%d", i+1))
+	}
+	return strings.Join(l, ".")
+}
+
+// partType returns the lower-case media type of a part, defaulting to text/plain.
+func partType(p *message.Part) string {
+	if p.MediaType == "" {
+		return "text/plain"
+	}
+	return strings.ToLower(p.MediaType + "/" + p.MediaSubType)
+}
+
+// bodyPart gathers information about a message part for EmailBodyPart objects.
+type bodyPart struct {
+	Path        []int
+	Part        *message.Part
+	Fields      []headerField
+	Disposition string // Lower case, without parameters.
+	Name        string
+}
+
+func newBodyPart(p *message.Part, path []int) bodyPart {
+	bp := bodyPart{Path: path, Part: p, Fields: parseHeaderFields(p.HeaderReader())}
+	if cd, ok := firstHeader(bp.Fields, "Content-Disposition"); ok {
+		disp, params, err := mime.ParseMediaType(headerText(cd))
+		if err == nil {
+			bp.Disposition = strings.ToLower(disp)
+			bp.Name = params["filename"]
+		} else {
+			bp.Disposition = strings.ToLower(strings.TrimSpace(strings.SplitN(headerText(cd), ";", 2)[0]))
+		}
+	}
+	if bp.Name == "" {
+		bp.Name = p.ContentTypeParams["name"]
+	}
+	if bp.Name != "" {
+		if s, err := wordDecoder.DecodeHeader(bp.Name); err == nil {
+			bp.Name = s
+		}
+	}
+	return bp
+}
+
+// object returns the EmailBodyPart object. ../rfc/8621:1390
+func (bp bodyPart) object(msgID int64, props []string) map[string]any {
+	p := bp.Part
+	isMultipart := p.MediaType == "MULTIPART"
+	o := map[string]any{}
+	for _, prop := range props {
+		switch prop {
+		case "partId":
+			if isMultipart {
+				o[prop] = nil
+			} else {
+				o[prop] = partID(bp.Path)
+			}
+		case "blobId":
+			if isMultipart {
+				o[prop] = nil
+			} else {
+				o[prop] = blobID(msgID, bp.Path)
+			}
+		case "size":
+			if isMultipart {
+				o[prop] = 0
+			} else {
+				o[prop] = p.DecodedSize
+			}
+		case "headers":
+			l := bp.Fields
+			if l == nil {
+				l = []headerField{}
+			}
+			o[prop] = l
+		case "name":
+			if bp.Name == "" {
+				o[prop] = nil
+			} else {
+				o[prop] = bp.Name
+			}
+		case "type":
+			o[prop] = partType(p)
+		case "charset":
+			if cs, ok := p.ContentTypeParams["charset"]; ok {
+				o[prop] = cs
+			} else if p.MediaType == "TEXT" || p.MediaType == "" {
+				o[prop] = "us-ascii"
+			} else {
+				o[prop] = nil
+			}
+		case "disposition":
+			if bp.Disposition == "" {
+				o[prop] = nil
+			} else {
+				o[prop] = bp.Disposition
+			}
+		case "cid":
+			if p.ContentID == "" {
+				o[prop] = nil
+			} else {
+				o[prop] = strings.TrimSuffix(strings.TrimPrefix(p.ContentID, "<"), ">")
+			}
+		case "language":
+			if v, ok := firstHeader(bp.Fields, "Content-Language"); ok {
+				var l []string
+				for _, s := range strings.Split(headerText(v), ",") {
+					if s = strings.TrimSpace(s); s != "" {
+						l = append(l, s)
+					}
+				}
+				o[prop] = l
+			} else {
+				o[prop] = nil
+			}
+		case "location":
+			if v, ok := firstHeader(bp.Fields, "Content-Location"); ok {
+				o[prop] = headerText(v)
+			} else {
+				o[prop] = nil
+			}
+		case "subParts":
+			if !isMultipart {
+				continue
+			}
+			l := []map[string]any{}
+			for i := range p.Parts {
+				sbp := newBodyPart(&p.Parts[i], append(slices.Clone(bp.Path), i))
+				l = append(l, sbp.object(msgID, props))
+			}
+			o[prop] = l
+		default:
+			if strings.HasPrefix(prop, "header:") {
+				o[prop] = headerValue(bp.Fields, prop)
+			}
+		}
+	}
+	return o
+}
+
+// parseStructure determines the textBody, htmlBody and attachments for a message,
+// following the algorithm from the RFC. ../rfc/8621:1540
+func parseStructure(root *message.Part) (textBody, htmlBody, attachments []bodyPart) {
+	isInlineMediaType := func(t string) bool {
+		return strings.HasPrefix(t, "image/") || strings.HasPrefix(t, "audio/") || strings.HasPrefix(t, "video/")
+	}
+
+	var parse func(parts []bodyPart, multipartType string, inAlternative bool, htmlBody, textBody, attachments *[]bodyPart)
+	parse = func(parts []bodyPart, multipartType string, inAlternative bool, htmlBody, textBody, attachments *[]bodyPart) {
+		textLength := -1
+		htmlLength := -1
+		if textBody != nil {
+			textLength = len(*textBody)
+		}
+		if htmlBody != nil {
+			htmlLength = len(*htmlBody)
+		}
+
+		for i, bp := range parts {
+			p := bp.Part
+			isMultipart := p.MediaType == "MULTIPART"
+			typ := partType(p)
+			isInline := bp.Disposition != "attachment" &&
+				(typ == "text/plain" || typ == "text/html" || isInlineMediaType(typ)) &&
+				(i == 0 || multipartType != "related" && (isInlineMediaType(typ) || bp.Name == ""))
+
+			if isMultipart {
+				var subParts []bodyPart
+				for j := range p.Parts {
+					subParts = append(subParts, newBodyPart(&p.Parts[j], append(slices.Clone(bp.Path), j)))
+				}
+				sub := strings.ToLower(p.MediaSubType)
+				parse(subParts, sub, inAlternative || sub == "alternative", htmlBody, textBody, attachments)
+			} else if isInline {
+				if multipartType == "alternative" {
+					switch typ {
+					case "text/plain":
+						if textBody != nil {
+							*textBody = append(*textBody, bp)
+						}
+					case "text/html":
+						if htmlBody != nil {
+							*htmlBody = append(*htmlBody, bp)
+						}
+					default:
+						*attachments = append(*attachments, bp)
+					}
+					continue
+				} else if inAlternative {
+					if typ == "text/plain" {
+						htmlBody = nil
+					}
+					if typ == "text/html" {
+						textBody = nil
+					}
+				}
+				if textBody != nil {
+					*textBody = append(*textBody, bp)
+				}
+				if htmlBody != nil {
+					*htmlBody = append(*htmlBody, bp)
+				}
+				if (textBody == nil || htmlBody == nil) && isInlineMediaType(typ) {
+					*attachments = append(*attachments, bp)
+				}
+			} else {
+				*attachments = append(*attachments, bp)
+			}
+		}
+
+		if multipartType == "alternative" && textBody != nil && htmlBody != nil {
+			// Found HTML part only, use it for text too.
+			if textLength == len(*textBody) && htmlLength != len(*htmlBody) {
+				*textBody = append(*textBody, (*htmlBody)[htmlLength:]...)
+			}
+			// Found plain text part only, use it for html too.
+			if htmlLength == len(*htmlBody) && textLength != len(*textBody) {
+				*htmlBody = append(*htmlBody, (*textBody)[textLength:]...)
+			}
+		}
+	}
+
+	textBody = []bodyPart{}
+	htmlBody = []bodyPart{}
+	attachments = []bodyPart{}
+	parse([]bodyPart{newBodyPart(root, nil)}, "mixed", false, &htmlBody, &textBody, &attachments)
+	return
+}
+
+// bodyValue is an EmailBodyValue. ../rfc/8621:1500
+type bodyValue struct {
+	Value             string `json:"value"`
+	IsEncodingProblem bool   `json:"isEncodingProblem"`
+	IsTruncated       bool   `json:"isTruncated"`
+}
+
+func readBodyValue(p *message.Part, maxBytes int) bodyValue {
+	var bv bodyValue
+	r := p.ReaderUTF8OrBinary()
+	var buf []byte
+	var err error
+	if maxBytes > 0 {
+		buf, err = io.ReadAll(io.LimitReader(r, int64(maxBytes)+1))
+		if len(buf) > maxBytes {
+			buf = buf[:maxBytes]
+			// Don't cut in the middle of a UTF-8 sequence.
+			for len(buf) > 0 && buf[len(buf)-1]&0xc0 == 0x80 {
+				buf = buf[:len(buf)-1]
+			}
+			if len(buf) > 0 && buf[len(buf)-1]&0x80 != 0 {
+				buf = buf[:len(buf)-1]
+			}
+			bv.IsTruncated = true
+		}
+	} else {
+		buf, err = io.ReadAll(r)
+	}
+	if err != nil {
+		bv.IsEncodingProblem = true
+	}
+	bv.Value = strings.ReplaceAll(string(buf), "\r\n", "\n")
+	return bv
+}
+
+// preview returns a short plain text preview of the message. ../rfc/8621:1480
+func preview(textBody []bodyPart) string {
+	for _, bp := range textBody {
+		typ := partType(bp.Part)
+		if typ != "text/plain" && typ != "text/html" {
+			continue
+		}
+		buf, _ := io.ReadAll(io.LimitReader(bp.Part.ReaderUTF8OrBinary(), 4*1024))
+		s := string(buf)
+		if typ == "text/html" {
+			s = stripHTML(s)
+		}
+		s = strings.Join(strings.FieldsFunc(s, unicode.IsSpace), " ")
+		if r := []rune(s); len(r) > 256 {
+			s = string(r[:256])
+		}
+		return s
+	}
+	return ""
+}
+
+// stripHTML removes tags from html, for a preview.
+func stripHTML(s string) string {
+	var b strings.Builder
+	intag := false
+	for _, c := range s {
+		switch {
+		case c == '<':
+			intag = true
+		case c == '>' && intag:
+			intag = false
+			b.WriteByte(' ')
+		case !intag:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// emailGetArgs are the arguments for Email/get. ../rfc/8621:1745
+type emailGetArgs struct {
+	getArgs
+	BodyProperties      *[]string `json:"bodyProperties"`
+	FetchTextBodyValues bool      `json:"fetchTextBodyValues"`
+	FetchHTMLBodyValues bool      `json:"fetchHTMLBodyValues"`
+	FetchAllBodyValues  bool      `json:"fetchAllBodyValues"`
+	MaxBodyValueBytes   int       `json:"maxBodyValueBytes"`
+}
+
+// emailObject returns the Email object for a message with the requested properties.
+func (c *call) xemailObject(m store.Message, req emailGetArgs, props, bodyProps []string) map[string]any {
+	o := map[string]any{}
+
+	// Properties that don't require the message structure.
+	var needPart bool
+	for _, prop := range props {
+		switch prop {
+		case "id":
+			o[prop] = emailID(m.ID)
+		case "blobId":
+			o[prop] = blobID(m.ID, nil)
+		case "threadId":
+			tid := m.ThreadID
+			if tid == 0 {
+				tid = m.ID
+			}
+			o[prop] = threadID(tid)
+		case "mailboxIds":
+			o[prop] = map[string]bool{mailboxID(m.MailboxID): true}
+		case "keywords":
+			o[prop] = messageKeywords(m)
+		case "size":
+			o[prop] = m.Size
+		case "receivedAt":
+			o[prop] = m.Received.UTC().Format(time.RFC3339)
+		default:
+			needPart = true
+		}
+	}
+	if !needPart {
+		return o
+	}
+
+	mr := c.acc.MessageReader(m)
+	defer func() {
+		err := mr.Close()
+		c.log.Check(err, "closing message reader")
+	}()
+	p, err := m.LoadPart(mr)
+	if err != nil {
+		c.log.Debugx("load message part, continuing with empty part", err, slog.Int64("msgid", m.ID))
+		p, _ = message.EnsurePart(c.log.Logger, false, mr, m.Size)
+	}
+	env := p.Envelope
+	if env == nil {
+		env = &message.Envelope{}
+	}
+	fields := parseHeaderFields(p.HeaderReader())
+
+	var structureParsed bool
+	var textBody, htmlBody, attachments []bodyPart
+	structure := func() {
+		if !structureParsed {
+			textBody, htmlBody, attachments = parseStructure(&p)
+			structureParsed = true
+		}
+	}
+	bodyParts := func(l []bodyPart) []map[string]any {
+		r := make([]map[string]any, len(l))
+		for i, bp := range l {
+			r[i] = bp.object(m.ID, bodyProps)
+		}
+		return r
+	}
+	optMessageIDs := func(name string) any {
+		if v, ok := firstHeader(fields, name); ok {
+			if l := headerMessageIDs(v); l != nil {
+				return l
+			}
+		}
+		return nil
+	}
+	optAddresses := func(l []message.Address) any {
+		if r := emailAddresses(l); r != nil {
+			return r
+		}
+		return nil
+	}
+
+	for _, prop := range props {
+		switch prop {
+		case "id", "blobId", "threadId", "mailboxIds", "keywords", "size", "receivedAt":
+		case "headers":
+			l := fields
+			if l == nil {
+				l = []headerField{}
+			}
+			o[prop] = l
+		case "messageId":
+			o[prop] = optMessageIDs("Message-Id")
+		case "inReplyTo":
+			o[prop] = optMessageIDs("In-Reply-To")
+		case "references":
+			o[prop] = optMessageIDs("References")
+		case "sender":
+			o[prop] = optAddresses(env.Sender)
+		case "from":
+			o[prop] = optAddresses(env.From)
+		case "to":
+			o[prop] = optAddresses(env.To)
+		case "cc":
+			o[prop] = optAddresses(env.CC)
+		case "bcc":
+			o[prop] = optAddresses(env.BCC)
+		case "replyTo":
+			o[prop] = optAddresses(env.ReplyTo)
+		case "subject":
+			if _, ok := firstHeader(fields, "Subject"); ok {
+				o[prop] = env.Subject
+			} else {
+				o[prop] = nil
+			}
+		case "sentAt":
+			if env.Date.IsZero() {
+				o[prop] = nil
+			} else {
+				o[prop] = env.Date.Format(time.RFC3339)
+			}
+		case "hasAttachment":
+			structure()
+			o[prop] = len(attachments) > 0
+		case "preview":
+			structure()
+			o[prop] = preview(textBody)
+		case "bodyStructure":
+			o[prop] = newBodyPart(&p, nil).object(m.ID, append(slices.Clone(bodyProps), "subParts"))
+		case "textBody":
+			structure()
+			o[prop] = bodyParts(textBody)
+		case "htmlBody":
+			structure()
+			o[prop] = bodyParts(htmlBody)
+		case "attachments":
+			structure()
+			o[prop] = bodyParts(attachments)
+		case "bodyValues":
+			structure()
+			values := map[string]bodyValue{}
+			add := func(l []bodyPart) {
+				for _, bp := range l {
+					id := partID(bp.Path)
+					if _, ok := values[id]; ok || bp.Part.MediaType != "TEXT" && bp.Part.MediaType != "" {
+						continue
+					}
+					values[id] = readBodyValue(bp.Part, req.MaxBodyValueBytes)
+				}
+			}
+			if req.FetchTextBodyValues || req.FetchAllBodyValues {
+				add(textBody)
+			}
+			if req.FetchHTMLBodyValues || req.FetchAllBodyValues {
+				add(htmlBody)
+			}
+			o[prop] = values
+		default:
+			if strings.HasPrefix(prop, "header:") {
+				o[prop] = headerValue(fields, prop)
+			}
+		}
+	}
+	return o
+}
+
+func (c *call) emailGet(args json.RawMessage) any {
+	var req emailGetArgs
+	c.xparseArgs(args, &req)
+	c.xcheckGetArgs(req.getArgs)
+	if req.MaxBodyValueBytes < 0 {
+		xmethodErrorf("invalidArguments", "maxBodyValueBytes must not be negative")
+	}
+	props := properties(req.Properties, emailProperties, emailKnownProperties)
+	for _, p := range props {
+		if strings.HasPrefix(p, "header:") {
+			xheaderProperty(p)
+		}
+	}
+	// Body parts don't have an "id", don't let properties add it.
+	bodyProps := properties(req.BodyProperties, bodyProperties, bodyKnownProperties)
+	bodyProps = slices.DeleteFunc(slices.Clone(bodyProps), func(s string) bool { return s == "id" })
+
+	resp := struct {
+		AccountID string           `json:"accountId"`
+		State     string           `json:"state"`
+		List      []map[string]any `json:"list"`
+		NotFound  []string         `json:"notFound"`
+	}{c.accountID, "", []map[string]any{}, []string{}}
+
+	c.xdbread(func(tx *bstore.Tx) {
+		resp.State = xemailState(tx)
+
+		if req.IDs == nil {
+			// Fetching all emails is allowed, but limited to maxObjectsInGet.
+			q := bstore.QueryTx[store.Message](tx)
+			q.FilterEqual("Expunged", false)
+			q.SortDesc("Received")
+			q.Limit(maxObjectsInGet)
+			err := q.ForEach(func(m store.Message) error {
+				resp.List = append(resp.List, c.xemailObject(m, req, props, bodyProps))
+				return nil
+			})
+			xcheckf(err, "listing messages")
+			return
+		}
+
+		for _, id := range *req.IDs {
+			mid, ok := parseID('e', c.resolveID(id))
+			if !ok {
+				resp.NotFound = append(resp.NotFound, id)
+				continue
+			}
+			m := store.Message{ID: mid}
+			err := tx.Get(&m)
+			if err == bstore.ErrAbsent || err == nil && m.Expunged {
+				resp.NotFound = append(resp.NotFound, id)
+				continue
+			}
+			xcheckf(err, "get message")
+			resp.List = append(resp.List, c.xemailObject(m, req, props, bodyProps))
+		}
+	})
+	return resp
+}
+
+// xchangedMessages returns messages changed since modseq, sorted by modseq, and
+// the new state. If maxChanges is set, only complete groups of changes with the
+// same modseq are returned, and hasMore indicates there are more changes.
+func xchangedMessages(tx *bstore.Tx, since store.ModSeq, maxChanges *int, count func(m store.Message) int) (l []store.Message, newState string, hasMore bool) {
+	if maxChanges != nil && *maxChanges <= 0 {
+		xmethodErrorf("invalidArguments", "maxChanges must be positive")
+	}
+
+	q := bstore.QueryTx[store.Message](tx)
+	q.FilterGreater("ModSeq", since)
+	q.SortAsc("ModSeq")
+	all, err := q.List()
+	xcheckf(err, "listing changed messages")
+
+	newState = xemailState(tx)
+	if maxChanges == nil {
+		return all, newState, false
+	}
+
+	n := 0
+	for i, m := range all {
+		n += count(m)
+		if n > *maxChanges && i > 0 && all[i-1].ModSeq != m.ModSeq {
+			// Cut before the group with this modseq.
+			j := i
+			for j > 0 && all[j-1].ModSeq == all[i-1].ModSeq {
+				j--
+			}
+			if j == 0 {
+				// First group is already too large, return it completely.
+				j = i
+			}
+			return all[:j], fmt.Sprintf("%d", all[j-1].ModSeq), true
+		}
+	}
+	return all, newState, false
+}
+
+func (c *call) emailChanges(args json.RawMessage) any {
+	var req changesArgs
+	c.xparseArgs(args, &req)
+	c.xcheckAccount(req.AccountID)
+
+	resp := changesResponse{AccountID: c.accountID, OldState: req.SinceState, Created: []string{}, Updated: []string{}, Destroyed: []string{}}
+	c.xdbread(func(tx *bstore.Tx) {
+		since := xparseEmailState(tx, req.SinceState)
+
+		l, newState, hasMore := xchangedMessages(tx, since, req.MaxChanges, func(m store.Message) int {
+			if m.Expunged && m.CreateSeq > since {
+				return 0
+			}
+			return 1
+		})
+		resp.NewState = newState
+		resp.HasMoreChanges = hasMore
+		seen := map[int64]bool{}
+		for _, m := range l {
+			if seen[m.ID] {
+				continue
+			}
+			seen[m.ID] = true
+			id := emailID(m.ID)
+			switch {
+			case m.Expunged && m.CreateSeq > since:
+				// Created and removed again, client never knew about it.
+			case m.Expunged:
+				resp.Destroyed = append(resp.Destroyed, id)
+			case m.CreateSeq > since:
+				resp.Created = append(resp.Created, id)
+			default:
+				resp.Updated = append(resp.Updated, id)
+			}
+		}
+	})
+	return resp
+}
+
+func (c *call) threadGet(args json.RawMessage) any {
+	var req getArgs
+	c.xparseArgs(args, &req)
+	c.xcheckGetArgs(req)
+	props := properties(req.Properties, []string{"id", "emailIds"}, []string{"id", "emailIds"})
+	if req.IDs == nil {
+		xmethodErrorf("requestTooLarge", "ids required for Thread/get")
+	}
+
+	resp := struct {
+		AccountID string           `json:"accountId"`
+		State     string           `json:"state"`
+		List      []map[string]any `json:"list"`
+		NotFound  []string         `json:"notFound"`
+	}{c.accountID, "", []map[string]any{}, []string{}}
+
+	c.xdbread(func(tx *bstore.Tx) {
+		resp.State = xemailState(tx)
+
+		for _, id := range *req.IDs {
+			tid, ok := parseID('t', c.resolveID(id))
+			if !ok {
+				resp.NotFound = append(resp.NotFound, id)
+				continue
+			}
+			q := bstore.QueryTx[store.Message](tx)
+			q.FilterNonzero(store.Message{ThreadID: tid})
+			q.FilterEqual("Expunged", false)
+			q.SortAsc("Received", "ID")
+			ml, err := q.List()
+			xcheckf(err, "listing messages in thread")
+			if len(ml) == 0 {
+				// Message without assigned thread id.
+				m := store.Message{ID: tid}
+				if err := tx.Get(&m); err == nil && !m.Expunged && m.ThreadID == 0 {
+					ml = []store.Message{m}
+				}
+			}
+			if len(ml) == 0 {
+				resp.NotFound = append(resp.NotFound, id)
+				continue
+			}
+			emailIDs := make([]string, len(ml))
+			for i, m := range ml {
+				emailIDs[i] = emailID(m.ID)
+			}
+			o := map[string]any{"id": threadID(tid), "emailIds": emailIDs}
+			resp.List = append(resp.List, pick(o, props))
+		}
+	})
+	return resp
+}
+
+func (c *call) threadChanges(args json.RawMessage) any {
+	var req changesArgs
+	c.xparseArgs(args, &req)
+	c.xcheckAccount(req.AccountID)
+
+	resp := changesResponse{AccountID: c.accountID, OldState: req.SinceState, Created: []string{}, Updated: []string{}, Destroyed: []string{}}
+	c.xdbread(func(tx *bstore.Tx) {
+		since := xparseEmailState(tx, req.SinceState)
+
+		l, newState, hasMore := xchangedMessages(tx, since, req.MaxChanges, func(m store.Message) int { return 1 })
+		resp.NewState = newState
+		resp.HasMoreChanges = hasMore
+
+		threads := map[int64]bool{} // Whether thread existed before since.
+		var order []int64
+		for _, m := range l {
+			tid := m.ThreadID
+			if tid == 0 {
+				tid = m.ID
+			}
+			if _, ok := threads[tid]; !ok {
+				order = append(order, tid)
+			}
+			threads[tid] = threads[tid] || m.CreateSeq <= since
+		}
+		for _, tid := range order {
+			q := bstore.QueryTx[store.Message](tx)
+			q.FilterNonzero(store.Message{ThreadID: tid})
+			q.FilterEqual("Expunged", false)
+			ml, err := q.List()
+			xcheckf(err, "listing messages in thread")
+			existed := threads[tid]
+			for _, m := range ml {
+				existed = existed || m.CreateSeq <= since
+			}
+			id := threadID(tid)
+			switch {
+			case len(ml) == 0 && existed:
+				resp.Destroyed = append(resp.Destroyed, id)
+			case len(ml) == 0:
+			case existed:
+				resp.Updated = append(resp.Updated, id)
+			default:
+				resp.Created = append(resp.Created, id)
+			}
+		}
+	})
+	return resp
+}
+
+// emailFilter is a FilterCondition or FilterOperator for Email/query. ../rfc/8621:2370
+type emailFilter struct {
+	Operator   string        `json:"operator"`
+	Conditions []emailFilter `json:"conditions"`
+
+	InMailbox          *string    `json:"inMailbox"`
+	InMailboxOtherThan []string   `json:"inMailboxOtherThan"`
+	Before             *time.Time `json:"before"`
+	After              *time.Time `json:"after"`
+	MinSize            *int64     `json:"minSize"`
+	MaxSize            *int64     `json:"maxSize"`
+	HasKeyword         *string    `json:"hasKeyword"`
+	NotKeyword         *string    `json:"notKeyword"`
+	HasAttachment      *bool      `json:"hasAttachment"`
+	Text               *string    `json:"text"`
+	From               *string    `json:"from"`
+	To                 *string    `json:"to"`
+	Cc                 *string    `json:"cc"`
+	Bcc                *string    `json:"bcc"`
+	Subject            *string    `json:"subject"`
+	Body               *string    `json:"body"`
+	Header             []string   `json:"header"`
+
+	AllInThreadHaveKeyword  *string `json:"allInThreadHaveKeyword"`
+	SomeInThreadHaveKeyword *string `json:"someInThreadHaveKeyword"`
+	NoneInThreadHaveKeyword *string `json:"noneInThreadHaveKeyword"`
+}
+
+// emailMatch holds a message with lazily loaded message structure for matching
+// and sorting.
+type emailMatch struct {
+	c      *call
+	m      store.Message
+	mr     *store.MsgReader
+	part   *message.Part
+	fields []headerField
+	text   *string // Lower-case text of body parts.
+}
+
+func (em *emailMatch) xpart() *message.Part {
+	if em.part == nil {
+		em.mr = em.c.acc.MessageReader(em.m)
+		p, err := em.m.LoadPart(em.mr)
+		if err != nil {
+			em.c.log.Debugx("load message part for query, continuing with fallback part", err, slog.Int64("msgid", em.m.ID))
+			p, _ = message.EnsurePart(em.c.log.Logger, false, em.mr, em.m.Size)
+		}
+		em.part = &p
+	}
+	return em.part
+}
+
+// close closes the message file if it was opened.
+func (em *emailMatch) close() {
+	if em.mr != nil {
+		err := em.mr.Close()
+		em.c.log.Check(err, "closing message reader")
+		em.mr = nil
+	}
+}
+
+func (em *emailMatch) envelope() *message.Envelope {
+	if env := em.xpart().Envelope; env != nil {
+		return env
+	}
+	return &message.Envelope{}
+}
+
+func (em *emailMatch) headerFields() []headerField {
+	if em.fields == nil {
+		em.fields = parseHeaderFields(em.xpart().HeaderReader())
+		if em.fields == nil {
+			em.fields = []headerField{}
+		}
+	}
+	return em.fields
+}
+
+// bodyText returns the lower-case text of the text and html body parts, limited in
+// size.
+func (em *emailMatch) bodyText() string {
+	if em.text == nil {
+		textBody, htmlBody, _ := parseStructure(em.xpart())
+		var b strings.Builder
+		for _, bp := range append(textBody, htmlBody...) {
+			buf, _ := io.ReadAll(io.LimitReader(bp.Part.ReaderUTF8OrBinary(), 1024*1024))
+			b.Write(bytes.ToLower(buf))
+			b.WriteString("\n")
+		}
+		s := b.String()
+		em.text = &s
+	}
+	return *em.text
+}
+
+func addressesContain(l []message.Address, s string) bool {
+	for _, a := range l {
+		if strings.Contains(strings.ToLower(a.Name+" <"+a.User+"@"+a.Host+">"), s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *call) xemailMatch(f emailFilter, em *emailMatch) bool {
+	if f.Operator != "" {
+		switch f.Operator {
+		case "AND":
+			for _, sf := range f.Conditions {
+				if !c.xemailMatch(sf, em) {
+					return false
+				}
+			}
+			return true
+		case "OR":
+			for _, sf := range f.Conditions {
+				if c.xemailMatch(sf, em) {
+					return true
+				}
+			}
+			return false
+		case "NOT":
+			for _, sf := range f.Conditions {
+				if c.xemailMatch(sf, em) {
+					return false
+				}
+			}
+			return true
+		default:
+			xmethodErrorf("unsupportedFilter", "unknown operator %q", f.Operator)
+		}
+	}
+
+	m := em.m
+	if f.AllInThreadHaveKeyword != nil || f.SomeInThreadHaveKeyword != nil || f.NoneInThreadHaveKeyword != nil {
+		xmethodErrorf("unsupportedFilter", "thread keyword filters not supported")
+	}
+	if f.InMailbox != nil {
+		id, ok := parseID('m', c.resolveID(*f.InMailbox))
+		if !ok || m.MailboxID != id {
+			return false
+		}
+	}
+	for _, s := range f.InMailboxOtherThan {
+		if id, ok := parseID('m', c.resolveID(s)); ok && m.MailboxID == id {
+			return false
+		}
+	}
+	if f.Before != nil && !m.Received.Before(*f.Before) {
+		return false
+	}
+	if f.After != nil && m.Received.Before(*f.After) {
+		return false
+	}
+	if f.MinSize != nil && m.Size < *f.MinSize {
+		return false
+	}
+	if f.MaxSize != nil && m.Size >= *f.MaxSize {
+		return false
+	}
+	if f.HasKeyword != nil && !hasKeyword(m, strings.ToLower(*f.HasKeyword)) {
+		return false
+	}
+	if f.NotKeyword != nil && hasKeyword(m, strings.ToLower(*f.NotKeyword)) {
+		return false
+	}
+	if f.HasAttachment != nil {
+		_, _, attachments := parseStructure(em.xpart())
+		if *f.HasAttachment != (len(attachments) > 0) {
+			return false
+		}
+	}
+	lower := func(s *string) string { return strings.ToLower(*s) }
+	if f.From != nil && !addressesContain(em.envelope().From, lower(f.From)) {
+		return false
+	}
+	if f.To != nil && !addressesContain(em.envelope().To, lower(f.To)) {
+		return false
+	}
+	if f.Cc != nil && !addressesContain(em.envelope().CC, lower(f.Cc)) {
+		return false
+	}
+	if f.Bcc != nil && !addressesContain(em.envelope().BCC, lower(f.Bcc)) {
+		return false
+	}
+	if f.Subject != nil && !strings.Contains(strings.ToLower(em.envelope().Subject), lower(f.Subject)) {
+		return false
+	}
+	if f.Body != nil && !strings.Contains(em.bodyText(), lower(f.Body)) {
+		return false
+	}
+	if f.Text != nil {
+		s := lower(f.Text)
+		env := em.envelope()
+		if !addressesContain(env.From, s) && !addressesContain(env.To, s) && !addressesContain(env.CC, s) && !addressesContain(env.BCC, s) && !strings.Contains(strings.ToLower(env.Subject), s) && !strings.Contains(em.bodyText(), s) {
+			return false
+		}
+	}
+	if f.Header != nil {
+		if len(f.Header) == 0 || len(f.Header) > 2 {
+			xmethodErrorf("invalidArguments", "header filter must have one or two elements")
+		}
+		var found bool
+		for _, hf := range em.headerFields() {
+			if strings.EqualFold(hf.Name, f.Header[0]) && (len(f.Header) == 1 || strings.Contains(strings.ToLower(headerText(hf.Value)), strings.ToLower(f.Header[1]))) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func firstAddress(l []message.Address) string {
+	if len(l) == 0 {
+		return ""
+	}
+	a := l[0]
+	if a.Name != "" {
+		return strings.ToLower(a.Name)
+	}
+	return strings.ToLower(a.User + "@" + a.Host)
+}
+
+// xemailCompare compares two messages for the comparator, returning -1, 0 or 1.
+func xemailCompare(cmp comparator, a, b *emailMatch) int {
+	var r int
+	switch cmp.Property {
+	case "receivedAt":
+		r = a.m.Received.Compare(b.m.Received)
+	case "sentAt":
+		r = a.envelope().Date.Compare(b.envelope().Date)
+	case "size":
+		r = int(a.m.Size - b.m.Size)
+	case "subject":
+		sa, _ := message.ThreadSubject(a.envelope().Subject, false)
+		sb, _ := message.ThreadSubject(b.envelope().Subject, false)
+		r = strings.Compare(sa, sb)
+	case "from":
+		r = strings.Compare(firstAddress(a.envelope().From), firstAddress(b.envelope().From))
+	case "to":
+		r = strings.Compare(firstAddress(a.envelope().To), firstAddress(b.envelope().To))
+	case "hasKeyword":
+		if cmp.Keyword == nil {
+			xmethodErrorf("invalidArguments", "keyword required for sorting on hasKeyword")
+		}
+		kw := strings.ToLower(*cmp.Keyword)
+		ha, hb := hasKeyword(a.m, kw), hasKeyword(b.m, kw)
+		if ha != hb {
+			r = -1
+			if ha {
+				r = 1
+			}
+		}
+	default:
+		xmethodErrorf("unsupportedSort", "cannot sort on %q", cmp.Property)
+	}
+	if r < 0 {
+		r = -1
+	} else if r > 0 {
+		r = 1
+	}
+	if !cmp.ascending() {
+		r = -r
+	}
+	return r
+}
+
+func (c *call) emailQuery(args json.RawMessage) any {
+	var req struct {
+		AccountID       string       `json:"accountId"`
+		Filter          *emailFilter `json:"filter"`
+		Sort            []comparator `json:"sort"`
+		Position        int          `json:"position"`
+		Anchor          *string      `json:"anchor"`
+		AnchorOffset    int          `json:"anchorOffset"`
+		Limit           *int         `json:"limit"`
+		CalculateTotal  bool         `json:"calculateTotal"`
+		CollapseThreads bool         `json:"collapseThreads"`
+	}
+	c.xparseArgs(args, &req)
+	c.xcheckAccount(req.AccountID)
+
+	// Default sort is most recent first.
+	if len(req.Sort) == 0 {
+		no := false
+		req.Sort = []comparator{{Property: "receivedAt", IsAscending: &no}}
+	}
+	for _, cmp := range req.Sort {
+		if !slices.Contains(emailSortProperties, cmp.Property) {
+			xmethodErrorf("unsupportedSort", "cannot sort on %q", cmp.Property)
+		}
+	}
+
+	var state string
+	var l []*emailMatch
+	c.xdbread(func(tx *bstore.Tx) {
+		state = xemailState(tx)
+
+		q := bstore.QueryTx[store.Message](tx)
+		q.FilterEqual("Expunged", false)
+		// Optimize common case of query in a single mailbox.
+		if req.Filter != nil && req.Filter.Operator == "" && req.Filter.InMailbox != nil {
+			if id, ok := parseID('m', c.resolveID(*req.Filter.InMailbox)); ok {
+				q.FilterNonzero(store.Message{MailboxID: id})
+			} else {
+				return
+			}
+		}
+		err := q.ForEach(func(m store.Message) error {
+			em := &emailMatch{c: c, m: m}
+			defer em.close()
+			if req.Filter == nil || c.xemailMatch(*req.Filter, em) {
+				l = append(l, em)
+			}
+			return nil
+		})
+		xcheckf(err, "listing messages")
+	})
+
+	sort.SliceStable(l, func(i, j int) bool {
+		for _, cmp := range req.Sort {
+			if r := xemailCompare(cmp, l[i], l[j]); r != 0 {
+				return r < 0
+			}
+		}
+		return l[i].m.ID < l[j].m.ID
+	})
+
+	ids := make([]string, 0, len(l))
+	seenThreads := map[int64]bool{}
+	for _, em := range l {
+		if req.CollapseThreads {
+			tid := em.m.ThreadID
+			if tid == 0 {
+				tid = em.m.ID
+			}
+			if seenThreads[tid] {
+				continue
+			}
+			seenThreads[tid] = true
+		}
+		ids = append(ids, emailID(em.m.ID))
+	}
+
+	var anchor *string
+	if req.Anchor != nil {
+		s := c.resolveID(*req.Anchor)
+		anchor = &s
+	}
+	resp := xqueryWindow(ids, req.Position, anchor, req.AnchorOffset, req.Limit, req.CalculateTotal)
+	resp.AccountID = c.accountID
+	resp.QueryState = state
+	return resp
+}
@@ -0,0 +1,768 @@
+package jmapserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/message"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/moxio"
+	"github.com/mjl-/mox/smtp"
+	"github.com/mjl-/mox/store"
+	"github.com/mjl-/mox/webops"
+)
+
+// xops are the shared message operations, with errors turned into JMAP server
+// errors or SetErrors.
+var xops = webops.XOps{
+	DBWrite: func(ctx context.Context, acc *store.Account, fn func(tx *bstore.Tx)) {
+		err := acc.DB.Write(ctx, func(tx *bstore.Tx) error {
+			fn(tx)
+			return nil
+		})
+		xcheckf(err, "transaction")
+	},
+	Checkf: func(ctx context.Context, err error, format string, args ...any) {
+		xcheckf(err, format, args...)
+	},
+	Checkuserf: func(ctx context.Context, err error, format string, args ...any) {
+		if err == nil {
+			return
+		}
+		if errors.Is(err, webops.ErrMessageNotFound) || errors.Is(err, bstore.ErrAbsent) {
+			xsetErrorf("notFound", "%s: %v", fmt.Sprintf(format, args...), err)
+		}
+		xsetErrorf("invalidProperties", "%s: %v", fmt.Sprintf(format, args...), err)
+	},
+}
+
+// xmessage returns the non-expunged message for an email id, or fails with a
+// notFound SetError.
+func (c *call) xmessage(tx *bstore.Tx, id string) store.Message {
+	mid, ok := parseID('e', c.resolveID(id))
+	if !ok {
+		xsetErrorf("notFound", "email not found")
+	}
+	m := store.Message{ID: mid}
+	err := tx.Get(&m)
+	if err == bstore.ErrAbsent || err == nil && m.Expunged {
+		xsetErrorf("notFound", "email not found")
+	}
+	xcheckf(err, "get message")
+	return m
+}
+
+// xmailboxIDs parses a mailboxIds object, which must reference exactly one
+// mailbox.
+func (c *call) xmailboxIDs(buf json.RawMessage) int64 {
+	var mbids map[string]bool
+	if err := json.Unmarshal(buf, &mbids); err != nil {
+		xinvalidProperties("mailboxIds must be an object with true values", "mailboxIds")
+	}
+	var ids []int64
+	for id, v := range mbids {
+		if !v {
+			xinvalidProperties("mailboxIds values must be true", "mailboxIds")
+		}
+		mbID, ok := parseID('m', c.resolveID(id))
+		if !ok {
+			xinvalidProperties("unknown mailbox", "mailboxIds")
+		}
+		ids = append(ids, mbID)
+	}
+	if len(ids) == 0 {
+		xinvalidProperties("email must be in a mailbox", "mailboxIds")
+	} else if len(ids) > 1 {
+		xsetErrorf("tooManyMailboxes", "email can only be in a single mailbox")
+	}
+	return ids[0]
+}
+
+// xdeliver adds the message in f to the mailbox. Must be called with the account
+// lock held. Returns the new message and the changes to broadcast.
+func (c *call) xdeliver(tx *bstore.Tx, mbID int64, f *os.File, size int64, flags store.Flags, keywords []string, received time.Time) (store.Message, []store.Change) {
+	mb := store.Mailbox{ID: mbID}
+	err := tx.Get(&mb)
+	if err == bstore.ErrAbsent {
+		xinvalidProperties("unknown mailbox", "mailboxIds")
+	}
+	xcheckf(err, "get mailbox")
+
+	ok, maxSize, err := c.acc.CanAddMessageSize(tx, size)
+	xcheckf(err, "checking quota")
+	if !ok {
+		xsetErrorf("overQuota", "account over maximum total message size %d", maxSize)
+	}
+
+	m := store.Message{
+		MailboxID:     mb.ID,
+		MailboxOrigID: mb.ID,
+		Received:      received,
+		Flags:         flags,
+		Keywords:      keywords,
+		Size:          size,
+	}
+
+	// Update mailbox before delivery, which changes uidnext.
+	origmb := mb
+	mb.Add(m.MailboxCounts())
+	mb.Keywords, _ = store.MergeKeywords(mb.Keywords, keywords)
+	err = tx.Update(&mb)
+	xcheckf(err, "updating mailbox counts")
+
+	err = c.acc.DeliverMessage(c.log, tx, &m, f, true, false, false, true)
+	xcheckf(err, "delivering message")
+
+	changes := []store.Change{m.ChangeAddUID(), mb.ChangeCounts()}
+	if mb.KeywordsChanged(origmb) {
+		changes = append(changes, mb.ChangeKeywords())
+	}
+	return m, changes
+}
+
+// xupdateFlags sets new flags and keywords on a message, updating its mailbox.
+func (c *call) xupdateFlags(tx *bstore.Tx, m store.Message, flags store.Flags, keywords []string, modseq *store.ModSeq) (store.Message, []store.Change) {
+	mb := store.Mailbox{ID: m.MailboxID}
+	err := tx.Get(&mb)
+	xcheckf(err, "get mailbox")
+	origmb := mb
+
+	mb.Sub(m.MailboxCounts())
+	oflags := m.Flags
+	m.Flags = flags
+	m.Keywords = keywords
+	mb.Add(m.MailboxCounts())
+	mb.Keywords, _ = store.MergeKeywords(mb.Keywords, keywords)
+
+	if *modseq == 0 {
+		*modseq, err = c.acc.NextModSeq(tx)
+		xcheckf(err, "assigning next modseq")
+	}
+	m.ModSeq = *modseq
+	err = tx.Update(&m)
+	xcheckf(err, "updating message")
+	err = tx.Update(&mb)
+	xcheckf(err, "updating mailbox")
+
+	changes := []store.Change{m.ChangeFlags(oflags)}
+	if mb.MailboxCounts != origmb.MailboxCounts {
+		changes = append(changes, mb.ChangeCounts())
+	}
+	if mb.KeywordsChanged(origmb) {
+		changes = append(changes, mb.ChangeKeywords())
+	}
+
+	err = c.acc.RetrainMessages(c.ctx, c.log, tx, []store.Message{m}, false)
+	xcheckf(err, "retraining message")
+	return m, changes
+}
+
+// emailBodyPartCreate is an EmailBodyPart as specified by a client when creating
+// an email.
+type emailBodyPartCreate struct {
+	PartID      *string   `json:"partId"`
+	BlobID      *string   `json:"blobId"`
+	Size        *int64    `json:"size"`
+	Name        *string   `json:"name"`
+	Type        *string   `json:"type"`
+	Charset     *string   `json:"charset"`
+	Disposition *string   `json:"disposition"`
+	Cid         *string   `json:"cid"`
+	Language    *[]string `json:"language"`
+	Location    *string   `json:"location"`
+}
+
+// emailCreate holds the properties for a new email. ../rfc/8621:2780
+type emailCreate struct {
+	MailboxIDs json.RawMessage `json:"mailboxIds"`
+	Keywords   json.RawMessage `json:"keywords"`
+	ReceivedAt *time.Time      `json:"receivedAt"`
+
+	MessageID  []string       `json:"messageId"`
+	InReplyTo  []string       `json:"inReplyTo"`
+	References []string       `json:"references"`
+	Sender     []EmailAddress `json:"sender"`
+	From       []EmailAddress `json:"from"`
+	To         []EmailAddress `json:"to"`
+	Cc         []EmailAddress `json:"cc"`
+	Bcc        []EmailAddress `json:"bcc"`
+	ReplyTo    []EmailAddress `json:"replyTo"`
+	Subject    *string        `json:"subject"`
+	SentAt     *time.Time     `json:"sentAt"`
+
+	BodyValues  map[string]bodyValue  `json:"bodyValues"`
+	TextBody    []emailBodyPartCreate `json:"textBody"`
+	HTMLBody    []emailBodyPartCreate `json:"htmlBody"`
+	Attachments []emailBodyPartCreate `json:"attachments"`
+}
+
+// xcheckcontrol fails for header values with control characters, to prevent
+// header injection.
+func xcheckcontrol(s, prop string) {
+	for _, c := range s {
+		if c < 0x20 || c == 0x7f {
+			xinvalidProperties("control characters not allowed", prop)
+		}
+	}
+}
+
+func xnameAddresses(l []EmailAddress, prop string) []message.NameAddress {
+	r := make([]message.NameAddress, len(l))
+	for i, a := range l {
+		addr, err := smtp.ParseAddress(a.Email)
+		if err != nil {
+			xinvalidProperties(fmt.Sprintf("parsing address %q: %v", a.Email, err), prop)
+		}
+		var name string
+		if a.Name != nil {
+			name = *a.Name
+			xcheckcontrol(name, prop)
+		}
+		r[i] = message.NameAddress{DisplayName: name, Address: addr}
+	}
+	return r
+}
+
+func xmessageIDs(l []string, prop string) string {
+	var ids []string
+	for _, id := range l {
+		xcheckcontrol(id, prop)
+		if id == "" || strings.ContainsAny(id, "<> ") {
+			xinvalidProperties("bad message-id", prop)
+		}
+		ids = append(ids, "<"+id+">")
+	}
+	return strings.Join(ids, "\r\n\t")
+}
+
+// xcompose writes a new message for ec to f, returning the number of bytes written.
+func (c *call) xcompose(ec emailCreate, f *os.File) (size int64) {
+	intl := func(l ...[]message.NameAddress) bool {
+		for _, ll := range l {
+			for _, a := range ll {
+				if a.Address.Localpart.IsInternational() {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	sender := xnameAddresses(ec.Sender, "sender")
+	from := xnameAddresses(ec.From, "from")
+	to := xnameAddresses(ec.To, "to")
+	cc := xnameAddresses(ec.Cc, "cc")
+	bcc := xnameAddresses(ec.Bcc, "bcc")
+	replyTo := xnameAddresses(ec.ReplyTo, "replyTo")
+	smtputf8 := intl(sender, from, to, cc, bcc, replyTo)
+
+	if len(ec.TextBody) > 1 || len(ec.HTMLBody) > 1 {
+		xinvalidProperties("at most one textBody and htmlBody part supported", "textBody", "htmlBody")
+	}
+	xbodyText := func(l []emailBodyPartCreate, typ, prop string) (string, bool) {
+		if len(l) == 0 {
+			return "", false
+		}
+		bp := l[0]
+		if bp.Type != nil && *bp.Type != typ || bp.BlobID != nil || bp.PartID == nil {
+			xinvalidProperties(fmt.Sprintf("body part must have partId and be of type %s", typ), prop)
+		}
+		bv, ok := ec.BodyValues[*bp.PartID]
+		if !ok {
+			xinvalidProperties("missing body value for partId", prop)
+		}
+		if bv.IsEncodingProblem || bv.IsTruncated {
+			xinvalidProperties("isEncodingProblem and isTruncated must be false", "bodyValues")
+		}
+		return bv.Value, true
+	}
+	text, haveText := xbodyText(ec.TextBody, "text/plain", "textBody")
+	html, haveHTML := xbodyText(ec.HTMLBody, "text/html", "htmlBody")
+
+	var inline, attached []emailBodyPartCreate
+	for _, a := range ec.Attachments {
+		if a.BlobID == nil || a.PartID != nil {
+			xinvalidProperties("attachments must have a blobId", "attachments")
+		}
+		if a.Disposition != nil && *a.Disposition == "inline" && a.Cid != nil && haveHTML {
+			inline = append(inline, a)
+		} else {
+			attached = append(attached, a)
+		}
+	}
+
+	xc := message.NewComposer(f, c.s.maxMsgSize, smtputf8)
+	defer func() {
+		x := recover()
+		if x == nil {
+			return
+		}
+		if err, ok := x.(error); ok && errors.Is(err, message.ErrMessageSize) {
+			xsetErrorf("tooLarge", "message too large")
+		} else if ok && errors.Is(err, message.ErrCompose) {
+			xcheckf(err, "composing message")
+		}
+		panic(x)
+	}()
+
+	xc.HeaderAddrs("From", from)
+	xc.HeaderAddrs("Sender", sender)
+	xc.HeaderAddrs("Reply-To", replyTo)
+	xc.HeaderAddrs("To", to)
+	xc.HeaderAddrs("Cc", cc)
+	// Bcc is stored with the message, it is removed when submitting.
+	xc.HeaderAddrs("Bcc", bcc)
+	if ec.Subject != nil && *ec.Subject != "" {
+		xcheckcontrol(*ec.Subject, "subject")
+		xc.Subject(*ec.Subject)
+	}
+	date := time.Now()
+	if ec.SentAt != nil {
+		date = *ec.SentAt
+	}
+	xc.Header("Date", date.Format(message.RFC5322Z))
+	if len(ec.MessageID) > 1 {
+		xinvalidProperties("at most one message-id allowed", "messageId")
+	} else if len(ec.MessageID) == 1 {
+		xc.Header("Message-Id", xmessageIDs(ec.MessageID, "messageId"))
+	} else {
+		xc.Header("Message-Id", fmt.Sprintf("<%s>", mox.MessageIDGen(smtputf8)))
+	}
+	if len(ec.InReplyTo) > 0 {
+		xc.Header("In-Reply-To", xmessageIDs(ec.InReplyTo, "inReplyTo"))
+	}
+	if len(ec.References) > 0 {
+		xc.Header("References", xmessageIDs(ec.References, "references"))
+	}
+	xc.Header("MIME-Version", "1.0")
+
+	// MIME structure, like for webapi Send:
+	// - multipart/mixed (in case of attached files)
+	//   - multipart/related (in case of inline files with html)
+	//     - multipart/alternative (in case we have both text and html bodies)
+	//       - text/plain (optional)
+	//       - text/html (optional)
+	//     - inline file, ...
+	//   - attached file, ...
+	var cur, mixed, related, alternative *multipart.Writer
+	xcreateMultipart := func(subtype string) *multipart.Writer {
+		mp := multipart.NewWriter(xc)
+		if cur == nil {
+			xc.Header("Content-Type", fmt.Sprintf(`multipart/%s; boundary="%s"`, subtype, mp.Boundary()))
+			xc.Line()
+		} else {
+			_, err := cur.CreatePart(textproto.MIMEHeader{"Content-Type": []string{fmt.Sprintf(`multipart/%s; boundary="%s"`, subtype, mp.Boundary())}})
+			xcheckf(err, "adding multipart")
+		}
+		return mp
+	}
+	xcreatePart := func(header textproto.MIMEHeader) io.Writer {
+		if cur == nil {
+			for k, vl := range header {
+				for _, v := range vl {
+					xc.Header(k, v)
+				}
+			}
+			xc.Line()
+			return xc
+		}
+		p, err := cur.CreatePart(header)
+		xcheckf(err, "adding part")
+		return p
+	}
+	if len(attached) > 0 {
+		mixed = xcreateMultipart("mixed")
+		cur = mixed
+	}
+	if len(inline) > 0 {
+		related = xcreateMultipart("related")
+		cur = related
+	}
+	if haveText && haveHTML {
+		alternative = xcreateMultipart("alternative")
+		cur = alternative
+	}
+	if haveText || !haveHTML {
+		textBody, ct, cte := xc.TextPart("plain", text)
+		tp := xcreatePart(textproto.MIMEHeader{"Content-Type": []string{ct}, "Content-Transfer-Encoding": []string{cte}})
+		_, err := tp.Write(textBody)
+		xcheckf(err, "write text part")
+	}
+	if haveHTML {
+		htmlBody, ct, cte := xc.TextPart("html", html)
+		tp := xcreatePart(textproto.MIMEHeader{"Content-Type": []string{ct}, "Content-Transfer-Encoding": []string{cte}})
+		_, err := tp.Write(htmlBody)
+		xcheckf(err, "write html part")
+	}
+	if alternative != nil {
+		alternative.Close()
+		alternative = nil
+	}
+
+	xaddFile := func(a emailBodyPartCreate, disp string) {
+		r, _, err := openBlob(c.log, c.ctx, c.acc, *a.BlobID)
+		if err == errBlobNotFound {
+			xsetErrorf("blobNotFound", "blob %q not found", *a.BlobID)
+		}
+		xcheckf(err, "open blob")
+		defer func() {
+			err := r.Close()
+			c.log.Check(err, "closing blob")
+		}()
+
+		h := textproto.MIMEHeader{}
+		ct := "application/octet-stream"
+		if a.Type != nil && *a.Type != "" {
+			ct = *a.Type
+		}
+		params := map[string]string{}
+		if a.Charset != nil {
+			params["charset"] = *a.Charset
+		}
+		h.Set("Content-Type", mime.FormatMediaType(ct, params))
+		if h.Get("Content-Type") == "" {
+			xinvalidProperties("bad content type", "attachments")
+		}
+		var cdparams map[string]string
+		if a.Name != nil {
+			cdparams = map[string]string{"filename": *a.Name}
+		}
+		h.Set("Content-Disposition", mime.FormatMediaType(disp, cdparams))
+		if a.Cid != nil {
+			xcheckcontrol(*a.Cid, "attachments")
+			h.Set("Content-ID", "<"+*a.Cid+">")
+		}
+		h.Set("Content-Transfer-Encoding", "base64")
+		p := xcreatePart(h)
+		bw := moxio.Base64Writer(p)
+		_, err = io.Copy(bw, r)
+		xcheckf(err, "adding attachment")
+		err = bw.Close()
+		xcheckf(err, "flushing attachment")
+	}
+
+	cur = related
+	for _, a := range inline {
+		xaddFile(a, "inline")
+	}
+	if related != nil {
+		related.Close()
+		related = nil
+	}
+	cur = mixed
+	for _, a := range attached {
+		disp := "attachment"
+		if a.Disposition != nil && *a.Disposition == "inline" {
+			disp = "inline"
+		}
+		xaddFile(a, disp)
+	}
+	if mixed != nil {
+		mixed.Close()
+		mixed = nil
+	}
+	cur = nil
+	xc.Flush()
+	return xc.Size
+}
+
+// emailCreated returns the server-set properties for a created email.
+func emailCreated(m store.Message) map[string]any {
+	tid := m.ThreadID
+	if tid == 0 {
+		tid = m.ID
+	}
+	return map[string]any{
+		"id":       emailID(m.ID),
+		"blobId":   blobID(m.ID, nil),
+		"threadId": threadID(tid),
+		"size":     m.Size,
+	}
+}
+
+func (c *call) emailSet(args json.RawMessage) any {
+	var req setArgs
+	c.xparseArgs(args, &req)
+	c.xcheckSetArgs(req)
+	return c.xemailSet(req)
+}
+
+// xemailSet executes an Email/set, also used for the implicit Email/set after
+// EmailSubmission/set.
+func (c *call) xemailSet(req setArgs) setResponse {
+	resp := setResponse{AccountID: c.accountID}
+
+	c.xdbread(func(tx *bstore.Tx) {
+		oldState := xemailState(tx)
+		resp.OldState = &oldState
+		if req.IfInState != nil && *req.IfInState != oldState {
+			xmethodErrorf("stateMismatch", "email state does not match ifInState")
+		}
+	})
+
+	for cid, buf := range req.Create {
+		err := trySet(func() {
+			var ec emailCreate
+			dec := json.NewDecoder(strings.NewReader(string(buf)))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&ec); err != nil {
+				xinvalidProperties(err.Error())
+			}
+			if ec.MailboxIDs == nil {
+				xinvalidProperties("mailboxIds required", "mailboxIds")
+			}
+			mbID := c.xmailboxIDs(ec.MailboxIDs)
+			var flags store.Flags
+			var keywords []string
+			if ec.Keywords != nil {
+				flags, keywords = xparseKeywords(ec.Keywords)
+			}
+			received := time.Now()
+			if ec.ReceivedAt != nil {
+				received = *ec.ReceivedAt
+			}
+
+			f, err := store.CreateMessageTemp(c.log, "jmap-create")
+			xcheckf(err, "creating temporary file for message")
+			defer store.CloseRemoveTempFile(c.log, f, "new email")
+
+			size := c.xcompose(ec, f)
+
+			var m store.Message
+			c.acc.WithRLock(func() {
+				var changes []store.Change
+				c.xdbwrite(func(tx *bstore.Tx) {
+					m, changes = c.xdeliver(tx, mbID, f, size, flags, keywords, received)
+				})
+				store.BroadcastChanges(c.acc, changes)
+			})
+			c.createdIDs[cid] = emailID(m.ID)
+			resp.addCreated(cid, emailCreated(m))
+		})
+		if err != nil {
+			resp.addNotCreated(cid, *err)
+		}
+	}
+
+	withLock := c.acc.WithRLock
+	if len(req.Destroy) > 0 {
+		withLock = c.acc.WithWLock
+	}
+	var removeMessageIDs []int64
+	withLock(func() {
+		var changes []store.Change
+
+		c.xdbwrite(func(tx *bstore.Tx) {
+			var modseq store.ModSeq
+
+			for id, buf := range req.Update {
+				err := trySet(func() {
+					m := c.xmessage(tx, id)
+					full, sub := xparsePatch(buf)
+					for k := range full {
+						if k != "keywords" && k != "mailboxIds" {
+							xinvalidProperties("property cannot be changed", k)
+						}
+					}
+					for k := range sub {
+						if k != "keywords" && k != "mailboxIds" {
+							xinvalidProperties("property cannot be changed", k)
+						}
+					}
+
+					flags, keywords := m.Flags, m.Keywords
+					if v, ok := full["keywords"]; ok {
+						deleted := flags.Deleted
+						flags, keywords = xparseKeywords(v)
+						flags.Deleted = deleted
+					}
+					for kw, v := range sub["keywords"] {
+						var set *bool
+						if err := json.Unmarshal(v, &set); err != nil || set != nil && !*set {
+							xinvalidProperties("keyword patch value must be true or null", "keywords")
+						}
+						keywords = xsetKeyword(&flags, keywords, kw, set != nil)
+					}
+
+					mbID := m.MailboxID
+					if v, ok := full["mailboxIds"]; ok {
+						mbID = c.xmailboxIDs(v)
+					}
+					if mbpatch, ok := sub["mailboxIds"]; ok {
+						mbids := map[string]json.RawMessage{mailboxID(m.MailboxID): json.RawMessage("true")}
+						for k, v := range mbpatch {
+							if string(v) == "null" {
+								delete(mbids, c.resolveID(k))
+							} else {
+								mbids[c.resolveID(k)] = v
+							}
+						}
+						buf, err := json.Marshal(mbids)
+						xcheckf(err, "marshal mailbox ids")
+						mbID = c.xmailboxIDs(buf)
+					}
+
+					// Check destination mailbox before making changes.
+					var mb store.Mailbox
+					if mbID != m.MailboxID {
+						mb = store.Mailbox{ID: mbID}
+						err := tx.Get(&mb)
+						if err == bstore.ErrAbsent {
+							xinvalidProperties("unknown mailbox", "mailboxIds")
+						}
+						xcheckf(err, "get mailbox")
+					}
+
+					if flags != m.Flags || !slices.Equal(keywords, m.Keywords) {
+						var nchanges []store.Change
+						m, nchanges = c.xupdateFlags(tx, m, flags, keywords, &modseq)
+						changes = append(changes, nchanges...)
+					}
+					if mb.ID != 0 {
+						var nchanges []store.Change
+						modseq, nchanges = xops.MessageMoveTx(c.ctx, c.log, c.acc, tx, []int64{m.ID}, mb, modseq)
+						changes = append(changes, nchanges...)
+					}
+					resp.addUpdated(id, nil)
+				})
+				if err != nil {
+					resp.addNotUpdated(id, *err)
+				}
+			}
+
+			for _, id := range req.Destroy {
+				err := trySet(func() {
+					m := c.xmessage(tx, id)
+					var nchanges []store.Change
+					modseq, nchanges = xops.MessageDeleteTx(c.ctx, c.log, tx, c.acc, []int64{m.ID}, modseq)
+					changes = append(changes, nchanges...)
+					removeMessageIDs = append(removeMessageIDs, m.ID)
+					resp.Destroyed = append(resp.Destroyed, id)
+				})
+				if err != nil {
+					resp.addNotDestroyed(id, *err)
+				}
+			}
+
+			resp.NewState = xemailState(tx)
+		})
+
+		store.BroadcastChanges(c.acc, changes)
+	})
+
+	for _, mID := range removeMessageIDs {
+		p := c.acc.MessagePath(mID)
+		err := os.Remove(p)
+		c.log.Check(err, "removing message file for expunge", slog.String("path", p))
+	}
+
+	return resp
+}
+
+func (c *call) emailImport(args json.RawMessage) any {
+	var req struct {
+		AccountID string  `json:"accountId"`
+		IfInState *string `json:"ifInState"`
+		Emails    map[string]struct {
+			BlobID     string          `json:"blobId"`
+			MailboxIDs json.RawMessage `json:"mailboxIds"`
+			Keywords   json.RawMessage `json:"keywords"`
+			ReceivedAt *time.Time      `json:"receivedAt"`
+		} `json:"emails"`
+	}
+	c.xparseArgs(args, &req)
+	c.xcheckAccount(req.AccountID)
+	if len(req.Emails) > maxObjectsInSet {
+		xmethodErrorf("requestTooLarge", "too many emails, max %d", maxObjectsInSet)
+	}
+
+	resp := struct {
+		AccountID  string              `json:"accountId"`
+		OldState   *string             `json:"oldState"`
+		NewState   string              `json:"newState"`
+		Created    map[string]any      `json:"created"`
+		NotCreated map[string]setError `json:"notCreated"`
+	}{AccountID: c.accountID}
+
+	c.xdbread(func(tx *bstore.Tx) {
+		oldState := xemailState(tx)
+		resp.OldState = &oldState
+		if req.IfInState != nil && *req.IfInState != oldState {
+			xmethodErrorf("stateMismatch", "email state does not match ifInState")
+		}
+	})
+
+	for cid, e := range req.Emails {
+		err := trySet(func() {
+			if e.MailboxIDs == nil {
+				xinvalidProperties("mailboxIds required", "mailboxIds")
+			}
+			mbID := c.xmailboxIDs(e.MailboxIDs)
+			var flags store.Flags
+			var keywords []string
+			if e.Keywords != nil {
+				flags, keywords = xparseKeywords(e.Keywords)
+			}
+			received := time.Now()
+			if e.ReceivedAt != nil {
+				received = *e.ReceivedAt
+			}
+
+			r, _, err := openBlob(c.log, c.ctx, c.acc, e.BlobID)
+			if err == errBlobNotFound {
+				xsetErrorf("blobNotFound", "blob %q not found", e.BlobID)
+			}
+			xcheckf(err, "open blob")
+			defer func() {
+				err := r.Close()
+				c.log.Check(err, "closing blob")
+			}()
+
+			f, err := store.CreateMessageTemp(c.log, "jmap-import")
+			xcheckf(err, "creating temporary file for message")
+			defer store.CloseRemoveTempFile(c.log, f, "imported email")
+			size, err := io.Copy(f, io.LimitReader(r, c.s.maxMsgSize+1))
+			xcheckf(err, "copying message to temporary file")
+			if size > c.s.maxMsgSize {
+				xsetErrorf("tooLarge", "message too large")
+			}
+
+			var m store.Message
+			c.acc.WithRLock(func() {
+				var changes []store.Change
+				c.xdbwrite(func(tx *bstore.Tx) {
+					m, changes = c.xdeliver(tx, mbID, f, size, flags, keywords, received)
+				})
+				store.BroadcastChanges(c.acc, changes)
+			})
+			c.createdIDs[cid] = emailID(m.ID)
+			if resp.Created == nil {
+				resp.Created = map[string]any{}
+			}
+			resp.Created[cid] = emailCreated(m)
+		})
+		if err != nil {
+			if resp.NotCreated == nil {
+				resp.NotCreated = map[string]setError{}
+			}
+			resp.NotCreated[cid] = *err
+		}
+	}
+
+	c.xdbread(func(tx *bstore.Tx) {
+		resp.NewState = xemailState(tx)
+	})
+	return resp
+}
@@ -0,0 +1,184 @@
+package jmapserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/store"
+)
+
+// StateChange is sent over the event source when data has changed. ../rfc/8620:3460
+type StateChange struct {
+	Type    string                       `json:"@type"` // "StateChange"
+	Changed map[string]map[string]string `json:"changed"`
+}
+
+// changeTypes returns the JMAP data types affected by changes.
+func changeTypes(changes []store.Change) map[string]bool {
+	r := map[string]bool{}
+	for _, c := range changes {
+		switch c.(type) {
+		case store.ChangeAddUID:
+			r["Email"] = true
+			r["EmailDelivery"] = true
+			r["Thread"] = true
+			r["Mailbox"] = true
+		case store.ChangeRemoveUIDs:
+			r["Email"] = true
+			r["Thread"] = true
+			r["Mailbox"] = true
+		case store.ChangeFlags:
+			r["Email"] = true
+			r["Mailbox"] = true
+		case store.ChangeThread:
+			// Muted/collapsed threads are not visible in JMAP.
+		case store.ChangeRemoveMailbox, store.ChangeAddMailbox, store.ChangeRenameMailbox, store.ChangeAddSubscription, store.ChangeMailboxCounts, store.ChangeMailboxSpecialUse, store.ChangeMailboxKeywords:
+			r["Mailbox"] = true
+		}
+	}
+	return r
+}
+
+// serveEventSource sends StateChange events as server-sent events until the
+// client disconnects. ../rfc/8620:3540
+func (s server) serveEventSource(log mlog.Log, w http.ResponseWriter, r *http.Request, acc *store.Account) {
+	q := r.URL.Query()
+	var types []string // Nil means all types.
+	if t := q.Get("types"); t != "" && t != "*" {
+		types = strings.Split(t, ",")
+	}
+	closeAfter := q.Get("closeafter")
+	if closeAfter != "" && closeAfter != "state" && closeAfter != "no" {
+		http.Error(w, "400 - bad request - closeafter must be state or no", http.StatusBadRequest)
+		return
+	}
+	var ping time.Duration
+	if p := q.Get("ping"); p != "" {
+		v, err := strconv.ParseUint(p, 10, 32)
+		if err != nil {
+			http.Error(w, "400 - bad request - bad ping interval", http.StatusBadRequest)
+			return
+		}
+		ping = time.Duration(v) * time.Second
+		// We don't want to send pings too often.
+		if ping > 0 && ping < 10*time.Second {
+			ping = 10 * time.Second
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Error("internal error: ResponseWriter not a http.Flusher")
+		http.Error(w, "500 - internal error - cannot stream events", http.StatusInternalServerError)
+		return
+	}
+
+	comm := store.RegisterComm(acc)
+	defer comm.Unregister()
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	metricRequests.WithLabelValues("eventsource", "ok").Inc()
+
+	accID := accountID(acc.Name)
+	write := func(event string, v any) bool {
+		buf, err := json.Marshal(v)
+		if err != nil {
+			log.Errorx("marshal event", err)
+			return false
+		}
+		bw := bufio.NewWriter(w)
+		if _, err := fmt.Fprintf(bw, "event: %s\ndata: %s\n\n", event, buf); err != nil {
+			log.Debugx("write event", err)
+			return false
+		}
+		if err := bw.Flush(); err != nil {
+			log.Debugx("flush event", err)
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+
+	// states returns the current state strings for the changed types.
+	states := func(changed map[string]bool) (m map[string]string) {
+		defer func() {
+			x := recover()
+			if x == nil {
+				return
+			}
+			err, ok := x.(serverError)
+			if !ok {
+				panic(x)
+			}
+			log.Errorx("getting states for event", err)
+			m = nil
+		}()
+
+		m = map[string]string{}
+		err := acc.DB.Read(r.Context(), func(tx *bstore.Tx) error {
+			emailState := xemailState(tx)
+			for t := range changed {
+				if types != nil && !slices.Contains(types, t) {
+					continue
+				}
+				switch t {
+				case "Email", "Thread", "EmailDelivery":
+					m[t] = emailState
+				case "Mailbox":
+					m[t] = xmailboxes(tx).State()
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Errorx("getting states for event", err)
+		}
+		return m
+	}
+
+	var pingc <-chan time.Time
+	if ping > 0 {
+		ticker := time.NewTicker(ping)
+		defer ticker.Stop()
+		pingc = ticker.C
+	}
+
+	for {
+		select {
+		case <-mox.Shutdown.Done():
+			return
+
+		case <-r.Context().Done():
+			return
+
+		case <-pingc:
+			if !write("ping", map[string]int{"interval": int(ping / time.Second)}) {
+				return
+			}
+
+		case <-comm.Pending:
+			changed := states(changeTypes(comm.Get()))
+			if len(changed) == 0 {
+				continue
+			}
+			sc := StateChange{"StateChange", map[string]map[string]string{accID: changed}}
+			if !write("state", sc) || closeAfter == "state" {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,733 @@
+package jmapserver
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/store"
+)
+
+// MailboxRights are the permissions for a mailbox. ../rfc/8621:520
+type MailboxRights struct {
+	MayReadItems   bool `json:"mayReadItems"`
+	MayAddItems    bool `json:"mayAddItems"`
+	MayRemoveItems bool `json:"mayRemoveItems"`
+	MaySetSeen     bool `json:"maySetSeen"`
+	MaySetKeywords bool `json:"maySetKeywords"`
+	MayCreateChild bool `json:"mayCreateChild"`
+	MayRename      bool `json:"mayRename"`
+	MayDelete      bool `json:"mayDelete"`
+	MaySubmit      bool `json:"maySubmit"`
+}
+
+var mailboxProperties = []string{"id", "name", "parentId", "role", "sortOrder", "totalEmails", "unreadEmails", "totalThreads", "unreadThreads", "myRights", "isSubscribed"}
+
+// mailboxRole returns the JMAP role for a mailbox, or nil. ../rfc/8621:440
+func mailboxRole(mb store.Mailbox) *string {
+	var role string
+	switch {
+	case mb.Name == "Inbox":
+		role = "inbox"
+	case mb.Archive:
+		role = "archive"
+	case mb.Draft:
+		role = "drafts"
+	case mb.Junk:
+		role = "junk"
+	case mb.Sent:
+		role = "sent"
+	case mb.Trash:
+		role = "trash"
+	default:
+		return nil
+	}
+	return &role
+}
+
+// mailboxes holds all mailboxes and subscriptions of an account, for producing
+// JMAP Mailbox objects.
+type mailboxes struct {
+	List       []store.Mailbox // Sorted by name.
+	ByID       map[int64]store.Mailbox
+	ByName     map[string]store.Mailbox
+	Subscribed map[string]bool
+}
+
+func xmailboxes(tx *bstore.Tx) mailboxes {
+	mbl, err := bstore.QueryTx[store.Mailbox](tx).SortAsc("Name").List()
+	xcheckf(err, "listing mailboxes")
+	subl, err := bstore.QueryTx[store.Subscription](tx).List()
+	xcheckf(err, "listing subscriptions")
+
+	mbs := mailboxes{mbl, map[int64]store.Mailbox{}, map[string]store.Mailbox{}, map[string]bool{}}
+	for _, mb := range mbl {
+		mbs.ByID[mb.ID] = mb
+		mbs.ByName[mb.Name] = mb
+	}
+	for _, sub := range subl {
+		mbs.Subscribed[sub.Name] = true
+	}
+	return mbs
+}
+
+// State returns a hash over the mailboxes, used as Mailbox state string.
+func (mbs mailboxes) State() string {
+	h := sha256.New()
+	for _, mb := range mbs.List {
+		fmt.Fprintf(h, "%d %q %v %v %v\n", mb.ID, mb.Name, mb.SpecialUse, mb.MailboxCounts, mbs.Subscribed[mb.Name])
+	}
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:12])
+}
+
+// parentName returns the leaf name and the parent mailbox. The parent is the
+// closest existing mailbox with a name that is a prefix. If no such mailbox
+// exists, the parent is nil and the name is the full mailbox name.
+func (mbs mailboxes) parentName(mb store.Mailbox) (string, *store.Mailbox) {
+	for i := strings.LastIndex(mb.Name, "/"); i > 0; i = strings.LastIndex(mb.Name[:i], "/") {
+		if pmb, ok := mbs.ByName[mb.Name[:i]]; ok {
+			return mb.Name[i+1:], &pmb
+		}
+	}
+	return mb.Name, nil
+}
+
+// threadCounts holds the number of threads and unread threads for a mailbox.
+type threadCounts struct {
+	Total  int64
+	Unread int64
+}
+
+// xthreadCounts calculates the thread counts for all mailboxes.
+func xthreadCounts(tx *bstore.Tx) map[int64]threadCounts {
+	type key struct{ mailboxID, threadID int64 }
+	threads := map[key]bool{} // Value is whether thread has unread message in mailbox.
+	q := bstore.QueryTx[store.Message](tx)
+	q.FilterEqual("Expunged", false)
+	err := q.ForEach(func(m store.Message) error {
+		k := key{m.MailboxID, m.ThreadID}
+		threads[k] = threads[k] || !m.Seen && !m.Deleted
+		return nil
+	})
+	xcheckf(err, "listing messages for thread counts")
+
+	r := map[int64]threadCounts{}
+	for k, unread := range threads {
+		tc := r[k.mailboxID]
+		tc.Total++
+		if unread {
+			tc.Unread++
+		}
+		r[k.mailboxID] = tc
+	}
+	return r
+}
+
+// object returns the JMAP Mailbox object. Thread counts are only used if not nil.
+func (mbs mailboxes) object(mb store.Mailbox, tc map[int64]threadCounts) map[string]any {
+	name, parent := mbs.parentName(mb)
+	var parentID *string
+	if parent != nil {
+		pid := mailboxID(parent.ID)
+		parentID = &pid
+	}
+	isInbox := mb.Name == "Inbox"
+	obj := map[string]any{
+		"id":           mailboxID(mb.ID),
+		"name":         name,
+		"parentId":     parentID,
+		"role":         mailboxRole(mb),
+		"sortOrder":    0,
+		"totalEmails":  mb.Total,
+		"unreadEmails": mb.Unread,
+		"myRights": MailboxRights{
+			MayReadItems:   true,
+			MayAddItems:    true,
+			MayRemoveItems: true,
+			MaySetSeen:     true,
+			MaySetKeywords: true,
+			MayCreateChild: true,
+			MayRename:      !isInbox,
+			MayDelete:      !isInbox,
+			MaySubmit:      true,
+		},
+		"isSubscribed": mbs.Subscribed[mb.Name],
+	}
+	if tc != nil {
+		obj["totalThreads"] = tc[mb.ID].Total
+		obj["unreadThreads"] = tc[mb.ID].Unread
+	}
+	return obj
+}
+
+// pick returns an object with only the requested properties.
+func pick(obj map[string]any, props []string) map[string]any {
+	r := make(map[string]any, len(props))
+	for _, p := range props {
+		if v, ok := obj[p]; ok {
+			r[p] = v
+		}
+	}
+	return r
+}
+
+func (c *call) mailboxGet(args json.RawMessage) any {
+	var req getArgs
+	c.xparseArgs(args, &req)
+	c.xcheckGetArgs(req)
+	props := properties(req.Properties, mailboxProperties, mailboxProperties)
+
+	resp := struct {
+		AccountID string           `json:"accountId"`
+		State     string           `json:"state"`
+		List      []map[string]any `json:"list"`
+		NotFound  []string         `json:"notFound"`
+	}{c.accountID, "", []map[string]any{}, []string{}}
+
+	c.xdbread(func(tx *bstore.Tx) {
+		mbs := xmailboxes(tx)
+		resp.State = mbs.State()
+
+		var tc map[int64]threadCounts
+		if slices.Contains(props, "totalThreads") || slices.Contains(props, "unreadThreads") {
+			tc = xthreadCounts(tx)
+		}
+
+		if req.IDs == nil {
+			for _, mb := range mbs.List {
+				resp.List = append(resp.List, pick(mbs.object(mb, tc), props))
+			}
+			return
+		}
+		for _, id := range *req.IDs {
+			mbID, ok := parseID('m', c.resolveID(id))
+			mb, found := mbs.ByID[mbID]
+			if !ok || !found {
+				resp.NotFound = append(resp.NotFound, id)
+				continue
+			}
+			resp.List = append(resp.List, pick(mbs.object(mb, tc), props))
+		}
+	})
+	return resp
+}
+
+func (c *call) mailboxChanges(args json.RawMessage) any {
+	var req changesArgs
+	c.xparseArgs(args, &req)
+	c.xcheckAccount(req.AccountID)
+
+	var state string
+	c.xdbread(func(tx *bstore.Tx) {
+		state = xmailboxes(tx).State()
+	})
+	// We don't keep a history of mailbox changes. Clients will have to fetch all
+	// mailboxes again. ../rfc/8620:1720
+	if req.SinceState != state {
+		xmethodErrorf("cannotCalculateChanges", "mailbox changes cannot be calculated, fetch all mailboxes")
+	}
+	return changesResponse{c.accountID, state, state, false, []string{}, []string{}, []string{}}
+}
+
+// mailboxFilter is a FilterCondition or FilterOperator for Mailbox/query.
+// ../rfc/8621:720
+type mailboxFilter struct {
+	Operator   string          `json:"operator"`
+	Conditions []mailboxFilter `json:"conditions"`
+
+	ParentID     *json.RawMessage `json:"parentId"` // Can be null to match top-level mailboxes.
+	Name         *string          `json:"name"`
+	Role         *json.RawMessage `json:"role"` // Can be null to match mailboxes without role.
+	HasAnyRole   *bool            `json:"hasAnyRole"`
+	IsSubscribed *bool            `json:"isSubscribed"`
+}
+
+func (c *call) xmailboxMatch(f mailboxFilter, mbs mailboxes, mb store.Mailbox) bool {
+	if f.Operator != "" {
+		switch f.Operator {
+		case "AND":
+			for _, sf := range f.Conditions {
+				if !c.xmailboxMatch(sf, mbs, mb) {
+					return false
+				}
+			}
+			return true
+		case "OR":
+			for _, sf := range f.Conditions {
+				if c.xmailboxMatch(sf, mbs, mb) {
+					return true
+				}
+			}
+			return false
+		case "NOT":
+			for _, sf := range f.Conditions {
+				if c.xmailboxMatch(sf, mbs, mb) {
+					return false
+				}
+			}
+			return true
+		default:
+			xmethodErrorf("unsupportedFilter", "unknown operator %q", f.Operator)
+		}
+	}
+
+	name, parent := mbs.parentName(mb)
+	if f.ParentID != nil {
+		var pid *string
+		if err := json.Unmarshal(*f.ParentID, &pid); err != nil {
+			xmethodErrorf("invalidArguments", "parsing parentId: %v", err)
+		}
+		if pid == nil && parent != nil || pid != nil && (parent == nil || mailboxID(parent.ID) != c.resolveID(*pid)) {
+			return false
+		}
+	}
+	if f.Name != nil && !strings.Contains(strings.ToLower(name), strings.ToLower(*f.Name)) {
+		return false
+	}
+	role := mailboxRole(mb)
+	if f.Role != nil {
+		var xrole *string
+		if err := json.Unmarshal(*f.Role, &xrole); err != nil {
+			xmethodErrorf("invalidArguments", "parsing role: %v", err)
+		}
+		if xrole == nil && role != nil || xrole != nil && (role == nil || *role != *xrole) {
+			return false
+		}
+	}
+	if f.HasAnyRole != nil && *f.HasAnyRole != (role != nil) {
+		return false
+	}
+	if f.IsSubscribed != nil && *f.IsSubscribed != mbs.Subscribed[mb.Name] {
+		return false
+	}
+	return true
+}
+
+// comparator is a sort criterium for /query. ../rfc/8620:2260
+type comparator struct {
+	Property    string  `json:"property"`
+	IsAscending *bool   `json:"isAscending"`
+	Collation   string  `json:"collation"`
+	Keyword     *string `json:"keyword"` // For Email sort by keywords.
+}
+
+func (c comparator) ascending() bool {
+	return c.IsAscending == nil || *c.IsAscending
+}
+
+// queryResponse is the response for /query methods. ../rfc/8620:2330
+type queryResponse struct {
+	AccountID           string   `json:"accountId"`
+	QueryState          string   `json:"queryState"`
+	CanCalculateChanges bool     `json:"canCalculateChanges"`
+	Position            int      `json:"position"`
+	IDs                 []string `json:"ids"`
+	Total               *int     `json:"total,omitempty"`
+	Limit               *int     `json:"limit,omitempty"`
+}
+
+// xqueryWindow selects the ids for the response based on position, anchor and
+// limit. ../rfc/8620:2290
+func xqueryWindow(ids []string, position int, anchor *string, anchorOffset int, limit *int, calculateTotal bool) (resp queryResponse) {
+	if anchor != nil {
+		i := slices.Index(ids, *anchor)
+		if i < 0 {
+			xmethodErrorf("anchorNotFound", "anchor not in results")
+		}
+		position = i + anchorOffset
+		if position < 0 {
+			position = 0
+		}
+	} else if position < 0 {
+		position += len(ids)
+		if position < 0 {
+			position = 0
+		}
+	}
+	if position > len(ids) {
+		position = len(ids)
+	}
+	end := len(ids)
+	if limit != nil {
+		if *limit < 0 {
+			xmethodErrorf("invalidArguments", "limit must not be negative")
+		}
+		if position+*limit < end {
+			end = position + *limit
+		}
+	}
+	resp.Position = position
+	resp.IDs = ids[position:end]
+	if calculateTotal {
+		n := len(ids)
+		resp.Total = &n
+	}
+	return
+}
+
+func (c *call) mailboxQuery(args json.RawMessage) any {
+	var req struct {
+		AccountID      string         `json:"accountId"`
+		Filter         *mailboxFilter `json:"filter"`
+		Sort           []comparator   `json:"sort"`
+		Position       int            `json:"position"`
+		Anchor         *string        `json:"anchor"`
+		AnchorOffset   int            `json:"anchorOffset"`
+		Limit          *int           `json:"limit"`
+		CalculateTotal bool           `json:"calculateTotal"`
+		SortAsTree     bool           `json:"sortAsTree"`
+		FilterAsTree   bool           `json:"filterAsTree"`
+	}
+	c.xparseArgs(args, &req)
+	c.xcheckAccount(req.AccountID)
+
+	var mbs mailboxes
+	c.xdbread(func(tx *bstore.Tx) {
+		mbs = xmailboxes(tx)
+	})
+
+	var l []store.Mailbox
+	for _, mb := range mbs.List {
+		if req.Filter == nil || c.xmailboxMatch(*req.Filter, mbs, mb) {
+			l = append(l, mb)
+		}
+	}
+	// With filterAsTree, mailboxes are only included if all their parents are included too.
+	if req.FilterAsTree && req.Filter != nil {
+		included := map[int64]bool{}
+		for _, mb := range l {
+			included[mb.ID] = true
+		}
+		var nl []store.Mailbox
+		for _, mb := range l {
+			ok := true
+			for xmb := mb; ok; {
+				_, parent := mbs.parentName(xmb)
+				if parent == nil {
+					break
+				}
+				ok = included[parent.ID]
+				xmb = *parent
+			}
+			if ok {
+				nl = append(nl, mb)
+			}
+		}
+		l = nl
+	}
+
+	for _, cmp := range req.Sort {
+		if cmp.Property != "name" && cmp.Property != "sortOrder" {
+			xmethodErrorf("unsupportedSort", "cannot sort on %q", cmp.Property)
+		}
+	}
+	// Sort orders are all 0, so only name is relevant. If sorting as tree, we compare
+	// by the path elements, so children follow their parents. Otherwise by the leaf
+	// name.
+	asc := true
+	for _, cmp := range req.Sort {
+		if cmp.Property == "name" {
+			asc = cmp.ascending()
+			break
+		}
+	}
+	sort.SliceStable(l, func(i, j int) bool {
+		var a, b string
+		if req.SortAsTree {
+			a, b = l[i].Name, l[j].Name
+			// Compare per path element, so "a/b" sorts before "a b".
+			ae, be := strings.Split(a, "/"), strings.Split(b, "/")
+			for k := 0; k < len(ae) && k < len(be); k++ {
+				if ae[k] != be[k] {
+					return ae[k] < be[k] == asc
+				}
+			}
+			return len(ae) < len(be)
+		}
+		a, _ = mbs.parentName(l[i])
+		b, _ = mbs.parentName(l[j])
+		if a == b {
+			return false
+		}
+		return a < b == asc
+	})
+
+	ids := make([]string, len(l))
+	for i, mb := range l {
+		ids[i] = mailboxID(mb.ID)
+	}
+	resp := xqueryWindow(ids, req.Position, req.Anchor, req.AnchorOffset, req.Limit, req.CalculateTotal)
+	resp.AccountID = c.accountID
+	resp.QueryState = mbs.State()
+	return resp
+}
+
+// mailboxCreate holds the properties of a mailbox to create or update.
+type mailboxCreate struct {
+	Name         *string          `json:"name"`
+	ParentID     *json.RawMessage `json:"parentId"`
+	Role         *json.RawMessage `json:"role"`
+	SortOrder    *int             `json:"sortOrder"`
+	IsSubscribed *bool            `json:"isSubscribed"`
+}
+
+func (c *call) mailboxSet(args json.RawMessage) any {
+	var req struct {
+		setArgs
+		OnDestroyRemoveEmails bool `json:"onDestroyRemoveEmails"`
+	}
+	c.xparseArgs(args, &req)
+	c.xcheckSetArgs(req.setArgs)
+
+	resp := setResponse{AccountID: c.accountID}
+
+	// Messages to remove after having broadcasted the removal of mailboxes.
+	var removeMessageIDs []int64
+
+	c.acc.WithWLock(func() {
+		var changes []store.Change
+
+		c.xdbwrite(func(tx *bstore.Tx) {
+			mbs := xmailboxes(tx)
+			oldState := mbs.State()
+			resp.OldState = &oldState
+			if req.IfInState != nil && *req.IfInState != oldState {
+				xmethodErrorf("stateMismatch", "mailbox state does not match ifInState")
+			}
+
+			// xparentName returns the full mailbox name for a new leaf name and parent id.
+			xfullName := func(name string, parentID *json.RawMessage, curParent *store.Mailbox) string {
+				if name == "" || strings.Contains(name, "/") {
+					xinvalidProperties("name must be non-empty and cannot contain a slash", "name")
+				}
+				parent := curParent
+				if parentID != nil {
+					var pid *string
+					if err := json.Unmarshal(*parentID, &pid); err != nil {
+						xinvalidProperties("bad parentId", "parentId")
+					}
+					parent = nil
+					if pid != nil {
+						id, ok := parseID('m', c.resolveID(*pid))
+						pmb, found := mbs.ByID[id]
+						if !ok || !found {
+							xinvalidProperties("unknown parent mailbox", "parentId")
+						}
+						parent = &pmb
+					}
+				}
+				full := name
+				if parent != nil {
+					full = parent.Name + "/" + name
+				}
+				norm, _, err := store.CheckMailboxName(full, true)
+				if err != nil {
+					xinvalidProperties(err.Error(), "name")
+				}
+				return norm
+			}
+			xcheckRole := func(role *json.RawMessage, mb *store.Mailbox) {
+				if role == nil {
+					return
+				}
+				var r *string
+				if err := json.Unmarshal(*role, &r); err != nil {
+					xinvalidProperties("bad role", "role")
+				}
+				var cur *string
+				if mb != nil {
+					cur = mailboxRole(*mb)
+				}
+				if r == nil && cur == nil || r != nil && cur != nil && *r == *cur {
+					return
+				}
+				// todo: allow changing special-use flags through roles.
+				xinvalidProperties("changing role not supported", "role")
+			}
+			xsubscribe := func(name string, subscribe bool) {
+				if subscribe {
+					nchanges, err := c.acc.SubscriptionEnsure(tx, name)
+					xcheckf(err, "ensuring subscription")
+					changes = append(changes, nchanges...)
+				} else {
+					err := tx.Delete(&store.Subscription{Name: name})
+					if err != nil && !errors.Is(err, bstore.ErrAbsent) {
+						xcheckf(err, "removing subscription")
+					}
+				}
+			}
+
+			for cid, buf := range req.Create {
+				err := trySet(func() {
+					var mc mailboxCreate
+					dec := json.NewDecoder(strings.NewReader(string(buf)))
+					dec.DisallowUnknownFields()
+					if err := dec.Decode(&mc); err != nil {
+						xinvalidProperties(err.Error())
+					}
+					if mc.Name == nil {
+						xinvalidProperties("name required", "name")
+					}
+					name := xfullName(*mc.Name, mc.ParentID, nil)
+					xcheckRole(mc.Role, nil)
+					if _, ok := mbs.ByName[name]; ok {
+						xinvalidProperties("mailbox already exists", "name")
+					}
+
+					nchanges, _, exists, err := c.acc.MailboxCreate(tx, name)
+					if exists {
+						xinvalidProperties("mailbox already exists", "name")
+					}
+					xcheckf(err, "creating mailbox")
+					changes = append(changes, nchanges...)
+					if mc.IsSubscribed != nil && !*mc.IsSubscribed {
+						xsubscribe(name, false)
+					}
+
+					mb, err := c.acc.MailboxFind(tx, name)
+					xcheckf(err, "looking up new mailbox")
+					if mb == nil {
+						xcheckf(errors.New("not found"), "looking up new mailbox")
+					}
+					// Refresh, parents may have been created too.
+					mbs = xmailboxes(tx)
+					id := mailboxID(mb.ID)
+					c.createdIDs[cid] = id
+					obj := mbs.object(*mb, nil)
+					resp.addCreated(cid, pick(obj, []string{"id", "totalEmails", "unreadEmails", "myRights", "isSubscribed", "sortOrder"}))
+				})
+				if err != nil {
+					resp.addNotCreated(cid, *err)
+				}
+			}
+
+			for id, buf := range req.Update {
+				err := trySet(func() {
+					mbID, ok := parseID('m', c.resolveID(id))
+					mb, found := mbs.ByID[mbID]
+					if !ok || !found {
+						xsetErrorf("notFound", "mailbox not found")
+					}
+					full, sub := xparsePatch(buf)
+					if len(sub) > 0 {
+						xsetErrorf("invalidPatch", "patching mailbox properties not supported")
+					}
+					var mc mailboxCreate
+					fbuf, err := json.Marshal(full)
+					xcheckf(err, "marshal patch")
+					dec := json.NewDecoder(strings.NewReader(string(fbuf)))
+					dec.DisallowUnknownFields()
+					if err := dec.Decode(&mc); err != nil {
+						xinvalidProperties(err.Error())
+					}
+					xcheckRole(mc.Role, &mb)
+
+					if mc.Name != nil || mc.ParentID != nil {
+						name, parent := mbs.parentName(mb)
+						if mc.Name != nil {
+							name = *mc.Name
+						}
+						dst := xfullName(name, mc.ParentID, parent)
+						if dst != mb.Name {
+							if mb.Name == "Inbox" {
+								xsetErrorf("forbidden", "inbox cannot be renamed")
+							}
+							if strings.HasPrefix(dst, mb.Name+"/") {
+								xinvalidProperties("cannot move mailbox into its own child", "parentId")
+							}
+							if _, ok := mbs.ByName[dst]; ok {
+								xinvalidProperties("mailbox already exists", "name")
+							}
+							nchanges, _, _, alreadyExists, err := c.acc.MailboxRename(tx, mb, dst)
+							if alreadyExists {
+								xinvalidProperties("mailbox already exists", "name")
+							}
+							xcheckf(err, "renaming mailbox")
+							changes = append(changes, nchanges...)
+							mbs = xmailboxes(tx)
+							mb = mbs.ByID[mb.ID]
+						}
+					}
+					if mc.IsSubscribed != nil && *mc.IsSubscribed != mbs.Subscribed[mb.Name] {
+						xsubscribe(mb.Name, *mc.IsSubscribed)
+						mbs.Subscribed[mb.Name] = *mc.IsSubscribed
+					}
+					resp.addUpdated(id, nil)
+				})
+				if err != nil {
+					resp.addNotUpdated(id, *err)
+				}
+			}
+
+			var removedMessages bool
+			for _, id := range req.Destroy {
+				err := trySet(func() {
+					mbID, ok := parseID('m', c.resolveID(id))
+					mb, found := mbs.ByID[mbID]
+					if !ok || !found {
+						xsetErrorf("notFound", "mailbox not found")
+					}
+					if mb.Name == "Inbox" {
+						xsetErrorf("forbidden", "inbox cannot be removed")
+					}
+					if mb.Total+mb.Deleted > 0 && !req.OnDestroyRemoveEmails {
+						xsetErrorf("mailboxHasEmail", "mailbox has messages")
+					}
+					nchanges, removeIDs, hasChildren, err := c.acc.MailboxDelete(c.ctx, c.log, tx, mb)
+					if hasChildren {
+						xsetErrorf("mailboxHasChild", "mailbox has child mailboxes")
+					}
+					xcheckf(err, "removing mailbox")
+					changes = append(changes, nchanges...)
+					removeMessageIDs = append(removeMessageIDs, removeIDs...)
+					removedMessages = removedMessages || len(removeIDs) > 0
+					err = tx.Delete(&store.Subscription{Name: mb.Name})
+					if err != nil && !errors.Is(err, bstore.ErrAbsent) {
+						xcheckf(err, "removing subscription")
+					}
+					delete(mbs.ByID, mb.ID)
+					delete(mbs.ByName, mb.Name)
+					resp.Destroyed = append(resp.Destroyed, id)
+				})
+				if err != nil {
+					resp.addNotDestroyed(id, *err)
+				}
+			}
+
+			// Messages of removed mailboxes are removed from the database, not marked as
+			// expunged. We can no longer report them as destroyed in Email/changes, so
+			// clients with an older state must resynchronize.
+			if removedMessages {
+				modseq, err := c.acc.NextModSeq(tx)
+				xcheckf(err, "next modseq")
+				ss := store.SyncState{ID: 1}
+				err = tx.Get(&ss)
+				xcheckf(err, "get sync state")
+				ss.HighestDeletedModSeq = modseq
+				err = tx.Update(&ss)
+				xcheckf(err, "update sync state")
+			}
+
+			resp.NewState = xmailboxes(tx).State()
+		})
+
+		store.BroadcastChanges(c.acc, changes)
+	})
+
+	for _, mID := range removeMessageIDs {
+		p := c.acc.MessagePath(mID)
+		err := os.Remove(p)
+		c.log.Check(err, "removing message file for mailbox delete", slog.String("path", p))
+	}
+
+	return resp
+}
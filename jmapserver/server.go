@@ -0,0 +1,650 @@
+// Package jmapserver implements a JMAP server, the JSON Meta Application
+// Protocol, for accessing and submitting email over HTTP.
+//
+// Implemented are JMAP Core (RFC 8620) with the session resource, API requests
+// with result references, blob upload/download and an event source for push
+// notifications, and JMAP Mail (RFC 8621) with the Mailbox, Email, Thread,
+// Identity and EmailSubmission data types.
+//
+// State strings for emails and threads are based on the per-account modification
+// sequence (ModSeq) of messages, so changes can be calculated. Mailbox states are
+// a hash over the mailboxes; for mailboxes only the full list is resent by
+// clients after a change.
+//
+// A message in mox is always in exactly one mailbox, so an Email has exactly one
+// entry in mailboxIds.
+package jmapserver
+
+// todo: implement push subscriptions (web push), ../rfc/8620:3700
+// todo: implement Email/parse, SearchSnippet/get, VacationResponse.
+// todo: implement Email/copy between accounts, when we have shared accounts.
+// todo: calculate query changes (Email/queryChanges), possibly by keeping query results for a while.
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/message"
+	"github.com/mjl-/mox/metrics"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/moxio"
+	"github.com/mjl-/mox/store"
+	"github.com/mjl-/mox/webauth"
+)
+
+var pkglog = mlog.New("jmapserver", nil)
+
+var (
+	metricRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mox_jmap_requests_total",
+			Help: "JMAP HTTP requests by endpoint and result.",
+		},
+		[]string{
+			"endpoint", // session, api, download, upload, eventsource
+			"result",   // ok, badauth, error
+		},
+	)
+	metricMethods = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mox_jmap_method_results_total",
+			Help: "JMAP method call results by method and result (ok or error type).",
+		},
+		[]string{"method", "result"},
+	)
+	metricSubmission = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mox_jmap_submission_total",
+			Help: "JMAP message submission results, known values (those ending with error are server errors): ok, badfrom, messagelimiterror, recipientlimiterror, queueerror.",
+		},
+		[]string{
+			"result",
+		},
+	)
+	metricServerErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mox_jmap_errors_total",
+			Help: "JMAP server errors, known values: dkimsign, submit.",
+		},
+		[]string{
+			"error",
+		},
+	)
+)
+
+// Capability URNs.
+const (
+	capCore       = "urn:ietf:params:jmap:core"       // ../rfc/8620:660
+	capMail       = "urn:ietf:params:jmap:mail"       // ../rfc/8621:243
+	capSubmission = "urn:ietf:params:jmap:submission" // ../rfc/8621:342
+)
+
+// Limits, announced in the session resource.
+const (
+	maxSizeRequest        = 10 * 1024 * 1024
+	maxConcurrentUpload   = 4
+	maxConcurrentRequests = 4
+	maxCallsInRequest     = 32
+	maxObjectsInGet       = 1000
+	maxObjectsInSet       = 1000
+)
+
+// How long uploaded blobs are kept around. The RFC recommends at least an hour. ../rfc/8620:2460
+const uploadExpiration = 2 * time.Hour
+
+func init() {
+	mox.NewJMAPHandler = func(maxMsgSize int64, basePath string, isForwarded bool) http.Handler {
+		return NewServer(maxMsgSize, basePath, isForwarded)
+	}
+}
+
+// NewServer returns a new http.Handler for a JMAP server. The handler expects the
+// path prefix to be stripped by the caller, i.e. the session resource is at "/".
+func NewServer(maxMsgSize int64, path string, isForwarded bool) http.Handler {
+	return server{maxMsgSize, path, isForwarded}
+}
+
+// server serves the JMAP session resource, API, blob upload/download and event
+// source.
+type server struct {
+	maxMsgSize  int64  // Of uploaded and submitted messages.
+	path        string // Path JMAP is configured under, typically /jmap/.
+	isForwarded bool   // Whether incoming requests are reverse-proxied. Used for getting remote IPs for rate limiting, and for the scheme of URLs in the session.
+}
+
+// upload is a blob uploaded by a client, typically a message to import or an
+// attachment for a new email. Uploads are stored in temporary files and
+// kept in memory for a limited time.
+type upload struct {
+	Account string
+	Path    string
+	Type    string
+	Size    int64
+	Expires time.Time
+}
+
+var uploads = struct {
+	sync.Mutex
+	m map[string]upload // By blob id.
+}{m: map[string]upload{}}
+
+// uploadsCleanup removes expired uploads. Must be called with uploads locked.
+func uploadsCleanup(log mlog.Log) {
+	now := time.Now()
+	for id, u := range uploads.m {
+		if now.After(u.Expires) {
+			err := os.Remove(u.Path)
+			log.Check(err, "removing expired jmap upload", slog.String("path", u.Path))
+			delete(uploads.m, id)
+		}
+	}
+}
+
+// uploadGet returns an upload for the account, if it exists.
+func uploadGet(log mlog.Log, accName, blobID string) (upload, bool) {
+	uploads.Lock()
+	defer uploads.Unlock()
+	uploadsCleanup(log)
+	u, ok := uploads.m[blobID]
+	if !ok || u.Account != accName {
+		return upload{}, false
+	}
+	return u, true
+}
+
+// accountID returns the JMAP account id for an account name.
+func accountID(name string) string {
+	return "a" + base64.RawURLEncoding.EncodeToString([]byte(name))
+}
+
+// ServeHTTP implements http.Handler.
+func (s server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log := pkglog.WithContext(r.Context()) // Take cid from webserver.
+
+	var endpoint string
+	switch {
+	case r.URL.Path == "/" || r.URL.Path == "/session":
+		endpoint = "session"
+	case r.URL.Path == "/api":
+		endpoint = "api"
+	case strings.HasPrefix(r.URL.Path, "/download/"):
+		endpoint = "download"
+	case strings.HasPrefix(r.URL.Path, "/upload/"):
+		endpoint = "upload"
+	case r.URL.Path == "/eventsource":
+		endpoint = "eventsource"
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	log = log.With(slog.String("endpoint", endpoint))
+
+	acc, loginAddress, ok := s.authenticate(log, w, r, endpoint)
+	if !ok {
+		return
+	}
+	defer func() {
+		err := acc.Close()
+		log.Check(err, "closing account")
+	}()
+	log = log.With(slog.String("account", acc.Name))
+
+	switch endpoint {
+	case "session":
+		if r.Method != "GET" {
+			http.Error(w, "405 - method not allowed - use get", http.StatusMethodNotAllowed)
+			return
+		}
+		s.serveSession(log, w, r, acc, loginAddress)
+	case "api":
+		if r.Method != "POST" {
+			http.Error(w, "405 - method not allowed - use post", http.StatusMethodNotAllowed)
+			return
+		}
+		s.serveAPI(log, w, r, acc, loginAddress)
+	case "download":
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "405 - method not allowed - use get", http.StatusMethodNotAllowed)
+			return
+		}
+		s.serveDownload(log, w, r, acc)
+	case "upload":
+		if r.Method != "POST" {
+			http.Error(w, "405 - method not allowed - use post", http.StatusMethodNotAllowed)
+			return
+		}
+		s.serveUpload(log, w, r, acc)
+	case "eventsource":
+		if r.Method != "GET" {
+			http.Error(w, "405 - method not allowed - use get", http.StatusMethodNotAllowed)
+			return
+		}
+		s.serveEventSource(log, w, r, acc)
+	}
+}
+
+// authenticate checks the HTTP basic authentication credentials, returning an
+// open account on success. On failure, a response has been written.
+func (s server) authenticate(log mlog.Log, w http.ResponseWriter, r *http.Request, endpoint string) (acc *store.Account, loginAddress string, ok bool) {
+	email, password, aok := r.BasicAuth()
+	if !aok {
+		metricRequests.WithLabelValues(endpoint, "badauth").Inc()
+		log.Debug("missing http basic authentication credentials")
+		w.Header().Set("WWW-Authenticate", `Basic realm="jmap"`)
+		http.Error(w, "401 - unauthorized - use http basic auth with email address as username", http.StatusUnauthorized)
+		return nil, "", false
+	}
+	log = log.With(slog.String("username", email))
+
+	t0 := time.Now()
+
+	// If remote IP/network resulted in too many authentication failures, refuse to serve.
+	remoteIP := webauth.RemoteIP(log, s.isForwarded, r)
+	if remoteIP == nil {
+		metricRequests.WithLabelValues(endpoint, "error").Inc()
+		log.Debug("cannot find remote ip for rate limiter")
+		http.Error(w, "500 - internal server error - cannot find remote ip", http.StatusInternalServerError)
+		return nil, "", false
+	}
+	if !mox.LimiterFailedAuth.CanAdd(remoteIP, t0, 1) {
+		metrics.AuthenticationRatelimitedInc("jmap")
+		log.Debug("refusing connection due to many auth failures", slog.Any("remoteip", remoteIP))
+		http.Error(w, "429 - too many auth attempts", http.StatusTooManyRequests)
+		return nil, "", false
+	}
+
+	authResult := "error"
+	defer func() {
+		metrics.AuthenticationInc("jmap", "httpbasic", authResult)
+	}()
+
+	acc, err := store.OpenEmailAuth(log, email, password, "")
+	if err != nil {
+		mox.LimiterFailedAuth.Add(remoteIP, t0, 1)
+		if errors.Is(err, mox.ErrDomainNotFound) || errors.Is(err, mox.ErrAddressNotFound) || errors.Is(err, store.ErrUnknownCredentials) {
+			log.Debug("bad http basic authentication credentials")
+			metricRequests.WithLabelValues(endpoint, "badauth").Inc()
+			authResult = "badcreds"
+			w.Header().Set("WWW-Authenticate", `Basic realm="jmap"`)
+			http.Error(w, "401 - unauthorized - use http basic auth with email address as username", http.StatusUnauthorized)
+			return nil, "", false
+		}
+		log.Errorx("open account", err)
+		metricRequests.WithLabelValues(endpoint, "error").Inc()
+		http.Error(w, "500 - internal server error - error verifying credentials", http.StatusInternalServerError)
+		return nil, "", false
+	}
+	authResult = "ok"
+	mox.LimiterFailedAuth.Reset(remoteIP, t0)
+	return acc, email, true
+}
+
+// baseURL returns the absolute URL JMAP is served under, ending with a slash.
+func (s server) baseURL(r *http.Request) string {
+	scheme := "http"
+	if s.isForwarded && r.Header.Get("X-Forwarded-Proto") == "https" || !s.isForwarded && r.TLS != nil {
+		scheme = "https"
+	}
+	host := r.Host
+	if s.isForwarded && r.Header.Get("X-Forwarded-Host") != "" {
+		host = r.Header.Get("X-Forwarded-Host")
+	}
+	return scheme + "://" + host + s.path
+}
+
+// Session is the JMAP session resource. ../rfc/8620:610
+type Session struct {
+	Capabilities    map[string]any     `json:"capabilities"`
+	Accounts        map[string]Account `json:"accounts"`
+	PrimaryAccounts map[string]string  `json:"primaryAccounts"`
+	Username        string             `json:"username"`
+	APIURL          string             `json:"apiUrl"`
+	DownloadURL     string             `json:"downloadUrl"`
+	UploadURL       string             `json:"uploadUrl"`
+	EventSourceURL  string             `json:"eventSourceUrl"`
+	State           string             `json:"state"`
+}
+
+// Account as listed in the session.
+type Account struct {
+	Name                string         `json:"name"`
+	IsPersonal          bool           `json:"isPersonal"`
+	IsReadOnly          bool           `json:"isReadOnly"`
+	AccountCapabilities map[string]any `json:"accountCapabilities"`
+}
+
+// CoreCapabilities are the limits of the server. ../rfc/8620:680
+type CoreCapabilities struct {
+	MaxSizeUpload         int64    `json:"maxSizeUpload"`
+	MaxConcurrentUpload   int      `json:"maxConcurrentUpload"`
+	MaxSizeRequest        int64    `json:"maxSizeRequest"`
+	MaxConcurrentRequests int      `json:"maxConcurrentRequests"`
+	MaxCallsInRequest     int      `json:"maxCallsInRequest"`
+	MaxObjectsInGet       int      `json:"maxObjectsInGet"`
+	MaxObjectsInSet       int      `json:"maxObjectsInSet"`
+	CollationAlgorithms   []string `json:"collationAlgorithms"`
+}
+
+// MailCapabilities describes the mail functionality for an account. ../rfc/8621:256
+type MailCapabilities struct {
+	MaxMailboxesPerEmail       *int     `json:"maxMailboxesPerEmail"`
+	MaxMailboxDepth            *int     `json:"maxMailboxDepth"`
+	MaxSizeMailboxName         int      `json:"maxSizeMailboxName"`
+	MaxSizeAttachmentsPerEmail int64    `json:"maxSizeAttachmentsPerEmail"`
+	EmailQuerySortOptions      []string `json:"emailQuerySortOptions"`
+	MayCreateTopLevelMailbox   bool     `json:"mayCreateTopLevelMailbox"`
+}
+
+// SubmissionCapabilities describes the submission functionality for an account.
+// ../rfc/8621:346
+type SubmissionCapabilities struct {
+	MaxDelayedSend       int                 `json:"maxDelayedSend"`
+	SubmissionExtensions map[string][]string `json:"submissionExtensions"`
+}
+
+func (s server) session(r *http.Request, acc *store.Account, loginAddress string) Session {
+	one := 1
+	accID := accountID(acc.Name)
+	base := s.baseURL(r)
+	sess := Session{
+		Capabilities: map[string]any{
+			capCore: CoreCapabilities{
+				MaxSizeUpload:         s.maxMsgSize,
+				MaxConcurrentUpload:   maxConcurrentUpload,
+				MaxSizeRequest:        maxSizeRequest,
+				MaxConcurrentRequests: maxConcurrentRequests,
+				MaxCallsInRequest:     maxCallsInRequest,
+				MaxObjectsInGet:       maxObjectsInGet,
+				MaxObjectsInSet:       maxObjectsInSet,
+				CollationAlgorithms:   []string{"i;ascii-casemap", "i;unicode-casemap"},
+			},
+			capMail:       struct{}{},
+			capSubmission: struct{}{},
+		},
+		Accounts: map[string]Account{
+			accID: {
+				Name:       loginAddress,
+				IsPersonal: true,
+				IsReadOnly: false,
+				AccountCapabilities: map[string]any{
+					capMail: MailCapabilities{
+						MaxMailboxesPerEmail:       &one,
+						MaxSizeMailboxName:         255,
+						MaxSizeAttachmentsPerEmail: s.maxMsgSize,
+						EmailQuerySortOptions:      emailSortProperties,
+						MayCreateTopLevelMailbox:   true,
+					},
+					capSubmission: SubmissionCapabilities{
+						SubmissionExtensions: map[string][]string{},
+					},
+				},
+			},
+		},
+		PrimaryAccounts: map[string]string{
+			capMail:       accID,
+			capSubmission: accID,
+		},
+		Username:       loginAddress,
+		APIURL:         base + "api",
+		DownloadURL:    base + "download/{accountId}/{blobId}/{name}?accept={type}",
+		UploadURL:      base + "upload/{accountId}/",
+		EventSourceURL: base + "eventsource?types={types}&closeafter={closeafter}&ping={ping}",
+	}
+	buf, err := json.Marshal(sess)
+	if err != nil {
+		panic(fmt.Sprintf("marshal session: %v", err))
+	}
+	h := sha256.Sum256(buf)
+	sess.State = base64.RawURLEncoding.EncodeToString(h[:12])
+	return sess
+}
+
+func (s server) serveSession(log mlog.Log, w http.ResponseWriter, r *http.Request, acc *store.Account, loginAddress string) {
+	sess := s.session(r, acc, loginAddress)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache, max-age=0")
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(sess)
+	if err != nil && !moxio.IsClosed(err) {
+		log.Errorx("writing session response", err)
+	}
+	metricRequests.WithLabelValues("session", "ok").Inc()
+}
+
+// writeProblem writes a request-level error as problem details JSON, RFC 7807.
+// ../rfc/8620:1218
+func writeProblem(log mlog.Log, w http.ResponseWriter, status int, typ, detail string) {
+	log.Debug("jmap request error", slog.String("type", typ), slog.String("detail", detail))
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(map[string]any{
+		"type":   typ,
+		"status": status,
+		"detail": detail,
+	})
+	if err != nil && !moxio.IsClosed(err) {
+		log.Infox("writing problem response", err)
+	}
+}
+
+// serveDownload serves a blob. The path is of the form
+// /download/<accountId>/<blobId>/<name>, with an optional "accept" query string
+// parameter for the content-type. ../rfc/8620:2520
+func (s server) serveDownload(log mlog.Log, w http.ResponseWriter, r *http.Request, acc *store.Account) {
+	t := strings.Split(strings.TrimPrefix(r.URL.Path, "/download/"), "/")
+	if len(t) != 3 {
+		metricRequests.WithLabelValues("download", "error").Inc()
+		http.Error(w, "400 - bad request - path must be download/<accountId>/<blobId>/<name>", http.StatusBadRequest)
+		return
+	}
+	if t[0] != accountID(acc.Name) {
+		metricRequests.WithLabelValues("download", "error").Inc()
+		http.NotFound(w, r)
+		return
+	}
+	blobID, name := t[1], t[2]
+
+	ct := r.URL.Query().Get("accept")
+	if ct != "" {
+		if _, _, err := mime.ParseMediaType(ct); err != nil {
+			ct = ""
+		}
+	}
+	if ct == "" {
+		ct = "application/octet-stream"
+	}
+
+	rd, size, err := openBlob(log, r.Context(), acc, blobID)
+	if err != nil {
+		metricRequests.WithLabelValues("download", "error").Inc()
+		if errors.Is(err, errBlobNotFound) {
+			http.NotFound(w, r)
+		} else {
+			log.Errorx("opening blob", err, slog.String("blobid", blobID))
+			http.Error(w, "500 - internal server error - opening blob", http.StatusInternalServerError)
+		}
+		return
+	}
+	defer func() {
+		err := rd.Close()
+		log.Check(err, "closing blob")
+	}()
+
+	h := w.Header()
+	h.Set("Content-Type", ct)
+	if size >= 0 {
+		h.Set("Content-Length", fmt.Sprintf("%d", size))
+	}
+	h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	// Blobs are immutable. ../rfc/8620:2560
+	h.Set("Cache-Control", "private, immutable, max-age=31536000")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == "HEAD" {
+		return
+	}
+	if _, err := io.Copy(w, rd); err != nil && !moxio.IsClosed(err) {
+		log.Errorx("writing blob to client", err)
+	}
+	metricRequests.WithLabelValues("download", "ok").Inc()
+}
+
+// serveUpload stores the request body as blob. ../rfc/8620:2420
+func (s server) serveUpload(log mlog.Log, w http.ResponseWriter, r *http.Request, acc *store.Account) {
+	t := strings.Split(strings.TrimPrefix(r.URL.Path, "/upload/"), "/")
+	if len(t) != 2 || t[1] != "" {
+		metricRequests.WithLabelValues("upload", "error").Inc()
+		http.Error(w, "400 - bad request - path must be upload/<accountId>/", http.StatusBadRequest)
+		return
+	}
+	accID := t[0]
+	if accID != accountID(acc.Name) {
+		metricRequests.WithLabelValues("upload", "error").Inc()
+		http.NotFound(w, r)
+		return
+	}
+
+	ct := r.Header.Get("Content-Type")
+	if ct == "" {
+		ct = "application/octet-stream"
+	}
+
+	f, err := store.CreateMessageTemp(log, "jmap-upload")
+	if err != nil {
+		metricRequests.WithLabelValues("upload", "error").Inc()
+		log.Errorx("creating temporary file for upload", err)
+		http.Error(w, "500 - internal server error - creating file", http.StatusInternalServerError)
+		return
+	}
+	var keep bool
+	defer func() {
+		if !keep {
+			store.CloseRemoveTempFile(log, f, "jmap upload")
+		}
+	}()
+
+	n, err := io.Copy(f, http.MaxBytesReader(w, r.Body, s.maxMsgSize))
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		metricRequests.WithLabelValues("upload", "error").Inc()
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			writeProblem(log, w, http.StatusRequestEntityTooLarge, "urn:ietf:params:jmap:error:limit", fmt.Sprintf("upload too large, max %d bytes", s.maxMsgSize))
+			return
+		}
+		log.Infox("storing upload", err)
+		http.Error(w, "400 - bad request - reading upload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	blobID := "u" + xrandomID(12)
+	uploads.Lock()
+	uploadsCleanup(log)
+	uploads.m[blobID] = upload{acc.Name, f.Name(), ct, n, time.Now().Add(uploadExpiration)}
+	uploads.Unlock()
+	keep = true
+
+	resp := map[string]any{
+		"accountId": accID,
+		"blobId":    blobID,
+		"type":      ct,
+		"size":      n,
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	err = enc.Encode(resp)
+	if err != nil && !moxio.IsClosed(err) {
+		log.Infox("writing upload response", err)
+	}
+	metricRequests.WithLabelValues("upload", "ok").Inc()
+}
+
+var errBlobNotFound = errors.New("blob not found")
+
+// blobReader combines a reader with a closer for the underlying file.
+type blobReader struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (b blobReader) Close() error {
+	return b.closer.Close()
+}
+
+// openBlob opens a blob for reading. Blobs are either uploads, full messages or
+// message parts. The returned size is -1 if unknown.
+func openBlob(log mlog.Log, ctx context.Context, acc *store.Account, blobID string) (io.ReadCloser, int64, error) {
+	if strings.HasPrefix(blobID, "u") {
+		u, ok := uploadGet(log, acc.Name, blobID)
+		if !ok {
+			return nil, 0, errBlobNotFound
+		}
+		f, err := os.Open(u.Path)
+		if err != nil {
+			return nil, 0, err
+		}
+		return f, u.Size, nil
+	}
+
+	msgID, partPath, ok := parseBlobID(blobID)
+	if !ok {
+		return nil, 0, errBlobNotFound
+	}
+	m := store.Message{ID: msgID}
+	err := acc.DB.Get(ctx, &m)
+	if err == bstore.ErrAbsent || err == nil && m.Expunged {
+		return nil, 0, errBlobNotFound
+	} else if err != nil {
+		return nil, 0, err
+	}
+	msgr := acc.MessageReader(m)
+	if partPath == nil {
+		return msgr, m.Size, nil
+	}
+	p, err := m.LoadPart(msgr)
+	if err != nil {
+		msgr.Close()
+		return nil, 0, err
+	}
+	xp := partByPath(&p, partPath)
+	if xp == nil {
+		msgr.Close()
+		return nil, 0, errBlobNotFound
+	}
+	return blobReader{xp.Reader(), msgr}, xp.DecodedSize, nil
+}
+
+// partByPath returns the part at the path of indices into subparts, or nil.
+func partByPath(p *message.Part, path []int) *message.Part {
+	for _, i := range path {
+		if i < 0 || i >= len(p.Parts) {
+			return nil
+		}
+		p = &p.Parts[i]
+	}
+	return p
+}
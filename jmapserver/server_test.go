@@ -0,0 +1,423 @@
+package jmapserver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/queue"
+	"github.com/mjl-/mox/store"
+)
+
+var ctxbg = context.Background()
+
+func tcheckf(t *testing.T, err error, format string, args ...any) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: %s", fmt.Sprintf(format, args...), err)
+	}
+}
+
+func tcompare(t *testing.T, got, expect any) {
+	t.Helper()
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("got:\n%#v\nexpected:\n%#v", got, expect)
+	}
+}
+
+const password = "test1234"
+
+var testMsg = strings.ReplaceAll(`From: <remote@example.org>
+To: <mjl@mox.example>
+Subject: hello jmap
+Message-Id: <test1@example.org>
+Date: Mon, 01 Jan 2024 10:00:00 +0100
+Content-Type: text/plain
+
+hi there, this is a test.
+`, "\n", "\r\n")
+
+type testServer struct {
+	t     *testing.T
+	hs    *httptest.Server
+	accID string
+}
+
+// do makes an http request, checking the response status.
+func (ts testServer) do(method, path, ct string, body io.Reader, expCode int) []byte {
+	ts.t.Helper()
+	req, err := http.NewRequest(method, ts.hs.URL+path, body)
+	tcheckf(ts.t, err, "new request")
+	req.SetBasicAuth("mjl@mox.example", password)
+	if ct != "" {
+		req.Header.Set("Content-Type", ct)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	tcheckf(ts.t, err, "http request")
+	defer resp.Body.Close()
+	buf, err := io.ReadAll(resp.Body)
+	tcheckf(ts.t, err, "read response")
+	if resp.StatusCode != expCode {
+		ts.t.Fatalf("got status %d, expected %d, body %q", resp.StatusCode, expCode, buf)
+	}
+	return buf
+}
+
+// call makes a single API call and returns the response name and arguments.
+func (ts testServer) call(name string, args any) (string, map[string]any) {
+	ts.t.Helper()
+	req := map[string]any{
+		"using":       []string{capCore, capMail, capSubmission},
+		"methodCalls": []any{[]any{name, args, "c0"}},
+	}
+	buf, err := json.Marshal(req)
+	tcheckf(ts.t, err, "marshal request")
+	rbuf := ts.do("POST", "/api", "application/json", bytes.NewReader(buf), http.StatusOK)
+	var resp struct {
+		MethodResponses [][]json.RawMessage
+	}
+	err = json.Unmarshal(rbuf, &resp)
+	tcheckf(ts.t, err, "parse response")
+	if len(resp.MethodResponses) == 0 {
+		ts.t.Fatalf("no method responses")
+	}
+	var rname string
+	var rargs map[string]any
+	err = json.Unmarshal(resp.MethodResponses[0][0], &rname)
+	tcheckf(ts.t, err, "parse response name")
+	err = json.Unmarshal(resp.MethodResponses[0][1], &rargs)
+	tcheckf(ts.t, err, "parse response arguments")
+	return rname, rargs
+}
+
+// xcall makes an API call and fails the test if it does not succeed.
+func (ts testServer) xcall(name string, args any) map[string]any {
+	ts.t.Helper()
+	rname, rargs := ts.call(name, args)
+	if rname != name {
+		ts.t.Fatalf("call %s: got response %s %v", name, rname, rargs)
+	}
+	return rargs
+}
+
+// xcallError makes an API call that must fail with a method error.
+func (ts testServer) xcallError(name string, args any, expType string) {
+	ts.t.Helper()
+	rname, rargs := ts.call(name, args)
+	if rname != "error" || rargs["type"] != expType {
+		ts.t.Fatalf("call %s: got %s %v, expected error %q", name, rname, rargs, expType)
+	}
+}
+
+func TestServer(t *testing.T) {
+	mox.LimitersInit()
+	os.RemoveAll("../testdata/jmapserver/data")
+	mox.Context = ctxbg
+	mox.ConfigStaticPath = filepath.FromSlash("../testdata/jmapserver/mox.conf")
+	mox.MustLoadConfig(true, false)
+	defer store.Switchboard()()
+	err := queue.Init()
+	tcheckf(t, err, "queue init")
+	defer queue.Shutdown()
+
+	log := mlog.New("jmapserver", nil)
+	acc, err := store.OpenAccount(log, "mjl")
+	tcheckf(t, err, "open account")
+	err = acc.SetPassword(log, password)
+	tcheckf(t, err, "set password")
+	defer func() {
+		err := acc.Close()
+		log.Check(err, "closing account")
+		acc.CheckClosed()
+	}()
+
+	hs := httptest.NewServer(NewServer(100*1024, "/jmap/", false))
+	defer hs.Close()
+	ts := testServer{t, hs, accountID("mjl")}
+
+	// Authentication is required.
+	resp, err := http.Get(hs.URL + "/session")
+	tcheckf(t, err, "get session without auth")
+	resp.Body.Close()
+	tcompare(t, resp.StatusCode, http.StatusUnauthorized)
+
+	// Session resource.
+	var sess Session
+	err = json.Unmarshal(ts.do("GET", "/session", "", nil, http.StatusOK), &sess)
+	tcheckf(t, err, "parse session")
+	tcompare(t, sess.Username, "mjl@mox.example")
+	tcompare(t, sess.PrimaryAccounts[capMail], ts.accID)
+	tcompare(t, sess.APIURL, hs.URL+"/jmap/api")
+
+	ts.do("GET", "/bogus", "", nil, http.StatusNotFound)
+	ts.do("GET", "/api", "", nil, http.StatusMethodNotAllowed)
+
+	// Unknown method, unknown account.
+	ts.xcallError("Bogus/get", map[string]any{}, "unknownMethod")
+	ts.xcallError("Mailbox/get", map[string]any{"accountId": "bogus"}, "accountNotFound")
+
+	// Mailboxes, with Inbox and special-use mailboxes.
+	r := ts.xcall("Mailbox/get", map[string]any{"accountId": ts.accID})
+	mailboxState := r["state"].(string)
+	roles := map[string]string{} // Role to id.
+	for _, o := range r["list"].([]any) {
+		mb := o.(map[string]any)
+		if role, ok := mb["role"].(string); ok {
+			roles[role] = mb["id"].(string)
+		}
+	}
+	inboxID := roles["inbox"]
+	if inboxID == "" || roles["sent"] == "" || roles["trash"] == "" {
+		t.Fatalf("missing mailbox roles: %v", roles)
+	}
+
+	// Create, rename and destroy a mailbox.
+	r = ts.xcall("Mailbox/set", map[string]any{
+		"accountId": ts.accID,
+		"create":    map[string]any{"m1": map[string]any{"name": "Lists", "isSubscribed": true}},
+	})
+	created := r["created"].(map[string]any)
+	listsID := created["m1"].(map[string]any)["id"].(string)
+	// Mailbox changes are not tracked, clients must fetch all mailboxes again.
+	ts.xcallError("Mailbox/changes", map[string]any{"accountId": ts.accID, "sinceState": mailboxState}, "cannotCalculateChanges")
+	r = ts.xcall("Mailbox/get", map[string]any{"accountId": ts.accID, "ids": []string{}})
+	mailboxState = r["state"].(string)
+	r = ts.xcall("Mailbox/changes", map[string]any{"accountId": ts.accID, "sinceState": mailboxState})
+	tcompare(t, r["created"], []any{})
+	r = ts.xcall("Mailbox/set", map[string]any{
+		"accountId": ts.accID,
+		"update":    map[string]any{listsID: map[string]any{"name": "Lists2"}},
+	})
+	tcompare(t, r["notUpdated"], nil)
+	r = ts.xcall("Mailbox/query", map[string]any{"accountId": ts.accID, "filter": map[string]any{"name": "Lists2"}})
+	tcompare(t, r["ids"], []any{listsID})
+	r = ts.xcall("Mailbox/set", map[string]any{
+		"accountId": ts.accID,
+		"create":    map[string]any{"m2": map[string]any{"name": "Inbox"}},
+		"destroy":   []string{listsID},
+	})
+	tcompare(t, r["destroyed"], []any{listsID})
+	notCreated := r["notCreated"].(map[string]any)
+	if notCreated["m2"] == nil {
+		t.Fatalf("duplicate mailbox created")
+	}
+
+	// Upload a message and import it.
+	var upload map[string]any
+	err = json.Unmarshal(ts.do("POST", "/upload/"+ts.accID+"/", "message/rfc822", strings.NewReader(testMsg), http.StatusCreated), &upload)
+	tcheckf(t, err, "parse upload response")
+	tcompare(t, upload["size"], float64(len(testMsg)))
+	ts.do("POST", "/upload/bogus/", "message/rfc822", strings.NewReader(testMsg), http.StatusNotFound)
+
+	r = ts.xcall("Email/get", map[string]any{"accountId": ts.accID, "ids": []string{}})
+	emailState := r["state"].(string)
+
+	r = ts.xcall("Email/import", map[string]any{
+		"accountId": ts.accID,
+		"emails": map[string]any{
+			"e1": map[string]any{
+				"blobId":     upload["blobId"],
+				"mailboxIds": map[string]bool{inboxID: true},
+				"keywords":   map[string]bool{"$seen": true},
+			},
+		},
+	})
+	imported := r["created"].(map[string]any)["e1"].(map[string]any)
+	email1ID := imported["id"].(string)
+
+	// Download the message.
+	blob := ts.do("GET", "/download/"+ts.accID+"/"+imported["blobId"].(string)+"/msg.eml?accept=message/rfc822", "", nil, http.StatusOK)
+	tcompare(t, string(blob), testMsg)
+
+	// Get the email with body values.
+	r = ts.xcall("Email/get", map[string]any{
+		"accountId":           ts.accID,
+		"ids":                 []string{email1ID},
+		"properties":          []string{"subject", "from", "keywords", "mailboxIds", "textBody", "bodyValues", "preview"},
+		"fetchTextBodyValues": true,
+	})
+	email := r["list"].([]any)[0].(map[string]any)
+	tcompare(t, email["subject"], "hello jmap")
+	tcompare(t, email["from"], []any{map[string]any{"name": nil, "email": "remote@example.org"}})
+	tcompare(t, email["keywords"], map[string]any{"$seen": true})
+	tcompare(t, email["mailboxIds"], map[string]any{inboxID: true})
+	tcompare(t, email["preview"], "hi there, this is a test.")
+	bodyValues := email["bodyValues"].(map[string]any)
+	if len(bodyValues) != 1 {
+		t.Fatalf("got %d body values, expected 1", len(bodyValues))
+	}
+	r = ts.xcall("Email/get", map[string]any{"accountId": ts.accID, "ids": []string{"Mbogus"}})
+	tcompare(t, r["notFound"], []any{"Mbogus"})
+
+	// Changes since before the import.
+	r = ts.xcall("Email/changes", map[string]any{"accountId": ts.accID, "sinceState": emailState})
+	tcompare(t, r["created"], []any{email1ID})
+	ts.xcallError("Email/changes", map[string]any{"accountId": ts.accID, "sinceState": "bogus"}, "cannotCalculateChanges")
+
+	// Create an email in Drafts.
+	r = ts.xcall("Email/set", map[string]any{
+		"accountId": ts.accID,
+		"create": map[string]any{
+			"d1": map[string]any{
+				"mailboxIds": map[string]bool{roles["drafts"]: true},
+				"keywords":   map[string]bool{"$draft": true},
+				"from":       []any{map[string]any{"email": "mjl@mox.example"}},
+				"to":         []any{map[string]any{"name": "Remote", "email": "remote@example.org"}},
+				"subject":    "test draft",
+				"textBody":   []any{map[string]any{"partId": "t", "type": "text/plain"}},
+				"bodyValues": map[string]any{"t": map[string]any{"value": "draft body\n"}},
+			},
+		},
+	})
+	draftID := r["created"].(map[string]any)["d1"].(map[string]any)["id"].(string)
+
+	// Query with filters and sort.
+	r = ts.xcall("Email/query", map[string]any{"accountId": ts.accID, "filter": map[string]any{"inMailbox": inboxID}})
+	tcompare(t, r["ids"], []any{email1ID})
+	r = ts.xcall("Email/query", map[string]any{
+		"accountId": ts.accID,
+		"filter":    map[string]any{"operator": "OR", "conditions": []any{map[string]any{"subject": "draft"}, map[string]any{"body": "this is a test"}}},
+		"sort":      []any{map[string]any{"property": "subject", "isAscending": true}},
+	})
+	tcompare(t, r["ids"], []any{email1ID, draftID})
+	r = ts.xcall("Email/query", map[string]any{"accountId": ts.accID, "filter": map[string]any{"hasKeyword": "$draft"}, "calculateTotal": true})
+	tcompare(t, r["total"], float64(1))
+
+	// Update keywords and move.
+	r = ts.xcall("Email/set", map[string]any{
+		"accountId": ts.accID,
+		"update": map[string]any{
+			email1ID: map[string]any{"keywords/$flagged": true, "mailboxIds": map[string]bool{roles["archive"]: true}},
+			"Mbogus": map[string]any{"keywords/$flagged": true},
+		},
+	})
+	tcompare(t, r["updated"], map[string]any{email1ID: nil})
+	if r["notUpdated"].(map[string]any)["Mbogus"] == nil {
+		t.Fatalf("missing notUpdated for unknown email")
+	}
+	r = ts.xcall("Email/get", map[string]any{"accountId": ts.accID, "ids": []string{email1ID}, "properties": []string{"keywords", "mailboxIds", "threadId"}})
+	email = r["list"].([]any)[0].(map[string]any)
+	tcompare(t, email["keywords"], map[string]any{"$seen": true, "$flagged": true})
+	tcompare(t, email["mailboxIds"], map[string]any{roles["archive"]: true})
+	r = ts.xcall("Thread/get", map[string]any{"accountId": ts.accID, "ids": []any{email["threadId"]}})
+	tcompare(t, r["list"].([]any)[0].(map[string]any)["emailIds"], []any{email1ID})
+
+	// Identities.
+	r = ts.xcall("Identity/get", map[string]any{"accountId": ts.accID})
+	var identID string
+	for _, o := range r["list"].([]any) {
+		ident := o.(map[string]any)
+		if ident["email"] == "mjl@mox.example" {
+			identID = ident["id"].(string)
+		}
+	}
+	if identID == "" {
+		t.Fatalf("no identity for mjl@mox.example")
+	}
+
+	// Submit the draft, moving it to Sent on success.
+	r = ts.xcall("EmailSubmission/set", map[string]any{
+		"accountId": ts.accID,
+		"create": map[string]any{
+			"s1": map[string]any{"identityId": identID, "emailId": draftID},
+		},
+		"onSuccessUpdateEmail": map[string]any{
+			"#s1": map[string]any{"mailboxIds/" + roles["drafts"]: nil, "mailboxIds/" + roles["sent"]: true, "keywords/$draft": nil},
+		},
+	})
+	subID := r["created"].(map[string]any)["s1"].(map[string]any)["id"].(string)
+	qmsgs, err := queue.List(ctxbg, queue.Filter{}, queue.Sort{})
+	tcheckf(t, err, "list queue")
+	tcompare(t, len(qmsgs), 1)
+	r = ts.xcall("EmailSubmission/get", map[string]any{"accountId": ts.accID, "ids": []string{subID}})
+	sub := r["list"].([]any)[0].(map[string]any)
+	tcompare(t, sub["undoStatus"], "pending")
+	tcompare(t, sub["emailId"], draftID)
+	r = ts.xcall("Email/get", map[string]any{"accountId": ts.accID, "ids": []string{draftID}, "properties": []string{"mailboxIds"}})
+	tcompare(t, r["list"].([]any)[0].(map[string]any)["mailboxIds"], map[string]any{roles["sent"]: true})
+
+	// Cancel the submission.
+	r = ts.xcall("EmailSubmission/set", map[string]any{
+		"accountId": ts.accID,
+		"update":    map[string]any{subID: map[string]any{"undoStatus": "canceled"}},
+	})
+	tcompare(t, r["updated"], map[string]any{subID: nil})
+	qmsgs, err = queue.List(ctxbg, queue.Filter{}, queue.Sort{})
+	tcheckf(t, err, "list queue")
+	tcompare(t, len(qmsgs), 0)
+
+	// Submitting with a From address not belonging to the account fails.
+	r = ts.xcall("Email/set", map[string]any{
+		"accountId": ts.accID,
+		"create": map[string]any{
+			"d2": map[string]any{
+				"mailboxIds": map[string]bool{roles["drafts"]: true},
+				"from":       []any{map[string]any{"email": "other@mox.example"}},
+				"to":         []any{map[string]any{"email": "remote@example.org"}},
+				"subject":    "spoof",
+				"textBody":   []any{map[string]any{"partId": "t", "type": "text/plain"}},
+				"bodyValues": map[string]any{"t": map[string]any{"value": "spoof\n"}},
+			},
+		},
+	})
+	draft2ID := r["created"].(map[string]any)["d2"].(map[string]any)["id"].(string)
+	r = ts.xcall("EmailSubmission/set", map[string]any{
+		"accountId": ts.accID,
+		"create":    map[string]any{"s2": map[string]any{"identityId": identID, "emailId": draft2ID}},
+	})
+	tcompare(t, r["notCreated"].(map[string]any)["s2"].(map[string]any)["type"], "forbiddenFrom")
+
+	// Event source, closing after the first state change.
+	req, err := http.NewRequest("GET", hs.URL+"/eventsource?types=Email&closeafter=state&ping=0", nil)
+	tcheckf(t, err, "new eventsource request")
+	req.SetBasicAuth("mjl@mox.example", password)
+	resp, err = http.DefaultClient.Do(req)
+	tcheckf(t, err, "eventsource request")
+	defer resp.Body.Close()
+	tcompare(t, resp.StatusCode, http.StatusOK)
+	tcompare(t, resp.Header.Get("Content-Type"), "text/event-stream")
+
+	// Destroy an email, causing a state change.
+	ts.xcall("Email/set", map[string]any{"accountId": ts.accID, "destroy": []string{draft2ID}})
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			resp.Body.Close()
+		}
+	}()
+	var event, data string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if s, ok := strings.CutPrefix(line, "event: "); ok {
+			event = s
+		} else if s, ok := strings.CutPrefix(line, "data: "); ok {
+			data = s
+		}
+	}
+	close(done)
+	tcompare(t, event, "state")
+	var sc StateChange
+	err = json.Unmarshal([]byte(data), &sc)
+	tcheckf(t, err, "parse state change")
+	tcompare(t, sc.Type, "StateChange")
+	if _, ok := sc.Changed[ts.accID]["Email"]; !ok || len(sc.Changed[ts.accID]) != 1 {
+		t.Fatalf("unexpected state change %v", sc.Changed)
+	}
+}
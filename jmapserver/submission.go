@@ -0,0 +1,692 @@
+package jmapserver
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/dkim"
+	"github.com/mjl-/mox/message"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/queue"
+	"github.com/mjl-/mox/smtp"
+	"github.com/mjl-/mox/store"
+)
+
+// Identity is an address the account can send from. ../rfc/8621:3010
+type Identity struct {
+	ID            string         `json:"id"`
+	Name          string         `json:"name"`
+	Email         string         `json:"email"`
+	ReplyTo       []EmailAddress `json:"replyTo"`
+	Bcc           []EmailAddress `json:"bcc"`
+	TextSignature string         `json:"textSignature"`
+	HTMLSignature string         `json:"htmlSignature"`
+	MayDelete     bool           `json:"mayDelete"`
+}
+
+func identityID(addr smtp.Address) string {
+	return "i" + base64.RawURLEncoding.EncodeToString([]byte(addr.String()))
+}
+
+// identities returns an identity for each address of the account, sorted by
+// email address. Catchall addresses are skipped.
+func (c *call) identities() []Identity {
+	accConf, _ := c.acc.Conf()
+	var l []Identity
+	for addrStr, dest := range accConf.Destinations {
+		addr, err := smtp.ParseAddress(addrStr)
+		if err != nil {
+			continue
+		}
+		name := dest.FullName
+		if name == "" {
+			name = accConf.FullName
+		}
+		l = append(l, Identity{ID: identityID(addr), Name: name, Email: addr.String()})
+	}
+	slices.SortFunc(l, func(a, b Identity) int { return strings.Compare(a.Email, b.Email) })
+	return l
+}
+
+func identityState(l []Identity) string {
+	buf, err := json.Marshal(l)
+	xcheckf(err, "marshal identities")
+	h := sha256.Sum256(buf)
+	return base64.RawURLEncoding.EncodeToString(h[:12])
+}
+
+func (c *call) identityGet(args json.RawMessage) any {
+	var req getArgs
+	c.xparseArgs(args, &req)
+	c.xcheckGetArgs(req)
+	known := []string{"id", "name", "email", "replyTo", "bcc", "textSignature", "htmlSignature", "mayDelete"}
+	props := properties(req.Properties, known, known)
+
+	l := c.identities()
+	resp := struct {
+		AccountID string           `json:"accountId"`
+		State     string           `json:"state"`
+		List      []map[string]any `json:"list"`
+		NotFound  []string         `json:"notFound"`
+	}{c.accountID, identityState(l), []map[string]any{}, []string{}}
+
+	object := func(ident Identity) map[string]any {
+		var o map[string]any
+		buf, err := json.Marshal(ident)
+		xcheckf(err, "marshal identity")
+		err = json.Unmarshal(buf, &o)
+		xcheckf(err, "unmarshal identity")
+		return pick(o, props)
+	}
+	if req.IDs == nil {
+		for _, ident := range l {
+			resp.List = append(resp.List, object(ident))
+		}
+		return resp
+	}
+	for _, id := range *req.IDs {
+		i := slices.IndexFunc(l, func(ident Identity) bool { return ident.ID == id })
+		if i < 0 {
+			resp.NotFound = append(resp.NotFound, id)
+		} else {
+			resp.List = append(resp.List, object(l[i]))
+		}
+	}
+	return resp
+}
+
+func (c *call) identityChanges(args json.RawMessage) any {
+	var req changesArgs
+	c.xparseArgs(args, &req)
+	c.xcheckAccount(req.AccountID)
+
+	// We don't keep history, identities come from the configuration file.
+	state := identityState(c.identities())
+	if req.SinceState != state {
+		xmethodErrorf("cannotCalculateChanges", "identity changes cannot be calculated, fetch all identities")
+	}
+	return changesResponse{c.accountID, state, state, false, []string{}, []string{}, []string{}}
+}
+
+// submissionAddress is an address in an EmailSubmission envelope. ../rfc/8621:3200
+type submissionAddress struct {
+	Email      string             `json:"email"`
+	Parameters map[string]*string `json:"parameters"`
+}
+
+// submissionEnvelope is the SMTP envelope for an EmailSubmission.
+type submissionEnvelope struct {
+	MailFrom submissionAddress   `json:"mailFrom"`
+	RcptTo   []submissionAddress `json:"rcptTo"`
+}
+
+// deliveryStatus is the delivery status for a single recipient.
+type deliveryStatus struct {
+	SMTPReply string `json:"smtpReply"`
+	Delivered string `json:"delivered"` // queued, yes, no, unknown
+	Displayed string `json:"displayed"` // unknown, yes
+}
+
+// submissionID returns the id for an EmailSubmission: the id of the first queued
+// message, which is also the BaseID of the other recipients, and the email id.
+func submissionID(queueID, msgID int64) string {
+	return fmt.Sprintf("s%d_%d", queueID, msgID)
+}
+
+func parseSubmissionID(s string) (queueID, msgID int64, ok bool) {
+	a, b, found := strings.Cut(s, "_")
+	if !found {
+		return 0, 0, false
+	}
+	queueID, ok = parseID('s', a)
+	if !ok {
+		return 0, 0, false
+	}
+	msgID, ok = parseID('e', "e"+b)
+	return queueID, msgID, ok
+}
+
+// submissionMsg is the part of queue.Msg and queue.MsgRetired used for EmailSubmission objects.
+type submissionMsg struct {
+	ID            int64
+	Queued        time.Time
+	NextAttempt   time.Time
+	Sender        string
+	Recipient     string
+	Attempts      int
+	Results       []queue.MsgResult
+	Retired       bool
+	Success       bool
+	FutureRelease string
+}
+
+// xsubmissionMsgs returns the queued and retired messages for a submission,
+// ordered by id.
+func (c *call) xsubmissionMsgs(queueID int64) []submissionMsg {
+	var l []submissionMsg
+	err := queue.DB.Read(c.ctx, func(tx *bstore.Tx) error {
+		q := bstore.QueryTx[queue.Msg](tx)
+		q.FilterNonzero(queue.Msg{SenderAccount: c.acc.Name})
+		q.FilterFn(func(qm queue.Msg) bool { return qm.ID == queueID || qm.BaseID == queueID })
+		err := q.ForEach(func(qm queue.Msg) error {
+			l = append(l, submissionMsg{qm.ID, qm.Queued, qm.NextAttempt, qm.Sender().XString(true), qm.Recipient().XString(true), qm.Attempts, qm.Results, false, false, qm.FutureReleaseRequest})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		qr := bstore.QueryTx[queue.MsgRetired](tx)
+		qr.FilterNonzero(queue.MsgRetired{SenderAccount: c.acc.Name})
+		qr.FilterFn(func(mr queue.MsgRetired) bool { return mr.ID == queueID || mr.BaseID == queueID })
+		return qr.ForEach(func(mr queue.MsgRetired) error {
+			var sender string
+			if p, err := mr.Sender(); err == nil {
+				sender = p.XString(true)
+			}
+			l = append(l, submissionMsg{mr.ID, mr.Queued, time.Time{}, sender, mr.Recipient().XString(true), mr.Attempts, mr.Results, true, mr.Success, mr.FutureReleaseRequest})
+			return nil
+		})
+	})
+	xcheckf(err, "looking up queued messages")
+	slices.SortFunc(l, func(a, b submissionMsg) int { return int(a.ID - b.ID) })
+	return l
+}
+
+// submissionObject returns the EmailSubmission object for the queue messages.
+func (c *call) submissionObject(id string, msgID, tid int64, l []submissionMsg) map[string]any {
+	undoStatus := "final"
+	pending := true
+	canceled := true
+	for _, sm := range l {
+		pending = pending && !sm.Retired && sm.Attempts == 0
+		canceled = canceled && sm.Retired && !sm.Success && len(sm.Results) > 0 && sm.Results[len(sm.Results)-1].Error == "delivery canceled by admin"
+	}
+	if pending {
+		undoStatus = "pending"
+	} else if canceled {
+		undoStatus = "canceled"
+	}
+
+	env := submissionEnvelope{RcptTo: []submissionAddress{}}
+	status := map[string]deliveryStatus{}
+	for i, sm := range l {
+		if i == 0 {
+			env.MailFrom = submissionAddress{Email: sm.Sender}
+		}
+		env.RcptTo = append(env.RcptTo, submissionAddress{Email: sm.Recipient})
+		ds := deliveryStatus{Delivered: "queued", Displayed: "unknown"}
+		if sm.Retired {
+			ds.Delivered = "no"
+			if sm.Success {
+				ds.Delivered = "yes"
+			}
+		}
+		if len(sm.Results) > 0 {
+			r := sm.Results[len(sm.Results)-1]
+			if r.Code != 0 {
+				ds.SMTPReply = strings.TrimSpace(fmt.Sprintf("%d %s %s", r.Code, r.Secode, r.Error))
+			} else if r.Success {
+				ds.SMTPReply = "250 2.0.0 ok"
+			} else {
+				ds.SMTPReply = "451 4.0.0 " + r.Error
+			}
+		} else {
+			ds.SMTPReply = "250 2.0.0 queued"
+		}
+		status[sm.Recipient] = ds
+	}
+
+	var identID string
+	if addr, err := smtp.ParseAddress(env.MailFrom.Email); err == nil {
+		identID = identityID(addr)
+	}
+	var sendAt string
+	if len(l) > 0 {
+		t := l[0].Queued
+		if !l[0].NextAttempt.IsZero() && l[0].FutureRelease != "" {
+			t = l[0].NextAttempt
+		}
+		sendAt = t.UTC().Format(time.RFC3339)
+	}
+	return map[string]any{
+		"id":             id,
+		"identityId":     identID,
+		"emailId":        emailID(msgID),
+		"threadId":       threadID(tid),
+		"envelope":       env,
+		"sendAt":         sendAt,
+		"undoStatus":     undoStatus,
+		"deliveryStatus": status,
+		"dsnBlobIds":     []string{},
+		"mdnBlobIds":     []string{},
+	}
+}
+
+func (c *call) emailSubmissionGet(args json.RawMessage) any {
+	var req getArgs
+	c.xparseArgs(args, &req)
+	c.xcheckGetArgs(req)
+	known := []string{"id", "identityId", "emailId", "threadId", "envelope", "sendAt", "undoStatus", "deliveryStatus", "dsnBlobIds", "mdnBlobIds"}
+	props := properties(req.Properties, known, known)
+
+	resp := struct {
+		AccountID string           `json:"accountId"`
+		State     string           `json:"state"`
+		List      []map[string]any `json:"list"`
+		NotFound  []string         `json:"notFound"`
+	}{c.accountID, "", []map[string]any{}, []string{}}
+
+	var ids []string
+	if req.IDs != nil {
+		ids = *req.IDs
+	} else {
+		// List all submissions still in the queue, and the recently retired.
+		seen := map[int64]bool{}
+		add := func(id, baseID int64, messageID string) {
+			if baseID != 0 {
+				id = baseID
+			}
+			if seen[id] {
+				return
+			}
+			seen[id] = true
+			var msgID int64
+			c.xdbread(func(tx *bstore.Tx) {
+				storedMsgID, err := store.HashThreadValue(tx, strings.ToLower(strings.Trim(messageID, "<>")))
+				xcheckf(err, "hashing message-id")
+				q := bstore.QueryTx[store.Message](tx)
+				q.FilterNonzero(store.Message{MessageID: storedMsgID})
+				q.FilterEqual("Expunged", false)
+				q.SortAsc("ID")
+				if m, err := q.Get(); err == nil {
+					msgID = m.ID
+				} else if err != bstore.ErrAbsent && err != bstore.ErrMultiple {
+					xcheckf(err, "looking up message")
+				}
+			})
+			if msgID != 0 {
+				ids = append(ids, submissionID(id, msgID))
+			}
+		}
+		err := queue.DB.Read(c.ctx, func(tx *bstore.Tx) error {
+			err := bstore.QueryTx[queue.Msg](tx).FilterNonzero(queue.Msg{SenderAccount: c.acc.Name}).SortAsc("ID").Limit(maxObjectsInGet).ForEach(func(qm queue.Msg) error {
+				add(qm.ID, qm.BaseID, qm.MessageID)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			return bstore.QueryTx[queue.MsgRetired](tx).FilterNonzero(queue.MsgRetired{SenderAccount: c.acc.Name}).SortDesc("LastActivity").Limit(maxObjectsInGet).ForEach(func(mr queue.MsgRetired) error {
+				add(mr.ID, mr.BaseID, mr.MessageID)
+				return nil
+			})
+		})
+		xcheckf(err, "listing queued messages")
+	}
+
+	for _, id := range ids {
+		queueID, msgID, ok := parseSubmissionID(id)
+		var l []submissionMsg
+		if ok {
+			l = c.xsubmissionMsgs(queueID)
+		}
+		if len(l) == 0 {
+			resp.NotFound = append(resp.NotFound, id)
+			continue
+		}
+		tid := msgID
+		c.xdbread(func(tx *bstore.Tx) {
+			m := store.Message{ID: msgID}
+			if err := tx.Get(&m); err == nil && m.ThreadID != 0 {
+				tid = m.ThreadID
+			}
+		})
+		resp.List = append(resp.List, pick(c.submissionObject(id, msgID, tid, l), props))
+	}
+	resp.State = c.xsubmissionState()
+	return resp
+}
+
+// xsubmissionState returns a state string for submissions, a hash over the queued
+// messages of the account.
+func (c *call) xsubmissionState() string {
+	h := sha256.New()
+	err := queue.DB.Read(c.ctx, func(tx *bstore.Tx) error {
+		return bstore.QueryTx[queue.Msg](tx).FilterNonzero(queue.Msg{SenderAccount: c.acc.Name}).SortAsc("ID").ForEach(func(qm queue.Msg) error {
+			fmt.Fprintf(h, "%d %d\n", qm.ID, qm.Attempts)
+			return nil
+		})
+	})
+	xcheckf(err, "listing queued messages")
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:12])
+}
+
+// copyWithoutBcc copies a message from r to w, leaving out Bcc header fields. It
+// returns whether the message has bytes with the high bit set.
+func copyWithoutBcc(w io.Writer, r io.Reader) (n int64, has8bit bool, rerr error) {
+	br := bufio.NewReader(r)
+	bw := bufio.NewWriter(w)
+	write := func(s string) {
+		if rerr != nil {
+			return
+		}
+		for _, c := range []byte(s) {
+			if c >= 0x80 {
+				has8bit = true
+				break
+			}
+		}
+		var nn int
+		nn, rerr = bw.WriteString(s)
+		n += int64(nn)
+	}
+
+	inHeader := true
+	skipping := false
+	for inHeader {
+		line, err := br.ReadString('\n')
+		if line == "" && err != nil {
+			if err != io.EOF {
+				return n, has8bit, err
+			}
+			break
+		}
+		if line == "\r\n" || line == "\n" {
+			inHeader = false
+		} else if line[0] == ' ' || line[0] == '\t' {
+			if skipping {
+				continue
+			}
+		} else {
+			k, _, _ := strings.Cut(line, ":")
+			skipping = strings.EqualFold(strings.TrimRight(k, " \t"), "Bcc")
+			if skipping {
+				continue
+			}
+		}
+		write(line)
+		if err != nil {
+			break
+		}
+	}
+	buf := make([]byte, 32*1024)
+	for rerr == nil {
+		nr, err := br.Read(buf)
+		if nr > 0 {
+			write(string(buf[:nr]))
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return n, has8bit, err
+		}
+	}
+	if rerr == nil {
+		rerr = bw.Flush()
+	}
+	return n, has8bit, rerr
+}
+
+// emailSubmissionCreate holds the properties for a new submission. ../rfc/8621:3440
+type emailSubmissionCreate struct {
+	IdentityID string              `json:"identityId"`
+	EmailID    string              `json:"emailId"`
+	Envelope   *submissionEnvelope `json:"envelope"`
+}
+
+// xsubmit queues the email for delivery, returning the submission id.
+func (c *call) xsubmit(sc emailSubmissionCreate) (string, store.Message) {
+	idents := c.identities()
+	if !slices.ContainsFunc(idents, func(ident Identity) bool { return ident.ID == sc.IdentityID }) {
+		xinvalidProperties("unknown identity", "identityId")
+	}
+
+	var m store.Message
+	var part message.Part
+	c.xdbread(func(tx *bstore.Tx) {
+		m = c.xmessage(tx, sc.EmailID)
+		mr := c.acc.MessageReader(m)
+		defer mr.Close()
+		var err error
+		part, err = m.LoadPart(mr)
+		xcheckf(err, "load message part")
+	})
+	env := part.Envelope
+	if env == nil || len(env.From) != 1 {
+		xinvalidProperties("email must have a single from address", "emailId")
+	}
+	from, err := smtp.ParseAddress(env.From[0].User + "@" + env.From[0].Host)
+	if err != nil {
+		xinvalidProperties(fmt.Sprintf("parsing from address: %v", err), "emailId")
+	}
+	if !mox.AllowMsgFrom(c.acc.Name, from) {
+		metricSubmission.WithLabelValues("badfrom").Inc()
+		xsetErrorf("forbiddenFrom", "from address not allowed for account")
+	}
+
+	var mailFrom smtp.Address
+	var rcpts []smtp.Path
+	if sc.Envelope != nil {
+		mailFrom, err = smtp.ParseAddress(sc.Envelope.MailFrom.Email)
+		if err != nil {
+			xinvalidProperties(fmt.Sprintf("parsing mailFrom: %v", err), "envelope")
+		}
+		if !mox.AllowMsgFrom(c.acc.Name, mailFrom) {
+			metricSubmission.WithLabelValues("badfrom").Inc()
+			xsetErrorf("forbiddenMailFrom", "mail from address not allowed for account")
+		}
+		for _, a := range sc.Envelope.RcptTo {
+			addr, err := smtp.ParseAddress(a.Email)
+			if err != nil {
+				xinvalidProperties(fmt.Sprintf("parsing rcptTo: %v", err), "envelope")
+			}
+			rcpts = append(rcpts, addr.Path())
+		}
+	} else {
+		mailFrom = from
+		for _, l := range [][]message.Address{env.To, env.CC, env.BCC} {
+			for _, a := range l {
+				addr, err := smtp.ParseAddress(a.User + "@" + a.Host)
+				if err != nil {
+					xsetErrorf("invalidRecipients", "parsing recipient address %q: %v", a.User+"@"+a.Host, err)
+				}
+				rcpts = append(rcpts, addr.Path())
+			}
+		}
+	}
+	if len(rcpts) == 0 {
+		xsetErrorf("noRecipients", "no recipients")
+	}
+
+	// Check outgoing message rate limit.
+	c.xdbread(func(tx *bstore.Tx) {
+		msglimit, rcptlimit, err := c.acc.SendLimitReached(tx, rcpts)
+		if msglimit >= 0 {
+			metricSubmission.WithLabelValues("messagelimiterror").Inc()
+			xsetErrorf("forbiddenToSend", "outgoing message rate limit reached")
+		} else if rcptlimit >= 0 {
+			metricSubmission.WithLabelValues("recipientlimiterror").Inc()
+			xsetErrorf("forbiddenToSend", "outgoing new recipient rate limit reached")
+		}
+		xcheckf(err, "checking send limit")
+	})
+
+	smtputf8 := mailFrom.Localpart.IsInternational()
+	for _, rcpt := range rcpts {
+		smtputf8 = smtputf8 || rcpt.Localpart.IsInternational()
+	}
+
+	// Copy message without Bcc header to a new file for the queue.
+	dataFile, err := store.CreateMessageTemp(c.log, "jmap-submit")
+	xcheckf(err, "creating temporary file for message")
+	defer store.CloseRemoveTempFile(c.log, dataFile, "message to submit")
+	mr := c.acc.MessageReader(m)
+	size, has8bit, err := copyWithoutBcc(dataFile, mr)
+	mr.Close()
+	xcheckf(err, "copying message for submission")
+
+	// Add DKIM-Signature headers.
+	var msgPrefix string
+	confDom, _ := mox.Conf.Domain(from.Domain)
+	selectors := mox.DKIMSelectors(confDom.DKIM)
+	if len(selectors) > 0 {
+		dkimHeaders, err := dkim.Sign(c.ctx, c.log.Logger, from.Localpart, from.Domain, selectors, smtputf8, dataFile)
+		if err != nil {
+			metricServerErrors.WithLabelValues("dkimsign").Inc()
+		}
+		xcheckf(err, "sign dkim")
+		msgPrefix = dkimHeaders
+	}
+
+	// Each queued message gets a Received header.
+	recvFrom := message.HeaderCommentDomain(mox.Conf.Static.HostnameDomain, smtputf8)
+	recvBy := mox.Conf.Static.HostnameDomain.XName(smtputf8)
+	recvID := mox.ReceivedID(mox.CidFromCtx(c.ctx))
+	recvHdrFor := func(rcptTo string) string {
+		recvHdr := &message.HeaderWriter{}
+		recvHdr.Add(" ", "Received:", "from", recvFrom, "by", recvBy, "id", recvID) // ../rfc/5321:3158
+		if c.r.TLS != nil {
+			recvHdr.Add(" ", mox.TLSReceivedComment(c.log, *c.r.TLS)...)
+		}
+		recvHdr.Add(" ", "for", "<"+rcptTo+">;", time.Now().Format(message.RFC5322Z))
+		return recvHdr.String()
+	}
+
+	qml := make([]queue.Msg, len(rcpts))
+	now := time.Now()
+	for i, rcpt := range rcpts {
+		// Don't use per-recipient unique message prefix when multiple recipients are
+		// present, we want to keep the message identical.
+		var recvRcpt string
+		if len(rcpts) == 1 {
+			recvRcpt = rcpt.XString(smtputf8)
+		}
+		rcptMsgPrefix := recvHdrFor(recvRcpt) + msgPrefix
+		msgSize := int64(len(rcptMsgPrefix)) + size
+		qml[i] = queue.MakeMsg(mailFrom.Path(), rcpt, has8bit, smtputf8, msgSize, env.MessageID, []byte(rcptMsgPrefix), nil, now, env.Subject)
+	}
+	err = queue.Add(c.ctx, c.log, c.acc.Name, dataFile, qml...)
+	if err != nil {
+		metricSubmission.WithLabelValues("queueerror").Inc()
+	}
+	xcheckf(err, "adding messages to the delivery queue")
+	metricSubmission.WithLabelValues("ok").Inc()
+
+	return submissionID(qml[0].ID, m.ID), m
+}
+
+func (c *call) emailSubmissionSet(args json.RawMessage) any {
+	var req struct {
+		setArgs
+		OnSuccessUpdateEmail  map[string]json.RawMessage `json:"onSuccessUpdateEmail"`
+		OnSuccessDestroyEmail []string                   `json:"onSuccessDestroyEmail"`
+	}
+	c.xparseArgs(args, &req)
+	c.xcheckSetArgs(req.setArgs)
+
+	oldState := c.xsubmissionState()
+	if req.IfInState != nil && *req.IfInState != oldState {
+		xmethodErrorf("stateMismatch", "submission state does not match ifInState")
+	}
+	resp := setResponse{AccountID: c.accountID, OldState: &oldState}
+
+	// Email ids for successfully created/updated submissions, keyed by submission id
+	// and "#" + creation id.
+	emailIDs := map[string]string{}
+
+	for cid, buf := range req.Create {
+		err := trySet(func() {
+			var sc emailSubmissionCreate
+			dec := json.NewDecoder(strings.NewReader(string(buf)))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&sc); err != nil {
+				xinvalidProperties(err.Error())
+			}
+			id, m := c.xsubmit(sc)
+			c.createdIDs[cid] = id
+			emailIDs[id] = emailID(m.ID)
+			emailIDs["#"+cid] = emailID(m.ID)
+			tid := m.ThreadID
+			if tid == 0 {
+				tid = m.ID
+			}
+			resp.addCreated(cid, map[string]any{"id": id, "threadId": threadID(tid), "undoStatus": "pending"})
+		})
+		if err != nil {
+			resp.addNotCreated(cid, *err)
+		}
+	}
+
+	for id, buf := range req.Update {
+		err := trySet(func() {
+			queueID, msgID, ok := parseSubmissionID(c.resolveID(id))
+			if !ok {
+				xsetErrorf("notFound", "submission not found")
+			}
+			var upd struct {
+				UndoStatus string `json:"undoStatus"`
+			}
+			dec := json.NewDecoder(strings.NewReader(string(buf)))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&upd); err != nil || upd.UndoStatus != "canceled" {
+				xinvalidProperties("only undoStatus can be changed, to canceled", "undoStatus")
+			}
+			l := c.xsubmissionMsgs(queueID)
+			if len(l) == 0 {
+				xsetErrorf("notFound", "submission not found")
+			}
+			var qids []int64
+			for _, sm := range l {
+				if sm.Retired || sm.Attempts > 0 {
+					xsetErrorf("cannotUnsend", "delivery already attempted")
+				}
+				qids = append(qids, sm.ID)
+			}
+			n, err := queue.Drop(c.ctx, c.log, queue.Filter{IDs: qids, Account: c.acc.Name})
+			xcheckf(err, "removing messages from queue")
+			if n != len(qids) {
+				xsetErrorf("cannotUnsend", "delivery already attempted")
+			}
+			emailIDs[id] = emailID(msgID)
+			resp.addUpdated(id, nil)
+		})
+		if err != nil {
+			resp.addNotUpdated(id, *err)
+		}
+	}
+
+	for _, id := range req.Destroy {
+		// Submissions are removed from the queue after delivery, clients cannot remove them.
+		resp.addNotDestroyed(id, setError{Type: "forbidden", Description: "submissions cannot be destroyed"})
+	}
+
+	resp.NewState = c.xsubmissionState()
+
+	// Implicit Email/set call for changes on success. ../rfc/8621:3560
+	emailReq := setArgs{AccountID: c.accountID, Update: map[string]json.RawMessage{}}
+	for id, patch := range req.OnSuccessUpdateEmail {
+		if eid, ok := emailIDs[id]; ok {
+			emailReq.Update[eid] = patch
+		}
+	}
+	for _, id := range req.OnSuccessDestroyEmail {
+		if eid, ok := emailIDs[id]; ok {
+			emailReq.Destroy = append(emailReq.Destroy, eid)
+		}
+	}
+	if len(emailReq.Update) > 0 || len(emailReq.Destroy) > 0 {
+		emailResp := c.xemailSet(emailReq)
+		c.extra = append(c.extra, invocation{Name: "Email/set", CallID: c.callID, value: emailResp})
+	}
+
+	return resp
+}
@@ -44,6 +44,7 @@ import (
 	"github.com/mjl-/bstore"
 	"github.com/mjl-/sherpa"
 
+	"github.com/mjl-/mox/admindb"
 	"github.com/mjl-/mox/config"
 	"github.com/mjl-/mox/dane"
 	"github.com/mjl-/mox/dkim"
@@ -103,6 +104,13 @@ var commands = []struct {
 	{"stop", cmdStop},
 	{"setaccountpassword", cmdSetaccountpassword},
 	{"setadminpassword", cmdSetadminpassword},
+	{"admin user list", cmdAdminUserList},
+	{"admin user add", cmdAdminUserAdd},
+	{"admin user update", cmdAdminUserUpdate},
+	{"admin user setpassword", cmdAdminUserSetpassword},
+	{"admin user totpdisable", cmdAdminUserTOTPDisable},
+	{"admin user rm", cmdAdminUserRemove},
+	{"admin auditlog", cmdAdminAuditlog},
 	{"loglevels", cmdLoglevels},
 	{"queue holdrules list", cmdQueueHoldrulesList},
 	{"queue holdrules add", cmdQueueHoldrulesAdd},
@@ -199,6 +207,8 @@ var commands = []struct {
 	{"fixuidmeta", cmdFixUIDMeta},
 	{"fixmsgsize", cmdFixmsgsize},
 	{"reparse", cmdReparse},
+	{"reindex", cmdReindex},
+	{"encryptmessages", cmdEncryptMessages},
 	{"ensureparsed", cmdEnsureParsed},
 	{"recalculatemailboxcounts", cmdRecalculateMailboxCounts},
 	{"message parse", cmdMessageParse},
@@ -1376,6 +1386,10 @@ increases the odds hardlinking succeeds: the default systemd service file
 specifically mounts the data directory, causing attempts to hardlink outside it
 to fail with an error about cross-device linking.
 
+Encrypted message files are stored as is. The key for decrypting them is in the
+account database, sealed with the account password, so a restored backup needs
+the account password at the time of the backup.
+
 All files in the data directory that aren't recognized (i.e. other than known
 database files, message files, an acme directory, the "tmp" directory, etc),
 are stored, but with a warning.
@@ -1431,6 +1445,13 @@ func cmdSetadminpassword(c *cmd) {
 
 The password is read from stdin. Its bcrypt hash is stored in a file named
 "adminpasswd" in the configuration directory.
+
+If two-factor authentication was enabled for the admin in the web interface, its
+secret is stored in "adminpasswd.totp". Remove that file to disable it, e.g.
+after losing the authenticator app.
+
+Additional admin users with their own password and a limited role can be added
+with "mox admin user add".
 `
 	if len(c.Parse()) != 0 {
 		c.Usage()
@@ -1451,6 +1472,223 @@ The password is read from stdin. Its bcrypt hash is stored in a file named
 	xcheckf(err, "writing hash to admin password file")
 }
 
+func cmdAdminUserList(c *cmd) {
+	c.help = `List admin users.
+
+Each line has the name, role, domains (for role "domain"), unix user and
+whether a password is set.
+`
+	if len(c.Parse()) != 0 {
+		c.Usage()
+	}
+	mustLoadConfig()
+	ctlcmdAdminUserList(xctl())
+}
+
+func ctlcmdAdminUserList(ctl *ctl) {
+	ctl.xwrite("adminuserlist")
+	ctl.xreadok()
+	ctl.xstreamto(os.Stdout)
+}
+
+// adminUserFlags registers the flags for the role, domains and unix user of an
+// admin user.
+func adminUserFlags(c *cmd, u *admindb.User) *string {
+	var domains string
+	c.flag.StringVar((*string)(&u.Role), "role", "", "role of admin user: admin, readonly, queue or domain")
+	c.flag.StringVar(&domains, "domains", "", "comma-separated domains managed by an admin user with role domain")
+	c.flag.StringVar(&u.UnixUser, "unixuser", "", "unix user whose connections to the ctl socket, e.g. through mox commands, are limited to the role of the admin user")
+	return &domains
+}
+
+func adminUserDomains(domains string) []string {
+	if domains == "" {
+		return nil
+	}
+	return strings.Split(domains, ",")
+}
+
+func cmdAdminUserAdd(c *cmd) {
+	c.params = "[-password] -role role [-domains domain1,domain2] [-unixuser user] name"
+	c.help = `Add an admin user.
+
+Admin users can log in to the admin web interface with their own password, with
+access limited by their role:
+
+- admin: full access, like the admin password.
+- readonly: viewing configuration, queues and reports, but no changes.
+- queue: like readonly, and managing the message and webhook queues.
+- domain: viewing and changing only the domains given with -domains, and their
+  accounts (by default domain), addresses and aliases.
+
+The admin password remains valid for full admin access.
+
+With -password, a password for logging in to the admin web interface is read
+from stdin. Without password, the user can only be used through its unix user.
+
+With -unixuser, connections to the ctl socket (e.g. with mox commands such as
+"mox queue list") by the unix user are limited to the role of the admin user.
+Connections by root and the unix user mox runs as are not limited. Once any
+admin user has a unix user, connections by all other unix users that are not
+associated with an admin user are denied. Peers can only be identified on
+Linux: on other platforms, all ctl connections are denied once an admin user
+has a unix user.
+`
+	var u admindb.User
+	var password bool
+	domains := adminUserFlags(c, &u)
+	c.flag.BoolVar(&password, "password", false, "read password for admin web interface from stdin")
+	args := c.Parse()
+	if len(args) != 1 || u.Role == "" {
+		c.Usage()
+	}
+	u.Name = args[0]
+	u.Domains = adminUserDomains(*domains)
+	mustLoadConfig()
+	var pw string
+	if password {
+		pw = xreadpassword()
+	}
+	ctlcmdAdminUserAdd(xctl(), u, pw)
+}
+
+func ctlcmdAdminUserAdd(ctl *ctl, u admindb.User, password string) {
+	ctl.xwrite("adminuseradd")
+	xctlwriteJSON(ctl, u)
+	ctl.xwrite(password)
+	ctl.xreadok()
+}
+
+func cmdAdminUserUpdate(c *cmd) {
+	c.params = "-role role [-domains domain1,domain2] [-unixuser user] name"
+	c.help = `Update the role, domains and unix user of an admin user.
+
+All fields are replaced, so unspecified domains and unix user are cleared.
+`
+	var u admindb.User
+	domains := adminUserFlags(c, &u)
+	args := c.Parse()
+	if len(args) != 1 || u.Role == "" {
+		c.Usage()
+	}
+	u.Name = args[0]
+	u.Domains = adminUserDomains(*domains)
+	mustLoadConfig()
+	ctlcmdAdminUserUpdate(xctl(), u)
+}
+
+func ctlcmdAdminUserUpdate(ctl *ctl, u admindb.User) {
+	ctl.xwrite("adminusersave")
+	xctlwriteJSON(ctl, u)
+	ctl.xreadok()
+}
+
+func cmdAdminUserSetpassword(c *cmd) {
+	c.params = "[-disable] name"
+	c.help = `Set a new password for an admin user, for the admin web interface.
+
+The password is read from stdin. Existing sessions of the admin user are ended.
+With -disable, the password is cleared and the user can no longer log in to the
+admin web interface.
+`
+	var disable bool
+	c.flag.BoolVar(&disable, "disable", false, "clear password, disabling logins to the admin web interface")
+	args := c.Parse()
+	if len(args) != 1 {
+		c.Usage()
+	}
+	mustLoadConfig()
+	var pw string
+	if !disable {
+		pw = xreadpassword()
+	}
+	ctlcmdAdminUserSetpassword(xctl(), args[0], pw)
+}
+
+func ctlcmdAdminUserSetpassword(ctl *ctl, name, password string) {
+	ctl.xwrite("adminusersetpassword")
+	ctl.xwrite(name)
+	ctl.xwrite(password)
+	ctl.xreadok()
+}
+
+func cmdAdminUserTOTPDisable(c *cmd) {
+	c.params = "name"
+	c.help = `Disable two-factor authentication for an admin user.
+
+For example after the user lost the authenticator app. The user can set up
+two-factor authentication again after logging in.
+`
+	args := c.Parse()
+	if len(args) != 1 {
+		c.Usage()
+	}
+	mustLoadConfig()
+	ctlcmdAdminUserTOTPDisable(xctl(), args[0])
+}
+
+func ctlcmdAdminUserTOTPDisable(ctl *ctl, name string) {
+	ctl.xwrite("adminusertotpdisable")
+	ctl.xwrite(name)
+	ctl.xreadok()
+}
+
+func cmdAdminUserRemove(c *cmd) {
+	c.params = "name"
+	c.help = `Remove an admin user, ending its sessions.`
+	args := c.Parse()
+	if len(args) != 1 {
+		c.Usage()
+	}
+	mustLoadConfig()
+	ctlcmdAdminUserRemove(xctl(), args[0])
+}
+
+func ctlcmdAdminUserRemove(ctl *ctl, name string) {
+	ctl.xwrite("adminuserrm")
+	ctl.xwrite(name)
+	ctl.xreadok()
+}
+
+func cmdAdminAuditlog(c *cmd) {
+	c.params = "[-source source] [-actor actor] [-kind kind] [-operation operation] [-since duration] [-text text]"
+	c.help = `Print entries from the audit log as JSON lines, oldest first.
+
+The audit log has changes to the configuration (domains.conf) with a diff,
+operations on the queues, and password changes, made through the admin and
+account web interfaces and through mox commands. Each entry has the source
+(ctl, webadmin or webaccount), the actor (admin user, account, or unix user for
+ctl), and the API function or ctl command. Changes to the admin password with
+"mox setadminpassword" are not recorded.
+`
+	var f admindb.AuditFilter
+	var since time.Duration
+	c.flag.StringVar((*string)(&f.Source), "source", "", "only entries from source: ctl, webadmin or webaccount")
+	c.flag.StringVar(&f.Actor, "actor", "", "only entries from actor: admin user, account, or unix user for ctl")
+	c.flag.StringVar((*string)(&f.Kind), "kind", "", "only entries of kind: config, queue, password or adminuser")
+	c.flag.StringVar(&f.Operation, "operation", "", "only entries for the API function or ctl command")
+	c.flag.DurationVar(&since, "since", 0, "only entries from this period until now, e.g. 24h")
+	c.flag.StringVar(&f.Text, "text", "", "only entries with this case-insensitive text in their details or diff")
+	if len(c.Parse()) != 0 {
+		c.Usage()
+	}
+	if since > 0 {
+		t := time.Now().Add(-since)
+		f.Start = &t
+	}
+	mustLoadConfig()
+	ctlcmdAdminAuditlog(xctl(), f)
+}
+
+func ctlcmdAdminAuditlog(ctl *ctl, f admindb.AuditFilter) {
+	ctl.xwrite("auditlog")
+	xctlwriteJSON(ctl, f)
+	ctl.xreadok()
+	if _, err := io.Copy(os.Stdout, ctl.reader()); err != nil {
+		log.Fatalf("%s", err)
+	}
+}
+
 func xreadpassword() string {
 	fmt.Printf(`
 Type new password. Password WILL echo.
@@ -3219,6 +3457,74 @@ func ctlcmdReparse(ctl *ctl, account string) {
 	ctl.xstreamto(os.Stdout)
 }
 
+func cmdReindex(c *cmd) {
+	c.params = "[account]"
+	c.help = `Rebuild the full-text index of all messages in the account or all accounts.
+
+The full-text index is used to quickly find messages when searching for words,
+e.g. with IMAP SEARCH BODY/TEXT and in the webmail search. Messages are added
+to the index when delivered. Messages that could not be indexed, e.g. because
+of their size, are read while searching.
+
+Can be useful after upgrading mox with improved indexing, or to add messages
+delivered before the index existed. The index is first cleared, then messages
+are indexed in batches, so other access to the mailboxes/messages is not
+blocked while indexing. Searches while reindexing read messages that are not
+yet indexed.
+`
+	args := c.Parse()
+	if len(args) > 1 {
+		c.Usage()
+	}
+
+	mustLoadConfig()
+	var account string
+	if len(args) == 1 {
+		account = args[0]
+	}
+	ctlcmdReindex(xctl(), account)
+}
+
+func ctlcmdReindex(ctl *ctl, account string) {
+	ctl.xwrite("reindex")
+	ctl.xwrite(account)
+	ctl.xreadok()
+	ctl.xstreamto(os.Stdout)
+}
+
+func cmdEncryptMessages(c *cmd) {
+	c.params = "account"
+	c.help = `Encrypt existing messages of an account.
+
+With EncryptMessages enabled for an account, new messages are stored encrypted.
+Messages delivered before are not. This command encrypts the remaining plain
+text message files, and the parsed messages in the account database. The
+Message-ID and base subject of messages, used for threading, are replaced with
+hashes, and the full-text index is removed. Until this command is run, new
+messages are not matched to threads of messages delivered before the key was
+created. The account must already have a key, which is created at the first
+login with password or password change after enabling encryption. Only the
+public key is needed, the account does not have to be unlocked.
+
+Messages are encrypted in small batches, so other access to the account is not
+blocked.
+`
+	args := c.Parse()
+	if len(args) != 1 {
+		c.Usage()
+	}
+
+	mustLoadConfig()
+	ctlcmdEncryptMessages(xctl(), args[0])
+}
+
+func ctlcmdEncryptMessages(ctl *ctl, account string) {
+	ctl.xwrite("encryptmessages")
+	ctl.xwrite(account)
+	ctl.xreadok()
+	ctl.xstreamto(os.Stdout)
+}
+
 func cmdEnsureParsed(c *cmd) {
 	c.params = "account"
 	c.help = "Ensure messages in the database have a pre-parsed MIME form in the database."
@@ -3255,9 +3561,9 @@ func cmdEnsureParsed(c *cmd) {
 			if err != nil {
 				log.Printf("parsing message %d: %v (continuing)", m.ID, err)
 			}
-			m.ParsedBuf, err = json.Marshal(p)
+			m.ParsedBuf, err = a.MarshalPart(tx, p)
 			if err != nil {
-				return fmt.Errorf("marshal parsed message: %v", err)
+				return err
 			}
 			if err := tx.Update(&m); err != nil {
 				return fmt.Errorf("update message: %v", err)
@@ -3482,7 +3788,9 @@ Opens database files directly, not going through a running mox instance.
 					HeaderOffset int64
 					BodyOffset   int64
 				}
-				if err := json.Unmarshal(m.ParsedBuf, &partialPart); err != nil {
+				if buf, err := m.ParsedJSON(); err != nil {
+					w.Err = fmt.Errorf("get part: %w", err)
+				} else if err := json.Unmarshal(buf, &partialPart); err != nil {
 					w.Err = fmt.Errorf("unmarshal part: %v", err)
 				} else {
 					size := partialPart.BodyOffset - partialPart.HeaderOffset
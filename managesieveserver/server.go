@@ -0,0 +1,1264 @@
+// Package managesieveserver implements a ManageSieve server (RFC 5804), for
+// email applications to manage the Sieve scripts of an account that filter
+// incoming messages.
+package managesieveserver
+
+/*
+Implementation notes
+
+- Scripts are stored in the account database, see store.SieveScript. At most one
+  script is active, it is evaluated for incoming messages.
+- Only the SASL mechanisms PLAIN and SCRAM-* are supported, like for IMAP. PLAIN
+  is only available on TLS connections, unless configured otherwise.
+- We don't implement the UNAUTHENTICATE extension, or SASL security layers.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"os"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/maps"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/metrics"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/moxio"
+	"github.com/mjl-/mox/moxvar"
+	"github.com/mjl-/mox/ratelimit"
+	"github.com/mjl-/mox/scram"
+	"github.com/mjl-/mox/sieve"
+	"github.com/mjl-/mox/store"
+)
+
+var (
+	metricConnection = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mox_managesieve_connection_total",
+			Help: "Incoming ManageSieve connections.",
+		},
+		[]string{
+			"service", // managesieve
+		},
+	)
+	metricCommands = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "mox_managesieve_command_duration_seconds",
+			Help:    "ManageSieve command duration and result codes in seconds.",
+			Buckets: []float64{0.001, 0.005, 0.01, 0.05, 0.100, 0.5, 1, 5, 10, 20},
+		},
+		[]string{
+			"cmd",
+			"result", // ok, panic, ioerror, badsyntax, servererror, usererror, error
+		},
+	)
+)
+
+var limiterConnectionrate, limiterConnections *ratelimit.Limiter
+
+func init() {
+	// Also called by tests, so they don't trigger the rate limiter.
+	limitersInit()
+}
+
+func limitersInit() {
+	mox.LimitersInit()
+	limiterConnectionrate = &ratelimit.Limiter{
+		WindowLimits: []ratelimit.WindowLimit{
+			{
+				Window: time.Minute,
+				Limits: [...]int64{100, 300, 900},
+			},
+		},
+	}
+	limiterConnections = &ratelimit.Limiter{
+		WindowLimits: []ratelimit.WindowLimit{
+			{
+				Window: time.Duration(math.MaxInt64), // All of time.
+				Limits: [...]int64{10, 30, 90},
+			},
+		},
+	}
+}
+
+// Delay after bad/suspicious behaviour. Tests set these to zero.
+var badClientDelay = time.Second // Before reads and after 1-byte writes for probably spammers.
+var authFailDelay = time.Second  // After authentication failure.
+
+// Limits on the size of command parameters. Quoted strings are limited by the RFC.
+// Literals hold scripts, which are limited by store.SieveScriptMaxSize. We read
+// somewhat larger literals so we can respond with a proper error.
+const (
+	maxAtom    = 1024
+	maxQuoted  = 1024 // ../rfc/5804:2158
+	maxLiteral = 4 * store.SieveScriptMaxSize
+	maxArgs    = 8
+)
+
+type conn struct {
+	cid               int64
+	state             state
+	conn              net.Conn
+	tls               bool               // Whether TLS has been initialized.
+	br                *bufio.Reader      // From remote, with TLS unwrapped in case of TLS.
+	bw                *bufio.Writer      // To remote, with TLS added in case of TLS.
+	tr                *moxio.TraceReader // Kept to change trace level when reading/writing cmd/auth/data.
+	tw                *moxio.TraceWriter
+	lineDone          bool        // Whether the current command line has been read completely, for skipping the remainder after a syntax error.
+	slow              bool        // If set, reads are done with a 1 second sleep, and writes are done 1 byte at a time, to keep spammers busy.
+	lastlog           time.Time   // For printing time since previous log line.
+	tlsConfig         *tls.Config // TLS config to use for handshake.
+	remoteIP          net.IP
+	noRequireSTARTTLS bool
+	cmd               string // Currently executing, for logging.
+	cmdMetric         string // Currently executing, for metrics.
+	cmdStart          time.Time
+	ncmds             int // Number of commands processed. Used to abort connection when first incoming command is unknown/invalid.
+	log               mlog.Log
+
+	// Only when authenticated.
+	authFailed int    // Number of failed auth attempts. For slowing down remote with many failures.
+	username   string // Full username as used during login.
+	account    *store.Account
+}
+
+type state byte
+
+const (
+	stateNotAuthenticated state = iota
+	stateAuthenticated
+)
+
+// Command parameter, either an atom (including numbers) or a string (quoted or literal).
+type arg struct {
+	s    string
+	atom bool
+}
+
+func stateCommands(cmds ...string) map[string]struct{} {
+	r := map[string]struct{}{}
+	for _, cmd := range cmds {
+		r[cmd] = struct{}{}
+	}
+	return r
+}
+
+var (
+	commandsStateAny              = stateCommands("capability", "logout", "noop")
+	commandsStateNotAuthenticated = stateCommands("starttls", "authenticate")
+	commandsStateAuthenticated    = stateCommands("havespace", "putscript", "listscripts", "setactive", "getscript", "deletescript", "renamescript", "checkscript")
+)
+
+var commands = map[string]func(c *conn, cmd string, args []arg){
+	// Any state.
+	"capability": (*conn).cmdCapability,
+	"logout":     (*conn).cmdLogout,
+	"noop":       (*conn).cmdNoop,
+
+	// Notauthenticated.
+	"starttls":     (*conn).cmdStarttls,
+	"authenticate": (*conn).cmdAuthenticate,
+
+	// Authenticated.
+	"havespace":    (*conn).cmdHavespace,
+	"putscript":    (*conn).cmdPutscript,
+	"listscripts":  (*conn).cmdListscripts,
+	"setactive":    (*conn).cmdSetactive,
+	"getscript":    (*conn).cmdGetscript,
+	"deletescript": (*conn).cmdDeletescript,
+	"renamescript": (*conn).cmdRenamescript,
+	"checkscript":  (*conn).cmdCheckscript,
+}
+
+var errIO = errors.New("io error")             // For read/write errors and errors that should close the connection.
+var errProtocol = errors.New("protocol error") // For protocol errors for which a stack trace should be printed.
+
+// Listen initializes all managesieve listeners for the configuration, and stores
+// them for Serve to start them.
+func Listen() {
+	names := maps.Keys(mox.Conf.Static.Listeners)
+	sort.Strings(names)
+	for _, name := range names {
+		listener := mox.Conf.Static.Listeners[name]
+
+		var tlsConfig *tls.Config
+		if listener.TLS != nil {
+			tlsConfig = listener.TLS.Config
+		}
+
+		if listener.ManageSieve.Enabled {
+			port := config.Port(listener.ManageSieve.Port, 4190)
+			for _, ip := range listener.IPs {
+				listen1("managesieve", name, ip, port, tlsConfig, listener.ManageSieve.NoRequireSTARTTLS)
+			}
+		}
+	}
+}
+
+var servers []func()
+
+func listen1(protocol, listenerName, ip string, port int, tlsConfig *tls.Config, noRequireSTARTTLS bool) {
+	log := mlog.New("managesieveserver", nil)
+	addr := net.JoinHostPort(ip, fmt.Sprintf("%d", port))
+	if os.Getuid() == 0 {
+		log.Print("listening for managesieve",
+			slog.String("listener", listenerName),
+			slog.String("addr", addr),
+			slog.String("protocol", protocol))
+	}
+	network := mox.Network(ip)
+	ln, err := mox.Listen(network, addr)
+	if err != nil {
+		log.Fatalx("managesieve: listen for managesieve", err, slog.String("protocol", protocol), slog.String("listener", listenerName))
+	}
+
+	serve := func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				log.Infox("managesieve: accept", err, slog.String("protocol", protocol), slog.String("listener", listenerName))
+				continue
+			}
+
+			metricConnection.WithLabelValues(protocol).Inc()
+			go serve(listenerName, mox.Cid(), tlsConfig, conn, false, noRequireSTARTTLS)
+		}
+	}
+
+	servers = append(servers, serve)
+}
+
+// Serve starts serving on all listeners, launching a goroutine per listener.
+func Serve() {
+	for _, serve := range servers {
+		go serve()
+	}
+	servers = nil
+}
+
+func (c *conn) setSlow(on bool) {
+	if on && !c.slow {
+		c.log.Debug("connection changed to slow")
+	} else if !on && c.slow {
+		c.log.Debug("connection restored to regular pace")
+	}
+	c.slow = on
+}
+
+// Write makes a connection an io.Writer. It panics for i/o errors. These errors
+// are handled in the connection command loop.
+func (c *conn) Write(buf []byte) (int, error) {
+	chunk := len(buf)
+	if c.slow {
+		chunk = 1
+	}
+
+	var n int
+	for len(buf) > 0 {
+		err := c.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+		c.log.Check(err, "setting write deadline")
+
+		nn, err := c.conn.Write(buf[:chunk])
+		if err != nil {
+			panic(fmt.Errorf("write: %s (%w)", err, errIO))
+		}
+		n += nn
+		buf = buf[chunk:]
+		if len(buf) > 0 && badClientDelay > 0 {
+			mox.Sleep(mox.Context, badClientDelay)
+		}
+	}
+	return n, nil
+}
+
+func (c *conn) xtrace(level slog.Level) func() {
+	c.xflush()
+	c.tr.SetTrace(level)
+	c.tw.SetTrace(level)
+	return func() {
+		c.xflush()
+		c.tr.SetTrace(mlog.LevelTrace)
+		c.tw.SetTrace(mlog.LevelTrace)
+	}
+}
+
+func (c *conn) bwritelinef(format string, args ...any) {
+	format += "\r\n"
+	fmt.Fprintf(c.bw, format, args...)
+}
+
+func (c *conn) writelinef(format string, args ...any) {
+	c.bwritelinef(format, args...)
+	c.xflush()
+}
+
+func (c *conn) xflush() {
+	err := c.bw.Flush()
+	xcheckf(err, "flush") // Should never happen, the Write caused by the Flush should panic on i/o error.
+}
+
+// ok writes an OK response, with an optional human-readable message.
+func (c *conn) ok(msg string) {
+	if msg == "" {
+		c.writelinef("OK")
+	} else {
+		c.writelinef("OK %s", encodeString(msg))
+	}
+}
+
+// encodeString returns s as quoted string, or as literal if it cannot be
+// represented as quoted string. ../rfc/5804:2138
+func encodeString(s string) string {
+	if len(s) > maxQuoted || strings.ContainsAny(s, "\r\n\x00") {
+		return fmt.Sprintf("{%d}\r\n%s", len(s), s)
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	return `"` + r.Replace(s) + `"`
+}
+
+// xreadByte reads a byte of the command line being read.
+func (c *conn) xreadByte() byte {
+	b, err := c.br.ReadByte()
+	if err != nil {
+		panic(fmt.Errorf("reading command: %s (%w)", err, errIO))
+	}
+	return b
+}
+
+// xreadArgs reads parameters until the end of the line. Strings can be quoted or
+// literals (that can span lines), other parameters are returned as atom.
+// ../rfc/5804:2091
+func (c *conn) xreadArgs() []arg {
+	if c.slow && badClientDelay > 0 {
+		mox.Sleep(mox.Context, badClientDelay)
+	}
+
+	var args []arg
+	for {
+		b := c.xreadByte()
+		switch b {
+		case ' ':
+			continue
+		case '\r':
+			if c.xreadByte() != '\n' {
+				xsyntaxErrorf("expected lf after cr")
+			}
+			fallthrough
+		case '\n':
+			c.lineDone = true
+			return args
+		}
+
+		if len(args) >= maxArgs {
+			xsyntaxErrorf("too many parameters")
+		}
+
+		var buf []byte
+		switch b {
+		case '"':
+			for {
+				b := c.xreadByte()
+				if b == '"' {
+					break
+				} else if b == '\\' {
+					b = c.xreadByte()
+					if b != '\\' && b != '"' {
+						xsyntaxErrorf("invalid escape in quoted string")
+					}
+				} else if b == '\r' || b == '\n' || b == 0 {
+					if b == '\n' {
+						c.lineDone = true
+					}
+					xsyntaxErrorf("invalid character in quoted string")
+				}
+				if len(buf) >= maxQuoted {
+					xsyntaxErrorf("quoted string too long")
+				}
+				buf = append(buf, b)
+			}
+			args = append(args, arg{s: string(buf)})
+
+		case '{':
+			// Literal, both synchronizing and non-synchronizing. We don't have to send a
+			// continuation for synchronizing literals. ../rfc/5804:2110
+			var digits []byte
+			for {
+				b := c.xreadByte()
+				if b >= '0' && b <= '9' && len(digits) < 10 {
+					digits = append(digits, b)
+					continue
+				}
+				if b == '+' {
+					b = c.xreadByte()
+				}
+				if b != '}' || len(digits) == 0 {
+					xsyntaxErrorf("malformed literal")
+				}
+				break
+			}
+			if c.xreadByte() != '\r' || c.xreadByte() != '\n' {
+				xsyntaxErrorf("expected crlf after literal size")
+			}
+			size, err := strconv.ParseInt(string(digits), 10, 64)
+			if err != nil || size > maxLiteral {
+				// We cannot continue reading commands, we don't want to read this much data.
+				c.writelinef("BYE %s", encodeString("literal too large"))
+				panic(fmt.Errorf("literal too large (%w)", errProtocol))
+			}
+			buf = make([]byte, size)
+			if _, err := io.ReadFull(c.br, buf); err != nil {
+				panic(fmt.Errorf("reading literal: %s (%w)", err, errIO))
+			}
+			args = append(args, arg{s: string(buf)})
+
+		default:
+			buf = append(buf, b)
+			for {
+				b, err := c.br.Peek(1)
+				if err != nil {
+					panic(fmt.Errorf("reading command: %s (%w)", err, errIO))
+				} else if b[0] == ' ' || b[0] == '\r' || b[0] == '\n' {
+					break
+				} else if b[0] == '"' || b[0] == '{' {
+					xsyntaxErrorf("unexpected %q in atom", b[0])
+				}
+				if len(buf) >= maxAtom {
+					xsyntaxErrorf("atom too long")
+				}
+				buf = append(buf, c.xreadByte())
+			}
+			args = append(args, arg{s: string(buf), atom: true})
+		}
+	}
+}
+
+// xskipLine reads until the end of the current line, after a syntax error.
+func (c *conn) xskipLine() {
+	for n := 0; !c.lineDone; n++ {
+		if n > 16*1024 {
+			panic(fmt.Errorf("syntax error and no end of line (%w)", errProtocol))
+		}
+		if c.xreadByte() == '\n' {
+			c.lineDone = true
+		}
+	}
+}
+
+var cleanClose struct{} // Sentinel value for panic/recover indicating clean close of connection.
+
+func serve(listenerName string, cid int64, tlsConfig *tls.Config, nc net.Conn, xtls, noRequireSTARTTLS bool) {
+	var remoteIP net.IP
+	if a, ok := nc.RemoteAddr().(*net.TCPAddr); ok {
+		remoteIP = a.IP
+	} else {
+		// For net.Pipe, during tests.
+		remoteIP = net.ParseIP("127.0.0.10")
+	}
+
+	c := &conn{
+		cid:               cid,
+		conn:              nc,
+		tls:               xtls,
+		lastlog:           time.Now(),
+		tlsConfig:         tlsConfig,
+		remoteIP:          remoteIP,
+		noRequireSTARTTLS: noRequireSTARTTLS,
+		cmd:               "(greeting)",
+		cmdStart:          time.Now(),
+	}
+	var logmutex sync.Mutex
+	c.log = mlog.New("managesieveserver", nil).WithFunc(func() []slog.Attr {
+		logmutex.Lock()
+		defer logmutex.Unlock()
+		now := time.Now()
+		l := []slog.Attr{
+			slog.Int64("cid", c.cid),
+			slog.Duration("delta", now.Sub(c.lastlog)),
+		}
+		c.lastlog = now
+		if c.username != "" {
+			l = append(l, slog.String("username", c.username))
+		}
+		return l
+	})
+	c.tr = moxio.NewTraceReader(c.log, "C: ", c.conn)
+	c.tw = moxio.NewTraceWriter(c.log, "S: ", c)
+	c.br = bufio.NewReader(c.tr)
+	c.bw = bufio.NewWriter(c.tw)
+
+	c.log.Info("new connection",
+		slog.Any("remote", c.conn.RemoteAddr()),
+		slog.Any("local", c.conn.LocalAddr()),
+		slog.Bool("tls", xtls),
+		slog.String("listener", listenerName))
+
+	defer func() {
+		c.conn.Close()
+
+		if c.account != nil {
+			err := c.account.Close()
+			c.log.Check(err, "close account")
+			c.account = nil
+		}
+
+		x := recover()
+		if x == nil || x == cleanClose {
+			c.log.Info("connection closed")
+		} else if err, ok := x.(error); ok && isClosed(err) {
+			c.log.Infox("connection closed", err)
+		} else {
+			c.log.Error("unhandled panic", slog.Any("err", x))
+			debug.PrintStack()
+			metrics.PanicInc(metrics.Managesieve)
+		}
+	}()
+
+	select {
+	case <-mox.Shutdown.Done():
+		c.writelinef("BYE %s", encodeString("mox shutting down"))
+		return
+	default:
+	}
+
+	if !limiterConnectionrate.Add(c.remoteIP, time.Now(), 1) {
+		c.writelinef("BYE %s", encodeString("connection rate from your ip or network too high, slow down please"))
+		return
+	}
+
+	// If remote IP/network resulted in too many authentication failures, refuse to serve.
+	if !mox.LimiterFailedAuth.CanAdd(c.remoteIP, time.Now(), 1) {
+		metrics.AuthenticationRatelimitedInc("managesieve")
+		c.log.Debug("refusing connection due to many auth failures", slog.Any("remoteip", c.remoteIP))
+		c.writelinef("BYE %s", encodeString("too many auth failures"))
+		return
+	}
+
+	if !limiterConnections.Add(c.remoteIP, time.Now(), 1) {
+		c.log.Debug("refusing connection due to many open connections", slog.Any("remoteip", c.remoteIP))
+		c.writelinef("BYE %s", encodeString("too many open connections from your ip or network"))
+		return
+	}
+	defer limiterConnections.Add(c.remoteIP, time.Now(), -1)
+
+	// We register and unregister the original connection, in case it c.conn is
+	// replaced with a TLS connection later on.
+	mox.Connections.Register(nc, "managesieve", listenerName)
+	defer mox.Connections.Unregister(nc)
+
+	// Greeting is the capabilities and an OK. ../rfc/5804:1002
+	c.bwriteCapabilities()
+	c.ok("mox managesieve ready")
+
+	for {
+		c.command()
+		c.xflush() // For flushing errors, or possibly commands that did not flush explicitly.
+	}
+}
+
+// isClosed returns whether i/o failed, typically because the connection is closed.
+// For connection errors, we often want to generate fewer logs.
+func isClosed(err error) bool {
+	return errors.Is(err, errIO) || errors.Is(err, errProtocol) || moxio.IsClosed(err)
+}
+
+func (c *conn) command() {
+	var cmd string
+
+	defer func() {
+		var result string
+		defer func() {
+			metricCommands.WithLabelValues(c.cmdMetric, result).Observe(float64(time.Since(c.cmdStart)) / float64(time.Second))
+		}()
+
+		logFields := []slog.Attr{
+			slog.String("cmd", c.cmd),
+			slog.Duration("duration", time.Since(c.cmdStart)),
+		}
+		c.cmd = ""
+
+		x := recover()
+		if x == nil || x == cleanClose {
+			c.log.Debug("managesieve command done", logFields...)
+			result = "ok"
+			if x == cleanClose {
+				panic(x)
+			}
+			return
+		}
+		err, ok := x.(error)
+		if !ok {
+			c.log.Error("managesieve command panic", append([]slog.Attr{slog.Any("panic", x)}, logFields...)...)
+			result = "panic"
+			panic(x)
+		}
+
+		var sxerr syntaxError
+		var uerr userError
+		var serr serverError
+		if isClosed(err) {
+			c.log.Infox("managesieve command ioerror", err, logFields...)
+			result = "ioerror"
+			if errors.Is(err, errProtocol) {
+				debug.PrintStack()
+			}
+			panic(err)
+		} else if errors.As(err, &sxerr) {
+			result = "badsyntax"
+			if c.ncmds == 0 {
+				// Other side is likely speaking something else than ManageSieve, send error
+				// message and stop processing.
+				c.writelinef("BYE %s", encodeString("please try again speaking managesieve"))
+				panic(errIO)
+			}
+			c.log.Debugx("managesieve command syntax error", sxerr.err, logFields...)
+			c.xskipLine()
+			c.writelinef("NO %s", encodeString(fmt.Sprintf("%s: %s", cmd, sxerr.err)))
+		} else if errors.As(err, &serr) {
+			result = "servererror"
+			c.log.Errorx("managesieve command server error", err, logFields...)
+			debug.PrintStack()
+			c.writelinef("NO %s", encodeString(fmt.Sprintf("%s: %s", cmd, err)))
+		} else if errors.As(err, &uerr) {
+			result = "usererror"
+			c.log.Debugx("managesieve command user error", err, logFields...)
+			code := ""
+			if uerr.code != "" {
+				code = "(" + uerr.code + ") "
+			}
+			c.writelinef("NO %s%s", code, encodeString(err.Error()))
+		} else {
+			// Other type of panic, we pass it on, aborting the connection.
+			result = "panic"
+			c.log.Errorx("managesieve command panic", err, logFields...)
+			panic(err)
+		}
+	}()
+
+	// Read the command. Unauthenticated connections must be quick.
+	d := 30 * time.Minute
+	if c.state == stateNotAuthenticated {
+		d = 30 * time.Second
+	}
+	err := c.conn.SetReadDeadline(time.Now().Add(d))
+	c.log.Check(err, "setting read deadline")
+
+	c.cmd = ""
+	c.cmdMetric = "(unrecognized)"
+	c.lineDone = false
+	var buf []byte
+	for {
+		b, err := c.br.ReadByte()
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				err := c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+				c.log.Check(err, "setting write deadline")
+				c.writelinef("BYE %s", encodeString("inactive"))
+			}
+			panic(fmt.Errorf("reading command: %s (%w)", err, errIO))
+		}
+		if b == ' ' || b == '\r' || b == '\n' {
+			if err := c.br.UnreadByte(); err != nil {
+				panic(fmt.Errorf("unread: %s (%w)", err, errIO))
+			}
+			break
+		}
+		if len(buf) >= 32 {
+			xsyntaxErrorf("command too long")
+		}
+		buf = append(buf, b)
+	}
+	cmd = string(buf)
+	cmdlow := strings.ToLower(cmd)
+	c.cmd = cmdlow
+	c.cmdStart = time.Now()
+
+	// Authentication can have a plain text password in the parameters.
+	var args []arg
+	if cmdlow == "authenticate" {
+		c.tr.SetTrace(mlog.LevelTraceauth)
+		args = c.xreadArgs()
+		c.tr.SetTrace(mlog.LevelTrace)
+	} else {
+		args = c.xreadArgs()
+	}
+
+	select {
+	case <-mox.Shutdown.Done():
+		c.writelinef("BYE %s", encodeString("shutting down"))
+		panic(errIO)
+	default:
+	}
+
+	fn := commands[cmdlow]
+	if fn == nil {
+		xsyntaxErrorf("unknown command %q", cmd)
+	}
+	c.cmdMetric = c.cmd
+	c.ncmds++
+
+	// Check if command is allowed in this state.
+	if _, ok1 := commandsStateAny[cmdlow]; ok1 {
+	} else if _, ok2 := commandsStateNotAuthenticated[cmdlow]; ok2 && c.state == stateNotAuthenticated {
+	} else if _, ok3 := commandsStateAuthenticated[cmdlow]; ok3 && c.state == stateAuthenticated {
+	} else {
+		xuserErrorf("not allowed in this connection state")
+	}
+
+	fn(c, cmd, args)
+}
+
+// xparams checks the number of parameters is between min and max, and that they
+// are strings, not atoms.
+func xparams(args []arg, min, max int) []string {
+	if len(args) < min || len(args) > max {
+		if min == max {
+			xsyntaxErrorf("expected %d parameters, got %d", min, len(args))
+		}
+		xsyntaxErrorf("expected %d to %d parameters, got %d", min, max, len(args))
+	}
+	var l []string
+	for _, a := range args {
+		if a.atom {
+			xsyntaxErrorf("expected string, got atom %q", a.s)
+		}
+		l = append(l, a.s)
+	}
+	return l
+}
+
+func (c *conn) xdbwrite(fn func(tx *bstore.Tx) error) {
+	err := c.account.DB.Write(context.TODO(), fn)
+	c.xcheckScriptErr(err)
+}
+
+func (c *conn) xdbread(fn func(tx *bstore.Tx) error) {
+	err := c.account.DB.Read(context.TODO(), fn)
+	c.xcheckScriptErr(err)
+}
+
+// xcheckScriptErr turns known errors about scripts into responses with a
+// response code.
+func (c *conn) xcheckScriptErr(err error) {
+	var perr sieve.ParseError
+	if err == nil {
+		return
+	} else if errors.Is(err, store.ErrSieveScriptUnknown) {
+		xusercodeErrorf("NONEXISTENT", "%s", err) // ../rfc/5804:822
+	} else if errors.Is(err, store.ErrSieveScriptActive) {
+		xusercodeErrorf("ACTIVE", "%s", err) // ../rfc/5804:834
+	} else if errors.Is(err, store.ErrSieveScriptExists) {
+		xusercodeErrorf("ALREADYEXISTS", "%s", err) // ../rfc/5804:842
+	} else if errors.As(err, &perr) {
+		xuserErrorf("%s", err)
+	}
+	xcheckf(err, "transaction")
+}
+
+// xcheckScript checks the script name and content, for PUTSCRIPT and
+// CHECKSCRIPT.
+func xcheckScript(content string) {
+	if len(content) > store.SieveScriptMaxSize {
+		xusercodeErrorf("QUOTA/MAXSIZE", "script larger than maximum size %d bytes", store.SieveScriptMaxSize) // ../rfc/5804:806
+	}
+	if _, err := sieve.Parse(content); err != nil {
+		xuserErrorf("%s", err)
+	}
+}
+
+func xcheckScriptName(name string) {
+	if err := store.CheckSieveScriptName(name); err != nil {
+		xuserErrorf("%s", err)
+	}
+}
+
+// bwriteCapabilities writes the capabilities, each on a line. Writing the
+// terminating OK is up to the caller.
+func (c *conn) bwriteCapabilities() {
+	// ../rfc/5804:1109
+	c.bwritelinef(`"IMPLEMENTATION" %s`, encodeString("mox "+moxvar.Version))
+	var mechs []string
+	if c.state == stateNotAuthenticated {
+		if store.PasswordHashMechanisms() {
+			mechs = []string{"SCRAM-SHA-256-PLUS", "SCRAM-SHA-256", "SCRAM-SHA-1-PLUS", "SCRAM-SHA-1"}
+		}
+		if c.tls || c.noRequireSTARTTLS {
+			mechs = append(mechs, "PLAIN")
+		}
+	}
+	c.bwritelinef(`"SASL" %s`, encodeString(strings.Join(mechs, " ")))
+	exts := make([]string, len(sieve.Extensions))
+	for i, s := range sieve.Extensions {
+		exts[i] = strings.ToLower(s)
+	}
+	c.bwritelinef(`"SIEVE" %s`, encodeString(strings.Join(exts, " ")))
+	if !c.tls && c.tlsConfig != nil && c.state == stateNotAuthenticated {
+		c.bwritelinef(`"STARTTLS"`)
+	}
+	c.bwritelinef(`"MAXREDIRECTS" %s`, encodeString(fmt.Sprintf("%d", sieve.MaxRedirects)))
+	if c.state == stateAuthenticated {
+		c.bwritelinef(`"OWNER" %s`, encodeString(c.username))
+	}
+	c.bwritelinef(`"VERSION" "1.0"`)
+}
+
+// Capability returns the capabilities the server currently has available given
+// the connection state.
+//
+// State: any
+func (c *conn) cmdCapability(cmd string, args []arg) {
+	// Command: ../rfc/5804:1085
+	xparams(args, 0, 0)
+	c.bwriteCapabilities()
+	c.ok("")
+}
+
+// Logout, after which server closes the connection.
+//
+// State: any
+func (c *conn) cmdLogout(cmd string, args []arg) {
+	// Command: ../rfc/5804:1296
+	xparams(args, 0, 0)
+	c.ok("bye")
+	panic(cleanClose)
+}
+
+// Noop does nothing. The optional parameter is echoed in a TAG response code.
+//
+// State: any
+func (c *conn) cmdNoop(cmd string, args []arg) {
+	// Command: ../rfc/5804:1644
+	l := xparams(args, 0, 1)
+	if len(l) == 1 {
+		c.writelinef("OK (TAG %s) %s", encodeString(l[0]), encodeString("done"))
+		return
+	}
+	c.ok("done")
+}
+
+// STARTTLS enables TLS on the connection, after a plain text start. After the
+// TLS handshake, the capabilities are sent again.
+//
+// State: Not authenticated.
+func (c *conn) cmdStarttls(cmd string, args []arg) {
+	// Command: ../rfc/5804:1050
+	xparams(args, 0, 0)
+
+	if c.tls {
+		xuserErrorf("tls already active")
+	}
+	if c.tlsConfig == nil {
+		xuserErrorf("starttls not available")
+	}
+
+	// TLS is done on the underlying connection, but bytes already read into the
+	// buffered reader must be used for the TLS handshake.
+	conn := c.conn
+	if n := c.br.Buffered(); n > 0 {
+		conn = &moxio.PrefixConn{
+			PrefixReader: io.LimitReader(c.br, int64(n)),
+			Conn:         conn,
+		}
+	}
+	// We add the cid to facilitate debugging in case of TLS connection failure.
+	c.ok("begin tls negotiation now (" + mox.ReceivedID(c.cid) + ")")
+
+	cidctx := context.WithValue(mox.Context, mlog.CidKey, c.cid)
+	ctx, cancel := context.WithTimeout(cidctx, time.Minute)
+	defer cancel()
+	tlsConn := tls.Server(conn, c.tlsConfig)
+	c.log.Debug("starting tls server handshake")
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		panic(fmt.Errorf("starttls handshake: %s (%w)", err, errIO))
+	}
+	cancel()
+	tlsversion, ciphersuite := moxio.TLSInfo(tlsConn)
+	c.log.Debug("tls server handshake done", slog.String("tls", tlsversion), slog.String("ciphersuite", ciphersuite))
+
+	c.conn = tlsConn
+	c.tr = moxio.NewTraceReader(c.log, "C: ", c.conn)
+	c.tw = moxio.NewTraceWriter(c.log, "S: ", c)
+	c.br = bufio.NewReader(c.tr)
+	c.bw = bufio.NewWriter(c.tw)
+	c.tls = true
+
+	// ../rfc/5804:1072
+	c.bwriteCapabilities()
+	c.ok("tls active")
+}
+
+// Authenticate using SASL. Like IMAP AUTHENTICATE, but challenges and responses
+// are strings instead of lines.
+//
+// State: Not authenticated.
+func (c *conn) cmdAuthenticate(cmd string, args []arg) {
+	// Command: ../rfc/5804:605
+	// Examples: ../rfc/5804:723
+
+	// For many failed auth attempts, slow down verification attempts.
+	if c.authFailed > 3 && authFailDelay > 0 {
+		mox.Sleep(mox.Context, time.Duration(c.authFailed-3)*authFailDelay)
+	}
+
+	// If authentication fails due to missing derived secrets, we don't hold it against
+	// the connection. There is no way to indicate server support for an authentication
+	// mechanism, but that a mechanism won't work for an account.
+	var missingDerivedSecrets bool
+
+	c.authFailed++ // Compensated on success.
+	defer func() {
+		if missingDerivedSecrets {
+			c.authFailed--
+		}
+		// On the 3rd failed authentication, start responding slowly. Successful auth will
+		// cause fast responses again.
+		if c.authFailed >= 3 {
+			c.setSlow(true)
+		}
+	}()
+
+	var authVariant string
+	authResult := "error"
+	defer func() {
+		metrics.AuthenticationInc("managesieve", authVariant, authResult)
+		if authResult == "ok" {
+			mox.LimiterFailedAuth.Reset(c.remoteIP, time.Now())
+		} else if !missingDerivedSecrets {
+			mox.LimiterFailedAuth.Add(c.remoteIP, time.Now(), 1)
+		}
+	}()
+
+	l := xparams(args, 1, 2)
+	authType := l[0]
+
+	xdecode := func(s string) []byte {
+		buf, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			xsyntaxErrorf("parsing base64: %v", err)
+		}
+		return buf
+	}
+
+	// Read the response to a challenge, a string, or "*" to abort.
+	xreadContinuation := func() []byte {
+		c.lineDone = false
+		args := c.xreadArgs()
+		if len(args) != 1 {
+			xsyntaxErrorf("expected single string as authentication response")
+		}
+		// ../rfc/5804:660
+		if args[0].s == "*" {
+			authResult = "aborted"
+			xuserErrorf("authenticate aborted by client")
+		}
+		return xdecode(args[0].s)
+	}
+
+	xreadInitial := func() []byte {
+		if len(l) == 2 {
+			return xdecode(l[1])
+		}
+		c.writelinef(`""`)
+		return xreadContinuation()
+	}
+
+	switch strings.ToUpper(authType) {
+	case "PLAIN":
+		authVariant = "plain"
+
+		if !c.noRequireSTARTTLS && !c.tls {
+			xusercodeErrorf("ENCRYPT-NEEDED", "tls required for login") // ../rfc/5804:874
+		}
+
+		// Plain text passwords, mark as traceauth.
+		defer c.xtrace(mlog.LevelTraceauth)()
+		buf := xreadInitial()
+		c.xtrace(mlog.LevelTrace) // Restore.
+		plain := bytes.Split(buf, []byte{0})
+		if len(plain) != 3 {
+			xsyntaxErrorf("bad plain auth data, expected 3 nul-separated tokens, got %d tokens", len(plain))
+		}
+		authz := string(plain[0])
+		authc := string(plain[1])
+		password := string(plain[2])
+
+		if authz != "" && authz != authc {
+			xuserErrorf("cannot assume role")
+		}
+
+		acc, err := store.OpenEmailAuth(c.log, authc, password, "")
+		if err != nil {
+			if errors.Is(err, store.ErrUnknownCredentials) {
+				authResult = "badcreds"
+				c.log.Info("authentication failed", slog.String("username", authc))
+				xuserErrorf("bad credentials")
+			}
+			xuserErrorf("error")
+		}
+		c.account = acc
+		c.username = authc
+
+	case "SCRAM-SHA-256-PLUS", "SCRAM-SHA-256", "SCRAM-SHA-1-PLUS", "SCRAM-SHA-1":
+		if !store.PasswordHashMechanisms() {
+			xuserErrorf("method not supported")
+		}
+		// No plaintext credentials, we can log these normally.
+
+		authVariant = strings.ToLower(authType)
+		var h func() hash.Hash
+		switch authVariant {
+		case "scram-sha-1", "scram-sha-1-plus":
+			h = sha1.New
+		case "scram-sha-256", "scram-sha-256-plus":
+			h = sha256.New
+		default:
+			xserverErrorf("missing case for scram variant")
+		}
+
+		var cs *tls.ConnectionState
+		requireChannelBinding := strings.HasSuffix(authVariant, "-plus")
+		if requireChannelBinding && !c.tls {
+			xuserErrorf("cannot use plus variant with tls channel binding without tls")
+		}
+		if c.tls {
+			xcs := c.conn.(*tls.Conn).ConnectionState()
+			cs = &xcs
+		}
+		c0 := xreadInitial()
+		ss, err := scram.NewServer(h, c0, cs, requireChannelBinding)
+		if err != nil {
+			xsyntaxErrorf("starting scram: %s", err)
+		}
+		c.log.Debug("scram auth", slog.String("authentication", ss.Authentication))
+		acc, _, err := store.OpenEmail(c.log, ss.Authentication)
+		if err != nil {
+			xuserErrorf("scram not possible")
+		}
+		defer func() {
+			if acc != nil {
+				err := acc.Close()
+				c.log.Check(err, "close account")
+			}
+		}()
+		if ss.Authorization != "" && ss.Authorization != ss.Authentication {
+			xuserErrorf("authentication with authorization for different user not supported")
+		}
+		var xscram store.SCRAM
+		acc.WithRLock(func() {
+			err := acc.DB.Read(context.TODO(), func(tx *bstore.Tx) error {
+				password, err := bstore.QueryTx[store.Password](tx).Get()
+				if err == bstore.ErrAbsent {
+					c.log.Info("failed authentication attempt", slog.String("username", ss.Authentication), slog.Any("remote", c.remoteIP))
+					xuserErrorf("bad credentials")
+				}
+				xcheckf(err, "fetching credentials")
+				switch authVariant {
+				case "scram-sha-1", "scram-sha-1-plus":
+					xscram = password.SCRAMSHA1
+				case "scram-sha-256", "scram-sha-256-plus":
+					xscram = password.SCRAMSHA256
+				default:
+					xserverErrorf("missing case for scram credentials")
+				}
+				if len(xscram.Salt) == 0 || xscram.Iterations == 0 || len(xscram.SaltedPassword) == 0 {
+					missingDerivedSecrets = true
+					c.log.Info("scram auth attempt without derived secrets set, save password again to store secrets", slog.String("address", ss.Authentication))
+					xuserErrorf("scram not possible")
+				}
+				return nil
+			})
+			xcheckf(err, "read tx")
+		})
+		s1, err := ss.ServerFirst(xscram.Iterations, xscram.Salt)
+		xcheckf(err, "scram first server step")
+		c.writelinef("%s", encodeString(base64.StdEncoding.EncodeToString([]byte(s1))))
+		c2 := xreadContinuation()
+		s3, err := ss.Finish(c2, xscram.SaltedPassword)
+		if err != nil {
+			if errors.Is(err, scram.ErrInvalidProof) {
+				authResult = "badcreds"
+				c.log.Info("failed authentication attempt", slog.String("username", ss.Authentication), slog.Any("remote", c.remoteIP))
+				xuserErrorf("bad credentials")
+			}
+			xuserErrorf("server final: %w", err)
+		}
+
+		c.account = acc
+		acc = nil // Cancel cleanup.
+		c.username = ss.Authentication
+
+		// The server-final message is sent as additional data with the OK. ../rfc/5804:653
+		c.setSlow(false)
+		authResult = "ok"
+		c.authFailed = 0
+		c.state = stateAuthenticated
+		c.writelinef("OK (SASL %s)", encodeString(base64.StdEncoding.EncodeToString([]byte(s3))))
+		return
+
+	default:
+		xuserErrorf("method not supported")
+	}
+
+	c.setSlow(false)
+	authResult = "ok"
+	c.authFailed = 0
+	c.state = stateAuthenticated
+	c.ok("authenticate done")
+}
+
+// Havespace checks if a script with the name and size can be stored.
+//
+// State: Authenticated.
+func (c *conn) cmdHavespace(cmd string, args []arg) {
+	// Command: ../rfc/5804:1157
+	if len(args) != 2 || args[0].atom || !args[1].atom {
+		xsyntaxErrorf("expected script name and size")
+	}
+	xcheckScriptName(args[0].s)
+	size, err := strconv.ParseInt(args[1].s, 10, 64)
+	if err != nil || size < 0 {
+		xsyntaxErrorf("invalid size %q", args[1].s)
+	}
+	if size > store.SieveScriptMaxSize {
+		xusercodeErrorf("QUOTA/MAXSIZE", "script larger than maximum size %d bytes", store.SieveScriptMaxSize)
+	}
+	c.ok("")
+}
+
+// Putscript stores a script, replacing an existing script with the same name.
+// The script is checked for errors first.
+//
+// State: Authenticated.
+func (c *conn) cmdPutscript(cmd string, args []arg) {
+	// Command: ../rfc/5804:1196
+	l := xparams(args, 2, 2)
+	name, content := l[0], l[1]
+	xcheckScriptName(name)
+	xcheckScript(content)
+
+	c.xdbwrite(func(tx *bstore.Tx) error {
+		ss, err := store.SieveScriptGet(tx, name)
+		if err == nil {
+			_, err = store.SieveScriptSave(tx, name, content, ss.Active)
+		} else if errors.Is(err, store.ErrSieveScriptUnknown) {
+			_, err = store.SieveScriptSave(tx, name, content, false)
+		}
+		return err
+	})
+	c.log.Info("sieve script stored", slog.String("name", name))
+	c.ok("")
+}
+
+// Listscripts lists all scripts, with the active script marked.
+//
+// State: Authenticated.
+func (c *conn) cmdListscripts(cmd string, args []arg) {
+	// Command: ../rfc/5804:1266
+	xparams(args, 0, 0)
+
+	var scripts []store.SieveScript
+	c.xdbread(func(tx *bstore.Tx) error {
+		var err error
+		scripts, err = store.SieveScriptList(tx)
+		return err
+	})
+	for _, ss := range scripts {
+		if ss.Active {
+			c.bwritelinef("%s ACTIVE", encodeString(ss.Name))
+		} else {
+			c.bwritelinef("%s", encodeString(ss.Name))
+		}
+	}
+	c.ok("")
+}
+
+// Setactive makes a script the active script, evaluated for incoming messages.
+// An empty name deactivates the active script.
+//
+// State: Authenticated.
+func (c *conn) cmdSetactive(cmd string, args []arg) {
+	// Command: ../rfc/5804:1325
+	l := xparams(args, 1, 1)
+	name := l[0]
+	c.xdbwrite(func(tx *bstore.Tx) error {
+		return store.SieveScriptActivate(tx, name)
+	})
+	c.log.Info("sieve script activated", slog.String("name", name))
+	c.ok("")
+}
+
+// Getscript returns the content of a script.
+//
+// State: Authenticated.
+func (c *conn) cmdGetscript(cmd string, args []arg) {
+	// Command: ../rfc/5804:1366
+	l := xparams(args, 1, 1)
+	var ss store.SieveScript
+	c.xdbread(func(tx *bstore.Tx) error {
+		var err error
+		ss, err = store.SieveScriptGet(tx, l[0])
+		return err
+	})
+	// Response is always a literal. ../rfc/5804:1382
+	c.bwritelinef("{%d}\r\n%s", len(ss.Content), ss.Content)
+	c.ok("")
+}
+
+// Deletescript removes a script. The active script cannot be removed.
+//
+// State: Authenticated.
+func (c *conn) cmdDeletescript(cmd string, args []arg) {
+	// Command: ../rfc/5804:1407
+	l := xparams(args, 1, 1)
+	c.xdbwrite(func(tx *bstore.Tx) error {
+		return store.SieveScriptRemove(tx, l[0])
+	})
+	c.log.Info("sieve script removed", slog.String("name", l[0]))
+	c.ok("")
+}
+
+// Renamescript renames a script. If the script is active, it stays active.
+//
+// State: Authenticated.
+func (c *conn) cmdRenamescript(cmd string, args []arg) {
+	// Command: ../rfc/5804:1443
+	l := xparams(args, 2, 2)
+	xcheckScriptName(l[1])
+	c.xdbwrite(func(tx *bstore.Tx) error {
+		return store.SieveScriptRename(tx, l[0], l[1])
+	})
+	c.ok("")
+}
+
+// Checkscript checks a script for errors without storing it.
+//
+// State: Authenticated.
+func (c *conn) cmdCheckscript(cmd string, args []arg) {
+	// Command: ../rfc/5804:1486
+	l := xparams(args, 1, 1)
+	xcheckScript(l[0])
+	c.ok("")
+}
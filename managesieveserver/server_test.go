@@ -0,0 +1,399 @@
+package managesieveserver
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	cryptorand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/sasl"
+	"github.com/mjl-/mox/store"
+)
+
+var ctxbg = context.Background()
+var pkglog = mlog.New("managesieveserver", nil)
+
+func init() {
+	// Don't slow down tests.
+	badClientDelay = 0
+	authFailDelay = 0
+}
+
+const password0 = "tést    " // NFD and various unicode spaces.
+
+func tcheck(t *testing.T, err error, msg string) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: %s", msg, err)
+	}
+}
+
+type testconn struct {
+	t          *testing.T
+	conn       net.Conn
+	br         *bufio.Reader
+	done       chan struct{}
+	serverConn net.Conn
+	account    *store.Account
+
+	// Result of last command.
+	lines  []string // Untagged lines before the result.
+	result string   // OK, NO, BYE.
+	code   string   // Response code, without parenthesis.
+}
+
+func (tc *testconn) close() {
+	if tc.account == nil {
+		return
+	}
+	err := tc.account.Close()
+	tc.t.Logf("close account: %v", err)
+	tc.account = nil
+	tc.conn.Close()
+	tc.serverConn.Close()
+	<-tc.done
+}
+
+func (tc *testconn) readline() string {
+	tc.t.Helper()
+	line, err := tc.br.ReadString('\n')
+	tcheck(tc.t, err, "read line")
+	line = strings.TrimSuffix(line, "\r\n")
+	// Literal, read its content, and the remainder of the line.
+	if strings.HasSuffix(line, "}") {
+		if i := strings.LastIndex(line, "{"); i >= 0 {
+			n, err := strconv.Atoi(line[i+1 : len(line)-1])
+			tcheck(tc.t, err, "parse literal size")
+			buf := make([]byte, n)
+			_, err = io.ReadFull(tc.br, buf)
+			tcheck(tc.t, err, "read literal")
+			line = line[:i] + string(buf) + tc.readline()
+		}
+	}
+	return line
+}
+
+// readResult reads lines until an OK, NO or BYE response.
+func (tc *testconn) readResult() {
+	tc.t.Helper()
+	tc.lines = nil
+	for {
+		line := tc.readline()
+		t := strings.SplitN(line, " ", 2)
+		switch t[0] {
+		case "OK", "NO", "BYE":
+			tc.result = t[0]
+			tc.code = ""
+			if len(t) == 2 && strings.HasPrefix(t[1], "(") {
+				tc.code = strings.SplitN(t[1][1:], ")", 2)[0]
+			}
+			return
+		}
+		tc.lines = append(tc.lines, line)
+	}
+}
+
+func (tc *testconn) writelinef(format string, args ...any) {
+	tc.t.Helper()
+	_, err := fmt.Fprintf(tc.conn, format+"\r\n", args...)
+	tcheck(tc.t, err, "write")
+}
+
+// transactf writes a command and checks the result.
+func (tc *testconn) transactf(result, format string, args ...any) {
+	tc.t.Helper()
+	tc.writelinef(format, args...)
+	tc.readResult()
+	if tc.result != result {
+		tc.t.Fatalf("command %q: got result %s (lines %q), expected %s", fmt.Sprintf(format, args...), tc.result, tc.lines, result)
+	}
+}
+
+func (tc *testconn) xcode(code string) {
+	tc.t.Helper()
+	if tc.code != code {
+		tc.t.Fatalf("got response code %q, expected %q", tc.code, code)
+	}
+}
+
+func (tc *testconn) xlines(exp ...string) {
+	tc.t.Helper()
+	if strings.Join(tc.lines, "\n") != strings.Join(exp, "\n") {
+		tc.t.Fatalf("got lines %q, expected %q", tc.lines, exp)
+	}
+}
+
+func (tc *testconn) hasCapability(name string) bool {
+	for _, line := range tc.lines {
+		if line == `"`+name+`"` || strings.HasPrefix(line, `"`+name+`" `) {
+			return true
+		}
+	}
+	return false
+}
+
+// literal returns s as non-synchronizing literal.
+func literal(s string) string {
+	return fmt.Sprintf("{%d+}\r\n%s", len(s), s)
+}
+
+var connCounter int64
+
+func start(t *testing.T, noRequireSTARTTLS bool) *testconn {
+	limitersInit() // Reset rate limiters.
+
+	os.RemoveAll("../testdata/managesieve/data")
+	mox.Context = ctxbg
+	mox.ConfigStaticPath = filepath.FromSlash("../testdata/managesieve/mox.conf")
+	mox.MustLoadConfig(true, false)
+	acc, err := store.OpenAccount(pkglog, "mjl")
+	tcheck(t, err, "open account")
+	err = acc.SetPassword(pkglog, password0)
+	tcheck(t, err, "set password")
+
+	serverConn, clientConn := net.Pipe()
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{fakeCert(t)},
+	}
+
+	done := make(chan struct{})
+	connCounter++
+	cid := connCounter
+	go func() {
+		serve("test", cid, tlsConfig, serverConn, false, noRequireSTARTTLS)
+		close(done)
+	}()
+	tc := &testconn{t: t, conn: clientConn, br: bufio.NewReader(clientConn), done: done, serverConn: serverConn, account: acc}
+	tc.readResult()
+	if tc.result != "OK" {
+		t.Fatalf("greeting: got %s, expected OK", tc.result)
+	}
+	return tc
+}
+
+func fakeCert(t *testing.T) tls.Certificate {
+	privKey := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)) // Fake key, don't use this for real!
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1), // Required field...
+	}
+	localCertBuf, err := x509.CreateCertificate(cryptorand.Reader, template, template, privKey.Public(), privKey)
+	if err != nil {
+		t.Fatalf("making certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(localCertBuf)
+	if err != nil {
+		t.Fatalf("parsing generated certificate: %s", err)
+	}
+	c := tls.Certificate{
+		Certificate: [][]byte{localCertBuf},
+		PrivateKey:  privKey,
+		Leaf:        cert,
+	}
+	return c
+}
+
+// authenticate with a SASL client, exchanging challenges and responses as
+// strings. A final message from the server is included in the OK response.
+func (tc *testconn) authenticate(client sasl.Client, expResult string) {
+	tc.t.Helper()
+	name, _ := client.Info()
+	toServer, _, err := client.Next(nil)
+	tcheck(tc.t, err, "sasl initial response")
+	tc.writelinef(`AUTHENTICATE "%s" "%s"`, name, base64.StdEncoding.EncodeToString(toServer))
+	for {
+		line := tc.readline()
+		if strings.HasPrefix(line, "OK") || strings.HasPrefix(line, "NO") || strings.HasPrefix(line, "BYE") {
+			tc.result = strings.SplitN(line, " ", 2)[0]
+			if tc.result != expResult {
+				tc.t.Fatalf("authenticate: got %q, expected result %s", line, expResult)
+			}
+			if tc.result == "OK" {
+				s := strings.TrimPrefix(line, `OK (SASL "`)
+				s = strings.SplitN(s, `"`, 2)[0]
+				fromServer, err := base64.StdEncoding.DecodeString(s)
+				tcheck(tc.t, err, "decode server final")
+				_, _, err = client.Next(fromServer)
+				tcheck(tc.t, err, "sasl server final")
+			}
+			return
+		}
+		fromServer, err := base64.StdEncoding.DecodeString(strings.Trim(line, `"`))
+		tcheck(tc.t, err, "decode challenge")
+		toServer, _, err = client.Next(fromServer)
+		tcheck(tc.t, err, "sasl next")
+		tc.writelinef(`"%s"`, base64.StdEncoding.EncodeToString(toServer))
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	tc := start(t, false)
+	tc.transactf("OK", "CAPABILITY")
+	if !tc.hasCapability("STARTTLS") || tc.hasCapability("OWNER") {
+		t.Fatalf("unexpected capabilities %q", tc.lines)
+	}
+	tc.xlines(
+		`"IMPLEMENTATION" "mox (devel)"`,
+		`"SASL" "SCRAM-SHA-256-PLUS SCRAM-SHA-256 SCRAM-SHA-1-PLUS SCRAM-SHA-1"`,
+		`"SIEVE" "body comparator-i;ascii-casemap comparator-i;octet copy envelope ereject fileinto imap4flags reject vacation variables"`,
+		`"STARTTLS"`,
+		`"MAXREDIRECTS" "10"`,
+		`"VERSION" "1.0"`,
+	)
+	tc.transactf("NO", "LISTSCRIPTS") // Not authenticated.
+	tc.transactf("NO", `AUTHENTICATE "PLAIN" "%s"`, base64.StdEncoding.EncodeToString([]byte("\u0000mjl@mox.example\u0000"+password0)))
+	tc.xcode("ENCRYPT-NEEDED")
+
+	// After STARTTLS, PLAIN is allowed.
+	tc.transactf("OK", "STARTTLS")
+	tlsConn := tls.Client(tc.conn, &tls.Config{InsecureSkipVerify: true})
+	tc.conn = tlsConn
+	tc.br = bufio.NewReader(tlsConn)
+	tc.readResult()
+	if tc.result != "OK" || tc.hasCapability("STARTTLS") || !strings.Contains(strings.Join(tc.lines, "\n"), "PLAIN") {
+		t.Fatalf("unexpected capabilities after starttls: %s %q", tc.result, tc.lines)
+	}
+	tc.transactf("NO", `AUTHENTICATE "PLAIN" "%s"`, base64.StdEncoding.EncodeToString([]byte("\u0000mjl@mox.example\u0000badpass")))
+	tc.transactf("NO", `AUTHENTICATE "BOGUS"`)
+	tc.transactf("OK", `AUTHENTICATE "PLAIN" "%s"`, base64.StdEncoding.EncodeToString([]byte("\u0000mjl@mox.example\u0000"+password0)))
+	tc.transactf("NO", "STARTTLS") // Already authenticated.
+	tc.transactf("OK", "CAPABILITY")
+	if !tc.hasCapability("OWNER") {
+		t.Fatalf("missing owner capability after authentication")
+	}
+	tc.close()
+
+	// PLAIN without initial response, as literal.
+	tc = start(t, true)
+	tc.writelinef(`AUTHENTICATE "PLAIN"`)
+	if line := tc.readline(); line != `""` {
+		t.Fatalf("got %q, expected empty challenge", line)
+	}
+	tc.writelinef("%s", literal(base64.StdEncoding.EncodeToString([]byte("\u0000mjl@mox.example\u0000"+password0))))
+	tc.readResult()
+	if tc.result != "OK" {
+		t.Fatalf("authenticate plain with continuation: got %s", tc.result)
+	}
+	tc.close()
+
+	// Aborted authentication.
+	tc = start(t, true)
+	tc.writelinef(`AUTHENTICATE "PLAIN"`)
+	tc.readline()
+	tc.transactf("NO", `"*"`)
+	tc.close()
+
+	tc = start(t, true)
+	tc.authenticate(sasl.NewClientSCRAMSHA256("mjl@mox.example", password0, false), "OK")
+	tc.transactf("OK", "LISTSCRIPTS")
+	tc.close()
+
+	tc = start(t, true)
+	tc.authenticate(sasl.NewClientSCRAMSHA1("mjl@mox.example", password0, false), "OK")
+	tc.close()
+
+	tc = start(t, true)
+	tc.authenticate(sasl.NewClientSCRAMSHA256("mjl@mox.example", "badpass", false), "NO")
+	tc.close()
+}
+
+func TestScripts(t *testing.T) {
+	tc := start(t, true)
+	defer tc.close()
+
+	tc.transactf("OK", `AUTHENTICATE "PLAIN" "%s"`, base64.StdEncoding.EncodeToString([]byte("\u0000mjl@mox.example\u0000"+password0)))
+
+	tc.transactf("OK", "LISTSCRIPTS")
+	tc.xlines()
+
+	tc.transactf("OK", `HAVESPACE "test" 100`)
+	tc.transactf("NO", `HAVESPACE "test" 1000000`)
+	tc.xcode("QUOTA/MAXSIZE")
+	tc.transactf("NO", `HAVESPACE "test"`)
+	tc.transactf("NO", `HAVESPACE "" 1`)
+
+	script := "require \"fileinto\";\r\nif header :contains \"subject\" \"test\" {\r\n\tfileinto \"Test\";\r\n}\r\n"
+	tc.transactf("OK", `CHECKSCRIPT %s`, literal(script))
+	tc.transactf("NO", `CHECKSCRIPT "fileinto \"x\";"`) // Missing require.
+	tc.transactf("NO", `PUTSCRIPT "bad" "bogus;"`)
+
+	tc.transactf("OK", `PUTSCRIPT "test" %s`, literal(script))
+	tc.transactf("OK", `PUTSCRIPT "other" "keep;"`)
+	tc.transactf("OK", "LISTSCRIPTS")
+	tc.xlines(`"other"`, `"test"`)
+
+	tc.transactf("OK", `SETACTIVE "test"`)
+	tc.transactf("NO", `SETACTIVE "unknown"`)
+	tc.xcode("NONEXISTENT")
+	tc.transactf("OK", "LISTSCRIPTS")
+	tc.xlines(`"other"`, `"test" ACTIVE`)
+
+	tc.transactf("OK", `GETSCRIPT "test"`)
+	tc.xlines(script)
+	tc.transactf("NO", `GETSCRIPT "unknown"`)
+	tc.xcode("NONEXISTENT")
+
+	// Replacing the active script keeps it active.
+	tc.transactf("OK", `PUTSCRIPT "test" "keep;"`)
+	tc.transactf("OK", "LISTSCRIPTS")
+	tc.xlines(`"other"`, `"test" ACTIVE`)
+
+	tc.transactf("NO", `DELETESCRIPT "test"`)
+	tc.xcode("ACTIVE")
+	tc.transactf("NO", `RENAMESCRIPT "test" "other"`)
+	tc.xcode("ALREADYEXISTS")
+	tc.transactf("OK", `RENAMESCRIPT "test" "renamed"`)
+	tc.transactf("OK", `DELETESCRIPT "other"`)
+	tc.transactf("NO", `DELETESCRIPT "other"`)
+	tc.xcode("NONEXISTENT")
+	tc.transactf("OK", "LISTSCRIPTS")
+	tc.xlines(`"renamed" ACTIVE`)
+
+	// Check the database directly.
+	err := tc.account.DB.Read(ctxbg, func(tx *bstore.Tx) error {
+		ss, err := store.SieveScriptGet(tx, "renamed")
+		if err == nil && (!ss.Active || ss.Content != "keep;") {
+			err = fmt.Errorf("unexpected script %#v", ss)
+		}
+		return err
+	})
+	tcheck(t, err, "get script")
+
+	tc.transactf("OK", `SETACTIVE ""`)
+	tc.transactf("OK", "LISTSCRIPTS")
+	tc.xlines(`"renamed"`)
+
+	tc.transactf("OK", `NOOP "tag"`)
+	tc.xcode(`TAG "tag"`)
+	tc.transactf("NO", `BOGUS`)
+	tc.transactf("NO", `PUTSCRIPT name "keep;"`) // Name must be string.
+	tc.transactf("NO", `PUTSCRIPT "unterminated`)
+	tc.transactf("OK", "NOOP")
+
+	tc.writelinef("LOGOUT")
+	tc.readResult()
+	if tc.result != "OK" {
+		t.Fatalf("logout: got %s", tc.result)
+	}
+	tc.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := tc.br.ReadByte(); err == nil {
+		t.Fatalf("connection not closed after logout")
+	}
+}
@@ -2,12 +2,16 @@ package message
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"mime"
+	"mime/multipart"
 	"mime/quotedprintable"
 	"net/mail"
+	"net/textproto"
+	"sort"
 	"strings"
 
 	"github.com/mjl-/mox/smtp"
@@ -26,6 +30,10 @@ type Composer struct {
 	SMTPUTF8 bool  // Whether message needs to be sent with SMTPUTF8 extension.
 	Size     int64 // Total bytes written.
 
+	// If set, TextPart uses quoted-printable instead of 8bit for non-ascii text. For
+	// content that will be signed, which transports must not change. ../rfc/1847
+	Need7bit bool
+
 	bw      *bufio.Writer
 	maxSize int64 // If greater than zero, writes beyond maximum size raise ErrMessageSize.
 }
@@ -156,6 +164,14 @@ func (c *Composer) TextPart(subtype, text string) (textBody []byte, ct, cte stri
 		c.Checkf(err, "converting text to quoted printable")
 		text = sb.String()
 		cte = "quoted-printable"
+	} else if c.Need7bit && charset == "utf-8" {
+		var sb strings.Builder
+		_, err := io.Copy(quotedprintable.NewWriter(&sb), strings.NewReader(text))
+		c.Checkf(err, "converting text to quoted printable")
+		text = sb.String()
+		cte = "quoted-printable"
+	} else if c.Need7bit {
+		cte = "7bit"
 	} else if c.Has8bit || charset == "utf-8" {
 		cte = "8bit"
 	} else {
@@ -166,6 +182,65 @@ func (c *Composer) TextPart(subtype, text string) (textBody []byte, ct, cte stri
 	return []byte(text), ct, cte
 }
 
+// MultipartSigned writes a Content-Type header and multipart/signed body, with
+// content as the first part and a detached signature as the second part, for
+// S/MIME or OpenPGP. Content must be a complete MIME entity with CRLF line
+// endings, its headers included, and is written as is: it is the exact data that
+// was signed. The signature part is written with the headers in sigHeader. Its
+// body must be in 7bit form, e.g. base64-encoded or ASCII-armored.
+//
+// ../rfc/1847 ../rfc/8551 ../rfc/3156
+func (c *Composer) MultipartSigned(protocol, micalg string, content []byte, sigHeader textproto.MIMEHeader, signature []byte) {
+	boundary := multipart.NewWriter(io.Discard).Boundary()
+	c.Header("Content-Type", mime.FormatMediaType("multipart/signed", map[string]string{"protocol": protocol, "micalg": micalg, "boundary": boundary}))
+	c.Line()
+	// The CRLF before a boundary is part of the boundary, not of the content.
+	fmt.Fprintf(c, "--%s\r\n", boundary)
+	c.Write(content)
+	fmt.Fprintf(c, "\r\n--%s\r\n", boundary)
+	c.part(sigHeader, signature)
+	fmt.Fprintf(c, "\r\n--%s--\r\n", boundary)
+}
+
+// MultipartEncrypted writes a Content-Type header and multipart/encrypted body
+// for OpenPGP, with a first part with the protocol content-type and control
+// information (e.g. "Version: 1"), and encrypted data, e.g. an ASCII-armored
+// OpenPGP message, as application/octet-stream second part.
+//
+// ../rfc/1847 ../rfc/3156
+func (c *Composer) MultipartEncrypted(protocol string, control, encrypted []byte) {
+	boundary := multipart.NewWriter(io.Discard).Boundary()
+	c.Header("Content-Type", mime.FormatMediaType("multipart/encrypted", map[string]string{"protocol": protocol, "boundary": boundary}))
+	c.Line()
+	fmt.Fprintf(c, "--%s\r\n", boundary)
+	c.part(textproto.MIMEHeader{"Content-Type": {protocol}}, control)
+	fmt.Fprintf(c, "\r\n--%s\r\n", boundary)
+	c.part(textproto.MIMEHeader{"Content-Type": {"application/octet-stream"}}, encrypted)
+	fmt.Fprintf(c, "\r\n--%s--\r\n", boundary)
+}
+
+// part writes headers, with Content-Type first, and a body in 7bit form, with
+// lines ending in LF changed to end in CRLF.
+func (c *Composer) part(h textproto.MIMEHeader, body []byte) {
+	var keys []string
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i] == "Content-Type" || keys[j] != "Content-Type" && keys[i] < keys[j]
+	})
+	for _, k := range keys {
+		for _, v := range h[k] {
+			c.Header(k, v)
+		}
+	}
+	c.Line()
+	body = bytes.ReplaceAll(body, []byte("\r\n"), []byte("\n"))
+	body = bytes.ReplaceAll(body, []byte("\n"), []byte("\r\n"))
+	body = bytes.TrimSuffix(body, []byte("\r\n"))
+	c.Write(body)
+}
+
 func isASCII(s string) bool {
 	for _, c := range s {
 		if c >= 0x80 {
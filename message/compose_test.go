@@ -0,0 +1,69 @@
+package message
+
+import (
+	"bytes"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/mjl-/mox/mlog"
+)
+
+func TestComposeMultipart(t *testing.T) {
+	log := mlog.New("message", nil)
+
+	var content bytes.Buffer
+	cc := NewComposer(&content, 0, false)
+	cc.Need7bit = true
+	text, ct, cte := cc.TextPart("plain", "héllo\n")
+	if cte != "quoted-printable" {
+		t.Fatalf("got cte %q, expected quoted-printable for 7bit text part", cte)
+	}
+	cc.Header("Content-Type", ct)
+	cc.Header("Content-Transfer-Encoding", cte)
+	cc.Line()
+	cc.Write(text)
+	cc.Flush()
+
+	var b bytes.Buffer
+	xc := NewComposer(&b, 0, false)
+	xc.Header("Subject", "test")
+	xc.Header("MIME-Version", "1.0")
+	xc.MultipartSigned("application/pgp-signature", "pgp-sha256", content.Bytes(), textproto.MIMEHeader{"Content-Description": {"signature"}, "Content-Type": {"application/pgp-signature"}}, []byte("sig\nnature\n"))
+	xc.Flush()
+
+	p, err := Parse(log.Logger, true, bytes.NewReader(b.Bytes()))
+	tcheck(t, err, "parse")
+	err = p.Walk(log.Logger, nil)
+	tcheck(t, err, "walk")
+	if p.MediaType != "MULTIPART" || p.MediaSubType != "SIGNED" || len(p.Parts) != 2 || p.ContentTypeParams["protocol"] != "application/pgp-signature" || p.ContentTypeParams["micalg"] != "pgp-sha256" {
+		t.Fatalf("unexpected multipart/signed structure %#v", p)
+	}
+	// The signed data must be exactly the content we passed in.
+	sp := p.Parts[0]
+	signed := b.Bytes()[sp.HeaderOffset:sp.EndOffset]
+	if !bytes.Equal(signed, content.Bytes()) {
+		t.Fatalf("signed part differs:\n%q\n%q", signed, content.Bytes())
+	}
+	sigp := p.Parts[1]
+	h, err := sigp.Header()
+	tcheck(t, err, "signature part header")
+	if h.Get("Content-Description") != "signature" || !strings.HasPrefix(string(b.Bytes()[sigp.HeaderOffset:]), "Content-Type: ") {
+		t.Fatalf("unexpected headers for signature part")
+	}
+	if sig := string(b.Bytes()[sigp.BodyOffset:sigp.EndOffset]); sig != "sig\r\nnature" {
+		t.Fatalf("got signature %q", sig)
+	}
+
+	b.Reset()
+	xc = NewComposer(&b, 0, false)
+	xc.MultipartEncrypted("application/pgp-encrypted", []byte("Version: 1\n"), []byte("-----BEGIN PGP MESSAGE-----\n\nxyz\n-----END PGP MESSAGE-----\n"))
+	xc.Flush()
+	p, err = Parse(log.Logger, true, bytes.NewReader(b.Bytes()))
+	tcheck(t, err, "parse")
+	err = p.Walk(log.Logger, nil)
+	tcheck(t, err, "walk")
+	if p.MediaType != "MULTIPART" || p.MediaSubType != "ENCRYPTED" || len(p.Parts) != 2 || p.Parts[0].MediaSubType != "PGP-ENCRYPTED" || p.Parts[1].MediaSubType != "OCTET-STREAM" {
+		t.Fatalf("unexpected multipart/encrypted structure %#v", p)
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 
+	"github.com/mjl-/mox/arc"
 	"github.com/mjl-/mox/dane"
 	"github.com/mjl-/mox/dkim"
 	"github.com/mjl-/mox/dmarc"
@@ -74,6 +75,28 @@ func httpClientObserve(ctx context.Context, elog *slog.Logger, pkg, method strin
 }
 
 func init() {
+	arc.MetricSeal = counterVec{promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mox_arc_seal_total",
+			Help: "ARC sealings of messages, label cv is the chain validation status in the new seal.",
+		},
+		[]string{
+			"cv",
+		},
+	)}
+	arc.MetricVerify = histogramVec{
+		promauto.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "mox_arc_verify_duration_seconds",
+				Help:    "ARC verify, including lookups, duration and result.",
+				Buckets: []float64{0.001, 0.005, 0.01, 0.05, 0.100, 0.5, 1, 5, 10, 20},
+			},
+			[]string{
+				"status",
+			},
+		),
+	}
+
 	dane.MetricVerify = promauto.NewCounter(
 		prometheus.CounterOpts{
 			Name: "mox_dane_verify_total",
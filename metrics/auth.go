@@ -14,7 +14,7 @@ var (
 		},
 		[]string{
 			"kind",    // submission, imap, webmail, webapi, webaccount, webadmin (formerly httpaccount, httpadmin)
-			"variant", // login, plain, scram-sha-256, scram-sha-1, cram-md5, weblogin, websessionuse, httpbasic.
+			"variant", // login, plain, scram-sha-256, scram-sha-1, cram-md5, weblogin, webtotp, websessionuse, httpbasic.
 			// todo: we currently only use badcreds, but known baduser can be helpful
 			"result", // ok, baduser, badpassword, badcreds, error, aborted
 		},
@@ -22,6 +22,10 @@ const (
 	Import           Panic = "import"
 	Serve            Panic = "serve"
 	Imapserver       Panic = "imapserver"
+	Managesieve      Panic = "managesieveserver"
+	Pop3server       Panic = "pop3server"
+	Jmapserver       Panic = "jmapserver"
+	Carddavserver    Panic = "carddavserver"
 	Dmarcdb          Panic = "dmarcdb"
 	Mtastsdb         Panic = "mtastsdb"
 	Queue            Panic = "queue"
@@ -29,6 +33,7 @@ const (
 	Smtpserver       Panic = "smtpserver"
 	Tlsrptdb         Panic = "tlsrptdb"
 	Dkimverify       Panic = "dkimverify"
+	Arcverify        Panic = "arcverify"
 	Spfverify        Panic = "spfverify"
 	Upgradethreads   Panic = "upgradethreads"
 	Importmanage     Panic = "importmanage"
@@ -51,11 +56,16 @@ func init() {
 		Import,
 		Serve,
 		Imapserver,
+		Managesieve,
+		Pop3server,
+		Jmapserver,
+		Carddavserver,
 		Mtastsdb,
 		Queue,
 		Smtpclient,
 		Smtpserver,
 		Dkimverify,
+		Arcverify,
 		Spfverify,
 		Upgradethreads,
 		Importmanage,
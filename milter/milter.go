@@ -0,0 +1,692 @@
+// Package milter implements the client (MTA) side of the Sendmail milter
+// protocol, version 6, for passing messages to external content filters, such as
+// spam/virus scanners, during an SMTP transaction.
+//
+// A milter session follows an SMTP connection: connect, helo, and per message
+// the envelope commands, the header, body and end of message. After each command
+// the milter responds with an action: continue, accept, reject, tempfail, discard
+// or a custom SMTP reply. At the end of message, the milter can also request
+// modifications to the message. Only header additions and changes, and
+// quarantining messages, are supported.
+//
+// There is no formal specification of the protocol. The implementation follows
+// the Sendmail/libmilter sources and the documentation of other implementations.
+package milter
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version is the protocol version negotiated by the client.
+const Version = 6
+
+// Commands sent by the MTA to the milter.
+const (
+	CmdAbort   byte = 'A' // Abort current message, the session continues.
+	CmdBody    byte = 'B' // Body chunk.
+	CmdConnect byte = 'C' // Connection information.
+	CmdMacro   byte = 'D' // Define macros for the command following.
+	CmdEOB     byte = 'E' // End of body, end of message.
+	CmdHelo    byte = 'H' // HELO/EHLO name.
+	CmdHeader  byte = 'L' // Header field.
+	CmdMail    byte = 'M' // MAIL FROM.
+	CmdEOH     byte = 'N' // End of header.
+	CmdOptNeg  byte = 'O' // Option negotiation.
+	CmdQuit    byte = 'Q' // Quit, closing the session.
+	CmdRcpt    byte = 'R' // RCPT TO.
+	CmdData    byte = 'T' // DATA.
+)
+
+// Responses and modification actions sent by the milter.
+const (
+	respAccept      byte = 'a'
+	respContinue    byte = 'c'
+	respDiscard     byte = 'd'
+	respReject      byte = 'r'
+	respTempfail    byte = 't'
+	respReplyCode   byte = 'y'
+	respProgress    byte = 'p'
+	respSkip        byte = 's'
+	respOptNeg      byte = 'O'
+	respAddHeader   byte = 'h'
+	respInsHeader   byte = 'i'
+	respChgHeader   byte = 'm'
+	respQuarantine  byte = 'q'
+	respReplBody    byte = 'b'
+	respAddRcpt     byte = '+'
+	respDelRcpt     byte = '-'
+	respChgFrom     byte = 'e'
+	respAddRcptPar  byte = '2'
+	respSetSymbList byte = 'l'
+)
+
+// Modification actions the milter may request, offered during negotiation.
+const (
+	actAddHeaders = 0x01
+	actChgHeaders = 0x10
+	actQuarantine = 0x20
+
+	// We only offer the actions we implement.
+	actSupported = actAddHeaders | actChgHeaders | actQuarantine
+)
+
+// Protocol flags. The "No" flags indicate the milter does not want a command.
+// The "NR" flags indicate the milter will not respond to a command.
+const (
+	protoNoConnect = 0x01
+	protoNoHelo    = 0x02
+	protoNoMail    = 0x04
+	protoNoRcpt    = 0x08
+	protoNoBody    = 0x10
+	protoNoHeaders = 0x20
+	protoNoEOH     = 0x40
+	protoNRHeader  = 0x80
+	protoNoUnknown = 0x100
+	protoNoData    = 0x200
+	protoSkip      = 0x400
+	protoNRConnect = 0x1000
+	protoNRHelo    = 0x2000
+	protoNRMail    = 0x4000
+	protoNRRcpt    = 0x8000
+	protoNRData    = 0x10000
+	protoNREOH     = 0x40000
+	protoNRBody    = 0x80000
+
+	protoSupported = protoNoConnect | protoNoHelo | protoNoMail | protoNoRcpt | protoNoBody | protoNoHeaders | protoNoEOH | protoNRHeader | protoNoUnknown | protoNoData | protoSkip | protoNRConnect | protoNRHelo | protoNRMail | protoNRRcpt | protoNRData | protoNREOH | protoNRBody
+)
+
+const (
+	maxPacketSize = 1024 * 1024 // Max size of packets we read from the milter.
+	maxBodyChunk  = 65535       // Max size of a body chunk we send.
+)
+
+var (
+	// ErrProtocol is returned for invalid or unexpected data from the milter.
+	ErrProtocol = errors.New("milter protocol error")
+)
+
+// Action is the outcome of a milter command.
+type Action byte
+
+const (
+	ActionContinue Action = 'c' // Continue with the next command.
+	ActionAccept   Action = 'a' // Accept, no further commands for this message (or connection, for connect and helo).
+	ActionReject   Action = 'r' // Reject the command (e.g. recipient) or message.
+	ActionTempfail Action = 't' // Temporarily reject the command or message.
+	ActionDiscard  Action = 'd' // Accept the message, but silently discard it.
+)
+
+func (a Action) String() string {
+	switch a {
+	case ActionContinue:
+		return "continue"
+	case ActionAccept:
+		return "accept"
+	case ActionReject:
+		return "reject"
+	case ActionTempfail:
+		return "tempfail"
+	case ActionDiscard:
+		return "discard"
+	}
+	return fmt.Sprintf("action(%q)", byte(a))
+}
+
+// Response is the result of a milter command.
+type Response struct {
+	Action Action
+
+	// For a custom SMTP reply from the milter, for reject or tempfail. Code is zero
+	// otherwise. ECode is an optional enhanced status code, e.g. "5.7.1".
+	Code  int
+	ECode string
+	Text  string
+}
+
+// HeaderChange is a modification of a message header requested by the milter.
+type HeaderChange struct {
+	// "add" appends a header field, "insert" inserts a header field at Index
+	// (0-based), "change" replaces the Index'th (1-based) occurrence of header Name,
+	// or removes it if Value is empty.
+	Kind  string
+	Index int
+	Name  string
+	Value string // Without leading space, may contain folded lines.
+}
+
+// EOMResult is the result of the end of message.
+type EOMResult struct {
+	Response
+	HeaderChanges []HeaderChange
+	Quarantine    bool
+	Reason        string // For Quarantine.
+}
+
+// ParseAddress parses a milter address into a network and address for net.Dial.
+// Supported are "unix:/path", "local:/path", "inet:port@host", "inet6:port@host"
+// (Sendmail syntax), and "host:port".
+func ParseAddress(s string) (network, address string, rerr error) {
+	if t := strings.SplitN(s, ":", 2); len(t) == 2 {
+		switch strings.ToLower(t[0]) {
+		case "unix", "local":
+			if t[1] == "" {
+				return "", "", fmt.Errorf("missing path for unix socket")
+			}
+			return "unix", t[1], nil
+		case "inet", "inet6":
+			port, host, ok := strings.Cut(t[1], "@")
+			if !ok || host == "" {
+				return "", "", fmt.Errorf("missing host for inet address, syntax is inet:port@host")
+			}
+			if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+				return "", "", fmt.Errorf("invalid port %q: %v", port, err)
+			}
+			network = "tcp4"
+			if t[0] == "inet6" {
+				network = "tcp6"
+			}
+			return network, net.JoinHostPort(strings.Trim(host, "[]"), port), nil
+		}
+	}
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return "", "", fmt.Errorf("parsing address: %v", err)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil || host == "" {
+		return "", "", fmt.Errorf("invalid host:port %q", s)
+	}
+	return "tcp", s, nil
+}
+
+// Client is a session with a milter for a single SMTP connection.
+type Client struct {
+	conn     net.Conn
+	br       *bufio.Reader
+	timeout  time.Duration
+	actions  uint32 // Negotiated modification actions.
+	protocol uint32 // Negotiated protocol flags.
+	skipBody bool   // Milter responded with skip to a body chunk.
+}
+
+// Dial connects to the milter at address (see ParseAddress), and negotiates
+// options. Timeout applies to connecting and to each command.
+func Dial(ctx context.Context, address string, timeout time.Duration) (*Client, error) {
+	network, addr, err := ParseAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	d := net.Dialer{Timeout: timeout}
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial milter: %w", err)
+	}
+	c, err := NewClient(conn, timeout)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewClient negotiates options over an existing connection to a milter.
+func NewClient(conn net.Conn, timeout time.Duration) (*Client, error) {
+	c := &Client{conn: conn, br: bufio.NewReader(conn), timeout: timeout}
+
+	buf := make([]byte, 12)
+	binary.BigEndian.PutUint32(buf[0:4], Version)
+	binary.BigEndian.PutUint32(buf[4:8], actSupported)
+	binary.BigEndian.PutUint32(buf[8:12], protoSupported)
+	if err := c.send(CmdOptNeg, buf); err != nil {
+		return nil, err
+	}
+	cmd, data, err := c.read()
+	if err != nil {
+		return nil, err
+	}
+	if cmd != respOptNeg || len(data) < 12 {
+		return nil, fmt.Errorf("%w: unexpected response %q to option negotiation", ErrProtocol, cmd)
+	}
+	version := binary.BigEndian.Uint32(data[0:4])
+	c.actions = binary.BigEndian.Uint32(data[4:8])
+	c.protocol = binary.BigEndian.Uint32(data[8:12])
+	// Any remaining data is a list of macros the milter wants, we ignore it.
+	if version < 2 || version > Version {
+		return nil, fmt.Errorf("%w: unsupported milter protocol version %d", ErrProtocol, version)
+	}
+	if c.actions&^actSupported != 0 {
+		return nil, fmt.Errorf("%w: milter requires unsupported actions 0x%x", ErrProtocol, c.actions&^actSupported)
+	}
+	if c.protocol&^protoSupported != 0 {
+		return nil, fmt.Errorf("%w: milter requires unsupported protocol flags 0x%x", ErrProtocol, c.protocol&^protoSupported)
+	}
+	return c, nil
+}
+
+// Close sends a quit command and closes the connection.
+func (c *Client) Close() error {
+	err := c.send(CmdQuit, nil)
+	if xerr := c.conn.Close(); err == nil {
+		err = xerr
+	}
+	return err
+}
+
+func (c *Client) send(cmd byte, data []byte) error {
+	buf := make([]byte, 5+len(data))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(1+len(data)))
+	buf[4] = cmd
+	copy(buf[5:], data)
+	if err := c.conn.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+		return err
+	}
+	if _, err := c.conn.Write(buf); err != nil {
+		return fmt.Errorf("write to milter: %w", err)
+	}
+	return nil
+}
+
+func (c *Client) read() (byte, []byte, error) {
+	if err := c.conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, nil, err
+	}
+	var lenbuf [4]byte
+	if _, err := io.ReadFull(c.br, lenbuf[:]); err != nil {
+		return 0, nil, fmt.Errorf("read from milter: %w", err)
+	}
+	n := binary.BigEndian.Uint32(lenbuf[:])
+	if n == 0 || n > maxPacketSize {
+		return 0, nil, fmt.Errorf("%w: invalid packet size %d", ErrProtocol, n)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(c.br, buf); err != nil {
+		return 0, nil, fmt.Errorf("read from milter: %w", err)
+	}
+	return buf[0], buf[1:], nil
+}
+
+// cstrings returns data with each string NUL-terminated.
+func cstrings(l ...string) []byte {
+	var buf []byte
+	for _, s := range l {
+		buf = append(buf, s...)
+		buf = append(buf, 0)
+	}
+	return buf
+}
+
+// parseStrings parses n NUL-terminated strings.
+func parseStrings(data []byte, n int) ([]string, error) {
+	var l []string
+	for i := 0; i < n; i++ {
+		s, rest, ok := strings.Cut(string(data), "\x00")
+		if !ok {
+			return nil, fmt.Errorf("%w: missing nul-terminated string", ErrProtocol)
+		}
+		l = append(l, s)
+		data = []byte(rest)
+	}
+	return l, nil
+}
+
+// command sends a command, and reads the response unless the command is
+// disabled, or the milter negotiated not to respond.
+func (c *Client) command(cmd byte, data []byte, noFlag, noReplyFlag uint32) (Response, error) {
+	if c.protocol&noFlag != 0 {
+		return Response{Action: ActionContinue}, nil
+	}
+	if err := c.send(cmd, data); err != nil {
+		return Response{}, err
+	}
+	if c.protocol&noReplyFlag != 0 {
+		return Response{Action: ActionContinue}, nil
+	}
+	for {
+		rcmd, rdata, err := c.read()
+		if err != nil {
+			return Response{}, err
+		}
+		if rcmd == respProgress {
+			continue
+		}
+		if rcmd == respSkip && cmd == CmdBody && c.protocol&protoSkip != 0 {
+			c.skipBody = true
+			return Response{Action: ActionContinue}, nil
+		}
+		return parseResponse(rcmd, rdata)
+	}
+}
+
+func parseResponse(cmd byte, data []byte) (Response, error) {
+	switch cmd {
+	case respAccept, respContinue, respDiscard, respReject, respTempfail:
+		return Response{Action: Action(cmd)}, nil
+	case respReplyCode:
+		// E.g. "550 5.7.1 Message rejected". ../rfc/5321:2428
+		l, err := parseStrings(data, 1)
+		if err != nil {
+			return Response{}, err
+		}
+		s := l[0]
+		if len(s) < 3 {
+			return Response{}, fmt.Errorf("%w: invalid reply code %q", ErrProtocol, s)
+		}
+		code, err := strconv.Atoi(s[:3])
+		if err != nil || code < 400 || code >= 600 {
+			return Response{}, fmt.Errorf("%w: invalid reply code %q", ErrProtocol, s)
+		}
+		r := Response{Action: ActionReject, Code: code}
+		if code < 500 {
+			r.Action = ActionTempfail
+		}
+		s = strings.TrimLeft(s[3:], " -")
+		if t := strings.SplitN(s, " ", 2); isECode(t[0], code) {
+			r.ECode = t[0]
+			s = ""
+			if len(t) == 2 {
+				s = t[1]
+			}
+		}
+		// Multiline replies are joined with CRLF, we keep just the first line.
+		s, _, _ = strings.Cut(s, "\r\n")
+		r.Text = s
+		return r, nil
+	}
+	return Response{}, fmt.Errorf("%w: unexpected response %q", ErrProtocol, cmd)
+}
+
+// isECode returns whether s is an enhanced status code matching the class of
+// the SMTP reply code. ../rfc/3463:89
+func isECode(s string, code int) bool {
+	t := strings.Split(s, ".")
+	if len(t) != 3 || t[0] != strconv.Itoa(code/100) {
+		return false
+	}
+	for _, x := range t[1:] {
+		if v, err := strconv.Atoi(x); err != nil || v < 0 || v > 999 {
+			return false
+		}
+	}
+	return true
+}
+
+// Macros sends macro definitions for the command cmd that follows, e.g. CmdMail.
+// NameValues holds pairs of macro names and values, e.g. "j" and the hostname,
+// or "{client_addr}" and an IP address.
+func (c *Client) Macros(cmd byte, nameValues ...string) error {
+	if len(nameValues)%2 != 0 {
+		return fmt.Errorf("odd number of macro names and values")
+	}
+	return c.send(CmdMacro, append([]byte{cmd}, cstrings(nameValues...)...))
+}
+
+// Connect passes information about the SMTP connection. Hostname is the
+// (reverse) name of the remote, or the IP address in brackets.
+func (c *Client) Connect(hostname string, ip net.IP, port int) (Response, error) {
+	family := byte('4')
+	if ip.To4() == nil {
+		family = '6'
+	}
+	data := cstrings(hostname)
+	data = append(data, family, byte(port>>8), byte(port))
+	data = append(data, cstrings(ip.String())...)
+	return c.command(CmdConnect, data, protoNoConnect, protoNRConnect)
+}
+
+// Helo passes the HELO/EHLO name.
+func (c *Client) Helo(name string) (Response, error) {
+	return c.command(CmdHelo, cstrings(name), protoNoHelo, protoNRHelo)
+}
+
+// Mail passes the MAIL FROM address, without brackets, and ESMTP parameters.
+func (c *Client) Mail(from string, params ...string) (Response, error) {
+	c.skipBody = false
+	return c.command(CmdMail, cstrings(append([]string{"<" + from + ">"}, params...)...), protoNoMail, protoNRMail)
+}
+
+// Rcpt passes a RCPT TO address, without brackets, and ESMTP parameters. A
+// reject or tempfail only applies to this recipient.
+func (c *Client) Rcpt(to string, params ...string) (Response, error) {
+	return c.command(CmdRcpt, cstrings(append([]string{"<" + to + ">"}, params...)...), protoNoRcpt, protoNRRcpt)
+}
+
+// Data signals the start of the message data.
+func (c *Client) Data() (Response, error) {
+	return c.command(CmdData, nil, protoNoData, protoNRData)
+}
+
+// Header passes a header field. Value is without leading whitespace, and
+// with CRLF line endings for folded lines.
+func (c *Client) Header(name, value string) (Response, error) {
+	return c.command(CmdHeader, cstrings(name, value), protoNoHeaders, protoNRHeader)
+}
+
+// EOH signals the end of the header section.
+func (c *Client) EOH() (Response, error) {
+	return c.command(CmdEOH, nil, protoNoEOH, protoNREOH)
+}
+
+// Body passes the body of the message, in chunks. The body should have CRLF line
+// endings.
+func (c *Client) Body(r io.Reader) (Response, error) {
+	buf := make([]byte, maxBodyChunk)
+	for !c.skipBody {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			resp, err := c.command(CmdBody, buf[:n], protoNoBody, protoNRBody)
+			if err != nil || resp.Action != ActionContinue {
+				return resp, err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return Response{}, fmt.Errorf("reading message body: %w", err)
+		}
+	}
+	return Response{Action: ActionContinue}, nil
+}
+
+// EOM signals the end of the message, and returns the final response with any
+// requested modifications.
+func (c *Client) EOM() (EOMResult, error) {
+	if err := c.send(CmdEOB, nil); err != nil {
+		return EOMResult{}, err
+	}
+	var r EOMResult
+	for {
+		cmd, data, err := c.read()
+		if err != nil {
+			return EOMResult{}, err
+		}
+		switch cmd {
+		case respProgress:
+			continue
+		case respAddHeader, respInsHeader, respChgHeader:
+			need := uint32(actAddHeaders)
+			if cmd == respChgHeader {
+				need = actChgHeaders
+			}
+			if c.actions&need == 0 {
+				return EOMResult{}, fmt.Errorf("%w: header modification %q not negotiated", ErrProtocol, cmd)
+			}
+			hc := HeaderChange{Kind: "add"}
+			if cmd != respAddHeader {
+				if len(data) < 4 {
+					return EOMResult{}, fmt.Errorf("%w: short header modification", ErrProtocol)
+				}
+				hc.Index = int(binary.BigEndian.Uint32(data[:4]))
+				data = data[4:]
+				hc.Kind = "insert"
+				if cmd == respChgHeader {
+					hc.Kind = "change"
+				}
+			}
+			l, err := parseStrings(data, 2)
+			if err != nil {
+				return EOMResult{}, err
+			}
+			hc.Name, hc.Value = l[0], l[1]
+			if hc.Name == "" || strings.ContainsAny(hc.Name, ": \t\r\n") {
+				return EOMResult{}, fmt.Errorf("%w: invalid header name %q", ErrProtocol, hc.Name)
+			}
+			r.HeaderChanges = append(r.HeaderChanges, hc)
+		case respQuarantine:
+			if c.actions&actQuarantine == 0 {
+				return EOMResult{}, fmt.Errorf("%w: quarantine not negotiated", ErrProtocol)
+			}
+			l, err := parseStrings(data, 1)
+			if err != nil {
+				return EOMResult{}, err
+			}
+			r.Quarantine = true
+			r.Reason = l[0]
+		case respReplBody, respAddRcpt, respDelRcpt, respChgFrom, respAddRcptPar, respSetSymbList:
+			return EOMResult{}, fmt.Errorf("%w: modification %q not negotiated", ErrProtocol, cmd)
+		default:
+			resp, err := parseResponse(cmd, data)
+			if err != nil {
+				return EOMResult{}, err
+			}
+			r.Response = resp
+			return r, nil
+		}
+	}
+}
+
+// Abort aborts the current message. The session can be used for a next message.
+func (c *Client) Abort() error {
+	c.skipBody = false
+	return c.send(CmdAbort, nil)
+}
+
+// headerField is a raw header field, including trailing CRLF.
+type headerField struct {
+	name string // As in message.
+	raw  string
+}
+
+// readHeader reads the header section of a message, including the empty line
+// separating it from the body, if present.
+func readHeader(br *bufio.Reader) (fields []headerField, rerr error) {
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			if err == io.EOF {
+				return fields, nil
+			}
+			return nil, err
+		}
+		if line == "\r\n" || line == "\n" {
+			return fields, nil
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].raw += line
+		} else {
+			name, _, ok := strings.Cut(line, ":")
+			if !ok {
+				return nil, fmt.Errorf("malformed header line")
+			}
+			fields = append(fields, headerField{strings.TrimRight(name, " \t"), line})
+		}
+		if err == io.EOF {
+			return fields, nil
+		}
+	}
+}
+
+// Message passes a message to the milter: data, the header fields, end of
+// header, the body and end of message. If the milter responds with an action
+// other than continue before the end of message, that response is returned.
+func (c *Client) Message(msg io.Reader) (EOMResult, error) {
+	br := bufio.NewReader(msg)
+	fields, err := readHeader(br)
+	if err != nil {
+		return EOMResult{}, fmt.Errorf("reading message header: %v", err)
+	}
+
+	resp, err := c.Data()
+	if err != nil || resp.Action != ActionContinue {
+		return EOMResult{Response: resp}, err
+	}
+	for _, f := range fields {
+		_, value, _ := strings.Cut(f.raw, ":")
+		value = strings.TrimSuffix(strings.TrimLeft(value, " \t"), "\r\n")
+		value = strings.TrimSuffix(value, "\n")
+		resp, err := c.Header(f.name, value)
+		if err != nil || resp.Action != ActionContinue {
+			return EOMResult{Response: resp}, err
+		}
+	}
+	resp, err = c.EOH()
+	if err != nil || resp.Action != ActionContinue {
+		return EOMResult{Response: resp}, err
+	}
+	resp, err = c.Body(br)
+	if err != nil || resp.Action != ActionContinue {
+		return EOMResult{Response: resp}, err
+	}
+	return c.EOM()
+}
+
+// ApplyHeaderChanges returns the message header with the changes applied. The
+// header must be the raw header section, with CRLF line endings, and may include
+// the empty line separating it from the body.
+func ApplyHeaderChanges(header []byte, changes []HeaderChange) ([]byte, error) {
+	fields, err := readHeader(bufio.NewReader(strings.NewReader(string(header))))
+	if err != nil {
+		return nil, err
+	}
+	raw := func(hc HeaderChange) string {
+		value := strings.ReplaceAll(hc.Value, "\r\n", "\n")
+		value = strings.ReplaceAll(value, "\n", "\r\n")
+		return hc.Name + ": " + value + "\r\n"
+	}
+	for _, hc := range changes {
+		switch hc.Kind {
+		case "add":
+			fields = append(fields, headerField{hc.Name, raw(hc)})
+		case "insert":
+			i := min(max(hc.Index, 0), len(fields))
+			fields = append(fields[:i], append([]headerField{{hc.Name, raw(hc)}}, fields[i:]...)...)
+		case "change":
+			// Index is the n-th occurrence of the header name, starting at 1.
+			var n int
+			for i, f := range fields {
+				if !strings.EqualFold(f.name, hc.Name) {
+					continue
+				}
+				n++
+				if n != max(hc.Index, 1) {
+					continue
+				}
+				if hc.Value == "" {
+					fields = append(fields[:i], fields[i+1:]...)
+				} else {
+					fields[i].raw = raw(hc)
+				}
+				break
+			}
+			// If the header is not present, sendmail adds it, so we do too.
+			if n < max(hc.Index, 1) && hc.Value != "" {
+				fields = append(fields, headerField{hc.Name, raw(hc)})
+			}
+		default:
+			return nil, fmt.Errorf("unknown header change %q", hc.Kind)
+		}
+	}
+	var b strings.Builder
+	for _, f := range fields {
+		b.WriteString(f.raw)
+	}
+	b.WriteString("\r\n")
+	return []byte(b.String()), nil
+}
@@ -0,0 +1,188 @@
+package milter
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tcheck(t *testing.T, err error, msg string) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: %s", msg, err)
+	}
+}
+
+func tcompare(t *testing.T, got, exp any) {
+	t.Helper()
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("got:\n%#v\nexpected:\n%#v", got, exp)
+	}
+}
+
+func TestParseAddress(t *testing.T) {
+	test := func(s, expNetwork, expAddress string, expErr bool) {
+		t.Helper()
+		network, address, err := ParseAddress(s)
+		if (err != nil) != expErr {
+			t.Fatalf("parse %q: got err %v, expected error %v", s, err, expErr)
+		}
+		tcompare(t, network, expNetwork)
+		tcompare(t, address, expAddress)
+	}
+
+	test("unix:/run/milter.sock", "unix", "/run/milter.sock", false)
+	test("local:/run/milter.sock", "unix", "/run/milter.sock", false)
+	test("inet:11332@localhost", "tcp4", "localhost:11332", false)
+	test("inet6:11332@::1", "tcp6", "[::1]:11332", false)
+	test("localhost:11332", "tcp", "localhost:11332", false)
+	test("unix:", "", "", true)
+	test("inet:11332", "", "", true)
+	test("inet:bogus@localhost", "", "", true)
+	test("localhost", "", "", true)
+	test(":11332", "", "", true)
+}
+
+func TestParseResponse(t *testing.T) {
+	test := func(s string, exp Response, expErr bool) {
+		t.Helper()
+		r, err := parseResponse(respReplyCode, cstrings(s))
+		if (err != nil) != expErr {
+			t.Fatalf("parse %q: got err %v, expected error %v", s, err, expErr)
+		}
+		tcompare(t, r, exp)
+	}
+
+	test("550 5.7.1 Message rejected", Response{ActionReject, 550, "5.7.1", "Message rejected"}, false)
+	test("451 4.7.1 Try again", Response{ActionTempfail, 451, "4.7.1", "Try again"}, false)
+	test("550 Message rejected", Response{ActionReject, 550, "", "Message rejected"}, false)
+	test("550 4.7.1 Mismatching class", Response{ActionReject, 550, "", "4.7.1 Mismatching class"}, false)
+	test("554-5.7.1 First\r\n554 5.7.1 Second", Response{ActionReject, 554, "5.7.1", "First"}, false)
+	test("550", Response{ActionReject, 550, "", ""}, false)
+	test("250 ok", Response{}, true)
+	test("5x0 bad", Response{}, true)
+	test("55", Response{}, true)
+}
+
+func TestClient(t *testing.T) {
+	var got []string
+	handle := func(cmd byte, data []byte) []Packet {
+		got = append(got, string(cmd)+" "+strings.ReplaceAll(string(data), "\x00", "|"))
+		switch cmd {
+		case CmdRcpt:
+			if strings.Contains(string(data), "reject") {
+				return []Packet{Reply("550 5.1.1 unknown")}
+			}
+		case CmdEOB:
+			return []Packet{
+				{Cmd: respProgress},
+				AddHeader("X-Spam", "yes"),
+				ChangeHeader(1, "Subject", "[spam] test"),
+				Quarantine("spam"),
+				Accept,
+			}
+		}
+		return nil
+	}
+
+	newClient := func(m MockMilter) *Client {
+		t.Helper()
+		serverConn, clientConn := net.Pipe()
+		go m.Serve(serverConn)
+		c, err := NewClient(clientConn, time.Second)
+		tcheck(t, err, "new client")
+		return c
+	}
+
+	c := newClient(MockMilter{Handle: handle})
+	defer c.Close()
+
+	err := c.Macros(CmdConnect, "j", "mox.example")
+	tcheck(t, err, "macros")
+	resp, err := c.Connect("[127.0.0.1]", net.ParseIP("127.0.0.1"), 1234)
+	tcheck(t, err, "connect")
+	tcompare(t, resp.Action, ActionContinue)
+	_, err = c.Helo("remote.example")
+	tcheck(t, err, "helo")
+	_, err = c.Mail("sender@remote.example")
+	tcheck(t, err, "mail")
+	resp, err = c.Rcpt("reject@mox.example")
+	tcheck(t, err, "rcpt")
+	tcompare(t, resp, Response{ActionReject, 550, "5.1.1", "unknown"})
+	_, err = c.Rcpt("mjl@mox.example")
+	tcheck(t, err, "rcpt")
+
+	msg := strings.ReplaceAll("Subject: test\nTo: mjl@mox.example\n\tcontinued\n\nbody\n", "\n", "\r\n")
+	r, err := c.Message(strings.NewReader(msg))
+	tcheck(t, err, "message")
+	tcompare(t, r, EOMResult{
+		Response: Response{Action: ActionAccept},
+		HeaderChanges: []HeaderChange{
+			{"add", 0, "X-Spam", "yes"},
+			{"change", 1, "Subject", "[spam] test"},
+		},
+		Quarantine: true,
+		Reason:     "spam",
+	})
+
+	tcompare(t, got, []string{
+		"C [127.0.0.1]|4\x04\xd2127.0.0.1|",
+		"H remote.example|",
+		"M <sender@remote.example>|",
+		"R <reject@mox.example>|",
+		"R <mjl@mox.example>|",
+		"T ",
+		"L Subject|test|",
+		"L To|mjl@mox.example\r\n\tcontinued|",
+		"N ",
+		"B body\r\n",
+		"E ",
+	})
+
+	// Milter that doesn't want headers and doesn't reply to rcpt.
+	got = nil
+	c2 := newClient(MockMilter{Protocol: protoNoHeaders | protoNRRcpt, Handle: handle})
+	defer c2.Close()
+	resp, err = c2.Rcpt("reject@mox.example")
+	tcheck(t, err, "rcpt")
+	tcompare(t, resp.Action, ActionContinue)
+	_, err = c2.Message(strings.NewReader(msg))
+	tcheck(t, err, "message")
+	tcompare(t, got, []string{"R <reject@mox.example>|", "T ", "N ", "B body\r\n", "E "})
+
+	// Modifications that were not negotiated are an error.
+	c3 := newClient(MockMilter{Actions: actAddHeaders, Handle: handle})
+	defer c3.Close()
+	_, err = c3.Message(strings.NewReader(msg))
+	if !errors.Is(err, ErrProtocol) {
+		t.Fatalf("got err %v, expected ErrProtocol", err)
+	}
+}
+
+func TestApplyHeaderChanges(t *testing.T) {
+	header := strings.ReplaceAll("Received: one\nReceived: two\nSubject: test\n\tcontinued\n\n", "\n", "\r\n")
+
+	test := func(changes []HeaderChange, exp string) {
+		t.Helper()
+		buf, err := ApplyHeaderChanges([]byte(header), changes)
+		tcheck(t, err, "apply header changes")
+		tcompare(t, string(buf), strings.ReplaceAll(exp, "\n", "\r\n"))
+	}
+
+	test(nil, "Received: one\nReceived: two\nSubject: test\n\tcontinued\n\n")
+	test([]HeaderChange{{"add", 0, "X-Spam", "yes\n\tmore"}}, "Received: one\nReceived: two\nSubject: test\n\tcontinued\nX-Spam: yes\n\tmore\n\n")
+	test([]HeaderChange{{"insert", 0, "X-First", "1"}}, "X-First: 1\nReceived: one\nReceived: two\nSubject: test\n\tcontinued\n\n")
+	test([]HeaderChange{{"insert", 100, "X-Last", "1"}}, "Received: one\nReceived: two\nSubject: test\n\tcontinued\nX-Last: 1\n\n")
+	test([]HeaderChange{{"change", 1, "subject", "new"}}, "Received: one\nReceived: two\nsubject: new\n\n")
+	test([]HeaderChange{{"change", 2, "Received", ""}}, "Received: one\nSubject: test\n\tcontinued\n\n")
+	test([]HeaderChange{{"change", 3, "Received", "three"}}, "Received: one\nReceived: two\nSubject: test\n\tcontinued\nReceived: three\n\n")
+	test([]HeaderChange{{"change", 1, "X-Absent", ""}}, "Received: one\nReceived: two\nSubject: test\n\tcontinued\n\n")
+
+	_, err := ApplyHeaderChanges([]byte(header), []HeaderChange{{"bogus", 0, "X", "y"}})
+	if err == nil {
+		t.Fatalf("expected error for unknown change")
+	}
+}
@@ -0,0 +1,134 @@
+package milter
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// Packet is a response from a milter.
+type Packet struct {
+	Cmd  byte
+	Data []byte
+}
+
+// Reply returns a packet with a custom SMTP reply, e.g. "550 5.7.1 rejected".
+func Reply(s string) Packet {
+	return Packet{respReplyCode, cstrings(s)}
+}
+
+// AddHeader returns a packet requesting a header to be added.
+func AddHeader(name, value string) Packet {
+	return Packet{respAddHeader, cstrings(name, value)}
+}
+
+// ChangeHeader returns a packet requesting the index'th (1-based) occurrence of
+// header name to be changed, or removed if value is empty.
+func ChangeHeader(index int, name, value string) Packet {
+	return Packet{respChgHeader, append(binary.BigEndian.AppendUint32(nil, uint32(index)), cstrings(name, value)...)}
+}
+
+// Quarantine returns a packet requesting the message to be quarantined.
+func Quarantine(reason string) Packet {
+	return Packet{respQuarantine, cstrings(reason)}
+}
+
+// Simple responses, for MockMilter.
+var (
+	Continue = Packet{Cmd: respContinue}
+	Accept   = Packet{Cmd: respAccept}
+	Reject   = Packet{Cmd: respReject}
+	Tempfail = Packet{Cmd: respTempfail}
+	Discard  = Packet{Cmd: respDiscard}
+)
+
+// MockMilter is a milter for testing, standing in for a real content filter.
+type MockMilter struct {
+	Actions  uint32 // Modification actions requested during negotiation, default all supported.
+	Protocol uint32 // Protocol flags requested during negotiation.
+
+	// Handle is called for each command except macros, abort and quit, and
+	// returns the responses: optionally modifications for the end of message,
+	// followed by a final response. If Handle is nil or returns no packets,
+	// Continue is sent.
+	Handle func(cmd byte, data []byte) []Packet
+}
+
+// Serve handles a milter session on conn, until the MTA quits or the connection
+// is closed. The connection is closed when Serve returns.
+func (m MockMilter) Serve(conn net.Conn) error {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	write := func(p Packet) error {
+		buf := binary.BigEndian.AppendUint32(nil, uint32(1+len(p.Data)))
+		buf = append(buf, p.Cmd)
+		buf = append(buf, p.Data...)
+		_, err := conn.Write(buf)
+		return err
+	}
+	for {
+		var lenbuf [4]byte
+		if _, err := io.ReadFull(br, lenbuf[:]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		n := binary.BigEndian.Uint32(lenbuf[:])
+		if n == 0 || n > maxPacketSize {
+			return fmt.Errorf("bad packet size %d", n)
+		}
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return err
+		}
+		cmd, data := buf[0], buf[1:]
+
+		switch cmd {
+		case CmdOptNeg:
+			actions := m.Actions
+			if actions == 0 {
+				actions = actSupported
+			}
+			resp := binary.BigEndian.AppendUint32(nil, Version)
+			resp = binary.BigEndian.AppendUint32(resp, actions)
+			resp = binary.BigEndian.AppendUint32(resp, m.Protocol)
+			if err := write(Packet{respOptNeg, resp}); err != nil {
+				return err
+			}
+			continue
+		case CmdMacro, CmdAbort:
+			continue
+		case CmdQuit:
+			return nil
+		}
+
+		// No response for commands the milter negotiated not to respond to.
+		noReply := map[byte]uint32{
+			CmdConnect: protoNRConnect,
+			CmdHelo:    protoNRHelo,
+			CmdMail:    protoNRMail,
+			CmdRcpt:    protoNRRcpt,
+			CmdData:    protoNRData,
+			CmdHeader:  protoNRHeader,
+			CmdEOH:     protoNREOH,
+			CmdBody:    protoNRBody,
+		}
+		var l []Packet
+		if m.Handle != nil {
+			l = m.Handle(cmd, data)
+		}
+		if m.Protocol&noReply[cmd] != 0 {
+			continue
+		}
+		if len(l) == 0 {
+			l = []Packet{Continue}
+		}
+		for _, p := range l {
+			if err := write(p); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -880,6 +880,10 @@ func DomainRecords(domConf config.Domain, domain dns.Domain, hasDNSSEC bool, cer
 		)
 	}
 
+	// POP3 is only advertised when enabled with TLS on the public listener.
+	public, ok := Conf.Static.Listeners["public"]
+	pop3s := ok && public.TLS != nil && public.POP3S.Enabled
+
 	records = append(records,
 		"; Autoconfig is used by Thunderbird. Autodiscover is (in theory) used by Microsoft.",
 		fmt.Sprintf(`autoconfig.%s.         CNAME %s.`, d, h),
@@ -890,6 +894,11 @@ func DomainRecords(domConf config.Domain, domain dns.Domain, hasDNSSEC bool, cer
 		"; For secure IMAP and submission autoconfig, point to mail host.",
 		fmt.Sprintf(`_imaps._tcp.%s.        SRV 0 1 993 %s.`, d, h),
 		fmt.Sprintf(`_submissions._tcp.%s.  SRV 0 1 465 %s.`, d, h),
+	)
+	if pop3s {
+		records = append(records, fmt.Sprintf(`_pop3s._tcp.%s.        SRV 0 1 995 %s.`, d, h))
+	}
+	records = append(records,
 		"",
 		// ../rfc/6186:242
 		"; Next records specify POP3 and non-TLS ports are not to be used.",
@@ -898,8 +907,10 @@ func DomainRecords(domConf config.Domain, domain dns.Domain, hasDNSSEC bool, cer
 		fmt.Sprintf(`_imap._tcp.%s.         SRV 0 1 143 .`, d),
 		fmt.Sprintf(`_submission._tcp.%s.   SRV 0 1 587 .`, d),
 		fmt.Sprintf(`_pop3._tcp.%s.         SRV 0 1 110 .`, d),
-		fmt.Sprintf(`_pop3s._tcp.%s.        SRV 0 1 995 .`, d),
 	)
+	if !pop3s {
+		records = append(records, fmt.Sprintf(`_pop3s._tcp.%s.        SRV 0 1 995 .`, d))
+	}
 
 	if certIssuerDomainName != "" {
 		// ../rfc/8659:18 for CAA records.
@@ -1526,6 +1537,15 @@ func ClientConfigsDomain(d dns.Domain) (ClientConfigs, error) {
 		if l.IMAP.Enabled {
 			c.Entries = append(c.Entries, ClientConfigsEntry{"IMAP", host, config.Port(l.IMAPS.Port, 143), name, note(l.TLS != nil, !l.IMAP.NoRequireSTARTTLS)})
 		}
+		if l.POP3S.Enabled {
+			c.Entries = append(c.Entries, ClientConfigsEntry{"POP3", host, config.Port(l.POP3S.Port, 995), name, "with TLS"})
+		}
+		if l.POP3.Enabled {
+			c.Entries = append(c.Entries, ClientConfigsEntry{"POP3", host, config.Port(l.POP3.Port, 110), name, note(l.TLS != nil, !l.POP3.NoRequireSTARTTLS)})
+		}
+		if l.ManageSieve.Enabled {
+			c.Entries = append(c.Entries, ClientConfigsEntry{"ManageSieve", host, config.Port(l.ManageSieve.Port, 4190), name, note(l.TLS != nil, !l.ManageSieve.NoRequireSTARTTLS)})
+		}
 	}
 
 	return c, nil
@@ -39,6 +39,7 @@ import (
 	"github.com/mjl-/mox/dkim"
 	"github.com/mjl-/mox/dns"
 	"github.com/mjl-/mox/message"
+	"github.com/mjl-/mox/milter"
 	"github.com/mjl-/mox/mlog"
 	"github.com/mjl-/mox/moxio"
 	"github.com/mjl-/mox/mtasts"
@@ -61,16 +62,22 @@ var (
 
 var ErrConfig = errors.New("config error")
 
-// Set by packages webadmin, webaccount, webmail, webapisrv to prevent cyclic dependencies.
+// Set by packages webadmin, webaccount, webmail, webapisrv, jmapserver, carddavserver to prevent cyclic dependencies.
 var NewWebadminHandler = func(basePath string, isForwarded bool) http.Handler { return nopHandler }
 var NewWebaccountHandler = func(basePath string, isForwarded bool) http.Handler { return nopHandler }
 var NewWebmailHandler = func(maxMsgSize int64, basePath string, isForwarded bool, accountPath string) http.Handler {
 	return nopHandler
 }
 var NewWebapiHandler = func(maxMsgSize int64, basePath string, isForwarded bool) http.Handler { return nopHandler }
+var NewJMAPHandler = func(maxMsgSize int64, basePath string, isForwarded bool) http.Handler { return nopHandler }
+var NewCardDAVHandler = func(basePath string, isForwarded bool) http.Handler { return nopHandler }
 
 var nopHandler = http.HandlerFunc(nil)
 
+// AuditConfigChange is called after the dynamic config has been written, set
+// by package admindb for recording the change in the audit log.
+var AuditConfigChange = func(ctx context.Context, log mlog.Log, before, after config.Dynamic) {}
+
 // Config as used in the code, a processed version of what is in the config file.
 //
 // Use methods to lookup a domain/account/address in the dynamic configuration.
@@ -394,6 +401,8 @@ func writeDynamic(ctx context.Context, log mlog.Log, c config.Dynamic) error {
 	}
 	f = nil
 
+	before := Conf.Dynamic
+
 	Conf.dynamicMtime = fi.ModTime()
 	Conf.DynamicLastCheck = time.Now()
 	Conf.Dynamic = c
@@ -402,6 +411,8 @@ func writeDynamic(ctx context.Context, log mlog.Log, c config.Dynamic) error {
 
 	Conf.allowACMEHosts(log, true)
 
+	AuditConfigChange(ctx, log, before, c)
+
 	return nil
 }
 
@@ -552,6 +563,62 @@ func PrepareStaticConfig(ctx context.Context, log mlog.Log, configFile string, c
 	}
 	c.HostnameDomain = hostname
 
+	for _, s := range c.TrustedARCSealers {
+		d, err := dns.ParseDomain(s)
+		if err != nil {
+			addErrorf("parsing trusted arc sealer domain %q: %s", s, err)
+			continue
+		}
+		c.TrustedARCSealerDomains = append(c.TrustedARCSealerDomains, d)
+	}
+
+	if ea := c.ExternalAuth; ea != nil {
+		if (ea.LDAP == nil) == (ea.Exec == nil) {
+			addErrorf("external auth must have exactly one of LDAP and Exec")
+		}
+		if ea.LDAP != nil {
+			u, err := url.Parse(ea.LDAP.URL)
+			if err != nil {
+				addErrorf("parsing ldap url %q for external auth: %v", ea.LDAP.URL, err)
+			} else if u.Scheme != "ldap" && u.Scheme != "ldaps" {
+				addErrorf("ldap url %q for external auth must have scheme ldap or ldaps", ea.LDAP.URL)
+			} else if u.Hostname() == "" {
+				addErrorf("ldap url %q for external auth must have a host", ea.LDAP.URL)
+			} else if u.Scheme == "ldaps" && ea.LDAP.StartTLS {
+				addErrorf("ldap url %q for external auth cannot have StartTLS with scheme ldaps", ea.LDAP.URL)
+			}
+			if ea.LDAP.BindDN == "" {
+				addErrorf("ldap for external auth must have BindDN")
+			}
+		}
+		if ea.Exec != nil && len(ea.Exec.Command) == 0 {
+			addErrorf("exec for external auth must have a command")
+		}
+	}
+
+	if o := c.OIDC; o != nil {
+		if u, err := url.Parse(o.Issuer); err != nil {
+			addErrorf("parsing oidc issuer %q: %v", o.Issuer, err)
+		} else if u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+			addErrorf("oidc issuer %q must be an absolute http or https url", o.Issuer)
+		}
+		if o.JWKSURL != "" && o.JWKSFile != "" {
+			addErrorf("oidc cannot have both JWKSURL and JWKSFile")
+		} else if o.JWKSURL != "" {
+			if u, err := url.Parse(o.JWKSURL); err != nil {
+				addErrorf("parsing oidc jwks url %q: %v", o.JWKSURL, err)
+			} else if u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+				addErrorf("oidc jwks url %q must be an absolute http or https url", o.JWKSURL)
+			}
+		}
+		if o.ClientSecret != "" && o.ClientID == "" {
+			addErrorf("oidc ClientSecret requires ClientID")
+		}
+		if o.Audience == "" && o.ClientID == "" {
+			addErrorf("oidc requires Audience or ClientID, for checking the audience of tokens")
+		}
+	}
+
 	if c.HostTLSRPT.Account != "" {
 		tlsrptLocalpart, err := smtp.ParseLocalpart(c.HostTLSRPT.Localpart)
 		if err != nil {
@@ -789,6 +856,7 @@ func PrepareStaticConfig(ctx context.Context, log mlog.Log, configFile string, c
 				}
 			}
 			needtls("IMAPS", l.IMAPS.Enabled)
+			needtls("POP3S", l.POP3S.Enabled)
 			needtls("SMTP", l.SMTP.Enabled && !l.SMTP.NoSTARTTLS)
 			needtls("Submissions", l.Submissions.Enabled)
 			needtls("Submission", l.Submission.Enabled && !l.Submission.NoRequireSTARTTLS)
@@ -835,6 +903,49 @@ func PrepareStaticConfig(ctx context.Context, log mlog.Log, configFile string, c
 			}
 			l.SMTP.DNSBLZones = append(l.SMTP.DNSBLZones, d)
 		}
+		for i, m := range l.SMTP.Milters {
+			if _, _, err := milter.ParseAddress(m.Address); err != nil {
+				addErrorf("listener %q has milter with invalid address %q: %v", name, m.Address, err)
+			}
+			switch m.OnError {
+			case "":
+				l.SMTP.Milters[i].OnError = "tempfail"
+			case "tempfail", "accept", "reject":
+			default:
+				addErrorf("listener %q has milter with invalid OnError %q, must be tempfail, accept or reject", name, m.OnError)
+			}
+			if m.Timeout == 0 {
+				l.SMTP.Milters[i].Timeout = 30 * time.Second
+			} else if m.Timeout < 0 {
+				addErrorf("listener %q has milter with negative timeout", name)
+			}
+		}
+		if l.LMTP.Enabled {
+			l.LMTP.TrustedIPNets = nil
+			nets := l.LMTP.TrustedNetworks
+			if len(nets) == 0 {
+				nets = []string{"127.0.0.0/8", "::1/128"}
+			}
+			for _, s := range nets {
+				if ip := net.ParseIP(s); ip != nil {
+					bits := 8 * len(ip.To16())
+					if ip.To4() != nil {
+						ip = ip.To4()
+						bits = 32
+					}
+					s = fmt.Sprintf("%s/%d", ip, bits)
+				}
+				_, ipnet, err := net.ParseCIDR(s)
+				if err != nil {
+					addErrorf("listener %q has invalid lmtp trusted network %q: %v", name, s, err)
+					continue
+				}
+				l.LMTP.TrustedIPNets = append(l.LMTP.TrustedIPNets, ipnet)
+			}
+			if l.LMTP.Port < 0 && l.LMTP.UnixSocket == "" {
+				addErrorf("listener %q has lmtp enabled but without tcp port or unix socket", name)
+			}
+		}
 		if l.IPsNATed && len(l.NATIPs) > 0 {
 			addErrorf("listener %q has both IPsNATed and NATIPs (remove deprecated IPsNATed)", name)
 		}
@@ -949,6 +1060,9 @@ func PrepareStaticConfig(ctx context.Context, log mlog.Log, configFile string, c
 		}
 	}
 
+	// IP pool names are unique over all direct transports.
+	ipPoolTransports := map[string]string{}
+
 	checkTransportDirect := func(name string, t *config.TransportDirect) {
 		if t.DisableIPv4 && t.DisableIPv6 {
 			addErrorf("transport %s: both IPv4 and IPv6 are disabled, enable at least one", name)
@@ -960,6 +1074,30 @@ func PrepareStaticConfig(ctx context.Context, log mlog.Log, configFile string, c
 		if t.DisableIPv6 {
 			t.IPFamily = "ip4"
 		}
+
+		for poolName, pool := range t.IPPools {
+			if other, ok := ipPoolTransports[poolName]; ok {
+				addErrorf("transport %s: ip pool %s already present in transport %s", name, poolName, other)
+			}
+			ipPoolTransports[poolName] = name
+			if len(pool.IPs) == 0 {
+				addErrorf("transport %s: ip pool %s: no ips", name, poolName)
+			}
+			for i, pip := range pool.IPs {
+				ip := net.ParseIP(pip.IP)
+				if ip == nil {
+					addErrorf("transport %s: ip pool %s: bad ip %s", name, poolName, pip.IP)
+				} else if t.DisableIPv4 && ip.To4() != nil || t.DisableIPv6 && ip.To4() == nil {
+					addErrorf("transport %s: ip pool %s: ip %s of disabled address family", name, poolName, pip.IP)
+				}
+				pool.IPs[i].ParsedIP = ip
+				var err error
+				pool.IPs[i].HostnameDomain, err = dns.ParseDomain(pip.Hostname)
+				if err != nil {
+					addErrorf("transport %s: ip pool %s: bad hostname %s: %v", name, poolName, pip.Hostname, err)
+				}
+			}
+		}
 	}
 
 	for name, t := range c.Transports {
@@ -989,6 +1127,74 @@ func PrepareStaticConfig(ctx context.Context, log mlog.Log, configFile string, c
 		}
 	}
 
+	for name, rl := range c.OutgoingRateLimits {
+		parseDomains := func(l []string) []string {
+			var r []string
+			for _, e := range l {
+				prefix := ""
+				if strings.HasPrefix(e, ".") {
+					prefix = "."
+					e = e[1:]
+				}
+				d, err := dns.ParseDomain(e)
+				if err != nil {
+					addErrorf("outgoing rate limit %s: invalid domain %s: %v", name, e, err)
+				}
+				r = append(r, prefix+d.ASCII)
+			}
+			return r
+		}
+
+		n := 0
+		if len(rl.RecipientDomains) > 0 {
+			n++
+			rl.RecipientDomainsASCII = parseDomains(rl.RecipientDomains)
+		}
+		if len(rl.MXHosts) > 0 {
+			n++
+			rl.MXHostsASCII = parseDomains(rl.MXHosts)
+		}
+		if len(rl.SourceIPs) > 0 {
+			n++
+			for _, ipstr := range rl.SourceIPs {
+				ip := net.ParseIP(ipstr)
+				if ip == nil {
+					addErrorf("outgoing rate limit %s: bad ip %s", name, ipstr)
+				} else {
+					rl.IPs = append(rl.IPs, ip)
+				}
+			}
+		}
+		if n != 1 {
+			addErrorf("outgoing rate limit %s: must have exactly one of RecipientDomains, MXHosts and SourceIPs", name)
+		}
+		if rl.MessagesPerMinute < 0 || rl.MaxConnections < 0 {
+			addErrorf("outgoing rate limit %s: limits cannot be negative", name)
+		}
+		if rl.WarmupStart != "" {
+			var err error
+			rl.WarmupStartDay, err = time.Parse("2006-01-02", rl.WarmupStart)
+			if err != nil {
+				addErrorf("outgoing rate limit %s: bad warmup start date %s: %v", name, rl.WarmupStart, err)
+			}
+			if len(rl.WarmupMessagesPerDay) == 0 {
+				addErrorf("outgoing rate limit %s: warmup start without messages per day", name)
+			}
+		} else if len(rl.WarmupMessagesPerDay) > 0 {
+			addErrorf("outgoing rate limit %s: warmup messages per day require a warmup start date", name)
+		}
+		for _, v := range rl.WarmupMessagesPerDay {
+			if v <= 0 {
+				addErrorf("outgoing rate limit %s: warmup messages per day must be positive", name)
+				break
+			}
+		}
+		if rl.MessagesPerMinute == 0 && rl.MaxConnections == 0 && len(rl.WarmupMessagesPerDay) == 0 {
+			addErrorf("outgoing rate limit %s: no limits configured", name)
+		}
+		c.OutgoingRateLimits[name] = rl
+	}
+
 	// Load CA certificate pool.
 	if c.TLS.CA != nil {
 		if c.TLS.CA.AdditionalToSystem {
@@ -1120,6 +1326,13 @@ func prepareDynamicConfig(ctx context.Context, log mlog.Log, dynamicPath string,
 			if !ok {
 				addErrorf("%s: route references undefined transport %s", descr, routes[i].Transport)
 			}
+			if pool := routes[i].IPPool; pool != "" {
+				if t := routes[i].ResolvedTransport.Direct; t == nil {
+					addErrorf("%s: route with ip pool %s must have a direct transport", descr, pool)
+				} else if _, ok := t.IPPools[pool]; !ok {
+					addErrorf("%s: route references undefined ip pool %s of transport %s", descr, pool, routes[i].Transport)
+				}
+			}
 		}
 	}
 
@@ -1533,6 +1746,26 @@ func prepareDynamicConfig(ctx context.Context, log mlog.Log, dynamicPath string,
 		}
 
 		checkRoutes("routes for account", acc.Routes)
+
+		// The key for encrypted messages is sealed with the account password. A password
+		// in an external backend can change without mox knowing the old password, making
+		// the messages unreadable.
+		if acc.EncryptMessages && static.ExternalAuth != nil {
+			addErrorf("account %q: EncryptMessages cannot be used with ExternalAuth", accName)
+		}
+
+	ippools:
+		for _, pool := range acc.IPPools {
+			for _, t := range static.Transports {
+				if t.Direct == nil {
+					continue
+				}
+				if _, ok := t.Direct.IPPools[pool]; ok {
+					continue ippools
+				}
+			}
+			addErrorf("account %q references undefined ip pool %s", accName, pool)
+		}
 	}
 
 	// Set DMARC destinations.
@@ -1668,7 +1901,7 @@ func prepareDynamicConfig(ctx context.Context, log mlog.Log, dynamicPath string,
 				}
 				dastr := da.Pack(true)
 				accDest, ok := accDests[dastr]
-				if !ok {
+				if _, local := c.Domains[da.Domain.Name()]; !ok && (local || a.ListOwner == "") {
 					addErrorf("domain %q: alias %q references non-existent address %q", d, addr, destAddr)
 					continue
 				}
@@ -1677,14 +1910,38 @@ func prepareDynamicConfig(ctx context.Context, log mlog.Log, dynamicPath string,
 					continue
 				}
 				seen[dastr] = true
+				// For external addresses, the account name and destination remain empty.
 				aa := config.AliasAddress{Address: da, AccountName: accDest.Account, Destination: accDest.Destination}
 				a.ParsedAddresses = append(a.ParsedAddresses, aa)
 			}
+			if a.ListOwner != "" {
+				oa, err := smtp.ParseAddress(a.ListOwner)
+				if err != nil {
+					addErrorf("domain %q: parsing list owner address %q in alias %q: %v", d, a.ListOwner, addr, err)
+					continue
+				}
+				accDest, ok := accDests[oa.Pack(true)]
+				if !ok {
+					addErrorf("domain %q: alias %q has list owner %q that is not an address of an account", d, addr, a.ListOwner)
+					continue
+				}
+				a.ParsedListOwner = config.AliasAddress{Address: oa, AccountName: accDest.Account, Destination: accDest.Destination}
+			} else if a.Subscribe || a.Moderate || a.DigestInterval != 0 {
+				addErrorf("domain %q: alias %q needs a list owner for subscriptions, moderation and digests", d, addr)
+				continue
+			}
+			if a.DigestInterval < 0 || a.DigestInterval > 0 && a.DigestInterval < time.Hour {
+				addErrorf("domain %q: alias %q has digest interval %v, must be at least 1h", d, addr, a.DigestInterval)
+				continue
+			}
 			a.Domain = domain.Domain
 			c.Domains[d].Aliases[lpstr] = a
 			aliases[addr] = a
 
 			for _, aa := range a.ParsedAddresses {
+				if aa.AccountName == "" {
+					continue
+				}
 				acc := c.Accounts[aa.AccountName]
 				var addrs []string
 				if a.ListMembers {
@@ -1836,6 +2093,10 @@ func prepareDynamicConfig(ctx context.Context, log mlog.Log, dynamicPath string,
 				wi.Handler = NewWebmailHandler(config.DefaultMaxMsgSize, wi.BasePath, isForwarded, accountPath)
 			case "webapi":
 				wi.Handler = NewWebapiHandler(config.DefaultMaxMsgSize, wi.BasePath, isForwarded)
+			case "jmap":
+				wi.Handler = NewJMAPHandler(config.DefaultMaxMsgSize, wi.BasePath, isForwarded)
+			case "carddav":
+				wi.Handler = NewCardDAVHandler(wi.BasePath, isForwarded)
 			default:
 				addErrorf("webinternal %s %s: unknown service %q", wh.Domain, wh.PathRegexp, wi.Service)
 			}
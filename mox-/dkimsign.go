@@ -3,13 +3,18 @@ package mox
 import (
 	"bytes"
 	"context"
+	"crypto/rsa"
 	"fmt"
+	"io"
+	"slices"
 	"strings"
 	"time"
 
+	"github.com/mjl-/mox/arc"
 	"github.com/mjl-/mox/config"
 	"github.com/mjl-/mox/dkim"
 	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/message"
 	"github.com/mjl-/mox/mlog"
 	"github.com/mjl-/mox/smtp"
 )
@@ -39,6 +44,13 @@ func DKIMSelectors(dkimConf config.DKIM) []dkim.Selector {
 // DKIM-Signatur headers, are returned. If no domain was found an empty string and
 // nil error is returned.
 func DKIMSign(ctx context.Context, log mlog.Log, from smtp.Path, smtputf8 bool, data []byte) (string, error) {
+	return DKIMSignHeaders(ctx, log, from, smtputf8, nil, data)
+}
+
+// DKIMSignHeaders is like DKIMSign, but also signs extraHeaders in addition to
+// the headers configured for the selectors. Used for headers that are not signed
+// by default, such as the List-* headers added to messages for mailing lists.
+func DKIMSignHeaders(ctx context.Context, log mlog.Log, from smtp.Path, smtputf8 bool, extraHeaders []string, data []byte) (string, error) {
 	// Add DKIM signature for domain, even if higher up than the full mail hostname.
 	// This helps with an assumed (because default) relaxed DKIM policy. If the DMARC
 	// policy happens to be strict, the signature won't help, but won't hurt either.
@@ -55,6 +67,17 @@ func DKIMSign(ctx context.Context, log mlog.Log, from smtp.Path, smtputf8 bool,
 		}
 
 		selectors := DKIMSelectors(confDom.DKIM)
+		if len(extraHeaders) > 0 {
+			for i := range selectors {
+				headers := append([]string{}, selectors[i].Headers...)
+				for _, h := range extraHeaders {
+					if !slices.ContainsFunc(headers, func(s string) bool { return strings.EqualFold(s, h) }) {
+						headers = append(headers, h)
+					}
+				}
+				selectors[i].Headers = headers
+			}
+		}
 		dkimHeaders, err := dkim.Sign(ctx, log.Logger, from.Localpart, fd, selectors, smtputf8, bytes.NewReader(data))
 		if err != nil {
 			return "", fmt.Errorf("dkim sign for domain %s: %v", fd, err)
@@ -63,3 +86,35 @@ func DKIMSign(ctx context.Context, log mlog.Log, from smtp.Path, smtputf8 bool,
 	}
 	return "", nil
 }
+
+// ARCSeal looks up the domain, like DKIMSign, and uses the first DKIM selector
+// with an RSA key that it signs with to generate headers for a new ARC set, for
+// inclusion in a forwarded message. The headers are returned. If no domain or
+// selector was found an empty string and nil error is returned.
+func ARCSeal(ctx context.Context, log mlog.Log, domain dns.Domain, authResults message.AuthResults, chain arc.Status, msg io.ReaderAt) (string, error) {
+	fd := domain
+	var zerodom dns.Domain
+	for fd != zerodom {
+		confDom, ok := Conf.Domain(fd)
+		if !ok {
+			var nfd dns.Domain
+			_, nfd.ASCII, _ = strings.Cut(fd.ASCII, ".")
+			_, nfd.Unicode, _ = strings.Cut(fd.Unicode, ".")
+			fd = nfd
+			continue
+		}
+
+		for _, sel := range DKIMSelectors(confDom.DKIM) {
+			if _, ok := sel.PrivateKey.(*rsa.PrivateKey); !ok {
+				continue
+			}
+			arcHeaders, err := arc.Seal(ctx, log.Logger, fd, sel, authResults, chain, msg)
+			if err != nil {
+				return "", fmt.Errorf("arc seal for domain %s: %w", fd, err)
+			}
+			return arcHeaders, nil
+		}
+		return "", nil
+	}
+	return "", nil
+}
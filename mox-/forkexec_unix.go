@@ -6,6 +6,7 @@ import (
 	"log/slog"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 )
@@ -42,8 +43,8 @@ func ForkExecUnprivileged() {
 		Files: files,
 		Sys: &syscall.SysProcAttr{
 			Credential: &syscall.Credential{
-				Uid: Conf.Static.UID,
-				Gid: Conf.Static.GID,
+				Uid: xid(Conf.Static.UID),
+				Gid: xid(Conf.Static.GID),
 			},
 		},
 	})
@@ -71,3 +72,8 @@ func ForkExecUnprivileged() {
 	pkglog.Print("stopping after child exit", slog.Int("exitcode", code))
 	os.Exit(code)
 }
+
+func xid(s string) uint32 {
+	v, _ := strconv.ParseUint(s, 10, 32)
+	return uint32(v)
+}
@@ -109,3 +109,69 @@ func AllowMsgFrom(accountName string, msgFrom smtp.Address) bool {
 	}
 	return accName == accountName
 }
+
+// ListCommand is the kind of request for a mailing list, through an address
+// with the alias localpart followed by a suffix.
+type ListCommand string
+
+const (
+	ListRequest         ListCommand = "request"          // Help about the list.
+	ListOwner           ListCommand = "owner"            // Delivered to the list owner.
+	ListSubscribe       ListCommand = "subscribe"        // Request to subscribe.
+	ListSubscribeDigest ListCommand = "subscribe-digest" // Request to subscribe in digest mode.
+	ListUnsubscribe     ListCommand = "unsubscribe"      // Request to unsubscribe.
+	ListBounces         ListCommand = "bounces"          // Envelope sender for messages to members, parameter is the member address.
+	ListConfirm         ListCommand = "confirm"          // Confirmation of (un)subscribe request, parameter is token.
+	ListApprove         ListCommand = "approve"          // Approve held message, parameter is token.
+	ListReject          ListCommand = "reject"           // Reject held message, parameter is token.
+)
+
+// LookupListAddress checks if localpart and domain form a command address for an
+// alias with a list owner, such as "<alias>-subscribe" or "<alias>-bounces-<param>".
+// Addresses that are explicitly configured take precedence.
+func LookupListAddress(localpart smtp.Localpart, domain dns.Domain) (alias *config.Alias, cmd ListCommand, param string, ok bool) {
+	d, ok := Conf.Domain(domain)
+	if !ok || d.ReportsOnly || len(d.Aliases) == 0 {
+		return nil, "", "", false
+	}
+	lp := string(localpart)
+	if !d.LocalpartCaseSensitive {
+		lp = strings.ToLower(lp)
+	}
+	if _, _, ok := Conf.AccountDestination(smtp.NewAddress(smtp.Localpart(lp), domain).String()); ok {
+		return nil, "", "", false
+	}
+
+	for lpstr, a := range d.Aliases {
+		if a.ListOwner == "" {
+			continue
+		}
+		alp, err := smtp.ParseLocalpart(lpstr)
+		if err != nil {
+			continue
+		}
+		prefix := string(alp)
+		if !d.LocalpartCaseSensitive {
+			prefix = strings.ToLower(prefix)
+		}
+		rest, ok := strings.CutPrefix(lp, prefix+"-")
+		if !ok {
+			continue
+		}
+		switch c := ListCommand(rest); c {
+		case ListRequest, ListOwner, ListUnsubscribe:
+			return &a, c, "", true
+		case ListSubscribe, ListSubscribeDigest:
+			if a.Subscribe {
+				return &a, c, "", true
+			}
+			continue
+		}
+		for _, c := range []ListCommand{ListBounces, ListConfirm, ListApprove, ListReject} {
+			if p, ok := strings.CutPrefix(rest, string(c)+"-"); ok && p != "" {
+				return &a, c, p, true
+			}
+		}
+	}
+	return nil, "", "", false
+}
@@ -0,0 +1,215 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+// After this time, keys are fetched again on next use. On failure, the old keys
+// remain in use.
+const jwksRefreshInterval = time.Hour
+
+// Minimum time between fetches because of tokens with unknown key ids, to prevent
+// tokens from causing many requests to the identity provider.
+const jwksMinFetchInterval = time.Minute
+
+// jwk is a JSON Web Key, only the fields for public keys for signatures. ../rfc/7517
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+
+	// RSA. ../rfc/7518
+	N string `json:"n"`
+	E string `json:"e"`
+
+	// EC and OKP (Ed25519). ../rfc/7518 ../rfc/8037
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type publicKey struct {
+	kid string
+	alg string // Optional, if set the token algorithm must match.
+	key crypto.PublicKey
+}
+
+// parseJWKS returns the signature keys from a JSON Web Key Set. Keys that are
+// not for signatures or that have unsupported types are skipped.
+func parseJWKS(log mlog.Log, buf []byte) ([]publicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(buf, &set); err != nil {
+		return nil, fmt.Errorf("parsing jwks: %v", err)
+	}
+	var l []publicKey
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			log.Debugx("skipping key in jwks", err, slog.String("kid", k.Kid), slog.String("kty", k.Kty))
+			continue
+		}
+		l = append(l, publicKey{k.Kid, k.Alg, key})
+	}
+	if len(l) == 0 {
+		return nil, fmt.Errorf("no usable signature keys in jwks")
+	}
+	return l, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	b64int := func(s string) (*big.Int, error) {
+		buf, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		} else if len(buf) == 0 {
+			return nil, fmt.Errorf("empty value")
+		}
+		return new(big.Int).SetBytes(buf), nil
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, err := b64int(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("rsa modulus: %v", err)
+		}
+		e, err := b64int(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("rsa exponent: %v", err)
+		} else if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("rsa exponent too large")
+		}
+		if n.BitLen() < 2048 {
+			return nil, fmt.Errorf("rsa key too small, %d bits", n.BitLen())
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := b64int(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("ec x: %v", err)
+		}
+		y, err := b64int(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("ec y: %v", err)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("ec point not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		buf, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("ed25519 key: %v", err)
+		} else if len(buf) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("ed25519 key has size %d, expected %d", len(buf), ed25519.PublicKeySize)
+		}
+		return ed25519.PublicKey(buf), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// keys returns the current keys of the provider, fetching or reading them if
+// needed. If refresh is set, e.g. because a token has an unknown key id, the keys
+// are fetched again if the last attempt is long enough ago.
+//
+// Must be called with the provider lock held.
+func (p *provider) keys(ctx context.Context, log mlog.Log, refresh bool) ([]publicKey, error) {
+	if p.conf.JWKSFile != "" {
+		path := mox.ConfigDirPath(p.conf.JWKSFile)
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("%w: jwks file: %v", ErrBackend, err)
+		}
+		if p.jwks != nil && fi.ModTime().Equal(p.jwksModTime) {
+			return p.jwks, nil
+		}
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("%w: reading jwks file: %v", ErrBackend, err)
+		}
+		keys, err := parseJWKS(log, buf)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrBackend, err)
+		}
+		p.jwks = keys
+		p.jwksModTime = fi.ModTime()
+		return keys, nil
+	}
+
+	now := time.Now()
+	fetch := p.jwks == nil || now.Sub(p.jwksFetched) > jwksRefreshInterval || refresh
+	if !fetch || now.Sub(p.jwksLastAttempt) < jwksMinFetchInterval {
+		if p.jwks == nil {
+			return nil, fmt.Errorf("%w: no keys after failed fetch", ErrBackend)
+		}
+		return p.jwks, nil
+	}
+	p.jwksLastAttempt = now
+
+	jwksURL := p.conf.JWKSURL
+	if jwksURL == "" {
+		d, err := p.discover(ctx, log)
+		if err != nil {
+			return p.keysAfterError(log, err)
+		}
+		jwksURL = d.JWKSURI
+	}
+	buf, err := p.get(ctx, "jwks", jwksURL)
+	if err != nil {
+		return p.keysAfterError(log, err)
+	}
+	keys, err := parseJWKS(log, buf)
+	if err != nil {
+		return p.keysAfterError(log, fmt.Errorf("%w: %v", ErrBackend, err))
+	}
+	p.jwks = keys
+	p.jwksFetched = now
+	return keys, nil
+}
+
+// keysAfterError returns the previous keys, if any, after failing to fetch new
+// keys.
+func (p *provider) keysAfterError(log mlog.Log, err error) ([]publicKey, error) {
+	if p.jwks == nil {
+		return nil, err
+	}
+	log.Errorx("fetching jwks, continuing with previous keys", err)
+	return p.jwks, nil
+}
@@ -0,0 +1,183 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Allowed clock difference with the identity provider for the time claims.
+const clockSkew = time.Minute
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// parseJWT parses a compact serialized JWS (the only form for JWTs), returning
+// its header, claims, signed data and signature. ../rfc/7519 ../rfc/7515
+func parseJWT(token string) (jwtHeader, map[string]any, []byte, []byte, error) {
+	var hdr jwtHeader
+	t := strings.Split(token, ".")
+	if len(t) != 3 {
+		return hdr, nil, nil, nil, fmt.Errorf("%w: jwt must have 3 parts, got %d", ErrToken, len(t))
+	}
+	hdrbuf, err := base64.RawURLEncoding.DecodeString(t[0])
+	if err != nil {
+		return hdr, nil, nil, nil, fmt.Errorf("%w: decoding header: %v", ErrToken, err)
+	}
+	if err := json.Unmarshal(hdrbuf, &hdr); err != nil {
+		return hdr, nil, nil, nil, fmt.Errorf("%w: parsing header: %v", ErrToken, err)
+	}
+	claimsbuf, err := base64.RawURLEncoding.DecodeString(t[1])
+	if err != nil {
+		return hdr, nil, nil, nil, fmt.Errorf("%w: decoding claims: %v", ErrToken, err)
+	}
+	var claims map[string]any
+	if err := json.Unmarshal(claimsbuf, &claims); err != nil {
+		return hdr, nil, nil, nil, fmt.Errorf("%w: parsing claims: %v", ErrToken, err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(t[2])
+	if err != nil {
+		return hdr, nil, nil, nil, fmt.Errorf("%w: decoding signature: %v", ErrToken, err)
+	}
+	return hdr, claims, []byte(t[0] + "." + t[1]), sig, nil
+}
+
+// algHash returns the hash function for a JWS algorithm. ../rfc/7518
+func algHash(alg string) (crypto.Hash, bool) {
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		return crypto.SHA256, true
+	case "RS384", "PS384", "ES384":
+		return crypto.SHA384, true
+	case "RS512", "PS512", "ES512":
+		return crypto.SHA512, true
+	}
+	return 0, false
+}
+
+// verifySignature checks the signature over data with key for algorithm alg.
+// Algorithm "none" and HMAC algorithms are never accepted.
+func verifySignature(alg string, key crypto.PublicKey, data, sig []byte) error {
+	if alg == "EdDSA" {
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return fmt.Errorf("%w: key type %T does not match algorithm %s", ErrToken, key, alg)
+		}
+		if !ed25519.Verify(pub, data, sig) {
+			return fmt.Errorf("%w: bad signature", ErrToken)
+		}
+		return nil
+	}
+
+	h, ok := algHash(alg)
+	if !ok {
+		return fmt.Errorf("%w: unsupported algorithm %q", ErrToken, alg)
+	}
+	hh := h.New()
+	hh.Write(data)
+	digest := hh.Sum(nil)
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		var err error
+		switch alg[:2] {
+		case "RS":
+			err = rsa.VerifyPKCS1v15(pub, h, digest, sig)
+		case "PS":
+			err = rsa.VerifyPSS(pub, h, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		default:
+			return fmt.Errorf("%w: key type %T does not match algorithm %s", ErrToken, key, alg)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: bad signature: %v", ErrToken, err)
+		}
+		return nil
+
+	case *ecdsa.PublicKey:
+		// The curve must match the algorithm. ../rfc/7518
+		curves := map[string]string{"ES256": "P-256", "ES384": "P-384", "ES512": "P-521"}
+		if curves[alg] != pub.Curve.Params().Name {
+			return fmt.Errorf("%w: key with curve %s does not match algorithm %s", ErrToken, pub.Curve.Params().Name, alg)
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		// Signature is R and S concatenated, each of the curve size. ../rfc/7518
+		if len(sig) != 2*size {
+			return fmt.Errorf("%w: bad signature size %d, expected %d", ErrToken, len(sig), 2*size)
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return fmt.Errorf("%w: bad signature", ErrToken)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: unsupported key type %T", ErrToken, key)
+}
+
+// checkClaims verifies the registered claims for issuer, audience and validity
+// period. The audience is always checked: without it, tokens issued by the
+// identity provider for any other client would be accepted. ../rfc/7519
+func checkClaims(claims map[string]any, issuer, audience string, now time.Time) error {
+	if iss, _ := claims["iss"].(string); iss != issuer {
+		return fmt.Errorf("%w: issuer %q, expected %q", ErrToken, iss, issuer)
+	}
+
+	if audience == "" {
+		return fmt.Errorf("%w: no audience configured", ErrToken)
+	}
+	var auds []string
+	switch aud := claims["aud"].(type) {
+	case string:
+		auds = []string{aud}
+	case []any:
+		for _, a := range aud {
+			if s, ok := a.(string); ok {
+				auds = append(auds, s)
+			}
+		}
+	}
+	if !slices.Contains(auds, audience) {
+		return fmt.Errorf("%w: audience %v does not contain %q", ErrToken, auds, audience)
+	}
+
+	// Tokens without expiration time are not accepted.
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return fmt.Errorf("%w: missing exp claim", ErrToken)
+	} else if now.Add(-clockSkew).After(time.Unix(int64(exp), 0)) {
+		return fmt.Errorf("%w: token expired", ErrToken)
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(clockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return fmt.Errorf("%w: token not yet valid", ErrToken)
+	}
+	return nil
+}
+
+// claimAddress returns the email address from claim. If claim is "email", the
+// "email_verified" claim must be present and true, otherwise an unverified address
+// could be used to log in to an account.
+func claimAddress(claims map[string]any, claim string) (string, error) {
+	addr, _ := claims[claim].(string)
+	if addr == "" {
+		return "", fmt.Errorf("%w: missing claim %q", ErrToken, claim)
+	}
+	if claim == "email" {
+		// Some identity providers send a string.
+		if v := claims["email_verified"]; v != true && v != "true" {
+			return "", fmt.Errorf("%w: email address not verified", ErrToken)
+		}
+	}
+	return addr, nil
+}
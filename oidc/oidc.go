@@ -0,0 +1,374 @@
+// Package oidc verifies OAuth 2.0 bearer tokens issued by an OpenID Connect
+// identity provider, and implements the authorization code flow for logging in to
+// the web interfaces.
+//
+// Tokens must be JWTs signed with a key from the JSON Web Key Set (JWKS) of the
+// provider. The JWKS is fetched from the provider, or read from a local file. An
+// email address from a claim in the token identifies the account.
+//
+// The SASL mechanisms OAUTHBEARER (RFC 7628) and XOAUTH2 (as used by Google and
+// Microsoft) carry bearer tokens in IMAP and SMTP.
+package oidc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/moxvar"
+)
+
+var metricRequest = promauto.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "mox_oidc_request_duration_seconds",
+		Help:    "Duration and result of requests to the OpenID Connect identity provider.",
+		Buckets: []float64{0.01, 0.05, 0.100, 0.5, 1, 5, 10, 20},
+	},
+	[]string{
+		"request", // discovery, jwks, token
+		"result",  // ok, error
+	},
+)
+
+var (
+	// ErrToken is returned for tokens that are not valid, e.g. with a bad signature,
+	// expired, or for another issuer or audience. Such tokens should be treated as
+	// bad credentials.
+	ErrToken = errors.New("invalid token")
+
+	// ErrBackend is returned when the identity provider or its keys are not
+	// available, e.g. because it cannot be reached.
+	ErrBackend = errors.New("identity provider error")
+)
+
+// DefaultTimeout is used for requests to the identity provider when no timeout
+// is configured.
+const DefaultTimeout = 10 * time.Second
+
+// Discovered endpoints are fetched again after this time.
+const discoveryRefreshInterval = time.Hour
+
+// Maximum size of documents fetched from the identity provider.
+const maxResponseSize = 1024 * 1024
+
+// HTTPClient is used for requests to the identity provider.
+var HTTPClient = &http.Client{}
+
+// Providers, keyed by their configuration.
+var providers = struct {
+	sync.Mutex
+	m map[config.OIDC]*provider
+}{
+	m: map[config.OIDC]*provider{},
+}
+
+type provider struct {
+	sync.Mutex
+	conf config.OIDC
+
+	discovery        *discovery
+	discoveryFetched time.Time
+
+	jwks            []publicKey
+	jwksFetched     time.Time
+	jwksLastAttempt time.Time
+	jwksModTime     time.Time // For JWKSFile.
+}
+
+// discovery holds the fields from the OpenID provider metadata we use.
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+func providerGet(conf config.OIDC) *provider {
+	providers.Lock()
+	defer providers.Unlock()
+	p := providers.m[conf]
+	if p == nil {
+		p = &provider{conf: conf}
+		providers.m[conf] = p
+	}
+	return p
+}
+
+func withTimeout(ctx context.Context, conf config.OIDC) (context.Context, context.CancelFunc) {
+	timeout := conf.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// Verify checks token, a JWT, and returns the email address from the configured
+// claim. Errors wrap ErrToken for invalid tokens, and ErrBackend if the token
+// could not be verified.
+func Verify(ctx context.Context, log mlog.Log, conf config.OIDC, token string) (address string, rerr error) {
+	log = log.WithPkg("oidc")
+	ctx, cancel := withTimeout(ctx, conf)
+	defer cancel()
+	start := time.Now()
+	defer func() {
+		log.Debugx("oidc token verification result", rerr,
+			slog.String("address", address),
+			slog.Duration("duration", time.Since(start)))
+	}()
+	return verify(ctx, log, conf, token, "")
+}
+
+// verify checks the signature and claims of token. If nonce is not empty, the
+// token must have a matching "nonce" claim, as used for ID tokens from the web
+// login flow.
+func verify(ctx context.Context, log mlog.Log, conf config.OIDC, token, nonce string) (string, error) {
+	hdr, claims, data, sig, err := parseJWT(token)
+	if err != nil {
+		return "", err
+	}
+
+	p := providerGet(conf)
+	p.Lock()
+	keys, err := p.keys(ctx, log, false)
+	if err == nil && hdr.Kid != "" && !hasKey(keys, hdr.Kid) {
+		// The provider may have rotated its keys.
+		keys, err = p.keys(ctx, log, true)
+	}
+	p.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	var verified bool
+	var verr error
+	for _, k := range keys {
+		if hdr.Kid != "" && k.kid != hdr.Kid || k.alg != "" && k.alg != hdr.Alg {
+			continue
+		}
+		if verr = verifySignature(hdr.Alg, k.key, data, sig); verr == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		if verr == nil {
+			verr = fmt.Errorf("%w: no key for key id %q and algorithm %q", ErrToken, hdr.Kid, hdr.Alg)
+		}
+		return "", verr
+	}
+
+	audience := conf.Audience
+	if audience == "" {
+		audience = conf.ClientID
+	}
+	if err := checkClaims(claims, conf.Issuer, audience, time.Now()); err != nil {
+		return "", err
+	}
+	if nonce != "" {
+		if n, _ := claims["nonce"].(string); n != nonce {
+			return "", fmt.Errorf("%w: nonce mismatch", ErrToken)
+		}
+	}
+	claim := conf.Claim
+	if claim == "" {
+		claim = "email"
+	}
+	return claimAddress(claims, claim)
+}
+
+func hasKey(keys []publicKey, kid string) bool {
+	for _, k := range keys {
+		if k.kid == kid {
+			return true
+		}
+	}
+	return false
+}
+
+// discover returns the provider metadata, fetching it if needed.
+//
+// Must be called with the provider lock held.
+func (p *provider) discover(ctx context.Context, log mlog.Log) (*discovery, error) {
+	if p.discovery != nil && time.Since(p.discoveryFetched) < discoveryRefreshInterval {
+		return p.discovery, nil
+	}
+
+	// ../rfc/8414 for the general form. OpenID Connect Discovery appends the path to
+	// the issuer, not inserting it before.
+	buf, err := p.get(ctx, "discovery", strings.TrimSuffix(p.conf.Issuer, "/")+"/.well-known/openid-configuration")
+	if err != nil {
+		return p.discoveryAfterError(log, err)
+	}
+	var d discovery
+	if err := json.Unmarshal(buf, &d); err != nil {
+		return p.discoveryAfterError(log, fmt.Errorf("%w: parsing openid configuration: %v", ErrBackend, err))
+	}
+	if d.Issuer != p.conf.Issuer {
+		return p.discoveryAfterError(log, fmt.Errorf("%w: openid configuration has issuer %q, expected %q", ErrBackend, d.Issuer, p.conf.Issuer))
+	}
+	p.discovery = &d
+	p.discoveryFetched = time.Now()
+	return &d, nil
+}
+
+func (p *provider) discoveryAfterError(log mlog.Log, err error) (*discovery, error) {
+	if p.discovery == nil {
+		return nil, err
+	}
+	log.Errorx("fetching openid configuration, continuing with previous configuration", err)
+	return p.discovery, nil
+}
+
+// get fetches a JSON document from the identity provider.
+func (p *provider) get(ctx context.Context, request, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: new request: %v", ErrBackend, err)
+	}
+	req.Header.Set("Accept", "application/json")
+	return do(req, request)
+}
+
+func do(req *http.Request, request string) (rbuf []byte, rerr error) {
+	req.Header.Set("User-Agent", "mox/"+moxvar.Version)
+	start := time.Now()
+	defer func() {
+		result := "ok"
+		if rerr != nil {
+			result = "error"
+		}
+		metricRequest.WithLabelValues(request, result).Observe(float64(time.Since(start)) / float64(time.Second))
+	}()
+
+	resp, err := HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s %s: %v", ErrBackend, req.Method, req.URL, err)
+	}
+	defer resp.Body.Close()
+	buf, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: reading response from %s: %v", ErrBackend, req.URL, err)
+	} else if len(buf) > maxResponseSize {
+		return nil, fmt.Errorf("%w: response from %s too large", ErrBackend, req.URL)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return buf, fmt.Errorf("%w: %s %s: http status %s", ErrBackend, req.Method, req.URL, resp.Status)
+	}
+	return buf, nil
+}
+
+// AuthURL returns the URL at the identity provider to redirect a user to for
+// logging in with the authorization code flow. The state and nonce must be
+// random, and are verified after the redirect back to redirectURI. The code
+// verifier is used for PKCE. ../rfc/6749 ../rfc/7636
+func AuthURL(ctx context.Context, log mlog.Log, conf config.OIDC, redirectURI, state, nonce, codeVerifier string) (string, error) {
+	log = log.WithPkg("oidc")
+	ctx, cancel := withTimeout(ctx, conf)
+	defer cancel()
+
+	p := providerGet(conf)
+	p.Lock()
+	d, err := p.discover(ctx, log)
+	p.Unlock()
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(d.AuthorizationEndpoint)
+	if err != nil || u.Scheme != "https" && u.Scheme != "http" {
+		return "", fmt.Errorf("%w: bad authorization endpoint %q", ErrBackend, d.AuthorizationEndpoint)
+	}
+
+	h := sha256.Sum256([]byte(codeVerifier))
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", conf.ClientID)
+	q.Set("redirect_uri", redirectURI)
+	q.Set("scope", "openid email")
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(h[:]))
+	q.Set("code_challenge_method", "S256")
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// Exchange redeems the authorization code from the redirect after a web login at
+// the identity provider, and returns the email address from the ID token. The
+// redirect URI and code verifier must be the same as for AuthURL, and the ID token
+// must have the nonce passed to AuthURL.
+func Exchange(ctx context.Context, log mlog.Log, conf config.OIDC, redirectURI, code, codeVerifier, nonce string) (address string, rerr error) {
+	log = log.WithPkg("oidc")
+	ctx, cancel := withTimeout(ctx, conf)
+	defer cancel()
+	start := time.Now()
+	defer func() {
+		log.Debugx("oidc authorization code exchange result", rerr,
+			slog.String("address", address),
+			slog.Duration("duration", time.Since(start)))
+	}()
+
+	p := providerGet(conf)
+	p.Lock()
+	d, err := p.discover(ctx, log)
+	p.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	// ../rfc/6749
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURI)
+	form.Set("code_verifier", codeVerifier)
+	if conf.ClientSecret == "" {
+		form.Set("client_id", conf.ClientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("%w: new request: %v", ErrBackend, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if conf.ClientSecret != "" {
+		// ../rfc/6749
+		req.SetBasicAuth(url.QueryEscape(conf.ClientID), url.QueryEscape(conf.ClientSecret))
+	}
+	buf, err := do(req, "token")
+	if err != nil {
+		// An invalid or reused code results in an error response with status 400.
+		// ../rfc/6749
+		var resp struct {
+			Error       string `json:"error"`
+			Description string `json:"error_description"`
+		}
+		if json.Unmarshal(buf, &resp) == nil && resp.Error == "invalid_grant" {
+			return "", fmt.Errorf("%w: authorization code rejected: %s", ErrToken, resp.Description)
+		}
+		return "", err
+	}
+	var resp struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(buf, &resp); err != nil {
+		return "", fmt.Errorf("%w: parsing token response: %v", ErrBackend, err)
+	} else if resp.IDToken == "" {
+		return "", fmt.Errorf("%w: no id_token in token response", ErrBackend)
+	}
+	return verify(ctx, log, conf, resp.IDToken, nonce)
+}
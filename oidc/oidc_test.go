@@ -0,0 +1,385 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/mlog"
+)
+
+var ctxbg = context.Background()
+var pkglog = mlog.New("oidc", nil)
+
+func tcheck(t *testing.T, err error, msg string) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: %s", msg, err)
+	}
+}
+
+func tcompare(t *testing.T, got, exp any) {
+	t.Helper()
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("got:\n%#v\nexpected:\n%#v", got, exp)
+	}
+}
+
+type testKeys struct {
+	rsa     *rsa.PrivateKey
+	ecdsa   *ecdsa.PrivateKey
+	ed25519 ed25519.PrivateKey
+}
+
+func newTestKeys(t *testing.T) testKeys {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	tcheck(t, err, "generate rsa key")
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tcheck(t, err, "generate ecdsa key")
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	tcheck(t, err, "generate ed25519 key")
+	return testKeys{rsaKey, ecKey, edKey}
+}
+
+func b64(buf []byte) string {
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func (k testKeys) jwks() []byte {
+	pad := func(v *big.Int, n int) []byte {
+		return v.FillBytes(make([]byte, n))
+	}
+	set := map[string]any{
+		"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64(k.rsa.N.Bytes()), "e": b64(big.NewInt(int64(k.rsa.E)).Bytes())},
+			{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(pad(k.ecdsa.X, 32)), "y": b64(pad(k.ecdsa.Y, 32))},
+			{"kty": "OKP", "kid": "ed", "alg": "EdDSA", "crv": "Ed25519", "x": b64(k.ed25519.Public().(ed25519.PublicKey))},
+			// Skipped, for encryption.
+			{"kty": "RSA", "kid": "enc", "use": "enc", "n": b64(k.rsa.N.Bytes()), "e": "AQAB"},
+		},
+	}
+	buf, err := json.Marshal(set)
+	if err != nil {
+		panic(err)
+	}
+	return buf
+}
+
+func (k testKeys) sign(t *testing.T, alg, kid string, claims map[string]any) string {
+	t.Helper()
+	hdr := map[string]string{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		hdr["kid"] = kid
+	}
+	hdrbuf, err := json.Marshal(hdr)
+	tcheck(t, err, "marshal header")
+	claimsbuf, err := json.Marshal(claims)
+	tcheck(t, err, "marshal claims")
+	data := b64(hdrbuf) + "." + b64(claimsbuf)
+
+	var sig []byte
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		h := sha256.Sum256([]byte(data))
+		switch alg {
+		case "RS256":
+			sig, err = rsa.SignPKCS1v15(rand.Reader, k.rsa, crypto.SHA256, h[:])
+		case "PS256":
+			sig, err = rsa.SignPSS(rand.Reader, k.rsa, crypto.SHA256, h[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		case "ES256":
+			var r, s *big.Int
+			r, s, err = ecdsa.Sign(rand.Reader, k.ecdsa, h[:])
+			if err == nil {
+				sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+			}
+		}
+		tcheck(t, err, "sign")
+	case "EdDSA":
+		sig = ed25519.Sign(k.ed25519, []byte(data))
+	case "none":
+	default:
+		t.Fatalf("unknown alg %q", alg)
+	}
+	return data + "." + b64(sig)
+}
+
+func testClaims(issuer string) map[string]any {
+	return map[string]any{
+		"iss":            issuer,
+		"aud":            []string{"mox", "other"},
+		"sub":            "1234",
+		"email":          "mjl@mox.example",
+		"email_verified": true,
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"iat":            time.Now().Unix(),
+	}
+}
+
+func TestVerify(t *testing.T) {
+	keys := newTestKeys(t)
+	jwksPath := filepath.Join(t.TempDir(), "jwks.json")
+	err := os.WriteFile(jwksPath, keys.jwks(), 0660)
+	tcheck(t, err, "write jwks")
+
+	const issuer = "https://id.mox.example"
+	conf := config.OIDC{Issuer: issuer, JWKSFile: jwksPath, Audience: "mox"}
+
+	test := func(token string, expAddr string, expErr error) {
+		t.Helper()
+		addr, err := Verify(ctxbg, pkglog, conf, token)
+		if (err == nil) != (expErr == nil) || err != nil && !errors.Is(err, expErr) {
+			t.Fatalf("got err %v, expected %v", err, expErr)
+		}
+		tcompare(t, addr, expAddr)
+	}
+
+	claims := testClaims(issuer)
+	test(keys.sign(t, "RS256", "rsa", claims), "mjl@mox.example", nil)
+	test(keys.sign(t, "PS256", "rsa", claims), "mjl@mox.example", nil)
+	test(keys.sign(t, "ES256", "ec", claims), "mjl@mox.example", nil)
+	test(keys.sign(t, "EdDSA", "ed", claims), "mjl@mox.example", nil)
+	// Without key id, all keys are tried.
+	test(keys.sign(t, "ES256", "", claims), "mjl@mox.example", nil)
+
+	// Wrong key for key id.
+	test(keys.sign(t, "ES256", "rsa", claims), "", ErrToken)
+	// Key id only for encryption.
+	test(keys.sign(t, "RS256", "enc", claims), "", ErrToken)
+	// Unknown key id.
+	test(keys.sign(t, "RS256", "unknown", claims), "", ErrToken)
+	// Unsigned.
+	test(keys.sign(t, "none", "", claims), "", ErrToken)
+	// Garbage.
+	test("", "", ErrToken)
+	test("a.b.c", "", ErrToken)
+
+	// Modified claims invalidate the signature.
+	token := keys.sign(t, "RS256", "rsa", claims)
+	claims["email"] = "other@mox.example"
+	other := keys.sign(t, "RS256", "rsa", claims)
+	tp, op := strings.Split(token, "."), strings.Split(other, ".")
+	test(tp[0]+"."+op[1]+"."+tp[2], "", ErrToken)
+
+	claimsTest := func(key string, value any, expErr error) {
+		t.Helper()
+		c := testClaims(issuer)
+		if value == nil {
+			delete(c, key)
+		} else {
+			c[key] = value
+		}
+		expAddr := "mjl@mox.example"
+		if expErr != nil {
+			expAddr = ""
+		}
+		test(keys.sign(t, "RS256", "rsa", c), expAddr, expErr)
+	}
+	claimsTest("iss", "https://other.example", ErrToken)
+	claimsTest("aud", "other", ErrToken)
+	claimsTest("aud", "mox", nil)
+	claimsTest("exp", nil, ErrToken)
+	claimsTest("exp", time.Now().Add(-2*time.Minute).Unix(), ErrToken)
+	claimsTest("exp", time.Now().Add(-30*time.Second).Unix(), nil) // Within allowed clock skew.
+	claimsTest("nbf", time.Now().Add(2*time.Minute).Unix(), ErrToken)
+	claimsTest("nbf", time.Now().Add(-time.Minute).Unix(), nil)
+	claimsTest("email_verified", false, ErrToken)
+	claimsTest("email_verified", "true", nil)
+	claimsTest("email_verified", nil, ErrToken)
+	claimsTest("email_verified", "false", ErrToken)
+	claimsTest("email", nil, ErrToken)
+
+	// Without a configured audience, no token is accepted.
+	c := map[string]any{"iss": issuer, "aud": "mox", "exp": float64(time.Now().Add(time.Hour).Unix())}
+	if err := checkClaims(c, issuer, "", time.Now()); !errors.Is(err, ErrToken) {
+		t.Fatalf("got err %v, expected ErrToken for missing audience", err)
+	}
+
+	// Custom claim, email_verified does not apply.
+	conf.Claim = "upn"
+	claims = testClaims(issuer)
+	claims["upn"] = "mjl@mox.example"
+	claims["email_verified"] = false
+	test(keys.sign(t, "RS256", "rsa", claims), "mjl@mox.example", nil)
+	conf.Claim = ""
+
+	// Keys are read again when the file changes.
+	newKeys := newTestKeys(t)
+	err = os.WriteFile(jwksPath, newKeys.jwks(), 0660)
+	tcheck(t, err, "write jwks")
+	mtime := time.Now().Add(time.Second)
+	err = os.Chtimes(jwksPath, mtime, mtime)
+	tcheck(t, err, "set mtime")
+	test(keys.sign(t, "RS256", "rsa", testClaims(issuer)), "", ErrToken)
+	test(newKeys.sign(t, "RS256", "rsa", testClaims(issuer)), "mjl@mox.example", nil)
+
+	// Missing file.
+	conf.JWKSFile = filepath.Join(t.TempDir(), "missing.json")
+	test(keys.sign(t, "RS256", "rsa", testClaims(issuer)), "", ErrBackend)
+}
+
+// Identity provider with discovery, jwks and token endpoint.
+func TestProvider(t *testing.T) {
+	keys := newTestKeys(t)
+
+	var jwksFetches int
+	var tokenClaims map[string]any
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	issuer := srv.URL
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"issuer": %q, "authorization_endpoint": %q, "token_endpoint": %q, "jwks_uri": %q}`, issuer, issuer+"/authorize?x=1", issuer+"/token", issuer+"/jwks")
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		jwksFetches++
+		w.Write(keys.jwks())
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ := r.BasicAuth()
+		if r.Method != "POST" || user != "mox" || pass != "secret" {
+			http.Error(w, `{"error": "invalid_client"}`, http.StatusUnauthorized)
+			return
+		}
+		if r.FormValue("code") != "goodcode" || r.FormValue("grant_type") != "authorization_code" || r.FormValue("redirect_uri") != "https://mail.mox.example/webmail/oidc" || r.FormValue("code_verifier") != "test" {
+			http.Error(w, `{"error": "invalid_grant", "error_description": "bad code"}`, http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, `{"access_token": "x", "token_type": "Bearer", "id_token": %q}`, keys.sign(t, "RS256", "rsa", tokenClaims))
+	})
+
+	conf := config.OIDC{Issuer: issuer, ClientID: "mox", ClientSecret: "secret"}
+
+	// Authorization URL.
+	authURL, err := AuthURL(ctxbg, pkglog, conf, "https://mail.mox.example/webmail/oidc", "state1", "nonce1", "verifier1")
+	tcheck(t, err, "auth url")
+	u, err := url.Parse(authURL)
+	tcheck(t, err, "parse auth url")
+	tcompare(t, u.Path, "/authorize")
+	q := u.Query()
+	tcompare(t, q.Get("x"), "1")
+	tcompare(t, q.Get("response_type"), "code")
+	tcompare(t, q.Get("client_id"), "mox")
+	tcompare(t, q.Get("state"), "state1")
+	tcompare(t, q.Get("nonce"), "nonce1")
+	tcompare(t, q.Get("code_challenge_method"), "S256")
+	h := sha256.Sum256([]byte("verifier1"))
+	tcompare(t, q.Get("code_challenge"), b64(h[:]))
+
+	// Token verification with keys fetched from jwks uri.
+	claims := testClaims(issuer)
+	claims["aud"] = "mox"
+	addr, err := Verify(ctxbg, pkglog, conf, keys.sign(t, "RS256", "rsa", claims))
+	tcheck(t, err, "verify")
+	tcompare(t, addr, "mjl@mox.example")
+	tcompare(t, jwksFetches, 1)
+	// Unknown key id does not cause immediate fetch again.
+	_, err = Verify(ctxbg, pkglog, conf, keys.sign(t, "RS256", "unknown", claims))
+	if !errors.Is(err, ErrToken) {
+		t.Fatalf("got err %v, expected ErrToken", err)
+	}
+	tcompare(t, jwksFetches, 1)
+
+	// Exchange of code for id token.
+	tokenClaims = testClaims(issuer)
+	tokenClaims["aud"] = "mox"
+	tokenClaims["nonce"] = "nonce1"
+	addr, err = Exchange(ctxbg, pkglog, conf, "https://mail.mox.example/webmail/oidc", "goodcode", "test", "nonce1")
+	tcheck(t, err, "exchange")
+	tcompare(t, addr, "mjl@mox.example")
+
+	_, err = Exchange(ctxbg, pkglog, conf, "https://mail.mox.example/webmail/oidc", "goodcode", "test", "othernonce")
+	if !errors.Is(err, ErrToken) {
+		t.Fatalf("got err %v, expected ErrToken for nonce mismatch", err)
+	}
+	_, err = Exchange(ctxbg, pkglog, conf, "https://mail.mox.example/webmail/oidc", "badcode", "test", "nonce1")
+	if !errors.Is(err, ErrToken) {
+		t.Fatalf("got err %v, expected ErrToken for bad code", err)
+	}
+	badConf := conf
+	badConf.ClientSecret = "bad"
+	_, err = Exchange(ctxbg, pkglog, badConf, "https://mail.mox.example/webmail/oidc", "goodcode", "test", "nonce1")
+	if !errors.Is(err, ErrBackend) {
+		t.Fatalf("got err %v, expected ErrBackend for bad client secret", err)
+	}
+
+	// Discovered issuer must match.
+	badConf = config.OIDC{Issuer: issuer + "/", ClientID: "mox"}
+	_, err = AuthURL(ctxbg, pkglog, badConf, "https://mail.mox.example/webmail/oidc", "state1", "nonce1", "verifier1")
+	if !errors.Is(err, ErrBackend) {
+		t.Fatalf("got err %v, expected ErrBackend for issuer mismatch", err)
+	}
+}
+
+func TestSASL(t *testing.T) {
+	authzid, token, err := ParseOAUTHBEARER([]byte("n,a=user@example.com,\x01host=server.example.com\x01port=143\x01auth=Bearer vF9dft4qmTc2Nvb3RlckBhbHRhdmlzdGEuY29tCg==\x01\x01"))
+	tcheck(t, err, "parse oauthbearer")
+	tcompare(t, authzid, "user@example.com")
+	tcompare(t, token, "vF9dft4qmTc2Nvb3RlckBhbHRhdmlzdGEuY29tCg==")
+
+	authzid, token, err = ParseOAUTHBEARER([]byte("n,a=a=2Cb=3Dc,\x01auth=bearer tok\x01\x01"))
+	tcheck(t, err, "parse oauthbearer")
+	tcompare(t, authzid, "a,b=c")
+	tcompare(t, token, "tok")
+
+	authzid, token, err = ParseOAUTHBEARER([]byte("n,,\x01auth=Bearer tok\x01\x01"))
+	tcheck(t, err, "parse oauthbearer")
+	tcompare(t, authzid, "")
+	tcompare(t, token, "tok")
+
+	bad := []string{
+		"",
+		"p=tls-unique,,\x01auth=Bearer tok\x01\x01",
+		"n,a=x\x01auth=Bearer tok\x01\x01",
+		"n,,\x01auth=Bearer tok\x01",
+		"n,,\x01auth=Basic tok\x01\x01",
+		"n,,\x01auth=Bearer \x01\x01",
+		"n,,\x01host=x\x01\x01",
+		"n,a=a=2,\x01auth=Bearer tok\x01\x01",
+		"n,b=x,\x01auth=Bearer tok\x01\x01",
+	}
+	for _, s := range bad {
+		_, _, err := ParseOAUTHBEARER([]byte(s))
+		if !errors.Is(err, ErrSASLSyntax) {
+			t.Fatalf("parse oauthbearer %q: got err %v, expected ErrSASLSyntax", s, err)
+		}
+	}
+
+	user, token, err := ParseXOAUTH2([]byte("user=someuser@example.com\x01auth=Bearer ya29.vF9dft4qmTc2Nvb3RlckBhdHRhdmlzdGEuY29tCg\x01\x01"))
+	tcheck(t, err, "parse xoauth2")
+	tcompare(t, user, "someuser@example.com")
+	tcompare(t, token, "ya29.vF9dft4qmTc2Nvb3RlckBhdHRhdmlzdGEuY29tCg")
+
+	_, _, err = ParseXOAUTH2([]byte("user=x\x01auth=Bearer tok"))
+	if !errors.Is(err, ErrSASLSyntax) {
+		t.Fatalf("got err %v, expected ErrSASLSyntax", err)
+	}
+
+	var m map[string]string
+	err = json.Unmarshal(ErrorOAUTHBEARER("https://id.mox.example/"), &m)
+	tcheck(t, err, "parse error")
+	tcompare(t, m["openid-configuration"], "https://id.mox.example/.well-known/openid-configuration")
+	err = json.Unmarshal(ErrorXOAUTH2(), &m)
+	tcheck(t, err, "parse error")
+	tcompare(t, m["status"], "401")
+}
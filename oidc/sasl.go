@@ -0,0 +1,136 @@
+package oidc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrSASLSyntax is returned for malformed OAUTHBEARER or XOAUTH2 client messages.
+var ErrSASLSyntax = errors.New("malformed oauth sasl message")
+
+// ParseOAUTHBEARER parses the initial client response for SASL OAUTHBEARER,
+// returning the optional authorization identity and the bearer token.
+//
+// Example: "n,a=user@example.com,\x01host=server.example.com\x01port=143\x01auth=Bearer vF9dft4qmTc2Nvb3RlckBhbHRhdmlzdGEuY29tCg==\x01\x01"
+//
+// ../rfc/7628
+func ParseOAUTHBEARER(buf []byte) (authzid, token string, rerr error) {
+	s := string(buf)
+
+	// GS2 header, with channel binding flag and optional authzid. We don't support
+	// channel binding. ../rfc/5801
+	switch {
+	case strings.HasPrefix(s, "n,"), strings.HasPrefix(s, "y,"):
+		s = s[2:]
+	case strings.HasPrefix(s, "p="):
+		return "", "", fmt.Errorf("%w: channel binding not supported", ErrSASLSyntax)
+	default:
+		return "", "", fmt.Errorf("%w: missing gs2 header", ErrSASLSyntax)
+	}
+	t := strings.SplitN(s, ",", 2)
+	if len(t) != 2 {
+		return "", "", fmt.Errorf("%w: missing end of gs2 header", ErrSASLSyntax)
+	}
+	if t[0] != "" {
+		if !strings.HasPrefix(t[0], "a=") {
+			return "", "", fmt.Errorf("%w: bad authzid in gs2 header", ErrSASLSyntax)
+		}
+		var err error
+		authzid, err = unescapeSASLName(t[0][2:])
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	kv, err := parseKVPairs(t[1])
+	if err != nil {
+		return "", "", err
+	}
+	token, err = bearerToken(kv["auth"])
+	return authzid, token, err
+}
+
+// ParseXOAUTH2 parses the client response for SASL XOAUTH2, returning the user and
+// bearer token.
+//
+// Example: "user=someuser@example.com\x01auth=Bearer ya29.vF9dft4qmTc2Nvb3RlckBhdHRhdmlzdGEuY29tCg\x01\x01"
+func ParseXOAUTH2(buf []byte) (user, token string, rerr error) {
+	kv, err := parseKVPairs(string(buf))
+	if err != nil {
+		return "", "", err
+	}
+	token, err = bearerToken(kv["auth"])
+	return kv["user"], token, err
+}
+
+// parseKVPairs parses key/value pairs, each followed by 0x01, and a final 0x01.
+func parseKVPairs(s string) (map[string]string, error) {
+	if !strings.HasSuffix(s, "\x01\x01") {
+		return nil, fmt.Errorf("%w: missing final separator", ErrSASLSyntax)
+	}
+	s = strings.TrimPrefix(s, "\x01")
+	kv := map[string]string{}
+	for _, p := range strings.Split(s[:len(s)-2], "\x01") {
+		k, v, ok := strings.Cut(p, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("%w: bad key/value pair", ErrSASLSyntax)
+		}
+		kv[strings.ToLower(k)] = v
+	}
+	return kv, nil
+}
+
+func bearerToken(auth string) (string, error) {
+	// Scheme is case-insensitive. ../rfc/6750
+	scheme, token, ok := strings.Cut(auth, " ")
+	if !ok || !strings.EqualFold(scheme, "bearer") || token == "" {
+		return "", fmt.Errorf("%w: missing bearer token", ErrSASLSyntax)
+	}
+	return token, nil
+}
+
+func unescapeSASLName(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '=' {
+			b.WriteByte(s[i])
+			continue
+		}
+		switch {
+		case strings.HasPrefix(s[i:], "=2C"):
+			b.WriteByte(',')
+		case strings.HasPrefix(s[i:], "=3D"):
+			b.WriteByte('=')
+		default:
+			return "", fmt.Errorf("%w: bad escape in authzid", ErrSASLSyntax)
+		}
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// ErrorOAUTHBEARER returns the JSON error message the server sends as challenge
+// after a failed OAUTHBEARER authentication. The client responds with a single
+// 0x01, after which the server fails the authentication. ../rfc/7628
+func ErrorOAUTHBEARER(issuer string) []byte {
+	buf, _ := json.Marshal(map[string]string{
+		"status":               "invalid_token",
+		"scope":                "openid email",
+		"openid-configuration": strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration",
+	})
+	return buf
+}
+
+// ErrorXOAUTH2 returns the JSON error message the server sends as challenge after
+// a failed XOAUTH2 authentication. The client responds with an empty message,
+// after which the server fails the authentication.
+func ErrorXOAUTH2() []byte {
+	buf, _ := json.Marshal(map[string]string{
+		"status":  "401",
+		"schemes": "bearer",
+		"scope":   "openid email",
+	})
+	return buf
+}
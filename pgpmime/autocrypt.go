@@ -0,0 +1,85 @@
+package pgpmime
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Autocrypt is the value of an Autocrypt message header, for sending an OpenPGP
+// public key along with regular messages. Recipients can store the key, and use
+// it to encrypt messages to the sender.
+//
+// https://autocrypt.org/level1.html
+type Autocrypt struct {
+	Addr          string // Email address of the sender, as in the From header.
+	PreferEncrypt bool   // Whether "prefer-encrypt=mutual" is set.
+	KeyData       []byte // OpenPGP public key in binary form.
+}
+
+// ParseAutocrypt parses the value of an Autocrypt header.
+func ParseAutocrypt(s string) (Autocrypt, error) {
+	var a Autocrypt
+	for _, attr := range strings.Split(s, ";") {
+		attr = strings.TrimSpace(attr)
+		if attr == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(attr, "=")
+		if !ok {
+			return Autocrypt{}, fmt.Errorf("missing = in attribute %q", attr)
+		}
+		k = strings.TrimSpace(k)
+		v = strings.TrimSpace(v)
+		switch k {
+		case "addr":
+			a.Addr = v
+		case "prefer-encrypt":
+			a.PreferEncrypt = v == "mutual"
+		case "keydata":
+			v = strings.Map(func(r rune) rune {
+				switch r {
+				case ' ', '\t', '\r', '\n':
+					return -1
+				}
+				return r
+			}, v)
+			buf, err := base64.StdEncoding.DecodeString(v)
+			if err != nil {
+				return Autocrypt{}, fmt.Errorf("decoding keydata: %v", err)
+			}
+			a.KeyData = buf
+		default:
+			// Unknown attributes are non-critical only when starting with an underscore,
+			// otherwise the header must be ignored.
+			if !strings.HasPrefix(k, "_") {
+				return Autocrypt{}, fmt.Errorf("unknown critical attribute %q", k)
+			}
+		}
+	}
+	if a.Addr == "" {
+		return Autocrypt{}, errors.New("missing addr")
+	}
+	if len(a.KeyData) == 0 {
+		return Autocrypt{}, errors.New("missing keydata")
+	}
+	return a, nil
+}
+
+// HeaderValue returns the value for an Autocrypt header, with the key data
+// folded over multiple lines.
+func (a Autocrypt) HeaderValue() string {
+	s := "addr=" + a.Addr + ";"
+	if a.PreferEncrypt {
+		s += " prefer-encrypt=mutual;"
+	}
+	s += " keydata="
+	data := base64.StdEncoding.EncodeToString(a.KeyData)
+	for len(data) > 0 {
+		n := min(len(data), 76)
+		s += "\r\n " + data[:n]
+		data = data[n:]
+	}
+	return s
+}
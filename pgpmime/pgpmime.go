@@ -0,0 +1,316 @@
+// Package pgpmime implements OpenPGP signing and encryption of message content
+// for MIME messages (PGP/MIME), and the Autocrypt header for exchanging keys.
+//
+// The OpenPGP operations use golang.org/x/crypto/openpgp. That package is frozen
+// and deprecated, but implements the RSA keys, signatures and encryption that are
+// still most commonly used with email, and there is no maintained OpenPGP
+// implementation in the standard library or x/crypto. The dependency is kept
+// within this package: its API only exposes Key, so the implementation can be
+// replaced without changing callers. The caller is responsible for the MIME
+// structure, e.g. multipart/signed and multipart/encrypted.
+//
+// ../rfc/3156 ../rfc/4880
+package pgpmime
+
+//lint:file-ignore SA1019 See package comment about golang.org/x/crypto/openpgp.
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	pgperrors "golang.org/x/crypto/openpgp/errors"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+var (
+	ErrUnknownKey = errors.New("signed with unknown key")
+	ErrSignature  = errors.New("bad signature")
+	ErrNoKey      = errors.New("not encrypted for key")
+)
+
+// Micalg is the value for the micalg parameter of multipart/signed messages
+// signed with Sign.
+const Micalg = "pgp-sha256"
+
+// Key is an OpenPGP key: a primary key with identities and subkeys. It holds the
+// private keys if it was generated or read from a private key.
+type Key struct {
+	entity *openpgp.Entity
+}
+
+func entityList(keys []*Key) openpgp.EntityList {
+	l := make(openpgp.EntityList, len(keys))
+	for i, k := range keys {
+		l[i] = k.entity
+	}
+	return l
+}
+
+// keyFor returns the key from keys for e, or a new key.
+func keyFor(keys []*Key, e *openpgp.Entity) *Key {
+	for _, k := range keys {
+		if k.entity == e {
+			return k
+		}
+	}
+	return &Key{e}
+}
+
+func config(now time.Time) *packet.Config {
+	return &packet.Config{
+		DefaultHash:   crypto.SHA256,
+		DefaultCipher: packet.CipherAES256,
+		Time:          func() time.Time { return now },
+	}
+}
+
+// GenerateKey generates a new OpenPGP key for name and address, with an RSA
+// primary key for signing and an RSA subkey for encryption.
+func GenerateKey(name, address string, rsaBits int, now time.Time) (*Key, error) {
+	c := config(now)
+	c.RSABits = rsaBits
+	e, err := openpgp.NewEntity(name, "", address, c)
+	if err != nil {
+		return nil, err
+	}
+	// Sign the identities and subkeys, needed before serializing the public key.
+	if err := e.SerializePrivate(io.Discard, c); err != nil {
+		return nil, fmt.Errorf("signing new key: %v", err)
+	}
+	return &Key{e}, nil
+}
+
+// ReadKeys parses one or more keys, in binary form or ASCII-armored.
+func ReadKeys(data []byte) ([]*Key, error) {
+	var el openpgp.EntityList
+	var err error
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN PGP")) {
+		el, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	} else {
+		el, err = openpgp.ReadKeyRing(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, err
+	}
+	l := make([]*Key, len(el))
+	for i, e := range el {
+		l[i] = &Key{e}
+	}
+	return l, nil
+}
+
+// ReadPrivateKey parses data, in binary form or ASCII-armored, with a single
+// private key. If the private key is protected with a passphrase, it is
+// decrypted with passphrase.
+func ReadPrivateKey(data []byte, passphrase string) (*Key, error) {
+	l, err := ReadKeys(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(l) != 1 {
+		return nil, fmt.Errorf("got %d keys, need exactly one", len(l))
+	}
+	e := l[0].entity
+	if e.PrivateKey == nil {
+		return nil, errors.New("not a private key")
+	}
+	keys := []*packet.PrivateKey{e.PrivateKey}
+	for _, sk := range e.Subkeys {
+		if sk.PrivateKey != nil {
+			keys = append(keys, sk.PrivateKey)
+		}
+	}
+	for _, k := range keys {
+		if !k.Encrypted {
+			continue
+		}
+		if passphrase == "" {
+			return nil, errors.New("private key is protected with passphrase")
+		}
+		if err := k.Decrypt([]byte(passphrase)); err != nil {
+			return nil, fmt.Errorf("decrypting private key: %v", err)
+		}
+	}
+	return l[0], nil
+}
+
+// SerializePrivate returns the unprotected private key in binary form.
+func (k *Key) SerializePrivate() ([]byte, error) {
+	var b bytes.Buffer
+	if err := k.entity.SerializePrivate(&b, nil); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// SerializePublic returns the public key in binary form.
+func (k *Key) SerializePublic() ([]byte, error) {
+	var b bytes.Buffer
+	if err := k.entity.Serialize(&b); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Armor returns the ASCII-armored form of a binary key.
+func Armor(key []byte, private bool) (string, error) {
+	blockType := openpgp.PublicKeyType
+	if private {
+		blockType = openpgp.PrivateKeyType
+	}
+	var b strings.Builder
+	w, err := armor.Encode(&b, blockType, nil)
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write(key); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// Fingerprint returns the fingerprint of the primary key, in upper case hex.
+func (k *Key) Fingerprint() string {
+	return strings.ToUpper(hex.EncodeToString(k.entity.PrimaryKey.Fingerprint[:]))
+}
+
+// Name returns the name of the primary identity, e.g. "Mox <mox@example.org>".
+// If no identity is marked as primary, the name of an arbitrary identity is
+// returned.
+func (k *Key) Name() string {
+	var name string
+	for _, id := range k.entity.Identities {
+		if name == "" || id.SelfSignature != nil && id.SelfSignature.IsPrimaryId != nil && *id.SelfSignature.IsPrimaryId {
+			name = id.Name
+		}
+	}
+	return name
+}
+
+// Addresses returns the email addresses of the identities of the key, in lower
+// case.
+func (k *Key) Addresses() []string {
+	var l []string
+	for _, id := range k.entity.Identities {
+		s := strings.ToLower(id.UserId.Email)
+		if s != "" && !slices.Contains(l, s) {
+			l = append(l, s)
+		}
+	}
+	slices.Sort(l)
+	return l
+}
+
+// Sign returns an ASCII-armored detached signature over content, for an
+// application/pgp-signature part in a multipart/signed message. Content must be
+// the exact bytes of the MIME entity (headers and body) with CRLF line endings.
+// ../rfc/3156
+func Sign(signer *Key, content []byte, now time.Time) ([]byte, error) {
+	var b bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&b, signer.entity, bytes.NewReader(content), config(now)); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Verify checks the ASCII-armored detached signature over content. If the signer
+// is not in keyring, ErrUnknownKey is returned.
+func Verify(keyring []*Key, content, signature []byte) (*Key, error) {
+	signer, err := openpgp.CheckArmoredDetachedSignature(entityList(keyring), bytes.NewReader(content), bytes.NewReader(signature))
+	if err == pgperrors.ErrUnknownIssuer {
+		return nil, ErrUnknownKey
+	} else if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSignature, err)
+	}
+	return keyFor(keyring, signer), nil
+}
+
+// Encrypt encrypts content for the recipients, and signs it with signer if
+// not nil, returning an ASCII-armored OpenPGP message for a multipart/encrypted
+// message. Senders typically include their own key in the recipients, so they
+// can read the message they sent.
+func Encrypt(recipients []*Key, signer *Key, content []byte, now time.Time) ([]byte, error) {
+	var b bytes.Buffer
+	aw, err := armor.Encode(&b, "PGP MESSAGE", nil)
+	if err != nil {
+		return nil, err
+	}
+	var signerEntity *openpgp.Entity
+	if signer != nil {
+		signerEntity = signer.entity
+	}
+	w, err := openpgp.Encrypt(aw, entityList(recipients), signerEntity, nil, config(now))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(content); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if err := aw.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Decrypted is the result of decrypting an OpenPGP message.
+type Decrypted struct {
+	Content []byte
+	Signed  bool
+
+	// If Signed, the signer, or nil if not in keyring.
+	Signer *Key
+
+	// If Signed, nil for a good signature, ErrUnknownKey if the signer isn't
+	// known, or another error.
+	SignatureError error
+}
+
+// Decrypt decrypts an ASCII-armored OpenPGP message with a private key from
+// keyring. Keyring should also contain the public keys of potential signers. If
+// none of the private keys can decrypt the message, ErrNoKey is returned.
+func Decrypt(keyring []*Key, data []byte) (Decrypted, error) {
+	b, err := armor.Decode(bytes.NewReader(data))
+	if err != nil {
+		return Decrypted{}, fmt.Errorf("decoding armor: %v", err)
+	}
+	md, err := openpgp.ReadMessage(b.Body, entityList(keyring), nil, nil)
+	if err == pgperrors.ErrKeyIncorrect {
+		return Decrypted{}, ErrNoKey
+	} else if err != nil {
+		return Decrypted{}, err
+	}
+	if !md.IsEncrypted {
+		return Decrypted{}, errors.New("message not encrypted")
+	}
+	// Reading everything also checks the signature.
+	content, err := io.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		return Decrypted{}, fmt.Errorf("reading decrypted content: %v", err)
+	}
+	d := Decrypted{Content: content, Signed: md.IsSigned}
+	if md.IsSigned {
+		if md.SignedBy == nil {
+			d.SignatureError = ErrUnknownKey
+		} else if md.SignatureError != nil {
+			d.SignatureError = fmt.Errorf("%w: %v", ErrSignature, md.SignatureError)
+		} else {
+			d.Signer = keyFor(keyring, md.SignedBy.Entity)
+		}
+	}
+	return d, nil
+}
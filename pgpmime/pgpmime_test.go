@@ -0,0 +1,142 @@
+package pgpmime
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tcheck(t *testing.T, err error, msg string) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: %s", msg, err)
+	}
+}
+
+func TestPGPMIME(t *testing.T) {
+	now := time.Now()
+
+	// Small keys to keep the test fast.
+	mjl, err := GenerateKey("mjl", "Mjl@mox.example", 1024, now)
+	tcheck(t, err, "generate key")
+	other, err := GenerateKey("other", "other@mox.example", 1024, now)
+	tcheck(t, err, "generate key")
+	third, err := GenerateKey("", "third@mox.example", 1024, now)
+	tcheck(t, err, "generate key")
+
+	if l := mjl.Addresses(); len(l) != 1 || l[0] != "mjl@mox.example" {
+		t.Fatalf("addresses, got %v", l)
+	}
+	if name := mjl.Name(); name != "mjl <Mjl@mox.example>" {
+		t.Fatalf("name, got %q", name)
+	}
+	if fp := mjl.Fingerprint(); len(fp) != 40 || strings.ToUpper(fp) != fp {
+		t.Fatalf("fingerprint, got %q", fp)
+	}
+
+	// Roundtrip private and public key, armored and binary.
+	priv, err := mjl.SerializePrivate()
+	tcheck(t, err, "serialize private key")
+	armored, err := Armor(priv, true)
+	tcheck(t, err, "armor")
+	for _, data := range [][]byte{priv, []byte(armored)} {
+		e, err := ReadPrivateKey(data, "")
+		tcheck(t, err, "read private key")
+		if e.Fingerprint() != mjl.Fingerprint() {
+			t.Fatalf("read private key, different fingerprint")
+		}
+	}
+	pub, err := mjl.SerializePublic()
+	tcheck(t, err, "serialize public key")
+	if _, err := ReadPrivateKey(pub, ""); err == nil {
+		t.Fatalf("read private key from public key succeeded")
+	}
+	l, err := ReadKeys(pub)
+	tcheck(t, err, "read public key")
+	mjlPub := l[0]
+
+	content := []byte("Content-Type: text/plain\r\n\r\nhi\r\n")
+
+	// Detached signature.
+	sig, err := Sign(mjl, content, now)
+	tcheck(t, err, "sign")
+	signer, err := Verify([]*Key{mjlPub}, content, sig)
+	tcheck(t, err, "verify")
+	if signer.Fingerprint() != mjl.Fingerprint() {
+		t.Fatalf("verify, wrong signer")
+	}
+	if _, err := Verify([]*Key{other}, content, sig); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("verify with unknown key, got err %v, expected ErrUnknownKey", err)
+	}
+	if _, err := Verify([]*Key{mjlPub}, append(bytes.Clone(content), 'x'), sig); !errors.Is(err, ErrSignature) {
+		t.Fatalf("verify modified content, got err %v, expected ErrSignature", err)
+	}
+
+	// Encrypt and sign, decrypt by each recipient.
+	encrypted, err := Encrypt([]*Key{mjl, other}, mjl, content, now)
+	tcheck(t, err, "encrypt")
+	d, err := Decrypt([]*Key{other, mjlPub}, encrypted)
+	tcheck(t, err, "decrypt")
+	if !bytes.Equal(d.Content, content) || !d.Signed || d.SignatureError != nil || d.Signer.Fingerprint() != mjl.Fingerprint() {
+		t.Fatalf("decrypt, unexpected result %#v", d)
+	}
+	d, err = Decrypt([]*Key{mjl}, encrypted)
+	tcheck(t, err, "decrypt")
+	if !bytes.Equal(d.Content, content) {
+		t.Fatalf("decrypted content differs")
+	}
+	// Signer unknown.
+	d, err = Decrypt([]*Key{other}, encrypted)
+	tcheck(t, err, "decrypt")
+	if !d.Signed || !errors.Is(d.SignatureError, ErrUnknownKey) {
+		t.Fatalf("decrypt with unknown signer, got %#v", d)
+	}
+	if _, err := Decrypt([]*Key{third}, encrypted); !errors.Is(err, ErrNoKey) {
+		t.Fatalf("decrypt without key, got err %v, expected ErrNoKey", err)
+	}
+
+	// Encrypt without signing.
+	encrypted, err = Encrypt([]*Key{third}, nil, content, now)
+	tcheck(t, err, "encrypt")
+	d, err = Decrypt([]*Key{third}, encrypted)
+	tcheck(t, err, "decrypt")
+	if d.Signed {
+		t.Fatalf("unsigned message decrypted as signed")
+	}
+}
+
+func TestAutocrypt(t *testing.T) {
+	a := Autocrypt{"mjl@mox.example", true, bytes.Repeat([]byte("x"), 100)}
+	s := a.HeaderValue()
+	for _, line := range strings.Split(s, "\r\n") {
+		if len(line) > 78 {
+			t.Fatalf("line too long: %q", line)
+		}
+	}
+	pa, err := ParseAutocrypt(s)
+	tcheck(t, err, "parse")
+	if pa.Addr != a.Addr || !pa.PreferEncrypt || !bytes.Equal(pa.KeyData, a.KeyData) {
+		t.Fatalf("parse, got %#v, expected %#v", pa, a)
+	}
+
+	pa, err = ParseAutocrypt("addr=mjl@mox.example; _ignored=x; keydata=eHh4")
+	tcheck(t, err, "parse")
+	if pa.PreferEncrypt || string(pa.KeyData) != "xxx" {
+		t.Fatalf("parse, got %#v", pa)
+	}
+
+	bad := []string{
+		"keydata=eHh4",
+		"addr=mjl@mox.example",
+		"addr=mjl@mox.example; keydata=!!",
+		"addr=mjl@mox.example; critical=x; keydata=eHh4",
+		"addr",
+	}
+	for _, s := range bad {
+		if _, err := ParseAutocrypt(s); err == nil {
+			t.Fatalf("parse %q succeeded", s)
+		}
+	}
+}
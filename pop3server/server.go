@@ -0,0 +1,1408 @@
+// Package pop3server implements a POP3 server (RFC 1939), for retrieving
+// messages from the Inbox of an account by email applications and devices that
+// don't support IMAP.
+package pop3server
+
+/*
+Implementation notes
+
+- The maildrop is the Inbox of the account. The messages are fixed when a
+  session enters the transaction state, messages delivered later are not visible
+  in the session.
+- We don't lock the maildrop. IMAP sessions and the webmail can make changes to
+  the Inbox while a POP3 session is active. Messages expunged by other sessions
+  cannot be retrieved anymore, an error is returned instead.
+- Unique IDs (UIDL) are formed from the UIDVALIDITY of the Inbox and the UID of
+  the message, so they are stable and also valid for IMAP clients.
+- Messages marked as deleted with DELE are expunged when the session ends with
+  QUIT, and the removal is broadcast to IMAP sessions.
+- Authentication is with USER/PASS or AUTH (RFC 5034) with the SASL mechanisms
+  PLAIN and SCRAM-*, like for IMAP. APOP is not supported, it requires
+  plain text passwords stored on the server.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"os"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/maps"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/metrics"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/moxio"
+	"github.com/mjl-/mox/moxvar"
+	"github.com/mjl-/mox/ratelimit"
+	"github.com/mjl-/mox/scram"
+	"github.com/mjl-/mox/smtp"
+	"github.com/mjl-/mox/store"
+)
+
+var (
+	metricConnection = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mox_pop3_connection_total",
+			Help: "Incoming POP3 connections.",
+		},
+		[]string{
+			"service", // pop3, pop3s
+		},
+	)
+	metricCommands = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "mox_pop3_command_duration_seconds",
+			Help:    "POP3 command duration and result codes in seconds.",
+			Buckets: []float64{0.001, 0.005, 0.01, 0.05, 0.100, 0.5, 1, 5, 10, 20},
+		},
+		[]string{
+			"cmd",
+			"result", // ok, panic, ioerror, badsyntax, servererror, usererror, error
+		},
+	)
+)
+
+var limiterConnectionrate, limiterConnections *ratelimit.Limiter
+
+func init() {
+	// Also called by tests, so they don't trigger the rate limiter.
+	limitersInit()
+}
+
+func limitersInit() {
+	mox.LimitersInit()
+	limiterConnectionrate = &ratelimit.Limiter{
+		WindowLimits: []ratelimit.WindowLimit{
+			{
+				Window: time.Minute,
+				Limits: [...]int64{300, 900, 2700},
+			},
+		},
+	}
+	limiterConnections = &ratelimit.Limiter{
+		WindowLimits: []ratelimit.WindowLimit{
+			{
+				Window: time.Duration(math.MaxInt64), // All of time.
+				Limits: [...]int64{30, 90, 270},
+			},
+		},
+	}
+}
+
+// Delay after bad/suspicious behaviour. Tests set these to zero.
+var badClientDelay = time.Second // Before reads and after 1-byte writes for probably spammers.
+var authFailDelay = time.Second  // After authentication failure.
+
+// Maximum length of a command line. Commands and their parameters are limited
+// to 255 octets, but SASL responses can be longer. ../rfc/2449 ../rfc/5034
+const maxLine = 8 * 1024
+
+type conn struct {
+	cid               int64
+	state             state
+	conn              net.Conn
+	tls               bool               // Whether TLS has been initialized.
+	br                *bufio.Reader      // From remote, with TLS unwrapped in case of TLS.
+	bw                *bufio.Writer      // To remote, with TLS added in case of TLS.
+	tr                *moxio.TraceReader // Kept to change trace level when reading/writing cmd/auth/data.
+	tw                *moxio.TraceWriter
+	slow              bool        // If set, reads are done with a 1 second sleep, and writes are done 1 byte at a time, to keep spammers busy.
+	lastlog           time.Time   // For printing time since previous log line.
+	tlsConfig         *tls.Config // TLS config to use for handshake.
+	remoteIP          net.IP
+	noRequireSTARTTLS bool
+	cmd               string // Currently executing, for logging.
+	cmdMetric         string // Currently executing, for metrics.
+	cmdStart          time.Time
+	ncmds             int // Number of commands processed. Used to abort connection when first incoming command is unknown/invalid.
+	log               mlog.Log
+
+	authFailed int    // Number of failed auth attempts. For slowing down remote with many failures.
+	user       string // From USER command, for use by PASS.
+
+	// Only when authenticated.
+	username    string // Full username as used during login.
+	account     *store.Account
+	mailboxID   int64  // Of Inbox, the maildrop.
+	uidValidity uint32 // Of Inbox, used in unique ids.
+	messages    []message
+}
+
+// Message in the maildrop. Message numbers are the index in conn.messages + 1.
+type message struct {
+	id      int64
+	uid     store.UID
+	size    int64
+	deleted bool
+}
+
+type state byte
+
+const (
+	stateAuthorization state = iota
+	stateTransaction
+)
+
+func stateCommands(cmds ...string) map[string]struct{} {
+	r := map[string]struct{}{}
+	for _, cmd := range cmds {
+		r[cmd] = struct{}{}
+	}
+	return r
+}
+
+var (
+	commandsStateAny           = stateCommands("capa", "quit")
+	commandsStateAuthorization = stateCommands("stls", "user", "pass", "auth")
+	commandsStateTransaction   = stateCommands("stat", "list", "retr", "dele", "noop", "rset", "top", "uidl")
+)
+
+var commands = map[string]func(c *conn, cmd string, params string){
+	// Any state.
+	"capa": (*conn).cmdCapa,
+	"quit": (*conn).cmdQuit,
+
+	// Authorization.
+	"stls": (*conn).cmdStls,
+	"user": (*conn).cmdUser,
+	"pass": (*conn).cmdPass,
+	"auth": (*conn).cmdAuth,
+
+	// Transaction.
+	"stat": (*conn).cmdStat,
+	"list": (*conn).cmdList,
+	"retr": (*conn).cmdRetr,
+	"dele": (*conn).cmdDele,
+	"noop": (*conn).cmdNoop,
+	"rset": (*conn).cmdRset,
+	"top":  (*conn).cmdTop,
+	"uidl": (*conn).cmdUidl,
+}
+
+var errIO = errors.New("io error")             // For read/write errors and errors that should close the connection.
+var errProtocol = errors.New("protocol error") // For protocol errors for which a stack trace should be printed.
+
+// Listen initializes all pop3 listeners for the configuration, and stores them for
+// Serve to start them.
+func Listen() {
+	names := maps.Keys(mox.Conf.Static.Listeners)
+	sort.Strings(names)
+	for _, name := range names {
+		listener := mox.Conf.Static.Listeners[name]
+
+		var tlsConfig *tls.Config
+		if listener.TLS != nil {
+			tlsConfig = listener.TLS.Config
+		}
+
+		if listener.POP3.Enabled {
+			port := config.Port(listener.POP3.Port, 110)
+			for _, ip := range listener.IPs {
+				listen1("pop3", name, ip, port, tlsConfig, false, listener.POP3.NoRequireSTARTTLS)
+			}
+		}
+
+		if listener.POP3S.Enabled {
+			port := config.Port(listener.POP3S.Port, 995)
+			for _, ip := range listener.IPs {
+				listen1("pop3s", name, ip, port, tlsConfig, true, false)
+			}
+		}
+	}
+}
+
+var servers []func()
+
+func listen1(protocol, listenerName, ip string, port int, tlsConfig *tls.Config, xtls, noRequireSTARTTLS bool) {
+	log := mlog.New("pop3server", nil)
+	addr := net.JoinHostPort(ip, fmt.Sprintf("%d", port))
+	if os.Getuid() == 0 {
+		log.Print("listening for pop3",
+			slog.String("listener", listenerName),
+			slog.String("addr", addr),
+			slog.String("protocol", protocol))
+	}
+	network := mox.Network(ip)
+	ln, err := mox.Listen(network, addr)
+	if err != nil {
+		log.Fatalx("pop3: listen for pop3", err, slog.String("protocol", protocol), slog.String("listener", listenerName))
+	}
+	if xtls {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+
+	serve := func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				log.Infox("pop3: accept", err, slog.String("protocol", protocol), slog.String("listener", listenerName))
+				continue
+			}
+
+			metricConnection.WithLabelValues(protocol).Inc()
+			go serve(listenerName, mox.Cid(), tlsConfig, conn, xtls, noRequireSTARTTLS)
+		}
+	}
+
+	servers = append(servers, serve)
+}
+
+// Serve starts serving on all listeners, launching a goroutine per listener.
+func Serve() {
+	for _, serve := range servers {
+		go serve()
+	}
+	servers = nil
+}
+
+func (c *conn) setSlow(on bool) {
+	if on && !c.slow {
+		c.log.Debug("connection changed to slow")
+	} else if !on && c.slow {
+		c.log.Debug("connection restored to regular pace")
+	}
+	c.slow = on
+}
+
+// Write makes a connection an io.Writer. It panics for i/o errors. These errors
+// are handled in the connection command loop.
+func (c *conn) Write(buf []byte) (int, error) {
+	chunk := len(buf)
+	if c.slow {
+		chunk = 1
+	}
+
+	var n int
+	for len(buf) > 0 {
+		err := c.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+		c.log.Check(err, "setting write deadline")
+
+		nn, err := c.conn.Write(buf[:chunk])
+		if err != nil {
+			panic(fmt.Errorf("write: %s (%w)", err, errIO))
+		}
+		n += nn
+		buf = buf[chunk:]
+		if len(buf) > 0 && badClientDelay > 0 {
+			mox.Sleep(mox.Context, badClientDelay)
+		}
+	}
+	return n, nil
+}
+
+func (c *conn) xtrace(level slog.Level) func() {
+	c.xflush()
+	c.tr.SetTrace(level)
+	c.tw.SetTrace(level)
+	return func() {
+		c.xflush()
+		c.tr.SetTrace(mlog.LevelTrace)
+		c.tw.SetTrace(mlog.LevelTrace)
+	}
+}
+
+func (c *conn) bwritelinef(format string, args ...any) {
+	format += "\r\n"
+	fmt.Fprintf(c.bw, format, args...)
+}
+
+func (c *conn) writelinef(format string, args ...any) {
+	c.bwritelinef(format, args...)
+	c.xflush()
+}
+
+func (c *conn) xflush() {
+	err := c.bw.Flush()
+	xcheckf(err, "flush") // Should never happen, the Write caused by the Flush should panic on i/o error.
+}
+
+// ok writes a positive response, with an optional human-readable message.
+func (c *conn) ok(msg string) {
+	if msg == "" {
+		c.writelinef("+OK")
+	} else {
+		c.writelinef("+OK %s", msg)
+	}
+}
+
+// xreadLine reads a line, for a command or a SASL response, without the
+// trailing (cr)lf. Lines that are too long result in a syntax error, after the
+// line has been read completely.
+func (c *conn) xreadLine() string {
+	if c.slow && badClientDelay > 0 {
+		mox.Sleep(mox.Context, badClientDelay)
+	}
+
+	var buf []byte
+	var toolong bool
+	for {
+		line, err := c.br.ReadSlice('\n')
+		if err == nil || err == bufio.ErrBufferFull {
+			if len(buf)+len(line) > maxLine {
+				toolong = true
+			} else {
+				buf = append(buf, line...)
+			}
+		}
+		if err == nil {
+			break
+		} else if err != bufio.ErrBufferFull {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				err := c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+				c.log.Check(err, "setting write deadline")
+				c.writelinef("-ERR inactive")
+			}
+			panic(fmt.Errorf("reading line: %s (%w)", err, errIO))
+		}
+	}
+	if toolong {
+		xsyntaxErrorf("line too long")
+	}
+	buf = bytes.TrimSuffix(buf, []byte{'\n'})
+	buf = bytes.TrimSuffix(buf, []byte{'\r'})
+	return string(buf)
+}
+
+var cleanClose struct{} // Sentinel value for panic/recover indicating clean close of connection.
+
+func serve(listenerName string, cid int64, tlsConfig *tls.Config, nc net.Conn, xtls, noRequireSTARTTLS bool) {
+	var remoteIP net.IP
+	if a, ok := nc.RemoteAddr().(*net.TCPAddr); ok {
+		remoteIP = a.IP
+	} else {
+		// For net.Pipe, during tests.
+		remoteIP = net.ParseIP("127.0.0.10")
+	}
+
+	c := &conn{
+		cid:               cid,
+		conn:              nc,
+		tls:               xtls,
+		lastlog:           time.Now(),
+		tlsConfig:         tlsConfig,
+		remoteIP:          remoteIP,
+		noRequireSTARTTLS: noRequireSTARTTLS,
+		cmd:               "(greeting)",
+		cmdStart:          time.Now(),
+	}
+	var logmutex sync.Mutex
+	c.log = mlog.New("pop3server", nil).WithFunc(func() []slog.Attr {
+		logmutex.Lock()
+		defer logmutex.Unlock()
+		now := time.Now()
+		l := []slog.Attr{
+			slog.Int64("cid", c.cid),
+			slog.Duration("delta", now.Sub(c.lastlog)),
+		}
+		c.lastlog = now
+		if c.username != "" {
+			l = append(l, slog.String("username", c.username))
+		}
+		return l
+	})
+	c.tr = moxio.NewTraceReader(c.log, "C: ", c.conn)
+	c.tw = moxio.NewTraceWriter(c.log, "S: ", c)
+	c.br = bufio.NewReader(c.tr)
+	c.bw = bufio.NewWriter(c.tw)
+
+	c.log.Info("new connection",
+		slog.Any("remote", c.conn.RemoteAddr()),
+		slog.Any("local", c.conn.LocalAddr()),
+		slog.Bool("tls", xtls),
+		slog.String("listener", listenerName))
+
+	defer func() {
+		c.conn.Close()
+
+		if c.account != nil {
+			err := c.account.Close()
+			c.log.Check(err, "close account")
+			c.account = nil
+		}
+
+		x := recover()
+		if x == nil || x == cleanClose {
+			c.log.Info("connection closed")
+		} else if err, ok := x.(error); ok && isClosed(err) {
+			c.log.Infox("connection closed", err)
+		} else {
+			c.log.Error("unhandled panic", slog.Any("err", x))
+			debug.PrintStack()
+			metrics.PanicInc(metrics.Pop3server)
+		}
+	}()
+
+	select {
+	case <-mox.Shutdown.Done():
+		c.writelinef("-ERR [SYS/TEMP] mox shutting down")
+		return
+	default:
+	}
+
+	if !limiterConnectionrate.Add(c.remoteIP, time.Now(), 1) {
+		c.writelinef("-ERR [SYS/TEMP] connection rate from your ip or network too high, slow down please")
+		return
+	}
+
+	// If remote IP/network resulted in too many authentication failures, refuse to serve.
+	if !mox.LimiterFailedAuth.CanAdd(c.remoteIP, time.Now(), 1) {
+		metrics.AuthenticationRatelimitedInc("pop3")
+		c.log.Debug("refusing connection due to many auth failures", slog.Any("remoteip", c.remoteIP))
+		c.writelinef("-ERR [SYS/TEMP] too many auth failures")
+		return
+	}
+
+	if !limiterConnections.Add(c.remoteIP, time.Now(), 1) {
+		c.log.Debug("refusing connection due to many open connections", slog.Any("remoteip", c.remoteIP))
+		c.writelinef("-ERR [SYS/TEMP] too many open connections from your ip or network")
+		return
+	}
+	defer limiterConnections.Add(c.remoteIP, time.Now(), -1)
+
+	// We register and unregister the original connection, in case it c.conn is
+	// replaced with a TLS connection later on.
+	mox.Connections.Register(nc, "pop3", listenerName)
+	defer mox.Connections.Unregister(nc)
+
+	// We don't include a timestamp in the greeting, we don't support APOP. ../rfc/1939
+	c.ok("mox pop3 ready")
+
+	for {
+		c.command()
+		c.xflush() // For flushing errors, or possibly commands that did not flush explicitly.
+	}
+}
+
+// isClosed returns whether i/o failed, typically because the connection is closed.
+// For connection errors, we often want to generate fewer logs.
+func isClosed(err error) bool {
+	return errors.Is(err, errIO) || errors.Is(err, errProtocol) || moxio.IsClosed(err)
+}
+
+func (c *conn) command() {
+	var cmd string
+
+	defer func() {
+		var result string
+		defer func() {
+			metricCommands.WithLabelValues(c.cmdMetric, result).Observe(float64(time.Since(c.cmdStart)) / float64(time.Second))
+		}()
+
+		logFields := []slog.Attr{
+			slog.String("cmd", c.cmd),
+			slog.Duration("duration", time.Since(c.cmdStart)),
+		}
+		c.cmd = ""
+
+		x := recover()
+		if x == nil || x == cleanClose {
+			c.log.Debug("pop3 command done", logFields...)
+			result = "ok"
+			if x == cleanClose {
+				panic(x)
+			}
+			return
+		}
+		err, ok := x.(error)
+		if !ok {
+			c.log.Error("pop3 command panic", append([]slog.Attr{slog.Any("panic", x)}, logFields...)...)
+			result = "panic"
+			panic(x)
+		}
+
+		var sxerr syntaxError
+		var uerr userError
+		var serr serverError
+		if isClosed(err) {
+			c.log.Infox("pop3 command ioerror", err, logFields...)
+			result = "ioerror"
+			if errors.Is(err, errProtocol) {
+				debug.PrintStack()
+			}
+			panic(err)
+		} else if errors.As(err, &sxerr) {
+			result = "badsyntax"
+			if c.ncmds == 0 {
+				// Other side is likely speaking something else than POP3, send error message and
+				// stop processing.
+				c.writelinef("-ERR please try again speaking pop3")
+				panic(errIO)
+			}
+			c.log.Debugx("pop3 command syntax error", sxerr.err, logFields...)
+			c.writelinef("-ERR %s: %s", cmd, sxerr.err)
+		} else if errors.As(err, &serr) {
+			result = "servererror"
+			c.log.Errorx("pop3 command server error", err, logFields...)
+			debug.PrintStack()
+			c.writelinef("-ERR [SYS/TEMP] %s: %s", cmd, err) // ../rfc/3206
+		} else if errors.As(err, &uerr) {
+			result = "usererror"
+			c.log.Debugx("pop3 command user error", err, logFields...)
+			if uerr.code != "" {
+				c.writelinef("-ERR [%s] %s", uerr.code, err)
+			} else {
+				c.writelinef("-ERR %s", err)
+			}
+		} else {
+			// Other type of panic, we pass it on, aborting the connection.
+			result = "panic"
+			c.log.Errorx("pop3 command panic", err, logFields...)
+			panic(err)
+		}
+	}()
+
+	// Read the command. Unauthenticated connections must be quick. Authenticated
+	// sessions must be kept for at least 10 minutes of inactivity. ../rfc/1939
+	d := 10 * time.Minute
+	if c.state == stateAuthorization {
+		d = 30 * time.Second
+	}
+	err := c.conn.SetReadDeadline(time.Now().Add(d))
+	c.log.Check(err, "setting read deadline")
+
+	c.cmd = ""
+	c.cmdMetric = "(unrecognized)"
+
+	// Passwords can be in the USER/PASS and AUTH commands, so we read the
+	// command name first, and the remainder of the line with a different trace
+	// level if needed.
+	var buf []byte
+	for {
+		b, err := c.br.ReadByte()
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				err := c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+				c.log.Check(err, "setting write deadline")
+				c.writelinef("-ERR inactive")
+			}
+			panic(fmt.Errorf("reading command: %s (%w)", err, errIO))
+		}
+		if b == ' ' || b == '\r' || b == '\n' {
+			if err := c.br.UnreadByte(); err != nil {
+				panic(fmt.Errorf("unread: %s (%w)", err, errIO))
+			}
+			break
+		}
+		buf = append(buf, b)
+		if len(buf) > 4 {
+			// All commands are 3 or 4 characters. ../rfc/1939
+			c.xreadLine()
+			xsyntaxErrorf("unknown command")
+		}
+	}
+	cmd = string(buf)
+	cmdlow := strings.ToLower(cmd)
+	c.cmd = cmdlow
+	c.cmdStart = time.Now()
+
+	var line string
+	if cmdlow == "pass" || cmdlow == "auth" {
+		c.tr.SetTrace(mlog.LevelTraceauth)
+		line = c.xreadLine()
+		c.tr.SetTrace(mlog.LevelTrace)
+	} else {
+		line = c.xreadLine()
+	}
+	var params string
+	if line != "" {
+		if !strings.HasPrefix(line, " ") {
+			xsyntaxErrorf("expected space after command")
+		}
+		params = line[1:]
+	}
+
+	select {
+	case <-mox.Shutdown.Done():
+		c.writelinef("-ERR [SYS/TEMP] shutting down")
+		panic(errIO)
+	default:
+	}
+
+	fn := commands[cmdlow]
+	if fn == nil {
+		xsyntaxErrorf("unknown command %q", cmd)
+	}
+	c.cmdMetric = c.cmd
+	c.ncmds++
+
+	// Check if command is allowed in this state.
+	if _, ok1 := commandsStateAny[cmdlow]; ok1 {
+	} else if _, ok2 := commandsStateAuthorization[cmdlow]; ok2 && c.state == stateAuthorization {
+	} else if _, ok3 := commandsStateTransaction[cmdlow]; ok3 && c.state == stateTransaction {
+	} else {
+		xuserErrorf("not allowed in this connection state")
+	}
+
+	fn(c, cmd, params)
+}
+
+// xparams splits the space-separated params and checks their number is between
+// min and max.
+func xparams(params string, min, max int) []string {
+	var l []string
+	if params != "" {
+		l = strings.Split(params, " ")
+	}
+	if len(l) < min || len(l) > max {
+		if min == max {
+			xsyntaxErrorf("expected %d parameters, got %d", min, len(l))
+		}
+		xsyntaxErrorf("expected %d to %d parameters, got %d", min, max, len(l))
+	}
+	return l
+}
+
+// xmessage returns the message for a message number parameter. Messages marked
+// as deleted cannot be referenced. ../rfc/1939
+func (c *conn) xmessage(s string) (int, *message) {
+	num, err := strconv.ParseInt(s, 10, 32)
+	if err != nil || num <= 0 {
+		xsyntaxErrorf("invalid message number %q", s)
+	}
+	if num > int64(len(c.messages)) {
+		xuserErrorf("no such message")
+	}
+	m := &c.messages[num-1]
+	if m.deleted {
+		xuserErrorf("message %d already deleted", num)
+	}
+	return int(num), m
+}
+
+func (c *conn) xdbwrite(fn func(tx *bstore.Tx)) {
+	err := c.account.DB.Write(context.TODO(), func(tx *bstore.Tx) error {
+		fn(tx)
+		return nil
+	})
+	xcheckf(err, "transaction")
+}
+
+func (c *conn) xdbread(fn func(tx *bstore.Tx)) {
+	err := c.account.DB.Read(context.TODO(), func(tx *bstore.Tx) error {
+		fn(tx)
+		return nil
+	})
+	xcheckf(err, "transaction")
+}
+
+// authMechanisms returns the SASL mechanisms available on the connection.
+func (c *conn) authMechanisms() []string {
+	var mechs []string
+	if store.PasswordHashMechanisms() {
+		mechs = []string{"SCRAM-SHA-256-PLUS", "SCRAM-SHA-256", "SCRAM-SHA-1-PLUS", "SCRAM-SHA-1"}
+	}
+	if c.tls || c.noRequireSTARTTLS {
+		mechs = append(mechs, "PLAIN")
+	}
+	return mechs
+}
+
+// Capa returns the capabilities for the current state of the connection.
+//
+// State: any
+func (c *conn) cmdCapa(cmd string, params string) {
+	// Command: ../rfc/2449
+	xparams(params, 0, 0)
+
+	c.bwritelinef("+OK capability list follows")
+	c.bwritelinef("TOP")
+	c.bwritelinef("UIDL")
+	c.bwritelinef("RESP-CODES")
+	c.bwritelinef("AUTH-RESP-CODE") // ../rfc/3206
+	c.bwritelinef("PIPELINING")
+	if c.state == stateAuthorization {
+		if c.tls || c.noRequireSTARTTLS {
+			c.bwritelinef("USER")
+		}
+		c.bwritelinef("SASL %s", strings.Join(c.authMechanisms(), " "))
+		if !c.tls && c.tlsConfig != nil {
+			c.bwritelinef("STLS") // ../rfc/2595
+		}
+	}
+	c.bwritelinef("IMPLEMENTATION mox %s", moxvar.Version)
+	c.writelinef(".")
+}
+
+// Quit ends the session. In the transaction state, messages marked as deleted
+// are removed first.
+//
+// State: any
+func (c *conn) cmdQuit(cmd string, params string) {
+	// Command: ../rfc/1939
+	xparams(params, 0, 0)
+
+	if c.state == stateTransaction {
+		// Update state. ../rfc/1939
+		n := c.xexpunge()
+		c.ok(fmt.Sprintf("bye, %d messages removed", n))
+	} else {
+		c.ok("bye")
+	}
+	panic(cleanClose)
+}
+
+// Stls enables TLS on the connection, after a plain text start.
+//
+// State: Authorization
+func (c *conn) cmdStls(cmd string, params string) {
+	// Command: ../rfc/2595
+	xparams(params, 0, 0)
+
+	if c.tls {
+		xuserErrorf("tls already active")
+	}
+	if c.tlsConfig == nil {
+		xuserErrorf("starttls not available")
+	}
+
+	// TLS is done on the underlying connection, but bytes already read into the
+	// buffered reader must be used for the TLS handshake.
+	conn := c.conn
+	if n := c.br.Buffered(); n > 0 {
+		conn = &moxio.PrefixConn{
+			PrefixReader: io.LimitReader(c.br, int64(n)),
+			Conn:         conn,
+		}
+	}
+	// We add the cid to facilitate debugging in case of TLS connection failure.
+	c.ok("begin tls negotiation now (" + mox.ReceivedID(c.cid) + ")")
+
+	cidctx := context.WithValue(mox.Context, mlog.CidKey, c.cid)
+	ctx, cancel := context.WithTimeout(cidctx, time.Minute)
+	defer cancel()
+	tlsConn := tls.Server(conn, c.tlsConfig)
+	c.log.Debug("starting tls server handshake")
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		panic(fmt.Errorf("starttls handshake: %s (%w)", err, errIO))
+	}
+	cancel()
+	tlsversion, ciphersuite := moxio.TLSInfo(tlsConn)
+	c.log.Debug("tls server handshake done", slog.String("tls", tlsversion), slog.String("ciphersuite", ciphersuite))
+
+	c.conn = tlsConn
+	c.tr = moxio.NewTraceReader(c.log, "C: ", c.conn)
+	c.tw = moxio.NewTraceWriter(c.log, "S: ", c)
+	c.br = bufio.NewReader(c.tr)
+	c.bw = bufio.NewWriter(c.tw)
+	c.tls = true
+}
+
+// User sets the username for the subsequent PASS command.
+//
+// State: Authorization
+func (c *conn) cmdUser(cmd string, params string) {
+	// Command: ../rfc/1939
+	if params == "" {
+		xsyntaxErrorf("missing username")
+	}
+	if !c.noRequireSTARTTLS && !c.tls {
+		xusercodeErrorf("AUTH", "tls required for login") // ../rfc/2595
+	}
+	c.user = params
+	c.ok("send password")
+}
+
+// Pass authenticates with the username from the USER command and the password.
+// Passwords can contain spaces.
+//
+// State: Authorization
+func (c *conn) cmdPass(cmd string, params string) {
+	// Command: ../rfc/1939
+	if c.user == "" {
+		xuserErrorf("send user first")
+	}
+	username := c.user
+	c.user = ""
+
+	c.authenticate("userpass", func() *store.Account {
+		acc, err := store.OpenEmailAuth(c.log, username, params, "")
+		if err != nil {
+			c.xauthError(err, username)
+		}
+		c.username = username
+		return acc
+	})
+	c.ok(fmt.Sprintf("logged in, %d messages", len(c.messages)))
+}
+
+// xauthError responds with an error for a failed password authentication.
+func (c *conn) xauthError(err error, username string) {
+	if errors.Is(err, store.ErrUnknownCredentials) {
+		c.log.Info("authentication failed", slog.String("username", username))
+		xusercodeErrorf("AUTH", "bad credentials")
+	}
+	xusercodeErrorf("SYS/TEMP", "error")
+}
+
+// authenticate calls fn to verify credentials and open the account, and
+// takes care of rate limiting, metrics and entering the transaction state.
+func (c *conn) authenticate(authVariant string, fn func() *store.Account) {
+	// For many failed auth attempts, slow down verification attempts.
+	if c.authFailed > 3 && authFailDelay > 0 {
+		mox.Sleep(mox.Context, time.Duration(c.authFailed-3)*authFailDelay)
+	}
+
+	c.authFailed++ // Compensated on success.
+	defer func() {
+		// On the 3rd failed authentication, start responding slowly. Successful auth will
+		// cause fast responses again.
+		if c.authFailed >= 3 {
+			c.setSlow(true)
+		}
+	}()
+
+	authResult := "error"
+	defer func() {
+		metrics.AuthenticationInc("pop3", authVariant, authResult)
+		if authResult == "ok" {
+			mox.LimiterFailedAuth.Reset(c.remoteIP, time.Now())
+		} else if authResult != "aborted" {
+			mox.LimiterFailedAuth.Add(c.remoteIP, time.Now(), 1)
+		}
+	}()
+	defer func() {
+		x := recover()
+		if x == nil {
+			return
+		}
+		if err, ok := x.(error); ok {
+			var uerr userError
+			if errors.As(err, &uerr) && uerr.code == "AUTH" {
+				authResult = "badcreds"
+			} else if errors.Is(err, errAuthAborted) {
+				authResult = "aborted"
+			}
+		}
+		panic(x)
+	}()
+
+	c.account = fn()
+	c.setSlow(false)
+	authResult = "ok"
+	c.authFailed = 0
+	c.xloadMaildrop()
+	c.state = stateTransaction
+}
+
+var errAuthAborted = errors.New("authentication aborted by client")
+
+// xloadMaildrop reads the messages in the Inbox for the session.
+func (c *conn) xloadMaildrop() {
+	c.xdbread(func(tx *bstore.Tx) {
+		mb, err := c.account.MailboxFind(tx, "Inbox")
+		xcheckf(err, "looking up inbox")
+		if mb == nil {
+			xserverErrorf("no inbox")
+		}
+		c.mailboxID = mb.ID
+		c.uidValidity = mb.UIDValidity
+
+		q := bstore.QueryTx[store.Message](tx)
+		q.FilterNonzero(store.Message{MailboxID: mb.ID})
+		q.FilterEqual("Expunged", false)
+		q.SortAsc("UID")
+		err = q.ForEach(func(m store.Message) error {
+			c.messages = append(c.messages, message{id: m.ID, uid: m.UID, size: m.Size})
+			return nil
+		})
+		xcheckf(err, "listing messages in inbox")
+	})
+}
+
+// Auth authenticates using SASL. Without parameters, the available mechanisms
+// are listed.
+//
+// State: Authorization
+func (c *conn) cmdAuth(cmd string, params string) {
+	// Command: ../rfc/5034
+
+	if params == "" {
+		// Listing mechanisms, as many clients expect. ../rfc/1734
+		c.bwritelinef("+OK")
+		for _, mech := range c.authMechanisms() {
+			c.bwritelinef("%s", mech)
+		}
+		c.writelinef(".")
+		return
+	}
+
+	l := xparams(params, 1, 2)
+	authType := strings.ToUpper(l[0])
+
+	xdecode := func(s string) []byte {
+		if s == "=" {
+			// Empty initial response. ../rfc/5034
+			return nil
+		}
+		buf, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			xsyntaxErrorf("parsing base64: %v", err)
+		}
+		return buf
+	}
+
+	// Send a challenge and read the response, "*" aborts authentication.
+	xchallenge := func(buf []byte) []byte {
+		c.writelinef("+ %s", base64.StdEncoding.EncodeToString(buf))
+		line := c.xreadLine()
+		if line == "*" {
+			panic(userError{err: errAuthAborted})
+		}
+		return xdecode(line)
+	}
+
+	xreadInitial := func() []byte {
+		if len(l) == 2 {
+			return xdecode(l[1])
+		}
+		return xchallenge(nil)
+	}
+
+	switch authType {
+	case "PLAIN":
+		if !c.noRequireSTARTTLS && !c.tls {
+			xusercodeErrorf("AUTH", "tls required for login")
+		}
+
+		c.authenticate("plain", func() *store.Account {
+			// Plain text passwords, mark as traceauth.
+			defer c.xtrace(mlog.LevelTraceauth)()
+			buf := xreadInitial()
+			c.xtrace(mlog.LevelTrace) // Restore.
+			plain := bytes.Split(buf, []byte{0})
+			if len(plain) != 3 {
+				xsyntaxErrorf("bad plain auth data, expected 3 nul-separated tokens, got %d tokens", len(plain))
+			}
+			authz := string(plain[0])
+			authc := string(plain[1])
+			password := string(plain[2])
+
+			if authz != "" && authz != authc {
+				xusercodeErrorf("AUTH", "cannot assume role")
+			}
+
+			acc, err := store.OpenEmailAuth(c.log, authc, password, "")
+			if err != nil {
+				c.xauthError(err, authc)
+			}
+			c.username = authc
+			return acc
+		})
+
+	case "SCRAM-SHA-256-PLUS", "SCRAM-SHA-256", "SCRAM-SHA-1-PLUS", "SCRAM-SHA-1":
+		if !store.PasswordHashMechanisms() {
+			xuserErrorf("mechanism not supported")
+		}
+		// No plaintext credentials, we can log these normally.
+
+		authVariant := strings.ToLower(authType)
+		var h func() hash.Hash
+		switch authVariant {
+		case "scram-sha-1", "scram-sha-1-plus":
+			h = sha1.New
+		case "scram-sha-256", "scram-sha-256-plus":
+			h = sha256.New
+		default:
+			xserverErrorf("missing case for scram variant")
+		}
+
+		var cs *tls.ConnectionState
+		requireChannelBinding := strings.HasSuffix(authVariant, "-plus")
+		if requireChannelBinding && !c.tls {
+			xuserErrorf("cannot use plus variant with tls channel binding without tls")
+		}
+		if c.tls {
+			xcs := c.conn.(*tls.Conn).ConnectionState()
+			cs = &xcs
+		}
+
+		c.authenticate(authVariant, func() *store.Account {
+			c0 := xreadInitial()
+			ss, err := scram.NewServer(h, c0, cs, requireChannelBinding)
+			if err != nil {
+				xsyntaxErrorf("starting scram: %s", err)
+			}
+			c.log.Debug("scram auth", slog.String("authentication", ss.Authentication))
+			acc, _, err := store.OpenEmail(c.log, ss.Authentication)
+			if err != nil {
+				xusercodeErrorf("AUTH", "scram not possible")
+			}
+			defer func() {
+				if acc != nil {
+					err := acc.Close()
+					c.log.Check(err, "close account")
+				}
+			}()
+			if ss.Authorization != "" && ss.Authorization != ss.Authentication {
+				xusercodeErrorf("AUTH", "authentication with authorization for different user not supported")
+			}
+			var xscram store.SCRAM
+			acc.WithRLock(func() {
+				err := acc.DB.Read(context.TODO(), func(tx *bstore.Tx) error {
+					password, err := bstore.QueryTx[store.Password](tx).Get()
+					if err == bstore.ErrAbsent {
+						c.log.Info("failed authentication attempt", slog.String("username", ss.Authentication), slog.Any("remote", c.remoteIP))
+						xusercodeErrorf("AUTH", "bad credentials")
+					}
+					xcheckf(err, "fetching credentials")
+					switch authVariant {
+					case "scram-sha-1", "scram-sha-1-plus":
+						xscram = password.SCRAMSHA1
+					case "scram-sha-256", "scram-sha-256-plus":
+						xscram = password.SCRAMSHA256
+					default:
+						xserverErrorf("missing case for scram credentials")
+					}
+					if len(xscram.Salt) == 0 || xscram.Iterations == 0 || len(xscram.SaltedPassword) == 0 {
+						c.log.Info("scram auth attempt without derived secrets set, save password again to store secrets", slog.String("address", ss.Authentication))
+						xusercodeErrorf("AUTH", "scram not possible")
+					}
+					return nil
+				})
+				xcheckf(err, "read tx")
+			})
+			s1, err := ss.ServerFirst(xscram.Iterations, xscram.Salt)
+			xcheckf(err, "scram first server step")
+			c2 := xchallenge([]byte(s1))
+			s3, err := ss.Finish(c2, xscram.SaltedPassword)
+			if err != nil {
+				if errors.Is(err, scram.ErrInvalidProof) {
+					c.log.Info("failed authentication attempt", slog.String("username", ss.Authentication), slog.Any("remote", c.remoteIP))
+					xusercodeErrorf("AUTH", "bad credentials")
+				}
+				xuserErrorf("server final: %w", err)
+			}
+
+			// POP3 has no additional data with success, the server-final message is sent as
+			// challenge, with an empty response. ../rfc/5034
+			if buf := xchallenge([]byte(s3)); len(buf) != 0 {
+				xsyntaxErrorf("expected empty response to server final message")
+			}
+
+			c.username = ss.Authentication
+			xacc := acc
+			acc = nil // Cancel cleanup.
+			return xacc
+		})
+
+	default:
+		xuserErrorf("mechanism not supported")
+	}
+
+	c.ok(fmt.Sprintf("logged in, %d messages", len(c.messages)))
+}
+
+// Stat returns the number of messages and their total size, excluding messages
+// marked as deleted.
+//
+// State: Transaction
+func (c *conn) cmdStat(cmd string, params string) {
+	// Command: ../rfc/1939
+	xparams(params, 0, 0)
+
+	var n int
+	var size int64
+	for _, m := range c.messages {
+		if !m.deleted {
+			n++
+			size += m.size
+		}
+	}
+	c.ok(fmt.Sprintf("%d %d", n, size))
+}
+
+// List returns the size of a single message, or of all messages not marked as
+// deleted.
+//
+// State: Transaction
+func (c *conn) cmdList(cmd string, params string) {
+	// Command: ../rfc/1939
+	l := xparams(params, 0, 1)
+
+	if len(l) == 1 {
+		num, m := c.xmessage(l[0])
+		c.ok(fmt.Sprintf("%d %d", num, m.size))
+		return
+	}
+	c.bwritelinef("+OK scan listing follows")
+	for i, m := range c.messages {
+		if !m.deleted {
+			c.bwritelinef("%d %d", i+1, m.size)
+		}
+	}
+	c.writelinef(".")
+}
+
+// Uidl returns the unique id of a single message, or of all messages not marked
+// as deleted.
+//
+// State: Transaction
+func (c *conn) cmdUidl(cmd string, params string) {
+	// Command: ../rfc/1939
+	l := xparams(params, 0, 1)
+
+	if len(l) == 1 {
+		num, m := c.xmessage(l[0])
+		c.ok(fmt.Sprintf("%d %d.%d", num, c.uidValidity, m.uid))
+		return
+	}
+	c.bwritelinef("+OK unique-id listing follows")
+	for i, m := range c.messages {
+		if !m.deleted {
+			c.bwritelinef("%d %d.%d", i+1, c.uidValidity, m.uid)
+		}
+	}
+	c.writelinef(".")
+}
+
+// xmessageReader returns a reader for the message, which must not have been
+// expunged by another session.
+func (c *conn) xmessageReader(m *message) *store.MsgReader {
+	var sm store.Message
+	c.xdbread(func(tx *bstore.Tx) {
+		sm = store.Message{ID: m.id}
+		err := tx.Get(&sm)
+		if err == bstore.ErrAbsent || err == nil && sm.Expunged {
+			xuserErrorf("message was removed by another session")
+		}
+		xcheckf(err, "get message")
+	})
+	return c.account.MessageReader(sm)
+}
+
+// xwriteMessage writes the data from r with dot stuffing, and the terminating
+// dot line. ../rfc/1939
+func (c *conn) xwriteMessage(r io.Reader) {
+	if err := smtp.DataWrite(c.bw, r); err != nil {
+		// We have already started the response, the only way out is closing the
+		// connection.
+		panic(fmt.Errorf("writing message: %s (%w)", err, errIO))
+	}
+	c.xflush()
+}
+
+// Retr returns a message.
+//
+// State: Transaction
+func (c *conn) cmdRetr(cmd string, params string) {
+	// Command: ../rfc/1939
+	l := xparams(params, 1, 1)
+	_, m := c.xmessage(l[0])
+	mr := c.xmessageReader(m)
+	defer func() {
+		err := mr.Close()
+		c.log.Check(err, "closing message reader")
+	}()
+
+	c.bwritelinef("+OK %d octets", m.size)
+	c.xwriteMessage(mr)
+}
+
+// Top returns the header and the first n lines of the body of a message.
+//
+// State: Transaction
+func (c *conn) cmdTop(cmd string, params string) {
+	// Command: ../rfc/1939
+	l := xparams(params, 2, 2)
+	_, m := c.xmessage(l[0])
+	nlines, err := strconv.ParseInt(l[1], 10, 32)
+	if err != nil || nlines < 0 {
+		xsyntaxErrorf("invalid number of lines %q", l[1])
+	}
+	mr := c.xmessageReader(m)
+	defer func() {
+		err := mr.Close()
+		c.log.Check(err, "closing message reader")
+	}()
+
+	// Gather the header up to and including the empty line, and the requested lines
+	// of the body.
+	var buf bytes.Buffer
+	br := bufio.NewReader(mr)
+	header := true
+	for header || nlines > 0 {
+		line, err := br.ReadBytes('\n')
+		buf.Write(line)
+		if err == io.EOF {
+			break
+		}
+		xcheckf(err, "reading message")
+		if header {
+			header = !bytes.Equal(line, []byte("\r\n"))
+		} else {
+			nlines--
+		}
+	}
+	if buf.Len() > 0 && !bytes.HasSuffix(buf.Bytes(), []byte("\r\n")) {
+		buf.WriteString("\r\n")
+	}
+
+	c.bwritelinef("+OK top of message follows")
+	c.xwriteMessage(&buf)
+}
+
+// Dele marks a message as deleted. It is removed at the end of the session, with
+// QUIT.
+//
+// State: Transaction
+func (c *conn) cmdDele(cmd string, params string) {
+	// Command: ../rfc/1939
+	l := xparams(params, 1, 1)
+	num, m := c.xmessage(l[0])
+	m.deleted = true
+	c.ok(fmt.Sprintf("message %d deleted", num))
+}
+
+// Noop does nothing.
+//
+// State: Transaction
+func (c *conn) cmdNoop(cmd string, params string) {
+	// Command: ../rfc/1939
+	xparams(params, 0, 0)
+	c.ok("")
+}
+
+// Rset unmarks messages marked as deleted.
+//
+// State: Transaction
+func (c *conn) cmdRset(cmd string, params string) {
+	// Command: ../rfc/1939
+	xparams(params, 0, 0)
+	for i := range c.messages {
+		c.messages[i].deleted = false
+	}
+	c.ok(fmt.Sprintf("%d messages", len(c.messages)))
+}
+
+// xexpunge removes the messages marked as deleted from the Inbox, and broadcasts
+// the changes to other sessions, e.g. IMAP. Messages already removed by other
+// sessions are skipped. The number of removed messages is returned.
+func (c *conn) xexpunge() int {
+	var ids []int64
+	for _, m := range c.messages {
+		if m.deleted {
+			ids = append(ids, m.id)
+		}
+	}
+	if len(ids) == 0 {
+		return 0
+	}
+
+	var remove []store.Message
+
+	c.account.WithWLock(func() {
+		var mb store.Mailbox
+		var modseq store.ModSeq
+
+		c.xdbwrite(func(tx *bstore.Tx) {
+			mb = store.Mailbox{ID: c.mailboxID}
+			err := tx.Get(&mb)
+			if err == bstore.ErrAbsent {
+				xuserErrorf("%w", store.ErrUnknownMailbox)
+			}
+			xcheckf(err, "get mailbox")
+
+			qm := bstore.QueryTx[store.Message](tx)
+			qm.FilterIDs(ids)
+			qm.FilterNonzero(store.Message{MailboxID: c.mailboxID})
+			qm.FilterEqual("Expunged", false)
+			qm.SortAsc("UID")
+			remove, err = qm.List()
+			xcheckf(err, "listing messages to delete")
+
+			if len(remove) == 0 {
+				return
+			}
+
+			modseq, err = c.account.NextModSeq(tx)
+			xcheckf(err, "assigning next modseq")
+
+			removeIDs := make([]int64, len(remove))
+			anyIDs := make([]any, len(remove))
+			var totalSize int64
+			for i, m := range remove {
+				removeIDs[i] = m.ID
+				anyIDs[i] = m.ID
+				mb.Sub(m.MailboxCounts())
+				totalSize += m.Size
+				// Update "remove", because RetrainMessages below will save the message.
+				remove[i].Expunged = true
+				remove[i].ModSeq = modseq
+			}
+			qmr := bstore.QueryTx[store.Recipient](tx)
+			qmr.FilterEqual("MessageID", anyIDs...)
+			_, err = qmr.Delete()
+			xcheckf(err, "removing message recipients")
+
+			err = store.TextIndexRemove(tx, removeIDs...)
+			xcheckf(err, "removing messages from full-text index")
+
+			qm = bstore.QueryTx[store.Message](tx)
+			qm.FilterIDs(removeIDs)
+			n, err := qm.UpdateNonzero(store.Message{Expunged: true, ModSeq: modseq})
+			if err == nil && n != len(removeIDs) {
+				err = fmt.Errorf("only %d messages set to expunged, expected %d", n, len(removeIDs))
+			}
+			xcheckf(err, "marking messages marked for deleted as expunged")
+
+			err = tx.Update(&mb)
+			xcheckf(err, "updating mailbox counts")
+
+			err = c.account.AddMessageSize(c.log, tx, -totalSize)
+			xcheckf(err, "updating disk usage")
+
+			// Mark expunged messages as not needing training, then retrain them, so if they
+			// were trained, they get untrained.
+			for i := range remove {
+				remove[i].Junk = false
+				remove[i].Notjunk = false
+			}
+			err = c.account.RetrainMessages(context.TODO(), c.log, tx, remove, true)
+			xcheckf(err, "untraining expunged messages")
+		})
+
+		if len(remove) > 0 {
+			uids := make([]store.UID, len(remove))
+			for i, m := range remove {
+				uids[i] = m.UID
+			}
+			changes := []store.Change{
+				store.ChangeRemoveUIDs{MailboxID: c.mailboxID, UIDs: uids, ModSeq: modseq},
+				mb.ChangeCounts(),
+			}
+			store.BroadcastChanges(c.account, changes)
+		}
+	})
+
+	for _, m := range remove {
+		p := c.account.MessagePath(m.ID)
+		err := os.Remove(p)
+		c.log.Check(err, "removing message file for expunge", slog.String("path", p))
+	}
+
+	return len(remove)
+}
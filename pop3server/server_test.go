@@ -0,0 +1,394 @@
+package pop3server
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	cryptorand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/sasl"
+	"github.com/mjl-/mox/store"
+)
+
+var ctxbg = context.Background()
+var pkglog = mlog.New("pop3server", nil)
+
+func init() {
+	// Don't slow down tests.
+	badClientDelay = 0
+	authFailDelay = 0
+}
+
+const password0 = "tést    " // NFD and various unicode spaces.
+
+func tcheck(t *testing.T, err error, msg string) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: %s", msg, err)
+	}
+}
+
+type testconn struct {
+	t          *testing.T
+	conn       net.Conn
+	br         *bufio.Reader
+	done       chan struct{}
+	serverConn net.Conn
+	account    *store.Account
+	switchStop func()
+
+	// Result of last command.
+	line  string   // First line of response, without +OK or -ERR.
+	lines []string // Lines of a multi-line response, with dot stuffing removed.
+}
+
+func (tc *testconn) close() {
+	if tc.account == nil {
+		return
+	}
+	err := tc.account.Close()
+	tc.t.Logf("close account: %v", err)
+	tc.account = nil
+	tc.serverConn.Close()
+	tc.conn.Close()
+	<-tc.done
+	tc.switchStop()
+}
+
+func (tc *testconn) readline() string {
+	tc.t.Helper()
+	line, err := tc.br.ReadString('\n')
+	tcheck(tc.t, err, "read line")
+	return strings.TrimSuffix(line, "\r\n")
+}
+
+func (tc *testconn) writelinef(format string, args ...any) {
+	tc.t.Helper()
+	_, err := fmt.Fprintf(tc.conn, format+"\r\n", args...)
+	tcheck(tc.t, err, "write")
+}
+
+// readResult reads a response line, and checks it is positive (ok) or negative.
+func (tc *testconn) readResult(ok bool) {
+	tc.t.Helper()
+	line := tc.readline()
+	if ok && line != "+OK" && !strings.HasPrefix(line, "+OK ") || !ok && !strings.HasPrefix(line, "-ERR") {
+		tc.t.Fatalf("got response %q, expected ok %v", line, ok)
+	}
+	if ok {
+		tc.line = strings.TrimPrefix(strings.TrimPrefix(line, "+OK"), " ")
+	} else {
+		tc.line = strings.TrimPrefix(strings.TrimPrefix(line, "-ERR"), " ")
+	}
+	tc.lines = nil
+}
+
+// transactf writes a command and checks the result.
+func (tc *testconn) transactf(ok bool, format string, args ...any) {
+	tc.t.Helper()
+	tc.writelinef(format, args...)
+	tc.readResult(ok)
+}
+
+// transactMultif writes a command with a multi-line response, and reads the
+// lines.
+func (tc *testconn) transactMultif(format string, args ...any) {
+	tc.t.Helper()
+	tc.transactf(true, format, args...)
+	for {
+		line := tc.readline()
+		if line == "." {
+			return
+		}
+		tc.lines = append(tc.lines, strings.TrimPrefix(line, "."))
+	}
+}
+
+func (tc *testconn) xline(exp string) {
+	tc.t.Helper()
+	if tc.line != exp {
+		tc.t.Fatalf("got response line %q, expected %q", tc.line, exp)
+	}
+}
+
+func (tc *testconn) xlines(exp ...string) {
+	tc.t.Helper()
+	if strings.Join(tc.lines, "\n") != strings.Join(exp, "\n") {
+		tc.t.Fatalf("got lines %q, expected %q", tc.lines, exp)
+	}
+}
+
+func (tc *testconn) hasCapability(name string) bool {
+	for _, line := range tc.lines {
+		if line == name || strings.HasPrefix(line, name+" ") {
+			return true
+		}
+	}
+	return false
+}
+
+var connCounter int64
+
+func start(t *testing.T, noRequireSTARTTLS bool) *testconn {
+	limitersInit() // Reset rate limiters.
+
+	os.RemoveAll("../testdata/pop3/data")
+	mox.Context = ctxbg
+	mox.ConfigStaticPath = filepath.FromSlash("../testdata/pop3/mox.conf")
+	mox.MustLoadConfig(true, false)
+	acc, err := store.OpenAccount(pkglog, "mjl")
+	tcheck(t, err, "open account")
+	err = acc.SetPassword(pkglog, password0)
+	tcheck(t, err, "set password")
+	switchStop := store.Switchboard()
+
+	serverConn, clientConn := net.Pipe()
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{fakeCert(t)},
+	}
+
+	done := make(chan struct{})
+	connCounter++
+	cid := connCounter
+	go func() {
+		serve("test", cid, tlsConfig, serverConn, false, noRequireSTARTTLS)
+		close(done)
+	}()
+	tc := &testconn{t: t, conn: clientConn, br: bufio.NewReader(clientConn), done: done, serverConn: serverConn, account: acc, switchStop: switchStop}
+	tc.readResult(true)
+	return tc
+}
+
+func fakeCert(t *testing.T) tls.Certificate {
+	privKey := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)) // Fake key, don't use this for real!
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1), // Required field...
+	}
+	localCertBuf, err := x509.CreateCertificate(cryptorand.Reader, template, template, privKey.Public(), privKey)
+	if err != nil {
+		t.Fatalf("making certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(localCertBuf)
+	if err != nil {
+		t.Fatalf("parsing generated certificate: %s", err)
+	}
+	c := tls.Certificate{
+		Certificate: [][]byte{localCertBuf},
+		PrivateKey:  privKey,
+		Leaf:        cert,
+	}
+	return c
+}
+
+// authenticate with a SASL client. The server-final message is sent as
+// challenge, with an empty response.
+func (tc *testconn) authenticate(client sasl.Client, ok bool) {
+	tc.t.Helper()
+	name, _ := client.Info()
+	toServer, _, err := client.Next(nil)
+	tcheck(tc.t, err, "sasl initial response")
+	tc.writelinef("AUTH %s %s", name, base64.StdEncoding.EncodeToString(toServer))
+	for {
+		line := tc.readline()
+		if !strings.HasPrefix(line, "+ ") {
+			if ok && !strings.HasPrefix(line, "+OK") || !ok && !strings.HasPrefix(line, "-ERR") {
+				tc.t.Fatalf("authenticate: got %q, expected ok %v", line, ok)
+			}
+			return
+		}
+		fromServer, err := base64.StdEncoding.DecodeString(line[2:])
+		tcheck(tc.t, err, "decode challenge")
+		var last bool
+		toServer, last, err = client.Next(fromServer)
+		tcheck(tc.t, err, "sasl next")
+		if last {
+			tc.writelinef("")
+		} else {
+			tc.writelinef("%s", base64.StdEncoding.EncodeToString(toServer))
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	tc := start(t, false)
+	defer tc.close()
+
+	tc.transactMultif("CAPA")
+	if !tc.hasCapability("STLS") || tc.hasCapability("USER") || !tc.hasCapability("UIDL") {
+		t.Fatalf("unexpected capabilities %q", tc.lines)
+	}
+	tc.transactMultif("AUTH")
+	tc.xlines("SCRAM-SHA-256-PLUS", "SCRAM-SHA-256", "SCRAM-SHA-1-PLUS", "SCRAM-SHA-1")
+
+	tc.transactf(false, "STAT") // Not authenticated.
+	tc.transactf(false, "USER mjl@mox.example")
+	tc.xline("[AUTH] tls required for login")
+	tc.transactf(false, "AUTH PLAIN %s", base64.StdEncoding.EncodeToString([]byte("\u0000mjl@mox.example\u0000"+password0)))
+	tc.xline("[AUTH] tls required for login")
+
+	// After STLS, USER/PASS and PLAIN are allowed.
+	tc.transactf(true, "STLS")
+	tlsConn := tls.Client(tc.conn, &tls.Config{InsecureSkipVerify: true})
+	err := tlsConn.Handshake()
+	tcheck(t, err, "tls handshake")
+	tc.conn = tlsConn
+	tc.br = bufio.NewReader(tlsConn)
+	tc.transactMultif("CAPA")
+	if tc.hasCapability("STLS") || !tc.hasCapability("USER") || !tc.hasCapability("SASL") {
+		t.Fatalf("unexpected capabilities after stls %q", tc.lines)
+	}
+
+	tc.transactf(false, "PASS test") // Without USER.
+	tc.transactf(true, "USER mjl@mox.example")
+	tc.transactf(false, "PASS bogus")
+	tc.xline("[AUTH] bad credentials")
+
+	tc.transactf(false, "AUTH PLAIN %s", base64.StdEncoding.EncodeToString([]byte("\u0000mjl@mox.example\u0000bogus")))
+	tc.xline("[AUTH] bad credentials")
+
+	// Abort with "*".
+	tc.writelinef("AUTH PLAIN")
+	if line := tc.readline(); line != "+ " {
+		t.Fatalf("got %q, expected empty challenge", line)
+	}
+	tc.transactf(false, "*")
+
+	tc.transactf(false, "AUTH BOGUS")
+	tc.authenticate(sasl.NewClientSCRAMSHA256("mjl@mox.example", "bogus", false), false)
+	tc.authenticate(sasl.NewClientSCRAMSHA1("mjl@mox.example", password0, false), true)
+	tc.transactf(true, "STAT")
+	tc.xline("0 0")
+	tc.transactf(false, "AUTH PLAIN") // Already authenticated.
+	tc.transactf(true, "QUIT")
+	tc.close()
+
+	tc = start(t, true)
+	defer tc.close()
+	tc.transactMultif("CAPA")
+	if !tc.hasCapability("USER") {
+		t.Fatalf("missing USER capability with noRequireSTARTTLS, %q", tc.lines)
+	}
+	tc.transactf(true, "USER mjl@mox.example")
+	tc.transactf(true, "PASS %s", password0)
+	tc.transactf(true, "NOOP")
+	tc.xline("")
+	tc.close()
+
+	tc = start(t, true)
+	defer tc.close()
+	tc.authenticate(sasl.NewClientPlain("mjl@mox.example", password0), true)
+	tc.writelinef("bogus command")
+	tc.readResult(false)
+}
+
+func TestMaildrop(t *testing.T) {
+	tc := start(t, true)
+	defer tc.close()
+
+	deliver := func(msg string) store.Message {
+		t.Helper()
+		msgFile, err := store.CreateMessageTemp(pkglog, "pop3-test")
+		tcheck(t, err, "create temp")
+		defer store.CloseRemoveTempFile(pkglog, msgFile, "test message")
+		_, err = msgFile.Write([]byte(msg))
+		tcheck(t, err, "write message")
+		m := store.Message{Received: time.Now(), Size: int64(len(msg))}
+		tc.account.WithWLock(func() {
+			err = tc.account.DeliverMailbox(pkglog, "Inbox", &m, msgFile)
+		})
+		tcheck(t, err, "deliver")
+		return m
+	}
+	const msg1 = "Subject: one\r\n\r\nline 1\r\n.line 2\r\nline 3\r\n"
+	const msg2 = "Subject: two\r\n\r\ntest\r\n"
+	m1 := deliver(msg1)
+	m2 := deliver(msg2)
+	deliver(msg2)
+
+	tc.transactf(true, "USER mjl@mox.example")
+	tc.transactf(true, "PASS %s", password0)
+
+	// Not part of the maildrop of this session.
+	deliver(msg2)
+
+	var uidvalidity uint32
+	err := tc.account.DB.Read(ctxbg, func(tx *bstore.Tx) error {
+		mb, err := tc.account.MailboxFind(tx, "Inbox")
+		uidvalidity = mb.UIDValidity
+		return err
+	})
+	tcheck(t, err, "get inbox")
+
+	tc.transactf(true, "STAT")
+	tc.xline(fmt.Sprintf("3 %d", len(msg1)+2*len(msg2)))
+	tc.transactMultif("LIST")
+	tc.xlines(fmt.Sprintf("1 %d", len(msg1)), fmt.Sprintf("2 %d", len(msg2)), fmt.Sprintf("3 %d", len(msg2)))
+	tc.transactf(true, "LIST 2")
+	tc.xline(fmt.Sprintf("2 %d", len(msg2)))
+	tc.transactf(false, "LIST 4")
+	tc.transactf(false, "LIST 0")
+	tc.transactMultif("UIDL")
+	tc.xlines(fmt.Sprintf("1 %d.1", uidvalidity), fmt.Sprintf("2 %d.2", uidvalidity), fmt.Sprintf("3 %d.3", uidvalidity))
+	tc.transactf(true, "UIDL 1")
+	tc.xline(fmt.Sprintf("1 %d.%d", uidvalidity, m1.UID))
+
+	tc.transactMultif("RETR 1")
+	tc.xlines(strings.Split(strings.TrimSuffix(msg1, "\r\n"), "\r\n")...)
+	tc.transactMultif("TOP 1 1")
+	tc.xlines("Subject: one", "", "line 1")
+	tc.transactMultif("TOP 1 0")
+	tc.xlines("Subject: one", "")
+	tc.transactMultif("TOP 2 10")
+	tc.xlines("Subject: two", "", "test")
+
+	tc.transactf(true, "DELE 1")
+	tc.transactf(false, "DELE 1")
+	tc.transactf(false, "RETR 1")
+	tc.transactf(true, "STAT")
+	tc.xline(fmt.Sprintf("2 %d", 2*len(msg2)))
+	tc.transactf(true, "RSET")
+	tc.transactf(true, "STAT")
+	tc.xline(fmt.Sprintf("3 %d", len(msg1)+2*len(msg2)))
+	tc.transactf(true, "DELE 1")
+	tc.transactf(true, "DELE 2")
+
+	// Other sessions, e.g. IMAP, are notified of the removals.
+	comm := store.RegisterComm(tc.account)
+	defer comm.Unregister()
+
+	tc.transactf(true, "QUIT")
+	tc.xline("bye, 2 messages removed")
+	<-comm.Pending
+	changes := comm.Get()
+	if len(changes) != 2 {
+		t.Fatalf("got changes %#v, expected remove and counts", changes)
+	}
+	if ch, ok := changes[0].(store.ChangeRemoveUIDs); !ok || len(ch.UIDs) != 2 || ch.UIDs[0] != m1.UID || ch.UIDs[1] != m2.UID {
+		t.Fatalf("got change %#v, expected removal of uids %d and %d", changes[0], m1.UID, m2.UID)
+	}
+
+	n, err := bstore.QueryDB[store.Message](ctxbg, tc.account.DB).FilterEqual("Expunged", false).Count()
+	tcheck(t, err, "count messages")
+	if n != 2 {
+		t.Fatalf("got %d messages, expected 2", n)
+	}
+	if _, err := os.Stat(tc.account.MessagePath(m1.ID)); err == nil {
+		t.Fatalf("message file still present after expunge")
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"log/slog"
 	"net"
 	"os"
+	"slices"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -112,7 +113,7 @@ type msgResp struct {
 // domain (MTA-STS), its policy type can be empty, in which case there is no
 // information (e.g. internal failure). hostResults are per-host details (DANE, one
 // per MX target).
-func deliverDirect(qlog mlog.Log, resolver dns.Resolver, dialer smtpclient.Dialer, ourHostname dns.Domain, transportName string, transportDirect *config.TransportDirect, msgs []*Msg, backoff time.Duration) (recipientDomainResult tlsrpt.Result, hostResults []tlsrpt.Result) {
+func deliverDirect(qlog mlog.Log, resolver dns.Resolver, dialer smtpclient.Dialer, ourHostname dns.Domain, transportName string, transportDirect *config.TransportDirect, ipPool string, msgs []*Msg, backoff time.Duration) (recipientDomainResult tlsrpt.Result, hostResults []tlsrpt.Result) {
 	// High-level approach:
 	// - Resolve domain to deliver to (CNAME), and determine hosts to try to deliver to (MX)
 	// - Get MTA-STS policy for domain (optional). If present, only deliver to its
@@ -193,7 +194,9 @@ func deliverDirect(qlog mlog.Log, resolver dns.Resolver, dialer smtpclient.Diale
 	// RFC 5321 does not specify a clear algorithm, but common practice is probably
 	// ../rfc/3974:268.
 	var remoteMTA dsn.NameIP
-	var lastErr = errors.New("no error") // Can be smtpclient.Error.
+	errNoError := errors.New("no error")
+	var lastErr = errNoError // Can be smtpclient.Error.
+	var rateLimited *rateLimitedError
 	nmissingRequireTLS := 0
 	// todo: should make distinction between host permanently not accepting the message, and the message not being deliverable permanently. e.g. a mx host may have a size limit, or not accept 8bitmime, while another host in the list does accept the message. same for smtputf8, ../rfc/6531:555
 	for _, h := range hosts {
@@ -254,7 +257,7 @@ func deliverDirect(qlog mlog.Log, resolver dns.Resolver, dialer smtpclient.Diale
 			msgResps[i] = &msgResp{msg: msgs[i]}
 		}
 
-		result := deliverHost(nqlog, resolver, dialer, ourHostname, transportName, transportDirect, h, enforceMTASTS, haveMX, origNextHopAuthentic, origNextHop, expandedNextHopAuthentic, expandedNextHop, msgResps, tlsMode, tlsPKIX, &recipientDomainResult)
+		result := deliverHost(nqlog, resolver, dialer, ourHostname, transportName, transportDirect, ipPool, h, enforceMTASTS, haveMX, origNextHopAuthentic, origNextHop, expandedNextHopAuthentic, expandedNextHop, msgResps, tlsMode, tlsPKIX, &recipientDomainResult)
 
 		var zerotype tlsrpt.PolicyType
 		if result.hostResult.Policy.Type != zerotype {
@@ -281,11 +284,22 @@ func deliverDirect(qlog mlog.Log, resolver dns.Resolver, dialer smtpclient.Diale
 				slog.Bool("enforcemtasts", enforceMTASTS),
 				slog.Bool("tlsdane", result.tlsDANE),
 				slog.Any("requiretls", m0.RequireTLS))
-			result = deliverHost(nqlog, resolver, dialer, ourHostname, transportName, transportDirect, h, enforceMTASTS, haveMX, origNextHopAuthentic, origNextHop, expandedNextHopAuthentic, expandedNextHop, msgResps, smtpclient.TLSSkip, false, &tlsrpt.Result{})
+			result = deliverHost(nqlog, resolver, dialer, ourHostname, transportName, transportDirect, ipPool, h, enforceMTASTS, haveMX, origNextHopAuthentic, origNextHop, expandedNextHopAuthentic, expandedNextHop, msgResps, smtpclient.TLSSkip, false, &tlsrpt.Result{})
 		}
 
 		remoteMTA = dsn.NameIP{Name: h.XString(false), IP: remoteIP}
 		if result.err != nil {
+			// Hosts we can't deliver to due to outgoing rate limits are skipped, perhaps
+			// another host can be used.
+			var rlerr rateLimitedError
+			if errors.As(result.err, &rlerr) {
+				nqlog.Debugx("not delivering to host due to outgoing rate limit", result.err, slog.Any("host", h))
+				if rateLimited == nil || rlerr.wait < rateLimited.wait {
+					rateLimited = &rlerr
+				}
+				continue
+			}
+
 			lastErr = result.err
 			var cerr smtpclient.Error
 			if errors.As(result.err, &cerr) {
@@ -345,6 +359,13 @@ func deliverDirect(qlog mlog.Log, resolver dns.Resolver, dialer smtpclient.Diale
 	// failures.
 	// todo: possibly detect that future deliveries will fail due to long ttl's of cached records that are preventing delivery.
 
+	// If delivery was only prevented by outgoing rate limits, we postpone the
+	// messages without counting this as a delivery attempt.
+	if rateLimited != nil && lastErr == errNoError {
+		postponeMsgsDB(qlog, msgs, *rateLimited)
+		return
+	}
+
 	// If we failed due to requiretls not being satisfied, make the delivery permanent.
 	// It is unlikely the recipient domain will implement requiretls during our retry
 	// period. Best to let the sender know immediately.
@@ -391,13 +412,16 @@ type deliverResult struct {
 // applicable. The next-hop fields themselves are used to determine valid names
 // during DANE TLS certificate verification.
 //
+// If ipPool is set, connections are made from an IP of the pool of
+// transportDirect, with its hostname in EHLO.
+//
 // The returned hostResult holds TLSRPT reporting results for the connection
 // attempt. Its policy type can be the zero value, indicating there was no finding
 // (e.g. internal error).
 //
 // deliverHost may send a message multiple times: if the server doesn't accept
 // multiple recipients for a message.
-func deliverHost(log mlog.Log, resolver dns.Resolver, dialer smtpclient.Dialer, ourHostname dns.Domain, transportName string, transportDirect *config.TransportDirect, host dns.IPDomain, enforceMTASTS, haveMX, origNextHopAuthentic bool, origNextHop dns.Domain, expandedNextHopAuthentic bool, expandedNextHop dns.Domain, msgResps []*msgResp, tlsMode smtpclient.TLSMode, tlsPKIX bool, recipientDomainResult *tlsrpt.Result) (result deliverResult) {
+func deliverHost(log mlog.Log, resolver dns.Resolver, dialer smtpclient.Dialer, ourHostname dns.Domain, transportName string, transportDirect *config.TransportDirect, ipPool string, host dns.IPDomain, enforceMTASTS, haveMX, origNextHopAuthentic bool, origNextHop dns.Domain, expandedNextHopAuthentic bool, expandedNextHop dns.Domain, msgResps []*msgResp, tlsMode smtpclient.TLSMode, tlsPKIX bool, recipientDomainResult *tlsrpt.Result) (result deliverResult) {
 	// About attempting delivery to multiple addresses of a host: ../rfc/5321:3898
 
 	m0 := msgResps[0].msg
@@ -438,6 +462,16 @@ func deliverHost(log mlog.Log, resolver dns.Resolver, dialer smtpclient.Dialer,
 			slog.Duration("duration", time.Since(start)))
 	}()
 
+	// Outgoing rate limits for the host are checked before doing any work. Limits for
+	// source IPs are checked before dialing. Messages are counted for all limits once
+	// connected.
+	hostLimits := rateLimitsHost(host)
+	limitName, limitWait, limitDone := rateLimitAcquire(log, hostLimits, len(msgResps))
+	if limitName != "" {
+		return deliverResult{err: rateLimitedError{limitName, limitWait}}
+	}
+	defer limitDone()
+
 	// Open message to deliver.
 	f, err := os.Open(m0.MessagePath())
 	if err != nil {
@@ -589,11 +623,35 @@ func deliverHost(log mlog.Log, resolver dns.Resolver, dialer smtpclient.Dialer,
 		return deliverResult{err: smtpErr}
 	}
 
+	// With an IP pool, we connect from one of its IPs, and only to remote IPs of an
+	// address family the pool has IPs for.
+	localIPs := mox.Conf.Static.SpecifiedSMTPListenIPs
+	var poolIPs []config.PoolIP
+	if err == nil && ipPool != "" && transportDirect != nil {
+		poolIPs = transportDirect.IPPools[ipPool].IPs
+		localIPs = ipPoolLocalIPs(log, ipPool, poolIPs, len(msgResps))
+		ips = slices.DeleteFunc(ips, func(ip net.IP) bool {
+			return localIPFor(localIPs, ip) == nil
+		})
+		if len(ips) == 0 {
+			err = fmt.Errorf("no remote ips for address families of ip pool %s", ipPool)
+		}
+	}
+
+	// Skip IPs we would connect from a source IP that is rate limited.
+	if err == nil {
+		ips, err = rateLimitFilterIPs(log, ips, localIPs, len(msgResps))
+		var rlerr rateLimitedError
+		if errors.As(err, &rlerr) {
+			return deliverResult{err: rlerr}
+		}
+	}
+
 	// Dial the remote host given the IPs if no error yet.
 	var conn net.Conn
 	if err == nil {
 		connectionCounter.Add(1)
-		conn, remoteIP, err = smtpclient.Dial(ctx, log.Logger, dialer, host, ips, 25, m0.DialedIPs, mox.Conf.Static.SpecifiedSMTPListenIPs)
+		conn, remoteIP, err = smtpclient.Dial(ctx, log.Logger, dialer, host, ips, 25, m0.DialedIPs, localIPs)
 	}
 	cancel()
 
@@ -614,6 +672,20 @@ func deliverHost(log mlog.Log, resolver dns.Resolver, dialer smtpclient.Dialer,
 		log.Debugx("connecting to remote smtp", err, slog.Any("host", host))
 		return deliverResult{err: fmt.Errorf("dialing smtp server: %v", err)}
 	}
+	rateLimitAdd(log, rateLimitsDelivered(rateLimitsDomain(m0.RecipientDomain.Domain), hostLimits), len(msgResps), false)
+	if laddr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		defer rateLimitAdd(log, rateLimitsIP(laddr.IP), len(msgResps), true)()
+	}
+	if len(poolIPs) > 0 {
+		lip := localIPFor(localIPs, remoteIP)
+		for _, pip := range poolIPs {
+			if pip.ParsedIP.Equal(lip) {
+				ourHostname = pip.HostnameDomain
+				log = log.With(slog.Any("localip", lip))
+				break
+			}
+		}
+	}
 
 	var mailFrom string
 	if m0.SenderLocalpart != "" || !m0.SenderDomain.IsZero() {
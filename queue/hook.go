@@ -279,6 +279,33 @@ func (f HookFilter) apply(q *bstore.Query[Hook]) error {
 	return nil
 }
 
+// String returns a description of the filter, for the audit log.
+func (f HookFilter) String() string {
+	var l []string
+	if f.Max != 0 {
+		l = append(l, fmt.Sprintf("max %d", f.Max))
+	}
+	if len(f.IDs) > 0 {
+		l = append(l, fmt.Sprintf("ids %v", f.IDs))
+	}
+	if f.Account != "" {
+		l = append(l, fmt.Sprintf("account %q", f.Account))
+	}
+	if f.Submitted != "" {
+		l = append(l, fmt.Sprintf("submitted %s", f.Submitted))
+	}
+	if f.NextAttempt != "" {
+		l = append(l, fmt.Sprintf("next attempt %s", f.NextAttempt))
+	}
+	if f.Event != "" {
+		l = append(l, fmt.Sprintf("event %q", f.Event))
+	}
+	if len(l) == 0 {
+		return "all"
+	}
+	return strings.Join(l, ", ")
+}
+
 type HookSort struct {
 	Field  string // "Queued" or "NextAttempt"/"".
 	LastID int64  // If > 0, we return objects beyond this, less/greater depending on Asc.
@@ -512,6 +539,7 @@ func HookNextAttemptAdd(ctx context.Context, filter HookFilter, d time.Duration)
 	if err != nil {
 		return 0, err
 	}
+	audit(ctx, "next attempt of %d webhooks delayed by %s, filter %s", affected, d, filter)
 	hookqueueKick()
 	return affected, nil
 }
@@ -527,6 +555,7 @@ func HookNextAttemptSet(ctx context.Context, filter HookFilter, t time.Time) (af
 	if err != nil {
 		return 0, fmt.Errorf("selecting and updating hooks in queue: %v", err)
 	}
+	audit(ctx, "next attempt of %d webhooks set to %s, filter %s", n, t.Format(time.RFC3339), filter)
 	hookqueueKick()
 	return n, nil
 }
@@ -571,6 +600,7 @@ func HookCancel(ctx context.Context, log mlog.Log, filter HookFilter) (affected
 	for _, h := range hooks {
 		log.Info("canceled hook", h.attrs()...)
 	}
+	audit(ctx, "%d webhooks canceled, filter %s", affected, filter)
 	hookqueueKick()
 	return affected, nil
 }
@@ -0,0 +1,80 @@
+package queue
+
+import (
+	"net"
+	"sync"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+// Index to start at for the next selection of IPs of a pool, for using the IPs in
+// turn.
+var ipPoolNext = struct {
+	sync.Mutex
+	m map[string]int
+}{m: map[string]int{}}
+
+// ipPoolTransport returns the direct transport with the IP pool.
+func ipPoolTransport(poolName string) (string, config.Transport, bool) {
+	for name, t := range mox.Conf.Static.Transports {
+		if t.Direct == nil {
+			continue
+		}
+		if _, ok := t.Direct.IPPools[poolName]; ok {
+			return name, t, true
+		}
+	}
+	return "", config.Transport{}, false
+}
+
+// IPPoolExists returns whether an IP pool with the name is configured for a
+// direct transport.
+func IPPoolExists(poolName string) bool {
+	_, _, ok := ipPoolTransport(poolName)
+	return ok
+}
+
+// ipPoolLocalIPs returns the local IPs to connect from for delivering n messages
+// with an IP pool, at most one for each address family. The IPs of the pool are
+// used in turn, skipping IPs that are rate limited unless all are.
+func ipPoolLocalIPs(log mlog.Log, poolName string, poolIPs []config.PoolIP, n int) []net.IP {
+	ipPoolNext.Lock()
+	start := ipPoolNext.m[poolName]
+	ipPoolNext.m[poolName] = start + 1
+	ipPoolNext.Unlock()
+
+	var l []net.IP
+	for _, is4 := range []bool{true, false} {
+		var first net.IP
+		for i := range poolIPs {
+			ip := poolIPs[(start+i)%len(poolIPs)].ParsedIP
+			if (ip.To4() != nil) != is4 {
+				continue
+			}
+			if first == nil {
+				first = ip
+			}
+			if name, _ := rateLimitWait(log, rateLimitsIP(ip), n); name == "" {
+				first = ip
+				break
+			}
+		}
+		if first != nil {
+			l = append(l, first)
+		}
+	}
+	return l
+}
+
+// localIPFor returns the local IP with the same address family as the remote IP,
+// as used by smtpclient.Dial. If none, the system picks an IP and nil is returned.
+func localIPFor(localIPs []net.IP, remoteIP net.IP) net.IP {
+	for _, lip := range localIPs {
+		if (lip.To4() != nil) == (remoteIP.To4() != nil) {
+			return lip
+		}
+	}
+	return nil
+}
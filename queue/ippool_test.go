@@ -0,0 +1,68 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/smtp"
+	"github.com/mjl-/mox/smtpclient"
+)
+
+func TestIPPool(t *testing.T) {
+	_, cleanup := setup(t)
+	defer cleanup()
+
+	tcompare(t, IPPoolExists("bulk"), true)
+	tcompare(t, IPPoolExists("other"), false)
+
+	path := smtp.Path{Localpart: "mjl", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: "mox.example"}}}
+	mf := prepareFile(t)
+	defer os.Remove(mf.Name())
+	defer mf.Close()
+	qm := MakeMsg(path, path, false, false, int64(len(testmsg)), "<test@localhost>", nil, nil, time.Now(), "test")
+	qm.IPPool = "bulk"
+	err := Add(ctxbg, pkglog, "mjl", mf, qm)
+	tcheck(t, err, "add message to queue")
+
+	resolver := dns.MockResolver{
+		A: map[string][]string{
+			"mail.mox.example.": {"127.0.0.1"},
+		},
+		AAAA: map[string][]string{
+			"mail.mox.example.": {"::1"},
+		},
+		MX: map[string][]*net.MX{
+			"mox.example.": {{Host: "mail.mox.example", Pref: 10}},
+		},
+	}
+
+	// Connections are only made to the IPv4 address, from the IPs of the pool in turn.
+	var dials []string
+	smtpclient.DialHook = func(ctx context.Context, dialer smtpclient.Dialer, timeout time.Duration, addr string, laddr net.Addr) (net.Conn, error) {
+		dials = append(dials, fmt.Sprintf("%s %s", laddr, addr))
+		return nil, fmt.Errorf("failure from test")
+	}
+	defer func() {
+		smtpclient.DialHook = nil
+	}()
+
+	for i := 0; i < 2; i++ {
+		_, err := NextAttemptSet(ctxbg, Filter{}, time.Now())
+		tcheck(t, err, "set next attempt")
+		n := launchWork(pkglog, resolver, map[string]struct{}{})
+		tcompare(t, n, 1)
+		timer := time.NewTimer(time.Second)
+		select {
+		case <-deliveryResults:
+		case <-timer.C:
+			t.Fatalf("no delivery within 1s")
+		}
+		timer.Stop()
+	}
+	tcompare(t, dials, []string{"10.0.0.1:0 127.0.0.1:25", "10.0.0.2:0 127.0.0.1:25"})
+}
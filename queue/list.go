@@ -0,0 +1,1091 @@
+package queue
+
+import (
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/dsn"
+	"github.com/mjl-/mox/message"
+	"github.com/mjl-/mox/metrics"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/moxio"
+	"github.com/mjl-/mox/moxvar"
+	"github.com/mjl-/mox/smtp"
+	"github.com/mjl-/mox/store"
+)
+
+// Mailing lists are aliases with a ListOwner. Messages for local members are
+// delivered by the smtpserver, like for regular aliases. Messages for external
+// members, and members that subscribed by email, are added to the queue with List-*
+// headers and a per-member envelope sender for matching bounces. ../rfc/2369
+// ../rfc/8058
+
+// ListMember is an address that subscribed to a mailing list by email, in
+// addition to the members configured in the alias.
+type ListMember struct {
+	ID      int64
+	Created time.Time `bstore:"default now"`
+	List    string    `bstore:"nonzero,unique List+Address"` // Address of alias, packed.
+	Address string    `bstore:"nonzero"`                     // Address of member, packed.
+	Digest  bool      // Whether member gets digests instead of individual messages.
+	Token   string    `bstore:"nonzero,unique"` // For unsubscribing with a single click.
+}
+
+// ListRequest is a request to subscribe to or unsubscribe from a list, pending
+// confirmation by a reply to the requesting address.
+type ListRequest struct {
+	ID        int64
+	Created   time.Time `bstore:"default now,index"`
+	Token     string    `bstore:"nonzero,unique"`
+	List      string    `bstore:"nonzero"`
+	Address   string    `bstore:"nonzero"`
+	Subscribe bool
+	Digest    bool
+}
+
+// ListMsg is a message to a list that is held for moderation, or that is pending
+// inclusion in a digest. The message is stored in the queue directory.
+type ListMsg struct {
+	ID        int64
+	Received  time.Time `bstore:"default now"`
+	List      string    `bstore:"nonzero,index"`
+	Held      bool      // Held for moderation, otherwise pending for digest.
+	Token     string    `bstore:"index"` // For approving or rejecting a held message.
+	MailFrom  string
+	MsgFrom   string // Packed address.
+	Subject   string
+	MessageID string
+	Has8bit   bool
+	SMTPUTF8  bool
+	Size      int64
+}
+
+// MessagePath returns the path where the message is stored.
+func (m ListMsg) MessagePath() string {
+	return mox.DataDirPath(filepath.Join("queue", "list", store.MessagePath(m.ID)))
+}
+
+// ListMessage holds properties of an incoming message for a list.
+type ListMessage struct {
+	MailFrom  string       // SMTP MAIL FROM, for Return-Path.
+	MsgFrom   smtp.Address // Address in message From header. A member with this address doesn't get a copy.
+	Has8bit   bool
+	SMTPUTF8  bool
+	MessageID string
+	Subject   string
+	Size      int64
+}
+
+// How long pending subscription requests and held messages are kept.
+const (
+	listRequestExpiration = 7 * 24 * time.Hour
+	listHeldExpiration    = 14 * 24 * time.Hour
+)
+
+var errListNoOwner = errors.New("alias has no list owner")
+
+// ListMemberList returns the members of list that subscribed by email.
+func ListMemberList(ctx context.Context, alias config.Alias) ([]ListMember, error) {
+	return bstore.QueryDB[ListMember](ctx, DB).FilterNonzero(ListMember{List: listAddress(alias).Pack(true)}).SortAsc("Address").List()
+}
+
+// ListIsMember returns whether addr subscribed to the list by email.
+func ListIsMember(ctx context.Context, alias config.Alias, addr smtp.Address) (bool, error) {
+	return bstore.QueryDB[ListMember](ctx, DB).FilterNonzero(ListMember{List: listAddress(alias).Pack(true), Address: addr.Pack(true)}).Exists()
+}
+
+func listAddress(alias config.Alias) smtp.Address {
+	lp, err := smtp.ParseLocalpart(alias.LocalpartStr)
+	if err != nil {
+		// Checked when parsing config.
+		lp = smtp.Localpart(alias.LocalpartStr)
+	}
+	return smtp.NewAddress(lp, alias.Domain)
+}
+
+// listCommandPath returns the address for a list command, with optional
+// parameter, e.g. "list-confirm-<token>@domain".
+func listCommandPath(alias config.Alias, cmd mox.ListCommand, param string) smtp.Path {
+	list := listAddress(alias)
+	lp := string(list.Localpart) + "-" + string(cmd)
+	if param != "" {
+		lp += "-" + param
+	}
+	return smtp.Path{Localpart: smtp.Localpart(lp), IPDomain: dns.IPDomain{Domain: list.Domain}}
+}
+
+// listBouncesPath returns the envelope sender for messages to a member, encoding
+// the member address so bounces can be matched.
+func listBouncesPath(alias config.Alias, member smtp.Address) smtp.Path {
+	return listCommandPath(alias, mox.ListBounces, string(member.Localpart)+"="+member.Domain.ASCII)
+}
+
+// listBouncesMember parses the parameter of a bounces address back into the
+// member address.
+func listBouncesMember(param string) (smtp.Address, error) {
+	i := strings.LastIndex(param, "=")
+	if i < 0 {
+		return smtp.Address{}, fmt.Errorf("missing = in bounces address")
+	}
+	d, err := dns.ParseDomain(param[i+1:])
+	if err != nil {
+		return smtp.Address{}, fmt.Errorf("parsing domain: %w", err)
+	}
+	return smtp.NewAddress(smtp.Localpart(param[:i]), d), nil
+}
+
+// listID returns the value for the List-Id header, without brackets. ../rfc/2919:168
+func listID(alias config.Alias) string {
+	list := listAddress(alias)
+	return strings.ReplaceAll(string(list.Localpart), ".", "-") + "." + list.Domain.ASCII
+}
+
+func listToken() (string, error) {
+	buf := make([]byte, 10)
+	if _, err := cryptorand.Read(buf); err != nil {
+		return "", err
+	}
+	return strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(buf)), nil
+}
+
+// listUnsubscribeURL returns an HTTPS URL for unsubscribing with a single click
+// through the account web interface, or an empty string if not available.
+func listUnsubscribeURL(token string) string {
+	names := make([]string, 0, len(mox.Conf.Static.Listeners))
+	for name := range mox.Conf.Static.Listeners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		l := mox.Conf.Static.Listeners[name]
+		if !l.AccountHTTPS.Enabled {
+			continue
+		}
+		host := l.HostnameDomain.ASCII
+		if host == "" {
+			host = mox.Conf.Static.HostnameDomain.ASCII
+		}
+		if l.AccountHTTPS.Port != 0 && l.AccountHTTPS.Port != 443 {
+			host += fmt.Sprintf(":%d", l.AccountHTTPS.Port)
+		}
+		path := l.AccountHTTPS.Path
+		if path == "" {
+			path = "/"
+		}
+		u := url.URL{Scheme: "https", Host: host, Path: path + "unsubscribe", RawQuery: url.Values{"token": []string{token}}.Encode()}
+		return u.String()
+	}
+	return ""
+}
+
+// listHeaders returns the List-* headers for a message to a member, and the
+// names of the headers, for signing with DKIM. ../rfc/2369:151 ../rfc/8058:116
+func listHeaders(alias config.Alias, unsubscribeToken string) (headers string, names []string) {
+	mailto := func(cmd mox.ListCommand, subject string) string {
+		s := "mailto:" + listCommandPath(alias, cmd, "").String()
+		if subject != "" {
+			s += "?subject=" + subject
+		}
+		return "<" + s + ">"
+	}
+	add := func(k, v string) {
+		headers += k + ": " + v + "\r\n"
+		names = append(names, k)
+	}
+
+	add("List-Id", "<"+listID(alias)+">")
+	add("List-Post", "<mailto:"+listAddress(alias).String()+">")
+	add("List-Help", mailto(mox.ListRequest, "help"))
+	add("List-Owner", mailto(mox.ListOwner, ""))
+	if alias.Subscribe {
+		add("List-Subscribe", mailto(mox.ListSubscribe, "subscribe"))
+	}
+	unsub := mailto(mox.ListUnsubscribe, "unsubscribe")
+	var u string
+	if unsubscribeToken != "" {
+		u = listUnsubscribeURL(unsubscribeToken)
+	}
+	if u != "" {
+		add("List-Unsubscribe", "<"+u+">, "+unsub)
+		add("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
+	} else {
+		add("List-Unsubscribe", unsub)
+	}
+	return
+}
+
+// listMember is an address to deliver list messages to through the queue.
+type listMember struct {
+	Address smtp.Address
+	Token   string // For one-click unsubscribe, for members that subscribed by email.
+}
+
+// listQueue adds a message for each member to the queue, with List-* headers
+// and a DKIM signature for the list domain covering those headers. Members on the
+// suppression list of the list owner are skipped.
+func listQueue(ctx context.Context, log mlog.Log, alias config.Alias, members []listMember, has8bit, smtputf8 bool, messageID, subject string, size int64, msgFile *os.File) error {
+	var qml []Msg
+	for _, m := range members {
+		if sup, err := SuppressionLookup(ctx, alias.ParsedListOwner.AccountName, m.Address.Path()); err != nil {
+			return fmt.Errorf("looking up address in suppression list: %v", err)
+		} else if sup != nil {
+			log.Debug("not delivering list message to member on suppression list", slog.Any("member", m.Address))
+			continue
+		}
+
+		xsmtputf8 := smtputf8 || m.Address.Localpart.IsInternational()
+		headers, names := listHeaders(alias, m.Token)
+		mr := io.MultiReader(strings.NewReader(headers), &moxio.AtReader{R: msgFile})
+		data, err := io.ReadAll(mr)
+		if err != nil {
+			return fmt.Errorf("reading message: %v", err)
+		}
+		dkimHeaders, err := mox.DKIMSignHeaders(ctx, log, listAddress(alias).Path(), xsmtputf8, names, data)
+		if err != nil {
+			log.Errorx("dkim-signing list message, continuing without signature", err)
+		}
+		prefix := []byte(dkimHeaders + headers)
+		qm := MakeMsg(listBouncesPath(alias, m.Address), m.Address.Path(), has8bit, xsmtputf8, size+int64(len(prefix)), messageID, prefix, nil, time.Now(), subject)
+		qml = append(qml, qm)
+	}
+	if len(qml) == 0 {
+		return nil
+	}
+	return Add(ctx, log, alias.ParsedListOwner.AccountName, msgFile, qml...)
+}
+
+// ListDeliver adds a message sent to a list to the queue for delivery to external
+// members and members that subscribed by email, and stores it for inclusion in
+// digests if there are members in digest mode. Local members configured in the
+// alias are delivered to by the caller. Addresses in skip, e.g. those that
+// already received the message as explicit recipient, are skipped.
+func ListDeliver(ctx context.Context, log mlog.Log, alias config.Alias, lm ListMessage, msgFile *os.File, skip []smtp.Address) error {
+	if alias.ListOwner == "" {
+		return errListNoOwner
+	}
+	list := listAddress(alias)
+	log = log.With(slog.Any("list", list))
+
+	// A message that already went through this list, e.g. through a member that
+	// forwards to the list, is not distributed again.
+	if p, err := message.Parse(log.Logger, false, msgFile); err != nil {
+		log.Debugx("parsing list message, continuing", err)
+	} else if h, err := p.Header(); err != nil {
+		log.Debugx("parsing headers of list message, continuing", err)
+	} else if strings.Contains(h.Get("List-Id"), "<"+listID(alias)+">") {
+		log.Info("message already distributed through list, not delivering again")
+		return nil
+	}
+
+	skip = append(skip, lm.MsgFrom)
+	var members []listMember
+	for _, aa := range alias.ParsedAddresses {
+		if aa.AccountName == "" && !slices.Contains(skip, aa.Address) {
+			members = append(members, listMember{Address: aa.Address})
+		}
+	}
+	dbmembers, err := ListMemberList(ctx, alias)
+	if err != nil {
+		return fmt.Errorf("listing list members: %v", err)
+	}
+	var digest bool
+	for _, m := range dbmembers {
+		if m.Digest {
+			digest = true
+			continue
+		}
+		addr, err := smtp.ParseAddress(m.Address)
+		if err != nil {
+			log.Errorx("parsing address of list member, skipping", err, slog.String("address", m.Address))
+			continue
+		}
+		if !slices.Contains(skip, addr) && !slices.ContainsFunc(members, func(lm listMember) bool { return lm.Address == addr }) {
+			members = append(members, listMember{addr, m.Token})
+		}
+	}
+
+	if err := listQueue(ctx, log, alias, members, lm.Has8bit, lm.SMTPUTF8, lm.MessageID, lm.Subject, lm.Size, msgFile); err != nil {
+		return fmt.Errorf("queueing list message for members: %v", err)
+	}
+	log.Debug("list message queued for members", slog.Int("nmembers", len(members)))
+
+	if digest {
+		if _, err := listMsgAdd(ctx, log, alias, lm, false, msgFile); err != nil {
+			return fmt.Errorf("storing message for digest: %v", err)
+		}
+	}
+	return nil
+}
+
+// listMsgAdd stores a copy of msgFile as held message or for a later digest.
+func listMsgAdd(ctx context.Context, log mlog.Log, alias config.Alias, lm ListMessage, held bool, msgFile *os.File) (ListMsg, error) {
+	m := ListMsg{
+		List:      listAddress(alias).Pack(true),
+		Held:      held,
+		MailFrom:  lm.MailFrom,
+		MsgFrom:   lm.MsgFrom.Pack(true),
+		Subject:   lm.Subject,
+		MessageID: lm.MessageID,
+		Has8bit:   lm.Has8bit,
+		SMTPUTF8:  lm.SMTPUTF8,
+		Size:      lm.Size,
+	}
+	if held {
+		token, err := listToken()
+		if err != nil {
+			return ListMsg{}, fmt.Errorf("generating token: %v", err)
+		}
+		m.Token = token
+	}
+
+	err := DB.Write(ctx, func(tx *bstore.Tx) error {
+		if err := tx.Insert(&m); err != nil {
+			return fmt.Errorf("inserting list message: %v", err)
+		}
+		p := m.MessagePath()
+		os.MkdirAll(filepath.Dir(p), 0770)
+		if err := moxio.LinkOrCopy(log, p, msgFile.Name(), nil, true); err != nil {
+			return fmt.Errorf("linking/copying message file: %v", err)
+		}
+		return nil
+	})
+	return m, err
+}
+
+func listMsgRemove(log mlog.Log, tx *bstore.Tx, m ListMsg) error {
+	if err := tx.Delete(&m); err != nil {
+		return err
+	}
+	err := os.Remove(m.MessagePath())
+	log.Check(err, "removing list message file", slog.String("path", m.MessagePath()))
+	return nil
+}
+
+// ListHold stores a message to a list from a non-member for moderation, and
+// notifies the list owner, who can approve or reject it by email.
+func ListHold(ctx context.Context, log mlog.Log, alias config.Alias, lm ListMessage, msgFile *os.File) error {
+	if alias.ListOwner == "" {
+		return errListNoOwner
+	}
+	m, err := listMsgAdd(ctx, log, alias, lm, true, msgFile)
+	if err != nil {
+		return fmt.Errorf("storing held message: %v", err)
+	}
+
+	approve := listCommandPath(alias, mox.ListApprove, m.Token)
+	reject := listCommandPath(alias, mox.ListReject, m.Token)
+	subject := fmt.Sprintf("Message for %s held for moderation", listAddress(alias))
+	text := fmt.Sprintf(`A message for list %s from a non-member is held for moderation:
+
+	From: %s
+	Subject: %s
+
+To approve delivery to the list members, send a message to:
+
+	%s
+
+To reject the message, send a message to:
+
+	%s
+
+Messages are removed after %d days. The held message is attached.
+`, listAddress(alias), lm.MsgFrom, lm.Subject, approve.String(), reject.String(), int(listHeldExpiration/(24*time.Hour)))
+
+	owner := alias.ParsedListOwner.Address
+	err = listNotify(ctx, log, alias, owner, subject, text, approve, &listAttachment{msgFile, lm.Size, lm.Has8bit})
+	if err != nil {
+		return fmt.Errorf("notifying list owner: %v", err)
+	}
+	log.Info("list message held for moderation", slog.Any("list", listAddress(alias)), slog.Any("msgfrom", lm.MsgFrom))
+	return nil
+}
+
+// listAttachment is a message to attach to a notification.
+type listAttachment struct {
+	File    *os.File
+	Size    int64
+	Has8bit bool
+}
+
+// listNotify sends an automated message from the list to an address, e.g. for
+// confirming subscriptions. If replyTo is not zero, it is added as Reply-To header.
+// If attach is not nil, it is attached as message/rfc822.
+func listNotify(ctx context.Context, log mlog.Log, alias config.Alias, to smtp.Address, subject, text string, replyTo smtp.Path, attach *listAttachment) (rerr error) {
+	if sup, err := SuppressionLookup(ctx, alias.ParsedListOwner.AccountName, to.Path()); err != nil {
+		return fmt.Errorf("looking up address in suppression list: %v", err)
+	} else if sup != nil {
+		log.Info("not sending list notification to address on suppression list", slog.Any("to", to))
+		return nil
+	}
+
+	msgFile, err := store.CreateMessageTemp(log, "list-notify")
+	if err != nil {
+		return fmt.Errorf("creating temporary message file: %w", err)
+	}
+	defer store.CloseRemoveTempFile(log, msgFile, "list notification message")
+
+	from := listCommandPath(alias, mox.ListRequest, "")
+	fromAddr := smtp.NewAddress(from.Localpart, from.IPDomain.Domain)
+	smtputf8 := fromAddr.Localpart.IsInternational() || to.Localpart.IsInternational()
+	maxSize := int64(1024 * 1024)
+	if attach != nil {
+		maxSize += attach.Size
+	}
+	xc := message.NewComposer(msgFile, maxSize, smtputf8)
+	defer func() {
+		x := recover()
+		if x == nil {
+			return
+		}
+		if err, ok := x.(error); ok && errors.Is(err, message.ErrCompose) {
+			rerr = err
+			return
+		}
+		panic(x)
+	}()
+
+	xc.HeaderAddrs("From", []message.NameAddress{{Address: fromAddr}})
+	xc.HeaderAddrs("To", []message.NameAddress{{Address: to}})
+	if !replyTo.IsZero() {
+		xc.HeaderAddrs("Reply-To", []message.NameAddress{{Address: smtp.NewAddress(replyTo.Localpart, replyTo.IPDomain.Domain)}})
+	}
+	xc.Subject(subject)
+	messageID := fmt.Sprintf("<%s>", mox.MessageIDGen(xc.SMTPUTF8))
+	xc.Header("Message-Id", messageID)
+	xc.Header("Date", time.Now().Format(message.RFC5322Z))
+	xc.Header("Auto-Submitted", "auto-generated") // ../rfc/3834:225
+	xc.Header("User-Agent", "mox/"+moxvar.Version)
+	xc.Header("MIME-Version", "1.0")
+	textBody, ct, cte := xc.TextPart("plain", text)
+	if attach == nil {
+		xc.Header("Content-Type", ct)
+		xc.Header("Content-Transfer-Encoding", cte)
+		xc.Line()
+		_, err := xc.Write(textBody)
+		xc.Checkf(err, "writing text")
+	} else {
+		mp := multipart.NewWriter(xc)
+		xc.Header("Content-Type", fmt.Sprintf(`multipart/mixed; boundary="%s"`, mp.Boundary()))
+		xc.Line()
+
+		textHdr := textproto.MIMEHeader{}
+		textHdr.Set("Content-Type", ct)
+		textHdr.Set("Content-Transfer-Encoding", cte)
+		textp, err := mp.CreatePart(textHdr)
+		xc.Checkf(err, "adding text part to message")
+		_, err = textp.Write(textBody)
+		xc.Checkf(err, "writing text part")
+
+		ahdr := textproto.MIMEHeader{}
+		ahdr.Set("Content-Type", "message/rfc822")
+		ahdr.Set("Content-Disposition", "attachment")
+		ap, err := mp.CreatePart(ahdr)
+		xc.Checkf(err, "adding attached message")
+		_, err = io.Copy(ap, &moxio.AtReader{R: attach.File})
+		xc.Checkf(err, "writing attached message")
+		xc.Has8bit = xc.Has8bit || attach.Has8bit
+
+		err = mp.Close()
+		xc.Checkf(err, "closing multipart")
+	}
+	xc.Flush()
+
+	buf, err := os.ReadFile(msgFile.Name())
+	if err != nil {
+		return fmt.Errorf("reading composed message: %w", err)
+	}
+	dkimHeaders, err := mox.DKIMSign(ctx, log, from, xc.SMTPUTF8, buf)
+	if err != nil {
+		log.Errorx("dkim-signing list notification, continuing without signature", err)
+	}
+
+	qm := MakeMsg(listBouncesPath(alias, to), to.Path(), xc.Has8bit, xc.SMTPUTF8, int64(len(dkimHeaders))+xc.Size, messageID, []byte(dkimHeaders), nil, time.Now(), subject)
+	return Add(ctx, log, alias.ParsedListOwner.AccountName, msgFile, qm)
+}
+
+// ListIncoming processes a message sent to a command address of a list, as
+// returned by mox.LookupListAddress. Commands for the list owner (ListOwner) are
+// not handled here, they are delivered to the owner like regular messages.
+//
+// Bounces for messages to members add the member address to the suppression
+// list of the list owner account. Subscribe and unsubscribe requests are
+// confirmed by email. Confirmations for requests, and approvals/rejections of held
+// messages by the list owner are processed.
+func ListIncoming(ctx context.Context, log mlog.Log, alias config.Alias, cmd mox.ListCommand, param string, msgFrom smtp.Address, part *message.Part, msgFile *os.File) error {
+	if alias.ListOwner == "" {
+		return errListNoOwner
+	}
+	list := listAddress(alias)
+	log = log.With(slog.Any("list", list), slog.String("listcommand", string(cmd)))
+
+	if cmd == mox.ListBounces {
+		return listBounce(ctx, log, alias, param, part)
+	}
+
+	if msgFrom.IsZero() {
+		log.Info("ignoring list command without message from address")
+		return nil
+	}
+	// Don't respond to automated messages, such as out-of-office replies, preventing loops. ../rfc/3834:346
+	if h, err := part.Header(); err == nil {
+		if s := strings.ToLower(strings.TrimSpace(h.Get("Auto-Submitted"))); s != "" && s != "no" {
+			log.Info("ignoring automated message to list command address", slog.String("autosubmitted", s))
+			return nil
+		}
+	}
+
+	switch cmd {
+	case mox.ListRequest:
+		return listHelp(ctx, log, alias, msgFrom)
+
+	case mox.ListSubscribe, mox.ListSubscribeDigest, mox.ListUnsubscribe:
+		return listRequestAdd(ctx, log, alias, cmd, msgFrom)
+
+	case mox.ListConfirm:
+		return listConfirm(ctx, log, alias, param)
+
+	case mox.ListApprove, mox.ListReject:
+		if msgFrom != alias.ParsedListOwner.Address {
+			log.Info("ignoring moderation by address other than list owner", slog.Any("msgfrom", msgFrom))
+			return nil
+		}
+		return listModerate(ctx, log, alias, param, cmd == mox.ListApprove)
+	}
+	return fmt.Errorf("unknown list command %q", cmd)
+}
+
+// listBounce processes a DSN for a message to a member, adding the member to the
+// suppression list for permanent failures.
+func listBounce(ctx context.Context, log mlog.Log, alias config.Alias, param string, part *message.Part) error {
+	member, err := listBouncesMember(param)
+	if err != nil {
+		log.Infox("parsing member from list bounces address, ignoring", err, slog.String("param", param))
+		return nil
+	}
+	log = log.With(slog.Any("member", member))
+
+	// Incoming messages are only parsed, not walked.
+	if part.MediaType == "MULTIPART" && part.MediaSubType == "REPORT" && len(part.Parts) == 0 {
+		if err := part.Walk(log.Logger, nil); err != nil {
+			log.Infox("parsing parts of message to list bounces address, ignoring", err)
+			return nil
+		}
+	}
+	if !(part.MediaType == "MULTIPART" && part.MediaSubType == "REPORT" && len(part.Parts) >= 2 && part.Parts[1].MediaType == "MESSAGE" && (part.Parts[1].MediaSubType == "DELIVERY-STATUS" || part.Parts[1].MediaSubType == "GLOBAL-DELIVERY-STATUS")) {
+		log.Info("message to list bounces address not a dsn, ignoring")
+		return nil
+	}
+	dsnutf8 := part.Parts[1].MediaSubType == "GLOBAL-DELIVERY-STATUS"
+	dsnmsg, err := dsn.Decode(part.Parts[1].ReaderUTF8OrBinary(), dsnutf8)
+	if err != nil {
+		log.Infox("parsing dsn for list member, ignoring", err)
+		return nil
+	}
+
+	for _, r := range dsnmsg.Recipients {
+		if r.Action != dsn.Failed {
+			continue
+		}
+		var code int
+		var secode string
+		if r.DiagnosticCodeSMTP != "" {
+			code, secode = parseSMTPCodes(r.DiagnosticCodeSMTP)
+		}
+		if code == 0 && strings.HasPrefix(r.Status, "5.") {
+			code = 500
+			secode = r.Status[2:]
+		}
+		if code/100 != 5 {
+			continue
+		}
+		log.Debug("permanent delivery failure for list member", slog.Int("code", code), slog.String("secode", secode))
+		err := DB.Write(ctx, func(tx *bstore.Tx) error {
+			sc := suppressionCheck{
+				Account:   alias.ParsedListOwner.AccountName,
+				Recipient: member.Path(),
+				Code:      code,
+				Secode:    secode,
+				Source:    "list bounce",
+			}
+			_, err := suppressionProcess(log, tx, sc)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("processing list bounce for suppression list: %v", err)
+		}
+		break
+	}
+	return nil
+}
+
+func listHelp(ctx context.Context, log mlog.Log, alias config.Alias, to smtp.Address) error {
+	list := listAddress(alias)
+	text := fmt.Sprintf("This is an automated response for mailing list %s.\n\n", list)
+	text += fmt.Sprintf("To send a message to the list:\n\n\t%s\n\n", list)
+	if alias.Subscribe {
+		text += fmt.Sprintf("To subscribe, send a message to:\n\n\t%s\n\n", listCommandPath(alias, mox.ListSubscribe, "").String())
+		text += fmt.Sprintf("To subscribe in digest mode, receiving a combined message periodically, send a message to:\n\n\t%s\n\n", listCommandPath(alias, mox.ListSubscribeDigest, "").String())
+	}
+	text += fmt.Sprintf("To unsubscribe, send a message to:\n\n\t%s\n\n", listCommandPath(alias, mox.ListUnsubscribe, "").String())
+	text += fmt.Sprintf("To contact the owner of the list, send a message to:\n\n\t%s\n", listCommandPath(alias, mox.ListOwner, "").String())
+	return listNotify(ctx, log, alias, to, "Help for list "+list.String(), text, smtp.Path{}, nil)
+}
+
+// listRequestAdd registers a subscribe or unsubscribe request and sends a
+// confirmation request to the address.
+func listRequestAdd(ctx context.Context, log mlog.Log, alias config.Alias, cmd mox.ListCommand, addr smtp.Address) error {
+	list := listAddress(alias)
+	subscribe := cmd != mox.ListUnsubscribe
+
+	// Members configured in the alias can only be changed by the administrator.
+	for _, aa := range alias.ParsedAddresses {
+		if aa.Address == addr {
+			text := fmt.Sprintf("Your address %s is a member of mailing list %s through the configuration of the list, it cannot be changed by email. Please contact the owner of the list at:\n\n\t%s\n", addr, list, listCommandPath(alias, mox.ListOwner, "").String())
+			return listNotify(ctx, log, alias, addr, "Request for list "+list.String(), text, smtp.Path{}, nil)
+		}
+	}
+
+	token, err := listToken()
+	if err != nil {
+		return fmt.Errorf("generating token: %v", err)
+	}
+	var member bool
+	err = DB.Write(ctx, func(tx *bstore.Tx) error {
+		member, err = bstore.QueryTx[ListMember](tx).FilterNonzero(ListMember{List: list.Pack(true), Address: addr.Pack(true)}).Exists()
+		if err != nil {
+			return fmt.Errorf("looking up member: %v", err)
+		}
+		if !subscribe && !member {
+			return nil
+		}
+		// Replace an earlier pending request.
+		_, err := bstore.QueryTx[ListRequest](tx).FilterNonzero(ListRequest{List: list.Pack(true), Address: addr.Pack(true)}).Delete()
+		if err != nil {
+			return fmt.Errorf("removing previous requests: %v", err)
+		}
+		lr := ListRequest{
+			Token:     token,
+			List:      list.Pack(true),
+			Address:   addr.Pack(true),
+			Subscribe: subscribe,
+			Digest:    cmd == mox.ListSubscribeDigest,
+		}
+		return tx.Insert(&lr)
+	})
+	if err != nil {
+		return err
+	}
+
+	if !subscribe && !member {
+		text := fmt.Sprintf("Your address %s is not a member of mailing list %s, nothing to unsubscribe.\n", addr, list)
+		return listNotify(ctx, log, alias, addr, "Request for list "+list.String(), text, smtp.Path{}, nil)
+	}
+
+	confirm := listCommandPath(alias, mox.ListConfirm, token)
+	what := "subscribe to"
+	if !subscribe {
+		what = "unsubscribe from"
+	} else if cmd == mox.ListSubscribeDigest {
+		what = "subscribe in digest mode to"
+	}
+	text := fmt.Sprintf(`A request was received to %s mailing list %s for address %s.
+
+To confirm, reply to this message, or send a message to:
+
+	%s
+
+If you did not make this request, you can ignore this message. The request
+expires in %d days.
+`, what, list, addr, confirm.String(), int(listRequestExpiration/(24*time.Hour)))
+	log.Info("list request registered, confirmation requested", slog.Any("address", addr), slog.Bool("subscribe", subscribe))
+	return listNotify(ctx, log, alias, addr, "Confirm request for list "+list.String(), text, confirm, nil)
+}
+
+// listConfirm applies a confirmed subscribe or unsubscribe request.
+func listConfirm(ctx context.Context, log mlog.Log, alias config.Alias, token string) error {
+	list := listAddress(alias)
+	var lr ListRequest
+	err := DB.Write(ctx, func(tx *bstore.Tx) error {
+		var err error
+		lr, err = bstore.QueryTx[ListRequest](tx).FilterNonzero(ListRequest{Token: token, List: list.Pack(true)}).Get()
+		if err == bstore.ErrAbsent {
+			return err
+		} else if err != nil {
+			return fmt.Errorf("looking up request: %v", err)
+		}
+		if err := tx.Delete(&lr); err != nil {
+			return fmt.Errorf("removing request: %v", err)
+		}
+
+		q := bstore.QueryTx[ListMember](tx).FilterNonzero(ListMember{List: lr.List, Address: lr.Address})
+		if !lr.Subscribe {
+			_, err := q.Delete()
+			return err
+		}
+		lm, err := q.Get()
+		if err == bstore.ErrAbsent {
+			memberToken, err := listToken()
+			if err != nil {
+				return fmt.Errorf("generating token: %v", err)
+			}
+			lm = ListMember{List: lr.List, Address: lr.Address, Digest: lr.Digest, Token: memberToken}
+			return tx.Insert(&lm)
+		} else if err != nil {
+			return fmt.Errorf("looking up member: %v", err)
+		}
+		lm.Digest = lr.Digest
+		return tx.Update(&lm)
+	})
+	if err == bstore.ErrAbsent {
+		log.Info("unknown or expired list confirmation token, ignoring")
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	addr, err := smtp.ParseAddress(lr.Address)
+	if err != nil {
+		return fmt.Errorf("parsing address: %v", err)
+	}
+	log.Info("list request confirmed", slog.Any("address", addr), slog.Bool("subscribe", lr.Subscribe), slog.Bool("digest", lr.Digest))
+	var text string
+	if lr.Subscribe {
+		text = fmt.Sprintf("Your address %s is now subscribed to mailing list %s.\n\nTo unsubscribe, send a message to:\n\n\t%s\n", addr, list, listCommandPath(alias, mox.ListUnsubscribe, "").String())
+	} else {
+		text = fmt.Sprintf("Your address %s is now unsubscribed from mailing list %s.\n", addr, list)
+	}
+	return listNotify(ctx, log, alias, addr, "Confirmed request for list "+list.String(), text, smtp.Path{}, nil)
+}
+
+// ListUnsubscribe removes the member that subscribed by email with the token
+// from the list.
+func ListUnsubscribe(ctx context.Context, log mlog.Log, token string) (list, address string, rerr error) {
+	err := DB.Write(ctx, func(tx *bstore.Tx) error {
+		m, err := bstore.QueryTx[ListMember](tx).FilterNonzero(ListMember{Token: token}).Get()
+		if err != nil {
+			return err
+		}
+		list, address = m.List, m.Address
+		return tx.Delete(&m)
+	})
+	if err == nil {
+		log.Info("list member unsubscribed by token", slog.String("list", list), slog.String("address", address))
+	}
+	return list, address, err
+}
+
+// listModerate approves or rejects a held message.
+func listModerate(ctx context.Context, log mlog.Log, alias config.Alias, token string, approve bool) error {
+	var m ListMsg
+	err := DB.Read(ctx, func(tx *bstore.Tx) error {
+		var err error
+		m, err = bstore.QueryTx[ListMsg](tx).FilterNonzero(ListMsg{Token: token, List: listAddress(alias).Pack(true), Held: true}).Get()
+		return err
+	})
+	if err == bstore.ErrAbsent {
+		log.Info("unknown or expired token for held list message, ignoring")
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("looking up held message: %v", err)
+	}
+	log = log.With(slog.Int64("listmsgid", m.ID), slog.Bool("approve", approve))
+
+	if approve {
+		if err := listApprove(ctx, log, alias, m); err != nil {
+			return err
+		}
+	}
+	err = DB.Write(ctx, func(tx *bstore.Tx) error {
+		return listMsgRemove(log, tx, m)
+	})
+	if err != nil {
+		return fmt.Errorf("removing held message: %v", err)
+	}
+	log.Info("held list message processed")
+	return nil
+}
+
+// listApprove delivers a held message to all members: local members directly,
+// other members through the queue.
+func listApprove(ctx context.Context, log mlog.Log, alias config.Alias, m ListMsg) error {
+	f, err := os.Open(m.MessagePath())
+	if err != nil {
+		return fmt.Errorf("open held message: %v", err)
+	}
+	defer func() {
+		err := f.Close()
+		log.Check(err, "closing held message")
+	}()
+
+	lm := ListMessage{
+		MailFrom:  m.MailFrom,
+		Has8bit:   m.Has8bit,
+		SMTPUTF8:  m.SMTPUTF8,
+		MessageID: m.MessageID,
+		Subject:   m.Subject,
+		Size:      m.Size,
+	}
+	lm.MsgFrom, _ = smtp.ParseAddress(m.MsgFrom)
+
+	for _, aa := range alias.ParsedAddresses {
+		if aa.AccountName == "" || aa.Address == lm.MsgFrom {
+			continue
+		}
+		if err := listDeliverLocal(log, aa, m, f); err != nil {
+			log.Errorx("delivering approved list message to local member", err, slog.Any("member", aa.Address))
+		}
+	}
+	return ListDeliver(ctx, log, alias, lm, f, nil)
+}
+
+func listDeliverLocal(log mlog.Log, aa config.AliasAddress, m ListMsg, f *os.File) error {
+	acc, err := store.OpenAccount(log, aa.AccountName)
+	if err != nil {
+		return fmt.Errorf("open account: %v", err)
+	}
+	defer func() {
+		err := acc.Close()
+		log.Check(err, "closing account")
+	}()
+
+	prefix := []byte("Delivered-To: " + aa.Address.Path().XString(m.SMTPUTF8) + "\r\n" + "Return-Path: <" + m.MailFrom + ">\r\n")
+	msgFrom, _ := smtp.ParseAddress(m.MsgFrom)
+	sm := store.Message{
+		Received:         time.Now(),
+		MailFrom:         m.MailFrom,
+		RcptToLocalpart:  aa.Address.Localpart,
+		RcptToDomain:     aa.Address.Domain.Name(),
+		MsgFromLocalpart: msgFrom.Localpart,
+		MsgFromDomain:    msgFrom.Domain.Name(),
+		MsgPrefix:        prefix,
+		Size:             int64(len(prefix)) + m.Size,
+		IsMailingList:    true,
+	}
+	acc.WithWLock(func() {
+		_, err = acc.DeliverDestination(log, aa.Destination, &sm, f)
+	})
+	return err
+}
+
+// startListDigests periodically sends digests and removes expired list
+// requests and held messages.
+func startListDigests(done chan struct{}) {
+	log := mlog.New("queue", nil)
+
+	defer func() {
+		x := recover()
+		if x != nil {
+			log.Error("unhandled panic in startListDigests", slog.Any("x", x))
+			debug.PrintStack()
+			metrics.PanicInc(metrics.Queue)
+		}
+	}()
+
+	timer := time.NewTimer(time.Minute)
+	for {
+		select {
+		case <-mox.Shutdown.Done():
+			done <- struct{}{}
+			return
+		case <-timer.C:
+		}
+
+		listMaintenance(mox.Shutdown, log, time.Now())
+		timer.Reset(10 * time.Minute)
+	}
+}
+
+// listMaintenance sends digests for lists with messages older than the digest
+// interval, and removes expired requests and held messages.
+func listMaintenance(ctx context.Context, log mlog.Log, now time.Time) {
+	err := DB.Write(ctx, func(tx *bstore.Tx) error {
+		_, err := bstore.QueryTx[ListRequest](tx).FilterLess("Created", now.Add(-listRequestExpiration)).Delete()
+		if err != nil {
+			return fmt.Errorf("removing expired list requests: %v", err)
+		}
+		l, err := bstore.QueryTx[ListMsg](tx).FilterEqual("Held", true).FilterLess("Received", now.Add(-listHeldExpiration)).List()
+		if err != nil {
+			return fmt.Errorf("listing expired held list messages: %v", err)
+		}
+		for _, m := range l {
+			if err := listMsgRemove(log, tx, m); err != nil {
+				return fmt.Errorf("removing expired held list message: %v", err)
+			}
+		}
+		return nil
+	})
+	log.Check(err, "cleaning up list requests and held messages")
+
+	// Gather lists with messages pending for a digest.
+	var pending []ListMsg
+	err = DB.Read(ctx, func(tx *bstore.Tx) error {
+		var err error
+		pending, err = bstore.QueryTx[ListMsg](tx).FilterEqual("Held", false).SortAsc("ID").List()
+		return err
+	})
+	if err != nil {
+		log.Errorx("listing pending digest messages", err)
+		return
+	}
+	lists := map[string][]ListMsg{}
+	for _, m := range pending {
+		lists[m.List] = append(lists[m.List], m)
+	}
+	for list, msgs := range lists {
+		if err := listDigest(ctx, log, list, msgs, now); err != nil {
+			log.Errorx("sending list digest", err, slog.String("list", list))
+		}
+	}
+}
+
+// listDigest sends a digest with msgs for list to members in digest mode if the
+// oldest message is older than the digest interval.
+func listDigest(ctx context.Context, log mlog.Log, list string, msgs []ListMsg, now time.Time) (rerr error) {
+	log = log.With(slog.String("list", list))
+
+	remove := func() error {
+		return DB.Write(ctx, func(tx *bstore.Tx) error {
+			for _, m := range msgs {
+				if err := listMsgRemove(log, tx, m); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+
+	addr, err := smtp.ParseAddress(list)
+	if err != nil {
+		return fmt.Errorf("parsing list address: %v", err)
+	}
+	_, alias, _, _, err := mox.LookupAddress(addr.Localpart, addr.Domain, false, true)
+	if err != nil || alias == nil || alias.ListOwner == "" {
+		log.Info("removing pending digest messages for list that no longer exists")
+		return remove()
+	}
+	interval := alias.DigestInterval
+	if interval == 0 {
+		interval = 24 * time.Hour
+	}
+	if now.Sub(msgs[0].Received) < interval {
+		return nil
+	}
+
+	var members []listMember
+	dbmembers, err := ListMemberList(ctx, *alias)
+	if err != nil {
+		return fmt.Errorf("listing members: %v", err)
+	}
+	for _, m := range dbmembers {
+		if !m.Digest {
+			continue
+		}
+		a, err := smtp.ParseAddress(m.Address)
+		if err != nil {
+			log.Errorx("parsing address of list member, skipping", err, slog.String("address", m.Address))
+			continue
+		}
+		members = append(members, listMember{a, m.Token})
+	}
+	if len(members) == 0 {
+		log.Debug("no digest members for list, removing pending digest messages")
+		return remove()
+	}
+
+	msgFile, err := store.CreateMessageTemp(log, "list-digest")
+	if err != nil {
+		return fmt.Errorf("creating temporary message file: %w", err)
+	}
+	defer store.CloseRemoveTempFile(log, msgFile, "list digest message")
+
+	var has8bit, smtputf8 bool
+	var size int64
+	for _, m := range msgs {
+		has8bit = has8bit || m.Has8bit
+		smtputf8 = smtputf8 || m.SMTPUTF8
+		size += m.Size
+	}
+
+	xc := message.NewComposer(msgFile, size+1024*1024, smtputf8)
+	defer func() {
+		x := recover()
+		if x == nil {
+			return
+		}
+		if err, ok := x.(error); ok && errors.Is(err, message.ErrCompose) {
+			rerr = err
+			return
+		}
+		panic(x)
+	}()
+
+	// A multipart/digest, with a table of contents as first part. ../rfc/2046:1411 ../rfc/1153:85
+	subject := fmt.Sprintf("Digest for %s, %d messages", addr, len(msgs))
+	xc.HeaderAddrs("From", []message.NameAddress{{Address: addr}})
+	xc.HeaderAddrs("To", []message.NameAddress{{Address: addr}})
+	xc.Subject(subject)
+	messageID := fmt.Sprintf("<%s>", mox.MessageIDGen(xc.SMTPUTF8))
+	xc.Header("Message-Id", messageID)
+	xc.Header("Date", now.Format(message.RFC5322Z))
+	xc.Header("User-Agent", "mox/"+moxvar.Version)
+	xc.Header("MIME-Version", "1.0")
+	mp := multipart.NewWriter(xc)
+	xc.Header("Content-Type", fmt.Sprintf(`multipart/digest; boundary="%s"`, mp.Boundary()))
+	xc.Line()
+
+	toc := fmt.Sprintf("Digest for mailing list %s, with %d messages:\n\n", addr, len(msgs))
+	for i, m := range msgs {
+		toc += fmt.Sprintf("%d. %s\n   From: %s\n", i+1, m.Subject, m.MsgFrom)
+	}
+	textBody, ct, cte := xc.TextPart("plain", toc)
+	textHdr := textproto.MIMEHeader{}
+	textHdr.Set("Content-Type", ct)
+	textHdr.Set("Content-Transfer-Encoding", cte)
+	textp, err := mp.CreatePart(textHdr)
+	xc.Checkf(err, "adding table of contents")
+	_, err = textp.Write(textBody)
+	xc.Checkf(err, "writing table of contents")
+
+	for _, m := range msgs {
+		// Default content-type in a digest is message/rfc822.
+		p, err := mp.CreatePart(textproto.MIMEHeader{})
+		xc.Checkf(err, "adding message to digest")
+		f, err := os.Open(m.MessagePath())
+		xc.Checkf(err, "open message for digest")
+		_, err = io.Copy(p, f)
+		if xerr := f.Close(); xerr != nil {
+			log.Check(xerr, "closing message file")
+		}
+		xc.Checkf(err, "adding message to digest")
+	}
+	err = mp.Close()
+	xc.Checkf(err, "closing multipart")
+	xc.Flush()
+	xc.Has8bit = xc.Has8bit || has8bit
+
+	if err := listQueue(ctx, log, *alias, members, xc.Has8bit, xc.SMTPUTF8, messageID, subject, xc.Size, msgFile); err != nil {
+		return fmt.Errorf("queueing digest: %v", err)
+	}
+	log.Info("list digest queued", slog.Int("nmessages", len(msgs)), slog.Int("nmembers", len(members)))
+	return remove()
+}
@@ -0,0 +1,272 @@
+package queue
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/dsn"
+	"github.com/mjl-/mox/message"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/smtp"
+	"github.com/mjl-/mox/store"
+)
+
+func TestList(t *testing.T) {
+	acc, cleanup := setup(t)
+	defer cleanup()
+
+	dom := dns.Domain{ASCII: "mox.example"}
+	_, alias, _, _, err := mox.LookupAddress("list", dom, false, true)
+	tcheck(t, err, "lookup alias")
+	tcompare(t, alias != nil, true)
+	tcompare(t, alias.ParsedListOwner.AccountName, "hook")
+
+	// Command addresses.
+	testLookup := func(lp string, expCmd mox.ListCommand, expParam string) {
+		t.Helper()
+		_, cmd, param, ok := mox.LookupListAddress(smtp.Localpart(lp), dom)
+		tcompare(t, ok, expCmd != "")
+		tcompare(t, cmd, expCmd)
+		tcompare(t, param, expParam)
+	}
+	testLookup("list-subscribe", mox.ListSubscribe, "")
+	testLookup("List-Subscribe-Digest", mox.ListSubscribeDigest, "")
+	testLookup("list-bounces-a=remote.example", mox.ListBounces, "a=remote.example")
+	testLookup("list-confirm-abc", mox.ListConfirm, "abc")
+	testLookup("list-confirm-", "", "")
+	testLookup("list-bogus", "", "")
+	testLookup("mjl", "", "")
+	testLookup("list", "", "")
+
+	parseAddr := func(s string) smtp.Address {
+		t.Helper()
+		a, err := smtp.ParseAddress(s)
+		tcheck(t, err, "parse address")
+		return a
+	}
+	// Message file and parsed part.
+	prepare := func(data string) (*os.File, *message.Part) {
+		t.Helper()
+		f, err := store.CreateMessageTemp(pkglog, "list")
+		tcheck(t, err, "create temp file")
+		_, err = f.Write([]byte(data))
+		tcheck(t, err, "write message")
+		p, err := message.Parse(pkglog.Logger, false, f)
+		tcheck(t, err, "parse message")
+		return f, &p
+	}
+	queued := func(rcpt string) []Msg {
+		t.Helper()
+		a := parseAddr(rcpt)
+		l, err := bstore.QueryDB[Msg](ctxbg, DB).FilterNonzero(Msg{RecipientLocalpart: a.Localpart, RecipientDomainStr: a.Domain.Name()}).SortAsc("ID").List()
+		tcheck(t, err, "list queued messages")
+		return l
+	}
+	lastPrefix := func(rcpt string) string {
+		t.Helper()
+		l := queued(rcpt)
+		if len(l) == 0 {
+			t.Fatalf("no queued messages for %s", rcpt)
+		}
+		return string(l[len(l)-1].MsgPrefix)
+	}
+
+	subscribe := func(addr string, cmd mox.ListCommand) {
+		t.Helper()
+		f, part := prepare(testmsg)
+		defer store.CloseRemoveTempFile(pkglog, f, "test")
+
+		n := len(queued(addr))
+		err := ListIncoming(ctxbg, pkglog, *alias, cmd, "", parseAddr(addr), part, f)
+		tcheck(t, err, "list subscribe")
+		l := queued(addr)
+		tcompare(t, len(l), n+1) // Confirmation request.
+		tcompare(t, l[n].Sender().String(), "list-bounces-"+strings.Replace(addr, "@", "=", 1)+"@mox.example")
+
+		lr, err := bstore.QueryDB[ListRequest](ctxbg, DB).FilterNonzero(ListRequest{Address: addr}).Get()
+		tcheck(t, err, "get list request")
+		tcompare(t, lr.Digest, cmd == mox.ListSubscribeDigest)
+
+		// Confirmation with unknown token is ignored.
+		err = ListIncoming(ctxbg, pkglog, *alias, mox.ListConfirm, "bogus", parseAddr(addr), part, f)
+		tcheck(t, err, "confirm with bogus token")
+
+		err = ListIncoming(ctxbg, pkglog, *alias, mox.ListConfirm, lr.Token, parseAddr(addr), part, f)
+		tcheck(t, err, "confirm")
+		tcompare(t, len(queued(addr)), n+2) // Confirmed notice.
+		member, err := ListIsMember(ctxbg, *alias, parseAddr(addr))
+		tcheck(t, err, "is member")
+		tcompare(t, member, true)
+	}
+	subscribe("sub@remote.example", mox.ListSubscribe)
+	subscribe("dig@remote.example", mox.ListSubscribeDigest)
+
+	members, err := ListMemberList(ctxbg, *alias)
+	tcheck(t, err, "list members")
+	tcompare(t, len(members), 2)
+
+	// Configured members cannot unsubscribe by email, they get a notice.
+	f, part := prepare(testmsg)
+	defer store.CloseRemoveTempFile(pkglog, f, "test")
+	err = ListIncoming(ctxbg, pkglog, *alias, mox.ListUnsubscribe, "", parseAddr("remote@remote.example"), part, f)
+	tcheck(t, err, "unsubscribe configured member")
+	tcompare(t, len(queued("remote@remote.example")), 1)
+	n, err := bstore.QueryDB[ListRequest](ctxbg, DB).Count()
+	tcheck(t, err, "count list requests")
+	tcompare(t, n, 0)
+
+	// Message to the list is queued for the external and subscribed members, not for
+	// digest members, and not for the sender.
+	lm := ListMessage{
+		MailFrom:  "sub@remote.example",
+		MsgFrom:   parseAddr("sub@remote.example"),
+		MessageID: "<test@remote.example>",
+		Subject:   "test",
+		Size:      int64(len(testmsg)),
+	}
+	nsub := len(queued("sub@remote.example"))
+	err = ListDeliver(ctxbg, pkglog, *alias, lm, f, nil)
+	tcheck(t, err, "list deliver")
+	tcompare(t, len(queued("remote@remote.example")), 2)
+	tcompare(t, len(queued("sub@remote.example")), nsub)
+	tcompare(t, len(queued("dig@remote.example")), 2)
+	qm := queued("remote@remote.example")[1]
+	tcompare(t, qm.Sender().String(), "list-bounces-remote=remote.example@mox.example")
+	prefix := string(qm.MsgPrefix)
+	for _, s := range []string{"List-Id: <list.mox.example>\r\n", "List-Post: <mailto:list@mox.example>\r\n", "List-Unsubscribe: <mailto:list-unsubscribe@mox.example?subject=unsubscribe>\r\n", "List-Subscribe: "} {
+		if !strings.Contains(prefix, s) {
+			t.Fatalf("missing %q in message prefix %q", s, prefix)
+		}
+	}
+	tcompare(t, qm.Size, int64(len(qm.MsgPrefix))+int64(len(testmsg)))
+
+	// Stored for digest.
+	lml, err := bstore.QueryDB[ListMsg](ctxbg, DB).List()
+	tcheck(t, err, "list list messages")
+	tcompare(t, len(lml), 1)
+	tcompare(t, lml[0].Held, false)
+
+	// A message that already went through the list is not distributed again.
+	floop, _ := prepare("List-Id: <list.mox.example>\r\n" + testmsg)
+	defer store.CloseRemoveTempFile(pkglog, floop, "test")
+	err = ListDeliver(ctxbg, pkglog, *alias, lm, floop, nil)
+	tcheck(t, err, "list deliver loop")
+	tcompare(t, len(queued("remote@remote.example")), 2)
+
+	// No digest before the interval has passed.
+	listMaintenance(ctxbg, pkglog, time.Now())
+	tcompare(t, len(queued("dig@remote.example")), 2)
+	listMaintenance(ctxbg, pkglog, time.Now().Add(2*time.Hour))
+	tcompare(t, len(queued("dig@remote.example")), 3)
+	digest := lastPrefix("dig@remote.example")
+	if !strings.Contains(digest, "List-Id: <list.mox.example>\r\n") {
+		t.Fatalf("missing list-id header in digest prefix %q", digest)
+	}
+	dm := queued("dig@remote.example")[2]
+	tcompare(t, dm.Subject, "Digest for list@mox.example, 1 messages")
+	dmf, err := os.ReadFile(dm.MessagePath())
+	tcheck(t, err, "read digest")
+	if !bytes.Contains(dmf, []byte("multipart/digest")) || !bytes.Contains(dmf, []byte("test email")) {
+		t.Fatalf("unexpected digest message %q", dmf)
+	}
+	n, err = bstore.QueryDB[ListMsg](ctxbg, DB).Count()
+	tcheck(t, err, "count list messages")
+	tcompare(t, n, 0)
+
+	// Message from non-member is held, owner is notified.
+	lm.MailFrom = "other@remote.example"
+	lm.MsgFrom = parseAddr("other@remote.example")
+	err = ListHold(ctxbg, pkglog, *alias, lm, f)
+	tcheck(t, err, "hold")
+	tcompare(t, len(queued("hook@mox.example")), 1)
+	held, err := bstore.QueryDB[ListMsg](ctxbg, DB).FilterEqual("Held", true).Get()
+	tcheck(t, err, "get held message")
+	notify, err := os.ReadFile(queued("hook@mox.example")[0].MessagePath())
+	tcheck(t, err, "read owner notification")
+	if !bytes.Contains(notify, []byte("list-approve-"+held.Token+"@mox.example")) {
+		t.Fatalf("missing approve address in owner notification %q", notify)
+	}
+
+	// Only the owner can approve.
+	err = ListIncoming(ctxbg, pkglog, *alias, mox.ListApprove, held.Token, parseAddr("other@remote.example"), part, f)
+	tcheck(t, err, "approve by non-owner")
+	n, err = bstore.QueryDB[ListMsg](ctxbg, DB).Count()
+	tcheck(t, err, "count list messages")
+	tcompare(t, n, 1)
+
+	nmsgs, err := bstore.QueryDB[store.Message](ctxbg, acc.DB).Count()
+	tcheck(t, err, "count messages")
+	err = ListIncoming(ctxbg, pkglog, *alias, mox.ListApprove, held.Token, parseAddr("hook@mox.example"), part, f)
+	tcheck(t, err, "approve by owner")
+	n, err = bstore.QueryDB[ListMsg](ctxbg, DB).FilterEqual("Held", true).Count()
+	tcheck(t, err, "count list messages")
+	tcompare(t, n, 0)
+	tcompare(t, len(queued("remote@remote.example")), 3)
+	tcompare(t, len(queued("sub@remote.example")), nsub+1)
+	// Delivered to local member.
+	nmsgs2, err := bstore.QueryDB[store.Message](ctxbg, acc.DB).Count()
+	tcheck(t, err, "count messages")
+	tcompare(t, nmsgs2, nmsgs+1)
+
+	// Rejected held message is removed without delivery.
+	err = ListHold(ctxbg, pkglog, *alias, lm, f)
+	tcheck(t, err, "hold")
+	held, err = bstore.QueryDB[ListMsg](ctxbg, DB).FilterEqual("Held", true).Get()
+	tcheck(t, err, "get held message")
+	err = ListIncoming(ctxbg, pkglog, *alias, mox.ListReject, held.Token, parseAddr("hook@mox.example"), part, f)
+	tcheck(t, err, "reject by owner")
+	n, err = bstore.QueryDB[ListMsg](ctxbg, DB).FilterEqual("Held", true).Count()
+	tcheck(t, err, "count list messages")
+	tcompare(t, n, 0)
+	tcompare(t, len(queued("remote@remote.example")), 3)
+
+	// Bounce for member adds it to the suppression list of the list owner, and it
+	// won't get messages anymore.
+	remote := parseAddr("remote@remote.example").Path()
+	dsnmsg := &dsn.Message{
+		From:         smtp.Path{Localpart: "postmaster", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: "remote.example"}}},
+		To:           listBouncesPath(*alias, parseAddr("remote@remote.example")),
+		TextBody:     "explanation",
+		MessageID:    "<dsnmsgid@remote.example>",
+		ReportingMTA: "remote.example",
+		Recipients: []dsn.Recipient{
+			{
+				FinalRecipient:     remote,
+				Action:             dsn.Failed,
+				Status:             "5.1.1",
+				DiagnosticCodeSMTP: "550 5.1.1 no such user",
+			},
+		},
+	}
+	dsnbuf, err := dsnmsg.Compose(pkglog, false)
+	tcheck(t, err, "compose dsn")
+	fdsn, partdsn := prepare(string(dsnbuf))
+	defer store.CloseRemoveTempFile(pkglog, fdsn, "test")
+	err = ListIncoming(ctxbg, pkglog, *alias, mox.ListBounces, "remote=remote.example", smtp.Address{}, partdsn, fdsn)
+	tcheck(t, err, "process bounce")
+	sup, err := SuppressionLookup(ctxbg, "hook", remote)
+	tcheck(t, err, "lookup suppression")
+	tcompare(t, sup != nil, true)
+
+	lm.MsgFrom = parseAddr("mjl@mox.example")
+	err = ListDeliver(ctxbg, pkglog, *alias, lm, f, nil)
+	tcheck(t, err, "list deliver")
+	tcompare(t, len(queued("remote@remote.example")), 3)
+	tcompare(t, len(queued("sub@remote.example")), nsub+2)
+
+	// One-click unsubscribe.
+	members, err = ListMemberList(ctxbg, *alias)
+	tcheck(t, err, "list members")
+	list, address, err := ListUnsubscribe(ctxbg, pkglog, members[0].Token)
+	tcheck(t, err, "unsubscribe")
+	tcompare(t, list, "list@mox.example")
+	tcompare(t, address, members[0].Address)
+	_, _, err = ListUnsubscribe(ctxbg, pkglog, members[0].Token)
+	tcompare(t, err, bstore.ErrAbsent)
+}
@@ -25,6 +25,7 @@ import (
 
 	"github.com/mjl-/bstore"
 
+	"github.com/mjl-/mox/admindb"
 	"github.com/mjl-/mox/config"
 	"github.com/mjl-/mox/dns"
 	"github.com/mjl-/mox/dsn"
@@ -78,8 +79,8 @@ var (
 
 var jitter = mox.NewPseudoRand()
 
-var DBTypes = []any{Msg{}, HoldRule{}, MsgRetired{}, webapi.Suppression{}, Hook{}, HookRetired{}} // Types stored in DB.
-var DB *bstore.DB                                                                                 // Exported for making backups.
+var DBTypes = []any{Msg{}, HoldRule{}, MsgRetired{}, webapi.Suppression{}, Hook{}, HookRetired{}, ListMember{}, ListRequest{}, ListMsg{}, RateLimitDay{}} // Types stored in DB.
+var DB *bstore.DB                                                                                                                                         // Exported for making backups.
 
 // Allow requesting delivery starting from up to this interval from time of submission.
 const FutureReleaseIntervalMax = 60 * 24 * time.Hour
@@ -158,6 +159,11 @@ type Msg struct {
 	// rules apply.
 	Transport string
 
+	// If non-empty, the name of the IP pool of a direct transport to make outgoing
+	// connections from, e.g. as requested through the webapi. Takes precedence over
+	// Transport and routes.
+	IPPool string
+
 	// RequireTLS influences TLS verification during delivery.
 	//
 	// If nil, the recipient domain policy is followed (MTA-STS and/or DANE), falling
@@ -179,7 +185,23 @@ type Msg struct {
 	FutureReleaseRequest string
 	// ../rfc/4865:305
 
+	// For messages submitted through webmail or the webapi with a scheduled delivery
+	// time or an "undo send" grace period, the time of the first delivery attempt.
+	// Until the first delivery attempt, the sending account can cancel the message or
+	// change this time, see ScheduledCancel and ScheduledReschedule. Zero for other
+	// messages.
+	SendAt time.Time
+
+	// Whether SendAt is the end of an "undo send" grace period, instead of a delivery
+	// time scheduled by the sender.
+	UndoSend bool
+
 	Extra map[string]string // Extra information, for transactional email.
+
+	// If set, the name of the outgoing rate limit that postponed the most recent
+	// delivery attempt, which did not count as an attempt. Cleared when delivery is
+	// attempted.
+	RateLimited string
 }
 
 // MsgResult is the result (or work in progress) of a delivery attempt.
@@ -260,6 +282,7 @@ func (m Msg) Retired(success bool, t, keepUntil time.Time) MsgRetired {
 		MessageID:            m.MessageID,
 		Subject:              m.Subject,
 		Transport:            m.Transport,
+		IPPool:               m.IPPool,
 		RequireTLS:           m.RequireTLS,
 		FutureReleaseRequest: m.FutureReleaseRequest,
 		Extra:                m.Extra,
@@ -301,6 +324,7 @@ type MsgRetired struct {
 	Subject       string // For context about delivery.
 
 	Transport            string
+	IPPool               string
 	RequireTLS           *bool
 	FutureReleaseRequest string
 
@@ -464,6 +488,48 @@ func (f Filter) apply(q *bstore.Query[Msg]) error {
 	return nil
 }
 
+// String returns a description of the filter, for the audit log.
+func (f Filter) String() string {
+	var l []string
+	if f.Max != 0 {
+		l = append(l, fmt.Sprintf("max %d", f.Max))
+	}
+	if len(f.IDs) > 0 {
+		l = append(l, fmt.Sprintf("ids %v", f.IDs))
+	}
+	if f.Account != "" {
+		l = append(l, fmt.Sprintf("account %q", f.Account))
+	}
+	if f.From != "" {
+		l = append(l, fmt.Sprintf("from %q", f.From))
+	}
+	if f.To != "" {
+		l = append(l, fmt.Sprintf("to %q", f.To))
+	}
+	if f.Hold != nil {
+		l = append(l, fmt.Sprintf("hold %v", *f.Hold))
+	}
+	if f.Submitted != "" {
+		l = append(l, fmt.Sprintf("submitted %s", f.Submitted))
+	}
+	if f.NextAttempt != "" {
+		l = append(l, fmt.Sprintf("next attempt %s", f.NextAttempt))
+	}
+	if f.Transport != nil {
+		l = append(l, fmt.Sprintf("transport %q", *f.Transport))
+	}
+	if len(l) == 0 {
+		return "all"
+	}
+	return strings.Join(l, ", ")
+}
+
+// audit adds an entry for an operation on the queue to the audit log.
+func audit(ctx context.Context, format string, args ...any) {
+	log := mlog.New("queue", nil).WithContext(ctx)
+	admindb.AuditAdd(ctx, log, admindb.AuditQueue, fmt.Sprintf(format, args...))
+}
+
 type Sort struct {
 	Field  string // "Queued" or "NextAttempt"/"".
 	LastID int64  // If > 0, we return objects beyond this, less/greater depending on Asc.
@@ -579,6 +645,7 @@ func HoldRuleAdd(ctx context.Context, log mlog.Log, hr HoldRule) (HoldRule, erro
 		return HoldRule{}, err
 	}
 	log.Info("marked messages in queue as on hold", slog.Int("messages", n))
+	audit(ctx, "hold rule %d added for account %q, sender domain %q, recipient domain %q; %d messages marked on hold", hr.ID, hr.Account, hr.SenderDomainStr, hr.RecipientDomainStr, n)
 	msgqueueKick()
 	return hr, nil
 }
@@ -586,7 +653,7 @@ func HoldRuleAdd(ctx context.Context, log mlog.Log, hr HoldRule) (HoldRule, erro
 // HoldRuleRemove removes a hold rule. The Hold field of existing messages are not
 // changed.
 func HoldRuleRemove(ctx context.Context, log mlog.Log, holdRuleID int64) error {
-	return DB.Write(ctx, func(tx *bstore.Tx) error {
+	err := DB.Write(ctx, func(tx *bstore.Tx) error {
 		hr := HoldRule{ID: holdRuleID}
 		if err := tx.Get(&hr); err != nil {
 			return err
@@ -594,6 +661,10 @@ func HoldRuleRemove(ctx context.Context, log mlog.Log, holdRuleID int64) error {
 		log.Info("removing hold rule", slog.Any("holdrule", hr))
 		return tx.Delete(HoldRule{ID: holdRuleID})
 	})
+	if err == nil {
+		audit(ctx, "hold rule %d removed", holdRuleID)
+	}
+	return err
 }
 
 // MakeMsg is a convenience function that sets the commonly used fields for a Msg.
@@ -792,6 +863,7 @@ func NextAttemptAdd(ctx context.Context, filter Filter, d time.Duration) (affect
 	if err != nil {
 		return 0, err
 	}
+	audit(ctx, "next attempt of %d messages delayed by %s, filter %s", affected, d, filter)
 	msgqueueKick()
 	return affected, nil
 }
@@ -807,6 +879,7 @@ func NextAttemptSet(ctx context.Context, filter Filter, t time.Time) (affected i
 	if err != nil {
 		return 0, fmt.Errorf("selecting and updating messages in queue: %v", err)
 	}
+	audit(ctx, "next attempt of %d messages set to %s, filter %s", n, t.Format(time.RFC3339), filter)
 	msgqueueKick()
 	return n, nil
 }
@@ -828,6 +901,7 @@ func HoldSet(ctx context.Context, filter Filter, hold bool) (affected int, err e
 	if err != nil {
 		return 0, err
 	}
+	audit(ctx, "hold of %d messages set to %v, filter %s", affected, hold, filter)
 	msgqueueKick()
 	return affected, nil
 }
@@ -842,6 +916,7 @@ func TransportSet(ctx context.Context, filter Filter, transport string) (affecte
 	if err != nil {
 		return 0, fmt.Errorf("selecting and updating messages in queue: %v", err)
 	}
+	audit(ctx, "transport of %d messages set to %q, filter %s", n, transport, filter)
 	msgqueueKick()
 	return n, nil
 }
@@ -908,6 +983,11 @@ func failDrop(ctx context.Context, log mlog.Log, filter Filter, fail bool) (affe
 	if err != nil {
 		return 0, err
 	}
+	if fail {
+		audit(ctx, "%d messages failed, filter %s", len(msgs), filter)
+	} else {
+		audit(ctx, "%d messages dropped, filter %s", len(msgs), filter)
+	}
 	if len(msgs) > 0 {
 		if err := removeMsgsFS(log, msgs...); err != nil {
 			return len(msgs), fmt.Errorf("removing queue messages from file system: %w", err)
@@ -924,6 +1004,15 @@ func RequireTLSSet(ctx context.Context, filter Filter, requireTLS *bool) (affect
 		return 0, err
 	}
 	n, err := q.UpdateFields(map[string]any{"RequireTLS": requireTLS})
+	if err == nil {
+		var s string
+		if requireTLS == nil {
+			s = "default"
+		} else {
+			s = fmt.Sprintf("%v", *requireTLS)
+		}
+		audit(ctx, "requiretls of %d messages set to %s, filter %s", n, s, filter)
+	}
 	msgqueueKick()
 	return n, err
 }
@@ -1106,6 +1195,7 @@ func Start(resolver dns.Resolver, done chan struct{}) error {
 
 	go cleanupMsgRetired(done)
 	go cleanupHookRetired(done)
+	go startListDigests(done)
 
 	return nil
 }
@@ -1178,12 +1268,23 @@ func startQueue(resolver dns.Resolver, done chan struct{}) {
 }
 
 func nextWork(ctx context.Context, log mlog.Log, busyDomains map[string]struct{}) time.Duration {
+	// Domains that are rate limited are skipped until their limit allows delivery.
+	now := time.Now()
+	limitedDomains := rateLimitedDomains(now)
+	next := 24 * time.Hour
+	for _, t := range limitedDomains {
+		next = min(next, t.Sub(now))
+	}
+
 	q := bstore.QueryDB[Msg](ctx, DB)
-	if len(busyDomains) > 0 {
+	if len(busyDomains) > 0 || len(limitedDomains) > 0 {
 		var doms []any
 		for d := range busyDomains {
 			doms = append(doms, d)
 		}
+		for d := range limitedDomains {
+			doms = append(doms, d)
+		}
 		q.FilterNotEqual("RecipientDomainStr", doms...)
 	}
 	q.FilterEqual("Hold", false)
@@ -1191,25 +1292,31 @@ func nextWork(ctx context.Context, log mlog.Log, busyDomains map[string]struct{}
 	q.Limit(1)
 	qm, err := q.Get()
 	if err == bstore.ErrAbsent {
-		return 24 * time.Hour
+		return next
 	} else if err != nil {
 		log.Errorx("finding time for next delivery attempt", err)
 		return 1 * time.Minute
 	}
-	return time.Until(qm.NextAttempt)
+	return min(next, time.Until(qm.NextAttempt))
 }
 
 func launchWork(log mlog.Log, resolver dns.Resolver, busyDomains map[string]struct{}) int {
+	now := time.Now()
+	limitedDomains := rateLimitedDomains(now)
+
 	q := bstore.QueryDB[Msg](mox.Shutdown, DB)
-	q.FilterLessEqual("NextAttempt", time.Now())
+	q.FilterLessEqual("NextAttempt", now)
 	q.FilterEqual("Hold", false)
 	q.SortAsc("NextAttempt")
 	q.Limit(maxConcurrentDeliveries)
-	if len(busyDomains) > 0 {
+	if len(busyDomains) > 0 || len(limitedDomains) > 0 {
 		var doms []any
 		for d := range busyDomains {
 			doms = append(doms, d)
 		}
+		for d := range limitedDomains {
+			doms = append(doms, d)
+		}
 		q.FilterNotEqual("RecipientDomainStr", doms...)
 	}
 	var msgs []Msg
@@ -1218,6 +1325,11 @@ func launchWork(log mlog.Log, resolver dns.Resolver, busyDomains map[string]stru
 		dom := m.RecipientDomainStr
 		if _, ok := busyDomains[dom]; !ok && !seen[dom] {
 			seen[dom] = true
+			if name, wait := rateLimitWait(log, rateLimitsDomain(m.RecipientDomain.Domain), 1); name != "" {
+				log.Debug("skipping recipient domain due to outgoing rate limit", slog.String("domain", dom), slog.String("ratelimit", name), slog.Duration("wait", wait))
+				rateLimitDomainDelay(dom, now.Add(wait))
+				return nil
+			}
 			msgs = append(msgs, m)
 		}
 		return nil
@@ -1338,6 +1450,18 @@ func deliver(log mlog.Log, resolver dns.Resolver, m0 Msg) {
 		}
 	}()
 
+	// Outgoing rate limits for the recipient domain are checked by the scheduler, but
+	// other deliveries may have been started since. The messages are counted once they
+	// are handed to a remote host, in deliverHost and deliverSubmit.
+	domainLimits := rateLimitsDomain(m0.RecipientDomain.Domain)
+	limitName, limitWait, limitDone := rateLimitAcquire(qlog, domainLimits, 1)
+	if limitName != "" {
+		qlog.Debug("not delivering due to outgoing rate limit for recipient domain", slog.String("ratelimit", limitName), slog.Duration("wait", limitWait))
+		rateLimitDomainDelay(m0.RecipientDomainStr, time.Now().Add(limitWait))
+		return
+	}
+	defer limitDone()
+
 	// We'll use a single transaction for the various checks, committing as soon as
 	// we're done with it.
 	xtx, err := DB.Begin(mox.Shutdown, true)
@@ -1378,6 +1502,7 @@ func deliver(log mlog.Log, resolver dns.Resolver, m0 Msg) {
 		origNextAttempt = m0.NextAttempt
 		m0.LastAttempt = &now
 		m0.NextAttempt = now.Add(backoff)
+		m0.RateLimited = ""
 		m0.Results = append(m0.Results, MsgResult{Start: now, Error: resultErrorDelivering})
 		if err := xtx.Update(&m0); err != nil {
 			return fmt.Errorf("update message to be delivered: %v", err)
@@ -1412,24 +1537,32 @@ func deliver(log mlog.Log, resolver dns.Resolver, m0 Msg) {
 		return
 	}
 
-	resolveTransport := func(mm Msg) (string, config.Transport, bool) {
+	resolveTransport := func(mm Msg) (string, config.Transport, string, bool) {
+		if mm.IPPool != "" {
+			transportName, transport, ok := ipPoolTransport(mm.IPPool)
+			return transportName, transport, mm.IPPool, ok
+		}
 		if mm.Transport != "" {
 			transport, ok := mox.Conf.Static.Transports[mm.Transport]
 			if !ok {
-				return "", config.Transport{}, false
+				return "", config.Transport{}, "", false
 			}
-			return mm.Transport, transport, ok
+			return mm.Transport, transport, "", ok
 		}
 		route := findRoute(mm.Attempts, mm)
-		return route.Transport, route.ResolvedTransport, true
+		return route.Transport, route.ResolvedTransport, route.IPPool, true
 	}
 
 	// Find route for transport to use for delivery attempt.
 	m0.Attempts--
-	transportName, transport, transportOK := resolveTransport(m0)
+	transportName, transport, ipPool, transportOK := resolveTransport(m0)
 	m0.Attempts++
 	if !transportOK {
-		failMsgsTx(qlog, xtx, []*Msg{&m0}, m0.DialedIPs, backoff, remoteMTA, fmt.Errorf("cannot find transport %q", m0.Transport))
+		err := fmt.Errorf("cannot find transport %q", m0.Transport)
+		if m0.IPPool != "" {
+			err = fmt.Errorf("cannot find ip pool %q", m0.IPPool)
+		}
+		failMsgsTx(qlog, xtx, []*Msg{&m0}, m0.DialedIPs, backoff, remoteMTA, err)
 		err = xtx.Commit()
 		qlog.Check(err, "commit processing failure to deliver messages")
 		xtx = nil
@@ -1441,26 +1574,34 @@ func deliver(log mlog.Log, resolver dns.Resolver, m0 Msg) {
 		qlog = qlog.With(slog.String("transport", transportName))
 		qlog.Debug("delivering with transport")
 	}
+	if ipPool != "" {
+		qlog = qlog.With(slog.String("ippool", ipPool))
+	}
 
 	// Attempt to gather more recipients for this identical message, only with the same
 	// recipient domain, and under the same conditions (recipientdomain, attempts,
-	// requiretls, transport). ../rfc/5321:3759
+	// requiretls, transport, ip pool). ../rfc/5321:3759
+	// The number of additional recipients is limited by outgoing rate limits for the
+	// recipient domain.
 	msgs := []*Msg{&m0}
-	if m0.BaseID != 0 {
+	if capacity := rateLimitCapacity(qlog, domainLimits); m0.BaseID != 0 && capacity != 0 {
 		gather := func() error {
 			q := bstore.QueryTx[Msg](xtx)
 			q.FilterNonzero(Msg{BaseID: m0.BaseID, RecipientDomainStr: m0.RecipientDomainStr, Attempts: m0.Attempts - 1})
 			q.FilterNotEqual("ID", m0.ID)
 			q.FilterLessEqual("NextAttempt", origNextAttempt)
 			q.FilterEqual("Hold", false)
+			if capacity > 0 {
+				q.Limit(capacity)
+			}
 			err := q.ForEach(func(xm Msg) error {
 				mrtls := m0.RequireTLS != nil
 				xmrtls := xm.RequireTLS != nil
 				if mrtls != xmrtls || mrtls && *m0.RequireTLS != *xm.RequireTLS {
 					return nil
 				}
-				tn, _, ok := resolveTransport(xm)
-				if ok && tn == transportName {
+				tn, _, pn, ok := resolveTransport(xm)
+				if ok && tn == transportName && pn == ipPool {
 					msgs = append(msgs, &xm)
 				}
 				return nil
@@ -1474,6 +1615,7 @@ func deliver(log mlog.Log, resolver dns.Resolver, m0 Msg) {
 				mm.Attempts++
 				mm.NextAttempt = m0.NextAttempt
 				mm.LastAttempt = m0.LastAttempt
+				mm.RateLimited = ""
 				mm.Results = append(mm.Results, MsgResult{Start: now, Error: resultErrorDelivering})
 				if err := xtx.Update(mm); err != nil {
 					return fmt.Errorf("updating more message recipients for smtp transaction: %v", err)
@@ -1616,7 +1758,7 @@ func deliver(log mlog.Log, resolver dns.Resolver, m0 Msg) {
 			}
 			ourHostname = transport.Socks.Hostname
 		}
-		recipientDomainResult, hostResults = deliverDirect(qlog, resolver, dialer, ourHostname, transportName, transport.Direct, msgs, backoff)
+		recipientDomainResult, hostResults = deliverDirect(qlog, resolver, dialer, ourHostname, transportName, transport.Direct, ipPool, msgs, backoff)
 	}
 }
 
@@ -1662,9 +1804,10 @@ func routeMatchDomain(l []string, d dns.Domain) bool {
 // Returns string representing delivery result for err, and number of delivered and
 // failed messages.
 //
-// Values: ok, okpartial, timeout, canceled, temperror, permerror, error.
+// Values: ok, okpartial, timeout, canceled, temperror, permerror, ratelimited, error.
 func deliveryResult(err error, delivered, failed int) string {
 	var cerr smtpclient.Error
+	var rlerr rateLimitedError
 	switch {
 	case err == nil:
 		if delivered == 0 {
@@ -1682,6 +1825,8 @@ func deliveryResult(err error, delivered, failed int) string {
 			return "permerror"
 		}
 		return "temperror"
+	case errors.As(err, &rlerr):
+		return "ratelimited"
 	}
 	return "error"
 }
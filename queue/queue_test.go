@@ -1193,7 +1193,8 @@ func TestQueueStart(t *testing.T) {
 	done := make(chan struct{})
 	defer func() {
 		mox.ShutdownCancel()
-		// Wait for message and hooks deliverers and cleaners.
+		// Wait for message and hooks deliverers, cleaners and list digests.
+		<-done
 		<-done
 		<-done
 		<-done
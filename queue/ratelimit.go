@@ -0,0 +1,492 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+// Time to wait before trying again when the maximum number of connections for a
+// rate limit is reached. We don't know when a connection will be done.
+const rateLimitConnectionWait = 30 * time.Second
+
+// RateLimitDay holds the number of messages delivered on a day for an outgoing
+// rate limit with a warm-up schedule, so daily limits are kept across restarts.
+type RateLimitDay struct {
+	ID       int64
+	Name     string `bstore:"unique Name+Day"` // Of rate limit in config.
+	Day      string // UTC, formatted as 20060102.
+	Messages int
+}
+
+// rateLimitedError is returned for a delivery attempt that is not made because
+// of an outgoing rate limit. The messages are postponed, not failed.
+type rateLimitedError struct {
+	name string        // Of rate limit in config.
+	wait time.Duration // Until delivery can be attempted again.
+}
+
+func (e rateLimitedError) Error() string {
+	return fmt.Sprintf("delivery postponed by outgoing rate limit %q for %s", e.name, e.wait.Round(time.Second))
+}
+
+// rateSent is a delivery of one or more messages, for limits per minute.
+type rateSent struct {
+	time time.Time
+	n    int
+}
+
+// rateLimiter tracks usage of an outgoing rate limit from the config.
+type rateLimiter struct {
+	sent        []rateSent // Deliveries in the past minute, oldest first.
+	connections int
+	day         string // UTC day of daySent, formatted as 20060102.
+	daySent     int    // Only for limits with a warm-up schedule.
+}
+
+var rateLimits = struct {
+	sync.Mutex
+	limiters map[string]*rateLimiter // By name of rate limit in config.
+
+	// Recipient domains (as in Msg.RecipientDomainStr) skipped by the scheduler due to
+	// a rate limit, with the time delivery can be attempted again.
+	domains map[string]time.Time
+}{
+	limiters: map[string]*rateLimiter{},
+	domains:  map[string]time.Time{},
+}
+
+// rateLimitNames returns the sorted names of the configured outgoing rate limits
+// for which match returns true.
+func rateLimitNames(match func(rl config.OutgoingRateLimit) bool) []string {
+	var l []string
+	for name, rl := range mox.Conf.Static.OutgoingRateLimits {
+		if match(rl) {
+			l = append(l, name)
+		}
+	}
+	sort.Strings(l)
+	return l
+}
+
+// rateLimitsDomain returns the outgoing rate limits for a recipient domain.
+func rateLimitsDomain(d dns.Domain) []string {
+	if d.IsZero() {
+		return nil
+	}
+	return rateLimitNames(func(rl config.OutgoingRateLimit) bool {
+		return len(rl.RecipientDomainsASCII) > 0 && routeMatchDomain(rl.RecipientDomainsASCII, d)
+	})
+}
+
+// rateLimitsHost returns the outgoing rate limits for an MX target host.
+func rateLimitsHost(h dns.IPDomain) []string {
+	if !h.IsDomain() {
+		return nil
+	}
+	return rateLimitNames(func(rl config.OutgoingRateLimit) bool {
+		return len(rl.MXHostsASCII) > 0 && routeMatchDomain(rl.MXHostsASCII, h.Domain)
+	})
+}
+
+// rateLimitsIP returns the outgoing rate limits for a local source IP.
+func rateLimitsIP(ip net.IP) []string {
+	if ip == nil {
+		return nil
+	}
+	return rateLimitNames(func(rl config.OutgoingRateLimit) bool {
+		return slices.ContainsFunc(rl.IPs, ip.Equal)
+	})
+}
+
+// rateLimitsDelivered returns the limits for recipient domain and MX host combined,
+// for counting delivered messages once per limit.
+func rateLimitsDelivered(domainLimits, hostLimits []string) []string {
+	l := append(slices.Clone(domainLimits), hostLimits...)
+	slices.Sort(l)
+	return slices.Compact(l)
+}
+
+// warmupLimit returns the maximum number of messages for the day of t according
+// to the warm-up schedule, or 0 if there is no daily limit.
+func warmupLimit(rl config.OutgoingRateLimit, t time.Time) int {
+	if len(rl.WarmupMessagesPerDay) == 0 {
+		return 0
+	}
+	day := int(t.UTC().Truncate(24*time.Hour).Sub(rl.WarmupStartDay) / (24 * time.Hour))
+	if day < 0 {
+		day = 0
+	}
+	if day >= len(rl.WarmupMessagesPerDay) {
+		return 0
+	}
+	return rl.WarmupMessagesPerDay[day]
+}
+
+// limiter returns the limiter for name, with deliveries older than a minute
+// removed and the daily count for the current day. Must be called with
+// rateLimits locked.
+func limiter(log mlog.Log, name string, rl config.OutgoingRateLimit, now time.Time) *rateLimiter {
+	l := rateLimits.limiters[name]
+	if l == nil {
+		l = &rateLimiter{}
+		rateLimits.limiters[name] = l
+	}
+
+	var n int
+	for n < len(l.sent) && now.Sub(l.sent[n].time) >= time.Minute {
+		n++
+	}
+	l.sent = l.sent[n:]
+
+	day := now.UTC().Format("20060102")
+	if l.day != day {
+		l.day = day
+		l.daySent = 0
+		if len(rl.WarmupMessagesPerDay) > 0 {
+			// Counts may have been stored before a restart. Older days are no longer needed.
+			err := DB.Write(mox.Shutdown, func(tx *bstore.Tx) error {
+				rld, err := bstore.QueryTx[RateLimitDay](tx).FilterNonzero(RateLimitDay{Name: name, Day: day}).Get()
+				if err == nil {
+					l.daySent = rld.Messages
+				} else if err != bstore.ErrAbsent {
+					return err
+				}
+				q := bstore.QueryTx[RateLimitDay](tx)
+				q.FilterNonzero(RateLimitDay{Name: name})
+				q.FilterLess("Day", day)
+				_, err = q.Delete()
+				return err
+			})
+			log.Check(err, "loading daily message count for outgoing rate limit", slog.String("ratelimit", name))
+		}
+	}
+	return l
+}
+
+// wait returns how long to wait before n messages can be delivered over a new
+// connection under the limit, 0 if they can be delivered now.
+func (l *rateLimiter) wait(rl config.OutgoingRateLimit, now time.Time, n int) time.Duration {
+	var wait time.Duration
+	if rl.MaxConnections > 0 && l.connections >= rl.MaxConnections {
+		wait = rateLimitConnectionWait
+	}
+	if rl.MessagesPerMinute > 0 {
+		var sum int
+		for _, s := range l.sent {
+			sum += s.n
+		}
+		// A delivery with more messages than the limit is allowed if nothing was sent in
+		// the past minute, otherwise we find when enough deliveries have expired.
+		for _, s := range l.sent {
+			if sum == 0 || sum+n <= rl.MessagesPerMinute {
+				break
+			}
+			sum -= s.n
+			wait = max(wait, s.time.Add(time.Minute).Sub(now))
+		}
+	}
+	if limit := warmupLimit(rl, now); limit > 0 && l.daySent > 0 && l.daySent+n > limit {
+		wait = max(wait, now.UTC().Truncate(24*time.Hour).Add(24*time.Hour).Sub(now))
+	}
+	return wait
+}
+
+// capacity returns the number of messages that can be delivered now under the
+// limit, or -1 if there is no limit on the number of messages.
+func (l *rateLimiter) capacity(rl config.OutgoingRateLimit, now time.Time) int {
+	c := -1
+	if rl.MessagesPerMinute > 0 {
+		c = rl.MessagesPerMinute
+		for _, s := range l.sent {
+			c -= s.n
+		}
+		c = max(c, 0)
+	}
+	if limit := warmupLimit(rl, now); limit > 0 {
+		if dc := max(limit-l.daySent, 0); c < 0 || dc < c {
+			c = dc
+		}
+	}
+	return c
+}
+
+// add registers n delivered messages, and a new connection if conn is set.
+func (l *rateLimiter) add(log mlog.Log, name string, rl config.OutgoingRateLimit, now time.Time, n int, conn bool) {
+	if conn {
+		l.connections++
+	}
+	if n == 0 {
+		return
+	}
+	if rl.MessagesPerMinute > 0 {
+		l.sent = append(l.sent, rateSent{now, n})
+	}
+	if warmupLimit(rl, now) == 0 {
+		return
+	}
+	l.daySent += n
+	err := DB.Write(mox.Shutdown, func(tx *bstore.Tx) error {
+		rld, err := bstore.QueryTx[RateLimitDay](tx).FilterNonzero(RateLimitDay{Name: name, Day: l.day}).Get()
+		if err == bstore.ErrAbsent {
+			return tx.Insert(&RateLimitDay{Name: name, Day: l.day, Messages: l.daySent})
+		} else if err != nil {
+			return err
+		}
+		rld.Messages = l.daySent
+		return tx.Update(&rld)
+	})
+	log.Check(err, "storing daily message count for outgoing rate limit", slog.String("ratelimit", name))
+}
+
+// rateLimitWait returns the name of a rate limit that prevents delivering n
+// messages over a new connection, and how long to wait. If the returned name is
+// empty, delivery can proceed.
+func rateLimitWait(log mlog.Log, names []string, n int) (string, time.Duration) {
+	if len(names) == 0 {
+		return "", 0
+	}
+
+	rateLimits.Lock()
+	defer rateLimits.Unlock()
+	return rateLimitWaitLocked(log, names, time.Now(), n)
+}
+
+func rateLimitWaitLocked(log mlog.Log, names []string, now time.Time, n int) (limitName string, wait time.Duration) {
+	for _, name := range names {
+		rl := mox.Conf.Static.OutgoingRateLimits[name]
+		if w := limiter(log, name, rl, now).wait(rl, now, n); w > wait {
+			limitName = name
+			wait = w
+		}
+	}
+	return
+}
+
+// rateLimitAcquire registers a new connection if the rate limits allow delivering
+// n messages over it. If not, the name of a limit that prevents delivery and the
+// time to wait are returned. Otherwise, the returned function must be called when
+// the connection is done. The messages are not counted yet, that is done with
+// rateLimitAdd once they are handed to a remote host.
+func rateLimitAcquire(log mlog.Log, names []string, n int) (string, time.Duration, func()) {
+	if len(names) == 0 {
+		return "", 0, func() {}
+	}
+
+	rateLimits.Lock()
+	defer rateLimits.Unlock()
+	now := time.Now()
+	if name, wait := rateLimitWaitLocked(log, names, now, n); name != "" {
+		return name, wait, nil
+	}
+	return "", 0, rateLimitAddLocked(log, names, now, 0, true)
+}
+
+// rateLimitAdd registers the delivery of n messages, regardless of whether the
+// limits allow it. If conn is set, a new connection is registered too, and the
+// returned function must be called when it is done.
+func rateLimitAdd(log mlog.Log, names []string, n int, conn bool) func() {
+	if len(names) == 0 {
+		return func() {}
+	}
+
+	rateLimits.Lock()
+	defer rateLimits.Unlock()
+	return rateLimitAddLocked(log, names, time.Now(), n, conn)
+}
+
+func rateLimitAddLocked(log mlog.Log, names []string, now time.Time, n int, conn bool) func() {
+	for _, name := range names {
+		rl := mox.Conf.Static.OutgoingRateLimits[name]
+		limiter(log, name, rl, now).add(log, name, rl, now, n, conn)
+	}
+	if !conn {
+		return func() {}
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			rateLimits.Lock()
+			defer rateLimits.Unlock()
+			for _, name := range names {
+				if l := rateLimits.limiters[name]; l != nil {
+					l.connections--
+				}
+			}
+		})
+	}
+}
+
+// rateLimitCapacity returns the number of messages that can be delivered now
+// under the limits, or -1 if the number is not limited.
+func rateLimitCapacity(log mlog.Log, names []string) int {
+	rateLimits.Lock()
+	defer rateLimits.Unlock()
+	now := time.Now()
+	c := -1
+	for _, name := range names {
+		rl := mox.Conf.Static.OutgoingRateLimits[name]
+		if lc := limiter(log, name, rl, now).capacity(rl, now); lc >= 0 && (c < 0 || lc < c) {
+			c = lc
+		}
+	}
+	return c
+}
+
+// rateLimitDomainDelay marks a recipient domain as rate limited until t, so the
+// scheduler skips its messages until then.
+func rateLimitDomainDelay(domain string, t time.Time) {
+	rateLimits.Lock()
+	defer rateLimits.Unlock()
+	rateLimits.domains[domain] = t
+}
+
+// rateLimitedDomains returns the recipient domains that are rate limited, with the
+// time until which they are limited.
+func rateLimitedDomains(now time.Time) map[string]time.Time {
+	rateLimits.Lock()
+	defer rateLimits.Unlock()
+	m := map[string]time.Time{}
+	for d, t := range rateLimits.domains {
+		if now.Before(t) {
+			m[d] = t
+		} else {
+			delete(rateLimits.domains, d)
+		}
+	}
+	return m
+}
+
+// postponeMsgsDB reschedules msgs for which delivery was not attempted due to an
+// outgoing rate limit, undoing the registration of the delivery attempt.
+func postponeMsgsDB(qlog mlog.Log, msgs []*Msg, rlerr rateLimitedError) {
+	ids := make([]int64, len(msgs))
+	for i, m := range msgs {
+		ids[i] = m.ID
+	}
+	next := time.Now().Add(rlerr.wait)
+	err := DB.Write(context.Background(), func(tx *bstore.Tx) error {
+		q := bstore.QueryTx[Msg](tx)
+		q.FilterIDs(ids)
+		umsgs, err := q.List()
+		if err != nil {
+			return fmt.Errorf("retrieving messages to postpone: %v", err)
+		}
+		for _, um := range umsgs {
+			if n := len(um.Results); n > 0 && um.Results[n-1].Error == resultErrorDelivering {
+				um.Results = um.Results[:n-1]
+				um.Attempts--
+			}
+			um.NextAttempt = next
+			um.RateLimited = rlerr.name
+			if err := tx.Update(&um); err != nil {
+				return fmt.Errorf("updating postponed message: %v", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		qlog.Errorx("postponing messages due to outgoing rate limit", err, slog.Any("msgids", ids))
+	} else {
+		qlog.Info("delivery postponed due to outgoing rate limit",
+			slog.Any("msgids", ids),
+			slog.String("ratelimit", rlerr.name),
+			slog.Time("nextattempt", next))
+	}
+	kick()
+}
+
+// RateLimitState is the configuration and current usage of an outgoing rate
+// limit, for display in the admin web interface.
+type RateLimitState struct {
+	Name               string
+	AppliesTo          string // Description of the recipient domains, MX hosts or source IPs.
+	MessagesPerMinute  int    // Limit, 0 if not limited.
+	MessagesLastMinute int
+	MaxConnections     int // Limit, 0 if not limited.
+	Connections        int
+	WarmupLimitToday   int // Limit according to warm-up schedule, 0 if not limited.
+	MessagesToday      int // Only counted for limits with a warm-up schedule.
+
+	// If set, new deliveries are postponed until at least this time.
+	LimitedUntil *time.Time
+}
+
+// RateLimitStates returns the configured outgoing rate limits with their current
+// usage.
+func RateLimitStates(log mlog.Log) []RateLimitState {
+	names := rateLimitNames(func(rl config.OutgoingRateLimit) bool { return true })
+
+	rateLimits.Lock()
+	defer rateLimits.Unlock()
+	now := time.Now()
+	l := make([]RateLimitState, len(names))
+	for i, name := range names {
+		rl := mox.Conf.Static.OutgoingRateLimits[name]
+		lim := limiter(log, name, rl, now)
+		var appliesTo string
+		switch {
+		case len(rl.RecipientDomains) > 0:
+			appliesTo = "recipient domains: " + strings.Join(rl.RecipientDomains, ", ")
+		case len(rl.MXHosts) > 0:
+			appliesTo = "mx hosts: " + strings.Join(rl.MXHosts, ", ")
+		default:
+			appliesTo = "source ips: " + strings.Join(rl.SourceIPs, ", ")
+		}
+		st := RateLimitState{
+			Name:              name,
+			AppliesTo:         appliesTo,
+			MessagesPerMinute: rl.MessagesPerMinute,
+			MaxConnections:    rl.MaxConnections,
+			Connections:       lim.connections,
+			WarmupLimitToday:  warmupLimit(rl, now),
+			MessagesToday:     lim.daySent,
+		}
+		for _, s := range lim.sent {
+			st.MessagesLastMinute += s.n
+		}
+		if wait := lim.wait(rl, now, 1); wait > 0 {
+			t := now.Add(wait)
+			st.LimitedUntil = &t
+		}
+		l[i] = st
+	}
+	return l
+}
+
+// rateLimitFilterIPs returns the remote IPs that can be dialed for delivering n
+// messages, given the outgoing rate limits of the local IPs connections would be
+// made from. If all IPs are rate limited, a rateLimitedError is returned.
+func rateLimitFilterIPs(log mlog.Log, ips, localIPs []net.IP, n int) ([]net.IP, error) {
+	if len(mox.Conf.Static.OutgoingRateLimits) == 0 || len(localIPs) == 0 {
+		return ips, nil
+	}
+
+	var l []net.IP
+	var rlerr rateLimitedError
+	for _, ip := range ips {
+		name, wait := rateLimitWait(log, rateLimitsIP(localIPFor(localIPs, ip)), n)
+		if name == "" {
+			l = append(l, ip)
+		} else if rlerr.name == "" || wait < rlerr.wait {
+			rlerr = rateLimitedError{name, wait}
+		}
+	}
+	if len(l) == 0 && len(ips) > 0 {
+		return nil, rlerr
+	}
+	return l, nil
+}
@@ -0,0 +1,199 @@
+package queue
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/smtp"
+	"github.com/mjl-/mox/smtpclient"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+
+	rl := config.OutgoingRateLimit{MessagesPerMinute: 10, MaxConnections: 2}
+	l := &rateLimiter{}
+	tcompare(t, l.wait(rl, now, 1), time.Duration(0))
+	tcompare(t, l.capacity(rl, now), 10)
+
+	// More messages than the limit are allowed if nothing was sent recently.
+	tcompare(t, l.wait(rl, now, 20), time.Duration(0))
+
+	l.sent = []rateSent{{now.Add(-50 * time.Second), 4}, {now.Add(-20 * time.Second), 4}}
+	tcompare(t, l.capacity(rl, now), 2)
+	tcompare(t, l.wait(rl, now, 2), time.Duration(0))
+	tcompare(t, l.wait(rl, now, 3), 10*time.Second)
+	tcompare(t, l.wait(rl, now, 7), 40*time.Second)
+	tcompare(t, l.wait(rl, now, 20), 40*time.Second)
+
+	l.connections = 2
+	tcompare(t, l.wait(rl, now, 1), rateLimitConnectionWait)
+
+	// Warm-up schedule, with daily limits.
+	rl = config.OutgoingRateLimit{WarmupMessagesPerDay: []int{10, 20}, WarmupStartDay: time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)}
+	tcompare(t, warmupLimit(rl, now.Add(-48*time.Hour)), 10)
+	tcompare(t, warmupLimit(rl, now.Add(-24*time.Hour)), 10)
+	tcompare(t, warmupLimit(rl, now), 20)
+	tcompare(t, warmupLimit(rl, now.Add(24*time.Hour)), 0)
+	l = &rateLimiter{daySent: 15}
+	tcompare(t, l.capacity(rl, now), 5)
+	tcompare(t, l.wait(rl, now, 5), time.Duration(0))
+	tcompare(t, l.wait(rl, now, 6), 12*time.Hour)
+}
+
+func TestRateLimitQueue(t *testing.T) {
+	_, cleanup := setup(t)
+	defer cleanup()
+
+	defer func() {
+		mox.Conf.Static.OutgoingRateLimits = nil
+		rateLimits.limiters = map[string]*rateLimiter{}
+		rateLimits.domains = map[string]time.Time{}
+	}()
+
+	path := smtp.Path{Localpart: "mjl", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: "mox.example"}}}
+	mf := prepareFile(t)
+	defer os.Remove(mf.Name())
+	defer mf.Close()
+	for i := 0; i < 2; i++ {
+		qm := MakeMsg(path, path, false, false, int64(len(testmsg)), "<test@localhost>", nil, nil, time.Now(), "test")
+		err := Add(ctxbg, pkglog, "mjl", mf, qm)
+		tcheck(t, err, "add message to queue")
+	}
+
+	resolver := dns.MockResolver{
+		A: map[string][]string{
+			"mail.mox.example.": {"127.0.0.1"},
+		},
+		MX: map[string][]*net.MX{
+			"mox.example.": {{Host: "mail.mox.example", Pref: 10}},
+		},
+	}
+
+	// Messages only count towards limits once connected to the remote host, so we
+	// return a connection that fails after the dial.
+	var ndial int
+	smtpclient.DialHook = func(ctx context.Context, dialer smtpclient.Dialer, timeout time.Duration, addr string, laddr net.Addr) (net.Conn, error) {
+		ndial++
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}
+	defer func() {
+		smtpclient.DialHook = nil
+	}()
+
+	waitDeliver := func() {
+		t.Helper()
+		timer := time.NewTimer(time.Second)
+		defer timer.Stop()
+		select {
+		case <-deliveryResults:
+		case <-timer.C:
+			t.Fatalf("no delivery within 1s")
+		}
+	}
+
+	msgs := func() []Msg {
+		t.Helper()
+		l, err := List(ctxbg, Filter{}, Sort{Field: "Queued", Asc: true})
+		tcheck(t, err, "list messages")
+		return l
+	}
+
+	// With a limit for the MX host, the second delivery attempt is postponed
+	// without counting as an attempt.
+	mox.Conf.Static.OutgoingRateLimits = map[string]config.OutgoingRateLimit{
+		"mx": {MXHosts: []string{".mox.example"}, MXHostsASCII: []string{".mox.example"}, MessagesPerMinute: 1},
+	}
+	n := launchWork(pkglog, resolver, map[string]struct{}{})
+	tcompare(t, n, 1)
+	waitDeliver()
+	tcompare(t, ndial, 1)
+
+	_, err := NextAttemptSet(ctxbg, Filter{}, time.Now())
+	tcheck(t, err, "set next attempt")
+	n = launchWork(pkglog, resolver, map[string]struct{}{})
+	tcompare(t, n, 1)
+	waitDeliver()
+	tcompare(t, ndial, 1)
+	l := msgs()
+	tcompare(t, l[0].Attempts+l[1].Attempts, 1)
+	var postponed Msg
+	for _, m := range l {
+		if m.RateLimited != "" {
+			postponed = m
+		}
+	}
+	tcompare(t, postponed.RateLimited, "mx")
+	if d := time.Until(postponed.NextAttempt); d <= 0 || d > time.Minute {
+		t.Fatalf("next attempt of postponed message in %s, expected within a minute", d)
+	}
+
+	states := RateLimitStates(pkglog)
+	tcompare(t, len(states), 1)
+	tcompare(t, states[0].MessagesLastMinute, 1)
+	if states[0].LimitedUntil == nil {
+		t.Fatalf("rate limit not limited")
+	}
+
+	// With a limit on the recipient domain, the scheduler skips the domain.
+	mox.Conf.Static.OutgoingRateLimits = map[string]config.OutgoingRateLimit{
+		"domain": {RecipientDomains: []string{"mox.example"}, RecipientDomainsASCII: []string{"mox.example"}, MessagesPerMinute: 1},
+	}
+	_, err = NextAttemptSet(ctxbg, Filter{}, time.Now())
+	tcheck(t, err, "set next attempt")
+	n = launchWork(pkglog, resolver, map[string]struct{}{})
+	tcompare(t, n, 1)
+	waitDeliver()
+	tcompare(t, ndial, 2)
+
+	_, err = NextAttemptSet(ctxbg, Filter{}, time.Now())
+	tcheck(t, err, "set next attempt")
+	n = launchWork(pkglog, resolver, map[string]struct{}{})
+	tcompare(t, n, 0)
+	if _, ok := rateLimitedDomains(time.Now())["mox.example"]; !ok {
+		t.Fatalf("recipient domain not marked as rate limited")
+	}
+	if d := nextWork(ctxbg, pkglog, nil); d <= 0 || d > time.Minute {
+		t.Fatalf("next work in %s, expected within a minute", d)
+	}
+
+	// Daily warm-up counts are stored in the database.
+	mox.Conf.Static.OutgoingRateLimits = map[string]config.OutgoingRateLimit{
+		"warmup": {SourceIPs: []string{"127.0.0.1"}, IPs: []net.IP{net.ParseIP("127.0.0.1")}, WarmupMessagesPerDay: []int{5}, WarmupStartDay: time.Now().UTC().Truncate(24 * time.Hour)},
+	}
+	rateLimitAdd(pkglog, rateLimitsIP(net.ParseIP("127.0.0.1")), 3, false)
+	rld, err := bstore.QueryDB[RateLimitDay](ctxbg, DB).Get()
+	tcheck(t, err, "get daily count")
+	tcompare(t, rld.Messages, 3)
+	rateLimits.limiters = map[string]*rateLimiter{}
+	tcompare(t, rateLimitCapacity(pkglog, []string{"warmup"}), 2)
+	ips, err := rateLimitFilterIPs(pkglog, []net.IP{net.ParseIP("10.0.0.1")}, []net.IP{net.ParseIP("127.0.0.1")}, 3)
+	if _, ok := err.(rateLimitedError); !ok || len(ips) != 0 {
+		t.Fatalf("got ips %v, err %v, expected rate limited error", ips, err)
+	}
+
+	// Acquiring only registers a connection, messages are counted when handed to the
+	// remote host.
+	mox.Conf.Static.OutgoingRateLimits = map[string]config.OutgoingRateLimit{
+		"conn": {MessagesPerMinute: 2, MaxConnections: 1},
+	}
+	name, _, done := rateLimitAcquire(pkglog, []string{"conn"}, 1)
+	tcompare(t, name, "")
+	tcompare(t, rateLimitCapacity(pkglog, []string{"conn"}), 2)
+	name, _, _ = rateLimitAcquire(pkglog, []string{"conn"}, 1)
+	tcompare(t, name, "conn")
+	done()
+	name, _, done = rateLimitAcquire(pkglog, []string{"conn"}, 1)
+	tcompare(t, name, "")
+	done()
+}
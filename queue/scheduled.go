@@ -0,0 +1,126 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/webhook"
+)
+
+// Maximum "undo send" grace period for messages submitted through webmail or the
+// webapi.
+const UndoSendIntervalMax = 10 * time.Minute
+
+var (
+	ErrNotScheduled      = errors.New("message not scheduled for delivery")
+	ErrDeliveryAttempted = errors.New("delivery already attempted")
+)
+
+// scheduled returns whether the message is still waiting for its first delivery
+// attempt at a time scheduled by the sender or after an "undo send" grace period.
+func (m Msg) scheduled() bool {
+	return !m.SendAt.IsZero() && m.Attempts == 0
+}
+
+// ScheduledList returns the messages of the account that are scheduled for later
+// delivery and can still be canceled or rescheduled, ordered by the time of
+// delivery.
+func ScheduledList(ctx context.Context, account string) ([]Msg, error) {
+	q := bstore.QueryDB[Msg](ctx, DB)
+	q.FilterNonzero(Msg{SenderAccount: account})
+	q.FilterFn(func(m Msg) bool { return m.scheduled() })
+	q.SortAsc("NextAttempt", "ID")
+	return q.List()
+}
+
+// scheduledGet returns the scheduled messages of the account with the ids. If
+// any message does not exist or is not scheduled, ErrNotScheduled is returned.
+// If delivery was attempted for any message, ErrDeliveryAttempted is returned.
+//
+// The first delivery attempt for a message increases Attempts in a write
+// transaction before connecting to a remote server, so callers holding a write
+// transaction can still change the returned messages before delivery.
+func scheduledGet(tx *bstore.Tx, account string, ids []int64) ([]Msg, error) {
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("%w: no messages", ErrNotScheduled)
+	}
+	msgs := make([]Msg, len(ids))
+	for i, id := range ids {
+		msgs[i] = Msg{ID: id}
+		if err := tx.Get(&msgs[i]); err == bstore.ErrAbsent {
+			return nil, fmt.Errorf("%w: message %d", ErrNotScheduled, id)
+		} else if err != nil {
+			return nil, fmt.Errorf("get message: %v", err)
+		}
+		m := msgs[i]
+		if m.SenderAccount != account || m.SendAt.IsZero() {
+			return nil, fmt.Errorf("%w: message %d", ErrNotScheduled, id)
+		} else if !m.scheduled() {
+			return nil, fmt.Errorf("%w: message %d", ErrDeliveryAttempted, id)
+		}
+	}
+	return msgs, nil
+}
+
+// ScheduledCancel removes scheduled messages of the account from the queue
+// before their first delivery attempt, e.g. for "undo send". Either all messages
+// are canceled, or none. The messages are retired, and webhooks with the
+// "canceled" event are queued.
+func ScheduledCancel(ctx context.Context, log mlog.Log, account string, ids []int64) ([]Msg, error) {
+	var msgs []Msg
+	err := DB.Write(ctx, func(tx *bstore.Tx) error {
+		var err error
+		msgs, err = scheduledGet(tx, account, ids)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		for i := range msgs {
+			msgs[i].Results = append(msgs[i].Results, MsgResult{Start: now, Error: "delivery canceled by sender"})
+		}
+		if err := retireMsgs(log, tx, webhook.EventCanceled, 0, "", nil, msgs...); err != nil {
+			return fmt.Errorf("removing queue messages from database: %w", err)
+		}
+		return metricHoldUpdate(tx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := removeMsgsFS(log, msgs...); err != nil {
+		return msgs, fmt.Errorf("removing queue messages from file system: %w", err)
+	}
+	kick()
+	return msgs, nil
+}
+
+// ScheduledReschedule changes the time of the first delivery attempt for
+// scheduled messages of the account. The messages are no longer considered to be
+// in an "undo send" grace period.
+func ScheduledReschedule(ctx context.Context, account string, ids []int64, t time.Time) error {
+	err := DB.Write(ctx, func(tx *bstore.Tx) error {
+		msgs, err := scheduledGet(tx, account, ids)
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			m.NextAttempt = t
+			m.SendAt = t
+			m.UndoSend = false
+			m.FutureReleaseRequest = "until;" + t.Format(time.RFC3339)
+			if err := tx.Update(&m); err != nil {
+				return fmt.Errorf("update message: %v", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	msgqueueKick()
+	return nil
+}
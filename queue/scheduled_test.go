@@ -0,0 +1,66 @@
+package queue
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/smtp"
+)
+
+func TestScheduled(t *testing.T) {
+	_, cleanup := setup(t)
+	defer cleanup()
+
+	path := smtp.Path{Localpart: "mjl", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: "mox.example"}}}
+	mf := prepareFile(t)
+	defer os.Remove(mf.Name())
+	defer mf.Close()
+
+	// One regular message, and two recipients of a message in an undo send period.
+	sendAt := time.Now().Add(time.Minute)
+	qm := MakeMsg(path, path, false, false, int64(len(testmsg)), "<test@localhost>", nil, nil, time.Now(), "test")
+	err := Add(ctxbg, pkglog, "mjl", mf, qm)
+	tcheck(t, err, "add message to queue")
+	qm.SendAt = sendAt
+	qm.NextAttempt = sendAt
+	qm.UndoSend = true
+	qml := []Msg{qm, qm}
+	err = Add(ctxbg, pkglog, "mjl", mf, qml...)
+	tcheck(t, err, "add messages to queue")
+	ids := []int64{qml[0].ID, qml[1].ID}
+
+	l, err := ScheduledList(ctxbg, "mjl")
+	tcheck(t, err, "list scheduled")
+	tcompare(t, len(l), 2)
+	l, err = ScheduledList(ctxbg, "other")
+	tcheck(t, err, "list scheduled")
+	tcompare(t, len(l), 0)
+
+	err = ScheduledReschedule(ctxbg, "other", ids, sendAt)
+	if !errors.Is(err, ErrNotScheduled) {
+		t.Fatalf("got err %v, expected ErrNotScheduled", err)
+	}
+	newSendAt := sendAt.Add(time.Hour).Truncate(time.Second)
+	err = ScheduledReschedule(ctxbg, "mjl", ids, newSendAt)
+	tcheck(t, err, "reschedule")
+	l, err = ScheduledList(ctxbg, "mjl")
+	tcheck(t, err, "list scheduled")
+	if !l[0].NextAttempt.Equal(newSendAt) || !l[0].SendAt.Equal(newSendAt) || l[0].UndoSend || l[0].FutureReleaseRequest == "" {
+		t.Fatalf("unexpected rescheduled message %#v", l[0])
+	}
+
+	// Not all messages scheduled, nothing is canceled.
+	_, err = ScheduledCancel(ctxbg, pkglog, "mjl", []int64{ids[0], qm.ID + 1000})
+	if !errors.Is(err, ErrNotScheduled) {
+		t.Fatalf("got err %v, expected ErrNotScheduled", err)
+	}
+	msgs, err := ScheduledCancel(ctxbg, pkglog, "mjl", ids)
+	tcheck(t, err, "cancel")
+	tcompare(t, len(msgs), 2)
+	n, err := Count(ctxbg)
+	tcheck(t, err, "count")
+	tcompare(t, n, 1)
+}
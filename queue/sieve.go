@@ -0,0 +1,244 @@
+package queue
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mjl-/mox/arc"
+	"github.com/mjl-/mox/message"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/moxvar"
+	"github.com/mjl-/mox/sieve"
+	"github.com/mjl-/mox/smtp"
+	"github.com/mjl-/mox/store"
+)
+
+// SieveActions performs the outgoing actions from a Sieve result for a message
+// that was delivered to acc for rcptTo: Messages for redirect actions are added
+// to the queue, and a vacation response is composed, DKIM-signed and queued if
+// none was sent to the sender recently. Reject actions must be handled by the
+// caller, before delivery.
+//
+// Redirected messages are sent with rcptTo as SMTP MAIL FROM, so the SPF check
+// of the next hop will use our IPs.
+func SieveActions(ctx context.Context, log mlog.Log, acc *store.Account, rcptTo smtp.Path, m *store.Message, msgFile *os.File, r *sieve.Result) error {
+	var errs []error
+	if len(r.Redirect) > 0 {
+		if err := sieveRedirect(ctx, log, acc, rcptTo, m, msgFile, r.Redirect); err != nil {
+			errs = append(errs, fmt.Errorf("redirecting message: %w", err))
+		}
+	}
+	if r.Vacation != nil {
+		if err := VacationReply(ctx, log, acc, rcptTo, r.Vacation); err != nil {
+			errs = append(errs, fmt.Errorf("sending vacation response: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func sieveRedirect(ctx context.Context, log mlog.Log, acc *store.Account, rcptTo smtp.Path, m *store.Message, msgFile *os.File, addresses []string) error {
+	if rcptTo.IsZero() {
+		return fmt.Errorf("missing envelope recipient to use as sender")
+	}
+
+	// Determine if the message needs 8BITMIME and/or SMTPUTF8 for delivery.
+	var has8bit, header8bit bool
+	inHeader := true
+	br := bufio.NewReader(store.FileMsgReader(m.MsgPrefix, msgFile))
+	for {
+		line, err := br.ReadString('\n')
+		if line == "\r\n" {
+			inHeader = false
+		}
+		for _, c := range []byte(line) {
+			if c >= 0x80 {
+				has8bit = true
+				header8bit = header8bit || inHeader
+				break
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("reading message: %w", err)
+		}
+	}
+
+	// Authentication results from our incoming delivery are used for the ARC seal. If
+	// we can't find them, we seal with no results.
+	authResults := message.AuthResults{Hostname: mox.Conf.Static.HostnameDomain.ASCII}
+	var messageID, subject string
+	if p, err := message.Parse(log.Logger, false, store.FileMsgReader(m.MsgPrefix, msgFile)); err != nil {
+		log.Debugx("parsing message for redirect", err)
+	} else if h, err := p.Header(); err != nil {
+		log.Debugx("parsing message header for redirect", err)
+	} else {
+		messageID = h.Get("Message-Id")
+		subject = h.Get("Subject")
+		if v := h.Get("Authentication-Results"); v != "" {
+			if ar, err := message.ParseAuthResults(v + "\r\n"); err != nil {
+				log.Debugx("parsing authentication-results for arc seal", err)
+			} else if strings.EqualFold(ar.Hostname, mox.Conf.Static.HostnameDomain.ASCII) || ar.Hostname == mox.Conf.Static.HostnameDomain.Unicode {
+				authResults = ar
+			}
+		}
+	}
+
+	// Seal the message with ARC, so the next hop can use the results of our
+	// verification of the message, which may no longer pass DMARC after forwarding.
+	msgPrefix := m.MsgPrefix
+	arcHeaders, err := mox.ARCSeal(ctx, log, rcptTo.IPDomain.Domain, authResults, arc.Status(m.ARCResult), store.FileMsgReader(m.MsgPrefix, msgFile))
+	if err != nil {
+		log.Errorx("arc-sealing redirected message, continuing without seal", err)
+	} else if arcHeaders != "" {
+		msgPrefix = append([]byte(arcHeaders), m.MsgPrefix...)
+	}
+
+	var qml []Msg
+	for _, s := range addresses {
+		a, err := mail.ParseAddress(s)
+		if err != nil {
+			log.Infox("parsing redirect address from sieve script, skipping", err, slog.String("address", s))
+			continue
+		}
+		addr, err := smtp.ParseAddress(a.Address)
+		if err != nil {
+			log.Infox("parsing redirect address from sieve script, skipping", err, slog.String("address", s))
+			continue
+		}
+		if addr.Path().Equal(rcptTo) {
+			log.Info("not redirecting message to original recipient", slog.Any("address", addr))
+			continue
+		}
+		smtputf8 := header8bit || rcptTo.Localpart.IsInternational() || addr.Localpart.IsInternational()
+		qm := MakeMsg(rcptTo, addr.Path(), has8bit, smtputf8, int64(len(arcHeaders))+m.Size, messageID, msgPrefix, nil, time.Now(), subject)
+		qml = append(qml, qm)
+	}
+	if len(qml) == 0 {
+		return nil
+	}
+	if err := Add(ctx, log, acc.Name, msgFile, qml...); err != nil {
+		return err
+	}
+	log.Info("message redirected by sieve script", slog.Int("recipients", len(qml)))
+	return nil
+}
+
+// VacationReply composes, DKIM-signs and queues vacation response v for a message
+// delivered to acc for rcptTo, from a Sieve script or the vacation settings of
+// the account. No response is sent if one was sent to the same sender with the
+// same handle within the interval of v.
+func VacationReply(ctx context.Context, log mlog.Log, acc *store.Account, rcptTo smtp.Path, v *sieve.Vacation) (rerr error) {
+	to, err := smtp.ParseAddress(v.To)
+	if err != nil {
+		return fmt.Errorf("parsing sender address: %w", err)
+	}
+
+	from := message.NameAddress{Address: smtp.NewAddress(rcptTo.Localpart, rcptTo.IPDomain.Domain)}
+	if v.From != "" {
+		a, err := mail.ParseAddress(v.From)
+		if err != nil {
+			return fmt.Errorf("parsing vacation from address: %w", err)
+		}
+		fromAddr, err := smtp.ParseAddress(a.Address)
+		if err != nil {
+			return fmt.Errorf("parsing vacation from address: %w", err)
+		}
+		from = message.NameAddress{DisplayName: a.Name, Address: fromAddr}
+	}
+	if from.Address.IsZero() {
+		return fmt.Errorf("no from address for vacation response")
+	}
+
+	// Check if we've sent a response to the sender recently, this also records the new
+	// response.
+	ok, err := acc.VacationReplyAllowed(v.Handle, to.String(), time.Duration(v.Days)*24*time.Hour)
+	if err != nil {
+		return err
+	} else if !ok {
+		log.Debug("vacation response sent recently, not sending again", slog.Any("to", to))
+		return nil
+	}
+
+	msgFile, err := store.CreateMessageTemp(log, "vacation")
+	if err != nil {
+		return fmt.Errorf("creating temporary message file: %w", err)
+	}
+	defer store.CloseRemoveTempFile(log, msgFile, "vacation message")
+
+	smtputf8 := from.Address.Localpart.IsInternational() || to.Localpart.IsInternational()
+	xc := message.NewComposer(msgFile, 1024*1024, smtputf8)
+	defer func() {
+		x := recover()
+		if x == nil {
+			return
+		}
+		if err, ok := x.(error); ok && errors.Is(err, message.ErrCompose) {
+			rerr = err
+			return
+		}
+		panic(x)
+	}()
+
+	// ../rfc/5230:617 ../rfc/3834:291
+	xc.HeaderAddrs("From", []message.NameAddress{from})
+	xc.HeaderAddrs("To", []message.NameAddress{{Address: to}})
+	xc.Subject(v.Subject)
+	messageID := fmt.Sprintf("<%s>", mox.MessageIDGen(xc.SMTPUTF8))
+	xc.Header("Message-Id", messageID)
+	if v.InReplyTo != "" {
+		xc.Header("In-Reply-To", v.InReplyTo)
+		xc.Header("References", v.InReplyTo)
+	}
+	xc.Header("Date", time.Now().Format(message.RFC5322Z))
+	xc.Header("Auto-Submitted", "auto-replied")
+	xc.Header("User-Agent", "mox/"+moxvar.Version)
+	xc.Header("MIME-Version", "1.0")
+	if v.Mime {
+		// Reason is a MIME entity with its own headers. ../rfc/5230:287
+		reason := strings.ReplaceAll(v.Reason, "\r\n", "\n")
+		reason = strings.ReplaceAll(reason, "\n", "\r\n")
+		for _, c := range []byte(reason) {
+			if c >= 0x80 {
+				xc.Has8bit = true
+				break
+			}
+		}
+		_, err := xc.Write([]byte(reason))
+		xc.Checkf(err, "writing mime body")
+	} else {
+		textBody, ct, cte := xc.TextPart("plain", strings.ReplaceAll(v.Reason, "\r\n", "\n"))
+		xc.Header("Content-Type", ct)
+		xc.Header("Content-Transfer-Encoding", cte)
+		xc.Line()
+		_, err := xc.Write(textBody)
+		xc.Checkf(err, "writing text")
+	}
+	xc.Flush()
+
+	buf, err := os.ReadFile(msgFile.Name())
+	if err != nil {
+		return fmt.Errorf("reading composed message: %w", err)
+	}
+	dkimHeaders, err := mox.DKIMSign(ctx, log, from.Address.Path(), xc.SMTPUTF8, buf)
+	if err != nil {
+		log.Errorx("dkim-signing vacation response, continuing without signature", err)
+	}
+
+	// Responses are sent with null reverse path, preventing loops. ../rfc/3834:326
+	qm := MakeMsg(smtp.Path{}, to.Path(), xc.Has8bit, xc.SMTPUTF8, int64(len(dkimHeaders))+xc.Size, messageID, []byte(dkimHeaders), nil, time.Now(), v.Subject)
+	if err := Add(ctx, log, acc.Name, msgFile, qm); err != nil {
+		return err
+	}
+	log.Info("vacation response queued", slog.Any("to", to), slog.Any("from", from.Address))
+	return nil
+}
@@ -133,6 +133,7 @@ func deliverSubmit(qlog mlog.Log, resolver dns.Resolver, dialer smtpclient.Diale
 		return
 	}
 	dialcancel()
+	rateLimitAdd(qlog, rateLimitsDomain(m0.RecipientDomain.Domain), len(msgs), false)
 
 	var auth func(mechanisms []string, cs *tls.ConnectionState) (sasl.Client, error)
 	if transport.Auth != nil {
@@ -286,3 +286,74 @@ func (a *clientSCRAMSHA) Next(fromServer []byte) (toServer []byte, last bool, re
 		return nil, false, fmt.Errorf("invalid step %d", a.step)
 	}
 }
+
+type clientOAUTHBEARER struct {
+	Username, Token string
+	step            int
+}
+
+var _ Client = (*clientOAUTHBEARER)(nil)
+
+// NewClientOAUTHBEARER returns a client for SASL OAUTHBEARER authentication with
+// an OAuth 2.0 bearer token. Username is sent as authorization identity if not
+// empty.
+//
+// OAUTHBEARER is specified in RFC 7628, A Set of Simple Authentication and
+// Security Layer (SASL) Mechanisms for OAuth.
+func NewClientOAUTHBEARER(username, token string) Client {
+	return &clientOAUTHBEARER{username, token, 0}
+}
+
+func (a *clientOAUTHBEARER) Info() (name string, hasCleartextCredentials bool) {
+	return "OAUTHBEARER", true
+}
+
+func (a *clientOAUTHBEARER) Next(fromServer []byte) (toServer []byte, last bool, rerr error) {
+	defer func() { a.step++ }()
+	switch a.step {
+	case 0:
+		// ../rfc/7628
+		var authzid string
+		if a.Username != "" {
+			authzid = "a=" + strings.NewReplacer("=", "=3D", ",", "=2C").Replace(a.Username)
+		}
+		return []byte(fmt.Sprintf("n,%s,\x01auth=Bearer %s\x01\x01", authzid, a.Token)), true, nil
+	case 1:
+		// Server sent an error as challenge, we must respond with a single kvsep, after
+		// which the server fails the authentication. ../rfc/7628
+		return []byte{0x01}, true, nil
+	default:
+		return nil, false, fmt.Errorf("invalid step %d", a.step)
+	}
+}
+
+type clientXOAUTH2 struct {
+	Username, Token string
+	step            int
+}
+
+var _ Client = (*clientXOAUTH2)(nil)
+
+// NewClientXOAUTH2 returns a client for the non-standard SASL XOAUTH2
+// authentication with an OAuth 2.0 bearer token, as used by Google and Microsoft.
+func NewClientXOAUTH2(username, token string) Client {
+	return &clientXOAUTH2{username, token, 0}
+}
+
+func (a *clientXOAUTH2) Info() (name string, hasCleartextCredentials bool) {
+	return "XOAUTH2", true
+}
+
+func (a *clientXOAUTH2) Next(fromServer []byte) (toServer []byte, last bool, rerr error) {
+	defer func() { a.step++ }()
+	switch a.step {
+	case 0:
+		return []byte(fmt.Sprintf("user=%s\x01auth=Bearer %s\x01\x01", a.Username, a.Token)), true, nil
+	case 1:
+		// Server sent an error as challenge, an empty response makes it fail the
+		// authentication.
+		return []byte{}, true, nil
+	default:
+		return nil, false, fmt.Errorf("invalid step %d", a.step)
+	}
+}
@@ -5,13 +5,16 @@ import (
 	"os"
 	"time"
 
+	"github.com/mjl-/mox/admindb"
 	"github.com/mjl-/mox/dmarcdb"
 	"github.com/mjl-/mox/dns"
 	"github.com/mjl-/mox/http"
 	"github.com/mjl-/mox/imapserver"
+	"github.com/mjl-/mox/managesieveserver"
 	"github.com/mjl-/mox/mlog"
 	"github.com/mjl-/mox/mox-"
 	"github.com/mjl-/mox/mtastsdb"
+	"github.com/mjl-/mox/pop3server"
 	"github.com/mjl-/mox/queue"
 	"github.com/mjl-/mox/smtpserver"
 	"github.com/mjl-/mox/store"
@@ -56,6 +59,8 @@ func shutdown(log mlog.Log) {
 func start(mtastsdbRefresher, sendDMARCReports, sendTLSReports, skipForkExec bool) error {
 	smtpserver.Listen()
 	imapserver.Listen()
+	managesieveserver.Listen()
+	pop3server.Listen()
 	http.Listen()
 
 	if !skipForkExec {
@@ -82,6 +87,10 @@ func start(mtastsdbRefresher, sendDMARCReports, sendTLSReports, skipForkExec boo
 		return fmt.Errorf("dmarcdb init: %s", err)
 	}
 
+	if err := admindb.Init(); err != nil {
+		return fmt.Errorf("admindb init: %s", err)
+	}
+
 	done := make(chan struct{}) // Goroutines for messages and webhooks, and cleaners.
 	if err := queue.Start(dns.StrictResolver{Pkg: "queue"}, done); err != nil {
 		return fmt.Errorf("queue start: %s", err)
@@ -98,6 +107,8 @@ func start(mtastsdbRefresher, sendDMARCReports, sendTLSReports, skipForkExec boo
 	store.StartAuthCache()
 	smtpserver.Serve()
 	imapserver.Serve()
+	managesieveserver.Serve()
+	pop3server.Serve()
 	http.Serve()
 
 	go func() {
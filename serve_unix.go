@@ -15,6 +15,7 @@ import (
 	"runtime"
 	"runtime/debug"
 	"slices"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -203,7 +204,7 @@ Only implemented on unix systems, not Windows.
 			} else {
 				configdir := filepath.Dir(mox.ConfigStaticPath)
 				datadir := mox.DataDirPath(".")
-				err := fixperms(log, workdir, configdir, datadir, mox.Conf.Static.UID, mox.Conf.Static.GID)
+				err := fixperms(log, workdir, configdir, datadir, tmpxid(mox.Conf.Static.UID), tmpxid(mox.Conf.Static.GID))
 				if err != nil {
 					log.Fatalx("fixing permissions", err)
 				}
@@ -233,7 +234,7 @@ Only implemented on unix systems, not Windows.
 		if err := os.WriteFile(recvidpath, recvidbuf, 0660); err != nil {
 			log.Fatalx("writing recvidpath", err, slog.String("path", recvidpath))
 		}
-		err := os.Chown(recvidpath, int(mox.Conf.Static.UID), 0)
+		err := os.Chown(recvidpath, int(tmpxid(mox.Conf.Static.UID)), 0)
 		log.Check(err, "chown receveidid.key",
 			slog.String("path", recvidpath),
 			slog.Any("uid", mox.Conf.Static.UID),
@@ -598,3 +599,8 @@ func fixperms(log mlog.Log, workdir, configdir, datadir string, moxuid, moxgid u
 	}
 	return nil
 }
+
+func tmpxid(s string) uint32 {
+	v, _ := strconv.ParseUint(s, 10, 32)
+	return uint32(v)
+}
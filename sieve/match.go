@@ -0,0 +1,62 @@
+package sieve
+
+import (
+	"unicode/utf8"
+)
+
+// Limit on the work for matching a single pattern, to prevent patterns with many
+// wildcards from taking excessive time.
+const maxGlobSteps = 100000
+
+// globMatch matches s against pattern with "*" (zero or more characters) and "?"
+// (a single character) wildcards. A backslash escapes the next character. On a
+// match, the offsets in s for each wildcard are returned. Wildcards match as few
+// characters as possible. ../rfc/5228:1189 ../rfc/5229:273
+func globMatch(pattern, s string) ([][2]int, bool) {
+	steps := 0
+	var match func(p string, o int, caps [][2]int) ([][2]int, bool)
+	match = func(p string, o int, caps [][2]int) ([][2]int, bool) {
+		for len(p) > 0 {
+			steps++
+			if steps > maxGlobSteps {
+				return nil, false
+			}
+			switch p[0] {
+			case '*':
+				p = p[1:]
+				for e := o; e <= len(s); {
+					if r, ok := match(p, e, append(caps[:len(caps):len(caps)], [2]int{o, e})); ok {
+						return r, true
+					}
+					if e == len(s) || steps > maxGlobSteps {
+						break
+					}
+					_, n := utf8.DecodeRuneInString(s[e:])
+					e += n
+				}
+				return nil, false
+			case '?':
+				if o >= len(s) {
+					return nil, false
+				}
+				_, n := utf8.DecodeRuneInString(s[o:])
+				caps = append(caps, [2]int{o, o + n})
+				o += n
+				p = p[1:]
+			default:
+				c := p[0]
+				if c == '\\' && len(p) > 1 {
+					p = p[1:]
+					c = p[0]
+				}
+				if o >= len(s) || s[o] != c {
+					return nil, false
+				}
+				o++
+				p = p[1:]
+			}
+		}
+		return caps, o == len(s)
+	}
+	return match(pattern, 0, nil)
+}
@@ -0,0 +1,634 @@
+package sieve
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Script is a parsed and checked Sieve script, ready for evaluation with Run.
+type Script struct {
+	Extensions []string // Extensions from "require" commands, in lower case.
+
+	commands []*node
+}
+
+// ParseError is returned for syntax and semantic errors in scripts.
+type ParseError struct {
+	Line int // 1-based.
+	Msg  string
+}
+
+func (e ParseError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// Kinds of arguments.
+type kind int
+
+const (
+	kindNone kind = iota // For tags without value.
+	kindString
+	kindStringList
+	kindNumber
+)
+
+func (k kind) String() string {
+	switch k {
+	case kindString:
+		return "string"
+	case kindStringList:
+		return "string list"
+	case kindNumber:
+		return "number"
+	}
+	return "none"
+}
+
+type argument struct {
+	tag     string   // For tags, lower case and without colon. Empty for other arguments.
+	number  int64    // For number.
+	strs    []string // For string and string list.
+	list    bool     // Whether strs is a string list, i.e. used brackets.
+	isNum   bool
+	tagLine int
+}
+
+func (a argument) kind() kind {
+	if a.tag != "" {
+		return kindNone
+	} else if a.isNum {
+		return kindNumber
+	} else if a.list {
+		return kindStringList
+	}
+	return kindString
+}
+
+// node is a command or a test.
+type node struct {
+	line  int
+	name  string // Lower case.
+	args  []argument
+	tests []*node // Single test for "if", "elsif" and "not", test list for "anyof" and "allof".
+	block []*node // For if/elsif/else.
+
+	// After checking.
+	tags map[string]argument // Value for tags with a parameter, or zero argument for tags without parameter.
+	pos  []argument          // Positional arguments.
+}
+
+// spec describes the arguments for a command or test.
+type spec struct {
+	ext    string          // Extension that must be required. Empty for core commands/tests.
+	tags   map[string]kind // Allowed tags, with kind of their parameter.
+	groups [][]string      // Groups of mutually exclusive tags.
+	pos    []kind          // Positional arguments.
+	minPos int             // Leading positional arguments are optional if fewer are present.
+	tests  int             // Number of tests, -1 for a test list.
+}
+
+var (
+	matchTags       = map[string]kind{"comparator": kindString, "is": kindNone, "contains": kindNone, "matches": kindNone}
+	matchGroups     = [][]string{{"is", "contains", "matches"}}
+	addressTags     = map[string]kind{"comparator": kindString, "is": kindNone, "contains": kindNone, "matches": kindNone, "all": kindNone, "localpart": kindNone, "domain": kindNone}
+	addressGroups   = [][]string{{"is", "contains", "matches"}, {"all", "localpart", "domain"}}
+	bodyTags        = map[string]kind{"comparator": kindString, "is": kindNone, "contains": kindNone, "matches": kindNone, "raw": kindNone, "content": kindStringList, "text": kindNone}
+	bodyGroups      = [][]string{{"is", "contains", "matches"}, {"raw", "content", "text"}}
+	setModifierTags = map[string]kind{"lower": kindNone, "upper": kindNone, "lowerfirst": kindNone, "upperfirst": kindNone, "quotewildcard": kindNone, "length": kindNone}
+)
+
+// tagExtensions lists tags that are only allowed when an extension is required.
+var tagExtensions = map[string]string{
+	"copy":  "copy",
+	"flags": "imap4flags",
+}
+
+var commandSpecs = map[string]spec{
+	"require":    {pos: []kind{kindStringList}, minPos: 1},
+	"stop":       {},
+	"keep":       {tags: map[string]kind{"flags": kindStringList}},
+	"discard":    {},
+	"redirect":   {tags: map[string]kind{"copy": kindNone}, pos: []kind{kindString}, minPos: 1},
+	"fileinto":   {ext: "fileinto", tags: map[string]kind{"copy": kindNone, "flags": kindStringList}, pos: []kind{kindString}, minPos: 1},
+	"reject":     {ext: "reject", pos: []kind{kindString}, minPos: 1},
+	"ereject":    {ext: "ereject", pos: []kind{kindString}, minPos: 1},
+	"vacation":   {ext: "vacation", tags: map[string]kind{"days": kindNumber, "subject": kindString, "from": kindString, "addresses": kindStringList, "mime": kindNone, "handle": kindString}, pos: []kind{kindString}, minPos: 1},
+	"set":        {ext: "variables", tags: setModifierTags, groups: [][]string{{"lower", "upper"}, {"lowerfirst", "upperfirst"}}, pos: []kind{kindString, kindString}, minPos: 2},
+	"setflag":    {ext: "imap4flags", pos: []kind{kindString, kindStringList}, minPos: 1},
+	"addflag":    {ext: "imap4flags", pos: []kind{kindString, kindStringList}, minPos: 1},
+	"removeflag": {ext: "imap4flags", pos: []kind{kindString, kindStringList}, minPos: 1},
+}
+
+var testSpecs = map[string]spec{
+	"address":  {tags: addressTags, groups: addressGroups, pos: []kind{kindStringList, kindStringList}, minPos: 2},
+	"allof":    {tests: -1},
+	"anyof":    {tests: -1},
+	"envelope": {ext: "envelope", tags: addressTags, groups: addressGroups, pos: []kind{kindStringList, kindStringList}, minPos: 2},
+	"exists":   {pos: []kind{kindStringList}, minPos: 1},
+	"false":    {},
+	"header":   {tags: matchTags, groups: matchGroups, pos: []kind{kindStringList, kindStringList}, minPos: 2},
+	"not":      {tests: 1},
+	"size":     {tags: map[string]kind{"over": kindNone, "under": kindNone}, groups: [][]string{{"over", "under"}}, pos: []kind{kindNumber}, minPos: 1},
+	"true":     {},
+	"body":     {ext: "body", tags: bodyTags, groups: bodyGroups, pos: []kind{kindStringList}, minPos: 1},
+	"string":   {ext: "variables", tags: matchTags, groups: matchGroups, pos: []kind{kindStringList, kindStringList}, minPos: 2},
+	"hasflag":  {ext: "imap4flags", tags: matchTags, groups: matchGroups, pos: []kind{kindStringList, kindStringList}, minPos: 1},
+}
+
+// Extensions lists the supported extensions, as used in "require" commands and
+// as announced in ManageSieve capabilities.
+var Extensions = []string{
+	"body",
+	"comparator-i;ascii-casemap",
+	"comparator-i;octet",
+	"copy",
+	"envelope",
+	"ereject",
+	"fileinto",
+	"imap4flags",
+	"reject",
+	"vacation",
+	"variables",
+}
+
+const maxNesting = 32
+
+type parser struct {
+	s    string
+	o    int
+	line int
+	exts map[string]bool
+}
+
+type parseError struct {
+	err ParseError
+}
+
+func (p *parser) xerrorf(format string, args ...any) {
+	panic(parseError{ParseError{p.line, fmt.Sprintf(format, args...)}})
+}
+
+func (p *parser) xlinef(line int, format string, args ...any) {
+	panic(parseError{ParseError{line, fmt.Sprintf(format, args...)}})
+}
+
+// Parse parses and checks a Sieve script. Unknown commands, tests or
+// extensions, and use of extensions without "require" result in an error.
+func Parse(script string) (s *Script, rerr error) {
+	p := &parser{s: script, line: 1, exts: map[string]bool{}}
+
+	defer func() {
+		x := recover()
+		if x == nil {
+			return
+		}
+		if err, ok := x.(parseError); ok {
+			rerr = err.err
+			return
+		}
+		panic(x)
+	}()
+
+	s = &Script{}
+	s.commands = p.xcommands(0, false)
+	for ext := range p.exts {
+		s.Extensions = append(s.Extensions, ext)
+	}
+	sort.Strings(s.Extensions)
+	return s, nil
+}
+
+// skip skips whitespace and comments.
+func (p *parser) skip() {
+	for p.o < len(p.s) {
+		c := p.s[p.o]
+		switch {
+		case c == '\n':
+			p.line++
+			p.o++
+		case c == ' ' || c == '\t' || c == '\r':
+			p.o++
+		case c == '#':
+			for p.o < len(p.s) && p.s[p.o] != '\n' {
+				p.o++
+			}
+		case strings.HasPrefix(p.s[p.o:], "/*"):
+			end := strings.Index(p.s[p.o+2:], "*/")
+			if end < 0 {
+				p.xerrorf("unterminated comment")
+			}
+			p.line += strings.Count(p.s[p.o:p.o+2+end], "\n")
+			p.o += 2 + end + 2
+		default:
+			return
+		}
+	}
+}
+
+func (p *parser) empty() bool {
+	p.skip()
+	return p.o >= len(p.s)
+}
+
+func (p *parser) peek(s string) bool {
+	p.skip()
+	return strings.HasPrefix(p.s[p.o:], s)
+}
+
+func (p *parser) take(s string) bool {
+	if p.peek(s) {
+		p.o += len(s)
+		return true
+	}
+	return false
+}
+
+func (p *parser) xtake(s string) {
+	if !p.take(s) {
+		p.xerrorf("expected %q", s)
+	}
+}
+
+func isAlpha(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func (p *parser) peekIdentifier() bool {
+	return !p.empty() && (isAlpha(p.s[p.o]) || p.s[p.o] == '_')
+}
+
+// identifier returns the identifier at the current position, or the empty string.
+func (p *parser) identifier() string {
+	p.skip()
+	o := p.o
+	for o < len(p.s) && (isAlpha(p.s[o]) || p.s[o] == '_' || o > p.o && isDigit(p.s[o])) {
+		o++
+	}
+	s := p.s[p.o:o]
+	p.o = o
+	return s
+}
+
+func (p *parser) xcommands(depth int, inBlock bool) []*node {
+	if depth > maxNesting {
+		p.xerrorf("blocks nested too deeply")
+	}
+
+	var l []*node
+	requireAllowed := depth == 0
+	for !p.empty() {
+		if inBlock && p.peek("}") {
+			break
+		}
+		line := p.line
+		name := strings.ToLower(p.identifier())
+		if name == "" {
+			p.xerrorf("expected command")
+		}
+		n := &node{line: line, name: name}
+		switch name {
+		case "if", "elsif", "else":
+			if name != "if" && (len(l) == 0 || l[len(l)-1].name != "if" && l[len(l)-1].name != "elsif") {
+				p.xerrorf("%s without preceding if or elsif", name)
+			}
+			if name != "else" {
+				n.tests = []*node{p.xtest(depth + 1)}
+			}
+			p.xtake("{")
+			n.block = p.xcommands(depth+1, true)
+			p.xtake("}")
+			l = append(l, n)
+			requireAllowed = false
+			continue
+		}
+		n.args = p.xarguments()
+		if p.peek("(") || p.peekIdentifier() {
+			p.xerrorf("unexpected test for command %s", name)
+		}
+		p.xtake(";")
+		if name == "require" {
+			if !requireAllowed {
+				p.xerrorf("require must come before other commands")
+			}
+		} else {
+			requireAllowed = false
+		}
+		p.xcheck(n, commandSpecs, "command")
+		if name == "require" {
+			for _, ext := range n.pos[0].strs {
+				ext = strings.ToLower(ext)
+				if !supported(ext) {
+					p.xlinef(line, "unsupported extension %q", ext)
+				}
+				p.exts[ext] = true
+			}
+		}
+		l = append(l, n)
+	}
+	return l
+}
+
+func supported(ext string) bool {
+	for _, e := range Extensions {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *parser) xtest(depth int) *node {
+	if depth > maxNesting {
+		p.xerrorf("tests nested too deeply")
+	}
+	line := p.line
+	name := strings.ToLower(p.identifier())
+	if name == "" {
+		p.xerrorf("expected test")
+	}
+	n := &node{line: line, name: name}
+	n.args = p.xarguments()
+	if p.take("(") {
+		for {
+			n.tests = append(n.tests, p.xtest(depth+1))
+			if !p.take(",") {
+				break
+			}
+		}
+		p.xtake(")")
+	} else if p.peekIdentifier() {
+		n.tests = []*node{p.xtest(depth + 1)}
+	}
+	p.xcheck(n, testSpecs, "test")
+	return n
+}
+
+func (p *parser) xarguments() []argument {
+	var l []argument
+	for !p.empty() {
+		c := p.s[p.o]
+		switch {
+		case c == ':':
+			line := p.line
+			p.o++
+			tag := strings.ToLower(p.identifier())
+			if tag == "" {
+				p.xerrorf("expected tag after colon")
+			}
+			l = append(l, argument{tag: tag, tagLine: line})
+		case isDigit(c):
+			l = append(l, argument{number: p.xnumber(), isNum: true})
+		case c == '[':
+			p.o++
+			var strs []string
+			for {
+				strs = append(strs, p.xstring())
+				if !p.take(",") {
+					break
+				}
+			}
+			p.xtake("]")
+			l = append(l, argument{strs: strs, list: true})
+		case c == '"' || strings.HasPrefix(p.s[p.o:], "text:"):
+			l = append(l, argument{strs: []string{p.xstring()}})
+		default:
+			return l
+		}
+	}
+	return l
+}
+
+func (p *parser) xnumber() int64 {
+	o := p.o
+	for p.o < len(p.s) && isDigit(p.s[p.o]) {
+		p.o++
+	}
+	v, err := strconv.ParseInt(p.s[o:p.o], 10, 64)
+	if err != nil {
+		p.xerrorf("bad number: %v", err)
+	}
+	if p.o < len(p.s) {
+		var mult int64
+		switch p.s[p.o] {
+		case 'k', 'K':
+			mult = 1024
+		case 'm', 'M':
+			mult = 1024 * 1024
+		case 'g', 'G':
+			mult = 1024 * 1024 * 1024
+		}
+		if mult > 0 {
+			p.o++
+			if v > (1<<62)/mult {
+				p.xerrorf("number too large")
+			}
+			v *= mult
+		}
+	}
+	return v
+}
+
+func (p *parser) xstring() string {
+	p.skip()
+	if p.o >= len(p.s) {
+		p.xerrorf("expected string")
+	}
+	if p.s[p.o] == '"' {
+		p.o++
+		var b strings.Builder
+		for {
+			if p.o >= len(p.s) {
+				p.xerrorf("unterminated string")
+			}
+			c := p.s[p.o]
+			p.o++
+			switch c {
+			case '"':
+				return b.String()
+			case '\\':
+				if p.o >= len(p.s) {
+					p.xerrorf("unterminated string")
+				}
+				c = p.s[p.o]
+				p.o++
+			case '\n':
+				p.line++
+			}
+			b.WriteByte(c)
+		}
+	}
+	if !strings.HasPrefix(p.s[p.o:], "text:") {
+		p.xerrorf("expected string")
+	}
+	p.o += len("text:")
+	for p.o < len(p.s) && (p.s[p.o] == ' ' || p.s[p.o] == '\t') {
+		p.o++
+	}
+	if p.o < len(p.s) && p.s[p.o] == '#' {
+		for p.o < len(p.s) && p.s[p.o] != '\n' {
+			p.o++
+		}
+	}
+	if strings.HasPrefix(p.s[p.o:], "\r\n") {
+		p.o += 2
+	} else if strings.HasPrefix(p.s[p.o:], "\n") {
+		p.o++
+	} else {
+		p.xerrorf("expected newline after text:")
+	}
+	p.line++
+	var b strings.Builder
+	for {
+		if p.o >= len(p.s) {
+			p.xerrorf("unterminated multi-line string")
+		}
+		end := strings.IndexByte(p.s[p.o:], '\n')
+		var line string
+		if end < 0 {
+			line = p.s[p.o:]
+			p.o = len(p.s)
+		} else {
+			line = p.s[p.o : p.o+end]
+			p.o += end + 1
+		}
+		p.line++
+		line = strings.TrimSuffix(line, "\r")
+		if line == "." {
+			return b.String()
+		}
+		line = strings.TrimPrefix(line, ".")
+		b.WriteString(line)
+		b.WriteString("\r\n")
+	}
+}
+
+// xcheck checks the arguments of n against the spec for its name, and
+// sets the parsed tags and positional arguments.
+func (p *parser) xcheck(n *node, specs map[string]spec, what string) {
+	sp, ok := specs[n.name]
+	if !ok {
+		p.xlinef(n.line, "unknown %s %q", what, n.name)
+	}
+	if sp.ext != "" && !p.exts[sp.ext] {
+		p.xlinef(n.line, "%s %q requires extension %q", what, n.name, sp.ext)
+	}
+
+	n.tags = map[string]argument{}
+	args := n.args
+	for len(args) > 0 && args[0].tag != "" {
+		a := args[0]
+		args = args[1:]
+		k, ok := sp.tags[a.tag]
+		if !ok {
+			p.xlinef(a.tagLine, "unknown tag :%s for %s %q", a.tag, what, n.name)
+		}
+		if ext, ok := tagExtensions[a.tag]; ok && !p.exts[ext] {
+			p.xlinef(a.tagLine, "tag :%s requires extension %q", a.tag, ext)
+		}
+		if _, ok := n.tags[a.tag]; ok {
+			p.xlinef(a.tagLine, "duplicate tag :%s", a.tag)
+		}
+		var v argument
+		if k != kindNone {
+			if len(args) == 0 || !kindMatches(k, args[0].kind()) {
+				p.xlinef(a.tagLine, "tag :%s requires %s parameter", a.tag, k)
+			}
+			v = args[0]
+			args = args[1:]
+		}
+		n.tags[a.tag] = v
+	}
+	for _, g := range sp.groups {
+		var have []string
+		for _, t := range g {
+			if _, ok := n.tags[t]; ok {
+				have = append(have, ":"+t)
+			}
+		}
+		if len(have) > 1 {
+			p.xlinef(n.line, "conflicting tags %s", strings.Join(have, " and "))
+		}
+	}
+	if n.name == "size" && len(n.tags) != 1 {
+		p.xlinef(n.line, "size requires :over or :under")
+	}
+	if len(args) < sp.minPos || len(args) > len(sp.pos) {
+		p.xlinef(n.line, "%s %q: expected %d positional arguments, got %d", what, n.name, len(sp.pos), len(args))
+	}
+	kinds := sp.pos[len(sp.pos)-len(args):]
+	for i, a := range args {
+		if a.tag != "" {
+			p.xlinef(a.tagLine, "tag :%s must come before other arguments", a.tag)
+		}
+		if !kindMatches(kinds[i], a.kind()) {
+			p.xlinef(n.line, "%s %q: argument %d must be %s", what, n.name, i+1, kinds[i])
+		}
+	}
+	// Optional leading positional arguments that are absent are represented as empty
+	// arguments, so evaluation can use fixed indices.
+	for i := len(args); i < len(sp.pos); i++ {
+		n.pos = append(n.pos, argument{})
+	}
+	n.pos = append(n.pos, args...)
+
+	switch {
+	case sp.tests == 0 && len(n.tests) > 0:
+		p.xlinef(n.line, "%s %q does not take tests", what, n.name)
+	case sp.tests == 1 && len(n.tests) != 1:
+		p.xlinef(n.line, "%s %q requires a single test", what, n.name)
+	case sp.tests == -1 && len(n.tests) == 0:
+		p.xlinef(n.line, "%s %q requires a test list", what, n.name)
+	}
+
+	if v, ok := n.tags["comparator"]; ok {
+		if c := strings.ToLower(v.strs[0]); c != "i;octet" && c != "i;ascii-casemap" {
+			p.xlinef(n.line, "unsupported comparator %q", v.strs[0])
+		}
+	}
+	if n.name == "set" && !validVariableName(n.pos[0].strs[0]) {
+		p.xlinef(n.line, "invalid variable name %q", n.pos[0].strs[0])
+	}
+	if (n.name == "setflag" || n.name == "addflag" || n.name == "removeflag") && n.pos[0].strs != nil && !validVariableName(n.pos[0].strs[0]) {
+		p.xlinef(n.line, "invalid variable name %q", n.pos[0].strs[0])
+	}
+	if n.name == "hasflag" && n.pos[0].strs != nil {
+		for _, s := range n.pos[0].strs {
+			if !validVariableName(s) {
+				p.xlinef(n.line, "invalid variable name %q", s)
+			}
+		}
+	}
+	if (n.name == "setflag" || n.name == "addflag" || n.name == "removeflag" || n.name == "hasflag") && n.pos[0].strs != nil && !p.exts["variables"] {
+		p.xlinef(n.line, "variable name parameter for %s requires extension %q", n.name, "variables")
+	}
+	if n.name == "vacation" {
+		if v, ok := n.tags["days"]; ok && v.number < 1 {
+			p.xlinef(n.line, "vacation :days must be at least 1")
+		}
+	}
+}
+
+// kindMatches returns whether an argument of kind have can be used for a
+// parameter of kind want. A single string is allowed where a string list is
+// expected.
+func kindMatches(want, have kind) bool {
+	return want == have || want == kindStringList && have == kindString
+}
+
+func validVariableName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range []byte(s) {
+		if !(isAlpha(c) || c == '_' || i > 0 && isDigit(c)) {
+			return false
+		}
+	}
+	return true
+}
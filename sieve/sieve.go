@@ -0,0 +1,855 @@
+// Package sieve implements the Sieve mail filtering language, RFC 5228.
+//
+// Supported extensions: fileinto, reject and ereject (RFC 5429), envelope,
+// body (RFC 5173), variables (RFC 5229), vacation (RFC 5230), imap4flags
+// (RFC 5232), copy (RFC 3894) and the i;octet and i;ascii-casemap comparators.
+//
+// A script is parsed and checked with Parse, and evaluated against a message
+// with Script.Run. Evaluation does not perform any actions, it returns a Result
+// with the actions the caller should perform, such as delivering to a mailbox,
+// redirecting or sending a vacation response.
+package sieve
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"strings"
+
+	"github.com/mjl-/mox/message"
+)
+
+// Message is the message and envelope that a script is evaluated against.
+type Message struct {
+	MailFrom string // SMTP MAIL FROM address, empty for the null sender.
+	RcptTo   string // SMTP RCPT TO address.
+	Size     int64  // Size of the message in bytes.
+
+	// Parsed message, with reader set and sub parts walked. If nil, the message is
+	// treated as having no header and an empty body.
+	Part *message.Part
+}
+
+// Result holds the actions that result from evaluating a script.
+type Result struct {
+	Keep      bool       // Whether to deliver to the default mailbox, due to an explicit or implicit keep.
+	KeepFlags []string   // Flags and keywords to set on a message delivered with keep.
+	FileInto  []FileInto // Mailboxes to deliver the message to. Never contains the same mailbox twice.
+	Redirect  []string   // Addresses to forward the message to.
+	Reject    *Reject    // If non-nil, the message must be rejected, and no other actions are present.
+	Vacation  *Vacation  // Vacation response to send, only set if the message qualifies for a response.
+}
+
+// FileInto is an action to deliver a message to a mailbox.
+type FileInto struct {
+	Mailbox string
+	Flags   []string // Flags and keywords, e.g. `\Seen` or `$Junk`.
+}
+
+// Reject is an action to refuse a message, with a reason for the sender.
+type Reject struct {
+	Reason   string
+	Extended bool // From "ereject", the rejection should be done at the protocol level (SMTP) instead of with a DSN.
+}
+
+// ResponseText returns the reason as a single line of at most 256 bytes, for use
+// in a protocol response. Scripts can set any text as reason, including multiple
+// lines. If the reason is empty, a default text is returned.
+func (r Reject) ResponseText() string {
+	reason := strings.Join(strings.Fields(r.Reason), " ")
+	if len(reason) > 256 {
+		reason = reason[:256]
+	}
+	if reason == "" {
+		reason = "rejected by recipient"
+	}
+	return reason
+}
+
+// Vacation is an auto-response to send to the sender of the message. The
+// caller must only send a response if none was sent to the same address with
+// the same handle within Days days.
+type Vacation struct {
+	To        string   // Address to send the response to, the SMTP MAIL FROM.
+	From      string   // From address for the response. If empty, the recipient address should be used.
+	Subject   string   // Subject for the response, "Auto: " and the original subject by default.
+	InReplyTo string   // Message-ID of the original message, for threading. Can be empty.
+	Reason    string   // Text body of the response, or MIME entity with headers if Mime is set.
+	Mime      bool     // Whether Reason is a MIME entity.
+	Days      int      // Minimum interval between responses to the same sender.
+	Handle    string   // Identifies the vacation response for tracking previous responses.
+	Addresses []string // Additional addresses of the recipient.
+}
+
+// MaxRedirects is the maximum number of redirect actions in a script evaluation.
+const MaxRedirects = 10
+
+// Limits on actions.
+const (
+	maxFileInto = 32
+	maxBodyRead = 1024 * 1024
+	defaultDays = 7
+	maxDays     = 90
+)
+
+// Errors during evaluation. When an error is returned, callers should perform
+// an implicit keep, i.e. deliver to the default mailbox.
+var (
+	ErrTooManyRedirects = errors.New("too many redirects")
+	ErrConflict         = errors.New("conflicting actions")
+)
+
+type runError struct {
+	err error
+}
+
+// stopped is used to abort evaluation on a "stop" command.
+type stopped struct{}
+
+type interp struct {
+	script *Script
+	msg    Message
+
+	variables bool              // Whether the "variables" extension is required.
+	vars      map[string]string // Lower case variable names.
+	matchVars []string          // Match variables, ${0} and further.
+	flags     []string          // Internal variable for imap4flags.
+
+	header    textproto.MIMEHeader
+	headerErr error
+
+	implicitKeep bool
+	explicitKeep bool
+	keepFlags    []string
+	fileinto     []FileInto
+	redirect     []string
+	reject       *Reject
+	vacation     *Vacation
+}
+
+func (in *interp) xerrorf(format string, args ...any) {
+	panic(runError{fmt.Errorf(format, args...)})
+}
+
+// Run evaluates the script against a message and returns the resulting actions.
+//
+// If an error is returned, the script failed at runtime. The message should be
+// delivered to the default mailbox, as with an implicit keep.
+func (s *Script) Run(m Message) (result Result, rerr error) {
+	in := &interp{
+		script:       s,
+		msg:          m,
+		vars:         map[string]string{},
+		implicitKeep: true,
+	}
+	for _, ext := range s.Extensions {
+		if ext == "variables" {
+			in.variables = true
+		}
+	}
+
+	defer func() {
+		x := recover()
+		if x == nil {
+			return
+		}
+		if err, ok := x.(runError); ok {
+			rerr = err.err
+			return
+		}
+		panic(x)
+	}()
+
+	in.run()
+
+	if in.reject != nil && (in.explicitKeep || len(in.fileinto) > 0 || len(in.redirect) > 0 || in.vacation != nil) {
+		return Result{}, fmt.Errorf("%w: reject cannot be combined with keep, fileinto, redirect or vacation", ErrConflict)
+	}
+
+	result = Result{
+		Keep:     in.explicitKeep || in.implicitKeep && in.reject == nil,
+		FileInto: in.fileinto,
+		Redirect: in.redirect,
+		Reject:   in.reject,
+	}
+	if in.explicitKeep {
+		result.KeepFlags = in.keepFlags
+	} else if result.Keep {
+		result.KeepFlags = in.flags
+	}
+	if in.vacation != nil && in.vacationApplies(in.vacation) {
+		result.Vacation = in.vacation
+	}
+	return result, nil
+}
+
+// run executes the script, until the end or a "stop" command.
+func (in *interp) run() {
+	defer func() {
+		x := recover()
+		if _, ok := x.(stopped); ok || x == nil {
+			return
+		}
+		panic(x)
+	}()
+
+	in.exec(in.script.commands)
+}
+
+func (in *interp) exec(l []*node) {
+	for i := 0; i < len(l); i++ {
+		n := l[i]
+		switch n.name {
+		case "require":
+		case "if":
+			// Evaluate the if/elsif chain, and execute the first block whose test is true.
+			for {
+				n := l[i]
+				if n.name == "else" || in.test(n.tests[0]) {
+					in.exec(n.block)
+					for i+1 < len(l) && (l[i+1].name == "elsif" || l[i+1].name == "else") {
+						i++
+					}
+					break
+				}
+				if i+1 >= len(l) || l[i+1].name != "elsif" && l[i+1].name != "else" {
+					break
+				}
+				i++
+			}
+		case "stop":
+			panic(stopped{})
+		case "keep":
+			in.explicitKeep = true
+			in.keepFlags = in.flagsTag(n)
+		case "discard":
+			in.implicitKeep = false
+		case "fileinto":
+			mailbox := in.expand(n.pos[0].strs[0])
+			flags := in.flagsTag(n)
+			if _, ok := n.tags["copy"]; !ok {
+				in.implicitKeep = false
+			}
+			var have bool
+			for _, fi := range in.fileinto {
+				have = have || fi.Mailbox == mailbox
+			}
+			if !have {
+				if len(in.fileinto) >= maxFileInto {
+					in.xerrorf("too many fileinto actions")
+				}
+				in.fileinto = append(in.fileinto, FileInto{mailbox, flags})
+			}
+		case "redirect":
+			addr := in.expand(n.pos[0].strs[0])
+			if _, err := mail.ParseAddress(addr); err != nil {
+				in.xerrorf("redirect: invalid address %q: %v", addr, err)
+			}
+			if _, ok := n.tags["copy"]; !ok {
+				in.implicitKeep = false
+			}
+			var have bool
+			for _, a := range in.redirect {
+				have = have || strings.EqualFold(a, addr)
+			}
+			if !have {
+				if len(in.redirect) >= MaxRedirects {
+					panic(runError{ErrTooManyRedirects})
+				}
+				in.redirect = append(in.redirect, addr)
+			}
+		case "reject", "ereject":
+			if in.reject != nil {
+				in.xerrorf("multiple reject actions")
+			}
+			in.reject = &Reject{in.expand(n.pos[0].strs[0]), n.name == "ereject"}
+			in.implicitKeep = false
+		case "vacation":
+			if in.vacation != nil {
+				in.xerrorf("multiple vacation actions")
+			}
+			in.vacation = in.makeVacation(n)
+		case "set":
+			in.set(n)
+		case "setflag", "addflag", "removeflag":
+			in.setFlags(n)
+		default:
+			in.xerrorf("unknown command %q", n.name)
+		}
+	}
+}
+
+// flagsTag returns the flags for a keep or fileinto command, either from the
+// :flags tag or the internal flags variable.
+func (in *interp) flagsTag(n *node) []string {
+	if v, ok := n.tags["flags"]; ok {
+		return flagList(in.expandList(v.strs))
+	}
+	return append([]string(nil), in.flags...)
+}
+
+// flagList splits the strings on whitespace and removes duplicates, comparing
+// case-insensitively.
+func flagList(l []string) []string {
+	var r []string
+	seen := map[string]bool{}
+	for _, s := range l {
+		for _, f := range strings.Fields(s) {
+			lf := strings.ToLower(f)
+			if !seen[lf] {
+				seen[lf] = true
+				r = append(r, f)
+			}
+		}
+	}
+	return r
+}
+
+func (in *interp) setFlags(n *node) {
+	var cur []string
+	varName := ""
+	if n.pos[0].strs != nil {
+		varName = strings.ToLower(n.pos[0].strs[0])
+		cur = flagList([]string{in.vars[varName]})
+	} else {
+		cur = in.flags
+	}
+	flags := flagList(in.expandList(n.pos[1].strs))
+	switch n.name {
+	case "setflag":
+		cur = flags
+	case "addflag":
+		cur = flagList(append(append([]string{}, cur...), flags...))
+	case "removeflag":
+		var r []string
+		for _, f := range cur {
+			var remove bool
+			for _, rf := range flags {
+				remove = remove || strings.EqualFold(f, rf)
+			}
+			if !remove {
+				r = append(r, f)
+			}
+		}
+		cur = r
+	}
+	if varName != "" {
+		in.vars[varName] = strings.Join(cur, " ")
+	} else {
+		in.flags = cur
+	}
+}
+
+func (in *interp) set(n *node) {
+	name := strings.ToLower(n.pos[0].strs[0])
+	v := in.expand(n.pos[1].strs[0])
+	has := func(t string) bool {
+		_, ok := n.tags[t]
+		return ok
+	}
+	// Modifiers are applied in order of precedence, ../rfc/5229:338
+	if has("lower") {
+		v = strings.ToLower(v)
+	} else if has("upper") {
+		v = strings.ToUpper(v)
+	}
+	if v != "" && has("lowerfirst") {
+		r := []rune(v)
+		v = strings.ToLower(string(r[0])) + string(r[1:])
+	} else if v != "" && has("upperfirst") {
+		r := []rune(v)
+		v = strings.ToUpper(string(r[0])) + string(r[1:])
+	}
+	if has("quotewildcard") {
+		v = strings.NewReplacer(`*`, `\*`, `?`, `\?`, `\`, `\\`).Replace(v)
+	}
+	if has("length") {
+		v = fmt.Sprintf("%d", len([]rune(v)))
+	}
+	in.vars[name] = v
+}
+
+func (in *interp) makeVacation(n *node) *Vacation {
+	str := func(tag string) string {
+		if v, ok := n.tags[tag]; ok {
+			return in.expand(v.strs[0])
+		}
+		return ""
+	}
+	v := &Vacation{
+		To:      in.msg.MailFrom,
+		From:    str("from"),
+		Subject: str("subject"),
+		Reason:  in.expand(n.pos[0].strs[0]),
+		Days:    defaultDays,
+		Handle:  str("handle"),
+	}
+	if _, ok := n.tags["mime"]; ok {
+		v.Mime = true
+	}
+	if a, ok := n.tags["days"]; ok {
+		v.Days = int(min(a.number, maxDays))
+	}
+	if a, ok := n.tags["addresses"]; ok {
+		v.Addresses = in.expandList(a.strs)
+	}
+	in.completeVacation(v)
+	return v
+}
+
+// completeVacation sets the handle and subject of v if empty, and the message-id
+// to reply to.
+func (in *interp) completeVacation(v *Vacation) {
+	if v.Handle == "" {
+		// Responses with different parameters are tracked separately. ../rfc/5230:279
+		h := sha256.New()
+		for _, s := range []string{v.From, v.Subject, v.Reason, fmt.Sprintf("%v", v.Mime)} {
+			h.Write([]byte(s))
+			h.Write([]byte{0})
+		}
+		v.Handle = base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:12])
+	}
+	if v.Subject == "" {
+		v.Subject = "Auto: " + in.decodedHeader("Subject")
+	}
+	hdr := in.xheader()
+	v.InReplyTo = strings.TrimSpace(hdr.Get("Message-Id"))
+}
+
+// AutoReply returns the vacation response v completed for message m, or nil if
+// the message does not qualify for an automatic response, with the same rules as
+// the "vacation" action of scripts, e.g. no responses to lists, automatically
+// submitted messages or messages the recipient is not explicitly addressed in.
+// Field To is set to the sender, and InReplyTo to the message-id of m. Subject
+// and Handle are set to defaults if empty, and Days if not positive.
+func AutoReply(m Message, v Vacation) (rv *Vacation, rerr error) {
+	in := &interp{msg: m, vars: map[string]string{}}
+
+	defer func() {
+		x := recover()
+		if x == nil {
+			return
+		}
+		if err, ok := x.(runError); ok {
+			rerr = err.err
+			return
+		}
+		panic(x)
+	}()
+
+	v.To = m.MailFrom
+	if v.Days <= 0 {
+		v.Days = defaultDays
+	}
+	v.Days = min(v.Days, maxDays)
+	if !in.vacationApplies(&v) {
+		return nil, nil
+	}
+	in.completeVacation(&v)
+	return &v, nil
+}
+
+// vacationApplies returns whether a vacation response should be sent for the
+// message. ../rfc/5230:351 ../rfc/3834:238
+func (in *interp) vacationApplies(v *Vacation) bool {
+	sender := in.msg.MailFrom
+	if sender == "" {
+		return false
+	}
+	t := strings.Index(sender, "@")
+	if t < 0 {
+		return false
+	}
+	lp := strings.ToLower(sender[:t])
+	if lp == "mailer-daemon" || lp == "postmaster" || lp == "listserv" || lp == "majordomo" || strings.HasPrefix(lp, "owner-") || strings.HasSuffix(lp, "-request") || strings.HasSuffix(lp, "-bounces") {
+		return false
+	}
+
+	own := append([]string{in.msg.RcptTo}, v.Addresses...)
+	for _, a := range own {
+		if strings.EqualFold(a, sender) {
+			return false
+		}
+	}
+
+	hdr := in.xheader()
+	if as := strings.ToLower(strings.TrimSpace(hdr.Get("Auto-Submitted"))); as != "" && as != "no" {
+		return false
+	}
+	for _, k := range []string{"List-Id", "List-Help", "List-Unsubscribe", "List-Subscribe", "List-Post", "List-Owner", "List-Archive"} {
+		if _, ok := hdr[k]; ok {
+			return false
+		}
+	}
+	switch strings.ToLower(strings.TrimSpace(hdr.Get("Precedence"))) {
+	case "bulk", "list", "junk":
+		return false
+	}
+
+	// The recipient must be explicitly addressed. ../rfc/5230:380
+	for _, k := range []string{"To", "Cc", "Bcc", "Resent-To", "Resent-Cc", "Resent-Bcc"} {
+		for _, a := range in.addresses(k) {
+			for _, o := range own {
+				if strings.EqualFold(a, o) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func (in *interp) xheader() textproto.MIMEHeader {
+	if in.header != nil || in.headerErr != nil {
+		return in.header
+	}
+	if in.msg.Part == nil {
+		in.header = textproto.MIMEHeader{}
+		return in.header
+	}
+	in.header, in.headerErr = in.msg.Part.Header()
+	if in.headerErr != nil {
+		in.xerrorf("parsing message header: %v", in.headerErr)
+	}
+	return in.header
+}
+
+var wordDecoder = mime.WordDecoder{
+	CharsetReader: func(charset string, r io.Reader) (io.Reader, error) {
+		return message.DecodeReader(charset, r), nil
+	},
+}
+
+// headerValues returns the values for a header, with RFC 2047 encoded-words decoded.
+func (in *interp) headerValues(k string) []string {
+	var l []string
+	for _, v := range in.xheader().Values(k) {
+		if dv, err := wordDecoder.DecodeHeader(v); err == nil {
+			v = dv
+		}
+		l = append(l, v)
+	}
+	return l
+}
+
+func (in *interp) decodedHeader(k string) string {
+	l := in.headerValues(k)
+	if len(l) == 0 {
+		return ""
+	}
+	return l[0]
+}
+
+// addresses returns the addresses in a header as "localpart@domain". Values
+// that cannot be parsed as address list are returned as is.
+func (in *interp) addresses(k string) []string {
+	var l []string
+	for _, v := range in.headerValues(k) {
+		addrs, err := mail.ParseAddressList(v)
+		if err != nil {
+			l = append(l, strings.TrimSpace(v))
+			continue
+		}
+		for _, a := range addrs {
+			l = append(l, a.Address)
+		}
+	}
+	return l
+}
+
+// expand replaces variable references if the variables extension is in use.
+// ../rfc/5229:175
+func (in *interp) expand(s string) string {
+	if !in.variables || !strings.Contains(s, "${") {
+		return s
+	}
+	var b strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			b.WriteString(s)
+			return b.String()
+		}
+		b.WriteString(s[:i])
+		s = s[i:]
+		e := strings.IndexByte(s, '}')
+		if e < 0 {
+			b.WriteString(s)
+			return b.String()
+		}
+		name := s[2:e]
+		if v, ok := in.variable(name); ok {
+			b.WriteString(v)
+			s = s[e+1:]
+		} else {
+			// Not a variable reference, keep as is. The inner part may still contain a reference.
+			b.WriteString("${")
+			s = s[2:]
+		}
+	}
+}
+
+func (in *interp) variable(name string) (string, bool) {
+	if name == "" {
+		return "", false
+	}
+	if isDigit(name[0]) {
+		var n int
+		for _, c := range []byte(name) {
+			if !isDigit(c) {
+				return "", false
+			}
+			n = n*10 + int(c-'0')
+			if n > 1000 {
+				return "", true
+			}
+		}
+		if n < len(in.matchVars) {
+			return in.matchVars[n], true
+		}
+		return "", true
+	}
+	if !validVariableName(name) {
+		return "", false
+	}
+	return in.vars[strings.ToLower(name)], true
+}
+
+func (in *interp) expandList(l []string) []string {
+	r := make([]string, len(l))
+	for i, s := range l {
+		r[i] = in.expand(s)
+	}
+	return r
+}
+
+func (in *interp) test(n *node) bool {
+	switch n.name {
+	case "true":
+		return true
+	case "false":
+		return false
+	case "not":
+		return !in.test(n.tests[0])
+	case "allof":
+		for _, t := range n.tests {
+			if !in.test(t) {
+				return false
+			}
+		}
+		return true
+	case "anyof":
+		for _, t := range n.tests {
+			if in.test(t) {
+				return true
+			}
+		}
+		return false
+	case "size":
+		limit := n.pos[0].number
+		if _, ok := n.tags["over"]; ok {
+			return in.msg.Size > limit
+		}
+		return in.msg.Size < limit
+	case "exists":
+		hdr := in.xheader()
+		for _, k := range in.expandList(n.pos[0].strs) {
+			if len(hdr.Values(k)) == 0 {
+				return false
+			}
+		}
+		return true
+	case "header":
+		var values []string
+		for _, k := range in.expandList(n.pos[0].strs) {
+			values = append(values, in.headerValues(k)...)
+		}
+		return in.match(n, values, n.pos[1].strs)
+	case "address":
+		var values []string
+		for _, k := range in.expandList(n.pos[0].strs) {
+			for _, a := range in.addresses(k) {
+				values = append(values, addressPart(n, a))
+			}
+		}
+		return in.match(n, values, n.pos[1].strs)
+	case "envelope":
+		var values []string
+		for _, part := range in.expandList(n.pos[0].strs) {
+			var a string
+			switch strings.ToLower(part) {
+			case "from":
+				a = in.msg.MailFrom
+			case "to":
+				a = in.msg.RcptTo
+			default:
+				continue
+			}
+			values = append(values, addressPart(n, a))
+		}
+		return in.match(n, values, n.pos[1].strs)
+	case "body":
+		return in.match(n, in.body(n), n.pos[0].strs)
+	case "string":
+		return in.match(n, in.expandList(n.pos[0].strs), n.pos[1].strs)
+	case "hasflag":
+		var values []string
+		if n.pos[0].strs != nil {
+			for _, name := range n.pos[0].strs {
+				values = append(values, strings.Fields(in.vars[strings.ToLower(name)])...)
+			}
+		} else {
+			values = in.flags
+		}
+		var keys []string
+		for _, k := range in.expandList(n.pos[1].strs) {
+			keys = append(keys, strings.Fields(k)...)
+		}
+		return in.matchExpanded(n, values, keys)
+	}
+	in.xerrorf("unknown test %q", n.name)
+	return false
+}
+
+// addressPart returns the part of address a selected by the address part tag
+// of n, ":all" by default.
+func addressPart(n *node, a string) string {
+	t := strings.LastIndex(a, "@")
+	if _, ok := n.tags["localpart"]; ok {
+		if t < 0 {
+			return a
+		}
+		return a[:t]
+	} else if _, ok := n.tags["domain"]; ok {
+		if t < 0 {
+			return ""
+		}
+		return a[t+1:]
+	}
+	return a
+}
+
+// body returns the body contents to match against for the body test.
+// ../rfc/5173:159
+func (in *interp) body(n *node) []string {
+	p := in.msg.Part
+	if p == nil {
+		return nil
+	}
+	if _, ok := n.tags["raw"]; ok {
+		buf, err := io.ReadAll(io.LimitReader(p.RawReader(), maxBodyRead))
+		if err != nil {
+			in.xerrorf("reading message body: %v", err)
+		}
+		return []string{string(buf)}
+	}
+
+	types := []string{"text"}
+	if v, ok := n.tags["content"]; ok {
+		types = in.expandList(v.strs)
+	}
+	typeMatches := func(p *message.Part) bool {
+		mt := strings.ToLower(p.MediaType)
+		if mt == "" {
+			mt = "text"
+		}
+		full := mt + "/" + strings.ToLower(p.MediaSubType)
+		if p.MediaSubType == "" {
+			full = mt + "/plain"
+		}
+		for _, t := range types {
+			t = strings.ToLower(t)
+			if t == "" || t == mt || t == full {
+				return true
+			}
+		}
+		return false
+	}
+
+	var l []string
+	var walk func(p *message.Part)
+	walk = func(p *message.Part) {
+		if len(p.Parts) > 0 {
+			for i := range p.Parts {
+				walk(&p.Parts[i])
+			}
+			return
+		}
+		if p.MediaType == "MULTIPART" || !typeMatches(p) {
+			return
+		}
+		buf, err := io.ReadAll(io.LimitReader(p.ReaderUTF8OrBinary(), maxBodyRead))
+		if err != nil {
+			in.xerrorf("reading message part: %v", err)
+		}
+		l = append(l, string(buf))
+	}
+	walk(p)
+	return l
+}
+
+// match returns whether any value matches any of the keys, after expanding
+// variables in the keys.
+func (in *interp) match(n *node, values, keys []string) bool {
+	return in.matchExpanded(n, values, in.expandList(keys))
+}
+
+func (in *interp) matchExpanded(n *node, values, keys []string) bool {
+	casemap := true
+	if v, ok := n.tags["comparator"]; ok && strings.EqualFold(v.strs[0], "i;octet") {
+		casemap = false
+	}
+	fold := func(s string) string {
+		if casemap {
+			return asciiLower(s)
+		}
+		return s
+	}
+
+	_, contains := n.tags["contains"]
+	_, matches := n.tags["matches"]
+	for _, v := range values {
+		fv := fold(v)
+		for _, k := range keys {
+			fk := fold(k)
+			switch {
+			case contains:
+				if strings.Contains(fv, fk) {
+					return true
+				}
+			case matches:
+				if caps, ok := globMatch(fk, fv); ok {
+					if in.variables {
+						in.matchVars = []string{v}
+						for _, c := range caps {
+							in.matchVars = append(in.matchVars, v[c[0]:c[1]])
+						}
+					}
+					return true
+				}
+			default:
+				if fv == fk {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// asciiLower lower cases A-Z only, keeping offsets intact for extracting match
+// variables from the original string.
+func asciiLower(s string) string {
+	r := []byte(s)
+	for i, c := range r {
+		if c >= 'A' && c <= 'Z' {
+			r[i] = c + 0x20
+		}
+	}
+	return string(r)
+}
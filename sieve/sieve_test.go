@@ -0,0 +1,275 @@
+package sieve
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mjl-/mox/message"
+)
+
+const testMsg = `From: Mjl <mjl@mox.example>
+To: "Other" <other@mox.example>, list@lists.example
+Subject: =?utf-8?q?hello_w=C3=B6rld?=
+Message-Id: <test@mox.example>
+X-Spam: yes
+MIME-Version: 1.0
+Content-Type: multipart/alternative; boundary=x
+
+--x
+Content-Type: text/plain; charset=utf-8
+
+this is the text body.
+
+--x
+Content-Type: text/html
+
+<p>this is html</p>
+--x--
+`
+
+func testMessage(t *testing.T, msg string) Message {
+	t.Helper()
+	msg = strings.ReplaceAll(msg, "\n", "\r\n")
+	r := strings.NewReader(msg)
+	p, err := message.EnsurePart(nil, false, r, int64(len(msg)))
+	tcheck(t, err, "parse message")
+	return Message{
+		MailFrom: "mjl@mox.example",
+		RcptTo:   "other@mox.example",
+		Size:     int64(len(msg)),
+		Part:     &p,
+	}
+}
+
+func tcheck(t *testing.T, err error, msg string) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: %s", msg, err)
+	}
+}
+
+func TestParse(t *testing.T) {
+	good := func(script string) {
+		t.Helper()
+		_, err := Parse(script)
+		tcheck(t, err, "parse")
+	}
+	bad := func(line int, script string) {
+		t.Helper()
+		_, err := Parse(script)
+		var perr ParseError
+		if err == nil || !errors.As(err, &perr) {
+			t.Fatalf("parse: got err %v, expected parse error for %q", err, script)
+		}
+		if perr.Line != line {
+			t.Fatalf("parse error %v on line %d, expected line %d", err, perr.Line, line)
+		}
+	}
+
+	good(``)
+	good(`# comment`)
+	good(`/* multi
+line */ keep;`)
+	good(`require ["fileinto", "imap4flags"]; fileinto :flags "\\Seen" "Archive";`)
+	good(`if size :over 100K { discard; stop; } elsif true { keep; } else { keep; }`)
+	good(`if anyof (header :contains "subject" "x", not exists "to") { discard; }`)
+	good("require \"vacation\";\nvacation :days 3 text:\nline\n..dot\n.\n;")
+	good(`require ["variables", "imap4flags"]; set :lower "a" "B"; addflag "a" "x"; if hasflag "a" "x" { keep; }`)
+	good(`REQUIRE "FileInto"; FILEINTO "x";`)
+
+	bad(1, `keep`)
+	bad(1, `unknown;`)
+	bad(1, `fileinto "x";`)
+	bad(1, `require "unknown";`)
+	bad(2, "keep;\nrequire \"fileinto\";")
+	bad(1, `if true keep;`)
+	bad(1, `else { keep; }`)
+	bad(1, `if header :is :contains "a" "b" { keep; }`)
+	bad(1, `if size 10 { keep; }`)
+	bad(1, `if header :comparator "i;unknown" "a" "b" { keep; }`)
+	bad(1, `redirect ["a@b.example"];`)
+	bad(1, `keep :flags "x";`)
+	bad(1, `redirect :copy "a@b.example";`)
+	bad(1, `/* unterminated`)
+	bad(1, `discard "x";`)
+	bad(2, "require \"variables\";\nset \"1a\" \"x\";")
+	bad(1, `require "imap4flags"; addflag "var" "x";`)
+}
+
+func TestRun(t *testing.T) {
+	m := testMessage(t, testMsg)
+
+	run := func(script string, exp Result) {
+		t.Helper()
+		s, err := Parse(script)
+		tcheck(t, err, "parse")
+		r, err := s.Run(m)
+		tcheck(t, err, "run")
+		if r.Vacation != nil {
+			r.Vacation.Handle = ""
+		}
+		if !reflect.DeepEqual(r, exp) {
+			t.Fatalf("run %q:\ngot      %#v\nexpected %#v", script, r, exp)
+		}
+	}
+	runErr := func(script string, exp error) {
+		t.Helper()
+		s, err := Parse(script)
+		tcheck(t, err, "parse")
+		_, err = s.Run(m)
+		if err == nil || exp != nil && !errors.Is(err, exp) {
+			t.Fatalf("run %q: got err %v, expected %v", script, err, exp)
+		}
+	}
+
+	keep := Result{Keep: true}
+	none := Result{}
+
+	run(``, keep)
+	run(`keep;`, keep)
+	run(`discard;`, none)
+	run(`discard; keep;`, keep)
+	run(`stop; discard;`, keep)
+	run(`if header :is "Subject" "hello wörld" { discard; }`, none)
+	run(`if header :is "Subject" "HELLO WÖRLD" { discard; }`, keep) // Only ascii is case-folded.
+	run(`if header :is :comparator "i;octet" "subject" "Hello wörld" { discard; }`, keep)
+	run(`if header :contains ["x-other", "x-spam"] "YES" { discard; }`, none)
+	run(`if header :matches "subject" "h?llo *" { discard; }`, none)
+	run(`if not exists ["subject", "x-absent"] { discard; }`, none)
+	run(`if address :domain "to" "lists.example" { discard; }`, none)
+	run(`if address :localpart :is "from" "mjl" { discard; }`, none)
+	run(`if address :all :is "from" "Mjl <mjl@mox.example>" { discard; }`, keep)
+	run(`if size :over 1M { discard; } elsif size :under 10 { discard; } else { stop; }`, keep)
+	run(`if allof (true, false) { discard; } elsif anyof (false, true) { discard; }`, none)
+
+	run(`require "envelope"; if envelope :domain "to" "mox.example" { discard; }`, none)
+	run(`require "envelope"; if envelope :is "from" "other@mox.example" { discard; }`, keep)
+
+	run(`require "body"; if body :contains "text body" { discard; }`, none)
+	run(`require "body"; if body :content "text/html" :contains "text body" { discard; }`, keep)
+	run(`require "body"; if body :content "text/html" :contains "html" { discard; }`, none)
+	run(`require "body"; if body :raw :contains "Content-Type: text/html" { discard; }`, none)
+
+	run(`require "fileinto"; fileinto "Lists";`, Result{FileInto: []FileInto{{"Lists", nil}}})
+	run(`require ["fileinto", "copy"]; fileinto :copy "Lists"; fileinto "Lists";`, Result{FileInto: []FileInto{{"Lists", nil}}})
+	run(`require ["fileinto", "copy"]; fileinto :copy "Lists";`, Result{Keep: true, FileInto: []FileInto{{"Lists", nil}}})
+	run(`redirect "other@example.org";`, Result{Redirect: []string{"other@example.org"}})
+	runErr(`redirect "not an address";`, nil)
+	runErr(`redirect "a1@x.example"; redirect "a2@x.example"; redirect "a3@x.example"; redirect "a4@x.example"; redirect "a5@x.example"; redirect "a6@x.example"; redirect "a7@x.example"; redirect "a8@x.example"; redirect "a9@x.example"; redirect "a10@x.example"; redirect "a11@x.example";`, ErrTooManyRedirects)
+
+	run(`require "reject"; reject "go away";`, Result{Reject: &Reject{"go away", false}})
+	run(`require "ereject"; ereject "go away";`, Result{Reject: &Reject{"go away", true}})
+	runErr(`require ["reject", "fileinto"]; reject "no"; fileinto "x";`, ErrConflict)
+
+	run(`require "imap4flags"; addflag ["\\Seen", "$label1 \\Flagged"]; removeflag "\\flagged"; keep;`, Result{Keep: true, KeepFlags: []string{`\Seen`, `$label1`}})
+	run(`require "imap4flags"; setflag "\\Seen";`, Result{Keep: true, KeepFlags: []string{`\Seen`}})
+	run(`require ["imap4flags", "fileinto"]; setflag "\\Seen"; fileinto "x"; fileinto :flags "a b" "y"; if hasflag :contains "see" { discard; }`, Result{FileInto: []FileInto{{"x", []string{`\Seen`}}, {"y", []string{"a", "b"}}}})
+	run(`require ["imap4flags", "variables"]; addflag "v" "a"; addflag "v" "b"; if hasflag "v" "b" { discard; }`, none)
+
+	run(`require ["variables", "fileinto"]; set "box" "Lists"; set :upperfirst "sub" "inbox"; fileinto "${box}/${sub}";`, Result{FileInto: []FileInto{{"Lists/Inbox", nil}}})
+	run(`require ["variables", "fileinto"]; if header :matches "to" "*<*@*>*" { fileinto "${2}.${3}"; }`, Result{FileInto: []FileInto{{"other.mox.example", nil}}})
+	run(`require ["variables", "fileinto"]; set :length "n" "héllo"; set :quotewildcard "q" "a*b"; fileinto "${n}${q}${unknown}${ bad}";`, Result{FileInto: []FileInto{{`5a\*b${ bad}`, nil}}})
+	run(`require "variables"; set "a" "x"; if string :is "${a}" "x" { discard; }`, none)
+	run(`require "fileinto"; fileinto "${box}";`, Result{FileInto: []FileInto{{"${box}", nil}}})
+
+	vac := &Vacation{
+		To:        "mjl@mox.example",
+		Subject:   "Auto: hello wörld",
+		InReplyTo: "<test@mox.example>",
+		Reason:    "away\r\n",
+		Days:      3,
+	}
+	run("require \"vacation\"; vacation :days 3 text:\naway\n.\n;", Result{Keep: true, Vacation: vac})
+	// Sender is not explicitly addressed.
+	m.RcptTo = "alias@mox.example"
+	run(`require "vacation"; vacation "away";`, keep)
+	run(`require "vacation"; vacation :addresses "other@mox.example" :subject "gone" "away";`, Result{Keep: true, Vacation: &Vacation{To: "mjl@mox.example", Subject: "gone", InReplyTo: "<test@mox.example>", Reason: "away", Days: 7, Addresses: []string{"other@mox.example"}}})
+	m.RcptTo = "other@mox.example"
+	// No responses to mailer-daemon and null senders.
+	m.MailFrom = "MAILER-DAEMON@mox.example"
+	run(`require "vacation"; vacation "away";`, keep)
+	m.MailFrom = ""
+	run(`require "vacation"; vacation "away";`, keep)
+	m.MailFrom = "mjl@mox.example"
+
+	// No responses to lists.
+	lm := testMessage(t, "List-Id: <list.example>\nTo: other@mox.example\n\nbody\n")
+	s, err := Parse(`require "vacation"; vacation "away";`)
+	tcheck(t, err, "parse")
+	r, err := s.Run(lm)
+	tcheck(t, err, "run")
+	if r.Vacation != nil {
+		t.Fatalf("got vacation response for list message")
+	}
+}
+
+func TestAutoReply(t *testing.T) {
+	m := testMessage(t, "From: <mjl@mox.example>\nTo: other@mox.example\nSubject: hello\nMessage-Id: <test@mox.example>\n\nbody\n")
+	m.RcptTo = "alias@mox.example"
+
+	v, err := AutoReply(m, Vacation{Reason: "away"})
+	tcheck(t, err, "auto reply")
+	if v != nil {
+		t.Fatalf("got auto reply for message not explicitly addressed to recipient")
+	}
+
+	v, err = AutoReply(m, Vacation{Reason: "away", Days: 1000, Addresses: []string{"other@mox.example"}})
+	tcheck(t, err, "auto reply")
+	if v == nil {
+		t.Fatalf("no auto reply")
+	}
+	if v.To != "mjl@mox.example" || v.Subject != "Auto: hello" || v.InReplyTo != "<test@mox.example>" || v.Days != maxDays || v.Handle == "" {
+		t.Fatalf("unexpected auto reply %#v", v)
+	}
+
+	m = testMessage(t, "To: other@mox.example\nAuto-Submitted: auto-replied\n\nbody\n")
+	v, err = AutoReply(m, Vacation{Reason: "away", Addresses: []string{"other@mox.example"}})
+	tcheck(t, err, "auto reply")
+	if v != nil {
+		t.Fatalf("got auto reply for automatically submitted message")
+	}
+}
+
+func TestGlob(t *testing.T) {
+	test := func(pattern, s string, exp bool, expCaps ...string) {
+		t.Helper()
+		caps, ok := globMatch(pattern, s)
+		if ok != exp {
+			t.Fatalf("glob %q %q: got %v, expected %v", pattern, s, ok, exp)
+		}
+		var l []string
+		for _, c := range caps {
+			l = append(l, s[c[0]:c[1]])
+		}
+		if ok && !reflect.DeepEqual(l, expCaps) {
+			t.Fatalf("glob %q %q: got captures %q, expected %q", pattern, s, l, expCaps)
+		}
+	}
+
+	test("", "", true)
+	test("*", "", true, "")
+	test("a*b", "axxb", true, "xx")
+	test("*@*", "a@b@c", true, "a", "b@c")
+	test("?", "ö", true, "ö")
+	test("??", "ö", false)
+	test(`a\*`, "a*", true)
+	test(`a\*`, "ab", false)
+	test("a*", "b", false)
+	test(strings.Repeat("*a", 30)+"b", strings.Repeat("a", 100), false)
+}
+
+func TestRejectResponseText(t *testing.T) {
+	test := func(reason, exp string) {
+		t.Helper()
+		if s := (Reject{Reason: reason}).ResponseText(); s != exp {
+			t.Fatalf("response text for %q: got %q, expected %q", reason, s, exp)
+		}
+	}
+
+	test("go away", "go away")
+	test(" multiple\r\nlines\n\tof  text ", "multiple lines of text")
+	test("\r\n", "rejected by recipient")
+	test(strings.Repeat("a", 300), strings.Repeat("a", 256))
+}
@@ -0,0 +1,287 @@
+package smime
+
+import (
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// ASN.1 structures from CMS, ../rfc/5652.
+
+var (
+	oidData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidEnvelopedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 3}
+
+	oidAttrContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidAttrMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidAttrSigningTime   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+
+	oidSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+
+	oidRSAEncryption   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidSHA256WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidSHA384WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 12}
+	oidSHA512WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 13}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidECDSAWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
+	oidECDSAWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}
+	oidECPublicKey     = asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
+
+	oidAES128CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// ../rfc/5652
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+// ../rfc/5652
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo encapContentInfo
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+// ../rfc/5652
+type encapContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"` // Absent for detached signatures.
+}
+
+// ../rfc/5652
+type signerInfo struct {
+	Version            int
+	SID                asn1.RawValue // IssuerAndSerialNumber, or [0] SubjectKeyIdentifier.
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+	UnsignedAttrs      asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+// ../rfc/5652
+type issuerAndSerial struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+// ../rfc/5652
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue // SET OF values.
+}
+
+// ../rfc/5652
+type envelopedData struct {
+	Version              int
+	OriginatorInfo       asn1.RawValue   `asn1:"optional,tag:0"`
+	RecipientInfos       []asn1.RawValue `asn1:"set"`
+	EncryptedContentInfo encryptedContentInfo
+	UnprotectedAttrs     asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+// ../rfc/5652
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           asn1.RawValue `asn1:"optional,tag:0"`
+}
+
+// ../rfc/5652
+type keyTransRecipientInfo struct {
+	Version                int
+	RID                    asn1.RawValue // IssuerAndSerialNumber, or [0] SubjectKeyIdentifier.
+	KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedKey           []byte
+}
+
+// makeSet returns the DER encoding of a SET with elements already DER-encoded in
+// buf.
+func makeSet(buf []byte) ([]byte, error) {
+	return asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: buf})
+}
+
+func makeAttribute(oid asn1.ObjectIdentifier, value any) ([]byte, error) {
+	v, err := asn1.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	vs, err := makeSet(v)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(attribute{oid, asn1.RawValue{FullBytes: vs}})
+}
+
+// signingTime returns a value for the signing-time attribute, which must be
+// UTCTime until 2049. ../rfc/5652
+func signingTime(tm time.Time) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagUTCTime, Bytes: []byte(tm.UTC().Format("060102150405Z"))}
+}
+
+// contentOctets returns the octets of a possibly constructed (chunked)
+// implicitly tagged OCTET STRING.
+func contentOctets(rv asn1.RawValue) ([]byte, error) {
+	if !rv.IsCompound {
+		return rv.Bytes, nil
+	}
+	var r []byte
+	rest := rv.Bytes
+	for len(rest) > 0 {
+		var chunk asn1.RawValue
+		var err error
+		rest, err = asn1.Unmarshal(rest, &chunk)
+		if err != nil {
+			return nil, fmt.Errorf("parsing constructed octet string: %w", err)
+		}
+		b, err := contentOctets(chunk)
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, b...)
+	}
+	return r, nil
+}
+
+// parseContentInfo parses data as ContentInfo with the expected content type,
+// returning the inner content.
+func parseContentInfo(data []byte, contentType asn1.ObjectIdentifier) ([]byte, error) {
+	der, err := berToDER(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: converting ber to der: %v", ErrMalformed, err)
+	}
+	var ci contentInfo
+	if rest, err := asn1.Unmarshal(der, &ci); err != nil {
+		return nil, fmt.Errorf("%w: parsing content info: %v", ErrMalformed, err)
+	} else if len(rest) > 0 {
+		return nil, fmt.Errorf("%w: trailing data after content info", ErrMalformed)
+	}
+	if !ci.ContentType.Equal(contentType) {
+		return nil, fmt.Errorf("%w: content type %s, expected %s", ErrUnsupported, ci.ContentType, contentType)
+	}
+	// With explicit tagging, a RawValue is the [0] element, its content is the inner element.
+	return ci.Content.Bytes, nil
+}
+
+// berToDER converts BER-encoded data, as generated by some mail clients, to DER.
+// Indefinite lengths are replaced by definite lengths. Other non-DER
+// encodings, such as constructed strings, are kept.
+func berToDER(b []byte) ([]byte, error) {
+	der, rest, err := berElem(b, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, errors.New("trailing data")
+	}
+	return der, nil
+}
+
+func berElem(b []byte, depth int) (der, rest []byte, rerr error) {
+	if depth > 64 {
+		return nil, nil, errors.New("nested too deeply")
+	}
+	if len(b) < 2 {
+		return nil, nil, errors.New("short element")
+	}
+	// Tag, possibly in multiple bytes.
+	o := 1
+	if b[0]&0x1f == 0x1f {
+		for o < len(b) && b[o]&0x80 != 0 {
+			o++
+		}
+		o++
+	}
+	if o >= len(b) {
+		return nil, nil, errors.New("short element")
+	}
+	tag := b[:o]
+	constructed := b[0]&0x20 != 0
+
+	l := b[o]
+	o++
+	if l == 0x80 {
+		if !constructed {
+			return nil, nil, errors.New("indefinite length for primitive element")
+		}
+		var content []byte
+		rest := b[o:]
+		for {
+			if len(rest) < 2 {
+				return nil, nil, errors.New("missing end-of-contents")
+			}
+			if rest[0] == 0 && rest[1] == 0 {
+				rest = rest[2:]
+				break
+			}
+			elem, nrest, err := berElem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			content = append(content, elem...)
+			rest = nrest
+		}
+		return derElem(tag, content), rest, nil
+	}
+
+	n := int(l)
+	if l&0x80 != 0 {
+		nb := int(l & 0x7f)
+		if nb == 0 || nb > 4 || o+nb > len(b) {
+			return nil, nil, errors.New("bad length")
+		}
+		n = 0
+		for _, c := range b[o : o+nb] {
+			n = n<<8 | int(c)
+		}
+		o += nb
+	}
+	if n < 0 || n > len(b)-o {
+		return nil, nil, errors.New("element length beyond data")
+	}
+	content := b[o : o+n]
+	if constructed {
+		var ncontent []byte
+		for len(content) > 0 {
+			elem, nrest, err := berElem(content, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			ncontent = append(ncontent, elem...)
+			content = nrest
+		}
+		content = ncontent
+	}
+	return derElem(tag, content), b[o+n:], nil
+}
+
+// derElem returns an element with the (already encoded) tag, a DER-encoded length
+// and content.
+func derElem(tag, content []byte) []byte {
+	var length []byte
+	n := len(content)
+	if n < 0x80 {
+		length = []byte{byte(n)}
+	} else {
+		for x := n; x > 0; x >>= 8 {
+			length = append([]byte{byte(x)}, length...)
+		}
+		length = append([]byte{0x80 | byte(len(length))}, length...)
+	}
+	r := make([]byte, 0, len(tag)+len(length)+len(content))
+	r = append(r, tag...)
+	r = append(r, length...)
+	return append(r, content...)
+}
@@ -0,0 +1,549 @@
+// Package smime implements S/MIME signing and encryption of message content,
+// with the Cryptographic Message Syntax (CMS).
+//
+// Only the commonly used subset of CMS is implemented: Detached signatures
+// (SignedData) with RSA or ECDSA keys and SHA-2 digests, and encryption
+// (EnvelopedData) with RSA key transport and AES-CBC content encryption. The
+// caller is responsible for the MIME structure of messages, e.g.
+// multipart/signed and application/pkcs7-mime.
+//
+// ../rfc/8551 ../rfc/5652
+package smime
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMalformed     = errors.New("malformed cms data")
+	ErrUnsupported   = errors.New("unsupported cms data")
+	ErrSignature     = errors.New("bad signature")
+	ErrNoRecipient   = errors.New("not encrypted for key")
+	ErrNoCertificate = errors.New("no certificate for signer")
+)
+
+// ParseKey parses PEM data with a private key and one or more certificates, as
+// used for signing and decrypting. The first certificate must be for the private
+// key, the others are (intermediate) certificates for its chain.
+func ParseKey(data []byte) (key crypto.Signer, certs []*x509.Certificate, rerr error) {
+	for {
+		var b *pem.Block
+		b, data = pem.Decode(data)
+		if b == nil {
+			break
+		}
+		switch b.Type {
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(b.Bytes)
+			if err != nil {
+				return nil, nil, fmt.Errorf("parsing certificate: %v", err)
+			}
+			certs = append(certs, cert)
+		case "PRIVATE KEY", "RSA PRIVATE KEY", "EC PRIVATE KEY":
+			if key != nil {
+				return nil, nil, errors.New("multiple private keys")
+			}
+			var k any
+			var err error
+			switch b.Type {
+			case "PRIVATE KEY":
+				k, err = x509.ParsePKCS8PrivateKey(b.Bytes)
+			case "RSA PRIVATE KEY":
+				k, err = x509.ParsePKCS1PrivateKey(b.Bytes)
+			case "EC PRIVATE KEY":
+				k, err = x509.ParseECPrivateKey(b.Bytes)
+			}
+			if err != nil {
+				return nil, nil, fmt.Errorf("parsing private key: %v", err)
+			}
+			switch xk := k.(type) {
+			case *rsa.PrivateKey:
+				key = xk
+			case *ecdsa.PrivateKey:
+				key = xk
+			default:
+				return nil, nil, fmt.Errorf("%w: private key type %T", ErrUnsupported, k)
+			}
+		}
+	}
+	if key == nil {
+		return nil, nil, errors.New("no private key in pem data")
+	}
+	if len(certs) == 0 {
+		return nil, nil, errors.New("no certificate in pem data")
+	}
+	// Move the certificate for the key to the front.
+	i := slices.IndexFunc(certs, func(c *x509.Certificate) bool {
+		return publicKeyEqual(c.PublicKey, key.Public())
+	})
+	if i < 0 {
+		return nil, nil, errors.New("no certificate for private key")
+	}
+	certs[0], certs[i] = certs[i], certs[0]
+	return key, certs, nil
+}
+
+func publicKeyEqual(a, b crypto.PublicKey) bool {
+	ak, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && ak.Equal(b)
+}
+
+// Addresses returns the email addresses from a certificate, from the subject
+// alternative names, and the deprecated emailAddress in the subject. Addresses
+// are returned in lower case.
+func Addresses(cert *x509.Certificate) []string {
+	var l []string
+	add := func(s string) {
+		s = strings.ToLower(s)
+		if s != "" && !slices.Contains(l, s) {
+			l = append(l, s)
+		}
+	}
+	for _, s := range cert.EmailAddresses {
+		add(s)
+	}
+	oidEmailAddress := asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}
+	for _, atv := range cert.Subject.Names {
+		if s, ok := atv.Value.(string); ok && atv.Type.Equal(oidEmailAddress) {
+			add(s)
+		}
+	}
+	return l
+}
+
+// Sign returns a DER-encoded detached signature over content in a CMS
+// SignedData structure, to be added as application/pkcs7-signature part in a
+// multipart/signed message. The first certificate must be for key, the other
+// certificates are included in the signature to help the recipient verify the
+// chain. The digest algorithm is SHA-256, with micalg "sha-256".
+func Sign(key crypto.Signer, certs []*x509.Certificate, content []byte, now time.Time) ([]byte, error) {
+	if len(certs) == 0 {
+		return nil, errors.New("missing certificate")
+	}
+
+	digest := crypto.SHA256.New()
+	digest.Write(content)
+	contentDigest := digest.Sum(nil)
+
+	// Signed attributes, a DER-encoded SET, so must be sorted. ../rfc/5652
+	var attrs [][]byte
+	for _, a := range []struct {
+		oid   asn1.ObjectIdentifier
+		value any
+	}{
+		{oidAttrContentType, oidData},
+		{oidAttrSigningTime, signingTime(now)},
+		{oidAttrMessageDigest, contentDigest},
+	} {
+		buf, err := makeAttribute(a.oid, a.value)
+		if err != nil {
+			return nil, fmt.Errorf("marshal signed attribute: %v", err)
+		}
+		attrs = append(attrs, buf)
+	}
+	sort.Slice(attrs, func(i, j int) bool {
+		return bytes.Compare(attrs[i], attrs[j]) < 0
+	})
+	signedAttrs := bytes.Join(attrs, nil)
+	// The signature is over the attributes with a SET tag, not the implicit tag. ../rfc/5652
+	attrsSet, err := makeSet(signedAttrs)
+	if err != nil {
+		return nil, fmt.Errorf("marshal signed attributes: %v", err)
+	}
+	digest = crypto.SHA256.New()
+	digest.Write(attrsSet)
+
+	var sigAlg asn1.ObjectIdentifier
+	var sig []byte
+	switch key.Public().(type) {
+	case *rsa.PublicKey:
+		sigAlg = oidRSAEncryption
+		sig, err = key.Sign(rand.Reader, digest.Sum(nil), crypto.SHA256)
+	case *ecdsa.PublicKey:
+		sigAlg = oidECDSAWithSHA256
+		sig, err = key.Sign(rand.Reader, digest.Sum(nil), crypto.SHA256)
+	default:
+		return nil, fmt.Errorf("%w: key type %T", ErrUnsupported, key.Public())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("signing: %v", err)
+	}
+
+	sid, err := asn1.Marshal(issuerAndSerial{asn1.RawValue{FullBytes: certs[0].RawIssuer}, certs[0].SerialNumber})
+	if err != nil {
+		return nil, fmt.Errorf("marshal signer identifier: %v", err)
+	}
+	var rawCerts []byte
+	for _, c := range certs {
+		rawCerts = append(rawCerts, c.Raw...)
+	}
+	sha256Alg := pkix.AlgorithmIdentifier{Algorithm: oidSHA256}
+	sd := signedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{sha256Alg},
+		EncapContentInfo: encapContentInfo{ContentType: oidData},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: rawCerts},
+		SignerInfos: []signerInfo{
+			{
+				Version:            1,
+				SID:                asn1.RawValue{FullBytes: sid},
+				DigestAlgorithm:    sha256Alg,
+				SignedAttrs:        asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: signedAttrs},
+				SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: sigAlg},
+				Signature:          sig,
+			},
+		},
+	}
+	return marshalContentInfo(oidSignedData, sd)
+}
+
+func marshalContentInfo(contentType asn1.ObjectIdentifier, content any) ([]byte, error) {
+	buf, err := asn1.Marshal(content)
+	if err != nil {
+		return nil, fmt.Errorf("marshal content: %v", err)
+	}
+	return asn1.Marshal(contentInfo{contentType, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: buf}})
+}
+
+// Verify checks a detached signature (from an application/pkcs7-signature
+// part) over content, which must be the exact bytes of the signed MIME entity
+// (headers and body). The certificate of the signer is returned, along with all
+// certificates in the signature, for verifying the chain, e.g. with
+// VerifyChain.
+//
+// Verify does not check the certificate chain.
+func Verify(signature, content []byte) (signer *x509.Certificate, certs []*x509.Certificate, rerr error) {
+	buf, err := parseContentInfo(signature, oidSignedData)
+	if err != nil {
+		return nil, nil, err
+	}
+	var sd signedData
+	if _, err := asn1.Unmarshal(buf, &sd); err != nil {
+		return nil, nil, fmt.Errorf("%w: parsing signed data: %v", ErrMalformed, err)
+	}
+	if len(sd.SignerInfos) == 0 {
+		return nil, nil, fmt.Errorf("%w: no signer info", ErrMalformed)
+	}
+	if len(sd.Certificates.Bytes) > 0 {
+		certs, err = x509.ParseCertificates(sd.Certificates.Bytes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: parsing certificates: %v", ErrMalformed, err)
+		}
+	}
+
+	// We verify the first signer info, typically there is only one.
+	si := sd.SignerInfos[0]
+	signer, err = findCertificate(si.SID, certs)
+	if err != nil {
+		return nil, certs, err
+	}
+
+	hash, err := digestHash(si.DigestAlgorithm.Algorithm)
+	if err != nil {
+		return signer, certs, err
+	}
+	h := hash.New()
+	h.Write(content)
+	contentDigest := h.Sum(nil)
+
+	var signed []byte
+	if len(si.SignedAttrs.Bytes) == 0 {
+		signed = content
+	} else {
+		// Check the message digest attribute, then verify the signature over the attributes.
+		var found bool
+		rest := si.SignedAttrs.Bytes
+		for len(rest) > 0 {
+			var a attribute
+			rest, err = asn1.Unmarshal(rest, &a)
+			if err != nil {
+				return signer, certs, fmt.Errorf("%w: parsing signed attribute: %v", ErrMalformed, err)
+			}
+			if !a.Type.Equal(oidAttrMessageDigest) {
+				continue
+			}
+			var d []byte
+			if _, err := asn1.Unmarshal(a.Values.Bytes, &d); err != nil {
+				return signer, certs, fmt.Errorf("%w: parsing message digest attribute: %v", ErrMalformed, err)
+			}
+			if !bytes.Equal(d, contentDigest) {
+				return signer, certs, fmt.Errorf("%w: message digest mismatch, content was modified", ErrSignature)
+			}
+			found = true
+		}
+		if !found {
+			return signer, certs, fmt.Errorf("%w: missing message digest attribute", ErrMalformed)
+		}
+		signed, err = makeSet(si.SignedAttrs.Bytes)
+		if err != nil {
+			return signer, certs, fmt.Errorf("marshal signed attributes: %v", err)
+		}
+	}
+	h = hash.New()
+	h.Write(signed)
+	if err := verifySignature(signer.PublicKey, si.SignatureAlgorithm.Algorithm, hash, h.Sum(nil), si.Signature); err != nil {
+		return signer, certs, err
+	}
+	return signer, certs, nil
+}
+
+// VerifyChain verifies the certificate chain for signing certificate cert,
+// with intermediate certificates from certs, against the system roots.
+func VerifyChain(cert *x509.Certificate, certs []*x509.Certificate, now time.Time) error {
+	intermediates := x509.NewCertPool()
+	for _, c := range certs {
+		if c != cert {
+			intermediates.AddCert(c)
+		}
+	}
+	opts := x509.VerifyOptions{
+		Intermediates: intermediates,
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+	}
+	_, err := cert.Verify(opts)
+	return err
+}
+
+func findCertificate(id asn1.RawValue, certs []*x509.Certificate) (*x509.Certificate, error) {
+	if id.Class == asn1.ClassContextSpecific && id.Tag == 0 {
+		for _, c := range certs {
+			if len(c.SubjectKeyId) > 0 && bytes.Equal(c.SubjectKeyId, id.Bytes) {
+				return c, nil
+			}
+		}
+		return nil, ErrNoCertificate
+	}
+	var ias issuerAndSerial
+	if _, err := asn1.Unmarshal(id.FullBytes, &ias); err != nil {
+		return nil, fmt.Errorf("%w: parsing issuer and serial number: %v", ErrMalformed, err)
+	}
+	for _, c := range certs {
+		if bytes.Equal(c.RawIssuer, ias.Issuer.FullBytes) && c.SerialNumber.Cmp(ias.SerialNumber) == 0 {
+			return c, nil
+		}
+	}
+	return nil, ErrNoCertificate
+}
+
+// matchesCertificate returns whether the recipient or signer identifier is for cert.
+func matchesCertificate(id asn1.RawValue, cert *x509.Certificate) bool {
+	c, err := findCertificate(id, []*x509.Certificate{cert})
+	return err == nil && c == cert
+}
+
+func digestHash(oid asn1.ObjectIdentifier) (crypto.Hash, error) {
+	switch {
+	case oid.Equal(oidSHA256):
+		return crypto.SHA256, nil
+	case oid.Equal(oidSHA384):
+		return crypto.SHA384, nil
+	case oid.Equal(oidSHA512):
+		return crypto.SHA512, nil
+	}
+	return 0, fmt.Errorf("%w: digest algorithm %s", ErrUnsupported, oid)
+}
+
+func verifySignature(pubKey crypto.PublicKey, sigAlg asn1.ObjectIdentifier, hash crypto.Hash, digest, sig []byte) error {
+	switch k := pubKey.(type) {
+	case *rsa.PublicKey:
+		if !sigAlg.Equal(oidRSAEncryption) && !sigAlg.Equal(oidSHA256WithRSA) && !sigAlg.Equal(oidSHA384WithRSA) && !sigAlg.Equal(oidSHA512WithRSA) {
+			return fmt.Errorf("%w: signature algorithm %s for rsa key", ErrUnsupported, sigAlg)
+		}
+		if err := rsa.VerifyPKCS1v15(k, hash, digest, sig); err != nil {
+			return fmt.Errorf("%w: %v", ErrSignature, err)
+		}
+	case *ecdsa.PublicKey:
+		if !sigAlg.Equal(oidECDSAWithSHA256) && !sigAlg.Equal(oidECDSAWithSHA384) && !sigAlg.Equal(oidECDSAWithSHA512) && !sigAlg.Equal(oidECPublicKey) {
+			return fmt.Errorf("%w: signature algorithm %s for ecdsa key", ErrUnsupported, sigAlg)
+		}
+		if !ecdsa.VerifyASN1(k, digest, sig) {
+			return ErrSignature
+		}
+	default:
+		return fmt.Errorf("%w: public key type %T", ErrUnsupported, pubKey)
+	}
+	return nil
+}
+
+// Encrypt encrypts content for the recipients, returning a DER-encoded CMS
+// EnvelopedData structure, to be sent as application/pkcs7-mime with
+// smime-type enveloped-data. Content is encrypted with AES-256-CBC, the
+// content-encryption key is encrypted with RSA for each recipient, which must
+// have certificates with RSA keys. Senders typically include their own
+// certificate, so they can read the message they sent.
+func Encrypt(recipients []*x509.Certificate, content []byte) ([]byte, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("no recipients")
+	}
+
+	key := make([]byte, 32)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("generating key: %v", err)
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, fmt.Errorf("generating iv: %v", err)
+	}
+
+	var ris []asn1.RawValue
+	for _, cert := range recipients {
+		pubKey, ok := cert.PublicKey.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("%w: recipient key type %T, only rsa keys supported", ErrUnsupported, cert.PublicKey)
+		}
+		encKey, err := rsa.EncryptPKCS1v15(rand.Reader, pubKey, key)
+		if err != nil {
+			return nil, fmt.Errorf("encrypting key for recipient: %v", err)
+		}
+		rid, err := asn1.Marshal(issuerAndSerial{asn1.RawValue{FullBytes: cert.RawIssuer}, cert.SerialNumber})
+		if err != nil {
+			return nil, fmt.Errorf("marshal recipient identifier: %v", err)
+		}
+		ri, err := asn1.Marshal(keyTransRecipientInfo{
+			Version:                0,
+			RID:                    asn1.RawValue{FullBytes: rid},
+			KeyEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue},
+			EncryptedKey:           encKey,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("marshal recipient info: %v", err)
+		}
+		ris = append(ris, asn1.RawValue{FullBytes: ri})
+	}
+	// DER requires sorted SET OF elements.
+	sort.Slice(ris, func(i, j int) bool {
+		return bytes.Compare(ris[i].FullBytes, ris[j].FullBytes) < 0
+	})
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("aes cipher: %v", err)
+	}
+	// PKCS#7 padding, always at least one byte. ../rfc/5652
+	padLen := aes.BlockSize - len(content)%aes.BlockSize
+	buf := make([]byte, len(content)+padLen)
+	copy(buf, content)
+	for i := len(content); i < len(buf); i++ {
+		buf[i] = byte(padLen)
+	}
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(buf, buf)
+
+	ivParam, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, fmt.Errorf("marshal iv: %v", err)
+	}
+	ed := envelopedData{
+		Version:        0,
+		RecipientInfos: ris,
+		EncryptedContentInfo: encryptedContentInfo{
+			ContentType:                oidData,
+			ContentEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParam}},
+			EncryptedContent:           asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, Bytes: buf},
+		},
+	}
+	return marshalContentInfo(oidEnvelopedData, ed)
+}
+
+// Decrypt decrypts CMS EnvelopedData (from an application/pkcs7-mime part with
+// smime-type enveloped-data) with the private key for cert. If the data was not
+// encrypted for cert, ErrNoRecipient is returned.
+func Decrypt(data []byte, cert *x509.Certificate, key crypto.PrivateKey) ([]byte, error) {
+	buf, err := parseContentInfo(data, oidEnvelopedData)
+	if err != nil {
+		return nil, err
+	}
+	var ed envelopedData
+	if _, err := asn1.Unmarshal(buf, &ed); err != nil {
+		return nil, fmt.Errorf("%w: parsing enveloped data: %v", ErrMalformed, err)
+	}
+
+	var encKey []byte
+	for _, rv := range ed.RecipientInfos {
+		// Other recipient info types are tagged. ../rfc/5652
+		if rv.Class != asn1.ClassUniversal || rv.Tag != asn1.TagSequence {
+			continue
+		}
+		var ri keyTransRecipientInfo
+		if _, err := asn1.Unmarshal(rv.FullBytes, &ri); err != nil {
+			return nil, fmt.Errorf("%w: parsing recipient info: %v", ErrMalformed, err)
+		}
+		if matchesCertificate(ri.RID, cert) {
+			if !ri.KeyEncryptionAlgorithm.Algorithm.Equal(oidRSAEncryption) {
+				return nil, fmt.Errorf("%w: key encryption algorithm %s", ErrUnsupported, ri.KeyEncryptionAlgorithm.Algorithm)
+			}
+			encKey = ri.EncryptedKey
+			break
+		}
+	}
+	if encKey == nil {
+		return nil, ErrNoRecipient
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: key type %T, only rsa keys supported", ErrUnsupported, key)
+	}
+	contentKey, err := rsa.DecryptPKCS1v15(nil, rsaKey, encKey)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting content key: %v", err)
+	}
+
+	eci := ed.EncryptedContentInfo
+	alg := eci.ContentEncryptionAlgorithm.Algorithm
+	var keySize int
+	switch {
+	case alg.Equal(oidAES128CBC):
+		keySize = 16
+	case alg.Equal(oidAES192CBC):
+		keySize = 24
+	case alg.Equal(oidAES256CBC):
+		keySize = 32
+	default:
+		return nil, fmt.Errorf("%w: content encryption algorithm %s", ErrUnsupported, alg)
+	}
+	if len(contentKey) != keySize {
+		return nil, fmt.Errorf("%w: content key size %d, expected %d", ErrMalformed, len(contentKey), keySize)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(eci.ContentEncryptionAlgorithm.Parameters.FullBytes, &iv); err != nil || len(iv) != aes.BlockSize {
+		return nil, fmt.Errorf("%w: bad iv parameter", ErrMalformed)
+	}
+	content, err := contentOctets(eci.EncryptedContent)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	if len(content) == 0 || len(content)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("%w: encrypted content size %d not a multiple of block size", ErrMalformed, len(content))
+	}
+	block, err := aes.NewCipher(contentKey)
+	if err != nil {
+		return nil, fmt.Errorf("aes cipher: %v", err)
+	}
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(content, content)
+	padLen := int(content[len(content)-1])
+	if padLen == 0 || padLen > aes.BlockSize {
+		return nil, fmt.Errorf("%w: bad padding", ErrMalformed)
+	}
+	for _, c := range content[len(content)-padLen:] {
+		if int(c) != padLen {
+			return nil, fmt.Errorf("%w: bad padding", ErrMalformed)
+		}
+	}
+	return content[:len(content)-padLen], nil
+}
@@ -0,0 +1,163 @@
+package smime
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func tcheck(t *testing.T, err error, msg string) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: %s", msg, err)
+	}
+}
+
+// fakeCert returns a certificate for key signed by parent/parentKey, or
+// self-signed if parent is nil.
+func fakeCert(t *testing.T, serial int64, address string, key crypto.Signer, parent *x509.Certificate, parentKey crypto.Signer) *x509.Certificate {
+	t.Helper()
+	template := &x509.Certificate{
+		SerialNumber:   big.NewInt(serial),
+		Subject:        pkix.Name{CommonName: address},
+		EmailAddresses: []string{address},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent = template
+		parentKey = key
+	}
+	buf, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	tcheck(t, err, "create certificate")
+	cert, err := x509.ParseCertificate(buf)
+	tcheck(t, err, "parse certificate")
+	return cert
+}
+
+func TestSMIME(t *testing.T) {
+	now := time.Now()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tcheck(t, err, "generate key")
+	caCert := fakeCert(t, 1, "ca@mox.example", caKey, nil, nil)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	tcheck(t, err, "generate key")
+	rsaCert := fakeCert(t, 2, "Mjl@mox.example", rsaKey, caCert, caKey)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tcheck(t, err, "generate key")
+	ecCert := fakeCert(t, 3, "other@mox.example", ecKey, caCert, caKey)
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	tcheck(t, err, "generate key")
+	otherCert := fakeCert(t, 4, "other@mox.example", otherKey, caCert, caKey)
+
+	content := []byte("Content-Type: text/plain\r\n\r\nhi\r\n")
+
+	// Parse PEM with chain, key first in file not required.
+	var pemBuf bytes.Buffer
+	pem.Encode(&pemBuf, &pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw})
+	pem.Encode(&pemBuf, &pem.Block{Type: "CERTIFICATE", Bytes: rsaCert.Raw})
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(rsaKey)
+	tcheck(t, err, "marshal key")
+	pem.Encode(&pemBuf, &pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})
+	key, certs, err := ParseKey(pemBuf.Bytes())
+	tcheck(t, err, "parse key")
+	if len(certs) != 2 || certs[0] != rsaCert && !certs[0].Equal(rsaCert) {
+		t.Fatalf("parse key, certificate for key not first")
+	}
+	if _, _, err := ParseKey(pemBuf.Bytes()[:len(pemBuf.Bytes())/2]); err == nil {
+		t.Fatalf("parse key without private key succeeded")
+	}
+
+	if addrs := Addresses(rsaCert); len(addrs) != 1 || addrs[0] != "mjl@mox.example" {
+		t.Fatalf("addresses, got %v", addrs)
+	}
+
+	// Sign and verify, with rsa and ecdsa keys.
+	for _, tc := range []struct {
+		key  crypto.Signer
+		cert *x509.Certificate
+	}{
+		{key, certs[0]},
+		{ecKey, ecCert},
+	} {
+		sig, err := Sign(tc.key, []*x509.Certificate{tc.cert, caCert}, content, now)
+		tcheck(t, err, "sign")
+		signer, xcerts, err := Verify(sig, content)
+		tcheck(t, err, "verify")
+		if !signer.Equal(tc.cert) || len(xcerts) != 2 {
+			t.Fatalf("verify, wrong signer or certificates")
+		}
+		_, _, err = Verify(sig, append(bytes.Clone(content), 'x'))
+		if !errors.Is(err, ErrSignature) {
+			t.Fatalf("verify modified content, got err %v, expected ErrSignature", err)
+		}
+		// Chain does not verify, our CA is not in the system roots.
+		if err := VerifyChain(signer, xcerts, now); err == nil {
+			t.Fatalf("verify chain with unknown ca succeeded")
+		}
+	}
+
+	// Encrypt and decrypt.
+	encrypted, err := Encrypt([]*x509.Certificate{rsaCert, otherCert}, content)
+	tcheck(t, err, "encrypt")
+	for _, tc := range []struct {
+		key  crypto.PrivateKey
+		cert *x509.Certificate
+	}{
+		{rsaKey, rsaCert},
+		{otherKey, otherCert},
+	} {
+		decrypted, err := Decrypt(encrypted, tc.cert, tc.key)
+		tcheck(t, err, "decrypt")
+		if !bytes.Equal(decrypted, content) {
+			t.Fatalf("decrypted content differs")
+		}
+	}
+	if _, err := Decrypt(encrypted, ecCert, ecKey); !errors.Is(err, ErrNoRecipient) {
+		t.Fatalf("decrypt for other key, got err %v, expected ErrNoRecipient", err)
+	}
+	if _, err := Encrypt([]*x509.Certificate{ecCert}, content); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("encrypt for ecdsa key, got err %v, expected ErrUnsupported", err)
+	}
+
+	// BER with indefinite length, as some mail clients generate, is converted to DER.
+	ber := toIndefinite(t, encrypted)
+	decrypted, err := Decrypt(ber, rsaCert, rsaKey)
+	tcheck(t, err, "decrypt ber")
+	if !bytes.Equal(decrypted, content) {
+		t.Fatalf("decrypted content from ber differs")
+	}
+
+	if _, err := Decrypt([]byte("bogus"), rsaCert, rsaKey); !errors.Is(err, ErrMalformed) {
+		t.Fatalf("decrypt bogus data, got err %v, expected ErrMalformed", err)
+	}
+}
+
+// toIndefinite changes the outer SEQUENCE of a DER encoding to indefinite length.
+func toIndefinite(t *testing.T, der []byte) []byte {
+	t.Helper()
+	if der[0] != 0x30 || der[1]&0x80 == 0 {
+		t.Fatalf("unexpected der encoding")
+	}
+	n := 2 + int(der[1]&0x7f)
+	r := append([]byte{0x30, 0x80}, der[n:]...)
+	return append(r, 0, 0)
+}
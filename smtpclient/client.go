@@ -1017,9 +1017,9 @@ func (c *Client) auth(auth func(mechanisms []string, cs *tls.ConnectionState) (s
 			}
 			return nil
 		} else if code == smtp.C334ContinueAuth {
-			if last {
-				c.xerrorf(false, code, secode, firstLine, moreLines, "server requested unexpected continuation of authentication")
-			}
+			// After the last client message, a server can still send a challenge, e.g. with
+			// error details for OAUTHBEARER. The mechanism decides if it responds.
+			wasLast := last
 			if len(moreLines) > 0 {
 				abort()
 				c.xerrorf(false, code, secode, firstLine, moreLines, "server responded with multiline contination")
@@ -1030,7 +1030,10 @@ func (c *Client) auth(auth func(mechanisms []string, cs *tls.ConnectionState) (s
 				c.xerrorf(false, code, secode, firstLine, moreLines, "malformed base64 data in authentication continuation response")
 			}
 			toserver, last, err = a.Next(fromserver)
-			if err != nil {
+			if err != nil && wasLast {
+				xcode, xsecode, xfirstLine, xmoreLines := abort()
+				c.xerrorf(false, xcode, xsecode, xfirstLine, xmoreLines, "server requested unexpected continuation of authentication: %w", err)
+			} else if err != nil {
 				// For failing SCRAM, the client stops due to message about invalid proof. The
 				// server still sends an authentication result (it probably should send 501
 				// instead).
@@ -6,11 +6,13 @@ import (
 	"log/slog"
 	"net"
 	"os"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/mjl-/bstore"
 
+	"github.com/mjl-/mox/arc"
 	"github.com/mjl-/mox/config"
 	"github.com/mjl-/mox/dkim"
 	"github.com/mjl-/mox/dmarc"
@@ -22,6 +24,7 @@ import (
 	"github.com/mjl-/mox/mlog"
 	"github.com/mjl-/mox/mox-"
 	"github.com/mjl-/mox/publicsuffix"
+	"github.com/mjl-/mox/sieve"
 	"github.com/mjl-/mox/smtp"
 	"github.com/mjl-/mox/store"
 	"github.com/mjl-/mox/subjectpass"
@@ -44,7 +47,9 @@ type delivery struct {
 	dmarcUse         bool
 	dmarcResult      dmarc.Result
 	dkimResults      []dkim.Result
+	arcResult        arc.Result
 	iprevStatus      iprev.Status
+	sieveResult      *sieve.Result // If non-nil, from the active Sieve script, used instead of rulesets.
 }
 
 type analysis struct {
@@ -80,8 +85,9 @@ const (
 	reasonDNSBlocklisted    = "dns-blocklisted"
 	reasonSubjectpass       = "subjectpass"
 	reasonSubjectpassError  = "subjectpass-error"
-	reasonIPrev             = "iprev"     // No or mild junk reputation signals, and bad iprev.
-	reasonHighRate          = "high-rate" // Too many messages, not added to rejects.
+	reasonIPrev             = "iprev"        // No or mild junk reputation signals, and bad iprev.
+	reasonHighRate          = "high-rate"    // Too many messages, not added to rejects.
+	reasonSieveReject       = "sieve-reject" // Rejected by Sieve script of recipient, not added to rejects.
 )
 
 func isListDomain(d delivery, ld dns.Domain) bool {
@@ -187,12 +193,25 @@ func analyze(ctx context.Context, log mlog.Log, resolver dns.Resolver, d deliver
 		mailbox = "Inbox"
 	}
 
+	// If a Sieve script is active, it is used instead of the rulesets. Its first
+	// local delivery determines the mailbox for reputation.
+	var rs *config.Ruleset
+	if d.sieveResult != nil {
+		if d.sieveResult.Reject != nil {
+			log.Info("rejecting message per sieve script")
+			reason := d.sieveResult.Reject.ResponseText()
+			return analysis{d: d, accept: false, mailbox: mailbox, code: smtp.C550MailboxUnavail, secode: smtp.SePol7DeliveryUnauth1, userError: true, errmsg: reason, reason: reasonSieveReject, headers: headers}
+		}
+		mailbox = store.SieveMailbox(mailbox, d.sieveResult)
+	} else {
+		rs = store.MessageRuleset(log, d.destination, d.m, d.m.MsgPrefix, d.dataFile)
+		if rs != nil {
+			mailbox = rs.Mailbox
+		}
+	}
+
 	// If destination mailbox has a mailing list domain (for SPF/DKIM) configured,
 	// check it for a pass.
-	rs := store.MessageRuleset(log, d.destination, d.m, d.m.MsgPrefix, d.dataFile)
-	if rs != nil {
-		mailbox = rs.Mailbox
-	}
 	if rs != nil && !rs.ListAllowDNSDomain.IsZero() {
 		// todo: on temporary failures, reject temporarily?
 		if isListDomain(d, rs.ListAllowDNSDomain) {
@@ -223,11 +242,32 @@ func analyze(ctx context.Context, log mlog.Log, resolver dns.Resolver, d deliver
 				dkimdoms = append(dkimdoms, dom)
 			}
 		}
+		// If the forwarding mail server sealed the message with ARC, we use the DKIM
+		// domains it verified, their signatures may have been broken in forwarding.
+		if arcTrustedSealer(d.arcResult, rs.VerifiedDNSDomain) {
+			for _, dom := range arcDKIMDomains(d.arcResult) {
+				if dom != rs.VerifiedDNSDomain.Name() && !slices.Contains(dkimdoms, dom) {
+					dkimdoms = append(dkimdoms, dom)
+				}
+			}
+		}
 		d.m.DKIMDomains = dkimdoms
 		dmarcOverrideReason = string(dmarcrpt.PolicyOverrideForwarded)
 		log.Info("forwarded message, clearing identifying signals of forwarding mail server")
 	}
 
+	// If the message fails DMARC but has a valid ARC chain most recently sealed by an
+	// intermediary we trust, we don't apply the DMARC policy: The intermediary
+	// verified the message when it came in, and likely modified it, e.g. by adding a
+	// footer for a mailing list. ../rfc/8617:1187
+	if d.dmarcUse && d.dmarcResult.Status != dmarc.StatusPass && arcTrustedSealer(d.arcResult, dns.Domain{}) {
+		d.dmarcUse = false
+		if dmarcOverrideReason == "" {
+			dmarcOverrideReason = string(dmarcrpt.PolicyOverrideTrustedForwarder)
+		}
+		log.Info("not applying dmarc policy for message with arc chain sealed by trusted intermediary", slog.Any("sealers", d.arcResult.Sealers()))
+	}
+
 	assignMailbox := func(tx *bstore.Tx) error {
 		// Set message MailboxID to which mail will be delivered. Reputation is
 		// per-mailbox. If referenced mailbox is not found (e.g. does not yet exist), we
@@ -404,9 +444,13 @@ func analyze(ctx context.Context, log mlog.Log, resolver dns.Resolver, d deliver
 		return analysis{d: d, accept: true, mailbox: mailbox, dmarcReport: dmarcReport, tlsReport: tlsReport, reason: reasonReporting, dmarcOverrideReason: dmarcOverrideReason, headers: headers}
 	}
 	// If there was no previous message from sender or its domain, and we have an SPF
-	// (soft)fail, reject the message.
+	// (soft)fail, reject the message. Unless it came through a trusted ARC sealer, an
+	// intermediary that kept the original SMTP MAIL FROM.
 	switch method {
 	case methodDKIMSPF, methodIP1, methodIP2, methodIP3, methodNone:
+		if arcTrustedSealer(d.arcResult, dns.Domain{}) {
+			break
+		}
 		switch d.m.MailFromValidation {
 		case store.ValidationFail, store.ValidationSoftfail:
 			return reject(smtp.C451LocalErr, smtp.SeSys3Other0, "error processing", nil, reasonSPFPolicy)
@@ -562,3 +606,36 @@ func analyze(ctx context.Context, log mlog.Log, resolver dns.Resolver, d deliver
 
 	return reject(smtp.C451LocalErr, smtp.SeSys3Other0, "error processing", nil, reason)
 }
+
+// arcTrustedSealer returns whether the message has a passing ARC chain, most
+// recently sealed by a configured trusted ARC sealer, or by forwarder if not zero.
+func arcTrustedSealer(r arc.Result, forwarder dns.Domain) bool {
+	sealers := r.Sealers()
+	if len(sealers) == 0 {
+		return false
+	}
+	return !forwarder.IsZero() && sealers[0] == forwarder || slices.Contains(mox.Conf.Static.TrustedARCSealerDomains, sealers[0])
+}
+
+// arcDKIMDomains returns the domains with a DKIM pass in the authentication
+// results recorded by the most recent ARC sealer. Unicode strings.
+func arcDKIMDomains(r arc.Result) []string {
+	if len(r.Sets) == 0 {
+		return nil
+	}
+	var l []string
+	for _, m := range r.Sets[len(r.Sets)-1].AuthResults.Methods {
+		if !strings.EqualFold(m.Method, "dkim") || !strings.EqualFold(m.Result, "pass") {
+			continue
+		}
+		for _, p := range m.Props {
+			if !strings.EqualFold(p.Type, "header") || !strings.EqualFold(p.Property, "d") {
+				continue
+			}
+			if d, err := dns.ParseDomain(p.Value); err == nil && !slices.Contains(l, d.Name()) {
+				l = append(l, d.Name())
+			}
+		}
+	}
+	return l
+}
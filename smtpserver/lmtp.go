@@ -0,0 +1,323 @@
+package smtpserver
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/textproto"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/message"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/publicsuffix"
+	"github.com/mjl-/mox/queue"
+	"github.com/mjl-/mox/sieve"
+	"github.com/mjl-/mox/smtp"
+	"github.com/mjl-/mox/store"
+)
+
+// listenLMTP prepares to listen for LMTP connections on a TCP address or unix
+// domain socket. Only TCP connections from trusted networks are served, all unix
+// domain socket connections are trusted.
+func listenLMTP(name, network, addr string, hostname dns.Domain, tlsConfig *tls.Config, maxMessageSize int64, trusted []*net.IPNet) {
+	log := mlog.New("smtpserver", nil)
+	var ln net.Listener
+	if network != "unix" {
+		if os.Getuid() == 0 {
+			log.Print("listening for lmtp",
+				slog.String("listener", name),
+				slog.String("address", addr))
+		}
+		var err error
+		ln, err = mox.Listen(network, addr)
+		if err != nil {
+			log.Fatalx("lmtp: listen for lmtp", err, slog.String("listener", name))
+		}
+	}
+
+	serve := func() {
+		if ln == nil {
+			// The unix domain socket is created by the unprivileged process, so it is owned
+			// by the mox user.
+			_ = os.Remove(addr)
+			var err error
+			ln, err = net.Listen("unix", addr)
+			if err != nil {
+				log.Fatalx("lmtp: listen on unix domain socket", err, slog.String("listener", name), slog.String("path", addr))
+			}
+			err = os.Chmod(addr, 0660)
+			log.Check(err, "setting permissions on lmtp unix domain socket")
+		}
+
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				log.Infox("lmtp: accept", err, slog.String("listener", name))
+				continue
+			}
+
+			if a, ok := conn.RemoteAddr().(*net.TCPAddr); ok && !slices.ContainsFunc(trusted, func(n *net.IPNet) bool { return n.Contains(a.IP) }) {
+				log.Info("lmtp: refusing connection from untrusted ip", slog.Any("remoteip", a.IP), slog.String("listener", name))
+				_, err := fmt.Fprintf(conn, "%d %d.%s not a trusted lmtp client\r\n", smtp.C554TransactionFailed, smtp.C554TransactionFailed/100, smtp.SePol7DeliveryUnauth1)
+				log.Check(err, "writing lmtp refusal")
+				err = conn.Close()
+				log.Check(err, "closing lmtp connection")
+				continue
+			}
+
+			resolver := dns.StrictResolver{Log: log.Logger}
+			go serve(name, mox.Cid(), hostname, tlsConfig, conn, resolver, false, false, maxMessageSize, false, false, false, nil, 0, nil, true)
+		}
+	}
+
+	servers = append(servers, serve)
+}
+
+// lmtpDeliver delivers a message received over LMTP to the accepted recipients,
+// and writes a response for each of them. The LMTP client is trusted: we don't
+// verify SPF/DKIM/DMARC or use reputation. The junk filter, Sieve scripts,
+// rulesets and quota do apply. ../rfc/2033:202
+func (c *conn) lmtpDeliver(ctx context.Context, recvHdrFor func(string) string, msgWriter *message.Writer, dataFile *os.File) {
+	var msgFrom smtp.Address
+	var headers textproto.MIMEHeader
+	part, err := message.Parse(c.log.Logger, false, dataFile)
+	if err == nil {
+		msgFrom, _, headers, err = message.From(c.log.Logger, false, dataFile, &part)
+	}
+	if err != nil {
+		c.log.Infox("parsing message for From address", err)
+	}
+	messageID := headers.Get("Message-Id")
+
+	type reply struct {
+		code   int
+		secode string
+		errmsg string
+	}
+
+	// Write one response for each accepted recipient, in order. ../rfc/2033:210
+	writeReplies := func(replies []reply) {
+		c.rset()
+		for _, r := range replies {
+			msg := r.errmsg
+			if r.code != smtp.C250Completed {
+				msg = fmt.Sprintf("%s (%s)", msg, mox.ReceivedID(c.cid))
+			}
+			c.bwritecodeline(r.code, r.secode, msg, nil)
+		}
+		c.xflush()
+	}
+
+	// Basic loop detection. ../rfc/5321:4065 ../rfc/5321:1526
+	if len(headers.Values("Received")) > 100 {
+		c.log.Info("loop detected, not delivering message over lmtp")
+		metricDelivery.WithLabelValues("reject", "loop").Inc()
+		replies := make([]reply, len(c.recipients))
+		for i := range replies {
+			replies[i] = reply{smtp.C550MailboxUnavail, smtp.SeNet4Loop6, "loop detected, more than 100 Received headers"}
+		}
+		writeReplies(replies)
+		return
+	}
+
+	// Whether addr is an explicit recipient in the transaction, for preventing
+	// duplicate deliveries to alias members.
+	regularRecipient := func(addr smtp.Path) bool {
+		return slices.ContainsFunc(c.recipients, func(rcpt recipient) bool {
+			return rcpt.account != nil && rcpt.addr.Equal(addr)
+		})
+	}
+
+	delivered := reply{smtp.C250Completed, smtp.SeMailbox2Other0, "it is done"}
+	errorProcessing := reply{smtp.C451LocalErr, smtp.SeSys3Other0, "error processing"}
+
+	// Deliver to a single account.
+	deliverAccount := func(log mlog.Log, smtpRcptTo, deliverTo smtp.Path, accountName string, dest config.Destination) reply {
+		acc, err := store.OpenAccount(log, accountName)
+		if err != nil {
+			log.Errorx("open account", err, slog.Any("account", accountName))
+			metricDelivery.WithLabelValues("accounterror", "lmtp").Inc()
+			return errorProcessing
+		}
+		defer func() {
+			err := acc.Close()
+			log.Check(err, "closing account after lmtp delivery")
+		}()
+
+		m := store.Message{
+			Received:          time.Now(),
+			RemoteIP:          c.remoteIP.String(),
+			EHLODomain:        c.hello.Domain.Name(),
+			MailFrom:          c.mailFrom.String(),
+			MailFromLocalpart: c.mailFrom.Localpart,
+			MailFromDomain:    c.mailFrom.IPDomain.Domain.Name(),
+			RcptToLocalpart:   smtpRcptTo.Localpart,
+			RcptToDomain:      smtpRcptTo.IPDomain.Domain.Name(),
+			MsgFromLocalpart:  msgFrom.Localpart,
+			MsgFromDomain:     msgFrom.Domain.Name(),
+			MsgFromOrgDomain:  publicsuffix.Lookup(ctx, log.Logger, msgFrom.Domain).Name(),
+			Size:              msgWriter.Size,
+		}
+		// ../rfc/9228:274 ../rfc/5321:3300
+		m.MsgPrefix = []byte(
+			"Delivered-To: " + deliverTo.XString(c.msgsmtputf8) + "\r\n" +
+				"Return-Path: <" + c.mailFrom.String() + ">\r\n" +
+				recvHdrFor(smtpRcptTo.String()),
+		)
+		m.Size += int64(len(m.MsgPrefix))
+
+		// Messages classified as junk go to the Junk mailbox. Others are delivered
+		// according to the Sieve script or rulesets.
+		var junk bool
+		if f, jf, err := acc.OpenJunkFilter(ctx, log); err == nil {
+			contentProb, _, _, _, err := f.ClassifyMessageReader(ctx, store.FileMsgReader(m.MsgPrefix, dataFile), m.Size)
+			xerr := f.Close()
+			log.Check(xerr, "closing junkfilter")
+			if err != nil {
+				log.Errorx("testing for spam", err)
+				return errorProcessing
+			}
+			junk = contentProb >= jf.Threshold
+			log.Debug("content analyzed", slog.Float64("contentprob", contentProb), slog.Bool("junk", junk))
+		} else if err != store.ErrNoJunkFilter {
+			log.Errorx("open junkfilter", err)
+			return errorProcessing
+		}
+
+		var sieveResult *sieve.Result
+		acc.WithWLock(func() {
+			if junk {
+				err = acc.DeliverMailbox(log, junkMailbox(ctx, log, acc), &m, dataFile)
+			} else {
+				sieveResult, err = acc.DeliverDestination(log, dest, &m, dataFile)
+			}
+		})
+		if err != nil {
+			log.Errorx("delivering", err)
+			metricDelivery.WithLabelValues("delivererror", "lmtp").Inc()
+			if errors.Is(err, store.ErrOverQuota) {
+				return reply{smtp.C452StorageFull, smtp.SeMailbox2Full2, "account storage full"}
+			}
+			return errorProcessing
+		} else if sieveResult != nil && sieveResult.Reject != nil {
+			log.Info("incoming message rejected by sieve script", slog.String("reason", sieveResult.Reject.Reason))
+			metricDelivery.WithLabelValues("reject", reasonSieveReject).Inc()
+			return reply{smtp.C550MailboxUnavail, smtp.SePol7DeliveryUnauth1, sieveResult.Reject.ResponseText()}
+		}
+		metricDelivery.WithLabelValues("delivered", "lmtp").Inc()
+		log.Info("incoming message delivered over lmtp", slog.Bool("junk", junk), slog.Any("msgfrom", msgFrom))
+
+		// Queue redirects and vacation responses from the Sieve script.
+		if sieveResult != nil {
+			err := queue.SieveActions(context.Background(), log, acc, deliverTo, &m, dataFile, sieveResult)
+			log.Check(err, "performing sieve actions for lmtp delivery")
+		}
+
+		// Automatic response if the account has vacation settings active. Not for junk.
+		if m.ID != 0 && !junk {
+			vacationReply(log, acc, deliverTo, &m, dataFile, sieveResult)
+		}
+
+		// Pass stored message to queue for webhooks. Not for a Sieve discard.
+		if m.ID != 0 {
+			mb := store.Mailbox{ID: m.MailboxID}
+			if err := acc.DB.Get(ctx, &mb); err != nil {
+				log.Errorx("get mailbox for evaluating webhook", err)
+			} else if part, err := m.LoadPart(store.FileMsgReader(m.MsgPrefix, dataFile)); err != nil {
+				log.Errorx("loading parsed part for evaluating webhook", err)
+			} else {
+				err = queue.Incoming(context.Background(), log, acc, messageID, m, part, mb.Name)
+				log.Check(err, "queueing webhook for incoming delivery")
+			}
+		}
+		return delivered
+	}
+
+	var replies []reply
+	var ndelivered int
+	for _, rcpt := range c.recipients {
+		log := c.log.With(slog.Any("mailfrom", c.mailFrom), slog.Any("rcptto", rcpt.addr))
+
+		var r reply
+		if rcpt.account != nil {
+			r = deliverAccount(log, rcpt.addr, rcpt.addr, rcpt.account.accountName, rcpt.account.destination)
+		} else if rcpt.alias != nil {
+			if !aliasAllowedMsgFrom(ctx, log, rcpt.alias.alias, msgFrom) {
+				r = reply{smtp.C550MailboxUnavail, smtp.SePol7ExpnProhibited2, "not allowed to send to destination"}
+			} else {
+				// We succeed if we delivered to any of the members. Members that are explicit
+				// recipients, or the sender, are skipped.
+				r = delivered
+				var memberDelivered bool
+				for _, aa := range rcpt.alias.alias.ParsedAddresses {
+					// External members of mailing lists get the message through the queue.
+					if aa.AccountName == "" || regularRecipient(aa.Address.Path()) || aa.Address == msgFrom {
+						continue
+					}
+					mr := deliverAccount(log, rcpt.addr, aa.Address.Path(), aa.AccountName, aa.Destination)
+					if mr.code == smtp.C250Completed {
+						memberDelivered = true
+					} else if !memberDelivered {
+						r = mr
+					}
+				}
+				if memberDelivered {
+					r = delivered
+				}
+
+				// Mailing lists: queue for external members and members that subscribed by email.
+				if rcpt.alias.alias.ListOwner != "" && r.code == smtp.C250Completed {
+					lm := queue.ListMessage{
+						MailFrom:  c.mailFrom.String(),
+						MsgFrom:   msgFrom,
+						Has8bit:   msgWriter.Has8bit,
+						SMTPUTF8:  c.msgsmtputf8,
+						MessageID: messageID,
+						Subject:   headers.Get("Subject"),
+						Size:      msgWriter.Size,
+					}
+					var skip []smtp.Address
+					for _, r := range c.recipients {
+						if r.account != nil {
+							skip = append(skip, smtp.NewAddress(r.addr.Localpart, r.addr.IPDomain.Domain))
+						}
+					}
+					if err := queue.ListDeliver(ctx, log, rcpt.alias.alias, lm, dataFile, skip); err != nil {
+						log.Errorx("queueing message for mailing list", err)
+						if !memberDelivered {
+							r = errorProcessing
+						}
+					}
+				}
+			}
+		} else if rcpt.list != nil {
+			// LMTP clients are trusted, the message from address is not verified.
+			r = delivered
+			if err := queue.ListIncoming(ctx, log, rcpt.list.alias, rcpt.list.cmd, rcpt.list.param, msgFrom, &part, dataFile); err != nil {
+				log.Errorx("processing list command", err)
+				r = errorProcessing
+			}
+		} else {
+			// Not possible, we only accept local recipients over LMTP.
+			r = reply{smtp.C550MailboxUnavail, smtp.SeAddr1UnknownDestMailbox1, "no such user"}
+		}
+		if r.code == smtp.C250Completed {
+			ndelivered++
+		}
+		replies = append(replies, r)
+	}
+
+	if ndelivered > 0 {
+		c.transactionGood++
+		c.transactionBad-- // Compensate for early earlier pessimistic increase.
+	}
+	writeReplies(replies)
+}
@@ -0,0 +1,92 @@
+package smtpserver
+
+import (
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mjl-/mox/dns"
+)
+
+// Test delivery over LMTP, with a response for each recipient after DATA.
+func TestLMTP(t *testing.T) {
+	ts := newTestServer(t, filepath.FromSlash("../testdata/smtp/mox.conf"), dns.MockResolver{})
+	defer ts.close()
+	ts.lmtp = true
+
+	ts.runRaw(func(conn net.Conn) {
+		t.Helper()
+		defer conn.Close()
+
+		tc := textproto.NewConn(conn)
+
+		cmd := func(s string, expCode int) {
+			t.Helper()
+			if s != "" {
+				err := tc.PrintfLine("%s", s)
+				tcheck(t, err, "write command")
+			}
+			_, _, err := tc.ReadResponse(expCode)
+			tcheck(t, err, "read response for "+s)
+		}
+
+		cmd("", 220)
+		cmd("EHLO remote.example", 500) // LHLO is required.
+		cmd("HELO remote.example", 500)
+		cmd("LHLO remote.example", 250)
+		cmd("MAIL FROM:<remote@example.org>", 250)
+		cmd("RCPT TO:<mjl@mox.example>", 250)
+		cmd("RCPT TO:<unknown@mox2.example>", 550) // Known domain, unknown user.
+		cmd("RCPT TO:<other@other.example>", 550)  // Not a local domain.
+		cmd("RCPT TO:<o@mox.example>", 250)
+		cmd("RCPT TO:<public@mox.example>", 250) // Alias, mjl@ is skipped, móx@ gets a copy.
+		cmd("DATA", 354)
+
+		w := tc.DotWriter()
+		_, err := w.Write([]byte(strings.ReplaceAll(deliverMessage, "\r\n", "\n")))
+		tcheck(t, err, "write message")
+		err = w.Close()
+		tcheck(t, err, "close message")
+
+		// One response for each accepted recipient.
+		for i := 0; i < 3; i++ {
+			cmd("", 250)
+		}
+
+		// A detected loop also results in a response for each accepted recipient,
+		// keeping the client in sync.
+		cmd("MAIL FROM:<remote@example.org>", 250)
+		cmd("RCPT TO:<mjl@mox.example>", 250)
+		cmd("RCPT TO:<o@mox.example>", 250)
+		cmd("DATA", 354)
+		w = tc.DotWriter()
+		_, err = w.Write([]byte(strings.Repeat("Received: from remote.example\n", 101) + strings.ReplaceAll(deliverMessage, "\r\n", "\n")))
+		tcheck(t, err, "write message")
+		err = w.Close()
+		tcheck(t, err, "close message")
+		for i := 0; i < 2; i++ {
+			cmd("", 550)
+		}
+		cmd("NOOP", 250)
+
+		cmd("QUIT", 221)
+	})
+	ts.checkCount("Inbox", 3)
+
+	// LHLO is not accepted for plain SMTP.
+	ts.lmtp = false
+	ts.runRaw(func(conn net.Conn) {
+		t.Helper()
+		defer conn.Close()
+
+		tc := textproto.NewConn(conn)
+		_, _, err := tc.ReadResponse(220)
+		tcheck(t, err, "read greeting")
+		err = tc.PrintfLine("LHLO remote.example")
+		tcheck(t, err, "write lhlo")
+		_, _, err = tc.ReadResponse(500)
+		tcheck(t, err, "read lhlo response")
+	})
+}
@@ -0,0 +1,295 @@
+package smtpserver
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/message"
+	"github.com/mjl-/mox/milter"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/moxio"
+	"github.com/mjl-/mox/smtp"
+	"github.com/mjl-/mox/store"
+)
+
+var metricMilter = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mox_smtpserver_milter_total",
+		Help: "Milter responses for incoming SMTP connections.",
+	},
+	[]string{
+		"stage",  // connect, helo, mail, rcpt, data
+		"result", // continue, accept, reject, tempfail, discard, error
+	},
+)
+
+// milterSession is the session with a milter for an incoming SMTP connection.
+type milterSession struct {
+	config config.Milter
+	client *milter.Client // Nil after an error, or after the milter accepted the connection.
+	failed bool           // Dial or protocol error, OnError applies to the remainder of the connection.
+	done   bool           // Milter accepted or discarded the current message, no more commands until the next message.
+}
+
+// errorResponse returns the response to use after an error with the milter.
+func (m *milterSession) errorResponse() milter.Response {
+	switch m.config.OnError {
+	case "accept":
+		return milter.Response{Action: milter.ActionContinue}
+	case "reject":
+		return milter.Response{Action: milter.ActionReject}
+	}
+	return milter.Response{Action: milter.ActionTempfail}
+}
+
+// milterFail closes the milter session after an error. The milter isn't used
+// anymore during this connection, instead its OnError config applies.
+func (c *conn) milterFail(m *milterSession, stage string, err error) {
+	c.log.Errorx("milter error", err,
+		slog.String("milter", m.config.Address),
+		slog.String("stage", stage),
+		slog.String("onerror", m.config.OnError))
+	metricMilter.WithLabelValues(stage, "error").Inc()
+	if m.client != nil {
+		err := m.client.Close()
+		c.log.Check(err, "closing milter connection after error")
+		m.client = nil
+	}
+	m.failed = true
+}
+
+// milterStart connects to the configured milters and passes the connection
+// information. The returned response has action continue, reject or tempfail.
+func (c *conn) milterStart(milters []config.Milter) milter.Response {
+	cidctx := context.WithValue(mox.Context, mlog.CidKey, c.cid)
+	for _, mc := range milters {
+		m := &milterSession{config: mc}
+		c.milters = append(c.milters, m)
+		ctx, cancel := context.WithTimeout(cidctx, mc.Timeout)
+		client, err := milter.Dial(ctx, mc.Address, mc.Timeout)
+		cancel()
+		if err != nil {
+			c.milterFail(m, "connect", err)
+		} else {
+			m.client = client
+		}
+	}
+
+	var port int
+	if a, ok := c.conn.RemoteAddr().(*net.TCPAddr); ok {
+		port = a.Port
+	}
+	// We don't have a verified reverse name yet, sendmail passes the IP in brackets in
+	// that case.
+	hostname := "[" + c.remoteIP.String() + "]"
+	return c.milterRun("connect", func(mc *milter.Client) (milter.Response, error) {
+		err := mc.Macros(milter.CmdConnect, "j", c.hostname.ASCII, "{daemon_name}", "mox", "{client_addr}", c.remoteIP.String())
+		if err != nil {
+			return milter.Response{}, err
+		}
+		return mc.Connect(hostname, c.remoteIP, port)
+	})
+}
+
+// milterRun calls fn for each milter that is still active, and returns the first
+// reject or tempfail response, or a continue response otherwise. A discard marks
+// the current message for discarding.
+func (c *conn) milterRun(stage string, fn func(mc *milter.Client) (milter.Response, error)) milter.Response {
+	for _, m := range c.milters {
+		if m.failed {
+			if resp := m.errorResponse(); resp.Action != milter.ActionContinue {
+				return resp
+			}
+			continue
+		}
+		if m.client == nil || m.done {
+			continue
+		}
+
+		resp, err := fn(m.client)
+		if err != nil {
+			c.milterFail(m, stage, err)
+			resp = m.errorResponse()
+		} else {
+			metricMilter.WithLabelValues(stage, resp.Action.String()).Inc()
+			c.log.Debug("milter response",
+				slog.String("milter", m.config.Address),
+				slog.String("stage", stage),
+				slog.Any("action", resp.Action),
+				slog.Int("code", resp.Code),
+				slog.String("text", resp.Text))
+		}
+
+		switch resp.Action {
+		case milter.ActionAccept:
+			if stage == "connect" || stage == "helo" {
+				// Accepted for the entire connection.
+				err := m.client.Close()
+				c.log.Check(err, "closing milter connection")
+				m.client = nil
+			} else {
+				m.done = true
+			}
+		case milter.ActionDiscard:
+			c.log.Info("milter requested discarding message", slog.String("milter", m.config.Address), slog.String("stage", stage))
+			c.milterDiscard = true
+			m.done = true
+		case milter.ActionReject, milter.ActionTempfail:
+			return resp
+		}
+	}
+	return milter.Response{Action: milter.ActionContinue}
+}
+
+// milterReply returns the SMTP reply for a reject or tempfail response from a
+// milter.
+func milterReply(resp milter.Response) (code int, secode, msg string) {
+	if resp.Action == milter.ActionTempfail {
+		code, secode, msg = smtp.C451LocalErr, smtp.SePol7DeliveryUnauth1, "temporarily rejected by content filter, try again later"
+	} else {
+		code, secode, msg = smtp.C550MailboxUnavail, smtp.SePol7DeliveryUnauth1, "rejected by content filter"
+	}
+	if resp.Code != 0 {
+		code = resp.Code
+		if resp.ECode != "" {
+			// We write the class of the enhanced status code from the reply code.
+			_, secode, _ = strings.Cut(resp.ECode, ".")
+		}
+		if resp.Text != "" {
+			msg = resp.Text
+		}
+	}
+	return
+}
+
+// xmilterCheck runs the milters for stage of the SMTP transaction, and fails the
+// command with an SMTP error if a milter rejects or tempfails.
+func (c *conn) xmilterCheck(stage string, fn func(mc *milter.Client) (milter.Response, error)) {
+	if len(c.milters) == 0 {
+		return
+	}
+	if resp := c.milterRun(stage, fn); resp.Action != milter.ActionContinue {
+		code, secode, msg := milterReply(resp)
+		xsmtpUserErrorf(code, secode, "%s", msg)
+	}
+}
+
+// xmilterMessage passes the message to the milters at the end of DATA. If a milter
+// rejects the message, the command fails with an SMTP error. If milters requested
+// header changes, a new temporary file with the modified message is returned,
+// which the caller must remove.
+func (c *conn) xmilterMessage(dataFile *os.File) (*os.File, *message.Writer) {
+	if c.milterDiscard {
+		return nil, nil
+	}
+
+	var changes []milter.HeaderChange
+	resp := c.milterRun("data", func(mc *milter.Client) (milter.Response, error) {
+		r, err := mc.Message(&moxio.AtReader{R: dataFile})
+		if err != nil {
+			return milter.Response{}, err
+		}
+		changes = append(changes, r.HeaderChanges...)
+		if r.Quarantine {
+			c.log.Info("milter requested quarantine of message", slog.String("reason", r.Reason))
+			metricMilter.WithLabelValues("data", "quarantine").Inc()
+			c.milterQuarantine = true
+		}
+		return r.Response, nil
+	})
+	if resp.Action != milter.ActionContinue {
+		code, secode, msg := milterReply(resp)
+		xsmtpUserErrorf(code, secode, "%s", msg)
+	}
+	if len(changes) == 0 || c.milterDiscard {
+		return nil, nil
+	}
+
+	// Write new message with the modified header and original body.
+	br := bufio.NewReader(&moxio.AtReader{R: dataFile})
+	var header []byte
+	for {
+		line, err := br.ReadBytes('\n')
+		header = append(header, line...)
+		if err == io.EOF || string(line) == "\r\n" {
+			break
+		}
+		xcheckf(err, "reading message header")
+	}
+	header, err := milter.ApplyHeaderChanges(header, changes)
+	xcheckf(err, "applying milter header changes")
+
+	f, err := store.CreateMessageTemp(c.log, "smtp-milter")
+	xcheckf(err, "creating temporary file for message")
+	w := message.NewWriter(f)
+	_, err = w.Write(header)
+	if err == nil {
+		_, err = io.Copy(w, br)
+	}
+	if err != nil {
+		store.CloseRemoveTempFile(c.log, f, "message with milter changes")
+		xcheckf(err, "writing message with milter header changes")
+	}
+	return f, w
+}
+
+// milterReset aborts the current message at the milters, if any, for a new
+// message transaction.
+func (c *conn) milterReset() {
+	if c.milterMessage {
+		for _, m := range c.milters {
+			if m.client == nil {
+				continue
+			}
+			if err := m.client.Abort(); err != nil {
+				c.milterFail(m, "abort", err)
+			}
+		}
+	}
+	for _, m := range c.milters {
+		m.done = false
+	}
+	c.milterMessage = false
+	c.milterDiscard = false
+	c.milterQuarantine = false
+}
+
+// milterClose ends the sessions with the milters.
+func (c *conn) milterClose() {
+	for _, m := range c.milters {
+		if m.client != nil {
+			err := m.client.Close()
+			c.log.Check(err, "closing milter connection")
+			m.client = nil
+		}
+	}
+}
+
+// junkMailbox returns the mailbox to deliver quarantined or junk messages to: the
+// mailbox with the Junk special-use flag, or "Junk" if there is none.
+func junkMailbox(ctx context.Context, log mlog.Log, acc *store.Account) string {
+	name := "Junk"
+	err := acc.DB.Read(ctx, func(tx *bstore.Tx) error {
+		mb, err := bstore.QueryTx[store.Mailbox](tx).FilterEqual("Junk", true).Get()
+		if err == nil {
+			name = mb.Name
+		} else if err != bstore.ErrAbsent {
+			return err
+		}
+		return nil
+	})
+	log.Check(err, "looking up junk mailbox")
+	return name
+}
@@ -0,0 +1,129 @@
+package smtpserver
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/message"
+	"github.com/mjl-/mox/milter"
+	"github.com/mjl-/mox/smtp"
+	"github.com/mjl-/mox/smtpclient"
+	"github.com/mjl-/mox/store"
+)
+
+// Test incoming deliveries passing through a milter.
+func TestMilter(t *testing.T) {
+	resolver := dns.MockResolver{
+		A: map[string][]string{
+			"example.org.": {"127.0.0.10"}, // For mx check.
+		},
+		PTR: map[string][]string{
+			"127.0.0.10": {"example.org."},
+		},
+	}
+	ts := newTestServer(t, filepath.FromSlash("../testdata/smtp/mox.conf"), resolver)
+	defer ts.close()
+
+	// Local test milter, deciding based on recipient and subject.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	tcheck(t, err, "listen for milter")
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			var subject string
+			m := milter.MockMilter{
+				Handle: func(cmd byte, data []byte) []milter.Packet {
+					switch cmd {
+					case milter.CmdRcpt:
+						if strings.HasPrefix(string(data), "<rcptreject@") {
+							return []milter.Packet{milter.Reply("550 5.7.1 recipient not wanted")}
+						}
+					case milter.CmdHeader:
+						if name, value, _ := strings.Cut(string(data), "\x00"); name == "Subject" {
+							subject = strings.TrimSuffix(value, "\x00")
+						}
+					case milter.CmdEOB:
+						switch subject {
+						case "reject":
+							return []milter.Packet{milter.Reject}
+						case "tempfail":
+							return []milter.Packet{milter.Reply("451 4.7.1 try again later")}
+						case "discard":
+							return []milter.Packet{milter.Discard}
+						case "quarantine":
+							return []milter.Packet{milter.Quarantine("looks like spam"), milter.Continue}
+						case "headers":
+							return []milter.Packet{milter.AddHeader("X-Scanned", "yes"), milter.ChangeHeader(1, "Subject", "changed"), milter.Continue}
+						}
+					}
+					return nil
+				},
+			}
+			go m.Serve(conn)
+		}
+	}()
+	ts.milters = []config.Milter{{Address: ln.Addr().String(), Timeout: time.Second, OnError: "tempfail"}}
+
+	testDeliver := func(rcptTo, subject string, expErr *smtpclient.Error) {
+		t.Helper()
+		msg := strings.ReplaceAll(deliverMessage, "Subject: test", "Subject: "+subject)
+		ts.run(func(err error, client *smtpclient.Client) {
+			t.Helper()
+			mailFrom := "remote@example.org"
+			if err == nil {
+				err = client.Deliver(ctxbg, mailFrom, rcptTo, int64(len(msg)), strings.NewReader(msg), false, false, false)
+			}
+			ts.smtpErr(err, expErr)
+		})
+	}
+
+	testDeliver("rcptreject@mox.example", "test", &smtpclient.Error{Permanent: true, Code: smtp.C550MailboxUnavail, Secode: smtp.SePol7DeliveryUnauth1})
+	testDeliver("mjl@mox.example", "reject", &smtpclient.Error{Permanent: true, Code: smtp.C550MailboxUnavail, Secode: smtp.SePol7DeliveryUnauth1})
+	testDeliver("mjl@mox.example", "tempfail", &smtpclient.Error{Code: smtp.C451LocalErr, Secode: smtp.SePol7DeliveryUnauth1})
+	testDeliver("mjl@mox.example", "discard", nil)
+	ts.checkCount("Inbox", 0)
+
+	testDeliver("mjl@mox.example", "headers", nil)
+	ts.checkCount("Inbox", 1)
+	m, err := bstore.QueryDB[store.Message](ctxbg, ts.acc.DB).FilterEqual("Expunged", false).SortDesc("ID").Limit(1).Get()
+	tcheck(t, err, "get delivered message")
+	p, err := message.Parse(pkglog.Logger, false, ts.acc.MessageReader(m))
+	tcheck(t, err, "parse message")
+	mh, err := p.Header()
+	tcheck(t, err, "parse message header")
+	tcompare(t, mh.Get("Subject"), "changed")
+	tcompare(t, mh.Get("X-Scanned"), "yes")
+
+	// Unreachable milter, with OnError tempfail, rejecting the connection.
+	milters := ts.milters
+	badln, err := net.Listen("tcp", "127.0.0.1:0")
+	tcheck(t, err, "listen")
+	badln.Close()
+	ts.milters = []config.Milter{{Address: badln.Addr().String(), Timeout: time.Second, OnError: "tempfail"}}
+	ts.run(func(err error, client *smtpclient.Client) {
+		ts.smtpErr(err, &smtpclient.Error{Code: smtp.C421ServiceUnavail})
+	})
+
+	// With OnError accept, the message is delivered.
+	ts.milters[0].OnError = "accept"
+	testDeliver("mjl@mox.example", "reject", nil)
+	ts.checkCount("Inbox", 2)
+	ts.milters = milters
+
+	// Quarantined message is delivered to the Junk mailbox. Last, because the junk
+	// filter learns from it.
+	testDeliver("mjl@mox.example", "quarantine", nil)
+	ts.checkCount("Inbox", 2)
+	ts.checkCount("Junk", 1)
+}
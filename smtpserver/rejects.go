@@ -56,11 +56,17 @@ func rejectPresent(log mlog.Log, acc *store.Account, rejectsMailbox string, m *s
 				return fmt.Errorf("looking for rejects mailbox: %w", err)
 			}
 
+			// Stored as hash for accounts with encryption.
+			storedMsgID, err := store.HashThreadValue(tx, msgID)
+			if err != nil {
+				return err
+			}
+
 			q := bstore.QueryTx[store.Message](tx)
 			q.FilterNonzero(store.Message{MailboxID: mb.ID})
 			q.FilterEqual("Expunged", false)
 			q.FilterFn(func(m store.Message) bool {
-				return msgID != "" && m.MessageID == msgID || len(hash) > 0 && bytes.Equal(m.MessageHash, hash)
+				return storedMsgID != "" && m.MessageID == storedMsgID || len(hash) > 0 && bytes.Equal(m.MessageHash, hash)
 			})
 			exists, err = q.Exists()
 			return err
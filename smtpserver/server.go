@@ -38,6 +38,7 @@ import (
 
 	"github.com/mjl-/bstore"
 
+	"github.com/mjl-/mox/arc"
 	"github.com/mjl-/mox/config"
 	"github.com/mjl-/mox/dkim"
 	"github.com/mjl-/mox/dmarc"
@@ -48,14 +49,17 @@ import (
 	"github.com/mjl-/mox/iprev"
 	"github.com/mjl-/mox/message"
 	"github.com/mjl-/mox/metrics"
+	"github.com/mjl-/mox/milter"
 	"github.com/mjl-/mox/mlog"
 	"github.com/mjl-/mox/mox-"
 	"github.com/mjl-/mox/moxio"
 	"github.com/mjl-/mox/moxvar"
+	"github.com/mjl-/mox/oidc"
 	"github.com/mjl-/mox/publicsuffix"
 	"github.com/mjl-/mox/queue"
 	"github.com/mjl-/mox/ratelimit"
 	"github.com/mjl-/mox/scram"
+	"github.com/mjl-/mox/sieve"
 	"github.com/mjl-/mox/smtp"
 	"github.com/mjl-/mox/spf"
 	"github.com/mjl-/mox/store"
@@ -208,7 +212,23 @@ func Listen() {
 			port := config.Port(listener.SMTP.Port, 25)
 			for _, ip := range listener.IPs {
 				firstTimeSenderDelay := durationDefault(listener.SMTP.FirstTimeSenderDelay, firstTimeSenderDelayDefault)
-				listen1("smtp", name, ip, port, hostname, tlsConfig, false, false, maxMsgSize, false, listener.SMTP.RequireSTARTTLS, !listener.SMTP.NoRequireTLS, listener.SMTP.DNSBLZones, firstTimeSenderDelay)
+				listen1("smtp", name, ip, port, hostname, tlsConfig, false, false, maxMsgSize, false, listener.SMTP.RequireSTARTTLS, !listener.SMTP.NoRequireTLS, listener.SMTP.DNSBLZones, firstTimeSenderDelay, listener.SMTP.Milters)
+			}
+		}
+		if listener.LMTP.Enabled {
+			hostname := mox.Conf.Static.HostnameDomain
+			if listener.Hostname != "" {
+				hostname = listener.HostnameDomain
+			}
+			if listener.LMTP.Port >= 0 {
+				port := config.Port(listener.LMTP.Port, 24)
+				for _, ip := range listener.IPs {
+					addr := net.JoinHostPort(ip, fmt.Sprintf("%d", port))
+					listenLMTP(name, mox.Network(ip), addr, hostname, tlsConfig, maxMsgSize, listener.LMTP.TrustedIPNets)
+				}
+			}
+			if listener.LMTP.UnixSocket != "" {
+				listenLMTP(name, "unix", mox.DataDirPath(listener.LMTP.UnixSocket), hostname, tlsConfig, maxMsgSize, nil)
 			}
 		}
 		if listener.Submission.Enabled {
@@ -218,7 +238,7 @@ func Listen() {
 			}
 			port := config.Port(listener.Submission.Port, 587)
 			for _, ip := range listener.IPs {
-				listen1("submission", name, ip, port, hostname, tlsConfig, true, false, maxMsgSize, !listener.Submission.NoRequireSTARTTLS, !listener.Submission.NoRequireSTARTTLS, true, nil, 0)
+				listen1("submission", name, ip, port, hostname, tlsConfig, true, false, maxMsgSize, !listener.Submission.NoRequireSTARTTLS, !listener.Submission.NoRequireSTARTTLS, true, nil, 0, nil)
 			}
 		}
 
@@ -229,7 +249,7 @@ func Listen() {
 			}
 			port := config.Port(listener.Submissions.Port, 465)
 			for _, ip := range listener.IPs {
-				listen1("submissions", name, ip, port, hostname, tlsConfig, true, true, maxMsgSize, true, true, true, nil, 0)
+				listen1("submissions", name, ip, port, hostname, tlsConfig, true, true, maxMsgSize, true, true, true, nil, 0, nil)
 			}
 		}
 	}
@@ -237,7 +257,7 @@ func Listen() {
 
 var servers []func()
 
-func listen1(protocol, name, ip string, port int, hostname dns.Domain, tlsConfig *tls.Config, submission, xtls bool, maxMessageSize int64, requireTLSForAuth, requireTLSForDelivery, requireTLS bool, dnsBLs []dns.Domain, firstTimeSenderDelay time.Duration) {
+func listen1(protocol, name, ip string, port int, hostname dns.Domain, tlsConfig *tls.Config, submission, xtls bool, maxMessageSize int64, requireTLSForAuth, requireTLSForDelivery, requireTLS bool, dnsBLs []dns.Domain, firstTimeSenderDelay time.Duration, milters []config.Milter) {
 	log := mlog.New("smtpserver", nil)
 	addr := net.JoinHostPort(ip, fmt.Sprintf("%d", port))
 	if os.Getuid() == 0 {
@@ -265,7 +285,7 @@ func listen1(protocol, name, ip string, port int, hostname dns.Domain, tlsConfig
 
 			// Package is set on the resolver by the dkim/spf/dmarc/etc packages.
 			resolver := dns.StrictResolver{Log: log.Logger}
-			go serve(name, mox.Cid(), hostname, tlsConfig, conn, resolver, submission, xtls, maxMessageSize, requireTLSForAuth, requireTLSForDelivery, requireTLS, dnsBLs, firstTimeSenderDelay)
+			go serve(name, mox.Cid(), hostname, tlsConfig, conn, resolver, submission, xtls, maxMessageSize, requireTLSForAuth, requireTLSForDelivery, requireTLS, dnsBLs, firstTimeSenderDelay, milters, false)
 		}
 	}
 
@@ -312,6 +332,8 @@ type conn struct {
 	ncmds                 int       // Number of commands processed. Used to abort connection when first incoming command is unknown/invalid.
 	dnsBLs                []dns.Domain
 	firstTimeSenderDelay  time.Duration
+	milters               []*milterSession // For incoming deliveries, if configured.
+	lmtp                  bool             // LMTP instead of SMTP, for final delivery by a trusted client. ../rfc/2033
 
 	// If non-zero, taken into account during Read and Write. Set while processing DATA
 	// command, we don't want the entire delivery to take too long.
@@ -337,6 +359,9 @@ type conn struct {
 	smtputf8             bool      // todo future: we should keep track of this per recipient. perhaps only a specific recipient requires smtputf8, e.g. due to a utf8 localpart.
 	msgsmtputf8          bool      // Is SMTPUTF8 required for the received message. Default to the same value as `smtputf8`, but is re-evaluated after the whole message (envelope and data) is received.
 	recipients           []recipient
+	milterMessage        bool // Whether milters have been sent MAIL FROM, and need an abort for a next message.
+	milterDiscard        bool // Milter requested discarding the message.
+	milterQuarantine     bool // Milter requested quarantine, message is delivered to Junk mailbox.
 }
 
 type rcptAccount struct {
@@ -350,6 +375,12 @@ type rcptAlias struct {
 	canonicalAddress string // Optional catchall part stripped and/or lowercased.
 }
 
+type rcptList struct {
+	alias config.Alias
+	cmd   mox.ListCommand
+	param string
+}
+
 type recipient struct {
 	addr smtp.Path
 
@@ -358,6 +389,7 @@ type recipient struct {
 	// deliveries, this will result in an error.
 	account *rcptAccount // If set, recipient address is for this local account.
 	alias   *rcptAlias   // If set, for a local alias.
+	list    *rcptList    // If set, for a command address of a mailing list, e.g. for subscribing.
 }
 
 func isClosed(err error) bool {
@@ -389,6 +421,7 @@ func (c *conn) rset() {
 	c.smtputf8 = false
 	c.msgsmtputf8 = false
 	c.recipients = nil
+	c.milterReset()
 }
 
 func (c *conn) earliestDeadline(d time.Duration) time.Time {
@@ -572,7 +605,7 @@ func (c *conn) writelinef(format string, args ...any) {
 
 var cleanClose struct{} // Sentinel value for panic/recover indicating clean close of connection.
 
-func serve(listenerName string, cid int64, hostname dns.Domain, tlsConfig *tls.Config, nc net.Conn, resolver dns.Resolver, submission, tls bool, maxMessageSize int64, requireTLSForAuth, requireTLSForDelivery, requireTLS bool, dnsBLs []dns.Domain, firstTimeSenderDelay time.Duration) {
+func serve(listenerName string, cid int64, hostname dns.Domain, tlsConfig *tls.Config, nc net.Conn, resolver dns.Resolver, submission, tls bool, maxMessageSize int64, requireTLSForAuth, requireTLSForDelivery, requireTLS bool, dnsBLs []dns.Domain, firstTimeSenderDelay time.Duration, milters []config.Milter, lmtp bool) {
 	var localIP, remoteIP net.IP
 	if a, ok := nc.LocalAddr().(*net.TCPAddr); ok {
 		localIP = a.IP
@@ -583,7 +616,7 @@ func serve(listenerName string, cid int64, hostname dns.Domain, tlsConfig *tls.C
 	if a, ok := nc.RemoteAddr().(*net.TCPAddr); ok {
 		remoteIP = a.IP
 	} else {
-		// For net.Pipe, during tests.
+		// For net.Pipe during tests, and unix domain sockets for LMTP.
 		remoteIP = net.ParseIP("127.0.0.10")
 	}
 
@@ -605,6 +638,7 @@ func serve(listenerName string, cid int64, hostname dns.Domain, tlsConfig *tls.C
 		requireTLSForDelivery: requireTLSForDelivery,
 		dnsBLs:                dnsBLs,
 		firstTimeSenderDelay:  firstTimeSenderDelay,
+		lmtp:                  lmtp,
 	}
 	var logmutex sync.Mutex
 	c.log = mlog.New("smtpserver", nil).WithFunc(func() []slog.Attr {
@@ -632,12 +666,15 @@ func serve(listenerName string, cid int64, hostname dns.Domain, tlsConfig *tls.C
 		slog.Any("local", c.conn.LocalAddr()),
 		slog.Bool("submission", submission),
 		slog.Bool("tls", tls),
+		slog.Bool("lmtp", lmtp),
 		slog.String("listener", listenerName))
 
 	defer func() {
 		c.origConn.Close() // Close actual TCP socket, regardless of TLS on top.
 		c.conn.Close()     // If TLS, will try to write alert notification to already closed socket, returning error quickly.
 
+		c.milterClose()
+
 		if c.account != nil {
 			err := c.account.Close()
 			c.log.Check(err, "closing account")
@@ -664,7 +701,8 @@ func serve(listenerName string, cid int64, hostname dns.Domain, tlsConfig *tls.C
 	default:
 	}
 
-	if !limiterConnectionRate.Add(c.remoteIP, time.Now(), 1) {
+	// LMTP clients are trusted, and may deliver many messages, we don't rate limit them.
+	if !lmtp && !limiterConnectionRate.Add(c.remoteIP, time.Now(), 1) {
 		c.writecodeline(smtp.C421ServiceUnavail, smtp.SePol7Other0, "connection rate from your ip or network too high, slow down please", nil)
 		return
 	}
@@ -677,24 +715,44 @@ func serve(listenerName string, cid int64, hostname dns.Domain, tlsConfig *tls.C
 		return
 	}
 
-	if !limiterConnections.Add(c.remoteIP, time.Now(), 1) {
-		c.log.Debug("refusing connection due to many open connections", slog.Any("remoteip", c.remoteIP))
-		c.writecodeline(smtp.C421ServiceUnavail, smtp.SePol7Other0, "too many open connections from your ip or network", nil)
-		return
+	if !lmtp {
+		if !limiterConnections.Add(c.remoteIP, time.Now(), 1) {
+			c.log.Debug("refusing connection due to many open connections", slog.Any("remoteip", c.remoteIP))
+			c.writecodeline(smtp.C421ServiceUnavail, smtp.SePol7Other0, "too many open connections from your ip or network", nil)
+			return
+		}
+		defer limiterConnections.Add(c.remoteIP, time.Now(), -1)
 	}
-	defer limiterConnections.Add(c.remoteIP, time.Now(), -1)
 
 	// We register and unregister the original connection, in case c.conn is replaced
 	// with a TLS connection later on.
 	mox.Connections.Register(nc, "smtp", listenerName)
 	defer mox.Connections.Unregister(nc)
 
+	// Milters can reject a connection before the greeting.
+	if len(milters) > 0 {
+		if resp := c.milterStart(milters); resp.Action != milter.ActionContinue {
+			code, secode, msg := milterReply(resp)
+			if code/100 == 5 {
+				code = smtp.C554TransactionFailed
+			} else {
+				code = smtp.C421ServiceUnavail
+			}
+			c.writecodeline(code, secode, msg, nil)
+			return
+		}
+	}
+
 	// ../rfc/5321:964 ../rfc/5321:4294 about announcing software and version
 	// Syntax: ../rfc/5321:2586
 	// We include the string ESMTP. https://cr.yp.to/smtp/greeting.html recommends it.
 	// Should not be too relevant nowadays, but does not hurt and default blackbox
 	// exporter SMTP health check expects it.
-	c.writelinef("%d %s ESMTP mox %s", smtp.C220ServiceReady, c.hostname.ASCII, moxvar.Version)
+	if lmtp {
+		c.writelinef("%d %s LMTP mox %s", smtp.C220ServiceReady, c.hostname.ASCII, moxvar.Version)
+	} else {
+		c.writelinef("%d %s ESMTP mox %s", smtp.C220ServiceReady, c.hostname.ASCII, moxvar.Version)
+	}
 
 	for {
 		command(c)
@@ -715,6 +773,7 @@ func serve(listenerName string, cid int64, hostname dns.Domain, tlsConfig *tls.C
 var commands = map[string]func(c *conn, p *parser){
 	"helo":     (*conn).cmdHelo,
 	"ehlo":     (*conn).cmdEhlo,
+	"lhlo":     (*conn).cmdLhlo,
 	"starttls": (*conn).cmdStarttls,
 	"auth":     (*conn).cmdAuth,
 	"mail":     (*conn).cmdMail,
@@ -802,6 +861,8 @@ func command(c *conn) {
 func (c *conn) kind() string {
 	if c.submission {
 		return "submission"
+	} else if c.lmtp {
+		return "lmtp"
 	}
 	return "smtp"
 }
@@ -829,13 +890,30 @@ func isTLSReportRecipient(rcpt smtp.Path) bool {
 }
 
 func (c *conn) cmdHelo(p *parser) {
+	c.xneedNotLMTP()
 	c.cmdHello(p, false)
 }
 
 func (c *conn) cmdEhlo(p *parser) {
+	c.xneedNotLMTP()
+	c.cmdHello(p, true)
+}
+
+// LHLO replaces HELO and EHLO for LMTP, and behaves like EHLO. ../rfc/2033:134
+func (c *conn) cmdLhlo(p *parser) {
+	if !c.lmtp {
+		xsmtpUserErrorf(smtp.C500BadSyntax, smtp.SeProto5BadCmdOrSeq1, "unknown command")
+	}
 	c.cmdHello(p, true)
 }
 
+// ../rfc/2033:138
+func (c *conn) xneedNotLMTP() {
+	if c.lmtp {
+		xsmtpUserErrorf(smtp.C500BadSyntax, smtp.SeProto5BadCmdOrSeq1, "use LHLO for lmtp")
+	}
+}
+
 // ../rfc/5321:1783
 func (c *conn) cmdHello(p *parser, ehlo bool) {
 	var remote dns.IPDomain
@@ -874,6 +952,10 @@ func (c *conn) cmdHello(p *parser, ehlo bool) {
 	// Reset state as if RSET command has been issued. ../rfc/5321:2093 ../rfc/5321:2453
 	c.rset()
 
+	c.xmilterCheck("helo", func(mc *milter.Client) (milter.Response, error) {
+		return mc.Helo(remote.String())
+	})
+
 	c.ehlo = ehlo
 	c.hello = remote
 
@@ -899,7 +981,14 @@ func (c *conn) cmdHello(p *parser, ehlo bool) {
 			// authentication. The client should select the bare variant when TLS isn't
 			// present, and also not indicate the server supports the PLUS variant in that
 			// case, or it would trigger the mechanism downgrade detection.
-			c.bwritelinef("250-AUTH SCRAM-SHA-256-PLUS SCRAM-SHA-256 SCRAM-SHA-1-PLUS SCRAM-SHA-1 CRAM-MD5 PLAIN LOGIN")
+			mechs := "PLAIN LOGIN"
+			if store.PasswordHashMechanisms() {
+				mechs = "SCRAM-SHA-256-PLUS SCRAM-SHA-256 SCRAM-SHA-1-PLUS SCRAM-SHA-1 CRAM-MD5 " + mechs
+			}
+			if mox.Conf.Static.OIDC != nil {
+				mechs += " OAUTHBEARER XOAUTH2"
+			}
+			c.bwritelinef("250-AUTH %s", mechs)
 		} else {
 			c.bwritelinef("250-AUTH ")
 		}
@@ -1095,7 +1184,7 @@ func (c *conn) cmdAuth(p *parser) {
 			xsmtpUserErrorf(smtp.C535AuthBadCreds, smtp.SePol7AuthBadCreds8, "cannot assume other role")
 		}
 
-		acc, err := store.OpenEmailAuth(c.log, authc, password)
+		acc, err := store.OpenEmailAuth(c.log, authc, password, store.AppProtocolSubmission)
 		if err != nil && errors.Is(err, store.ErrUnknownCredentials) {
 			// ../rfc/4954:274
 			authResult = "badcreds"
@@ -1141,7 +1230,7 @@ func (c *conn) cmdAuth(p *parser) {
 		password := string(xreadContinuation())
 		c.xtrace(mlog.LevelTrace) // Restore.
 
-		acc, err := store.OpenEmailAuth(c.log, username, password)
+		acc, err := store.OpenEmailAuth(c.log, username, password, store.AppProtocolSubmission)
 		if err != nil && errors.Is(err, store.ErrUnknownCredentials) {
 			// ../rfc/4954:274
 			authResult = "badcreds"
@@ -1159,6 +1248,9 @@ func (c *conn) cmdAuth(p *parser) {
 		c.writecodeline(smtp.C235AuthSuccess, smtp.SePol7Other0, "hello ancient smtp implementation", nil)
 
 	case "CRAM-MD5":
+		if !store.PasswordHashMechanisms() {
+			xsmtpUserErrorf(smtp.C504ParamNotImpl, smtp.SeProto5BadParams4, "mechanism %s not supported", mech)
+		}
 		authVariant = strings.ToLower(mech)
 
 		p.xempty()
@@ -1232,6 +1324,9 @@ func (c *conn) cmdAuth(p *parser) {
 		c.writecodeline(smtp.C235AuthSuccess, smtp.SePol7Other0, "nice", nil)
 
 	case "SCRAM-SHA-256-PLUS", "SCRAM-SHA-256", "SCRAM-SHA-1-PLUS", "SCRAM-SHA-1":
+		if !store.PasswordHashMechanisms() {
+			xsmtpUserErrorf(smtp.C504ParamNotImpl, smtp.SeProto5BadParams4, "mechanism %s not supported", mech)
+		}
 		// todo: improve handling of errors during scram. e.g. invalid parameters. should we abort the imap command, or continue until the end and respond with a scram-level error?
 		// todo: use single implementation between ../imapserver/server.go and ../smtpserver/server.go
 
@@ -1338,6 +1433,62 @@ func (c *conn) cmdAuth(p *parser) {
 		// ../rfc/4954:276
 		c.writecodeline(smtp.C235AuthSuccess, smtp.SePol7Other0, "nice", nil)
 
+	case "OAUTHBEARER", "XOAUTH2":
+		oidcConf := mox.Conf.Static.OIDC
+		if oidcConf == nil {
+			xsmtpUserErrorf(smtp.C504ParamNotImpl, smtp.SeProto5BadParams4, "mechanism %s not supported", mech)
+		}
+		authVariant = strings.ToLower(mech)
+
+		// ../rfc/4954:343
+		if !c.tls && c.requireTLSForAuth {
+			xsmtpUserErrorf(smtp.C538EncReqForAuth, smtp.SePol7EncReqForAuth11, "authentication requires tls")
+		}
+
+		// Bearer tokens are credentials, so hide them.
+		defer c.xtrace(mlog.LevelTraceauth)()
+		buf := xreadInitial()
+		c.xtrace(mlog.LevelTrace) // Restore.
+		var authz, token string
+		var err error
+		if authVariant == "oauthbearer" {
+			authz, token, err = oidc.ParseOAUTHBEARER(buf)
+		} else {
+			authz, token, err = oidc.ParseXOAUTH2(buf)
+		}
+		if err != nil {
+			xsmtpUserErrorf(smtp.C501BadParamSyntax, smtp.SeProto5Syntax2, "%s", err)
+		}
+		authz = norm.NFC.String(authz)
+
+		acc, username, err := store.OpenEmailToken(context.TODO(), c.log, authz, token)
+		if err != nil && errors.Is(err, store.ErrUnknownCredentials) {
+			authResult = "badcreds"
+			c.log.Infox("failed authentication attempt", err, slog.String("username", authz), slog.Any("remote", c.remoteIP))
+			// The error is sent as challenge. The client responds, and only then we fail.
+			// ../rfc/7628
+			var chal []byte
+			if authVariant == "oauthbearer" {
+				chal = oidc.ErrorOAUTHBEARER(oidcConf.Issuer)
+			} else {
+				chal = oidc.ErrorXOAUTH2()
+			}
+			c.writelinef("%d %s", smtp.C334ContinueAuth, base64.StdEncoding.EncodeToString(chal))
+			xreadContinuation()
+			xsmtpUserErrorf(smtp.C535AuthBadCreds, smtp.SePol7AuthBadCreds8, "bad credentials")
+		} else if err != nil {
+			c.log.Errorx("verifying bearer token", err)
+			xsmtpUserErrorf(smtp.C454TempAuthFail, smtp.SeSys3Other0, "cannot verify token at this time")
+		}
+
+		authResult = "ok"
+		c.authFailed = 0
+		c.setSlow(false)
+		c.account = acc
+		c.username = username
+		// ../rfc/4954:276
+		c.writecodeline(smtp.C235AuthSuccess, smtp.SePol7Other0, "nice", nil)
+
 	default:
 		// ../rfc/4954:176
 		xsmtpUserErrorf(smtp.C504ParamNotImpl, smtp.SeProto5BadParams4, "mechanism %s not supported", mech)
@@ -1502,7 +1653,7 @@ func (c *conn) cmdMail(p *parser) {
 		return err == nil && accName == c.account.Name
 	}
 
-	if !c.submission && !rpath.IPDomain.Domain.IsZero() {
+	if !c.submission && !c.lmtp && !rpath.IPDomain.Domain.IsZero() {
 		// If rpath domain has null MX record or is otherwise not accepting email, reject.
 		// ../rfc/7505:181
 		// ../rfc/5321:4045
@@ -1533,6 +1684,13 @@ func (c *conn) cmdMail(p *parser) {
 		c.xlocalserveError(rpath.Localpart)
 	}
 
+	if len(c.milters) > 0 {
+		c.milterMessage = true
+		c.xmilterCheck("mail", func(mc *milter.Client) (milter.Response, error) {
+			return mc.Mail(rpath.String())
+		})
+	}
+
 	c.mailFrom = &rpath
 
 	c.bwritecodeline(smtp.C250Completed, smtp.SeAddr1Other0, "looking good", nil)
@@ -1587,7 +1745,7 @@ func (c *conn) cmdRcpt(p *parser) {
 	// We don't want to allow delivery to multiple recipients with a null reverse path.
 	// Why would anyone send like that? Null reverse path is intended for delivery
 	// notifications, they should go to a single recipient.
-	if !c.submission && len(c.recipients) > 0 && c.mailFrom.IsZero() {
+	if !c.submission && !c.lmtp && len(c.recipients) > 0 && c.mailFrom.IsZero() {
 		xsmtpUserErrorf(smtp.C452StorageFull, smtp.SeProto5TooManyRcpts3, "only one recipient allowed with null reverse address")
 	}
 
@@ -1600,7 +1758,7 @@ func (c *conn) cmdRcpt(p *parser) {
 	// ../rfc/5321:3598
 	// ../rfc/5321:4045
 	// Also see ../rfc/7489:2214
-	if !c.submission && len(c.recipients) == 1 && !Localserve {
+	if !c.submission && !c.lmtp && len(c.recipients) == 1 && !Localserve {
 		// note: because of check above, mailFrom cannot be the null address.
 		var pass bool
 		d := c.mailFrom.IPDomain.Domain
@@ -1633,17 +1791,35 @@ func (c *conn) cmdRcpt(p *parser) {
 		c.xlocalserveError(fpath.Localpart)
 	}
 
+	// A milter reject or tempfail only fails this recipient.
+	c.xmilterCheck("rcpt", func(mc *milter.Client) (milter.Response, error) {
+		rcptTo := fpath.String()
+		if fpath.IPDomain.IsZero() {
+			rcptTo = fpath.Localpart.String()
+		}
+		return mc.Rcpt(rcptTo)
+	})
+
 	if len(fpath.IPDomain.IP) > 0 {
 		if !c.submission {
 			xsmtpUserErrorf(smtp.C550MailboxUnavail, smtp.SeAddr1UnknownDestMailbox1, "not accepting email for ip")
 		}
-		c.recipients = append(c.recipients, recipient{fpath, nil, nil})
+		c.recipients = append(c.recipients, recipient{fpath, nil, nil, nil})
+	} else if alias, cmd, param, ok := mox.LookupListAddress(fpath.Localpart, fpath.IPDomain.Domain); ok && !c.submission {
+		// Messages for the list owner are delivered like messages to the owner address,
+		// other list commands are handled after receiving the message.
+		if cmd == mox.ListOwner {
+			owner := alias.ParsedListOwner
+			c.recipients = append(c.recipients, recipient{fpath, &rcptAccount{owner.AccountName, owner.Destination, owner.Address.String()}, nil, nil})
+		} else {
+			c.recipients = append(c.recipients, recipient{fpath, nil, nil, &rcptList{*alias, cmd, param}})
+		}
 	} else if accountName, alias, canonical, addr, err := mox.LookupAddress(fpath.Localpart, fpath.IPDomain.Domain, true, true); err == nil {
 		// note: a bare postmaster, without domain, is handled by LookupAddress. ../rfc/5321:735
 		if alias != nil {
-			c.recipients = append(c.recipients, recipient{fpath, nil, &rcptAlias{*alias, canonical}})
+			c.recipients = append(c.recipients, recipient{fpath, nil, &rcptAlias{*alias, canonical}, nil})
 		} else {
-			c.recipients = append(c.recipients, recipient{fpath, &rcptAccount{accountName, addr, canonical}, nil})
+			c.recipients = append(c.recipients, recipient{fpath, &rcptAccount{accountName, addr, canonical}, nil, nil})
 		}
 
 	} else if Localserve {
@@ -1653,23 +1829,24 @@ func (c *conn) cmdRcpt(p *parser) {
 		// which is typically the mox user.
 		acc, _ := mox.Conf.Account("mox")
 		dest := acc.Destinations["mox@localhost"]
-		c.recipients = append(c.recipients, recipient{fpath, &rcptAccount{"mox", dest, "mox@localhost"}, nil})
+		c.recipients = append(c.recipients, recipient{fpath, &rcptAccount{"mox", dest, "mox@localhost"}, nil, nil})
 	} else if errors.Is(err, mox.ErrDomainNotFound) {
 		if !c.submission {
 			xsmtpUserErrorf(smtp.C550MailboxUnavail, smtp.SeAddr1UnknownDestMailbox1, "not accepting email for domain")
 		}
 		// We'll be delivering this email.
-		c.recipients = append(c.recipients, recipient{fpath, nil, nil})
+		c.recipients = append(c.recipients, recipient{fpath, nil, nil, nil})
 	} else if errors.Is(err, mox.ErrAddressNotFound) {
-		if c.submission {
-			// For submission, we're transparent about which user exists. Should be fine for the typical small-scale deploy.
+		if c.submission || c.lmtp {
+			// For submission, we're transparent about which user exists. Should be fine for
+			// the typical small-scale deploy. LMTP clients are trusted.
 			// ../rfc/5321:1071
 			xsmtpUserErrorf(smtp.C550MailboxUnavail, smtp.SeAddr1UnknownDestMailbox1, "no such user")
 		}
 		// We pretend to accept. We don't want to let remote know the user does not exist
 		// until after DATA. Because then remote has committed to sending a message.
 		// note: not local for !c.submission is the signal this address is in error.
-		c.recipients = append(c.recipients, recipient{fpath, nil, nil})
+		c.recipients = append(c.recipients, recipient{fpath, nil, nil, nil})
 	} else {
 		c.log.Errorx("looking up account for delivery", err, slog.Any("rcptto", fpath))
 		xsmtpServerErrorf(codes{smtp.C451LocalErr, smtp.SeSys3Other0}, "error processing")
@@ -1851,6 +2028,14 @@ func (c *conn) cmdData(p *parser) {
 		// Hide internal hosts.
 		// todo future: make this a config option, where admins specify ip ranges that they don't want exposed. also see ../rfc/5321:4321
 		recvFrom = message.HeaderCommentDomain(mox.Conf.Static.HostnameDomain, c.msgsmtputf8)
+	} else if c.lmtp {
+		// The LMTP client is trusted, we don't do iprev checks.
+		if len(c.hello.IP) > 0 {
+			recvFrom = smtp.AddressLiteral(c.hello.IP)
+		} else {
+			recvFrom = c.hello.Domain.XName(c.msgsmtputf8)
+		}
+		recvFrom += " (" + smtp.AddressLiteral(c.remoteIP) + ")"
 	} else {
 		if len(c.hello.IP) > 0 {
 			recvFrom = smtp.AddressLiteral(c.hello.IP)
@@ -1893,7 +2078,12 @@ func (c *conn) cmdData(p *parser) {
 
 	// ../rfc/3848:34 ../rfc/6531:791
 	with := "SMTP"
-	if c.msgsmtputf8 {
+	if c.lmtp {
+		with = "LMTP"
+		if c.msgsmtputf8 {
+			with = "UTF8LMTP"
+		}
+	} else if c.msgsmtputf8 {
 		with = "UTF8SMTP"
 	} else if c.ehlo {
 		with = "ESMTP"
@@ -1937,8 +2127,27 @@ func (c *conn) cmdData(p *parser) {
 	// Submission is easiest because user is trusted. Far fewer checks to make. So
 	// handle it first, and leave the rest of the function for handling wild west
 	// internet traffic.
+	// Pass the message through the milters, which can reject it, or request
+	// discarding, quarantining or header changes.
+	if len(c.milters) > 0 {
+		if f, w := c.xmilterMessage(dataFile); f != nil {
+			defer store.CloseRemoveTempFile(c.log, f, "smtpserver message with milter changes")
+			dataFile, msgWriter = f, w
+		}
+		if c.milterDiscard {
+			c.log.Info("discarding message as requested by milter")
+			c.transactionGood++
+			c.transactionBad--
+			c.rset()
+			c.writecodeline(smtp.C250Completed, smtp.SeMailbox2Other0, "it is done", nil)
+			return
+		}
+	}
+
 	if c.submission {
 		c.submit(cmdctx, recvHdrFor, msgWriter, dataFile, part)
+	} else if c.lmtp {
+		c.lmtpDeliver(cmdctx, recvHdrFor, msgWriter, dataFile)
 	} else {
 		c.deliver(cmdctx, recvHdrFor, msgWriter, iprevStatus, iprevAuthentic, dataFile)
 	}
@@ -2347,6 +2556,27 @@ func (c *conn) deliver(ctx context.Context, recvHdrFor func(string) string, msgW
 		dkimcancel()
 	}()
 
+	// ARC, for messages passing through intermediaries, such as forwarders and mailing
+	// lists.
+	wg.Add(1)
+	var arcResult arc.Result
+	var arcErr error
+	go func() {
+		defer func() {
+			x := recover() // Should not happen, but don't take program down if it does.
+			if x != nil {
+				c.log.Error("arc verify panic", slog.Any("err", x))
+				debug.PrintStack()
+				metrics.PanicInc(metrics.Arcverify)
+			}
+		}()
+		defer wg.Done()
+		arcctx, arccancel := context.WithTimeout(ctx, time.Minute)
+		defer arccancel()
+		arcResult, arcErr = arc.Verify(arcctx, c.log.Logger, c.resolver, dataFile)
+		arccancel()
+	}()
+
 	// SPF.
 	// ../rfc/7208:472
 	var receivedSPF spf.Received
@@ -2392,7 +2622,7 @@ func (c *conn) deliver(ctx context.Context, recvHdrFor func(string) string, msgW
 		}
 	}()
 
-	// Wait for DKIM and SPF validation to finish.
+	// Wait for DKIM, ARC and SPF validation to finish.
 	wg.Wait()
 
 	// Give immediate response if all recipients are unknown.
@@ -2543,6 +2773,33 @@ func (c *conn) deliver(ctx context.Context, recvHdrFor func(string) string, msgW
 		receivedSPF.Result = spf.StatusNone
 	}
 
+	// Add ARC result to Authentication-Results header. ../rfc/8617:1105
+	if arcErr != nil {
+		c.log.Infox("arc verify", arcErr)
+		arcResult = arc.Result{Status: arc.StatusFail, Err: arcErr}
+	}
+	arcMethod := message.AuthMethod{
+		Method: "arc",
+		Result: string(arcResult.Status),
+	}
+	if arcResult.Status == arc.StatusPass {
+		n := len(arcResult.Sets)
+		sealer := arcResult.Sets[n-1].Seal.Domain
+		arcMethod.Comment = fmt.Sprintf("i=%d, sealed by %s", n, sealer.XName(c.msgsmtputf8))
+		arcMethod.Props = []message.AuthProp{
+			message.MakeAuthProp("header", "oldest-pass", fmt.Sprintf("%d", arcResult.OldestPass), false, ""),
+			message.MakeAuthProp("smtp", "remote-ip", c.remoteIP.String(), false, ""),
+		}
+	} else if arcResult.Err != nil {
+		arcMethod.Reason = arcResult.Err.Error()
+	}
+	authResults.Methods = append(authResults.Methods, arcMethod)
+	var arcSealDomains []string
+	for _, d := range arcResult.Sealers() {
+		arcSealDomains = append(arcSealDomains, d.Name())
+	}
+	c.log.Debugx("arc verification result", arcResult.Err, slog.Any("status", arcResult.Status), slog.Any("sealers", arcSealDomains))
+
 	// DMARC
 	var dmarcUse bool
 	var dmarcResult dmarc.Result
@@ -2711,6 +2968,8 @@ func (c *conn) deliver(ctx context.Context, recvHdrFor func(string) string, msgW
 			MailFromValidation: mailFromValidation,
 			MsgFromValidation:  msgFromValidation,
 			DKIMDomains:        verifiedDKIMDomains,
+			ARCResult:          string(arcResult.Status),
+			ARCSealDomains:     arcSealDomains,
 			DSN:                isDSN,
 			Size:               msgWriter.Size,
 		}
@@ -2730,7 +2989,15 @@ func (c *conn) deliver(ctx context.Context, recvHdrFor func(string) string, msgW
 			msgTo = envelope.To
 			msgCc = envelope.CC
 		}
-		d := delivery{c.tls, &m, dataFile, smtpRcptTo, deliverTo, destination, canonicalAddr, acc, msgTo, msgCc, msgFrom, c.dnsBLs, dmarcUse, dmarcResult, dkimResults, iprevStatus}
+		// If the account has an active Sieve script, it determines delivery.
+		sieveResult, err := acc.SieveEval(log, &m, dataFile)
+		if err != nil {
+			log.Errorx("evaluating sieve script", err)
+			metricDelivery.WithLabelValues("sieveerror", "").Inc()
+			return nil, err
+		}
+
+		d := delivery{c.tls, &m, dataFile, smtpRcptTo, deliverTo, destination, canonicalAddr, acc, msgTo, msgCc, msgFrom, c.dnsBLs, dmarcUse, dmarcResult, dkimResults, arcResult, iprevStatus, sieveResult}
 
 		r := analyze(ctx, log, c.resolver, d)
 		return &r, nil
@@ -2751,6 +3018,24 @@ func (c *conn) deliver(ctx context.Context, recvHdrFor func(string) string, msgW
 		// deliveries, and return an error at the end? Though the failure conditions will
 		// probably prevent any other successful deliveries too...
 		// We'll continue delivering to other recipients. ../rfc/5321:3275
+		if rcpt.list != nil {
+			// Requests by email must come from a verified address, we don't want to send
+			// confirmation requests to forged addresses. Bounces and confirmations (with
+			// secret token) don't need verification.
+			switch rcpt.list.cmd {
+			case mox.ListBounces, mox.ListConfirm:
+			default:
+				if msgFromValidation != store.ValidationStrict && msgFromValidation != store.ValidationDMARC && msgFromValidation != store.ValidationRelaxed {
+					addError(rcpt, smtp.C550MailboxUnavail, smtp.SePol7DeliveryUnauth1, true, "message from address must be verified for list requests")
+					return
+				}
+			}
+			if err := queue.ListIncoming(ctx, log, rcpt.list.alias, rcpt.list.cmd, rcpt.list.param, msgFrom, &part, dataFile); err != nil {
+				log.Errorx("processing list command", err, slog.String("listcommand", string(rcpt.list.cmd)))
+				addError(rcpt, smtp.C451LocalErr, smtp.SeSys3Other0, false, "error processing")
+			}
+			return
+		}
 		if rcpt.account == nil && rcpt.alias == nil {
 			metricDelivery.WithLabelValues("unknownuser", "").Inc()
 			addError(rcpt, smtp.C550MailboxUnavail, smtp.SeAddr1UnknownDestMailbox1, true, "no such user")
@@ -2771,17 +3056,29 @@ func (c *conn) deliver(ctx context.Context, recvHdrFor func(string) string, msgW
 		// any recipient accepts it. Regular destination have just a single account to
 		// check. We check all alias destinations, even if we already explicitly delivered
 		// to them: they may be the only destination that would accept the message.
-		var a0 *analysis // Analysis we've used for accept/reject decision.
+		var a0 *analysis         // Analysis we've used for accept/reject decision.
+		var listHold bool        // Whether message is for list and must be held for moderation.
+		var listAnalyzeOnly bool // Whether la is only for analysis, for lists without local members.
 		if rcpt.alias != nil {
+			alias := rcpt.alias.alias
+
 			// Check if msgFrom address is acceptable. This doesn't take validation into
 			// consideration. If the header was forged, the message may be rejected later on.
-			if !aliasAllowedMsgFrom(rcpt.alias.alias, msgFrom) {
-				addError(rcpt, smtp.C550MailboxUnavail, smtp.SePol7ExpnProhibited2, true, "not allowed to send to destination")
-				return
+			// For moderated lists, messages from non-members are held after analysis.
+			if !aliasAllowedMsgFrom(ctx, log, alias, msgFrom) {
+				if !alias.Moderate {
+					addError(rcpt, smtp.C550MailboxUnavail, smtp.SePol7ExpnProhibited2, true, "not allowed to send to destination")
+					return
+				}
+				listHold = true
 			}
 
-			la = make([]analysis, 0, len(rcpt.alias.alias.ParsedAddresses))
-			for _, aa := range rcpt.alias.alias.ParsedAddresses {
+			la = make([]analysis, 0, len(alias.ParsedAddresses))
+			for _, aa := range alias.ParsedAddresses {
+				if aa.AccountName == "" {
+					// External member, message is added to the queue below.
+					continue
+				}
 				a, err := messageAnalyze(log, rcpt.addr, aa.Address.Path(), aa.AccountName, aa.Destination, rcpt.alias.canonicalAddress)
 				if err != nil {
 					addError(rcpt, smtp.C451LocalErr, smtp.SeSys3Other0, false, "error processing")
@@ -2793,6 +3090,18 @@ func (c *conn) deliver(ctx context.Context, recvHdrFor func(string) string, msgW
 					a0 = &la[len(la)-1]
 				}
 			}
+			if len(la) == 0 {
+				// List without local members. We analyze against the account of the list owner,
+				// but won't deliver to it.
+				owner := alias.ParsedListOwner
+				a, err := messageAnalyze(log, rcpt.addr, owner.Address.Path(), owner.AccountName, owner.Destination, rcpt.alias.canonicalAddress)
+				if err != nil {
+					addError(rcpt, smtp.C451LocalErr, smtp.SeSys3Other0, false, "error processing")
+					return
+				}
+				la = append(la, *a)
+				listAnalyzeOnly = true
+			}
 			if a0 == nil {
 				// First address, for rejecting.
 				a0 = &la[0]
@@ -2814,6 +3123,12 @@ func (c *conn) deliver(ctx context.Context, recvHdrFor func(string) string, msgW
 			addError(rcpt, a0.code, a0.secode, a0.userError, a0.errmsg)
 			return
 		}
+		if !a0.accept && a0.reason == reasonSieveReject {
+			log.Info("incoming message rejected by sieve script", slog.Any("msgfrom", msgFrom))
+			metricDelivery.WithLabelValues("reject", a0.reason).Inc()
+			addError(rcpt, a0.code, a0.secode, a0.userError, a0.errmsg)
+			return
+		}
 
 		// Any DMARC result override is stored in the evaluation for outgoing DMARC
 		// aggregate reports, and added to the Authentication-Results message header.
@@ -3110,15 +3425,44 @@ func (c *conn) deliver(ctx context.Context, recvHdrFor func(string) string, msgW
 		var nfull int      // Number of failed deliveries due to over quota.
 		var ndelivered int // Number delivered to account.
 		for _, a := range la {
+			// Messages held for moderation are only delivered after approval.
+			if listHold || listAnalyzeOnly {
+				break
+			}
+
 			// Don't deliver to recipient that was explicitly present in SMTP transaction, or
 			// is sending the message to an alias they are member of.
 			if rcpt.alias != nil && (regularRecipient(a.d.deliverTo) || a.d.deliverTo.Equal(msgFrom.Path())) {
 				continue
 			}
 
+			// Alias member that rejects the message through its Sieve script.
+			if a.d.sieveResult != nil && a.d.sieveResult.Reject != nil {
+				continue
+			}
+
+			// A milter can request quarantine, delivering to the Junk mailbox, ignoring
+			// Sieve.
+			mailbox := a.mailbox
+			if c.milterQuarantine {
+				mailbox = junkMailbox(ctx, log, a.d.acc)
+			}
+
 			var delivered bool
+			var stored bool // Whether message was stored in a mailbox, false for a Sieve discard.
 			a.d.acc.WithWLock(func() {
-				if err := a.d.acc.DeliverMailbox(log, a.mailbox, a.d.m, dataFile); err != nil {
+				var err error
+				if a.d.sieveResult != nil && !c.milterQuarantine {
+					keepMailbox := a.d.destination.Mailbox
+					if keepMailbox == "" {
+						keepMailbox = "Inbox"
+					}
+					stored, err = a.d.acc.DeliverSieve(log, keepMailbox, a.d.sieveResult, a.d.m, dataFile)
+				} else {
+					err = a.d.acc.DeliverMailbox(log, mailbox, a.d.m, dataFile)
+					stored = err == nil
+				}
+				if err != nil {
 					log.Errorx("delivering", err)
 					metricDelivery.WithLabelValues("delivererror", a0.reason).Inc()
 					if errors.Is(err, store.ErrOverQuota) {
@@ -3132,24 +3476,35 @@ func (c *conn) deliver(ctx context.Context, recvHdrFor func(string) string, msgW
 				delivered = true
 				ndelivered++
 				metricDelivery.WithLabelValues("delivered", a0.reason).Inc()
-				log.Info("incoming message delivered", slog.String("reason", a0.reason), slog.Any("msgfrom", msgFrom))
+				log.Info("incoming message delivered", slog.String("reason", a0.reason), slog.Any("msgfrom", msgFrom), slog.String("mailbox", mailbox))
 
 				conf, _ := a.d.acc.Conf()
-				if conf.RejectsMailbox != "" && a.d.m.MessageID != "" {
+				if stored && conf.RejectsMailbox != "" && a.d.m.MessageID != "" {
 					if err := a.d.acc.RejectsRemove(log, conf.RejectsMailbox, a.d.m.MessageID); err != nil {
 						log.Errorx("removing message from rejects mailbox", err, slog.String("messageid", messageID))
 					}
 				}
 			})
 
+			// Queue redirects and vacation responses from the Sieve script.
+			if delivered && a.d.sieveResult != nil && !c.milterQuarantine {
+				err := queue.SieveActions(context.Background(), log, a.d.acc, a.d.deliverTo, a.d.m, dataFile, a.d.sieveResult)
+				log.Check(err, "performing sieve actions for incoming delivery")
+			}
+
+			// Automatic response if the account has vacation settings active.
+			if stored && !c.milterQuarantine {
+				vacationReply(log, a.d.acc, a.d.deliverTo, a.d.m, dataFile, a.d.sieveResult)
+			}
+
 			// Pass delivered messages to queue for DSN processing and/or hooks.
-			if delivered {
+			if stored {
 				mr := store.FileMsgReader(a.d.m.MsgPrefix, dataFile)
 				part, err := a.d.m.LoadPart(mr)
 				if err != nil {
 					log.Errorx("loading parsed part for evaluating webhook", err)
 				} else {
-					err = queue.Incoming(context.Background(), log, a.d.acc, messageID, *a.d.m, part, a.mailbox)
+					err = queue.Incoming(context.Background(), log, a.d.acc, messageID, *a.d.m, part, mailbox)
 					log.Check(err, "queueing webhook for incoming delivery")
 				}
 			} else if nerr > 0 && ndelivered == 0 {
@@ -3158,6 +3513,42 @@ func (c *conn) deliver(ctx context.Context, recvHdrFor func(string) string, msgW
 				break
 			}
 		}
+
+		// For mailing lists, hold the message for moderation, or queue it for members
+		// not delivered to above.
+		if rcpt.alias != nil && rcpt.alias.alias.ListOwner != "" && !c.milterQuarantine && (nerr == 0 || ndelivered > 0) {
+			lm := queue.ListMessage{
+				MailFrom:  c.mailFrom.String(),
+				MsgFrom:   msgFrom,
+				Has8bit:   msgWriter.Has8bit,
+				SMTPUTF8:  c.msgsmtputf8,
+				MessageID: messageID,
+				Size:      msgWriter.Size,
+			}
+			if envelope != nil {
+				lm.Subject = envelope.Subject
+			}
+			var err error
+			if listHold {
+				err = queue.ListHold(ctx, log, rcpt.alias.alias, lm, dataFile)
+			} else {
+				var skip []smtp.Address
+				for _, r := range c.recipients {
+					if r.account != nil {
+						skip = append(skip, smtp.NewAddress(r.addr.Localpart, r.addr.IPDomain.Domain))
+					}
+				}
+				err = queue.ListDeliver(ctx, log, rcpt.alias.alias, lm, dataFile, skip)
+			}
+			if err != nil {
+				log.Errorx("processing message for mailing list", err)
+				if ndelivered == 0 {
+					addError(rcpt, smtp.C451LocalErr, smtp.SeSys3Other0, false, "error processing")
+					return
+				}
+			}
+		}
+
 		if ndelivered == 0 && (nerr > 0 || nfull > 0) {
 			if nerr == 0 {
 				addError(rcpt, smtp.C452StorageFull, smtp.SeMailbox2Full2, true, "account storage full")
@@ -3263,13 +3654,39 @@ func (c *conn) deliver(ctx context.Context, recvHdrFor func(string) string, msgW
 	c.writecodeline(smtp.C250Completed, smtp.SeMailbox2Other0, "it is done", nil)
 }
 
-// Return whether msgFrom address is allowed to send a message to alias.
-func aliasAllowedMsgFrom(alias config.Alias, msgFrom smtp.Address) bool {
+// vacationReply queues an automatic response for message m delivered to acc, if
+// the account has vacation settings active and the message qualifies. Not done
+// when the Sieve script already handles vacation responses.
+func vacationReply(log mlog.Log, acc *store.Account, rcptTo smtp.Path, m *store.Message, msgFile *os.File, sieveResult *sieve.Result) {
+	if sieveResult != nil && sieveResult.Vacation != nil {
+		return
+	}
+	v, err := acc.VacationEval(log, m, msgFile)
+	if err != nil {
+		log.Errorx("evaluating vacation settings", err)
+		return
+	} else if v == nil {
+		return
+	}
+	err = queue.VacationReply(context.Background(), log, acc, rcptTo, v)
+	log.Check(err, "sending vacation response")
+}
+
+// Return whether msgFrom address is allowed to send a message to alias. For
+// mailing lists, members that subscribed by email are allowed too.
+func aliasAllowedMsgFrom(ctx context.Context, log mlog.Log, alias config.Alias, msgFrom smtp.Address) bool {
 	for _, aa := range alias.ParsedAddresses {
 		if aa.Address == msgFrom {
 			return true
 		}
 	}
+	if alias.ListOwner != "" && !msgFrom.IsZero() {
+		if member, err := queue.ListIsMember(ctx, alias, msgFrom); err != nil {
+			log.Errorx("checking list membership", err)
+		} else if member {
+			return true
+		}
+	}
 	lp, err := smtp.ParseLocalpart(alias.LocalpartStr)
 	xcheckf(err, "parsing alias localpart")
 	if msgFrom == smtp.NewAddress(lp, alias.Domain) {
@@ -8,6 +8,7 @@ import (
 	"context"
 	"crypto/ed25519"
 	cryptorand "crypto/rand"
+	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
@@ -26,10 +27,12 @@ import (
 
 	"github.com/mjl-/bstore"
 
+	"github.com/mjl-/mox/arc"
 	"github.com/mjl-/mox/config"
 	"github.com/mjl-/mox/dkim"
 	"github.com/mjl-/mox/dmarcdb"
 	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/message"
 	"github.com/mjl-/mox/mlog"
 	"github.com/mjl-/mox/mox-"
 	"github.com/mjl-/mox/queue"
@@ -93,6 +96,8 @@ type testserver struct {
 	submission bool
 	requiretls bool
 	dnsbls     []dns.Domain
+	milters    []config.Milter
+	lmtp       bool
 	tlsmode    smtpclient.TLSMode
 	tlspkix    bool
 }
@@ -209,7 +214,7 @@ func (ts *testserver) runRaw(fn func(clientConn net.Conn)) {
 		tlsConfig := &tls.Config{
 			Certificates: []tls.Certificate{fakeCert(ts.t)},
 		}
-		serve("test", ts.cid-2, dns.Domain{ASCII: "mox.example"}, tlsConfig, serverConn, ts.resolver, ts.submission, false, 100<<20, false, false, ts.requiretls, ts.dnsbls, 0)
+		serve("test", ts.cid-2, dns.Domain{ASCII: "mox.example"}, tlsConfig, serverConn, ts.resolver, ts.submission, false, 100<<20, false, false, ts.requiretls, ts.dnsbls, 0, ts.milters, ts.lmtp)
 		close(serverdone)
 	}()
 
@@ -330,6 +335,36 @@ func TestSubmission(t *testing.T) {
 		testAuth(fn, "mo\u0301x@mox.example", password0, nil)
 		testAuth(fn, "mo\u0301x@mox.example", password1, nil)
 	}
+
+	// Bearer tokens from an identity provider, with its key in a local JWKS file.
+	oidcPub, oidcPriv, err := ed25519.GenerateKey(cryptorand.Reader)
+	tcheck(t, err, "generate key")
+	b64 := base64.RawURLEncoding.EncodeToString
+	jwksPath := filepath.Join(t.TempDir(), "jwks.json")
+	err = os.WriteFile(jwksPath, []byte(fmt.Sprintf(`{"keys": [{"kty": "OKP", "crv": "Ed25519", "x": %q}]}`, b64(oidcPub))), 0660)
+	tcheck(t, err, "write jwks")
+	token := func(email string) string {
+		claims := fmt.Sprintf(`{"iss": "https://id.mox.example", "aud": "mox", "email": %q, "email_verified": true, "exp": %d}`, email, time.Now().Add(time.Hour).Unix())
+		data := b64([]byte(`{"alg":"EdDSA"}`)) + "." + b64([]byte(claims))
+		return data + "." + b64(ed25519.Sign(oidcPriv, []byte(data)))
+	}
+	tokenfns := []func(user, pass string, cs *tls.ConnectionState) sasl.Client{
+		func(user, pass string, cs *tls.ConnectionState) sasl.Client {
+			return sasl.NewClientOAUTHBEARER(user, pass)
+		},
+		func(user, pass string, cs *tls.ConnectionState) sasl.Client { return sasl.NewClientXOAUTH2(user, pass) },
+	}
+	for _, fn := range tokenfns {
+		testAuth(fn, "mjl@mox.example", token("mjl@mox.example"), &smtpclient.Error{Code: smtp.C504ParamNotImpl, Secode: smtp.SeProto5BadParams4}) // Not configured.
+	}
+	mox.Conf.Static.OIDC = &config.OIDC{Issuer: "https://id.mox.example", Audience: "mox", JWKSFile: jwksPath}
+	defer func() { mox.Conf.Static.OIDC = nil }()
+	for _, fn := range tokenfns {
+		testAuth(fn, "mjl@mox.example", "bad", &smtpclient.Error{Code: smtp.C535AuthBadCreds, Secode: smtp.SePol7AuthBadCreds8})
+		testAuth(fn, "other@mox.example", token("mjl@mox.example"), &smtpclient.Error{Code: smtp.C535AuthBadCreds, Secode: smtp.SePol7AuthBadCreds8})
+		testAuth(fn, "mjl@mox.example", token("mjl@mox.example"), nil)
+		testAuth(fn, "móx@mox.example", token("mjl@mox.example"), nil)
+	}
 }
 
 // Test delivery from external MTA.
@@ -1249,7 +1284,7 @@ func TestNonSMTP(t *testing.T) {
 		tlsConfig := &tls.Config{
 			Certificates: []tls.Certificate{fakeCert(ts.t)},
 		}
-		serve("test", ts.cid-2, dns.Domain{ASCII: "mox.example"}, tlsConfig, serverConn, ts.resolver, ts.submission, false, 100<<20, false, false, false, ts.dnsbls, 0)
+		serve("test", ts.cid-2, dns.Domain{ASCII: "mox.example"}, tlsConfig, serverConn, ts.resolver, ts.submission, false, 100<<20, false, false, false, ts.dnsbls, 0, ts.milters, ts.lmtp)
 		close(serverdone)
 	}()
 
@@ -1947,3 +1982,241 @@ test email
 	})
 
 }
+
+// Test delivery with an active Sieve script.
+func TestSieve(t *testing.T) {
+	resolver := dns.MockResolver{
+		A: map[string][]string{
+			"example.org.": {"127.0.0.10"}, // For mx check.
+		},
+		PTR: map[string][]string{
+			"127.0.0.10": {"example.org."},
+		},
+	}
+	ts := newTestServer(t, filepath.FromSlash("../testdata/smtp/mox.conf"), resolver)
+	defer ts.close()
+
+	script := `require ["fileinto", "reject", "copy"];
+if header :contains "subject" "reject" {
+	reject "not wanted";
+} elsif header :contains "subject" "redirect" {
+	redirect :copy "other@example.org";
+} else {
+	fileinto "Sieved";
+}
+`
+	err := ts.acc.DB.Write(ctxbg, func(tx *bstore.Tx) error {
+		_, err := store.SieveScriptSave(tx, "test", script, true)
+		return err
+	})
+	tcheck(t, err, "save sieve script")
+
+	testDeliver := func(subject string, expErr *smtpclient.Error) {
+		t.Helper()
+		msg := strings.ReplaceAll(deliverMessage, "Subject: test", "Subject: "+subject)
+		ts.run(func(err error, client *smtpclient.Client) {
+			t.Helper()
+			mailFrom := "remote@example.org"
+			rcptTo := "mjl@mox.example"
+			if err == nil {
+				err = client.Deliver(ctxbg, mailFrom, rcptTo, int64(len(msg)), strings.NewReader(msg), false, false, false)
+			}
+			ts.smtpErr(err, expErr)
+		})
+	}
+
+	testDeliver("please reject", &smtpclient.Error{Permanent: true, Code: smtp.C550MailboxUnavail, Secode: smtp.SePol7DeliveryUnauth1})
+	ts.checkCount("Inbox", 0)
+
+	testDeliver("test", nil)
+	ts.checkCount("Sieved", 1)
+
+	testDeliver("please redirect", nil)
+	ts.checkCount("Inbox", 1)
+	msgs, err := queue.List(ctxbg, queue.Filter{}, queue.Sort{})
+	tcheck(t, err, "listing queue")
+	if len(msgs) != 1 || msgs[0].Recipient().XString(false) != "other@example.org" || msgs[0].Sender().XString(false) != "mjl@mox.example" {
+		t.Fatalf("unexpected queue after redirect: %#v", msgs)
+	}
+}
+
+// Test automatic responses with the vacation settings of an account.
+func TestVacation(t *testing.T) {
+	resolver := dns.MockResolver{
+		A: map[string][]string{
+			"example.org.": {"127.0.0.10"}, // For mx check.
+		},
+		PTR: map[string][]string{
+			"127.0.0.10": {"example.org."},
+		},
+	}
+	ts := newTestServer(t, filepath.FromSlash("../testdata/smtp/mox.conf"), resolver)
+	defer ts.close()
+
+	saveVacation := func(v store.Vacation) {
+		t.Helper()
+		err := ts.acc.DB.Write(ctxbg, func(tx *bstore.Tx) error {
+			return store.VacationSave(tx, v)
+		})
+		tcheck(t, err, "save vacation settings")
+	}
+
+	testDeliver := func(msg string, expQueued int) {
+		t.Helper()
+		ts.run(func(err error, client *smtpclient.Client) {
+			t.Helper()
+			mailFrom := "remote@example.org"
+			rcptTo := "mjl@mox.example"
+			if err == nil {
+				err = client.Deliver(ctxbg, mailFrom, rcptTo, int64(len(msg)), strings.NewReader(msg), false, false, false)
+			}
+			ts.smtpErr(err, nil)
+		})
+		n, err := queue.Count(ctxbg)
+		tcheck(t, err, "count queue")
+		tcompare(t, n, expQueued)
+	}
+
+	// Not enabled yet.
+	testDeliver(deliverMessage, 0)
+
+	// Not active yet.
+	saveVacation(store.Vacation{Enabled: true, Start: time.Now().Add(time.Hour), Body: "away"})
+	testDeliver(deliverMessage, 0)
+
+	saveVacation(store.Vacation{Enabled: true, Subject: "away", Body: "away\n"})
+	testDeliver(deliverMessage, 1)
+	msgs, err := queue.List(ctxbg, queue.Filter{}, queue.Sort{})
+	tcheck(t, err, "listing queue")
+	if len(msgs) != 1 || msgs[0].Recipient().XString(false) != "remote@example.org" || !msgs[0].Sender().IsZero() || msgs[0].Subject != "away" {
+		t.Fatalf("unexpected queue after vacation response: %#v", msgs)
+	}
+
+	// No second response within the interval.
+	testDeliver(deliverMessage2, 1)
+
+	// No responses to automated messages.
+	_, err = queue.Drop(ctxbg, pkglog, queue.Filter{})
+	tcheck(t, err, "drop messages from queue")
+	err = ts.acc.DB.Write(ctxbg, func(tx *bstore.Tx) error {
+		_, err := bstore.QueryTx[store.VacationReply](tx).Delete()
+		return err
+	})
+	tcheck(t, err, "remove vacation replies")
+	testDeliver(strings.Replace(deliverMessage, "Subject: test", "Auto-Submitted: auto-generated\r\nSubject: test", 1), 0)
+	testDeliver(strings.Replace(deliverMessage, "Subject: test", "Precedence: bulk\r\nSubject: test", 1), 0)
+	testDeliver(strings.Replace(deliverMessage, "Subject: test", "List-Id: <list.example.org>\r\nSubject: test", 1), 0)
+}
+
+// Test that a DMARC failure is overridden for a message with a valid ARC chain
+// sealed by a trusted intermediary, and that redirected messages are sealed.
+func TestARC(t *testing.T) {
+	resolver := dns.MockResolver{
+		A: map[string][]string{
+			"example.org.":     {"127.0.0.10"}, // For mx check.
+			"forward.example.": {"127.0.0.10"}, // For iprev check.
+		},
+		TXT: map[string][]string{
+			"example.org.":        {"v=spf1 ip4:127.0.0.1 -all"}, // Not our IP, so DMARC fails.
+			"_dmarc.example.org.": {"v=DMARC1;p=reject"},
+		},
+		PTR: map[string][]string{
+			"127.0.0.10": {"forward.example."},
+		},
+	}
+
+	// Key for both the forwarding mail server and our own ARC seals.
+	key, err := rsa.GenerateKey(cryptorand.Reader, 2048)
+	tcheck(t, err, "generate rsa key")
+	dkimr := dkim.Record{
+		Version:   "DKIM1",
+		Key:       "rsa",
+		PublicKey: key.Public(),
+	}
+	txt, err := dkimr.Record()
+	tcheck(t, err, "dkim record")
+	resolver.TXT["testsel._domainkey.forward.example."] = []string{txt}
+	resolver.TXT["testsel._domainkey.mox.example."] = []string{txt}
+
+	ts := newTestServer(t, filepath.FromSlash("../testdata/smtp/mox.conf"), resolver)
+	defer ts.close()
+
+	sel := dkim.Selector{
+		Hash:       "sha256",
+		PrivateKey: key,
+		Headers:    []string{"From", "To", "Subject", "Message-Id"},
+		Domain:     dns.Domain{ASCII: "testsel"},
+	}
+	ar := message.AuthResults{
+		Hostname: "forward.example",
+		Methods: []message.AuthMethod{
+			{Method: "dmarc", Result: "pass", Props: []message.AuthProp{message.MakeAuthProp("header", "from", "example.org", true, "")}},
+		},
+	}
+	arcHeaders, err := arc.Seal(ctxbg, pkglog.Logger, dns.Domain{ASCII: "forward.example"}, sel, ar, arc.StatusNone, strings.NewReader(deliverMessage))
+	tcheck(t, err, "arc seal")
+	msg := arcHeaders + deliverMessage
+
+	testDeliver := func(expErr *smtpclient.Error) {
+		t.Helper()
+		ts.run(func(err error, client *smtpclient.Client) {
+			t.Helper()
+			mailFrom := "remote@example.org"
+			rcptTo := "mjl@mox.example"
+			if err == nil {
+				err = client.Deliver(ctxbg, mailFrom, rcptTo, int64(len(msg)), strings.NewReader(msg), false, false, false)
+			}
+			ts.smtpErr(err, expErr)
+		})
+	}
+
+	// Without trusting the sealer, the DMARC policy rejects the message.
+	testDeliver(&smtpclient.Error{Permanent: true, Code: smtp.C550MailboxUnavail, Secode: smtp.SePol7MultiAuthFails26})
+
+	mox.Conf.Static.TrustedARCSealerDomains = []dns.Domain{{ASCII: "forward.example"}}
+	defer func() {
+		mox.Conf.Static.TrustedARCSealerDomains = nil
+	}()
+
+	// Redirect to check our own seal on the forwarded message.
+	dom, _ := mox.Conf.Domain(dns.Domain{ASCII: "mox.example"})
+	dom.DKIM = config.DKIM{
+		Selectors: map[string]config.Selector{
+			"testsel": {
+				HashEffective:    "sha256",
+				HeadersEffective: []string{"From", "To", "Subject", "Message-Id"},
+				Key:              key,
+				Domain:           dns.Domain{ASCII: "testsel"},
+			},
+		},
+		Sign: []string{"testsel"},
+	}
+	mox.Conf.Dynamic.Domains["mox.example"] = dom
+	err = ts.acc.DB.Write(ctxbg, func(tx *bstore.Tx) error {
+		_, err := store.SieveScriptSave(tx, "test", `require "copy"; redirect :copy "other@example.org";`, true)
+		return err
+	})
+	tcheck(t, err, "save sieve script")
+
+	testDeliver(nil)
+	ts.checkCount("Inbox", 1)
+
+	m, err := bstore.QueryDB[store.Message](ctxbg, ts.acc.DB).Get()
+	tcheck(t, err, "get message")
+	tcompare(t, m.ARCResult, "pass")
+	tcompare(t, m.ARCSealDomains, []string{"forward.example"})
+	if !strings.Contains(string(m.MsgPrefix), "arc=pass") || !strings.Contains(string(m.MsgPrefix), "override trusted_forwarder") {
+		t.Fatalf("missing arc result or dmarc override in message prefix: %q", m.MsgPrefix)
+	}
+
+	msgs, err := queue.List(ctxbg, queue.Filter{}, queue.Sort{})
+	tcheck(t, err, "listing queue")
+	tcompare(t, len(msgs), 1)
+	f, err := queue.OpenMessage(ctxbg, msgs[0].ID)
+	tcheck(t, err, "open message in queue")
+	defer f.Close()
+	result, err := arc.Verify(ctxbg, pkglog.Logger, resolver, f)
+	tcheck(t, err, "verify arc of redirected message")
+	tcompare(t, result.Status, arc.StatusPass)
+	tcompare(t, result.Sealers(), []dns.Domain{{ASCII: "mox.example"}, {ASCII: "forward.example"}})
+}
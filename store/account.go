@@ -52,13 +52,16 @@ import (
 
 	"github.com/mjl-/mox/config"
 	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/extauth"
 	"github.com/mjl-/mox/message"
 	"github.com/mjl-/mox/metrics"
 	"github.com/mjl-/mox/mlog"
 	"github.com/mjl-/mox/mox-"
 	"github.com/mjl-/mox/moxio"
+	"github.com/mjl-/mox/oidc"
 	"github.com/mjl-/mox/publicsuffix"
 	"github.com/mjl-/mox/scram"
+	"github.com/mjl-/mox/sieve"
 	"github.com/mjl-/mox/smtp"
 )
 
@@ -442,6 +445,12 @@ type Message struct {
 	// in OrigDKIMDomains.
 	DKIMDomains []string `bstore:"index DKIMDomains+Received"`
 
+	// Result of ARC chain validation of incoming messages, "none", "pass" or "fail".
+	// Empty if not verified, e.g. for messages not received over SMTP.
+	ARCResult string
+	// Domains that sealed a passing ARC chain, most recent first. Unicode string.
+	ARCSealDomains []string
+
 	// For forwarded messages,
 	OrigEHLODomain  string
 	OrigDKIMDomains []string
@@ -489,6 +498,10 @@ type Message struct {
 	// at the subject when matching threads.
 	DSN bool
 
+	// Whether the message has been added to the full-text index. Messages that are
+	// not indexed are always read when searching for words.
+	TextIndexed bool
+
 	ReceivedTLSVersion     uint16 // 0 if unknown, 1 if plaintext/no TLS, otherwise TLS cipher suite.
 	ReceivedTLSCipherSuite uint16
 	ReceivedRequireTLS     bool // Whether RequireTLS was known to be used for incoming delivery.
@@ -597,17 +610,42 @@ func (m *Message) PrepareThreading(log mlog.Log, part *message.Part) {
 	m.SubjectBase, _ = message.ThreadSubject(part.Envelope.Subject, false)
 }
 
-// LoadPart returns a message.Part by reading from m.ParsedBuf.
-func (m Message) LoadPart(r io.ReaderAt) (message.Part, error) {
+// ParsedJSON returns the JSON of the parsed message in m.ParsedBuf, decrypting it
+// for accounts with encryption. ErrAccountLocked is returned if the key of the
+// account is not unlocked.
+func (m Message) ParsedJSON() ([]byte, error) {
 	if m.ParsedBuf == nil {
-		return message.Part{}, fmt.Errorf("message not parsed")
+		return nil, fmt.Errorf("message not parsed")
+	}
+	return openField(m.ParsedBuf)
+}
+
+// LoadPart returns a message.Part by reading from m.ParsedBuf. If r is nil, the
+// part has no reader.
+//
+// If m.ParsedBuf is encrypted and the account is locked, the message is parsed
+// from r instead, e.g. for a new delivery, with the message still in a plain text
+// file. If r is an encrypted message file, ErrAccountLocked is returned.
+func (m Message) LoadPart(r io.ReaderAt) (message.Part, error) {
+	buf, err := m.ParsedJSON()
+	if errors.Is(err, ErrAccountLocked) && r != nil && m.Size > 0 {
+		if _, err := r.ReadAt(make([]byte, 1), m.Size-1); err != nil {
+			return message.Part{}, err
+		}
+		// Like a new delivery, we continue with the part after a parse error.
+		p, _ := message.EnsurePart(mlog.New("store", nil).Logger, false, r, m.Size)
+		return p, nil
+	} else if err != nil {
+		return message.Part{}, err
 	}
 	var p message.Part
-	err := json.Unmarshal(m.ParsedBuf, &p)
+	err = json.Unmarshal(buf, &p)
 	if err != nil {
 		return p, fmt.Errorf("unmarshal message part")
 	}
-	p.SetReaderAt(r)
+	if r != nil {
+		p.SetReaderAt(r)
+	}
 	return p, nil
 }
 
@@ -738,6 +776,10 @@ type Settings struct {
 	// Whether to show the bars underneath the address input fields indicating
 	// starttls/dnssec/dane/mtasts/requiretls support by address.
 	ShowAddressSecurity bool
+
+	// If > 0, messages sent without a scheduled time are held in the queue for this
+	// many seconds, during which sending can be undone.
+	UndoSendSeconds int
 }
 
 // ViewMode how a message should be viewed: its text parts, html parts, or html
@@ -808,6 +850,19 @@ var DBTypes = []any{
 	RulesetNoListID{},
 	RulesetNoMsgFrom{},
 	RulesetNoMailbox{},
+	SieveScript{},
+	VacationReply{},
+	Vacation{},
+	MailboxACL{},
+	TextWord{},
+	TextPosting{},
+	AddressBook{},
+	Contact{},
+	AppPassword{},
+	CryptoKey{},
+	PeerKey{},
+	TOTP{},
+	EncryptionKey{},
 }
 
 // Account holds the information about a user, includings mailboxes, messages, imap subscriptions.
@@ -1242,12 +1297,12 @@ func (a *Account) CheckConsistency() error {
 				return nil
 			}
 			p := a.MessagePath(m.ID)
-			st, err := os.Stat(p)
+			size, err := MessageFileSize(p)
 			if err != nil {
 				existserr := fmt.Sprintf("message %d in mailbox %q (id %d) on-disk file %s: %v", m.ID, mb.Name, mb.ID, p, err)
 				fileErrors = append(fileErrors, existserr)
-			} else if len(fileErrors) < 20 && m.Size != int64(len(m.MsgPrefix))+st.Size() {
-				sizeerr := fmt.Sprintf("message %d in mailbox %q (id %d) has size %d != len msgprefix %d + on-disk file size %d = %d", m.ID, mb.Name, mb.ID, m.Size, len(m.MsgPrefix), st.Size(), int64(len(m.MsgPrefix))+st.Size())
+			} else if len(fileErrors) < 20 && m.Size != int64(len(m.MsgPrefix))+size {
+				sizeerr := fmt.Sprintf("message %d in mailbox %q (id %d) has size %d != len msgprefix %d + on-disk file size %d = %d", m.ID, mb.Name, mb.ID, m.Size, len(m.MsgPrefix), size, int64(len(m.MsgPrefix))+size)
 				fileErrors = append(fileErrors, sizeerr)
 			}
 
@@ -1388,6 +1443,9 @@ func (a *Account) WithRLock(fn func()) {
 // for its recipients (to/cc/bcc). Their domains are added to Recipients for use in
 // dmarc reputation.
 //
+// For accounts with encryption, the parsed message in m.ParsedBuf and the message
+// file are encrypted, and m.MessageID and m.SubjectBase are set to hashes.
+//
 // If sync is true, the message file and its directory are synced. Should be true
 // for regular mail delivery, but can be false when importing many messages.
 //
@@ -1431,6 +1489,22 @@ func (a *Account) DeliverMessage(log mlog.Log, tx *bstore.Tx, m *Message, msgFil
 	conf, _ := a.Conf()
 	m.JunkFlagsForMailbox(mb, conf)
 
+	// With a key, Message-ID and base subject are stored as hashes. If encryption is
+	// enabled, the parsed message and message file are encrypted. Only the public key
+	// is needed, so this works for locked accounts too.
+	k, err := encryptionKeyGet(tx)
+	if err != nil {
+		return err
+	}
+	var threadKey []byte
+	var encKey *EncryptionKey
+	if k != nil {
+		threadKey = k.PublicKey
+		if conf.EncryptMessages {
+			encKey = k
+		}
+	}
+
 	mr := FileMsgReader(m.MsgPrefix, msgFile) // We don't close, it would close the msgFile.
 	var part *message.Part
 	if m.ParsedBuf == nil {
@@ -1446,13 +1520,18 @@ func (a *Account) DeliverMessage(log mlog.Log, tx *bstore.Tx, m *Message, msgFil
 		}
 		m.ParsedBuf = buf
 	} else {
-		var p message.Part
-		if err := json.Unmarshal(m.ParsedBuf, &p); err != nil {
+		if p, err := m.LoadPart(mr); err != nil {
 			log.Errorx("unmarshal parsed message, continuing", err, slog.String("parse", ""))
 		} else {
 			part = &p
 		}
 	}
+	if encKey != nil && !isSealedField(m.ParsedBuf) {
+		m.ParsedBuf, err = sealField(encKey.PublicKey, m.ParsedBuf)
+		if err != nil {
+			return fmt.Errorf("encrypting parsed message: %w", err)
+		}
+	}
 
 	// If we are delivering to the originally intended mailbox, no need to store the mailbox ID again.
 	if m.MailboxDestinedID != 0 && m.MailboxDestinedID == m.MailboxOrigID {
@@ -1470,6 +1549,8 @@ func (a *Account) DeliverMessage(log mlog.Log, tx *bstore.Tx, m *Message, msgFil
 	if part != nil && m.MessageID == "" && m.SubjectBase == "" {
 		m.PrepareThreading(log, part)
 	}
+	m.MessageID = threadHash(threadKey, m.MessageID)
+	m.SubjectBase = threadHash(threadKey, m.SubjectBase)
 
 	// Assign to thread (if upgrade has completed).
 	noThreadID := nothreads
@@ -1480,7 +1561,7 @@ func (a *Account) DeliverMessage(log mlog.Log, tx *bstore.Tx, m *Message, msgFil
 				log.Info("not assigning threads for new delivery, upgrading to threads failed")
 				noThreadID = true
 			} else {
-				if err := assignThread(log, tx, m, part); err != nil {
+				if err := assignThread(log, tx, m, part, threadKey); err != nil {
 					return fmt.Errorf("assigning thread: %w", err)
 				}
 			}
@@ -1503,6 +1584,13 @@ func (a *Account) DeliverMessage(log mlog.Log, tx *bstore.Tx, m *Message, msgFil
 		}
 	}
 
+	if part != nil {
+		m.TextIndexed = false
+		if err := textIndexAdd(log, tx, m, part); err != nil {
+			return fmt.Errorf("adding message to full-text index: %w", err)
+		}
+	}
+
 	// todo: perhaps we should match the recipients based on smtp submission and a matching message-id? we now miss the addresses in bcc's if the mail client doesn't save a message that includes the bcc header in the sent mailbox.
 	if mb.Sent && part != nil && part.Envelope != nil {
 		e := part.Envelope
@@ -1554,7 +1642,15 @@ func (a *Account) DeliverMessage(log mlog.Log, tx *bstore.Tx, m *Message, msgFil
 		}
 	}
 
-	if err := moxio.LinkOrCopy(log, msgPath, msgFile.Name(), &moxio.AtReader{R: msgFile}, true); err != nil {
+	if encKey != nil {
+		fi, err := msgFile.Stat()
+		if err != nil {
+			return fmt.Errorf("stat message file: %v", err)
+		}
+		if err := writeEncryptedMessageFile(log, msgPath, encKey.PublicKey, msgFile, fi.Size(), true); err != nil {
+			return fmt.Errorf("writing encrypted message file: %w", err)
+		}
+	} else if err := moxio.LinkOrCopy(log, msgPath, msgFile.Name(), &moxio.AtReader{R: msgFile}, true); err != nil {
 		return fmt.Errorf("linking/copying message to new file: %w", err)
 	}
 
@@ -1568,7 +1664,7 @@ func (a *Account) DeliverMessage(log mlog.Log, tx *bstore.Tx, m *Message, msgFil
 
 	if !notrain && m.NeedsTraining() {
 		l := []Message{*m}
-		if err := a.RetrainMessages(context.TODO(), log, tx, l, false); err != nil {
+		if err := a.retrainMessages(context.TODO(), log, tx, l, false, msgFile); err != nil {
 			xerr := os.Remove(msgPath)
 			log.Check(xerr, "removing message after syncdir error", slog.String("path", msgPath))
 			return fmt.Errorf("training junkfilter: %w", err)
@@ -1581,6 +1677,10 @@ func (a *Account) DeliverMessage(log mlog.Log, tx *bstore.Tx, m *Message, msgFil
 
 // SetPassword saves a new password for this account. This password is used for
 // IMAP, SMTP (submission) sessions and the HTTP account web page.
+//
+// The key for encrypted message files is sealed with the new password, or created
+// if encryption is enabled. If the account has a key, it must be unlocked, or an
+// error wrapping ErrAccountLocked is returned.
 func (a *Account) SetPassword(log mlog.Log, password string) error {
 	password, err := precis.OpaqueString.String(password)
 	if err != nil {
@@ -1641,6 +1741,11 @@ func (a *Account) SetPassword(log mlog.Log, password string) error {
 			return fmt.Errorf("inserting new password: %v", err)
 		}
 
+		conf, _ := a.Conf()
+		if err := a.encryptionKeySet(log, tx, password, conf.EncryptMessages); err != nil {
+			return err
+		}
+
 		return sessionRemoveAll(context.TODO(), log, tx, a.Name)
 	})
 	if err == nil {
@@ -1878,29 +1983,47 @@ func (a *Account) MessagePath(messageID int64) string {
 }
 
 // MessageReader opens a message for reading, transparently combining the
-// message prefix with the original incoming message.
+// message prefix with the original incoming message, and decrypting the message
+// file if needed.
 func (a *Account) MessageReader(m Message) *MsgReader {
-	return &MsgReader{prefix: m.MsgPrefix, path: a.MessagePath(m.ID), size: m.Size}
+	return &MsgReader{prefix: m.MsgPrefix, path: a.MessagePath(m.ID), account: a.Name, size: m.Size}
 }
 
-// DeliverDestination delivers an email to dest, based on the configured rulesets.
+// DeliverDestination delivers an email to dest, based on the active Sieve script
+// or otherwise the configured rulesets.
+//
+// If a Sieve script is active, its result is returned after delivering to the
+// mailboxes of keep and fileinto actions. Redirect and vacation actions must be
+// handled by the caller. If the result has a reject action, nothing is
+// delivered.
 //
 // Returns ErrOverQuota when account would be over quota after adding message.
 //
 // Caller must hold account wlock (mailbox may be created).
 // Message delivery, possible mailbox creation, and updated mailbox counts are
 // broadcasted.
-func (a *Account) DeliverDestination(log mlog.Log, dest config.Destination, m *Message, msgFile *os.File) error {
-	var mailbox string
+func (a *Account) DeliverDestination(log mlog.Log, dest config.Destination, m *Message, msgFile *os.File) (*sieve.Result, error) {
+	mailbox := dest.Mailbox
+	if mailbox == "" {
+		mailbox = "Inbox"
+	}
+
+	sr, err := a.SieveEval(log, m, msgFile)
+	if err != nil {
+		return nil, err
+	} else if sr != nil {
+		if sr.Reject != nil {
+			return sr, nil
+		}
+		_, err := a.DeliverSieve(log, mailbox, sr, m, msgFile)
+		return sr, err
+	}
+
 	rs := MessageRuleset(log, dest, m, m.MsgPrefix, msgFile)
 	if rs != nil {
 		mailbox = rs.Mailbox
-	} else if dest.Mailbox == "" {
-		mailbox = "Inbox"
-	} else {
-		mailbox = dest.Mailbox
 	}
-	return a.DeliverMailbox(log, mailbox, m, msgFile)
+	return nil, a.DeliverMailbox(log, mailbox, m, msgFile)
 }
 
 // DeliverMailbox delivers an email to the specified mailbox.
@@ -2035,6 +2158,10 @@ func (a *Account) rejectsRemoveMessages(ctx context.Context, log mlog.Log, tx *b
 		return nil, fmt.Errorf("deleting from message recipient: %w", err)
 	}
 
+	if err := TextIndexRemove(tx, ids...); err != nil {
+		return nil, err
+	}
+
 	// Assign new modseq.
 	modseq, err := a.NextModSeq(tx)
 	if err != nil {
@@ -2104,6 +2231,10 @@ func (a *Account) RejectsRemove(log mlog.Log, rejectsMailbox, messageID string)
 			return nil
 		}
 
+		messageID, err := HashThreadValue(tx, messageID)
+		if err != nil {
+			return err
+		}
 		q := bstore.QueryTx[Message](tx)
 		q.FilterNonzero(Message{MailboxID: mb.ID, MessageID: messageID})
 		q.FilterEqual("Expunged", false)
@@ -2202,8 +2333,16 @@ func manageAuthCache() {
 
 // OpenEmailAuth opens an account given an email address and password.
 //
+// The password is verified against the password set in the account, and/or with
+// the external authentication backend if configured. Successful authentications
+// are cached. If appProtocol is not empty, app passwords valid for that protocol
+// (e.g. AppProtocolIMAP) are also accepted. A successful login with the account
+// password unlocks the key for encrypted message files. Logins with a password
+// verified by the external authentication backend don't, the key is sealed with
+// the account password.
+//
 // The email address may contain a catchall separator.
-func OpenEmailAuth(log mlog.Log, email string, password string) (acc *Account, rerr error) {
+func OpenEmailAuth(log mlog.Log, email, password, appProtocol string) (acc *Account, rerr error) {
 	password, err := precis.OpaqueString.String(password)
 	if err != nil {
 		return nil, ErrUnknownCredentials
@@ -2222,29 +2361,119 @@ func OpenEmailAuth(log mlog.Log, email string, password string) (acc *Account, r
 		}
 	}()
 
-	pw, err := bstore.QueryDB[Password](context.TODO(), acc.DB).Get()
-	if err != nil {
-		if err == bstore.ErrAbsent {
-			return acc, ErrUnknownCredentials
+	// App passwords are cheap to check, and we don't want a bcrypt for the account
+	// password on each login by a device.
+	if appProtocol != "" {
+		if ok, err := acc.checkAppPassword(password, appProtocol); err != nil {
+			return acc, fmt.Errorf("checking app password: %v", err)
+		} else if ok {
+			return acc, nil
 		}
+	}
+
+	extAuth := mox.Conf.Static.ExternalAuth
+
+	pw, err := bstore.QueryDB[Password](context.TODO(), acc.DB).Get()
+	if err != nil && err != bstore.ErrAbsent {
 		return acc, fmt.Errorf("looking up password: %v", err)
 	}
+	if err == nil && (extAuth == nil || extAuth.LocalPasswords) {
+		authCache.Lock()
+		ok := len(password) >= 8 && authCache.success[authKey{email, pw.Hash}] == password
+		authCache.Unlock()
+		if ok {
+			acc.unlock(log, password)
+			return
+		}
+		if err := bcrypt.CompareHashAndPassword([]byte(pw.Hash), []byte(password)); err == nil {
+			authCache.Lock()
+			authCache.success[authKey{email, pw.Hash}] = password
+			authCache.Unlock()
+			acc.unlock(log, password)
+			return
+		}
+	}
+	if extAuth == nil {
+		return acc, ErrUnknownCredentials
+	}
+
+	// Bcrypt hashes never match this key.
+	key := authKey{email, "external"}
 	authCache.Lock()
-	ok := len(password) >= 8 && authCache.success[authKey{email, pw.Hash}] == password
+	ok := len(password) >= 8 && authCache.success[key] == password
 	authCache.Unlock()
 	if ok {
 		return
 	}
-	if err := bcrypt.CompareHashAndPassword([]byte(pw.Hash), []byte(password)); err != nil {
-		rerr = ErrUnknownCredentials
-	} else {
-		authCache.Lock()
-		authCache.success[authKey{email, pw.Hash}] = password
-		authCache.Unlock()
+	ok, err = extauth.Verify(context.TODO(), log, *extAuth, mox.Conf.Static.TLS.CertPool, acc.Name, email, password)
+	if err != nil {
+		return acc, err
+	} else if !ok {
+		return acc, ErrUnknownCredentials
 	}
+	authCache.Lock()
+	authCache.success[key] = password
+	authCache.Unlock()
 	return
 }
 
+// OpenEmailToken opens the account for the email address in an OAuth 2.0 bearer
+// token from the configured OpenID Connect identity provider. The address from
+// the token is returned, for use as username.
+//
+// If email is not empty, e.g. an authorization identity from the client, it must
+// be an address of the same account. Invalid tokens result in
+// ErrUnknownCredentials.
+func OpenEmailToken(ctx context.Context, log mlog.Log, email, token string) (acc *Account, address string, rerr error) {
+	conf := mox.Conf.Static.OIDC
+	if conf == nil {
+		return nil, "", ErrUnknownCredentials
+	}
+
+	address, err := oidc.Verify(ctx, log, *conf, token)
+	if err != nil && errors.Is(err, oidc.ErrToken) {
+		return nil, "", fmt.Errorf("%w: %v", ErrUnknownCredentials, err)
+	} else if err != nil {
+		return nil, "", err
+	}
+
+	if email != "" && !strings.EqualFold(email, address) {
+		addr, err := smtp.ParseAddress(email)
+		if err != nil {
+			return nil, "", fmt.Errorf("%w: %v", ErrUnknownCredentials, err)
+		}
+		tokenAddr, err := smtp.ParseAddress(address)
+		if err != nil {
+			return nil, "", fmt.Errorf("%w: %v", ErrUnknownCredentials, err)
+		}
+		accName, _, _, _, err := mox.LookupAddress(addr.Localpart, addr.Domain, false, false)
+		if err != nil {
+			return nil, "", fmt.Errorf("%w: %v", ErrUnknownCredentials, err)
+		}
+		tokenAccName, _, _, _, err := mox.LookupAddress(tokenAddr.Localpart, tokenAddr.Domain, false, false)
+		if err != nil {
+			return nil, "", fmt.Errorf("%w: %v", ErrUnknownCredentials, err)
+		}
+		if accName != tokenAccName {
+			return nil, "", fmt.Errorf("%w: address %q is not for the account of token address %q", ErrUnknownCredentials, email, address)
+		}
+	}
+
+	acc, _, err = OpenEmail(log, address)
+	if err != nil {
+		return nil, "", err
+	}
+	return acc, address, nil
+}
+
+// PasswordHashMechanisms returns whether authentication mechanisms that need
+// password hashes stored in the account, such as SCRAM-SHA-* and CRAM-MD5, are
+// available. Not when all passwords are verified with an external backend.
+func PasswordHashMechanisms() bool {
+	ea := mox.Conf.Static.ExternalAuth
+	return ea == nil || ea.LocalPasswords
+}
+
 // OpenEmail opens an account given an email address.
 //
 // The email address may contain a catchall separator.
@@ -2709,14 +2938,19 @@ func (a *Account) MailboxDelete(ctx context.Context, log mlog.Log, tx *bstore.Tx
 
 	if len(remove) > 0 {
 		removeIDs := make([]any, len(remove))
+		ids := make([]int64, len(remove))
 		for i, m := range remove {
 			removeIDs[i] = m.ID
+			ids[i] = m.ID
 		}
 		qmr := bstore.QueryTx[Recipient](tx)
 		qmr.FilterEqual("MessageID", removeIDs...)
 		if _, err = qmr.Delete(); err != nil {
 			return nil, nil, false, fmt.Errorf("removing message recipients for messages: %v", err)
 		}
+		if err := TextIndexRemove(tx, ids...); err != nil {
+			return nil, nil, false, err
+		}
 
 		qm = bstore.QueryTx[Message](tx)
 		qm.FilterNonzero(Message{MailboxID: mailbox.ID})
@@ -2752,6 +2986,12 @@ func (a *Account) MailboxDelete(ctx context.Context, log mlog.Log, tx *bstore.Tx
 		}
 	}
 
+	qacl := bstore.QueryTx[MailboxACL](tx)
+	qacl.FilterNonzero(MailboxACL{MailboxID: mailbox.ID})
+	if _, err := qacl.Delete(); err != nil {
+		return nil, nil, false, fmt.Errorf("removing mailbox acl: %v", err)
+	}
+
 	if err := tx.Delete(&Mailbox{ID: mailbox.ID}); err != nil {
 		return nil, nil, false, fmt.Errorf("removing mailbox: %v", err)
 	}
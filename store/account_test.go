@@ -2,6 +2,7 @@ package store
 
 import (
 	"context"
+	"errors"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -73,7 +74,7 @@ func TestMailbox(t *testing.T) {
 	}
 	acc.WithWLock(func() {
 		conf, _ := acc.Conf()
-		err := acc.DeliverDestination(log, conf.Destinations["mjl"], &m, msgFile)
+		_, err := acc.DeliverDestination(log, conf.Destinations["mjl"], &m, msgFile)
 		tcheck(t, err, "deliver without consume")
 
 		err = acc.DB.Write(ctxbg, func(tx *bstore.Tx) error {
@@ -111,7 +112,7 @@ func TestMailbox(t *testing.T) {
 		})
 		tcheck(t, err, "deliver as sent and rejects")
 
-		err = acc.DeliverDestination(pkglog, conf.Destinations["mjl"], &mconsumed, msgFile)
+		_, err = acc.DeliverDestination(pkglog, conf.Destinations["mjl"], &mconsumed, msgFile)
 		tcheck(t, err, "deliver with consume")
 
 		err = acc.DB.Write(ctxbg, func(tx *bstore.Tx) error {
@@ -224,33 +225,116 @@ func TestMailbox(t *testing.T) {
 
 	// Run the auth tests twice for possible cache effects.
 	for i := 0; i < 2; i++ {
-		_, err := OpenEmailAuth(log, "mjl@mox.example", "bogus")
+		_, err := OpenEmailAuth(log, "mjl@mox.example", "bogus", "")
 		if err != ErrUnknownCredentials {
 			t.Fatalf("got %v, expected ErrUnknownCredentials", err)
 		}
 	}
 
 	for i := 0; i < 2; i++ {
-		acc2, err := OpenEmailAuth(log, "mjl@mox.example", "testtest")
+		acc2, err := OpenEmailAuth(log, "mjl@mox.example", "testtest", "")
 		tcheck(t, err, "open for email with auth")
 		err = acc2.Close()
 		tcheck(t, err, "close account")
 	}
 
-	acc2, err := OpenEmailAuth(log, "other@mox.example", "testtest")
+	acc2, err := OpenEmailAuth(log, "other@mox.example", "testtest", "")
 	tcheck(t, err, "open for email with auth")
 	err = acc2.Close()
 	tcheck(t, err, "close account")
 
-	_, err = OpenEmailAuth(log, "bogus@mox.example", "testtest")
+	_, err = OpenEmailAuth(log, "bogus@mox.example", "testtest", "")
 	if err != ErrUnknownCredentials {
 		t.Fatalf("got %v, expected ErrUnknownCredentials", err)
 	}
 
-	_, err = OpenEmailAuth(log, "mjl@test.example", "testtest")
+	_, err = OpenEmailAuth(log, "mjl@test.example", "testtest", "")
 	if err != ErrUnknownCredentials {
 		t.Fatalf("got %v, expected ErrUnknownCredentials", err)
 	}
+
+	// App passwords, only for their protocols and until they expire.
+	var appPassword, expiredPassword string
+	err = acc.DB.Write(ctxbg, func(tx *bstore.Tx) error {
+		_, appPassword, err = AppPasswordAdd(tx, "phone", []string{AppProtocolIMAP}, time.Time{})
+		tcheck(t, err, "add app password")
+		_, _, err = AppPasswordAdd(tx, "phone", []string{AppProtocolIMAP}, time.Time{})
+		if err != ErrAppPasswordExists {
+			t.Fatalf("got %v, expected ErrAppPasswordExists", err)
+		}
+		_, _, err = AppPasswordAdd(tx, "bad", []string{"bogus"}, time.Time{})
+		if !errors.Is(err, ErrAppPasswordInvalid) {
+			t.Fatalf("got %v, expected ErrAppPasswordInvalid", err)
+		}
+		_, expiredPassword, err = AppPasswordAdd(tx, "expired", []string{AppProtocolIMAP}, time.Now().Add(time.Hour))
+		tcheck(t, err, "add app password")
+		_, err = bstore.QueryTx[AppPassword](tx).FilterNonzero(AppPassword{Name: "expired"}).UpdateNonzero(AppPassword{Expires: time.Now().Add(-time.Minute)})
+		return err
+	})
+	tcheck(t, err, "app passwords")
+	acc2, err = OpenEmailAuth(log, "mjl@mox.example", appPassword, AppProtocolIMAP)
+	tcheck(t, err, "open with app password")
+	err = acc2.Close()
+	tcheck(t, err, "close account")
+	for _, proto := range []string{"", AppProtocolSubmission} {
+		_, err = OpenEmailAuth(log, "mjl@mox.example", appPassword, proto)
+		if err != ErrUnknownCredentials {
+			t.Fatalf("got %v, expected ErrUnknownCredentials for app password with protocol %q", err, proto)
+		}
+	}
+	_, err = OpenEmailAuth(log, "mjl@mox.example", expiredPassword, AppProtocolIMAP)
+	if err != ErrUnknownCredentials {
+		t.Fatalf("got %v, expected ErrUnknownCredentials for expired app password", err)
+	}
+	err = acc.DB.Write(ctxbg, func(tx *bstore.Tx) error {
+		l, err := AppPasswordList(tx)
+		tcheck(t, err, "list app passwords")
+		if len(l) != 2 || l[1].Name != "phone" || l[1].LastUsedProtocol != AppProtocolIMAP || l[1].LastUsed.IsZero() {
+			t.Fatalf("unexpected app passwords %v", l)
+		}
+		tcheck(t, AppPasswordRemove(tx, "phone"), "remove app password")
+		if err := AppPasswordRemove(tx, "phone"); err != ErrAppPasswordUnknown {
+			t.Fatalf("got %v, expected ErrAppPasswordUnknown", err)
+		}
+		return nil
+	})
+	tcheck(t, err, "app passwords")
+	_, err = OpenEmailAuth(log, "mjl@mox.example", appPassword, AppProtocolIMAP)
+	if err != ErrUnknownCredentials {
+		t.Fatalf("got %v, expected ErrUnknownCredentials for removed app password", err)
+	}
+
+	// External authentication with a helper that only accepts "external".
+	script := filepath.Join(t.TempDir(), "auth.sh")
+	err = os.WriteFile(script, []byte("#!/bin/sh\nread email\nread password\n[ \"$password\" = external ]\n"), 0700)
+	tcheck(t, err, "write auth script")
+	mox.Conf.Static.ExternalAuth = &config.ExternalAuth{Exec: &config.ExecAuth{Command: []string{"/bin/sh", script}}}
+	defer func() {
+		mox.Conf.Static.ExternalAuth = nil
+	}()
+	if PasswordHashMechanisms() {
+		t.Fatalf("password hash mechanisms enabled with external auth")
+	}
+
+	testAuth := func(password string, expErr error) {
+		t.Helper()
+		for i := 0; i < 2; i++ {
+			acc2, err := OpenEmailAuth(log, "mjl@mox.example", password, "")
+			if err != expErr {
+				t.Fatalf("got %v, expected %v", err, expErr)
+			}
+			if err == nil {
+				err = acc2.Close()
+				tcheck(t, err, "close account")
+			}
+		}
+	}
+	testAuth("external", nil)
+	testAuth("testtest", ErrUnknownCredentials) // Local password not allowed.
+	mox.Conf.Static.ExternalAuth.LocalPasswords = true
+	testAuth("testtest", nil)
+	testAuth("external", nil)
+	testAuth("bogus", ErrUnknownCredentials)
 }
 
 func TestMessageRuleset(t *testing.T) {
@@ -0,0 +1,246 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+// MailboxACL is an entry in the access control list of a mailbox, giving another
+// account, or all accounts, rights on the mailbox. The account owning the mailbox
+// always has all rights, it does not have entries.
+//
+// ../rfc/4314:191
+type MailboxACL struct {
+	ID         int64
+	MailboxID  int64  `bstore:"nonzero,ref Mailbox,unique MailboxID+Identifier"`
+	Identifier string `bstore:"nonzero,index"` // Account name, or "anyone" for all accounts.
+	Rights     string `bstore:"nonzero"`       // Letters from RightsAll, in that order.
+}
+
+// RightsAll are all rights that can be granted, in canonical order.
+//
+//   - l: lookup, mailbox is visible in LIST.
+//   - r: read, SELECT/EXAMINE, FETCH, SEARCH, COPY from mailbox.
+//   - s: keep seen/unseen state.
+//   - w: write flags and keywords other than \Seen and \Deleted.
+//   - i: insert, APPEND and COPY/MOVE into mailbox.
+//   - p: post, send mail to the mailbox address, not used.
+//   - k: create child mailboxes.
+//   - x: delete mailbox.
+//   - t: set \Deleted flag.
+//   - e: expunge messages.
+//   - a: administer, change the ACL.
+//
+// ../rfc/4314:253
+const RightsAll = "lrswipkxtea"
+
+// IdentifierAnyone is the ACL identifier matching all accounts. ../rfc/4314:213
+const IdentifierAnyone = "anyone"
+
+var (
+	ErrACLRights     = errors.New("invalid rights")
+	ErrACLIdentifier = errors.New("invalid identifier")
+)
+
+// ParseRights checks rights and returns them in canonical order. The obsolete
+// virtual rights "c" and "d" are expanded to the rights they stand for, as
+// RFC 4314 recommends.
+func ParseRights(s string) (string, error) {
+	var have [256]bool
+	for _, c := range s {
+		switch {
+		case c == 'c':
+			// ../rfc/4314:1118
+			have['k'] = true
+			have['x'] = true
+		case c == 'd':
+			// ../rfc/4314:1129
+			have['x'] = true
+			have['t'] = true
+			have['e'] = true
+		case c < 0x80 && strings.ContainsRune(RightsAll, c):
+			have[c] = true
+		default:
+			return "", fmt.Errorf("%w: unknown right %q", ErrACLRights, c)
+		}
+	}
+	var r string
+	for _, c := range []byte(RightsAll) {
+		if have[c] {
+			r += string(c)
+		}
+	}
+	return r, nil
+}
+
+// HasRights returns whether have includes all of rights.
+func HasRights(have, rights string) bool {
+	for _, c := range rights {
+		if !strings.ContainsRune(have, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// MailboxACLList returns the ACL entries for a mailbox, ordered by identifier.
+func MailboxACLList(tx *bstore.Tx, mailboxID int64) ([]MailboxACL, error) {
+	q := bstore.QueryTx[MailboxACL](tx)
+	q.FilterNonzero(MailboxACL{MailboxID: mailboxID})
+	q.SortAsc("Identifier")
+	return q.List()
+}
+
+// MailboxACLSet sets the rights of identifier on mailbox, replacing any existing
+// rights. Empty rights remove the entry. Identifier must be "anyone" or the name
+// of another account.
+func (a *Account) MailboxACLSet(tx *bstore.Tx, mailboxID int64, identifier, rights string) error {
+	rights, err := ParseRights(rights)
+	if err != nil {
+		return err
+	}
+	if identifier == a.Name {
+		// The owner always has all rights. ../rfc/4314:349
+		return fmt.Errorf("%w: cannot change rights of mailbox owner", ErrACLIdentifier)
+	} else if identifier != IdentifierAnyone && rights != "" {
+		// Entries for accounts that were removed can still be removed.
+		if _, ok := mox.Conf.Account(identifier); !ok {
+			return fmt.Errorf("%w: no account %q", ErrACLIdentifier, identifier)
+		}
+	}
+
+	if err := tx.Get(&Mailbox{ID: mailboxID}); err == bstore.ErrAbsent {
+		return ErrUnknownMailbox
+	} else if err != nil {
+		return fmt.Errorf("get mailbox: %v", err)
+	}
+
+	q := bstore.QueryTx[MailboxACL](tx)
+	q.FilterNonzero(MailboxACL{MailboxID: mailboxID, Identifier: identifier})
+	acl, err := q.Get()
+	if err == bstore.ErrAbsent {
+		if rights == "" {
+			return nil
+		}
+		acl = MailboxACL{MailboxID: mailboxID, Identifier: identifier, Rights: rights}
+		return tx.Insert(&acl)
+	} else if err != nil {
+		return fmt.Errorf("get acl: %v", err)
+	} else if rights == "" {
+		return tx.Delete(&acl)
+	}
+	acl.Rights = rights
+	return tx.Update(&acl)
+}
+
+// MailboxRights returns the rights accountName has on a mailbox of a. The owner
+// has all rights. Other accounts have the combined rights of their own entry and
+// the "anyone" entry.
+func (a *Account) MailboxRights(tx *bstore.Tx, mailboxID int64, accountName string) (string, error) {
+	if accountName == a.Name {
+		return RightsAll, nil
+	}
+	q := bstore.QueryTx[MailboxACL](tx)
+	q.FilterNonzero(MailboxACL{MailboxID: mailboxID})
+	q.FilterEqual("Identifier", accountName, IdentifierAnyone)
+	l, err := q.List()
+	if err != nil {
+		return "", fmt.Errorf("listing acl: %v", err)
+	}
+	var rights string
+	for _, acl := range l {
+		rights += acl.Rights
+	}
+	return ParseRights(rights)
+}
+
+// SharedMailbox is a mailbox of another account that an account has been given
+// rights to.
+type SharedMailbox struct {
+	Account string // Owner of the mailbox.
+	Mailbox Mailbox
+	Rights  string // Effective rights, see MailboxRights.
+	Direct  bool   // Whether an entry exists for the account itself.
+	Anyone  bool   // Whether an entry exists for "anyone".
+}
+
+// SharedMailboxes returns the mailboxes of other accounts that accountName has
+// the lookup right on, ordered by account and mailbox name.
+func SharedMailboxes(ctx context.Context, log mlog.Log, accountName string) ([]SharedMailbox, error) {
+	names := mox.Conf.Accounts()
+	sort.Strings(names)
+
+	var r []SharedMailbox
+	for _, name := range names {
+		if name == accountName {
+			continue
+		}
+		l, err := sharedMailboxes(ctx, log, name, accountName)
+		if err != nil {
+			return nil, fmt.Errorf("mailboxes of account %q: %w", name, err)
+		}
+		r = append(r, l...)
+	}
+	return r, nil
+}
+
+func sharedMailboxes(ctx context.Context, log mlog.Log, owner, accountName string) (r []SharedMailbox, rerr error) {
+	acc, err := OpenAccount(log, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err := acc.Close()
+		log.Check(err, "closing account")
+	}()
+
+	rerr = acc.DB.Read(ctx, func(tx *bstore.Tx) error {
+		q := bstore.QueryTx[MailboxACL](tx)
+		q.FilterEqual("Identifier", accountName, IdentifierAnyone)
+		acls, err := q.List()
+		if err != nil {
+			return fmt.Errorf("listing acls: %v", err)
+		}
+
+		byMailbox := map[int64]*SharedMailbox{}
+		for _, acl := range acls {
+			sm := byMailbox[acl.MailboxID]
+			if sm == nil {
+				sm = &SharedMailbox{Account: owner, Mailbox: Mailbox{ID: acl.MailboxID}}
+				byMailbox[acl.MailboxID] = sm
+			}
+			sm.Rights += acl.Rights
+			if acl.Identifier == IdentifierAnyone {
+				sm.Anyone = true
+			} else {
+				sm.Direct = true
+			}
+		}
+		for _, sm := range byMailbox {
+			if sm.Rights, err = ParseRights(sm.Rights); err != nil {
+				return err
+			}
+			if !strings.Contains(sm.Rights, "l") {
+				continue
+			}
+			if err := tx.Get(&sm.Mailbox); err != nil {
+				return fmt.Errorf("get mailbox: %v", err)
+			}
+			r = append(r, *sm)
+		}
+		return nil
+	})
+	slices.SortFunc(r, func(a, b SharedMailbox) int {
+		return strings.Compare(a.Mailbox.Name, b.Mailbox.Name)
+	})
+	return r, rerr
+}
@@ -0,0 +1,164 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/mjl-/bstore"
+)
+
+// AppPassword is an additional password for an account, typically for a single
+// device or application, so it can be revoked without changing the account
+// password. An app password can only be used for its protocols, and optionally
+// expires.
+//
+// App passwords are generated by mox, they are long random strings. Only a
+// SHA-256 hash is stored, which is sufficient for high-entropy passwords and
+// allows looking up the app password by its hash. App passwords cannot be used
+// with SCRAM-SHA-* and CRAM-MD5 authentication.
+type AppPassword struct {
+	ID        int64
+	Created   time.Time `bstore:"nonzero,default now"`
+	Name      string    `bstore:"nonzero,unique"`
+	Hash      string    `bstore:"nonzero,unique" json:"-"` // Hex SHA-256 of password.
+	Protocols []string  // One or more of AppProtocolIMAP, AppProtocolSubmission, AppProtocolWebAPI.
+	Expires   time.Time // Zero if app password does not expire.
+
+	LastUsed         time.Time // Zero if never used. Updated at most once a minute.
+	LastUsedProtocol string
+}
+
+// Protocols for which an app password can be valid.
+const (
+	AppProtocolIMAP       = "imap"
+	AppProtocolSubmission = "submission"
+	AppProtocolWebAPI     = "webapi"
+)
+
+// AppProtocols are all protocols for which app passwords can be used.
+var AppProtocols = []string{AppProtocolIMAP, AppProtocolSubmission, AppProtocolWebAPI}
+
+var (
+	ErrAppPasswordUnknown = errors.New("no such app password")
+	ErrAppPasswordExists  = errors.New("app password with that name already exists")
+	ErrAppPasswordInvalid = errors.New("invalid app password parameters")
+)
+
+// AppPasswordList returns the app passwords of the account, ordered by name.
+func AppPasswordList(tx *bstore.Tx) ([]AppPassword, error) {
+	return bstore.QueryTx[AppPassword](tx).SortAsc("Name").List()
+}
+
+// AppPasswordAdd adds a new app password, returning it and the generated password.
+// The password is not stored and cannot be retrieved later.
+func AppPasswordAdd(tx *bstore.Tx, name string, protocols []string, expires time.Time) (AppPassword, string, error) {
+	if name == "" || len(name) > 128 {
+		return AppPassword{}, "", fmt.Errorf("%w: name must be non-empty and at most 128 characters", ErrAppPasswordInvalid)
+	}
+	if len(protocols) == 0 {
+		return AppPassword{}, "", fmt.Errorf("%w: at least one protocol required", ErrAppPasswordInvalid)
+	}
+	for _, p := range protocols {
+		if !slices.Contains(AppProtocols, p) {
+			return AppPassword{}, "", fmt.Errorf("%w: unknown protocol %q", ErrAppPasswordInvalid, p)
+		}
+	}
+	if !expires.IsZero() && !expires.After(time.Now()) {
+		return AppPassword{}, "", fmt.Errorf("%w: expiration time must be in the future", ErrAppPasswordInvalid)
+	}
+
+	exists, err := bstore.QueryTx[AppPassword](tx).FilterNonzero(AppPassword{Name: name}).Exists()
+	if err != nil {
+		return AppPassword{}, "", err
+	} else if exists {
+		return AppPassword{}, "", ErrAppPasswordExists
+	}
+
+	password := generateCode(6)
+	ap := AppPassword{
+		Name:      name,
+		Hash:      appPasswordHash(password),
+		Protocols: protocols,
+		Expires:   expires,
+	}
+	if err := tx.Insert(&ap); err != nil {
+		return AppPassword{}, "", err
+	}
+	return ap, password, nil
+}
+
+// AppPasswordRemove removes an app password, it can no longer be used.
+func AppPasswordRemove(tx *bstore.Tx, name string) error {
+	n, err := bstore.QueryTx[AppPassword](tx).FilterNonzero(AppPassword{Name: name}).Delete()
+	if err != nil {
+		return err
+	} else if n == 0 {
+		return ErrAppPasswordUnknown
+	}
+	return nil
+}
+
+// Characters for generated app passwords and recovery codes, without easily
+// confused characters.
+const appPasswordChars = "abcdefghjkmnpqrstuvwxyz23456789"
+
+// generateCode returns a new random code of groups of 4 characters, separated by
+// dashes. Each group has over 19 bits of entropy, app passwords have 6 groups.
+func generateCode(groups int) string {
+	var s []byte
+	var buf [1]byte
+	for len(s) < groups*5-1 {
+		if len(s)%5 == 4 {
+			s = append(s, '-')
+			continue
+		}
+		if _, err := rand.Read(buf[:]); err != nil {
+			panic(fmt.Sprintf("reading random bytes: %v", err))
+		}
+		// Prevent bias by only using bytes that map evenly to the characters.
+		if n := int(buf[0]); n < 256/len(appPasswordChars)*len(appPasswordChars) {
+			s = append(s, appPasswordChars[n%len(appPasswordChars)])
+		}
+	}
+	return string(s)
+}
+
+func appPasswordHash(password string) string {
+	h := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(h[:])
+}
+
+// checkAppPassword returns whether password is a valid app password for protocol,
+// updating its last use.
+func (a *Account) checkAppPassword(password, protocol string) (bool, error) {
+	ap, err := bstore.QueryDB[AppPassword](context.TODO(), a.DB).FilterNonzero(AppPassword{Hash: appPasswordHash(password)}).Get()
+	if err == bstore.ErrAbsent {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	if !slices.Contains(ap.Protocols, protocol) || !ap.Expires.IsZero() && now.After(ap.Expires) {
+		return false, nil
+	}
+
+	// Prevent database writes for clients that log in often.
+	if now.Sub(ap.LastUsed) < time.Minute && ap.LastUsedProtocol == protocol {
+		return true, nil
+	}
+	ap.LastUsed = now
+	ap.LastUsedProtocol = protocol
+	if err := a.DB.Update(context.TODO(), &ap); err == bstore.ErrAbsent {
+		// Removed in the mean time.
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("updating last use of app password: %v", err)
+	}
+	return true, nil
+}
@@ -0,0 +1,445 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/smtp"
+)
+
+// AddressBook is a collection of contacts, served over CardDAV. A new account
+// gets a default address book when contacts are first accessed.
+type AddressBook struct {
+	ID          int64
+	Name        string `bstore:"nonzero,unique"` // Used as path segment in URLs, e.g. "contacts".
+	DisplayName string
+	Description string
+
+	// ModSeq of the last change to the address book or its contacts. Used as CTag
+	// and sync-token for CardDAV clients.
+	ModSeq  ModSeq    `bstore:"nonzero"`
+	Created time.Time `bstore:"nonzero,default now"`
+}
+
+// Contact is a vCard in an address book. Removed contacts are kept as tombstones
+// with Expunged set, so CardDAV clients can synchronize removals.
+type Contact struct {
+	ID            int64
+	AddressBookID int64  `bstore:"nonzero,ref AddressBook,unique AddressBookID+Name,index AddressBookID+ModSeq"`
+	Name          string `bstore:"nonzero"` // Resource name, last path segment in URLs, e.g. "<uid>.vcf".
+	ModSeq        ModSeq `bstore:"nonzero"`
+	Expunged      bool
+
+	// Fields below are parsed from the vCard when stored, and cleared when expunged.
+	UID           string
+	FormattedName string   // From FN property.
+	Emails        []string // From EMAIL properties, as in the vCard.
+	VCard         string
+	Updated       time.Time `bstore:"nonzero,default now"`
+}
+
+// ETag returns the entity tag for the current version of the contact, for use in
+// HTTP headers.
+func (c Contact) ETag() string {
+	return fmt.Sprintf(`"%d"`, c.ModSeq)
+}
+
+// DefaultAddressBook is the name of the address book created for accounts.
+const DefaultAddressBook = "contacts"
+
+// ContactMaxSize is the maximum size of a vCard in bytes.
+const ContactMaxSize = 256 * 1024
+
+var (
+	ErrAddressBookUnknown = errors.New("no such address book")
+	ErrAddressBookExists  = errors.New("address book already exists")
+	ErrContactUnknown     = errors.New("no such contact")
+	ErrContactUIDConflict = errors.New("contact with same uid already exists in address book")
+	ErrVCard              = errors.New("invalid vcard")
+)
+
+// CheckAddressBookName returns an error if name is not valid as address book
+// name. Names are used as path segments.
+func CheckAddressBookName(name string) error {
+	if name == "" {
+		return errors.New("address book name cannot be empty")
+	}
+	if len(name) > 128 {
+		return errors.New("address book name too long")
+	}
+	if name == "." || name == ".." {
+		return errors.New("invalid address book name")
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return errors.New("address book name can only contain letters, digits, dash, underscore and dot")
+		}
+	}
+	return nil
+}
+
+// CheckContactName returns an error if name is not valid as resource name for a
+// contact.
+func CheckContactName(name string) error {
+	if name == "" || name == "." || name == ".." {
+		return errors.New("invalid contact name")
+	}
+	if len(name) > 256 {
+		return errors.New("contact name too long")
+	}
+	for _, c := range name {
+		if c <= 0x1f || c == 0x7f || c == '/' {
+			return errors.New("control characters and slash not allowed in contact name")
+		}
+	}
+	return nil
+}
+
+// AddressBookList returns the address books, ordered by name. If the account
+// does not have any address book, the default address book is created.
+func AddressBookList(tx *bstore.Tx, acc *Account) ([]AddressBook, error) {
+	q := bstore.QueryTx[AddressBook](tx)
+	q.SortAsc("Name")
+	l, err := q.List()
+	if err != nil {
+		return nil, err
+	}
+	if len(l) == 0 {
+		ab, err := AddressBookCreate(tx, acc, DefaultAddressBook, "Contacts", "")
+		if err != nil {
+			return nil, fmt.Errorf("creating default address book: %v", err)
+		}
+		l = []AddressBook{ab}
+	}
+	return l, nil
+}
+
+// AddressBookGet returns an address book by name.
+func AddressBookGet(tx *bstore.Tx, name string) (AddressBook, error) {
+	ab, err := bstore.QueryTx[AddressBook](tx).FilterNonzero(AddressBook{Name: name}).Get()
+	if err == bstore.ErrAbsent {
+		return AddressBook{}, ErrAddressBookUnknown
+	}
+	return ab, err
+}
+
+// AddressBookCreate adds a new address book.
+func AddressBookCreate(tx *bstore.Tx, acc *Account, name, displayName, description string) (AddressBook, error) {
+	if err := CheckAddressBookName(name); err != nil {
+		return AddressBook{}, err
+	}
+	if _, err := AddressBookGet(tx, name); err == nil {
+		return AddressBook{}, ErrAddressBookExists
+	} else if err != ErrAddressBookUnknown {
+		return AddressBook{}, err
+	}
+	modseq, err := acc.NextModSeq(tx)
+	if err != nil {
+		return AddressBook{}, fmt.Errorf("assigning next modseq: %v", err)
+	}
+	ab := AddressBook{Name: name, DisplayName: displayName, Description: description, ModSeq: modseq}
+	if err := tx.Insert(&ab); err != nil {
+		return AddressBook{}, err
+	}
+	return ab, nil
+}
+
+// AddressBookUpdate stores changes to the display name and description of an
+// address book.
+func AddressBookUpdate(tx *bstore.Tx, acc *Account, ab *AddressBook) error {
+	modseq, err := acc.NextModSeq(tx)
+	if err != nil {
+		return fmt.Errorf("assigning next modseq: %v", err)
+	}
+	ab.ModSeq = modseq
+	return tx.Update(ab)
+}
+
+// AddressBookRemove removes an address book and its contacts.
+func AddressBookRemove(tx *bstore.Tx, name string) error {
+	ab, err := AddressBookGet(tx, name)
+	if err != nil {
+		return err
+	}
+	q := bstore.QueryTx[Contact](tx)
+	q.FilterNonzero(Contact{AddressBookID: ab.ID})
+	if _, err := q.Delete(); err != nil {
+		return fmt.Errorf("removing contacts: %v", err)
+	}
+	return tx.Delete(&ab)
+}
+
+// ContactList returns the contacts in an address book, excluding removed
+// contacts, ordered by name.
+func ContactList(tx *bstore.Tx, addressBookID int64) ([]Contact, error) {
+	q := bstore.QueryTx[Contact](tx)
+	q.FilterNonzero(Contact{AddressBookID: addressBookID})
+	q.FilterEqual("Expunged", false)
+	q.SortAsc("Name")
+	return q.List()
+}
+
+// ContactChanges returns the contacts in an address book that were changed or
+// removed after modseq.
+func ContactChanges(tx *bstore.Tx, addressBookID int64, modseq ModSeq) ([]Contact, error) {
+	q := bstore.QueryTx[Contact](tx)
+	q.FilterNonzero(Contact{AddressBookID: addressBookID})
+	q.FilterGreater("ModSeq", modseq)
+	q.SortAsc("ModSeq")
+	return q.List()
+}
+
+// ContactGet returns a contact by name. Removed contacts are not returned.
+func ContactGet(tx *bstore.Tx, addressBookID int64, name string) (Contact, error) {
+	q := bstore.QueryTx[Contact](tx)
+	q.FilterNonzero(Contact{AddressBookID: addressBookID, Name: name})
+	q.FilterEqual("Expunged", false)
+	c, err := q.Get()
+	if err == bstore.ErrAbsent {
+		return Contact{}, ErrContactUnknown
+	}
+	return c, err
+}
+
+// ContactFindUID returns a contact by its vCard UID. Removed contacts are not
+// returned.
+func ContactFindUID(tx *bstore.Tx, addressBookID int64, uid string) (Contact, error) {
+	q := bstore.QueryTx[Contact](tx)
+	q.FilterNonzero(Contact{AddressBookID: addressBookID, UID: uid})
+	q.FilterEqual("Expunged", false)
+	c, err := q.Get()
+	if err == bstore.ErrAbsent {
+		return Contact{}, ErrContactUnknown
+	}
+	return c, err
+}
+
+// ContactPut adds or replaces a contact in an address book. The vCard is checked
+// and the UID, FN and EMAIL properties are stored with the contact. A contact
+// with the same UID under another name is refused. The address book ModSeq is
+// updated.
+func ContactPut(tx *bstore.Tx, acc *Account, ab *AddressBook, name, vcard string) (c Contact, created bool, rerr error) {
+	if err := CheckContactName(name); err != nil {
+		return Contact{}, false, err
+	}
+	if len(vcard) > ContactMaxSize {
+		return Contact{}, false, fmt.Errorf("%w: larger than maximum size %d bytes", ErrVCard, ContactMaxSize)
+	}
+	vc, err := ParseVCard(vcard)
+	if err != nil {
+		return Contact{}, false, err
+	}
+	uid := vc.Value("UID")
+
+	q := bstore.QueryTx[Contact](tx)
+	q.FilterNonzero(Contact{AddressBookID: ab.ID, Name: name})
+	c, err = q.Get()
+	if err == bstore.ErrAbsent {
+		c = Contact{AddressBookID: ab.ID, Name: name}
+	} else if err != nil {
+		return Contact{}, false, err
+	}
+	created = c.ID == 0 || c.Expunged
+
+	if uid != "" {
+		if oc, err := ContactFindUID(tx, ab.ID, uid); err == nil && oc.Name != name {
+			return Contact{}, false, ErrContactUIDConflict
+		} else if err != nil && err != ErrContactUnknown {
+			return Contact{}, false, err
+		}
+	}
+
+	modseq, err := acc.NextModSeq(tx)
+	if err != nil {
+		return Contact{}, false, fmt.Errorf("assigning next modseq: %v", err)
+	}
+	c.ModSeq = modseq
+	c.Expunged = false
+	c.UID = uid
+	c.FormattedName = vc.Value("FN")
+	c.Emails = vc.Values("EMAIL")
+	c.VCard = vcard
+	c.Updated = time.Now()
+	if c.ID == 0 {
+		err = tx.Insert(&c)
+	} else {
+		err = tx.Update(&c)
+	}
+	if err != nil {
+		return Contact{}, false, err
+	}
+
+	ab.ModSeq = modseq
+	if err := tx.Update(ab); err != nil {
+		return Contact{}, false, fmt.Errorf("updating address book: %v", err)
+	}
+	return c, created, nil
+}
+
+// ContactRemove marks a contact as removed, keeping a tombstone for
+// synchronization. The address book ModSeq is updated.
+func ContactRemove(tx *bstore.Tx, acc *Account, ab *AddressBook, name string) error {
+	c, err := ContactGet(tx, ab.ID, name)
+	if err != nil {
+		return err
+	}
+	modseq, err := acc.NextModSeq(tx)
+	if err != nil {
+		return fmt.Errorf("assigning next modseq: %v", err)
+	}
+	c = Contact{ID: c.ID, AddressBookID: c.AddressBookID, Name: c.Name, ModSeq: modseq, Expunged: true, Updated: time.Now()}
+	if err := tx.Update(&c); err != nil {
+		return err
+	}
+	ab.ModSeq = modseq
+	return tx.Update(ab)
+}
+
+// ContactAddress is an email address with name from a contact, for completing
+// recipient addresses.
+type ContactAddress struct {
+	Name    string
+	Address smtp.Address
+}
+
+// ContactAddresses returns the email addresses of contacts in all address books
+// that contain search (lower case) in their name or address. At most max
+// addresses are returned, more is true if there were more matches.
+func ContactAddresses(tx *bstore.Tx, search string, max int) (l []ContactAddress, more bool, rerr error) {
+	seen := map[smtp.Address]bool{}
+	q := bstore.QueryTx[Contact](tx)
+	q.FilterEqual("Expunged", false)
+	q.SortAsc("FormattedName")
+	err := q.ForEach(func(c Contact) error {
+		nameMatch := strings.Contains(strings.ToLower(c.FormattedName), search)
+		for _, s := range c.Emails {
+			addr, err := smtp.ParseAddress(s)
+			if err != nil || seen[addr] {
+				continue
+			}
+			if !nameMatch && !strings.Contains(strings.ToLower(addr.String()), search) {
+				continue
+			}
+			if len(l) >= max {
+				more = true
+				return bstore.StopForEach
+			}
+			seen[addr] = true
+			l = append(l, ContactAddress{c.FormattedName, addr})
+		}
+		return nil
+	})
+	return l, more, err
+}
+
+// VCardProperty is a content line of a vCard. ../rfc/6350:363
+type VCardProperty struct {
+	Group  string // Optional, before the dot in the property name.
+	Name   string // Upper case.
+	Params string // Raw parameters, without leading semicolon.
+	Value  string // Raw value, not unescaped.
+}
+
+// VCard is a parsed vCard, with only its properties. Nested vCards are not
+// supported.
+type VCard struct {
+	Properties []VCardProperty
+}
+
+// ParseVCard parses a single vCard, unfolding lines. It checks for the BEGIN and
+// END lines, and that properties are syntactically valid.
+func ParseVCard(s string) (*VCard, error) {
+	// Unfold, lines starting with whitespace continue the previous line. ../rfc/6350:318
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	s = strings.ReplaceAll(s, "\n ", "")
+	s = strings.ReplaceAll(s, "\n\t", "")
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+
+	if len(lines) < 2 || !strings.EqualFold(lines[0], "BEGIN:VCARD") || !strings.EqualFold(lines[len(lines)-1], "END:VCARD") {
+		return nil, fmt.Errorf("%w: must start with BEGIN:VCARD and end with END:VCARD", ErrVCard)
+	}
+	vc := &VCard{}
+	for i, line := range lines[1 : len(lines)-1] {
+		if line == "" {
+			continue
+		}
+		// Find the colon separating name and parameters from the value. Parameter values
+		// can be quoted and contain colons.
+		var quoted bool
+		colon := -1
+		for j, c := range line {
+			if c == '"' {
+				quoted = !quoted
+			} else if c == ':' && !quoted {
+				colon = j
+				break
+			}
+		}
+		if colon <= 0 {
+			return nil, fmt.Errorf("%w: line %d: missing colon", ErrVCard, i+2)
+		}
+		name, params, _ := strings.Cut(line[:colon], ";")
+		var group string
+		if g, n, ok := strings.Cut(name, "."); ok {
+			group, name = g, n
+		}
+		for _, c := range name {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return nil, fmt.Errorf("%w: line %d: invalid property name %q", ErrVCard, i+2, name)
+			}
+		}
+		if strings.EqualFold(name, "BEGIN") || strings.EqualFold(name, "END") {
+			return nil, fmt.Errorf("%w: line %d: nested vcards not supported", ErrVCard, i+2)
+		}
+		vc.Properties = append(vc.Properties, VCardProperty{group, strings.ToUpper(name), params, line[colon+1:]})
+	}
+	return vc, nil
+}
+
+// Values returns the unescaped text values of all properties with name (upper
+// case).
+func (vc *VCard) Values(name string) []string {
+	var l []string
+	for _, p := range vc.Properties {
+		if p.Name == name {
+			l = append(l, vcardUnescape(p.Value))
+		}
+	}
+	return l
+}
+
+// Value returns the first unescaped text value of a property, or the empty
+// string.
+func (vc *VCard) Value(name string) string {
+	for _, p := range vc.Properties {
+		if p.Name == name {
+			return vcardUnescape(p.Value)
+		}
+	}
+	return ""
+}
+
+// vcardUnescape returns a text value with backslash escapes removed. ../rfc/6350:571
+func vcardUnescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+			if s[i] == 'n' || s[i] == 'N' {
+				b.WriteByte('\n')
+			} else {
+				b.WriteByte(s[i])
+			}
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
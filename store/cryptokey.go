@@ -0,0 +1,397 @@
+package store
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/pgpmime"
+	"github.com/mjl-/mox/smime"
+)
+
+// CryptoKind is a mechanism for signing and encrypting messages.
+type CryptoKind string
+
+const (
+	CryptoSMIME   CryptoKind = "smime"
+	CryptoOpenPGP CryptoKind = "openpgp"
+)
+
+// CryptoKey is a private key of the account, for signing outgoing messages and
+// decrypting incoming messages in webmail, with S/MIME or OpenPGP.
+//
+// Private keys are stored without passphrase protection in the account
+// database, like the DKIM private keys in the configuration directory. Keys
+// protected with a passphrase are decrypted during import.
+type CryptoKey struct {
+	ID          int64
+	Created     time.Time  `bstore:"nonzero,default now"`
+	Kind        CryptoKind `bstore:"nonzero"`
+	Fingerprint string     `bstore:"nonzero,unique"` // Hex SHA-256 of the certificate for S/MIME, key fingerprint for OpenPGP.
+	Addresses   []string   // Email addresses from the certificate or key, in lower case.
+	Description string     // Certificate subject for S/MIME, user ID for OpenPGP.
+	NotAfter    time.Time  // Expiration of the S/MIME certificate. Zero for OpenPGP.
+	PrivateKey  []byte     `bstore:"nonzero" json:"-"` // PEM private key and certificate chain for S/MIME, binary private key for OpenPGP.
+	PublicKey   []byte     `bstore:"nonzero" json:"-"` // PEM certificate chain for S/MIME, binary public key for OpenPGP.
+}
+
+// Sources of a PeerKey.
+const (
+	PeerKeySourceImport    = "import"
+	PeerKeySourceAutocrypt = "autocrypt"
+	PeerKeySourceSignature = "signature"
+)
+
+// PeerKey is a public key of a correspondent, for encrypting messages to them,
+// and for verifying their OpenPGP signatures. A key is stored for each address
+// of a certificate or OpenPGP key. Keys are imported by the user, or learned from
+// Autocrypt headers (OpenPGP) and from the certificates in valid signatures
+// (S/MIME) of messages opened in webmail.
+type PeerKey struct {
+	ID            int64
+	Updated       time.Time  `bstore:"nonzero,default now"`
+	Kind          CryptoKind `bstore:"nonzero,unique Kind+Address"`
+	Address       string     `bstore:"nonzero"` // In lower case.
+	Fingerprint   string     `bstore:"nonzero"` // As for CryptoKey.
+	Source        string     // PeerKeySourceImport, PeerKeySourceAutocrypt or PeerKeySourceSignature.
+	PreferEncrypt bool       // From Autocrypt header.
+	MessageTime   time.Time  // For learned keys, Date of the message the key was learned from.
+	PublicKey     []byte     `bstore:"nonzero" json:"-"` // DER certificate for S/MIME, binary public key for OpenPGP.
+}
+
+var (
+	ErrCryptoKeyUnknown = errors.New("no such key")
+	ErrCryptoKeyExists  = errors.New("key already present")
+	ErrCryptoKeyInvalid = errors.New("invalid key")
+)
+
+// CertificateFingerprint returns the fingerprint of an S/MIME certificate, as
+// used for CryptoKey and PeerKey.
+func CertificateFingerprint(cert *x509.Certificate) string {
+	h := sha256.Sum256(cert.Raw)
+	return strings.ToUpper(hex.EncodeToString(h[:]))
+}
+
+// SMIME returns the parsed private key and certificate chain of an S/MIME key.
+func (k CryptoKey) SMIME() (crypto.Signer, []*x509.Certificate, error) {
+	return smime.ParseKey(k.PrivateKey)
+}
+
+// OpenPGP returns the parsed private key of an OpenPGP key.
+func (k CryptoKey) OpenPGP() (*pgpmime.Key, error) {
+	return pgpmime.ReadPrivateKey(k.PrivateKey, "")
+}
+
+// PublicKeyText returns the public key in text form, for sharing with
+// correspondents: PEM certificates for S/MIME, an ASCII-armored key for OpenPGP.
+func (k CryptoKey) PublicKeyText() (string, error) {
+	if k.Kind == CryptoOpenPGP {
+		return pgpmime.Armor(k.PublicKey, false)
+	}
+	return string(k.PublicKey), nil
+}
+
+// CryptoKeyImport parses and adds a private key. For S/MIME, data must be PEM
+// with the private key and the certificate chain. For OpenPGP, data must be a
+// single private key, binary or ASCII-armored, passphrase is used to decrypt a
+// protected key.
+func CryptoKeyImport(tx *bstore.Tx, kind CryptoKind, data []byte, passphrase string) (CryptoKey, error) {
+	var k CryptoKey
+	switch kind {
+	case CryptoSMIME:
+		key, certs, err := smime.ParseKey(data)
+		if err != nil {
+			return CryptoKey{}, fmt.Errorf("%w: %v", ErrCryptoKeyInvalid, err)
+		}
+		// Store only the PEM blocks we need.
+		pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return CryptoKey{}, fmt.Errorf("marshal private key: %v", err)
+		}
+		var priv, pub bytes.Buffer
+		if err := pem.Encode(&priv, &pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}); err != nil {
+			return CryptoKey{}, fmt.Errorf("pem-encoding private key: %v", err)
+		}
+		for _, c := range certs {
+			if err := pem.Encode(&pub, &pem.Block{Type: "CERTIFICATE", Bytes: c.Raw}); err != nil {
+				return CryptoKey{}, fmt.Errorf("pem-encoding certificate: %v", err)
+			}
+		}
+		priv.Write(pub.Bytes())
+		k = CryptoKey{
+			Kind:        kind,
+			Fingerprint: CertificateFingerprint(certs[0]),
+			Addresses:   smime.Addresses(certs[0]),
+			Description: certs[0].Subject.String(),
+			NotAfter:    certs[0].NotAfter,
+			PrivateKey:  priv.Bytes(),
+			PublicKey:   pub.Bytes(),
+		}
+
+	case CryptoOpenPGP:
+		e, err := pgpmime.ReadPrivateKey(data, passphrase)
+		if err != nil {
+			return CryptoKey{}, fmt.Errorf("%w: %v", ErrCryptoKeyInvalid, err)
+		}
+		k, err = openpgpCryptoKey(e)
+		if err != nil {
+			return CryptoKey{}, err
+		}
+
+	default:
+		return CryptoKey{}, fmt.Errorf("%w: unknown kind %q", ErrCryptoKeyInvalid, kind)
+	}
+	if len(k.Addresses) == 0 {
+		return CryptoKey{}, fmt.Errorf("%w: no email addresses in key", ErrCryptoKeyInvalid)
+	}
+
+	exists, err := bstore.QueryTx[CryptoKey](tx).FilterNonzero(CryptoKey{Fingerprint: k.Fingerprint}).Exists()
+	if err != nil {
+		return CryptoKey{}, err
+	} else if exists {
+		return CryptoKey{}, ErrCryptoKeyExists
+	}
+	if err := tx.Insert(&k); err != nil {
+		return CryptoKey{}, err
+	}
+	return k, nil
+}
+
+func openpgpCryptoKey(pk *pgpmime.Key) (CryptoKey, error) {
+	priv, err := pk.SerializePrivate()
+	if err != nil {
+		return CryptoKey{}, fmt.Errorf("serializing private key: %v", err)
+	}
+	pub, err := pk.SerializePublic()
+	if err != nil {
+		return CryptoKey{}, fmt.Errorf("serializing public key: %v", err)
+	}
+	return CryptoKey{
+		Kind:        CryptoOpenPGP,
+		Fingerprint: pk.Fingerprint(),
+		Addresses:   pk.Addresses(),
+		Description: pk.Name(),
+		PrivateKey:  priv,
+		PublicKey:   pub,
+	}, nil
+}
+
+// CryptoKeyGenerate generates and adds a new OpenPGP key for name and address.
+func CryptoKeyGenerate(tx *bstore.Tx, name, address string) (CryptoKey, error) {
+	e, err := pgpmime.GenerateKey(name, address, 3072, time.Now())
+	if err != nil {
+		return CryptoKey{}, fmt.Errorf("generating key: %v", err)
+	}
+	k, err := openpgpCryptoKey(e)
+	if err != nil {
+		return CryptoKey{}, err
+	}
+	if err := tx.Insert(&k); err != nil {
+		return CryptoKey{}, err
+	}
+	return k, nil
+}
+
+// CryptoKeyList returns the private keys of the account, oldest first.
+func CryptoKeyList(tx *bstore.Tx) ([]CryptoKey, error) {
+	return bstore.QueryTx[CryptoKey](tx).SortAsc("ID").List()
+}
+
+// CryptoKeyFind returns the most recently added key of kind for address, or nil
+// if there is none.
+func CryptoKeyFind(tx *bstore.Tx, kind CryptoKind, address string) (*CryptoKey, error) {
+	address = strings.ToLower(address)
+	q := bstore.QueryTx[CryptoKey](tx)
+	q.FilterNonzero(CryptoKey{Kind: kind})
+	q.FilterFn(func(k CryptoKey) bool {
+		return slices.Contains(k.Addresses, address)
+	})
+	q.SortDesc("ID")
+	q.Limit(1)
+	k, err := q.Get()
+	if err == bstore.ErrAbsent {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+// CryptoKeyRemove removes a private key. Messages encrypted for it can no longer
+// be decrypted.
+func CryptoKeyRemove(tx *bstore.Tx, id int64) error {
+	k := CryptoKey{ID: id}
+	if err := tx.Delete(&k); err == bstore.ErrAbsent {
+		return ErrCryptoKeyUnknown
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Certificate returns the parsed certificate of an S/MIME peer key.
+func (pk PeerKey) Certificate() (*x509.Certificate, error) {
+	return x509.ParseCertificate(pk.PublicKey)
+}
+
+// OpenPGP returns the parsed public key of an OpenPGP peer key.
+func (pk PeerKey) OpenPGP() (*pgpmime.Key, error) {
+	l, err := pgpmime.ReadKeys(pk.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(l) != 1 {
+		return nil, fmt.Errorf("got %d keys, expected 1", len(l))
+	}
+	return l[0], nil
+}
+
+// PeerKeysFromCertificate returns peer keys for each address in the
+// certificate.
+func PeerKeysFromCertificate(cert *x509.Certificate, source string, msgTime time.Time) []PeerKey {
+	var l []PeerKey
+	for _, addr := range smime.Addresses(cert) {
+		l = append(l, PeerKey{Kind: CryptoSMIME, Address: addr, Fingerprint: CertificateFingerprint(cert), Source: source, MessageTime: msgTime, PublicKey: cert.Raw})
+	}
+	return l
+}
+
+// PeerKeysFromOpenPGP returns peer keys for each address of the OpenPGP key.
+func PeerKeysFromOpenPGP(pk *pgpmime.Key, source string, msgTime time.Time) ([]PeerKey, error) {
+	pub, err := pk.SerializePublic()
+	if err != nil {
+		return nil, fmt.Errorf("serializing public key: %v", err)
+	}
+	var l []PeerKey
+	for _, addr := range pk.Addresses() {
+		l = append(l, PeerKey{Kind: CryptoOpenPGP, Address: addr, Fingerprint: pk.Fingerprint(), Source: source, MessageTime: msgTime, PublicKey: pub})
+	}
+	return l, nil
+}
+
+// PeerKeyImport parses public keys and stores them as peer keys, replacing any
+// existing key for the same address. For S/MIME, data must be one or more
+// certificates, PEM or DER. For OpenPGP, data must be one or more public keys,
+// binary or ASCII-armored.
+func PeerKeyImport(tx *bstore.Tx, kind CryptoKind, data []byte) ([]PeerKey, error) {
+	var l []PeerKey
+	switch kind {
+	case CryptoSMIME:
+		var certs []*x509.Certificate
+		if bytes.Contains(data, []byte("-----BEGIN")) {
+			for {
+				var b *pem.Block
+				b, data = pem.Decode(data)
+				if b == nil {
+					break
+				}
+				if b.Type != "CERTIFICATE" {
+					continue
+				}
+				cert, err := x509.ParseCertificate(b.Bytes)
+				if err != nil {
+					return nil, fmt.Errorf("%w: parsing certificate: %v", ErrCryptoKeyInvalid, err)
+				}
+				certs = append(certs, cert)
+			}
+		} else {
+			cert, err := x509.ParseCertificate(data)
+			if err != nil {
+				return nil, fmt.Errorf("%w: parsing certificate: %v", ErrCryptoKeyInvalid, err)
+			}
+			certs = append(certs, cert)
+		}
+		for _, cert := range certs {
+			l = append(l, PeerKeysFromCertificate(cert, PeerKeySourceImport, time.Time{})...)
+		}
+
+	case CryptoOpenPGP:
+		el, err := pgpmime.ReadKeys(data)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCryptoKeyInvalid, err)
+		}
+		for _, e := range el {
+			xl, err := PeerKeysFromOpenPGP(e, PeerKeySourceImport, time.Time{})
+			if err != nil {
+				return nil, err
+			}
+			l = append(l, xl...)
+		}
+
+	default:
+		return nil, fmt.Errorf("%w: unknown kind %q", ErrCryptoKeyInvalid, kind)
+	}
+	if len(l) == 0 {
+		return nil, fmt.Errorf("%w: no keys with email addresses", ErrCryptoKeyInvalid)
+	}
+	for i := range l {
+		if _, err := PeerKeySave(tx, &l[i]); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// PeerKeySave stores a peer key, replacing an existing key for the same kind and
+// address. A learned key does not replace a key learned from a more recent
+// message, or an imported key for a different key. Returns whether the key was
+// stored.
+func PeerKeySave(tx *bstore.Tx, pk *PeerKey) (bool, error) {
+	pk.Address = strings.ToLower(pk.Address)
+	pk.Updated = time.Now()
+	opk, err := PeerKeyGet(tx, pk.Kind, pk.Address)
+	if err != nil {
+		return false, err
+	}
+	if opk == nil {
+		return true, tx.Insert(pk)
+	}
+	if pk.Source != PeerKeySourceImport {
+		if opk.Source == PeerKeySourceImport && opk.Fingerprint != pk.Fingerprint || pk.MessageTime.Before(opk.MessageTime) {
+			return false, nil
+		}
+		if opk.Fingerprint == pk.Fingerprint && opk.PreferEncrypt == pk.PreferEncrypt && opk.Source == pk.Source {
+			// Prevent needless writes for each message.
+			return false, nil
+		}
+	}
+	pk.ID = opk.ID
+	return true, tx.Update(pk)
+}
+
+// PeerKeyGet returns the peer key of kind for address, or nil if there is none.
+func PeerKeyGet(tx *bstore.Tx, kind CryptoKind, address string) (*PeerKey, error) {
+	pk, err := bstore.QueryTx[PeerKey](tx).FilterNonzero(PeerKey{Kind: kind, Address: strings.ToLower(address)}).Get()
+	if err == bstore.ErrAbsent {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &pk, nil
+}
+
+// PeerKeyList returns all peer keys, ordered by address.
+func PeerKeyList(tx *bstore.Tx) ([]PeerKey, error) {
+	return bstore.QueryTx[PeerKey](tx).SortAsc("Address", "Kind").List()
+}
+
+// PeerKeyRemove removes a peer key.
+func PeerKeyRemove(tx *bstore.Tx, id int64) error {
+	pk := PeerKey{ID: id}
+	if err := tx.Delete(&pk); err == bstore.ErrAbsent {
+		return ErrCryptoKeyUnknown
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
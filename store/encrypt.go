@@ -0,0 +1,852 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/message"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/moxio"
+)
+
+// Message files of an account can be encrypted at rest, enabled with
+// EncryptMessages in the account configuration.
+//
+// Each account with encryption has a key pair (X25519). Message files are
+// encrypted with the public key, so messages can be delivered at any time. The
+// private key, the master key, is stored in the account database, sealed with a
+// key derived from the account password with scrypt. It is unsealed by a login
+// with the password in plain text (e.g. webmail/account login, IMAP/SMTP
+// PLAIN/LOGIN), and then kept in memory until mox restarts. Until then, the
+// account is locked and reading messages fails with ErrAccountLocked. Logins with
+// SCRAM-*, CRAM-MD5, app passwords or OAuth tokens don't have the password and
+// cannot unlock an account.
+//
+// The key pair is created on the first password login or password change after
+// enabling encryption. Only the account password seals and unlocks the key, not
+// passwords verified by an external authentication backend, which can change
+// without mox knowing the old password. New deliveries are encrypted, existing
+// messages are encrypted with EncryptMessages ("mox encryptmessages").
+//
+// The account database is a single bbolt file that must be readable and writable
+// for deliveries while the account is locked, so it is encrypted per field: The
+// parsed message (Message.ParsedBuf, with the envelope with addresses, subject and
+// message-id, and the MIME structure with file names) is encrypted with the public
+// key, like message files. Message.MessageID and Message.SubjectBase are stored as
+// SHA-256 hashes (with the public key), so deliveries can still be matched to
+// threads. Messages of accounts with a key are not added to the full-text index,
+// it would reveal the message contents. Other data in the database remains in
+// plain text, it is needed while the account is locked: For reputation analysis
+// of incoming messages, the SMTP envelope and message From addresses, remote IPs,
+// EHLO and DKIM domains of earlier deliveries (also in the trace headers in
+// Message.MsgPrefix), their junk flags, and the recipient addresses of sent
+// messages. Also the message sizes and times, flags and keywords, mailbox names,
+// and account settings. The junk filter has its own database, with words of
+// trained messages.
+//
+// An encrypted message file starts with a magic value and an ephemeral X25519
+// public key. The key for the file is derived with HKDF-SHA256 from the shared
+// secret with the account public key. The contents follow as chunks, each
+// encrypted with AES-256-GCM, allowing random access for IMAP partial fetches.
+// The nonce is the chunk number, the additional data indicates whether the chunk
+// is the last, so truncated files are detected. Encrypted database fields are
+// similar, but with a different magic value, followed by the account public key
+// for finding the key to decrypt, and a single encrypted chunk.
+
+// EncryptionKey is the key pair for encrypting messages of the account. An
+// account has at most one, with ID 1.
+type EncryptionKey struct {
+	ID        int64
+	Created   time.Time `bstore:"nonzero,default now"`
+	PublicKey []byte    `bstore:"nonzero"` // X25519.
+
+	// Private key, encrypted with AES-256-GCM using a key derived from the account
+	// password with scrypt and Salt. The nonce is prepended.
+	SealedKey []byte `bstore:"nonzero" json:"-"`
+	Salt      []byte `bstore:"nonzero" json:"-"`
+}
+
+// ErrAccountLocked is returned when reading an encrypted message file of an
+// account whose key has not been unlocked by a login with the account password.
+var ErrAccountLocked = errors.New("account is locked, encrypted messages can be read after logging in with the account password")
+
+const (
+	encMagic      = "\x00moxenc\x01"
+	encHeaderSize = len(encMagic) + 32 // Magic and ephemeral public key.
+	encChunkSize  = 64 * 1024          // Plain text bytes per chunk, except for the last chunk.
+	encTagSize    = 16                 // AES-GCM overhead per chunk.
+
+	encFieldMagic      = "\x00moxdbenc\x01"
+	encFieldHeaderSize = len(encFieldMagic) + 32 + 32 // Magic, account and ephemeral public key.
+
+	encHashPrefix = "sha256:" // Of hashed Message-ID and base subject values.
+
+	// Parameters for deriving the key that seals the private key from the password.
+	// The key is only derived when unlocking or changing the password.
+	encScryptN = 1 << 15
+	encScryptR = 8
+	encScryptP = 1
+)
+
+// Private keys of unlocked accounts. Keyed by account name.
+var unlockedKeys = struct {
+	sync.Mutex
+	m map[string]*ecdh.PrivateKey
+}{
+	m: map[string]*ecdh.PrivateKey{},
+}
+
+func unlockedKey(accountName string) *ecdh.PrivateKey {
+	unlockedKeys.Lock()
+	defer unlockedKeys.Unlock()
+	return unlockedKeys.m[accountName]
+}
+
+func encryptionKeyGet(tx *bstore.Tx) (*EncryptionKey, error) {
+	k := EncryptionKey{ID: 1}
+	if err := tx.Get(&k); err == bstore.ErrAbsent {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("get encryption key: %v", err)
+	}
+	return &k, nil
+}
+
+func passwordKeyAEAD(password string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(password), salt, encScryptN, encScryptR, encScryptP, 32)
+	if err != nil {
+		return nil, fmt.Errorf("deriving key from password: %v", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealKey sets the sealed private key in k, with a key derived from password.
+func sealKey(k *EncryptionKey, priv *ecdh.PrivateKey, password string) error {
+	salt := make([]byte, 16)
+	if _, err := cryptorand.Read(salt); err != nil {
+		return fmt.Errorf("generating salt: %v", err)
+	}
+	aead, err := passwordKeyAEAD(password, salt)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := cryptorand.Read(nonce); err != nil {
+		return fmt.Errorf("generating nonce: %v", err)
+	}
+	k.Salt = salt
+	k.SealedKey = aead.Seal(nonce, nonce, priv.Bytes(), k.PublicKey)
+	return nil
+}
+
+func openKey(k EncryptionKey, password string) (*ecdh.PrivateKey, error) {
+	aead, err := passwordKeyAEAD(password, k.Salt)
+	if err != nil {
+		return nil, err
+	}
+	ns := aead.NonceSize()
+	if len(k.SealedKey) < ns {
+		return nil, fmt.Errorf("sealed key too short")
+	}
+	buf, err := aead.Open(nil, k.SealedKey[:ns], k.SealedKey[ns:], k.PublicKey)
+	if err != nil {
+		return nil, ErrUnknownCredentials
+	}
+	priv, err := ecdh.X25519().NewPrivateKey(buf)
+	if err != nil {
+		return nil, fmt.Errorf("parsing private key: %v", err)
+	}
+	if !bytes.Equal(priv.PublicKey().Bytes(), k.PublicKey) {
+		return nil, fmt.Errorf("private key does not match public key")
+	}
+	return priv, nil
+}
+
+// encryptionKeySet seals the private key of the account with a new password, or
+// creates a new key pair if the account does not have one yet and create is set.
+// Called when the password is changed. If the account has a key that is locked,
+// an error is returned, the messages would become unreadable.
+func (a *Account) encryptionKeySet(log mlog.Log, tx *bstore.Tx, password string, create bool) error {
+	k, err := encryptionKeyGet(tx)
+	if err != nil {
+		return err
+	}
+	var priv *ecdh.PrivateKey
+	if k == nil {
+		if !create {
+			return nil
+		}
+		priv, err = ecdh.X25519().GenerateKey(cryptorand.Reader)
+		if err != nil {
+			return fmt.Errorf("generating key: %v", err)
+		}
+		k = &EncryptionKey{ID: 1, PublicKey: priv.PublicKey().Bytes()}
+		if err := sealKey(k, priv, password); err != nil {
+			return err
+		}
+		if err := tx.Insert(k); err != nil {
+			return fmt.Errorf("inserting encryption key: %v", err)
+		}
+		log.Info("created key for encrypting message files", slog.String("account", a.Name))
+	} else {
+		priv = unlockedKey(a.Name)
+		if priv == nil || !bytes.Equal(priv.PublicKey().Bytes(), k.PublicKey) {
+			return fmt.Errorf("%w: the current password is needed for the key of encrypted messages", ErrAccountLocked)
+		}
+		if err := sealKey(k, priv, password); err != nil {
+			return err
+		}
+		if err := tx.Update(k); err != nil {
+			return fmt.Errorf("updating encryption key: %v", err)
+		}
+	}
+
+	unlockedKeys.Lock()
+	unlockedKeys.m[a.Name] = priv
+	unlockedKeys.Unlock()
+	return nil
+}
+
+// unlock makes the private key of the account available for reading encrypted
+// messages, after a successful login with password. If encryption is enabled but
+// the account has no key yet, it is created. Errors are logged, the login
+// continues.
+func (a *Account) unlock(log mlog.Log, password string) {
+	conf, _ := a.Conf()
+
+	var k *EncryptionKey
+	err := a.DB.Read(context.TODO(), func(tx *bstore.Tx) error {
+		var err error
+		k, err = encryptionKeyGet(tx)
+		return err
+	})
+	if err != nil {
+		log.Errorx("get encryption key for unlocking account", err, slog.String("account", a.Name))
+		return
+	}
+	if k == nil {
+		if !conf.EncryptMessages {
+			return
+		}
+		err := a.DB.Write(context.TODO(), func(tx *bstore.Tx) error {
+			return a.encryptionKeySet(log, tx, password, true)
+		})
+		log.Check(err, "creating encryption key for account", slog.String("account", a.Name))
+		return
+	}
+	if priv := unlockedKey(a.Name); priv != nil && bytes.Equal(priv.PublicKey().Bytes(), k.PublicKey) {
+		return
+	}
+	if err := EncryptionKeyUnlock(*k, a.Name, password); err != nil {
+		log.Errorx("unlocking key for encrypted messages, account remains locked", err, slog.String("account", a.Name))
+	} else {
+		log.Info("account unlocked for reading encrypted messages", slog.String("account", a.Name))
+	}
+}
+
+// EncryptionKeyGet returns the key for encrypting message files in the account
+// database, or nil if the account has no key.
+func EncryptionKeyGet(ctx context.Context, db *bstore.DB) (k *EncryptionKey, rerr error) {
+	rerr = db.Read(ctx, func(tx *bstore.Tx) error {
+		k, rerr = encryptionKeyGet(tx)
+		return rerr
+	})
+	return
+}
+
+// EncryptionKeyUnlock unseals the private key of k with the account password,
+// making encrypted message files of the account readable within this process,
+// e.g. for an export from the command-line. ErrUnknownCredentials is returned for
+// a wrong password.
+func EncryptionKeyUnlock(k EncryptionKey, accountName, password string) error {
+	priv, err := openKey(k, password)
+	if err != nil {
+		return err
+	}
+	unlockedKeys.Lock()
+	unlockedKeys.m[accountName] = priv
+	unlockedKeys.Unlock()
+	return nil
+}
+
+func keyAEAD(label string, shared, ephemeralPub, accountPub []byte) (cipher.AEAD, error) {
+	info := append(append([]byte(label), ephemeralPub...), accountPub...)
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, nil, info), key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealField encrypts a database field value for the account public key pub. The
+// sealed value starts with a magic value, the account public key (to find the
+// private key for opening) and an ephemeral X25519 public key, followed by the
+// AES-256-GCM encrypted value. The key is only used once, so the nonce is zero.
+func sealField(pub, value []byte) ([]byte, error) {
+	accountPub, err := ecdh.X25519().NewPublicKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("parsing account public key: %v", err)
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(cryptorand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generating ephemeral key: %v", err)
+	}
+	shared, err := ephemeral.ECDH(accountPub)
+	if err != nil {
+		return nil, fmt.Errorf("key agreement: %v", err)
+	}
+	ephemeralPub := ephemeral.PublicKey().Bytes()
+	aead, err := keyAEAD("mox database field", shared, ephemeralPub, pub)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 0, encFieldHeaderSize+len(value)+encTagSize)
+	buf = append(append(append(buf, encFieldMagic...), pub...), ephemeralPub...)
+	return aead.Seal(buf, make([]byte, aead.NonceSize()), value, nil), nil
+}
+
+func isSealedField(buf []byte) bool {
+	return bytes.HasPrefix(buf, []byte(encFieldMagic))
+}
+
+// openField returns the plain text for a database field value. Values that
+// aren't sealed are returned as is. If the key of the account that sealed the
+// value is not unlocked, ErrAccountLocked is returned.
+func openField(buf []byte) ([]byte, error) {
+	if !isSealedField(buf) {
+		return buf, nil
+	}
+	if len(buf) < encFieldHeaderSize+encTagSize {
+		return nil, fmt.Errorf("encrypted database field too short")
+	}
+	o := len(encFieldMagic)
+	accountPub := buf[o : o+32]
+	ephemeralPubBuf := buf[o+32 : encFieldHeaderSize]
+
+	var priv *ecdh.PrivateKey
+	unlockedKeys.Lock()
+	for _, k := range unlockedKeys.m {
+		if bytes.Equal(k.PublicKey().Bytes(), accountPub) {
+			priv = k
+			break
+		}
+	}
+	unlockedKeys.Unlock()
+	if priv == nil {
+		return nil, ErrAccountLocked
+	}
+
+	ephemeralPub, err := ecdh.X25519().NewPublicKey(ephemeralPubBuf)
+	if err != nil {
+		return nil, fmt.Errorf("parsing ephemeral public key: %v", err)
+	}
+	shared, err := priv.ECDH(ephemeralPub)
+	if err != nil {
+		return nil, fmt.Errorf("key agreement: %v", err)
+	}
+	aead, err := keyAEAD("mox database field", shared, ephemeralPubBuf, accountPub)
+	if err != nil {
+		return nil, err
+	}
+	value, err := aead.Open(nil, make([]byte, aead.NonceSize()), buf[encFieldHeaderSize:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting database field: %v", err)
+	}
+	return value, nil
+}
+
+// threadHashKey returns the public key of the account for hashing Message-ID and
+// base subject values, or nil if the account has no key. Hashing depends on the
+// presence of the key, not on the EncryptMessages setting, so all messages
+// delivered since the key was created can be matched.
+func threadHashKey(tx *bstore.Tx) ([]byte, error) {
+	k, err := encryptionKeyGet(tx)
+	if err != nil || k == nil {
+		return nil, err
+	}
+	return k.PublicKey, nil
+}
+
+// threadHash returns the value of a Message-ID or base subject as stored in the
+// database. With a key, this is a SHA-256 hash of the key and value, so messages
+// can be matched for threading without storing the value in plain text. Values
+// that are already hashed, and empty values, are returned as is.
+func threadHash(key []byte, s string) string {
+	if key == nil || s == "" || strings.HasPrefix(s, encHashPrefix) {
+		return s
+	}
+	h := sha256.New()
+	h.Write(key)
+	h.Write([]byte(s))
+	return encHashPrefix + base64.RawStdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// HashThreadValue returns the value of a Message-ID or base subject as stored in
+// Message.MessageID or Message.SubjectBase, for comparing against a value from a
+// message header. For accounts with a key for encrypting messages, the stored
+// value is a hash.
+func HashThreadValue(tx *bstore.Tx, s string) (string, error) {
+	key, err := threadHashKey(tx)
+	if err != nil {
+		return "", err
+	}
+	return threadHash(key, s), nil
+}
+
+// MarshalPart returns the value for Message.ParsedBuf for p: its JSON encoding,
+// encrypted if the account has encryption enabled.
+func (a *Account) MarshalPart(tx *bstore.Tx, p message.Part) ([]byte, error) {
+	buf, err := json.Marshal(p)
+	if err != nil {
+		return nil, fmt.Errorf("marshal parsed message: %v", err)
+	}
+	if conf, _ := a.Conf(); !conf.EncryptMessages {
+		return buf, nil
+	}
+	k, err := encryptionKeyGet(tx)
+	if err != nil || k == nil {
+		return buf, err
+	}
+	return sealField(k.PublicKey, buf)
+}
+
+func chunkNonce(nonce []byte, chunk int64) []byte {
+	clear(nonce)
+	binary.BigEndian.PutUint64(nonce, uint64(chunk))
+	return nonce
+}
+
+func chunkAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// writeEncryptedMessageFile creates a new file at path with the contents of src,
+// of size bytes, encrypted for the account public key pub.
+func writeEncryptedMessageFile(log mlog.Log, path string, pub []byte, src io.ReaderAt, size int64, sync bool) (rerr error) {
+	accountPub, err := ecdh.X25519().NewPublicKey(pub)
+	if err != nil {
+		return fmt.Errorf("parsing account public key: %v", err)
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(cryptorand.Reader)
+	if err != nil {
+		return fmt.Errorf("generating ephemeral key: %v", err)
+	}
+	shared, err := ephemeral.ECDH(accountPub)
+	if err != nil {
+		return fmt.Errorf("key agreement: %v", err)
+	}
+	ephemeralPub := ephemeral.PublicKey().Bytes()
+	aead, err := keyAEAD("mox message file", shared, ephemeralPub, pub)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0660)
+	if err != nil {
+		return fmt.Errorf("create message file: %w", err)
+	}
+	defer func() {
+		if f != nil {
+			err := f.Close()
+			log.Check(err, "closing partial encrypted message file")
+		}
+		if rerr != nil {
+			err := os.Remove(path)
+			log.Check(err, "removing partial encrypted message file", slog.String("path", path))
+		}
+	}()
+
+	if _, err := f.Write(append([]byte(encMagic), ephemeralPub...)); err != nil {
+		return fmt.Errorf("writing header: %v", err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	buf := make([]byte, encChunkSize)
+	sealed := make([]byte, 0, encChunkSize+encTagSize)
+	var off, chunk int64
+	for {
+		n := min(size-off, encChunkSize)
+		if nr, err := src.ReadAt(buf[:n], off); int64(nr) != n {
+			return fmt.Errorf("reading message: %v", err)
+		}
+		off += n
+		last := off == size
+		sealed = aead.Seal(sealed[:0], chunkNonce(nonce, chunk), buf[:n], chunkAD(last))
+		if _, err := f.Write(sealed); err != nil {
+			return fmt.Errorf("writing message file: %v", err)
+		}
+		if last {
+			break
+		}
+		chunk++
+	}
+	if sync {
+		if err := f.Sync(); err != nil {
+			return fmt.Errorf("sync message file: %v", err)
+		}
+	}
+	err = f.Close()
+	f = nil
+	return err
+}
+
+// encryptedContentSize returns the size of the plain text contents for an
+// encrypted file of fileSize bytes.
+func encryptedContentSize(fileSize int64) (int64, error) {
+	n := fileSize - int64(encHeaderSize)
+	if n < encTagSize {
+		return 0, fmt.Errorf("encrypted message file too small")
+	}
+	full := n / (encChunkSize + encTagSize)
+	rem := n % (encChunkSize + encTagSize)
+	if rem == 0 {
+		return full * encChunkSize, nil
+	} else if rem < encTagSize {
+		return 0, fmt.Errorf("encrypted message file with truncated chunk")
+	}
+	return full*encChunkSize + rem - encTagSize, nil
+}
+
+func isEncryptedFile(f *os.File) (bool, error) {
+	buf := make([]byte, len(encMagic))
+	if _, err := f.ReadAt(buf, 0); err == io.EOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return string(buf) == encMagic, nil
+}
+
+// MessageFileSize returns the size of the message contents in the on-disk message
+// file at path, i.e. without encryption overhead. A message size is the length of
+// its MsgPrefix plus this size. The key is not needed for encrypted files.
+func MessageFileSize(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if enc, err := isEncryptedFile(f); err != nil {
+		return 0, err
+	} else if !enc {
+		return st.Size(), nil
+	}
+	return encryptedContentSize(st.Size())
+}
+
+// encryptedReader is an io.ReaderAt for the plain text contents of an encrypted
+// message file. The last decrypted chunk is kept.
+type encryptedReader struct {
+	f       *os.File
+	aead    cipher.AEAD
+	size    int64 // Of plain text.
+	nchunks int64
+	nonce   []byte
+	sealed  []byte
+	chunk   int64 // Chunk in buf, -1 if none.
+	buf     []byte
+}
+
+// newMessageFileReader returns a reader for the contents of an on-disk message
+// file, decrypting if needed with the unlocked key of the account.
+func newMessageFileReader(f *os.File, accountName string) (io.ReaderAt, error) {
+	if enc, err := isEncryptedFile(f); err != nil {
+		return nil, err
+	} else if !enc {
+		return f, nil
+	}
+	priv := unlockedKey(accountName)
+	if accountName == "" || priv == nil {
+		return nil, ErrAccountLocked
+	}
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size, err := encryptedContentSize(st.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	ephemeralPubBuf := make([]byte, encHeaderSize-len(encMagic))
+	if _, err := f.ReadAt(ephemeralPubBuf, int64(len(encMagic))); err != nil {
+		return nil, fmt.Errorf("reading header: %v", err)
+	}
+	ephemeralPub, err := ecdh.X25519().NewPublicKey(ephemeralPubBuf)
+	if err != nil {
+		return nil, fmt.Errorf("parsing ephemeral public key: %v", err)
+	}
+	shared, err := priv.ECDH(ephemeralPub)
+	if err != nil {
+		return nil, fmt.Errorf("key agreement: %v", err)
+	}
+	aead, err := keyAEAD("mox message file", shared, ephemeralPubBuf, priv.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	nchunks := (size + encChunkSize - 1) / encChunkSize
+	if nchunks == 0 {
+		nchunks = 1
+	}
+	r := &encryptedReader{
+		f:       f,
+		aead:    aead,
+		size:    size,
+		nchunks: nchunks,
+		nonce:   make([]byte, aead.NonceSize()),
+		chunk:   -1,
+	}
+	return r, nil
+}
+
+func (r *encryptedReader) load(chunk int64) error {
+	if chunk == r.chunk {
+		return nil
+	}
+	last := chunk == r.nchunks-1
+	n := int64(encChunkSize)
+	if last {
+		n = r.size - chunk*encChunkSize
+	}
+	if r.sealed == nil {
+		r.sealed = make([]byte, encChunkSize+encTagSize)
+		r.buf = make([]byte, 0, encChunkSize)
+	}
+	sealed := r.sealed[:n+encTagSize]
+	if _, err := r.f.ReadAt(sealed, int64(encHeaderSize)+chunk*(encChunkSize+encTagSize)); err != nil {
+		return fmt.Errorf("reading encrypted message file: %v", err)
+	}
+	r.chunk = -1
+	buf, err := r.aead.Open(r.buf[:0], chunkNonce(r.nonce, chunk), sealed, chunkAD(last))
+	if err != nil {
+		return fmt.Errorf("decrypting message file: %v", err)
+	}
+	r.buf = buf
+	r.chunk = chunk
+	return nil
+}
+
+// ReadAt reads the plain text, with semantics like os.File.ReadAt.
+func (r *encryptedReader) ReadAt(p []byte, off int64) (int, error) {
+	var o int
+	for o < len(p) {
+		if off >= r.size {
+			return o, io.EOF
+		}
+		chunk := off / encChunkSize
+		if err := r.load(chunk); err != nil {
+			return o, err
+		}
+		n := copy(p[o:], r.buf[off-chunk*encChunkSize:])
+		o += n
+		off += int64(n)
+	}
+	return o, nil
+}
+
+// MessageTempFile returns a new temporary file with the contents of the on-disk
+// message file of m, without MsgPrefix, decrypted if needed. For delivering a copy
+// of a message to another account, which may not have the same key. The caller
+// must close and remove the file.
+func (a *Account) MessageTempFile(log mlog.Log, m Message) (rf *os.File, rerr error) {
+	f, err := os.Open(a.MessagePath(m.ID))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err := f.Close()
+		log.Check(err, "closing message file")
+	}()
+	r, err := newMessageFileReader(f, a.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	tf, err := CreateMessageTemp(log, "copy")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if rerr != nil {
+			CloseRemoveTempFile(log, tf, "copy of message")
+		}
+	}()
+	if _, err := io.Copy(tf, io.NewSectionReader(r, 0, m.Size-int64(len(m.MsgPrefix)))); err != nil {
+		return nil, fmt.Errorf("copying message: %v", err)
+	}
+	return tf, nil
+}
+
+// EncryptMessages encrypts the existing messages of the account that are still in
+// plain text, e.g. delivered before encryption was enabled: Message files and
+// parsed messages in the database are encrypted, Message-ID and base subject are
+// replaced with hashes, and the full-text index is removed. Only the public key
+// is needed, the account does not have to be unlocked. Returns the number of
+// encrypted files and updated messages in the database.
+func (a *Account) EncryptMessages(ctx context.Context, log mlog.Log) (nfiles, nmessages int, rerr error) {
+	k, err := EncryptionKeyGet(ctx, a.DB)
+	if err != nil {
+		return 0, 0, err
+	} else if k == nil {
+		return 0, 0, fmt.Errorf("account has no key for encrypting message files yet, it is created at the next login with password or password change when encryption is enabled")
+	}
+
+	// Words of messages indexed before the key was created.
+	err = a.DB.Write(ctx, func(tx *bstore.Tx) error {
+		return textIndexClear(tx)
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	const batchSize = 100
+	var lastID int64
+	for {
+		var l []Message
+		err := a.DB.Read(ctx, func(tx *bstore.Tx) error {
+			q := bstore.QueryTx[Message](tx)
+			q.FilterEqual("Expunged", false)
+			q.FilterGreater("ID", lastID)
+			q.SortAsc("ID")
+			q.Limit(batchSize)
+			var err error
+			l, err = q.List()
+			return err
+		})
+		if err != nil {
+			return nfiles, nmessages, fmt.Errorf("listing messages: %v", err)
+		}
+		for _, m := range l {
+			lastID = m.ID
+			var encrypted bool
+			// Files of expunged messages are removed with the write lock held.
+			a.WithRLock(func() {
+				encrypted, err = a.encryptMessageFile(ctx, log, k.PublicKey, m)
+			})
+			if err != nil {
+				return nfiles, nmessages, fmt.Errorf("encrypting message file for message %d: %v", m.ID, err)
+			}
+			if encrypted {
+				nfiles++
+			}
+		}
+
+		err = a.DB.Write(ctx, func(tx *bstore.Tx) error {
+			for _, m := range l {
+				// Message may have been expunged in the mean time.
+				if err := tx.Get(&m); err == bstore.ErrAbsent || err == nil && m.Expunged {
+					continue
+				} else if err != nil {
+					return err
+				}
+				if isSealedField(m.ParsedBuf) && threadHash(k.PublicKey, m.MessageID) == m.MessageID && threadHash(k.PublicKey, m.SubjectBase) == m.SubjectBase {
+					continue
+				}
+				if m.ParsedBuf != nil && !isSealedField(m.ParsedBuf) {
+					var err error
+					m.ParsedBuf, err = sealField(k.PublicKey, m.ParsedBuf)
+					if err != nil {
+						return fmt.Errorf("encrypting parsed message: %v", err)
+					}
+				}
+				m.MessageID = threadHash(k.PublicKey, m.MessageID)
+				m.SubjectBase = threadHash(k.PublicKey, m.SubjectBase)
+				if err := tx.Update(&m); err != nil {
+					return fmt.Errorf("updating message: %v", err)
+				}
+				nmessages++
+			}
+			return nil
+		})
+		if err != nil {
+			return nfiles, nmessages, fmt.Errorf("encrypting messages in database: %v", err)
+		}
+
+		if len(l) < batchSize {
+			break
+		}
+	}
+	return nfiles, nmessages, nil
+}
+
+// encryptMessageFile replaces the message file of m, if it isn't encrypted yet.
+// Must be called with account rlock held.
+func (a *Account) encryptMessageFile(ctx context.Context, log mlog.Log, pub []byte, m Message) (bool, error) {
+	// Message may have been expunged in the mean time.
+	if err := a.DB.Get(ctx, &m); err == bstore.ErrAbsent || err == nil && m.Expunged {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	p := a.MessagePath(m.ID)
+	f, err := os.Open(p)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		err := f.Close()
+		log.Check(err, "closing message file")
+	}()
+	if enc, err := isEncryptedFile(f); err != nil {
+		return false, err
+	} else if enc {
+		return false, nil
+	}
+	st, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	// Write to a new file and rename it into place. Readers with the old file open
+	// can continue reading.
+	tmpPath := p + ".encrypt"
+	if err := writeEncryptedMessageFile(log, tmpPath, pub, f, st.Size(), true); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmpPath, p); err != nil {
+		xerr := os.Remove(tmpPath)
+		log.Check(xerr, "removing encrypted message file after rename error", slog.String("path", tmpPath))
+		return false, err
+	}
+	if err := moxio.SyncDir(log, filepath.Dir(p)); err != nil {
+		return false, fmt.Errorf("sync directory: %v", err)
+	}
+	return true, nil
+}
@@ -0,0 +1,334 @@
+package store
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/mox-"
+)
+
+func TestEncrypt(t *testing.T) {
+	os.RemoveAll("../testdata/store/data")
+	mox.ConfigStaticPath = filepath.FromSlash("../testdata/store/mox.conf")
+	mox.MustLoadConfig(true, false)
+	acc, err := OpenAccount(pkglog, "mjl")
+	tcheck(t, err, "open account")
+	defer func() {
+		err := acc.Close()
+		tcheck(t, err, "closing account")
+		acc.CheckClosed()
+	}()
+	defer Switchboard()()
+
+	defer func() {
+		unlockedKeys.Lock()
+		delete(unlockedKeys.m, acc.Name)
+		unlockedKeys.Unlock()
+	}()
+
+	const password = "test1234"
+
+	// Sizes around chunk boundaries.
+	sizes := []int{0, 1, encChunkSize - 1, encChunkSize, encChunkSize + 1, 3*encChunkSize + 100}
+	makeMsg := func(size int) string {
+		msg := "Subject: test\r\n\r\n"
+		for len(msg) < size {
+			msg += "0123456789abcdef"
+		}
+		return msg[:max(size, len("Subject: test\r\n\r\n"))]
+	}
+
+	deliver := func(msg string) Message {
+		t.Helper()
+		msgFile, err := CreateMessageTemp(pkglog, "mox-test-encrypt")
+		tcheck(t, err, "create temp")
+		defer CloseRemoveTempFile(pkglog, msgFile, "test message")
+		_, err = msgFile.Write([]byte(msg))
+		tcheck(t, err, "write message")
+		m := Message{Received: time.Now(), Size: int64(len(msg)), MsgPrefix: []byte("X-Prefix: 1\r\n")}
+		m.Size += int64(len(m.MsgPrefix))
+		acc.WithWLock(func() {
+			err = acc.DeliverMailbox(pkglog, "Inbox", &m, msgFile)
+		})
+		tcheck(t, err, "deliver")
+		return m
+	}
+
+	readMsg := func(m Message) (string, error) {
+		mr := acc.MessageReader(m)
+		defer mr.Close()
+		buf, err := io.ReadAll(mr)
+		return string(buf), err
+	}
+
+	isEncrypted := func(m Message) bool {
+		t.Helper()
+		f, err := os.Open(acc.MessagePath(m.ID))
+		tcheck(t, err, "open message file")
+		defer f.Close()
+		enc, err := isEncryptedFile(f)
+		tcheck(t, err, "checking for encrypted file")
+		return enc
+	}
+
+	// Message delivered before enabling encryption.
+	plainMsg := makeMsg(100)
+	mplain := deliver(plainMsg)
+
+	// Enable encryption, setting a password creates the key.
+	conf, _ := acc.Conf()
+	conf.EncryptMessages = true
+	mox.Conf.Dynamic.Accounts[acc.Name] = conf
+	err = acc.SetPassword(pkglog, password)
+	tcheck(t, err, "set password")
+	k, err := EncryptionKeyGet(ctxbg, acc.DB)
+	tcheck(t, err, "get key")
+	if k == nil {
+		t.Fatalf("no key after setting password")
+	}
+
+	var msgs []Message
+	for _, size := range sizes {
+		msg := makeMsg(size)
+		m := deliver(msg)
+		msgs = append(msgs, m)
+		if !isEncrypted(m) {
+			t.Fatalf("message file not encrypted")
+		}
+		if size, err := MessageFileSize(acc.MessagePath(m.ID)); err != nil || size != int64(len(msg)) {
+			t.Fatalf("message file size %d, %v, expected %d", size, err, len(msg))
+		}
+		if s, err := readMsg(m); err != nil || s != string(m.MsgPrefix)+msg {
+			t.Fatalf("reading message, err %v, got size %d, expected %d", err, len(s), len(m.MsgPrefix)+len(msg))
+		}
+	}
+
+	// Random access.
+	m := msgs[len(msgs)-1]
+	mr := acc.MessageReader(m)
+	buf := make([]byte, 200)
+	off := int64(len(m.MsgPrefix) + encChunkSize - 100)
+	n, err := mr.ReadAt(buf, off)
+	tcheck(t, err, "readat")
+	if n != len(buf) || string(buf) != (string(m.MsgPrefix) + makeMsg(sizes[len(sizes)-1]))[off:off+200] {
+		t.Fatalf("readat across chunks, bad data")
+	}
+	mr.Close()
+
+	// Messages are not in the full-text index.
+	err = acc.DB.Read(ctxbg, func(tx *bstore.Tx) error {
+		return tx.Get(&m)
+	})
+	tcheck(t, err, "get message")
+	if m.TextIndexed {
+		t.Fatalf("encrypted message added to full-text index")
+	}
+
+	// The parsed message in the database is encrypted, Message-ID and base subject
+	// are hashed.
+	mroot := deliver("Message-ID: <root@mox.example>\r\nSubject: thread test\r\n\r\nbody\r\n")
+	err = acc.DB.Get(ctxbg, &mroot)
+	tcheck(t, err, "get message")
+	if !isSealedField(mroot.ParsedBuf) || bytes.Contains(mroot.ParsedBuf, []byte("thread test")) {
+		t.Fatalf("parsed message not encrypted in database")
+	}
+	if mroot.MessageID != threadHash(k.PublicKey, "root@mox.example") || mroot.SubjectBase != threadHash(k.PublicKey, "thread test") {
+		t.Fatalf("message-id %q and subject base %q not hashed", mroot.MessageID, mroot.SubjectBase)
+	}
+	err = acc.DB.Read(ctxbg, func(tx *bstore.Tx) error {
+		if s, err := HashThreadValue(tx, "root@mox.example"); err != nil || s != mroot.MessageID {
+			t.Fatalf("hash thread value, got %q, %v, expected %q", s, err, mroot.MessageID)
+		}
+		return nil
+	})
+	tcheck(t, err, "read")
+	if p, err := mroot.LoadPart(nil); err != nil || p.Envelope == nil || p.Envelope.Subject != "thread test" {
+		t.Fatalf("load part of encrypted parsed message, err %v", err)
+	}
+
+	// Lock the account, messages cannot be read.
+	unlockedKeys.Lock()
+	delete(unlockedKeys.m, acc.Name)
+	unlockedKeys.Unlock()
+	if _, err := readMsg(msgs[1]); !errors.Is(err, ErrAccountLocked) {
+		t.Fatalf("reading message of locked account, got err %v, expected ErrAccountLocked", err)
+	}
+	// Plain text messages can still be read.
+	if s, err := readMsg(mplain); err != nil || s != string(mplain.MsgPrefix)+plainMsg {
+		t.Fatalf("reading plain text message: %v", err)
+	}
+	// Messages can still be delivered.
+	mlocked := deliver(makeMsg(10))
+	if !isEncrypted(mlocked) {
+		t.Fatalf("message not encrypted while locked")
+	}
+	// Parsed messages cannot be read.
+	if _, err := mroot.LoadPart(nil); !errors.Is(err, ErrAccountLocked) {
+		t.Fatalf("load part of locked account, got err %v, expected ErrAccountLocked", err)
+	}
+	mr = acc.MessageReader(mroot)
+	if _, err := mroot.LoadPart(mr); !errors.Is(err, ErrAccountLocked) {
+		t.Fatalf("load part with reader of locked account, got err %v, expected ErrAccountLocked", err)
+	}
+	mr.Close()
+	// New messages are still matched to threads, by message-id and subject.
+	mreply := deliver("Message-ID: <reply@mox.example>\r\nIn-Reply-To: <root@mox.example>\r\nSubject: Re: thread test\r\n\r\nbody\r\n")
+	msubject := deliver("Subject: Re: thread test\r\n\r\nbody\r\n")
+	if mreply.ThreadID != mroot.ThreadID || msubject.ThreadID != mroot.ThreadID {
+		t.Fatalf("messages delivered while locked not in thread %d, got %d and %d", mroot.ThreadID, mreply.ThreadID, msubject.ThreadID)
+	}
+	// Changing the password would make messages unreadable.
+	if err := acc.SetPassword(pkglog, "other1234"); !errors.Is(err, ErrAccountLocked) {
+		t.Fatalf("set password for locked account, got err %v, expected ErrAccountLocked", err)
+	}
+
+	// Login with bad password, still locked.
+	_, err = OpenEmailAuth(pkglog, "mjl@mox.example", "bad password", "")
+	if !errors.Is(err, ErrUnknownCredentials) {
+		t.Fatalf("login with bad password, got err %v", err)
+	}
+	if unlockedKey(acc.Name) != nil {
+		t.Fatalf("account unlocked with bad password")
+	}
+
+	// Login with password unlocks.
+	xacc, err := OpenEmailAuth(pkglog, "mjl@mox.example", password, "")
+	tcheck(t, err, "login")
+	err = xacc.Close()
+	tcheck(t, err, "close account")
+	if _, err := readMsg(msgs[1]); err != nil {
+		t.Fatalf("reading message after unlock: %v", err)
+	}
+
+	// Change password, and unlock with new password.
+	err = acc.SetPassword(pkglog, "other1234")
+	tcheck(t, err, "set password")
+	k, err = EncryptionKeyGet(ctxbg, acc.DB)
+	tcheck(t, err, "get key")
+	unlockedKeys.Lock()
+	delete(unlockedKeys.m, acc.Name)
+	unlockedKeys.Unlock()
+	if err := EncryptionKeyUnlock(*k, acc.Name, password); !errors.Is(err, ErrUnknownCredentials) {
+		t.Fatalf("unlock with old password, got err %v", err)
+	}
+	err = EncryptionKeyUnlock(*k, acc.Name, "other1234")
+	tcheck(t, err, "unlock with new password")
+	if _, err := readMsg(msgs[1]); err != nil {
+		t.Fatalf("reading message after unlock: %v", err)
+	}
+
+	// Passwords verified by an external authentication backend don't unlock, they can
+	// change in the backend at any time.
+	script := filepath.Join(t.TempDir(), "auth.sh")
+	writeScript := func(extPassword string) {
+		t.Helper()
+		err := os.WriteFile(script, []byte("#!/bin/sh\nread email\nread password\n[ \"$password\" = "+extPassword+" ]\n"), 0700)
+		tcheck(t, err, "write auth script")
+	}
+	writeScript("external1")
+	mox.Conf.Static.ExternalAuth = &config.ExternalAuth{Exec: &config.ExecAuth{Command: []string{"/bin/sh", script}}, LocalPasswords: true}
+	unlockedKeys.Lock()
+	delete(unlockedKeys.m, acc.Name)
+	unlockedKeys.Unlock()
+	testLogin := func(password string) {
+		t.Helper()
+		xacc, err := OpenEmailAuth(pkglog, "mjl@mox.example", password, "")
+		tcheck(t, err, "login")
+		err = xacc.Close()
+		tcheck(t, err, "close account")
+	}
+	testLogin("external1")
+	if unlockedKey(acc.Name) != nil {
+		t.Fatalf("account unlocked with external password")
+	}
+	// Password changed in external backend.
+	writeScript("external2")
+	testLogin("external2")
+	if unlockedKey(acc.Name) != nil {
+		t.Fatalf("account unlocked with external password")
+	}
+	// The account password still unlocks.
+	testLogin("other1234")
+	if _, err := readMsg(msgs[1]); err != nil {
+		t.Fatalf("reading message after unlock: %v", err)
+	}
+	mox.Conf.Static.ExternalAuth = nil
+
+	// Tampering is detected.
+	p := acc.MessagePath(mlocked.ID)
+	orig, err := os.ReadFile(p)
+	tcheck(t, err, "read message file")
+	tampered := bytes.Clone(orig)
+	tampered[len(tampered)-1] ^= 1
+	err = os.Remove(p)
+	tcheck(t, err, "remove message file")
+	err = os.WriteFile(p, tampered, 0660)
+	tcheck(t, err, "write message file")
+	if _, err := readMsg(mlocked); err == nil {
+		t.Fatalf("reading tampered message file succeeded")
+	}
+	err = os.WriteFile(p, orig, 0660)
+	tcheck(t, err, "write message file")
+
+	// Encrypt the existing plain text message, and remove it from the full-text index.
+	encFiles, encMsgs, err := acc.EncryptMessages(ctxbg, pkglog)
+	tcheck(t, err, "encrypt messages")
+	if encFiles != 1 || encMsgs != 1 || !isEncrypted(mplain) {
+		t.Fatalf("encrypting existing messages, got %d files and %d messages, expected 1 and 1", encFiles, encMsgs)
+	}
+	if s, err := readMsg(mplain); err != nil || s != string(mplain.MsgPrefix)+plainMsg {
+		t.Fatalf("reading encrypted message: %v", err)
+	}
+	err = acc.DB.Get(ctxbg, &mplain)
+	tcheck(t, err, "get message")
+	if !isSealedField(mplain.ParsedBuf) || mplain.SubjectBase != threadHash(k.PublicKey, "test") || mplain.TextIndexed {
+		t.Fatalf("existing message not encrypted in database")
+	}
+	if n, err := bstore.QueryDB[TextWord](ctxbg, acc.DB).Count(); err != nil || n != 0 {
+		t.Fatalf("full-text index has %d words, err %v, expected none", n, err)
+	}
+
+	err = acc.CheckConsistency()
+	tcheck(t, err, "check consistency")
+
+	// Export decrypts.
+	var zipbuf bytes.Buffer
+	archiver := ZipArchiver{zip.NewWriter(&zipbuf)}
+	err = ExportMessages(ctxbg, pkglog, acc.DB, acc.Dir, archiver, true, "", true)
+	tcheck(t, err, "export")
+	err = archiver.Close()
+	tcheck(t, err, "close archiver")
+	zr, err := zip.NewReader(bytes.NewReader(zipbuf.Bytes()), int64(zipbuf.Len()))
+	tcheck(t, err, "open zip")
+	var nfiles int
+	for _, f := range zr.File {
+		if f.Name == "errors.txt" {
+			t.Fatalf("export has errors")
+		}
+		if strings.HasSuffix(f.Name, "/") || !strings.Contains(f.Name, "/cur/") && !strings.Contains(f.Name, "/new/") {
+			continue
+		}
+		nfiles++
+		r, err := f.Open()
+		tcheck(t, err, "open file in zip")
+		buf, err := io.ReadAll(r)
+		tcheck(t, err, "read file in zip")
+		// Maildir files have bare newlines.
+		if !bytes.HasPrefix(buf, []byte("X-Prefix: 1\n")) || !bytes.Contains(buf, []byte("Subject: ")) {
+			t.Fatalf("exported message %s not decrypted", f.Name)
+		}
+	}
+	if nfiles != len(sizes)+5 {
+		t.Fatalf("exported %d messages, expected %d", nfiles, len(sizes)+5)
+	}
+}
@@ -129,6 +129,10 @@ func (a *MboxArchiver) Close() error {
 // Some errors are not fatal and result in skipped messages. In that happens, a
 // file "errors.txt" is added to the archive describing the errors. The goal is to
 // let users export (hopefully) most messages even in the face of errors.
+//
+// Encrypted message files are decrypted with the key of the account, named after
+// the last path element of accountDir, which must be unlocked, e.g. with
+// EncryptionKeyUnlock.
 func ExportMessages(ctx context.Context, log mlog.Log, db *bstore.DB, accountDir string, archiver Archiver, maildir bool, mailboxOpt string, recursive bool) error {
 	// todo optimize: should prepare next file to add to archive (can be an mbox with many messages) while writing a file to the archive (which typically compresses, which takes time).
 
@@ -301,16 +305,22 @@ func exportMailbox(log mlog.Log, tx *bstore.Tx, accountDir string, mailboxID int
 				err := mf.Close()
 				log.Check(err, "closing message file after export")
 			}()
-			st, err := mf.Stat()
+			fsize, err := MessageFileSize(mp)
 			if err != nil {
 				errors += fmt.Sprintf("stat message file for id %d, path %s: %v (message skipped)\n", m.ID, mp, err)
 				return nil
 			}
-			size := st.Size() + int64(len(m.MsgPrefix))
+			size := fsize + int64(len(m.MsgPrefix))
 			if size != m.Size {
-				errors += fmt.Sprintf("message size mismatch for message id %d, database has %d, size is %d+%d=%d, using calculated size\n", m.ID, m.Size, len(m.MsgPrefix), st.Size(), size)
+				errors += fmt.Sprintf("message size mismatch for message id %d, database has %d, size is %d+%d=%d, using calculated size\n", m.ID, m.Size, len(m.MsgPrefix), fsize, size)
+			}
+			// Decrypts with the key of the account, if unlocked.
+			r, err := newMessageFileReader(mf, filepath.Base(accountDir))
+			if err != nil {
+				errors += fmt.Sprintf("reading message file for id %d, path %s: %v (message skipped)\n", m.ID, mp, err)
+				return nil
 			}
-			mr = FileMsgReader(m.MsgPrefix, mf)
+			mr = &MsgReader{prefix: m.MsgPrefix, path: mp, size: size, f: mf, r: r}
 		}
 
 		if maildir {
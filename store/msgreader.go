@@ -11,12 +11,14 @@ import (
 // database (typically received headers), followed by the on-disk msg file
 // contents. MsgReader is an io.Reader, io.ReaderAt and io.Closer.
 type MsgReader struct {
-	prefix []byte   // First part of the message. Typically contains received headers.
-	path   string   // To on-disk message file.
-	size   int64    // Total size of message, including prefix and contents from path.
-	offset int64    // Current reading offset.
-	f      *os.File // Opened path, automatically opened after prefix has been read.
-	err    error    // If set, error to return for reads. Sets io.EOF for readers, but ReadAt ignores them.
+	prefix  []byte      // First part of the message. Typically contains received headers.
+	path    string      // To on-disk message file.
+	account string      // Name of account with the message file, for decrypting. Empty for temporary files.
+	size    int64       // Total size of message, including prefix and contents from path.
+	offset  int64       // Current reading offset.
+	f       *os.File    // Opened path, automatically opened after prefix has been read.
+	r       io.ReaderAt // Reads from f, decrypting if needed.
+	err     error       // If set, error to return for reads. Sets io.EOF for readers, but ReadAt ignores them.
 }
 
 var errMsgClosed = errors.New("msg is closed")
@@ -25,7 +27,7 @@ var errMsgClosed = errors.New("msg is closed")
 // If initialization fails, reads will return the error.
 // Only call close on the returned MsgReader if you want to close msgFile.
 func FileMsgReader(prefix []byte, msgFile *os.File) *MsgReader {
-	mr := &MsgReader{prefix: prefix, path: msgFile.Name(), f: msgFile}
+	mr := &MsgReader{prefix: prefix, path: msgFile.Name(), f: msgFile, r: msgFile}
 	fi, err := msgFile.Stat()
 	if err != nil {
 		mr.err = err
@@ -79,8 +81,13 @@ func (m *MsgReader) read(buf []byte, off int64, pread bool) (int, error) {
 				break
 			}
 			m.f = f
+			m.r, err = newMessageFileReader(f, m.account)
+			if err != nil {
+				m.err = err
+				break
+			}
 		}
-		n, err := m.f.ReadAt(buf[o:], off-int64(len(m.prefix)))
+		n, err := m.r.ReadAt(buf[o:], off-int64(len(m.prefix)))
 		if !pread && n > 0 {
 			m.offset += int64(n)
 		}
@@ -7,6 +7,8 @@ import (
 	"unicode"
 	"unicode/utf8"
 
+	"github.com/mjl-/bstore"
+
 	"github.com/mjl-/mox/message"
 	"github.com/mjl-/mox/mlog"
 )
@@ -16,6 +18,10 @@ import (
 type WordSearch struct {
 	words, notWords    [][]byte
 	searchBuf, keepBuf []byte
+
+	// Set by UseIndex. Messages that are indexed but not in candidates can be skipped.
+	index      bool
+	candidates map[int64]struct{}
 }
 
 // PrepareWordSearch returns a search context that can be used to match multiple
@@ -50,7 +56,30 @@ func PrepareWordSearch(words, notWords []string) WordSearch {
 	keepBuf := make([]byte, keep)
 	searchBuf := make([]byte, bufSize)
 
-	return WordSearch{wl, nwl, searchBuf, keepBuf}
+	return WordSearch{words: wl, notWords: nwl, searchBuf: searchBuf, keepBuf: keepBuf}
+}
+
+// UseIndex looks up the messages that can match the search words in the
+// full-text index, for use by IndexMiss. If headerToo is false, only words in
+// bodies are considered.
+func (ws *WordSearch) UseIndex(tx *bstore.Tx, headerToo bool) error {
+	candidates, ok, err := textIndexCandidates(tx, ws.words, headerToo)
+	if err != nil {
+		return err
+	}
+	ws.index = ok
+	ws.candidates = candidates
+	return nil
+}
+
+// IndexMiss returns whether m cannot match the search according to the full-text
+// index, in which case m does not have to be read. Only valid after UseIndex.
+func (ws WordSearch) IndexMiss(m Message) bool {
+	if !ws.index || !m.TextIndexed {
+		return false
+	}
+	_, ok := ws.candidates[m.ID]
+	return !ok
 }
 
 // MatchPart returns whether the part/mail message p matches the search.
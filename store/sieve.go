@@ -0,0 +1,393 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/message"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/sieve"
+)
+
+// SieveScript is a Sieve script for filtering incoming messages. An account can
+// have multiple scripts, but at most one is active. If a script is active, it is
+// evaluated for incoming messages instead of the rulesets of the destination
+// address.
+type SieveScript struct {
+	ID      int64
+	Name    string    `bstore:"nonzero,unique"`
+	Content string    // Script source, syntax checked when stored.
+	Active  bool      `bstore:"index"`
+	Created time.Time `bstore:"nonzero,default now"`
+	Updated time.Time `bstore:"nonzero,default now"`
+}
+
+// VacationReply records when an automatic vacation response was last sent to an
+// address, to limit the number of responses sent to a single sender.
+type VacationReply struct {
+	ID      int64
+	Handle  string    `bstore:"nonzero,index Handle+Address"` // Identifies the vacation response, e.g. from a Sieve "vacation" action.
+	Address string    `bstore:"nonzero"`                      // Lower case address the response was sent to.
+	Sent    time.Time `bstore:"nonzero"`
+}
+
+// SieveScriptMaxSize is the maximum size of a Sieve script in bytes.
+const SieveScriptMaxSize = 64 * 1024
+
+var (
+	ErrSieveScriptUnknown = errors.New("no such sieve script")
+	ErrSieveScriptActive  = errors.New("sieve script is active")
+	ErrSieveScriptExists  = errors.New("sieve script already exists")
+)
+
+// CheckSieveScriptName returns an error if name is not a valid script name.
+func CheckSieveScriptName(name string) error {
+	if name == "" {
+		return errors.New("script name cannot be empty")
+	}
+	if len(name) > 128 {
+		return errors.New("script name too long")
+	}
+	for _, c := range name {
+		// ../rfc/5804:2116
+		if c <= 0x1f || c == 0x7f || c >= 0x80 && c <= 0x9f || c == 0x2028 || c == 0x2029 {
+			return errors.New("control characters not allowed in script name")
+		}
+	}
+	return nil
+}
+
+// SieveScriptCheck parses a script, returning an error if the script is too large
+// or has syntax errors.
+func SieveScriptCheck(content string) (*sieve.Script, error) {
+	if len(content) > SieveScriptMaxSize {
+		return nil, fmt.Errorf("script larger than maximum size %d bytes", SieveScriptMaxSize)
+	}
+	return sieve.Parse(content)
+}
+
+// SieveScriptList returns all scripts, ordered by name.
+func SieveScriptList(tx *bstore.Tx) ([]SieveScript, error) {
+	q := bstore.QueryTx[SieveScript](tx)
+	q.SortAsc("Name")
+	return q.List()
+}
+
+// SieveScriptGet returns a script by name, or ErrSieveScriptUnknown.
+func SieveScriptGet(tx *bstore.Tx, name string) (SieveScript, error) {
+	q := bstore.QueryTx[SieveScript](tx)
+	q.FilterNonzero(SieveScript{Name: name})
+	ss, err := q.Get()
+	if err == bstore.ErrAbsent {
+		return SieveScript{}, ErrSieveScriptUnknown
+	}
+	return ss, err
+}
+
+// SieveScriptSave adds a new script, or replaces the content of an existing
+// script with the same name. The script is parsed first, and not stored if it
+// has errors. If activate is set, the script becomes the active script.
+func SieveScriptSave(tx *bstore.Tx, name, content string, activate bool) (SieveScript, error) {
+	if err := CheckSieveScriptName(name); err != nil {
+		return SieveScript{}, err
+	}
+	if _, err := SieveScriptCheck(content); err != nil {
+		return SieveScript{}, err
+	}
+
+	ss, err := SieveScriptGet(tx, name)
+	if err == ErrSieveScriptUnknown {
+		ss = SieveScript{Name: name, Content: content}
+		if err := tx.Insert(&ss); err != nil {
+			return SieveScript{}, fmt.Errorf("inserting sieve script: %w", err)
+		}
+	} else if err != nil {
+		return SieveScript{}, fmt.Errorf("looking up sieve script: %w", err)
+	} else {
+		ss.Content = content
+		ss.Updated = time.Now()
+		if err := tx.Update(&ss); err != nil {
+			return SieveScript{}, fmt.Errorf("updating sieve script: %w", err)
+		}
+	}
+	if activate {
+		if err := SieveScriptActivate(tx, name); err != nil {
+			return SieveScript{}, err
+		}
+		ss.Active = true
+	}
+	return ss, nil
+}
+
+// SieveScriptActivate makes the script with name the active script. If name is
+// empty, no script will be active and incoming messages are evaluated against the
+// rulesets of the destination again.
+func SieveScriptActivate(tx *bstore.Tx, name string) error {
+	if name != "" {
+		if _, err := SieveScriptGet(tx, name); err != nil {
+			return err
+		}
+	}
+	q := bstore.QueryTx[SieveScript](tx)
+	q.FilterEqual("Active", true)
+	q.FilterNotEqual("Name", name)
+	if _, err := q.UpdateField("Active", false); err != nil {
+		return fmt.Errorf("deactivating sieve scripts: %w", err)
+	}
+	if name == "" {
+		return nil
+	}
+	q = bstore.QueryTx[SieveScript](tx)
+	q.FilterNonzero(SieveScript{Name: name})
+	if _, err := q.UpdateField("Active", true); err != nil {
+		return fmt.Errorf("activating sieve script: %w", err)
+	}
+	return nil
+}
+
+// SieveScriptRename renames a script. The new name must not exist yet.
+func SieveScriptRename(tx *bstore.Tx, oldName, newName string) error {
+	if err := CheckSieveScriptName(newName); err != nil {
+		return err
+	}
+	ss, err := SieveScriptGet(tx, oldName)
+	if err != nil {
+		return err
+	}
+	if _, err := SieveScriptGet(tx, newName); err == nil {
+		return ErrSieveScriptExists
+	} else if err != ErrSieveScriptUnknown {
+		return err
+	}
+	ss.Name = newName
+	ss.Updated = time.Now()
+	if err := tx.Update(&ss); err != nil {
+		return fmt.Errorf("updating sieve script: %w", err)
+	}
+	return nil
+}
+
+// SieveScriptRemove removes a script. The active script cannot be removed.
+func SieveScriptRemove(tx *bstore.Tx, name string) error {
+	ss, err := SieveScriptGet(tx, name)
+	if err != nil {
+		return err
+	}
+	if ss.Active {
+		return ErrSieveScriptActive
+	}
+	if err := tx.Delete(&ss); err != nil {
+		return fmt.Errorf("removing sieve script: %w", err)
+	}
+	return nil
+}
+
+// SieveEval evaluates the active Sieve script of the account, if any, against an
+// incoming message. If no script is active, a nil result is returned. Errors in
+// the script during evaluation are logged and result in an implicit keep.
+func (a *Account) SieveEval(log mlog.Log, m *Message, msgFile *os.File) (*sieve.Result, error) {
+	var ss SieveScript
+	err := a.DB.Read(context.TODO(), func(tx *bstore.Tx) error {
+		q := bstore.QueryTx[SieveScript](tx)
+		q.FilterEqual("Active", true)
+		var err error
+		ss, err = q.Get()
+		return err
+	})
+	if err == bstore.ErrAbsent {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("looking up active sieve script: %w", err)
+	}
+
+	log = log.With(slog.String("sievescript", ss.Name))
+	keep := &sieve.Result{Keep: true}
+	script, err := sieve.Parse(ss.Content)
+	if err != nil {
+		log.Errorx("parsing active sieve script, delivering to default mailbox", err)
+		return keep, nil
+	}
+
+	mr := FileMsgReader(m.MsgPrefix, msgFile) // We don't close, it would close the msgFile.
+	p, err := message.EnsurePart(log.Logger, false, mr, m.Size)
+	if err != nil {
+		log.Debugx("parsing message for sieve script, continuing", err, slog.String("parse", ""))
+		// note: p is still usable.
+	}
+	sm := sieve.Message{
+		MailFrom: m.MailFrom,
+		Size:     m.Size,
+		Part:     &p,
+	}
+	if m.RcptToLocalpart != "" || m.RcptToDomain != "" {
+		sm.RcptTo = m.RcptToLocalpart.String() + "@" + m.RcptToDomain
+	}
+	r, err := script.Run(sm)
+	if err != nil {
+		log.Infox("evaluating sieve script, delivering to default mailbox", err)
+		return keep, nil
+	}
+	log.Debug("sieve script evaluated",
+		slog.Bool("keep", r.Keep),
+		slog.Any("fileinto", r.FileInto),
+		slog.Any("redirect", r.Redirect),
+		slog.Bool("reject", r.Reject != nil),
+		slog.Bool("vacation", r.Vacation != nil))
+	return &r, nil
+}
+
+// SieveMailbox returns the mailbox a message will be delivered to by the Sieve
+// result: keepMailbox for a keep, or otherwise the mailbox of the first fileinto
+// action. If the message isn't delivered locally, keepMailbox is returned.
+func SieveMailbox(keepMailbox string, r *sieve.Result) string {
+	if !r.Keep && len(r.FileInto) > 0 {
+		if name, _, err := CheckMailboxName(r.FileInto[0].Mailbox, true); err == nil {
+			return name
+		}
+	}
+	return keepMailbox
+}
+
+// DeliverSieve delivers a message to the mailboxes of a Sieve result: to
+// keepMailbox for a keep action, and to the mailboxes of fileinto actions, each
+// with their flags and keywords. Mailboxes are created if needed. If the result
+// has no local deliveries, e.g. due to a discard, nothing is delivered and
+// delivered is false. Redirect, reject and vacation actions are not handled,
+// they are the responsibility of the caller.
+//
+// Fileinto actions with invalid mailbox names deliver to keepMailbox instead.
+// The first delivery is stored in m, other deliveries are copies.
+//
+// Returns ErrOverQuota when account would be over quota after adding message.
+//
+// Caller must hold account wlock (mailbox may be created).
+// Message delivery, possible mailbox creation, and updated mailbox counts are
+// broadcasted.
+func (a *Account) DeliverSieve(log mlog.Log, keepMailbox string, r *sieve.Result, m *Message, msgFile *os.File) (delivered bool, rerr error) {
+	type target struct {
+		mailbox string
+		flags   []string
+	}
+	var targets []target
+	add := func(mailbox string, flags []string) {
+		for _, t := range targets {
+			if strings.EqualFold(t.mailbox, mailbox) {
+				return
+			}
+		}
+		targets = append(targets, target{mailbox, flags})
+	}
+	if r.Keep {
+		add(keepMailbox, r.KeepFlags)
+	}
+	for _, fi := range r.FileInto {
+		name, _, err := CheckMailboxName(fi.Mailbox, true)
+		if err != nil {
+			log.Infox("invalid mailbox in sieve fileinto action, delivering to default mailbox", err, slog.String("mailbox", fi.Mailbox))
+			name = keepMailbox
+		}
+		add(name, fi.Flags)
+	}
+	if len(targets) == 0 {
+		return false, nil
+	}
+
+	orig := *m
+	var changes []Change
+	err := a.DB.Write(context.TODO(), func(tx *bstore.Tx) error {
+		for i, t := range targets {
+			mc := m
+			if i > 0 {
+				nm := orig
+				nm.MailboxDestinedID = 0
+				mc = &nm
+			}
+
+			flags, keywords, err := ParseFlagsKeywords(t.flags)
+			if err != nil {
+				log.Infox("invalid flags from sieve script, ignoring", err, slog.Any("flags", t.flags))
+			} else {
+				mc.Flags = mc.Flags.Set(flags, flags)
+				mc.Keywords = keywords
+			}
+
+			if ok, _, err := a.CanAddMessageSize(tx, mc.Size); err != nil {
+				return err
+			} else if !ok {
+				return ErrOverQuota
+			}
+
+			mb, chl, err := a.MailboxEnsure(tx, t.mailbox, true)
+			if err != nil {
+				return fmt.Errorf("ensuring mailbox: %w", err)
+			}
+			mc.MailboxID = mb.ID
+			mc.MailboxOrigID = mb.ID
+
+			var kwChanged bool
+			mb.Keywords, kwChanged = MergeKeywords(mb.Keywords, mc.Keywords)
+
+			// Update count early, DeliverMessage will update mb too and we don't want to fetch
+			// it again before updating.
+			mb.MailboxCounts.Add(mc.MailboxCounts())
+			if err := tx.Update(&mb); err != nil {
+				return fmt.Errorf("updating mailbox for delivery: %w", err)
+			}
+
+			if err := a.DeliverMessage(log, tx, mc, msgFile, true, false, false, true); err != nil {
+				return err
+			}
+
+			changes = append(changes, chl...)
+			changes = append(changes, mc.ChangeAddUID(), mb.ChangeCounts())
+			if kwChanged {
+				changes = append(changes, mb.ChangeKeywords())
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	BroadcastChanges(a, changes)
+	return true, nil
+}
+
+// VacationReplyAllowed returns whether a vacation response with handle may be
+// sent to address, based on when a response was last sent. If so, the time of
+// the response is recorded.
+func (a *Account) VacationReplyAllowed(handle, address string, interval time.Duration) (allowed bool, rerr error) {
+	address = strings.ToLower(address)
+	err := a.DB.Write(context.TODO(), func(tx *bstore.Tx) error {
+		q := bstore.QueryTx[VacationReply](tx)
+		q.FilterNonzero(VacationReply{Handle: handle, Address: address})
+		vr, err := q.Get()
+		if err == bstore.ErrAbsent {
+			vr = VacationReply{Handle: handle, Address: address}
+		} else if err != nil {
+			return fmt.Errorf("looking up previous vacation reply: %w", err)
+		} else if time.Since(vr.Sent) < interval {
+			return nil
+		}
+		allowed = true
+		vr.Sent = time.Now()
+		if vr.ID == 0 {
+			err = tx.Insert(&vr)
+		} else {
+			err = tx.Update(&vr)
+		}
+		if err != nil {
+			return fmt.Errorf("storing vacation reply: %w", err)
+		}
+		return nil
+	})
+	return allowed, err
+}
@@ -0,0 +1,133 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/message"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/sieve"
+)
+
+func TestSieve(t *testing.T) {
+	log := mlog.New("store", nil)
+	os.RemoveAll("../testdata/store/data")
+	mox.ConfigStaticPath = filepath.FromSlash("../testdata/store/mox.conf")
+	mox.MustLoadConfig(true, false)
+	acc, err := OpenAccount(log, "mjl")
+	tcheck(t, err, "open account")
+	defer func() {
+		err = acc.Close()
+		tcheck(t, err, "closing account")
+		acc.CheckClosed()
+	}()
+	defer Switchboard()()
+
+	// Managing scripts.
+	err = acc.DB.Write(ctxbg, func(tx *bstore.Tx) error {
+		_, err := SieveScriptSave(tx, "bad", "bogus;", false)
+		if err == nil {
+			t.Fatalf("saving bad script succeeded")
+		}
+		_, err = SieveScriptSave(tx, "", "keep;", false)
+		if err == nil {
+			t.Fatalf("saving script without name succeeded")
+		}
+
+		_, err = SieveScriptSave(tx, "a", "keep;", true)
+		tcheck(t, err, "save script")
+		_, err = SieveScriptSave(tx, "b", `require ["fileinto", "imap4flags"]; if header :contains "subject" "list" { fileinto :flags "\\Seen $label1" "Lists"; } elsif header :contains "subject" "spam" { discard; } else { keep; }`, false)
+		tcheck(t, err, "save script")
+
+		err = SieveScriptRemove(tx, "a")
+		if !errors.Is(err, ErrSieveScriptActive) {
+			t.Fatalf("removing active script: got err %v, expected %v", err, ErrSieveScriptActive)
+		}
+		err = SieveScriptActivate(tx, "b")
+		tcheck(t, err, "activate script")
+		err = SieveScriptRemove(tx, "a")
+		tcheck(t, err, "remove script")
+		err = SieveScriptActivate(tx, "a")
+		if !errors.Is(err, ErrSieveScriptUnknown) {
+			t.Fatalf("activating removed script: got err %v, expected %v", err, ErrSieveScriptUnknown)
+		}
+		err = SieveScriptRename(tx, "b", "filter")
+		tcheck(t, err, "rename script")
+
+		l, err := SieveScriptList(tx)
+		tcheck(t, err, "list scripts")
+		if len(l) != 1 || l[0].Name != "filter" || !l[0].Active {
+			t.Fatalf("unexpected scripts %v", l)
+		}
+		return nil
+	})
+	tcheck(t, err, "managing scripts")
+
+	deliver := func(subject string) (*Message, bool) {
+		t.Helper()
+
+		msgFile, err := CreateMessageTemp(log, "sieve-test")
+		tcheck(t, err, "create temp message")
+		defer CloseRemoveTempFile(log, msgFile, "test message")
+		msgWriter := message.NewWriter(msgFile)
+		_, err = msgWriter.Write([]byte("From: <remote@example.org>\r\nSubject: " + subject + "\r\n\r\ntest\r\n"))
+		tcheck(t, err, "write message")
+
+		m := &Message{
+			Received: time.Now(),
+			Size:     msgWriter.Size,
+			MailFrom: "remote@example.org",
+		}
+		conf, _ := acc.Conf()
+		var sr *sieve.Result
+		acc.WithWLock(func() {
+			sr, err = acc.DeliverDestination(log, conf.Destinations["mjl"], m, msgFile)
+		})
+		tcheck(t, err, "deliver")
+		if sr == nil {
+			t.Fatalf("no sieve result for delivery")
+		}
+		return m, m.ID != 0
+	}
+
+	mailboxName := func(m *Message) string {
+		t.Helper()
+		mb := Mailbox{ID: m.MailboxID}
+		err := acc.DB.Get(ctxbg, &mb)
+		tcheck(t, err, "get mailbox")
+		return mb.Name
+	}
+
+	m, ok := deliver("for the list")
+	if !ok || mailboxName(m) != "Lists" || !m.Seen || len(m.Keywords) != 1 || m.Keywords[0] != "$label1" {
+		t.Fatalf("unexpected delivery for fileinto, delivered %v, message %#v", ok, m)
+	}
+
+	m, ok = deliver("hello")
+	if !ok || mailboxName(m) != "Inbox" || m.Seen {
+		t.Fatalf("unexpected delivery for keep, delivered %v, message %#v", ok, m)
+	}
+
+	_, ok = deliver("spam")
+	if ok {
+		t.Fatalf("message delivered for discard")
+	}
+
+	// Vacation responses are sent once per interval.
+	allowed, err := acc.VacationReplyAllowed("handle", "Remote@example.org", time.Hour)
+	tcheck(t, err, "vacation reply allowed")
+	if !allowed {
+		t.Fatalf("first vacation reply not allowed")
+	}
+	allowed, err = acc.VacationReplyAllowed("handle", "remote@example.org", time.Hour)
+	tcheck(t, err, "vacation reply allowed")
+	if allowed {
+		t.Fatalf("second vacation reply allowed")
+	}
+}
@@ -0,0 +1,374 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"unicode"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/message"
+	"github.com/mjl-/mox/mlog"
+)
+
+// The full-text index is an inverted index from words to messages, used to find
+// the candidate messages for word searches (e.g. IMAP SEARCH BODY/TEXT, webmail
+// search) without reading all messages. Search semantics are substring matches,
+// so the index is only used to skip messages that cannot match. Candidates are
+// still matched against the message contents with WordSearch.MatchPart.
+//
+// Words are lower-cased sequences of letters and digits. A search term matches a
+// message only if each of its words is a substring of a word in the message.
+// Words of a single character are not indexed. Long words are indexed as
+// overlapping chunks, and long search words are truncated, so a search word is
+// always contained in a chunk.
+//
+// Messages are indexed on delivery, and have Message.TextIndexed set. Messages
+// that could not be indexed, or were delivered before the index existed, have
+// TextIndexed false and are always read during a search. Command "mox reindex"
+// rebuilds the index for all messages. Accounts with encrypted message files have
+// no index.
+
+const (
+	textWordMax      = 40              // Max number of runes in an indexed word. Longer words are chunked.
+	textWordStep     = 20              // Start offset of consecutive chunks, and max size of search words used for the index.
+	textMessageWords = 20000           // Max distinct words for a message. Messages with more are not indexed.
+	textMessageSize  = 4 * 1024 * 1024 // Max bytes of text read for indexing a message.
+	textIndexMatches = 10000           // Max indexed words containing a search word, beyond which the search word is not used for the index.
+)
+
+// TextWord is a word in the full-text index. Words that no longer occur in any
+// message are only removed when rebuilding the index.
+type TextWord struct {
+	ID   int64
+	Word string `bstore:"nonzero,unique"` // Lower case.
+}
+
+// TextPosting records that a word occurs in a message.
+type TextPosting struct {
+	ID        int64
+	WordID    int64 `bstore:"nonzero,index WordID+MessageID"`
+	MessageID int64 `bstore:"nonzero,index"`
+	Header    bool  // Word occurs in a header section (of the message or a part).
+	Body      bool  // Word occurs in a text body part.
+}
+
+// textWords calls fn for each word in r, lower-cased like WordSearch does.
+// Reading stops with an error after max bytes.
+func textWords(r io.Reader, max *int64, fn func(w string)) error {
+	br := bufio.NewReader(r)
+	var word []rune
+	flush := func() {
+		for i := 0; i < len(word); i += textWordStep {
+			e := min(i+textWordMax, len(word))
+			if e-i > 1 {
+				fn(string(word[i:e]))
+			}
+			if e == len(word) {
+				break
+			}
+		}
+		word = word[:0]
+	}
+	for {
+		c, size, err := br.ReadRune()
+		if err == io.EOF {
+			flush()
+			return nil
+		} else if err != nil {
+			return err
+		}
+		*max -= int64(size)
+		if *max < 0 {
+			return fmt.Errorf("text too large for index")
+		}
+		c = unicode.ToLower(c)
+		if unicode.IsLetter(c) || unicode.IsDigit(c) {
+			word = append(word, c)
+		} else {
+			flush()
+		}
+	}
+}
+
+// textSearchWords returns the words of a (lower-case) search word to look up in
+// the index. Each word is truncated to fit in an indexed chunk.
+func textSearchWords(s string) (l []string) {
+	for _, w := range strings.FieldsFunc(s, func(c rune) bool { return !unicode.IsLetter(c) && !unicode.IsDigit(c) }) {
+		r := []rune(w)
+		if len(r) < 2 {
+			continue
+		}
+		l = append(l, string(r[:min(len(r), textWordStep)]))
+	}
+	return l
+}
+
+const (
+	textInHeader = 1 << iota
+	textInBody
+)
+
+// textPartWords gathers the words for the index from the parts of a message
+// that WordSearch.MatchPart searches.
+func textPartWords(p *message.Part, words map[string]byte, max *int64) error {
+	add := func(in byte) func(w string) {
+		return func(w string) {
+			words[w] |= in
+		}
+	}
+	if err := textWords(p.HeaderReader(), max, add(textInHeader)); err != nil {
+		return err
+	}
+	if len(p.Parts) == 0 && p.MediaType == "TEXT" {
+		if err := textWords(p.ReaderUTF8OrBinary(), max, add(textInBody)); err != nil {
+			return err
+		}
+	}
+	for _, pp := range p.Parts {
+		if pp.Message != nil {
+			if err := pp.SetMessageReaderAt(); err != nil {
+				return err
+			}
+			pp = *pp.Message
+		}
+		if err := textPartWords(&pp, words, max); err != nil {
+			return err
+		}
+	}
+	if len(words) > textMessageWords {
+		return fmt.Errorf("too many words for index")
+	}
+	return nil
+}
+
+// textIndexAdd adds the words of message m, which must have an ID, to the index
+// and sets TextIndexed. Part must have a reader. If the message cannot be indexed,
+// e.g. because it has too much text, it is logged and m is left unindexed.
+//
+// Messages of accounts with a key for encrypting message files are not indexed,
+// the index would reveal the contents.
+func textIndexAdd(log mlog.Log, tx *bstore.Tx, m *Message, part *message.Part) error {
+	if k, err := encryptionKeyGet(tx); err != nil {
+		return err
+	} else if k != nil {
+		return nil
+	}
+
+	words := map[string]byte{}
+	max := int64(textMessageSize)
+	if err := textPartWords(part, words, &max); err != nil {
+		log.Debugx("not adding message to full-text index", err, slog.Int64("msgid", m.ID))
+		return nil
+	}
+
+	for w, in := range words {
+		tw, err := bstore.QueryTx[TextWord](tx).FilterNonzero(TextWord{Word: w}).Get()
+		if err == bstore.ErrAbsent {
+			tw = TextWord{Word: w}
+			err = tx.Insert(&tw)
+		}
+		if err != nil {
+			return fmt.Errorf("looking up or adding word to index: %v", err)
+		}
+		tp := TextPosting{WordID: tw.ID, MessageID: m.ID, Header: in&textInHeader != 0, Body: in&textInBody != 0}
+		if err := tx.Insert(&tp); err != nil {
+			return fmt.Errorf("adding word for message to index: %v", err)
+		}
+	}
+	m.TextIndexed = true
+	if err := tx.Update(m); err != nil {
+		return fmt.Errorf("marking message as indexed: %v", err)
+	}
+	return nil
+}
+
+// TextIndexRemove removes messages from the full-text index, e.g. when they are
+// expunged. TextIndexed is not cleared.
+func TextIndexRemove(tx *bstore.Tx, messageIDs ...int64) error {
+	if len(messageIDs) == 0 {
+		return nil
+	}
+	ids := make([]any, len(messageIDs))
+	for i, id := range messageIDs {
+		ids[i] = id
+	}
+	q := bstore.QueryTx[TextPosting](tx)
+	q.FilterEqual("MessageID", ids...)
+	if _, err := q.Delete(); err != nil {
+		return fmt.Errorf("removing messages from full-text index: %v", err)
+	}
+	return nil
+}
+
+// TextIndexCopy adds postings for a copy of a message to the full-text index.
+// The copy should have TextIndexed set like the original.
+func TextIndexCopy(tx *bstore.Tx, origID, newID int64) error {
+	q := bstore.QueryTx[TextPosting](tx)
+	q.FilterNonzero(TextPosting{MessageID: origID})
+	l, err := q.List()
+	if err != nil {
+		return fmt.Errorf("listing words of message in full-text index: %v", err)
+	}
+	for _, tp := range l {
+		tp.ID = 0
+		tp.MessageID = newID
+		if err := tx.Insert(&tp); err != nil {
+			return fmt.Errorf("adding word for copied message to index: %v", err)
+		}
+	}
+	return nil
+}
+
+// TextIndexUpdate indexes a message again, e.g. after it was parsed again. Part
+// must have a reader.
+func TextIndexUpdate(log mlog.Log, tx *bstore.Tx, m *Message, part *message.Part) error {
+	if err := TextIndexRemove(tx, m.ID); err != nil {
+		return err
+	}
+	m.TextIndexed = false
+	return textIndexAdd(log, tx, m, part)
+}
+
+// textIndexCandidates returns the IDs of indexed messages that may contain all
+// search words. If none of the words can be looked up in the index, ok is false
+// and all messages must be read.
+func textIndexCandidates(tx *bstore.Tx, searchWords [][]byte, headerToo bool) (candidates map[int64]struct{}, ok bool, rerr error) {
+	var parts []string
+	for _, sw := range searchWords {
+		parts = append(parts, textSearchWords(string(sw))...)
+	}
+	if len(parts) == 0 {
+		return nil, false, nil
+	}
+
+	// Find the indexed words that contain each search word.
+	wordIDs := make([][]any, len(parts))
+	err := bstore.QueryTx[TextWord](tx).ForEach(func(tw TextWord) error {
+		for i, p := range parts {
+			if len(wordIDs[i]) <= textIndexMatches && strings.Contains(tw.Word, p) {
+				wordIDs[i] = append(wordIDs[i], tw.ID)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("looking up words in full-text index: %v", err)
+	}
+
+	for i := range parts {
+		if len(wordIDs[i]) > textIndexMatches {
+			continue
+		}
+		msgIDs := map[int64]struct{}{}
+		if len(wordIDs[i]) > 0 {
+			q := bstore.QueryTx[TextPosting](tx)
+			q.FilterEqual("WordID", wordIDs[i]...)
+			if !headerToo {
+				q.FilterEqual("Body", true)
+			}
+			err := q.ForEach(func(tp TextPosting) error {
+				if _, have := candidates[tp.MessageID]; !ok || have {
+					msgIDs[tp.MessageID] = struct{}{}
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, false, fmt.Errorf("looking up messages in full-text index: %v", err)
+			}
+		}
+		candidates = msgIDs
+		ok = true
+	}
+	return candidates, ok, nil
+}
+
+// textIndexClear removes all words from the index, and clears TextIndexed for all
+// messages.
+func textIndexClear(tx *bstore.Tx) error {
+	if _, err := bstore.QueryTx[TextPosting](tx).Delete(); err != nil {
+		return fmt.Errorf("removing words for messages from index: %v", err)
+	}
+	if _, err := bstore.QueryTx[TextWord](tx).Delete(); err != nil {
+		return fmt.Errorf("removing words from index: %v", err)
+	}
+	q := bstore.QueryTx[Message](tx)
+	q.FilterEqual("TextIndexed", true)
+	if _, err := q.UpdateField("TextIndexed", false); err != nil {
+		return fmt.Errorf("clearing indexed state for messages: %v", err)
+	}
+	return nil
+}
+
+// ReindexMessages rebuilds the full-text index for all messages. The index is
+// first cleared, then messages are indexed in batches, so other access to the
+// account is not blocked for too long. Returns the number of messages indexed.
+func (a *Account) ReindexMessages(ctx context.Context, log mlog.Log) (int, error) {
+	// Clear the index and indexed state in a single transaction, so we never have
+	// messages marked as indexed without index entries.
+	err := a.DB.Write(ctx, func(tx *bstore.Tx) error {
+		return textIndexClear(tx)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	const batchSize = 100
+	var total int
+	var lastID int64
+	for {
+		var n int
+		err := a.DB.Write(ctx, func(tx *bstore.Tx) error {
+			q := bstore.QueryTx[Message](tx)
+			q.FilterEqual("Expunged", false)
+			q.FilterGreater("ID", lastID)
+			q.SortAsc("ID")
+			q.Limit(batchSize)
+			l, err := q.List()
+			if err != nil {
+				return fmt.Errorf("listing messages: %v", err)
+			}
+			for _, m := range l {
+				lastID = m.ID
+				n++
+				// Messages delivered in the mean time are already indexed.
+				if m.TextIndexed {
+					continue
+				}
+				if err := a.textIndexMessage(log, tx, &m); err != nil {
+					return err
+				}
+				if m.TextIndexed {
+					total++
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return total, err
+		}
+		if n < batchSize {
+			break
+		}
+	}
+	return total, nil
+}
+
+// textIndexMessage reads message m and adds it to the index.
+func (a *Account) textIndexMessage(log mlog.Log, tx *bstore.Tx, m *Message) error {
+	mr := a.MessageReader(*m)
+	defer func() {
+		err := mr.Close()
+		log.Check(err, "closing message reader after indexing")
+	}()
+	p, err := m.LoadPart(mr)
+	if err != nil {
+		log.Debugx("loading parsed message for index, not indexing", err, slog.Int64("msgid", m.ID))
+		return nil
+	}
+	return textIndexAdd(log, tx, m, &p)
+}
@@ -0,0 +1,116 @@
+package store
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+func TestTextIndex(t *testing.T) {
+	log := mlog.New("store", nil)
+	os.RemoveAll("../testdata/store/data")
+	mox.ConfigStaticPath = filepath.FromSlash("../testdata/store/mox.conf")
+	mox.MustLoadConfig(true, false)
+	acc, err := OpenAccount(log, "mjl")
+	tcheck(t, err, "open account")
+	defer func() {
+		err = acc.Close()
+		tcheck(t, err, "closing account")
+		acc.CheckClosed()
+	}()
+	defer Switchboard()()
+
+	deliver := func(s string) Message {
+		t.Helper()
+		f, err := CreateMessageTemp(log, "account-test")
+		tcheck(t, err, "temp file")
+		defer os.Remove(f.Name())
+		defer f.Close()
+
+		s = strings.ReplaceAll(s, "\n", "\r\n")
+		m := Message{
+			Size:      int64(len(s)),
+			MsgPrefix: []byte(s),
+		}
+		err = acc.DeliverMailbox(log, "Inbox", &m, f)
+		tcheck(t, err, "deliver")
+		if !m.TextIndexed {
+			t.Fatalf("message not indexed")
+		}
+		return m
+	}
+
+	long := strings.Repeat("abcdefghij", 10)
+	m0 := deliver("Subject: Hello World\nContent-Type: text/plain\n\nThe quick brown fox.\n")
+	m1 := deliver("Subject: other\nContent-Type: text/plain\n\nJumps over the lazy dog, hello.\n")
+	m2 := deliver("Subject: long\nContent-Type: multipart/mixed; boundary=x\n\n--x\nContent-Type: text/plain\n\nxx" + long + "\n--x--\n")
+
+	// Check which messages the index can skip, for a word search.
+	xcheck := func(words []string, headerToo bool, exp ...Message) {
+		t.Helper()
+		ws := PrepareWordSearch(words, nil)
+		err := acc.DB.Read(ctxbg, func(tx *bstore.Tx) error {
+			return ws.UseIndex(tx, headerToo)
+		})
+		tcheck(t, err, "use index")
+		var got []int64
+		for _, m := range []Message{m0, m1, m2} {
+			if !ws.IndexMiss(m) {
+				got = append(got, m.ID)
+			}
+		}
+		var expIDs []int64
+		for _, m := range exp {
+			expIDs = append(expIDs, m.ID)
+		}
+		if !reflect.DeepEqual(got, expIDs) {
+			t.Fatalf("words %v, headerToo %v: got candidates %v, expected %v", words, headerToo, got, expIDs)
+		}
+	}
+
+	xcheck([]string{"hello"}, true, m0, m1)
+	xcheck([]string{"hello"}, false, m1)
+	xcheck([]string{"HELL"}, true, m0, m1)
+	xcheck([]string{"quick brown"}, true, m0)
+	xcheck([]string{"hello", "fox"}, true, m0)
+	xcheck([]string{"absent"}, true)
+	xcheck([]string{"hijabcd"}, true, m2)
+	xcheck([]string{long}, false, m2)
+	xcheck([]string{"x"}, true, m0, m1, m2) // Too short for index.
+
+	// Removed messages are no longer candidates.
+	err = acc.DB.Write(ctxbg, func(tx *bstore.Tx) error {
+		return TextIndexRemove(tx, m1.ID)
+	})
+	tcheck(t, err, "remove from index")
+	xcheck([]string{"hello"}, true, m0)
+
+	// Messages not in the index are always candidates.
+	unindexed := m1
+	unindexed.TextIndexed = false
+	ws := PrepareWordSearch([]string{"hello"}, nil)
+	err = acc.DB.Read(ctxbg, func(tx *bstore.Tx) error {
+		return ws.UseIndex(tx, true)
+	})
+	tcheck(t, err, "use index")
+	if ws.IndexMiss(unindexed) {
+		t.Fatalf("index miss for unindexed message")
+	}
+
+	// Rebuild adds all messages again.
+	n, err := acc.ReindexMessages(context.Background(), log)
+	tcheck(t, err, "reindex")
+	if n != 3 {
+		t.Fatalf("reindexed %d messages, expected 3", n)
+	}
+	xcheck([]string{"hello"}, true, m0, m1)
+	xcheck([]string{"hello"}, false, m1)
+}
@@ -26,7 +26,9 @@ import (
 // may have a threadid 0. That results in this message getting threadid 0, which
 // will handled by the background upgrade process assigning a threadid when it gets
 // to this message.
-func assignThread(log mlog.Log, tx *bstore.Tx, m *Message, part *message.Part) error {
+// For accounts with a key, threadKey is set, and the message-ids and subject from
+// the headers are hashed like the stored values.
+func assignThread(log mlog.Log, tx *bstore.Tx, m *Message, part *message.Part, threadKey []byte) error {
 	if m.MessageID != "" {
 		// Match against existing different message with same Message-ID.
 		q := bstore.QueryTx[Message](tx)
@@ -54,7 +56,7 @@ func assignThread(log mlog.Log, tx *bstore.Tx, m *Message, part *message.Part) e
 		log.Errorx("assigning threads: parsing references/in-reply-to headers, not matching by message-id", err, slog.Int64("msgid", m.ID))
 	}
 	for i := len(messageIDs) - 1; i >= 0; i-- {
-		messageID := messageIDs[i]
+		messageID := threadHash(threadKey, messageIDs[i])
 		if messageID == m.MessageID {
 			continue
 		}
@@ -74,6 +76,7 @@ func assignThread(log mlog.Log, tx *bstore.Tx, m *Message, part *message.Part) e
 	var isResp bool
 	if part != nil && part.Envelope != nil {
 		m.SubjectBase, isResp = message.ThreadSubject(part.Envelope.Subject, false)
+		m.SubjectBase = threadHash(threadKey, m.SubjectBase)
 	}
 	if !isResp || m.SubjectBase == "" {
 		return nil
@@ -126,6 +129,16 @@ func assignParent(m *Message, pm Message, updateSeen bool) {
 func (a *Account) ResetThreading(ctx context.Context, log mlog.Log, batchSize int, clearIDs bool) (int, error) {
 	// todo: should this send Change events for ThreadMuted and ThreadCollapsed? worth it?
 
+	var threadKey []byte
+	err := a.DB.Read(ctx, func(tx *bstore.Tx) error {
+		var err error
+		threadKey, err = threadHashKey(tx)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
 	var lastID int64
 	total := 0
 	for {
@@ -146,7 +159,9 @@ func (a *Account) ResetThreading(ctx context.Context, log mlog.Log, batchSize in
 				var part struct {
 					Envelope *message.Envelope
 				}
-				if err := json.Unmarshal(m.ParsedBuf, &part); err != nil {
+				if buf, err := m.ParsedJSON(); err != nil {
+					log.Errorx("get json parsedbuf for setting message-id, skipping", err, slog.Int64("msgid", m.ID))
+				} else if err := json.Unmarshal(buf, &part); err != nil {
 					log.Errorx("unmarshal json parsedbuf for setting message-id, skipping", err, slog.Int64("msgid", m.ID))
 				} else {
 					m.MessageID = ""
@@ -155,10 +170,11 @@ func (a *Account) ResetThreading(ctx context.Context, log mlog.Log, batchSize in
 						if err != nil {
 							log.Debugx("parsing message-id, skipping", err, slog.Int64("msgid", m.ID), slog.String("messageid", part.Envelope.MessageID))
 						}
-						m.MessageID = s
+						m.MessageID = threadHash(threadKey, s)
 					}
 					if part.Envelope != nil {
 						m.SubjectBase, _ = message.ThreadSubject(part.Envelope.Subject, false)
+						m.SubjectBase = threadHash(threadKey, m.SubjectBase)
 					}
 				}
 				w.Out = m
@@ -255,6 +271,22 @@ func (a *Account) AssignThreads(ctx context.Context, log mlog.Log, txOpt *bstore
 	// its original as parent.
 	pending := map[string][]childMsg{}
 
+	// Message-ids and subjects from headers are hashed like the stored values for
+	// accounts with a key.
+	var threadKey []byte
+	var err error
+	if txOpt != nil {
+		threadKey, err = threadHashKey(txOpt)
+	} else {
+		err = a.DB.Read(ctx, func(tx *bstore.Tx) error {
+			threadKey, err = threadHashKey(tx)
+			return err
+		})
+	}
+	if err != nil {
+		return err
+	}
+
 	// Current tx. If not equal to txOpt, we clean it up before we leave.
 	var tx *bstore.Tx
 	defer func() {
@@ -298,7 +330,7 @@ func (a *Account) AssignThreads(ctx context.Context, log mlog.Log, txOpt *bstore
 		}
 
 		for i := len(refids) - 1; i >= 0; i-- {
-			messageID := refids[i]
+			messageID := threadHash(threadKey, refids[i])
 			if messageID == m.MessageID {
 				continue
 			}
@@ -318,6 +350,7 @@ func (a *Account) AssignThreads(ctx context.Context, log mlog.Log, txOpt *bstore
 		var isResp bool
 		if subject != "" {
 			subjectBase, isResp = message.ThreadSubject(subject, false)
+			subjectBase = threadHash(threadKey, subjectBase)
 		}
 		if len(refids) > 0 || !isResp || subjectBase == "" {
 			m.ThreadID = m.ID
@@ -410,7 +443,9 @@ func (a *Account) AssignThreads(ctx context.Context, log mlog.Log, txOpt *bstore
 				HeaderOffset int64
 				BodyOffset   int64
 			}
-			if err := json.Unmarshal(m.ParsedBuf, &partialPart); err != nil {
+			if buf, err := m.ParsedJSON(); err != nil {
+				w.Err = fmt.Errorf("get part: %w", err)
+			} else if err := json.Unmarshal(buf, &partialPart); err != nil {
 				w.Err = fmt.Errorf("unmarshal part: %v", err)
 			} else {
 				size := partialPart.BodyOffset - partialPart.HeaderOffset
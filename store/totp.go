@@ -0,0 +1,171 @@
+package store
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/totp"
+)
+
+// TOTP holds the time-based one-time password secret for two-factor
+// authentication of logins to the web interfaces (account, mail). An account has
+// at most one TOTP, with ID 1. A code is only required at login after enrollment
+// was confirmed with a valid code, so a user cannot lock themselves out by not
+// finishing the setup.
+//
+// TOTP does not apply to IMAP/SMTP/etc, app passwords can be used for those.
+type TOTP struct {
+	ID          int64
+	Created     time.Time `bstore:"nonzero,default now"`
+	Secret      []byte    `bstore:"nonzero" json:"-"`
+	Confirmed   bool
+	LastCounter int64 // Time step of last accepted code, codes cannot be used twice.
+
+	// Hex SHA-256 of unused recovery codes. Each can be used once instead of a TOTP
+	// code, e.g. after losing the device with the authenticator app.
+	RecoveryCodes []string `json:"-"`
+}
+
+// Number of recovery codes generated when confirming TOTP enrollment.
+const totpRecoveryCodes = 10
+
+var (
+	ErrTOTPUnknown     = errors.New("two-factor authentication not enabled")
+	ErrTOTPEnabled     = errors.New("two-factor authentication already enabled")
+	ErrTOTPCodeInvalid = errors.New("invalid two-factor authentication code")
+)
+
+// TOTPGet returns the TOTP for the account, or ErrTOTPUnknown if the account has
+// no confirmed TOTP.
+func TOTPGet(tx *bstore.Tx) (TOTP, error) {
+	t := TOTP{ID: 1}
+	if err := tx.Get(&t); err == bstore.ErrAbsent || err == nil && !t.Confirmed {
+		return TOTP{}, ErrTOTPUnknown
+	} else if err != nil {
+		return TOTP{}, err
+	}
+	return t, nil
+}
+
+// TOTPSetupStart starts enrollment, replacing any pending unconfirmed enrollment
+// with a new secret. The TOTP is not used for logins until it is confirmed with
+// TOTPSetupConfirm.
+func TOTPSetupStart(tx *bstore.Tx) (TOTP, error) {
+	t := TOTP{ID: 1}
+	if err := tx.Get(&t); err == nil && t.Confirmed {
+		return TOTP{}, ErrTOTPEnabled
+	} else if err == nil {
+		if err := tx.Delete(&t); err != nil {
+			return TOTP{}, fmt.Errorf("removing pending totp: %v", err)
+		}
+	} else if err != bstore.ErrAbsent {
+		return TOTP{}, err
+	}
+
+	t = TOTP{ID: 1, Secret: totp.NewSecret()}
+	if err := tx.Insert(&t); err != nil {
+		return TOTP{}, err
+	}
+	return t, nil
+}
+
+// TOTPSetupConfirm finishes enrollment if code is valid for the pending TOTP.
+// The returned recovery codes are not stored and cannot be retrieved later.
+func TOTPSetupConfirm(tx *bstore.Tx, code string) ([]string, error) {
+	t := TOTP{ID: 1}
+	if err := tx.Get(&t); err == bstore.ErrAbsent {
+		return nil, ErrTOTPUnknown
+	} else if err != nil {
+		return nil, err
+	} else if t.Confirmed {
+		return nil, ErrTOTPEnabled
+	}
+
+	counter, ok := totp.Verify(t.Secret, code, time.Now(), t.LastCounter)
+	if !ok {
+		return nil, ErrTOTPCodeInvalid
+	}
+	t.Confirmed = true
+	t.LastCounter = counter
+	codes := totpSetRecoveryCodes(&t)
+	if err := tx.Update(&t); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// TOTPRecoveryCodesRegenerate replaces the recovery codes with new codes, and
+// returns them.
+func TOTPRecoveryCodesRegenerate(tx *bstore.Tx) ([]string, error) {
+	t, err := TOTPGet(tx)
+	if err != nil {
+		return nil, err
+	}
+	codes := totpSetRecoveryCodes(&t)
+	if err := tx.Update(&t); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func totpSetRecoveryCodes(t *TOTP) []string {
+	codes := make([]string, totpRecoveryCodes)
+	t.RecoveryCodes = make([]string, totpRecoveryCodes)
+	for i := range codes {
+		codes[i] = generateCode(3)
+		t.RecoveryCodes[i] = appPasswordHash(codes[i])
+	}
+	return codes
+}
+
+// TOTPDisable removes the TOTP, including a pending enrollment. Logins no
+// longer require a code.
+func TOTPDisable(tx *bstore.Tx) error {
+	n, err := bstore.QueryTx[TOTP](tx).Delete()
+	if err != nil {
+		return err
+	} else if n == 0 {
+		return ErrTOTPUnknown
+	}
+	return nil
+}
+
+// TOTPRequired returns whether logins to the web interfaces require a TOTP code.
+func TOTPRequired(tx *bstore.Tx) (bool, error) {
+	_, err := TOTPGet(tx)
+	if err == ErrTOTPUnknown {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// TOTPCheck returns whether code is a valid TOTP code or unused recovery code. A
+// used recovery code is removed.
+func TOTPCheck(tx *bstore.Tx, code string) (bool, error) {
+	t, err := TOTPGet(tx)
+	if err != nil {
+		return false, err
+	}
+
+	code = strings.TrimSpace(code)
+	if counter, ok := totp.Verify(t.Secret, code, time.Now(), t.LastCounter); ok {
+		t.LastCounter = counter
+		return true, tx.Update(&t)
+	}
+
+	h := appPasswordHash(strings.ToLower(code))
+	i := slices.IndexFunc(t.RecoveryCodes, func(rh string) bool {
+		return subtle.ConstantTimeCompare([]byte(rh), []byte(h)) == 1
+	})
+	if i < 0 {
+		return false, nil
+	}
+	t.RecoveryCodes = slices.Delete(t.RecoveryCodes, i, i+1)
+	return true, tx.Update(&t)
+}
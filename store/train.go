@@ -48,6 +48,14 @@ func (a *Account) OpenJunkFilter(ctx context.Context, log mlog.Log) (*junk.Filte
 // RetrainMessages (un)trains messages, if relevant given their flags. Updates
 // m.TrainedJunk after retraining.
 func (a *Account) RetrainMessages(ctx context.Context, log mlog.Log, tx *bstore.Tx, msgs []Message, absentOK bool) (rerr error) {
+	return a.retrainMessages(ctx, log, tx, msgs, absentOK, nil)
+}
+
+// retrainMessages is like RetrainMessages, but if msgFile is not nil, it is read
+// as message file for the single message in msgs. For training during delivery,
+// when the message file may have been stored encrypted and the account may be
+// locked.
+func (a *Account) retrainMessages(ctx context.Context, log mlog.Log, tx *bstore.Tx, msgs []Message, absentOK bool, msgFile *os.File) (rerr error) {
 	if len(msgs) == 0 {
 		return nil
 	}
@@ -78,7 +86,7 @@ func (a *Account) RetrainMessages(ctx context.Context, log mlog.Log, tx *bstore.
 				}
 			}()
 		}
-		if err := a.RetrainMessage(ctx, log, tx, jf, &msgs[i], absentOK); err != nil {
+		if err := a.retrainMessage(ctx, log, tx, jf, &msgs[i], absentOK, msgFile); err != nil {
 			return err
 		}
 	}
@@ -88,6 +96,10 @@ func (a *Account) RetrainMessages(ctx context.Context, log mlog.Log, tx *bstore.
 // RetrainMessage untrains and/or trains a message, if relevant given m.TrainedJunk
 // and m.Junk/m.Notjunk. Updates m.TrainedJunk after retraining.
 func (a *Account) RetrainMessage(ctx context.Context, log mlog.Log, tx *bstore.Tx, jf *junk.Filter, m *Message, absentOK bool) error {
+	return a.retrainMessage(ctx, log, tx, jf, m, absentOK, nil)
+}
+
+func (a *Account) retrainMessage(ctx context.Context, log mlog.Log, tx *bstore.Tx, jf *junk.Filter, m *Message, absentOK bool, msgFile *os.File) error {
 	untrain := m.TrainedJunk != nil
 	untrainJunk := untrain && *m.TrainedJunk
 	train := m.Junk || m.Notjunk && !(m.Junk && m.Notjunk)
@@ -103,11 +115,16 @@ func (a *Account) RetrainMessage(ctx context.Context, log mlog.Log, tx *bstore.T
 		slog.Bool("train", train),
 		slog.Bool("trainjunk", trainJunk))
 
-	mr := a.MessageReader(*m)
-	defer func() {
-		err := mr.Close()
-		log.Check(err, "closing message reader after retraining")
-	}()
+	var mr *MsgReader
+	if msgFile != nil {
+		mr = FileMsgReader(m.MsgPrefix, msgFile) // We don't close, it would close the msgFile.
+	} else {
+		mr = a.MessageReader(*m)
+		defer func() {
+			err := mr.Close()
+			log.Check(err, "closing message reader after retraining")
+		}()
+	}
 
 	p, err := m.LoadPart(mr)
 	if err != nil {
@@ -0,0 +1,134 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/message"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/sieve"
+)
+
+// Vacation holds the out-of-office settings of an account. While enabled and
+// within the optional date range, senders of incoming messages get an automatic
+// response. Singleton with ID 1.
+type Vacation struct {
+	ID uint8
+
+	Enabled      bool
+	Start        time.Time // If not zero, no responses are sent before this time.
+	End          time.Time // If not zero, no responses are sent at or after this time.
+	Subject      string    // If empty, "Auto: " followed by the subject of the incoming message.
+	Body         string    // Text of the response.
+	IntervalDays int       // Minimum number of days between responses to the same sender. If zero, 7 days.
+}
+
+// VacationMaxBodySize is the maximum size of the text of a vacation response.
+const VacationMaxBodySize = 64 * 1024
+
+// VacationMaxIntervalDays is the maximum interval between responses to a sender.
+const VacationMaxIntervalDays = 90
+
+var ErrVacationInvalid = errors.New("invalid vacation settings")
+
+// Active returns whether responses are to be sent at time t.
+func (v Vacation) Active(t time.Time) bool {
+	return v.Enabled && (v.Start.IsZero() || !t.Before(v.Start)) && (v.End.IsZero() || t.Before(v.End))
+}
+
+// VacationGet returns the vacation settings, disabled if never saved.
+func VacationGet(tx *bstore.Tx) (Vacation, error) {
+	v := Vacation{ID: 1}
+	err := tx.Get(&v)
+	if err == bstore.ErrAbsent {
+		return Vacation{ID: 1}, nil
+	}
+	return v, err
+}
+
+// VacationSave checks and stores the vacation settings.
+func VacationSave(tx *bstore.Tx, v Vacation) error {
+	v.ID = 1
+	if v.Enabled && strings.TrimSpace(v.Body) == "" {
+		return fmt.Errorf("%w: text of response required", ErrVacationInvalid)
+	}
+	if len(v.Body) > VacationMaxBodySize {
+		return fmt.Errorf("%w: text of response larger than maximum size %d bytes", ErrVacationInvalid, VacationMaxBodySize)
+	}
+	if strings.ContainsAny(v.Subject, "\r\n") {
+		return fmt.Errorf("%w: subject cannot contain newlines", ErrVacationInvalid)
+	}
+	if !v.Start.IsZero() && !v.End.IsZero() && !v.End.After(v.Start) {
+		return fmt.Errorf("%w: end must be after start", ErrVacationInvalid)
+	}
+	if v.IntervalDays < 0 || v.IntervalDays > VacationMaxIntervalDays {
+		return fmt.Errorf("%w: interval must be between 0 and %d days", ErrVacationInvalid, VacationMaxIntervalDays)
+	}
+	if err := tx.Get(&Vacation{ID: 1}); err == bstore.ErrAbsent {
+		return tx.Insert(&v)
+	} else if err != nil {
+		return err
+	}
+	return tx.Update(&v)
+}
+
+// VacationEval returns the vacation response to send for message m that was
+// delivered to the account, or nil if vacation is not active or the message does
+// not qualify for an automatic response, e.g. because it is from a mailing list or
+// automated sender. The caller must check with VacationReplyAllowed whether a
+// response was sent to the sender recently.
+func (a *Account) VacationEval(log mlog.Log, m *Message, msgFile *os.File) (*sieve.Vacation, error) {
+	var v Vacation
+	err := a.DB.Read(context.TODO(), func(tx *bstore.Tx) error {
+		var err error
+		v, err = VacationGet(tx)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("looking up vacation settings: %w", err)
+	} else if !v.Active(time.Now()) {
+		return nil, nil
+	}
+
+	mr := FileMsgReader(m.MsgPrefix, msgFile) // We don't close, it would close the msgFile.
+	p, err := message.EnsurePart(log.Logger, false, mr, m.Size)
+	if err != nil {
+		log.Debugx("parsing message for vacation response, continuing", err, slog.String("parse", ""))
+		// note: p is still usable.
+	}
+	sm := sieve.Message{
+		MailFrom: m.MailFrom,
+		Size:     m.Size,
+		Part:     &p,
+	}
+	if m.RcptToLocalpart != "" || m.RcptToDomain != "" {
+		sm.RcptTo = m.RcptToLocalpart.String() + "@" + m.RcptToDomain
+	}
+
+	// Messages to any address of the account qualify, e.g. when delivered through an
+	// alias.
+	var addresses []string
+	if conf, ok := a.Conf(); ok {
+		for addr := range conf.Destinations {
+			if !strings.HasPrefix(addr, "@") {
+				addresses = append(addresses, addr)
+			}
+		}
+	}
+
+	sv := sieve.Vacation{
+		Subject:   v.Subject,
+		Reason:    v.Body,
+		Days:      v.IntervalDays,
+		Handle:    "vacation",
+		Addresses: addresses,
+	}
+	return sieve.AutoReply(sm, sv)
+}
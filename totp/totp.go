@@ -0,0 +1,132 @@
+// Package totp implements time-based one-time passwords (TOTP), for two-factor
+// authentication with authenticator apps.
+//
+// Codes are 6 digits, for 30 second time steps, with HMAC-SHA1, the parameters
+// supported by all common authenticator apps. ../rfc/6238
+package totp
+
+import (
+	"crypto/hmac"
+	cryptorand "crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"rsc.io/qr"
+)
+
+const (
+	Digits = 6
+	Period = 30 // Seconds per time step.
+
+	// Number of time steps before and after the current time step for which codes are
+	// also accepted, for clock skew and typing delay. ../rfc/6238
+	skew = 1
+)
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewSecret returns a new random secret, of 20 bytes, the size of the HMAC-SHA1
+// output. ../rfc/4226
+func NewSecret() []byte {
+	buf := make([]byte, 20)
+	if _, err := cryptorand.Read(buf); err != nil {
+		panic(fmt.Sprintf("reading random bytes: %v", err))
+	}
+	return buf
+}
+
+// EncodeSecret returns the base32 form of secret as used in provisioning URIs and
+// for manual entry in authenticator apps.
+func EncodeSecret(secret []byte) string {
+	return b32.EncodeToString(secret)
+}
+
+// DecodeSecret parses a base32 secret as returned by EncodeSecret. Spaces are
+// ignored and lower case is allowed.
+func DecodeSecret(s string) ([]byte, error) {
+	s = strings.ToUpper(strings.ReplaceAll(s, " ", ""))
+	return b32.DecodeString(strings.TrimRight(s, "="))
+}
+
+// URI returns an "otpauth" URI for provisioning an authenticator app, typically
+// presented as QR code. The issuer and account name are shown in the app.
+func URI(issuer, accountName string, secret []byte) string {
+	q := url.Values{}
+	q.Set("secret", EncodeSecret(secret))
+	q.Set("issuer", issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprintf("%d", Digits))
+	q.Set("period", fmt.Sprintf("%d", Period))
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + accountName,
+		RawQuery: q.Encode(),
+	}
+	return u.String()
+}
+
+// QRCodePNG returns a PNG image with a QR code for uri.
+func QRCodePNG(uri string) ([]byte, error) {
+	code, err := qr.Encode(uri, qr.M)
+	if err != nil {
+		return nil, err
+	}
+	return code.PNG(), nil
+}
+
+// Counter returns the time step for t. ../rfc/6238
+func Counter(t time.Time) int64 {
+	return t.Unix() / Period
+}
+
+// Code returns the code for the time step counter.
+func Code(secret []byte, counter int64) string {
+	return hotp(secret, counter, Digits)
+}
+
+// hotp returns an HMAC-based one-time password. ../rfc/4226
+func hotp(secret []byte, counter int64, digits int) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation. ../rfc/4226
+	offset := sum[len(sum)-1] & 0x0f
+	v := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, v%mod)
+}
+
+// Verify checks if code is valid at time now. Codes for time steps up to and
+// including last are not accepted, so a code cannot be used twice. ../rfc/6238
+//
+// If the code is valid, the time step of the code is returned, to be stored and
+// passed as last in future calls.
+func Verify(secret []byte, code string, now time.Time, last int64) (int64, bool) {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != Digits {
+		return 0, false
+	}
+	cur := Counter(now)
+	for c := cur - skew; c <= cur+skew; c++ {
+		if c <= last {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(Code(secret, c)), []byte(code)) == 1 {
+			return c, true
+		}
+	}
+	return 0, false
+}
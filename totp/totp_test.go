@@ -0,0 +1,84 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHOTP(t *testing.T) {
+	// Test vectors from RFC 6238, for SHA-1.
+	secret := []byte("12345678901234567890")
+	vectors := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, v := range vectors {
+		code := hotp(secret, Counter(time.Unix(v.unix, 0)), 8)
+		if code != v.code {
+			t.Fatalf("time %d: got code %s, expected %s", v.unix, code, v.code)
+		}
+		if code := Code(secret, Counter(time.Unix(v.unix, 0))); code != v.code[2:] {
+			t.Fatalf("time %d: got code %s, expected %s", v.unix, code, v.code[2:])
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	secret := NewSecret()
+	now := time.Now()
+	cur := Counter(now)
+
+	test := func(code string, last int64, expCounter int64, expOK bool) {
+		t.Helper()
+		counter, ok := Verify(secret, code, now, last)
+		if ok != expOK || counter != expCounter {
+			t.Fatalf("verify %q, last %d: got %d, %v, expected %d, %v", code, last, counter, ok, expCounter, expOK)
+		}
+	}
+
+	test(Code(secret, cur), 0, cur, true)
+	test(Code(secret, cur-1), 0, cur-1, true)
+	test(Code(secret, cur+1), 0, cur+1, true)
+	test(Code(secret, cur-2), 0, 0, false)
+	test(Code(secret, cur+2), 0, 0, false)
+	// Replay.
+	test(Code(secret, cur), cur, 0, false)
+	test(Code(secret, cur-1), cur-1, 0, false)
+	test(Code(secret, cur+1), cur, cur+1, true)
+	test("", 0, 0, false)
+	test("12345", 0, 0, false)
+	code := Code(secret, cur)
+	test(code[:3]+" "+code[3:], 0, cur, true)
+}
+
+func TestSecret(t *testing.T) {
+	secret := NewSecret()
+	s := EncodeSecret(secret)
+	if strings.Contains(s, "=") {
+		t.Fatalf("padding in encoded secret %q", s)
+	}
+	buf, err := DecodeSecret(strings.ToLower(s[:4] + " " + s[4:]))
+	if err != nil {
+		t.Fatalf("decode secret: %v", err)
+	}
+	if string(buf) != string(secret) {
+		t.Fatalf("secret mismatch after decode")
+	}
+
+	uri := URI("mox", "mjl@mox.example", []byte("12345678901234567890"))
+	exp := "otpauth://totp/mox:mjl@mox.example?algorithm=SHA1&digits=6&issuer=mox&period=30&secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	if uri != exp {
+		t.Fatalf("got uri %q, expected %q", uri, exp)
+	}
+	if _, err := QRCodePNG(uri); err != nil {
+		t.Fatalf("qr code: %v", err)
+	}
+}
@@ -16,6 +16,7 @@ import (
 
 	"github.com/mjl-/bstore"
 
+	"github.com/mjl-/mox/admindb"
 	"github.com/mjl-/mox/dmarcdb"
 	"github.com/mjl-/mox/junk"
 	"github.com/mjl-/mox/moxvar"
@@ -149,11 +150,11 @@ possibly making them potentially no longer readable by the previous version.
 	}
 
 	checkFile := func(dbpath, path string, prefixSize int, size int64) {
-		st, err := os.Stat(path)
+		// Size of contents, without overhead of encrypted message files.
+		filesize, err := store.MessageFileSize(path)
 		checkf(err, path, "checking if file exists")
-		if !skipSizeCheck && err == nil && int64(prefixSize)+st.Size() != size {
-			filesize := st.Size()
-			checkf(fmt.Errorf("%s: message size is %d, should be %d (length of MsgPrefix %d + file size %d), see \"mox fixmsgsize\"", path, size, int64(prefixSize)+st.Size(), prefixSize, filesize), dbpath, "checking message size")
+		if !skipSizeCheck && err == nil && int64(prefixSize)+filesize != size {
+			checkf(fmt.Errorf("%s: message size is %d, should be %d (length of MsgPrefix %d + file size %d), see \"mox fixmsgsize\"", path, size, int64(prefixSize)+filesize, prefixSize, filesize), dbpath, "checking message size")
 		}
 	}
 
@@ -175,6 +176,15 @@ possibly making them potentially no longer readable by the previous version.
 				return nil
 			})
 			checkf(err, dbpath, "reading messages in queue database to check files")
+
+			err = bstore.QueryDB[queue.ListMsg](ctxbg, db).ForEach(func(m queue.ListMsg) error {
+				mp := filepath.Join("list", store.MessagePath(m.ID))
+				seen[mp] = struct{}{}
+				p := filepath.Join(dataDir, "queue", mp)
+				checkFile(dbpath, p, 0, m.Size)
+				return nil
+			})
+			checkf(err, dbpath, "reading mailing list messages in queue database to check files")
 		}
 
 		// Check that there are no files that could be treated as a message.
@@ -422,7 +432,7 @@ possibly making them potentially no longer readable by the previous version.
 				p = p[len(dataDir)+1:]
 			}
 			switch p {
-			case "dmarcrpt.db", "dmarceval.db", "mtasts.db", "tlsrpt.db", "tlsrptresult.db", "receivedid.key", "lastknownversion":
+			case "admin.db", "dmarcrpt.db", "dmarceval.db", "mtasts.db", "tlsrpt.db", "tlsrptresult.db", "receivedid.key", "lastknownversion":
 				return nil
 			case "acme", "queue", "accounts", "tmp", "moved":
 				return fs.SkipDir
@@ -440,6 +450,7 @@ possibly making them potentially no longer readable by the previous version.
 		checkf(err, dataDir, "walking data directory")
 	}
 
+	checkDB(false, filepath.Join(dataDir, "admin.db"), admindb.DBTypes) // After admin users were added.
 	checkDB(true, filepath.Join(dataDir, "dmarcrpt.db"), dmarcdb.ReportsDBTypes)
 	checkDB(false, filepath.Join(dataDir, "dmarceval.db"), dmarcdb.EvalDBTypes) // After v0.0.7.
 	checkDB(true, filepath.Join(dataDir, "mtasts.db"), mtastsdb.DBTypes)
@@ -26,6 +26,7 @@ import (
 	"github.com/mjl-/sherpadoc"
 	"github.com/mjl-/sherpaprom"
 
+	"github.com/mjl-/mox/admindb"
 	"github.com/mjl-/mox/config"
 	"github.com/mjl-/mox/mlog"
 	"github.com/mjl-/mox/mox-"
@@ -100,10 +101,52 @@ func Handler(cookiePath string, isForwarded bool) func(w http.ResponseWriter, r
 			http.Error(w, "500 - internal server error - cannot handle requests", http.StatusInternalServerError)
 			return
 		}
+		if r.URL.Path == "/oidc" {
+			// Redirect back from the identity provider, without authentication.
+			ctx := context.WithValue(r.Context(), mlog.CidKey, mox.Cid())
+			webauth.OIDCCallback(ctx, pkglog.WithContext(ctx), "webaccount", cookiePath, isForwarded, w, r)
+			return
+		}
 		handle(sh, isForwarded, w, r)
 	}
 }
 
+// listUnsubscribe handles unsubscribe requests from a List-Unsubscribe header.
+// Mail clients send a POST. For GET requests, e.g. for users following the link,
+// we show a form, so automated link checkers don't unsubscribe. ../rfc/8058:168
+func listUnsubscribe(ctx context.Context, log mlog.Log, w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Error(w, "400 - bad request - missing token", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, `<!doctype html>
+<html><head><meta charset="utf-8" /><meta name="viewport" content="width=device-width, initial-scale=1" /><title>Unsubscribe</title></head>
+<body><form method="POST"><input type="hidden" name="List-Unsubscribe" value="One-Click" /><button type="submit">Unsubscribe from mailing list</button></form></body></html>
+`)
+
+	case "POST":
+		list, address, err := queue.ListUnsubscribe(ctx, log, token)
+		if err == bstore.ErrAbsent {
+			http.Error(w, "404 - not found - unknown token, perhaps already unsubscribed", http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Errorx("unsubscribing from list", err)
+			http.Error(w, "500 - internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "Address %s unsubscribed from mailing list %s.\n", address, list)
+
+	default:
+		http.Error(w, "405 - method not allowed - use get or post", http.StatusMethodNotAllowed)
+	}
+}
+
 func xcheckf(ctx context.Context, err error, format string, args ...any) {
 	if err == nil {
 		return
@@ -202,6 +245,13 @@ func handle(apiHandler http.Handler, isForwarded bool, w http.ResponseWriter, r
 		}
 	}
 
+	// One-click unsubscribe from a mailing list, without authentication. The token is
+	// unguessable.
+	if r.URL.Path == "/unsubscribe" {
+		listUnsubscribe(ctx, log, w, r)
+		return
+	}
+
 	// HTML/JS can be retrieved without authentication.
 	if r.URL.Path == "/" {
 		switch r.Method {
@@ -223,7 +273,7 @@ func handle(apiHandler http.Handler, isForwarded bool, w http.ResponseWriter, r
 	var loginAddress, accName string
 	var sessionToken store.SessionToken
 	// All other URLs, except the login endpoint require some authentication.
-	if r.URL.Path != "/api/LoginPrep" && r.URL.Path != "/api/Login" {
+	if r.URL.Path != "/api/LoginPrep" && r.URL.Path != "/api/Login" && r.URL.Path != "/api/LoginTOTP" && r.URL.Path != "/api/LoginOIDCEnabled" && r.URL.Path != "/api/LoginOIDCStart" && r.URL.Path != "/api/LoginOIDC" {
 		var ok bool
 		isExport := r.URL.Path == "/export"
 		requireCSRF := isAPI || r.URL.Path == "/import" || isExport
@@ -235,6 +285,13 @@ func handle(apiHandler http.Handler, isForwarded bool, w http.ResponseWriter, r
 	}
 
 	if isAPI {
+		actor := admindb.AuditActor{
+			Source:    admindb.AuditSourceWebaccount,
+			Name:      accName,
+			RemoteIP:  webauth.RemoteIP(log, isForwarded, r).String(),
+			Operation: strings.TrimPrefix(r.URL.Path, "/api/"),
+		}
+		ctx = admindb.ContextWithAuditActor(ctx, actor)
 		reqInfo := requestInfo{loginAddress, accName, sessionToken, w, r}
 		ctx = context.WithValue(ctx, requestInfoCtxKey, reqInfo)
 		apiHandler.ServeHTTP(w, r.WithContext(ctx))
@@ -348,6 +405,57 @@ func (w Account) Login(ctx context.Context, loginToken, username, password strin
 	return csrfToken
 }
 
+// LoginTOTP completes a login for which Login failed with error code
+// "user:totpRequired", with a code from an authenticator app or a recovery code.
+// Fails with error code "user:loginFailed" for a bad code.
+func (w Account) LoginTOTP(ctx context.Context, loginToken, code string) store.CSRFToken {
+	log := pkglog.WithContext(ctx)
+	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
+
+	csrfToken, err := webauth.LoginTOTP(ctx, log, webauth.Accounts, "webaccount", w.cookiePath, w.isForwarded, reqInfo.Response, reqInfo.Request, loginToken, code)
+	if _, ok := err.(*sherpa.Error); ok {
+		panic(err)
+	}
+	xcheckf(ctx, err, "login")
+	return csrfToken
+}
+
+// LoginOIDCEnabled returns whether logging in through an OpenID Connect identity
+// provider (single sign-on) is available.
+func (Account) LoginOIDCEnabled(ctx context.Context) bool {
+	return webauth.OIDCEnabled()
+}
+
+// LoginOIDCStart starts a login through the identity provider, returning the URL
+// to navigate to. Call LoginPrep to get a loginToken. After logging in at the
+// identity provider, the browser returns with an "oidc" query string parameter,
+// which must be passed to LoginOIDC.
+func (w Account) LoginOIDCStart(ctx context.Context, loginToken string) string {
+	log := pkglog.WithContext(ctx)
+	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
+
+	authURL, err := webauth.LoginOIDCStart(ctx, log, "webaccount", w.cookiePath, w.isForwarded, reqInfo.Response, reqInfo.Request, loginToken)
+	if _, ok := err.(*sherpa.Error); ok {
+		panic(err)
+	}
+	xcheckf(ctx, err, "starting login")
+	return authURL
+}
+
+// LoginOIDC completes a login through the identity provider, returning a session
+// token like Login, and the address the user logged in with.
+func (w Account) LoginOIDC(ctx context.Context, state string) (csrfToken store.CSRFToken, loginAddress string) {
+	log := pkglog.WithContext(ctx)
+	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
+
+	csrfToken, loginAddress, err := webauth.LoginOIDC(ctx, log, webauth.Accounts, "webaccount", w.cookiePath, w.isForwarded, reqInfo.Response, reqInfo.Request, state)
+	if _, ok := err.(*sherpa.Error); ok {
+		panic(err)
+	}
+	xcheckf(ctx, err, "login")
+	return csrfToken, loginAddress
+}
+
 // Logout invalidates the session token.
 func (w Account) Logout(ctx context.Context) {
 	log := pkglog.WithContext(ctx)
@@ -380,6 +488,7 @@ func (Account) SetPassword(ctx context.Context, password string) {
 
 	err = acc.SetPassword(log, password)
 	xcheckf(ctx, err, "setting password")
+	admindb.AuditAdd(ctx, log, admindb.AuditPassword, fmt.Sprintf("password set for account %q", reqInfo.AccountName))
 
 	// Session has been invalidated. Add it again.
 	err = store.SessionAddToken(ctx, log, &ls)
@@ -661,3 +770,598 @@ func (Account) RejectsSave(ctx context.Context, mailbox string, keep bool) {
 	})
 	xcheckf(ctx, err, "saving account rejects settings")
 }
+
+// SieveScripts returns the Sieve scripts of the account, ordered by name.
+func (Account) SieveScripts(ctx context.Context) (scripts []store.SieveScript) {
+	log := pkglog.WithContext(ctx)
+	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
+	acc, err := store.OpenAccount(log, reqInfo.AccountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		log.Check(err, "closing account")
+	}()
+
+	err = acc.DB.Read(ctx, func(tx *bstore.Tx) error {
+		scripts, err = store.SieveScriptList(tx)
+		return err
+	})
+	xcheckf(ctx, err, "listing sieve scripts")
+	return scripts
+}
+
+// SieveScriptSave adds or replaces a Sieve script. The script is checked for
+// errors before it is stored. If activate is set, the script becomes the active
+// script, used for evaluating incoming messages instead of the rulesets of the
+// destinations.
+func (Account) SieveScriptSave(ctx context.Context, name, content string, activate bool) (script store.SieveScript) {
+	log := pkglog.WithContext(ctx)
+	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
+
+	err := store.CheckSieveScriptName(name)
+	xcheckuserf(ctx, err, "checking script name")
+	_, err = store.SieveScriptCheck(content)
+	xcheckuserf(ctx, err, "checking script")
+
+	acc, err := store.OpenAccount(log, reqInfo.AccountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		log.Check(err, "closing account")
+	}()
+
+	err = acc.DB.Write(ctx, func(tx *bstore.Tx) error {
+		script, err = store.SieveScriptSave(tx, name, content, activate)
+		return err
+	})
+	xcheckf(ctx, err, "saving sieve script")
+	return script
+}
+
+// SieveScriptActivate makes the script with name the active script. If name is
+// empty, no script will be active anymore.
+func (Account) SieveScriptActivate(ctx context.Context, name string) {
+	log := pkglog.WithContext(ctx)
+	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
+	acc, err := store.OpenAccount(log, reqInfo.AccountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		log.Check(err, "closing account")
+	}()
+
+	err = acc.DB.Write(ctx, func(tx *bstore.Tx) error {
+		return store.SieveScriptActivate(tx, name)
+	})
+	if errors.Is(err, store.ErrSieveScriptUnknown) {
+		xcheckuserf(ctx, err, "activating sieve script")
+	}
+	xcheckf(ctx, err, "activating sieve script")
+}
+
+// SieveScriptRemove removes a Sieve script. The active script cannot be removed.
+func (Account) SieveScriptRemove(ctx context.Context, name string) {
+	log := pkglog.WithContext(ctx)
+	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
+	acc, err := store.OpenAccount(log, reqInfo.AccountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		log.Check(err, "closing account")
+	}()
+
+	err = acc.DB.Write(ctx, func(tx *bstore.Tx) error {
+		return store.SieveScriptRemove(tx, name)
+	})
+	if errors.Is(err, store.ErrSieveScriptUnknown) || errors.Is(err, store.ErrSieveScriptActive) {
+		xcheckuserf(ctx, err, "removing sieve script")
+	}
+	xcheckf(ctx, err, "removing sieve script")
+}
+
+// Vacation returns the vacation settings of the account, for automatic responses
+// to incoming messages.
+func (Account) Vacation(ctx context.Context) (vacation store.Vacation) {
+	log := pkglog.WithContext(ctx)
+	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
+	acc, err := store.OpenAccount(log, reqInfo.AccountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		log.Check(err, "closing account")
+	}()
+
+	err = acc.DB.Read(ctx, func(tx *bstore.Tx) error {
+		vacation, err = store.VacationGet(tx)
+		return err
+	})
+	xcheckf(ctx, err, "get vacation settings")
+	return vacation
+}
+
+// VacationSave saves the vacation settings. While enabled and within the
+// optional start and end time, senders of incoming messages get an automatic
+// response, at most once per interval. No responses are sent to mailing lists,
+// automated messages, or if the active Sieve script sends its own vacation
+// response.
+func (Account) VacationSave(ctx context.Context, vacation store.Vacation) {
+	log := pkglog.WithContext(ctx)
+	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
+	acc, err := store.OpenAccount(log, reqInfo.AccountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		log.Check(err, "closing account")
+	}()
+
+	err = acc.DB.Write(ctx, func(tx *bstore.Tx) error {
+		return store.VacationSave(tx, vacation)
+	})
+	if errors.Is(err, store.ErrVacationInvalid) {
+		xcheckuserf(ctx, err, "saving vacation settings")
+	}
+	xcheckf(ctx, err, "saving vacation settings")
+}
+
+// AddressBookContacts is an address book with its contacts.
+type AddressBookContacts struct {
+	AddressBook store.AddressBook
+	Contacts    []store.Contact // Ordered by name.
+}
+
+// AddressBooks returns the address books of the account with their contacts,
+// ordered by name. The default address book is created if the account has none.
+// Address books are synchronized with clients over CardDAV.
+func (Account) AddressBooks(ctx context.Context) (l []AddressBookContacts) {
+	log := pkglog.WithContext(ctx)
+	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
+	acc, err := store.OpenAccount(log, reqInfo.AccountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		log.Check(err, "closing account")
+	}()
+
+	err = acc.DB.Write(ctx, func(tx *bstore.Tx) error {
+		abs, err := store.AddressBookList(tx, acc)
+		if err != nil {
+			return err
+		}
+		for _, ab := range abs {
+			contacts, err := store.ContactList(tx, ab.ID)
+			if err != nil {
+				return err
+			}
+			l = append(l, AddressBookContacts{ab, contacts})
+		}
+		return nil
+	})
+	xcheckf(ctx, err, "listing address books")
+	return l
+}
+
+// AddressBookCreate adds a new address book.
+func (Account) AddressBookCreate(ctx context.Context, name, displayName string) {
+	log := pkglog.WithContext(ctx)
+	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
+
+	err := store.CheckAddressBookName(name)
+	xcheckuserf(ctx, err, "checking address book name")
+
+	acc, err := store.OpenAccount(log, reqInfo.AccountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		log.Check(err, "closing account")
+	}()
+
+	err = acc.DB.Write(ctx, func(tx *bstore.Tx) error {
+		_, err := store.AddressBookCreate(tx, acc, name, displayName, "")
+		return err
+	})
+	if errors.Is(err, store.ErrAddressBookExists) {
+		xcheckuserf(ctx, err, "adding address book")
+	}
+	xcheckf(ctx, err, "adding address book")
+}
+
+// AddressBookRemove removes an address book and its contacts.
+func (Account) AddressBookRemove(ctx context.Context, name string) {
+	log := pkglog.WithContext(ctx)
+	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
+	acc, err := store.OpenAccount(log, reqInfo.AccountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		log.Check(err, "closing account")
+	}()
+
+	err = acc.DB.Write(ctx, func(tx *bstore.Tx) error {
+		return store.AddressBookRemove(tx, name)
+	})
+	if errors.Is(err, store.ErrAddressBookUnknown) {
+		xcheckuserf(ctx, err, "removing address book")
+	}
+	xcheckf(ctx, err, "removing address book")
+}
+
+// ContactRemove removes a contact from an address book.
+func (Account) ContactRemove(ctx context.Context, addressBook, name string) {
+	log := pkglog.WithContext(ctx)
+	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
+	acc, err := store.OpenAccount(log, reqInfo.AccountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		log.Check(err, "closing account")
+	}()
+
+	err = acc.DB.Write(ctx, func(tx *bstore.Tx) error {
+		ab, err := store.AddressBookGet(tx, addressBook)
+		if err != nil {
+			return err
+		}
+		return store.ContactRemove(tx, acc, &ab, name)
+	})
+	if errors.Is(err, store.ErrAddressBookUnknown) || errors.Is(err, store.ErrContactUnknown) {
+		xcheckuserf(ctx, err, "removing contact")
+	}
+	xcheckf(ctx, err, "removing contact")
+}
+
+// AppPasswords returns the app passwords of the account, ordered by name.
+func (Account) AppPasswords(ctx context.Context) (l []store.AppPassword) {
+	log := pkglog.WithContext(ctx)
+	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
+	acc, err := store.OpenAccount(log, reqInfo.AccountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		log.Check(err, "closing account")
+	}()
+
+	err = acc.DB.Read(ctx, func(tx *bstore.Tx) error {
+		l, err = store.AppPasswordList(tx)
+		return err
+	})
+	xcheckf(ctx, err, "listing app passwords")
+	return l
+}
+
+// AppPasswordAdd adds a new app password for one or more of the protocols
+// "imap", "submission" and "webapi", optionally with an expiration time. The
+// generated password is returned, it cannot be retrieved later.
+func (Account) AppPasswordAdd(ctx context.Context, name string, protocols []string, expires *time.Time) (password string) {
+	log := pkglog.WithContext(ctx)
+	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
+	acc, err := store.OpenAccount(log, reqInfo.AccountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		log.Check(err, "closing account")
+	}()
+
+	var exp time.Time
+	if expires != nil {
+		exp = *expires
+	}
+	err = acc.DB.Write(ctx, func(tx *bstore.Tx) error {
+		_, password, err = store.AppPasswordAdd(tx, name, protocols, exp)
+		return err
+	})
+	if errors.Is(err, store.ErrAppPasswordExists) || errors.Is(err, store.ErrAppPasswordInvalid) {
+		xcheckuserf(ctx, err, "adding app password")
+	}
+	xcheckf(ctx, err, "adding app password")
+	return password
+}
+
+// AppPasswordRemove removes an app password, it can no longer be used for
+// logging in.
+func (Account) AppPasswordRemove(ctx context.Context, name string) {
+	log := pkglog.WithContext(ctx)
+	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
+	acc, err := store.OpenAccount(log, reqInfo.AccountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		log.Check(err, "closing account")
+	}()
+
+	err = acc.DB.Write(ctx, func(tx *bstore.Tx) error {
+		return store.AppPasswordRemove(tx, name)
+	})
+	if errors.Is(err, store.ErrAppPasswordUnknown) {
+		xcheckuserf(ctx, err, "removing app password")
+	}
+	xcheckf(ctx, err, "removing app password")
+}
+
+// CryptoKeys returns the private keys of the account for signing and
+// decrypting messages in webmail, and the public keys of correspondents.
+func (Account) CryptoKeys(ctx context.Context) (keys []store.CryptoKey, peerKeys []store.PeerKey) {
+	log := pkglog.WithContext(ctx)
+	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
+	acc, err := store.OpenAccount(log, reqInfo.AccountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		log.Check(err, "closing account")
+	}()
+
+	err = acc.DB.Read(ctx, func(tx *bstore.Tx) error {
+		keys, err = store.CryptoKeyList(tx)
+		if err != nil {
+			return err
+		}
+		peerKeys, err = store.PeerKeyList(tx)
+		return err
+	})
+	xcheckf(ctx, err, "listing keys")
+	return
+}
+
+// CryptoKeyGenerate generates a new OpenPGP key for the address, which must be
+// an address of the account.
+func (Account) CryptoKeyGenerate(ctx context.Context, name, address string) store.CryptoKey {
+	log := pkglog.WithContext(ctx)
+	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
+
+	addr, err := smtp.ParseAddress(address)
+	xcheckuserf(ctx, err, "parsing address")
+	accName, _, _, _, err := mox.LookupAddress(addr.Localpart, addr.Domain, false, false)
+	if err != nil || accName != reqInfo.AccountName {
+		xcheckuserf(ctx, errors.New("not an address of the account"), "checking address")
+	}
+
+	acc, err := store.OpenAccount(log, reqInfo.AccountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		log.Check(err, "closing account")
+	}()
+
+	var k store.CryptoKey
+	err = acc.DB.Write(ctx, func(tx *bstore.Tx) error {
+		k, err = store.CryptoKeyGenerate(tx, name, addr.String())
+		return err
+	})
+	xcheckf(ctx, err, "generating key")
+	return k
+}
+
+// CryptoKeyImport adds a private key. For S/MIME, data must be PEM with the
+// private key and certificate chain. For OpenPGP, data is an ASCII-armored
+// private key, decrypted with passphrase if protected.
+func (Account) CryptoKeyImport(ctx context.Context, kind store.CryptoKind, data, passphrase string) store.CryptoKey {
+	log := pkglog.WithContext(ctx)
+	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
+	acc, err := store.OpenAccount(log, reqInfo.AccountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		log.Check(err, "closing account")
+	}()
+
+	var k store.CryptoKey
+	err = acc.DB.Write(ctx, func(tx *bstore.Tx) error {
+		k, err = store.CryptoKeyImport(tx, kind, []byte(data), passphrase)
+		return err
+	})
+	if errors.Is(err, store.ErrCryptoKeyExists) || errors.Is(err, store.ErrCryptoKeyInvalid) {
+		xcheckuserf(ctx, err, "importing key")
+	}
+	xcheckf(ctx, err, "importing key")
+	return k
+}
+
+// CryptoKeyPublic returns the public part of a key, to share with
+// correspondents: PEM certificates for S/MIME, an ASCII-armored key for OpenPGP.
+func (Account) CryptoKeyPublic(ctx context.Context, id int64) string {
+	log := pkglog.WithContext(ctx)
+	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
+	acc, err := store.OpenAccount(log, reqInfo.AccountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		log.Check(err, "closing account")
+	}()
+
+	k := store.CryptoKey{ID: id}
+	err = acc.DB.Get(ctx, &k)
+	if err == bstore.ErrAbsent {
+		xcheckuserf(ctx, store.ErrCryptoKeyUnknown, "get key")
+	}
+	xcheckf(ctx, err, "get key")
+	s, err := k.PublicKeyText()
+	xcheckf(ctx, err, "formatting public key")
+	return s
+}
+
+// CryptoKeyRemove removes a private key. Messages encrypted for the key can no
+// longer be decrypted.
+func (Account) CryptoKeyRemove(ctx context.Context, id int64) {
+	log := pkglog.WithContext(ctx)
+	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
+	acc, err := store.OpenAccount(log, reqInfo.AccountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		log.Check(err, "closing account")
+	}()
+
+	err = acc.DB.Write(ctx, func(tx *bstore.Tx) error {
+		return store.CryptoKeyRemove(tx, id)
+	})
+	if errors.Is(err, store.ErrCryptoKeyUnknown) {
+		xcheckuserf(ctx, err, "removing key")
+	}
+	xcheckf(ctx, err, "removing key")
+}
+
+// PeerKeyImport adds public keys of correspondents, replacing existing keys for
+// the same addresses. For S/MIME, data must be PEM certificates. For OpenPGP,
+// data must be ASCII-armored public keys.
+func (Account) PeerKeyImport(ctx context.Context, kind store.CryptoKind, data string) []store.PeerKey {
+	log := pkglog.WithContext(ctx)
+	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
+	acc, err := store.OpenAccount(log, reqInfo.AccountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		log.Check(err, "closing account")
+	}()
+
+	var l []store.PeerKey
+	err = acc.DB.Write(ctx, func(tx *bstore.Tx) error {
+		l, err = store.PeerKeyImport(tx, kind, []byte(data))
+		return err
+	})
+	if errors.Is(err, store.ErrCryptoKeyInvalid) {
+		xcheckuserf(ctx, err, "importing keys")
+	}
+	xcheckf(ctx, err, "importing keys")
+	return l
+}
+
+// PeerKeyRemove removes a public key of a correspondent.
+func (Account) PeerKeyRemove(ctx context.Context, id int64) {
+	log := pkglog.WithContext(ctx)
+	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
+	acc, err := store.OpenAccount(log, reqInfo.AccountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		log.Check(err, "closing account")
+	}()
+
+	err = acc.DB.Write(ctx, func(tx *bstore.Tx) error {
+		return store.PeerKeyRemove(tx, id)
+	})
+	if errors.Is(err, store.ErrCryptoKeyUnknown) {
+		xcheckuserf(ctx, err, "removing key")
+	}
+	xcheckf(ctx, err, "removing key")
+}
+
+// TOTPStatus returns whether two-factor authentication with a TOTP is enabled for
+// logins to the web interfaces, and the number of unused recovery codes.
+func (Account) TOTPStatus(ctx context.Context) (enabled bool, recoveryCodesLeft int) {
+	log := pkglog.WithContext(ctx)
+	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
+	acc, err := store.OpenAccount(log, reqInfo.AccountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		log.Check(err, "closing account")
+	}()
+
+	err = acc.DB.Read(ctx, func(tx *bstore.Tx) error {
+		t, err := store.TOTPGet(tx)
+		if err == store.ErrTOTPUnknown {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		enabled = true
+		recoveryCodesLeft = len(t.RecoveryCodes)
+		return nil
+	})
+	xcheckf(ctx, err, "get totp")
+	return
+}
+
+// TOTPSetupStart starts enrollment for two-factor authentication with a new
+// secret, for adding to an authenticator app. Logins do not require a code until
+// enrollment is confirmed with TOTPSetupConfirm.
+func (Account) TOTPSetupStart(ctx context.Context) webauth.TOTPSetup {
+	log := pkglog.WithContext(ctx)
+	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
+	acc, err := store.OpenAccount(log, reqInfo.AccountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		log.Check(err, "closing account")
+	}()
+
+	var t store.TOTP
+	err = acc.DB.Write(ctx, func(tx *bstore.Tx) error {
+		t, err = store.TOTPSetupStart(tx)
+		return err
+	})
+	if errors.Is(err, store.ErrTOTPEnabled) {
+		xcheckuserf(ctx, err, "starting two-factor authentication setup")
+	}
+	xcheckf(ctx, err, "starting two-factor authentication setup")
+
+	setup, err := webauth.NewTOTPSetup(mox.Conf.Static.HostnameDomain.ASCII, reqInfo.LoginAddress, t.Secret)
+	xcheckf(ctx, err, "totp setup")
+	return setup
+}
+
+// TOTPSetupConfirm enables two-factor authentication if code from the
+// authenticator app is valid, and returns recovery codes. Each recovery code can
+// be used once instead of a code from the authenticator app.
+func (Account) TOTPSetupConfirm(ctx context.Context, code string) (recoveryCodes []string) {
+	log := pkglog.WithContext(ctx)
+	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
+	acc, err := store.OpenAccount(log, reqInfo.AccountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		log.Check(err, "closing account")
+	}()
+
+	err = acc.DB.Write(ctx, func(tx *bstore.Tx) error {
+		recoveryCodes, err = store.TOTPSetupConfirm(tx, code)
+		return err
+	})
+	if errors.Is(err, store.ErrTOTPUnknown) || errors.Is(err, store.ErrTOTPEnabled) || errors.Is(err, store.ErrTOTPCodeInvalid) {
+		xcheckuserf(ctx, err, "confirming two-factor authentication")
+	}
+	xcheckf(ctx, err, "confirming two-factor authentication")
+	return recoveryCodes
+}
+
+// TOTPRecoveryCodes replaces the recovery codes with new codes, and returns them.
+func (Account) TOTPRecoveryCodes(ctx context.Context) (recoveryCodes []string) {
+	log := pkglog.WithContext(ctx)
+	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
+	acc, err := store.OpenAccount(log, reqInfo.AccountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		log.Check(err, "closing account")
+	}()
+
+	err = acc.DB.Write(ctx, func(tx *bstore.Tx) error {
+		recoveryCodes, err = store.TOTPRecoveryCodesRegenerate(tx)
+		return err
+	})
+	if errors.Is(err, store.ErrTOTPUnknown) {
+		xcheckuserf(ctx, err, "generating recovery codes")
+	}
+	xcheckf(ctx, err, "generating recovery codes")
+	return recoveryCodes
+}
+
+// TOTPDisable disables two-factor authentication, logins only require a password
+// again.
+func (Account) TOTPDisable(ctx context.Context) {
+	log := pkglog.WithContext(ctx)
+	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
+	acc, err := store.OpenAccount(log, reqInfo.AccountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		log.Check(err, "closing account")
+	}()
+
+	err = acc.DB.Write(ctx, func(tx *bstore.Tx) error {
+		return store.TOTPDisable(tx)
+	})
+	if errors.Is(err, store.ErrTOTPUnknown) {
+		xcheckuserf(ctx, err, "disabling two-factor authentication")
+	}
+	xcheckf(ctx, err, "disabling two-factor authentication")
+}
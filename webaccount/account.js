@@ -255,11 +255,17 @@ var api;
 		// per-outgoing-message address used for sending.
 		OutgoingEvent["EventUnrecognized"] = "unrecognized";
 	})(OutgoingEvent = api.OutgoingEvent || (api.OutgoingEvent = {}));
-	api.structTypes = { "Account": true, "Address": true, "AddressAlias": true, "Alias": true, "AliasAddress": true, "AutomaticJunkFlags": true, "Destination": true, "Domain": true, "ImportProgress": true, "Incoming": true, "IncomingMeta": true, "IncomingWebhook": true, "JunkFilter": true, "NameAddress": true, "Outgoing": true, "OutgoingWebhook": true, "Route": true, "Ruleset": true, "Structure": true, "SubjectPass": true, "Suppression": true };
-	api.stringsTypes = { "CSRFToken": true, "Localpart": true, "OutgoingEvent": true };
-	api.intsTypes = {};
+	// CryptoKind is a mechanism for signing and encrypting messages.
+	let CryptoKind;
+	(function (CryptoKind) {
+		CryptoKind["CryptoSMIME"] = "smime";
+		CryptoKind["CryptoOpenPGP"] = "openpgp";
+	})(CryptoKind = api.CryptoKind || (api.CryptoKind = {}));
+	api.structTypes = { "Account": true, "Address": true, "AddressAlias": true, "AddressBook": true, "AddressBookContacts": true, "Alias": true, "AliasAddress": true, "AppPassword": true, "AutomaticJunkFlags": true, "Contact": true, "CryptoKey": true, "Destination": true, "Domain": true, "ImportProgress": true, "Incoming": true, "IncomingMeta": true, "IncomingWebhook": true, "JunkFilter": true, "NameAddress": true, "Outgoing": true, "OutgoingWebhook": true, "PeerKey": true, "Route": true, "Ruleset": true, "SieveScript": true, "Structure": true, "SubjectPass": true, "Suppression": true, "TOTPSetup": true, "Vacation": true };
+	api.stringsTypes = { "CSRFToken": true, "CryptoKind": true, "Localpart": true, "OutgoingEvent": true };
+	api.intsTypes = { "ModSeq": true };
 	api.types = {
-		"Account": { "Name": "Account", "Docs": "", "Fields": [{ "Name": "OutgoingWebhook", "Docs": "", "Typewords": ["nullable", "OutgoingWebhook"] }, { "Name": "IncomingWebhook", "Docs": "", "Typewords": ["nullable", "IncomingWebhook"] }, { "Name": "FromIDLoginAddresses", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "KeepRetiredMessagePeriod", "Docs": "", "Typewords": ["int64"] }, { "Name": "KeepRetiredWebhookPeriod", "Docs": "", "Typewords": ["int64"] }, { "Name": "Domain", "Docs": "", "Typewords": ["string"] }, { "Name": "Description", "Docs": "", "Typewords": ["string"] }, { "Name": "FullName", "Docs": "", "Typewords": ["string"] }, { "Name": "Destinations", "Docs": "", "Typewords": ["{}", "Destination"] }, { "Name": "SubjectPass", "Docs": "", "Typewords": ["SubjectPass"] }, { "Name": "QuotaMessageSize", "Docs": "", "Typewords": ["int64"] }, { "Name": "RejectsMailbox", "Docs": "", "Typewords": ["string"] }, { "Name": "KeepRejects", "Docs": "", "Typewords": ["bool"] }, { "Name": "AutomaticJunkFlags", "Docs": "", "Typewords": ["AutomaticJunkFlags"] }, { "Name": "JunkFilter", "Docs": "", "Typewords": ["nullable", "JunkFilter"] }, { "Name": "MaxOutgoingMessagesPerDay", "Docs": "", "Typewords": ["int32"] }, { "Name": "MaxFirstTimeRecipientsPerDay", "Docs": "", "Typewords": ["int32"] }, { "Name": "NoFirstTimeSenderDelay", "Docs": "", "Typewords": ["bool"] }, { "Name": "Routes", "Docs": "", "Typewords": ["[]", "Route"] }, { "Name": "DNSDomain", "Docs": "", "Typewords": ["Domain"] }, { "Name": "Aliases", "Docs": "", "Typewords": ["[]", "AddressAlias"] }] },
+		"Account": { "Name": "Account", "Docs": "", "Fields": [{ "Name": "OutgoingWebhook", "Docs": "", "Typewords": ["nullable", "OutgoingWebhook"] }, { "Name": "IncomingWebhook", "Docs": "", "Typewords": ["nullable", "IncomingWebhook"] }, { "Name": "FromIDLoginAddresses", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "KeepRetiredMessagePeriod", "Docs": "", "Typewords": ["int64"] }, { "Name": "KeepRetiredWebhookPeriod", "Docs": "", "Typewords": ["int64"] }, { "Name": "Domain", "Docs": "", "Typewords": ["string"] }, { "Name": "Description", "Docs": "", "Typewords": ["string"] }, { "Name": "FullName", "Docs": "", "Typewords": ["string"] }, { "Name": "Destinations", "Docs": "", "Typewords": ["{}", "Destination"] }, { "Name": "SubjectPass", "Docs": "", "Typewords": ["SubjectPass"] }, { "Name": "QuotaMessageSize", "Docs": "", "Typewords": ["int64"] }, { "Name": "RejectsMailbox", "Docs": "", "Typewords": ["string"] }, { "Name": "KeepRejects", "Docs": "", "Typewords": ["bool"] }, { "Name": "AutomaticJunkFlags", "Docs": "", "Typewords": ["AutomaticJunkFlags"] }, { "Name": "JunkFilter", "Docs": "", "Typewords": ["nullable", "JunkFilter"] }, { "Name": "MaxOutgoingMessagesPerDay", "Docs": "", "Typewords": ["int32"] }, { "Name": "MaxFirstTimeRecipientsPerDay", "Docs": "", "Typewords": ["int32"] }, { "Name": "NoFirstTimeSenderDelay", "Docs": "", "Typewords": ["bool"] }, { "Name": "Routes", "Docs": "", "Typewords": ["[]", "Route"] }, { "Name": "EncryptMessages", "Docs": "", "Typewords": ["bool"] }, { "Name": "DNSDomain", "Docs": "", "Typewords": ["Domain"] }, { "Name": "Aliases", "Docs": "", "Typewords": ["[]", "AddressAlias"] }] },
 		"OutgoingWebhook": { "Name": "OutgoingWebhook", "Docs": "", "Fields": [{ "Name": "URL", "Docs": "", "Typewords": ["string"] }, { "Name": "Authorization", "Docs": "", "Typewords": ["string"] }, { "Name": "Events", "Docs": "", "Typewords": ["[]", "string"] }] },
 		"IncomingWebhook": { "Name": "IncomingWebhook", "Docs": "", "Fields": [{ "Name": "URL", "Docs": "", "Typewords": ["string"] }, { "Name": "Authorization", "Docs": "", "Typewords": ["string"] }] },
 		"Destination": { "Name": "Destination", "Docs": "", "Fields": [{ "Name": "Mailbox", "Docs": "", "Typewords": ["string"] }, { "Name": "Rulesets", "Docs": "", "Typewords": ["[]", "Ruleset"] }, { "Name": "FullName", "Docs": "", "Typewords": ["string"] }] },
@@ -268,9 +274,9 @@ var api;
 		"SubjectPass": { "Name": "SubjectPass", "Docs": "", "Fields": [{ "Name": "Period", "Docs": "", "Typewords": ["int64"] }] },
 		"AutomaticJunkFlags": { "Name": "AutomaticJunkFlags", "Docs": "", "Fields": [{ "Name": "Enabled", "Docs": "", "Typewords": ["bool"] }, { "Name": "JunkMailboxRegexp", "Docs": "", "Typewords": ["string"] }, { "Name": "NeutralMailboxRegexp", "Docs": "", "Typewords": ["string"] }, { "Name": "NotJunkMailboxRegexp", "Docs": "", "Typewords": ["string"] }] },
 		"JunkFilter": { "Name": "JunkFilter", "Docs": "", "Fields": [{ "Name": "Threshold", "Docs": "", "Typewords": ["float64"] }, { "Name": "Onegrams", "Docs": "", "Typewords": ["bool"] }, { "Name": "Twograms", "Docs": "", "Typewords": ["bool"] }, { "Name": "Threegrams", "Docs": "", "Typewords": ["bool"] }, { "Name": "MaxPower", "Docs": "", "Typewords": ["float64"] }, { "Name": "TopWords", "Docs": "", "Typewords": ["int32"] }, { "Name": "IgnoreWords", "Docs": "", "Typewords": ["float64"] }, { "Name": "RareWords", "Docs": "", "Typewords": ["int32"] }] },
-		"Route": { "Name": "Route", "Docs": "", "Fields": [{ "Name": "FromDomain", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "ToDomain", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "MinimumAttempts", "Docs": "", "Typewords": ["int32"] }, { "Name": "Transport", "Docs": "", "Typewords": ["string"] }, { "Name": "FromDomainASCII", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "ToDomainASCII", "Docs": "", "Typewords": ["[]", "string"] }] },
+		"Route": { "Name": "Route", "Docs": "", "Fields": [{ "Name": "FromDomain", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "ToDomain", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "MinimumAttempts", "Docs": "", "Typewords": ["int32"] }, { "Name": "Transport", "Docs": "", "Typewords": ["string"] }, { "Name": "IPPool", "Docs": "", "Typewords": ["string"] }, { "Name": "FromDomainASCII", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "ToDomainASCII", "Docs": "", "Typewords": ["[]", "string"] }] },
 		"AddressAlias": { "Name": "AddressAlias", "Docs": "", "Fields": [{ "Name": "SubscriptionAddress", "Docs": "", "Typewords": ["string"] }, { "Name": "Alias", "Docs": "", "Typewords": ["Alias"] }, { "Name": "MemberAddresses", "Docs": "", "Typewords": ["[]", "string"] }] },
-		"Alias": { "Name": "Alias", "Docs": "", "Fields": [{ "Name": "Addresses", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "PostPublic", "Docs": "", "Typewords": ["bool"] }, { "Name": "ListMembers", "Docs": "", "Typewords": ["bool"] }, { "Name": "AllowMsgFrom", "Docs": "", "Typewords": ["bool"] }, { "Name": "LocalpartStr", "Docs": "", "Typewords": ["string"] }, { "Name": "Domain", "Docs": "", "Typewords": ["Domain"] }, { "Name": "ParsedAddresses", "Docs": "", "Typewords": ["[]", "AliasAddress"] }] },
+		"Alias": { "Name": "Alias", "Docs": "", "Fields": [{ "Name": "Addresses", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "PostPublic", "Docs": "", "Typewords": ["bool"] }, { "Name": "ListMembers", "Docs": "", "Typewords": ["bool"] }, { "Name": "AllowMsgFrom", "Docs": "", "Typewords": ["bool"] }, { "Name": "ListOwner", "Docs": "", "Typewords": ["string"] }, { "Name": "Subscribe", "Docs": "", "Typewords": ["bool"] }, { "Name": "Moderate", "Docs": "", "Typewords": ["bool"] }, { "Name": "DigestInterval", "Docs": "", "Typewords": ["int64"] }, { "Name": "LocalpartStr", "Docs": "", "Typewords": ["string"] }, { "Name": "Domain", "Docs": "", "Typewords": ["Domain"] }, { "Name": "ParsedAddresses", "Docs": "", "Typewords": ["[]", "AliasAddress"] }, { "Name": "ParsedListOwner", "Docs": "", "Typewords": ["AliasAddress"] }] },
 		"AliasAddress": { "Name": "AliasAddress", "Docs": "", "Fields": [{ "Name": "Address", "Docs": "", "Typewords": ["Address"] }, { "Name": "AccountName", "Docs": "", "Typewords": ["string"] }, { "Name": "Destination", "Docs": "", "Typewords": ["Destination"] }] },
 		"Address": { "Name": "Address", "Docs": "", "Fields": [{ "Name": "Localpart", "Docs": "", "Typewords": ["Localpart"] }, { "Name": "Domain", "Docs": "", "Typewords": ["Domain"] }] },
 		"Suppression": { "Name": "Suppression", "Docs": "", "Fields": [{ "Name": "ID", "Docs": "", "Typewords": ["int64"] }, { "Name": "Created", "Docs": "", "Typewords": ["timestamp"] }, { "Name": "Account", "Docs": "", "Typewords": ["string"] }, { "Name": "BaseAddress", "Docs": "", "Typewords": ["string"] }, { "Name": "OriginalAddress", "Docs": "", "Typewords": ["string"] }, { "Name": "Manual", "Docs": "", "Typewords": ["bool"] }, { "Name": "Reason", "Docs": "", "Typewords": ["string"] }] },
@@ -280,9 +286,20 @@ var api;
 		"NameAddress": { "Name": "NameAddress", "Docs": "", "Fields": [{ "Name": "Name", "Docs": "", "Typewords": ["string"] }, { "Name": "Address", "Docs": "", "Typewords": ["string"] }] },
 		"Structure": { "Name": "Structure", "Docs": "", "Fields": [{ "Name": "ContentType", "Docs": "", "Typewords": ["string"] }, { "Name": "ContentTypeParams", "Docs": "", "Typewords": ["{}", "string"] }, { "Name": "ContentID", "Docs": "", "Typewords": ["string"] }, { "Name": "DecodedSize", "Docs": "", "Typewords": ["int64"] }, { "Name": "Parts", "Docs": "", "Typewords": ["[]", "Structure"] }] },
 		"IncomingMeta": { "Name": "IncomingMeta", "Docs": "", "Fields": [{ "Name": "MsgID", "Docs": "", "Typewords": ["int64"] }, { "Name": "MailFrom", "Docs": "", "Typewords": ["string"] }, { "Name": "MailFromValidated", "Docs": "", "Typewords": ["bool"] }, { "Name": "MsgFromValidated", "Docs": "", "Typewords": ["bool"] }, { "Name": "RcptTo", "Docs": "", "Typewords": ["string"] }, { "Name": "DKIMVerifiedDomains", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "RemoteIP", "Docs": "", "Typewords": ["string"] }, { "Name": "Received", "Docs": "", "Typewords": ["timestamp"] }, { "Name": "MailboxName", "Docs": "", "Typewords": ["string"] }, { "Name": "Automated", "Docs": "", "Typewords": ["bool"] }] },
+		"SieveScript": { "Name": "SieveScript", "Docs": "", "Fields": [{ "Name": "ID", "Docs": "", "Typewords": ["int64"] }, { "Name": "Name", "Docs": "", "Typewords": ["string"] }, { "Name": "Content", "Docs": "", "Typewords": ["string"] }, { "Name": "Active", "Docs": "", "Typewords": ["bool"] }, { "Name": "Created", "Docs": "", "Typewords": ["timestamp"] }, { "Name": "Updated", "Docs": "", "Typewords": ["timestamp"] }] },
+		"Vacation": { "Name": "Vacation", "Docs": "", "Fields": [{ "Name": "ID", "Docs": "", "Typewords": ["uint8"] }, { "Name": "Enabled", "Docs": "", "Typewords": ["bool"] }, { "Name": "Start", "Docs": "", "Typewords": ["timestamp"] }, { "Name": "End", "Docs": "", "Typewords": ["timestamp"] }, { "Name": "Subject", "Docs": "", "Typewords": ["string"] }, { "Name": "Body", "Docs": "", "Typewords": ["string"] }, { "Name": "IntervalDays", "Docs": "", "Typewords": ["int32"] }] },
+		"AddressBookContacts": { "Name": "AddressBookContacts", "Docs": "", "Fields": [{ "Name": "AddressBook", "Docs": "", "Typewords": ["AddressBook"] }, { "Name": "Contacts", "Docs": "", "Typewords": ["[]", "Contact"] }] },
+		"AddressBook": { "Name": "AddressBook", "Docs": "", "Fields": [{ "Name": "ID", "Docs": "", "Typewords": ["int64"] }, { "Name": "Name", "Docs": "", "Typewords": ["string"] }, { "Name": "DisplayName", "Docs": "", "Typewords": ["string"] }, { "Name": "Description", "Docs": "", "Typewords": ["string"] }, { "Name": "ModSeq", "Docs": "", "Typewords": ["ModSeq"] }, { "Name": "Created", "Docs": "", "Typewords": ["timestamp"] }] },
+		"Contact": { "Name": "Contact", "Docs": "", "Fields": [{ "Name": "ID", "Docs": "", "Typewords": ["int64"] }, { "Name": "AddressBookID", "Docs": "", "Typewords": ["int64"] }, { "Name": "Name", "Docs": "", "Typewords": ["string"] }, { "Name": "ModSeq", "Docs": "", "Typewords": ["ModSeq"] }, { "Name": "Expunged", "Docs": "", "Typewords": ["bool"] }, { "Name": "UID", "Docs": "", "Typewords": ["string"] }, { "Name": "FormattedName", "Docs": "", "Typewords": ["string"] }, { "Name": "Emails", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "VCard", "Docs": "", "Typewords": ["string"] }, { "Name": "Updated", "Docs": "", "Typewords": ["timestamp"] }] },
+		"AppPassword": { "Name": "AppPassword", "Docs": "", "Fields": [{ "Name": "ID", "Docs": "", "Typewords": ["int64"] }, { "Name": "Created", "Docs": "", "Typewords": ["timestamp"] }, { "Name": "Name", "Docs": "", "Typewords": ["string"] }, { "Name": "Protocols", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "Expires", "Docs": "", "Typewords": ["timestamp"] }, { "Name": "LastUsed", "Docs": "", "Typewords": ["timestamp"] }, { "Name": "LastUsedProtocol", "Docs": "", "Typewords": ["string"] }] },
+		"CryptoKey": { "Name": "CryptoKey", "Docs": "", "Fields": [{ "Name": "ID", "Docs": "", "Typewords": ["int64"] }, { "Name": "Created", "Docs": "", "Typewords": ["timestamp"] }, { "Name": "Kind", "Docs": "", "Typewords": ["CryptoKind"] }, { "Name": "Fingerprint", "Docs": "", "Typewords": ["string"] }, { "Name": "Addresses", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "Description", "Docs": "", "Typewords": ["string"] }, { "Name": "NotAfter", "Docs": "", "Typewords": ["timestamp"] }] },
+		"PeerKey": { "Name": "PeerKey", "Docs": "", "Fields": [{ "Name": "ID", "Docs": "", "Typewords": ["int64"] }, { "Name": "Updated", "Docs": "", "Typewords": ["timestamp"] }, { "Name": "Kind", "Docs": "", "Typewords": ["CryptoKind"] }, { "Name": "Address", "Docs": "", "Typewords": ["string"] }, { "Name": "Fingerprint", "Docs": "", "Typewords": ["string"] }, { "Name": "Source", "Docs": "", "Typewords": ["string"] }, { "Name": "PreferEncrypt", "Docs": "", "Typewords": ["bool"] }, { "Name": "MessageTime", "Docs": "", "Typewords": ["timestamp"] }] },
+		"TOTPSetup": { "Name": "TOTPSetup", "Docs": "", "Fields": [{ "Name": "URI", "Docs": "", "Typewords": ["string"] }, { "Name": "Secret", "Docs": "", "Typewords": ["string"] }, { "Name": "QRCodePNG", "Docs": "", "Typewords": ["string"] }] },
+		"ModSeq": { "Name": "ModSeq", "Docs": "", "Values": null },
 		"CSRFToken": { "Name": "CSRFToken", "Docs": "", "Values": null },
 		"Localpart": { "Name": "Localpart", "Docs": "", "Values": null },
 		"OutgoingEvent": { "Name": "OutgoingEvent", "Docs": "", "Values": [{ "Name": "EventDelivered", "Value": "delivered", "Docs": "" }, { "Name": "EventSuppressed", "Value": "suppressed", "Docs": "" }, { "Name": "EventDelayed", "Value": "delayed", "Docs": "" }, { "Name": "EventFailed", "Value": "failed", "Docs": "" }, { "Name": "EventRelayed", "Value": "relayed", "Docs": "" }, { "Name": "EventExpanded", "Value": "expanded", "Docs": "" }, { "Name": "EventCanceled", "Value": "canceled", "Docs": "" }, { "Name": "EventUnrecognized", "Value": "unrecognized", "Docs": "" }] },
+		"CryptoKind": { "Name": "CryptoKind", "Docs": "", "Values": [{ "Name": "CryptoSMIME", "Value": "smime", "Docs": "" }, { "Name": "CryptoOpenPGP", "Value": "openpgp", "Docs": "" }] },
 	};
 	api.parser = {
 		Account: (v) => api.parse("Account", v),
@@ -306,9 +323,20 @@ var api;
 		NameAddress: (v) => api.parse("NameAddress", v),
 		Structure: (v) => api.parse("Structure", v),
 		IncomingMeta: (v) => api.parse("IncomingMeta", v),
+		SieveScript: (v) => api.parse("SieveScript", v),
+		Vacation: (v) => api.parse("Vacation", v),
+		AddressBookContacts: (v) => api.parse("AddressBookContacts", v),
+		AddressBook: (v) => api.parse("AddressBook", v),
+		Contact: (v) => api.parse("Contact", v),
+		AppPassword: (v) => api.parse("AppPassword", v),
+		CryptoKey: (v) => api.parse("CryptoKey", v),
+		PeerKey: (v) => api.parse("PeerKey", v),
+		TOTPSetup: (v) => api.parse("TOTPSetup", v),
+		ModSeq: (v) => api.parse("ModSeq", v),
 		CSRFToken: (v) => api.parse("CSRFToken", v),
 		Localpart: (v) => api.parse("Localpart", v),
 		OutgoingEvent: (v) => api.parse("OutgoingEvent", v),
+		CryptoKind: (v) => api.parse("CryptoKind", v),
 	};
 	// Account exports web API functions for the account web interface. All its
 	// methods are exported under api/. Function calls require valid HTTP
@@ -353,6 +381,45 @@ var api;
 			const params = [loginToken, username, password];
 			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
 		}
+		// LoginTOTP completes a login for which Login failed with error code
+		// "user:totpRequired", with a code from an authenticator app or a recovery code.
+		// Fails with error code "user:loginFailed" for a bad code.
+		async LoginTOTP(loginToken, code) {
+			const fn = "LoginTOTP";
+			const paramTypes = [["string"], ["string"]];
+			const returnTypes = [["CSRFToken"]];
+			const params = [loginToken, code];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// LoginOIDCEnabled returns whether logging in through an OpenID Connect identity
+		// provider (single sign-on) is available.
+		async LoginOIDCEnabled() {
+			const fn = "LoginOIDCEnabled";
+			const paramTypes = [];
+			const returnTypes = [["bool"]];
+			const params = [];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// LoginOIDCStart starts a login through the identity provider, returning the URL
+		// to navigate to. Call LoginPrep to get a loginToken. After logging in at the
+		// identity provider, the browser returns with an "oidc" query string parameter,
+		// which must be passed to LoginOIDC.
+		async LoginOIDCStart(loginToken) {
+			const fn = "LoginOIDCStart";
+			const paramTypes = [["string"]];
+			const returnTypes = [["string"]];
+			const params = [loginToken];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// LoginOIDC completes a login through the identity provider, returning a session
+		// token like Login, and the address the user logged in with.
+		async LoginOIDC(state) {
+			const fn = "LoginOIDC";
+			const paramTypes = [["string"]];
+			const returnTypes = [["CSRFToken"], ["string"]];
+			const params = [state];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
 		// Logout invalidates the session token.
 		async Logout() {
 			const fn = "Logout";
@@ -525,6 +592,234 @@ var api;
 			const params = [mailbox, keep];
 			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
 		}
+		// SieveScripts returns the Sieve scripts of the account, ordered by name.
+		async SieveScripts() {
+			const fn = "SieveScripts";
+			const paramTypes = [];
+			const returnTypes = [["[]", "SieveScript"]];
+			const params = [];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// SieveScriptSave adds or replaces a Sieve script. The script is checked for
+		// errors before it is stored. If activate is set, the script becomes the active
+		// script, used for evaluating incoming messages instead of the rulesets of the
+		// destinations.
+		async SieveScriptSave(name, content, activate) {
+			const fn = "SieveScriptSave";
+			const paramTypes = [["string"], ["string"], ["bool"]];
+			const returnTypes = [["SieveScript"]];
+			const params = [name, content, activate];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// SieveScriptActivate makes the script with name the active script. If name is
+		// empty, no script will be active anymore.
+		async SieveScriptActivate(name) {
+			const fn = "SieveScriptActivate";
+			const paramTypes = [["string"]];
+			const returnTypes = [];
+			const params = [name];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// SieveScriptRemove removes a Sieve script. The active script cannot be removed.
+		async SieveScriptRemove(name) {
+			const fn = "SieveScriptRemove";
+			const paramTypes = [["string"]];
+			const returnTypes = [];
+			const params = [name];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// Vacation returns the vacation settings of the account, for automatic responses
+		// to incoming messages.
+		async Vacation() {
+			const fn = "Vacation";
+			const paramTypes = [];
+			const returnTypes = [["Vacation"]];
+			const params = [];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// VacationSave saves the vacation settings. While enabled and within the
+		// optional start and end time, senders of incoming messages get an automatic
+		// response, at most once per interval. No responses are sent to mailing lists,
+		// automated messages, or if the active Sieve script sends its own vacation
+		// response.
+		async VacationSave(vacation) {
+			const fn = "VacationSave";
+			const paramTypes = [["Vacation"]];
+			const returnTypes = [];
+			const params = [vacation];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// AddressBooks returns the address books of the account with their contacts,
+		// ordered by name. The default address book is created if the account has none.
+		// Address books are synchronized with clients over CardDAV.
+		async AddressBooks() {
+			const fn = "AddressBooks";
+			const paramTypes = [];
+			const returnTypes = [["[]", "AddressBookContacts"]];
+			const params = [];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// AddressBookCreate adds a new address book.
+		async AddressBookCreate(name, displayName) {
+			const fn = "AddressBookCreate";
+			const paramTypes = [["string"], ["string"]];
+			const returnTypes = [];
+			const params = [name, displayName];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// AddressBookRemove removes an address book and its contacts.
+		async AddressBookRemove(name) {
+			const fn = "AddressBookRemove";
+			const paramTypes = [["string"]];
+			const returnTypes = [];
+			const params = [name];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// ContactRemove removes a contact from an address book.
+		async ContactRemove(addressBook, name) {
+			const fn = "ContactRemove";
+			const paramTypes = [["string"], ["string"]];
+			const returnTypes = [];
+			const params = [addressBook, name];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// AppPasswords returns the app passwords of the account, ordered by name.
+		async AppPasswords() {
+			const fn = "AppPasswords";
+			const paramTypes = [];
+			const returnTypes = [["[]", "AppPassword"]];
+			const params = [];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// AppPasswordAdd adds a new app password for one or more of the protocols
+		// "imap", "submission" and "webapi", optionally with an expiration time. The
+		// generated password is returned, it cannot be retrieved later.
+		async AppPasswordAdd(name, protocols, expires) {
+			const fn = "AppPasswordAdd";
+			const paramTypes = [["string"], ["[]", "string"], ["nullable", "timestamp"]];
+			const returnTypes = [["string"]];
+			const params = [name, protocols, expires];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// AppPasswordRemove removes an app password, it can no longer be used for
+		// logging in.
+		async AppPasswordRemove(name) {
+			const fn = "AppPasswordRemove";
+			const paramTypes = [["string"]];
+			const returnTypes = [];
+			const params = [name];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// CryptoKeys returns the private keys of the account for signing and
+		// decrypting messages in webmail, and the public keys of correspondents.
+		async CryptoKeys() {
+			const fn = "CryptoKeys";
+			const paramTypes = [];
+			const returnTypes = [["[]", "CryptoKey"], ["[]", "PeerKey"]];
+			const params = [];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// CryptoKeyGenerate generates a new OpenPGP key for the address, which must be
+		// an address of the account.
+		async CryptoKeyGenerate(name, address) {
+			const fn = "CryptoKeyGenerate";
+			const paramTypes = [["string"], ["string"]];
+			const returnTypes = [["CryptoKey"]];
+			const params = [name, address];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// CryptoKeyImport adds a private key. For S/MIME, data must be PEM with the
+		// private key and certificate chain. For OpenPGP, data is an ASCII-armored
+		// private key, decrypted with passphrase if protected.
+		async CryptoKeyImport(kind, data, passphrase) {
+			const fn = "CryptoKeyImport";
+			const paramTypes = [["CryptoKind"], ["string"], ["string"]];
+			const returnTypes = [["CryptoKey"]];
+			const params = [kind, data, passphrase];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// CryptoKeyPublic returns the public part of a key, to share with
+		// correspondents: PEM certificates for S/MIME, an ASCII-armored key for OpenPGP.
+		async CryptoKeyPublic(id) {
+			const fn = "CryptoKeyPublic";
+			const paramTypes = [["int64"]];
+			const returnTypes = [["string"]];
+			const params = [id];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// CryptoKeyRemove removes a private key. Messages encrypted for the key can no
+		// longer be decrypted.
+		async CryptoKeyRemove(id) {
+			const fn = "CryptoKeyRemove";
+			const paramTypes = [["int64"]];
+			const returnTypes = [];
+			const params = [id];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// PeerKeyImport adds public keys of correspondents, replacing existing keys for
+		// the same addresses. For S/MIME, data must be PEM certificates. For OpenPGP,
+		// data must be ASCII-armored public keys.
+		async PeerKeyImport(kind, data) {
+			const fn = "PeerKeyImport";
+			const paramTypes = [["CryptoKind"], ["string"]];
+			const returnTypes = [["[]", "PeerKey"]];
+			const params = [kind, data];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// PeerKeyRemove removes a public key of a correspondent.
+		async PeerKeyRemove(id) {
+			const fn = "PeerKeyRemove";
+			const paramTypes = [["int64"]];
+			const returnTypes = [];
+			const params = [id];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// TOTPStatus returns whether two-factor authentication with a TOTP is enabled for
+		// logins to the web interfaces, and the number of unused recovery codes.
+		async TOTPStatus() {
+			const fn = "TOTPStatus";
+			const paramTypes = [];
+			const returnTypes = [["bool"], ["int32"]];
+			const params = [];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// TOTPSetupStart starts enrollment for two-factor authentication with a new
+		// secret, for adding to an authenticator app. Logins do not require a code until
+		// enrollment is confirmed with TOTPSetupConfirm.
+		async TOTPSetupStart() {
+			const fn = "TOTPSetupStart";
+			const paramTypes = [];
+			const returnTypes = [["TOTPSetup"]];
+			const params = [];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// TOTPSetupConfirm enables two-factor authentication if code from the
+		// authenticator app is valid, and returns recovery codes. Each recovery code can
+		// be used once instead of a code from the authenticator app.
+		async TOTPSetupConfirm(code) {
+			const fn = "TOTPSetupConfirm";
+			const paramTypes = [["string"]];
+			const returnTypes = [["[]", "string"]];
+			const params = [code];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// TOTPRecoveryCodes replaces the recovery codes with new codes, and returns them.
+		async TOTPRecoveryCodes() {
+			const fn = "TOTPRecoveryCodes";
+			const paramTypes = [];
+			const returnTypes = [["[]", "string"]];
+			const params = [];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// TOTPDisable disables two-factor authentication, logins only require a password
+		// again.
+		async TOTPDisable() {
+			const fn = "TOTPDisable";
+			const paramTypes = [];
+			const returnTypes = [];
+			const params = [];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
 	}
 	api.Client = Client;
 	api.defaultBaseURL = (function () {
@@ -885,14 +1180,37 @@ const login = async (reason) => {
 		let autosize;
 		let username;
 		let password;
+		let totpBox;
+		let totp;
+		let oidcBox;
+		// Set after a valid password when a TOTP code is required for the login.
+		let totpLoginToken = '';
 		const root = dom.div(style({ position: 'absolute', top: 0, right: 0, bottom: 0, left: 0, backgroundColor: '#eee', display: 'flex', alignItems: 'center', justifyContent: 'center', zIndex: '1', animation: 'fadein .15s ease-in' }), dom.div(reasonElem = reason ? dom.div(style({ marginBottom: '2ex', textAlign: 'center' }), reason) : dom.div(), dom.div(style({ backgroundColor: 'white', borderRadius: '.25em', padding: '1em', boxShadow: '0 0 20px rgba(0, 0, 0, 0.1)', border: '1px solid #ddd', maxWidth: '95vw', overflowX: 'auto', maxHeight: '95vh', overflowY: 'auto', marginBottom: '20vh' }), dom.form(async function submit(e) {
 			e.preventDefault();
 			e.stopPropagation();
 			reasonElem.remove();
 			try {
 				fieldset.disabled = true;
-				const loginToken = await client.LoginPrep();
-				const token = await client.Login(loginToken, username.value, password.value);
+				let token;
+				if (totpLoginToken) {
+					token = await client.LoginTOTP(totpLoginToken, totp.value);
+				}
+				else {
+					const loginToken = await client.LoginPrep();
+					try {
+						token = await client.Login(loginToken, username.value, password.value);
+					}
+					catch (err) {
+						if (err.code !== 'user:totpRequired') {
+							throw err;
+						}
+						// Password is valid, a code from the authenticator app is needed too.
+						totpLoginToken = loginToken;
+						totpBox.style.display = 'block';
+						totp.required = true;
+						return;
+					}
+				}
 				try {
 					window.localStorage.setItem('webaccountaddress', username.value);
 					window.localStorage.setItem('webaccountcsrftoken', token);
@@ -909,13 +1227,41 @@ const login = async (reason) => {
 			catch (err) {
 				console.log('login error', err);
 				window.alert('Error: ' + errmsg(err));
+				if (totpLoginToken && err.code !== 'user:loginFailed') {
+					// Login expired, start again with the password.
+					totpLoginToken = '';
+					totpBox.style.display = 'none';
+					totp.required = false;
+				}
 			}
 			finally {
 				fieldset.disabled = false;
+				if (totpLoginToken) {
+					totp.focus();
+				}
+			}
+		}, fieldset = dom.fieldset(dom.h1('Account'), dom.label(style({ display: 'block', marginBottom: '2ex' }), dom.div('Email address', style({ marginBottom: '.5ex' })), autosize = dom.span(dom._class('autosize'), username = dom.input(attr.required(''), attr.placeholder('jane@example.org'), function change() { autosize.dataset.value = username.value; }, function input() { autosize.dataset.value = username.value; }))), dom.label(style({ display: 'block', marginBottom: '2ex' }), dom.div('Password', style({ marginBottom: '.5ex' })), password = dom.input(attr.type('password'), attr.required(''))), totpBox = dom.label(style({ display: 'none', marginBottom: '2ex' }), dom.div('Two-factor authentication code', style({ marginBottom: '.5ex' })), totp = dom.input(attr.autocomplete('one-time-code')), dom.div('From your authenticator app, or a recovery code.', style({ marginTop: '.5ex', fontSize: '.9em' }))), dom.div(style({ textAlign: 'center' }), dom.submitbutton('Login')), oidcBox = dom.div(style({ display: 'none', textAlign: 'center', marginTop: '2ex' }), dom.clickbutton('Login with single sign-on', async function click() {
+			try {
+				fieldset.disabled = true;
+				const loginToken = await client.LoginPrep();
+				// The identity provider redirects back to us, init completes the login.
+				window.location.href = await client.LoginOIDCStart(loginToken);
+			}
+			catch (err) {
+				console.log('login error', err);
+				window.alert('Error: ' + errmsg(err));
+				fieldset.disabled = false;
 			}
-		}, fieldset = dom.fieldset(dom.h1('Account'), dom.label(style({ display: 'block', marginBottom: '2ex' }), dom.div('Email address', style({ marginBottom: '.5ex' })), autosize = dom.span(dom._class('autosize'), username = dom.input(attr.required(''), attr.placeholder('jane@example.org'), function change() { autosize.dataset.value = username.value; }, function input() { autosize.dataset.value = username.value; }))), dom.label(style({ display: 'block', marginBottom: '2ex' }), dom.div('Password', style({ marginBottom: '.5ex' })), password = dom.input(attr.type('password'), attr.required(''))), dom.div(style({ textAlign: 'center' }), dom.submitbutton('Login')))))));
+		})))))));
 		document.body.appendChild(root);
 		username.focus();
+		client.LoginOIDCEnabled()
+			.then(enabled => {
+			if (enabled) {
+				oidcBox.style.display = 'block';
+			}
+		})
+			.catch(err => console.log('checking for single sign-on', err));
 	});
 };
 // Popup shows kids in a centered div with white background on top of a
@@ -1401,7 +1747,7 @@ const index = async () => {
 		await check(fullNameFieldset, client.AccountSaveFullName(fullName.value));
 		fullName.setAttribute('value', fullName.value);
 		fullNameForm.reset();
-	}), dom.br(), dom.h2('Addresses'), dom.ul(Object.entries(acc.Destinations || {}).length === 0 ? dom.li('(None, login disabled)') : [], Object.entries(acc.Destinations || {}).sort().map(t => dom.li(dom.a(prewrap(t[0]), attr.href('#destinations/' + encodeURIComponent(t[0]))), t[0].startsWith('@') ? ' (catchall)' : []))), dom.br(), dom.h2('Aliases/lists'), dom.table(dom.thead(dom.tr(dom.th('Alias address', attr.title('Messages sent to this address will be delivered to all members of the alias/list.')), dom.th('Subscription address', attr.title('Address subscribed to the alias/list.')), dom.th('Allowed senders', attr.title('Whether only members can send through the alias/list, or anyone.')), dom.th('Send as alias address', attr.title('If enabled, messages can be sent with the alias address in the message "From" header.')), dom.th())), (acc.Aliases || []).length === 0 ? dom.tr(dom.td(attr.colspan('5'), 'None')) : [], (acc.Aliases || []).sort((a, b) => a.Alias.LocalpartStr < b.Alias.LocalpartStr ? -1 : (domainName(a.Alias.Domain) < domainName(b.Alias.Domain) ? -1 : 1)).map(a => dom.tr(dom.td(prewrap(a.Alias.LocalpartStr, '@', domainName(a.Alias.Domain))), dom.td(prewrap(a.SubscriptionAddress)), dom.td(a.Alias.PostPublic ? 'Anyone' : 'Members only'), dom.td(a.Alias.AllowMsgFrom ? 'Yes' : 'No'), dom.td((a.MemberAddresses || []).length === 0 ? [] :
+	}), dom.br(), dom.h2('Addresses'), dom.ul(Object.entries(acc.Destinations || {}).length === 0 ? dom.li('(None, login disabled)') : [], Object.entries(acc.Destinations || {}).sort().map(t => dom.li(dom.a(prewrap(t[0]), attr.href('#destinations/' + encodeURIComponent(t[0]))), t[0].startsWith('@') ? ' (catchall)' : []))), dom.br(), dom.h2('Sieve scripts'), dom.p('A Sieve script can be used to filter incoming messages, e.g. delivering to a mailbox, adding flags, redirecting, rejecting or sending a vacation response. If a script is active, it is used instead of the rulesets of the addresses.'), dom.div(dom.a(attr.href('#sieve'), 'Manage Sieve scripts')), dom.br(), dom.h2('Vacation'), dom.p('Send an automatic response to senders of incoming messages while you are away.'), dom.div(dom.a(attr.href('#vacation'), 'Manage vacation response')), dom.br(), dom.h2('Contacts'), dom.p('Contacts in address books are used for completing recipient addresses in webmail, and can be synchronized with phones and desktop clients over CardDAV.'), dom.div(dom.a(attr.href('#contacts'), 'Manage contacts')), dom.br(), dom.h2('Aliases/lists'), dom.table(dom.thead(dom.tr(dom.th('Alias address', attr.title('Messages sent to this address will be delivered to all members of the alias/list.')), dom.th('Subscription address', attr.title('Address subscribed to the alias/list.')), dom.th('Allowed senders', attr.title('Whether only members can send through the alias/list, or anyone.')), dom.th('Send as alias address', attr.title('If enabled, messages can be sent with the alias address in the message "From" header.')), dom.th())), (acc.Aliases || []).length === 0 ? dom.tr(dom.td(attr.colspan('5'), 'None')) : [], (acc.Aliases || []).sort((a, b) => a.Alias.LocalpartStr < b.Alias.LocalpartStr ? -1 : (domainName(a.Alias.Domain) < domainName(b.Alias.Domain) ? -1 : 1)).map(a => dom.tr(dom.td(prewrap(a.Alias.LocalpartStr, '@', domainName(a.Alias.Domain))), dom.td(prewrap(a.SubscriptionAddress)), dom.td(a.Alias.PostPublic ? 'Anyone' : 'Members only'), dom.td(a.Alias.AllowMsgFrom ? 'Yes' : 'No'), dom.td((a.MemberAddresses || []).length === 0 ? [] :
 		dom.clickbutton('Show members', function click() {
 			popup(dom.h1('Members of alias ', prewrap(a.Alias.LocalpartStr, '@', domainName(a.Alias.Domain))), dom.ul((a.MemberAddresses || []).map(addr => dom.li(prewrap(addr)))));
 		}))))), dom.br(), dom.h2('Change password'), passwordForm = dom.form(passwordFieldset = dom.fieldset(dom.label(style({ display: 'inline-block' }), 'New password', dom.br(), password1 = dom.input(attr.type('password'), attr.autocomplete('new-password'), attr.required(''), function focus() {
@@ -1431,7 +1777,7 @@ const index = async () => {
 		}
 		await check(passwordFieldset, client.SetPassword(password1.value));
 		passwordForm.reset();
-	}), dom.br(), dom.h2('Disk usage'), dom.p('Storage used is ', dom.b(formatQuotaSize(Math.floor(storageUsed / (1024 * 1024)) * 1024 * 1024)), storageLimit > 0 ? [
+	}), dom.br(), dom.h2('App passwords'), dom.p('App passwords are generated passwords for a single device or application, for IMAP, SMTP submission and/or the webapi. They can be revoked without changing your account password.'), dom.div(dom.a(attr.href('#apppasswords'), 'Manage app passwords')), dom.br(), dom.h2('Two-factor authentication'), dom.p('Require a code from an authenticator app in addition to your password when logging in to the web interfaces (account and mail).'), dom.div(dom.a(attr.href('#twofactor'), 'Manage two-factor authentication')), dom.br(), dom.h2('Signing and encryption keys'), dom.p('S/MIME and OpenPGP keys for signing and encrypting messages in webmail, and public keys of correspondents.'), dom.div(dom.a(attr.href('#keys'), 'Manage keys')), dom.br(), dom.h2('Disk usage'), dom.p('Storage used is ', dom.b(formatQuotaSize(Math.floor(storageUsed / (1024 * 1024)) * 1024 * 1024)), storageLimit > 0 ? [
 		dom.b('/', formatQuotaSize(storageLimit)),
 		' (',
 		'' + Math.floor(100 * storageUsed / storageLimit),
@@ -1730,7 +2076,224 @@ const destination = async (name) => {
 		window.location.reload(); // todo: only refresh part of ui
 	}), dom.br(), dom.br(), dom.br(), dom.p("Apple's mail applications don't do account autoconfiguration, and when adding an account it can choose defaults that don't work with modern email servers. Adding an account through a \"mobileconfig\" profile file can be more convenient: It contains the IMAP/SMTP settings such as host name, port, TLS, authentication mechanism and user name. This profile does not contain a login password. Opening the profile adds it under Profiles in System Preferences (macOS) or Settings (iOS), where you can install it. These profiles are not signed, so users will have to ignore the warnings about them being unsigned. ", dom.br(), dom.a(attr.href('https://autoconfig.' + domainName(acc.DNSDomain) + '/profile.mobileconfig?addresses=' + encodeURIComponent(addresses.join(',')) + '&name=' + encodeURIComponent(dest.FullName)), attr.download(''), 'Download .mobileconfig email account profile'), dom.br(), dom.a(attr.href('https://autoconfig.' + domainName(acc.DNSDomain) + '/profile.mobileconfig.qrcode.png?addresses=' + encodeURIComponent(addresses.join(',')) + '&name=' + encodeURIComponent(dest.FullName)), attr.download(''), 'Open QR-code with link to .mobileconfig profile')));
 };
+const sieve = async () => {
+	const scripts = await client.SieveScripts();
+	let scriptFieldset;
+	let name;
+	let content;
+	let activate;
+	const edit = (s) => {
+		name.value = s.Name;
+		content.value = s.Content;
+		activate.checked = s.Active;
+		content.focus();
+	};
+	dom._kids(page, crumbs(crumblink('Mox Account', '#'), 'Sieve scripts'), dom.p('Incoming messages are evaluated by the active Sieve script (RFC 5228). Without active script, the rulesets of the addresses are used. Supported extensions: body, copy, envelope, ereject, fileinto, imap4flags, reject, vacation, variables.'), dom.table(dom.thead(dom.tr(dom.th('Name'), dom.th('Active'), dom.th('Updated'), dom.th('Action'))), dom.tbody((scripts || []).length === 0 ? dom.tr(dom.td(attr.colspan('4'), '(None)')) : [], (scripts || []).map(s => dom.tr(dom.td(prewrap(s.Name)), dom.td(s.Active ? '✓' : ''), dom.td(age(s.Updated)), dom.td(dom.clickbutton('Edit', function click() {
+		edit(s);
+	}), ' ', dom.clickbutton(s.Active ? 'Deactivate' : 'Activate', async function click(e) {
+		await check(e.target, client.SieveScriptActivate(s.Active ? '' : s.Name));
+		window.location.reload(); // todo: reload less
+	}), ' ', dom.clickbutton('Remove', s.Active ? [attr.disabled(''), attr.title('The active script cannot be removed.')] : [], async function click(e) {
+		if (!window.confirm('Are you sure you want to remove script ' + s.Name + '?')) {
+			return;
+		}
+		await check(e.target, client.SieveScriptRemove(s.Name));
+		window.location.reload(); // todo: reload less
+	})))))), dom.br(), dom.h2('Add or replace script'), dom.form(async function submit(e) {
+		e.preventDefault();
+		e.stopPropagation();
+		await check(scriptFieldset, client.SieveScriptSave(name.value, content.value, activate.checked));
+		window.location.reload(); // todo: reload less
+	}, scriptFieldset = dom.fieldset(dom.div(style({ marginBottom: '1ex' }), dom.label(dom.div('Name', attr.title('Name of the script. An existing script with the same name is replaced.')), name = dom.input(attr.required('')))), dom.div(style({ marginBottom: '1ex' }), dom.label(dom.div('Script'), content = dom.textarea(attr.rows('20'), style({ width: '50em', fontFamily: 'monospace' }), attr.placeholder('require ["fileinto"];\nif header :contains "list-id" "<list.example.org>" {\n\tfileinto "Lists";\n}')))), dom.div(style({ marginBottom: '1ex' }), dom.label(activate = dom.input(attr.type('checkbox')), ' Active', attr.title('Make this the active script. Only one script can be active at a time.'))), dom.submitbutton('Save'))));
+};
+const vacation = async () => {
+	const v = await client.Vacation();
+	// Zero times from the server are before 1970.
+	const localDateTime = (d) => {
+		if (d.getTime() <= 0) {
+			return '';
+		}
+		const pad = (n) => (n < 10 ? '0' : '') + n;
+		return d.getFullYear() + '-' + pad(d.getMonth() + 1) + '-' + pad(d.getDate()) + 'T' + pad(d.getHours()) + ':' + pad(d.getMinutes());
+	};
+	const parseDateTime = (s) => s ? new Date(s) : new Date('0001-01-01T00:00:00Z');
+	let fieldset;
+	let enabled;
+	let start;
+	let end;
+	let subject;
+	let body;
+	let intervalDays;
+	dom._kids(page, crumbs(crumblink('Mox Account', '#'), 'Vacation'), dom.p('While enabled, and between the optional start and end time, senders of incoming messages get an automatic response (RFC 3834). A sender gets at most one response per interval. No responses are sent to mailing lists, automated messages or messages that do not explicitly address you. If the active Sieve script sends a vacation response for a message, no additional response is sent.'), dom.form(async function submit(e) {
+		e.preventDefault();
+		e.stopPropagation();
+		const nv = {
+			ID: v.ID,
+			Enabled: enabled.checked,
+			Start: parseDateTime(start.value),
+			End: parseDateTime(end.value),
+			Subject: subject.value,
+			Body: body.value,
+			IntervalDays: parseInt(intervalDays.value) || 0,
+		};
+		await check(fieldset, client.VacationSave(nv));
+		window.location.reload(); // todo: reload less
+	}, fieldset = dom.fieldset(dom.div(style({ marginBottom: '1ex' }), dom.label(enabled = dom.input(attr.type('checkbox'), v.Enabled ? attr.checked('') : []), ' Enabled')), dom.div(style({ marginBottom: '1ex', display: 'flex', gap: '1em' }), dom.label(dom.div('Start', attr.title('Optional. No responses are sent before this time.')), start = dom.input(attr.type('datetime-local'), attr.value(localDateTime(v.Start)))), dom.label(dom.div('End', attr.title('Optional. No responses are sent from this time.')), end = dom.input(attr.type('datetime-local'), attr.value(localDateTime(v.End))))), dom.div(style({ marginBottom: '1ex' }), dom.label(dom.div('Subject', attr.title('Optional. If empty, "Auto: " followed by the subject of the incoming message.')), subject = dom.input(attr.value(v.Subject), style({ width: '50em' })))), dom.div(style({ marginBottom: '1ex' }), dom.label(dom.div('Message'), body = dom.textarea(attr.rows('10'), style({ width: '50em' }), v.Body))), dom.div(style({ marginBottom: '1ex' }), dom.label(dom.div('Interval in days', attr.title('Minimum number of days between responses to the same sender. Default 7.')), intervalDays = dom.input(attr.type('number'), attr.min('0'), attr.max('90'), attr.value(v.IntervalDays ? '' + v.IntervalDays : ''), attr.placeholder('7')))), dom.submitbutton('Save'))));
+};
+const contacts = async () => {
+	const books = await client.AddressBooks();
+	let bookFieldset;
+	let name;
+	let displayName;
+	dom._kids(page, crumbs(crumblink('Mox Account', '#'), 'Contacts'), dom.p('Address books can be synchronized with clients over CardDAV (RFC 6352), using your email address and password. Clients typically find the address books through ', dom.span(style({ fontFamily: 'monospace' }), 'https://' + window.location.host + '/.well-known/carddav'), ', or can be configured with the CardDAV URL directly, by default ', dom.span(style({ fontFamily: 'monospace' }), 'https://' + window.location.host + '/carddav/'), '.'), (books || []).map(b => dom.div(dom.h2(b.AddressBook.DisplayName || b.AddressBook.Name, b.AddressBook.DisplayName && b.AddressBook.DisplayName !== b.AddressBook.Name ? ' (' + b.AddressBook.Name + ')' : ''), b.AddressBook.Description ? dom.p(b.AddressBook.Description) : [], dom.table(dom.thead(dom.tr(dom.th('Name'), dom.th('Email addresses'), dom.th('Updated'), dom.th('Action'))), dom.tbody((b.Contacts || []).length === 0 ? dom.tr(dom.td(attr.colspan('4'), '(None)')) : [], (b.Contacts || []).map(c => dom.tr(dom.td(prewrap(c.FormattedName || c.Name)), dom.td((c.Emails || []).join(', ')), dom.td(age(c.Updated)), dom.td(dom.clickbutton('Remove', async function click(e) {
+		if (!window.confirm('Are you sure you want to remove contact ' + (c.FormattedName || c.Name) + '?')) {
+			return;
+		}
+		await check(e.target, client.ContactRemove(b.AddressBook.Name, c.Name));
+		window.location.reload(); // todo: reload less
+	})))))), dom.div(style({ marginTop: '1ex' }), dom.clickbutton('Remove address book', async function click(e) {
+		if (!window.confirm('Are you sure you want to remove address book ' + b.AddressBook.Name + ' and its ' + (b.Contacts || []).length + ' contact(s)?')) {
+			return;
+		}
+		await check(e.target, client.AddressBookRemove(b.AddressBook.Name));
+		window.location.reload(); // todo: reload less
+	})), dom.br())), dom.h2('Add address book'), dom.form(async function submit(e) {
+		e.preventDefault();
+		e.stopPropagation();
+		await check(bookFieldset, client.AddressBookCreate(name.value, displayName.value));
+		window.location.reload(); // todo: reload less
+	}, bookFieldset = dom.fieldset(dom.label(style({ display: 'inline-block' }), dom.div('Name', attr.title('Name of the address book, used in the CardDAV URL. Can contain letters, digits, dash, underscore and dot.')), name = dom.input(attr.required(''))), ' ', dom.label(style({ display: 'inline-block' }), dom.div('Display name'), displayName = dom.input()), ' ', dom.submitbutton('Add'))));
+};
+const appPasswords = async () => {
+	const passwords = await client.AppPasswords();
+	let fieldset;
+	let name;
+	let imap;
+	let submission;
+	let webapi;
+	let expires;
+	let generated;
+	const protocolNames = { imap: 'IMAP', submission: 'SMTP submission', webapi: 'Webapi' };
+	dom._kids(page, crumbs(crumblink('Mox Account', '#'), 'App passwords'), dom.p('App passwords can only be used with authentication mechanisms that send the password, such as PLAIN and LOGIN, not with SCRAM-SHA-* or CRAM-MD5. They cannot be used for logging in to the web interface.'), dom.table(dom.thead(dom.tr(dom.th('Name'), dom.th('Protocols'), dom.th('Created'), dom.th('Expires'), dom.th('Last used'), dom.th('Action'))), dom.tbody((passwords || []).length === 0 ? dom.tr(dom.td(attr.colspan('6'), '(None)')) : [], (passwords || []).map(ap => dom.tr(dom.td(ap.Name), dom.td((ap.Protocols || []).map(p => protocolNames[p] || p).join(', ')), dom.td(age(ap.Created)), dom.td(ap.Expires.getTime() > 0 ? ap.Expires.toLocaleString() : 'Never'), dom.td(ap.LastUsed.getTime() > 0 ? [age(ap.LastUsed), ' (' + (protocolNames[ap.LastUsedProtocol] || ap.LastUsedProtocol) + ')'] : 'Never'), dom.td(dom.clickbutton('Remove', async function click(e) {
+		if (!window.confirm('Are you sure you want to remove app password ' + ap.Name + '? It can no longer be used for logging in.')) {
+			return;
+		}
+		await check(e.target, client.AppPasswordRemove(ap.Name));
+		window.location.reload(); // todo: reload less
+	})))))), dom.br(), dom.h2('Add app password'), dom.form(async function submit(e) {
+		e.preventDefault();
+		e.stopPropagation();
+		const protocols = [[imap, 'imap'], [submission, 'submission'], [webapi, 'webapi']].filter(t => t[0].checked).map(t => t[1]);
+		let exp = null;
+		if (expires.value) {
+			exp = new Date(Date.now() + parseInt(expires.value) * 24 * 3600 * 1000);
+		}
+		const password = await check(fieldset, client.AppPasswordAdd(name.value, protocols, exp));
+		dom._kids(generated, box(yellow, 'App password ', dom.b(name.value), ' has been added. Use this password in your application, it will not be shown again: ', dom.span(style({ fontFamily: 'monospace', fontWeight: 'bold' }), password), ' ', dom.clickbutton('Done', function click() {
+			window.location.reload(); // todo: reload less
+		})));
+	}, fieldset = dom.fieldset(dom.label(style({ display: 'inline-block' }), dom.div('Name', attr.title('Name of the device or application, for recognizing the app password later.')), name = dom.input(attr.required(''))), ' ', dom.div(style({ display: 'inline-block' }), dom.div('Protocols'), dom.label(imap = dom.input(attr.type('checkbox'), attr.checked('')), ' IMAP'), ' ', dom.label(submission = dom.input(attr.type('checkbox'), attr.checked('')), ' SMTP submission'), ' ', dom.label(webapi = dom.input(attr.type('checkbox')), ' Webapi')), ' ', dom.label(style({ display: 'inline-block' }), dom.div('Expires'), expires = dom.select(dom.option('Never', attr.value('')), dom.option('After 30 days', attr.value('30')), dom.option('After 90 days', attr.value('90')), dom.option('After 1 year', attr.value('365')))), ' ', dom.submitbutton('Add'))), generated = dom.div());
+};
+const cryptoKeys = async () => {
+	const [keys, peerKeys] = await client.CryptoKeys();
+	let genFieldset;
+	let genName;
+	let genAddress;
+	let importFieldset;
+	let importKind;
+	let importData;
+	let importPassphrase;
+	let peerFieldset;
+	let peerKind;
+	let peerData;
+	let publicBox;
+	const kindNames = { smime: 'S/MIME', openpgp: 'OpenPGP' };
+	const sourceNames = { import: 'Imported', autocrypt: 'Autocrypt header', signature: 'Signed message' };
+	dom._kids(page, crumbs(crumblink('Mox Account', '#'), 'Signing and encryption keys'), dom.p('Keys are used by webmail to sign and encrypt messages you send, and to decrypt messages you receive. Private keys are stored unprotected in your account database on the server.'), dom.h2('Your keys'), dom.table(dom.thead(dom.tr(dom.th('Type'), dom.th('Addresses'), dom.th('Description'), dom.th('Fingerprint'), dom.th('Created'), dom.th('Action'))), dom.tbody((keys || []).length === 0 ? dom.tr(dom.td(attr.colspan('6'), '(None)')) : [], (keys || []).map(k => dom.tr(dom.td(kindNames[k.Kind] || k.Kind), dom.td((k.Addresses || []).join(', ')), dom.td(k.Description, k.NotAfter.getTime() > 0 ? ' (expires ' + k.NotAfter.toLocaleDateString() + ')' : []), dom.td(style({ fontFamily: 'monospace' }), k.Fingerprint), dom.td(age(k.Created)), dom.td(dom.clickbutton('Public key', async function click(e) {
+		const s = await check(e.target, client.CryptoKeyPublic(k.ID));
+		dom._kids(publicBox, dom.h2('Public key'), dom.p('Send this public key to correspondents so they can encrypt messages to you and verify your signatures.'), dom.pre(style({ fontFamily: 'monospace' }), s));
+	}), ' ', dom.clickbutton('Remove', async function click(e) {
+		if (!window.confirm('Are you sure you want to remove this key? Messages encrypted for this key can no longer be read.')) {
+			return;
+		}
+		await check(e.target, client.CryptoKeyRemove(k.ID));
+		window.location.reload(); // todo: reload less
+	})))))), publicBox = dom.div(), dom.br(), dom.h2('Generate OpenPGP key'), dom.form(async function submit(e) {
+		e.preventDefault();
+		e.stopPropagation();
+		await check(genFieldset, client.CryptoKeyGenerate(genName.value, genAddress.value));
+		window.location.reload(); // todo: reload less
+	}, genFieldset = dom.fieldset(dom.label(style({ display: 'inline-block' }), dom.div('Name'), genName = dom.input()), ' ', dom.label(style({ display: 'inline-block' }), dom.div('Email address'), genAddress = dom.input(attr.required(''))), ' ', dom.submitbutton('Generate'))), dom.br(), dom.h2('Import key'), dom.form(async function submit(e) {
+		e.preventDefault();
+		e.stopPropagation();
+		await check(importFieldset, client.CryptoKeyImport(importKind.value, importData.value, importPassphrase.value));
+		window.location.reload(); // todo: reload less
+	}, importFieldset = dom.fieldset(dom.label(style({ display: 'inline-block' }), dom.div('Type'), importKind = dom.select(dom.option('S/MIME', attr.value('smime')), dom.option('OpenPGP', attr.value('openpgp')))), ' ', dom.label(style({ display: 'inline-block' }), dom.div('Passphrase', attr.title('For OpenPGP private keys protected with a passphrase. The key is stored without passphrase.')), importPassphrase = dom.input(attr.type('password'), attr.autocomplete('off'))), dom.label(dom.div('Private key', attr.title('For S/MIME, PEM with the private key and certificate chain. For OpenPGP, an ASCII-armored private key.')), importData = dom.textarea(attr.required(''), attr.rows('8'), style({ width: '100%', fontFamily: 'monospace' }))), dom.submitbutton('Import'))), dom.br(), dom.h2('Keys of correspondents'), dom.p('Public keys are used to encrypt messages to correspondents. Keys are learned automatically from Autocrypt headers and signed messages you open in webmail.'), dom.table(dom.thead(dom.tr(dom.th('Type'), dom.th('Address'), dom.th('Fingerprint'), dom.th('Source'), dom.th('Updated'), dom.th('Action'))), dom.tbody((peerKeys || []).length === 0 ? dom.tr(dom.td(attr.colspan('6'), '(None)')) : [], (peerKeys || []).map(pk => dom.tr(dom.td(kindNames[pk.Kind] || pk.Kind), dom.td(pk.Address), dom.td(style({ fontFamily: 'monospace' }), pk.Fingerprint), dom.td(sourceNames[pk.Source] || pk.Source), dom.td(age(pk.Updated)), dom.td(dom.clickbutton('Remove', async function click(e) {
+		await check(e.target, client.PeerKeyRemove(pk.ID));
+		window.location.reload(); // todo: reload less
+	})))))), dom.br(), dom.h2('Import keys of correspondents'), dom.form(async function submit(e) {
+		e.preventDefault();
+		e.stopPropagation();
+		await check(peerFieldset, client.PeerKeyImport(peerKind.value, peerData.value));
+		window.location.reload(); // todo: reload less
+	}, peerFieldset = dom.fieldset(dom.label(style({ display: 'inline-block' }), dom.div('Type'), peerKind = dom.select(dom.option('S/MIME', attr.value('smime')), dom.option('OpenPGP', attr.value('openpgp')))), dom.label(dom.div('Public keys', attr.title('For S/MIME, PEM certificates. For OpenPGP, ASCII-armored public keys.')), peerData = dom.textarea(attr.required(''), attr.rows('8'), style({ width: '100%', fontFamily: 'monospace' }))), dom.submitbutton('Import'))));
+};
+const twoFactor = async () => {
+	const [enabled, recoveryCodesLeft] = await client.TOTPStatus();
+	let setupBox;
+	let fieldset;
+	let code;
+	const recoveryCodesBox = (codes) => box(yellow, dom.p('Each recovery code can be used once instead of a code from your authenticator app, e.g. after losing your device. Store them in a safe place, they will not be shown again.'), dom.ul(style({ fontFamily: 'monospace' }), (codes || []).map(c => dom.li(c))), dom.clickbutton('Done', function click() {
+		window.location.reload(); // todo: reload less
+	}));
+	dom._kids(page, crumbs(crumblink('Mox Account', '#'), 'Two-factor authentication'), dom.p('With two-factor authentication, logging in to the web interfaces (account and mail) requires a code from an authenticator app in addition to your password. It does not apply to IMAP and SMTP submission, use app passwords for those.'), enabled ? [
+		dom.p('Two-factor authentication is enabled. Unused recovery codes: ', '' + recoveryCodesLeft, '.'),
+		setupBox = dom.div(),
+		dom.clickbutton('Generate new recovery codes', async function click(e) {
+			if (!window.confirm('Are you sure? Existing recovery codes can no longer be used.')) {
+				return;
+			}
+			const codes = await check(e.target, client.TOTPRecoveryCodes());
+			dom._kids(setupBox, recoveryCodesBox(codes));
+		}),
+		' ',
+		dom.clickbutton('Disable two-factor authentication', async function click(e) {
+			if (!window.confirm('Are you sure you want to disable two-factor authentication? Logging in will only require your password.')) {
+				return;
+			}
+			await check(e.target, client.TOTPDisable());
+			window.location.reload(); // todo: reload less
+		}),
+	] : setupBox = dom.div(dom.clickbutton('Set up two-factor authentication', async function click(e) {
+		const setup = await check(e.target, client.TOTPSetupStart());
+		dom._kids(setupBox, dom.p('Scan the QR code with your authenticator app, or enter the secret manually. Then enter the code shown by the app to enable two-factor authentication.'), dom.img(attr.src(setup.QRCodePNG), attr.title(setup.URI), style({ width: '15em', imageRendering: 'pixelated' })), dom.p('Secret: ', dom.span(style({ fontFamily: 'monospace' }), setup.Secret)), dom.form(async function submit(e) {
+			e.preventDefault();
+			e.stopPropagation();
+			const codes = await check(fieldset, client.TOTPSetupConfirm(code.value));
+			dom._kids(setupBox, dom.p('Two-factor authentication is now enabled.'), recoveryCodesBox(codes));
+		}, fieldset = dom.fieldset(dom.label(style({ display: 'inline-block' }), dom.div('Code'), code = dom.input(attr.required(''), attr.autocomplete('one-time-code'))), ' ', dom.submitbutton('Enable'))));
+	})));
+};
 const init = async () => {
+	// Back from a login at the identity provider.
+	const oidcState = new URLSearchParams(window.location.search).get('oidc');
+	if (oidcState) {
+		try {
+			const [token, address] = await client.LoginOIDC(oidcState);
+			try {
+				window.localStorage.setItem('webaccountaddress', address);
+				window.localStorage.setItem('webaccountcsrftoken', token);
+			}
+			catch (err) {
+				console.log('saving csrf token in localStorage', err);
+			}
+		}
+		catch (err) {
+			window.alert('Error: ' + errmsg(err));
+		}
+		window.location.replace(window.location.pathname + window.location.hash);
+		return;
+	}
 	let curhash;
 	const hashChange = async () => {
 		if (curhash === window.location.hash) {
@@ -1749,6 +2312,24 @@ const init = async () => {
 			else if (t[0] === 'destinations' && t.length === 2) {
 				await destination(t[1]);
 			}
+			else if (h === 'sieve') {
+				await sieve();
+			}
+			else if (h === 'vacation') {
+				await vacation();
+			}
+			else if (h === 'contacts') {
+				await contacts();
+			}
+			else if (h === 'apppasswords') {
+				await appPasswords();
+			}
+			else if (h === 'twofactor') {
+				await twoFactor();
+			}
+			else if (h === 'keys') {
+				await cryptoKeys();
+			}
 			else {
 				dom._kids(page, 'page not found');
 			}
@@ -15,6 +15,11 @@ const login = async (reason: string) => {
 		let autosize: HTMLElement
 		let username: HTMLInputElement
 		let password: HTMLInputElement
+		let totpBox: HTMLElement
+		let totp: HTMLInputElement
+		let oidcBox: HTMLElement
+		// Set after a valid password when a TOTP code is required for the login.
+		let totpLoginToken = ''
 
 		const root = dom.div(
 			style({position: 'absolute', top: 0, right: 0, bottom: 0, left: 0, backgroundColor: '#eee', display: 'flex', alignItems: 'center', justifyContent: 'center', zIndex: '1', animation: 'fadein .15s ease-in'}),
@@ -31,8 +36,24 @@ const login = async (reason: string) => {
 
 							try {
 								fieldset.disabled = true
-								const loginToken = await client.LoginPrep()
-								const token = await client.Login(loginToken, username.value, password.value)
+								let token: string
+								if (totpLoginToken) {
+									token = await client.LoginTOTP(totpLoginToken, totp.value)
+								} else {
+									const loginToken = await client.LoginPrep()
+									try {
+										token = await client.Login(loginToken, username.value, password.value)
+									} catch (err) {
+										if ((err as any).code !== 'user:totpRequired') {
+											throw err
+										}
+										// Password is valid, a code from the authenticator app is needed too.
+										totpLoginToken = loginToken
+										totpBox.style.display = 'block'
+										totp.required = true
+										return
+									}
+								}
 								try {
 									window.localStorage.setItem('webaccountaddress', username.value)
 									window.localStorage.setItem('webaccountcsrftoken', token)
@@ -47,8 +68,17 @@ const login = async (reason: string) => {
 							} catch (err) {
 								console.log('login error', err)
 								window.alert('Error: ' + errmsg(err))
+								if (totpLoginToken && (err as any).code !== 'user:loginFailed') {
+									// Login expired, start again with the password.
+									totpLoginToken = ''
+									totpBox.style.display = 'none'
+									totp.required = false
+								}
 							} finally {
 								fieldset.disabled = false
+								if (totpLoginToken) {
+									totp.focus()
+								}
 							}
 						},
 						fieldset=dom.fieldset(
@@ -70,10 +100,31 @@ const login = async (reason: string) => {
 								dom.div('Password', style({marginBottom: '.5ex'})),
 								password=dom.input(attr.type('password'), attr.required('')),
 							),
+							totpBox=dom.label(
+								style({display: 'none', marginBottom: '2ex'}),
+								dom.div('Two-factor authentication code', style({marginBottom: '.5ex'})),
+								totp=dom.input(attr.autocomplete('one-time-code')),
+								dom.div('From your authenticator app, or a recovery code.', style({marginTop: '.5ex', fontSize: '.9em'})),
+							),
 							dom.div(
 								style({textAlign: 'center'}),
 								dom.submitbutton('Login'),
 							),
+							oidcBox=dom.div(
+								style({display: 'none', textAlign: 'center', marginTop: '2ex'}),
+								dom.clickbutton('Login with single sign-on', async function click() {
+									try {
+										fieldset.disabled = true
+										const loginToken = await client.LoginPrep()
+										// The identity provider redirects back to us, init completes the login.
+										window.location.href = await client.LoginOIDCStart(loginToken)
+									} catch (err) {
+										console.log('login error', err)
+										window.alert('Error: ' + errmsg(err))
+										fieldset.disabled = false
+									}
+								}),
+							),
 						),
 					)
 				)
@@ -81,6 +132,13 @@ const login = async (reason: string) => {
 		)
 		document.body.appendChild(root)
 		username.focus()
+		client.LoginOIDCEnabled()
+			.then(enabled => {
+				if (enabled) {
+					oidcBox.style.display = 'block'
+				}
+			})
+			.catch(err => console.log('checking for single sign-on', err))
 	})
 }
 
@@ -777,6 +835,21 @@ const index = async () => {
 		),
 		dom.br(),
 
+		dom.h2('Sieve scripts'),
+		dom.p('A Sieve script can be used to filter incoming messages, e.g. delivering to a mailbox, adding flags, redirecting, rejecting or sending a vacation response. If a script is active, it is used instead of the rulesets of the addresses.'),
+		dom.div(dom.a(attr.href('#sieve'), 'Manage Sieve scripts')),
+		dom.br(),
+
+		dom.h2('Vacation'),
+		dom.p('Send an automatic response to senders of incoming messages while you are away.'),
+		dom.div(dom.a(attr.href('#vacation'), 'Manage vacation response')),
+		dom.br(),
+
+		dom.h2('Contacts'),
+		dom.p('Contacts in address books are used for completing recipient addresses in webmail, and can be synchronized with phones and desktop clients over CardDAV.'),
+		dom.div(dom.a(attr.href('#contacts'), 'Manage contacts')),
+		dom.br(),
+
 		dom.h2('Aliases/lists'),
 		dom.table(
 			dom.thead(
@@ -868,6 +941,21 @@ const index = async () => {
 		),
 		dom.br(),
 
+		dom.h2('App passwords'),
+		dom.p('App passwords are generated passwords for a single device or application, for IMAP, SMTP submission and/or the webapi. They can be revoked without changing your account password.'),
+		dom.div(dom.a(attr.href('#apppasswords'), 'Manage app passwords')),
+		dom.br(),
+
+		dom.h2('Two-factor authentication'),
+		dom.p('Require a code from an authenticator app in addition to your password when logging in to the web interfaces (account and mail).'),
+		dom.div(dom.a(attr.href('#twofactor'), 'Manage two-factor authentication')),
+		dom.br(),
+
+		dom.h2('Signing and encryption keys'),
+		dom.p('S/MIME and OpenPGP keys for signing and encrypting messages in webmail, and public keys of correspondents.'),
+		dom.div(dom.a(attr.href('#keys'), 'Manage keys')),
+		dom.br(),
+
 		dom.h2('Disk usage'),
 		dom.p('Storage used is ', dom.b(formatQuotaSize(Math.floor(storageUsed/(1024*1024))*1024*1024)),
 			storageLimit > 0 ? [
@@ -1649,7 +1737,665 @@ const destination = async (name: string) => {
 	)
 }
 
+const sieve = async () => {
+	const scripts = await client.SieveScripts()
+
+	let scriptFieldset: HTMLFieldSetElement
+	let name: HTMLInputElement
+	let content: HTMLTextAreaElement
+	let activate: HTMLInputElement
+
+	const edit = (s: api.SieveScript) => {
+		name.value = s.Name
+		content.value = s.Content
+		activate.checked = s.Active
+		content.focus()
+	}
+
+	dom._kids(page,
+		crumbs(
+			crumblink('Mox Account', '#'),
+			'Sieve scripts',
+		),
+
+		dom.p('Incoming messages are evaluated by the active Sieve script (RFC 5228). Without active script, the rulesets of the addresses are used. Supported extensions: body, copy, envelope, ereject, fileinto, imap4flags, reject, vacation, variables.'),
+		dom.table(
+			dom.thead(
+				dom.tr(
+					dom.th('Name'),
+					dom.th('Active'),
+					dom.th('Updated'),
+					dom.th('Action'),
+				),
+			),
+			dom.tbody(
+				(scripts || []).length === 0 ? dom.tr(dom.td(attr.colspan('4'), '(None)')) : [],
+				(scripts || []).map(s =>
+					dom.tr(
+						dom.td(prewrap(s.Name)),
+						dom.td(s.Active ? '✓' : ''),
+						dom.td(age(s.Updated)),
+						dom.td(
+							dom.clickbutton('Edit', function click() {
+								edit(s)
+							}), ' ',
+							dom.clickbutton(s.Active ? 'Deactivate' : 'Activate', async function click(e: MouseEvent) {
+								await check(e.target! as HTMLButtonElement, client.SieveScriptActivate(s.Active ? '' : s.Name))
+								window.location.reload() // todo: reload less
+							}), ' ',
+							dom.clickbutton('Remove', s.Active ? [attr.disabled(''), attr.title('The active script cannot be removed.')] : [], async function click(e: MouseEvent) {
+								if (!window.confirm('Are you sure you want to remove script '+s.Name+'?')) {
+									return
+								}
+								await check(e.target! as HTMLButtonElement, client.SieveScriptRemove(s.Name))
+								window.location.reload() // todo: reload less
+							}),
+						),
+					),
+				),
+			),
+		),
+		dom.br(),
+
+		dom.h2('Add or replace script'),
+		dom.form(
+			async function submit(e: SubmitEvent) {
+				e.preventDefault()
+				e.stopPropagation()
+				await check(scriptFieldset, client.SieveScriptSave(name.value, content.value, activate.checked))
+				window.location.reload() // todo: reload less
+			},
+			scriptFieldset=dom.fieldset(
+				dom.div(
+					style({marginBottom: '1ex'}),
+					dom.label(
+						dom.div('Name', attr.title('Name of the script. An existing script with the same name is replaced.')),
+						name=dom.input(attr.required('')),
+					),
+				),
+				dom.div(
+					style({marginBottom: '1ex'}),
+					dom.label(
+						dom.div('Script'),
+						content=dom.textarea(attr.rows('20'), style({width: '50em', fontFamily: 'monospace'}), attr.placeholder('require ["fileinto"];\nif header :contains "list-id" "<list.example.org>" {\n\tfileinto "Lists";\n}')),
+					),
+				),
+				dom.div(
+					style({marginBottom: '1ex'}),
+					dom.label(activate=dom.input(attr.type('checkbox')), ' Active', attr.title('Make this the active script. Only one script can be active at a time.')),
+				),
+				dom.submitbutton('Save'),
+			),
+		),
+	)
+}
+
+const vacation = async () => {
+	const v = await client.Vacation()
+
+	// Zero times from the server are before 1970.
+	const localDateTime = (d: Date) => {
+		if (d.getTime() <= 0) {
+			return ''
+		}
+		const pad = (n: number) => (n < 10 ? '0' : '') + n
+		return d.getFullYear()+'-'+pad(d.getMonth()+1)+'-'+pad(d.getDate())+'T'+pad(d.getHours())+':'+pad(d.getMinutes())
+	}
+	const parseDateTime = (s: string) => s ? new Date(s) : new Date('0001-01-01T00:00:00Z')
+
+	let fieldset: HTMLFieldSetElement
+	let enabled: HTMLInputElement
+	let start: HTMLInputElement
+	let end: HTMLInputElement
+	let subject: HTMLInputElement
+	let body: HTMLTextAreaElement
+	let intervalDays: HTMLInputElement
+
+	dom._kids(page,
+		crumbs(
+			crumblink('Mox Account', '#'),
+			'Vacation',
+		),
+
+		dom.p('While enabled, and between the optional start and end time, senders of incoming messages get an automatic response (RFC 3834). A sender gets at most one response per interval. No responses are sent to mailing lists, automated messages or messages that do not explicitly address you. If the active Sieve script sends a vacation response for a message, no additional response is sent.'),
+		dom.form(
+			async function submit(e: SubmitEvent) {
+				e.preventDefault()
+				e.stopPropagation()
+				const nv: api.Vacation = {
+					ID: v.ID,
+					Enabled: enabled.checked,
+					Start: parseDateTime(start.value),
+					End: parseDateTime(end.value),
+					Subject: subject.value,
+					Body: body.value,
+					IntervalDays: parseInt(intervalDays.value) || 0,
+				}
+				await check(fieldset, client.VacationSave(nv))
+				window.location.reload() // todo: reload less
+			},
+			fieldset=dom.fieldset(
+				dom.div(
+					style({marginBottom: '1ex'}),
+					dom.label(enabled=dom.input(attr.type('checkbox'), v.Enabled ? attr.checked('') : []), ' Enabled'),
+				),
+				dom.div(
+					style({marginBottom: '1ex', display: 'flex', gap: '1em'}),
+					dom.label(
+						dom.div('Start', attr.title('Optional. No responses are sent before this time.')),
+						start=dom.input(attr.type('datetime-local'), attr.value(localDateTime(v.Start))),
+					),
+					dom.label(
+						dom.div('End', attr.title('Optional. No responses are sent from this time.')),
+						end=dom.input(attr.type('datetime-local'), attr.value(localDateTime(v.End))),
+					),
+				),
+				dom.div(
+					style({marginBottom: '1ex'}),
+					dom.label(
+						dom.div('Subject', attr.title('Optional. If empty, "Auto: " followed by the subject of the incoming message.')),
+						subject=dom.input(attr.value(v.Subject), style({width: '50em'})),
+					),
+				),
+				dom.div(
+					style({marginBottom: '1ex'}),
+					dom.label(
+						dom.div('Message'),
+						body=dom.textarea(attr.rows('10'), style({width: '50em'}), v.Body),
+					),
+				),
+				dom.div(
+					style({marginBottom: '1ex'}),
+					dom.label(
+						dom.div('Interval in days', attr.title('Minimum number of days between responses to the same sender. Default 7.')),
+						intervalDays=dom.input(attr.type('number'), attr.min('0'), attr.max('90'), attr.value(v.IntervalDays ? ''+v.IntervalDays : ''), attr.placeholder('7')),
+					),
+				),
+				dom.submitbutton('Save'),
+			),
+		),
+	)
+}
+
+const contacts = async () => {
+	const books = await client.AddressBooks()
+
+	let bookFieldset: HTMLFieldSetElement
+	let name: HTMLInputElement
+	let displayName: HTMLInputElement
+
+	dom._kids(page,
+		crumbs(
+			crumblink('Mox Account', '#'),
+			'Contacts',
+		),
+
+		dom.p('Address books can be synchronized with clients over CardDAV (RFC 6352), using your email address and password. Clients typically find the address books through ', dom.span(style({fontFamily: 'monospace'}), 'https://'+window.location.host+'/.well-known/carddav'), ', or can be configured with the CardDAV URL directly, by default ', dom.span(style({fontFamily: 'monospace'}), 'https://'+window.location.host+'/carddav/'), '.'),
+		(books || []).map(b =>
+			dom.div(
+				dom.h2(b.AddressBook.DisplayName || b.AddressBook.Name, b.AddressBook.DisplayName && b.AddressBook.DisplayName !== b.AddressBook.Name ? ' ('+b.AddressBook.Name+')' : ''),
+				b.AddressBook.Description ? dom.p(b.AddressBook.Description) : [],
+				dom.table(
+					dom.thead(
+						dom.tr(
+							dom.th('Name'),
+							dom.th('Email addresses'),
+							dom.th('Updated'),
+							dom.th('Action'),
+						),
+					),
+					dom.tbody(
+						(b.Contacts || []).length === 0 ? dom.tr(dom.td(attr.colspan('4'), '(None)')) : [],
+						(b.Contacts || []).map(c =>
+							dom.tr(
+								dom.td(prewrap(c.FormattedName || c.Name)),
+								dom.td((c.Emails || []).join(', ')),
+								dom.td(age(c.Updated)),
+								dom.td(
+									dom.clickbutton('Remove', async function click(e: MouseEvent) {
+										if (!window.confirm('Are you sure you want to remove contact '+(c.FormattedName || c.Name)+'?')) {
+											return
+										}
+										await check(e.target! as HTMLButtonElement, client.ContactRemove(b.AddressBook.Name, c.Name))
+										window.location.reload() // todo: reload less
+									}),
+								),
+							),
+						),
+					),
+				),
+				dom.div(
+					style({marginTop: '1ex'}),
+					dom.clickbutton('Remove address book', async function click(e: MouseEvent) {
+						if (!window.confirm('Are you sure you want to remove address book '+b.AddressBook.Name+' and its '+(b.Contacts || []).length+' contact(s)?')) {
+							return
+						}
+						await check(e.target! as HTMLButtonElement, client.AddressBookRemove(b.AddressBook.Name))
+						window.location.reload() // todo: reload less
+					}),
+				),
+				dom.br(),
+			),
+		),
+
+		dom.h2('Add address book'),
+		dom.form(
+			async function submit(e: SubmitEvent) {
+				e.preventDefault()
+				e.stopPropagation()
+				await check(bookFieldset, client.AddressBookCreate(name.value, displayName.value))
+				window.location.reload() // todo: reload less
+			},
+			bookFieldset=dom.fieldset(
+				dom.label(
+					style({display: 'inline-block'}),
+					dom.div('Name', attr.title('Name of the address book, used in the CardDAV URL. Can contain letters, digits, dash, underscore and dot.')),
+					name=dom.input(attr.required('')),
+				),
+				' ',
+				dom.label(
+					style({display: 'inline-block'}),
+					dom.div('Display name'),
+					displayName=dom.input(),
+				),
+				' ',
+				dom.submitbutton('Add'),
+			),
+		),
+	)
+}
+
+const appPasswords = async () => {
+	const passwords = await client.AppPasswords()
+
+	let fieldset: HTMLFieldSetElement
+	let name: HTMLInputElement
+	let imap: HTMLInputElement
+	let submission: HTMLInputElement
+	let webapi: HTMLInputElement
+	let expires: HTMLSelectElement
+	let generated: HTMLElement
+
+	const protocolNames: {[key: string]: string} = {imap: 'IMAP', submission: 'SMTP submission', webapi: 'Webapi'}
+
+	dom._kids(page,
+		crumbs(
+			crumblink('Mox Account', '#'),
+			'App passwords',
+		),
+
+		dom.p('App passwords can only be used with authentication mechanisms that send the password, such as PLAIN and LOGIN, not with SCRAM-SHA-* or CRAM-MD5. They cannot be used for logging in to the web interface.'),
+		dom.table(
+			dom.thead(
+				dom.tr(
+					dom.th('Name'),
+					dom.th('Protocols'),
+					dom.th('Created'),
+					dom.th('Expires'),
+					dom.th('Last used'),
+					dom.th('Action'),
+				),
+			),
+			dom.tbody(
+				(passwords || []).length === 0 ? dom.tr(dom.td(attr.colspan('6'), '(None)')) : [],
+				(passwords || []).map(ap =>
+					dom.tr(
+						dom.td(ap.Name),
+						dom.td((ap.Protocols || []).map(p => protocolNames[p] || p).join(', ')),
+						dom.td(age(ap.Created)),
+						dom.td(ap.Expires.getTime() > 0 ? ap.Expires.toLocaleString() : 'Never'),
+						dom.td(ap.LastUsed.getTime() > 0 ? [age(ap.LastUsed), ' ('+(protocolNames[ap.LastUsedProtocol] || ap.LastUsedProtocol)+')'] : 'Never'),
+						dom.td(
+							dom.clickbutton('Remove', async function click(e: MouseEvent) {
+								if (!window.confirm('Are you sure you want to remove app password '+ap.Name+'? It can no longer be used for logging in.')) {
+									return
+								}
+								await check(e.target! as HTMLButtonElement, client.AppPasswordRemove(ap.Name))
+								window.location.reload() // todo: reload less
+							}),
+						),
+					),
+				),
+			),
+		),
+		dom.br(),
+
+		dom.h2('Add app password'),
+		dom.form(
+			async function submit(e: SubmitEvent) {
+				e.preventDefault()
+				e.stopPropagation()
+				const protocols = [[imap, 'imap'], [submission, 'submission'], [webapi, 'webapi']].filter(t => (t[0] as HTMLInputElement).checked).map(t => t[1] as string)
+				let exp: Date | null = null
+				if (expires.value) {
+					exp = new Date(Date.now() + parseInt(expires.value)*24*3600*1000)
+				}
+				const password = await check(fieldset, client.AppPasswordAdd(name.value, protocols, exp))
+				dom._kids(generated,
+					box(yellow,
+						'App password ', dom.b(name.value), ' has been added. Use this password in your application, it will not be shown again: ',
+						dom.span(style({fontFamily: 'monospace', fontWeight: 'bold'}), password),
+						' ',
+						dom.clickbutton('Done', function click() {
+							window.location.reload() // todo: reload less
+						}),
+					),
+				)
+			},
+			fieldset=dom.fieldset(
+				dom.label(
+					style({display: 'inline-block'}),
+					dom.div('Name', attr.title('Name of the device or application, for recognizing the app password later.')),
+					name=dom.input(attr.required('')),
+				),
+				' ',
+				dom.div(
+					style({display: 'inline-block'}),
+					dom.div('Protocols'),
+					dom.label(imap=dom.input(attr.type('checkbox'), attr.checked('')), ' IMAP'), ' ',
+					dom.label(submission=dom.input(attr.type('checkbox'), attr.checked('')), ' SMTP submission'), ' ',
+					dom.label(webapi=dom.input(attr.type('checkbox')), ' Webapi'),
+				),
+				' ',
+				dom.label(
+					style({display: 'inline-block'}),
+					dom.div('Expires'),
+					expires=dom.select(
+						dom.option('Never', attr.value('')),
+						dom.option('After 30 days', attr.value('30')),
+						dom.option('After 90 days', attr.value('90')),
+						dom.option('After 1 year', attr.value('365')),
+					),
+				),
+				' ',
+				dom.submitbutton('Add'),
+			),
+		),
+		generated=dom.div(),
+	)
+}
+
+const cryptoKeys = async () => {
+	const [keys, peerKeys] = await client.CryptoKeys()
+
+	let genFieldset: HTMLFieldSetElement
+	let genName: HTMLInputElement
+	let genAddress: HTMLInputElement
+	let importFieldset: HTMLFieldSetElement
+	let importKind: HTMLSelectElement
+	let importData: HTMLTextAreaElement
+	let importPassphrase: HTMLInputElement
+	let peerFieldset: HTMLFieldSetElement
+	let peerKind: HTMLSelectElement
+	let peerData: HTMLTextAreaElement
+	let publicBox: HTMLElement
+
+	const kindNames: {[key: string]: string} = {smime: 'S/MIME', openpgp: 'OpenPGP'}
+	const sourceNames: {[key: string]: string} = {import: 'Imported', autocrypt: 'Autocrypt header', signature: 'Signed message'}
+
+	dom._kids(page,
+		crumbs(
+			crumblink('Mox Account', '#'),
+			'Signing and encryption keys',
+		),
+
+		dom.p('Keys are used by webmail to sign and encrypt messages you send, and to decrypt messages you receive. Private keys are stored unprotected in your account database on the server.'),
+		dom.h2('Your keys'),
+		dom.table(
+			dom.thead(
+				dom.tr(
+					dom.th('Type'),
+					dom.th('Addresses'),
+					dom.th('Description'),
+					dom.th('Fingerprint'),
+					dom.th('Created'),
+					dom.th('Action'),
+				),
+			),
+			dom.tbody(
+				(keys || []).length === 0 ? dom.tr(dom.td(attr.colspan('6'), '(None)')) : [],
+				(keys || []).map(k =>
+					dom.tr(
+						dom.td(kindNames[k.Kind] || k.Kind),
+						dom.td((k.Addresses || []).join(', ')),
+						dom.td(k.Description, k.NotAfter.getTime() > 0 ? ' (expires '+k.NotAfter.toLocaleDateString()+')' : []),
+						dom.td(style({fontFamily: 'monospace'}), k.Fingerprint),
+						dom.td(age(k.Created)),
+						dom.td(
+							dom.clickbutton('Public key', async function click(e: MouseEvent) {
+								const s = await check(e.target! as HTMLButtonElement, client.CryptoKeyPublic(k.ID))
+								dom._kids(publicBox,
+									dom.h2('Public key'),
+									dom.p('Send this public key to correspondents so they can encrypt messages to you and verify your signatures.'),
+									dom.pre(style({fontFamily: 'monospace'}), s),
+								)
+							}), ' ',
+							dom.clickbutton('Remove', async function click(e: MouseEvent) {
+								if (!window.confirm('Are you sure you want to remove this key? Messages encrypted for this key can no longer be read.')) {
+									return
+								}
+								await check(e.target! as HTMLButtonElement, client.CryptoKeyRemove(k.ID))
+								window.location.reload() // todo: reload less
+							}),
+						),
+					),
+				),
+			),
+		),
+		publicBox=dom.div(),
+		dom.br(),
+
+		dom.h2('Generate OpenPGP key'),
+		dom.form(
+			async function submit(e: SubmitEvent) {
+				e.preventDefault()
+				e.stopPropagation()
+				await check(genFieldset, client.CryptoKeyGenerate(genName.value, genAddress.value))
+				window.location.reload() // todo: reload less
+			},
+			genFieldset=dom.fieldset(
+				dom.label(
+					style({display: 'inline-block'}),
+					dom.div('Name'),
+					genName=dom.input(),
+				),
+				' ',
+				dom.label(
+					style({display: 'inline-block'}),
+					dom.div('Email address'),
+					genAddress=dom.input(attr.required('')),
+				),
+				' ',
+				dom.submitbutton('Generate'),
+			),
+		),
+		dom.br(),
+
+		dom.h2('Import key'),
+		dom.form(
+			async function submit(e: SubmitEvent) {
+				e.preventDefault()
+				e.stopPropagation()
+				await check(importFieldset, client.CryptoKeyImport(importKind.value as api.CryptoKind, importData.value, importPassphrase.value))
+				window.location.reload() // todo: reload less
+			},
+			importFieldset=dom.fieldset(
+				dom.label(
+					style({display: 'inline-block'}),
+					dom.div('Type'),
+					importKind=dom.select(
+						dom.option('S/MIME', attr.value('smime')),
+						dom.option('OpenPGP', attr.value('openpgp')),
+					),
+				),
+				' ',
+				dom.label(
+					style({display: 'inline-block'}),
+					dom.div('Passphrase', attr.title('For OpenPGP private keys protected with a passphrase. The key is stored without passphrase.')),
+					importPassphrase=dom.input(attr.type('password'), attr.autocomplete('off')),
+				),
+				dom.label(
+					dom.div('Private key', attr.title('For S/MIME, PEM with the private key and certificate chain. For OpenPGP, an ASCII-armored private key.')),
+					importData=dom.textarea(attr.required(''), attr.rows('8'), style({width: '100%', fontFamily: 'monospace'})),
+				),
+				dom.submitbutton('Import'),
+			),
+		),
+		dom.br(),
+
+		dom.h2('Keys of correspondents'),
+		dom.p('Public keys are used to encrypt messages to correspondents. Keys are learned automatically from Autocrypt headers and signed messages you open in webmail.'),
+		dom.table(
+			dom.thead(
+				dom.tr(
+					dom.th('Type'),
+					dom.th('Address'),
+					dom.th('Fingerprint'),
+					dom.th('Source'),
+					dom.th('Updated'),
+					dom.th('Action'),
+				),
+			),
+			dom.tbody(
+				(peerKeys || []).length === 0 ? dom.tr(dom.td(attr.colspan('6'), '(None)')) : [],
+				(peerKeys || []).map(pk =>
+					dom.tr(
+						dom.td(kindNames[pk.Kind] || pk.Kind),
+						dom.td(pk.Address),
+						dom.td(style({fontFamily: 'monospace'}), pk.Fingerprint),
+						dom.td(sourceNames[pk.Source] || pk.Source),
+						dom.td(age(pk.Updated)),
+						dom.td(
+							dom.clickbutton('Remove', async function click(e: MouseEvent) {
+								await check(e.target! as HTMLButtonElement, client.PeerKeyRemove(pk.ID))
+								window.location.reload() // todo: reload less
+							}),
+						),
+					),
+				),
+			),
+		),
+		dom.br(),
+
+		dom.h2('Import keys of correspondents'),
+		dom.form(
+			async function submit(e: SubmitEvent) {
+				e.preventDefault()
+				e.stopPropagation()
+				await check(peerFieldset, client.PeerKeyImport(peerKind.value as api.CryptoKind, peerData.value))
+				window.location.reload() // todo: reload less
+			},
+			peerFieldset=dom.fieldset(
+				dom.label(
+					style({display: 'inline-block'}),
+					dom.div('Type'),
+					peerKind=dom.select(
+						dom.option('S/MIME', attr.value('smime')),
+						dom.option('OpenPGP', attr.value('openpgp')),
+					),
+				),
+				dom.label(
+					dom.div('Public keys', attr.title('For S/MIME, PEM certificates. For OpenPGP, ASCII-armored public keys.')),
+					peerData=dom.textarea(attr.required(''), attr.rows('8'), style({width: '100%', fontFamily: 'monospace'})),
+				),
+				dom.submitbutton('Import'),
+			),
+		),
+	)
+}
+
+const twoFactor = async () => {
+	const [enabled, recoveryCodesLeft] = await client.TOTPStatus()
+
+	let setupBox: HTMLElement
+	let fieldset: HTMLFieldSetElement
+	let code: HTMLInputElement
+
+	const recoveryCodesBox = (codes: string[] | null) => box(yellow,
+		dom.p('Each recovery code can be used once instead of a code from your authenticator app, e.g. after losing your device. Store them in a safe place, they will not be shown again.'),
+		dom.ul(style({fontFamily: 'monospace'}), (codes || []).map(c => dom.li(c))),
+		dom.clickbutton('Done', function click() {
+			window.location.reload() // todo: reload less
+		}),
+	)
+
+	dom._kids(page,
+		crumbs(
+			crumblink('Mox Account', '#'),
+			'Two-factor authentication',
+		),
+
+		dom.p('With two-factor authentication, logging in to the web interfaces (account and mail) requires a code from an authenticator app in addition to your password. It does not apply to IMAP and SMTP submission, use app passwords for those.'),
+		enabled ? [
+			dom.p('Two-factor authentication is enabled. Unused recovery codes: ', ''+recoveryCodesLeft, '.'),
+			setupBox=dom.div(),
+			dom.clickbutton('Generate new recovery codes', async function click(e: MouseEvent) {
+				if (!window.confirm('Are you sure? Existing recovery codes can no longer be used.')) {
+					return
+				}
+				const codes = await check(e.target! as HTMLButtonElement, client.TOTPRecoveryCodes())
+				dom._kids(setupBox, recoveryCodesBox(codes))
+			}),
+			' ',
+			dom.clickbutton('Disable two-factor authentication', async function click(e: MouseEvent) {
+				if (!window.confirm('Are you sure you want to disable two-factor authentication? Logging in will only require your password.')) {
+					return
+				}
+				await check(e.target! as HTMLButtonElement, client.TOTPDisable())
+				window.location.reload() // todo: reload less
+			}),
+		] : setupBox=dom.div(
+			dom.clickbutton('Set up two-factor authentication', async function click(e: MouseEvent) {
+				const setup = await check(e.target! as HTMLButtonElement, client.TOTPSetupStart())
+				dom._kids(setupBox,
+					dom.p('Scan the QR code with your authenticator app, or enter the secret manually. Then enter the code shown by the app to enable two-factor authentication.'),
+					dom.img(attr.src(setup.QRCodePNG), attr.title(setup.URI), style({width: '15em', imageRendering: 'pixelated'})),
+					dom.p('Secret: ', dom.span(style({fontFamily: 'monospace'}), setup.Secret)),
+					dom.form(
+						async function submit(e: SubmitEvent) {
+							e.preventDefault()
+							e.stopPropagation()
+							const codes = await check(fieldset, client.TOTPSetupConfirm(code.value))
+							dom._kids(setupBox,
+								dom.p('Two-factor authentication is now enabled.'),
+								recoveryCodesBox(codes),
+							)
+						},
+						fieldset=dom.fieldset(
+							dom.label(
+								style({display: 'inline-block'}),
+								dom.div('Code'),
+								code=dom.input(attr.required(''), attr.autocomplete('one-time-code')),
+							),
+							' ',
+							dom.submitbutton('Enable'),
+						),
+					),
+				)
+			}),
+		),
+	)
+}
+
 const init = async () => {
+	// Back from a login at the identity provider.
+	const oidcState = new URLSearchParams(window.location.search).get('oidc')
+	if (oidcState) {
+		try {
+			const [token, address] = await client.LoginOIDC(oidcState)
+			try {
+				window.localStorage.setItem('webaccountaddress', address)
+				window.localStorage.setItem('webaccountcsrftoken', token)
+			} catch (err) {
+				console.log('saving csrf token in localStorage', err)
+			}
+		} catch (err) {
+			window.alert('Error: ' + errmsg(err))
+		}
+		window.location.replace(window.location.pathname + window.location.hash)
+		return
+	}
+
 	let curhash: string | undefined
 
 	const hashChange = async () => {
@@ -1667,6 +2413,18 @@ const init = async () => {
 				await index()
 			} else if (t[0] === 'destinations' && t.length === 2) {
 				await destination(t[1])
+			} else if (h === 'sieve') {
+				await sieve()
+			} else if (h === 'vacation') {
+				await vacation()
+			} else if (h === 'contacts') {
+				await contacts()
+			} else if (h === 'apppasswords') {
+				await appPasswords()
+			} else if (h === 'twofactor') {
+				await twoFactor()
+			} else if (h === 'keys') {
+				await cryptoKeys()
 			} else {
 				dom._kids(page, 'page not found')
 			}
@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"io"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -33,6 +34,7 @@ import (
 	"github.com/mjl-/mox/mox-"
 	"github.com/mjl-/mox/queue"
 	"github.com/mjl-/mox/store"
+	"github.com/mjl-/mox/totp"
 	"github.com/mjl-/mox/webauth"
 	"github.com/mjl-/mox/webhook"
 )
@@ -478,6 +480,156 @@ func TestAccount(t *testing.T) {
 
 	api.RejectsSave(ctx, "Rejects", true)
 	api.RejectsSave(ctx, "Rejects", false)
+
+	// Vacation settings.
+	tcompare(t, api.Vacation(ctx), store.Vacation{ID: 1})
+	tneedErrorCode(t, "user:error", func() { api.VacationSave(ctx, store.Vacation{Enabled: true}) }) // Missing text.
+	tneedErrorCode(t, "user:error", func() { api.VacationSave(ctx, store.Vacation{Body: "away", IntervalDays: 1000}) })
+	now := time.Now().Round(0)
+	tneedErrorCode(t, "user:error", func() { api.VacationSave(ctx, store.Vacation{Body: "away", Start: now, End: now}) })
+	vacation := store.Vacation{ID: 1, Enabled: true, Start: now, Subject: "Away", Body: "away", IntervalDays: 3}
+	api.VacationSave(ctx, vacation)
+	tcompare(t, api.Vacation(ctx), vacation)
+
+	// Address books, the default is created on first use.
+	books := api.AddressBooks(ctx)
+	tcompare(t, len(books), 1)
+	tcompare(t, books[0].AddressBook.Name, store.DefaultAddressBook)
+	api.AddressBookCreate(ctx, "work", "Work")
+	tneedErrorCode(t, "user:error", func() { api.AddressBookCreate(ctx, "work", "Work") })    // Duplicate.
+	tneedErrorCode(t, "user:error", func() { api.AddressBookCreate(ctx, "bad/name", "Bad") }) // Invalid name.
+	tcompare(t, len(api.AddressBooks(ctx)), 2)
+	tneedErrorCode(t, "user:error", func() { api.ContactRemove(ctx, "work", "absent.vcf") })
+	api.AddressBookRemove(ctx, "work")
+	tneedErrorCode(t, "user:error", func() { api.AddressBookRemove(ctx, "work") })
+	tcompare(t, len(api.AddressBooks(ctx)), 1)
+
+	// App passwords.
+	tcompare(t, len(api.AppPasswords(ctx)), 0)
+	appPassword := api.AppPasswordAdd(ctx, "phone", []string{store.AppProtocolIMAP}, nil)
+	tcompare(t, len(appPassword), 29)
+	tneedErrorCode(t, "user:error", func() { api.AppPasswordAdd(ctx, "phone", []string{store.AppProtocolIMAP}, nil) }) // Duplicate.
+	tneedErrorCode(t, "user:error", func() { api.AppPasswordAdd(ctx, "other", []string{"bogus"}, nil) })               // Unknown protocol.
+	tneedErrorCode(t, "user:error", func() { api.AppPasswordAdd(ctx, "other", nil, nil) })                             // No protocol.
+	tcompare(t, len(api.AppPasswords(ctx)), 1)
+	api.AppPasswordRemove(ctx, "phone")
+	tneedErrorCode(t, "user:error", func() { api.AppPasswordRemove(ctx, "phone") })
+
+	// Signing and encryption keys.
+	tneedErrorCode(t, "user:error", func() { api.CryptoKeyGenerate(ctx, "mjl", "other@other.example") }) // Not our address.
+	key := api.CryptoKeyGenerate(ctx, "mjl", "mjl☺@mox.example")
+	tcompare(t, key.Addresses, []string{"mjl☺@mox.example"})
+	pubKey := api.CryptoKeyPublic(ctx, key.ID)
+	tneedErrorCode(t, "user:error", func() { api.CryptoKeyImport(ctx, store.CryptoOpenPGP, pubKey, "") }) // Not a private key.
+	tneedErrorCode(t, "user:error", func() { api.CryptoKeyImport(ctx, store.CryptoSMIME, "bogus", "") })
+	peerKeys := api.PeerKeyImport(ctx, store.CryptoOpenPGP, pubKey)
+	tcompare(t, len(peerKeys), 1)
+	tcompare(t, peerKeys[0].Fingerprint, key.Fingerprint)
+	tneedErrorCode(t, "user:error", func() { api.PeerKeyImport(ctx, store.CryptoSMIME, pubKey) })
+	keys, peerKeys := api.CryptoKeys(ctx)
+	tcompare(t, len(keys), 1)
+	tcompare(t, len(peerKeys), 1)
+	api.PeerKeyRemove(ctx, peerKeys[0].ID)
+	tneedErrorCode(t, "user:error", func() { api.PeerKeyRemove(ctx, peerKeys[0].ID) })
+	api.CryptoKeyRemove(ctx, key.ID)
+	tneedErrorCode(t, "user:error", func() { api.CryptoKeyRemove(ctx, key.ID) })
+	tneedErrorCode(t, "user:error", func() { api.CryptoKeyPublic(ctx, key.ID) })
+
+	// Two-factor authentication.
+	enabled, _ := api.TOTPStatus(ctx)
+	tcompare(t, enabled, false)
+	tneedErrorCode(t, "user:error", func() { api.TOTPSetupConfirm(ctx, "123456") }) // Not started.
+	setup := api.TOTPSetupStart(ctx)
+	secret, err := totp.DecodeSecret(setup.Secret)
+	tcheck(t, err, "decode totp secret")
+	enabled, _ = api.TOTPStatus(ctx)
+	tcompare(t, enabled, false) // Not confirmed yet.
+	cur := totp.Counter(time.Now())
+	tneedErrorCode(t, "user:error", func() { api.TOTPSetupConfirm(ctx, totp.Code(secret, cur+5)) })
+	recoveryCodes := api.TOTPSetupConfirm(ctx, totp.Code(secret, cur))
+	tcompare(t, len(recoveryCodes), 10)
+	enabled, recoveryCodesLeft := api.TOTPStatus(ctx)
+	tcompare(t, enabled, true)
+	tcompare(t, recoveryCodesLeft, 10)
+	tneedErrorCode(t, "user:error", func() { api.TOTPSetupStart(ctx) }) // Already enabled.
+
+	// Login now needs a second step with a code.
+	loginCookie.Value = api.LoginPrep(ctx)
+	reqInfo.Request.Header = http.Header{"Cookie": []string{loginCookie.String()}}
+	tneedErrorCode(t, "user:totpRequired", func() { api.Login(ctx, loginCookie.Value, "mjl☺@mox.example", "test1234") })
+	tneedErrorCode(t, "user:loginFailed", func() { api.LoginTOTP(ctx, loginCookie.Value, totp.Code(secret, cur)) }) // Already used.
+	tneedErrorCode(t, "user:error", func() { api.LoginTOTP(ctx, "badtoken", totp.Code(secret, cur+1)) })
+	api.LoginTOTP(ctx, loginCookie.Value, totp.Code(secret, cur+1))
+	tneedErrorCode(t, "user:error", func() { api.LoginTOTP(ctx, loginCookie.Value, totp.Code(secret, cur+1)) }) // Login completed.
+
+	// Recovery codes can be used once.
+	loginCookie.Value = api.LoginPrep(ctx)
+	reqInfo.Request.Header = http.Header{"Cookie": []string{loginCookie.String()}}
+	tneedErrorCode(t, "user:totpRequired", func() { api.Login(ctx, loginCookie.Value, "mjl☺@mox.example", "test1234") })
+	api.LoginTOTP(ctx, loginCookie.Value, strings.ToUpper(recoveryCodes[0]))
+	loginCookie.Value = api.LoginPrep(ctx)
+	reqInfo.Request.Header = http.Header{"Cookie": []string{loginCookie.String()}}
+	tneedErrorCode(t, "user:totpRequired", func() { api.Login(ctx, loginCookie.Value, "mjl☺@mox.example", "test1234") })
+	tneedErrorCode(t, "user:loginFailed", func() { api.LoginTOTP(ctx, loginCookie.Value, recoveryCodes[0]) })
+	_, recoveryCodesLeft = api.TOTPStatus(ctx)
+	tcompare(t, recoveryCodesLeft, 9)
+	tcompare(t, len(api.TOTPRecoveryCodes(ctx)), 10)
+
+	// Someone who knows the password cannot guess codes without limit by logging in
+	// again after bad codes.
+	errorCode := func(fn func()) (code string) {
+		defer func() {
+			x := recover()
+			if err, ok := x.(*sherpa.Error); ok {
+				code = err.Code
+			} else if x != nil {
+				panic(x)
+			}
+		}()
+		fn()
+		return ""
+	}
+	badCode := totp.Code(secret, cur+100)
+	cycleLogins := func(resetIP bool) {
+		t.Helper()
+		for i := 0; i < 5; i++ {
+			if resetIP {
+				mox.LimiterFailedAuth.Reset(net.ParseIP("127.0.0.1"), time.Now())
+			}
+			loginCookie.Value = api.LoginPrep(ctx)
+			reqInfo.Request.Header = http.Header{"Cookie": []string{loginCookie.String()}}
+			code := errorCode(func() { api.Login(ctx, loginCookie.Value, "mjl☺@mox.example", "test1234") })
+			if code == "user:error" {
+				return
+			}
+			tcompare(t, code, "user:totpRequired")
+			for j := 0; j < 5; j++ {
+				code := errorCode(func() { api.LoginTOTP(ctx, loginCookie.Value, badCode) })
+				if code == "user:error" {
+					return
+				}
+				tcompare(t, code, "user:loginFailed")
+			}
+		}
+		t.Fatalf("not blocked after repeated logins with bad codes")
+	}
+	// A login with a valid password no longer resets the rate limiter for the IP.
+	cycleLogins(false)
+	// Bad codes are counted per account, not per login.
+	cycleLogins(true)
+	// The account stays blocked for a while, even for a valid code.
+	mox.LimiterFailedAuth.Reset(net.ParseIP("127.0.0.1"), time.Now())
+	loginCookie.Value = api.LoginPrep(ctx)
+	reqInfo.Request.Header = http.Header{"Cookie": []string{loginCookie.String()}}
+	tneedErrorCode(t, "user:totpRequired", func() { api.Login(ctx, loginCookie.Value, "mjl☺@mox.example", "test1234") })
+	tneedErrorCode(t, "user:error", func() { api.LoginTOTP(ctx, loginCookie.Value, totp.Code(secret, cur+2)) })
+	mox.LimiterFailedAuth.Reset(net.ParseIP("127.0.0.1"), time.Now())
+
+	api.TOTPDisable(ctx)
+	tneedErrorCode(t, "user:error", func() { api.TOTPDisable(ctx) })
+	loginCookie.Value = api.LoginPrep(ctx)
+	reqInfo.Request.Header = http.Header{"Cookie": []string{loginCookie.String()}}
+	api.Login(ctx, loginCookie.Value, "mjl☺@mox.example", "test1234")
 	api.RejectsSave(ctx, "", false) // Restore.
 
 	api.Logout(ctx)
@@ -22,6 +22,8 @@ export interface Account {
 	MaxFirstTimeRecipientsPerDay: number
 	NoFirstTimeSenderDelay: boolean
 	Routes?: Route[] | null
+	IPPools?: string[] | null
+	EncryptMessages: boolean
 	DNSDomain: Domain  // Parsed form of Domain.
 	Aliases?: AddressAlias[] | null
 }
@@ -48,7 +50,7 @@ export interface Ruleset {
 	MsgFromRegexp: string
 	VerifiedDomain: string
 	HeadersRegexp?: { [key: string]: string }
-	IsForward: boolean  // todo: once we implement ARC, we can use dkim domains that we cannot verify but that the arc-verified forwarding mail server was able to verify.
+	IsForward: boolean
 	ListAllowDomain: string
 	AcceptRejectsToMailbox: string
 	Mailbox: string
@@ -93,6 +95,7 @@ export interface Route {
 	ToDomain?: string[] | null
 	MinimumAttempts: number
 	Transport: string
+	IPPool: string
 	FromDomainASCII?: string[] | null
 	ToDomainASCII?: string[] | null
 }
@@ -108,9 +111,14 @@ export interface Alias {
 	PostPublic: boolean
 	ListMembers: boolean
 	AllowMsgFrom: boolean
+	ListOwner: string
+	Subscribe: boolean
+	Moderate: boolean
+	DigestInterval: number
 	LocalpartStr: string  // In encoded form.
 	Domain: Domain
-	ParsedAddresses?: AliasAddress[] | null  // Matches addresses.
+	ParsedAddresses?: AliasAddress[] | null  // Matches addresses. AccountName is empty for external addresses.
+	ParsedListOwner: AliasAddress  // If ListOwner is set.
 }
 
 export interface AliasAddress {
@@ -204,6 +212,127 @@ export interface IncomingMeta {
 	Automated: boolean  // Whether this message was automated and should not receive automated replies. E.g. out of office or mailing list messages.
 }
 
+// SieveScript is a Sieve script for filtering incoming messages. An account can
+// have multiple scripts, but at most one is active. If a script is active, it is
+// evaluated for incoming messages instead of the rulesets of the destination
+// address.
+export interface SieveScript {
+	ID: number
+	Name: string
+	Content: string  // Script source, syntax checked when stored.
+	Active: boolean
+	Created: Date
+	Updated: Date
+}
+
+// Vacation holds the out-of-office settings of an account. While enabled and
+// within the optional date range, senders of incoming messages get an automatic
+// response. Singleton with ID 1.
+export interface Vacation {
+	ID: number
+	Enabled: boolean
+	Start: Date  // If not zero, no responses are sent before this time.
+	End: Date  // If not zero, no responses are sent at or after this time.
+	Subject: string  // If empty, "Auto: " followed by the subject of the incoming message.
+	Body: string  // Text of the response.
+	IntervalDays: number  // Minimum number of days between responses to the same sender. If zero, 7 days.
+}
+
+// AddressBookContacts is an address book with its contacts.
+export interface AddressBookContacts {
+	AddressBook: AddressBook
+	Contacts?: Contact[] | null  // Ordered by name.
+}
+
+// AddressBook is a collection of contacts, served over CardDAV. A new account
+// gets a default address book when contacts are first accessed.
+export interface AddressBook {
+	ID: number
+	Name: string  // Used as path segment in URLs, e.g. "contacts".
+	DisplayName: string
+	Description: string
+	ModSeq: ModSeq  // ModSeq of the last change to the address book or its contacts. Used as CTag and sync-token for CardDAV clients.
+	Created: Date
+}
+
+// Contact is a vCard in an address book. Removed contacts are kept as tombstones
+// with Expunged set, so CardDAV clients can synchronize removals.
+export interface Contact {
+	ID: number
+	AddressBookID: number
+	Name: string  // Resource name, last path segment in URLs, e.g. "<uid>.vcf".
+	ModSeq: ModSeq
+	Expunged: boolean
+	UID: string  // Fields below are parsed from the vCard when stored, and cleared when expunged.
+	FormattedName: string  // From FN property.
+	Emails?: string[] | null  // From EMAIL properties, as in the vCard.
+	VCard: string
+	Updated: Date
+}
+
+// AppPassword is an additional password for an account, typically for a single
+// device or application, so it can be revoked without changing the account
+// password. An app password can only be used for its protocols, and optionally
+// expires.
+// 
+// App passwords are generated by mox, they are long random strings. Only a
+// SHA-256 hash is stored, which is sufficient for high-entropy passwords and
+// allows looking up the app password by its hash. App passwords cannot be used
+// with SCRAM-SHA-* and CRAM-MD5 authentication.
+export interface AppPassword {
+	ID: number
+	Created: Date
+	Name: string
+	Protocols?: string[] | null  // One or more of AppProtocolIMAP, AppProtocolSubmission, AppProtocolWebAPI.
+	Expires: Date  // Zero if app password does not expire.
+	LastUsed: Date  // Zero if never used. Updated at most once a minute.
+	LastUsedProtocol: string
+}
+
+// CryptoKey is a private key of the account, for signing outgoing messages and
+// decrypting incoming messages in webmail, with S/MIME or OpenPGP.
+// 
+// Private keys are stored without passphrase protection in the account
+// database, like the DKIM private keys in the configuration directory. Keys
+// protected with a passphrase are decrypted during import.
+export interface CryptoKey {
+	ID: number
+	Created: Date
+	Kind: CryptoKind
+	Fingerprint: string  // Hex SHA-256 of the certificate for S/MIME, key fingerprint for OpenPGP.
+	Addresses?: string[] | null  // Email addresses from the certificate or key, in lower case.
+	Description: string  // Certificate subject for S/MIME, user ID for OpenPGP.
+	NotAfter: Date  // Expiration of the S/MIME certificate. Zero for OpenPGP.
+}
+
+// PeerKey is a public key of a correspondent, for encrypting messages to them,
+// and for verifying their OpenPGP signatures. A key is stored for each address
+// of a certificate or OpenPGP key. Keys are imported by the user, or learned from
+// Autocrypt headers (OpenPGP) and from the certificates in valid signatures
+// (S/MIME) of messages opened in webmail.
+export interface PeerKey {
+	ID: number
+	Updated: Date
+	Kind: CryptoKind
+	Address: string  // In lower case.
+	Fingerprint: string  // As for CryptoKey.
+	Source: string  // PeerKeySourceImport, PeerKeySourceAutocrypt or PeerKeySourceSignature.
+	PreferEncrypt: boolean  // From Autocrypt header.
+	MessageTime: Date  // For learned keys, Date of the message the key was learned from.
+}
+
+// TOTPSetup has the parameters for adding a TOTP to an authenticator app.
+export interface TOTPSetup {
+	URI: string  // With "otpauth" scheme.
+	Secret: string  // Base32, for manual entry.
+	QRCodePNG: string  // Data URL with PNG image of a QR code for URI.
+}
+
+// ModSeq represents a modseq as stored in the database. ModSeq 0 in the
+// database is sent to the client as 1, because modseq 0 is special in IMAP.
+// ModSeq coming from the client are of type int64.
+export type ModSeq = number
+
 export type CSRFToken = string
 
 // Localpart is a decoded local part of an email address, before the "@".
@@ -238,11 +367,17 @@ export enum OutgoingEvent {
 	EventUnrecognized = "unrecognized",
 }
 
-export const structTypes: {[typename: string]: boolean} = {"Account":true,"Address":true,"AddressAlias":true,"Alias":true,"AliasAddress":true,"AutomaticJunkFlags":true,"Destination":true,"Domain":true,"ImportProgress":true,"Incoming":true,"IncomingMeta":true,"IncomingWebhook":true,"JunkFilter":true,"NameAddress":true,"Outgoing":true,"OutgoingWebhook":true,"Route":true,"Ruleset":true,"Structure":true,"SubjectPass":true,"Suppression":true}
-export const stringsTypes: {[typename: string]: boolean} = {"CSRFToken":true,"Localpart":true,"OutgoingEvent":true}
-export const intsTypes: {[typename: string]: boolean} = {}
+// CryptoKind is a mechanism for signing and encrypting messages.
+export enum CryptoKind {
+	CryptoSMIME = "smime",
+	CryptoOpenPGP = "openpgp",
+}
+
+export const structTypes: {[typename: string]: boolean} = {"Account":true,"Address":true,"AddressAlias":true,"AddressBook":true,"AddressBookContacts":true,"Alias":true,"AliasAddress":true,"AppPassword":true,"AutomaticJunkFlags":true,"Contact":true,"CryptoKey":true,"Destination":true,"Domain":true,"ImportProgress":true,"Incoming":true,"IncomingMeta":true,"IncomingWebhook":true,"JunkFilter":true,"NameAddress":true,"Outgoing":true,"OutgoingWebhook":true,"PeerKey":true,"Route":true,"Ruleset":true,"SieveScript":true,"Structure":true,"SubjectPass":true,"Suppression":true,"TOTPSetup":true,"Vacation":true}
+export const stringsTypes: {[typename: string]: boolean} = {"CSRFToken":true,"CryptoKind":true,"Localpart":true,"OutgoingEvent":true}
+export const intsTypes: {[typename: string]: boolean} = {"ModSeq":true}
 export const types: TypenameMap = {
-	"Account": {"Name":"Account","Docs":"","Fields":[{"Name":"OutgoingWebhook","Docs":"","Typewords":["nullable","OutgoingWebhook"]},{"Name":"IncomingWebhook","Docs":"","Typewords":["nullable","IncomingWebhook"]},{"Name":"FromIDLoginAddresses","Docs":"","Typewords":["[]","string"]},{"Name":"KeepRetiredMessagePeriod","Docs":"","Typewords":["int64"]},{"Name":"KeepRetiredWebhookPeriod","Docs":"","Typewords":["int64"]},{"Name":"Domain","Docs":"","Typewords":["string"]},{"Name":"Description","Docs":"","Typewords":["string"]},{"Name":"FullName","Docs":"","Typewords":["string"]},{"Name":"Destinations","Docs":"","Typewords":["{}","Destination"]},{"Name":"SubjectPass","Docs":"","Typewords":["SubjectPass"]},{"Name":"QuotaMessageSize","Docs":"","Typewords":["int64"]},{"Name":"RejectsMailbox","Docs":"","Typewords":["string"]},{"Name":"KeepRejects","Docs":"","Typewords":["bool"]},{"Name":"AutomaticJunkFlags","Docs":"","Typewords":["AutomaticJunkFlags"]},{"Name":"JunkFilter","Docs":"","Typewords":["nullable","JunkFilter"]},{"Name":"MaxOutgoingMessagesPerDay","Docs":"","Typewords":["int32"]},{"Name":"MaxFirstTimeRecipientsPerDay","Docs":"","Typewords":["int32"]},{"Name":"NoFirstTimeSenderDelay","Docs":"","Typewords":["bool"]},{"Name":"Routes","Docs":"","Typewords":["[]","Route"]},{"Name":"DNSDomain","Docs":"","Typewords":["Domain"]},{"Name":"Aliases","Docs":"","Typewords":["[]","AddressAlias"]}]},
+	"Account": {"Name":"Account","Docs":"","Fields":[{"Name":"OutgoingWebhook","Docs":"","Typewords":["nullable","OutgoingWebhook"]},{"Name":"IncomingWebhook","Docs":"","Typewords":["nullable","IncomingWebhook"]},{"Name":"FromIDLoginAddresses","Docs":"","Typewords":["[]","string"]},{"Name":"KeepRetiredMessagePeriod","Docs":"","Typewords":["int64"]},{"Name":"KeepRetiredWebhookPeriod","Docs":"","Typewords":["int64"]},{"Name":"Domain","Docs":"","Typewords":["string"]},{"Name":"Description","Docs":"","Typewords":["string"]},{"Name":"FullName","Docs":"","Typewords":["string"]},{"Name":"Destinations","Docs":"","Typewords":["{}","Destination"]},{"Name":"SubjectPass","Docs":"","Typewords":["SubjectPass"]},{"Name":"QuotaMessageSize","Docs":"","Typewords":["int64"]},{"Name":"RejectsMailbox","Docs":"","Typewords":["string"]},{"Name":"KeepRejects","Docs":"","Typewords":["bool"]},{"Name":"AutomaticJunkFlags","Docs":"","Typewords":["AutomaticJunkFlags"]},{"Name":"JunkFilter","Docs":"","Typewords":["nullable","JunkFilter"]},{"Name":"MaxOutgoingMessagesPerDay","Docs":"","Typewords":["int32"]},{"Name":"MaxFirstTimeRecipientsPerDay","Docs":"","Typewords":["int32"]},{"Name":"NoFirstTimeSenderDelay","Docs":"","Typewords":["bool"]},{"Name":"Routes","Docs":"","Typewords":["[]","Route"]},{"Name":"IPPools","Docs":"","Typewords":["[]","string"]},{"Name":"EncryptMessages","Docs":"","Typewords":["bool"]},{"Name":"DNSDomain","Docs":"","Typewords":["Domain"]},{"Name":"Aliases","Docs":"","Typewords":["[]","AddressAlias"]}]},
 	"OutgoingWebhook": {"Name":"OutgoingWebhook","Docs":"","Fields":[{"Name":"URL","Docs":"","Typewords":["string"]},{"Name":"Authorization","Docs":"","Typewords":["string"]},{"Name":"Events","Docs":"","Typewords":["[]","string"]}]},
 	"IncomingWebhook": {"Name":"IncomingWebhook","Docs":"","Fields":[{"Name":"URL","Docs":"","Typewords":["string"]},{"Name":"Authorization","Docs":"","Typewords":["string"]}]},
 	"Destination": {"Name":"Destination","Docs":"","Fields":[{"Name":"Mailbox","Docs":"","Typewords":["string"]},{"Name":"Rulesets","Docs":"","Typewords":["[]","Ruleset"]},{"Name":"FullName","Docs":"","Typewords":["string"]}]},
@@ -251,9 +386,9 @@ export const types: TypenameMap = {
 	"SubjectPass": {"Name":"SubjectPass","Docs":"","Fields":[{"Name":"Period","Docs":"","Typewords":["int64"]}]},
 	"AutomaticJunkFlags": {"Name":"AutomaticJunkFlags","Docs":"","Fields":[{"Name":"Enabled","Docs":"","Typewords":["bool"]},{"Name":"JunkMailboxRegexp","Docs":"","Typewords":["string"]},{"Name":"NeutralMailboxRegexp","Docs":"","Typewords":["string"]},{"Name":"NotJunkMailboxRegexp","Docs":"","Typewords":["string"]}]},
 	"JunkFilter": {"Name":"JunkFilter","Docs":"","Fields":[{"Name":"Threshold","Docs":"","Typewords":["float64"]},{"Name":"Onegrams","Docs":"","Typewords":["bool"]},{"Name":"Twograms","Docs":"","Typewords":["bool"]},{"Name":"Threegrams","Docs":"","Typewords":["bool"]},{"Name":"MaxPower","Docs":"","Typewords":["float64"]},{"Name":"TopWords","Docs":"","Typewords":["int32"]},{"Name":"IgnoreWords","Docs":"","Typewords":["float64"]},{"Name":"RareWords","Docs":"","Typewords":["int32"]}]},
-	"Route": {"Name":"Route","Docs":"","Fields":[{"Name":"FromDomain","Docs":"","Typewords":["[]","string"]},{"Name":"ToDomain","Docs":"","Typewords":["[]","string"]},{"Name":"MinimumAttempts","Docs":"","Typewords":["int32"]},{"Name":"Transport","Docs":"","Typewords":["string"]},{"Name":"FromDomainASCII","Docs":"","Typewords":["[]","string"]},{"Name":"ToDomainASCII","Docs":"","Typewords":["[]","string"]}]},
+	"Route": {"Name":"Route","Docs":"","Fields":[{"Name":"FromDomain","Docs":"","Typewords":["[]","string"]},{"Name":"ToDomain","Docs":"","Typewords":["[]","string"]},{"Name":"MinimumAttempts","Docs":"","Typewords":["int32"]},{"Name":"Transport","Docs":"","Typewords":["string"]},{"Name":"IPPool","Docs":"","Typewords":["string"]},{"Name":"FromDomainASCII","Docs":"","Typewords":["[]","string"]},{"Name":"ToDomainASCII","Docs":"","Typewords":["[]","string"]}]},
 	"AddressAlias": {"Name":"AddressAlias","Docs":"","Fields":[{"Name":"SubscriptionAddress","Docs":"","Typewords":["string"]},{"Name":"Alias","Docs":"","Typewords":["Alias"]},{"Name":"MemberAddresses","Docs":"","Typewords":["[]","string"]}]},
-	"Alias": {"Name":"Alias","Docs":"","Fields":[{"Name":"Addresses","Docs":"","Typewords":["[]","string"]},{"Name":"PostPublic","Docs":"","Typewords":["bool"]},{"Name":"ListMembers","Docs":"","Typewords":["bool"]},{"Name":"AllowMsgFrom","Docs":"","Typewords":["bool"]},{"Name":"LocalpartStr","Docs":"","Typewords":["string"]},{"Name":"Domain","Docs":"","Typewords":["Domain"]},{"Name":"ParsedAddresses","Docs":"","Typewords":["[]","AliasAddress"]}]},
+	"Alias": {"Name":"Alias","Docs":"","Fields":[{"Name":"Addresses","Docs":"","Typewords":["[]","string"]},{"Name":"PostPublic","Docs":"","Typewords":["bool"]},{"Name":"ListMembers","Docs":"","Typewords":["bool"]},{"Name":"AllowMsgFrom","Docs":"","Typewords":["bool"]},{"Name":"ListOwner","Docs":"","Typewords":["string"]},{"Name":"Subscribe","Docs":"","Typewords":["bool"]},{"Name":"Moderate","Docs":"","Typewords":["bool"]},{"Name":"DigestInterval","Docs":"","Typewords":["int64"]},{"Name":"LocalpartStr","Docs":"","Typewords":["string"]},{"Name":"Domain","Docs":"","Typewords":["Domain"]},{"Name":"ParsedAddresses","Docs":"","Typewords":["[]","AliasAddress"]},{"Name":"ParsedListOwner","Docs":"","Typewords":["AliasAddress"]}]},
 	"AliasAddress": {"Name":"AliasAddress","Docs":"","Fields":[{"Name":"Address","Docs":"","Typewords":["Address"]},{"Name":"AccountName","Docs":"","Typewords":["string"]},{"Name":"Destination","Docs":"","Typewords":["Destination"]}]},
 	"Address": {"Name":"Address","Docs":"","Fields":[{"Name":"Localpart","Docs":"","Typewords":["Localpart"]},{"Name":"Domain","Docs":"","Typewords":["Domain"]}]},
 	"Suppression": {"Name":"Suppression","Docs":"","Fields":[{"Name":"ID","Docs":"","Typewords":["int64"]},{"Name":"Created","Docs":"","Typewords":["timestamp"]},{"Name":"Account","Docs":"","Typewords":["string"]},{"Name":"BaseAddress","Docs":"","Typewords":["string"]},{"Name":"OriginalAddress","Docs":"","Typewords":["string"]},{"Name":"Manual","Docs":"","Typewords":["bool"]},{"Name":"Reason","Docs":"","Typewords":["string"]}]},
@@ -263,9 +398,20 @@ export const types: TypenameMap = {
 	"NameAddress": {"Name":"NameAddress","Docs":"","Fields":[{"Name":"Name","Docs":"","Typewords":["string"]},{"Name":"Address","Docs":"","Typewords":["string"]}]},
 	"Structure": {"Name":"Structure","Docs":"","Fields":[{"Name":"ContentType","Docs":"","Typewords":["string"]},{"Name":"ContentTypeParams","Docs":"","Typewords":["{}","string"]},{"Name":"ContentID","Docs":"","Typewords":["string"]},{"Name":"DecodedSize","Docs":"","Typewords":["int64"]},{"Name":"Parts","Docs":"","Typewords":["[]","Structure"]}]},
 	"IncomingMeta": {"Name":"IncomingMeta","Docs":"","Fields":[{"Name":"MsgID","Docs":"","Typewords":["int64"]},{"Name":"MailFrom","Docs":"","Typewords":["string"]},{"Name":"MailFromValidated","Docs":"","Typewords":["bool"]},{"Name":"MsgFromValidated","Docs":"","Typewords":["bool"]},{"Name":"RcptTo","Docs":"","Typewords":["string"]},{"Name":"DKIMVerifiedDomains","Docs":"","Typewords":["[]","string"]},{"Name":"RemoteIP","Docs":"","Typewords":["string"]},{"Name":"Received","Docs":"","Typewords":["timestamp"]},{"Name":"MailboxName","Docs":"","Typewords":["string"]},{"Name":"Automated","Docs":"","Typewords":["bool"]}]},
+	"SieveScript": {"Name":"SieveScript","Docs":"","Fields":[{"Name":"ID","Docs":"","Typewords":["int64"]},{"Name":"Name","Docs":"","Typewords":["string"]},{"Name":"Content","Docs":"","Typewords":["string"]},{"Name":"Active","Docs":"","Typewords":["bool"]},{"Name":"Created","Docs":"","Typewords":["timestamp"]},{"Name":"Updated","Docs":"","Typewords":["timestamp"]}]},
+	"Vacation": {"Name":"Vacation","Docs":"","Fields":[{"Name":"ID","Docs":"","Typewords":["uint8"]},{"Name":"Enabled","Docs":"","Typewords":["bool"]},{"Name":"Start","Docs":"","Typewords":["timestamp"]},{"Name":"End","Docs":"","Typewords":["timestamp"]},{"Name":"Subject","Docs":"","Typewords":["string"]},{"Name":"Body","Docs":"","Typewords":["string"]},{"Name":"IntervalDays","Docs":"","Typewords":["int32"]}]},
+	"AddressBookContacts": {"Name":"AddressBookContacts","Docs":"","Fields":[{"Name":"AddressBook","Docs":"","Typewords":["AddressBook"]},{"Name":"Contacts","Docs":"","Typewords":["[]","Contact"]}]},
+	"AddressBook": {"Name":"AddressBook","Docs":"","Fields":[{"Name":"ID","Docs":"","Typewords":["int64"]},{"Name":"Name","Docs":"","Typewords":["string"]},{"Name":"DisplayName","Docs":"","Typewords":["string"]},{"Name":"Description","Docs":"","Typewords":["string"]},{"Name":"ModSeq","Docs":"","Typewords":["ModSeq"]},{"Name":"Created","Docs":"","Typewords":["timestamp"]}]},
+	"Contact": {"Name":"Contact","Docs":"","Fields":[{"Name":"ID","Docs":"","Typewords":["int64"]},{"Name":"AddressBookID","Docs":"","Typewords":["int64"]},{"Name":"Name","Docs":"","Typewords":["string"]},{"Name":"ModSeq","Docs":"","Typewords":["ModSeq"]},{"Name":"Expunged","Docs":"","Typewords":["bool"]},{"Name":"UID","Docs":"","Typewords":["string"]},{"Name":"FormattedName","Docs":"","Typewords":["string"]},{"Name":"Emails","Docs":"","Typewords":["[]","string"]},{"Name":"VCard","Docs":"","Typewords":["string"]},{"Name":"Updated","Docs":"","Typewords":["timestamp"]}]},
+	"AppPassword": {"Name":"AppPassword","Docs":"","Fields":[{"Name":"ID","Docs":"","Typewords":["int64"]},{"Name":"Created","Docs":"","Typewords":["timestamp"]},{"Name":"Name","Docs":"","Typewords":["string"]},{"Name":"Protocols","Docs":"","Typewords":["[]","string"]},{"Name":"Expires","Docs":"","Typewords":["timestamp"]},{"Name":"LastUsed","Docs":"","Typewords":["timestamp"]},{"Name":"LastUsedProtocol","Docs":"","Typewords":["string"]}]},
+	"CryptoKey": {"Name":"CryptoKey","Docs":"","Fields":[{"Name":"ID","Docs":"","Typewords":["int64"]},{"Name":"Created","Docs":"","Typewords":["timestamp"]},{"Name":"Kind","Docs":"","Typewords":["CryptoKind"]},{"Name":"Fingerprint","Docs":"","Typewords":["string"]},{"Name":"Addresses","Docs":"","Typewords":["[]","string"]},{"Name":"Description","Docs":"","Typewords":["string"]},{"Name":"NotAfter","Docs":"","Typewords":["timestamp"]}]},
+	"PeerKey": {"Name":"PeerKey","Docs":"","Fields":[{"Name":"ID","Docs":"","Typewords":["int64"]},{"Name":"Updated","Docs":"","Typewords":["timestamp"]},{"Name":"Kind","Docs":"","Typewords":["CryptoKind"]},{"Name":"Address","Docs":"","Typewords":["string"]},{"Name":"Fingerprint","Docs":"","Typewords":["string"]},{"Name":"Source","Docs":"","Typewords":["string"]},{"Name":"PreferEncrypt","Docs":"","Typewords":["bool"]},{"Name":"MessageTime","Docs":"","Typewords":["timestamp"]}]},
+	"TOTPSetup": {"Name":"TOTPSetup","Docs":"","Fields":[{"Name":"URI","Docs":"","Typewords":["string"]},{"Name":"Secret","Docs":"","Typewords":["string"]},{"Name":"QRCodePNG","Docs":"","Typewords":["string"]}]},
+	"ModSeq": {"Name":"ModSeq","Docs":"","Values":null},
 	"CSRFToken": {"Name":"CSRFToken","Docs":"","Values":null},
 	"Localpart": {"Name":"Localpart","Docs":"","Values":null},
 	"OutgoingEvent": {"Name":"OutgoingEvent","Docs":"","Values":[{"Name":"EventDelivered","Value":"delivered","Docs":""},{"Name":"EventSuppressed","Value":"suppressed","Docs":""},{"Name":"EventDelayed","Value":"delayed","Docs":""},{"Name":"EventFailed","Value":"failed","Docs":""},{"Name":"EventRelayed","Value":"relayed","Docs":""},{"Name":"EventExpanded","Value":"expanded","Docs":""},{"Name":"EventCanceled","Value":"canceled","Docs":""},{"Name":"EventUnrecognized","Value":"unrecognized","Docs":""}]},
+	"CryptoKind": {"Name":"CryptoKind","Docs":"","Values":[{"Name":"CryptoSMIME","Value":"smime","Docs":""},{"Name":"CryptoOpenPGP","Value":"openpgp","Docs":""}]},
 }
 
 export const parser = {
@@ -290,9 +436,20 @@ export const parser = {
 	NameAddress: (v: any) => parse("NameAddress", v) as NameAddress,
 	Structure: (v: any) => parse("Structure", v) as Structure,
 	IncomingMeta: (v: any) => parse("IncomingMeta", v) as IncomingMeta,
+	SieveScript: (v: any) => parse("SieveScript", v) as SieveScript,
+	Vacation: (v: any) => parse("Vacation", v) as Vacation,
+	AddressBookContacts: (v: any) => parse("AddressBookContacts", v) as AddressBookContacts,
+	AddressBook: (v: any) => parse("AddressBook", v) as AddressBook,
+	Contact: (v: any) => parse("Contact", v) as Contact,
+	AppPassword: (v: any) => parse("AppPassword", v) as AppPassword,
+	CryptoKey: (v: any) => parse("CryptoKey", v) as CryptoKey,
+	PeerKey: (v: any) => parse("PeerKey", v) as PeerKey,
+	TOTPSetup: (v: any) => parse("TOTPSetup", v) as TOTPSetup,
+	ModSeq: (v: any) => parse("ModSeq", v) as ModSeq,
 	CSRFToken: (v: any) => parse("CSRFToken", v) as CSRFToken,
 	Localpart: (v: any) => parse("Localpart", v) as Localpart,
 	OutgoingEvent: (v: any) => parse("OutgoingEvent", v) as OutgoingEvent,
+	CryptoKind: (v: any) => parse("CryptoKind", v) as CryptoKind,
 }
 
 // Account exports web API functions for the account web interface. All its
@@ -345,6 +502,49 @@ export class Client {
 		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as CSRFToken
 	}
 
+	// LoginTOTP completes a login for which Login failed with error code
+	// "user:totpRequired", with a code from an authenticator app or a recovery code.
+	// Fails with error code "user:loginFailed" for a bad code.
+	async LoginTOTP(loginToken: string, code: string): Promise<CSRFToken> {
+		const fn: string = "LoginTOTP"
+		const paramTypes: string[][] = [["string"],["string"]]
+		const returnTypes: string[][] = [["CSRFToken"]]
+		const params: any[] = [loginToken, code]
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as CSRFToken
+	}
+
+	// LoginOIDCEnabled returns whether logging in through an OpenID Connect identity
+	// provider (single sign-on) is available.
+	async LoginOIDCEnabled(): Promise<boolean> {
+		const fn: string = "LoginOIDCEnabled"
+		const paramTypes: string[][] = []
+		const returnTypes: string[][] = [["bool"]]
+		const params: any[] = []
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as boolean
+	}
+
+	// LoginOIDCStart starts a login through the identity provider, returning the URL
+	// to navigate to. Call LoginPrep to get a loginToken. After logging in at the
+	// identity provider, the browser returns with an "oidc" query string parameter,
+	// which must be passed to LoginOIDC.
+	async LoginOIDCStart(loginToken: string): Promise<string> {
+		const fn: string = "LoginOIDCStart"
+		const paramTypes: string[][] = [["string"]]
+		const returnTypes: string[][] = [["string"]]
+		const params: any[] = [loginToken]
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as string
+	}
+
+	// LoginOIDC completes a login through the identity provider, returning a session
+	// token like Login, and the address the user logged in with.
+	async LoginOIDC(state: string): Promise<[CSRFToken, string]> {
+		const fn: string = "LoginOIDC"
+		const paramTypes: string[][] = [["string"]]
+		const returnTypes: string[][] = [["CSRFToken"],["string"]]
+		const params: any[] = [state]
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as [CSRFToken, string]
+	}
+
 	// Logout invalidates the session token.
 	async Logout(): Promise<void> {
 		const fn: string = "Logout"
@@ -535,6 +735,259 @@ export class Client {
 		const params: any[] = [mailbox, keep]
 		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as void
 	}
+
+	// SieveScripts returns the Sieve scripts of the account, ordered by name.
+	async SieveScripts(): Promise<SieveScript[] | null> {
+		const fn: string = "SieveScripts"
+		const paramTypes: string[][] = []
+		const returnTypes: string[][] = [["[]","SieveScript"]]
+		const params: any[] = []
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as SieveScript[] | null
+	}
+
+	// SieveScriptSave adds or replaces a Sieve script. The script is checked for
+	// errors before it is stored. If activate is set, the script becomes the active
+	// script, used for evaluating incoming messages instead of the rulesets of the
+	// destinations.
+	async SieveScriptSave(name: string, content: string, activate: boolean): Promise<SieveScript> {
+		const fn: string = "SieveScriptSave"
+		const paramTypes: string[][] = [["string"],["string"],["bool"]]
+		const returnTypes: string[][] = [["SieveScript"]]
+		const params: any[] = [name, content, activate]
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as SieveScript
+	}
+
+	// SieveScriptActivate makes the script with name the active script. If name is
+	// empty, no script will be active anymore.
+	async SieveScriptActivate(name: string): Promise<void> {
+		const fn: string = "SieveScriptActivate"
+		const paramTypes: string[][] = [["string"]]
+		const returnTypes: string[][] = []
+		const params: any[] = [name]
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as void
+	}
+
+	// SieveScriptRemove removes a Sieve script. The active script cannot be removed.
+	async SieveScriptRemove(name: string): Promise<void> {
+		const fn: string = "SieveScriptRemove"
+		const paramTypes: string[][] = [["string"]]
+		const returnTypes: string[][] = []
+		const params: any[] = [name]
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as void
+	}
+
+	// Vacation returns the vacation settings of the account, for automatic responses
+	// to incoming messages.
+	async Vacation(): Promise<Vacation> {
+		const fn: string = "Vacation"
+		const paramTypes: string[][] = []
+		const returnTypes: string[][] = [["Vacation"]]
+		const params: any[] = []
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as Vacation
+	}
+
+	// VacationSave saves the vacation settings. While enabled and within the
+	// optional start and end time, senders of incoming messages get an automatic
+	// response, at most once per interval. No responses are sent to mailing lists,
+	// automated messages, or if the active Sieve script sends its own vacation
+	// response.
+	async VacationSave(vacation: Vacation): Promise<void> {
+		const fn: string = "VacationSave"
+		const paramTypes: string[][] = [["Vacation"]]
+		const returnTypes: string[][] = []
+		const params: any[] = [vacation]
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as void
+	}
+
+	// AddressBooks returns the address books of the account with their contacts,
+	// ordered by name. The default address book is created if the account has none.
+	// Address books are synchronized with clients over CardDAV.
+	async AddressBooks(): Promise<AddressBookContacts[] | null> {
+		const fn: string = "AddressBooks"
+		const paramTypes: string[][] = []
+		const returnTypes: string[][] = [["[]","AddressBookContacts"]]
+		const params: any[] = []
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as AddressBookContacts[] | null
+	}
+
+	// AddressBookCreate adds a new address book.
+	async AddressBookCreate(name: string, displayName: string): Promise<void> {
+		const fn: string = "AddressBookCreate"
+		const paramTypes: string[][] = [["string"],["string"]]
+		const returnTypes: string[][] = []
+		const params: any[] = [name, displayName]
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as void
+	}
+
+	// AddressBookRemove removes an address book and its contacts.
+	async AddressBookRemove(name: string): Promise<void> {
+		const fn: string = "AddressBookRemove"
+		const paramTypes: string[][] = [["string"]]
+		const returnTypes: string[][] = []
+		const params: any[] = [name]
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as void
+	}
+
+	// ContactRemove removes a contact from an address book.
+	async ContactRemove(addressBook: string, name: string): Promise<void> {
+		const fn: string = "ContactRemove"
+		const paramTypes: string[][] = [["string"],["string"]]
+		const returnTypes: string[][] = []
+		const params: any[] = [addressBook, name]
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as void
+	}
+
+	// AppPasswords returns the app passwords of the account, ordered by name.
+	async AppPasswords(): Promise<AppPassword[] | null> {
+		const fn: string = "AppPasswords"
+		const paramTypes: string[][] = []
+		const returnTypes: string[][] = [["[]","AppPassword"]]
+		const params: any[] = []
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as AppPassword[] | null
+	}
+
+	// AppPasswordAdd adds a new app password for one or more of the protocols
+	// "imap", "submission" and "webapi", optionally with an expiration time. The
+	// generated password is returned, it cannot be retrieved later.
+	async AppPasswordAdd(name: string, protocols: string[] | null, expires: Date | null): Promise<string> {
+		const fn: string = "AppPasswordAdd"
+		const paramTypes: string[][] = [["string"],["[]","string"],["nullable","timestamp"]]
+		const returnTypes: string[][] = [["string"]]
+		const params: any[] = [name, protocols, expires]
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as string
+	}
+
+	// AppPasswordRemove removes an app password, it can no longer be used for
+	// logging in.
+	async AppPasswordRemove(name: string): Promise<void> {
+		const fn: string = "AppPasswordRemove"
+		const paramTypes: string[][] = [["string"]]
+		const returnTypes: string[][] = []
+		const params: any[] = [name]
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as void
+	}
+
+	// CryptoKeys returns the private keys of the account for signing and
+	// decrypting messages in webmail, and the public keys of correspondents.
+	async CryptoKeys(): Promise<[CryptoKey[] | null, PeerKey[] | null]> {
+		const fn: string = "CryptoKeys"
+		const paramTypes: string[][] = []
+		const returnTypes: string[][] = [["[]","CryptoKey"],["[]","PeerKey"]]
+		const params: any[] = []
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as [CryptoKey[] | null, PeerKey[] | null]
+	}
+
+	// CryptoKeyGenerate generates a new OpenPGP key for the address, which must be
+	// an address of the account.
+	async CryptoKeyGenerate(name: string, address: string): Promise<CryptoKey> {
+		const fn: string = "CryptoKeyGenerate"
+		const paramTypes: string[][] = [["string"],["string"]]
+		const returnTypes: string[][] = [["CryptoKey"]]
+		const params: any[] = [name, address]
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as CryptoKey
+	}
+
+	// CryptoKeyImport adds a private key. For S/MIME, data must be PEM with the
+	// private key and certificate chain. For OpenPGP, data is an ASCII-armored
+	// private key, decrypted with passphrase if protected.
+	async CryptoKeyImport(kind: CryptoKind, data: string, passphrase: string): Promise<CryptoKey> {
+		const fn: string = "CryptoKeyImport"
+		const paramTypes: string[][] = [["CryptoKind"],["string"],["string"]]
+		const returnTypes: string[][] = [["CryptoKey"]]
+		const params: any[] = [kind, data, passphrase]
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as CryptoKey
+	}
+
+	// CryptoKeyPublic returns the public part of a key, to share with
+	// correspondents: PEM certificates for S/MIME, an ASCII-armored key for OpenPGP.
+	async CryptoKeyPublic(id: number): Promise<string> {
+		const fn: string = "CryptoKeyPublic"
+		const paramTypes: string[][] = [["int64"]]
+		const returnTypes: string[][] = [["string"]]
+		const params: any[] = [id]
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as string
+	}
+
+	// CryptoKeyRemove removes a private key. Messages encrypted for the key can no
+	// longer be decrypted.
+	async CryptoKeyRemove(id: number): Promise<void> {
+		const fn: string = "CryptoKeyRemove"
+		const paramTypes: string[][] = [["int64"]]
+		const returnTypes: string[][] = []
+		const params: any[] = [id]
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as void
+	}
+
+	// PeerKeyImport adds public keys of correspondents, replacing existing keys for
+	// the same addresses. For S/MIME, data must be PEM certificates. For OpenPGP,
+	// data must be ASCII-armored public keys.
+	async PeerKeyImport(kind: CryptoKind, data: string): Promise<PeerKey[] | null> {
+		const fn: string = "PeerKeyImport"
+		const paramTypes: string[][] = [["CryptoKind"],["string"]]
+		const returnTypes: string[][] = [["[]","PeerKey"]]
+		const params: any[] = [kind, data]
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as PeerKey[] | null
+	}
+
+	// PeerKeyRemove removes a public key of a correspondent.
+	async PeerKeyRemove(id: number): Promise<void> {
+		const fn: string = "PeerKeyRemove"
+		const paramTypes: string[][] = [["int64"]]
+		const returnTypes: string[][] = []
+		const params: any[] = [id]
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as void
+	}
+
+	// TOTPStatus returns whether two-factor authentication with a TOTP is enabled for
+	// logins to the web interfaces, and the number of unused recovery codes.
+	async TOTPStatus(): Promise<[boolean, number]> {
+		const fn: string = "TOTPStatus"
+		const paramTypes: string[][] = []
+		const returnTypes: string[][] = [["bool"],["int32"]]
+		const params: any[] = []
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as [boolean, number]
+	}
+
+	// TOTPSetupStart starts enrollment for two-factor authentication with a new
+	// secret, for adding to an authenticator app. Logins do not require a code until
+	// enrollment is confirmed with TOTPSetupConfirm.
+	async TOTPSetupStart(): Promise<TOTPSetup> {
+		const fn: string = "TOTPSetupStart"
+		const paramTypes: string[][] = []
+		const returnTypes: string[][] = [["TOTPSetup"]]
+		const params: any[] = []
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as TOTPSetup
+	}
+
+	// TOTPSetupConfirm enables two-factor authentication if code from the
+	// authenticator app is valid, and returns recovery codes. Each recovery code can
+	// be used once instead of a code from the authenticator app.
+	async TOTPSetupConfirm(code: string): Promise<string[] | null> {
+		const fn: string = "TOTPSetupConfirm"
+		const paramTypes: string[][] = [["string"]]
+		const returnTypes: string[][] = [["[]","string"]]
+		const params: any[] = [code]
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as string[] | null
+	}
+
+	// TOTPRecoveryCodes replaces the recovery codes with new codes, and returns them.
+	async TOTPRecoveryCodes(): Promise<string[] | null> {
+		const fn: string = "TOTPRecoveryCodes"
+		const paramTypes: string[][] = []
+		const returnTypes: string[][] = [["[]","string"]]
+		const params: any[] = []
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as string[] | null
+	}
+
+	// TOTPDisable disables two-factor authentication, logins only require a password
+	// again.
+	async TOTPDisable(): Promise<void> {
+		const fn: string = "TOTPDisable"
+		const paramTypes: string[][] = []
+		const returnTypes: string[][] = []
+		const params: any[] = []
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as void
+	}
 }
 
 export const defaultBaseURL = (function() {
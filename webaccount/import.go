@@ -411,17 +411,13 @@ func importMessages(ctx context.Context, log mlog.Log, token string, acc *store.
 	}
 
 	openTrainMessage := func(m *store.Message) {
-		path := acc.MessagePath(m.ID)
-		f, err := os.Open(path)
-		if err != nil {
-			problemf("opening message again for training junk filter: %v (continuing)", err)
-			return
-		}
+		// Message file may have been stored encrypted.
+		mr := acc.MessageReader(*m)
 		defer func() {
-			err := f.Close()
-			log.Check(err, "closing file after training junkfilter")
+			err := mr.Close()
+			log.Check(err, "closing message after training junkfilter")
 		}()
-		p, err := m.LoadPart(f)
+		p, err := m.LoadPart(mr)
 		if err != nil {
 			problemf("loading parsed message again for training junk filter: %v (continuing)", err)
 			return
@@ -45,6 +45,7 @@ import (
 	"github.com/mjl-/sherpadoc"
 	"github.com/mjl-/sherpaprom"
 
+	"github.com/mjl-/mox/admindb"
 	"github.com/mjl-/mox/config"
 	"github.com/mjl-/mox/dkim"
 	"github.com/mjl-/mox/dmarc"
@@ -135,7 +136,8 @@ func Handler(cookiePath string, isForwarded bool) func(w http.ResponseWriter, r
 
 // Admin exports web API functions for the admin web interface. All its methods are
 // exported under api/. Function calls require valid HTTP Authentication
-// credentials of a user.
+// credentials of a user, and the role of the admin user must allow the function,
+// see apiPermissions.
 type Admin struct {
 	cookiePath  string // From listener, for setting authentication cookies.
 	isForwarded bool   // From listener, whether we look at X-Forwarded-* headers.
@@ -149,6 +151,122 @@ type requestInfo struct {
 	SessionToken store.SessionToken
 	Response     http.ResponseWriter
 	Request      *http.Request // For Proto and TLS connection state during message submit.
+	AdminUser    admindb.User  // Admin making the request. For the admin password, the name is empty and role is admin.
+}
+
+// apiPermissions is the permission required for each API function. Functions
+// not listed cannot be called. For functions requiring PermDomainRead or
+// PermDomainChange, the function itself checks access to the domain, account or
+// address for domain admins.
+var apiPermissions = map[string]admindb.Permission{
+	"_docs":                          admindb.PermSession,
+	"LoginPrep":                      admindb.PermSession,
+	"Login":                          admindb.PermSession,
+	"LoginTOTP":                      admindb.PermSession,
+	"Logout":                         admindb.PermSession,
+	"TOTPStatus":                     admindb.PermSession,
+	"TOTPSetupStart":                 admindb.PermSession,
+	"TOTPSetupConfirm":               admindb.PermSession,
+	"TOTPDisable":                    admindb.PermSession,
+	"AdminUserCurrent":               admindb.PermSession,
+	"CheckDomain":                    admindb.PermDomainRead,
+	"Domains":                        admindb.PermDomainRead,
+	"Domain":                         admindb.PermDomainRead,
+	"ParseDomain":                    admindb.PermDomainRead,
+	"DomainConfig":                   admindb.PermDomainRead,
+	"DomainLocalparts":               admindb.PermDomainRead,
+	"Accounts":                       admindb.PermDomainRead,
+	"Account":                        admindb.PermDomainRead,
+	"TLSReports":                     admindb.PermDomainRead,
+	"TLSReportID":                    admindb.PermDomainRead,
+	"TLSRPTSummaries":                admindb.PermDomainRead,
+	"DMARCReports":                   admindb.PermDomainRead,
+	"DMARCReportID":                  admindb.PermDomainRead,
+	"DMARCSummaries":                 admindb.PermDomainRead,
+	"LookupIP":                       admindb.PermDomainRead,
+	"DomainRecords":                  admindb.PermDomainRead,
+	"ClientConfigsDomain":            admindb.PermDomainRead,
+	"ConfigFiles":                    admindb.PermRead,
+	"MTASTSPolicies":                 admindb.PermRead,
+	"DNSBLStatus":                    admindb.PermRead,
+	"QueueSize":                      admindb.PermRead,
+	"QueueHoldRuleList":              admindb.PermRead,
+	"QueueList":                      admindb.PermRead,
+	"QueueRateLimits":                admindb.PermRead,
+	"RetiredList":                    admindb.PermRead,
+	"HookQueueSize":                  admindb.PermRead,
+	"HookList":                       admindb.PermRead,
+	"HookRetiredList":                admindb.PermRead,
+	"LogLevels":                      admindb.PermRead,
+	"CheckUpdatesEnabled":            admindb.PermRead,
+	"WebserverConfig":                admindb.PermRead,
+	"Transports":                     admindb.PermRead,
+	"DMARCEvaluationStats":           admindb.PermRead,
+	"DMARCEvaluationsDomain":         admindb.PermRead,
+	"DMARCSuppressList":              admindb.PermRead,
+	"TLSRPTResults":                  admindb.PermRead,
+	"TLSRPTResultsDomain":            admindb.PermRead,
+	"LookupTLSRPTRecord":             admindb.PermRead,
+	"TLSRPTSuppressList":             admindb.PermRead,
+	"LookupCid":                      admindb.PermRead,
+	"Config":                         admindb.PermRead,
+	"QueueHoldRuleAdd":               admindb.PermQueue,
+	"QueueHoldRuleRemove":            admindb.PermQueue,
+	"QueueNextAttemptSet":            admindb.PermQueue,
+	"QueueNextAttemptAdd":            admindb.PermQueue,
+	"QueueHoldSet":                   admindb.PermQueue,
+	"QueueFail":                      admindb.PermQueue,
+	"QueueDrop":                      admindb.PermQueue,
+	"QueueRequireTLSSet":             admindb.PermQueue,
+	"QueueTransportSet":              admindb.PermQueue,
+	"HookNextAttemptSet":             admindb.PermQueue,
+	"HookNextAttemptAdd":             admindb.PermQueue,
+	"HookCancel":                     admindb.PermQueue,
+	"AccountAdd":                     admindb.PermDomainChange,
+	"AccountRemove":                  admindb.PermDomainChange,
+	"AddressAdd":                     admindb.PermDomainChange,
+	"AddressRemove":                  admindb.PermDomainChange,
+	"SetPassword":                    admindb.PermDomainChange,
+	"AccountTOTPDisable":             admindb.PermDomainChange,
+	"DomainDescriptionSave":          admindb.PermDomainChange,
+	"DomainClientSettingsDomainSave": admindb.PermDomainChange,
+	"DomainLocalpartConfigSave":      admindb.PermDomainChange,
+	"DomainDMARCAddressSave":         admindb.PermDomainChange,
+	"DomainTLSRPTAddressSave":        admindb.PermDomainChange,
+	"DomainMTASTSSave":               admindb.PermDomainChange,
+	"DomainDKIMAdd":                  admindb.PermDomainChange,
+	"DomainDKIMRemove":               admindb.PermDomainChange,
+	"DomainDKIMSave":                 admindb.PermDomainChange,
+	"AliasAdd":                       admindb.PermDomainChange,
+	"AliasUpdate":                    admindb.PermDomainChange,
+	"AliasRemove":                    admindb.PermDomainChange,
+	"AliasAddressesAdd":              admindb.PermDomainChange,
+	"AliasAddressesRemove":           admindb.PermDomainChange,
+	"DomainAdd":                      admindb.PermAdmin,
+	"DomainRemove":                   admindb.PermAdmin,
+	"AccountSettingsSave":            admindb.PermAdmin,
+	"MonitorDNSBLsSave":              admindb.PermAdmin,
+	"LogLevelSet":                    admindb.PermAdmin,
+	"LogLevelRemove":                 admindb.PermAdmin,
+	"WebserverConfigSave":            admindb.PermAdmin,
+	"DMARCRemoveEvaluations":         admindb.PermAdmin,
+	"DMARCSuppressAdd":               admindb.PermAdmin,
+	"DMARCSuppressRemove":            admindb.PermAdmin,
+	"DMARCSuppressExtend":            admindb.PermAdmin,
+	"TLSRPTRemoveResults":            admindb.PermAdmin,
+	"TLSRPTSuppressAdd":              admindb.PermAdmin,
+	"TLSRPTSuppressRemove":           admindb.PermAdmin,
+	"TLSRPTSuppressExtend":           admindb.PermAdmin,
+	"AccountRoutesSave":              admindb.PermAdmin,
+	"DomainRoutesSave":               admindb.PermAdmin,
+	"RoutesSave":                     admindb.PermAdmin,
+	"AdminUsers":                     admindb.PermAdmin,
+	"AdminUserAdd":                   admindb.PermAdmin,
+	"AdminUserSave":                  admindb.PermAdmin,
+	"AdminUserPasswordSet":           admindb.PermAdmin,
+	"AdminUserTOTPDisable":           admindb.PermAdmin,
+	"AdminUserRemove":                admindb.PermAdmin,
+	"AuditList":                      admindb.PermRead,
 }
 
 func handle(apiHandler http.Handler, isForwarded bool, w http.ResponseWriter, r *http.Request) {
@@ -175,23 +293,141 @@ func handle(apiHandler http.Handler, isForwarded bool, w http.ResponseWriter, r
 
 	// All other URLs, except the login endpoint require some authentication.
 	var sessionToken store.SessionToken
-	if r.URL.Path != "/api/LoginPrep" && r.URL.Path != "/api/Login" {
+	var admin admindb.User
+	isLogin := r.URL.Path == "/api/LoginPrep" || r.URL.Path == "/api/Login" || r.URL.Path == "/api/LoginTOTP"
+	if !isLogin {
+		var adminName string
 		var ok bool
-		_, sessionToken, _, ok = webauth.Check(ctx, log, webauth.Admin, "webadmin", isForwarded, w, r, isAPI, isAPI, false)
+		isExport := r.URL.Path == "/auditlog"
+		adminName, sessionToken, _, ok = webauth.Check(ctx, log, webauth.Admin, "webadmin", isForwarded, w, r, isAPI, isAPI || isExport, isExport)
 		if !ok {
 			// Response has been written already.
 			return
 		}
+		if adminName == "" {
+			admin = admindb.User{Role: admindb.RoleAdmin}
+		} else if u, err := admindb.UserGet(ctx, adminName); err != nil {
+			log.Errorx("looking up admin user for session", err, slog.String("adminuser", adminName))
+			respondError(w, isAPI, "user:badAuth", "unknown admin user")
+			return
+		} else {
+			admin = u
+		}
 	}
 
 	if isAPI {
-		reqInfo := requestInfo{sessionToken, w, r}
+		fn := strings.TrimPrefix(r.URL.Path, "/api/")
+		if !isLogin && fn != "" {
+			perm, ok := apiPermissions[fn]
+			if !ok || !admin.Role.Allowed(perm) {
+				log.Info("admin api call not allowed for role", slog.String("function", fn), slog.String("adminuser", admin.Name), slog.Any("role", admin.Role))
+				respondError(w, isAPI, "user:error", "permission denied")
+				return
+			}
+			if perm == admindb.PermQueue || perm == admindb.PermAdmin || perm == admindb.PermDomainChange {
+				log.Info("admin api call", slog.String("function", fn), slog.String("adminuser", admin.Name), slog.Any("role", admin.Role))
+			}
+		}
+
+		actor := admindb.AuditActor{
+			Source:    admindb.AuditSourceWebadmin,
+			Name:      admin.Name,
+			RemoteIP:  webauth.RemoteIP(log, isForwarded, r).String(),
+			Operation: fn,
+		}
+		ctx = admindb.ContextWithAuditActor(ctx, actor)
+		reqInfo := requestInfo{sessionToken, w, r, admin}
 		ctx = context.WithValue(ctx, requestInfoCtxKey, reqInfo)
 		apiHandler.ServeHTTP(w, r.WithContext(ctx))
 		return
 	}
 
-	http.NotFound(w, r)
+	switch r.URL.Path {
+	case "/auditlog":
+		// Export of the audit log as JSON lines, with the filter as JSON in form field
+		// "filter".
+		if r.Method != "POST" {
+			http.Error(w, "405 - method not allowed - use post", http.StatusMethodNotAllowed)
+			return
+		}
+		if !admin.Role.Allowed(admindb.PermRead) {
+			respondError(w, false, "user:error", "permission denied")
+			return
+		}
+		var filter admindb.AuditFilter
+		if s := r.PostFormValue("filter"); s != "" {
+			if err := json.Unmarshal([]byte(s), &filter); err != nil {
+				http.Error(w, "400 - bad request - parsing filter: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="mox-auditlog.jsonl"`)
+		err := admindb.AuditExport(ctx, w, filter)
+		log.Check(err, "exporting audit log")
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// respondError writes an error response, as sherpa error for API requests.
+func respondError(w http.ResponseWriter, isAPI bool, code, msg string) {
+	if !isAPI {
+		http.Error(w, "403 - forbidden - "+msg, http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	result := struct {
+		Error sherpa.Error `json:"error"`
+	}{
+		sherpa.Error{Code: code, Message: msg},
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// adminUser returns the admin user making the request. Calls without request
+// information, e.g. from tests, are made as the admin.
+func adminUser(ctx context.Context) admindb.User {
+	if reqInfo, ok := ctx.Value(requestInfoCtxKey).(requestInfo); ok {
+		return reqInfo.AdminUser
+	}
+	return admindb.User{Role: admindb.RoleAdmin}
+}
+
+// xdomainAccess fails with a user error if the admin user is a domain admin
+// without access to the domain. Other roles have been checked for access to the
+// API function already.
+func xdomainAccess(ctx context.Context, domain string) {
+	u := adminUser(ctx)
+	if u.Role != admindb.RoleDomain {
+		return
+	}
+	d, err := dns.ParseDomain(domain)
+	if err != nil || !u.DomainAllowed(d) {
+		xusererrorf(ctx, "permission denied for domain %q", domain)
+	}
+}
+
+// xaddressAccess is like xdomainAccess, for the domain of an address, which can
+// also be of the form "@domain" for a catchall address.
+func xaddressAccess(ctx context.Context, address string) {
+	if adminUser(ctx).Role != admindb.RoleDomain {
+		return
+	}
+	if i := strings.LastIndex(address, "@"); i < 0 {
+		xusererrorf(ctx, "permission denied for address %q", address)
+	} else {
+		xdomainAccess(ctx, address[i+1:])
+	}
+}
+
+// xaccountAccess fails with a user error if the admin user is a domain admin
+// without access to the default domain of the account.
+func xaccountAccess(ctx context.Context, accountName string) {
+	if !adminUser(ctx).AccountAllowed(accountName) {
+		xusererrorf(ctx, "permission denied for account %q", accountName)
+	}
 }
 
 func xcheckf(ctx context.Context, err error, format string, args ...any) {
@@ -246,12 +482,13 @@ func (w Admin) LoginPrep(ctx context.Context) string {
 }
 
 // Login returns a session token for the credentials, or fails with error code
-// "user:badLogin". Call LoginPrep to get a loginToken.
-func (w Admin) Login(ctx context.Context, loginToken, password string) store.CSRFToken {
+// "user:badLogin". Call LoginPrep to get a loginToken. For the admin password,
+// username must be empty. Otherwise the credentials are of an admin user.
+func (w Admin) Login(ctx context.Context, loginToken, username, password string) store.CSRFToken {
 	log := pkglog.WithContext(ctx)
 	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
 
-	csrfToken, err := webauth.Login(ctx, log, webauth.Admin, "webadmin", w.cookiePath, w.isForwarded, reqInfo.Response, reqInfo.Request, loginToken, "", password)
+	csrfToken, err := webauth.Login(ctx, log, webauth.Admin, "webadmin", w.cookiePath, w.isForwarded, reqInfo.Response, reqInfo.Request, loginToken, username, password)
 	if _, ok := err.(*sherpa.Error); ok {
 		panic(err)
 	}
@@ -259,15 +496,155 @@ func (w Admin) Login(ctx context.Context, loginToken, password string) store.CSR
 	return csrfToken
 }
 
+// LoginTOTP completes a login for which Login failed with error code
+// "user:totpRequired", with a code from an authenticator app. Fails with error
+// code "user:loginFailed" for a bad code.
+func (w Admin) LoginTOTP(ctx context.Context, loginToken, code string) store.CSRFToken {
+	log := pkglog.WithContext(ctx)
+	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
+
+	csrfToken, err := webauth.LoginTOTP(ctx, log, webauth.Admin, "webadmin", w.cookiePath, w.isForwarded, reqInfo.Response, reqInfo.Request, loginToken, code)
+	if _, ok := err.(*sherpa.Error); ok {
+		panic(err)
+	}
+	xcheckf(ctx, err, "login")
+	return csrfToken
+}
+
+// TOTPStatus returns whether logins of the admin (user) require a TOTP code from
+// an authenticator app.
+func (Admin) TOTPStatus(ctx context.Context) (enabled bool) {
+	enabled, err := webauth.AdminTOTPEnabled(ctx, adminUser(ctx).Name)
+	xcheckf(ctx, err, "checking admin totp")
+	return enabled
+}
+
+// TOTPSetupStart starts enrollment of the admin for two-factor authentication
+// with a new secret, for adding to an authenticator app. Logins do not require a
+// code until enrollment is confirmed with TOTPSetupConfirm.
+func (Admin) TOTPSetupStart(ctx context.Context) webauth.TOTPSetup {
+	name := adminUser(ctx).Name
+	secret, err := webauth.AdminTOTPSetupStart(ctx, name)
+	if errors.Is(err, store.ErrTOTPEnabled) {
+		xcheckuserf(ctx, err, "starting two-factor authentication setup")
+	}
+	xcheckf(ctx, err, "starting two-factor authentication setup")
+
+	if name == "" {
+		name = "admin"
+	}
+	setup, err := webauth.NewTOTPSetup(mox.Conf.Static.HostnameDomain.ASCII, name, secret)
+	xcheckf(ctx, err, "totp setup")
+	return setup
+}
+
+// TOTPSetupConfirm enables two-factor authentication for the admin (user) if code
+// from the authenticator app is valid. To disable TOTP for the admin password
+// without the web interface, remove the admin password file with ".totp"
+// appended.
+func (Admin) TOTPSetupConfirm(ctx context.Context, code string) {
+	err := webauth.AdminTOTPSetupConfirm(ctx, adminUser(ctx).Name, code)
+	if errors.Is(err, store.ErrTOTPUnknown) || errors.Is(err, store.ErrTOTPCodeInvalid) {
+		xcheckuserf(ctx, err, "confirming two-factor authentication")
+	}
+	xcheckf(ctx, err, "confirming two-factor authentication")
+}
+
+// TOTPDisable disables two-factor authentication for the admin (user), logins
+// only require the password again.
+func (Admin) TOTPDisable(ctx context.Context) {
+	err := webauth.AdminTOTPDisable(ctx, adminUser(ctx).Name)
+	if errors.Is(err, store.ErrTOTPUnknown) {
+		xcheckuserf(ctx, err, "disabling two-factor authentication")
+	}
+	xcheckf(ctx, err, "disabling two-factor authentication")
+}
+
 // Logout invalidates the session token.
 func (w Admin) Logout(ctx context.Context) {
 	log := pkglog.WithContext(ctx)
 	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
 
-	err := webauth.Logout(ctx, log, webauth.Admin, "webadmin", w.cookiePath, w.isForwarded, reqInfo.Response, reqInfo.Request, "", reqInfo.SessionToken)
+	err := webauth.Logout(ctx, log, webauth.Admin, "webadmin", w.cookiePath, w.isForwarded, reqInfo.Response, reqInfo.Request, reqInfo.AdminUser.Name, reqInfo.SessionToken)
 	xcheckf(ctx, err, "logout")
 }
 
+// AdminUserCurrent returns the logged in admin user. For the admin password, the
+// name is empty and the role is admin.
+func (Admin) AdminUserCurrent(ctx context.Context) admindb.User {
+	return adminUser(ctx)
+}
+
+// AdminUsers returns all admin users.
+func (Admin) AdminUsers(ctx context.Context) []admindb.User {
+	l, err := admindb.UserList(ctx)
+	xcheckf(ctx, err, "listing admin users")
+	return l
+}
+
+// AdminUserAdd adds an admin user with a role, and for role "domain" the domains
+// it manages. The password is optional, without password the user cannot log in
+// to the admin web interface, but can still be used for connections to the ctl
+// socket by its unix user.
+func (Admin) AdminUserAdd(ctx context.Context, user admindb.User, password string) {
+	if password != "" && len(password) < 8 {
+		xusererrorf(ctx, "password must be at least 8 characters")
+	}
+	_, err := admindb.UserAdd(ctx, user, password)
+	xcheckf(ctx, err, "adding admin user")
+}
+
+// AdminUserSave changes the role, domains and unix user of an admin user.
+func (Admin) AdminUserSave(ctx context.Context, user admindb.User) {
+	err := admindb.UserSave(ctx, user)
+	if errors.Is(err, admindb.ErrUnknownUser) {
+		xcheckuserf(ctx, err, "saving admin user")
+	}
+	xcheckf(ctx, err, "saving admin user")
+}
+
+// AdminUserPasswordSet sets a new password for an admin user, ending its
+// sessions. An empty password disables logins to the admin web interface.
+func (Admin) AdminUserPasswordSet(ctx context.Context, name, password string) {
+	if password != "" && len(password) < 8 {
+		xusererrorf(ctx, "password must be at least 8 characters")
+	}
+	err := admindb.UserSetPassword(ctx, name, password)
+	if errors.Is(err, admindb.ErrUnknownUser) {
+		xcheckuserf(ctx, err, "setting password for admin user")
+	}
+	xcheckf(ctx, err, "setting password for admin user")
+	webauth.AdminSessionsRemove(name)
+}
+
+// AdminUserTOTPDisable disables two-factor authentication for an admin user,
+// e.g. after losing the authenticator app.
+func (Admin) AdminUserTOTPDisable(ctx context.Context, name string) {
+	err := webauth.AdminTOTPDisable(ctx, name)
+	if errors.Is(err, admindb.ErrUnknownUser) || errors.Is(err, store.ErrTOTPUnknown) {
+		xcheckuserf(ctx, err, "disabling two-factor authentication for admin user")
+	}
+	xcheckf(ctx, err, "disabling two-factor authentication for admin user")
+}
+
+// AdminUserRemove removes an admin user, ending its sessions.
+func (Admin) AdminUserRemove(ctx context.Context, name string) {
+	err := admindb.UserRemove(ctx, name)
+	if errors.Is(err, admindb.ErrUnknownUser) {
+		xcheckuserf(ctx, err, "removing admin user")
+	}
+	xcheckf(ctx, err, "removing admin user")
+	webauth.AdminSessionsRemove(name)
+}
+
+// AuditList returns entries from the audit log of changes to the configuration,
+// queues and passwords, newest first.
+func (Admin) AuditList(ctx context.Context, filter admindb.AuditFilter) []admindb.AuditEntry {
+	l, err := admindb.AuditList(ctx, filter)
+	xcheckf(ctx, err, "listing audit log")
+	return l
+}
+
 type Result struct {
 	Errors       []string
 	Warnings     []string
@@ -428,6 +805,7 @@ func xsendingIPs(ctx context.Context) []net.IP {
 // CheckDomain checks the configuration for the domain, such as MX, SMTP STARTTLS,
 // SPF, DKIM, DMARC, TLSRPT, MTASTS, autoconfig, autodiscover.
 func (Admin) CheckDomain(ctx context.Context, domainName string) (r CheckResult) {
+	xdomainAccess(ctx, domainName)
 	// todo future: should run these checks without a DNS cache so recent changes are picked up.
 
 	resolver := dns.StrictResolver{Pkg: "check", Log: pkglog.WithContext(ctx).Logger}
@@ -624,6 +1002,16 @@ EOF
 				instr := fmt.Sprintf("For SOCKS transport %s, ensure IPs %s have reverse address %s.", tname, iplist(t.Socks.IPs), t.Socks.Hostname)
 				r.IPRev.Instructions = append(r.IPRev.Instructions, instr)
 			}
+			// And for IP pools of direct transports, each IP with its own hostname.
+			if t.Direct != nil {
+				for pname, pool := range t.Direct.IPPools {
+					for _, pip := range pool.IPs {
+						hostIPs[pip.HostnameDomain] = append(hostIPs[pip.HostnameDomain], pip.ParsedIP)
+						instr := fmt.Sprintf("For IP pool %s of transport %s, ensure IP %s has reverse address %s.", pname, tname, pip.ParsedIP, pip.HostnameDomain.ASCII)
+						r.IPRev.Instructions = append(r.IPRev.Instructions, instr)
+					}
+				}
+			}
 		}
 
 		type result struct {
@@ -1361,7 +1749,8 @@ When enabling MTA-STS, or updating a policy, always update the policy first (thr
 
 		// We'll assume if any submissions is configured, it is public. Same for imap. And
 		// if not, that there is a plain option.
-		var submissions, imaps bool
+		// POP3 is only expected when explicitly enabled with TLS, see DomainRecords.
+		var submissions, imaps, pop3s bool
 		for _, l := range mox.Conf.Static.Listeners {
 			if l.TLS != nil && l.Submissions.Enabled {
 				submissions = true
@@ -1370,6 +1759,9 @@ When enabling MTA-STS, or updating a policy, always update the policy first (thr
 				imaps = true
 			}
 		}
+		if l, ok := mox.Conf.Static.Listeners["public"]; ok && l.TLS != nil && l.POP3S.Enabled {
+			pop3s = true
+		}
 		srvhost := func(ok bool) string {
 			if ok {
 				return mox.Conf.Static.HostnameDomain.ASCII + "."
@@ -1382,7 +1774,7 @@ When enabling MTA-STS, or updating a policy, always update the policy first (thr
 			{name: "_imaps", port: 993, host: srvhost(imaps)},
 			{name: "_imap", port: 143, host: srvhost(!imaps)},
 			{name: "_pop3", port: 110, host: "."},
-			{name: "_pop3s", port: 995, host: "."},
+			{name: "_pop3s", port: 995, host: srvhost(pop3s)},
 		}
 		var srvwg sync.WaitGroup
 		srvwg.Add(len(reqs))
@@ -1499,18 +1891,23 @@ When enabling MTA-STS, or updating a policy, always update the policy first (thr
 	return
 }
 
-// Domains returns all configured domain names, in UTF-8 for IDNA domains.
+// Domains returns all configured domain names, in UTF-8 for IDNA domains. For
+// domain admins, only the domains managed by the admin are returned.
 func (Admin) Domains(ctx context.Context) []dns.Domain {
+	u := adminUser(ctx)
 	l := []dns.Domain{}
 	for _, s := range mox.Conf.Domains() {
 		d, _ := dns.ParseDomain(s)
-		l = append(l, d)
+		if u.DomainAllowed(d) {
+			l = append(l, d)
+		}
 	}
 	return l
 }
 
 // Domain returns the dns domain for a (potentially unicode as IDNA) domain name.
 func (Admin) Domain(ctx context.Context, domain string) dns.Domain {
+	xdomainAccess(ctx, domain)
 	d, err := dns.ParseDomain(domain)
 	xcheckuserf(ctx, err, "parse domain")
 	_, ok := mox.Conf.Domain(d)
@@ -1529,6 +1926,7 @@ func (Admin) ParseDomain(ctx context.Context, domain string) dns.Domain {
 
 // DomainConfig returns the configuration for a domain.
 func (Admin) DomainConfig(ctx context.Context, domain string) config.Domain {
+	xdomainAccess(ctx, domain)
 	d, err := dns.ParseDomain(domain)
 	xcheckuserf(ctx, err, "parse domain")
 	conf, ok := mox.Conf.Domain(d)
@@ -1540,6 +1938,7 @@ func (Admin) DomainConfig(ctx context.Context, domain string) config.Domain {
 
 // DomainLocalparts returns the encoded localparts and accounts configured in domain.
 func (Admin) DomainLocalparts(ctx context.Context, domain string) (localpartAccounts map[string]string, localpartAliases map[string]config.Alias) {
+	xdomainAccess(ctx, domain)
 	d, err := dns.ParseDomain(domain)
 	xcheckuserf(ctx, err, "parsing domain")
 	_, ok := mox.Conf.Domain(d)
@@ -1549,9 +1948,13 @@ func (Admin) DomainLocalparts(ctx context.Context, domain string) (localpartAcco
 	return mox.Conf.DomainLocalparts(d)
 }
 
-// Accounts returns the names of all configured accounts.
+// Accounts returns the names of all configured accounts. For domain admins, only
+// accounts with a default domain managed by the admin are returned.
 func (Admin) Accounts(ctx context.Context) []string {
-	l := mox.Conf.Accounts()
+	u := adminUser(ctx)
+	l := slices.DeleteFunc(mox.Conf.Accounts(), func(name string) bool {
+		return !u.AccountAllowed(name)
+	})
 	sort.Slice(l, func(i, j int) bool {
 		return l[i] < l[j]
 	})
@@ -1560,6 +1963,7 @@ func (Admin) Accounts(ctx context.Context) []string {
 
 // Account returns the parsed configuration of an account.
 func (Admin) Account(ctx context.Context, account string) (accountConfig config.Account, diskUsage int64) {
+	xaccountAccess(ctx, account)
 	log := pkglog.WithContext(ctx)
 
 	acc, err := store.OpenAccount(log, account)
@@ -1608,6 +2012,7 @@ func (Admin) MTASTSPolicies(ctx context.Context) (records []mtastsdb.PolicyRecor
 // policy domain (or all domains if empty). The reports are sorted first by period
 // end (most recent first), then by policy domain.
 func (Admin) TLSReports(ctx context.Context, start, end time.Time, policyDomain string) (reports []tlsrptdb.Record) {
+	xdomainAccess(ctx, policyDomain)
 	var polDom dns.Domain
 	if policyDomain != "" {
 		var err error
@@ -1630,6 +2035,7 @@ func (Admin) TLSReports(ctx context.Context, start, end time.Time, policyDomain
 
 // TLSReportID returns a single TLS report.
 func (Admin) TLSReportID(ctx context.Context, domain string, reportID int64) tlsrptdb.Record {
+	xdomainAccess(ctx, domain)
 	record, err := tlsrptdb.RecordID(ctx, reportID)
 	if err == nil && record.Domain != domain {
 		err = bstore.ErrAbsent
@@ -1654,6 +2060,7 @@ type TLSRPTSummary struct {
 // period start/end for one or all domains (when domain is empty).
 // The returned summaries are ordered by domain name.
 func (Admin) TLSRPTSummaries(ctx context.Context, start, end time.Time, policyDomain string) (domainSummaries []TLSRPTSummary) {
+	xdomainAccess(ctx, policyDomain)
 	var polDom dns.Domain
 	if policyDomain != "" {
 		var err error
@@ -1696,6 +2103,7 @@ func (Admin) TLSRPTSummaries(ctx context.Context, start, end time.Time, policyDo
 // given domain (or all domains if empty). The reports are sorted first by period
 // end (most recent first), then by domain.
 func (Admin) DMARCReports(ctx context.Context, start, end time.Time, domain string) (reports []dmarcdb.DomainFeedback) {
+	xdomainAccess(ctx, domain)
 	reports, err := dmarcdb.RecordsPeriodDomain(ctx, start, end, domain)
 	xcheckf(ctx, err, "fetching dmarc aggregate reports from database")
 	sort.Slice(reports, func(i, j int) bool {
@@ -1711,6 +2119,7 @@ func (Admin) DMARCReports(ctx context.Context, start, end time.Time, domain stri
 
 // DMARCReportID returns a single DMARC report.
 func (Admin) DMARCReportID(ctx context.Context, domain string, reportID int64) (report dmarcdb.DomainFeedback) {
+	xdomainAccess(ctx, domain)
 	report, err := dmarcdb.RecordID(ctx, reportID)
 	if err == nil && report.Domain != domain {
 		err = bstore.ErrAbsent
@@ -1739,6 +2148,7 @@ type DMARCSummary struct {
 // period start/end for one or all domains (when domain is empty).
 // The returned summaries are ordered by domain name.
 func (Admin) DMARCSummaries(ctx context.Context, start, end time.Time, domain string) (domainSummaries []DMARCSummary) {
+	xdomainAccess(ctx, domain)
 	reports, err := dmarcdb.RecordsPeriodDomain(ctx, start, end, domain)
 	xcheckf(ctx, err, "fetching dmarc aggregate reports from database")
 	summaries := map[string]DMARCSummary{}
@@ -1879,6 +2289,7 @@ func (Admin) MonitorDNSBLsSave(ctx context.Context, text string) {
 // DomainRecords returns lines describing DNS records that should exist for the
 // configured domain.
 func (Admin) DomainRecords(ctx context.Context, domain string) []string {
+	xdomainAccess(ctx, domain)
 	log := pkglog.WithContext(ctx)
 	return DomainRecords(ctx, log, domain)
 }
@@ -1938,24 +2349,29 @@ func (Admin) DomainRemove(ctx context.Context, domain string) {
 // AccountAdd adds existing a new account, with an initial email address, and
 // reloads the configuration.
 func (Admin) AccountAdd(ctx context.Context, accountName, address string) {
+	xaddressAccess(ctx, address)
 	err := mox.AccountAdd(ctx, accountName, address)
 	xcheckf(ctx, err, "adding account")
 }
 
 // AccountRemove removes an existing account and reloads the configuration.
 func (Admin) AccountRemove(ctx context.Context, accountName string) {
+	xaccountAccess(ctx, accountName)
 	err := mox.AccountRemove(ctx, accountName)
 	xcheckf(ctx, err, "removing account")
 }
 
 // AddressAdd adds a new address to the account, which must already exist.
 func (Admin) AddressAdd(ctx context.Context, address, accountName string) {
+	xaddressAccess(ctx, address)
+	xaccountAccess(ctx, accountName)
 	err := mox.AddressAdd(ctx, address, accountName)
 	xcheckf(ctx, err, "adding address")
 }
 
 // AddressRemove removes an existing address.
 func (Admin) AddressRemove(ctx context.Context, address string) {
+	xaddressAccess(ctx, address)
 	err := mox.AddressRemove(ctx, address)
 	xcheckf(ctx, err, "removing address")
 }
@@ -1964,6 +2380,7 @@ func (Admin) AddressRemove(ctx context.Context, address string) {
 // Sessions are not interrupted, and will keep working. New login attempts must use the new password.
 // Password must be at least 8 characters.
 func (Admin) SetPassword(ctx context.Context, accountName, password string) {
+	xaccountAccess(ctx, accountName)
 	log := pkglog.WithContext(ctx)
 	if len(password) < 8 {
 		xusererrorf(ctx, "message must be at least 8 characters")
@@ -1976,6 +2393,28 @@ func (Admin) SetPassword(ctx context.Context, accountName, password string) {
 	}()
 	err = acc.SetPassword(log, password)
 	xcheckf(ctx, err, "setting password")
+	admindb.AuditAdd(ctx, log, admindb.AuditPassword, fmt.Sprintf("password set for account %q", accountName))
+}
+
+// AccountTOTPDisable disables two-factor authentication for logins to the web
+// interfaces of an account, e.g. after a user lost their authenticator app and
+// recovery codes.
+func (Admin) AccountTOTPDisable(ctx context.Context, accountName string) {
+	xaccountAccess(ctx, accountName)
+	log := pkglog.WithContext(ctx)
+	acc, err := store.OpenAccount(log, accountName)
+	xcheckf(ctx, err, "open account")
+	defer func() {
+		err := acc.Close()
+		log.WithContext(ctx).Check(err, "closing account")
+	}()
+	err = acc.DB.Write(ctx, func(tx *bstore.Tx) error {
+		return store.TOTPDisable(tx)
+	})
+	if errors.Is(err, store.ErrTOTPUnknown) {
+		xcheckuserf(ctx, err, "disabling two-factor authentication")
+	}
+	xcheckf(ctx, err, "disabling two-factor authentication")
 }
 
 // AccountSettingsSave set new settings for an account that only an admin can set.
@@ -1992,6 +2431,7 @@ func (Admin) AccountSettingsSave(ctx context.Context, accountName string, maxOut
 // ClientConfigsDomain returns configurations for email clients, IMAP and
 // Submission (SMTP) for the domain.
 func (Admin) ClientConfigsDomain(ctx context.Context, domain string) mox.ClientConfigs {
+	xdomainAccess(ctx, domain)
 	d, err := dns.ParseDomain(domain)
 	xcheckuserf(ctx, err, "parsing domain")
 
@@ -2044,6 +2484,12 @@ func (Admin) QueueList(ctx context.Context, filter queue.Filter, sort queue.Sort
 	return l
 }
 
+// QueueRateLimits returns the configured outgoing rate limits with their current
+// usage.
+func (Admin) QueueRateLimits(ctx context.Context) []queue.RateLimitState {
+	return queue.RateLimitStates(pkglog.WithContext(ctx))
+}
+
 // QueueNextAttemptSet sets a new time for next delivery attempt of matching
 // messages from the queue.
 func (Admin) QueueNextAttemptSet(ctx context.Context, filter queue.Filter, minutes int) (affected int) {
@@ -2451,6 +2897,7 @@ func (Admin) RoutesSave(ctx context.Context, routes []config.Route) {
 
 // DomainDescriptionSave saves the description for a domain.
 func (Admin) DomainDescriptionSave(ctx context.Context, domainName, descr string) {
+	xdomainAccess(ctx, domainName)
 	err := mox.DomainSave(ctx, domainName, func(domain *config.Domain) error {
 		domain.Description = descr
 		return nil
@@ -2460,6 +2907,7 @@ func (Admin) DomainDescriptionSave(ctx context.Context, domainName, descr string
 
 // DomainClientSettingsDomainSave saves the client settings domain for a domain.
 func (Admin) DomainClientSettingsDomainSave(ctx context.Context, domainName, clientSettingsDomain string) {
+	xdomainAccess(ctx, domainName)
 	err := mox.DomainSave(ctx, domainName, func(domain *config.Domain) error {
 		domain.ClientSettingsDomain = clientSettingsDomain
 		return nil
@@ -2470,6 +2918,7 @@ func (Admin) DomainClientSettingsDomainSave(ctx context.Context, domainName, cli
 // DomainLocalpartConfigSave saves the localpart catchall and case-sensitive
 // settings for a domain.
 func (Admin) DomainLocalpartConfigSave(ctx context.Context, domainName, localpartCatchallSeparator string, localpartCaseSensitive bool) {
+	xdomainAccess(ctx, domainName)
 	err := mox.DomainSave(ctx, domainName, func(domain *config.Domain) error {
 		domain.LocalpartCatchallSeparator = localpartCatchallSeparator
 		domain.LocalpartCaseSensitive = localpartCaseSensitive
@@ -2482,6 +2931,10 @@ func (Admin) DomainLocalpartConfigSave(ctx context.Context, domainName, localpar
 // configuration for a domain. If localpart is empty, processing reports is
 // disabled.
 func (Admin) DomainDMARCAddressSave(ctx context.Context, domainName, localpart, domain, account, mailbox string) {
+	xdomainAccess(ctx, domainName)
+	if account != "" {
+		xaccountAccess(ctx, account)
+	}
 	err := mox.DomainSave(ctx, domainName, func(d *config.Domain) error {
 		if localpart == "" {
 			d.DMARC = nil
@@ -2502,6 +2955,10 @@ func (Admin) DomainDMARCAddressSave(ctx context.Context, domainName, localpart,
 // configuration for a domain. If localpart is empty, processing reports is
 // disabled.
 func (Admin) DomainTLSRPTAddressSave(ctx context.Context, domainName, localpart, domain, account, mailbox string) {
+	xdomainAccess(ctx, domainName)
+	if account != "" {
+		xaccountAccess(ctx, account)
+	}
 	err := mox.DomainSave(ctx, domainName, func(d *config.Domain) error {
 		if localpart == "" {
 			d.TLSRPT = nil
@@ -2521,6 +2978,7 @@ func (Admin) DomainTLSRPTAddressSave(ctx context.Context, domainName, localpart,
 // DomainMTASTSSave saves the MTASTS policy for a domain. If policyID is empty,
 // no MTASTS policy is served.
 func (Admin) DomainMTASTSSave(ctx context.Context, domainName, policyID string, mode mtasts.Mode, maxAge time.Duration, mx []string) {
+	xdomainAccess(ctx, domainName)
 	err := mox.DomainSave(ctx, domainName, func(d *config.Domain) error {
 		if policyID == "" {
 			d.MTASTS = nil
@@ -2540,6 +2998,7 @@ func (Admin) DomainMTASTSSave(ctx context.Context, domainName, policyID string,
 // DomainDKIMAdd adds a DKIM selector for a domain, generating a new private
 // key. The selector is not enabled for signing.
 func (Admin) DomainDKIMAdd(ctx context.Context, domainName, selector, algorithm, hash string, headerRelaxed, bodyRelaxed, seal bool, headers []string, lifetime time.Duration) {
+	xdomainAccess(ctx, domainName)
 	d, err := dns.ParseDomain(domainName)
 	xcheckuserf(ctx, err, "parsing domain")
 	s, err := dns.ParseDomain(selector)
@@ -2550,6 +3009,7 @@ func (Admin) DomainDKIMAdd(ctx context.Context, domainName, selector, algorithm,
 
 // DomainDKIMRemove removes a DKIM selector for a domain.
 func (Admin) DomainDKIMRemove(ctx context.Context, domainName, selector string) {
+	xdomainAccess(ctx, domainName)
 	d, err := dns.ParseDomain(domainName)
 	xcheckuserf(ctx, err, "parsing domain")
 	s, err := dns.ParseDomain(selector)
@@ -2562,6 +3022,7 @@ func (Admin) DomainDKIMRemove(ctx context.Context, domainName, selector string)
 // signing, for a domain. All currently configured selectors must be present,
 // selectors cannot be added/removed with this function.
 func (Admin) DomainDKIMSave(ctx context.Context, domainName string, selectors map[string]config.Selector, sign []string) {
+	xdomainAccess(ctx, domainName)
 	for _, s := range sign {
 		if _, ok := selectors[s]; !ok {
 			xcheckuserf(ctx, fmt.Errorf("cannot sign unknown selector %q", s), "checking selectors")
@@ -2616,12 +3077,14 @@ func xparseAddress(ctx context.Context, lp, domain string) smtp.Address {
 }
 
 func (Admin) AliasAdd(ctx context.Context, aliaslp string, domainName string, alias config.Alias) {
+	xdomainAccess(ctx, domainName)
 	addr := xparseAddress(ctx, aliaslp, domainName)
 	err := mox.AliasAdd(ctx, addr, alias)
 	xcheckf(ctx, err, "adding alias")
 }
 
 func (Admin) AliasUpdate(ctx context.Context, aliaslp string, domainName string, postPublic, listMembers, allowMsgFrom bool) {
+	xdomainAccess(ctx, domainName)
 	addr := xparseAddress(ctx, aliaslp, domainName)
 	alias := config.Alias{
 		PostPublic:   postPublic,
@@ -2633,18 +3096,21 @@ func (Admin) AliasUpdate(ctx context.Context, aliaslp string, domainName string,
 }
 
 func (Admin) AliasRemove(ctx context.Context, aliaslp string, domainName string) {
+	xdomainAccess(ctx, domainName)
 	addr := xparseAddress(ctx, aliaslp, domainName)
 	err := mox.AliasRemove(ctx, addr)
 	xcheckf(ctx, err, "removing alias")
 }
 
 func (Admin) AliasAddressesAdd(ctx context.Context, aliaslp string, domainName string, addresses []string) {
+	xdomainAccess(ctx, domainName)
 	addr := xparseAddress(ctx, aliaslp, domainName)
 	err := mox.AliasAddressesAdd(ctx, addr, addresses)
 	xcheckf(ctx, err, "adding address to alias")
 }
 
 func (Admin) AliasAddressesRemove(ctx context.Context, aliaslp string, domainName string, addresses []string) {
+	xdomainAccess(ctx, domainName)
 	addr := xparseAddress(ctx, aliaslp, domainName)
 	err := mox.AliasAddressesRemove(ctx, addr, addresses)
 	xcheckf(ctx, err, "removing address from alias")
@@ -229,6 +229,36 @@ const [dom, style, attr, prop] = (function () {
 // NOTE: GENERATED by github.com/mjl-/sherpats, DO NOT MODIFY
 var api;
 (function (api) {
+	// Role determines which operations an admin user is allowed to do.
+	let Role;
+	(function (Role) {
+		Role["RoleAdmin"] = "admin";
+		Role["RoleReadOnly"] = "readonly";
+		// Like readonly, and managing the queues: hold, reschedule, fail and drop
+		// messages and webhooks, and managing hold rules.
+		Role["RoleQueue"] = "queue";
+		// Viewing and changing the domains listed in the Domains field of the user,
+		// and the accounts (based on their default domain), addresses and aliases of
+		// those domains. No access to other configuration.
+		Role["RoleDomain"] = "domain";
+	})(Role = api.Role || (api.Role = {}));
+	// AuditSource is the interface through which a change was made.
+	let AuditSource;
+	(function (AuditSource) {
+		AuditSource["AuditSourceNone"] = "";
+		AuditSource["AuditSourceCtl"] = "ctl";
+		AuditSource["AuditSourceWebadmin"] = "webadmin";
+		AuditSource["AuditSourceWebaccount"] = "webaccount";
+	})(AuditSource = api.AuditSource || (api.AuditSource = {}));
+	// AuditKind is the type of change recorded in the audit log.
+	let AuditKind;
+	(function (AuditKind) {
+		AuditKind["AuditKindAny"] = "";
+		AuditKind["AuditConfig"] = "config";
+		AuditKind["AuditQueue"] = "queue";
+		AuditKind["AuditPassword"] = "password";
+		AuditKind["AuditAdminUser"] = "adminuser";
+	})(AuditKind = api.AuditKind || (api.AuditKind = {}));
 	// Policy as used in DMARC DNS record for "p=" or "sp=".
 	let DMARCPolicy;
 	(function (DMARCPolicy) {
@@ -250,10 +280,14 @@ var api;
 		Mode["ModeTesting"] = "testing";
 		Mode["ModeNone"] = "none";
 	})(Mode = api.Mode || (api.Mode = {}));
-	api.structTypes = { "Account": true, "Address": true, "AddressAlias": true, "Alias": true, "AliasAddress": true, "AuthResults": true, "AutoconfCheckResult": true, "AutodiscoverCheckResult": true, "AutodiscoverSRV": true, "AutomaticJunkFlags": true, "Canonicalization": true, "CheckResult": true, "ClientConfigs": true, "ClientConfigsEntry": true, "ConfigDomain": true, "DANECheckResult": true, "DKIM": true, "DKIMAuthResult": true, "DKIMCheckResult": true, "DKIMRecord": true, "DMARC": true, "DMARCCheckResult": true, "DMARCRecord": true, "DMARCSummary": true, "DNSSECResult": true, "DateRange": true, "Destination": true, "Directive": true, "Domain": true, "DomainFeedback": true, "Dynamic": true, "Evaluation": true, "EvaluationStat": true, "Extension": true, "FailureDetails": true, "Filter": true, "HoldRule": true, "Hook": true, "HookFilter": true, "HookResult": true, "HookRetired": true, "HookRetiredFilter": true, "HookRetiredSort": true, "HookSort": true, "IPDomain": true, "IPRevCheckResult": true, "Identifiers": true, "IncomingWebhook": true, "JunkFilter": true, "MTASTS": true, "MTASTSCheckResult": true, "MTASTSRecord": true, "MX": true, "MXCheckResult": true, "Modifier": true, "Msg": true, "MsgResult": true, "MsgRetired": true, "OutgoingWebhook": true, "Pair": true, "Policy": true, "PolicyEvaluated": true, "PolicyOverrideReason": true, "PolicyPublished": true, "PolicyRecord": true, "Record": true, "Report": true, "ReportMetadata": true, "ReportRecord": true, "Result": true, "ResultPolicy": true, "RetiredFilter": true, "RetiredSort": true, "Reverse": true, "Route": true, "Row": true, "Ruleset": true, "SMTPAuth": true, "SPFAuthResult": true, "SPFCheckResult": true, "SPFRecord": true, "SRV": true, "SRVConfCheckResult": true, "STSMX": true, "Selector": true, "Sort": true, "SubjectPass": true, "Summary": true, "SuppressAddress": true, "TLSCheckResult": true, "TLSRPT": true, "TLSRPTCheckResult": true, "TLSRPTDateRange": true, "TLSRPTRecord": true, "TLSRPTSummary": true, "TLSRPTSuppressAddress": true, "TLSReportRecord": true, "TLSResult": true, "Transport": true, "TransportDirect": true, "TransportSMTP": true, "TransportSocks": true, "URI": true, "WebForward": true, "WebHandler": true, "WebInternal": true, "WebRedirect": true, "WebStatic": true, "WebserverConfig": true };
-	api.stringsTypes = { "Align": true, "CSRFToken": true, "DMARCPolicy": true, "IP": true, "Localpart": true, "Mode": true, "RUA": true };
+	api.structTypes = { "Account": true, "Address": true, "AddressAlias": true, "Alias": true, "AliasAddress": true, "AuditEntry": true, "AuditFilter": true, "AuthResults": true, "AutoconfCheckResult": true, "AutodiscoverCheckResult": true, "AutodiscoverSRV": true, "AutomaticJunkFlags": true, "Canonicalization": true, "CheckResult": true, "ClientConfigs": true, "ClientConfigsEntry": true, "ConfigDomain": true, "DANECheckResult": true, "DKIM": true, "DKIMAuthResult": true, "DKIMCheckResult": true, "DKIMRecord": true, "DMARC": true, "DMARCCheckResult": true, "DMARCRecord": true, "DMARCSummary": true, "DNSSECResult": true, "DateRange": true, "Destination": true, "Directive": true, "Domain": true, "DomainFeedback": true, "Dynamic": true, "Evaluation": true, "EvaluationStat": true, "Extension": true, "FailureDetails": true, "Filter": true, "HoldRule": true, "Hook": true, "HookFilter": true, "HookResult": true, "HookRetired": true, "HookRetiredFilter": true, "HookRetiredSort": true, "HookSort": true, "IPDomain": true, "IPPool": true, "IPRevCheckResult": true, "Identifiers": true, "IncomingWebhook": true, "JunkFilter": true, "MTASTS": true, "MTASTSCheckResult": true, "MTASTSRecord": true, "MX": true, "MXCheckResult": true, "Modifier": true, "Msg": true, "MsgResult": true, "MsgRetired": true, "OutgoingWebhook": true, "Pair": true, "Policy": true, "PolicyEvaluated": true, "PolicyOverrideReason": true, "PolicyPublished": true, "PolicyRecord": true, "PoolIP": true, "RateLimitState": true, "Record": true, "Report": true, "ReportMetadata": true, "ReportRecord": true, "Result": true, "ResultPolicy": true, "RetiredFilter": true, "RetiredSort": true, "Reverse": true, "Route": true, "Row": true, "Ruleset": true, "SMTPAuth": true, "SPFAuthResult": true, "SPFCheckResult": true, "SPFRecord": true, "SRV": true, "SRVConfCheckResult": true, "STSMX": true, "Selector": true, "Sort": true, "SubjectPass": true, "Summary": true, "SuppressAddress": true, "TLSCheckResult": true, "TLSRPT": true, "TLSRPTCheckResult": true, "TLSRPTDateRange": true, "TLSRPTRecord": true, "TLSRPTSummary": true, "TLSRPTSuppressAddress": true, "TLSReportRecord": true, "TLSResult": true, "TOTPSetup": true, "Transport": true, "TransportDirect": true, "TransportSMTP": true, "TransportSocks": true, "URI": true, "User": true, "WebForward": true, "WebHandler": true, "WebInternal": true, "WebRedirect": true, "WebStatic": true, "WebserverConfig": true };
+	api.stringsTypes = { "Align": true, "AuditKind": true, "AuditSource": true, "CSRFToken": true, "DMARCPolicy": true, "IP": true, "Localpart": true, "Mode": true, "RUA": true, "Role": true };
 	api.intsTypes = {};
 	api.types = {
+		"TOTPSetup": { "Name": "TOTPSetup", "Docs": "", "Fields": [{ "Name": "URI", "Docs": "", "Typewords": ["string"] }, { "Name": "Secret", "Docs": "", "Typewords": ["string"] }, { "Name": "QRCodePNG", "Docs": "", "Typewords": ["string"] }] },
+		"User": { "Name": "User", "Docs": "", "Fields": [{ "Name": "Name", "Docs": "", "Typewords": ["string"] }, { "Name": "Created", "Docs": "", "Typewords": ["timestamp"] }, { "Name": "Role", "Docs": "", "Typewords": ["Role"] }, { "Name": "Domains", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "UnixUser", "Docs": "", "Typewords": ["string"] }] },
+		"AuditFilter": { "Name": "AuditFilter", "Docs": "", "Fields": [{ "Name": "Max", "Docs": "", "Typewords": ["int32"] }, { "Name": "Source", "Docs": "", "Typewords": ["AuditSource"] }, { "Name": "Actor", "Docs": "", "Typewords": ["string"] }, { "Name": "Kind", "Docs": "", "Typewords": ["AuditKind"] }, { "Name": "Operation", "Docs": "", "Typewords": ["string"] }, { "Name": "Start", "Docs": "", "Typewords": ["nullable", "timestamp"] }, { "Name": "End", "Docs": "", "Typewords": ["nullable", "timestamp"] }, { "Name": "Text", "Docs": "", "Typewords": ["string"] }] },
+		"AuditEntry": { "Name": "AuditEntry", "Docs": "", "Fields": [{ "Name": "ID", "Docs": "", "Typewords": ["int64"] }, { "Name": "Time", "Docs": "", "Typewords": ["timestamp"] }, { "Name": "Source", "Docs": "", "Typewords": ["AuditSource"] }, { "Name": "Actor", "Docs": "", "Typewords": ["string"] }, { "Name": "RemoteIP", "Docs": "", "Typewords": ["string"] }, { "Name": "Operation", "Docs": "", "Typewords": ["string"] }, { "Name": "Kind", "Docs": "", "Typewords": ["AuditKind"] }, { "Name": "Details", "Docs": "", "Typewords": ["string"] }, { "Name": "Diff", "Docs": "", "Typewords": ["string"] }] },
 		"CheckResult": { "Name": "CheckResult", "Docs": "", "Fields": [{ "Name": "Domain", "Docs": "", "Typewords": ["string"] }, { "Name": "DNSSEC", "Docs": "", "Typewords": ["DNSSECResult"] }, { "Name": "IPRev", "Docs": "", "Typewords": ["IPRevCheckResult"] }, { "Name": "MX", "Docs": "", "Typewords": ["MXCheckResult"] }, { "Name": "TLS", "Docs": "", "Typewords": ["TLSCheckResult"] }, { "Name": "DANE", "Docs": "", "Typewords": ["DANECheckResult"] }, { "Name": "SPF", "Docs": "", "Typewords": ["SPFCheckResult"] }, { "Name": "DKIM", "Docs": "", "Typewords": ["DKIMCheckResult"] }, { "Name": "DMARC", "Docs": "", "Typewords": ["DMARCCheckResult"] }, { "Name": "HostTLSRPT", "Docs": "", "Typewords": ["TLSRPTCheckResult"] }, { "Name": "DomainTLSRPT", "Docs": "", "Typewords": ["TLSRPTCheckResult"] }, { "Name": "MTASTS", "Docs": "", "Typewords": ["MTASTSCheckResult"] }, { "Name": "SRVConf", "Docs": "", "Typewords": ["SRVConfCheckResult"] }, { "Name": "Autoconf", "Docs": "", "Typewords": ["AutoconfCheckResult"] }, { "Name": "Autodiscover", "Docs": "", "Typewords": ["AutodiscoverCheckResult"] }] },
 		"DNSSECResult": { "Name": "DNSSECResult", "Docs": "", "Fields": [{ "Name": "Errors", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "Warnings", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "Instructions", "Docs": "", "Typewords": ["[]", "string"] }] },
 		"IPRevCheckResult": { "Name": "IPRevCheckResult", "Docs": "", "Fields": [{ "Name": "Hostname", "Docs": "", "Typewords": ["Domain"] }, { "Name": "IPNames", "Docs": "", "Typewords": ["{}", "[]", "string"] }, { "Name": "Errors", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "Warnings", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "Instructions", "Docs": "", "Typewords": ["[]", "string"] }] },
@@ -292,13 +326,13 @@ var api;
 		"DMARC": { "Name": "DMARC", "Docs": "", "Fields": [{ "Name": "Localpart", "Docs": "", "Typewords": ["string"] }, { "Name": "Domain", "Docs": "", "Typewords": ["string"] }, { "Name": "Account", "Docs": "", "Typewords": ["string"] }, { "Name": "Mailbox", "Docs": "", "Typewords": ["string"] }, { "Name": "ParsedLocalpart", "Docs": "", "Typewords": ["Localpart"] }, { "Name": "DNSDomain", "Docs": "", "Typewords": ["Domain"] }] },
 		"MTASTS": { "Name": "MTASTS", "Docs": "", "Fields": [{ "Name": "PolicyID", "Docs": "", "Typewords": ["string"] }, { "Name": "Mode", "Docs": "", "Typewords": ["Mode"] }, { "Name": "MaxAge", "Docs": "", "Typewords": ["int64"] }, { "Name": "MX", "Docs": "", "Typewords": ["[]", "string"] }] },
 		"TLSRPT": { "Name": "TLSRPT", "Docs": "", "Fields": [{ "Name": "Localpart", "Docs": "", "Typewords": ["string"] }, { "Name": "Domain", "Docs": "", "Typewords": ["string"] }, { "Name": "Account", "Docs": "", "Typewords": ["string"] }, { "Name": "Mailbox", "Docs": "", "Typewords": ["string"] }, { "Name": "ParsedLocalpart", "Docs": "", "Typewords": ["Localpart"] }, { "Name": "DNSDomain", "Docs": "", "Typewords": ["Domain"] }] },
-		"Route": { "Name": "Route", "Docs": "", "Fields": [{ "Name": "FromDomain", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "ToDomain", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "MinimumAttempts", "Docs": "", "Typewords": ["int32"] }, { "Name": "Transport", "Docs": "", "Typewords": ["string"] }, { "Name": "FromDomainASCII", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "ToDomainASCII", "Docs": "", "Typewords": ["[]", "string"] }] },
-		"Alias": { "Name": "Alias", "Docs": "", "Fields": [{ "Name": "Addresses", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "PostPublic", "Docs": "", "Typewords": ["bool"] }, { "Name": "ListMembers", "Docs": "", "Typewords": ["bool"] }, { "Name": "AllowMsgFrom", "Docs": "", "Typewords": ["bool"] }, { "Name": "LocalpartStr", "Docs": "", "Typewords": ["string"] }, { "Name": "Domain", "Docs": "", "Typewords": ["Domain"] }, { "Name": "ParsedAddresses", "Docs": "", "Typewords": ["[]", "AliasAddress"] }] },
+		"Route": { "Name": "Route", "Docs": "", "Fields": [{ "Name": "FromDomain", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "ToDomain", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "MinimumAttempts", "Docs": "", "Typewords": ["int32"] }, { "Name": "Transport", "Docs": "", "Typewords": ["string"] }, { "Name": "IPPool", "Docs": "", "Typewords": ["string"] }, { "Name": "FromDomainASCII", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "ToDomainASCII", "Docs": "", "Typewords": ["[]", "string"] }] },
+		"Alias": { "Name": "Alias", "Docs": "", "Fields": [{ "Name": "Addresses", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "PostPublic", "Docs": "", "Typewords": ["bool"] }, { "Name": "ListMembers", "Docs": "", "Typewords": ["bool"] }, { "Name": "AllowMsgFrom", "Docs": "", "Typewords": ["bool"] }, { "Name": "ListOwner", "Docs": "", "Typewords": ["string"] }, { "Name": "Subscribe", "Docs": "", "Typewords": ["bool"] }, { "Name": "Moderate", "Docs": "", "Typewords": ["bool"] }, { "Name": "DigestInterval", "Docs": "", "Typewords": ["int64"] }, { "Name": "LocalpartStr", "Docs": "", "Typewords": ["string"] }, { "Name": "Domain", "Docs": "", "Typewords": ["Domain"] }, { "Name": "ParsedAddresses", "Docs": "", "Typewords": ["[]", "AliasAddress"] }, { "Name": "ParsedListOwner", "Docs": "", "Typewords": ["AliasAddress"] }] },
 		"AliasAddress": { "Name": "AliasAddress", "Docs": "", "Fields": [{ "Name": "Address", "Docs": "", "Typewords": ["Address"] }, { "Name": "AccountName", "Docs": "", "Typewords": ["string"] }, { "Name": "Destination", "Docs": "", "Typewords": ["Destination"] }] },
 		"Address": { "Name": "Address", "Docs": "", "Fields": [{ "Name": "Localpart", "Docs": "", "Typewords": ["Localpart"] }, { "Name": "Domain", "Docs": "", "Typewords": ["Domain"] }] },
 		"Destination": { "Name": "Destination", "Docs": "", "Fields": [{ "Name": "Mailbox", "Docs": "", "Typewords": ["string"] }, { "Name": "Rulesets", "Docs": "", "Typewords": ["[]", "Ruleset"] }, { "Name": "FullName", "Docs": "", "Typewords": ["string"] }] },
 		"Ruleset": { "Name": "Ruleset", "Docs": "", "Fields": [{ "Name": "SMTPMailFromRegexp", "Docs": "", "Typewords": ["string"] }, { "Name": "MsgFromRegexp", "Docs": "", "Typewords": ["string"] }, { "Name": "VerifiedDomain", "Docs": "", "Typewords": ["string"] }, { "Name": "HeadersRegexp", "Docs": "", "Typewords": ["{}", "string"] }, { "Name": "IsForward", "Docs": "", "Typewords": ["bool"] }, { "Name": "ListAllowDomain", "Docs": "", "Typewords": ["string"] }, { "Name": "AcceptRejectsToMailbox", "Docs": "", "Typewords": ["string"] }, { "Name": "Mailbox", "Docs": "", "Typewords": ["string"] }, { "Name": "Comment", "Docs": "", "Typewords": ["string"] }, { "Name": "VerifiedDNSDomain", "Docs": "", "Typewords": ["Domain"] }, { "Name": "ListAllowDNSDomain", "Docs": "", "Typewords": ["Domain"] }] },
-		"Account": { "Name": "Account", "Docs": "", "Fields": [{ "Name": "OutgoingWebhook", "Docs": "", "Typewords": ["nullable", "OutgoingWebhook"] }, { "Name": "IncomingWebhook", "Docs": "", "Typewords": ["nullable", "IncomingWebhook"] }, { "Name": "FromIDLoginAddresses", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "KeepRetiredMessagePeriod", "Docs": "", "Typewords": ["int64"] }, { "Name": "KeepRetiredWebhookPeriod", "Docs": "", "Typewords": ["int64"] }, { "Name": "Domain", "Docs": "", "Typewords": ["string"] }, { "Name": "Description", "Docs": "", "Typewords": ["string"] }, { "Name": "FullName", "Docs": "", "Typewords": ["string"] }, { "Name": "Destinations", "Docs": "", "Typewords": ["{}", "Destination"] }, { "Name": "SubjectPass", "Docs": "", "Typewords": ["SubjectPass"] }, { "Name": "QuotaMessageSize", "Docs": "", "Typewords": ["int64"] }, { "Name": "RejectsMailbox", "Docs": "", "Typewords": ["string"] }, { "Name": "KeepRejects", "Docs": "", "Typewords": ["bool"] }, { "Name": "AutomaticJunkFlags", "Docs": "", "Typewords": ["AutomaticJunkFlags"] }, { "Name": "JunkFilter", "Docs": "", "Typewords": ["nullable", "JunkFilter"] }, { "Name": "MaxOutgoingMessagesPerDay", "Docs": "", "Typewords": ["int32"] }, { "Name": "MaxFirstTimeRecipientsPerDay", "Docs": "", "Typewords": ["int32"] }, { "Name": "NoFirstTimeSenderDelay", "Docs": "", "Typewords": ["bool"] }, { "Name": "Routes", "Docs": "", "Typewords": ["[]", "Route"] }, { "Name": "DNSDomain", "Docs": "", "Typewords": ["Domain"] }, { "Name": "Aliases", "Docs": "", "Typewords": ["[]", "AddressAlias"] }] },
+		"Account": { "Name": "Account", "Docs": "", "Fields": [{ "Name": "OutgoingWebhook", "Docs": "", "Typewords": ["nullable", "OutgoingWebhook"] }, { "Name": "IncomingWebhook", "Docs": "", "Typewords": ["nullable", "IncomingWebhook"] }, { "Name": "FromIDLoginAddresses", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "KeepRetiredMessagePeriod", "Docs": "", "Typewords": ["int64"] }, { "Name": "KeepRetiredWebhookPeriod", "Docs": "", "Typewords": ["int64"] }, { "Name": "Domain", "Docs": "", "Typewords": ["string"] }, { "Name": "Description", "Docs": "", "Typewords": ["string"] }, { "Name": "FullName", "Docs": "", "Typewords": ["string"] }, { "Name": "Destinations", "Docs": "", "Typewords": ["{}", "Destination"] }, { "Name": "SubjectPass", "Docs": "", "Typewords": ["SubjectPass"] }, { "Name": "QuotaMessageSize", "Docs": "", "Typewords": ["int64"] }, { "Name": "RejectsMailbox", "Docs": "", "Typewords": ["string"] }, { "Name": "KeepRejects", "Docs": "", "Typewords": ["bool"] }, { "Name": "AutomaticJunkFlags", "Docs": "", "Typewords": ["AutomaticJunkFlags"] }, { "Name": "JunkFilter", "Docs": "", "Typewords": ["nullable", "JunkFilter"] }, { "Name": "MaxOutgoingMessagesPerDay", "Docs": "", "Typewords": ["int32"] }, { "Name": "MaxFirstTimeRecipientsPerDay", "Docs": "", "Typewords": ["int32"] }, { "Name": "NoFirstTimeSenderDelay", "Docs": "", "Typewords": ["bool"] }, { "Name": "Routes", "Docs": "", "Typewords": ["[]", "Route"] }, { "Name": "EncryptMessages", "Docs": "", "Typewords": ["bool"] }, { "Name": "DNSDomain", "Docs": "", "Typewords": ["Domain"] }, { "Name": "Aliases", "Docs": "", "Typewords": ["[]", "AddressAlias"] }] },
 		"OutgoingWebhook": { "Name": "OutgoingWebhook", "Docs": "", "Fields": [{ "Name": "URL", "Docs": "", "Typewords": ["string"] }, { "Name": "Authorization", "Docs": "", "Typewords": ["string"] }, { "Name": "Events", "Docs": "", "Typewords": ["[]", "string"] }] },
 		"IncomingWebhook": { "Name": "IncomingWebhook", "Docs": "", "Fields": [{ "Name": "URL", "Docs": "", "Typewords": ["string"] }, { "Name": "Authorization", "Docs": "", "Typewords": ["string"] }] },
 		"SubjectPass": { "Name": "SubjectPass", "Docs": "", "Fields": [{ "Name": "Period", "Docs": "", "Typewords": ["int64"] }] },
@@ -333,12 +367,13 @@ var api;
 		"HoldRule": { "Name": "HoldRule", "Docs": "", "Fields": [{ "Name": "ID", "Docs": "", "Typewords": ["int64"] }, { "Name": "Account", "Docs": "", "Typewords": ["string"] }, { "Name": "SenderDomain", "Docs": "", "Typewords": ["Domain"] }, { "Name": "RecipientDomain", "Docs": "", "Typewords": ["Domain"] }, { "Name": "SenderDomainStr", "Docs": "", "Typewords": ["string"] }, { "Name": "RecipientDomainStr", "Docs": "", "Typewords": ["string"] }] },
 		"Filter": { "Name": "Filter", "Docs": "", "Fields": [{ "Name": "Max", "Docs": "", "Typewords": ["int32"] }, { "Name": "IDs", "Docs": "", "Typewords": ["[]", "int64"] }, { "Name": "Account", "Docs": "", "Typewords": ["string"] }, { "Name": "From", "Docs": "", "Typewords": ["string"] }, { "Name": "To", "Docs": "", "Typewords": ["string"] }, { "Name": "Hold", "Docs": "", "Typewords": ["nullable", "bool"] }, { "Name": "Submitted", "Docs": "", "Typewords": ["string"] }, { "Name": "NextAttempt", "Docs": "", "Typewords": ["string"] }, { "Name": "Transport", "Docs": "", "Typewords": ["nullable", "string"] }] },
 		"Sort": { "Name": "Sort", "Docs": "", "Fields": [{ "Name": "Field", "Docs": "", "Typewords": ["string"] }, { "Name": "LastID", "Docs": "", "Typewords": ["int64"] }, { "Name": "Last", "Docs": "", "Typewords": ["any"] }, { "Name": "Asc", "Docs": "", "Typewords": ["bool"] }] },
-		"Msg": { "Name": "Msg", "Docs": "", "Fields": [{ "Name": "ID", "Docs": "", "Typewords": ["int64"] }, { "Name": "BaseID", "Docs": "", "Typewords": ["int64"] }, { "Name": "Queued", "Docs": "", "Typewords": ["timestamp"] }, { "Name": "Hold", "Docs": "", "Typewords": ["bool"] }, { "Name": "SenderAccount", "Docs": "", "Typewords": ["string"] }, { "Name": "SenderLocalpart", "Docs": "", "Typewords": ["Localpart"] }, { "Name": "SenderDomain", "Docs": "", "Typewords": ["IPDomain"] }, { "Name": "SenderDomainStr", "Docs": "", "Typewords": ["string"] }, { "Name": "FromID", "Docs": "", "Typewords": ["string"] }, { "Name": "RecipientLocalpart", "Docs": "", "Typewords": ["Localpart"] }, { "Name": "RecipientDomain", "Docs": "", "Typewords": ["IPDomain"] }, { "Name": "RecipientDomainStr", "Docs": "", "Typewords": ["string"] }, { "Name": "Attempts", "Docs": "", "Typewords": ["int32"] }, { "Name": "MaxAttempts", "Docs": "", "Typewords": ["int32"] }, { "Name": "DialedIPs", "Docs": "", "Typewords": ["{}", "[]", "IP"] }, { "Name": "NextAttempt", "Docs": "", "Typewords": ["timestamp"] }, { "Name": "LastAttempt", "Docs": "", "Typewords": ["nullable", "timestamp"] }, { "Name": "Results", "Docs": "", "Typewords": ["[]", "MsgResult"] }, { "Name": "Has8bit", "Docs": "", "Typewords": ["bool"] }, { "Name": "SMTPUTF8", "Docs": "", "Typewords": ["bool"] }, { "Name": "IsDMARCReport", "Docs": "", "Typewords": ["bool"] }, { "Name": "IsTLSReport", "Docs": "", "Typewords": ["bool"] }, { "Name": "Size", "Docs": "", "Typewords": ["int64"] }, { "Name": "MessageID", "Docs": "", "Typewords": ["string"] }, { "Name": "MsgPrefix", "Docs": "", "Typewords": ["nullable", "string"] }, { "Name": "Subject", "Docs": "", "Typewords": ["string"] }, { "Name": "DSNUTF8", "Docs": "", "Typewords": ["nullable", "string"] }, { "Name": "Transport", "Docs": "", "Typewords": ["string"] }, { "Name": "RequireTLS", "Docs": "", "Typewords": ["nullable", "bool"] }, { "Name": "FutureReleaseRequest", "Docs": "", "Typewords": ["string"] }, { "Name": "Extra", "Docs": "", "Typewords": ["{}", "string"] }] },
+		"Msg": { "Name": "Msg", "Docs": "", "Fields": [{ "Name": "ID", "Docs": "", "Typewords": ["int64"] }, { "Name": "BaseID", "Docs": "", "Typewords": ["int64"] }, { "Name": "Queued", "Docs": "", "Typewords": ["timestamp"] }, { "Name": "Hold", "Docs": "", "Typewords": ["bool"] }, { "Name": "SenderAccount", "Docs": "", "Typewords": ["string"] }, { "Name": "SenderLocalpart", "Docs": "", "Typewords": ["Localpart"] }, { "Name": "SenderDomain", "Docs": "", "Typewords": ["IPDomain"] }, { "Name": "SenderDomainStr", "Docs": "", "Typewords": ["string"] }, { "Name": "FromID", "Docs": "", "Typewords": ["string"] }, { "Name": "RecipientLocalpart", "Docs": "", "Typewords": ["Localpart"] }, { "Name": "RecipientDomain", "Docs": "", "Typewords": ["IPDomain"] }, { "Name": "RecipientDomainStr", "Docs": "", "Typewords": ["string"] }, { "Name": "Attempts", "Docs": "", "Typewords": ["int32"] }, { "Name": "MaxAttempts", "Docs": "", "Typewords": ["int32"] }, { "Name": "DialedIPs", "Docs": "", "Typewords": ["{}", "[]", "IP"] }, { "Name": "NextAttempt", "Docs": "", "Typewords": ["timestamp"] }, { "Name": "LastAttempt", "Docs": "", "Typewords": ["nullable", "timestamp"] }, { "Name": "Results", "Docs": "", "Typewords": ["[]", "MsgResult"] }, { "Name": "Has8bit", "Docs": "", "Typewords": ["bool"] }, { "Name": "SMTPUTF8", "Docs": "", "Typewords": ["bool"] }, { "Name": "IsDMARCReport", "Docs": "", "Typewords": ["bool"] }, { "Name": "IsTLSReport", "Docs": "", "Typewords": ["bool"] }, { "Name": "Size", "Docs": "", "Typewords": ["int64"] }, { "Name": "MessageID", "Docs": "", "Typewords": ["string"] }, { "Name": "MsgPrefix", "Docs": "", "Typewords": ["nullable", "string"] }, { "Name": "Subject", "Docs": "", "Typewords": ["string"] }, { "Name": "DSNUTF8", "Docs": "", "Typewords": ["nullable", "string"] }, { "Name": "Transport", "Docs": "", "Typewords": ["string"] }, { "Name": "IPPool", "Docs": "", "Typewords": ["string"] }, { "Name": "RequireTLS", "Docs": "", "Typewords": ["nullable", "bool"] }, { "Name": "FutureReleaseRequest", "Docs": "", "Typewords": ["string"] }, { "Name": "SendAt", "Docs": "", "Typewords": ["timestamp"] }, { "Name": "UndoSend", "Docs": "", "Typewords": ["bool"] }, { "Name": "Extra", "Docs": "", "Typewords": ["{}", "string"] }, { "Name": "RateLimited", "Docs": "", "Typewords": ["string"] }] },
 		"IPDomain": { "Name": "IPDomain", "Docs": "", "Fields": [{ "Name": "IP", "Docs": "", "Typewords": ["IP"] }, { "Name": "Domain", "Docs": "", "Typewords": ["Domain"] }] },
 		"MsgResult": { "Name": "MsgResult", "Docs": "", "Fields": [{ "Name": "Start", "Docs": "", "Typewords": ["timestamp"] }, { "Name": "Duration", "Docs": "", "Typewords": ["int64"] }, { "Name": "Success", "Docs": "", "Typewords": ["bool"] }, { "Name": "Code", "Docs": "", "Typewords": ["int32"] }, { "Name": "Secode", "Docs": "", "Typewords": ["string"] }, { "Name": "Error", "Docs": "", "Typewords": ["string"] }] },
+		"RateLimitState": { "Name": "RateLimitState", "Docs": "", "Fields": [{ "Name": "Name", "Docs": "", "Typewords": ["string"] }, { "Name": "AppliesTo", "Docs": "", "Typewords": ["string"] }, { "Name": "MessagesPerMinute", "Docs": "", "Typewords": ["int32"] }, { "Name": "MessagesLastMinute", "Docs": "", "Typewords": ["int32"] }, { "Name": "MaxConnections", "Docs": "", "Typewords": ["int32"] }, { "Name": "Connections", "Docs": "", "Typewords": ["int32"] }, { "Name": "WarmupLimitToday", "Docs": "", "Typewords": ["int32"] }, { "Name": "MessagesToday", "Docs": "", "Typewords": ["int32"] }, { "Name": "LimitedUntil", "Docs": "", "Typewords": ["nullable", "timestamp"] }] },
 		"RetiredFilter": { "Name": "RetiredFilter", "Docs": "", "Fields": [{ "Name": "Max", "Docs": "", "Typewords": ["int32"] }, { "Name": "IDs", "Docs": "", "Typewords": ["[]", "int64"] }, { "Name": "Account", "Docs": "", "Typewords": ["string"] }, { "Name": "From", "Docs": "", "Typewords": ["string"] }, { "Name": "To", "Docs": "", "Typewords": ["string"] }, { "Name": "Submitted", "Docs": "", "Typewords": ["string"] }, { "Name": "LastActivity", "Docs": "", "Typewords": ["string"] }, { "Name": "Transport", "Docs": "", "Typewords": ["nullable", "string"] }, { "Name": "Success", "Docs": "", "Typewords": ["nullable", "bool"] }] },
 		"RetiredSort": { "Name": "RetiredSort", "Docs": "", "Fields": [{ "Name": "Field", "Docs": "", "Typewords": ["string"] }, { "Name": "LastID", "Docs": "", "Typewords": ["int64"] }, { "Name": "Last", "Docs": "", "Typewords": ["any"] }, { "Name": "Asc", "Docs": "", "Typewords": ["bool"] }] },
-		"MsgRetired": { "Name": "MsgRetired", "Docs": "", "Fields": [{ "Name": "ID", "Docs": "", "Typewords": ["int64"] }, { "Name": "BaseID", "Docs": "", "Typewords": ["int64"] }, { "Name": "Queued", "Docs": "", "Typewords": ["timestamp"] }, { "Name": "SenderAccount", "Docs": "", "Typewords": ["string"] }, { "Name": "SenderLocalpart", "Docs": "", "Typewords": ["Localpart"] }, { "Name": "SenderDomainStr", "Docs": "", "Typewords": ["string"] }, { "Name": "FromID", "Docs": "", "Typewords": ["string"] }, { "Name": "RecipientLocalpart", "Docs": "", "Typewords": ["Localpart"] }, { "Name": "RecipientDomain", "Docs": "", "Typewords": ["IPDomain"] }, { "Name": "RecipientDomainStr", "Docs": "", "Typewords": ["string"] }, { "Name": "Attempts", "Docs": "", "Typewords": ["int32"] }, { "Name": "MaxAttempts", "Docs": "", "Typewords": ["int32"] }, { "Name": "DialedIPs", "Docs": "", "Typewords": ["{}", "[]", "IP"] }, { "Name": "LastAttempt", "Docs": "", "Typewords": ["nullable", "timestamp"] }, { "Name": "Results", "Docs": "", "Typewords": ["[]", "MsgResult"] }, { "Name": "Has8bit", "Docs": "", "Typewords": ["bool"] }, { "Name": "SMTPUTF8", "Docs": "", "Typewords": ["bool"] }, { "Name": "IsDMARCReport", "Docs": "", "Typewords": ["bool"] }, { "Name": "IsTLSReport", "Docs": "", "Typewords": ["bool"] }, { "Name": "Size", "Docs": "", "Typewords": ["int64"] }, { "Name": "MessageID", "Docs": "", "Typewords": ["string"] }, { "Name": "Subject", "Docs": "", "Typewords": ["string"] }, { "Name": "Transport", "Docs": "", "Typewords": ["string"] }, { "Name": "RequireTLS", "Docs": "", "Typewords": ["nullable", "bool"] }, { "Name": "FutureReleaseRequest", "Docs": "", "Typewords": ["string"] }, { "Name": "Extra", "Docs": "", "Typewords": ["{}", "string"] }, { "Name": "LastActivity", "Docs": "", "Typewords": ["timestamp"] }, { "Name": "RecipientAddress", "Docs": "", "Typewords": ["string"] }, { "Name": "Success", "Docs": "", "Typewords": ["bool"] }, { "Name": "KeepUntil", "Docs": "", "Typewords": ["timestamp"] }] },
+		"MsgRetired": { "Name": "MsgRetired", "Docs": "", "Fields": [{ "Name": "ID", "Docs": "", "Typewords": ["int64"] }, { "Name": "BaseID", "Docs": "", "Typewords": ["int64"] }, { "Name": "Queued", "Docs": "", "Typewords": ["timestamp"] }, { "Name": "SenderAccount", "Docs": "", "Typewords": ["string"] }, { "Name": "SenderLocalpart", "Docs": "", "Typewords": ["Localpart"] }, { "Name": "SenderDomainStr", "Docs": "", "Typewords": ["string"] }, { "Name": "FromID", "Docs": "", "Typewords": ["string"] }, { "Name": "RecipientLocalpart", "Docs": "", "Typewords": ["Localpart"] }, { "Name": "RecipientDomain", "Docs": "", "Typewords": ["IPDomain"] }, { "Name": "RecipientDomainStr", "Docs": "", "Typewords": ["string"] }, { "Name": "Attempts", "Docs": "", "Typewords": ["int32"] }, { "Name": "MaxAttempts", "Docs": "", "Typewords": ["int32"] }, { "Name": "DialedIPs", "Docs": "", "Typewords": ["{}", "[]", "IP"] }, { "Name": "LastAttempt", "Docs": "", "Typewords": ["nullable", "timestamp"] }, { "Name": "Results", "Docs": "", "Typewords": ["[]", "MsgResult"] }, { "Name": "Has8bit", "Docs": "", "Typewords": ["bool"] }, { "Name": "SMTPUTF8", "Docs": "", "Typewords": ["bool"] }, { "Name": "IsDMARCReport", "Docs": "", "Typewords": ["bool"] }, { "Name": "IsTLSReport", "Docs": "", "Typewords": ["bool"] }, { "Name": "Size", "Docs": "", "Typewords": ["int64"] }, { "Name": "MessageID", "Docs": "", "Typewords": ["string"] }, { "Name": "Subject", "Docs": "", "Typewords": ["string"] }, { "Name": "Transport", "Docs": "", "Typewords": ["string"] }, { "Name": "IPPool", "Docs": "", "Typewords": ["string"] }, { "Name": "RequireTLS", "Docs": "", "Typewords": ["nullable", "bool"] }, { "Name": "FutureReleaseRequest", "Docs": "", "Typewords": ["string"] }, { "Name": "Extra", "Docs": "", "Typewords": ["{}", "string"] }, { "Name": "LastActivity", "Docs": "", "Typewords": ["timestamp"] }, { "Name": "RecipientAddress", "Docs": "", "Typewords": ["string"] }, { "Name": "Success", "Docs": "", "Typewords": ["bool"] }, { "Name": "KeepUntil", "Docs": "", "Typewords": ["timestamp"] }] },
 		"HookFilter": { "Name": "HookFilter", "Docs": "", "Fields": [{ "Name": "Max", "Docs": "", "Typewords": ["int32"] }, { "Name": "IDs", "Docs": "", "Typewords": ["[]", "int64"] }, { "Name": "Account", "Docs": "", "Typewords": ["string"] }, { "Name": "Submitted", "Docs": "", "Typewords": ["string"] }, { "Name": "NextAttempt", "Docs": "", "Typewords": ["string"] }, { "Name": "Event", "Docs": "", "Typewords": ["string"] }] },
 		"HookSort": { "Name": "HookSort", "Docs": "", "Fields": [{ "Name": "Field", "Docs": "", "Typewords": ["string"] }, { "Name": "LastID", "Docs": "", "Typewords": ["int64"] }, { "Name": "Last", "Docs": "", "Typewords": ["any"] }, { "Name": "Asc", "Docs": "", "Typewords": ["bool"] }] },
 		"Hook": { "Name": "Hook", "Docs": "", "Fields": [{ "Name": "ID", "Docs": "", "Typewords": ["int64"] }, { "Name": "QueueMsgID", "Docs": "", "Typewords": ["int64"] }, { "Name": "FromID", "Docs": "", "Typewords": ["string"] }, { "Name": "MessageID", "Docs": "", "Typewords": ["string"] }, { "Name": "Subject", "Docs": "", "Typewords": ["string"] }, { "Name": "Extra", "Docs": "", "Typewords": ["{}", "string"] }, { "Name": "Account", "Docs": "", "Typewords": ["string"] }, { "Name": "URL", "Docs": "", "Typewords": ["string"] }, { "Name": "Authorization", "Docs": "", "Typewords": ["string"] }, { "Name": "IsIncoming", "Docs": "", "Typewords": ["bool"] }, { "Name": "OutgoingEvent", "Docs": "", "Typewords": ["string"] }, { "Name": "Payload", "Docs": "", "Typewords": ["string"] }, { "Name": "Submitted", "Docs": "", "Typewords": ["timestamp"] }, { "Name": "Attempts", "Docs": "", "Typewords": ["int32"] }, { "Name": "NextAttempt", "Docs": "", "Typewords": ["timestamp"] }, { "Name": "Results", "Docs": "", "Typewords": ["[]", "HookResult"] }] },
@@ -356,7 +391,9 @@ var api;
 		"TransportSMTP": { "Name": "TransportSMTP", "Docs": "", "Fields": [{ "Name": "Host", "Docs": "", "Typewords": ["string"] }, { "Name": "Port", "Docs": "", "Typewords": ["int32"] }, { "Name": "STARTTLSInsecureSkipVerify", "Docs": "", "Typewords": ["bool"] }, { "Name": "NoSTARTTLS", "Docs": "", "Typewords": ["bool"] }, { "Name": "Auth", "Docs": "", "Typewords": ["nullable", "SMTPAuth"] }] },
 		"SMTPAuth": { "Name": "SMTPAuth", "Docs": "", "Fields": [{ "Name": "Username", "Docs": "", "Typewords": ["string"] }, { "Name": "Password", "Docs": "", "Typewords": ["string"] }, { "Name": "Mechanisms", "Docs": "", "Typewords": ["[]", "string"] }] },
 		"TransportSocks": { "Name": "TransportSocks", "Docs": "", "Fields": [{ "Name": "Address", "Docs": "", "Typewords": ["string"] }, { "Name": "RemoteIPs", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "RemoteHostname", "Docs": "", "Typewords": ["string"] }] },
-		"TransportDirect": { "Name": "TransportDirect", "Docs": "", "Fields": [{ "Name": "DisableIPv4", "Docs": "", "Typewords": ["bool"] }, { "Name": "DisableIPv6", "Docs": "", "Typewords": ["bool"] }] },
+		"TransportDirect": { "Name": "TransportDirect", "Docs": "", "Fields": [{ "Name": "DisableIPv4", "Docs": "", "Typewords": ["bool"] }, { "Name": "DisableIPv6", "Docs": "", "Typewords": ["bool"] }, { "Name": "IPPools", "Docs": "", "Typewords": ["{}", "IPPool"] }] },
+		"IPPool": { "Name": "IPPool", "Docs": "", "Fields": [{ "Name": "IPs", "Docs": "", "Typewords": ["[]", "PoolIP"] }] },
+		"PoolIP": { "Name": "PoolIP", "Docs": "", "Fields": [{ "Name": "IP", "Docs": "", "Typewords": ["string"] }, { "Name": "Hostname", "Docs": "", "Typewords": ["string"] }] },
 		"EvaluationStat": { "Name": "EvaluationStat", "Docs": "", "Fields": [{ "Name": "Domain", "Docs": "", "Typewords": ["Domain"] }, { "Name": "Dispositions", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "Count", "Docs": "", "Typewords": ["int32"] }, { "Name": "SendReport", "Docs": "", "Typewords": ["bool"] }] },
 		"Evaluation": { "Name": "Evaluation", "Docs": "", "Fields": [{ "Name": "ID", "Docs": "", "Typewords": ["int64"] }, { "Name": "PolicyDomain", "Docs": "", "Typewords": ["string"] }, { "Name": "Evaluated", "Docs": "", "Typewords": ["timestamp"] }, { "Name": "Optional", "Docs": "", "Typewords": ["bool"] }, { "Name": "IntervalHours", "Docs": "", "Typewords": ["int32"] }, { "Name": "Addresses", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "PolicyPublished", "Docs": "", "Typewords": ["PolicyPublished"] }, { "Name": "SourceIP", "Docs": "", "Typewords": ["string"] }, { "Name": "Disposition", "Docs": "", "Typewords": ["string"] }, { "Name": "AlignedDKIMPass", "Docs": "", "Typewords": ["bool"] }, { "Name": "AlignedSPFPass", "Docs": "", "Typewords": ["bool"] }, { "Name": "OverrideReasons", "Docs": "", "Typewords": ["[]", "PolicyOverrideReason"] }, { "Name": "EnvelopeTo", "Docs": "", "Typewords": ["string"] }, { "Name": "EnvelopeFrom", "Docs": "", "Typewords": ["string"] }, { "Name": "HeaderFrom", "Docs": "", "Typewords": ["string"] }, { "Name": "DKIMResults", "Docs": "", "Typewords": ["[]", "DKIMAuthResult"] }, { "Name": "SPFResults", "Docs": "", "Typewords": ["[]", "SPFAuthResult"] }] },
 		"SuppressAddress": { "Name": "SuppressAddress", "Docs": "", "Fields": [{ "Name": "ID", "Docs": "", "Typewords": ["int64"] }, { "Name": "Inserted", "Docs": "", "Typewords": ["timestamp"] }, { "Name": "ReportingAddress", "Docs": "", "Typewords": ["string"] }, { "Name": "Until", "Docs": "", "Typewords": ["timestamp"] }, { "Name": "Comment", "Docs": "", "Typewords": ["string"] }] },
@@ -364,6 +401,9 @@ var api;
 		"TLSRPTSuppressAddress": { "Name": "TLSRPTSuppressAddress", "Docs": "", "Fields": [{ "Name": "ID", "Docs": "", "Typewords": ["int64"] }, { "Name": "Inserted", "Docs": "", "Typewords": ["timestamp"] }, { "Name": "ReportingAddress", "Docs": "", "Typewords": ["string"] }, { "Name": "Until", "Docs": "", "Typewords": ["timestamp"] }, { "Name": "Comment", "Docs": "", "Typewords": ["string"] }] },
 		"Dynamic": { "Name": "Dynamic", "Docs": "", "Fields": [{ "Name": "Domains", "Docs": "", "Typewords": ["{}", "ConfigDomain"] }, { "Name": "Accounts", "Docs": "", "Typewords": ["{}", "Account"] }, { "Name": "WebDomainRedirects", "Docs": "", "Typewords": ["{}", "string"] }, { "Name": "WebHandlers", "Docs": "", "Typewords": ["[]", "WebHandler"] }, { "Name": "Routes", "Docs": "", "Typewords": ["[]", "Route"] }, { "Name": "MonitorDNSBLs", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "MonitorDNSBLZones", "Docs": "", "Typewords": ["[]", "Domain"] }] },
 		"CSRFToken": { "Name": "CSRFToken", "Docs": "", "Values": null },
+		"Role": { "Name": "Role", "Docs": "", "Values": [{ "Name": "RoleAdmin", "Value": "admin", "Docs": "" }, { "Name": "RoleReadOnly", "Value": "readonly", "Docs": "" }, { "Name": "RoleQueue", "Value": "queue", "Docs": "" }, { "Name": "RoleDomain", "Value": "domain", "Docs": "" }] },
+		"AuditSource": { "Name": "AuditSource", "Docs": "", "Values": [{ "Name": "AuditSourceNone", "Value": "", "Docs": "" }, { "Name": "AuditSourceCtl", "Value": "ctl", "Docs": "" }, { "Name": "AuditSourceWebadmin", "Value": "webadmin", "Docs": "" }, { "Name": "AuditSourceWebaccount", "Value": "webaccount", "Docs": "" }] },
+		"AuditKind": { "Name": "AuditKind", "Docs": "", "Values": [{ "Name": "AuditKindAny", "Value": "", "Docs": "" }, { "Name": "AuditConfig", "Value": "config", "Docs": "" }, { "Name": "AuditQueue", "Value": "queue", "Docs": "" }, { "Name": "AuditPassword", "Value": "password", "Docs": "" }, { "Name": "AuditAdminUser", "Value": "adminuser", "Docs": "" }] },
 		"DMARCPolicy": { "Name": "DMARCPolicy", "Docs": "", "Values": [{ "Name": "PolicyEmpty", "Value": "", "Docs": "" }, { "Name": "PolicyNone", "Value": "none", "Docs": "" }, { "Name": "PolicyQuarantine", "Value": "quarantine", "Docs": "" }, { "Name": "PolicyReject", "Value": "reject", "Docs": "" }] },
 		"Align": { "Name": "Align", "Docs": "", "Values": [{ "Name": "AlignStrict", "Value": "s", "Docs": "" }, { "Name": "AlignRelaxed", "Value": "r", "Docs": "" }] },
 		"RUA": { "Name": "RUA", "Docs": "", "Values": null },
@@ -372,6 +412,10 @@ var api;
 		"IP": { "Name": "IP", "Docs": "", "Values": [] },
 	};
 	api.parser = {
+		TOTPSetup: (v) => api.parse("TOTPSetup", v),
+		User: (v) => api.parse("User", v),
+		AuditFilter: (v) => api.parse("AuditFilter", v),
+		AuditEntry: (v) => api.parse("AuditEntry", v),
 		CheckResult: (v) => api.parse("CheckResult", v),
 		DNSSECResult: (v) => api.parse("DNSSECResult", v),
 		IPRevCheckResult: (v) => api.parse("IPRevCheckResult", v),
@@ -454,6 +498,7 @@ var api;
 		Msg: (v) => api.parse("Msg", v),
 		IPDomain: (v) => api.parse("IPDomain", v),
 		MsgResult: (v) => api.parse("MsgResult", v),
+		RateLimitState: (v) => api.parse("RateLimitState", v),
 		RetiredFilter: (v) => api.parse("RetiredFilter", v),
 		RetiredSort: (v) => api.parse("RetiredSort", v),
 		MsgRetired: (v) => api.parse("MsgRetired", v),
@@ -475,6 +520,8 @@ var api;
 		SMTPAuth: (v) => api.parse("SMTPAuth", v),
 		TransportSocks: (v) => api.parse("TransportSocks", v),
 		TransportDirect: (v) => api.parse("TransportDirect", v),
+		IPPool: (v) => api.parse("IPPool", v),
+		PoolIP: (v) => api.parse("PoolIP", v),
 		EvaluationStat: (v) => api.parse("EvaluationStat", v),
 		Evaluation: (v) => api.parse("Evaluation", v),
 		SuppressAddress: (v) => api.parse("SuppressAddress", v),
@@ -482,6 +529,9 @@ var api;
 		TLSRPTSuppressAddress: (v) => api.parse("TLSRPTSuppressAddress", v),
 		Dynamic: (v) => api.parse("Dynamic", v),
 		CSRFToken: (v) => api.parse("CSRFToken", v),
+		Role: (v) => api.parse("Role", v),
+		AuditSource: (v) => api.parse("AuditSource", v),
+		AuditKind: (v) => api.parse("AuditKind", v),
 		DMARCPolicy: (v) => api.parse("DMARCPolicy", v),
 		Align: (v) => api.parse("Align", v),
 		RUA: (v) => api.parse("RUA", v),
@@ -491,7 +541,8 @@ var api;
 	};
 	// Admin exports web API functions for the admin web interface. All its methods are
 	// exported under api/. Function calls require valid HTTP Authentication
-	// credentials of a user.
+	// credentials of a user, and the role of the admin user must allow the function,
+	// see apiPermissions.
 	let defaultOptions = { slicesNullable: true, mapsNullable: true, nullableOptional: true };
 	class Client {
 		baseURL;
@@ -524,12 +575,62 @@ var api;
 			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
 		}
 		// Login returns a session token for the credentials, or fails with error code
-		// "user:badLogin". Call LoginPrep to get a loginToken.
-		async Login(loginToken, password) {
+		// "user:badLogin". Call LoginPrep to get a loginToken. For the admin password,
+		// username must be empty. Otherwise the credentials are of an admin user.
+		async Login(loginToken, username, password) {
 			const fn = "Login";
+			const paramTypes = [["string"], ["string"], ["string"]];
+			const returnTypes = [["CSRFToken"]];
+			const params = [loginToken, username, password];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// LoginTOTP completes a login for which Login failed with error code
+		// "user:totpRequired", with a code from an authenticator app. Fails with error
+		// code "user:loginFailed" for a bad code.
+		async LoginTOTP(loginToken, code) {
+			const fn = "LoginTOTP";
 			const paramTypes = [["string"], ["string"]];
 			const returnTypes = [["CSRFToken"]];
-			const params = [loginToken, password];
+			const params = [loginToken, code];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// TOTPStatus returns whether logins of the admin (user) require a TOTP code from
+		// an authenticator app.
+		async TOTPStatus() {
+			const fn = "TOTPStatus";
+			const paramTypes = [];
+			const returnTypes = [["bool"]];
+			const params = [];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// TOTPSetupStart starts enrollment of the admin for two-factor authentication
+		// with a new secret, for adding to an authenticator app. Logins do not require a
+		// code until enrollment is confirmed with TOTPSetupConfirm.
+		async TOTPSetupStart() {
+			const fn = "TOTPSetupStart";
+			const paramTypes = [];
+			const returnTypes = [["TOTPSetup"]];
+			const params = [];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// TOTPSetupConfirm enables two-factor authentication for the admin (user) if code
+		// from the authenticator app is valid. To disable TOTP for the admin password
+		// without the web interface, remove the admin password file with ".totp"
+		// appended.
+		async TOTPSetupConfirm(code) {
+			const fn = "TOTPSetupConfirm";
+			const paramTypes = [["string"]];
+			const returnTypes = [];
+			const params = [code];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// TOTPDisable disables two-factor authentication for the admin (user), logins
+		// only require the password again.
+		async TOTPDisable() {
+			const fn = "TOTPDisable";
+			const paramTypes = [];
+			const returnTypes = [];
+			const params = [];
 			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
 		}
 		// Logout invalidates the session token.
@@ -540,6 +641,77 @@ var api;
 			const params = [];
 			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
 		}
+		// AdminUserCurrent returns the logged in admin user. For the admin password, the
+		// name is empty and the role is admin.
+		async AdminUserCurrent() {
+			const fn = "AdminUserCurrent";
+			const paramTypes = [];
+			const returnTypes = [["User"]];
+			const params = [];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// AdminUsers returns all admin users.
+		async AdminUsers() {
+			const fn = "AdminUsers";
+			const paramTypes = [];
+			const returnTypes = [["[]", "User"]];
+			const params = [];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// AdminUserAdd adds an admin user with a role, and for role "domain" the domains
+		// it manages. The password is optional, without password the user cannot log in
+		// to the admin web interface, but can still be used for connections to the ctl
+		// socket by its unix user.
+		async AdminUserAdd(user, password) {
+			const fn = "AdminUserAdd";
+			const paramTypes = [["User"], ["string"]];
+			const returnTypes = [];
+			const params = [user, password];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// AdminUserSave changes the role, domains and unix user of an admin user.
+		async AdminUserSave(user) {
+			const fn = "AdminUserSave";
+			const paramTypes = [["User"]];
+			const returnTypes = [];
+			const params = [user];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// AdminUserPasswordSet sets a new password for an admin user, ending its
+		// sessions. An empty password disables logins to the admin web interface.
+		async AdminUserPasswordSet(name, password) {
+			const fn = "AdminUserPasswordSet";
+			const paramTypes = [["string"], ["string"]];
+			const returnTypes = [];
+			const params = [name, password];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// AdminUserTOTPDisable disables two-factor authentication for an admin user,
+		// e.g. after losing the authenticator app.
+		async AdminUserTOTPDisable(name) {
+			const fn = "AdminUserTOTPDisable";
+			const paramTypes = [["string"]];
+			const returnTypes = [];
+			const params = [name];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// AdminUserRemove removes an admin user, ending its sessions.
+		async AdminUserRemove(name) {
+			const fn = "AdminUserRemove";
+			const paramTypes = [["string"]];
+			const returnTypes = [];
+			const params = [name];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// AuditList returns entries from the audit log of changes to the configuration,
+		// queues and passwords, newest first.
+		async AuditList(filter) {
+			const fn = "AuditList";
+			const paramTypes = [["AuditFilter"]];
+			const returnTypes = [["[]", "AuditEntry"]];
+			const params = [filter];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
 		// CheckDomain checks the configuration for the domain, such as MX, SMTP STARTTLS,
 		// SPF, DKIM, DMARC, TLSRPT, MTASTS, autoconfig, autodiscover.
 		async CheckDomain(domainName) {
@@ -549,7 +721,8 @@ var api;
 			const params = [domainName];
 			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
 		}
-		// Domains returns all configured domain names, in UTF-8 for IDNA domains.
+		// Domains returns all configured domain names, in UTF-8 for IDNA domains. For
+		// domain admins, only the domains managed by the admin are returned.
 		async Domains() {
 			const fn = "Domains";
 			const paramTypes = [];
@@ -589,7 +762,8 @@ var api;
 			const params = [domain];
 			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
 		}
-		// Accounts returns the names of all configured accounts.
+		// Accounts returns the names of all configured accounts. For domain admins, only
+		// accounts with a default domain managed by the admin are returned.
 		async Accounts() {
 			const fn = "Accounts";
 			const paramTypes = [];
@@ -774,6 +948,16 @@ var api;
 			const params = [accountName, password];
 			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
 		}
+		// AccountTOTPDisable disables two-factor authentication for logins to the web
+		// interfaces of an account, e.g. after a user lost their authenticator app and
+		// recovery codes.
+		async AccountTOTPDisable(accountName) {
+			const fn = "AccountTOTPDisable";
+			const paramTypes = [["string"]];
+			const returnTypes = [];
+			const params = [accountName];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
 		// AccountSettingsSave set new settings for an account that only an admin can set.
 		async AccountSettingsSave(accountName, maxOutgoingMessagesPerDay, maxFirstTimeRecipientsPerDay, maxMsgSize, firstTimeSenderDelay) {
 			const fn = "AccountSettingsSave";
@@ -833,6 +1017,15 @@ var api;
 			const params = [filter, sort];
 			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
 		}
+		// QueueRateLimits returns the configured outgoing rate limits with their current
+		// usage.
+		async QueueRateLimits() {
+			const fn = "QueueRateLimits";
+			const paramTypes = [];
+			const returnTypes = [["[]", "RateLimitState"]];
+			const params = [];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
 		// QueueNextAttemptSet sets a new time for next delivery attempt of matching
 		// messages from the queue.
 		async QueueNextAttemptSet(filter, minutes) {
@@ -1648,21 +1841,45 @@ const login = async (reason) => {
 		const origFocus = document.activeElement;
 		let reasonElem;
 		let fieldset;
+		let username;
 		let password;
+		let totpBox;
+		let totp;
+		// Set after a valid password when a TOTP code is required for the login.
+		let totpLoginToken = '';
 		const root = dom.div(style({ position: 'absolute', top: 0, right: 0, bottom: 0, left: 0, backgroundColor: '#eee', display: 'flex', alignItems: 'center', justifyContent: 'center', zIndex: '1', animation: 'fadein .15s ease-in' }), dom.div(reasonElem = reason ? dom.div(style({ marginBottom: '2ex', textAlign: 'center' }), reason) : dom.div(), dom.div(style({ backgroundColor: 'white', borderRadius: '.25em', padding: '1em', boxShadow: '0 0 20px rgba(0, 0, 0, 0.1)', border: '1px solid #ddd', maxWidth: '95vw', overflowX: 'auto', maxHeight: '95vh', overflowY: 'auto', marginBottom: '20vh' }), dom.form(async function submit(e) {
 			e.preventDefault();
 			e.stopPropagation();
 			reasonElem.remove();
 			try {
 				fieldset.disabled = true;
-				const loginToken = await client.LoginPrep();
-				const token = await client.Login(loginToken, password.value);
+				let token;
+				if (totpLoginToken) {
+					token = await client.LoginTOTP(totpLoginToken, totp.value);
+				}
+				else {
+					const loginToken = await client.LoginPrep();
+					try {
+						token = await client.Login(loginToken, username.value, password.value);
+					}
+					catch (err) {
+						if (err.code !== 'user:totpRequired') {
+							throw err;
+						}
+						// Password is valid, a code from the authenticator app is needed too.
+						totpLoginToken = loginToken;
+						totpBox.style.display = 'block';
+						totp.required = true;
+						return;
+					}
+				}
 				try {
 					window.localStorage.setItem('webadmincsrftoken', token);
 				}
 				catch (err) {
 					console.log('saving csrf token in localStorage', err);
 				}
+				currentAdmin = null;
 				root.remove();
 				if (origFocus && origFocus instanceof HTMLElement && origFocus.parentNode) {
 					origFocus.focus();
@@ -1672,13 +1889,22 @@ const login = async (reason) => {
 			catch (err) {
 				console.log('login error', err);
 				window.alert('Error: ' + errmsg(err));
+				if (totpLoginToken && err.code !== 'user:loginFailed') {
+					// Login expired, start again with the password.
+					totpLoginToken = '';
+					totpBox.style.display = 'none';
+					totp.required = false;
+				}
 			}
 			finally {
 				fieldset.disabled = false;
+				if (totpLoginToken) {
+					totp.focus();
+				}
 			}
-		}, fieldset = dom.fieldset(dom.h1('Admin'), dom.label(style({ display: 'block', marginBottom: '2ex' }), dom.div('Password', style({ marginBottom: '.5ex' })), password = dom.input(attr.type('password'), attr.required(''))), dom.div(style({ textAlign: 'center' }), dom.submitbutton('Login')))))));
+		}, fieldset = dom.fieldset(dom.h1('Admin'), dom.label(style({ display: 'block', marginBottom: '2ex' }), dom.div('Username', style({ marginBottom: '.5ex' })), username = dom.input(attr.autocomplete('username'), attr.placeholder('Empty for admin password'))), dom.label(style({ display: 'block', marginBottom: '2ex' }), dom.div('Password', style({ marginBottom: '.5ex' })), password = dom.input(attr.type('password'), attr.required(''))), totpBox = dom.label(style({ display: 'none', marginBottom: '2ex' }), dom.div('Two-factor authentication code', style({ marginBottom: '.5ex' })), totp = dom.input(attr.autocomplete('one-time-code')), dom.div('From your authenticator app.', style({ marginTop: '.5ex', fontSize: '.9em' }))), dom.div(style({ textAlign: 'center' }), dom.submitbutton('Login')))))));
 		document.body.appendChild(root);
-		password.focus();
+		username.focus();
 	});
 };
 // Popup shows kids in a centered div with white background on top of a
@@ -1728,6 +1954,22 @@ const localStorageRemove = (k) => {
 	}
 };
 const client = new api.Client().withOptions({ csrfHeader: 'x-mox-csrf', login: login }).withAuthToken(localStorageGet('webadmincsrftoken') || '');
+// Admin user of the session, cleared on login.
+let currentAdmin = null;
+const adminUser = async () => {
+	if (!currentAdmin) {
+		currentAdmin = await client.AdminUserCurrent();
+	}
+	return currentAdmin;
+};
+// Domain admins cannot view the transports, and cannot change routes.
+const transportsOrNone = async () => {
+	const admin = await adminUser();
+	if (admin.Role === api.Role.RoleDomain) {
+		return {};
+	}
+	return await client.Transports() || {};
+};
 const check = async (elem, p) => {
 	try {
 		elem.disabled = true;
@@ -1907,11 +2149,14 @@ const formatSize = (n) => {
 	return n + ' bytes';
 };
 const index = async () => {
+	const admin = await adminUser();
+	const isAdmin = admin.Role === api.Role.RoleAdmin;
+	const isDomainAdmin = admin.Role === api.Role.RoleDomain;
 	const [domains, queueSize, hooksQueueSize, checkUpdatesEnabled, accounts] = await Promise.all([
 		client.Domains(),
-		client.QueueSize(),
-		client.HookQueueSize(),
-		client.CheckUpdatesEnabled(),
+		isDomainAdmin ? 0 : client.QueueSize(),
+		isDomainAdmin ? 0 : client.HookQueueSize(),
+		isDomainAdmin ? true : client.CheckUpdatesEnabled(),
 		client.Accounts(),
 	]);
 	let fieldset;
@@ -1921,13 +2166,22 @@ const index = async () => {
 	let recvIDFieldset;
 	let recvID;
 	let cidElem;
-	dom._kids(page, crumbs('Mox Admin'), checkUpdatesEnabled ? [] : dom.p(box(yellow, 'Warning: Checking for updates has not been enabled in mox.conf (CheckUpdates: true).', dom.br(), 'Make sure you stay up to date through another mechanism!', dom.br(), 'You have a responsibility to keep the internet-connected software you run up to date and secure!', dom.br(), 'See ', link('https://updates.xmox.nl/changelog'))), dom.p(dom.a('Accounts', attr.href('#accounts')), dom.br(), dom.a('Queue', attr.href('#queue')), ' (' + queueSize + ')', dom.br(), dom.a('Webhook queue', attr.href('#webhookqueue')), ' (' + hooksQueueSize + ')', dom.br()), dom.h2('Domains'), (domains || []).length === 0 ? box(red, 'No domains') :
-		dom.ul((domains || []).map(d => dom.li(dom.a(attr.href('#domains/' + domainName(d)), domainString(d))))), dom.br(), dom.h2('Add domain'), dom.form(async function submit(e) {
+	dom._kids(page, crumbs('Mox Admin'), admin.Name ? dom.p('Logged in as admin user ', dom.b(admin.Name), ', with role ', admin.Role, '.') : [], checkUpdatesEnabled ? [] : dom.p(box(yellow, 'Warning: Checking for updates has not been enabled in mox.conf (CheckUpdates: true).', dom.br(), 'Make sure you stay up to date through another mechanism!', dom.br(), 'You have a responsibility to keep the internet-connected software you run up to date and secure!', dom.br(), 'See ', link('https://updates.xmox.nl/changelog'))), dom.p(dom.a('Accounts', attr.href('#accounts')), dom.br(), isDomainAdmin ? [] : [
+		dom.a('Queue', attr.href('#queue')), ' (' + queueSize + ')', dom.br(),
+		dom.a('Webhook queue', attr.href('#webhookqueue')), ' (' + hooksQueueSize + ')', dom.br(),
+	]), dom.h2('Domains'), (domains || []).length === 0 ? box(red, 'No domains') :
+		dom.ul((domains || []).map(d => dom.li(dom.a(attr.href('#domains/' + domainName(d)), domainString(d))))), !isAdmin ? [] : [
+		dom.br(),
+		dom.h2('Add domain'),
+		dom.form(async function submit(e) {
 		e.preventDefault();
 		e.stopPropagation();
 		await check(fieldset, client.DomainAdd(domain.value, account.value, localpart.value));
 		window.location.hash = '#domains/' + domain.value;
-	}, fieldset = dom.fieldset(dom.label(style({ display: 'inline-block' }), dom.span('Domain', attr.title('Domain for incoming/outgoing email to add to mox. Can also be a subdomain of a domain already configured.')), dom.br(), domain = dom.input(attr.required(''))), ' ', dom.label(style({ display: 'inline-block' }), dom.span('Postmaster/reporting account', attr.title('Account that is considered the owner of this domain. If the account does not yet exist, it will be created and a a localpart is required for the initial email address.')), dom.br(), account = dom.input(attr.required(''), attr.list('accountList')), dom.datalist(attr.id('accountList'), (accounts || []).map(a => dom.option(a)))), ' ', dom.label(style({ display: 'inline-block' }), dom.span('Localpart (if new account)', attr.title('Must be set if and only if account does not yet exist. A localpart is the part before the "@"-sign of an email address. An account requires an email address, so creating a new account for a domain requires a localpart to form an initial email address.')), dom.br(), localpart = dom.input()), ' ', dom.submitbutton('Add domain', attr.title('Domain will be added and the config reloaded. Add the required DNS records after adding the domain.')))), dom.br(), dom.h2('Reports'), dom.div(dom.a('DMARC', attr.href('#dmarc/reports'))), dom.div(dom.a('TLS', attr.href('#tlsrpt/reports'))), dom.br(), dom.h2('Operations'), dom.div(dom.a('MTA-STS policies', attr.href('#mtasts'))), dom.div(dom.a('DMARC evaluations', attr.href('#dmarc/evaluations'))), dom.div(dom.a('TLS connection results', attr.href('#tlsrpt/results'))), dom.div(dom.a('DNSBL', attr.href('#dnsbl'))), dom.div(style({ marginTop: '.5ex' }), dom.form(async function submit(e) {
+	}, fieldset = dom.fieldset(dom.label(style({ display: 'inline-block' }), dom.span('Domain', attr.title('Domain for incoming/outgoing email to add to mox. Can also be a subdomain of a domain already configured.')), dom.br(), domain = dom.input(attr.required(''))), ' ', dom.label(style({ display: 'inline-block' }), dom.span('Postmaster/reporting account', attr.title('Account that is considered the owner of this domain. If the account does not yet exist, it will be created and a a localpart is required for the initial email address.')), dom.br(), account = dom.input(attr.required(''), attr.list('accountList')), dom.datalist(attr.id('accountList'), (accounts || []).map(a => dom.option(a)))), ' ', dom.label(style({ display: 'inline-block' }), dom.span('Localpart (if new account)', attr.title('Must be set if and only if account does not yet exist. A localpart is the part before the "@"-sign of an email address. An account requires an email address, so creating a new account for a domain requires a localpart to form an initial email address.')), dom.br(), localpart = dom.input()), ' ', dom.submitbutton('Add domain', attr.title('Domain will be added and the config reloaded. Add the required DNS records after adding the domain.')))),
+	], isDomainAdmin ? [] : [
+		dom.br(),
+		dom.h2('Reports'), dom.div(dom.a('DMARC', attr.href('#dmarc/reports'))), dom.div(dom.a('TLS', attr.href('#tlsrpt/reports'))), dom.br(), dom.h2('Operations'), dom.div(dom.a('MTA-STS policies', attr.href('#mtasts'))), dom.div(dom.a('DMARC evaluations', attr.href('#dmarc/evaluations'))), dom.div(dom.a('TLS connection results', attr.href('#tlsrpt/results'))), dom.div(dom.a('DNSBL', attr.href('#dnsbl'))), dom.div(style({ marginTop: '.5ex' }), dom.form(async function submit(e) {
 		e.preventDefault();
 		e.stopPropagation();
 		dom._kids(cidElem);
@@ -1935,7 +2189,8 @@ const index = async () => {
 		dom._kids(cidElem, cid);
 	}, recvIDFieldset = dom.fieldset(dom.label('Received ID', attr.title('The ID in the Received header that was added during incoming delivery.')), ' ', recvID = dom.input(attr.required('')), ' ', dom.submitbutton('Lookup cid', attr.title('Logging about an incoming message includes an attribute "cid", a counter identifying the transaction related to delivery of the message. The ID in the received header is an encrypted cid, which this form decrypts, after which you can look it up in the logging.')), ' ', cidElem = dom.span()))), 
 	// todo: routing, globally, per domain and per account
-	dom.br(), dom.h2('Configuration'), dom.div(dom.a('Routes', attr.href('#routes'))), dom.div(dom.a('Webserver', attr.href('#webserver'))), dom.div(dom.a('Files', attr.href('#config'))), dom.div(dom.a('Log levels', attr.href('#loglevels'))), footer);
+	dom.br(), dom.h2('Configuration'), dom.div(dom.a('Routes', attr.href('#routes'))), dom.div(dom.a('Webserver', attr.href('#webserver'))), dom.div(dom.a('Files', attr.href('#config'))), dom.div(dom.a('Log levels', attr.href('#loglevels'))), isAdmin ? dom.div(dom.a('Admin users', attr.href('#adminusers'))) : [], dom.div(dom.a('Audit log', attr.href('#auditlog'))),
+	], isDomainAdmin ? [dom.br(), dom.h2('Configuration')] : [], dom.div(dom.a('Two-factor authentication', attr.href('#twofactor'))), footer);
 };
 const globalRoutes = async () => {
 	const [transports, config] = await Promise.all([
@@ -1948,6 +2203,144 @@ const config = async () => {
 	const [staticPath, dynamicPath, staticText, dynamicText] = await client.ConfigFiles();
 	dom._kids(page, crumbs(crumblink('Mox Admin', '#'), 'Config'), dom.h2(staticPath), dom.pre(dom._class('literal'), staticText), dom.h2(dynamicPath), dom.pre(dom._class('literal'), dynamicText));
 };
+const twoFactor = async () => {
+	const enabled = await client.TOTPStatus();
+	let setupBox;
+	let fieldset;
+	let code;
+	dom._kids(page, crumbs(crumblink('Mox Admin', '#'), 'Two-factor authentication'), dom.p('With two-factor authentication, logging in to the admin web interface requires a code from an authenticator app in addition to the password. To disable it for the admin password without the web interface, remove the file with the name of the admin password file and ".totp" appended from the config directory. For admin users, an admin can disable it.'), enabled ? [
+		dom.p('Two-factor authentication is enabled.'),
+		dom.clickbutton('Disable two-factor authentication', async function click(e) {
+			if (!window.confirm('Are you sure you want to disable two-factor authentication? Logging in will only require the admin password.')) {
+				return;
+			}
+			await check(e.target, client.TOTPDisable());
+			window.location.reload(); // todo: reload less
+		}),
+	] : setupBox = dom.div(dom.clickbutton('Set up two-factor authentication', async function click(e) {
+		const setup = await check(e.target, client.TOTPSetupStart());
+		dom._kids(setupBox, dom.p('Scan the QR code with your authenticator app, or enter the secret manually. Then enter the code shown by the app to enable two-factor authentication.'), dom.img(attr.src(setup.QRCodePNG), attr.title(setup.URI), style({ width: '15em', imageRendering: 'pixelated' })), dom.p('Secret: ', dom.span(style({ fontFamily: 'monospace' }), setup.Secret)), dom.form(async function submit(e) {
+			e.preventDefault();
+			e.stopPropagation();
+			await check(fieldset, client.TOTPSetupConfirm(code.value));
+			window.alert('Two-factor authentication is now enabled.');
+			window.location.reload(); // todo: reload less
+		}, fieldset = dom.fieldset(dom.label(style({ display: 'inline-block' }), dom.div('Code'), code = dom.input(attr.required(''), attr.autocomplete('one-time-code'))), ' ', dom.submitbutton('Enable'))));
+	})));
+};
+const adminUsers = async () => {
+	const [users, domains] = await Promise.all([
+		client.AdminUsers(),
+		client.Domains(),
+	]);
+	const roles = [api.Role.RoleAdmin, api.Role.RoleReadOnly, api.Role.RoleQueue, api.Role.RoleDomain];
+	const domainNames = (domains || []).map(d => domainName(d));
+	// Form fields for role, domains and unix user, for adding and editing users.
+	const userFields = (u) => {
+		const role = dom.select(attr.required(''), roles.map(r => dom.option(r, u && u.Role === r ? attr.selected('') : [])));
+		const userDomains = dom.select(attr.multiple(''), attr.size('' + Math.min(5, Math.max(2, domainNames.length))), domainNames.map(d => dom.option(d, u && (u.Domains || []).includes(d) ? attr.selected('') : [])));
+		const unixUser = dom.input(attr.value(u ? u.UnixUser : ''));
+		const elem = [
+			dom.label(style({ display: 'inline-block' }), dom.span('Role', attr.title('Admin has full access. Read-only can view but not change configuration, queues and reports. Queue is like read-only, but can also manage the message and webhook queues. Domain can only view and change the selected domains, and their accounts, addresses and aliases.')), dom.br(), role),
+			' ',
+			dom.label(style({ display: 'inline-block', verticalAlign: 'top' }), dom.span('Domains', attr.title('For role "domain", the domains the user manages. Accounts with one of these domains as default domain are managed by the user too.')), dom.br(), userDomains),
+			' ',
+			dom.label(style({ display: 'inline-block' }), dom.span('Unix user', attr.title('Optional. Connections to the ctl socket, e.g. by running "mox" commands, by this unix user are limited to the role of this admin user. Once any admin user has a unix user, other unix users not associated with an admin user are denied, except root and the unix user mox runs as. Only supported on Linux, other platforms deny all connections.')), dom.br(), unixUser),
+		];
+		const value = (name) => {
+			return {
+				Name: name,
+				Created: new Date(),
+				Role: role.value,
+				Domains: role.value === api.Role.RoleDomain ? Array.from(userDomains.selectedOptions).map(o => o.value) : [],
+				UnixUser: unixUser.value,
+			};
+		};
+		return { elem, value };
+	};
+	const editUser = (u) => {
+		let fieldset;
+		const fields = userFields(u);
+		const close = popup(dom.h1('Edit admin user ', u.Name), dom.form(async function submit(e) {
+			e.preventDefault();
+			e.stopPropagation();
+			await check(fieldset, client.AdminUserSave(fields.value(u.Name)));
+			close();
+			window.location.reload(); // todo: reload less
+		}, fieldset = dom.fieldset(fields.elem, ' ', dom.submitbutton('Save'))));
+	};
+	let fieldset;
+	let name;
+	let password;
+	const addFields = userFields(null);
+	dom._kids(page, crumbs(crumblink('Mox Admin', '#'), 'Admin users'), dom.p('Admin users can log in to the admin web interface with their own password, and their role limits what they can view and change. The admin password remains valid for full admin access. Admin users can also be associated with a unix user, limiting connections to the ctl socket by that unix user.'), dom.table(dom._class('hover'), dom.thead(dom.tr(dom.th('Name'), dom.th('Role'), dom.th('Domains'), dom.th('Unix user'), dom.th('Created'), dom.th('Action'))), dom.tbody((users || []).length === 0 ? dom.tr(dom.td(attr.colspan('6'), 'None')) : [], (users || []).map(u => dom.tr(dom.td(u.Name), dom.td(u.Role), dom.td((u.Domains || []).join(', ')), dom.td(u.UnixUser), dom.td(u.Created.toLocaleString()), dom.td(dom.clickbutton('Edit', function click() {
+		editUser(u);
+	}), ' ', dom.clickbutton('Set password', attr.title('Set a new password for the user. Existing sessions of the user are ended.'), async function click(e) {
+		const pw = window.prompt('New password, at least 8 characters. Leave empty to disable logins to the admin web interface.');
+		if (pw === null) {
+			return;
+		}
+		await check(e.target, client.AdminUserPasswordSet(u.Name, pw));
+		window.alert('Password has been changed.');
+	}), ' ', dom.clickbutton('Disable two-factor authentication', async function click(e) {
+		if (!window.confirm('Are you sure you want to disable two-factor authentication for this user?')) {
+			return;
+		}
+		await check(e.target, client.AdminUserTOTPDisable(u.Name));
+		window.alert('Two-factor authentication has been disabled.');
+	}), ' ', dom.clickbutton('Remove', async function click(e) {
+		if (!window.confirm('Are you sure you want to remove this admin user?')) {
+			return;
+		}
+		await check(e.target, client.AdminUserRemove(u.Name));
+		window.location.reload(); // todo: reload less
+	})))))), dom.br(), dom.h2('Add admin user'), dom.form(async function submit(e) {
+		e.preventDefault();
+		e.stopPropagation();
+		await check(fieldset, client.AdminUserAdd(addFields.value(name.value), password.value));
+		window.location.reload(); // todo: reload less
+	}, fieldset = dom.fieldset(dom.label(style({ display: 'inline-block' }), dom.span('Name'), dom.br(), name = dom.input(attr.required(''))), ' ', addFields.elem, ' ', dom.label(style({ display: 'inline-block' }), dom.span('Password', attr.title('Optional, at least 8 characters. Without password, the user cannot log in to the admin web interface.')), dom.br(), password = dom.input(attr.type('password'), attr.autocomplete('new-password'))), ' ', dom.submitbutton('Add admin user'))));
+};
+const auditLog = async () => {
+	const filter = { Max: parseInt(localStorageGet('adminpaginationsize') || '') || 100, Source: api.AuditSource.AuditSourceNone, Actor: '', Kind: api.AuditKind.AuditKindAny, Operation: '', Start: null, End: null, Text: '' };
+	const entries = await client.AuditList(filter);
+	let fieldset;
+	let source;
+	let actor;
+	let kind;
+	let operation;
+	let start;
+	let end;
+	let text;
+	let exportFilter;
+	let tbody;
+	// Gather the filter from the form fields. End date is inclusive in the form.
+	const formFilter = () => {
+		return {
+			Max: filter.Max,
+			Source: source.value,
+			Actor: actor.value,
+			Kind: kind.value,
+			Operation: operation.value,
+			Start: start.value ? new Date(start.value) : null,
+			End: end.value ? new Date(new Date(end.value).getTime() + 24 * 3600 * 1000) : null,
+			Text: text.value,
+		};
+	};
+	const render = (l) => {
+		dom._kids(tbody, (l || []).length === 0 ? dom.tr(dom.td(attr.colspan('7'), 'No entries.')) : [], (l || []).map(e => dom.tr(dom.td(e.Time.toLocaleString()), dom.td(e.Source || '-'), dom.td(e.Actor || (e.Source === api.AuditSource.AuditSourceWebadmin ? '(admin password)' : '-'), e.RemoteIP ? dom.div(e.RemoteIP) : []), dom.td(e.Operation), dom.td(e.Kind), dom.td(e.Details), dom.td(e.Diff ? dom.pre(dom._class('literal'), style({ maxHeight: '20em', overflow: 'auto' }), e.Diff) : []))));
+	};
+	dom._kids(page, crumbs(crumblink('Mox Admin', '#'), 'Audit log'), dom.p('The audit log has changes to the configuration (domains.conf), operations on the queues, and password changes, made through the admin and account web interfaces and the "mox" command-line. The newest entries are listed first. The admin password can only be set from the command-line without a running mox, those changes are not in the audit log.'), dom.form(async function submit(e) {
+		e.preventDefault();
+		e.stopPropagation();
+		const l = await check(fieldset, client.AuditList(formFilter()));
+		render(l);
+	}, fieldset = dom.fieldset(dom.label(style({ display: 'inline-block' }), dom.span('Source'), dom.br(), source = dom.select(dom.option('', attr.value('')), Object.values(api.AuditSource).filter(s => s).map(s => dom.option(s)))), ' ', dom.label(style({ display: 'inline-block' }), dom.span('Actor', attr.title('Admin user, account, or unix user for ctl.')), dom.br(), actor = dom.input()), ' ', dom.label(style({ display: 'inline-block' }), dom.span('Kind'), dom.br(), kind = dom.select(dom.option('', attr.value('')), Object.values(api.AuditKind).filter(k => k).map(k => dom.option(k)))), ' ', dom.label(style({ display: 'inline-block' }), dom.span('Operation', attr.title('API function or ctl command.')), dom.br(), operation = dom.input()), ' ', dom.label(style({ display: 'inline-block' }), dom.span('From'), dom.br(), start = dom.input(attr.type('date'))), ' ', dom.label(style({ display: 'inline-block' }), dom.span('Until', attr.title('Inclusive.')), dom.br(), end = dom.input(attr.type('date'))), ' ', dom.label(style({ display: 'inline-block' }), dom.span('Text', attr.title('Case-insensitive text to search for in details and diff.')), dom.br(), text = dom.input()), ' ', dom.submitbutton('Search'))), dom.form(attr.target('_blank'), attr.method('POST'), attr.action('auditlog'), function submit() {
+		// Form is submitted normally, for downloading the file.
+		exportFilter.value = JSON.stringify(formFilter());
+	}, dom.input(attr.type('hidden'), attr.name('csrf'), attr.value(localStorageGet('webadmincsrftoken') || '')), exportFilter = dom.input(attr.type('hidden'), attr.name('filter')), dom.submitbutton('Export as JSON lines', attr.title('Export all entries matching the filter, oldest first.'))), dom.br(), dom.table(dom._class('hover'), dom.thead(dom.tr(dom.th('Time'), dom.th('Source'), dom.th('Actor'), dom.th('Operation'), dom.th('Kind'), dom.th('Details'), dom.th('Diff'))), tbody = dom.tbody()));
+	render(entries);
+};
 const loglevels = async () => {
 	const loglevels = await client.LogLevels();
 	const levels = ['error', 'info', 'warn', 'debug', 'trace', 'traceauth', 'tracedata'];
@@ -2047,16 +2440,17 @@ const RoutesEditor = (kind, transports, routes, save) => {
 			e.stopPropagation();
 			e.preventDefault();
 			await check(routesFieldset, save(routeRows.map(rr => rr.gather())));
-		}, routesFieldset = dom.fieldset(dom.table(dom.thead(dom.tr(dom.th('From domain'), dom.th('To domain'), dom.th('Minimum attempts'), dom.th('Transport'), dom.th(dom.clickbutton('Add', function click() {
+		}, routesFieldset = dom.fieldset(dom.table(dom.thead(dom.tr(dom.th('From domain'), dom.th('To domain'), dom.th('Minimum attempts'), dom.th('Transport'), dom.th('IP pool', attr.title('Optional name of an IP pool of a direct transport to deliver from. If set, the transport of the IP pool is used.')), dom.th(dom.clickbutton('Add', function click() {
 			routes = routeRows.map(rr => rr.gather());
-			routes.push({ FromDomain: [], ToDomain: [], MinimumAttempts: 0, Transport: transportNames[0] });
+			routes.push({ FromDomain: [], ToDomain: [], MinimumAttempts: 0, Transport: transportNames[0], IPPool: '' });
 			render();
-		})))), dom.tbody((routes || []).length === 0 ? dom.tr(dom.td(attr.colspan('5'), 'No routes.')) : [], routeRows = (routes || []).map((r, index) => {
+		})))), dom.tbody((routes || []).length === 0 ? dom.tr(dom.td(attr.colspan('6'), 'No routes.')) : [], routeRows = (routes || []).map((r, index) => {
 			let fromDomain = dom.input(attr.value((r.FromDomain || []).join(',')));
 			let toDomain = dom.input(attr.value((r.ToDomain || []).join(',')));
 			let minimumAttempts = dom.input(attr.value('' + r.MinimumAttempts));
 			let transport = dom.select(attr.required(''), transportNames.map(s => dom.option(s, s === r.Transport ? attr.selected('') : [])));
-			const tr = dom.tr(dom.td(fromDomain), dom.td(toDomain), dom.td(minimumAttempts), dom.td(transport), dom.td(dom.clickbutton('Remove', function click() {
+			let ipPool = dom.input(attr.value(r.IPPool || ''));
+			const tr = dom.tr(dom.td(fromDomain), dom.td(toDomain), dom.td(minimumAttempts), dom.td(transport), dom.td(ipPool), dom.td(dom.clickbutton('Remove', function click() {
 				routeRows.splice(index, 1);
 				routes = routeRows.map(rr => rr.gather());
 				render();
@@ -2069,6 +2463,7 @@ const RoutesEditor = (kind, transports, routes, save) => {
 						ToDomain: toDomain.value ? toDomain.value.split(',') : [],
 						MinimumAttempts: parseInt(minimumAttempts.value) || 0,
 						Transport: transport.value,
+						IPPool: ipPool.value,
 					};
 				},
 			};
@@ -2077,7 +2472,7 @@ const RoutesEditor = (kind, transports, routes, save) => {
 			// Keep it short.
 			elem = dom.div('No ' + kind + ' routes configured. ', dom.clickbutton('Add', function click() {
 				routes = routeRows.map(rr => rr.gather());
-				routes.push({ FromDomain: [], ToDomain: [], MinimumAttempts: 0, Transport: transportNames[0] });
+				routes.push({ FromDomain: [], ToDomain: [], MinimumAttempts: 0, Transport: transportNames[0], IPPool: '' });
 				render();
 			}));
 		}
@@ -2094,7 +2489,7 @@ const account = async (name) => {
 	const [[config, diskUsage], domains, transports] = await Promise.all([
 		client.Account(name),
 		client.Domains(),
-		client.Transports(),
+		transportsOrNone(),
 	]);
 	// todo: show suppression list, and buttons to add/remove entries.
 	let form;
@@ -2201,6 +2596,13 @@ const account = async (name) => {
 		}
 		await check(e.target, client.AccountRemove(name));
 		window.location.hash = '#accounts';
+	}), ' ', dom.clickbutton('Disable two-factor authentication', attr.title('Disable two-factor authentication for the web interfaces, e.g. after the user lost their authenticator app and recovery codes.'), async function click(e) {
+		e.preventDefault();
+		if (!window.confirm('Are you sure you want to disable two-factor authentication for this account? Logging in to the web interfaces will only require the password.')) {
+			return;
+		}
+		await check(e.target, client.AccountTOTPDisable(name));
+		window.alert('Two-factor authentication has been disabled.');
 	}));
 };
 const second = 1000 * 1000 * 1000;
@@ -2267,7 +2669,7 @@ const domain = async (d) => {
 		client.ClientConfigsDomain(d),
 		client.Accounts(),
 		client.DomainConfig(d),
-		client.Transports(),
+		transportsOrNone(),
 	]);
 	let addrForm;
 	let addrFieldset;
@@ -3146,10 +3548,11 @@ const dnsbl = async () => {
 const queueList = async () => {
 	let filter = { Max: parseInt(localStorageGet('adminpaginationsize') || '') || 100, IDs: [], Account: '', From: '', To: '', Hold: null, Submitted: '', NextAttempt: '', Transport: null };
 	let sort = { Field: "NextAttempt", LastID: 0, Last: null, Asc: true };
-	let [holdRules, msgs0, transports] = await Promise.all([
+	let [holdRules, msgs0, transports, rateLimits] = await Promise.all([
 		client.QueueHoldRuleList(),
 		client.QueueList(filter, sort),
 		client.Transports(),
+		client.QueueRateLimits(),
 	]);
 	let msgs = msgs0 || [];
 	// todo: more sorting
@@ -3211,7 +3614,7 @@ const queueList = async () => {
 		const ntbody = dom.tbody(dom._class('loadend'), msgs.length === 0 ? dom.tr(dom.td(attr.colspan('15'), 'No messages.')) : [], msgs.map(m => {
 			return dom.tr(dom.td(toggles.get(m.ID)), dom.td('' + m.ID + (m.BaseID > 0 ? '/' + m.BaseID : '')), dom.td(age(new Date(m.Queued), false, nowSecs)), dom.td(m.SenderAccount || '-'), dom.td(prewrap(m.SenderLocalpart, "@", ipdomainString(m.SenderDomain))), // todo: escaping of localpart
 			dom.td(prewrap(m.RecipientLocalpart, "@", ipdomainString(m.RecipientDomain))), // todo: escaping of localpart
-			dom.td(formatSize(m.Size)), dom.td('' + m.Attempts), dom.td(m.Hold ? 'Hold' : ''), dom.td(age(new Date(m.NextAttempt), true, nowSecs)), dom.td(m.LastAttempt ? age(new Date(m.LastAttempt), false, nowSecs) : '-'), dom.td(m.Results && m.Results.length > 0 ? m.Results[m.Results.length - 1].Error : []), dom.td(m.Transport || '(default)'), dom.td(m.RequireTLS === true ? 'Yes' : (m.RequireTLS === false ? 'No' : '')), dom.td(dom.clickbutton('Details', function click() {
+			dom.td(formatSize(m.Size)), dom.td('' + m.Attempts), dom.td(m.Hold ? 'Hold' : ''), dom.td(age(new Date(m.NextAttempt), true, nowSecs), m.RateLimited ? [' ', dom.span(attr.title('The previous delivery attempt was postponed by this outgoing rate limit, without counting as an attempt.'), '(rate limit ', m.RateLimited, ')')] : []), dom.td(m.LastAttempt ? age(new Date(m.LastAttempt), false, nowSecs) : '-'), dom.td(m.Results && m.Results.length > 0 ? m.Results[m.Results.length - 1].Error : []), dom.td(m.Transport || '(default)'), dom.td(m.RequireTLS === true ? 'Yes' : (m.RequireTLS === false ? 'No' : '')), dom.td(dom.clickbutton('Details', function click() {
 				popupDetails(m);
 			})));
 		}));
@@ -3268,7 +3671,11 @@ const queueList = async () => {
 		};
 		renderHoldRules();
 		return box;
-	})(), dom.br(), 
+	})(), dom.br(), (rateLimits || []).length === 0 ? [] : [
+		dom.h2('Outgoing rate limits', attr.title('Rate limits are configured in mox.conf. Messages that would exceed a limit stay in the queue until the limit allows delivery, without counting as a delivery attempt.')),
+		dom.table(dom.thead(dom.tr(dom.th('Name'), dom.th('Applies to'), dom.th('Messages last minute'), dom.th('Connections'), dom.th('Messages today', attr.title('Only counted for limits with a warm-up schedule.')), dom.th('Limited until'))), dom.tbody((rateLimits || []).map(rl => dom.tr(dom.td(rl.Name), dom.td(rl.AppliesTo), dom.td('' + rl.MessagesLastMinute + (rl.MessagesPerMinute > 0 ? ' / ' + rl.MessagesPerMinute : '')), dom.td('' + rl.Connections + (rl.MaxConnections > 0 ? ' / ' + rl.MaxConnections : '')), dom.td(rl.WarmupLimitToday > 0 ? '' + rl.MessagesToday + ' / ' + rl.WarmupLimitToday : '-'), dom.td(rl.LimitedUntil ? age(new Date(rl.LimitedUntil), true, nowSecs) : '-'))))),
+		dom.br(),
+	], 
 	// Filtering.
 	filterForm = dom.form(attr.id('queuefilter'), // Referenced by input elements in table row.
 	async function submit(e) {
@@ -4036,6 +4443,15 @@ const init = async () => {
 			else if (h === 'loglevels') {
 				await loglevels();
 			}
+			else if (h === 'twofactor') {
+				await twoFactor();
+			}
+			else if (h === 'adminusers') {
+				await adminUsers();
+			}
+			else if (h === 'auditlog') {
+				await auditLog();
+			}
 			else if (h === 'accounts') {
 				await accounts();
 			}
@@ -12,7 +12,12 @@ const login = async (reason: string) => {
 		const origFocus = document.activeElement
 		let reasonElem: HTMLElement
 		let fieldset: HTMLFieldSetElement
+		let username: HTMLInputElement
 		let password: HTMLInputElement
+		let totpBox: HTMLElement
+		let totp: HTMLInputElement
+		// Set after a valid password when a TOTP code is required for the login.
+		let totpLoginToken = ''
 		const root = dom.div(
 			style({position: 'absolute', top: 0, right: 0, bottom: 0, left: 0, backgroundColor: '#eee', display: 'flex', alignItems: 'center', justifyContent: 'center', zIndex: '1', animation: 'fadein .15s ease-in'}),
 			dom.div(
@@ -28,13 +33,30 @@ const login = async (reason: string) => {
 
 							try {
 								fieldset.disabled = true
-								const loginToken = await client.LoginPrep()
-								const token = await client.Login(loginToken, password.value)
+								let token: string
+								if (totpLoginToken) {
+									token = await client.LoginTOTP(totpLoginToken, totp.value)
+								} else {
+									const loginToken = await client.LoginPrep()
+									try {
+										token = await client.Login(loginToken, username.value, password.value)
+									} catch (err) {
+										if ((err as any).code !== 'user:totpRequired') {
+											throw err
+										}
+										// Password is valid, a code from the authenticator app is needed too.
+										totpLoginToken = loginToken
+										totpBox.style.display = 'block'
+										totp.required = true
+										return
+									}
+								}
 								try {
 									window.localStorage.setItem('webadmincsrftoken', token)
 								} catch (err) {
 									console.log('saving csrf token in localStorage', err)
 								}
+								currentAdmin = null
 								root.remove()
 								if (origFocus && origFocus instanceof HTMLElement && origFocus.parentNode) {
 									origFocus.focus()
@@ -43,17 +65,37 @@ const login = async (reason: string) => {
 							} catch (err) {
 								console.log('login error', err)
 								window.alert('Error: ' + errmsg(err))
+								if (totpLoginToken && (err as any).code !== 'user:loginFailed') {
+									// Login expired, start again with the password.
+									totpLoginToken = ''
+									totpBox.style.display = 'none'
+									totp.required = false
+								}
 							} finally {
 								fieldset.disabled = false
+								if (totpLoginToken) {
+									totp.focus()
+								}
 							}
 						},
 						fieldset=dom.fieldset(
 							dom.h1('Admin'),
+							dom.label(
+								style({display: 'block', marginBottom: '2ex'}),
+								dom.div('Username', style({marginBottom: '.5ex'})),
+								username=dom.input(attr.autocomplete('username'), attr.placeholder('Empty for admin password')),
+							),
 							dom.label(
 								style({display: 'block', marginBottom: '2ex'}),
 								dom.div('Password', style({marginBottom: '.5ex'})),
 								password=dom.input(attr.type('password'), attr.required('')),
 							),
+							totpBox=dom.label(
+								style({display: 'none', marginBottom: '2ex'}),
+								dom.div('Two-factor authentication code', style({marginBottom: '.5ex'})),
+								totp=dom.input(attr.autocomplete('one-time-code')),
+								dom.div('From your authenticator app.', style({marginTop: '.5ex', fontSize: '.9em'})),
+							),
 							dom.div(
 								style({textAlign: 'center'}),
 								dom.submitbutton('Login'),
@@ -64,7 +106,7 @@ const login = async (reason: string) => {
 			)
 		)
 		document.body.appendChild(root)
-		password.focus()
+		username.focus()
 	})
 }
 
@@ -127,6 +169,25 @@ const localStorageRemove = (k: string) => {
 
 const client = new api.Client().withOptions({csrfHeader: 'x-mox-csrf', login: login}).withAuthToken(localStorageGet('webadmincsrftoken') || '')
 
+// Admin user of the session, cleared on login.
+let currentAdmin: api.User | null = null
+
+const adminUser = async (): Promise<api.User> => {
+	if (!currentAdmin) {
+		currentAdmin = await client.AdminUserCurrent()
+	}
+	return currentAdmin
+}
+
+// Domain admins cannot view the transports, and cannot change routes.
+const transportsOrNone = async (): Promise<{ [key: string]: api.Transport }> => {
+	const admin = await adminUser()
+	if (admin.Role === api.Role.RoleDomain) {
+		return {}
+	}
+	return await client.Transports() || {}
+}
+
 const check = async <T>(elem: {disabled: boolean}, p: Promise<T>): Promise<T> => {
 	try {
 		elem.disabled = true
@@ -329,11 +390,14 @@ const formatSize = (n: number) => {
 }
 
 const index = async () => {
+	const admin = await adminUser()
+	const isAdmin = admin.Role === api.Role.RoleAdmin
+	const isDomainAdmin = admin.Role === api.Role.RoleDomain
 	const [domains, queueSize, hooksQueueSize, checkUpdatesEnabled, accounts] = await Promise.all([
 		client.Domains(),
-		client.QueueSize(),
-		client.HookQueueSize(),
-		client.CheckUpdatesEnabled(),
+		isDomainAdmin ? 0 : client.QueueSize(),
+		isDomainAdmin ? 0 : client.HookQueueSize(),
+		isDomainAdmin ? true : client.CheckUpdatesEnabled(),
 		client.Accounts(),
 	])
 
@@ -348,17 +412,21 @@ const index = async () => {
 
 	dom._kids(page,
 		crumbs('Mox Admin'),
+		admin.Name ? dom.p('Logged in as admin user ', dom.b(admin.Name), ', with role ', admin.Role, '.') : [],
 		checkUpdatesEnabled ? [] : dom.p(box(yellow, 'Warning: Checking for updates has not been enabled in mox.conf (CheckUpdates: true).', dom.br(), 'Make sure you stay up to date through another mechanism!', dom.br(), 'You have a responsibility to keep the internet-connected software you run up to date and secure!', dom.br(), 'See ', link('https://updates.xmox.nl/changelog'))),
 		dom.p(
 			dom.a('Accounts', attr.href('#accounts')), dom.br(),
-			dom.a('Queue', attr.href('#queue')), ' ('+queueSize+')', dom.br(),
-			dom.a('Webhook queue', attr.href('#webhookqueue')), ' ('+hooksQueueSize+')', dom.br(),
+			isDomainAdmin ? [] : [
+				dom.a('Queue', attr.href('#queue')), ' ('+queueSize+')', dom.br(),
+				dom.a('Webhook queue', attr.href('#webhookqueue')), ' ('+hooksQueueSize+')', dom.br(),
+			],
 		),
 		dom.h2('Domains'),
 		(domains || []).length === 0 ? box(red, 'No domains') :
 		dom.ul(
 			(domains || []).map(d => dom.li(dom.a(attr.href('#domains/'+domainName(d)), domainString(d)))),
 		),
+		!isAdmin ? [] : [
 		dom.br(),
 		dom.h2('Add domain'),
 		dom.form(
@@ -394,6 +462,8 @@ const index = async () => {
 				dom.submitbutton('Add domain', attr.title('Domain will be added and the config reloaded. Add the required DNS records after adding the domain.')),
 			),
 		),
+		],
+		isDomainAdmin ? [] : [
 		dom.br(),
 		dom.h2('Reports'),
 		dom.div(dom.a('DMARC', attr.href('#dmarc/reports'))),
@@ -429,6 +499,11 @@ const index = async () => {
 		dom.div(dom.a('Webserver', attr.href('#webserver'))),
 		dom.div(dom.a('Files', attr.href('#config'))),
 		dom.div(dom.a('Log levels', attr.href('#loglevels'))),
+		isAdmin ? dom.div(dom.a('Admin users', attr.href('#adminusers'))) : [],
+		dom.div(dom.a('Audit log', attr.href('#auditlog'))),
+		],
+		isDomainAdmin ? [dom.br(), dom.h2('Configuration')] : [],
+		dom.div(dom.a('Two-factor authentication', attr.href('#twofactor'))),
 		footer,
 	)
 }
@@ -463,6 +538,363 @@ const config = async () => {
 	)
 }
 
+const twoFactor = async () => {
+	const enabled = await client.TOTPStatus()
+
+	let setupBox: HTMLElement
+	let fieldset: HTMLFieldSetElement
+	let code: HTMLInputElement
+
+	dom._kids(page,
+		crumbs(
+			crumblink('Mox Admin', '#'),
+			'Two-factor authentication',
+		),
+		dom.p('With two-factor authentication, logging in to the admin web interface requires a code from an authenticator app in addition to the password. To disable it for the admin password without the web interface, remove the file with the name of the admin password file and ".totp" appended from the config directory. For admin users, an admin can disable it.'),
+		enabled ? [
+			dom.p('Two-factor authentication is enabled.'),
+			dom.clickbutton('Disable two-factor authentication', async function click(e: MouseEvent) {
+				if (!window.confirm('Are you sure you want to disable two-factor authentication? Logging in will only require the admin password.')) {
+					return
+				}
+				await check(e.target! as HTMLButtonElement, client.TOTPDisable())
+				window.location.reload() // todo: reload less
+			}),
+		] : setupBox=dom.div(
+			dom.clickbutton('Set up two-factor authentication', async function click(e: MouseEvent) {
+				const setup = await check(e.target! as HTMLButtonElement, client.TOTPSetupStart())
+				dom._kids(setupBox,
+					dom.p('Scan the QR code with your authenticator app, or enter the secret manually. Then enter the code shown by the app to enable two-factor authentication.'),
+					dom.img(attr.src(setup.QRCodePNG), attr.title(setup.URI), style({width: '15em', imageRendering: 'pixelated'})),
+					dom.p('Secret: ', dom.span(style({fontFamily: 'monospace'}), setup.Secret)),
+					dom.form(
+						async function submit(e: SubmitEvent) {
+							e.preventDefault()
+							e.stopPropagation()
+							await check(fieldset, client.TOTPSetupConfirm(code.value))
+							window.alert('Two-factor authentication is now enabled.')
+							window.location.reload() // todo: reload less
+						},
+						fieldset=dom.fieldset(
+							dom.label(
+								style({display: 'inline-block'}),
+								dom.div('Code'),
+								code=dom.input(attr.required(''), attr.autocomplete('one-time-code')),
+							),
+							' ',
+							dom.submitbutton('Enable'),
+						),
+					),
+				)
+			}),
+		),
+	)
+}
+
+const adminUsers = async () => {
+	const [users, domains] = await Promise.all([
+		client.AdminUsers(),
+		client.Domains(),
+	])
+
+	const roles = [api.Role.RoleAdmin, api.Role.RoleReadOnly, api.Role.RoleQueue, api.Role.RoleDomain]
+	const domainNames = (domains || []).map(d => domainName(d))
+
+	// Form fields for role, domains and unix user, for adding and editing users.
+	const userFields = (u: api.User | null) => {
+		const role = dom.select(attr.required(''), roles.map(r => dom.option(r, u && u.Role === r ? attr.selected('') : [])))
+		const userDomains = dom.select(attr.multiple(''), attr.size(''+Math.min(5, Math.max(2, domainNames.length))), domainNames.map(d => dom.option(d, u && (u.Domains || []).includes(d) ? attr.selected('') : [])))
+		const unixUser = dom.input(attr.value(u ? u.UnixUser : ''))
+		const elem = [
+			dom.label(
+				style({display: 'inline-block'}),
+				dom.span('Role', attr.title('Admin has full access. Read-only can view but not change configuration, queues and reports. Queue is like read-only, but can also manage the message and webhook queues. Domain can only view and change the selected domains, and their accounts, addresses and aliases.')),
+				dom.br(),
+				role,
+			),
+			' ',
+			dom.label(
+				style({display: 'inline-block', verticalAlign: 'top'}),
+				dom.span('Domains', attr.title('For role "domain", the domains the user manages. Accounts with one of these domains as default domain are managed by the user too.')),
+				dom.br(),
+				userDomains,
+			),
+			' ',
+			dom.label(
+				style({display: 'inline-block'}),
+				dom.span('Unix user', attr.title('Optional. Connections to the ctl socket, e.g. by running "mox" commands, by this unix user are limited to the role of this admin user. Once any admin user has a unix user, other unix users not associated with an admin user are denied, except root and the unix user mox runs as. Only supported on Linux, other platforms deny all connections.')),
+				dom.br(),
+				unixUser,
+			),
+		]
+		const value = (name: string): api.User => {
+			return {
+				Name: name,
+				Created: new Date(),
+				Role: role.value as api.Role,
+				Domains: role.value === api.Role.RoleDomain ? Array.from(userDomains.selectedOptions).map(o => o.value) : [],
+				UnixUser: unixUser.value,
+			}
+		}
+		return {elem, value}
+	}
+
+	const editUser = (u: api.User) => {
+		let fieldset: HTMLFieldSetElement
+		const fields = userFields(u)
+		const close = popup(
+			dom.h1('Edit admin user ', u.Name),
+			dom.form(
+				async function submit(e: SubmitEvent) {
+					e.preventDefault()
+					e.stopPropagation()
+					await check(fieldset, client.AdminUserSave(fields.value(u.Name)))
+					close()
+					window.location.reload() // todo: reload less
+				},
+				fieldset=dom.fieldset(
+					fields.elem,
+					' ',
+					dom.submitbutton('Save'),
+				),
+			),
+		)
+	}
+
+	let fieldset: HTMLFieldSetElement
+	let name: HTMLInputElement
+	let password: HTMLInputElement
+	const addFields = userFields(null)
+
+	dom._kids(page,
+		crumbs(
+			crumblink('Mox Admin', '#'),
+			'Admin users',
+		),
+		dom.p('Admin users can log in to the admin web interface with their own password, and their role limits what they can view and change. The admin password remains valid for full admin access. Admin users can also be associated with a unix user, limiting connections to the ctl socket by that unix user.'),
+		dom.table(dom._class('hover'),
+			dom.thead(
+				dom.tr(
+					dom.th('Name'),
+					dom.th('Role'),
+					dom.th('Domains'),
+					dom.th('Unix user'),
+					dom.th('Created'),
+					dom.th('Action'),
+				),
+			),
+			dom.tbody(
+				(users || []).length === 0 ? dom.tr(dom.td(attr.colspan('6'), 'None')) : [],
+				(users || []).map(u =>
+					dom.tr(
+						dom.td(u.Name),
+						dom.td(u.Role),
+						dom.td((u.Domains || []).join(', ')),
+						dom.td(u.UnixUser),
+						dom.td(u.Created.toLocaleString()),
+						dom.td(
+							dom.clickbutton('Edit', function click() {
+								editUser(u)
+							}), ' ',
+							dom.clickbutton('Set password', attr.title('Set a new password for the user. Existing sessions of the user are ended.'), async function click(e: MouseEvent) {
+								const pw = window.prompt('New password, at least 8 characters. Leave empty to disable logins to the admin web interface.')
+								if (pw === null) {
+									return
+								}
+								await check(e.target! as HTMLButtonElement, client.AdminUserPasswordSet(u.Name, pw))
+								window.alert('Password has been changed.')
+							}), ' ',
+							dom.clickbutton('Disable two-factor authentication', async function click(e: MouseEvent) {
+								if (!window.confirm('Are you sure you want to disable two-factor authentication for this user?')) {
+									return
+								}
+								await check(e.target! as HTMLButtonElement, client.AdminUserTOTPDisable(u.Name))
+								window.alert('Two-factor authentication has been disabled.')
+							}), ' ',
+							dom.clickbutton('Remove', async function click(e: MouseEvent) {
+								if (!window.confirm('Are you sure you want to remove this admin user?')) {
+									return
+								}
+								await check(e.target! as HTMLButtonElement, client.AdminUserRemove(u.Name))
+								window.location.reload() // todo: reload less
+							}),
+						),
+					)
+				),
+			),
+		),
+		dom.br(),
+		dom.h2('Add admin user'),
+		dom.form(
+			async function submit(e: SubmitEvent) {
+				e.preventDefault()
+				e.stopPropagation()
+				await check(fieldset, client.AdminUserAdd(addFields.value(name.value), password.value))
+				window.location.reload() // todo: reload less
+			},
+			fieldset=dom.fieldset(
+				dom.label(
+					style({display: 'inline-block'}),
+					dom.span('Name'),
+					dom.br(),
+					name=dom.input(attr.required('')),
+				),
+				' ',
+				addFields.elem,
+				' ',
+				dom.label(
+					style({display: 'inline-block'}),
+					dom.span('Password', attr.title('Optional, at least 8 characters. Without password, the user cannot log in to the admin web interface.')),
+					dom.br(),
+					password=dom.input(attr.type('password'), attr.autocomplete('new-password')),
+				),
+				' ',
+				dom.submitbutton('Add admin user'),
+			),
+		),
+	)
+}
+
+const auditLog = async () => {
+	const filter: api.AuditFilter = {Max: parseInt(localStorageGet('adminpaginationsize') || '') || 100, Source: api.AuditSource.AuditSourceNone, Actor: '', Kind: api.AuditKind.AuditKindAny, Operation: '', Start: null, End: null, Text: ''}
+	const entries = await client.AuditList(filter)
+
+	let fieldset: HTMLFieldSetElement
+	let source: HTMLSelectElement
+	let actor: HTMLInputElement
+	let kind: HTMLSelectElement
+	let operation: HTMLInputElement
+	let start: HTMLInputElement
+	let end: HTMLInputElement
+	let text: HTMLInputElement
+	let exportFilter: HTMLInputElement
+	let tbody: HTMLTableSectionElement
+
+	// Gather the filter from the form fields. End date is inclusive in the form.
+	const formFilter = (): api.AuditFilter => {
+		return {
+			Max: filter.Max,
+			Source: source.value as api.AuditSource,
+			Actor: actor.value,
+			Kind: kind.value as api.AuditKind,
+			Operation: operation.value,
+			Start: start.value ? new Date(start.value) : null,
+			End: end.value ? new Date(new Date(end.value).getTime() + 24*3600*1000) : null,
+			Text: text.value,
+		}
+	}
+
+	const render = (l: api.AuditEntry[] | null) => {
+		dom._kids(tbody,
+			(l || []).length === 0 ? dom.tr(dom.td(attr.colspan('7'), 'No entries.')) : [],
+			(l || []).map(e =>
+				dom.tr(
+					dom.td(e.Time.toLocaleString()),
+					dom.td(e.Source || '-'),
+					dom.td(e.Actor || (e.Source === api.AuditSource.AuditSourceWebadmin ? '(admin password)' : '-'), e.RemoteIP ? dom.div(e.RemoteIP) : []),
+					dom.td(e.Operation),
+					dom.td(e.Kind),
+					dom.td(e.Details),
+					dom.td(e.Diff ? dom.pre(dom._class('literal'), style({maxHeight: '20em', overflow: 'auto'}), e.Diff) : []),
+				)
+			),
+		)
+	}
+
+	dom._kids(page,
+		crumbs(
+			crumblink('Mox Admin', '#'),
+			'Audit log',
+		),
+		dom.p('The audit log has changes to the configuration (domains.conf), operations on the queues, and password changes, made through the admin and account web interfaces and the "mox" command-line. The newest entries are listed first. The admin password can only be set from the command-line without a running mox, those changes are not in the audit log.'),
+		dom.form(
+			async function submit(e: SubmitEvent) {
+				e.preventDefault()
+				e.stopPropagation()
+				const l = await check(fieldset, client.AuditList(formFilter()))
+				render(l)
+			},
+			fieldset=dom.fieldset(
+				dom.label(
+					style({display: 'inline-block'}),
+					dom.span('Source'), dom.br(),
+					source=dom.select(
+						dom.option('', attr.value('')),
+						Object.values(api.AuditSource).filter(s => s).map(s => dom.option(s)),
+					),
+				),
+				' ',
+				dom.label(
+					style({display: 'inline-block'}),
+					dom.span('Actor', attr.title('Admin user, account, or unix user for ctl.')), dom.br(),
+					actor=dom.input(),
+				),
+				' ',
+				dom.label(
+					style({display: 'inline-block'}),
+					dom.span('Kind'), dom.br(),
+					kind=dom.select(
+						dom.option('', attr.value('')),
+						Object.values(api.AuditKind).filter(k => k).map(k => dom.option(k)),
+					),
+				),
+				' ',
+				dom.label(
+					style({display: 'inline-block'}),
+					dom.span('Operation', attr.title('API function or ctl command.')), dom.br(),
+					operation=dom.input(),
+				),
+				' ',
+				dom.label(
+					style({display: 'inline-block'}),
+					dom.span('From'), dom.br(),
+					start=dom.input(attr.type('date')),
+				),
+				' ',
+				dom.label(
+					style({display: 'inline-block'}),
+					dom.span('Until', attr.title('Inclusive.')), dom.br(),
+					end=dom.input(attr.type('date')),
+				),
+				' ',
+				dom.label(
+					style({display: 'inline-block'}),
+					dom.span('Text', attr.title('Case-insensitive text to search for in details and diff.')), dom.br(),
+					text=dom.input(),
+				),
+				' ',
+				dom.submitbutton('Search'),
+			),
+		),
+		dom.form(
+			attr.target('_blank'), attr.method('POST'), attr.action('auditlog'),
+			function submit() {
+				// Form is submitted normally, for downloading the file.
+				exportFilter.value = JSON.stringify(formFilter())
+			},
+			dom.input(attr.type('hidden'), attr.name('csrf'), attr.value(localStorageGet('webadmincsrftoken') || '')),
+			exportFilter=dom.input(attr.type('hidden'), attr.name('filter')),
+			dom.submitbutton('Export as JSON lines', attr.title('Export all entries matching the filter, oldest first.')),
+		),
+		dom.br(),
+		dom.table(dom._class('hover'),
+			dom.thead(
+				dom.tr(
+					dom.th('Time'),
+					dom.th('Source'),
+					dom.th('Actor'),
+					dom.th('Operation'),
+					dom.th('Kind'),
+					dom.th('Details'),
+					dom.th('Diff'),
+				),
+			),
+			tbody=dom.tbody(),
+		),
+	)
+	render(entries)
+}
+
 const loglevels = async () => {
 	const loglevels = await client.LogLevels()
 
@@ -688,28 +1120,31 @@ const RoutesEditor = (kind: string, transports: { [key: string]: api.Transport }
 							dom.th('To domain'),
 							dom.th('Minimum attempts'),
 							dom.th('Transport'),
+							dom.th('IP pool', attr.title('Optional name of an IP pool of a direct transport to deliver from. If set, the transport of the IP pool is used.')),
 							dom.th(
 								dom.clickbutton('Add', function click() {
 									routes = routeRows.map(rr => rr.gather())
-									routes.push({FromDomain: [], ToDomain: [], MinimumAttempts: 0, Transport: transportNames[0]})
+									routes.push({FromDomain: [], ToDomain: [], MinimumAttempts: 0, Transport: transportNames[0], IPPool: ''})
 									render()
 								}),
 							),
 						),
 					),
 					dom.tbody(
-						(routes || []).length === 0 ? dom.tr(dom.td(attr.colspan('5'), 'No routes.')) : [],
+						(routes || []).length === 0 ? dom.tr(dom.td(attr.colspan('6'), 'No routes.')) : [],
 						routeRows=(routes || []).map((r, index) => {
 							let fromDomain = dom.input(attr.value((r.FromDomain || []).join(',')))
 							let toDomain = dom.input(attr.value((r.ToDomain || []).join(',')))
 							let minimumAttempts = dom.input(attr.value(''+r.MinimumAttempts))
 							let transport = dom.select(attr.required(''), transportNames.map(s => dom.option(s, s === r.Transport ? attr.selected('') : [])))
+							let ipPool = dom.input(attr.value(r.IPPool || ''))
 
 							const tr = dom.tr(
 								dom.td(fromDomain),
 								dom.td(toDomain),
 								dom.td(minimumAttempts),
 								dom.td(transport),
+								dom.td(ipPool),
 								dom.td(
 									dom.clickbutton('Remove', function click() {
 										routeRows.splice(index, 1)
@@ -726,6 +1161,7 @@ const RoutesEditor = (kind: string, transports: { [key: string]: api.Transport }
 										ToDomain: toDomain.value ? toDomain.value.split(',') : [],
 										MinimumAttempts: parseInt(minimumAttempts.value) || 0,
 										Transport: transport.value,
+										IPPool: ipPool.value,
 									}
 								},
 							}
@@ -741,7 +1177,7 @@ const RoutesEditor = (kind: string, transports: { [key: string]: api.Transport }
 				'No '+kind+' routes configured. ',
 				dom.clickbutton('Add', function click() {
 					routes = routeRows.map(rr => rr.gather())
-					routes.push({FromDomain: [], ToDomain: [], MinimumAttempts: 0, Transport: transportNames[0]})
+					routes.push({FromDomain: [], ToDomain: [], MinimumAttempts: 0, Transport: transportNames[0], IPPool: ''})
 					render()
 				}),
 			)
@@ -760,7 +1196,7 @@ const account = async (name: string) => {
 	const [[config, diskUsage], domains, transports] = await Promise.all([
 		client.Account(name),
 		client.Domains(),
-		client.Transports(),
+		transportsOrNone(),
 	])
 
 	// todo: show suppression list, and buttons to add/remove entries.
@@ -1005,6 +1441,15 @@ const account = async (name: string) => {
 			await check(e.target! as HTMLButtonElement, client.AccountRemove(name))
 			window.location.hash = '#accounts'
 		}),
+		' ',
+		dom.clickbutton('Disable two-factor authentication', attr.title('Disable two-factor authentication for the web interfaces, e.g. after the user lost their authenticator app and recovery codes.'), async function click(e: MouseEvent) {
+			e.preventDefault()
+			if (!window.confirm('Are you sure you want to disable two-factor authentication for this account? Logging in to the web interfaces will only require the password.')) {
+				return
+			}
+			await check(e.target! as HTMLButtonElement, client.AccountTOTPDisable(name))
+			window.alert('Two-factor authentication has been disabled.')
+		}),
 	)
 }
 
@@ -1053,7 +1498,7 @@ const domain = async (d: string) => {
 		client.ClientConfigsDomain(d),
 		client.Accounts(),
 		client.DomainConfig(d),
-		client.Transports(),
+		transportsOrNone(),
 	])
 
 	let addrForm: HTMLFormElement
@@ -3111,10 +3556,11 @@ const dnsbl = async () => {
 const queueList = async () => {
 	let filter: api.Filter = {Max: parseInt(localStorageGet('adminpaginationsize') || '') || 100, IDs: [], Account: '', From: '', To: '', Hold: null, Submitted: '', NextAttempt: '', Transport: null}
 	let sort: api.Sort = {Field: "NextAttempt", LastID: 0, Last: null, Asc: true}
-	let [holdRules, msgs0, transports] = await Promise.all([
+	let [holdRules, msgs0, transports, rateLimits] = await Promise.all([
 		client.QueueHoldRuleList(),
 		client.QueueList(filter, sort),
 		client.Transports(),
+		client.QueueRateLimits(),
 	])
 	let msgs: api.Msg[] = msgs0 || []
 
@@ -3224,7 +3670,10 @@ const queueList = async () => {
 					dom.td(formatSize(m.Size)),
 					dom.td(''+m.Attempts),
 					dom.td(m.Hold ? 'Hold' : ''),
-					dom.td(age(new Date(m.NextAttempt), true, nowSecs)),
+					dom.td(
+						age(new Date(m.NextAttempt), true, nowSecs),
+						m.RateLimited ? [' ', dom.span(attr.title('The previous delivery attempt was postponed by this outgoing rate limit, without counting as an attempt.'), '(rate limit ', m.RateLimited, ')')] : [],
+					),
 					dom.td(m.LastAttempt ? age(new Date(m.LastAttempt), false, nowSecs) : '-'),
 					dom.td(m.Results && m.Results.length > 0 ? m.Results[m.Results.length-1].Error : []),
 					dom.td(m.Transport || '(default)'),
@@ -3336,6 +3785,35 @@ const queueList = async () => {
 		})(),
 		dom.br(),
 
+		(rateLimits || []).length === 0 ? [] : [
+			dom.h2('Outgoing rate limits', attr.title('Rate limits are configured in mox.conf. Messages that would exceed a limit stay in the queue until the limit allows delivery, without counting as a delivery attempt.')),
+			dom.table(
+				dom.thead(
+					dom.tr(
+						dom.th('Name'),
+						dom.th('Applies to'),
+						dom.th('Messages last minute'),
+						dom.th('Connections'),
+						dom.th('Messages today', attr.title('Only counted for limits with a warm-up schedule.')),
+						dom.th('Limited until'),
+					),
+				),
+				dom.tbody(
+					(rateLimits || []).map(rl =>
+						dom.tr(
+							dom.td(rl.Name),
+							dom.td(rl.AppliesTo),
+							dom.td(''+rl.MessagesLastMinute + (rl.MessagesPerMinute > 0 ? ' / '+rl.MessagesPerMinute : '')),
+							dom.td(''+rl.Connections + (rl.MaxConnections > 0 ? ' / '+rl.MaxConnections : '')),
+							dom.td(rl.WarmupLimitToday > 0 ? ''+rl.MessagesToday+' / '+rl.WarmupLimitToday : '-'),
+							dom.td(rl.LimitedUntil ? age(new Date(rl.LimitedUntil), true, nowSecs) : '-'),
+						)
+					),
+				),
+			),
+			dom.br(),
+		],
+
 		// Filtering.
 		filterForm=dom.form(
 			attr.id('queuefilter'), // Referenced by input elements in table row.
@@ -5125,6 +5603,12 @@ const init = async () => {
 				await config()
 			} else if (h === 'loglevels') {
 				await loglevels()
+			} else if (h === 'twofactor') {
+				await twoFactor()
+			} else if (h === 'adminusers') {
+				await adminUsers()
+			} else if (h === 'auditlog') {
+				await auditLog()
 			} else if (h === 'accounts') {
 				await accounts()
 			} else if (t[0] === 'accounts' && t.length === 2) {
@@ -10,6 +10,7 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -22,6 +23,7 @@ import (
 
 	"github.com/mjl-/sherpa"
 
+	"github.com/mjl-/mox/admindb"
 	"github.com/mjl-/mox/config"
 	"github.com/mjl-/mox/dns"
 	"github.com/mjl-/mox/mlog"
@@ -29,6 +31,7 @@ import (
 	"github.com/mjl-/mox/mtasts"
 	"github.com/mjl-/mox/queue"
 	"github.com/mjl-/mox/store"
+	"github.com/mjl-/mox/totp"
 	"github.com/mjl-/mox/webauth"
 )
 
@@ -87,6 +90,12 @@ func TestAdminAuth(t *testing.T) {
 	mox.ConfigStaticPath = filepath.FromSlash("../testdata/webadmin/mox.conf")
 	mox.ConfigDynamicPath = filepath.Join(filepath.Dir(mox.ConfigStaticPath), "domains.conf")
 	mox.MustLoadConfig(true, false)
+	err := admindb.Init()
+	tcheck(t, err, "admindb init")
+	defer func() {
+		err := admindb.Close()
+		tcheck(t, err, "admindb close")
+	}()
 
 	adminpwhash, err := bcrypt.GenerateFromPassword([]byte("moxtest123"), bcrypt.DefaultCost)
 	tcheck(t, err, "generate bcrypt hash")
@@ -101,18 +110,18 @@ func TestAdminAuth(t *testing.T) {
 	tcheck(t, err, "sherpa handler")
 
 	respRec := httptest.NewRecorder()
-	reqInfo := requestInfo{"", respRec, &http.Request{RemoteAddr: "127.0.0.1:1234"}}
+	reqInfo := requestInfo{"", respRec, &http.Request{RemoteAddr: "127.0.0.1:1234"}, admindb.User{Role: admindb.RoleAdmin}}
 	ctx := context.WithValue(ctxbg, requestInfoCtxKey, reqInfo)
 
 	// Missing login token.
-	tneedErrorCode(t, "user:error", func() { api.Login(ctx, "", "moxtest123") })
+	tneedErrorCode(t, "user:error", func() { api.Login(ctx, "", "", "moxtest123") })
 
 	// Login with loginToken.
 	loginCookie := &http.Cookie{Name: "webadminlogin"}
 	loginCookie.Value = api.LoginPrep(ctx)
 	reqInfo.Request.Header = http.Header{"Cookie": []string{loginCookie.String()}}
 
-	csrfToken := api.Login(ctx, loginCookie.Value, "moxtest123")
+	csrfToken := api.Login(ctx, loginCookie.Value, "", "moxtest123")
 	var sessionCookie *http.Cookie
 	for _, c := range respRec.Result().Cookies() {
 		if c.Name == "webadminsession" {
@@ -127,7 +136,32 @@ func TestAdminAuth(t *testing.T) {
 	// Valid loginToken, but bad credentials.
 	loginCookie.Value = api.LoginPrep(ctx)
 	reqInfo.Request.Header = http.Header{"Cookie": []string{loginCookie.String()}}
-	tneedErrorCode(t, "user:loginFailed", func() { api.Login(ctx, loginCookie.Value, "badauth") })
+	tneedErrorCode(t, "user:loginFailed", func() { api.Login(ctx, loginCookie.Value, "", "badauth") })
+
+	// Two-factor authentication for admin.
+	defer os.Remove(path + ".totp")
+	tcompare(t, api.TOTPStatus(ctx), false)
+	tneedErrorCode(t, "user:error", func() { api.TOTPSetupConfirm(ctx, "123456") }) // Not started.
+	setup := api.TOTPSetupStart(ctx)
+	secret, err := totp.DecodeSecret(setup.Secret)
+	tcheck(t, err, "decode totp secret")
+	cur := totp.Counter(time.Now())
+	tneedErrorCode(t, "user:error", func() { api.TOTPSetupConfirm(ctx, totp.Code(secret, cur+5)) })
+	api.TOTPSetupConfirm(ctx, totp.Code(secret, cur))
+	tcompare(t, api.TOTPStatus(ctx), true)
+	tneedErrorCode(t, "user:error", func() { api.TOTPSetupStart(ctx) }) // Already enabled.
+
+	loginCookie.Value = api.LoginPrep(ctx)
+	reqInfo.Request.Header = http.Header{"Cookie": []string{loginCookie.String()}}
+	tneedErrorCode(t, "user:totpRequired", func() { api.Login(ctx, loginCookie.Value, "", "moxtest123") })
+	tneedErrorCode(t, "user:loginFailed", func() { api.LoginTOTP(ctx, loginCookie.Value, totp.Code(secret, cur)) }) // Already used.
+	api.LoginTOTP(ctx, loginCookie.Value, totp.Code(secret, cur+1))
+
+	api.TOTPDisable(ctx)
+	tneedErrorCode(t, "user:error", func() { api.TOTPDisable(ctx) })
+	loginCookie.Value = api.LoginPrep(ctx)
+	reqInfo.Request.Header = http.Header{"Cookie": []string{loginCookie.String()}}
+	api.Login(ctx, loginCookie.Value, "", "moxtest123")
 
 	type httpHeaders [][2]string
 	ctJSON := [2]string{"Content-Type", "application/json; charset=utf-8"}
@@ -204,6 +238,80 @@ func TestAdminAuth(t *testing.T) {
 	testHTTPAuthAPI("GET", "/api/Transports", http.StatusMethodNotAllowed, nil, nil)
 	testHTTPAuthAPI("POST", "/api/Transports", http.StatusOK, httpHeaders{ctJSON}, nil)
 
+	// Export of audit log as JSON lines, with CSRF token in form.
+	testExport := func(csrf string, expStatusCode int) {
+		t.Helper()
+		form := url.Values{"csrf": {csrf}, "filter": {`{"Kind": "adminuser"}`}}
+		req := httptest.NewRequest("POST", "/auditlog", strings.NewReader(form.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Add(hdrSessionOK[0], hdrSessionOK[1])
+		rr := httptest.NewRecorder()
+		handle(apiHandler, false, rr, req)
+		if rr.Code != expStatusCode {
+			t.Fatalf("got status %d, expected %d (%s)", rr.Code, expStatusCode, readBody(rr.Body))
+		}
+	}
+	testExport("", http.StatusForbidden)
+	testExport(string(csrfToken), http.StatusOK)
+
+	// Admin user with domain role, can only call functions for its domain.
+	_, err = admindb.UserAdd(ctxbg, admindb.User{Name: "domainadmin", Role: admindb.RoleDomain, Domains: []string{"mox.example"}}, "moxtest123")
+	tcheck(t, err, "add admin user")
+	loginCookie.Value = api.LoginPrep(ctx)
+	reqInfo.Request.Header = http.Header{"Cookie": []string{loginCookie.String()}}
+	tneedErrorCode(t, "user:loginFailed", func() { api.Login(ctx, loginCookie.Value, "domainadmin", "badauth") })
+	tneedErrorCode(t, "user:loginFailed", func() { api.Login(ctx, loginCookie.Value, "bogus", "moxtest123") })
+	respRec = httptest.NewRecorder()
+	reqInfo.Response = respRec
+	ctx = context.WithValue(ctxbg, requestInfoCtxKey, reqInfo)
+	domainCSRFToken := api.Login(ctx, loginCookie.Value, "domainadmin", "moxtest123")
+	var domainSessionCookie *http.Cookie
+	for _, c := range respRec.Result().Cookies() {
+		if c.Name == "webadminsession" {
+			domainSessionCookie = c
+			break
+		}
+	}
+	if domainSessionCookie == nil {
+		t.Fatalf("missing session cookie for admin user")
+	}
+	hdrDomainAuth := httpHeaders{
+		{"Cookie", (&http.Cookie{Name: "webadminsession", Value: domainSessionCookie.Value}).String()},
+		{"x-mox-csrf", string(domainCSRFToken)},
+	}
+	permissionDenied := func(resp *http.Response) {
+		t.Helper()
+		userAuthError(resp, "user:error")
+	}
+	req := httptest.NewRequest("POST", "/api/Domains", strings.NewReader(`{"params": []}`))
+	for _, kv := range hdrDomainAuth {
+		req.Header.Add(kv[0], kv[1])
+	}
+	req.Header.Add("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	handle(apiHandler, false, rr, req)
+	var domainsResp struct {
+		Result []dns.Domain  `json:"result"`
+		Error  *sherpa.Error `json:"error"`
+	}
+	err = json.NewDecoder(rr.Body).Decode(&domainsResp)
+	tcheck(t, err, "parsing response")
+	if domainsResp.Error != nil {
+		t.Fatalf("domains for admin user: %v", domainsResp.Error)
+	}
+	tcompare(t, domainsResp.Result, []dns.Domain{{ASCII: "mox.example"}})
+	testHTTP("POST", "/api/Transports", hdrDomainAuth, http.StatusOK, nil, permissionDenied)
+	testHTTP("POST", "/api/DomainAdd", hdrDomainAuth, http.StatusOK, nil, permissionDenied)
+	testHTTP("POST", "/api/Bogus", hdrDomainAuth, http.StatusOK, nil, permissionDenied)
+
+	// Session of removed admin user is no longer valid.
+	err = admindb.UserRemove(ctxbg, "domainadmin")
+	tcheck(t, err, "remove admin user")
+	webauth.AdminSessionsRemove("domainadmin")
+	testHTTP("POST", "/api/Domains", hdrDomainAuth, http.StatusOK, nil, badAuth)
+	respRec = httptest.NewRecorder()
+	reqInfo.Response = respRec
+
 	// Logout needs session token.
 	reqInfo.SessionToken = store.SessionToken(strings.SplitN(sessionCookie.Value, " ", 2)[0])
 	ctx = context.WithValue(ctxbg, requestInfoCtxKey, reqInfo)
@@ -355,12 +463,83 @@ func TestAdmin(t *testing.T) {
 	}) // Cannot leave zero addresses.
 	api.AliasAddressesRemove(ctxbg, "support", "mox.example", []string{"mjl@mox.example"})
 
+	// Domain admins are limited to their domains.
+	err = admindb.Init()
+	tcheck(t, err, "admindb init")
+	defer func() {
+		err := admindb.Close()
+		tcheck(t, err, "admindb close")
+	}()
+	tneedErrorCode(t, "user:error", func() { api.AdminUserAdd(ctxbg, admindb.User{Name: "x", Role: admindb.RoleDomain}, "") }) // Need domain.
+	tneedErrorCode(t, "user:error", func() {
+		api.AdminUserAdd(ctxbg, admindb.User{Name: "x", Role: admindb.RoleDomain, Domains: []string{"bogus.example"}}, "")
+	}) // Unknown domain.
+	tneedErrorCode(t, "user:error", func() { api.AdminUserAdd(ctxbg, admindb.User{Name: "x", Role: admindb.RoleAdmin}, "short") }) // Password too short.
+	api.AdminUserAdd(ctxbg, admindb.User{Name: "x", Role: admindb.RoleDomain, Domains: []string{"mox.example"}}, "")
+	tneedErrorCode(t, "user:error", func() { api.AdminUserAdd(ctxbg, admindb.User{Name: "x", Role: admindb.RoleAdmin}, "") }) // Already exists.
+	api.AdminUserPasswordSet(ctxbg, "x", "moxtest123")
+	api.AdminUserSave(ctxbg, admindb.User{Name: "x", Role: admindb.RoleDomain, Domains: []string{"mox.example"}, UnixUser: "x"})
+	tneedErrorCode(t, "user:error", func() { api.AdminUserSave(ctxbg, admindb.User{Name: "bogus", Role: admindb.RoleAdmin}) })
+	tneedErrorCode(t, "user:error", func() { api.AdminUserTOTPDisable(ctxbg, "x") }) // Not enabled.
+	users := api.AdminUsers(ctxbg)
+	tcompare(t, len(users), 1)
+	tcompare(t, users[0].UnixUser, "x")
+
+	domainCtx := context.WithValue(ctxbg, requestInfoCtxKey, requestInfo{AdminUser: users[0]})
+	tcompare(t, api.AdminUserCurrent(domainCtx).Name, "x")
+	tcompare(t, api.Domains(domainCtx), []dns.Domain{{ASCII: "mox.example"}})
+	tcompare(t, api.Accounts(domainCtx), []string{"mjl"})
+	api.DomainConfig(domainCtx, "mox.example")
+	api.AliasUpdate(domainCtx, "support", "mox.example", false, false, false)
+	tneedErrorCode(t, "user:error", func() { api.DMARCReports(domainCtx, time.Now(), time.Now(), "") }) // All domains.
+	tneedErrorCode(t, "user:error", func() { api.AccountAdd(domainCtx, "other", "other@other.example") })
+
+	domainCtx = context.WithValue(ctxbg, requestInfoCtxKey, requestInfo{AdminUser: admindb.User{Name: "y", Role: admindb.RoleDomain, Domains: []string{"other.example"}}})
+	tcompare(t, api.Domains(domainCtx), []dns.Domain{})
+	tcompare(t, api.Accounts(domainCtx), []string{})
+	tneedErrorCode(t, "user:error", func() { api.DomainConfig(domainCtx, "mox.example") })
+	tneedErrorCode(t, "user:error", func() { api.Account(domainCtx, "mjl") })
+	tneedErrorCode(t, "user:error", func() { api.SetPassword(domainCtx, "mjl", "moxtest123") })
+	tneedErrorCode(t, "user:error", func() { api.AddressRemove(domainCtx, "mjl2@mox.example") })
+	tneedErrorCode(t, "user:error", func() { api.AliasRemove(domainCtx, "support", "mox.example") })
+
+	api.AdminUserRemove(ctxbg, "x")
+	tneedErrorCode(t, "user:error", func() { api.AdminUserRemove(ctxbg, "x") }) // Already removed.
+
+	// Changes are in the audit log.
+	auditActorCtx := admindb.ContextWithAuditActor(ctxbg, admindb.AuditActor{Source: admindb.AuditSourceWebadmin, Operation: "AliasUpdate"})
+	api.AliasUpdate(auditActorCtx, "support", "mox.example", true, false, false)
+	entries := api.AuditList(ctxbg, admindb.AuditFilter{Max: 1})
+	tcompare(t, len(entries), 1)
+	tcompare(t, entries[0].Kind, admindb.AuditConfig)
+	tcompare(t, entries[0].Operation, "AliasUpdate")
+	tcompare(t, entries[0].Diff != "", true)
+	entries = api.AuditList(ctxbg, admindb.AuditFilter{Kind: admindb.AuditAdminUser})
+	tcompare(t, len(entries), 3) // Add, save, remove.
+	tcompare(t, len(api.AuditList(ctxbg, admindb.AuditFilter{Kind: admindb.AuditPassword})), 1)
+
 	api.AliasRemove(ctxbg, "support", "mox.example")                                               // Restore.
 	tneedErrorCode(t, "user:error", func() { api.AliasRemove(ctxbg, "support", "mox.example") })   // No longer exists.
 	tneedErrorCode(t, "user:error", func() { api.AliasRemove(ctxbg, "support", "bogus.example") }) // Unknown alias domain.
 
 }
 
+// All API functions must have a permission.
+func TestAPIPermissions(t *testing.T) {
+	typ := reflect.TypeOf(Admin{})
+	for i := 0; i < typ.NumMethod(); i++ {
+		name := typ.Method(i).Name
+		if _, ok := apiPermissions[name]; !ok {
+			t.Fatalf("missing permission for api function %s", name)
+		}
+	}
+	for name := range apiPermissions {
+		if _, ok := typ.MethodByName(name); !ok && name != "_docs" {
+			t.Fatalf("permission for unknown api function %s", name)
+		}
+	}
+}
+
 func TestCheckDomain(t *testing.T) {
 	// NOTE: we aren't currently looking at the results, having the code paths executed is better than nothing.
 
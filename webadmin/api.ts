@@ -2,6 +2,50 @@
 
 namespace api {
 
+// TOTPSetup has the parameters for adding a TOTP to an authenticator app.
+export interface TOTPSetup {
+	URI: string  // With "otpauth" scheme.
+	Secret: string  // Base32, for manual entry.
+	QRCodePNG: string  // Data URL with PNG image of a QR code for URI.
+}
+
+// User is an admin user that can log in to the admin web interface with a
+// password, and/or is the admin for connections to the ctl socket from a unix
+// user.
+export interface User {
+	Name: string  // Used for logging in.
+	Created: Date
+	Role: Role
+	Domains?: string[] | null  // For role "domain", the domains the user manages, as unicode names.
+	UnixUser: string  // Optional unix user name. Connections to the ctl socket (e.g. "mox" commands) by this unix user are limited to the role of this admin user. Once any admin user has a unix user, connections by other unix users (except root and the unix user mox runs as) are denied. Peers can only be identified on Linux, other platforms deny all connections once a unix user is configured.
+}
+
+// AuditFilter selects entries from the audit log. Zero values match all
+// entries.
+export interface AuditFilter {
+	Max: number  // Maximum number of entries to return, for listing the newest first.
+	Source: AuditSource
+	Actor: string
+	Kind: AuditKind
+	Operation: string
+	Start?: Date | null  // Inclusive.
+	End?: Date | null  // Exclusive.
+	Text: string  // Case-insensitive substring of details or diff.
+}
+
+// AuditEntry is a recorded change to the configuration, queues or passwords.
+export interface AuditEntry {
+	ID: number
+	Time: Date
+	Source: AuditSource
+	Actor: string
+	RemoteIP: string
+	Operation: string
+	Kind: AuditKind
+	Details: string  // Human-readable description, e.g. the filter for queue operations.
+	Diff: string  // For config changes, the changed lines of domains.conf, prefixed with "-" for removed and "+" for added lines, with some unchanged lines (prefixed with a space) for context.
+}
+
 // CheckResult is the analysis of a domain, its actual configuration (DNS, TLS,
 // connectivity) and the mox configuration. It includes configuration instructions
 // (e.g. DNS records), and warnings and errors encountered.
@@ -331,6 +375,7 @@ export interface Route {
 	ToDomain?: string[] | null
 	MinimumAttempts: number
 	Transport: string
+	IPPool: string
 	FromDomainASCII?: string[] | null
 	ToDomainASCII?: string[] | null
 }
@@ -340,9 +385,14 @@ export interface Alias {
 	PostPublic: boolean
 	ListMembers: boolean
 	AllowMsgFrom: boolean
+	ListOwner: string
+	Subscribe: boolean
+	Moderate: boolean
+	DigestInterval: number
 	LocalpartStr: string  // In encoded form.
 	Domain: Domain
-	ParsedAddresses?: AliasAddress[] | null  // Matches addresses.
+	ParsedAddresses?: AliasAddress[] | null  // Matches addresses. AccountName is empty for external addresses.
+	ParsedListOwner: AliasAddress  // If ListOwner is set.
 }
 
 export interface AliasAddress {
@@ -368,7 +418,7 @@ export interface Ruleset {
 	MsgFromRegexp: string
 	VerifiedDomain: string
 	HeadersRegexp?: { [key: string]: string }
-	IsForward: boolean  // todo: once we implement ARC, we can use dkim domains that we cannot verify but that the arc-verified forwarding mail server was able to verify.
+	IsForward: boolean
 	ListAllowDomain: string
 	AcceptRejectsToMailbox: string
 	Mailbox: string
@@ -397,6 +447,8 @@ export interface Account {
 	MaxFirstTimeRecipientsPerDay: number
 	NoFirstTimeSenderDelay: boolean
 	Routes?: Route[] | null
+	IPPools?: string[] | null
+	EncryptMessages: boolean
 	DNSDomain: Domain  // Parsed form of Domain.
 	Aliases?: AddressAlias[] | null
 }
@@ -706,9 +758,13 @@ export interface Msg {
 	Subject: string  // For context about delivery.
 	DSNUTF8?: string | null  // If set, this message is a DSN and this is a version using utf-8, for the case the remote MTA supports smtputf8. In this case, Size and MsgPrefix are not relevant.
 	Transport: string  // If non-empty, the transport to use for this message. Can be set through cli or admin interface. If empty (the default for a submitted message), regular routing rules apply.
+	IPPool: string  // If non-empty, the name of the IP pool of a direct transport to make outgoing connections from, e.g. as requested through the webapi. Takes precedence over Transport and routes.
 	RequireTLS?: boolean | null  // RequireTLS influences TLS verification during delivery.  If nil, the recipient domain policy is followed (MTA-STS and/or DANE), falling back to optional opportunistic non-verified STARTTLS.  If RequireTLS is true (through SMTP REQUIRETLS extension or webmail submit), MTA-STS or DANE is required, as well as REQUIRETLS support by the next hop server.  If RequireTLS is false (through messag header "TLS-Required: No"), the recipient domain's policy is ignored if it does not lead to a successful TLS connection, i.e. falling back to SMTP delivery with unverified STARTTLS or plain text.
 	FutureReleaseRequest: string  // For DSNs, where the original FUTURERELEASE value must be included as per-message field. This field should be of the form "for;" plus interval, or "until;" plus utc date-time.
+	SendAt: Date  // For messages submitted through webmail or the webapi with a scheduled delivery time or an "undo send" grace period, the time of the first delivery attempt. Until the first delivery attempt, the sending account can cancel the message or change this time, see ScheduledCancel and ScheduledReschedule. Zero for other messages.
+	UndoSend: boolean  // Whether SendAt is the end of an "undo send" grace period, instead of a delivery time scheduled by the sender.
 	Extra?: { [key: string]: string }  // Extra information, for transactional email.
+	RateLimited: string  // If set, the name of the outgoing rate limit that postponed the most recent delivery attempt, which did not count as an attempt. Cleared when delivery is attempted.
 }
 
 // IPDomain is an ip address, a domain, or empty.
@@ -727,6 +783,20 @@ export interface MsgResult {
 	Error: string
 }
 
+// RateLimitState is the configuration and current usage of an outgoing rate
+// limit, for display in the admin web interface.
+export interface RateLimitState {
+	Name: string
+	AppliesTo: string  // Description of the recipient domains, MX hosts or source IPs.
+	MessagesPerMinute: number  // Limit, 0 if not limited.
+	MessagesLastMinute: number
+	MaxConnections: number  // Limit, 0 if not limited.
+	Connections: number
+	WarmupLimitToday: number  // Limit according to warm-up schedule, 0 if not limited.
+	MessagesToday: number  // Only counted for limits with a warm-up schedule.
+	LimitedUntil?: Date | null  // If set, new deliveries are postponed until at least this time.
+}
+
 // RetiredFilter filters messages to list or operate on. Used by admin web interface
 // and cli.
 // 
@@ -778,6 +848,7 @@ export interface MsgRetired {
 	MessageID: string  // Used when composing a DSN, in its References header.
 	Subject: string  // For context about delivery.
 	Transport: string
+	IPPool: string
 	RequireTLS?: boolean | null
 	FutureReleaseRequest: string
 	Extra?: { [key: string]: string }  // Extra information, for transactional email.
@@ -971,6 +1042,18 @@ export interface TransportSocks {
 export interface TransportDirect {
 	DisableIPv4: boolean
 	DisableIPv6: boolean
+	IPPools?: { [key: string]: IPPool }
+}
+
+// IPPool is a set of local IPs to make outgoing connections from, each with its
+// own hostname.
+export interface IPPool {
+	IPs?: PoolIP[] | null
+}
+
+export interface PoolIP {
+	IP: string
+	Hostname: string
 }
 
 // EvaluationStat summarizes stored evaluations, for inclusion in an upcoming
@@ -1054,6 +1137,36 @@ export interface Dynamic {
 
 export type CSRFToken = string
 
+// Role determines which operations an admin user is allowed to do.
+export enum Role {
+	RoleAdmin = "admin",  // Full access, like the admin password.
+	RoleReadOnly = "readonly",  // Viewing configuration, queues and reports, but no changes.
+	// Like readonly, and managing the queues: hold, reschedule, fail and drop
+	// messages and webhooks, and managing hold rules.
+	RoleQueue = "queue",
+	// Viewing and changing the domains listed in the Domains field of the user,
+	// and the accounts (based on their default domain), addresses and aliases of
+	// those domains. No access to other configuration.
+	RoleDomain = "domain",
+}
+
+// AuditSource is the interface through which a change was made.
+export enum AuditSource {
+	AuditSourceNone = "",  // Not through ctl or a web interface. In filters, matches all sources.
+	AuditSourceCtl = "ctl",  // Through the ctl socket, typically the "mox" command-line.
+	AuditSourceWebadmin = "webadmin",  // Through the admin web interface.
+	AuditSourceWebaccount = "webaccount",  // Through the account web interface.
+}
+
+// AuditKind is the type of change recorded in the audit log.
+export enum AuditKind {
+	AuditKindAny = "",  // Only for filters, matching all kinds.
+	AuditConfig = "config",  // Change to the dynamic configuration file domains.conf, with a diff.
+	AuditQueue = "queue",  // Operation on the queues, e.g. dropping messages or changing hold rules.
+	AuditPassword = "password",  // Password change of an account or admin user.
+	AuditAdminUser = "adminuser",  // Admin user added, changed or removed.
+}
+
 // Policy as used in DMARC DNS record for "p=" or "sp=".
 export enum DMARCPolicy {
 	PolicyEmpty = "",  // Only for the optional Record.SubdomainPolicy.
@@ -1096,10 +1209,14 @@ export type Localpart = string
 // be an IPv4 address.
 export type IP = string
 
-export const structTypes: {[typename: string]: boolean} = {"Account":true,"Address":true,"AddressAlias":true,"Alias":true,"AliasAddress":true,"AuthResults":true,"AutoconfCheckResult":true,"AutodiscoverCheckResult":true,"AutodiscoverSRV":true,"AutomaticJunkFlags":true,"Canonicalization":true,"CheckResult":true,"ClientConfigs":true,"ClientConfigsEntry":true,"ConfigDomain":true,"DANECheckResult":true,"DKIM":true,"DKIMAuthResult":true,"DKIMCheckResult":true,"DKIMRecord":true,"DMARC":true,"DMARCCheckResult":true,"DMARCRecord":true,"DMARCSummary":true,"DNSSECResult":true,"DateRange":true,"Destination":true,"Directive":true,"Domain":true,"DomainFeedback":true,"Dynamic":true,"Evaluation":true,"EvaluationStat":true,"Extension":true,"FailureDetails":true,"Filter":true,"HoldRule":true,"Hook":true,"HookFilter":true,"HookResult":true,"HookRetired":true,"HookRetiredFilter":true,"HookRetiredSort":true,"HookSort":true,"IPDomain":true,"IPRevCheckResult":true,"Identifiers":true,"IncomingWebhook":true,"JunkFilter":true,"MTASTS":true,"MTASTSCheckResult":true,"MTASTSRecord":true,"MX":true,"MXCheckResult":true,"Modifier":true,"Msg":true,"MsgResult":true,"MsgRetired":true,"OutgoingWebhook":true,"Pair":true,"Policy":true,"PolicyEvaluated":true,"PolicyOverrideReason":true,"PolicyPublished":true,"PolicyRecord":true,"Record":true,"Report":true,"ReportMetadata":true,"ReportRecord":true,"Result":true,"ResultPolicy":true,"RetiredFilter":true,"RetiredSort":true,"Reverse":true,"Route":true,"Row":true,"Ruleset":true,"SMTPAuth":true,"SPFAuthResult":true,"SPFCheckResult":true,"SPFRecord":true,"SRV":true,"SRVConfCheckResult":true,"STSMX":true,"Selector":true,"Sort":true,"SubjectPass":true,"Summary":true,"SuppressAddress":true,"TLSCheckResult":true,"TLSRPT":true,"TLSRPTCheckResult":true,"TLSRPTDateRange":true,"TLSRPTRecord":true,"TLSRPTSummary":true,"TLSRPTSuppressAddress":true,"TLSReportRecord":true,"TLSResult":true,"Transport":true,"TransportDirect":true,"TransportSMTP":true,"TransportSocks":true,"URI":true,"WebForward":true,"WebHandler":true,"WebInternal":true,"WebRedirect":true,"WebStatic":true,"WebserverConfig":true}
-export const stringsTypes: {[typename: string]: boolean} = {"Align":true,"CSRFToken":true,"DMARCPolicy":true,"IP":true,"Localpart":true,"Mode":true,"RUA":true}
+export const structTypes: {[typename: string]: boolean} = {"Account":true,"Address":true,"AddressAlias":true,"Alias":true,"AliasAddress":true,"AuditEntry":true,"AuditFilter":true,"AuthResults":true,"AutoconfCheckResult":true,"AutodiscoverCheckResult":true,"AutodiscoverSRV":true,"AutomaticJunkFlags":true,"Canonicalization":true,"CheckResult":true,"ClientConfigs":true,"ClientConfigsEntry":true,"ConfigDomain":true,"DANECheckResult":true,"DKIM":true,"DKIMAuthResult":true,"DKIMCheckResult":true,"DKIMRecord":true,"DMARC":true,"DMARCCheckResult":true,"DMARCRecord":true,"DMARCSummary":true,"DNSSECResult":true,"DateRange":true,"Destination":true,"Directive":true,"Domain":true,"DomainFeedback":true,"Dynamic":true,"Evaluation":true,"EvaluationStat":true,"Extension":true,"FailureDetails":true,"Filter":true,"HoldRule":true,"Hook":true,"HookFilter":true,"HookResult":true,"HookRetired":true,"HookRetiredFilter":true,"HookRetiredSort":true,"HookSort":true,"IPDomain":true,"IPPool":true,"IPRevCheckResult":true,"Identifiers":true,"IncomingWebhook":true,"JunkFilter":true,"MTASTS":true,"MTASTSCheckResult":true,"MTASTSRecord":true,"MX":true,"MXCheckResult":true,"Modifier":true,"Msg":true,"MsgResult":true,"MsgRetired":true,"OutgoingWebhook":true,"Pair":true,"Policy":true,"PolicyEvaluated":true,"PolicyOverrideReason":true,"PolicyPublished":true,"PolicyRecord":true,"PoolIP":true,"RateLimitState":true,"Record":true,"Report":true,"ReportMetadata":true,"ReportRecord":true,"Result":true,"ResultPolicy":true,"RetiredFilter":true,"RetiredSort":true,"Reverse":true,"Route":true,"Row":true,"Ruleset":true,"SMTPAuth":true,"SPFAuthResult":true,"SPFCheckResult":true,"SPFRecord":true,"SRV":true,"SRVConfCheckResult":true,"STSMX":true,"Selector":true,"Sort":true,"SubjectPass":true,"Summary":true,"SuppressAddress":true,"TLSCheckResult":true,"TLSRPT":true,"TLSRPTCheckResult":true,"TLSRPTDateRange":true,"TLSRPTRecord":true,"TLSRPTSummary":true,"TLSRPTSuppressAddress":true,"TLSReportRecord":true,"TLSResult":true,"TOTPSetup":true,"Transport":true,"TransportDirect":true,"TransportSMTP":true,"TransportSocks":true,"URI":true,"User":true,"WebForward":true,"WebHandler":true,"WebInternal":true,"WebRedirect":true,"WebStatic":true,"WebserverConfig":true}
+export const stringsTypes: {[typename: string]: boolean} = {"Align":true,"AuditKind":true,"AuditSource":true,"CSRFToken":true,"DMARCPolicy":true,"IP":true,"Localpart":true,"Mode":true,"RUA":true,"Role":true}
 export const intsTypes: {[typename: string]: boolean} = {}
 export const types: TypenameMap = {
+	"TOTPSetup": {"Name":"TOTPSetup","Docs":"","Fields":[{"Name":"URI","Docs":"","Typewords":["string"]},{"Name":"Secret","Docs":"","Typewords":["string"]},{"Name":"QRCodePNG","Docs":"","Typewords":["string"]}]},
+	"User": {"Name":"User","Docs":"","Fields":[{"Name":"Name","Docs":"","Typewords":["string"]},{"Name":"Created","Docs":"","Typewords":["timestamp"]},{"Name":"Role","Docs":"","Typewords":["Role"]},{"Name":"Domains","Docs":"","Typewords":["[]","string"]},{"Name":"UnixUser","Docs":"","Typewords":["string"]}]},
+	"AuditFilter": {"Name":"AuditFilter","Docs":"","Fields":[{"Name":"Max","Docs":"","Typewords":["int32"]},{"Name":"Source","Docs":"","Typewords":["AuditSource"]},{"Name":"Actor","Docs":"","Typewords":["string"]},{"Name":"Kind","Docs":"","Typewords":["AuditKind"]},{"Name":"Operation","Docs":"","Typewords":["string"]},{"Name":"Start","Docs":"","Typewords":["nullable","timestamp"]},{"Name":"End","Docs":"","Typewords":["nullable","timestamp"]},{"Name":"Text","Docs":"","Typewords":["string"]}]},
+	"AuditEntry": {"Name":"AuditEntry","Docs":"","Fields":[{"Name":"ID","Docs":"","Typewords":["int64"]},{"Name":"Time","Docs":"","Typewords":["timestamp"]},{"Name":"Source","Docs":"","Typewords":["AuditSource"]},{"Name":"Actor","Docs":"","Typewords":["string"]},{"Name":"RemoteIP","Docs":"","Typewords":["string"]},{"Name":"Operation","Docs":"","Typewords":["string"]},{"Name":"Kind","Docs":"","Typewords":["AuditKind"]},{"Name":"Details","Docs":"","Typewords":["string"]},{"Name":"Diff","Docs":"","Typewords":["string"]}]},
 	"CheckResult": {"Name":"CheckResult","Docs":"","Fields":[{"Name":"Domain","Docs":"","Typewords":["string"]},{"Name":"DNSSEC","Docs":"","Typewords":["DNSSECResult"]},{"Name":"IPRev","Docs":"","Typewords":["IPRevCheckResult"]},{"Name":"MX","Docs":"","Typewords":["MXCheckResult"]},{"Name":"TLS","Docs":"","Typewords":["TLSCheckResult"]},{"Name":"DANE","Docs":"","Typewords":["DANECheckResult"]},{"Name":"SPF","Docs":"","Typewords":["SPFCheckResult"]},{"Name":"DKIM","Docs":"","Typewords":["DKIMCheckResult"]},{"Name":"DMARC","Docs":"","Typewords":["DMARCCheckResult"]},{"Name":"HostTLSRPT","Docs":"","Typewords":["TLSRPTCheckResult"]},{"Name":"DomainTLSRPT","Docs":"","Typewords":["TLSRPTCheckResult"]},{"Name":"MTASTS","Docs":"","Typewords":["MTASTSCheckResult"]},{"Name":"SRVConf","Docs":"","Typewords":["SRVConfCheckResult"]},{"Name":"Autoconf","Docs":"","Typewords":["AutoconfCheckResult"]},{"Name":"Autodiscover","Docs":"","Typewords":["AutodiscoverCheckResult"]}]},
 	"DNSSECResult": {"Name":"DNSSECResult","Docs":"","Fields":[{"Name":"Errors","Docs":"","Typewords":["[]","string"]},{"Name":"Warnings","Docs":"","Typewords":["[]","string"]},{"Name":"Instructions","Docs":"","Typewords":["[]","string"]}]},
 	"IPRevCheckResult": {"Name":"IPRevCheckResult","Docs":"","Fields":[{"Name":"Hostname","Docs":"","Typewords":["Domain"]},{"Name":"IPNames","Docs":"","Typewords":["{}","[]","string"]},{"Name":"Errors","Docs":"","Typewords":["[]","string"]},{"Name":"Warnings","Docs":"","Typewords":["[]","string"]},{"Name":"Instructions","Docs":"","Typewords":["[]","string"]}]},
@@ -1138,13 +1255,13 @@ export const types: TypenameMap = {
 	"DMARC": {"Name":"DMARC","Docs":"","Fields":[{"Name":"Localpart","Docs":"","Typewords":["string"]},{"Name":"Domain","Docs":"","Typewords":["string"]},{"Name":"Account","Docs":"","Typewords":["string"]},{"Name":"Mailbox","Docs":"","Typewords":["string"]},{"Name":"ParsedLocalpart","Docs":"","Typewords":["Localpart"]},{"Name":"DNSDomain","Docs":"","Typewords":["Domain"]}]},
 	"MTASTS": {"Name":"MTASTS","Docs":"","Fields":[{"Name":"PolicyID","Docs":"","Typewords":["string"]},{"Name":"Mode","Docs":"","Typewords":["Mode"]},{"Name":"MaxAge","Docs":"","Typewords":["int64"]},{"Name":"MX","Docs":"","Typewords":["[]","string"]}]},
 	"TLSRPT": {"Name":"TLSRPT","Docs":"","Fields":[{"Name":"Localpart","Docs":"","Typewords":["string"]},{"Name":"Domain","Docs":"","Typewords":["string"]},{"Name":"Account","Docs":"","Typewords":["string"]},{"Name":"Mailbox","Docs":"","Typewords":["string"]},{"Name":"ParsedLocalpart","Docs":"","Typewords":["Localpart"]},{"Name":"DNSDomain","Docs":"","Typewords":["Domain"]}]},
-	"Route": {"Name":"Route","Docs":"","Fields":[{"Name":"FromDomain","Docs":"","Typewords":["[]","string"]},{"Name":"ToDomain","Docs":"","Typewords":["[]","string"]},{"Name":"MinimumAttempts","Docs":"","Typewords":["int32"]},{"Name":"Transport","Docs":"","Typewords":["string"]},{"Name":"FromDomainASCII","Docs":"","Typewords":["[]","string"]},{"Name":"ToDomainASCII","Docs":"","Typewords":["[]","string"]}]},
-	"Alias": {"Name":"Alias","Docs":"","Fields":[{"Name":"Addresses","Docs":"","Typewords":["[]","string"]},{"Name":"PostPublic","Docs":"","Typewords":["bool"]},{"Name":"ListMembers","Docs":"","Typewords":["bool"]},{"Name":"AllowMsgFrom","Docs":"","Typewords":["bool"]},{"Name":"LocalpartStr","Docs":"","Typewords":["string"]},{"Name":"Domain","Docs":"","Typewords":["Domain"]},{"Name":"ParsedAddresses","Docs":"","Typewords":["[]","AliasAddress"]}]},
+	"Route": {"Name":"Route","Docs":"","Fields":[{"Name":"FromDomain","Docs":"","Typewords":["[]","string"]},{"Name":"ToDomain","Docs":"","Typewords":["[]","string"]},{"Name":"MinimumAttempts","Docs":"","Typewords":["int32"]},{"Name":"Transport","Docs":"","Typewords":["string"]},{"Name":"IPPool","Docs":"","Typewords":["string"]},{"Name":"FromDomainASCII","Docs":"","Typewords":["[]","string"]},{"Name":"ToDomainASCII","Docs":"","Typewords":["[]","string"]}]},
+	"Alias": {"Name":"Alias","Docs":"","Fields":[{"Name":"Addresses","Docs":"","Typewords":["[]","string"]},{"Name":"PostPublic","Docs":"","Typewords":["bool"]},{"Name":"ListMembers","Docs":"","Typewords":["bool"]},{"Name":"AllowMsgFrom","Docs":"","Typewords":["bool"]},{"Name":"ListOwner","Docs":"","Typewords":["string"]},{"Name":"Subscribe","Docs":"","Typewords":["bool"]},{"Name":"Moderate","Docs":"","Typewords":["bool"]},{"Name":"DigestInterval","Docs":"","Typewords":["int64"]},{"Name":"LocalpartStr","Docs":"","Typewords":["string"]},{"Name":"Domain","Docs":"","Typewords":["Domain"]},{"Name":"ParsedAddresses","Docs":"","Typewords":["[]","AliasAddress"]},{"Name":"ParsedListOwner","Docs":"","Typewords":["AliasAddress"]}]},
 	"AliasAddress": {"Name":"AliasAddress","Docs":"","Fields":[{"Name":"Address","Docs":"","Typewords":["Address"]},{"Name":"AccountName","Docs":"","Typewords":["string"]},{"Name":"Destination","Docs":"","Typewords":["Destination"]}]},
 	"Address": {"Name":"Address","Docs":"","Fields":[{"Name":"Localpart","Docs":"","Typewords":["Localpart"]},{"Name":"Domain","Docs":"","Typewords":["Domain"]}]},
 	"Destination": {"Name":"Destination","Docs":"","Fields":[{"Name":"Mailbox","Docs":"","Typewords":["string"]},{"Name":"Rulesets","Docs":"","Typewords":["[]","Ruleset"]},{"Name":"FullName","Docs":"","Typewords":["string"]}]},
 	"Ruleset": {"Name":"Ruleset","Docs":"","Fields":[{"Name":"SMTPMailFromRegexp","Docs":"","Typewords":["string"]},{"Name":"MsgFromRegexp","Docs":"","Typewords":["string"]},{"Name":"VerifiedDomain","Docs":"","Typewords":["string"]},{"Name":"HeadersRegexp","Docs":"","Typewords":["{}","string"]},{"Name":"IsForward","Docs":"","Typewords":["bool"]},{"Name":"ListAllowDomain","Docs":"","Typewords":["string"]},{"Name":"AcceptRejectsToMailbox","Docs":"","Typewords":["string"]},{"Name":"Mailbox","Docs":"","Typewords":["string"]},{"Name":"Comment","Docs":"","Typewords":["string"]},{"Name":"VerifiedDNSDomain","Docs":"","Typewords":["Domain"]},{"Name":"ListAllowDNSDomain","Docs":"","Typewords":["Domain"]}]},
-	"Account": {"Name":"Account","Docs":"","Fields":[{"Name":"OutgoingWebhook","Docs":"","Typewords":["nullable","OutgoingWebhook"]},{"Name":"IncomingWebhook","Docs":"","Typewords":["nullable","IncomingWebhook"]},{"Name":"FromIDLoginAddresses","Docs":"","Typewords":["[]","string"]},{"Name":"KeepRetiredMessagePeriod","Docs":"","Typewords":["int64"]},{"Name":"KeepRetiredWebhookPeriod","Docs":"","Typewords":["int64"]},{"Name":"Domain","Docs":"","Typewords":["string"]},{"Name":"Description","Docs":"","Typewords":["string"]},{"Name":"FullName","Docs":"","Typewords":["string"]},{"Name":"Destinations","Docs":"","Typewords":["{}","Destination"]},{"Name":"SubjectPass","Docs":"","Typewords":["SubjectPass"]},{"Name":"QuotaMessageSize","Docs":"","Typewords":["int64"]},{"Name":"RejectsMailbox","Docs":"","Typewords":["string"]},{"Name":"KeepRejects","Docs":"","Typewords":["bool"]},{"Name":"AutomaticJunkFlags","Docs":"","Typewords":["AutomaticJunkFlags"]},{"Name":"JunkFilter","Docs":"","Typewords":["nullable","JunkFilter"]},{"Name":"MaxOutgoingMessagesPerDay","Docs":"","Typewords":["int32"]},{"Name":"MaxFirstTimeRecipientsPerDay","Docs":"","Typewords":["int32"]},{"Name":"NoFirstTimeSenderDelay","Docs":"","Typewords":["bool"]},{"Name":"Routes","Docs":"","Typewords":["[]","Route"]},{"Name":"DNSDomain","Docs":"","Typewords":["Domain"]},{"Name":"Aliases","Docs":"","Typewords":["[]","AddressAlias"]}]},
+	"Account": {"Name":"Account","Docs":"","Fields":[{"Name":"OutgoingWebhook","Docs":"","Typewords":["nullable","OutgoingWebhook"]},{"Name":"IncomingWebhook","Docs":"","Typewords":["nullable","IncomingWebhook"]},{"Name":"FromIDLoginAddresses","Docs":"","Typewords":["[]","string"]},{"Name":"KeepRetiredMessagePeriod","Docs":"","Typewords":["int64"]},{"Name":"KeepRetiredWebhookPeriod","Docs":"","Typewords":["int64"]},{"Name":"Domain","Docs":"","Typewords":["string"]},{"Name":"Description","Docs":"","Typewords":["string"]},{"Name":"FullName","Docs":"","Typewords":["string"]},{"Name":"Destinations","Docs":"","Typewords":["{}","Destination"]},{"Name":"SubjectPass","Docs":"","Typewords":["SubjectPass"]},{"Name":"QuotaMessageSize","Docs":"","Typewords":["int64"]},{"Name":"RejectsMailbox","Docs":"","Typewords":["string"]},{"Name":"KeepRejects","Docs":"","Typewords":["bool"]},{"Name":"AutomaticJunkFlags","Docs":"","Typewords":["AutomaticJunkFlags"]},{"Name":"JunkFilter","Docs":"","Typewords":["nullable","JunkFilter"]},{"Name":"MaxOutgoingMessagesPerDay","Docs":"","Typewords":["int32"]},{"Name":"MaxFirstTimeRecipientsPerDay","Docs":"","Typewords":["int32"]},{"Name":"NoFirstTimeSenderDelay","Docs":"","Typewords":["bool"]},{"Name":"Routes","Docs":"","Typewords":["[]","Route"]},{"Name":"IPPools","Docs":"","Typewords":["[]","string"]},{"Name":"EncryptMessages","Docs":"","Typewords":["bool"]},{"Name":"DNSDomain","Docs":"","Typewords":["Domain"]},{"Name":"Aliases","Docs":"","Typewords":["[]","AddressAlias"]}]},
 	"OutgoingWebhook": {"Name":"OutgoingWebhook","Docs":"","Fields":[{"Name":"URL","Docs":"","Typewords":["string"]},{"Name":"Authorization","Docs":"","Typewords":["string"]},{"Name":"Events","Docs":"","Typewords":["[]","string"]}]},
 	"IncomingWebhook": {"Name":"IncomingWebhook","Docs":"","Fields":[{"Name":"URL","Docs":"","Typewords":["string"]},{"Name":"Authorization","Docs":"","Typewords":["string"]}]},
 	"SubjectPass": {"Name":"SubjectPass","Docs":"","Fields":[{"Name":"Period","Docs":"","Typewords":["int64"]}]},
@@ -1179,12 +1296,13 @@ export const types: TypenameMap = {
 	"HoldRule": {"Name":"HoldRule","Docs":"","Fields":[{"Name":"ID","Docs":"","Typewords":["int64"]},{"Name":"Account","Docs":"","Typewords":["string"]},{"Name":"SenderDomain","Docs":"","Typewords":["Domain"]},{"Name":"RecipientDomain","Docs":"","Typewords":["Domain"]},{"Name":"SenderDomainStr","Docs":"","Typewords":["string"]},{"Name":"RecipientDomainStr","Docs":"","Typewords":["string"]}]},
 	"Filter": {"Name":"Filter","Docs":"","Fields":[{"Name":"Max","Docs":"","Typewords":["int32"]},{"Name":"IDs","Docs":"","Typewords":["[]","int64"]},{"Name":"Account","Docs":"","Typewords":["string"]},{"Name":"From","Docs":"","Typewords":["string"]},{"Name":"To","Docs":"","Typewords":["string"]},{"Name":"Hold","Docs":"","Typewords":["nullable","bool"]},{"Name":"Submitted","Docs":"","Typewords":["string"]},{"Name":"NextAttempt","Docs":"","Typewords":["string"]},{"Name":"Transport","Docs":"","Typewords":["nullable","string"]}]},
 	"Sort": {"Name":"Sort","Docs":"","Fields":[{"Name":"Field","Docs":"","Typewords":["string"]},{"Name":"LastID","Docs":"","Typewords":["int64"]},{"Name":"Last","Docs":"","Typewords":["any"]},{"Name":"Asc","Docs":"","Typewords":["bool"]}]},
-	"Msg": {"Name":"Msg","Docs":"","Fields":[{"Name":"ID","Docs":"","Typewords":["int64"]},{"Name":"BaseID","Docs":"","Typewords":["int64"]},{"Name":"Queued","Docs":"","Typewords":["timestamp"]},{"Name":"Hold","Docs":"","Typewords":["bool"]},{"Name":"SenderAccount","Docs":"","Typewords":["string"]},{"Name":"SenderLocalpart","Docs":"","Typewords":["Localpart"]},{"Name":"SenderDomain","Docs":"","Typewords":["IPDomain"]},{"Name":"SenderDomainStr","Docs":"","Typewords":["string"]},{"Name":"FromID","Docs":"","Typewords":["string"]},{"Name":"RecipientLocalpart","Docs":"","Typewords":["Localpart"]},{"Name":"RecipientDomain","Docs":"","Typewords":["IPDomain"]},{"Name":"RecipientDomainStr","Docs":"","Typewords":["string"]},{"Name":"Attempts","Docs":"","Typewords":["int32"]},{"Name":"MaxAttempts","Docs":"","Typewords":["int32"]},{"Name":"DialedIPs","Docs":"","Typewords":["{}","[]","IP"]},{"Name":"NextAttempt","Docs":"","Typewords":["timestamp"]},{"Name":"LastAttempt","Docs":"","Typewords":["nullable","timestamp"]},{"Name":"Results","Docs":"","Typewords":["[]","MsgResult"]},{"Name":"Has8bit","Docs":"","Typewords":["bool"]},{"Name":"SMTPUTF8","Docs":"","Typewords":["bool"]},{"Name":"IsDMARCReport","Docs":"","Typewords":["bool"]},{"Name":"IsTLSReport","Docs":"","Typewords":["bool"]},{"Name":"Size","Docs":"","Typewords":["int64"]},{"Name":"MessageID","Docs":"","Typewords":["string"]},{"Name":"MsgPrefix","Docs":"","Typewords":["nullable","string"]},{"Name":"Subject","Docs":"","Typewords":["string"]},{"Name":"DSNUTF8","Docs":"","Typewords":["nullable","string"]},{"Name":"Transport","Docs":"","Typewords":["string"]},{"Name":"RequireTLS","Docs":"","Typewords":["nullable","bool"]},{"Name":"FutureReleaseRequest","Docs":"","Typewords":["string"]},{"Name":"Extra","Docs":"","Typewords":["{}","string"]}]},
+	"Msg": {"Name":"Msg","Docs":"","Fields":[{"Name":"ID","Docs":"","Typewords":["int64"]},{"Name":"BaseID","Docs":"","Typewords":["int64"]},{"Name":"Queued","Docs":"","Typewords":["timestamp"]},{"Name":"Hold","Docs":"","Typewords":["bool"]},{"Name":"SenderAccount","Docs":"","Typewords":["string"]},{"Name":"SenderLocalpart","Docs":"","Typewords":["Localpart"]},{"Name":"SenderDomain","Docs":"","Typewords":["IPDomain"]},{"Name":"SenderDomainStr","Docs":"","Typewords":["string"]},{"Name":"FromID","Docs":"","Typewords":["string"]},{"Name":"RecipientLocalpart","Docs":"","Typewords":["Localpart"]},{"Name":"RecipientDomain","Docs":"","Typewords":["IPDomain"]},{"Name":"RecipientDomainStr","Docs":"","Typewords":["string"]},{"Name":"Attempts","Docs":"","Typewords":["int32"]},{"Name":"MaxAttempts","Docs":"","Typewords":["int32"]},{"Name":"DialedIPs","Docs":"","Typewords":["{}","[]","IP"]},{"Name":"NextAttempt","Docs":"","Typewords":["timestamp"]},{"Name":"LastAttempt","Docs":"","Typewords":["nullable","timestamp"]},{"Name":"Results","Docs":"","Typewords":["[]","MsgResult"]},{"Name":"Has8bit","Docs":"","Typewords":["bool"]},{"Name":"SMTPUTF8","Docs":"","Typewords":["bool"]},{"Name":"IsDMARCReport","Docs":"","Typewords":["bool"]},{"Name":"IsTLSReport","Docs":"","Typewords":["bool"]},{"Name":"Size","Docs":"","Typewords":["int64"]},{"Name":"MessageID","Docs":"","Typewords":["string"]},{"Name":"MsgPrefix","Docs":"","Typewords":["nullable","string"]},{"Name":"Subject","Docs":"","Typewords":["string"]},{"Name":"DSNUTF8","Docs":"","Typewords":["nullable","string"]},{"Name":"Transport","Docs":"","Typewords":["string"]},{"Name":"IPPool","Docs":"","Typewords":["string"]},{"Name":"RequireTLS","Docs":"","Typewords":["nullable","bool"]},{"Name":"FutureReleaseRequest","Docs":"","Typewords":["string"]},{"Name":"SendAt","Docs":"","Typewords":["timestamp"]},{"Name":"UndoSend","Docs":"","Typewords":["bool"]},{"Name":"Extra","Docs":"","Typewords":["{}","string"]},{"Name":"RateLimited","Docs":"","Typewords":["string"]}]},
 	"IPDomain": {"Name":"IPDomain","Docs":"","Fields":[{"Name":"IP","Docs":"","Typewords":["IP"]},{"Name":"Domain","Docs":"","Typewords":["Domain"]}]},
 	"MsgResult": {"Name":"MsgResult","Docs":"","Fields":[{"Name":"Start","Docs":"","Typewords":["timestamp"]},{"Name":"Duration","Docs":"","Typewords":["int64"]},{"Name":"Success","Docs":"","Typewords":["bool"]},{"Name":"Code","Docs":"","Typewords":["int32"]},{"Name":"Secode","Docs":"","Typewords":["string"]},{"Name":"Error","Docs":"","Typewords":["string"]}]},
+	"RateLimitState": {"Name":"RateLimitState","Docs":"","Fields":[{"Name":"Name","Docs":"","Typewords":["string"]},{"Name":"AppliesTo","Docs":"","Typewords":["string"]},{"Name":"MessagesPerMinute","Docs":"","Typewords":["int32"]},{"Name":"MessagesLastMinute","Docs":"","Typewords":["int32"]},{"Name":"MaxConnections","Docs":"","Typewords":["int32"]},{"Name":"Connections","Docs":"","Typewords":["int32"]},{"Name":"WarmupLimitToday","Docs":"","Typewords":["int32"]},{"Name":"MessagesToday","Docs":"","Typewords":["int32"]},{"Name":"LimitedUntil","Docs":"","Typewords":["nullable","timestamp"]}]},
 	"RetiredFilter": {"Name":"RetiredFilter","Docs":"","Fields":[{"Name":"Max","Docs":"","Typewords":["int32"]},{"Name":"IDs","Docs":"","Typewords":["[]","int64"]},{"Name":"Account","Docs":"","Typewords":["string"]},{"Name":"From","Docs":"","Typewords":["string"]},{"Name":"To","Docs":"","Typewords":["string"]},{"Name":"Submitted","Docs":"","Typewords":["string"]},{"Name":"LastActivity","Docs":"","Typewords":["string"]},{"Name":"Transport","Docs":"","Typewords":["nullable","string"]},{"Name":"Success","Docs":"","Typewords":["nullable","bool"]}]},
 	"RetiredSort": {"Name":"RetiredSort","Docs":"","Fields":[{"Name":"Field","Docs":"","Typewords":["string"]},{"Name":"LastID","Docs":"","Typewords":["int64"]},{"Name":"Last","Docs":"","Typewords":["any"]},{"Name":"Asc","Docs":"","Typewords":["bool"]}]},
-	"MsgRetired": {"Name":"MsgRetired","Docs":"","Fields":[{"Name":"ID","Docs":"","Typewords":["int64"]},{"Name":"BaseID","Docs":"","Typewords":["int64"]},{"Name":"Queued","Docs":"","Typewords":["timestamp"]},{"Name":"SenderAccount","Docs":"","Typewords":["string"]},{"Name":"SenderLocalpart","Docs":"","Typewords":["Localpart"]},{"Name":"SenderDomainStr","Docs":"","Typewords":["string"]},{"Name":"FromID","Docs":"","Typewords":["string"]},{"Name":"RecipientLocalpart","Docs":"","Typewords":["Localpart"]},{"Name":"RecipientDomain","Docs":"","Typewords":["IPDomain"]},{"Name":"RecipientDomainStr","Docs":"","Typewords":["string"]},{"Name":"Attempts","Docs":"","Typewords":["int32"]},{"Name":"MaxAttempts","Docs":"","Typewords":["int32"]},{"Name":"DialedIPs","Docs":"","Typewords":["{}","[]","IP"]},{"Name":"LastAttempt","Docs":"","Typewords":["nullable","timestamp"]},{"Name":"Results","Docs":"","Typewords":["[]","MsgResult"]},{"Name":"Has8bit","Docs":"","Typewords":["bool"]},{"Name":"SMTPUTF8","Docs":"","Typewords":["bool"]},{"Name":"IsDMARCReport","Docs":"","Typewords":["bool"]},{"Name":"IsTLSReport","Docs":"","Typewords":["bool"]},{"Name":"Size","Docs":"","Typewords":["int64"]},{"Name":"MessageID","Docs":"","Typewords":["string"]},{"Name":"Subject","Docs":"","Typewords":["string"]},{"Name":"Transport","Docs":"","Typewords":["string"]},{"Name":"RequireTLS","Docs":"","Typewords":["nullable","bool"]},{"Name":"FutureReleaseRequest","Docs":"","Typewords":["string"]},{"Name":"Extra","Docs":"","Typewords":["{}","string"]},{"Name":"LastActivity","Docs":"","Typewords":["timestamp"]},{"Name":"RecipientAddress","Docs":"","Typewords":["string"]},{"Name":"Success","Docs":"","Typewords":["bool"]},{"Name":"KeepUntil","Docs":"","Typewords":["timestamp"]}]},
+	"MsgRetired": {"Name":"MsgRetired","Docs":"","Fields":[{"Name":"ID","Docs":"","Typewords":["int64"]},{"Name":"BaseID","Docs":"","Typewords":["int64"]},{"Name":"Queued","Docs":"","Typewords":["timestamp"]},{"Name":"SenderAccount","Docs":"","Typewords":["string"]},{"Name":"SenderLocalpart","Docs":"","Typewords":["Localpart"]},{"Name":"SenderDomainStr","Docs":"","Typewords":["string"]},{"Name":"FromID","Docs":"","Typewords":["string"]},{"Name":"RecipientLocalpart","Docs":"","Typewords":["Localpart"]},{"Name":"RecipientDomain","Docs":"","Typewords":["IPDomain"]},{"Name":"RecipientDomainStr","Docs":"","Typewords":["string"]},{"Name":"Attempts","Docs":"","Typewords":["int32"]},{"Name":"MaxAttempts","Docs":"","Typewords":["int32"]},{"Name":"DialedIPs","Docs":"","Typewords":["{}","[]","IP"]},{"Name":"LastAttempt","Docs":"","Typewords":["nullable","timestamp"]},{"Name":"Results","Docs":"","Typewords":["[]","MsgResult"]},{"Name":"Has8bit","Docs":"","Typewords":["bool"]},{"Name":"SMTPUTF8","Docs":"","Typewords":["bool"]},{"Name":"IsDMARCReport","Docs":"","Typewords":["bool"]},{"Name":"IsTLSReport","Docs":"","Typewords":["bool"]},{"Name":"Size","Docs":"","Typewords":["int64"]},{"Name":"MessageID","Docs":"","Typewords":["string"]},{"Name":"Subject","Docs":"","Typewords":["string"]},{"Name":"Transport","Docs":"","Typewords":["string"]},{"Name":"IPPool","Docs":"","Typewords":["string"]},{"Name":"RequireTLS","Docs":"","Typewords":["nullable","bool"]},{"Name":"FutureReleaseRequest","Docs":"","Typewords":["string"]},{"Name":"Extra","Docs":"","Typewords":["{}","string"]},{"Name":"LastActivity","Docs":"","Typewords":["timestamp"]},{"Name":"RecipientAddress","Docs":"","Typewords":["string"]},{"Name":"Success","Docs":"","Typewords":["bool"]},{"Name":"KeepUntil","Docs":"","Typewords":["timestamp"]}]},
 	"HookFilter": {"Name":"HookFilter","Docs":"","Fields":[{"Name":"Max","Docs":"","Typewords":["int32"]},{"Name":"IDs","Docs":"","Typewords":["[]","int64"]},{"Name":"Account","Docs":"","Typewords":["string"]},{"Name":"Submitted","Docs":"","Typewords":["string"]},{"Name":"NextAttempt","Docs":"","Typewords":["string"]},{"Name":"Event","Docs":"","Typewords":["string"]}]},
 	"HookSort": {"Name":"HookSort","Docs":"","Fields":[{"Name":"Field","Docs":"","Typewords":["string"]},{"Name":"LastID","Docs":"","Typewords":["int64"]},{"Name":"Last","Docs":"","Typewords":["any"]},{"Name":"Asc","Docs":"","Typewords":["bool"]}]},
 	"Hook": {"Name":"Hook","Docs":"","Fields":[{"Name":"ID","Docs":"","Typewords":["int64"]},{"Name":"QueueMsgID","Docs":"","Typewords":["int64"]},{"Name":"FromID","Docs":"","Typewords":["string"]},{"Name":"MessageID","Docs":"","Typewords":["string"]},{"Name":"Subject","Docs":"","Typewords":["string"]},{"Name":"Extra","Docs":"","Typewords":["{}","string"]},{"Name":"Account","Docs":"","Typewords":["string"]},{"Name":"URL","Docs":"","Typewords":["string"]},{"Name":"Authorization","Docs":"","Typewords":["string"]},{"Name":"IsIncoming","Docs":"","Typewords":["bool"]},{"Name":"OutgoingEvent","Docs":"","Typewords":["string"]},{"Name":"Payload","Docs":"","Typewords":["string"]},{"Name":"Submitted","Docs":"","Typewords":["timestamp"]},{"Name":"Attempts","Docs":"","Typewords":["int32"]},{"Name":"NextAttempt","Docs":"","Typewords":["timestamp"]},{"Name":"Results","Docs":"","Typewords":["[]","HookResult"]}]},
@@ -1202,7 +1320,9 @@ export const types: TypenameMap = {
 	"TransportSMTP": {"Name":"TransportSMTP","Docs":"","Fields":[{"Name":"Host","Docs":"","Typewords":["string"]},{"Name":"Port","Docs":"","Typewords":["int32"]},{"Name":"STARTTLSInsecureSkipVerify","Docs":"","Typewords":["bool"]},{"Name":"NoSTARTTLS","Docs":"","Typewords":["bool"]},{"Name":"Auth","Docs":"","Typewords":["nullable","SMTPAuth"]}]},
 	"SMTPAuth": {"Name":"SMTPAuth","Docs":"","Fields":[{"Name":"Username","Docs":"","Typewords":["string"]},{"Name":"Password","Docs":"","Typewords":["string"]},{"Name":"Mechanisms","Docs":"","Typewords":["[]","string"]}]},
 	"TransportSocks": {"Name":"TransportSocks","Docs":"","Fields":[{"Name":"Address","Docs":"","Typewords":["string"]},{"Name":"RemoteIPs","Docs":"","Typewords":["[]","string"]},{"Name":"RemoteHostname","Docs":"","Typewords":["string"]}]},
-	"TransportDirect": {"Name":"TransportDirect","Docs":"","Fields":[{"Name":"DisableIPv4","Docs":"","Typewords":["bool"]},{"Name":"DisableIPv6","Docs":"","Typewords":["bool"]}]},
+	"TransportDirect": {"Name":"TransportDirect","Docs":"","Fields":[{"Name":"DisableIPv4","Docs":"","Typewords":["bool"]},{"Name":"DisableIPv6","Docs":"","Typewords":["bool"]},{"Name":"IPPools","Docs":"","Typewords":["{}","IPPool"]}]},
+	"IPPool": {"Name":"IPPool","Docs":"","Fields":[{"Name":"IPs","Docs":"","Typewords":["[]","PoolIP"]}]},
+	"PoolIP": {"Name":"PoolIP","Docs":"","Fields":[{"Name":"IP","Docs":"","Typewords":["string"]},{"Name":"Hostname","Docs":"","Typewords":["string"]}]},
 	"EvaluationStat": {"Name":"EvaluationStat","Docs":"","Fields":[{"Name":"Domain","Docs":"","Typewords":["Domain"]},{"Name":"Dispositions","Docs":"","Typewords":["[]","string"]},{"Name":"Count","Docs":"","Typewords":["int32"]},{"Name":"SendReport","Docs":"","Typewords":["bool"]}]},
 	"Evaluation": {"Name":"Evaluation","Docs":"","Fields":[{"Name":"ID","Docs":"","Typewords":["int64"]},{"Name":"PolicyDomain","Docs":"","Typewords":["string"]},{"Name":"Evaluated","Docs":"","Typewords":["timestamp"]},{"Name":"Optional","Docs":"","Typewords":["bool"]},{"Name":"IntervalHours","Docs":"","Typewords":["int32"]},{"Name":"Addresses","Docs":"","Typewords":["[]","string"]},{"Name":"PolicyPublished","Docs":"","Typewords":["PolicyPublished"]},{"Name":"SourceIP","Docs":"","Typewords":["string"]},{"Name":"Disposition","Docs":"","Typewords":["string"]},{"Name":"AlignedDKIMPass","Docs":"","Typewords":["bool"]},{"Name":"AlignedSPFPass","Docs":"","Typewords":["bool"]},{"Name":"OverrideReasons","Docs":"","Typewords":["[]","PolicyOverrideReason"]},{"Name":"EnvelopeTo","Docs":"","Typewords":["string"]},{"Name":"EnvelopeFrom","Docs":"","Typewords":["string"]},{"Name":"HeaderFrom","Docs":"","Typewords":["string"]},{"Name":"DKIMResults","Docs":"","Typewords":["[]","DKIMAuthResult"]},{"Name":"SPFResults","Docs":"","Typewords":["[]","SPFAuthResult"]}]},
 	"SuppressAddress": {"Name":"SuppressAddress","Docs":"","Fields":[{"Name":"ID","Docs":"","Typewords":["int64"]},{"Name":"Inserted","Docs":"","Typewords":["timestamp"]},{"Name":"ReportingAddress","Docs":"","Typewords":["string"]},{"Name":"Until","Docs":"","Typewords":["timestamp"]},{"Name":"Comment","Docs":"","Typewords":["string"]}]},
@@ -1210,6 +1330,9 @@ export const types: TypenameMap = {
 	"TLSRPTSuppressAddress": {"Name":"TLSRPTSuppressAddress","Docs":"","Fields":[{"Name":"ID","Docs":"","Typewords":["int64"]},{"Name":"Inserted","Docs":"","Typewords":["timestamp"]},{"Name":"ReportingAddress","Docs":"","Typewords":["string"]},{"Name":"Until","Docs":"","Typewords":["timestamp"]},{"Name":"Comment","Docs":"","Typewords":["string"]}]},
 	"Dynamic": {"Name":"Dynamic","Docs":"","Fields":[{"Name":"Domains","Docs":"","Typewords":["{}","ConfigDomain"]},{"Name":"Accounts","Docs":"","Typewords":["{}","Account"]},{"Name":"WebDomainRedirects","Docs":"","Typewords":["{}","string"]},{"Name":"WebHandlers","Docs":"","Typewords":["[]","WebHandler"]},{"Name":"Routes","Docs":"","Typewords":["[]","Route"]},{"Name":"MonitorDNSBLs","Docs":"","Typewords":["[]","string"]},{"Name":"MonitorDNSBLZones","Docs":"","Typewords":["[]","Domain"]}]},
 	"CSRFToken": {"Name":"CSRFToken","Docs":"","Values":null},
+	"Role": {"Name":"Role","Docs":"","Values":[{"Name":"RoleAdmin","Value":"admin","Docs":""},{"Name":"RoleReadOnly","Value":"readonly","Docs":""},{"Name":"RoleQueue","Value":"queue","Docs":""},{"Name":"RoleDomain","Value":"domain","Docs":""}]},
+	"AuditSource": {"Name":"AuditSource","Docs":"","Values":[{"Name":"AuditSourceNone","Value":"","Docs":""},{"Name":"AuditSourceCtl","Value":"ctl","Docs":""},{"Name":"AuditSourceWebadmin","Value":"webadmin","Docs":""},{"Name":"AuditSourceWebaccount","Value":"webaccount","Docs":""}]},
+	"AuditKind": {"Name":"AuditKind","Docs":"","Values":[{"Name":"AuditKindAny","Value":"","Docs":""},{"Name":"AuditConfig","Value":"config","Docs":""},{"Name":"AuditQueue","Value":"queue","Docs":""},{"Name":"AuditPassword","Value":"password","Docs":""},{"Name":"AuditAdminUser","Value":"adminuser","Docs":""}]},
 	"DMARCPolicy": {"Name":"DMARCPolicy","Docs":"","Values":[{"Name":"PolicyEmpty","Value":"","Docs":""},{"Name":"PolicyNone","Value":"none","Docs":""},{"Name":"PolicyQuarantine","Value":"quarantine","Docs":""},{"Name":"PolicyReject","Value":"reject","Docs":""}]},
 	"Align": {"Name":"Align","Docs":"","Values":[{"Name":"AlignStrict","Value":"s","Docs":""},{"Name":"AlignRelaxed","Value":"r","Docs":""}]},
 	"RUA": {"Name":"RUA","Docs":"","Values":null},
@@ -1219,6 +1342,10 @@ export const types: TypenameMap = {
 }
 
 export const parser = {
+	TOTPSetup: (v: any) => parse("TOTPSetup", v) as TOTPSetup,
+	User: (v: any) => parse("User", v) as User,
+	AuditFilter: (v: any) => parse("AuditFilter", v) as AuditFilter,
+	AuditEntry: (v: any) => parse("AuditEntry", v) as AuditEntry,
 	CheckResult: (v: any) => parse("CheckResult", v) as CheckResult,
 	DNSSECResult: (v: any) => parse("DNSSECResult", v) as DNSSECResult,
 	IPRevCheckResult: (v: any) => parse("IPRevCheckResult", v) as IPRevCheckResult,
@@ -1301,6 +1428,7 @@ export const parser = {
 	Msg: (v: any) => parse("Msg", v) as Msg,
 	IPDomain: (v: any) => parse("IPDomain", v) as IPDomain,
 	MsgResult: (v: any) => parse("MsgResult", v) as MsgResult,
+	RateLimitState: (v: any) => parse("RateLimitState", v) as RateLimitState,
 	RetiredFilter: (v: any) => parse("RetiredFilter", v) as RetiredFilter,
 	RetiredSort: (v: any) => parse("RetiredSort", v) as RetiredSort,
 	MsgRetired: (v: any) => parse("MsgRetired", v) as MsgRetired,
@@ -1322,6 +1450,8 @@ export const parser = {
 	SMTPAuth: (v: any) => parse("SMTPAuth", v) as SMTPAuth,
 	TransportSocks: (v: any) => parse("TransportSocks", v) as TransportSocks,
 	TransportDirect: (v: any) => parse("TransportDirect", v) as TransportDirect,
+	IPPool: (v: any) => parse("IPPool", v) as IPPool,
+	PoolIP: (v: any) => parse("PoolIP", v) as PoolIP,
 	EvaluationStat: (v: any) => parse("EvaluationStat", v) as EvaluationStat,
 	Evaluation: (v: any) => parse("Evaluation", v) as Evaluation,
 	SuppressAddress: (v: any) => parse("SuppressAddress", v) as SuppressAddress,
@@ -1329,6 +1459,9 @@ export const parser = {
 	TLSRPTSuppressAddress: (v: any) => parse("TLSRPTSuppressAddress", v) as TLSRPTSuppressAddress,
 	Dynamic: (v: any) => parse("Dynamic", v) as Dynamic,
 	CSRFToken: (v: any) => parse("CSRFToken", v) as CSRFToken,
+	Role: (v: any) => parse("Role", v) as Role,
+	AuditSource: (v: any) => parse("AuditSource", v) as AuditSource,
+	AuditKind: (v: any) => parse("AuditKind", v) as AuditKind,
 	DMARCPolicy: (v: any) => parse("DMARCPolicy", v) as DMARCPolicy,
 	Align: (v: any) => parse("Align", v) as Align,
 	RUA: (v: any) => parse("RUA", v) as RUA,
@@ -1339,7 +1472,8 @@ export const parser = {
 
 // Admin exports web API functions for the admin web interface. All its methods are
 // exported under api/. Function calls require valid HTTP Authentication
-// credentials of a user.
+// credentials of a user, and the role of the admin user must allow the function,
+// see apiPermissions.
 let defaultOptions: ClientOptions = {slicesNullable: true, mapsNullable: true, nullableOptional: true}
 
 export class Client {
@@ -1378,15 +1512,70 @@ export class Client {
 	}
 
 	// Login returns a session token for the credentials, or fails with error code
-	// "user:badLogin". Call LoginPrep to get a loginToken.
-	async Login(loginToken: string, password: string): Promise<CSRFToken> {
+	// "user:badLogin". Call LoginPrep to get a loginToken. For the admin password,
+	// username must be empty. Otherwise the credentials are of an admin user.
+	async Login(loginToken: string, username: string, password: string): Promise<CSRFToken> {
 		const fn: string = "Login"
+		const paramTypes: string[][] = [["string"],["string"],["string"]]
+		const returnTypes: string[][] = [["CSRFToken"]]
+		const params: any[] = [loginToken, username, password]
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as CSRFToken
+	}
+
+	// LoginTOTP completes a login for which Login failed with error code
+	// "user:totpRequired", with a code from an authenticator app. Fails with error
+	// code "user:loginFailed" for a bad code.
+	async LoginTOTP(loginToken: string, code: string): Promise<CSRFToken> {
+		const fn: string = "LoginTOTP"
 		const paramTypes: string[][] = [["string"],["string"]]
 		const returnTypes: string[][] = [["CSRFToken"]]
-		const params: any[] = [loginToken, password]
+		const params: any[] = [loginToken, code]
 		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as CSRFToken
 	}
 
+	// TOTPStatus returns whether logins of the admin (user) require a TOTP code from
+	// an authenticator app.
+	async TOTPStatus(): Promise<boolean> {
+		const fn: string = "TOTPStatus"
+		const paramTypes: string[][] = []
+		const returnTypes: string[][] = [["bool"]]
+		const params: any[] = []
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as boolean
+	}
+
+	// TOTPSetupStart starts enrollment of the admin for two-factor authentication
+	// with a new secret, for adding to an authenticator app. Logins do not require a
+	// code until enrollment is confirmed with TOTPSetupConfirm.
+	async TOTPSetupStart(): Promise<TOTPSetup> {
+		const fn: string = "TOTPSetupStart"
+		const paramTypes: string[][] = []
+		const returnTypes: string[][] = [["TOTPSetup"]]
+		const params: any[] = []
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as TOTPSetup
+	}
+
+	// TOTPSetupConfirm enables two-factor authentication for the admin (user) if code
+	// from the authenticator app is valid. To disable TOTP for the admin password
+	// without the web interface, remove the admin password file with ".totp"
+	// appended.
+	async TOTPSetupConfirm(code: string): Promise<void> {
+		const fn: string = "TOTPSetupConfirm"
+		const paramTypes: string[][] = [["string"]]
+		const returnTypes: string[][] = []
+		const params: any[] = [code]
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as void
+	}
+
+	// TOTPDisable disables two-factor authentication for the admin (user), logins
+	// only require the password again.
+	async TOTPDisable(): Promise<void> {
+		const fn: string = "TOTPDisable"
+		const paramTypes: string[][] = []
+		const returnTypes: string[][] = []
+		const params: any[] = []
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as void
+	}
+
 	// Logout invalidates the session token.
 	async Logout(): Promise<void> {
 		const fn: string = "Logout"
@@ -1396,6 +1585,85 @@ export class Client {
 		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as void
 	}
 
+	// AdminUserCurrent returns the logged in admin user. For the admin password, the
+	// name is empty and the role is admin.
+	async AdminUserCurrent(): Promise<User> {
+		const fn: string = "AdminUserCurrent"
+		const paramTypes: string[][] = []
+		const returnTypes: string[][] = [["User"]]
+		const params: any[] = []
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as User
+	}
+
+	// AdminUsers returns all admin users.
+	async AdminUsers(): Promise<User[] | null> {
+		const fn: string = "AdminUsers"
+		const paramTypes: string[][] = []
+		const returnTypes: string[][] = [["[]","User"]]
+		const params: any[] = []
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as User[] | null
+	}
+
+	// AdminUserAdd adds an admin user with a role, and for role "domain" the domains
+	// it manages. The password is optional, without password the user cannot log in
+	// to the admin web interface, but can still be used for connections to the ctl
+	// socket by its unix user.
+	async AdminUserAdd(user: User, password: string): Promise<void> {
+		const fn: string = "AdminUserAdd"
+		const paramTypes: string[][] = [["User"],["string"]]
+		const returnTypes: string[][] = []
+		const params: any[] = [user, password]
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as void
+	}
+
+	// AdminUserSave changes the role, domains and unix user of an admin user.
+	async AdminUserSave(user: User): Promise<void> {
+		const fn: string = "AdminUserSave"
+		const paramTypes: string[][] = [["User"]]
+		const returnTypes: string[][] = []
+		const params: any[] = [user]
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as void
+	}
+
+	// AdminUserPasswordSet sets a new password for an admin user, ending its
+	// sessions. An empty password disables logins to the admin web interface.
+	async AdminUserPasswordSet(name: string, password: string): Promise<void> {
+		const fn: string = "AdminUserPasswordSet"
+		const paramTypes: string[][] = [["string"],["string"]]
+		const returnTypes: string[][] = []
+		const params: any[] = [name, password]
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as void
+	}
+
+	// AdminUserTOTPDisable disables two-factor authentication for an admin user,
+	// e.g. after losing the authenticator app.
+	async AdminUserTOTPDisable(name: string): Promise<void> {
+		const fn: string = "AdminUserTOTPDisable"
+		const paramTypes: string[][] = [["string"]]
+		const returnTypes: string[][] = []
+		const params: any[] = [name]
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as void
+	}
+
+	// AdminUserRemove removes an admin user, ending its sessions.
+	async AdminUserRemove(name: string): Promise<void> {
+		const fn: string = "AdminUserRemove"
+		const paramTypes: string[][] = [["string"]]
+		const returnTypes: string[][] = []
+		const params: any[] = [name]
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as void
+	}
+
+	// AuditList returns entries from the audit log of changes to the configuration,
+	// queues and passwords, newest first.
+	async AuditList(filter: AuditFilter): Promise<AuditEntry[] | null> {
+		const fn: string = "AuditList"
+		const paramTypes: string[][] = [["AuditFilter"]]
+		const returnTypes: string[][] = [["[]","AuditEntry"]]
+		const params: any[] = [filter]
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as AuditEntry[] | null
+	}
+
 	// CheckDomain checks the configuration for the domain, such as MX, SMTP STARTTLS,
 	// SPF, DKIM, DMARC, TLSRPT, MTASTS, autoconfig, autodiscover.
 	async CheckDomain(domainName: string): Promise<CheckResult> {
@@ -1406,7 +1674,8 @@ export class Client {
 		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as CheckResult
 	}
 
-	// Domains returns all configured domain names, in UTF-8 for IDNA domains.
+	// Domains returns all configured domain names, in UTF-8 for IDNA domains. For
+	// domain admins, only the domains managed by the admin are returned.
 	async Domains(): Promise<Domain[] | null> {
 		const fn: string = "Domains"
 		const paramTypes: string[][] = []
@@ -1451,7 +1720,8 @@ export class Client {
 		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as [{ [key: string]: string }, { [key: string]: Alias }]
 	}
 
-	// Accounts returns the names of all configured accounts.
+	// Accounts returns the names of all configured accounts. For domain admins, only
+	// accounts with a default domain managed by the admin are returned.
 	async Accounts(): Promise<string[] | null> {
 		const fn: string = "Accounts"
 		const paramTypes: string[][] = []
@@ -1657,6 +1927,17 @@ export class Client {
 		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as void
 	}
 
+	// AccountTOTPDisable disables two-factor authentication for logins to the web
+	// interfaces of an account, e.g. after a user lost their authenticator app and
+	// recovery codes.
+	async AccountTOTPDisable(accountName: string): Promise<void> {
+		const fn: string = "AccountTOTPDisable"
+		const paramTypes: string[][] = [["string"]]
+		const returnTypes: string[][] = []
+		const params: any[] = [accountName]
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as void
+	}
+
 	// AccountSettingsSave set new settings for an account that only an admin can set.
 	async AccountSettingsSave(accountName: string, maxOutgoingMessagesPerDay: number, maxFirstTimeRecipientsPerDay: number, maxMsgSize: number, firstTimeSenderDelay: boolean): Promise<void> {
 		const fn: string = "AccountSettingsSave"
@@ -1723,6 +2004,16 @@ export class Client {
 		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as Msg[] | null
 	}
 
+	// QueueRateLimits returns the configured outgoing rate limits with their current
+	// usage.
+	async QueueRateLimits(): Promise<RateLimitState[] | null> {
+		const fn: string = "QueueRateLimits"
+		const paramTypes: string[][] = []
+		const returnTypes: string[][] = [["[]","RateLimitState"]]
+		const params: any[] = []
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as RateLimitState[] | null
+	}
+
 	// QueueNextAttemptSet sets a new time for next delivery attempt of matching
 	// messages from the queue.
 	async QueueNextAttemptSet(filter: Filter, minutes: number): Promise<number> {
@@ -134,6 +134,8 @@ func badResponse(hresp *http.Response) error {
 //   - multipleFrom, if multiple from addresses were specified.
 //   - badFrom, if a from address was specified that isn't configured for the account.
 //   - noRecipients, if no recipients were specified.
+//   - unknownIPPool, if IPPool was specified but is not configured.
+//   - ipPoolNotAllowed, if IPPool is not in the IP pools configured for the account.
 //   - messageLimitReached, if the outgoing message rate limit was reached.
 //   - recipientLimitReached, if the outgoing new recipient rate limit was reached.
 //   - messageTooLarge, message larger than configured maximum size.
@@ -242,3 +244,54 @@ func (c Client) MessageFlagsRemove(ctx context.Context, req MessageFlagsRemoveRe
 func (c Client) MessageMove(ctx context.Context, req MessageMoveRequest) (resp MessageMoveResult, err error) {
 	return transact[MessageMoveResult](ctx, c, "MessageMove", req)
 }
+
+// MessageSearch returns IDs of messages containing all words, in headers or
+// text bodies, newest first. Words are matched case-insensitively, and can be
+// part of a longer word in the message.
+//
+// Error codes:
+//   - mailboxNotFound, if the mailbox does not exist.
+func (c Client) MessageSearch(ctx context.Context, req MessageSearchRequest) (resp MessageSearchResult, err error) {
+	return transact[MessageSearchResult](ctx, c, "MessageSearch", req)
+}
+
+// VacationGet returns the settings for automatic responses to incoming messages.
+func (c Client) VacationGet(ctx context.Context, req VacationGetRequest) (resp VacationGetResult, err error) {
+	return transact[VacationGetResult](ctx, c, "VacationGet", req)
+}
+
+// VacationSet replaces the settings for automatic responses to incoming
+// messages. No responses are sent to mailing lists, automated messages, or
+// messages that don't explicitly address the account.
+func (c Client) VacationSet(ctx context.Context, req VacationSetRequest) (resp VacationSetResult, err error) {
+	return transact[VacationSetResult](ctx, c, "VacationSet", req)
+}
+
+// ScheduledList returns the messages submitted by the account that are waiting
+// for their first delivery attempt, at a time requested with FutureRelease or
+// after an "undo send" grace period.
+func (c Client) ScheduledList(ctx context.Context, req ScheduledListRequest) (resp ScheduledListResult, err error) {
+	return transact[ScheduledListResult](ctx, c, "ScheduledList", req)
+}
+
+// ScheduledCancel removes scheduled messages from the queue before their first
+// delivery attempt. Either all messages are canceled, or none. Webhooks with
+// event "canceled" are sent for the messages. A copy stored in the Sent mailbox
+// is not removed.
+//
+// Error codes:
+//   - notScheduled, if a message does not exist or was not scheduled.
+//   - deliveryAttempted, if delivery was already attempted for a message.
+func (c Client) ScheduledCancel(ctx context.Context, req ScheduledCancelRequest) (resp ScheduledCancelResult, err error) {
+	return transact[ScheduledCancelResult](ctx, c, "ScheduledCancel", req)
+}
+
+// ScheduledReschedule changes the time of the first delivery attempt of
+// scheduled messages.
+//
+// Error codes:
+//   - notScheduled, if a message does not exist or was not scheduled.
+//   - deliveryAttempted, if delivery was already attempted for a message.
+func (c Client) ScheduledReschedule(ctx context.Context, req ScheduledRescheduleRequest) (resp ScheduledRescheduleResult, err error) {
+	return transact[ScheduledRescheduleResult](ctx, c, "ScheduledReschedule", req)
+}
@@ -27,6 +27,12 @@ type Methods interface {
 	MessageFlagsAdd(ctx context.Context, request MessageFlagsAddRequest) (response MessageFlagsAddResult, err error)
 	MessageFlagsRemove(ctx context.Context, request MessageFlagsRemoveRequest) (response MessageFlagsRemoveResult, err error)
 	MessageMove(ctx context.Context, request MessageMoveRequest) (response MessageMoveResult, err error)
+	MessageSearch(ctx context.Context, request MessageSearchRequest) (response MessageSearchResult, err error)
+	VacationGet(ctx context.Context, request VacationGetRequest) (response VacationGetResult, err error)
+	VacationSet(ctx context.Context, request VacationSetRequest) (response VacationSetResult, err error)
+	ScheduledList(ctx context.Context, request ScheduledListRequest) (response ScheduledListResult, err error)
+	ScheduledCancel(ctx context.Context, request ScheduledCancelRequest) (response ScheduledCancelResult, err error)
+	ScheduledReschedule(ctx context.Context, request ScheduledRescheduleRequest) (response ScheduledRescheduleResult, err error)
 }
 
 // Error indicates an API-related error.
@@ -133,9 +139,21 @@ type SendRequest struct {
 	RequireTLS *bool
 
 	// If set, it should be a time in the future at which the first delivery attempt
-	// starts. Optional.
+	// starts. Until then, the message can be canceled or rescheduled. Optional.
 	FutureRelease *time.Time
 
+	// If set and FutureRelease is not, the first delivery attempt is delayed by this
+	// many seconds, at most 600. Until then, sending can be undone with
+	// ScheduledCancel. Optional.
+	UndoSendSeconds int
+
+	// Name of an IP pool configured for a direct transport, to make outgoing
+	// connections from, e.g. to keep transactional messages apart from newsletters.
+	// The pool must be listed in the IPPools of the account configuration. Takes
+	// precedence over routes configured for the account, domain or globally.
+	// Optional.
+	IPPool string
+
 	// Whether to store outgoing message in designated Sent mailbox (if configured).
 	SaveSent bool
 }
@@ -259,3 +277,61 @@ type MessageMoveRequest struct {
 	DestMailboxName string // E.g. "Inbox", must already exist.
 }
 type MessageMoveResult struct{}
+
+type MessageSearchRequest struct {
+	MailboxName string   // Optional, e.g. "Inbox". If empty, all mailboxes are searched.
+	Words       []string // Required. Messages must contain all words, case-insensitive, in headers or text bodies.
+	Limit       int      // Maximum number of results. Default and maximum is 1000.
+}
+type MessageSearchResult struct {
+	MsgIDs []int64 // Newest first.
+}
+
+// Vacation holds the settings for automatic responses to senders of incoming
+// messages, e.g. while out of office.
+type Vacation struct {
+	Enabled      bool
+	Start        *time.Time // Optional. No responses are sent before this time.
+	End          *time.Time // Optional. No responses are sent at or after this time.
+	Subject      string     // Optional. If empty, "Auto: " followed by the subject of the incoming message.
+	Text         string     // Text of the response, required when enabled. Lines must be \n-separated.
+	IntervalDays int        // Minimum number of days between responses to the same sender. Default 7, maximum 90.
+}
+
+type VacationGetRequest struct{}
+type VacationGetResult struct {
+	Vacation Vacation
+}
+
+type VacationSetRequest struct {
+	Vacation Vacation
+}
+type VacationSetResult struct{}
+
+// Scheduled is a submitted message waiting for its first delivery attempt, at a
+// time requested with FutureRelease or after an "undo send" grace period.
+type Scheduled struct {
+	QueueMsgID int64
+	MessageID  string // Message-ID header, including <>.
+	Subject    string
+	Recipient  string
+	Queued     time.Time
+	SendAt     time.Time // Time of first delivery attempt.
+	UndoSend   bool      // Whether SendAt is the end of an "undo send" grace period.
+}
+
+type ScheduledListRequest struct{}
+type ScheduledListResult struct {
+	Scheduled []Scheduled // Ordered by SendAt.
+}
+
+type ScheduledCancelRequest struct {
+	QueueMsgIDs []int64
+}
+type ScheduledCancelResult struct{}
+
+type ScheduledRescheduleRequest struct {
+	QueueMsgIDs []int64
+	SendAt      time.Time
+}
+type ScheduledRescheduleResult struct{}
@@ -432,7 +432,7 @@ func (s server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}()
 
 	var err error
-	acc, err = store.OpenEmailAuth(log, email, password)
+	acc, err = store.OpenEmailAuth(log, email, password, store.AppProtocolWebAPI)
 	if err != nil {
 		mox.LimiterFailedAuth.Add(remoteIP, t0, 1)
 		if errors.Is(err, mox.ErrDomainNotFound) || errors.Is(err, mox.ErrAddressNotFound) || errors.Is(err, store.ErrUnknownCredentials) {
@@ -634,6 +634,18 @@ func (s server) Send(ctx context.Context, req webapi.SendRequest) (resp webapi.S
 		return resp, webapi.Error{Code: "noRecipients", Message: "no recipients"}
 	}
 
+	if req.IPPool != "" && !queue.IPPoolExists(req.IPPool) {
+		return resp, webapi.Error{Code: "unknownIPPool", Message: "ip pool not configured"}
+	} else if req.IPPool != "" && !slices.Contains(accConf.IPPools, req.IPPool) {
+		return resp, webapi.Error{Code: "ipPoolNotAllowed", Message: "ip pool not allowed for account"}
+	}
+
+	if req.FutureRelease != nil {
+		xcheckFutureRelease(*req.FutureRelease)
+	} else if req.UndoSendSeconds < 0 || time.Duration(req.UndoSendSeconds)*time.Second > queue.UndoSendIntervalMax {
+		xcheckuserf(fmt.Errorf("must be between 0 and %v", queue.UndoSendIntervalMax), "checking undo send period")
+	}
+
 	// Check outgoing message rate limit.
 	xdbread(ctx, acc, func(tx *bstore.Tx) {
 		msglimit, rcptlimit, err := acc.SendLimitReached(tx, recipients)
@@ -994,14 +1006,16 @@ func (s server) Send(ctx context.Context, req webapi.SendRequest) (resp webapi.S
 		qm := queue.MakeMsg(fp, rcpt, xc.Has8bit, xc.SMTPUTF8, msgSize, m.MessageID, []byte(rcptMsgPrefix), req.RequireTLS, now, m.Subject)
 		qm.FromID = fromIDs[i]
 		qm.Extra = req.Extra
+		qm.IPPool = req.IPPool
 		if req.FutureRelease != nil {
-			ival := time.Until(*req.FutureRelease)
-			if ival > queue.FutureReleaseIntervalMax {
-				xcheckuserf(fmt.Errorf("date/time can not be further than %v in the future", queue.FutureReleaseIntervalMax), "scheduling delivery")
-			}
 			qm.NextAttempt = *req.FutureRelease
+			qm.SendAt = *req.FutureRelease
 			qm.FutureReleaseRequest = "until;" + req.FutureRelease.Format(time.RFC3339)
 			// todo: possibly add a header to the message stored in the Sent mailbox to indicate it was scheduled for later delivery.
+		} else if req.UndoSendSeconds > 0 {
+			qm.NextAttempt = now.Add(time.Duration(req.UndoSendSeconds) * time.Second)
+			qm.SendAt = qm.NextAttempt
+			qm.UndoSend = true
 		}
 		qml[i] = qm
 	}
@@ -1098,6 +1112,13 @@ func (s server) Send(ctx context.Context, req webapi.SendRequest) (resp webapi.S
 	return resp, nil
 }
 
+// xcheckFutureRelease checks a requested time for a scheduled delivery.
+func xcheckFutureRelease(t time.Time) {
+	if time.Until(t) > queue.FutureReleaseIntervalMax {
+		xcheckuserf(fmt.Errorf("date/time can not be further than %v in the future", queue.FutureReleaseIntervalMax), "scheduling delivery")
+	}
+}
+
 func (s server) SuppressionList(ctx context.Context, req webapi.SuppressionListRequest) (resp webapi.SuppressionListResult, err error) {
 	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
 	resp.Suppressions, err = queue.SuppressionList(ctx, reqInfo.Account.Name)
@@ -1339,3 +1360,158 @@ func (s server) MessageMove(ctx context.Context, req webapi.MessageMoveRequest)
 	xops.MessageMove(ctx, reqInfo.Log, reqInfo.Account, []int64{req.MsgID}, req.DestMailboxName, 0)
 	return
 }
+
+func (s server) MessageSearch(ctx context.Context, req webapi.MessageSearchRequest) (resp webapi.MessageSearchResult, err error) {
+	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
+	log := reqInfo.Log
+	acc := reqInfo.Account
+
+	if len(req.Words) == 0 {
+		return resp, webapi.Error{Code: "user", Message: "at least one word required"}
+	}
+	limit := req.Limit
+	if limit <= 0 || limit > 1000 {
+		limit = 1000
+	}
+
+	resp.MsgIDs = []int64{}
+	acc.WithRLock(func() {
+		err = acc.DB.Read(ctx, func(tx *bstore.Tx) error {
+			q := bstore.QueryTx[store.Message](tx)
+			q.FilterEqual("Expunged", false)
+			if req.MailboxName != "" {
+				mb, err := acc.MailboxFind(tx, req.MailboxName)
+				xcheckf(err, "looking up mailbox")
+				if mb == nil {
+					panic(webapi.Error{Code: "mailboxNotFound", Message: "mailbox not found"})
+				}
+				q.FilterNonzero(store.Message{MailboxID: mb.ID})
+			}
+			q.SortDesc("Received")
+
+			ws := store.PrepareWordSearch(req.Words, nil)
+			err := ws.UseIndex(tx, true)
+			xcheckf(err, "looking up words in full-text index")
+
+			return q.ForEach(func(m store.Message) error {
+				if ws.IndexMiss(m) {
+					return nil
+				}
+				mr := acc.MessageReader(m)
+				defer func() {
+					err := mr.Close()
+					log.Check(err, "closing message reader")
+				}()
+				p, err := m.LoadPart(mr)
+				if err != nil {
+					log.Debugx("load parsed message for search, skipping", err, slog.Int64("msgid", m.ID))
+					return nil
+				}
+				if match, err := ws.MatchPart(log, &p, true); err != nil {
+					return fmt.Errorf("searching message %d: %v", m.ID, err)
+				} else if match {
+					resp.MsgIDs = append(resp.MsgIDs, m.ID)
+					if len(resp.MsgIDs) >= limit {
+						return bstore.StopForEach
+					}
+				}
+				return nil
+			})
+		})
+	})
+	xcheckf(err, "searching messages")
+	return resp, nil
+}
+
+func (s server) VacationGet(ctx context.Context, req webapi.VacationGetRequest) (resp webapi.VacationGetResult, err error) {
+	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
+
+	var v store.Vacation
+	xdbread(ctx, reqInfo.Account, func(tx *bstore.Tx) {
+		v, err = store.VacationGet(tx)
+		xcheckf(err, "get vacation settings")
+	})
+	resp.Vacation = webapi.Vacation{
+		Enabled:      v.Enabled,
+		Subject:      v.Subject,
+		Text:         v.Body,
+		IntervalDays: v.IntervalDays,
+	}
+	if !v.Start.IsZero() {
+		resp.Vacation.Start = &v.Start
+	}
+	if !v.End.IsZero() {
+		resp.Vacation.End = &v.End
+	}
+	return resp, nil
+}
+
+func (s server) VacationSet(ctx context.Context, req webapi.VacationSetRequest) (resp webapi.VacationSetResult, err error) {
+	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
+
+	v := store.Vacation{
+		Enabled:      req.Vacation.Enabled,
+		Subject:      req.Vacation.Subject,
+		Body:         req.Vacation.Text,
+		IntervalDays: req.Vacation.IntervalDays,
+	}
+	if req.Vacation.Start != nil {
+		v.Start = *req.Vacation.Start
+	}
+	if req.Vacation.End != nil {
+		v.End = *req.Vacation.End
+	}
+	xdbwrite(ctx, reqInfo.Account, func(tx *bstore.Tx) {
+		err := store.VacationSave(tx, v)
+		if errors.Is(err, store.ErrVacationInvalid) {
+			xcheckuserf(err, "saving vacation settings")
+		}
+		xcheckf(err, "saving vacation settings")
+	})
+	return resp, nil
+}
+
+func (s server) ScheduledList(ctx context.Context, req webapi.ScheduledListRequest) (resp webapi.ScheduledListResult, err error) {
+	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
+	qml, err := queue.ScheduledList(ctx, reqInfo.Account.Name)
+	xcheckf(err, "listing scheduled messages")
+	resp.Scheduled = make([]webapi.Scheduled, len(qml))
+	for i, qm := range qml {
+		resp.Scheduled[i] = webapi.Scheduled{
+			QueueMsgID: qm.ID,
+			MessageID:  qm.MessageID,
+			Subject:    qm.Subject,
+			Recipient:  qm.Recipient().XString(true),
+			Queued:     qm.Queued,
+			SendAt:     qm.SendAt,
+			UndoSend:   qm.UndoSend,
+		}
+	}
+	return resp, nil
+}
+
+// xcheckScheduled checks an error from an operation on scheduled messages in the
+// queue.
+func xcheckScheduled(err error, action string) {
+	if errors.Is(err, queue.ErrNotScheduled) {
+		panic(webapi.Error{Code: "notScheduled", Message: fmt.Sprintf("%s: %s", action, err)})
+	} else if errors.Is(err, queue.ErrDeliveryAttempted) {
+		panic(webapi.Error{Code: "deliveryAttempted", Message: fmt.Sprintf("%s: %s", action, err)})
+	}
+	xcheckf(err, "%s", action)
+}
+
+func (s server) ScheduledCancel(ctx context.Context, req webapi.ScheduledCancelRequest) (resp webapi.ScheduledCancelResult, err error) {
+	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
+	_, err = queue.ScheduledCancel(ctx, reqInfo.Log, reqInfo.Account.Name, req.QueueMsgIDs)
+	xcheckScheduled(err, "canceling scheduled messages")
+	return resp, nil
+}
+
+func (s server) ScheduledReschedule(ctx context.Context, req webapi.ScheduledRescheduleRequest) (resp webapi.ScheduledRescheduleResult, err error) {
+	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
+	xcheckFutureRelease(req.SendAt)
+	err = queue.ScheduledReschedule(ctx, reqInfo.Account.Name, req.QueueMsgIDs, req.SendAt)
+	xcheckScheduled(err, "rescheduling messages")
+	return resp, nil
+}
@@ -19,6 +19,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/mjl-/mox/config"
 	"github.com/mjl-/mox/message"
 	"github.com/mjl-/mox/mlog"
 	"github.com/mjl-/mox/mox-"
@@ -297,6 +298,31 @@ func TestServer(t *testing.T) {
 	_, err = client.Send(ctxbg, webapi.SendRequest{Message: webapi.Message{Subject: "test", Text: "hi"}})
 	terrcode(t, err, "noRecipients")
 
+	_, err = client.Send(ctxbg, webapi.SendRequest{
+		Message: webapi.Message{
+			To:      []webapi.NameAddress{{Address: "mjl@mox.example"}},
+			Subject: "test",
+			Text:    "hi",
+		},
+		IPPool: "bogus",
+	})
+	terrcode(t, err, "unknownIPPool")
+
+	// Configured IP pools can only be used when allowed for the account.
+	mox.Conf.Static.Transports = map[string]config.Transport{
+		"direct": {Direct: &config.TransportDirect{IPPools: map[string]config.IPPool{"pool": {}}}},
+	}
+	_, err = client.Send(ctxbg, webapi.SendRequest{
+		Message: webapi.Message{
+			To:      []webapi.NameAddress{{Address: "mjl@mox.example"}},
+			Subject: "test",
+			Text:    "hi",
+		},
+		IPPool: "pool",
+	})
+	terrcode(t, err, "ipPoolNotAllowed")
+	mox.Conf.Static.Transports = nil
+
 	_, err = client.Send(ctxbg, webapi.SendRequest{
 		Message: webapi.Message{
 			MessageID: "missingltgt@localhost",
@@ -460,6 +486,18 @@ func TestServer(t *testing.T) {
 	_, err = client.MessageFlagsRemove(ctxbg, webapi.MessageFlagsRemoveRequest{MsgID: 1 + 999, Flags: []string{`\Answered`, "$forwarded", "custom"}})
 	terrcode(t, err, "messageNotFound")
 
+	// MessageSearch
+	searchRes, err := client.MessageSearch(ctxbg, webapi.MessageSearchRequest{Words: []string{"HELLO", "world"}})
+	tcheckf(t, err, "search messages")
+	tcompare(t, searchRes.MsgIDs, []int64{1})
+	searchRes, err = client.MessageSearch(ctxbg, webapi.MessageSearchRequest{MailboxName: "Inbox", Words: []string{"hello"}})
+	tcheckf(t, err, "search messages in mailbox")
+	tcompare(t, searchRes.MsgIDs, []int64{})
+	_, err = client.MessageSearch(ctxbg, webapi.MessageSearchRequest{MailboxName: "Bogus", Words: []string{"hello"}})
+	terrcode(t, err, "mailboxNotFound")
+	_, err = client.MessageSearch(ctxbg, webapi.MessageSearchRequest{})
+	terrcode(t, err, "user")
+
 	// MessageMove
 	tcompare(t, msgRes.Meta.MailboxName, "Sent")
 	_, err = client.MessageMove(ctxbg, webapi.MessageMoveRequest{MsgID: 1, DestMailboxName: "Inbox"})
@@ -481,6 +519,73 @@ func TestServer(t *testing.T) {
 	terrcode(t, err, "messageNotFound") // No longer.
 	_, err = client.MessageDelete(ctxbg, webapi.MessageDeleteRequest{MsgID: 1 + 999})
 	terrcode(t, err, "messageNotFound")
+
+	// VacationGet and VacationSet
+	vacRes, err := client.VacationGet(ctxbg, webapi.VacationGetRequest{})
+	tcheckf(t, err, "get vacation")
+	tcompare(t, vacRes.Vacation, webapi.Vacation{})
+	_, err = client.VacationSet(ctxbg, webapi.VacationSetRequest{Vacation: webapi.Vacation{Enabled: true}})
+	terrcode(t, err, "user") // Missing text.
+	end := time.Now().Add(time.Hour).Round(time.Second)
+	vacation := webapi.Vacation{Enabled: true, End: &end, Subject: "away", Text: "back soon\n", IntervalDays: 3}
+	_, err = client.VacationSet(ctxbg, webapi.VacationSetRequest{Vacation: vacation})
+	tcheckf(t, err, "set vacation")
+	vacRes, err = client.VacationGet(ctxbg, webapi.VacationGetRequest{})
+	tcheckf(t, err, "get vacation")
+	if vacRes.Vacation.End == nil || !vacRes.Vacation.End.Equal(end) {
+		t.Fatalf("got vacation end %v, expected %v", vacRes.Vacation.End, end)
+	}
+	vacRes.Vacation.End = &end
+	tcompare(t, vacRes.Vacation, vacation)
+
+	// ScheduledList, ScheduledReschedule and ScheduledCancel, with the messages sent
+	// with FutureRelease above, and a message sent with an undo period.
+	undoReq := webapi.SendRequest{Message: webapi.Message{To: []webapi.NameAddress{{Address: "mjl+to@mox.example"}}, Text: "hi"}, UndoSendSeconds: 3600}
+	_, err = client.Send(ctxbg, undoReq)
+	terrcode(t, err, "user")
+	undoReq.UndoSendSeconds = 30
+	undoResp, err := client.Send(ctxbg, undoReq)
+	tcheckf(t, err, "send with undo period")
+	undoIDs := []int64{undoResp.Submissions[0].QueueMsgID}
+	schedRes, err := client.ScheduledList(ctxbg, webapi.ScheduledListRequest{})
+	tcheckf(t, err, "list scheduled messages")
+	tcompare(t, len(schedRes.Scheduled), 4+1)
+	tcompare(t, schedRes.Scheduled[0].QueueMsgID, subs[0].QueueMsgID)
+	undoSched := schedRes.Scheduled[4]
+	tcompare(t, undoSched.QueueMsgID, undoIDs[0])
+	tcompare(t, undoSched.UndoSend, true)
+
+	sendAt := time.Now().Add(time.Hour).Round(time.Second)
+	_, err = client.ScheduledReschedule(ctxbg, webapi.ScheduledRescheduleRequest{QueueMsgIDs: undoIDs, SendAt: sendAt.Add(100 * 24 * time.Hour)})
+	terrcode(t, err, "user")
+	_, err = client.ScheduledReschedule(ctxbg, webapi.ScheduledRescheduleRequest{QueueMsgIDs: undoIDs, SendAt: sendAt})
+	tcheckf(t, err, "reschedule")
+	schedRes, err = client.ScheduledList(ctxbg, webapi.ScheduledListRequest{})
+	tcheckf(t, err, "list scheduled messages")
+	undoSched = schedRes.Scheduled[4]
+	if undoSched.UndoSend || !undoSched.SendAt.Equal(sendAt) {
+		t.Fatalf("got scheduled %#v, expected rescheduled at %v", undoSched, sendAt)
+	}
+
+	_, err = client.ScheduledCancel(ctxbg, webapi.ScheduledCancelRequest{QueueMsgIDs: undoIDs})
+	tcheckf(t, err, "cancel")
+	_, err = client.ScheduledCancel(ctxbg, webapi.ScheduledCancelRequest{QueueMsgIDs: undoIDs})
+	terrcode(t, err, "notScheduled")
+	_, err = client.ScheduledCancel(ctxbg, webapi.ScheduledCancelRequest{QueueMsgIDs: []int64{sendRes.Submissions[0].QueueMsgID}})
+	terrcode(t, err, "notScheduled") // Not sent with FutureRelease.
+
+	// After a delivery attempt, messages can no longer be canceled.
+	qm := queue.Msg{ID: subs[0].QueueMsgID}
+	err = queue.DB.Get(ctxbg, &qm)
+	tcheckf(t, err, "get queue message")
+	qm.Attempts = 1
+	err = queue.DB.Update(ctxbg, &qm)
+	tcheckf(t, err, "update queue message")
+	_, err = client.ScheduledCancel(ctxbg, webapi.ScheduledCancelRequest{QueueMsgIDs: []int64{subs[0].QueueMsgID, subs[1].QueueMsgID}})
+	terrcode(t, err, "deliveryAttempted")
+	schedRes, err = client.ScheduledList(ctxbg, webapi.ScheduledListRequest{})
+	tcheckf(t, err, "list scheduled messages")
+	tcompare(t, len(schedRes.Scheduled), 3)
 }
 
 func tdata(t *testing.T, r io.Reader, exp string) {
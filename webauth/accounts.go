@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 
+	"github.com/mjl-/bstore"
+
 	"github.com/mjl-/mox/mlog"
 	"github.com/mjl-/mox/store"
 )
@@ -15,7 +17,7 @@ var Accounts SessionAuth = accountSessionAuth{}
 type accountSessionAuth struct{}
 
 func (accountSessionAuth) login(ctx context.Context, log mlog.Log, username, password string) (bool, string, error) {
-	acc, err := store.OpenEmailAuth(log, username, password)
+	acc, err := store.OpenEmailAuth(log, username, password, "")
 	if err != nil && errors.Is(err, store.ErrUnknownCredentials) {
 		return false, "", nil
 	} else if err != nil {
@@ -28,6 +30,38 @@ func (accountSessionAuth) login(ctx context.Context, log mlog.Log, username, pas
 	return true, acc.Name, nil
 }
 
+func (accountSessionAuth) totpRequired(ctx context.Context, log mlog.Log, accountName string) (required bool, rerr error) {
+	acc, err := store.OpenAccount(log, accountName)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		err := acc.Close()
+		log.Check(err, "closing account")
+	}()
+	err = acc.DB.Read(ctx, func(tx *bstore.Tx) error {
+		required, err = store.TOTPRequired(tx)
+		return err
+	})
+	return required, err
+}
+
+func (accountSessionAuth) totpCheck(ctx context.Context, log mlog.Log, accountName, code string) (valid bool, rerr error) {
+	acc, err := store.OpenAccount(log, accountName)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		err := acc.Close()
+		log.Check(err, "closing account")
+	}()
+	err = acc.DB.Write(ctx, func(tx *bstore.Tx) error {
+		valid, err = store.TOTPCheck(tx, code)
+		return err
+	})
+	return valid, err
+}
+
 func (accountSessionAuth) add(ctx context.Context, log mlog.Log, accountName string, loginAddress string) (sessionToken store.SessionToken, csrfToken store.CSRFToken, rerr error) {
 	return store.SessionAdd(ctx, log, accountName, loginAddress)
 }
@@ -4,7 +4,9 @@ import (
 	"context"
 	cryptorand "crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"strings"
 	"sync"
@@ -13,14 +15,18 @@ import (
 	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/text/secure/precis"
 
+	"github.com/mjl-/mox/admindb"
 	"github.com/mjl-/mox/mlog"
 	"github.com/mjl-/mox/mox-"
 	"github.com/mjl-/mox/store"
+	"github.com/mjl-/mox/totp"
 )
 
-// Admin is for admin logins, with authentication by password, and sessions only
-// stored in memory only, with lifetime 12 hour after last use, with a maximum of
-// 10 active sessions.
+// Admin is for admin logins, with authentication by the admin password (with an
+// empty username) or by an admin user from admindb, and sessions stored in memory
+// only, with lifetime 12 hour after last use, with a maximum of 10 active
+// sessions per admin user. The account name of sessions is the name of the admin
+// user, empty for the admin password.
 var Admin SessionAuth = &adminSessionAuth{
 	sessions: map[store.SessionToken]adminSession{},
 }
@@ -29,6 +35,7 @@ var Admin SessionAuth = &adminSessionAuth{
 const adminSessionLifetime = 12 * time.Hour
 
 type adminSession struct {
+	username     string // Empty for the admin password.
 	sessionToken store.SessionToken
 	csrfToken    store.CSRFToken
 	expires      time.Time
@@ -40,6 +47,11 @@ type adminSessionAuth struct {
 }
 
 func (a *adminSessionAuth) login(ctx context.Context, log mlog.Log, username, password string) (bool, string, error) {
+	if username != "" {
+		u, valid, err := admindb.UserLogin(ctx, username, password)
+		return valid, u.Name, err
+	}
+
 	a.Lock()
 	defer a.Unlock()
 
@@ -61,6 +73,31 @@ func (a *adminSessionAuth) login(ctx context.Context, log mlog.Log, username, pa
 	return true, "", nil
 }
 
+func (a *adminSessionAuth) totpRequired(ctx context.Context, log mlog.Log, accountName string) (bool, error) {
+	return AdminTOTPEnabled(ctx, accountName)
+}
+
+func (a *adminSessionAuth) totpCheck(ctx context.Context, log mlog.Log, accountName, code string) (bool, error) {
+	if accountName != "" {
+		return admindb.UserTOTPCheck(ctx, accountName, code)
+	}
+
+	secret, err := adminTOTPSecret()
+	if err != nil {
+		return false, err
+	} else if secret == nil {
+		return false, store.ErrTOTPUnknown
+	}
+
+	adminTOTP.Lock()
+	defer adminTOTP.Unlock()
+	counter, ok := totp.Verify(secret, code, time.Now(), adminTOTP.lastCounter)
+	if ok {
+		adminTOTP.lastCounter = counter
+	}
+	return ok, nil
+}
+
 func (a *adminSessionAuth) add(ctx context.Context, log mlog.Log, accountName string, loginAddress string) (sessionToken store.SessionToken, csrfToken store.CSRFToken, rerr error) {
 	a.Lock()
 	defer a.Unlock()
@@ -72,15 +109,20 @@ func (a *adminSessionAuth) add(ctx context.Context, log mlog.Log, accountName st
 		}
 	}
 
-	// Ensure we have at most 10 sessions.
-	if len(a.sessions) > 10 {
-		var oldest *store.SessionToken
-		for _, s := range a.sessions {
-			if oldest == nil || s.expires.Before(a.sessions[*oldest].expires) {
-				oldest = &s.sessionToken
-			}
+	// Ensure we have at most 10 sessions for the admin user.
+	var n int
+	var oldest adminSession
+	for _, s := range a.sessions {
+		if s.username != accountName {
+			continue
 		}
-		delete(a.sessions, *oldest)
+		n++
+		if n == 1 || s.expires.Before(oldest.expires) {
+			oldest = s
+		}
+	}
+	if n > 10 {
+		delete(a.sessions, oldest.sessionToken)
 	}
 
 	// Generate new tokens.
@@ -95,7 +137,7 @@ func (a *adminSessionAuth) add(ctx context.Context, log mlog.Log, accountName st
 	csrfToken = store.CSRFToken(base64.RawURLEncoding.EncodeToString(csrfData[:]))
 
 	// Register session.
-	a.sessions[sessionToken] = adminSession{sessionToken, csrfToken, time.Now().Add(adminSessionLifetime)}
+	a.sessions[sessionToken] = adminSession{accountName, sessionToken, csrfToken, time.Now().Add(adminSessionLifetime)}
 	return sessionToken, csrfToken, nil
 }
 
@@ -104,7 +146,7 @@ func (a *adminSessionAuth) use(ctx context.Context, log mlog.Log, accountName st
 	defer a.Unlock()
 
 	s, ok := a.sessions[sessionToken]
-	if !ok {
+	if !ok || s.username != accountName {
 		return "", fmt.Errorf("unknown session")
 	} else if time.Until(s.expires) < 0 {
 		return "", fmt.Errorf("session expired")
@@ -120,9 +162,142 @@ func (a *adminSessionAuth) remove(ctx context.Context, log mlog.Log, accountName
 	a.Lock()
 	defer a.Unlock()
 
-	if _, ok := a.sessions[sessionToken]; !ok {
+	if s, ok := a.sessions[sessionToken]; !ok || s.username != accountName {
 		return fmt.Errorf("unknown session")
 	}
 	delete(a.sessions, sessionToken)
 	return nil
 }
+
+// AdminSessionsRemove removes all sessions of the admin user, e.g. after it was
+// removed or its password changed.
+func AdminSessionsRemove(username string) {
+	a := Admin.(*adminSessionAuth)
+	a.Lock()
+	defer a.Unlock()
+
+	for st, s := range a.sessions {
+		if s.username == username {
+			delete(a.sessions, st)
+		}
+	}
+}
+
+// The admin TOTP secret is stored base32-encoded in a file next to the admin
+// password file, with ".totp" appended to its name. Removing the file disables
+// TOTP for the admin. For admin users, the secret is stored in admindb.
+var adminTOTP = struct {
+	sync.Mutex
+	pending     map[string][]byte // Secret during enrollment, until confirmed. Key is admin username, empty for the admin password.
+	lastCounter int64             // Time step of last accepted code for the admin password, only kept in memory.
+}{
+	pending: map[string][]byte{},
+}
+
+func adminTOTPPath() string {
+	if mox.Conf.Static.AdminPasswordFile == "" {
+		return ""
+	}
+	return mox.ConfigDirPath(mox.Conf.Static.AdminPasswordFile) + ".totp"
+}
+
+// adminTOTPSecret returns the secret, or nil if TOTP is not enabled for the admin.
+func adminTOTPSecret() ([]byte, error) {
+	p := adminTOTPPath()
+	if p == "" {
+		return nil, nil
+	}
+	buf, err := os.ReadFile(p)
+	if err != nil && errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading admin totp file: %v", err)
+	}
+	secret, err := totp.DecodeSecret(strings.TrimSpace(string(buf)))
+	if err != nil {
+		return nil, fmt.Errorf("parsing admin totp file: %v", err)
+	}
+	return secret, nil
+}
+
+// AdminTOTPEnabled returns whether logins of the admin user (empty username
+// for the admin password) require a TOTP code.
+func AdminTOTPEnabled(ctx context.Context, username string) (bool, error) {
+	if username != "" {
+		u, err := admindb.UserGet(ctx, username)
+		return u.TOTPSecret != nil, err
+	}
+	secret, err := adminTOTPSecret()
+	return secret != nil, err
+}
+
+// AdminTOTPSetupStart returns a new secret for enrolling the admin user. It is
+// kept in memory until confirmed with AdminTOTPSetupConfirm.
+func AdminTOTPSetupStart(ctx context.Context, username string) ([]byte, error) {
+	if username == "" && adminTOTPPath() == "" {
+		return nil, fmt.Errorf("no admin password file configured")
+	}
+	if enabled, err := AdminTOTPEnabled(ctx, username); err != nil {
+		return nil, err
+	} else if enabled {
+		return nil, store.ErrTOTPEnabled
+	}
+
+	adminTOTP.Lock()
+	defer adminTOTP.Unlock()
+	secret := totp.NewSecret()
+	adminTOTP.pending[username] = secret
+	return secret, nil
+}
+
+// AdminTOTPSetupConfirm enables TOTP for the admin user if code is valid for the
+// pending secret from AdminTOTPSetupStart.
+func AdminTOTPSetupConfirm(ctx context.Context, username, code string) error {
+	adminTOTP.Lock()
+	defer adminTOTP.Unlock()
+
+	secret := adminTOTP.pending[username]
+	if secret == nil {
+		return store.ErrTOTPUnknown
+	}
+	counter, ok := totp.Verify(secret, code, time.Now(), 0)
+	if !ok {
+		return store.ErrTOTPCodeInvalid
+	}
+	if username != "" {
+		if err := admindb.UserTOTPSet(ctx, username, secret, counter); err != nil {
+			return fmt.Errorf("storing totp for admin user: %v", err)
+		}
+	} else {
+		if err := os.WriteFile(adminTOTPPath(), []byte(totp.EncodeSecret(secret)+"\n"), 0660); err != nil {
+			return fmt.Errorf("writing admin totp file: %v", err)
+		}
+		adminTOTP.lastCounter = counter
+	}
+	delete(adminTOTP.pending, username)
+	return nil
+}
+
+// AdminTOTPDisable removes the TOTP of the admin user, logins only require the
+// password.
+func AdminTOTPDisable(ctx context.Context, username string) error {
+	if username != "" {
+		if enabled, err := AdminTOTPEnabled(ctx, username); err != nil {
+			return err
+		} else if !enabled {
+			return store.ErrTOTPUnknown
+		}
+		return admindb.UserTOTPSet(ctx, username, nil, 0)
+	}
+
+	p := adminTOTPPath()
+	if p == "" {
+		return store.ErrTOTPUnknown
+	}
+	if err := os.Remove(p); err != nil && errors.Is(err, fs.ErrNotExist) {
+		return store.ErrTOTPUnknown
+	} else if err != nil {
+		return fmt.Errorf("removing admin totp file: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+package webauth
+
+import (
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/mjl-/sherpa"
+
+	"github.com/mjl-/mox/metrics"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/oidc"
+	"github.com/mjl-/mox/store"
+)
+
+// Time for logging in at the identity provider and completing the login.
+const pendingOIDCLifetime = 10 * time.Minute
+
+// Logins through the OpenID Connect identity provider that are in progress. Only
+// kept in memory.
+var pendingOIDCLogins = struct {
+	sync.Mutex
+	m map[string]pendingOIDC // Key is state.
+}{
+	m: map[string]pendingOIDC{},
+}
+
+type pendingOIDC struct {
+	kind         string
+	loginToken   string
+	nonce        string
+	codeVerifier string
+	redirectURI  string
+	expires      time.Time
+
+	// Set after the redirect back from the identity provider.
+	accountName string
+	username    string
+}
+
+func randomToken(n int) string {
+	buf := make([]byte, n)
+	if _, err := cryptorand.Read(buf); err != nil {
+		panic(fmt.Sprintf("generating random token: %v", err))
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// OIDCEnabled returns whether logging in through an OpenID Connect identity
+// provider is configured for the account and mail web interfaces.
+func OIDCEnabled() bool {
+	conf := mox.Conf.Static.OIDC
+	return conf != nil && conf.ClientID != ""
+}
+
+// LoginOIDCStart starts a login through the identity provider, returning the URL
+// the browser must be sent to. The loginToken from LoginPrep must be passed, its
+// cookie is extended to last until the login is completed.
+//
+// After logging in, the identity provider redirects the browser to the "oidc"
+// endpoint, handled by OIDCCallback, which redirects to cookiePath with
+// parameter "oidc" set to a state value. The frontend must then call LoginOIDC
+// with that state to get a session.
+func LoginOIDCStart(ctx context.Context, log mlog.Log, kind, cookiePath string, isForwarded bool, w http.ResponseWriter, r *http.Request, loginToken string) (string, error) {
+	if err := checkLoginToken(kind, isForwarded, r, loginToken); err != nil {
+		return "", err
+	}
+	if !OIDCEnabled() {
+		return "", &sherpa.Error{Code: "user:error", Message: "single sign-on not configured"}
+	}
+
+	// The redirect URI must be registered at the identity provider. We use the host
+	// the user is accessing us at.
+	scheme := "http"
+	if isHTTPS(isForwarded, r) {
+		scheme = "https"
+	}
+	redirectURI := scheme + "://" + r.Host + cookiePath + "oidc"
+
+	p := pendingOIDC{
+		kind:         kind,
+		loginToken:   loginToken,
+		nonce:        randomToken(16),
+		codeVerifier: randomToken(32),
+		redirectURI:  redirectURI,
+		expires:      time.Now().Add(pendingOIDCLifetime),
+	}
+	state := randomToken(16)
+	authURL, err := oidc.AuthURL(ctx, log, *mox.Conf.Static.OIDC, redirectURI, state, p.nonce, p.codeVerifier)
+	if err != nil {
+		return "", fmt.Errorf("preparing login at identity provider: %w", err)
+	}
+
+	pendingOIDCLogins.Lock()
+	for k, po := range pendingOIDCLogins.m {
+		if time.Until(po.expires) < 0 {
+			delete(pendingOIDCLogins.m, k)
+		}
+	}
+	pendingOIDCLogins.m[state] = p
+	pendingOIDCLogins.Unlock()
+
+	// Keep the login cookie until we are back from the identity provider.
+	http.SetCookie(w, &http.Cookie{
+		Name:     kind + "login",
+		Value:    loginToken,
+		Path:     cookiePath,
+		Secure:   isHTTPS(isForwarded, r),
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+		MaxAge:   int(pendingOIDCLifetime / time.Second),
+	})
+	return authURL, nil
+}
+
+// OIDCCallback handles the redirect from the identity provider back to the "oidc"
+// endpoint of a web interface. It exchanges the authorization code for an ID
+// token, and finds the account for the address in the token. The browser is then
+// redirected to cookiePath, for the frontend to complete the login with LoginOIDC.
+//
+// Session cookies are not set in this request: The request comes from another
+// site (the identity provider), for which browsers don't send and may not store
+// cookies with samesite "strict".
+func OIDCCallback(ctx context.Context, log mlog.Log, kind, cookiePath string, isForwarded bool, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "405 - method not allowed - use get", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	state := q.Get("state")
+	pendingOIDCLogins.Lock()
+	p, ok := pendingOIDCLogins.m[state]
+	pendingOIDCLogins.Unlock()
+	if !ok || p.kind != kind || time.Until(p.expires) < 0 {
+		http.Error(w, "400 - bad request - unknown or expired login, try logging in again", http.StatusBadRequest)
+		return
+	}
+	if errCode := q.Get("error"); errCode != "" {
+		// ../rfc/6749
+		log.Info("login at identity provider failed", slog.String("error", errCode), slog.String("description", q.Get("error_description")))
+		http.Error(w, "403 - forbidden - login at identity provider failed: "+errCode, http.StatusForbidden)
+		return
+	}
+
+	ip := RemoteIP(log, isForwarded, r)
+	if ip == nil {
+		http.Error(w, "400 - bad request - cannot find ip for rate limit check (missing x-forwarded-for header?)", http.StatusBadRequest)
+		return
+	}
+	start := time.Now()
+	if !mox.LimiterFailedAuth.Add(ip, start, 1) {
+		metrics.AuthenticationRatelimitedInc(kind)
+		http.Error(w, "429 - too many auth attempts", http.StatusTooManyRequests)
+		return
+	}
+
+	var authResult string
+	defer func() {
+		metrics.AuthenticationInc(kind, "weboidc", authResult)
+	}()
+
+	address, err := oidc.Exchange(ctx, log, *mox.Conf.Static.OIDC, p.redirectURI, q.Get("code"), p.codeVerifier, p.nonce)
+	if err != nil && errors.Is(err, oidc.ErrToken) {
+		authResult = "badcreds"
+		log.Infox("login through identity provider failed", err)
+		http.Error(w, "403 - forbidden - login through identity provider failed", http.StatusForbidden)
+		return
+	} else if err != nil {
+		authResult = "error"
+		log.Errorx("login through identity provider", err)
+		http.Error(w, "502 - bad gateway - cannot complete login with identity provider", http.StatusBadGateway)
+		return
+	}
+
+	acc, _, err := store.OpenEmail(log, address)
+	if err != nil && errors.Is(err, store.ErrUnknownCredentials) {
+		authResult = "badcreds"
+		log.Info("no account for address from identity provider", slog.String("address", address))
+		http.Error(w, "403 - forbidden - no account for address "+address, http.StatusForbidden)
+		return
+	} else if err != nil {
+		authResult = "error"
+		log.Errorx("looking up account for address from identity provider", err, slog.String("address", address))
+		http.Error(w, "500 - internal server error - looking up account", http.StatusInternalServerError)
+		return
+	}
+	p.accountName = acc.Name
+	err = acc.Close()
+	log.Check(err, "closing account")
+	p.username = address
+	authResult = "ok"
+	mox.LimiterFailedAuth.Reset(ip, start)
+
+	pendingOIDCLogins.Lock()
+	pendingOIDCLogins.m[state] = p
+	pendingOIDCLogins.Unlock()
+
+	http.Redirect(w, r, cookiePath+"?oidc="+url.QueryEscape(state), http.StatusFound)
+}
+
+// LoginOIDC completes a login through the identity provider after the redirect
+// handled by OIDCCallback, setting a session token cookie on the HTTP response
+// and returning the associated CSRF token, like Login, and the login address from
+// the identity provider. The login cookie must match the loginToken passed to
+// LoginOIDCStart.
+//
+// A two-factor authentication code is not required, the identity provider is
+// responsible for the authentication.
+func LoginOIDC(ctx context.Context, log mlog.Log, sessionAuth SessionAuth, kind, cookiePath string, isForwarded bool, w http.ResponseWriter, r *http.Request, state string) (store.CSRFToken, string, error) {
+	pendingOIDCLogins.Lock()
+	p, ok := pendingOIDCLogins.m[state]
+	pendingOIDCLogins.Unlock()
+	if !ok || p.kind != kind || p.accountName == "" || time.Until(p.expires) < 0 {
+		return "", "", &sherpa.Error{Code: "user:error", Message: "unknown or expired login, login again"}
+	}
+	if err := checkLoginToken(kind, isForwarded, r, p.loginToken); err != nil {
+		return "", "", err
+	}
+
+	pendingOIDCLogins.Lock()
+	delete(pendingOIDCLogins.m, state)
+	pendingOIDCLogins.Unlock()
+
+	csrfToken, err := loginSession(ctx, log, sessionAuth, kind, cookiePath, isForwarded, w, r, p.accountName, p.username)
+	return csrfToken, p.username, err
+}
@@ -0,0 +1,187 @@
+package webauth
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/mjl-/sherpa"
+
+	"github.com/mjl-/mox/metrics"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/store"
+	"github.com/mjl-/mox/totp"
+)
+
+// Time for entering a TOTP code after a valid password.
+const pendingLoginLifetime = 5 * time.Minute
+
+// Maximum number of bad TOTP codes for an account within the period. Counted per
+// account instead of per pending login, so someone who knows the password cannot
+// get new attempts by logging in again.
+const totpFailuresMax = 10
+const totpFailuresPeriod = time.Hour
+
+// Logins with a valid password, waiting for a TOTP code. Only kept in memory.
+var pendingLogins = struct {
+	sync.Mutex
+	m map[string]pendingLogin // Key is kind and login token.
+}{
+	m: map[string]pendingLogin{},
+}
+
+type pendingLogin struct {
+	accountName string
+	username    string
+	expires     time.Time
+}
+
+// Times of recent bad TOTP codes. Only kept in memory.
+var totpFailures = struct {
+	sync.Mutex
+	m map[string][]time.Time // Key is kind and account name.
+}{
+	m: map[string][]time.Time{},
+}
+
+func pendingLoginAdd(kind, loginToken, accountName, username string) {
+	pendingLogins.Lock()
+	defer pendingLogins.Unlock()
+
+	for k, pl := range pendingLogins.m {
+		if time.Until(pl.expires) < 0 {
+			delete(pendingLogins.m, k)
+		}
+	}
+	pendingLogins.m[kind+" "+loginToken] = pendingLogin{accountName, username, time.Now().Add(pendingLoginLifetime)}
+}
+
+// pendingLoginGet returns the pending login for the login token, if it hasn't
+// expired.
+func pendingLoginGet(kind, loginToken string) (pendingLogin, bool) {
+	pendingLogins.Lock()
+	defer pendingLogins.Unlock()
+
+	k := kind + " " + loginToken
+	pl, ok := pendingLogins.m[k]
+	if !ok || time.Until(pl.expires) < 0 {
+		delete(pendingLogins.m, k)
+		return pendingLogin{}, false
+	}
+	return pl, true
+}
+
+func pendingLoginRemove(kind, loginToken string) {
+	pendingLogins.Lock()
+	defer pendingLogins.Unlock()
+	delete(pendingLogins.m, kind+" "+loginToken)
+}
+
+// totpAllowed returns whether a TOTP code can be checked for the account, i.e.
+// whether it had fewer than totpFailuresMax bad codes in the past period.
+func totpAllowed(kind, accountName string, now time.Time) bool {
+	totpFailures.Lock()
+	defer totpFailures.Unlock()
+
+	k := kind + " " + accountName
+	l := slices.DeleteFunc(totpFailures.m[k], func(t time.Time) bool {
+		return now.Sub(t) >= totpFailuresPeriod
+	})
+	if len(l) == 0 {
+		delete(totpFailures.m, k)
+	} else {
+		totpFailures.m[k] = l
+	}
+	return len(l) < totpFailuresMax
+}
+
+func totpFailureAdd(kind, accountName string, now time.Time) {
+	totpFailures.Lock()
+	defer totpFailures.Unlock()
+	k := kind + " " + accountName
+	totpFailures.m[k] = append(totpFailures.m[k], now)
+}
+
+func totpFailuresReset(kind, accountName string) {
+	totpFailures.Lock()
+	defer totpFailures.Unlock()
+	delete(totpFailures.m, kind+" "+accountName)
+}
+
+// LoginTOTP completes a login for which Login returned error code
+// "user:totpRequired", by checking a TOTP code or recovery code through
+// sessionAuth. On success, a session token cookie is set on the HTTP response and
+// the associated CSRF token returned, like Login.
+//
+// For a bad code, the error code is "user:loginFailed", and another attempt can be
+// made. If the pending login expired, the error code is "user:error" and the login
+// must be started again. After too many bad codes for the account, the error code
+// is "user:error" until the failures are old enough, regardless of pending logins.
+func LoginTOTP(ctx context.Context, log mlog.Log, sessionAuth SessionAuth, kind, cookiePath string, isForwarded bool, w http.ResponseWriter, r *http.Request, loginToken, code string) (store.CSRFToken, error) {
+	if err := checkLoginToken(kind, isForwarded, r, loginToken); err != nil {
+		return "", err
+	}
+
+	ip := RemoteIP(log, isForwarded, r)
+	if ip == nil {
+		return "", fmt.Errorf("cannot find ip for rate limit check (missing x-forwarded-for header?)")
+	}
+	start := time.Now()
+	if !mox.LimiterFailedAuth.Add(ip, start, 1) {
+		metrics.AuthenticationRatelimitedInc(kind)
+		return "", &sherpa.Error{Code: "user:error", Message: "too many authentication attempts"}
+	}
+
+	pl, ok := pendingLoginGet(kind, loginToken)
+	if !ok {
+		return "", &sherpa.Error{Code: "user:error", Message: "login expired, login again"}
+	}
+	if !totpAllowed(kind, pl.accountName, start) {
+		metrics.AuthenticationRatelimitedInc(kind)
+		return "", &sherpa.Error{Code: "user:error", Message: "too many two-factor authentication attempts, try again later"}
+	}
+
+	valid, err := sessionAuth.totpCheck(ctx, log, pl.accountName, code)
+	var authResult string
+	defer func() {
+		metrics.AuthenticationInc(kind, "webtotp", authResult)
+	}()
+	if err != nil {
+		authResult = "error"
+		return "", fmt.Errorf("checking two-factor authentication code: %v", err)
+	} else if !valid {
+		totpFailureAdd(kind, pl.accountName, start)
+		time.Sleep(BadAuthDelay)
+		authResult = "badcreds"
+		return "", &sherpa.Error{Code: "user:loginFailed", Message: "invalid two-factor authentication code"}
+	}
+	authResult = "ok"
+	mox.LimiterFailedAuth.Reset(ip, start)
+	totpFailuresReset(kind, pl.accountName)
+	pendingLoginRemove(kind, loginToken)
+
+	return loginSession(ctx, log, sessionAuth, kind, cookiePath, isForwarded, w, r, pl.accountName, pl.username)
+}
+
+// TOTPSetup has the parameters for adding a TOTP to an authenticator app.
+type TOTPSetup struct {
+	URI       string // With "otpauth" scheme.
+	Secret    string // Base32, for manual entry.
+	QRCodePNG string // Data URL with PNG image of a QR code for URI.
+}
+
+// NewTOTPSetup returns the setup parameters for secret. The issuer and account
+// name are displayed in authenticator apps.
+func NewTOTPSetup(issuer, accountName string, secret []byte) (TOTPSetup, error) {
+	uri := totp.URI(issuer, accountName, secret)
+	png, err := totp.QRCodePNG(uri)
+	if err != nil {
+		return TOTPSetup{}, fmt.Errorf("generating qr code: %v", err)
+	}
+	return TOTPSetup{uri, totp.EncodeSecret(secret), "data:image/png;base64," + base64.StdEncoding.EncodeToString(png)}, nil
+}
@@ -18,6 +18,17 @@ along with login credentials. If the loginToken is missing, the login attempt
 fails before checking any credentials. This should prevent third party websites
 from tricking a browser into logging in.
 
+If two-factor authentication with a time-based one-time password (TOTP) is
+enabled for the account (or admin), a valid password does not result in a
+session. Instead, Login fails with error code "user:totpRequired", and a call to
+LoginTOTP with the same loginToken and a TOTP code (or recovery code) must
+follow within 5 minutes to complete the login.
+
+If an OpenID Connect identity provider is configured with a client ID, users
+of the account and mail interfaces can instead log in through the identity
+provider with LoginOIDCStart, OIDCCallback and LoginOIDC, also starting with a
+loginToken from LoginPrep.
+
 Sessions are stored server-side, and their lifetime automatically extended each
 time they are used. This makes it easy to invalidate existing sessions after a
 password change, and keeps the frontend free from handling long-term vs
@@ -25,7 +36,9 @@ short-term sessions.
 
 Sessions for the admin interface have a lifetime of 12 hours after last use,
 are only stored in memory (don't survive a server restart), and only 10
-sessions can exist at a time (the oldest session is dropped).
+sessions can exist at a time per admin user (the oldest session is dropped).
+Admins log in with the admin password (and an empty username), or as an admin
+user with a username and password.
 
 Sessions for the account and mail interfaces have a lifetime of 24 hours after
 last use, are kept in memory and stored in the database (do survive a server
@@ -61,6 +74,12 @@ var BadAuthDelay = time.Second
 type SessionAuth interface {
 	login(ctx context.Context, log mlog.Log, username, password string) (valid bool, accountName string, rerr error)
 
+	// Whether a TOTP code is required as second step after a valid password.
+	totpRequired(ctx context.Context, log mlog.Log, accountName string) (bool, error)
+
+	// Check a TOTP code or recovery code for the second step of a login.
+	totpCheck(ctx context.Context, log mlog.Log, accountName, code string) (valid bool, rerr error)
+
 	// Add a new session for account and login address.
 	add(ctx context.Context, log mlog.Log, accountName string, loginAddress string) (sessionToken store.SessionToken, csrfToken store.CSRFToken, rerr error)
 
@@ -147,7 +166,8 @@ func Check(ctx context.Context, log mlog.Log, sessionAuth SessionAuth, kind stri
 	}()
 
 	// Cookie values are of the form: token SP accountname.
-	// For admin sessions, the accountname is empty (there is no login address either).
+	// For admin sessions, the accountname is the admin username, empty for the admin
+	// password (there is no login address either).
 	t := strings.SplitN(cookie.Value, " ", 2)
 	if len(t) != 2 {
 		time.Sleep(BadAuthDelay)
@@ -223,15 +243,12 @@ func LoginPrep(ctx context.Context, log mlog.Log, kind, cookiePath string, isFor
 // response and returning the associated CSRF token.
 //
 // In case of a user error, a *sherpa.Error is returned that sherpa handlers can
-// pass to panic. For bad credentials, the error code is "user:loginFailed".
+// pass to panic. For bad credentials, the error code is "user:loginFailed". If
+// the credentials are valid but a TOTP code is required, the error code is
+// "user:totpRequired", and the login must be completed with LoginTOTP.
 func Login(ctx context.Context, log mlog.Log, sessionAuth SessionAuth, kind, cookiePath string, isForwarded bool, w http.ResponseWriter, r *http.Request, loginToken, username, password string) (store.CSRFToken, error) {
-	loginCookie, _ := r.Cookie(kind + "login")
-	if loginCookie == nil || loginCookie.Value != loginToken {
-		msg := "missing login token cookie"
-		if isForwarded && loginCookie == nil {
-			msg += " (hint: reverse proxy must keep path, for login cookie)"
-		}
-		return "", &sherpa.Error{Code: "user:error", Message: msg}
+	if err := checkLoginToken(kind, isForwarded, r, loginToken); err != nil {
+		return "", err
 	}
 
 	ip := RemoteIP(log, isForwarded, r)
@@ -258,8 +275,49 @@ func Login(ctx context.Context, log mlog.Log, sessionAuth SessionAuth, kind, coo
 		return "", &sherpa.Error{Code: "user:loginFailed", Message: "invalid credentials"}
 	}
 	authResult = "ok"
+
+	// The rate limiter is only reset once a session is created. Otherwise someone who
+	// knows the password could keep resetting it while guessing TOTP codes.
+	totpRequired, err := sessionAuth.totpRequired(ctx, log, accountName)
+	if err != nil {
+		authResult = "error"
+		return "", fmt.Errorf("checking if two-factor authentication is required: %v", err)
+	} else if totpRequired {
+		pendingLoginAdd(kind, loginToken, accountName, username)
+		// Keep the login cookie for the second step, entering a code takes time.
+		http.SetCookie(w, &http.Cookie{
+			Name:     kind + "login",
+			Value:    loginToken,
+			Path:     cookiePath,
+			Secure:   isHTTPS(isForwarded, r),
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+			MaxAge:   int(pendingLoginLifetime / time.Second),
+		})
+		return "", &sherpa.Error{Code: "user:totpRequired", Message: "two-factor authentication code required"}
+	}
+
 	mox.LimiterFailedAuth.Reset(ip, start)
+	return loginSession(ctx, log, sessionAuth, kind, cookiePath, isForwarded, w, r, accountName, username)
+}
+
+// checkLoginToken checks that the login token cookie matches the loginToken
+// from the request.
+func checkLoginToken(kind string, isForwarded bool, r *http.Request, loginToken string) error {
+	loginCookie, _ := r.Cookie(kind + "login")
+	if loginCookie == nil || loginCookie.Value != loginToken {
+		msg := "missing login token cookie"
+		if isForwarded && loginCookie == nil {
+			msg += " (hint: reverse proxy must keep path, for login cookie)"
+		}
+		return &sherpa.Error{Code: "user:error", Message: msg}
+	}
+	return nil
+}
 
+// loginSession adds a new session after a successful login, setting the session
+// cookie and removing the login cookie.
+func loginSession(ctx context.Context, log mlog.Log, sessionAuth SessionAuth, kind, cookiePath string, isForwarded bool, w http.ResponseWriter, r *http.Request, accountName, username string) (store.CSRFToken, error) {
 	sessionToken, csrfToken, err := sessionAuth.add(ctx, log, accountName, username)
 	if err != nil {
 		log.Errorx("adding session after login", err)
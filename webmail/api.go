@@ -1,6 +1,7 @@
 package webmail
 
 import (
+	"bytes"
 	"context"
 	cryptorand "crypto/rand"
 	"encoding/base64"
@@ -121,6 +122,57 @@ func (w Webmail) Login(ctx context.Context, loginToken, username, password strin
 	return csrfToken
 }
 
+// LoginTOTP completes a login for which Login failed with error code
+// "user:totpRequired", with a code from an authenticator app or a recovery code.
+// Fails with error code "user:loginFailed" for a bad code.
+func (w Webmail) LoginTOTP(ctx context.Context, loginToken, code string) store.CSRFToken {
+	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
+	log := reqInfo.Log
+
+	csrfToken, err := webauth.LoginTOTP(ctx, log, webauth.Accounts, "webmail", w.cookiePath, w.isForwarded, reqInfo.Response, reqInfo.Request, loginToken, code)
+	if _, ok := err.(*sherpa.Error); ok {
+		panic(err)
+	}
+	xcheckf(ctx, err, "login")
+	return csrfToken
+}
+
+// LoginOIDCEnabled returns whether logging in through an OpenID Connect identity
+// provider (single sign-on) is available.
+func (Webmail) LoginOIDCEnabled(ctx context.Context) bool {
+	return webauth.OIDCEnabled()
+}
+
+// LoginOIDCStart starts a login through the identity provider, returning the URL
+// to navigate to. Call LoginPrep to get a loginToken. After logging in at the
+// identity provider, the browser returns with an "oidc" query string parameter,
+// which must be passed to LoginOIDC.
+func (w Webmail) LoginOIDCStart(ctx context.Context, loginToken string) string {
+	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
+	log := reqInfo.Log
+
+	authURL, err := webauth.LoginOIDCStart(ctx, log, "webmail", w.cookiePath, w.isForwarded, reqInfo.Response, reqInfo.Request, loginToken)
+	if _, ok := err.(*sherpa.Error); ok {
+		panic(err)
+	}
+	xcheckf(ctx, err, "starting login")
+	return authURL
+}
+
+// LoginOIDC completes a login through the identity provider, returning a session
+// token like Login, and the address the user logged in with.
+func (w Webmail) LoginOIDC(ctx context.Context, state string) (csrfToken store.CSRFToken, loginAddress string) {
+	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
+	log := reqInfo.Log
+
+	csrfToken, loginAddress, err := webauth.LoginOIDC(ctx, log, webauth.Accounts, "webmail", w.cookiePath, w.isForwarded, reqInfo.Response, reqInfo.Request, state)
+	if _, ok := err.(*sherpa.Error); ok {
+		panic(err)
+	}
+	xcheckf(ctx, err, "login")
+	return csrfToken, loginAddress
+}
+
 // Logout invalidates the session token.
 func (w Webmail) Logout(ctx context.Context) {
 	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
@@ -167,7 +219,7 @@ func (Webmail) ParsedMessage(ctx context.Context, msgID int64) (pm ParsedMessage
 	xdbread(ctx, acc, func(tx *bstore.Tx) {
 		m := xmessageID(ctx, tx, msgID)
 
-		state := msgState{acc: acc}
+		state := msgState{acc: acc, keysTx: tx}
 		defer state.clear()
 		var err error
 		pm, err = parsedMessage(log, m, &state, true, false)
@@ -178,6 +230,22 @@ func (Webmail) ParsedMessage(ctx context.Context, msgID int64) (pm ParsedMessage
 			xcheckf(ctx, err, "looking up view mode for from address")
 		}
 	})
+
+	// Store public keys of the sender, for encrypting messages to them later.
+	if len(pm.peerKeys) > 0 {
+		xdbwrite(ctx, acc, func(tx *bstore.Tx) {
+			for _, pk := range pm.peerKeys {
+				// Don't store our own keys, e.g. from the Autocrypt header in our own messages.
+				own, err := bstore.QueryTx[store.CryptoKey](tx).FilterNonzero(store.CryptoKey{Fingerprint: pk.Fingerprint}).Exists()
+				xcheckf(ctx, err, "looking up key")
+				if own {
+					continue
+				}
+				_, err = store.PeerKeySave(tx, &pk)
+				xcheckf(ctx, err, "saving key of sender")
+			}
+		})
+	}
 	return
 }
 
@@ -230,6 +298,8 @@ func (Webmail) MessageFindMessageID(ctx context.Context, messageID string) (id i
 	}
 
 	xdbread(ctx, acc, func(tx *bstore.Tx) {
+		messageID, err := store.HashThreadValue(tx, messageID)
+		xcheckf(ctx, err, "hashing message-id")
 		m, err := bstore.QueryTx[store.Message](tx).FilterNonzero(store.Message{MessageID: messageID}).Get()
 		if err == bstore.ErrAbsent {
 			return
@@ -497,8 +567,16 @@ type SubmitMessage struct {
 	UserAgent          string     // User-Agent header added if not empty.
 	RequireTLS         *bool      // For "Require TLS" extension during delivery.
 	FutureRelease      *time.Time // If set, time (in the future) when message should be delivered from queue.
+	UndoSendSeconds    int        // If > 0 and FutureRelease is not set, the first delivery attempt is delayed by this many seconds, during which sending can be undone.
 	ArchiveThread      bool       // If set, thread is archived after sending message.
 	DraftMessageID     int64      // If set, draft message that will be removed after sending.
+
+	// If set, sign and/or encrypt the message with S/MIME or OpenPGP. Signing
+	// requires a key for the From address. Encrypting requires a key for each
+	// recipient, and the message is also encrypted to the key for the From address.
+	Crypto  store.CryptoKind
+	Sign    bool
+	Encrypt bool
 }
 
 // ForwardAttachments references attachments by a list of message.Part paths.
@@ -580,13 +658,23 @@ func xrandom(ctx context.Context, n int) []byte {
 // If a Sent mailbox is configured, messages are added to it after submitting
 // to the delivery queue. If Bcc addresses were present, a header is prepended
 // to the message stored in the Sent mailbox.
-func (w Webmail) MessageSubmit(ctx context.Context, m SubmitMessage) {
+//
+// The IDs of the messages added to the queue are returned, one for each
+// recipient, e.g. for canceling with ScheduledCancel during an "undo send" grace
+// period.
+func (w Webmail) MessageSubmit(ctx context.Context, m SubmitMessage) (queueMsgIDs []int64) {
 	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
 	acc := reqInfo.Account
 	log := reqInfo.Log
 
 	log.Debug("message submit")
 
+	if m.FutureRelease != nil {
+		xcheckFutureRelease(ctx, *m.FutureRelease)
+	} else if m.UndoSendSeconds < 0 || time.Duration(m.UndoSendSeconds)*time.Second > queue.UndoSendIntervalMax {
+		xcheckuserf(ctx, fmt.Errorf("must be between 0 and %v", queue.UndoSendIntervalMax), "checking undo send period")
+	}
+
 	// Similar between ../smtpserver/server.go:/submit\( and ../webmail/api.go:/MessageSubmit\( and ../webapisrv/server.go:/Send\(
 
 	// todo: consider making this an HTTP POST, so we can upload as regular form, which is probably more efficient for encoding for the client and we can stream the data in. also not unlike the webapi Submit method.
@@ -666,6 +754,12 @@ func (w Webmail) MessageSubmit(ctx context.Context, m SubmitMessage) {
 		xcheckf(ctx, err, "checking send limit")
 	})
 
+	// Keys for signing and/or encrypting, and for an Autocrypt header.
+	var sk submitKeys
+	xdbread(ctx, acc, func(tx *bstore.Tx) {
+		sk = xsubmitKeys(ctx, tx, m, fromAddr.Address, recipients)
+	})
+
 	// We only use smtputf8 if we have to, with a utf-8 localpart. For IDNA, we use ASCII domains.
 	smtputf8 := false
 	for _, a := range recipients {
@@ -778,14 +872,28 @@ func (w Webmail) MessageSubmit(ctx context.Context, m SubmitMessage) {
 	if m.RequireTLS != nil && !*m.RequireTLS {
 		xc.Header("TLS-Required", "No")
 	}
+	if sk.autocrypt != nil && m.Crypto != store.CryptoSMIME {
+		// https://autocrypt.org/level1.html#the-autocrypt-header
+		xc.Header("Autocrypt", xautocryptHeader(ctx, sk, fromAddr.Address))
+	}
 	xc.Header("MIME-Version", "1.0")
 
+	// For signed and/or encrypted messages, the body is composed separately, and
+	// signed/encrypted into the message.
+	bc := xc
+	var content bytes.Buffer
+	if m.Crypto != "" {
+		bc = message.NewComposer(&content, w.maxMessageSize, smtputf8)
+		// Signed content must not be changed by transports.
+		bc.Need7bit = m.Sign
+	}
+
 	if len(m.Attachments) > 0 || len(m.ForwardAttachments.Paths) > 0 {
-		mp := multipart.NewWriter(xc)
-		xc.Header("Content-Type", fmt.Sprintf(`multipart/mixed; boundary="%s"`, mp.Boundary()))
-		xc.Line()
+		mp := multipart.NewWriter(bc)
+		bc.Header("Content-Type", fmt.Sprintf(`multipart/mixed; boundary="%s"`, mp.Boundary()))
+		bc.Line()
 
-		textBody, ct, cte := xc.TextPart("plain", m.TextBody)
+		textBody, ct, cte := bc.TextPart("plain", m.TextBody)
 		textHdr := textproto.MIMEHeader{}
 		textHdr.Set("Content-Type", ct)
 		textHdr.Set("Content-Transfer-Encoding", cte)
@@ -906,11 +1014,16 @@ func (w Webmail) MessageSubmit(ctx context.Context, m SubmitMessage) {
 		err = mp.Close()
 		xcheckf(ctx, err, "writing mime multipart")
 	} else {
-		textBody, ct, cte := xc.TextPart("plain", m.TextBody)
-		xc.Header("Content-Type", ct)
-		xc.Header("Content-Transfer-Encoding", cte)
-		xc.Line()
-		xc.Write([]byte(textBody))
+		textBody, ct, cte := bc.TextPart("plain", m.TextBody)
+		bc.Header("Content-Type", ct)
+		bc.Header("Content-Transfer-Encoding", cte)
+		bc.Line()
+		bc.Write([]byte(textBody))
+	}
+
+	if m.Crypto != "" {
+		bc.Flush()
+		xcryptoCompose(ctx, xc, m, sk, content.Bytes())
 	}
 
 	xc.Flush()
@@ -963,15 +1076,14 @@ func (w Webmail) MessageSubmit(ctx context.Context, m SubmitMessage) {
 		}
 		qm := queue.MakeMsg(fp, toPath, xc.Has8bit, xc.SMTPUTF8, msgSize, messageID, []byte(rcptMsgPrefix), m.RequireTLS, now, m.Subject)
 		if m.FutureRelease != nil {
-			ival := time.Until(*m.FutureRelease)
-			if ival < 0 {
-				xcheckuserf(ctx, errors.New("date/time is in the past"), "scheduling delivery")
-			} else if ival > queue.FutureReleaseIntervalMax {
-				xcheckuserf(ctx, fmt.Errorf("date/time can not be further than %v in the future", queue.FutureReleaseIntervalMax), "scheduling delivery")
-			}
 			qm.NextAttempt = *m.FutureRelease
+			qm.SendAt = *m.FutureRelease
 			qm.FutureReleaseRequest = "until;" + m.FutureRelease.Format(time.RFC3339)
 			// todo: possibly add a header to the message stored in the Sent mailbox to indicate it was scheduled for later delivery.
+		} else if m.UndoSendSeconds > 0 {
+			qm.NextAttempt = now.Add(time.Duration(m.UndoSendSeconds) * time.Second)
+			qm.SendAt = qm.NextAttempt
+			qm.UndoSend = true
 		}
 		qm.FromID = fromID
 		// no qm.Extra from webmail
@@ -983,6 +1095,9 @@ func (w Webmail) MessageSubmit(ctx context.Context, m SubmitMessage) {
 	}
 	xcheckf(ctx, err, "adding messages to the delivery queue")
 	metricSubmission.WithLabelValues("ok").Inc()
+	for _, qm := range qml {
+		queueMsgIDs = append(queueMsgIDs, qm.ID)
+	}
 
 	var modseq store.ModSeq // Only set if needed.
 
@@ -1117,6 +1232,154 @@ func (w Webmail) MessageSubmit(ctx context.Context, m SubmitMessage) {
 		err := os.Remove(p)
 		log.Check(err, "removing draft message file")
 	}
+	return
+}
+
+// xcheckFutureRelease checks a requested time for a scheduled delivery.
+func xcheckFutureRelease(ctx context.Context, t time.Time) {
+	ival := time.Until(t)
+	if ival < 0 {
+		xcheckuserf(ctx, errors.New("date/time is in the past"), "scheduling delivery")
+	} else if ival > queue.FutureReleaseIntervalMax {
+		xcheckuserf(ctx, fmt.Errorf("date/time can not be further than %v in the future", queue.FutureReleaseIntervalMax), "scheduling delivery")
+	}
+}
+
+// ScheduledMessage is a submitted message waiting for its first delivery
+// attempt, at a scheduled time or after an "undo send" grace period. Until then,
+// it can be canceled or rescheduled.
+type ScheduledMessage struct {
+	QueueMsgIDs []int64  // One for each recipient.
+	MessageID   string   // Message-ID header, including <>.
+	Subject     string   // Subject header.
+	Recipients  []string // Addresses the message is delivered to, including Bcc.
+	Queued      time.Time
+	SendAt      time.Time // Time of first delivery attempt.
+	UndoSend    bool      // Whether SendAt is the end of an "undo send" grace period.
+}
+
+// ScheduledList returns the submitted messages of the account that are scheduled
+// for later delivery, ordered by time of delivery.
+func (Webmail) ScheduledList(ctx context.Context) []ScheduledMessage {
+	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
+	acc := reqInfo.Account
+
+	qml, err := queue.ScheduledList(ctx, acc.Name)
+	xcheckf(ctx, err, "listing scheduled messages")
+
+	// Messages submitted together have the same Message-ID, one queue message per
+	// recipient.
+	l := []ScheduledMessage{}
+	index := map[string]int{}
+	for _, qm := range qml {
+		key := qm.MessageID + " " + qm.SendAt.String()
+		if i, ok := index[key]; ok && qm.MessageID != "" {
+			l[i].QueueMsgIDs = append(l[i].QueueMsgIDs, qm.ID)
+			l[i].Recipients = append(l[i].Recipients, qm.Recipient().XString(true))
+			continue
+		}
+		index[key] = len(l)
+		sm := ScheduledMessage{
+			QueueMsgIDs: []int64{qm.ID},
+			MessageID:   qm.MessageID,
+			Subject:     qm.Subject,
+			Recipients:  []string{qm.Recipient().XString(true)},
+			Queued:      qm.Queued,
+			SendAt:      qm.SendAt,
+			UndoSend:    qm.UndoSend,
+		}
+		l = append(l, sm)
+	}
+	return l
+}
+
+// xcheckScheduled checks an error from an operation on scheduled messages in the
+// queue.
+func xcheckScheduled(ctx context.Context, err error, action string) {
+	if errors.Is(err, queue.ErrNotScheduled) || errors.Is(err, queue.ErrDeliveryAttempted) {
+		xcheckuserf(ctx, err, "%s", action)
+	}
+	xcheckf(ctx, err, "%s", action)
+}
+
+// ScheduledCancel removes scheduled messages from the queue before their first
+// delivery attempt, e.g. to undo sending. Either all messages are canceled, or
+// none.
+//
+// If the message was stored in the Sent mailbox and a Drafts mailbox is
+// configured, the message is moved to the Drafts mailbox and returned, for
+// continued editing. Otherwise, nil is returned.
+func (Webmail) ScheduledCancel(ctx context.Context, queueMsgIDs []int64) (draft *MessageItem) {
+	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
+	acc := reqInfo.Account
+	log := reqInfo.Log
+
+	qml, err := queue.ScheduledCancel(ctx, log, acc.Name, queueMsgIDs)
+	xcheckScheduled(ctx, err, "canceling scheduled messages")
+
+	messageID := strings.ToLower(strings.Trim(qml[0].MessageID, "<>"))
+	if messageID == "" {
+		return nil
+	}
+
+	acc.WithRLock(func() {
+		var changes []store.Change
+
+		xdbwrite(ctx, acc, func(tx *bstore.Tx) {
+			sentmb, err := bstore.QueryTx[store.Mailbox](tx).FilterEqual("Sent", true).Get()
+			if err == bstore.ErrAbsent {
+				return
+			}
+			xcheckf(ctx, err, "looking up sent mailbox")
+			draftsmb, err := bstore.QueryTx[store.Mailbox](tx).FilterEqual("Draft", true).Get()
+			if err == bstore.ErrAbsent {
+				return
+			}
+			xcheckf(ctx, err, "looking up drafts mailbox")
+
+			q := bstore.QueryTx[store.Message](tx)
+			q.FilterNonzero(store.Message{MailboxID: sentmb.ID, MessageID: messageID})
+			q.FilterEqual("Expunged", false)
+			q.SortDesc("ID")
+			q.Limit(1)
+			m, err := q.Get()
+			if err == bstore.ErrAbsent {
+				return
+			}
+			xcheckf(ctx, err, "looking up message in sent mailbox")
+
+			modseq, nchanges := xops.MessageMoveTx(ctx, log, acc, tx, []int64{m.ID}, draftsmb, 0)
+			changes = append(changes, nchanges...)
+
+			m = xmessageID(ctx, tx, m.ID)
+			oflags := m.Flags
+			m.Draft = true
+			m.ModSeq = modseq
+			err = tx.Update(&m)
+			xcheckf(ctx, err, "marking message as draft")
+			changes = append(changes, m.ChangeFlags(oflags))
+
+			state := msgState{acc: acc}
+			defer state.clear()
+			mi, err := messageItem(log, m, &state)
+			xcheckf(ctx, err, "parsing message")
+			draft = &mi
+		})
+
+		store.BroadcastChanges(acc, changes)
+	})
+	return draft
+}
+
+// ScheduledReschedule changes the time of the first delivery attempt of
+// scheduled messages.
+func (Webmail) ScheduledReschedule(ctx context.Context, queueMsgIDs []int64, sendAt time.Time) {
+	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
+	acc := reqInfo.Account
+
+	xcheckFutureRelease(ctx, sendAt)
+	err := queue.ScheduledReschedule(ctx, acc.Name, queueMsgIDs, sendAt)
+	xcheckScheduled(ctx, err, "rescheduling messages")
 }
 
 // MessageMove moves messages to another mailbox. If the message is already in
@@ -1259,14 +1522,19 @@ func (Webmail) MailboxEmpty(ctx context.Context, mailboxID int64) {
 
 			// Remove Recipients.
 			anyIDs := make([]any, len(expunged))
+			ids := make([]int64, len(expunged))
 			for i, m := range expunged {
 				anyIDs[i] = m.ID
+				ids[i] = m.ID
 			}
 			qmr := bstore.QueryTx[store.Recipient](tx)
 			qmr.FilterEqual("MessageID", anyIDs...)
 			_, err = qmr.Delete()
 			xcheckf(ctx, err, "removing message recipients")
 
+			err = store.TextIndexRemove(tx, ids...)
+			xcheckf(ctx, err, "removing messages from full-text index")
+
 			// Adjust mailbox counts, gather UIDs for broadcasted change, prepare for untraining.
 			var totalSize int64
 			uids := make([]store.UID, len(expunged))
@@ -1334,8 +1602,9 @@ func (Webmail) MailboxRename(ctx context.Context, mailboxID int64, newName strin
 }
 
 // CompleteRecipient returns autocomplete matches for a recipient, returning the
-// matches, most recently used first, and whether this is the full list and further
-// requests for longer prefixes aren't necessary.
+// matches, first from contacts in the address books, then from recipients of sent
+// messages, most recently used first, and whether this is the full list and
+// further requests for longer prefixes aren't necessary.
 func (Webmail) CompleteRecipient(ctx context.Context, search string) ([]string, bool) {
 	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
 	acc := reqInfo.Account
@@ -1352,9 +1621,21 @@ func (Webmail) CompleteRecipient(ctx context.Context, search string) ([]string,
 			}
 			seen := map[key]bool{}
 
+			contacts, more, err := store.ContactAddresses(tx, search, 20)
+			xcheckf(ctx, err, "listing contacts")
+			for _, ca := range contacts {
+				a := message.Address{Name: ca.Name, User: ca.Address.Localpart.String(), Host: ca.Address.Domain.ASCII}
+				matches = append(matches, addressString(a, false))
+				seen[key{ca.Address.Localpart.String(), ca.Address.Domain.Name()}] = true
+			}
+			if more {
+				all = false
+				return
+			}
+
 			q := bstore.QueryTx[store.Recipient](tx)
 			q.SortDesc("Sent")
-			err := q.ForEach(func(r store.Recipient) error {
+			err = q.ForEach(func(r store.Recipient) error {
 				k := key{r.Localpart, r.Domain}
 				if seen[k] {
 					return nil
@@ -1374,8 +1655,7 @@ func (Webmail) CompleteRecipient(ctx context.Context, search string) ([]string,
 				err := tx.Get(&m)
 				xcheckf(ctx, err, "get sent message")
 				if !m.Expunged && m.ParsedBuf != nil {
-					var part message.Part
-					err := json.Unmarshal(m.ParsedBuf, &part)
+					part, err := m.LoadPart(nil)
 					xcheckf(ctx, err, "parsing part")
 
 					dom, err := dns.ParseDomain(r.Domain)
@@ -1477,6 +1757,52 @@ func (Webmail) MailboxSetSpecialUse(ctx context.Context, mb store.Mailbox) {
 	})
 }
 
+// MailboxACL returns the access control list of a mailbox: the rights other
+// accounts have been given on the mailbox.
+func (Webmail) MailboxACL(ctx context.Context, mailboxID int64) (acls []store.MailboxACL) {
+	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
+	acc := reqInfo.Account
+
+	acc.WithRLock(func() {
+		xdbread(ctx, acc, func(tx *bstore.Tx) {
+			mb := xmailboxID(ctx, tx, mailboxID)
+			var err error
+			acls, err = store.MailboxACLList(tx, mb.ID)
+			xcheckf(ctx, err, "listing acl")
+		})
+	})
+	return
+}
+
+// MailboxACLSet sets the rights of another account, or "anyone" for all
+// accounts, on a mailbox. Rights are letters as used in IMAP ACL, e.g. "lr" for
+// read-only access. Empty rights remove the entry.
+func (Webmail) MailboxACLSet(ctx context.Context, mailboxID int64, identifier, rights string) {
+	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
+	acc := reqInfo.Account
+
+	acc.WithWLock(func() {
+		xdbwrite(ctx, acc, func(tx *bstore.Tx) {
+			mb := xmailboxID(ctx, tx, mailboxID)
+			err := acc.MailboxACLSet(tx, mb.ID, identifier, rights)
+			if errors.Is(err, store.ErrACLRights) || errors.Is(err, store.ErrACLIdentifier) {
+				xcheckuserf(ctx, err, "setting rights")
+			}
+			xcheckf(ctx, err, "setting rights")
+		})
+	})
+}
+
+// SharedMailboxes returns the mailboxes of other accounts that this account has
+// been given access to. They can be accessed through IMAP, in the "Other Users"
+// and "Shared" namespaces.
+func (Webmail) SharedMailboxes(ctx context.Context) []store.SharedMailbox {
+	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
+	l, err := store.SharedMailboxes(ctx, reqInfo.Log, reqInfo.Account.Name)
+	xcheckf(ctx, err, "listing shared mailboxes")
+	return l
+}
+
 // ThreadCollapse saves the ThreadCollapse field for the messages and its
 // children. The messageIDs are typically thread roots. But not all roots
 // (without parent) of a thread need to have the same collapsed state.
@@ -1784,6 +2110,10 @@ func (Webmail) SettingsSave(ctx context.Context, settings store.Settings) {
 	reqInfo := ctx.Value(requestInfoCtxKey).(requestInfo)
 	acc := reqInfo.Account
 
+	if settings.UndoSendSeconds < 0 || time.Duration(settings.UndoSendSeconds)*time.Second > queue.UndoSendIntervalMax {
+		xcheckuserf(ctx, fmt.Errorf("must be between 0 and %v", queue.UndoSendIntervalMax), "checking undo send period")
+	}
+
 	settings.ID = 1
 	err := acc.DB.Update(ctx, &settings)
 	xcheckf(ctx, err, "save settings")
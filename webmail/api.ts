@@ -68,6 +68,7 @@ export interface ParsedMessage {
 	Texts?: string[] | null  // Text parts, can be empty.
 	HasHTML: boolean  // Whether there is an HTML part. The webclient renders HTML message parts through an iframe and a separate request with strict CSP headers to prevent script execution and loading of external resources, which isn't possible when loading in iframe with inline HTML because not all browsers support the iframe csp attribute.
 	ListReplyAddress?: MessageAddress | null  // From List-Post.
+	Crypto?: MessageCrypto | null  // For messages signed or encrypted with S/MIME or OpenPGP. If the message was decrypted, Part is the decrypted message.
 }
 
 // Part represents a whole mail message, or a part of a multipart message. It
@@ -128,6 +129,22 @@ export interface Domain {
 	Unicode: string  // Name as U-labels, in Unicode NFC. Empty if this is an ASCII-only domain. No trailing dot.
 }
 
+// MessageCrypto is the result of decrypting an S/MIME or OpenPGP message, and
+// verifying its signature.
+export interface MessageCrypto {
+	Kind: CryptoKind
+	Encrypted: boolean
+	Decrypted: boolean
+	DecryptError: string  // If Encrypted but not Decrypted.
+	Signed: boolean
+	SignatureValid: boolean
+	SignatureError: string  // If Signed but not SignatureValid, e.g. for an unknown signer.
+	SignerAddresses?: string[] | null  // If SignatureValid, addresses of the certificate or key.
+	SignerFingerprint: string  // If SignatureValid.
+	SignerMatchesFrom: boolean  // If SignatureValid and the From address is one of SignerAddresses.
+	SignerTrusted: boolean  // If SignatureValid, whether the signer is trusted. For S/MIME, when the certificate chain verifies against the trusted CAs of the system. For both S/MIME and OpenPGP, when the key is one of our own or was imported. Keys learned from messages, e.g. through Autocrypt headers, are not trusted.
+}
+
 // FromAddressSettings are webmail client settings per "From" address.
 export interface FromAddressSettings {
 	FromAddress: string  // Unicode.
@@ -165,8 +182,12 @@ export interface SubmitMessage {
 	UserAgent: string  // User-Agent header added if not empty.
 	RequireTLS?: boolean | null  // For "Require TLS" extension during delivery.
 	FutureRelease?: Date | null  // If set, time (in the future) when message should be delivered from queue.
+	UndoSendSeconds: number  // If > 0 and FutureRelease is not set, the first delivery attempt is delayed by this many seconds, during which sending can be undone.
 	ArchiveThread: boolean  // If set, thread is archived after sending message.
 	DraftMessageID: number  // If set, draft message that will be removed after sending.
+	Crypto: CryptoKind  // If set, sign and/or encrypt the message with S/MIME or OpenPGP. Signing requires a key for the From address. Encrypting requires a key for each recipient, and the message is also encrypted to the key for the From address.
+	Sign: boolean
+	Encrypt: boolean
 }
 
 // File is a new attachment (not from an existing message that is being
@@ -182,107 +203,17 @@ export interface ForwardAttachments {
 	Paths?: (number[] | null)[] | null  // List of attachments, each path is a list of indices into the top-level message.Part.Parts.
 }
 
-// Mailbox is collection of messages, e.g. Inbox or Sent.
-export interface Mailbox {
-	ID: number
-	Name: string  // "Inbox" is the name for the special IMAP "INBOX". Slash separated for hierarchy.
-	UIDValidity: number  // If UIDs are invalidated, e.g. when renaming a mailbox to a previously existing name, UIDValidity must be changed. Used by IMAP for synchronization.
-	UIDNext: UID  // UID likely to be assigned to next message. Used by IMAP to detect messages delivered to a mailbox.
-	Archive: boolean
-	Draft: boolean
-	Junk: boolean
-	Sent: boolean
-	Trash: boolean
-	Keywords?: string[] | null  // Keywords as used in messages. Storing a non-system keyword for a message automatically adds it to this list. Used in the IMAP FLAGS response. Only "atoms" are allowed (IMAP syntax), keywords are case-insensitive, only stored in lower case (for JMAP), sorted.
-	HaveCounts: boolean  // Whether MailboxCounts have been initialized.
-	Total: number  // Total number of messages, excluding \Deleted. For JMAP.
-	Deleted: number  // Number of messages with \Deleted flag. Used for IMAP message count that includes messages with \Deleted.
-	Unread: number  // Messages without \Seen, excluding those with \Deleted, for JMAP.
-	Unseen: number  // Messages without \Seen, including those with \Deleted, for IMAP.
-	Size: number  // Number of bytes for all messages.
-}
-
-// RecipientSecurity is a quick analysis of the security properties of delivery to
-// the recipient (domain).
-export interface RecipientSecurity {
-	STARTTLS: SecurityResult  // Whether recipient domain supports (opportunistic) STARTTLS, as seen during most recent delivery attempt. Will be "unknown" if no delivery to the domain has been attempted yet.
-	MTASTS: SecurityResult  // Whether we have a stored enforced MTA-STS policy, or domain has MTA-STS DNS record.
-	DNSSEC: SecurityResult  // Whether MX lookup response was DNSSEC-signed.
-	DANE: SecurityResult  // Whether first delivery destination has DANE records.
-	RequireTLS: SecurityResult  // Whether recipient domain is known to implement the REQUIRETLS SMTP extension. Will be "unknown" if no delivery to the domain has been attempted yet.
-}
-
-// Settings are webmail client settings.
-export interface Settings {
-	ID: number  // Singleton ID 1.
-	Signature: string
-	Quoting: Quoting
-	ShowAddressSecurity: boolean  // Whether to show the bars underneath the address input fields indicating starttls/dnssec/dane/mtasts/requiretls support by address.
-}
-
-export interface Ruleset {
-	SMTPMailFromRegexp: string
-	MsgFromRegexp: string
-	VerifiedDomain: string
-	HeadersRegexp?: { [key: string]: string }
-	IsForward: boolean  // todo: once we implement ARC, we can use dkim domains that we cannot verify but that the arc-verified forwarding mail server was able to verify.
-	ListAllowDomain: string
-	AcceptRejectsToMailbox: string
-	Mailbox: string
-	Comment: string
-	VerifiedDNSDomain: Domain
-	ListAllowDNSDomain: Domain
-}
-
-// EventStart is the first message sent on an SSE connection, giving the client
-// basic data to populate its UI. After this event, messages will follow quickly in
-// an EventViewMsgs event.
-export interface EventStart {
-	SSEID: number
-	LoginAddress: MessageAddress
-	Addresses?: MessageAddress[] | null
-	DomainAddressConfigs?: { [key: string]: DomainAddressConfig }  // ASCII domain to address config.
-	MailboxName: string
-	Mailboxes?: Mailbox[] | null
-	RejectsMailbox: string
-	Settings: Settings
-	AccountPath: string  // If nonempty, the path on same host to webaccount interface.
-	Version: string
-}
-
-// DomainAddressConfig has the address (localpart) configuration for a domain, so
-// the webmail client can decide if an address matches the addresses of the
-// account.
-export interface DomainAddressConfig {
-	LocalpartCatchallSeparator: string  // Can be empty.
-	LocalpartCaseSensitive: boolean
-}
-
-// EventViewErr indicates an error during a query for messages. The request is
-// aborted, no more request-related messages will be sent until the next request.
-export interface EventViewErr {
-	ViewID: number
-	RequestID: number
-	Err: string  // To be displayed in client.
-}
-
-// EventViewReset indicates that a request for the next set of messages in a few
-// could not be fulfilled, e.g. because the anchor message does not exist anymore.
-// The client should clear its list of messages. This can happen before
-// EventViewMsgs events are sent.
-export interface EventViewReset {
-	ViewID: number
-	RequestID: number
-}
-
-// EventViewMsgs contains messages for a view, possibly a continuation of an
-// earlier list of messages.
-export interface EventViewMsgs {
-	ViewID: number
-	RequestID: number
-	MessageItems?: (MessageItem[] | null)[] | null  // If empty, this was the last message for the request. If non-empty, a list of thread messages. Each with the first message being the reason this thread is included and can be used as AnchorID in followup requests. If the threading mode is "off" in the query, there will always be only a single message. If a thread is sent, all messages in the thread are sent, including those that don't match the query (e.g. from another mailbox). Threads can be displayed based on the ThreadParentIDs field, with possibly slightly different display based on field ThreadMissingLink.
-	ParsedMessage?: ParsedMessage | null  // If set, will match the target page.DestMessageID from the request.
-	ViewEnd: boolean  // If set, there are no more messages in this view at this moment. Messages can be added, typically via Change messages, e.g. for new deliveries.
+// ScheduledMessage is a submitted message waiting for its first delivery
+// attempt, at a scheduled time or after an "undo send" grace period. Until then,
+// it can be canceled or rescheduled.
+export interface ScheduledMessage {
+	QueueMsgIDs?: number[] | null  // One for each recipient.
+	MessageID: string  // Message-ID header, including <>.
+	Subject: string  // Subject header.
+	Recipients?: string[] | null  // Addresses the message is delivered to, including Bcc.
+	Queued: Date
+	SendAt: Date  // Time of first delivery attempt.
+	UndoSend: boolean  // Whether SendAt is the end of an "undo send" grace period.
 }
 
 // MessageItem is sent by queries, it has derived information analyzed from
@@ -337,6 +268,8 @@ export interface Message {
 	MailFromValidation: Validation  // Can have SPF-specific validations like ValidationSoftfail.
 	MsgFromValidation: Validation  // Desirable validations: Strict, DMARC, Relaxed. Will not be just Pass.
 	DKIMDomains?: string[] | null  // Domains with verified DKIM signatures. Unicode string. For forwarded messages, a DKIM domain that matched a ruleset's verified domain is left out, but included in OrigDKIMDomains.
+	ARCResult: string  // Result of ARC chain validation of incoming messages, "none", "pass" or "fail". Empty if not verified, e.g. for messages not received over SMTP.
+	ARCSealDomains?: string[] | null  // Domains that sealed a passing ARC chain, most recent first. Unicode string.
 	OrigEHLODomain: string  // For forwarded messages,
 	OrigDKIMDomains?: string[] | null
 	MessageID: string  // Canonicalized Message-Id, always lower-case and normalized quoting, without <>'s. Empty if missing. Used for matching message threads, and to prevent duplicate reject delivery.
@@ -349,6 +282,7 @@ export interface Message {
 	ThreadCollapsed: boolean  // If set, this (sub)thread is collapsed in the webmail client, for threading mode "on" (mode "unread" ignores it). This field is copied to new child message. Changes are propagated to the webmail client.
 	IsMailingList: boolean  // If received message was known to match a mailing list rule (with modified junk filtering).
 	DSN: boolean  // If this message is a DSN, generated by us or received. For DSNs, we don't look at the subject when matching threads.
+	TextIndexed: boolean  // Whether the message has been added to the full-text index. Messages that are not indexed are always read when searching for words.
 	ReceivedTLSVersion: number  // 0 if unknown, 1 if plaintext/no TLS, otherwise TLS cipher suite.
 	ReceivedTLSCipherSuite: number
 	ReceivedRequireTLS: boolean  // Whether RequireTLS was known to be used for incoming delivery.
@@ -392,6 +326,132 @@ export interface Attachment {
 	Part: Part
 }
 
+// Mailbox is collection of messages, e.g. Inbox or Sent.
+export interface Mailbox {
+	ID: number
+	Name: string  // "Inbox" is the name for the special IMAP "INBOX". Slash separated for hierarchy.
+	UIDValidity: number  // If UIDs are invalidated, e.g. when renaming a mailbox to a previously existing name, UIDValidity must be changed. Used by IMAP for synchronization.
+	UIDNext: UID  // UID likely to be assigned to next message. Used by IMAP to detect messages delivered to a mailbox.
+	Archive: boolean
+	Draft: boolean
+	Junk: boolean
+	Sent: boolean
+	Trash: boolean
+	Keywords?: string[] | null  // Keywords as used in messages. Storing a non-system keyword for a message automatically adds it to this list. Used in the IMAP FLAGS response. Only "atoms" are allowed (IMAP syntax), keywords are case-insensitive, only stored in lower case (for JMAP), sorted.
+	HaveCounts: boolean  // Whether MailboxCounts have been initialized.
+	Total: number  // Total number of messages, excluding \Deleted. For JMAP.
+	Deleted: number  // Number of messages with \Deleted flag. Used for IMAP message count that includes messages with \Deleted.
+	Unread: number  // Messages without \Seen, excluding those with \Deleted, for JMAP.
+	Unseen: number  // Messages without \Seen, including those with \Deleted, for IMAP.
+	Size: number  // Number of bytes for all messages.
+}
+
+// MailboxACL is an entry in the access control list of a mailbox, giving another
+// account, or all accounts, rights on the mailbox. The account owning the mailbox
+// always has all rights, it does not have entries.
+// 
+// ../rfc/4314:191
+export interface MailboxACL {
+	ID: number
+	MailboxID: number
+	Identifier: string  // Account name, or "anyone" for all accounts.
+	Rights: string  // Letters from RightsAll, in that order.
+}
+
+// SharedMailbox is a mailbox of another account that an account has been given
+// rights to.
+export interface SharedMailbox {
+	Account: string  // Owner of the mailbox.
+	Mailbox: Mailbox
+	Rights: string  // Effective rights, see MailboxRights.
+	Direct: boolean  // Whether an entry exists for the account itself.
+	Anyone: boolean  // Whether an entry exists for "anyone".
+}
+
+// RecipientSecurity is a quick analysis of the security properties of delivery to
+// the recipient (domain).
+export interface RecipientSecurity {
+	STARTTLS: SecurityResult  // Whether recipient domain supports (opportunistic) STARTTLS, as seen during most recent delivery attempt. Will be "unknown" if no delivery to the domain has been attempted yet.
+	MTASTS: SecurityResult  // Whether we have a stored enforced MTA-STS policy, or domain has MTA-STS DNS record.
+	DNSSEC: SecurityResult  // Whether MX lookup response was DNSSEC-signed.
+	DANE: SecurityResult  // Whether first delivery destination has DANE records.
+	RequireTLS: SecurityResult  // Whether recipient domain is known to implement the REQUIRETLS SMTP extension. Will be "unknown" if no delivery to the domain has been attempted yet.
+}
+
+// Settings are webmail client settings.
+export interface Settings {
+	ID: number  // Singleton ID 1.
+	Signature: string
+	Quoting: Quoting
+	ShowAddressSecurity: boolean  // Whether to show the bars underneath the address input fields indicating starttls/dnssec/dane/mtasts/requiretls support by address.
+	UndoSendSeconds: number  // If > 0, messages sent without a scheduled time are held in the queue for this many seconds, during which sending can be undone.
+}
+
+export interface Ruleset {
+	SMTPMailFromRegexp: string
+	MsgFromRegexp: string
+	VerifiedDomain: string
+	HeadersRegexp?: { [key: string]: string }
+	IsForward: boolean
+	ListAllowDomain: string
+	AcceptRejectsToMailbox: string
+	Mailbox: string
+	Comment: string
+	VerifiedDNSDomain: Domain
+	ListAllowDNSDomain: Domain
+}
+
+// EventStart is the first message sent on an SSE connection, giving the client
+// basic data to populate its UI. After this event, messages will follow quickly in
+// an EventViewMsgs event.
+export interface EventStart {
+	SSEID: number
+	LoginAddress: MessageAddress
+	Addresses?: MessageAddress[] | null
+	DomainAddressConfigs?: { [key: string]: DomainAddressConfig }  // ASCII domain to address config.
+	MailboxName: string
+	Mailboxes?: Mailbox[] | null
+	RejectsMailbox: string
+	Settings: Settings
+	AccountPath: string  // If nonempty, the path on same host to webaccount interface.
+	Version: string
+}
+
+// DomainAddressConfig has the address (localpart) configuration for a domain, so
+// the webmail client can decide if an address matches the addresses of the
+// account.
+export interface DomainAddressConfig {
+	LocalpartCatchallSeparator: string  // Can be empty.
+	LocalpartCaseSensitive: boolean
+}
+
+// EventViewErr indicates an error during a query for messages. The request is
+// aborted, no more request-related messages will be sent until the next request.
+export interface EventViewErr {
+	ViewID: number
+	RequestID: number
+	Err: string  // To be displayed in client.
+}
+
+// EventViewReset indicates that a request for the next set of messages in a few
+// could not be fulfilled, e.g. because the anchor message does not exist anymore.
+// The client should clear its list of messages. This can happen before
+// EventViewMsgs events are sent.
+export interface EventViewReset {
+	ViewID: number
+	RequestID: number
+}
+
+// EventViewMsgs contains messages for a view, possibly a continuation of an
+// earlier list of messages.
+export interface EventViewMsgs {
+	ViewID: number
+	RequestID: number
+	MessageItems?: (MessageItem[] | null)[] | null  // If empty, this was the last message for the request. If non-empty, a list of thread messages. Each with the first message being the reason this thread is included and can be used as AnchorID in followup requests. If the threading mode is "off" in the query, there will always be only a single message. If a thread is sent, all messages in the thread are sent, including those that don't match the query (e.g. from another mailbox). Threads can be displayed based on the ThreadParentIDs field, with possibly slightly different display based on field ThreadMissingLink.
+	ParsedMessage?: ParsedMessage | null  // If set, will match the target page.DestMessageID from the request.
+	ViewEnd: boolean  // If set, there are no more messages in this view at this moment. Messages can be added, typically via Change messages, e.g. for new deliveries.
+}
+
 // EventViewChanges contain one or more changes relevant for the client, either
 // with new mailbox total/unseen message counts, or messages added/removed/modified
 // (flags) for the current view.
@@ -557,6 +617,18 @@ export enum ViewMode {
 	ModeHTMLExt = "htmlext",  // HTML with external resources.
 }
 
+// CryptoKind is a mechanism for signing and encrypting messages.
+export enum CryptoKind {
+	CryptoSMIME = "smime",
+	CryptoOpenPGP = "openpgp",
+}
+
+// Localpart is a decoded local part of an email address, before the "@".
+// For quoted strings, values do not hold the double quote or escaping backslashes.
+// An empty string can be a valid localpart.
+// Localparts are in Unicode NFC.
+export type Localpart = string
+
 // SecurityResult indicates whether a security feature is supported.
 export enum SecurityResult {
 	SecurityResultError = "error",
@@ -575,14 +647,8 @@ export enum Quoting {
 	Top = "top",
 }
 
-// Localpart is a decoded local part of an email address, before the "@".
-// For quoted strings, values do not hold the double quote or escaping backslashes.
-// An empty string can be a valid localpart.
-// Localparts are in Unicode NFC.
-export type Localpart = string
-
-export const structTypes: {[typename: string]: boolean} = {"Address":true,"Attachment":true,"ChangeMailboxAdd":true,"ChangeMailboxCounts":true,"ChangeMailboxKeywords":true,"ChangeMailboxRemove":true,"ChangeMailboxRename":true,"ChangeMailboxSpecialUse":true,"ChangeMsgAdd":true,"ChangeMsgFlags":true,"ChangeMsgRemove":true,"ChangeMsgThread":true,"ComposeMessage":true,"Domain":true,"DomainAddressConfig":true,"Envelope":true,"EventStart":true,"EventViewChanges":true,"EventViewErr":true,"EventViewMsgs":true,"EventViewReset":true,"File":true,"Filter":true,"Flags":true,"ForwardAttachments":true,"FromAddressSettings":true,"Mailbox":true,"Message":true,"MessageAddress":true,"MessageEnvelope":true,"MessageItem":true,"NotFilter":true,"Page":true,"ParsedMessage":true,"Part":true,"Query":true,"RecipientSecurity":true,"Request":true,"Ruleset":true,"Settings":true,"SpecialUse":true,"SubmitMessage":true}
-export const stringsTypes: {[typename: string]: boolean} = {"AttachmentType":true,"CSRFToken":true,"Localpart":true,"Quoting":true,"SecurityResult":true,"ThreadMode":true,"ViewMode":true}
+export const structTypes: {[typename: string]: boolean} = {"Address":true,"Attachment":true,"ChangeMailboxAdd":true,"ChangeMailboxCounts":true,"ChangeMailboxKeywords":true,"ChangeMailboxRemove":true,"ChangeMailboxRename":true,"ChangeMailboxSpecialUse":true,"ChangeMsgAdd":true,"ChangeMsgFlags":true,"ChangeMsgRemove":true,"ChangeMsgThread":true,"ComposeMessage":true,"Domain":true,"DomainAddressConfig":true,"Envelope":true,"EventStart":true,"EventViewChanges":true,"EventViewErr":true,"EventViewMsgs":true,"EventViewReset":true,"File":true,"Filter":true,"Flags":true,"ForwardAttachments":true,"FromAddressSettings":true,"Mailbox":true,"MailboxACL":true,"Message":true,"MessageAddress":true,"MessageCrypto":true,"MessageEnvelope":true,"MessageItem":true,"NotFilter":true,"Page":true,"ParsedMessage":true,"Part":true,"Query":true,"RecipientSecurity":true,"Request":true,"Ruleset":true,"ScheduledMessage":true,"Settings":true,"SharedMailbox":true,"SpecialUse":true,"SubmitMessage":true}
+export const stringsTypes: {[typename: string]: boolean} = {"AttachmentType":true,"CSRFToken":true,"CryptoKind":true,"Localpart":true,"Quoting":true,"SecurityResult":true,"ThreadMode":true,"ViewMode":true}
 export const intsTypes: {[typename: string]: boolean} = {"ModSeq":true,"UID":true,"Validation":true}
 export const types: TypenameMap = {
 	"Request": {"Name":"Request","Docs":"","Fields":[{"Name":"ID","Docs":"","Typewords":["int64"]},{"Name":"SSEID","Docs":"","Typewords":["int64"]},{"Name":"ViewID","Docs":"","Typewords":["int64"]},{"Name":"Cancel","Docs":"","Typewords":["bool"]},{"Name":"Query","Docs":"","Typewords":["Query"]},{"Name":"Page","Docs":"","Typewords":["Page"]}]},
@@ -590,30 +656,34 @@ export const types: TypenameMap = {
 	"Filter": {"Name":"Filter","Docs":"","Fields":[{"Name":"MailboxID","Docs":"","Typewords":["int64"]},{"Name":"MailboxChildrenIncluded","Docs":"","Typewords":["bool"]},{"Name":"MailboxName","Docs":"","Typewords":["string"]},{"Name":"Words","Docs":"","Typewords":["[]","string"]},{"Name":"From","Docs":"","Typewords":["[]","string"]},{"Name":"To","Docs":"","Typewords":["[]","string"]},{"Name":"Oldest","Docs":"","Typewords":["nullable","timestamp"]},{"Name":"Newest","Docs":"","Typewords":["nullable","timestamp"]},{"Name":"Subject","Docs":"","Typewords":["[]","string"]},{"Name":"Attachments","Docs":"","Typewords":["AttachmentType"]},{"Name":"Labels","Docs":"","Typewords":["[]","string"]},{"Name":"Headers","Docs":"","Typewords":["[]","[]","string"]},{"Name":"SizeMin","Docs":"","Typewords":["int64"]},{"Name":"SizeMax","Docs":"","Typewords":["int64"]}]},
 	"NotFilter": {"Name":"NotFilter","Docs":"","Fields":[{"Name":"Words","Docs":"","Typewords":["[]","string"]},{"Name":"From","Docs":"","Typewords":["[]","string"]},{"Name":"To","Docs":"","Typewords":["[]","string"]},{"Name":"Subject","Docs":"","Typewords":["[]","string"]},{"Name":"Attachments","Docs":"","Typewords":["AttachmentType"]},{"Name":"Labels","Docs":"","Typewords":["[]","string"]}]},
 	"Page": {"Name":"Page","Docs":"","Fields":[{"Name":"AnchorMessageID","Docs":"","Typewords":["int64"]},{"Name":"Count","Docs":"","Typewords":["int32"]},{"Name":"DestMessageID","Docs":"","Typewords":["int64"]}]},
-	"ParsedMessage": {"Name":"ParsedMessage","Docs":"","Fields":[{"Name":"ID","Docs":"","Typewords":["int64"]},{"Name":"Part","Docs":"","Typewords":["Part"]},{"Name":"Headers","Docs":"","Typewords":["{}","[]","string"]},{"Name":"ViewMode","Docs":"","Typewords":["ViewMode"]},{"Name":"Texts","Docs":"","Typewords":["[]","string"]},{"Name":"HasHTML","Docs":"","Typewords":["bool"]},{"Name":"ListReplyAddress","Docs":"","Typewords":["nullable","MessageAddress"]}]},
+	"ParsedMessage": {"Name":"ParsedMessage","Docs":"","Fields":[{"Name":"ID","Docs":"","Typewords":["int64"]},{"Name":"Part","Docs":"","Typewords":["Part"]},{"Name":"Headers","Docs":"","Typewords":["{}","[]","string"]},{"Name":"ViewMode","Docs":"","Typewords":["ViewMode"]},{"Name":"Texts","Docs":"","Typewords":["[]","string"]},{"Name":"HasHTML","Docs":"","Typewords":["bool"]},{"Name":"ListReplyAddress","Docs":"","Typewords":["nullable","MessageAddress"]},{"Name":"Crypto","Docs":"","Typewords":["nullable","MessageCrypto"]}]},
 	"Part": {"Name":"Part","Docs":"","Fields":[{"Name":"BoundaryOffset","Docs":"","Typewords":["int64"]},{"Name":"HeaderOffset","Docs":"","Typewords":["int64"]},{"Name":"BodyOffset","Docs":"","Typewords":["int64"]},{"Name":"EndOffset","Docs":"","Typewords":["int64"]},{"Name":"RawLineCount","Docs":"","Typewords":["int64"]},{"Name":"DecodedSize","Docs":"","Typewords":["int64"]},{"Name":"MediaType","Docs":"","Typewords":["string"]},{"Name":"MediaSubType","Docs":"","Typewords":["string"]},{"Name":"ContentTypeParams","Docs":"","Typewords":["{}","string"]},{"Name":"ContentID","Docs":"","Typewords":["string"]},{"Name":"ContentDescription","Docs":"","Typewords":["string"]},{"Name":"ContentTransferEncoding","Docs":"","Typewords":["string"]},{"Name":"Envelope","Docs":"","Typewords":["nullable","Envelope"]},{"Name":"Parts","Docs":"","Typewords":["[]","Part"]},{"Name":"Message","Docs":"","Typewords":["nullable","Part"]}]},
 	"Envelope": {"Name":"Envelope","Docs":"","Fields":[{"Name":"Date","Docs":"","Typewords":["timestamp"]},{"Name":"Subject","Docs":"","Typewords":["string"]},{"Name":"From","Docs":"","Typewords":["[]","Address"]},{"Name":"Sender","Docs":"","Typewords":["[]","Address"]},{"Name":"ReplyTo","Docs":"","Typewords":["[]","Address"]},{"Name":"To","Docs":"","Typewords":["[]","Address"]},{"Name":"CC","Docs":"","Typewords":["[]","Address"]},{"Name":"BCC","Docs":"","Typewords":["[]","Address"]},{"Name":"InReplyTo","Docs":"","Typewords":["string"]},{"Name":"MessageID","Docs":"","Typewords":["string"]}]},
 	"Address": {"Name":"Address","Docs":"","Fields":[{"Name":"Name","Docs":"","Typewords":["string"]},{"Name":"User","Docs":"","Typewords":["string"]},{"Name":"Host","Docs":"","Typewords":["string"]}]},
 	"MessageAddress": {"Name":"MessageAddress","Docs":"","Fields":[{"Name":"Name","Docs":"","Typewords":["string"]},{"Name":"User","Docs":"","Typewords":["string"]},{"Name":"Domain","Docs":"","Typewords":["Domain"]}]},
 	"Domain": {"Name":"Domain","Docs":"","Fields":[{"Name":"ASCII","Docs":"","Typewords":["string"]},{"Name":"Unicode","Docs":"","Typewords":["string"]}]},
+	"MessageCrypto": {"Name":"MessageCrypto","Docs":"","Fields":[{"Name":"Kind","Docs":"","Typewords":["CryptoKind"]},{"Name":"Encrypted","Docs":"","Typewords":["bool"]},{"Name":"Decrypted","Docs":"","Typewords":["bool"]},{"Name":"DecryptError","Docs":"","Typewords":["string"]},{"Name":"Signed","Docs":"","Typewords":["bool"]},{"Name":"SignatureValid","Docs":"","Typewords":["bool"]},{"Name":"SignatureError","Docs":"","Typewords":["string"]},{"Name":"SignerAddresses","Docs":"","Typewords":["[]","string"]},{"Name":"SignerFingerprint","Docs":"","Typewords":["string"]},{"Name":"SignerMatchesFrom","Docs":"","Typewords":["bool"]},{"Name":"SignerTrusted","Docs":"","Typewords":["bool"]}]},
 	"FromAddressSettings": {"Name":"FromAddressSettings","Docs":"","Fields":[{"Name":"FromAddress","Docs":"","Typewords":["string"]},{"Name":"ViewMode","Docs":"","Typewords":["ViewMode"]}]},
 	"ComposeMessage": {"Name":"ComposeMessage","Docs":"","Fields":[{"Name":"From","Docs":"","Typewords":["string"]},{"Name":"To","Docs":"","Typewords":["[]","string"]},{"Name":"Cc","Docs":"","Typewords":["[]","string"]},{"Name":"Bcc","Docs":"","Typewords":["[]","string"]},{"Name":"ReplyTo","Docs":"","Typewords":["string"]},{"Name":"Subject","Docs":"","Typewords":["string"]},{"Name":"TextBody","Docs":"","Typewords":["string"]},{"Name":"ResponseMessageID","Docs":"","Typewords":["int64"]},{"Name":"DraftMessageID","Docs":"","Typewords":["int64"]}]},
-	"SubmitMessage": {"Name":"SubmitMessage","Docs":"","Fields":[{"Name":"From","Docs":"","Typewords":["string"]},{"Name":"To","Docs":"","Typewords":["[]","string"]},{"Name":"Cc","Docs":"","Typewords":["[]","string"]},{"Name":"Bcc","Docs":"","Typewords":["[]","string"]},{"Name":"ReplyTo","Docs":"","Typewords":["string"]},{"Name":"Subject","Docs":"","Typewords":["string"]},{"Name":"TextBody","Docs":"","Typewords":["string"]},{"Name":"Attachments","Docs":"","Typewords":["[]","File"]},{"Name":"ForwardAttachments","Docs":"","Typewords":["ForwardAttachments"]},{"Name":"IsForward","Docs":"","Typewords":["bool"]},{"Name":"ResponseMessageID","Docs":"","Typewords":["int64"]},{"Name":"UserAgent","Docs":"","Typewords":["string"]},{"Name":"RequireTLS","Docs":"","Typewords":["nullable","bool"]},{"Name":"FutureRelease","Docs":"","Typewords":["nullable","timestamp"]},{"Name":"ArchiveThread","Docs":"","Typewords":["bool"]},{"Name":"DraftMessageID","Docs":"","Typewords":["int64"]}]},
+	"SubmitMessage": {"Name":"SubmitMessage","Docs":"","Fields":[{"Name":"From","Docs":"","Typewords":["string"]},{"Name":"To","Docs":"","Typewords":["[]","string"]},{"Name":"Cc","Docs":"","Typewords":["[]","string"]},{"Name":"Bcc","Docs":"","Typewords":["[]","string"]},{"Name":"ReplyTo","Docs":"","Typewords":["string"]},{"Name":"Subject","Docs":"","Typewords":["string"]},{"Name":"TextBody","Docs":"","Typewords":["string"]},{"Name":"Attachments","Docs":"","Typewords":["[]","File"]},{"Name":"ForwardAttachments","Docs":"","Typewords":["ForwardAttachments"]},{"Name":"IsForward","Docs":"","Typewords":["bool"]},{"Name":"ResponseMessageID","Docs":"","Typewords":["int64"]},{"Name":"UserAgent","Docs":"","Typewords":["string"]},{"Name":"RequireTLS","Docs":"","Typewords":["nullable","bool"]},{"Name":"FutureRelease","Docs":"","Typewords":["nullable","timestamp"]},{"Name":"UndoSendSeconds","Docs":"","Typewords":["int32"]},{"Name":"ArchiveThread","Docs":"","Typewords":["bool"]},{"Name":"DraftMessageID","Docs":"","Typewords":["int64"]},{"Name":"Crypto","Docs":"","Typewords":["CryptoKind"]},{"Name":"Sign","Docs":"","Typewords":["bool"]},{"Name":"Encrypt","Docs":"","Typewords":["bool"]}]},
 	"File": {"Name":"File","Docs":"","Fields":[{"Name":"Filename","Docs":"","Typewords":["string"]},{"Name":"DataURI","Docs":"","Typewords":["string"]}]},
 	"ForwardAttachments": {"Name":"ForwardAttachments","Docs":"","Fields":[{"Name":"MessageID","Docs":"","Typewords":["int64"]},{"Name":"Paths","Docs":"","Typewords":["[]","[]","int32"]}]},
+	"ScheduledMessage": {"Name":"ScheduledMessage","Docs":"","Fields":[{"Name":"QueueMsgIDs","Docs":"","Typewords":["[]","int64"]},{"Name":"MessageID","Docs":"","Typewords":["string"]},{"Name":"Subject","Docs":"","Typewords":["string"]},{"Name":"Recipients","Docs":"","Typewords":["[]","string"]},{"Name":"Queued","Docs":"","Typewords":["timestamp"]},{"Name":"SendAt","Docs":"","Typewords":["timestamp"]},{"Name":"UndoSend","Docs":"","Typewords":["bool"]}]},
+	"MessageItem": {"Name":"MessageItem","Docs":"","Fields":[{"Name":"Message","Docs":"","Typewords":["Message"]},{"Name":"Envelope","Docs":"","Typewords":["MessageEnvelope"]},{"Name":"Attachments","Docs":"","Typewords":["[]","Attachment"]},{"Name":"IsSigned","Docs":"","Typewords":["bool"]},{"Name":"IsEncrypted","Docs":"","Typewords":["bool"]},{"Name":"FirstLine","Docs":"","Typewords":["string"]},{"Name":"MatchQuery","Docs":"","Typewords":["bool"]}]},
+	"Message": {"Name":"Message","Docs":"","Fields":[{"Name":"ID","Docs":"","Typewords":["int64"]},{"Name":"UID","Docs":"","Typewords":["UID"]},{"Name":"MailboxID","Docs":"","Typewords":["int64"]},{"Name":"ModSeq","Docs":"","Typewords":["ModSeq"]},{"Name":"CreateSeq","Docs":"","Typewords":["ModSeq"]},{"Name":"Expunged","Docs":"","Typewords":["bool"]},{"Name":"IsReject","Docs":"","Typewords":["bool"]},{"Name":"IsForward","Docs":"","Typewords":["bool"]},{"Name":"MailboxOrigID","Docs":"","Typewords":["int64"]},{"Name":"MailboxDestinedID","Docs":"","Typewords":["int64"]},{"Name":"Received","Docs":"","Typewords":["timestamp"]},{"Name":"RemoteIP","Docs":"","Typewords":["string"]},{"Name":"RemoteIPMasked1","Docs":"","Typewords":["string"]},{"Name":"RemoteIPMasked2","Docs":"","Typewords":["string"]},{"Name":"RemoteIPMasked3","Docs":"","Typewords":["string"]},{"Name":"EHLODomain","Docs":"","Typewords":["string"]},{"Name":"MailFrom","Docs":"","Typewords":["string"]},{"Name":"MailFromLocalpart","Docs":"","Typewords":["Localpart"]},{"Name":"MailFromDomain","Docs":"","Typewords":["string"]},{"Name":"RcptToLocalpart","Docs":"","Typewords":["Localpart"]},{"Name":"RcptToDomain","Docs":"","Typewords":["string"]},{"Name":"MsgFromLocalpart","Docs":"","Typewords":["Localpart"]},{"Name":"MsgFromDomain","Docs":"","Typewords":["string"]},{"Name":"MsgFromOrgDomain","Docs":"","Typewords":["string"]},{"Name":"EHLOValidated","Docs":"","Typewords":["bool"]},{"Name":"MailFromValidated","Docs":"","Typewords":["bool"]},{"Name":"MsgFromValidated","Docs":"","Typewords":["bool"]},{"Name":"EHLOValidation","Docs":"","Typewords":["Validation"]},{"Name":"MailFromValidation","Docs":"","Typewords":["Validation"]},{"Name":"MsgFromValidation","Docs":"","Typewords":["Validation"]},{"Name":"DKIMDomains","Docs":"","Typewords":["[]","string"]},{"Name":"ARCResult","Docs":"","Typewords":["string"]},{"Name":"ARCSealDomains","Docs":"","Typewords":["[]","string"]},{"Name":"OrigEHLODomain","Docs":"","Typewords":["string"]},{"Name":"OrigDKIMDomains","Docs":"","Typewords":["[]","string"]},{"Name":"MessageID","Docs":"","Typewords":["string"]},{"Name":"SubjectBase","Docs":"","Typewords":["string"]},{"Name":"MessageHash","Docs":"","Typewords":["nullable","string"]},{"Name":"ThreadID","Docs":"","Typewords":["int64"]},{"Name":"ThreadParentIDs","Docs":"","Typewords":["[]","int64"]},{"Name":"ThreadMissingLink","Docs":"","Typewords":["bool"]},{"Name":"ThreadMuted","Docs":"","Typewords":["bool"]},{"Name":"ThreadCollapsed","Docs":"","Typewords":["bool"]},{"Name":"IsMailingList","Docs":"","Typewords":["bool"]},{"Name":"DSN","Docs":"","Typewords":["bool"]},{"Name":"TextIndexed","Docs":"","Typewords":["bool"]},{"Name":"ReceivedTLSVersion","Docs":"","Typewords":["uint16"]},{"Name":"ReceivedTLSCipherSuite","Docs":"","Typewords":["uint16"]},{"Name":"ReceivedRequireTLS","Docs":"","Typewords":["bool"]},{"Name":"Seen","Docs":"","Typewords":["bool"]},{"Name":"Answered","Docs":"","Typewords":["bool"]},{"Name":"Flagged","Docs":"","Typewords":["bool"]},{"Name":"Forwarded","Docs":"","Typewords":["bool"]},{"Name":"Junk","Docs":"","Typewords":["bool"]},{"Name":"Notjunk","Docs":"","Typewords":["bool"]},{"Name":"Deleted","Docs":"","Typewords":["bool"]},{"Name":"Draft","Docs":"","Typewords":["bool"]},{"Name":"Phishing","Docs":"","Typewords":["bool"]},{"Name":"MDNSent","Docs":"","Typewords":["bool"]},{"Name":"Keywords","Docs":"","Typewords":["[]","string"]},{"Name":"Size","Docs":"","Typewords":["int64"]},{"Name":"TrainedJunk","Docs":"","Typewords":["nullable","bool"]},{"Name":"MsgPrefix","Docs":"","Typewords":["nullable","string"]},{"Name":"ParsedBuf","Docs":"","Typewords":["nullable","string"]}]},
+	"MessageEnvelope": {"Name":"MessageEnvelope","Docs":"","Fields":[{"Name":"Date","Docs":"","Typewords":["timestamp"]},{"Name":"Subject","Docs":"","Typewords":["string"]},{"Name":"From","Docs":"","Typewords":["[]","MessageAddress"]},{"Name":"Sender","Docs":"","Typewords":["[]","MessageAddress"]},{"Name":"ReplyTo","Docs":"","Typewords":["[]","MessageAddress"]},{"Name":"To","Docs":"","Typewords":["[]","MessageAddress"]},{"Name":"CC","Docs":"","Typewords":["[]","MessageAddress"]},{"Name":"BCC","Docs":"","Typewords":["[]","MessageAddress"]},{"Name":"InReplyTo","Docs":"","Typewords":["string"]},{"Name":"MessageID","Docs":"","Typewords":["string"]}]},
+	"Attachment": {"Name":"Attachment","Docs":"","Fields":[{"Name":"Path","Docs":"","Typewords":["[]","int32"]},{"Name":"Filename","Docs":"","Typewords":["string"]},{"Name":"Part","Docs":"","Typewords":["Part"]}]},
 	"Mailbox": {"Name":"Mailbox","Docs":"","Fields":[{"Name":"ID","Docs":"","Typewords":["int64"]},{"Name":"Name","Docs":"","Typewords":["string"]},{"Name":"UIDValidity","Docs":"","Typewords":["uint32"]},{"Name":"UIDNext","Docs":"","Typewords":["UID"]},{"Name":"Archive","Docs":"","Typewords":["bool"]},{"Name":"Draft","Docs":"","Typewords":["bool"]},{"Name":"Junk","Docs":"","Typewords":["bool"]},{"Name":"Sent","Docs":"","Typewords":["bool"]},{"Name":"Trash","Docs":"","Typewords":["bool"]},{"Name":"Keywords","Docs":"","Typewords":["[]","string"]},{"Name":"HaveCounts","Docs":"","Typewords":["bool"]},{"Name":"Total","Docs":"","Typewords":["int64"]},{"Name":"Deleted","Docs":"","Typewords":["int64"]},{"Name":"Unread","Docs":"","Typewords":["int64"]},{"Name":"Unseen","Docs":"","Typewords":["int64"]},{"Name":"Size","Docs":"","Typewords":["int64"]}]},
+	"MailboxACL": {"Name":"MailboxACL","Docs":"","Fields":[{"Name":"ID","Docs":"","Typewords":["int64"]},{"Name":"MailboxID","Docs":"","Typewords":["int64"]},{"Name":"Identifier","Docs":"","Typewords":["string"]},{"Name":"Rights","Docs":"","Typewords":["string"]}]},
+	"SharedMailbox": {"Name":"SharedMailbox","Docs":"","Fields":[{"Name":"Account","Docs":"","Typewords":["string"]},{"Name":"Mailbox","Docs":"","Typewords":["Mailbox"]},{"Name":"Rights","Docs":"","Typewords":["string"]},{"Name":"Direct","Docs":"","Typewords":["bool"]},{"Name":"Anyone","Docs":"","Typewords":["bool"]}]},
 	"RecipientSecurity": {"Name":"RecipientSecurity","Docs":"","Fields":[{"Name":"STARTTLS","Docs":"","Typewords":["SecurityResult"]},{"Name":"MTASTS","Docs":"","Typewords":["SecurityResult"]},{"Name":"DNSSEC","Docs":"","Typewords":["SecurityResult"]},{"Name":"DANE","Docs":"","Typewords":["SecurityResult"]},{"Name":"RequireTLS","Docs":"","Typewords":["SecurityResult"]}]},
-	"Settings": {"Name":"Settings","Docs":"","Fields":[{"Name":"ID","Docs":"","Typewords":["uint8"]},{"Name":"Signature","Docs":"","Typewords":["string"]},{"Name":"Quoting","Docs":"","Typewords":["Quoting"]},{"Name":"ShowAddressSecurity","Docs":"","Typewords":["bool"]}]},
+	"Settings": {"Name":"Settings","Docs":"","Fields":[{"Name":"ID","Docs":"","Typewords":["uint8"]},{"Name":"Signature","Docs":"","Typewords":["string"]},{"Name":"Quoting","Docs":"","Typewords":["Quoting"]},{"Name":"ShowAddressSecurity","Docs":"","Typewords":["bool"]},{"Name":"UndoSendSeconds","Docs":"","Typewords":["int32"]}]},
 	"Ruleset": {"Name":"Ruleset","Docs":"","Fields":[{"Name":"SMTPMailFromRegexp","Docs":"","Typewords":["string"]},{"Name":"MsgFromRegexp","Docs":"","Typewords":["string"]},{"Name":"VerifiedDomain","Docs":"","Typewords":["string"]},{"Name":"HeadersRegexp","Docs":"","Typewords":["{}","string"]},{"Name":"IsForward","Docs":"","Typewords":["bool"]},{"Name":"ListAllowDomain","Docs":"","Typewords":["string"]},{"Name":"AcceptRejectsToMailbox","Docs":"","Typewords":["string"]},{"Name":"Mailbox","Docs":"","Typewords":["string"]},{"Name":"Comment","Docs":"","Typewords":["string"]},{"Name":"VerifiedDNSDomain","Docs":"","Typewords":["Domain"]},{"Name":"ListAllowDNSDomain","Docs":"","Typewords":["Domain"]}]},
 	"EventStart": {"Name":"EventStart","Docs":"","Fields":[{"Name":"SSEID","Docs":"","Typewords":["int64"]},{"Name":"LoginAddress","Docs":"","Typewords":["MessageAddress"]},{"Name":"Addresses","Docs":"","Typewords":["[]","MessageAddress"]},{"Name":"DomainAddressConfigs","Docs":"","Typewords":["{}","DomainAddressConfig"]},{"Name":"MailboxName","Docs":"","Typewords":["string"]},{"Name":"Mailboxes","Docs":"","Typewords":["[]","Mailbox"]},{"Name":"RejectsMailbox","Docs":"","Typewords":["string"]},{"Name":"Settings","Docs":"","Typewords":["Settings"]},{"Name":"AccountPath","Docs":"","Typewords":["string"]},{"Name":"Version","Docs":"","Typewords":["string"]}]},
 	"DomainAddressConfig": {"Name":"DomainAddressConfig","Docs":"","Fields":[{"Name":"LocalpartCatchallSeparator","Docs":"","Typewords":["string"]},{"Name":"LocalpartCaseSensitive","Docs":"","Typewords":["bool"]}]},
 	"EventViewErr": {"Name":"EventViewErr","Docs":"","Fields":[{"Name":"ViewID","Docs":"","Typewords":["int64"]},{"Name":"RequestID","Docs":"","Typewords":["int64"]},{"Name":"Err","Docs":"","Typewords":["string"]}]},
 	"EventViewReset": {"Name":"EventViewReset","Docs":"","Fields":[{"Name":"ViewID","Docs":"","Typewords":["int64"]},{"Name":"RequestID","Docs":"","Typewords":["int64"]}]},
 	"EventViewMsgs": {"Name":"EventViewMsgs","Docs":"","Fields":[{"Name":"ViewID","Docs":"","Typewords":["int64"]},{"Name":"RequestID","Docs":"","Typewords":["int64"]},{"Name":"MessageItems","Docs":"","Typewords":["[]","[]","MessageItem"]},{"Name":"ParsedMessage","Docs":"","Typewords":["nullable","ParsedMessage"]},{"Name":"ViewEnd","Docs":"","Typewords":["bool"]}]},
-	"MessageItem": {"Name":"MessageItem","Docs":"","Fields":[{"Name":"Message","Docs":"","Typewords":["Message"]},{"Name":"Envelope","Docs":"","Typewords":["MessageEnvelope"]},{"Name":"Attachments","Docs":"","Typewords":["[]","Attachment"]},{"Name":"IsSigned","Docs":"","Typewords":["bool"]},{"Name":"IsEncrypted","Docs":"","Typewords":["bool"]},{"Name":"FirstLine","Docs":"","Typewords":["string"]},{"Name":"MatchQuery","Docs":"","Typewords":["bool"]}]},
-	"Message": {"Name":"Message","Docs":"","Fields":[{"Name":"ID","Docs":"","Typewords":["int64"]},{"Name":"UID","Docs":"","Typewords":["UID"]},{"Name":"MailboxID","Docs":"","Typewords":["int64"]},{"Name":"ModSeq","Docs":"","Typewords":["ModSeq"]},{"Name":"CreateSeq","Docs":"","Typewords":["ModSeq"]},{"Name":"Expunged","Docs":"","Typewords":["bool"]},{"Name":"IsReject","Docs":"","Typewords":["bool"]},{"Name":"IsForward","Docs":"","Typewords":["bool"]},{"Name":"MailboxOrigID","Docs":"","Typewords":["int64"]},{"Name":"MailboxDestinedID","Docs":"","Typewords":["int64"]},{"Name":"Received","Docs":"","Typewords":["timestamp"]},{"Name":"RemoteIP","Docs":"","Typewords":["string"]},{"Name":"RemoteIPMasked1","Docs":"","Typewords":["string"]},{"Name":"RemoteIPMasked2","Docs":"","Typewords":["string"]},{"Name":"RemoteIPMasked3","Docs":"","Typewords":["string"]},{"Name":"EHLODomain","Docs":"","Typewords":["string"]},{"Name":"MailFrom","Docs":"","Typewords":["string"]},{"Name":"MailFromLocalpart","Docs":"","Typewords":["Localpart"]},{"Name":"MailFromDomain","Docs":"","Typewords":["string"]},{"Name":"RcptToLocalpart","Docs":"","Typewords":["Localpart"]},{"Name":"RcptToDomain","Docs":"","Typewords":["string"]},{"Name":"MsgFromLocalpart","Docs":"","Typewords":["Localpart"]},{"Name":"MsgFromDomain","Docs":"","Typewords":["string"]},{"Name":"MsgFromOrgDomain","Docs":"","Typewords":["string"]},{"Name":"EHLOValidated","Docs":"","Typewords":["bool"]},{"Name":"MailFromValidated","Docs":"","Typewords":["bool"]},{"Name":"MsgFromValidated","Docs":"","Typewords":["bool"]},{"Name":"EHLOValidation","Docs":"","Typewords":["Validation"]},{"Name":"MailFromValidation","Docs":"","Typewords":["Validation"]},{"Name":"MsgFromValidation","Docs":"","Typewords":["Validation"]},{"Name":"DKIMDomains","Docs":"","Typewords":["[]","string"]},{"Name":"OrigEHLODomain","Docs":"","Typewords":["string"]},{"Name":"OrigDKIMDomains","Docs":"","Typewords":["[]","string"]},{"Name":"MessageID","Docs":"","Typewords":["string"]},{"Name":"SubjectBase","Docs":"","Typewords":["string"]},{"Name":"MessageHash","Docs":"","Typewords":["nullable","string"]},{"Name":"ThreadID","Docs":"","Typewords":["int64"]},{"Name":"ThreadParentIDs","Docs":"","Typewords":["[]","int64"]},{"Name":"ThreadMissingLink","Docs":"","Typewords":["bool"]},{"Name":"ThreadMuted","Docs":"","Typewords":["bool"]},{"Name":"ThreadCollapsed","Docs":"","Typewords":["bool"]},{"Name":"IsMailingList","Docs":"","Typewords":["bool"]},{"Name":"DSN","Docs":"","Typewords":["bool"]},{"Name":"ReceivedTLSVersion","Docs":"","Typewords":["uint16"]},{"Name":"ReceivedTLSCipherSuite","Docs":"","Typewords":["uint16"]},{"Name":"ReceivedRequireTLS","Docs":"","Typewords":["bool"]},{"Name":"Seen","Docs":"","Typewords":["bool"]},{"Name":"Answered","Docs":"","Typewords":["bool"]},{"Name":"Flagged","Docs":"","Typewords":["bool"]},{"Name":"Forwarded","Docs":"","Typewords":["bool"]},{"Name":"Junk","Docs":"","Typewords":["bool"]},{"Name":"Notjunk","Docs":"","Typewords":["bool"]},{"Name":"Deleted","Docs":"","Typewords":["bool"]},{"Name":"Draft","Docs":"","Typewords":["bool"]},{"Name":"Phishing","Docs":"","Typewords":["bool"]},{"Name":"MDNSent","Docs":"","Typewords":["bool"]},{"Name":"Keywords","Docs":"","Typewords":["[]","string"]},{"Name":"Size","Docs":"","Typewords":["int64"]},{"Name":"TrainedJunk","Docs":"","Typewords":["nullable","bool"]},{"Name":"MsgPrefix","Docs":"","Typewords":["nullable","string"]},{"Name":"ParsedBuf","Docs":"","Typewords":["nullable","string"]}]},
-	"MessageEnvelope": {"Name":"MessageEnvelope","Docs":"","Fields":[{"Name":"Date","Docs":"","Typewords":["timestamp"]},{"Name":"Subject","Docs":"","Typewords":["string"]},{"Name":"From","Docs":"","Typewords":["[]","MessageAddress"]},{"Name":"Sender","Docs":"","Typewords":["[]","MessageAddress"]},{"Name":"ReplyTo","Docs":"","Typewords":["[]","MessageAddress"]},{"Name":"To","Docs":"","Typewords":["[]","MessageAddress"]},{"Name":"CC","Docs":"","Typewords":["[]","MessageAddress"]},{"Name":"BCC","Docs":"","Typewords":["[]","MessageAddress"]},{"Name":"InReplyTo","Docs":"","Typewords":["string"]},{"Name":"MessageID","Docs":"","Typewords":["string"]}]},
-	"Attachment": {"Name":"Attachment","Docs":"","Fields":[{"Name":"Path","Docs":"","Typewords":["[]","int32"]},{"Name":"Filename","Docs":"","Typewords":["string"]},{"Name":"Part","Docs":"","Typewords":["Part"]}]},
 	"EventViewChanges": {"Name":"EventViewChanges","Docs":"","Fields":[{"Name":"ViewID","Docs":"","Typewords":["int64"]},{"Name":"Changes","Docs":"","Typewords":["[]","[]","any"]}]},
 	"ChangeMsgAdd": {"Name":"ChangeMsgAdd","Docs":"","Fields":[{"Name":"MailboxID","Docs":"","Typewords":["int64"]},{"Name":"UID","Docs":"","Typewords":["UID"]},{"Name":"ModSeq","Docs":"","Typewords":["ModSeq"]},{"Name":"Flags","Docs":"","Typewords":["Flags"]},{"Name":"Keywords","Docs":"","Typewords":["[]","string"]},{"Name":"MessageItems","Docs":"","Typewords":["[]","MessageItem"]}]},
 	"Flags": {"Name":"Flags","Docs":"","Fields":[{"Name":"Seen","Docs":"","Typewords":["bool"]},{"Name":"Answered","Docs":"","Typewords":["bool"]},{"Name":"Flagged","Docs":"","Typewords":["bool"]},{"Name":"Forwarded","Docs":"","Typewords":["bool"]},{"Name":"Junk","Docs":"","Typewords":["bool"]},{"Name":"Notjunk","Docs":"","Typewords":["bool"]},{"Name":"Deleted","Docs":"","Typewords":["bool"]},{"Name":"Draft","Docs":"","Typewords":["bool"]},{"Name":"Phishing","Docs":"","Typewords":["bool"]},{"Name":"MDNSent","Docs":"","Typewords":["bool"]}]},
@@ -634,9 +704,10 @@ export const types: TypenameMap = {
 	"ThreadMode": {"Name":"ThreadMode","Docs":"","Values":[{"Name":"ThreadOff","Value":"off","Docs":""},{"Name":"ThreadOn","Value":"on","Docs":""},{"Name":"ThreadUnread","Value":"unread","Docs":""}]},
 	"AttachmentType": {"Name":"AttachmentType","Docs":"","Values":[{"Name":"AttachmentIndifferent","Value":"","Docs":""},{"Name":"AttachmentNone","Value":"none","Docs":""},{"Name":"AttachmentAny","Value":"any","Docs":""},{"Name":"AttachmentImage","Value":"image","Docs":""},{"Name":"AttachmentPDF","Value":"pdf","Docs":""},{"Name":"AttachmentArchive","Value":"archive","Docs":""},{"Name":"AttachmentSpreadsheet","Value":"spreadsheet","Docs":""},{"Name":"AttachmentDocument","Value":"document","Docs":""},{"Name":"AttachmentPresentation","Value":"presentation","Docs":""}]},
 	"ViewMode": {"Name":"ViewMode","Docs":"","Values":[{"Name":"ModeDefault","Value":"","Docs":""},{"Name":"ModeText","Value":"text","Docs":""},{"Name":"ModeHTML","Value":"html","Docs":""},{"Name":"ModeHTMLExt","Value":"htmlext","Docs":""}]},
+	"CryptoKind": {"Name":"CryptoKind","Docs":"","Values":[{"Name":"CryptoSMIME","Value":"smime","Docs":""},{"Name":"CryptoOpenPGP","Value":"openpgp","Docs":""}]},
+	"Localpart": {"Name":"Localpart","Docs":"","Values":null},
 	"SecurityResult": {"Name":"SecurityResult","Docs":"","Values":[{"Name":"SecurityResultError","Value":"error","Docs":""},{"Name":"SecurityResultNo","Value":"no","Docs":""},{"Name":"SecurityResultYes","Value":"yes","Docs":""},{"Name":"SecurityResultUnknown","Value":"unknown","Docs":""}]},
 	"Quoting": {"Name":"Quoting","Docs":"","Values":[{"Name":"Default","Value":"","Docs":""},{"Name":"Bottom","Value":"bottom","Docs":""},{"Name":"Top","Value":"top","Docs":""}]},
-	"Localpart": {"Name":"Localpart","Docs":"","Values":null},
 }
 
 export const parser = {
@@ -651,12 +722,20 @@ export const parser = {
 	Address: (v: any) => parse("Address", v) as Address,
 	MessageAddress: (v: any) => parse("MessageAddress", v) as MessageAddress,
 	Domain: (v: any) => parse("Domain", v) as Domain,
+	MessageCrypto: (v: any) => parse("MessageCrypto", v) as MessageCrypto,
 	FromAddressSettings: (v: any) => parse("FromAddressSettings", v) as FromAddressSettings,
 	ComposeMessage: (v: any) => parse("ComposeMessage", v) as ComposeMessage,
 	SubmitMessage: (v: any) => parse("SubmitMessage", v) as SubmitMessage,
 	File: (v: any) => parse("File", v) as File,
 	ForwardAttachments: (v: any) => parse("ForwardAttachments", v) as ForwardAttachments,
+	ScheduledMessage: (v: any) => parse("ScheduledMessage", v) as ScheduledMessage,
+	MessageItem: (v: any) => parse("MessageItem", v) as MessageItem,
+	Message: (v: any) => parse("Message", v) as Message,
+	MessageEnvelope: (v: any) => parse("MessageEnvelope", v) as MessageEnvelope,
+	Attachment: (v: any) => parse("Attachment", v) as Attachment,
 	Mailbox: (v: any) => parse("Mailbox", v) as Mailbox,
+	MailboxACL: (v: any) => parse("MailboxACL", v) as MailboxACL,
+	SharedMailbox: (v: any) => parse("SharedMailbox", v) as SharedMailbox,
 	RecipientSecurity: (v: any) => parse("RecipientSecurity", v) as RecipientSecurity,
 	Settings: (v: any) => parse("Settings", v) as Settings,
 	Ruleset: (v: any) => parse("Ruleset", v) as Ruleset,
@@ -665,10 +744,6 @@ export const parser = {
 	EventViewErr: (v: any) => parse("EventViewErr", v) as EventViewErr,
 	EventViewReset: (v: any) => parse("EventViewReset", v) as EventViewReset,
 	EventViewMsgs: (v: any) => parse("EventViewMsgs", v) as EventViewMsgs,
-	MessageItem: (v: any) => parse("MessageItem", v) as MessageItem,
-	Message: (v: any) => parse("Message", v) as Message,
-	MessageEnvelope: (v: any) => parse("MessageEnvelope", v) as MessageEnvelope,
-	Attachment: (v: any) => parse("Attachment", v) as Attachment,
 	EventViewChanges: (v: any) => parse("EventViewChanges", v) as EventViewChanges,
 	ChangeMsgAdd: (v: any) => parse("ChangeMsgAdd", v) as ChangeMsgAdd,
 	Flags: (v: any) => parse("Flags", v) as Flags,
@@ -689,9 +764,10 @@ export const parser = {
 	ThreadMode: (v: any) => parse("ThreadMode", v) as ThreadMode,
 	AttachmentType: (v: any) => parse("AttachmentType", v) as AttachmentType,
 	ViewMode: (v: any) => parse("ViewMode", v) as ViewMode,
+	CryptoKind: (v: any) => parse("CryptoKind", v) as CryptoKind,
+	Localpart: (v: any) => parse("Localpart", v) as Localpart,
 	SecurityResult: (v: any) => parse("SecurityResult", v) as SecurityResult,
 	Quoting: (v: any) => parse("Quoting", v) as Quoting,
-	Localpart: (v: any) => parse("Localpart", v) as Localpart,
 }
 
 let defaultOptions: ClientOptions = {slicesNullable: true, mapsNullable: true, nullableOptional: true}
@@ -741,6 +817,49 @@ export class Client {
 		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as CSRFToken
 	}
 
+	// LoginTOTP completes a login for which Login failed with error code
+	// "user:totpRequired", with a code from an authenticator app or a recovery code.
+	// Fails with error code "user:loginFailed" for a bad code.
+	async LoginTOTP(loginToken: string, code: string): Promise<CSRFToken> {
+		const fn: string = "LoginTOTP"
+		const paramTypes: string[][] = [["string"],["string"]]
+		const returnTypes: string[][] = [["CSRFToken"]]
+		const params: any[] = [loginToken, code]
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as CSRFToken
+	}
+
+	// LoginOIDCEnabled returns whether logging in through an OpenID Connect identity
+	// provider (single sign-on) is available.
+	async LoginOIDCEnabled(): Promise<boolean> {
+		const fn: string = "LoginOIDCEnabled"
+		const paramTypes: string[][] = []
+		const returnTypes: string[][] = [["bool"]]
+		const params: any[] = []
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as boolean
+	}
+
+	// LoginOIDCStart starts a login through the identity provider, returning the URL
+	// to navigate to. Call LoginPrep to get a loginToken. After logging in at the
+	// identity provider, the browser returns with an "oidc" query string parameter,
+	// which must be passed to LoginOIDC.
+	async LoginOIDCStart(loginToken: string): Promise<string> {
+		const fn: string = "LoginOIDCStart"
+		const paramTypes: string[][] = [["string"]]
+		const returnTypes: string[][] = [["string"]]
+		const params: any[] = [loginToken]
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as string
+	}
+
+	// LoginOIDC completes a login through the identity provider, returning a session
+	// token like Login, and the address the user logged in with.
+	async LoginOIDC(state: string): Promise<[CSRFToken, string]> {
+		const fn: string = "LoginOIDC"
+		const paramTypes: string[][] = [["string"]]
+		const returnTypes: string[][] = [["CSRFToken"],["string"]]
+		const params: any[] = [state]
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as [CSRFToken, string]
+	}
+
 	// Logout invalidates the session token.
 	async Logout(): Promise<void> {
 		const fn: string = "Logout"
@@ -822,11 +941,50 @@ export class Client {
 	// If a Sent mailbox is configured, messages are added to it after submitting
 	// to the delivery queue. If Bcc addresses were present, a header is prepended
 	// to the message stored in the Sent mailbox.
-	async MessageSubmit(m: SubmitMessage): Promise<void> {
+	// 
+	// The IDs of the messages added to the queue are returned, one for each
+	// recipient, e.g. for canceling with ScheduledCancel during an "undo send" grace
+	// period.
+	async MessageSubmit(m: SubmitMessage): Promise<number[] | null> {
 		const fn: string = "MessageSubmit"
 		const paramTypes: string[][] = [["SubmitMessage"]]
-		const returnTypes: string[][] = []
+		const returnTypes: string[][] = [["[]","int64"]]
 		const params: any[] = [m]
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as number[] | null
+	}
+
+	// ScheduledList returns the submitted messages of the account that are scheduled
+	// for later delivery, ordered by time of delivery.
+	async ScheduledList(): Promise<ScheduledMessage[] | null> {
+		const fn: string = "ScheduledList"
+		const paramTypes: string[][] = []
+		const returnTypes: string[][] = [["[]","ScheduledMessage"]]
+		const params: any[] = []
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as ScheduledMessage[] | null
+	}
+
+	// ScheduledCancel removes scheduled messages from the queue before their first
+	// delivery attempt, e.g. to undo sending. Either all messages are canceled, or
+	// none.
+	// 
+	// If the message was stored in the Sent mailbox and a Drafts mailbox is
+	// configured, the message is moved to the Drafts mailbox and returned, for
+	// continued editing. Otherwise, nil is returned.
+	async ScheduledCancel(queueMsgIDs: number[] | null): Promise<MessageItem | null> {
+		const fn: string = "ScheduledCancel"
+		const paramTypes: string[][] = [["[]","int64"]]
+		const returnTypes: string[][] = [["nullable","MessageItem"]]
+		const params: any[] = [queueMsgIDs]
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as MessageItem | null
+	}
+
+	// ScheduledReschedule changes the time of the first delivery attempt of
+	// scheduled messages.
+	async ScheduledReschedule(queueMsgIDs: number[] | null, sendAt: Date): Promise<void> {
+		const fn: string = "ScheduledReschedule"
+		const paramTypes: string[][] = [["[]","int64"],["timestamp"]]
+		const returnTypes: string[][] = []
+		const params: any[] = [queueMsgIDs, sendAt]
 		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as void
 	}
 
@@ -907,8 +1065,9 @@ export class Client {
 	}
 
 	// CompleteRecipient returns autocomplete matches for a recipient, returning the
-	// matches, most recently used first, and whether this is the full list and further
-	// requests for longer prefixes aren't necessary.
+	// matches, first from contacts in the address books, then from recipients of sent
+	// messages, most recently used first, and whether this is the full list and
+	// further requests for longer prefixes aren't necessary.
 	async CompleteRecipient(search: string): Promise<[string[] | null, boolean]> {
 		const fn: string = "CompleteRecipient"
 		const paramTypes: string[][] = [["string"]]
@@ -926,6 +1085,38 @@ export class Client {
 		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as void
 	}
 
+	// MailboxACL returns the access control list of a mailbox: the rights other
+	// accounts have been given on the mailbox.
+	async MailboxACL(mailboxID: number): Promise<MailboxACL[] | null> {
+		const fn: string = "MailboxACL"
+		const paramTypes: string[][] = [["int64"]]
+		const returnTypes: string[][] = [["[]","MailboxACL"]]
+		const params: any[] = [mailboxID]
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as MailboxACL[] | null
+	}
+
+	// MailboxACLSet sets the rights of another account, or "anyone" for all
+	// accounts, on a mailbox. Rights are letters as used in IMAP ACL, e.g. "lr" for
+	// read-only access. Empty rights remove the entry.
+	async MailboxACLSet(mailboxID: number, identifier: string, rights: string): Promise<void> {
+		const fn: string = "MailboxACLSet"
+		const paramTypes: string[][] = [["int64"],["string"],["string"]]
+		const returnTypes: string[][] = []
+		const params: any[] = [mailboxID, identifier, rights]
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as void
+	}
+
+	// SharedMailboxes returns the mailboxes of other accounts that this account has
+	// been given access to. They can be accessed through IMAP, in the "Other Users"
+	// and "Shared" namespaces.
+	async SharedMailboxes(): Promise<SharedMailbox[] | null> {
+		const fn: string = "SharedMailboxes"
+		const paramTypes: string[][] = []
+		const returnTypes: string[][] = [["[]","SharedMailbox"]]
+		const params: any[] = []
+		return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params) as SharedMailbox[] | null
+	}
+
 	// ThreadCollapse saves the ThreadCollapse field for the messages and its
 	// children. The messageIDs are typically thread roots. But not all roots
 	// (without parent) of a thread need to have the same collapsed state.
@@ -10,6 +10,7 @@ import (
 	"runtime/debug"
 	"slices"
 	"testing"
+	"time"
 
 	"github.com/mjl-/bstore"
 	"github.com/mjl-/sherpa"
@@ -222,6 +223,34 @@ func TestAPI(t *testing.T) {
 	tneedError(t, func() { api.MailboxRename(ctx, inbox.ID, "Binbox") })      // Inbox not allowed.
 	tneedError(t, func() { api.MailboxRename(ctx, testbox1.ID, "Archive") })  // Exists.
 
+	// MailboxACLSet, MailboxACL
+	api.MailboxACLSet(ctx, testbox1.ID, "other", "lrc")
+	api.MailboxACLSet(ctx, testbox1.ID, "anyone", "lr")
+	acls := api.MailboxACL(ctx, testbox1.ID)
+	tcompare(t, len(acls), 2)
+	tcompare(t, acls[1].Identifier, "other")
+	tcompare(t, acls[1].Rights, "lrkx")
+	api.MailboxACLSet(ctx, testbox1.ID, "anyone", "")
+	tcompare(t, len(api.MailboxACL(ctx, testbox1.ID)), 1)
+	tneedError(t, func() { api.MailboxACLSet(ctx, testbox1.ID, "bogus", "lr") }) // No such account.
+	tneedError(t, func() { api.MailboxACLSet(ctx, testbox1.ID, "mjl", "lr") })   // Owner.
+	tneedError(t, func() { api.MailboxACLSet(ctx, testbox1.ID, "other", "lz") }) // Bad right.
+	tneedError(t, func() { api.MailboxACLSet(ctx, 0, "other", "lr") })
+	tneedError(t, func() { api.MailboxACL(ctx, 0) })
+
+	// SharedMailboxes
+	otherReqInfo := requestInfo{log, "other@mox.example", nil, "", nil, &http.Request{RemoteAddr: "127.0.0.1:1234"}}
+	otherReqInfo.Account, err = store.OpenAccount(log, "other")
+	tcheck(t, err, "open account")
+	defer otherReqInfo.Account.Close()
+	otherctx := context.WithValue(ctxbg, requestInfoCtxKey, otherReqInfo)
+	shared := api.SharedMailboxes(otherctx)
+	tcompare(t, len(shared), 1)
+	tcompare(t, shared[0].Account, "mjl")
+	tcompare(t, shared[0].Mailbox.Name, "Testbox1")
+	tcompare(t, len(api.SharedMailboxes(ctx)), 0)
+	api.MailboxACLSet(ctx, testbox1.ID, "other", "")
+
 	// ParsedMessage
 	// todo: verify contents
 	api.ParsedMessage(ctx, inboxMinimal.ID)
@@ -390,6 +419,40 @@ func TestAPI(t *testing.T) {
 		TextBody: fmt.Sprintf("%80s", "tést"),
 	})
 
+	// Signed and encrypted messages.
+	testCrypto(t, ctx, api, acc, sent)
+
+	// Send with undo period, then reschedule and cancel, moving the message to drafts.
+	tneedError(t, func() {
+		api.MessageSubmit(ctx, SubmitMessage{From: "mjl@mox.example", To: []string{"mjl+to@mox.example"}, TextBody: "test", UndoSendSeconds: 3600})
+	})
+	qids := api.MessageSubmit(ctx, SubmitMessage{
+		From:            "mjl@mox.example",
+		To:              []string{"mjl+to@mox.example", "mjl+to2@mox.example"},
+		Subject:         "undo",
+		TextBody:        "test",
+		UndoSendSeconds: 30,
+	})
+	tcompare(t, len(qids), 2)
+	scheduled := api.ScheduledList(ctx)
+	tcompare(t, len(scheduled), 1)
+	tcompare(t, scheduled[0].QueueMsgIDs, qids)
+	tcompare(t, scheduled[0].Subject, "undo")
+	tcompare(t, scheduled[0].UndoSend, true)
+	sendAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	api.ScheduledReschedule(ctx, qids, sendAt)
+	tneedError(t, func() { api.ScheduledReschedule(ctx, qids, time.Now().Add(-time.Minute)) })
+	scheduled = api.ScheduledList(ctx)
+	tcompare(t, scheduled[0].UndoSend, false)
+	tcompare(t, scheduled[0].SendAt.Equal(sendAt), true)
+	api.MailboxSetSpecialUse(ctx, store.Mailbox{ID: drafts.ID, SpecialUse: store.SpecialUse{Draft: true}})
+	draft := api.ScheduledCancel(ctx, qids)
+	if draft == nil || draft.Message.MailboxID != drafts.ID || !draft.Message.Draft || draft.Envelope.Subject != "undo" {
+		t.Fatalf("unexpected draft after cancel %#v", draft)
+	}
+	tcompare(t, len(api.ScheduledList(ctx)), 0)
+	tneedError(t, func() { api.ScheduledCancel(ctx, qids) })
+
 	// Send without special-use Sent mailbox.
 	api.MailboxSetSpecialUse(ctx, store.Mailbox{ID: sent.ID, SpecialUse: store.SpecialUse{}})
 	api.MessageSubmit(ctx, SubmitMessage{
@@ -465,6 +528,18 @@ func TestAPI(t *testing.T) {
 	tcompare(t, l, []string{"mjl cc2 <mjl+cc2@mox.example>", "mjl bcc2 <mjl+bcc2@mox.example>"})
 	tcompare(t, full, true)
 
+	// Contacts from address books are completed first, and not repeated.
+	err = acc.DB.Write(ctx, func(tx *bstore.Tx) error {
+		abs, err := store.AddressBookList(tx, acc)
+		tcheck(t, err, "address books")
+		_, _, err = store.ContactPut(tx, acc, &abs[0], "c1.vcf", "BEGIN:VCARD\r\nVERSION:4.0\r\nUID:c1\r\nFN:Contact cc2\r\nEMAIL:mjl+bcc2@mox.example\r\nEND:VCARD\r\n")
+		return err
+	})
+	tcheck(t, err, "add contact")
+	l, full = api.CompleteRecipient(ctx, "cc2")
+	tcompare(t, l, []string{"Contact cc2 <mjl+bcc2@mox.example>", "mjl cc2 <mjl+cc2@mox.example>"})
+	tcompare(t, full, true)
+
 	// RecipientSecurity
 	resolver := dns.MockResolver{}
 	rs, err := recipientSecurity(ctx, log, resolver, "mjl@a.mox.example")
@@ -0,0 +1,512 @@
+package webmail
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/textproto"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/message"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/moxio"
+	"github.com/mjl-/mox/pgpmime"
+	"github.com/mjl-/mox/smime"
+	"github.com/mjl-/mox/smtp"
+	"github.com/mjl-/mox/store"
+)
+
+// MessageCrypto is the result of decrypting an S/MIME or OpenPGP message, and
+// verifying its signature.
+type MessageCrypto struct {
+	Kind store.CryptoKind
+
+	Encrypted    bool
+	Decrypted    bool
+	DecryptError string // If Encrypted but not Decrypted.
+
+	Signed            bool
+	SignatureValid    bool
+	SignatureError    string   // If Signed but not SignatureValid, e.g. for an unknown signer.
+	SignerAddresses   []string // If SignatureValid, addresses of the certificate or key.
+	SignerFingerprint string   // If SignatureValid.
+	SignerMatchesFrom bool     // If SignatureValid and the From address is one of SignerAddresses.
+
+	// If SignatureValid, whether the signer is trusted. For S/MIME, when the
+	// certificate chain verifies against the trusted CAs of the system. For both
+	// S/MIME and OpenPGP, when the key is one of our own or was imported. Keys
+	// learned from messages, e.g. through Autocrypt headers, are not trusted.
+	SignerTrusted bool
+}
+
+type smimeKey struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+// cryptoKeys holds the keys of an account for decrypting messages and verifying
+// signatures.
+type cryptoKeys struct {
+	smime   []smimeKey
+	openpgp []*pgpmime.Key  // Our private keys, and public keys of correspondents.
+	trusted map[string]bool // Fingerprints of our own and imported keys.
+}
+
+func loadCryptoKeys(log mlog.Log, tx *bstore.Tx) (*cryptoKeys, error) {
+	keys := &cryptoKeys{trusted: map[string]bool{}}
+
+	kl, err := store.CryptoKeyList(tx)
+	if err != nil {
+		return nil, fmt.Errorf("listing keys: %v", err)
+	}
+	for _, k := range kl {
+		switch k.Kind {
+		case store.CryptoSMIME:
+			key, certs, err := k.SMIME()
+			if err != nil {
+				log.Errorx("parsing s/mime key", err, slog.Int64("id", k.ID))
+				continue
+			}
+			keys.smime = append(keys.smime, smimeKey{certs[0], key})
+		case store.CryptoOpenPGP:
+			e, err := k.OpenPGP()
+			if err != nil {
+				log.Errorx("parsing openpgp key", err, slog.Int64("id", k.ID))
+				continue
+			}
+			keys.openpgp = append(keys.openpgp, e)
+		}
+		keys.trusted[k.Fingerprint] = true
+	}
+
+	pkl, err := store.PeerKeyList(tx)
+	if err != nil {
+		return nil, fmt.Errorf("listing peer keys: %v", err)
+	}
+	// A key with multiple addresses is stored multiple times.
+	seen := map[string]bool{}
+	for _, pk := range pkl {
+		if pk.Source == store.PeerKeySourceImport {
+			keys.trusted[pk.Fingerprint] = true
+		}
+		if pk.Kind != store.CryptoOpenPGP || seen[pk.Fingerprint] {
+			continue
+		}
+		seen[pk.Fingerprint] = true
+		e, err := pk.OpenPGP()
+		if err != nil {
+			log.Errorx("parsing openpgp peer key", err, slog.Int64("id", pk.ID))
+			continue
+		}
+		keys.openpgp = append(keys.openpgp, e)
+	}
+	return keys, nil
+}
+
+// isCryptoPart returns whether the top-level part is signed or encrypted with
+// S/MIME or OpenPGP.
+func isCryptoPart(p *message.Part) bool {
+	switch p.MediaType + "/" + p.MediaSubType {
+	case "MULTIPART/SIGNED", "MULTIPART/ENCRYPTED", "APPLICATION/PKCS7-MIME", "APPLICATION/X-PKCS7-MIME":
+		return true
+	}
+	return false
+}
+
+// ensureCrypto decrypts ms.part and verifies its signature if it is encrypted or
+// signed with S/MIME or OpenPGP, setting ms.crypto. If the message was decrypted,
+// ms.part is replaced with the decrypted part, with the envelope of the original
+// message. Keys are loaded through ms.keysTx. Public keys of the sender, from an
+// Autocrypt header or the certificate of a valid S/MIME signature, are set in
+// ms.peerKeys, for storing by the caller.
+func (ms *msgState) ensureCrypto(log mlog.Log) error {
+	if ms.cryptoChecked {
+		return nil
+	}
+	ms.cryptoChecked = true
+
+	p := ms.part
+	var from string
+	if p.Envelope != nil && len(p.Envelope.From) == 1 {
+		a := p.Envelope.From[0]
+		from = strings.ToLower(a.User + "@" + a.Host)
+	}
+
+	// Learn OpenPGP key of the sender from an Autocrypt header. Messages with
+	// multiple Autocrypt headers must be ignored.
+	// https://autocrypt.org/level1.html#the-autocrypt-header
+	if p.BodyOffset > 0 && from != "" {
+		h, err := p.Header()
+		if err != nil {
+			return fmt.Errorf("parsing headers: %v", err)
+		}
+		if l := h.Values("Autocrypt"); len(l) == 1 {
+			ms.peerKeys = append(ms.peerKeys, autocryptPeerKeys(log, l[0], from, ms.m.Received)...)
+		}
+	}
+
+	if !isCryptoPart(p) {
+		return nil
+	}
+
+	keys, err := loadCryptoKeys(log, ms.keysTx)
+	if err != nil {
+		return err
+	}
+	cc := cryptoCheck{log: log, keys: keys}
+	np := cc.check(p, false)
+	if np != nil {
+		np.Envelope = p.Envelope
+		ms.part = np
+	}
+	mc := cc.mc
+	if mc.SignatureValid {
+		mc.SignerMatchesFrom = slices.Contains(mc.SignerAddresses, from)
+	}
+	if cc.signerCert != nil && mc.SignerMatchesFrom {
+		ms.peerKeys = append(ms.peerKeys, store.PeerKeysFromCertificate(cc.signerCert, store.PeerKeySourceSignature, ms.m.Received)...)
+	}
+	ms.crypto = &mc
+	return nil
+}
+
+// autocryptPeerKeys parses an Autocrypt header value, returning a peer key if it
+// is valid and for the from address.
+func autocryptPeerKeys(log mlog.Log, value, from string, msgTime time.Time) []store.PeerKey {
+	a, err := pgpmime.ParseAutocrypt(value)
+	if err != nil {
+		log.Debugx("parsing autocrypt header", err)
+		return nil
+	}
+	if !strings.EqualFold(a.Addr, from) {
+		log.Debug("autocrypt header for address other than from, ignoring", slog.String("addr", a.Addr), slog.String("from", from))
+		return nil
+	}
+	el, err := pgpmime.ReadKeys(a.KeyData)
+	if err != nil || len(el) != 1 {
+		log.Debugx("parsing key from autocrypt header", err, slog.Int("nkeys", len(el)))
+		return nil
+	}
+	l, err := store.PeerKeysFromOpenPGP(el[0], store.PeerKeySourceAutocrypt, msgTime)
+	if err != nil {
+		log.Debugx("peer keys from autocrypt header", err)
+		return nil
+	}
+	for _, pk := range l {
+		if pk.Address == strings.ToLower(a.Addr) {
+			pk.PreferEncrypt = a.PreferEncrypt
+			return []store.PeerKey{pk}
+		}
+	}
+	return nil
+}
+
+type cryptoCheck struct {
+	log        mlog.Log
+	keys       *cryptoKeys
+	mc         MessageCrypto
+	signerCert *x509.Certificate // Of valid S/MIME signature.
+}
+
+// check decrypts and/or verifies p. If p was decrypted, the parsed decrypted part
+// is returned. A decrypted part is checked again, for a signature, but not
+// decrypted again.
+func (cc *cryptoCheck) check(p *message.Part, decrypted bool) *message.Part {
+	mt := p.MediaType + "/" + p.MediaSubType
+	switch {
+	case mt == "MULTIPART/SIGNED" && len(p.Parts) == 2:
+		// ../rfc/1847
+		protocol := strings.ToLower(p.ContentTypeParams["protocol"])
+		var kind store.CryptoKind
+		switch protocol {
+		case "application/pkcs7-signature", "application/x-pkcs7-signature":
+			kind = store.CryptoSMIME
+		case "application/pgp-signature":
+			kind = store.CryptoOpenPGP
+		default:
+			return nil
+		}
+		if cc.mc.Kind == "" {
+			cc.mc.Kind = kind
+		}
+		cc.mc.Signed = true
+
+		// The signature is over the exact bytes of the first part, headers included.
+		sp := &p.Parts[0]
+		content, err := io.ReadAll(io.MultiReader(sp.HeaderReader(), sp.RawReader()))
+		if err != nil {
+			cc.mc.SignatureError = fmt.Sprintf("reading signed content: %v", err)
+			return nil
+		}
+		sig, err := io.ReadAll(p.Parts[1].Reader())
+		if err != nil {
+			cc.mc.SignatureError = fmt.Sprintf("reading signature: %v", err)
+			return nil
+		}
+		if kind == store.CryptoSMIME {
+			cc.verifySMIME(content, sig)
+		} else {
+			signer, err := pgpmime.Verify(cc.keys.openpgp, content, sig)
+			cc.openpgpSigner(signer, err)
+		}
+		return nil
+
+	case mt == "MULTIPART/ENCRYPTED" && len(p.Parts) == 2 && !decrypted:
+		// ../rfc/3156
+		if !strings.EqualFold(p.ContentTypeParams["protocol"], "application/pgp-encrypted") {
+			return nil
+		}
+		cc.mc.Kind = store.CryptoOpenPGP
+		cc.mc.Encrypted = true
+		data, err := io.ReadAll(p.Parts[1].Reader())
+		if err != nil {
+			cc.mc.DecryptError = fmt.Sprintf("reading encrypted data: %v", err)
+			return nil
+		}
+		d, err := pgpmime.Decrypt(cc.keys.openpgp, data)
+		if err != nil {
+			cc.mc.DecryptError = err.Error()
+			return nil
+		}
+		np, err := cc.parseDecrypted(d.Content)
+		if err != nil {
+			return nil
+		}
+		// Signed and encrypted at once, ../rfc/3156:622
+		if d.Signed {
+			cc.mc.Signed = true
+			cc.openpgpSigner(d.Signer, d.SignatureError)
+		} else {
+			cc.check(np, true)
+		}
+		return np
+
+	case (mt == "APPLICATION/PKCS7-MIME" || mt == "APPLICATION/X-PKCS7-MIME") && !decrypted:
+		// ../rfc/8551
+		cc.mc.Kind = store.CryptoSMIME
+		if strings.EqualFold(p.ContentTypeParams["smime-type"], "signed-data") {
+			cc.mc.Signed = true
+			cc.mc.SignatureError = "opaque signed messages not supported"
+			return nil
+		}
+		cc.mc.Encrypted = true
+		data, err := io.ReadAll(p.Reader())
+		if err != nil {
+			cc.mc.DecryptError = fmt.Sprintf("reading encrypted data: %v", err)
+			return nil
+		}
+		var content []byte
+		err = smime.ErrNoRecipient
+		for _, k := range cc.keys.smime {
+			content, err = smime.Decrypt(data, k.cert, k.key)
+			if !errors.Is(err, smime.ErrNoRecipient) {
+				break
+			}
+		}
+		if err != nil {
+			cc.mc.DecryptError = err.Error()
+			return nil
+		}
+		np, err := cc.parseDecrypted(content)
+		if err != nil {
+			return nil
+		}
+		cc.check(np, true)
+		return np
+	}
+	return nil
+}
+
+func (cc *cryptoCheck) parseDecrypted(content []byte) (*message.Part, error) {
+	p, err := message.Parse(cc.log.Logger, false, bytes.NewReader(content))
+	if err == nil {
+		err = p.Walk(cc.log.Logger, nil)
+	}
+	if err != nil {
+		cc.mc.DecryptError = fmt.Sprintf("parsing decrypted message: %v", err)
+		return nil, err
+	}
+	cc.mc.Decrypted = true
+	return &p, nil
+}
+
+func (cc *cryptoCheck) verifySMIME(content, sig []byte) {
+	signer, certs, err := smime.Verify(sig, content)
+	if err != nil {
+		cc.mc.SignatureError = err.Error()
+		return
+	}
+	cc.signerCert = signer
+	cc.mc.SignatureValid = true
+	cc.mc.SignerAddresses = smime.Addresses(signer)
+	cc.mc.SignerFingerprint = store.CertificateFingerprint(signer)
+	err = smime.VerifyChain(signer, certs, time.Now())
+	cc.log.Debugx("verifying s/mime certificate chain", err)
+	cc.mc.SignerTrusted = err == nil || cc.keys.trusted[cc.mc.SignerFingerprint]
+}
+
+func (cc *cryptoCheck) openpgpSigner(signer *pgpmime.Key, err error) {
+	if err != nil {
+		cc.mc.SignatureError = err.Error()
+		return
+	}
+	cc.mc.SignatureValid = true
+	cc.mc.SignerAddresses = signer.Addresses()
+	cc.mc.SignerFingerprint = signer.Fingerprint()
+	cc.mc.SignerTrusted = cc.keys.trusted[cc.mc.SignerFingerprint]
+}
+
+// submitKeys are the keys for signing and encrypting a message being submitted.
+type submitKeys struct {
+	key       *store.CryptoKey // For signing, and for encrypting to ourselves.
+	peers     []store.PeerKey  // For encrypting to recipients.
+	autocrypt *store.CryptoKey // OpenPGP key for From address for an Autocrypt header, if any.
+}
+
+// xsubmitKeys checks the signing and encryption options of a message being
+// submitted, and loads the keys needed.
+func xsubmitKeys(ctx context.Context, tx *bstore.Tx, m SubmitMessage, from smtp.Address, recipients []smtp.Address) submitKeys {
+	var sk submitKeys
+	var err error
+	sk.autocrypt, err = store.CryptoKeyFind(tx, store.CryptoOpenPGP, from.String())
+	xcheckf(ctx, err, "looking up key for from address")
+
+	switch m.Crypto {
+	case "":
+		if m.Sign || m.Encrypt {
+			xcheckuserf(ctx, errors.New("signing or encrypting requires s/mime or openpgp"), "checking crypto options")
+		}
+		return sk
+	case store.CryptoSMIME, store.CryptoOpenPGP:
+	default:
+		xcheckuserf(ctx, fmt.Errorf("unknown crypto %q", m.Crypto), "checking crypto options")
+	}
+	if !m.Sign && !m.Encrypt {
+		xcheckuserf(ctx, errors.New("crypto set without signing or encrypting"), "checking crypto options")
+	}
+	sk.key, err = store.CryptoKeyFind(tx, m.Crypto, from.String())
+	xcheckf(ctx, err, "looking up key for from address")
+	if sk.key == nil {
+		xcheckuserf(ctx, fmt.Errorf("no %s key for from address %s", m.Crypto, from), "looking up key")
+	}
+	if !m.Encrypt {
+		return sk
+	}
+	for _, rcpt := range recipients {
+		pk, err := store.PeerKeyGet(tx, m.Crypto, rcpt.String())
+		xcheckf(ctx, err, "looking up key for recipient")
+		if pk == nil {
+			xcheckuserf(ctx, fmt.Errorf("no %s key for recipient %s", m.Crypto, rcpt), "looking up key")
+		}
+		sk.peers = append(sk.peers, *pk)
+	}
+	return sk
+}
+
+// xcryptoCompose writes the MIME headers and body of a signed and/or encrypted
+// message to xc. Content is the MIME entity, headers and body, to sign and/or
+// encrypt.
+func xcryptoCompose(ctx context.Context, xc *message.Composer, m SubmitMessage, sk submitKeys, content []byte) {
+	now := time.Now()
+
+	base64Lines := func(data []byte) []byte {
+		var b bytes.Buffer
+		wc := moxio.Base64Writer(&b)
+		_, err := wc.Write(data)
+		xcheckf(ctx, err, "base64-encoding")
+		err = wc.Close()
+		xcheckf(ctx, err, "base64-encoding")
+		return b.Bytes()
+	}
+
+	switch m.Crypto {
+	case store.CryptoSMIME:
+		// ../rfc/8551
+		key, certs, err := sk.key.SMIME()
+		xcheckf(ctx, err, "parsing s/mime key")
+
+		if m.Sign {
+			sig, err := smime.Sign(key, certs, content, now)
+			xcheckf(ctx, err, "signing message")
+			sigHdr := textproto.MIMEHeader{
+				"Content-Type":              {mime.FormatMediaType("application/pkcs7-signature", map[string]string{"name": "smime.p7s"})},
+				"Content-Transfer-Encoding": {"base64"},
+				"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": "smime.p7s"})},
+			}
+			if !m.Encrypt {
+				xc.MultipartSigned("application/pkcs7-signature", "sha-256", content, sigHdr, base64Lines(sig))
+				return
+			}
+			var b bytes.Buffer
+			sc := message.NewComposer(&b, 0, xc.SMTPUTF8)
+			sc.MultipartSigned("application/pkcs7-signature", "sha-256", content, sigHdr, base64Lines(sig))
+			sc.Flush()
+			content = b.Bytes()
+		}
+
+		rcpts := []*x509.Certificate{certs[0]}
+		for _, pk := range sk.peers {
+			cert, err := pk.Certificate()
+			xcheckf(ctx, err, "parsing certificate for %s", pk.Address)
+			rcpts = append(rcpts, cert)
+		}
+		encrypted, err := smime.Encrypt(rcpts, content)
+		xcheckf(ctx, err, "encrypting message")
+		xc.Header("Content-Type", mime.FormatMediaType("application/pkcs7-mime", map[string]string{"smime-type": "enveloped-data", "name": "smime.p7m"}))
+		xc.Header("Content-Transfer-Encoding", "base64")
+		xc.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": "smime.p7m"}))
+		xc.Line()
+		xc.Write(base64Lines(encrypted))
+
+	case store.CryptoOpenPGP:
+		// ../rfc/3156
+		e, err := sk.key.OpenPGP()
+		xcheckf(ctx, err, "parsing openpgp key")
+
+		if !m.Encrypt {
+			sig, err := pgpmime.Sign(e, content, now)
+			xcheckf(ctx, err, "signing message")
+			sigHdr := textproto.MIMEHeader{
+				"Content-Type":        {mime.FormatMediaType("application/pgp-signature", map[string]string{"name": "signature.asc"})},
+				"Content-Description": {"OpenPGP digital signature"},
+				"Content-Disposition": {mime.FormatMediaType("attachment", map[string]string{"filename": "signature.asc"})},
+			}
+			xc.MultipartSigned("application/pgp-signature", pgpmime.Micalg, content, sigHdr, sig)
+			return
+		}
+
+		rcpts := []*pgpmime.Key{e}
+		for _, pk := range sk.peers {
+			pe, err := pk.OpenPGP()
+			xcheckf(ctx, err, "parsing openpgp key for %s", pk.Address)
+			rcpts = append(rcpts, pe)
+		}
+		var signer *pgpmime.Key
+		if m.Sign {
+			signer = e
+		}
+		encrypted, err := pgpmime.Encrypt(rcpts, signer, content, now)
+		xcheckf(ctx, err, "encrypting message")
+		xc.MultipartEncrypted("application/pgp-encrypted", []byte("Version: 1\r\n"), encrypted)
+	}
+}
+
+// xautocryptHeader returns the value for an Autocrypt header with the public key
+// of sk.autocrypt.
+func xautocryptHeader(ctx context.Context, sk submitKeys, from smtp.Address) string {
+	e, err := sk.autocrypt.OpenPGP()
+	xcheckf(ctx, err, "parsing openpgp key")
+	pub, err := e.SerializePublic()
+	xcheckf(ctx, err, "serializing public key")
+	return pgpmime.Autocrypt{Addr: from.String(), KeyData: pub}.HeaderValue()
+}
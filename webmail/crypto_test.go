@@ -0,0 +1,155 @@
+package webmail
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/pgpmime"
+	"github.com/mjl-/mox/store"
+)
+
+// testCrypto submits signed and/or encrypted messages, and checks they are
+// decrypted and verified when parsing the copy in the Sent mailbox. Called from
+// TestAPI.
+func testCrypto(t *testing.T, ctx context.Context, api Webmail, acc *store.Account, sent store.Mailbox) {
+	submit := func(kind store.CryptoKind, sign, encrypt bool) {
+		t.Helper()
+		api.MessageSubmit(ctx, SubmitMessage{
+			From:     "mjl@mox.example",
+			To:       []string{"mjl+to@mox.example"},
+			Subject:  "crypto",
+			TextBody: "tést crypto\n",
+			Crypto:   kind,
+			Sign:     sign,
+			Encrypt:  encrypt,
+		})
+	}
+
+	// No keys yet.
+	tneedError(t, func() { submit(store.CryptoOpenPGP, true, false) })
+	tneedError(t, func() { submit(store.CryptoSMIME, true, false) })
+	// Bad options.
+	tneedError(t, func() { submit("", true, false) })
+	tneedError(t, func() { submit(store.CryptoOpenPGP, false, false) })
+	tneedError(t, func() { submit("bogus", true, false) })
+
+	// Small keys to keep the test fast.
+	newCert := func(key *rsa.PrivateKey, address string) []byte {
+		t.Helper()
+		template := &x509.Certificate{
+			SerialNumber:   big.NewInt(1),
+			Subject:        pkix.Name{CommonName: address},
+			NotBefore:      time.Now().Add(-time.Hour),
+			NotAfter:       time.Now().Add(time.Hour),
+			EmailAddresses: []string{address},
+			KeyUsage:       x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+			ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+		}
+		buf, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+		tcheck(t, err, "create certificate")
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: buf})
+	}
+	smimeKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	tcheck(t, err, "generate key")
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(smimeKey)
+	tcheck(t, err, "marshal key")
+	smimePEM := append(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}), newCert(smimeKey, "mjl@mox.example")...)
+	smimePeerKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	tcheck(t, err, "generate key")
+
+	pgpKey, err := pgpmime.GenerateKey("mjl", "mjl@mox.example", 1024, time.Now())
+	tcheck(t, err, "generate key")
+	pgpPriv, err := pgpKey.SerializePrivate()
+	tcheck(t, err, "serialize key")
+	pgpPeerKey, err := pgpmime.GenerateKey("", "mjl+to@mox.example", 1024, time.Now())
+	tcheck(t, err, "generate key")
+	pgpPeerPub, err := pgpPeerKey.SerializePublic()
+	tcheck(t, err, "serialize key")
+
+	err = acc.DB.Write(ctx, func(tx *bstore.Tx) error {
+		_, err := store.CryptoKeyImport(tx, store.CryptoSMIME, smimePEM, "")
+		tcheck(t, err, "import s/mime key")
+		_, err = store.CryptoKeyImport(tx, store.CryptoOpenPGP, pgpPriv, "")
+		tcheck(t, err, "import openpgp key")
+		return nil
+	})
+	tcheck(t, err, "import keys")
+
+	// No key for recipient yet.
+	tneedError(t, func() { submit(store.CryptoOpenPGP, false, true) })
+	tneedError(t, func() { submit(store.CryptoSMIME, false, true) })
+
+	err = acc.DB.Write(ctx, func(tx *bstore.Tx) error {
+		_, err := store.PeerKeyImport(tx, store.CryptoSMIME, newCert(smimePeerKey, "mjl+to@mox.example"))
+		tcheck(t, err, "import s/mime peer key")
+		_, err = store.PeerKeyImport(tx, store.CryptoOpenPGP, pgpPeerPub)
+		tcheck(t, err, "import openpgp peer key")
+		return nil
+	})
+	tcheck(t, err, "import peer keys")
+
+	lastSent := func() ParsedMessage {
+		t.Helper()
+		m, err := bstore.QueryDB[store.Message](ctx, acc.DB).FilterNonzero(store.Message{MailboxID: sent.ID}).SortDesc("ID").Limit(1).Get()
+		tcheck(t, err, "get sent message")
+		return api.ParsedMessage(ctx, m.ID)
+	}
+
+	for _, kind := range []store.CryptoKind{store.CryptoSMIME, store.CryptoOpenPGP} {
+		for _, opts := range [][2]bool{{true, false}, {false, true}, {true, true}} {
+			sign, encrypt := opts[0], opts[1]
+			submit(kind, sign, encrypt)
+			pm := lastSent()
+			mc := pm.Crypto
+			if mc == nil {
+				t.Fatalf("%s sign %v encrypt %v: no crypto result", kind, sign, encrypt)
+			}
+			tcompare(t, mc.Kind, kind)
+			tcompare(t, mc.Encrypted, encrypt)
+			tcompare(t, mc.Decrypted, encrypt)
+			tcompare(t, mc.DecryptError, "")
+			tcompare(t, mc.Signed, sign)
+			tcompare(t, mc.SignatureValid, sign)
+			tcompare(t, mc.SignatureError, "")
+			tcompare(t, mc.SignerMatchesFrom, sign)
+			tcompare(t, mc.SignerTrusted, sign) // Our own key.
+			if len(pm.Texts) != 1 || pm.Texts[0] != "tést crypto\r\n" {
+				t.Fatalf("%s sign %v encrypt %v: unexpected texts %q", kind, sign, encrypt, pm.Texts)
+			}
+			if _, ok := pm.Headers["Autocrypt"]; ok != (kind == store.CryptoOpenPGP) {
+				t.Fatalf("%s: unexpected presence of autocrypt header: %v", kind, ok)
+			}
+		}
+	}
+
+	// Without our private key, the message cannot be decrypted. Our own keys are not
+	// stored as peer keys, neither from our Autocrypt headers nor our signatures.
+	err = acc.DB.Write(ctx, func(tx *bstore.Tx) error {
+		pkl, err := store.PeerKeyList(tx)
+		tcheck(t, err, "list peer keys")
+		tcompare(t, len(pkl), 2)
+		kl, err := store.CryptoKeyList(tx)
+		tcheck(t, err, "list keys")
+		for _, k := range kl {
+			err := store.CryptoKeyRemove(tx, k.ID)
+			tcheck(t, err, "remove key")
+		}
+		return nil
+	})
+	tcheck(t, err, "remove keys")
+	pm := lastSent()
+	if pm.Crypto == nil || pm.Crypto.Decrypted || !strings.Contains(pm.Crypto.DecryptError, "not encrypted for key") {
+		t.Fatalf("unexpected crypto result without key: %#v", pm.Crypto)
+	}
+	tcompare(t, pm.Part.MediaSubType, "ENCRYPTED")
+}
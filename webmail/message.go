@@ -239,6 +239,15 @@ func parsedMessage(log mlog.Log, m store.Message, state *msgState, full, msgitem
 		pm.Headers = map[string][]string{}
 	}
 
+	if full && (state.keysTx != nil || state.cryptoChecked) {
+		if err := state.ensureCrypto(log); err != nil {
+			return ParsedMessage{}, fmt.Errorf("checking signature and encryption: %v", err)
+		}
+		pm.Part = *state.part
+		pm.Crypto = state.crypto
+		pm.peerKeys = state.peerKeys
+	}
+
 	pm.Texts = []string{}
 	pm.attachments = []Attachment{}
 
@@ -299,7 +308,7 @@ func parsedMessage(log mlog.Log, m store.Message, state *msgState, full, msgitem
 			if parent == nil && mt == "MULTIPART/SIGNED" {
 				pm.isSigned = true
 			}
-			if parent == nil && mt == "MULTIPART/ENCRYPTED" {
+			if parent == nil && (mt == "MULTIPART/ENCRYPTED" || (mt == "APPLICATION/PKCS7-MIME" || mt == "APPLICATION/X-PKCS7-MIME") && !strings.EqualFold(p.ContentTypeParams["smime-type"], "signed-data")) {
 				pm.isEncrypted = true
 			}
 			// todo: possibly do not include anything below multipart/alternative that starts with text/html, they may be cids. perhaps have a separate list of attachments for the text vs html version?
@@ -354,6 +363,10 @@ func parsedMessage(log mlog.Log, m store.Message, state *msgState, full, msgitem
 		}
 	}
 	usePart(*state.part, -1, nil, []int{})
+	if state.crypto != nil {
+		pm.isSigned = pm.isSigned || state.crypto.Signed
+		pm.isEncrypted = pm.isEncrypted || state.crypto.Encrypted
+	}
 
 	if rerr == nil {
 		pm.ID = m.ID
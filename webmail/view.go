@@ -197,12 +197,17 @@ type ParsedMessage struct {
 
 	ListReplyAddress *MessageAddress // From List-Post.
 
+	// For messages signed or encrypted with S/MIME or OpenPGP. If the message was
+	// decrypted, Part is the decrypted message.
+	Crypto *MessageCrypto
+
 	// Information used by MessageItem, not exported in this type.
 	envelope    MessageEnvelope
 	attachments []Attachment
 	isSigned    bool
 	isEncrypted bool
 	firstLine   string
+	peerKeys    []store.PeerKey // Keys of sender learned from message, to store.
 }
 
 // EventStart is the first message sent on an SSE connection, giving the client
@@ -1207,7 +1212,7 @@ func (v view) matches(log mlog.Log, acc *store.Account, checkRange bool, message
 		return false, rerr
 	}
 
-	wordsFilter := q.wordsFilterFn(log, &state)
+	wordsFilter := q.wordsFilterFn(log, nil, &state)
 	if wordsFilter != nil && (!ensureMessage() || !wordsFilter(m)) {
 		return false, rerr
 	}
@@ -1415,7 +1420,7 @@ func queryMessages(ctx context.Context, log mlog.Log, acc *store.Account, tx *bs
 	// implement reporting errors, or anything else, just a bool. So when making the
 	// filter functions, we give them a place to store parsed message state, and an
 	// error. We check the error during and after query execution.
-	state := msgState{acc: acc}
+	state := msgState{acc: acc, keysTx: tx}
 	defer state.clear()
 
 	flagfilter := query.flagFilterFn()
@@ -1454,7 +1459,7 @@ func queryMessages(ctx context.Context, log mlog.Log, acc *store.Account, tx *bs
 		q.FilterFn(headerFilter)
 	}
 
-	wordsFilter := query.wordsFilterFn(log, &state)
+	wordsFilter := query.wordsFilterFn(log, tx, &state)
 	if wordsFilter != nil {
 		q.FilterFn(wordsFilter)
 	}
@@ -1594,7 +1599,7 @@ func gatherThread(log mlog.Log, tx *bstore.Tx, acc *store.Account, v view, m sto
 	var firstUnread bool
 	for _, tm := range tml {
 		err := func() error {
-			xstate := msgState{acc: acc}
+			xstate := msgState{acc: acc, keysTx: tx}
 			defer xstate.clear()
 
 			mi, err := messageItem(log, tm, &xstate)
@@ -1627,7 +1632,7 @@ func gatherThread(log mlog.Log, tx *bstore.Tx, acc *store.Account, v view, m sto
 	// Finally, the message that caused us to gather this thread (which is likely the
 	// most recent message in the thread) could be the only unread message.
 	if destMessageID == 0 && first && !m.Seen && !firstUnread {
-		xstate := msgState{acc: acc}
+		xstate := msgState{acc: acc, keysTx: tx}
 		defer xstate.clear()
 		xpm, err := parsedMessage(log, m, &xstate, true, false)
 		if err != nil {
@@ -1650,6 +1655,13 @@ type msgState struct {
 	m    store.Message
 	part *message.Part // Will be without Reader when msgr is nil.
 	msgr *store.MsgReader
+
+	// If set, full parses of signed or encrypted messages load keys through keysTx
+	// to verify and decrypt the message, see ensureCrypto.
+	keysTx        *bstore.Tx
+	cryptoChecked bool
+	crypto        *MessageCrypto
+	peerKeys      []store.PeerKey
 }
 
 func (ms *msgState) clear() {
@@ -1657,7 +1669,7 @@ func (ms *msgState) clear() {
 		ms.msgr.Close()
 		ms.msgr = nil
 	}
-	*ms = msgState{acc: ms.acc, err: ms.err}
+	*ms = msgState{acc: ms.acc, err: ms.err, keysTx: ms.keysTx}
 }
 
 func (ms *msgState) ensureMsg(m store.Message) {
@@ -1676,8 +1688,8 @@ func (ms *msgState) ensurePart(m store.Message, withMsgReader bool) bool {
 				ms.err = fmt.Errorf("message %d not parsed", m.ID)
 				return false
 			}
-			var p message.Part
-			if err := json.Unmarshal(m.ParsedBuf, &p); err != nil {
+			p, err := m.LoadPart(nil)
+			if err != nil {
 				ms.err = fmt.Errorf("load part for message %d: %w", m.ID, err)
 				return false
 			}
@@ -1968,15 +1980,24 @@ func (q Query) headerFilterFn(log mlog.Log, state *msgState) func(m store.Messag
 }
 
 // wordFiltersFn returns a function that applies the word filters of the query. A
-// nil function is returned when query does not contain a word filter.
-func (q Query) wordsFilterFn(log mlog.Log, state *msgState) func(m store.Message) bool {
+// nil function is returned when query does not contain a word filter. If tx is
+// not nil, the full-text index is used to skip messages that cannot match.
+func (q Query) wordsFilterFn(log mlog.Log, tx *bstore.Tx, state *msgState) func(m store.Message) bool {
 	if len(q.Filter.Words) == 0 && len(q.NotFilter.Words) == 0 {
 		return nil
 	}
 
 	ws := store.PrepareWordSearch(q.Filter.Words, q.NotFilter.Words)
+	if tx != nil {
+		if err := ws.UseIndex(tx, true); err != nil {
+			state.err = fmt.Errorf("looking up words in full-text index: %w", err)
+		}
+	}
 
 	return func(m store.Message) bool {
+		if state.err != nil || ws.IndexMiss(m) {
+			return false
+		}
 		if !state.ensurePart(m, true) {
 			return false
 		}
@@ -185,6 +185,12 @@ func Handler(maxMessageSize int64, cookiePath string, isForwarded bool, accountP
 			http.Error(w, "500 - internal server error - cannot handle requests", http.StatusInternalServerError)
 			return
 		}
+		if r.URL.Path == "/oidc" {
+			// Redirect back from the identity provider, without authentication.
+			ctx := r.Context()
+			webauth.OIDCCallback(ctx, pkglog.WithContext(ctx), "webmail", cookiePath, isForwarded, w, r)
+			return
+		}
 		handle(sh, isForwarded, accountPath, w, r)
 	}
 }
@@ -264,7 +270,7 @@ func handle(apiHandler http.Handler, isForwarded bool, accountPath string, w htt
 	var loginAddress, accName string
 	var sessionToken store.SessionToken
 	// All other URLs, except the login endpoint require some authentication.
-	if r.URL.Path != "/api/LoginPrep" && r.URL.Path != "/api/Login" {
+	if r.URL.Path != "/api/LoginPrep" && r.URL.Path != "/api/Login" && r.URL.Path != "/api/LoginTOTP" && r.URL.Path != "/api/LoginOIDCEnabled" && r.URL.Path != "/api/LoginOIDCStart" && r.URL.Path != "/api/LoginOIDC" {
 		var ok bool
 		isExport := r.URL.Path == "/export"
 		requireCSRF := isAPI || isExport
@@ -328,7 +334,8 @@ func handle(apiHandler http.Handler, isForwarded bool, accountPath string, w htt
 	// Many of the requests need either a message or a parsed part. Make it easy to
 	// fetch/prepare and cleanup. We only do all the work when the request seems legit
 	// (valid HTTP route and method).
-	xprepare := func() (acc *store.Account, m store.Message, msgr *store.MsgReader, p message.Part, cleanup func(), ok bool) {
+	// Signed and/or encrypted messages are decrypted, with the result in mc.
+	xprepare := func() (acc *store.Account, m store.Message, msgr *store.MsgReader, p message.Part, mc *MessageCrypto, cleanup func(), ok bool) {
 		if r.Method != "GET" {
 			http.Error(w, "405 - method not allowed - post required", http.StatusMethodNotAllowed)
 			return
@@ -368,6 +375,20 @@ func handle(apiHandler http.Handler, isForwarded bool, accountPath string, w htt
 		p, err = m.LoadPart(msgr)
 		xcheckf(ctx, err, "load parsed message")
 
+		// Decrypt so part paths are the same as for the parsed message in webmail.
+		if isCryptoPart(&p) {
+			err = acc.DB.Read(ctx, func(tx *bstore.Tx) error {
+				state := msgState{acc: acc, m: m, msgr: msgr, part: &p, keysTx: tx}
+				if err := state.ensureCrypto(log); err != nil {
+					return err
+				}
+				p = *state.part
+				mc = state.crypto
+				return nil
+			})
+			xcheckf(ctx, err, "checking signature and encryption")
+		}
+
 		cleanup = func() {
 			err := msgr.Close()
 			log.Check(err, "closing message reader")
@@ -438,12 +459,12 @@ func handle(apiHandler http.Handler, isForwarded bool, accountPath string, w htt
 
 	switch {
 	case len(t) == 2 && t[1] == "attachments.zip":
-		acc, m, msgr, p, cleanup, ok := xprepare()
+		acc, m, msgr, p, mc, cleanup, ok := xprepare()
 		if !ok {
 			return
 		}
 		defer cleanup()
-		state := msgState{acc: acc, m: m, msgr: msgr, part: &p}
+		state := msgState{acc: acc, m: m, msgr: msgr, part: &p, cryptoChecked: true, crypto: mc}
 		// note: state is cleared by cleanup
 
 		mi, err := messageItem(log, m, &state)
@@ -559,7 +580,7 @@ func handle(apiHandler http.Handler, isForwarded bool, accountPath string, w htt
 
 	// Raw display of a message, as text/plain.
 	case len(t) == 2 && t[1] == "raw":
-		_, _, msgr, p, cleanup, ok := xprepare()
+		_, _, msgr, p, _, cleanup, ok := xprepare()
 		if !ok {
 			return
 		}
@@ -585,13 +606,13 @@ func handle(apiHandler http.Handler, isForwarded bool, accountPath string, w htt
 		// msg.html has a javascript tag with message data, and javascript to render the
 		// message header like the regular webmail.html and to load the message body in a
 		// separate iframe with a separate request with stronger CSP.
-		acc, m, msgr, p, cleanup, ok := xprepare()
+		acc, m, msgr, p, mc, cleanup, ok := xprepare()
 		if !ok {
 			return
 		}
 		defer cleanup()
 
-		state := msgState{acc: acc, m: m, msgr: msgr, part: &p}
+		state := msgState{acc: acc, m: m, msgr: msgr, part: &p, cryptoChecked: true, crypto: mc}
 		// note: state is cleared by cleanup
 
 		pm, err := parsedMessage(log, m, &state, true, true)
@@ -618,12 +639,12 @@ func handle(apiHandler http.Handler, isForwarded bool, accountPath string, w htt
 		// This is js with data inside instead so we can load it synchronously, which we do
 		// to get a "loaded" event after the page was actually loaded.
 
-		acc, m, msgr, p, cleanup, ok := xprepare()
+		acc, m, msgr, p, mc, cleanup, ok := xprepare()
 		if !ok {
 			return
 		}
 		defer cleanup()
-		state := msgState{acc: acc, m: m, msgr: msgr, part: &p}
+		state := msgState{acc: acc, m: m, msgr: msgr, part: &p, cryptoChecked: true, crypto: mc}
 		// note: state is cleared by cleanup
 
 		pm, err := parsedMessage(log, m, &state, true, true)
@@ -649,13 +670,13 @@ func handle(apiHandler http.Handler, isForwarded bool, accountPath string, w htt
 		// renders just the text content with the same code as webmail.html. Used by the
 		// iframe in the msgtext endpoint. Not used by the regular webmail viewer, it
 		// renders the text itself, with the same shared js code.
-		acc, m, msgr, p, cleanup, ok := xprepare()
+		acc, m, msgr, p, mc, cleanup, ok := xprepare()
 		if !ok {
 			return
 		}
 		defer cleanup()
 
-		state := msgState{acc: acc, m: m, msgr: msgr, part: &p}
+		state := msgState{acc: acc, m: m, msgr: msgr, part: &p, cryptoChecked: true, crypto: mc}
 		// note: state is cleared by cleanup
 
 		pm, err := parsedMessage(log, m, &state, true, true)
@@ -683,7 +704,7 @@ func handle(apiHandler http.Handler, isForwarded bool, accountPath string, w htt
 	case len(t) == 2 && (t[1] == "html" || t[1] == "htmlexternal"):
 		// Returns the first HTML part, with "cid:" URIs replaced with an inlined datauri
 		// if the referenced Content-ID attachment can be found.
-		_, _, _, p, cleanup, ok := xprepare()
+		_, _, _, p, _, cleanup, ok := xprepare()
 		if !ok {
 			return
 		}
@@ -737,7 +758,7 @@ func handle(apiHandler http.Handler, isForwarded bool, accountPath string, w htt
 		// data with a text/plain content-type so the browser will attempt to display it,
 		// and "download" adds a content-disposition header causing the browser the
 		// download the file.
-		_, _, _, p, cleanup, ok := xprepare()
+		_, _, _, p, _, cleanup, ok := xprepare()
 		if !ok {
 			return
 		}
@@ -272,6 +272,12 @@ var api;
 		ViewMode["ModeHTML"] = "html";
 		ViewMode["ModeHTMLExt"] = "htmlext";
 	})(ViewMode = api.ViewMode || (api.ViewMode = {}));
+	// CryptoKind is a mechanism for signing and encrypting messages.
+	let CryptoKind;
+	(function (CryptoKind) {
+		CryptoKind["CryptoSMIME"] = "smime";
+		CryptoKind["CryptoOpenPGP"] = "openpgp";
+	})(CryptoKind = api.CryptoKind || (api.CryptoKind = {}));
 	// SecurityResult indicates whether a security feature is supported.
 	let SecurityResult;
 	(function (SecurityResult) {
@@ -290,8 +296,8 @@ var api;
 		Quoting["Bottom"] = "bottom";
 		Quoting["Top"] = "top";
 	})(Quoting = api.Quoting || (api.Quoting = {}));
-	api.structTypes = { "Address": true, "Attachment": true, "ChangeMailboxAdd": true, "ChangeMailboxCounts": true, "ChangeMailboxKeywords": true, "ChangeMailboxRemove": true, "ChangeMailboxRename": true, "ChangeMailboxSpecialUse": true, "ChangeMsgAdd": true, "ChangeMsgFlags": true, "ChangeMsgRemove": true, "ChangeMsgThread": true, "ComposeMessage": true, "Domain": true, "DomainAddressConfig": true, "Envelope": true, "EventStart": true, "EventViewChanges": true, "EventViewErr": true, "EventViewMsgs": true, "EventViewReset": true, "File": true, "Filter": true, "Flags": true, "ForwardAttachments": true, "FromAddressSettings": true, "Mailbox": true, "Message": true, "MessageAddress": true, "MessageEnvelope": true, "MessageItem": true, "NotFilter": true, "Page": true, "ParsedMessage": true, "Part": true, "Query": true, "RecipientSecurity": true, "Request": true, "Ruleset": true, "Settings": true, "SpecialUse": true, "SubmitMessage": true };
-	api.stringsTypes = { "AttachmentType": true, "CSRFToken": true, "Localpart": true, "Quoting": true, "SecurityResult": true, "ThreadMode": true, "ViewMode": true };
+	api.structTypes = { "Address": true, "Attachment": true, "ChangeMailboxAdd": true, "ChangeMailboxCounts": true, "ChangeMailboxKeywords": true, "ChangeMailboxRemove": true, "ChangeMailboxRename": true, "ChangeMailboxSpecialUse": true, "ChangeMsgAdd": true, "ChangeMsgFlags": true, "ChangeMsgRemove": true, "ChangeMsgThread": true, "ComposeMessage": true, "Domain": true, "DomainAddressConfig": true, "Envelope": true, "EventStart": true, "EventViewChanges": true, "EventViewErr": true, "EventViewMsgs": true, "EventViewReset": true, "File": true, "Filter": true, "Flags": true, "ForwardAttachments": true, "FromAddressSettings": true, "Mailbox": true, "MailboxACL": true, "Message": true, "MessageAddress": true, "MessageCrypto": true, "MessageEnvelope": true, "MessageItem": true, "NotFilter": true, "Page": true, "ParsedMessage": true, "Part": true, "Query": true, "RecipientSecurity": true, "Request": true, "Ruleset": true, "ScheduledMessage": true, "Settings": true, "SharedMailbox": true, "SpecialUse": true, "SubmitMessage": true };
+	api.stringsTypes = { "AttachmentType": true, "CSRFToken": true, "CryptoKind": true, "Localpart": true, "Quoting": true, "SecurityResult": true, "ThreadMode": true, "ViewMode": true };
 	api.intsTypes = { "ModSeq": true, "UID": true, "Validation": true };
 	api.types = {
 		"Request": { "Name": "Request", "Docs": "", "Fields": [{ "Name": "ID", "Docs": "", "Typewords": ["int64"] }, { "Name": "SSEID", "Docs": "", "Typewords": ["int64"] }, { "Name": "ViewID", "Docs": "", "Typewords": ["int64"] }, { "Name": "Cancel", "Docs": "", "Typewords": ["bool"] }, { "Name": "Query", "Docs": "", "Typewords": ["Query"] }, { "Name": "Page", "Docs": "", "Typewords": ["Page"] }] },
@@ -299,30 +305,34 @@ var api;
 		"Filter": { "Name": "Filter", "Docs": "", "Fields": [{ "Name": "MailboxID", "Docs": "", "Typewords": ["int64"] }, { "Name": "MailboxChildrenIncluded", "Docs": "", "Typewords": ["bool"] }, { "Name": "MailboxName", "Docs": "", "Typewords": ["string"] }, { "Name": "Words", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "From", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "To", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "Oldest", "Docs": "", "Typewords": ["nullable", "timestamp"] }, { "Name": "Newest", "Docs": "", "Typewords": ["nullable", "timestamp"] }, { "Name": "Subject", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "Attachments", "Docs": "", "Typewords": ["AttachmentType"] }, { "Name": "Labels", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "Headers", "Docs": "", "Typewords": ["[]", "[]", "string"] }, { "Name": "SizeMin", "Docs": "", "Typewords": ["int64"] }, { "Name": "SizeMax", "Docs": "", "Typewords": ["int64"] }] },
 		"NotFilter": { "Name": "NotFilter", "Docs": "", "Fields": [{ "Name": "Words", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "From", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "To", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "Subject", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "Attachments", "Docs": "", "Typewords": ["AttachmentType"] }, { "Name": "Labels", "Docs": "", "Typewords": ["[]", "string"] }] },
 		"Page": { "Name": "Page", "Docs": "", "Fields": [{ "Name": "AnchorMessageID", "Docs": "", "Typewords": ["int64"] }, { "Name": "Count", "Docs": "", "Typewords": ["int32"] }, { "Name": "DestMessageID", "Docs": "", "Typewords": ["int64"] }] },
-		"ParsedMessage": { "Name": "ParsedMessage", "Docs": "", "Fields": [{ "Name": "ID", "Docs": "", "Typewords": ["int64"] }, { "Name": "Part", "Docs": "", "Typewords": ["Part"] }, { "Name": "Headers", "Docs": "", "Typewords": ["{}", "[]", "string"] }, { "Name": "ViewMode", "Docs": "", "Typewords": ["ViewMode"] }, { "Name": "Texts", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "HasHTML", "Docs": "", "Typewords": ["bool"] }, { "Name": "ListReplyAddress", "Docs": "", "Typewords": ["nullable", "MessageAddress"] }] },
+		"ParsedMessage": { "Name": "ParsedMessage", "Docs": "", "Fields": [{ "Name": "ID", "Docs": "", "Typewords": ["int64"] }, { "Name": "Part", "Docs": "", "Typewords": ["Part"] }, { "Name": "Headers", "Docs": "", "Typewords": ["{}", "[]", "string"] }, { "Name": "ViewMode", "Docs": "", "Typewords": ["ViewMode"] }, { "Name": "Texts", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "HasHTML", "Docs": "", "Typewords": ["bool"] }, { "Name": "ListReplyAddress", "Docs": "", "Typewords": ["nullable", "MessageAddress"] }, { "Name": "Crypto", "Docs": "", "Typewords": ["nullable", "MessageCrypto"] }] },
 		"Part": { "Name": "Part", "Docs": "", "Fields": [{ "Name": "BoundaryOffset", "Docs": "", "Typewords": ["int64"] }, { "Name": "HeaderOffset", "Docs": "", "Typewords": ["int64"] }, { "Name": "BodyOffset", "Docs": "", "Typewords": ["int64"] }, { "Name": "EndOffset", "Docs": "", "Typewords": ["int64"] }, { "Name": "RawLineCount", "Docs": "", "Typewords": ["int64"] }, { "Name": "DecodedSize", "Docs": "", "Typewords": ["int64"] }, { "Name": "MediaType", "Docs": "", "Typewords": ["string"] }, { "Name": "MediaSubType", "Docs": "", "Typewords": ["string"] }, { "Name": "ContentTypeParams", "Docs": "", "Typewords": ["{}", "string"] }, { "Name": "ContentID", "Docs": "", "Typewords": ["string"] }, { "Name": "ContentDescription", "Docs": "", "Typewords": ["string"] }, { "Name": "ContentTransferEncoding", "Docs": "", "Typewords": ["string"] }, { "Name": "Envelope", "Docs": "", "Typewords": ["nullable", "Envelope"] }, { "Name": "Parts", "Docs": "", "Typewords": ["[]", "Part"] }, { "Name": "Message", "Docs": "", "Typewords": ["nullable", "Part"] }] },
 		"Envelope": { "Name": "Envelope", "Docs": "", "Fields": [{ "Name": "Date", "Docs": "", "Typewords": ["timestamp"] }, { "Name": "Subject", "Docs": "", "Typewords": ["string"] }, { "Name": "From", "Docs": "", "Typewords": ["[]", "Address"] }, { "Name": "Sender", "Docs": "", "Typewords": ["[]", "Address"] }, { "Name": "ReplyTo", "Docs": "", "Typewords": ["[]", "Address"] }, { "Name": "To", "Docs": "", "Typewords": ["[]", "Address"] }, { "Name": "CC", "Docs": "", "Typewords": ["[]", "Address"] }, { "Name": "BCC", "Docs": "", "Typewords": ["[]", "Address"] }, { "Name": "InReplyTo", "Docs": "", "Typewords": ["string"] }, { "Name": "MessageID", "Docs": "", "Typewords": ["string"] }] },
 		"Address": { "Name": "Address", "Docs": "", "Fields": [{ "Name": "Name", "Docs": "", "Typewords": ["string"] }, { "Name": "User", "Docs": "", "Typewords": ["string"] }, { "Name": "Host", "Docs": "", "Typewords": ["string"] }] },
 		"MessageAddress": { "Name": "MessageAddress", "Docs": "", "Fields": [{ "Name": "Name", "Docs": "", "Typewords": ["string"] }, { "Name": "User", "Docs": "", "Typewords": ["string"] }, { "Name": "Domain", "Docs": "", "Typewords": ["Domain"] }] },
 		"Domain": { "Name": "Domain", "Docs": "", "Fields": [{ "Name": "ASCII", "Docs": "", "Typewords": ["string"] }, { "Name": "Unicode", "Docs": "", "Typewords": ["string"] }] },
+		"MessageCrypto": { "Name": "MessageCrypto", "Docs": "", "Fields": [{ "Name": "Kind", "Docs": "", "Typewords": ["CryptoKind"] }, { "Name": "Encrypted", "Docs": "", "Typewords": ["bool"] }, { "Name": "Decrypted", "Docs": "", "Typewords": ["bool"] }, { "Name": "DecryptError", "Docs": "", "Typewords": ["string"] }, { "Name": "Signed", "Docs": "", "Typewords": ["bool"] }, { "Name": "SignatureValid", "Docs": "", "Typewords": ["bool"] }, { "Name": "SignatureError", "Docs": "", "Typewords": ["string"] }, { "Name": "SignerAddresses", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "SignerFingerprint", "Docs": "", "Typewords": ["string"] }, { "Name": "SignerMatchesFrom", "Docs": "", "Typewords": ["bool"] }, { "Name": "SignerTrusted", "Docs": "", "Typewords": ["bool"] }] },
 		"FromAddressSettings": { "Name": "FromAddressSettings", "Docs": "", "Fields": [{ "Name": "FromAddress", "Docs": "", "Typewords": ["string"] }, { "Name": "ViewMode", "Docs": "", "Typewords": ["ViewMode"] }] },
 		"ComposeMessage": { "Name": "ComposeMessage", "Docs": "", "Fields": [{ "Name": "From", "Docs": "", "Typewords": ["string"] }, { "Name": "To", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "Cc", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "Bcc", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "ReplyTo", "Docs": "", "Typewords": ["string"] }, { "Name": "Subject", "Docs": "", "Typewords": ["string"] }, { "Name": "TextBody", "Docs": "", "Typewords": ["string"] }, { "Name": "ResponseMessageID", "Docs": "", "Typewords": ["int64"] }, { "Name": "DraftMessageID", "Docs": "", "Typewords": ["int64"] }] },
-		"SubmitMessage": { "Name": "SubmitMessage", "Docs": "", "Fields": [{ "Name": "From", "Docs": "", "Typewords": ["string"] }, { "Name": "To", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "Cc", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "Bcc", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "ReplyTo", "Docs": "", "Typewords": ["string"] }, { "Name": "Subject", "Docs": "", "Typewords": ["string"] }, { "Name": "TextBody", "Docs": "", "Typewords": ["string"] }, { "Name": "Attachments", "Docs": "", "Typewords": ["[]", "File"] }, { "Name": "ForwardAttachments", "Docs": "", "Typewords": ["ForwardAttachments"] }, { "Name": "IsForward", "Docs": "", "Typewords": ["bool"] }, { "Name": "ResponseMessageID", "Docs": "", "Typewords": ["int64"] }, { "Name": "UserAgent", "Docs": "", "Typewords": ["string"] }, { "Name": "RequireTLS", "Docs": "", "Typewords": ["nullable", "bool"] }, { "Name": "FutureRelease", "Docs": "", "Typewords": ["nullable", "timestamp"] }, { "Name": "ArchiveThread", "Docs": "", "Typewords": ["bool"] }, { "Name": "DraftMessageID", "Docs": "", "Typewords": ["int64"] }] },
+		"SubmitMessage": { "Name": "SubmitMessage", "Docs": "", "Fields": [{ "Name": "From", "Docs": "", "Typewords": ["string"] }, { "Name": "To", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "Cc", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "Bcc", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "ReplyTo", "Docs": "", "Typewords": ["string"] }, { "Name": "Subject", "Docs": "", "Typewords": ["string"] }, { "Name": "TextBody", "Docs": "", "Typewords": ["string"] }, { "Name": "Attachments", "Docs": "", "Typewords": ["[]", "File"] }, { "Name": "ForwardAttachments", "Docs": "", "Typewords": ["ForwardAttachments"] }, { "Name": "IsForward", "Docs": "", "Typewords": ["bool"] }, { "Name": "ResponseMessageID", "Docs": "", "Typewords": ["int64"] }, { "Name": "UserAgent", "Docs": "", "Typewords": ["string"] }, { "Name": "RequireTLS", "Docs": "", "Typewords": ["nullable", "bool"] }, { "Name": "FutureRelease", "Docs": "", "Typewords": ["nullable", "timestamp"] }, { "Name": "UndoSendSeconds", "Docs": "", "Typewords": ["int32"] }, { "Name": "ArchiveThread", "Docs": "", "Typewords": ["bool"] }, { "Name": "DraftMessageID", "Docs": "", "Typewords": ["int64"] }, { "Name": "Crypto", "Docs": "", "Typewords": ["CryptoKind"] }, { "Name": "Sign", "Docs": "", "Typewords": ["bool"] }, { "Name": "Encrypt", "Docs": "", "Typewords": ["bool"] }] },
 		"File": { "Name": "File", "Docs": "", "Fields": [{ "Name": "Filename", "Docs": "", "Typewords": ["string"] }, { "Name": "DataURI", "Docs": "", "Typewords": ["string"] }] },
 		"ForwardAttachments": { "Name": "ForwardAttachments", "Docs": "", "Fields": [{ "Name": "MessageID", "Docs": "", "Typewords": ["int64"] }, { "Name": "Paths", "Docs": "", "Typewords": ["[]", "[]", "int32"] }] },
+		"ScheduledMessage": { "Name": "ScheduledMessage", "Docs": "", "Fields": [{ "Name": "QueueMsgIDs", "Docs": "", "Typewords": ["[]", "int64"] }, { "Name": "MessageID", "Docs": "", "Typewords": ["string"] }, { "Name": "Subject", "Docs": "", "Typewords": ["string"] }, { "Name": "Recipients", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "Queued", "Docs": "", "Typewords": ["timestamp"] }, { "Name": "SendAt", "Docs": "", "Typewords": ["timestamp"] }, { "Name": "UndoSend", "Docs": "", "Typewords": ["bool"] }] },
+		"MessageItem": { "Name": "MessageItem", "Docs": "", "Fields": [{ "Name": "Message", "Docs": "", "Typewords": ["Message"] }, { "Name": "Envelope", "Docs": "", "Typewords": ["MessageEnvelope"] }, { "Name": "Attachments", "Docs": "", "Typewords": ["[]", "Attachment"] }, { "Name": "IsSigned", "Docs": "", "Typewords": ["bool"] }, { "Name": "IsEncrypted", "Docs": "", "Typewords": ["bool"] }, { "Name": "FirstLine", "Docs": "", "Typewords": ["string"] }, { "Name": "MatchQuery", "Docs": "", "Typewords": ["bool"] }] },
+		"Message": { "Name": "Message", "Docs": "", "Fields": [{ "Name": "ID", "Docs": "", "Typewords": ["int64"] }, { "Name": "UID", "Docs": "", "Typewords": ["UID"] }, { "Name": "MailboxID", "Docs": "", "Typewords": ["int64"] }, { "Name": "ModSeq", "Docs": "", "Typewords": ["ModSeq"] }, { "Name": "CreateSeq", "Docs": "", "Typewords": ["ModSeq"] }, { "Name": "Expunged", "Docs": "", "Typewords": ["bool"] }, { "Name": "IsReject", "Docs": "", "Typewords": ["bool"] }, { "Name": "IsForward", "Docs": "", "Typewords": ["bool"] }, { "Name": "MailboxOrigID", "Docs": "", "Typewords": ["int64"] }, { "Name": "MailboxDestinedID", "Docs": "", "Typewords": ["int64"] }, { "Name": "Received", "Docs": "", "Typewords": ["timestamp"] }, { "Name": "RemoteIP", "Docs": "", "Typewords": ["string"] }, { "Name": "RemoteIPMasked1", "Docs": "", "Typewords": ["string"] }, { "Name": "RemoteIPMasked2", "Docs": "", "Typewords": ["string"] }, { "Name": "RemoteIPMasked3", "Docs": "", "Typewords": ["string"] }, { "Name": "EHLODomain", "Docs": "", "Typewords": ["string"] }, { "Name": "MailFrom", "Docs": "", "Typewords": ["string"] }, { "Name": "MailFromLocalpart", "Docs": "", "Typewords": ["Localpart"] }, { "Name": "MailFromDomain", "Docs": "", "Typewords": ["string"] }, { "Name": "RcptToLocalpart", "Docs": "", "Typewords": ["Localpart"] }, { "Name": "RcptToDomain", "Docs": "", "Typewords": ["string"] }, { "Name": "MsgFromLocalpart", "Docs": "", "Typewords": ["Localpart"] }, { "Name": "MsgFromDomain", "Docs": "", "Typewords": ["string"] }, { "Name": "MsgFromOrgDomain", "Docs": "", "Typewords": ["string"] }, { "Name": "EHLOValidated", "Docs": "", "Typewords": ["bool"] }, { "Name": "MailFromValidated", "Docs": "", "Typewords": ["bool"] }, { "Name": "MsgFromValidated", "Docs": "", "Typewords": ["bool"] }, { "Name": "EHLOValidation", "Docs": "", "Typewords": ["Validation"] }, { "Name": "MailFromValidation", "Docs": "", "Typewords": ["Validation"] }, { "Name": "MsgFromValidation", "Docs": "", "Typewords": ["Validation"] }, { "Name": "DKIMDomains", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "ARCResult", "Docs": "", "Typewords": ["string"] }, { "Name": "ARCSealDomains", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "OrigEHLODomain", "Docs": "", "Typewords": ["string"] }, { "Name": "OrigDKIMDomains", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "MessageID", "Docs": "", "Typewords": ["string"] }, { "Name": "SubjectBase", "Docs": "", "Typewords": ["string"] }, { "Name": "MessageHash", "Docs": "", "Typewords": ["nullable", "string"] }, { "Name": "ThreadID", "Docs": "", "Typewords": ["int64"] }, { "Name": "ThreadParentIDs", "Docs": "", "Typewords": ["[]", "int64"] }, { "Name": "ThreadMissingLink", "Docs": "", "Typewords": ["bool"] }, { "Name": "ThreadMuted", "Docs": "", "Typewords": ["bool"] }, { "Name": "ThreadCollapsed", "Docs": "", "Typewords": ["bool"] }, { "Name": "IsMailingList", "Docs": "", "Typewords": ["bool"] }, { "Name": "DSN", "Docs": "", "Typewords": ["bool"] }, { "Name": "TextIndexed", "Docs": "", "Typewords": ["bool"] }, { "Name": "ReceivedTLSVersion", "Docs": "", "Typewords": ["uint16"] }, { "Name": "ReceivedTLSCipherSuite", "Docs": "", "Typewords": ["uint16"] }, { "Name": "ReceivedRequireTLS", "Docs": "", "Typewords": ["bool"] }, { "Name": "Seen", "Docs": "", "Typewords": ["bool"] }, { "Name": "Answered", "Docs": "", "Typewords": ["bool"] }, { "Name": "Flagged", "Docs": "", "Typewords": ["bool"] }, { "Name": "Forwarded", "Docs": "", "Typewords": ["bool"] }, { "Name": "Junk", "Docs": "", "Typewords": ["bool"] }, { "Name": "Notjunk", "Docs": "", "Typewords": ["bool"] }, { "Name": "Deleted", "Docs": "", "Typewords": ["bool"] }, { "Name": "Draft", "Docs": "", "Typewords": ["bool"] }, { "Name": "Phishing", "Docs": "", "Typewords": ["bool"] }, { "Name": "MDNSent", "Docs": "", "Typewords": ["bool"] }, { "Name": "Keywords", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "Size", "Docs": "", "Typewords": ["int64"] }, { "Name": "TrainedJunk", "Docs": "", "Typewords": ["nullable", "bool"] }, { "Name": "MsgPrefix", "Docs": "", "Typewords": ["nullable", "string"] }, { "Name": "ParsedBuf", "Docs": "", "Typewords": ["nullable", "string"] }] },
+		"MessageEnvelope": { "Name": "MessageEnvelope", "Docs": "", "Fields": [{ "Name": "Date", "Docs": "", "Typewords": ["timestamp"] }, { "Name": "Subject", "Docs": "", "Typewords": ["string"] }, { "Name": "From", "Docs": "", "Typewords": ["[]", "MessageAddress"] }, { "Name": "Sender", "Docs": "", "Typewords": ["[]", "MessageAddress"] }, { "Name": "ReplyTo", "Docs": "", "Typewords": ["[]", "MessageAddress"] }, { "Name": "To", "Docs": "", "Typewords": ["[]", "MessageAddress"] }, { "Name": "CC", "Docs": "", "Typewords": ["[]", "MessageAddress"] }, { "Name": "BCC", "Docs": "", "Typewords": ["[]", "MessageAddress"] }, { "Name": "InReplyTo", "Docs": "", "Typewords": ["string"] }, { "Name": "MessageID", "Docs": "", "Typewords": ["string"] }] },
+		"Attachment": { "Name": "Attachment", "Docs": "", "Fields": [{ "Name": "Path", "Docs": "", "Typewords": ["[]", "int32"] }, { "Name": "Filename", "Docs": "", "Typewords": ["string"] }, { "Name": "Part", "Docs": "", "Typewords": ["Part"] }] },
 		"Mailbox": { "Name": "Mailbox", "Docs": "", "Fields": [{ "Name": "ID", "Docs": "", "Typewords": ["int64"] }, { "Name": "Name", "Docs": "", "Typewords": ["string"] }, { "Name": "UIDValidity", "Docs": "", "Typewords": ["uint32"] }, { "Name": "UIDNext", "Docs": "", "Typewords": ["UID"] }, { "Name": "Archive", "Docs": "", "Typewords": ["bool"] }, { "Name": "Draft", "Docs": "", "Typewords": ["bool"] }, { "Name": "Junk", "Docs": "", "Typewords": ["bool"] }, { "Name": "Sent", "Docs": "", "Typewords": ["bool"] }, { "Name": "Trash", "Docs": "", "Typewords": ["bool"] }, { "Name": "Keywords", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "HaveCounts", "Docs": "", "Typewords": ["bool"] }, { "Name": "Total", "Docs": "", "Typewords": ["int64"] }, { "Name": "Deleted", "Docs": "", "Typewords": ["int64"] }, { "Name": "Unread", "Docs": "", "Typewords": ["int64"] }, { "Name": "Unseen", "Docs": "", "Typewords": ["int64"] }, { "Name": "Size", "Docs": "", "Typewords": ["int64"] }] },
+		"MailboxACL": { "Name": "MailboxACL", "Docs": "", "Fields": [{ "Name": "ID", "Docs": "", "Typewords": ["int64"] }, { "Name": "MailboxID", "Docs": "", "Typewords": ["int64"] }, { "Name": "Identifier", "Docs": "", "Typewords": ["string"] }, { "Name": "Rights", "Docs": "", "Typewords": ["string"] }] },
+		"SharedMailbox": { "Name": "SharedMailbox", "Docs": "", "Fields": [{ "Name": "Account", "Docs": "", "Typewords": ["string"] }, { "Name": "Mailbox", "Docs": "", "Typewords": ["Mailbox"] }, { "Name": "Rights", "Docs": "", "Typewords": ["string"] }, { "Name": "Direct", "Docs": "", "Typewords": ["bool"] }, { "Name": "Anyone", "Docs": "", "Typewords": ["bool"] }] },
 		"RecipientSecurity": { "Name": "RecipientSecurity", "Docs": "", "Fields": [{ "Name": "STARTTLS", "Docs": "", "Typewords": ["SecurityResult"] }, { "Name": "MTASTS", "Docs": "", "Typewords": ["SecurityResult"] }, { "Name": "DNSSEC", "Docs": "", "Typewords": ["SecurityResult"] }, { "Name": "DANE", "Docs": "", "Typewords": ["SecurityResult"] }, { "Name": "RequireTLS", "Docs": "", "Typewords": ["SecurityResult"] }] },
-		"Settings": { "Name": "Settings", "Docs": "", "Fields": [{ "Name": "ID", "Docs": "", "Typewords": ["uint8"] }, { "Name": "Signature", "Docs": "", "Typewords": ["string"] }, { "Name": "Quoting", "Docs": "", "Typewords": ["Quoting"] }, { "Name": "ShowAddressSecurity", "Docs": "", "Typewords": ["bool"] }] },
+		"Settings": { "Name": "Settings", "Docs": "", "Fields": [{ "Name": "ID", "Docs": "", "Typewords": ["uint8"] }, { "Name": "Signature", "Docs": "", "Typewords": ["string"] }, { "Name": "Quoting", "Docs": "", "Typewords": ["Quoting"] }, { "Name": "ShowAddressSecurity", "Docs": "", "Typewords": ["bool"] }, { "Name": "UndoSendSeconds", "Docs": "", "Typewords": ["int32"] }] },
 		"Ruleset": { "Name": "Ruleset", "Docs": "", "Fields": [{ "Name": "SMTPMailFromRegexp", "Docs": "", "Typewords": ["string"] }, { "Name": "MsgFromRegexp", "Docs": "", "Typewords": ["string"] }, { "Name": "VerifiedDomain", "Docs": "", "Typewords": ["string"] }, { "Name": "HeadersRegexp", "Docs": "", "Typewords": ["{}", "string"] }, { "Name": "IsForward", "Docs": "", "Typewords": ["bool"] }, { "Name": "ListAllowDomain", "Docs": "", "Typewords": ["string"] }, { "Name": "AcceptRejectsToMailbox", "Docs": "", "Typewords": ["string"] }, { "Name": "Mailbox", "Docs": "", "Typewords": ["string"] }, { "Name": "Comment", "Docs": "", "Typewords": ["string"] }, { "Name": "VerifiedDNSDomain", "Docs": "", "Typewords": ["Domain"] }, { "Name": "ListAllowDNSDomain", "Docs": "", "Typewords": ["Domain"] }] },
 		"EventStart": { "Name": "EventStart", "Docs": "", "Fields": [{ "Name": "SSEID", "Docs": "", "Typewords": ["int64"] }, { "Name": "LoginAddress", "Docs": "", "Typewords": ["MessageAddress"] }, { "Name": "Addresses", "Docs": "", "Typewords": ["[]", "MessageAddress"] }, { "Name": "DomainAddressConfigs", "Docs": "", "Typewords": ["{}", "DomainAddressConfig"] }, { "Name": "MailboxName", "Docs": "", "Typewords": ["string"] }, { "Name": "Mailboxes", "Docs": "", "Typewords": ["[]", "Mailbox"] }, { "Name": "RejectsMailbox", "Docs": "", "Typewords": ["string"] }, { "Name": "Settings", "Docs": "", "Typewords": ["Settings"] }, { "Name": "AccountPath", "Docs": "", "Typewords": ["string"] }, { "Name": "Version", "Docs": "", "Typewords": ["string"] }] },
 		"DomainAddressConfig": { "Name": "DomainAddressConfig", "Docs": "", "Fields": [{ "Name": "LocalpartCatchallSeparator", "Docs": "", "Typewords": ["string"] }, { "Name": "LocalpartCaseSensitive", "Docs": "", "Typewords": ["bool"] }] },
 		"EventViewErr": { "Name": "EventViewErr", "Docs": "", "Fields": [{ "Name": "ViewID", "Docs": "", "Typewords": ["int64"] }, { "Name": "RequestID", "Docs": "", "Typewords": ["int64"] }, { "Name": "Err", "Docs": "", "Typewords": ["string"] }] },
 		"EventViewReset": { "Name": "EventViewReset", "Docs": "", "Fields": [{ "Name": "ViewID", "Docs": "", "Typewords": ["int64"] }, { "Name": "RequestID", "Docs": "", "Typewords": ["int64"] }] },
 		"EventViewMsgs": { "Name": "EventViewMsgs", "Docs": "", "Fields": [{ "Name": "ViewID", "Docs": "", "Typewords": ["int64"] }, { "Name": "RequestID", "Docs": "", "Typewords": ["int64"] }, { "Name": "MessageItems", "Docs": "", "Typewords": ["[]", "[]", "MessageItem"] }, { "Name": "ParsedMessage", "Docs": "", "Typewords": ["nullable", "ParsedMessage"] }, { "Name": "ViewEnd", "Docs": "", "Typewords": ["bool"] }] },
-		"MessageItem": { "Name": "MessageItem", "Docs": "", "Fields": [{ "Name": "Message", "Docs": "", "Typewords": ["Message"] }, { "Name": "Envelope", "Docs": "", "Typewords": ["MessageEnvelope"] }, { "Name": "Attachments", "Docs": "", "Typewords": ["[]", "Attachment"] }, { "Name": "IsSigned", "Docs": "", "Typewords": ["bool"] }, { "Name": "IsEncrypted", "Docs": "", "Typewords": ["bool"] }, { "Name": "FirstLine", "Docs": "", "Typewords": ["string"] }, { "Name": "MatchQuery", "Docs": "", "Typewords": ["bool"] }] },
-		"Message": { "Name": "Message", "Docs": "", "Fields": [{ "Name": "ID", "Docs": "", "Typewords": ["int64"] }, { "Name": "UID", "Docs": "", "Typewords": ["UID"] }, { "Name": "MailboxID", "Docs": "", "Typewords": ["int64"] }, { "Name": "ModSeq", "Docs": "", "Typewords": ["ModSeq"] }, { "Name": "CreateSeq", "Docs": "", "Typewords": ["ModSeq"] }, { "Name": "Expunged", "Docs": "", "Typewords": ["bool"] }, { "Name": "IsReject", "Docs": "", "Typewords": ["bool"] }, { "Name": "IsForward", "Docs": "", "Typewords": ["bool"] }, { "Name": "MailboxOrigID", "Docs": "", "Typewords": ["int64"] }, { "Name": "MailboxDestinedID", "Docs": "", "Typewords": ["int64"] }, { "Name": "Received", "Docs": "", "Typewords": ["timestamp"] }, { "Name": "RemoteIP", "Docs": "", "Typewords": ["string"] }, { "Name": "RemoteIPMasked1", "Docs": "", "Typewords": ["string"] }, { "Name": "RemoteIPMasked2", "Docs": "", "Typewords": ["string"] }, { "Name": "RemoteIPMasked3", "Docs": "", "Typewords": ["string"] }, { "Name": "EHLODomain", "Docs": "", "Typewords": ["string"] }, { "Name": "MailFrom", "Docs": "", "Typewords": ["string"] }, { "Name": "MailFromLocalpart", "Docs": "", "Typewords": ["Localpart"] }, { "Name": "MailFromDomain", "Docs": "", "Typewords": ["string"] }, { "Name": "RcptToLocalpart", "Docs": "", "Typewords": ["Localpart"] }, { "Name": "RcptToDomain", "Docs": "", "Typewords": ["string"] }, { "Name": "MsgFromLocalpart", "Docs": "", "Typewords": ["Localpart"] }, { "Name": "MsgFromDomain", "Docs": "", "Typewords": ["string"] }, { "Name": "MsgFromOrgDomain", "Docs": "", "Typewords": ["string"] }, { "Name": "EHLOValidated", "Docs": "", "Typewords": ["bool"] }, { "Name": "MailFromValidated", "Docs": "", "Typewords": ["bool"] }, { "Name": "MsgFromValidated", "Docs": "", "Typewords": ["bool"] }, { "Name": "EHLOValidation", "Docs": "", "Typewords": ["Validation"] }, { "Name": "MailFromValidation", "Docs": "", "Typewords": ["Validation"] }, { "Name": "MsgFromValidation", "Docs": "", "Typewords": ["Validation"] }, { "Name": "DKIMDomains", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "OrigEHLODomain", "Docs": "", "Typewords": ["string"] }, { "Name": "OrigDKIMDomains", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "MessageID", "Docs": "", "Typewords": ["string"] }, { "Name": "SubjectBase", "Docs": "", "Typewords": ["string"] }, { "Name": "MessageHash", "Docs": "", "Typewords": ["nullable", "string"] }, { "Name": "ThreadID", "Docs": "", "Typewords": ["int64"] }, { "Name": "ThreadParentIDs", "Docs": "", "Typewords": ["[]", "int64"] }, { "Name": "ThreadMissingLink", "Docs": "", "Typewords": ["bool"] }, { "Name": "ThreadMuted", "Docs": "", "Typewords": ["bool"] }, { "Name": "ThreadCollapsed", "Docs": "", "Typewords": ["bool"] }, { "Name": "IsMailingList", "Docs": "", "Typewords": ["bool"] }, { "Name": "DSN", "Docs": "", "Typewords": ["bool"] }, { "Name": "ReceivedTLSVersion", "Docs": "", "Typewords": ["uint16"] }, { "Name": "ReceivedTLSCipherSuite", "Docs": "", "Typewords": ["uint16"] }, { "Name": "ReceivedRequireTLS", "Docs": "", "Typewords": ["bool"] }, { "Name": "Seen", "Docs": "", "Typewords": ["bool"] }, { "Name": "Answered", "Docs": "", "Typewords": ["bool"] }, { "Name": "Flagged", "Docs": "", "Typewords": ["bool"] }, { "Name": "Forwarded", "Docs": "", "Typewords": ["bool"] }, { "Name": "Junk", "Docs": "", "Typewords": ["bool"] }, { "Name": "Notjunk", "Docs": "", "Typewords": ["bool"] }, { "Name": "Deleted", "Docs": "", "Typewords": ["bool"] }, { "Name": "Draft", "Docs": "", "Typewords": ["bool"] }, { "Name": "Phishing", "Docs": "", "Typewords": ["bool"] }, { "Name": "MDNSent", "Docs": "", "Typewords": ["bool"] }, { "Name": "Keywords", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "Size", "Docs": "", "Typewords": ["int64"] }, { "Name": "TrainedJunk", "Docs": "", "Typewords": ["nullable", "bool"] }, { "Name": "MsgPrefix", "Docs": "", "Typewords": ["nullable", "string"] }, { "Name": "ParsedBuf", "Docs": "", "Typewords": ["nullable", "string"] }] },
-		"MessageEnvelope": { "Name": "MessageEnvelope", "Docs": "", "Fields": [{ "Name": "Date", "Docs": "", "Typewords": ["timestamp"] }, { "Name": "Subject", "Docs": "", "Typewords": ["string"] }, { "Name": "From", "Docs": "", "Typewords": ["[]", "MessageAddress"] }, { "Name": "Sender", "Docs": "", "Typewords": ["[]", "MessageAddress"] }, { "Name": "ReplyTo", "Docs": "", "Typewords": ["[]", "MessageAddress"] }, { "Name": "To", "Docs": "", "Typewords": ["[]", "MessageAddress"] }, { "Name": "CC", "Docs": "", "Typewords": ["[]", "MessageAddress"] }, { "Name": "BCC", "Docs": "", "Typewords": ["[]", "MessageAddress"] }, { "Name": "InReplyTo", "Docs": "", "Typewords": ["string"] }, { "Name": "MessageID", "Docs": "", "Typewords": ["string"] }] },
-		"Attachment": { "Name": "Attachment", "Docs": "", "Fields": [{ "Name": "Path", "Docs": "", "Typewords": ["[]", "int32"] }, { "Name": "Filename", "Docs": "", "Typewords": ["string"] }, { "Name": "Part", "Docs": "", "Typewords": ["Part"] }] },
 		"EventViewChanges": { "Name": "EventViewChanges", "Docs": "", "Fields": [{ "Name": "ViewID", "Docs": "", "Typewords": ["int64"] }, { "Name": "Changes", "Docs": "", "Typewords": ["[]", "[]", "any"] }] },
 		"ChangeMsgAdd": { "Name": "ChangeMsgAdd", "Docs": "", "Fields": [{ "Name": "MailboxID", "Docs": "", "Typewords": ["int64"] }, { "Name": "UID", "Docs": "", "Typewords": ["UID"] }, { "Name": "ModSeq", "Docs": "", "Typewords": ["ModSeq"] }, { "Name": "Flags", "Docs": "", "Typewords": ["Flags"] }, { "Name": "Keywords", "Docs": "", "Typewords": ["[]", "string"] }, { "Name": "MessageItems", "Docs": "", "Typewords": ["[]", "MessageItem"] }] },
 		"Flags": { "Name": "Flags", "Docs": "", "Fields": [{ "Name": "Seen", "Docs": "", "Typewords": ["bool"] }, { "Name": "Answered", "Docs": "", "Typewords": ["bool"] }, { "Name": "Flagged", "Docs": "", "Typewords": ["bool"] }, { "Name": "Forwarded", "Docs": "", "Typewords": ["bool"] }, { "Name": "Junk", "Docs": "", "Typewords": ["bool"] }, { "Name": "Notjunk", "Docs": "", "Typewords": ["bool"] }, { "Name": "Deleted", "Docs": "", "Typewords": ["bool"] }, { "Name": "Draft", "Docs": "", "Typewords": ["bool"] }, { "Name": "Phishing", "Docs": "", "Typewords": ["bool"] }, { "Name": "MDNSent", "Docs": "", "Typewords": ["bool"] }] },
@@ -343,9 +353,10 @@ var api;
 		"ThreadMode": { "Name": "ThreadMode", "Docs": "", "Values": [{ "Name": "ThreadOff", "Value": "off", "Docs": "" }, { "Name": "ThreadOn", "Value": "on", "Docs": "" }, { "Name": "ThreadUnread", "Value": "unread", "Docs": "" }] },
 		"AttachmentType": { "Name": "AttachmentType", "Docs": "", "Values": [{ "Name": "AttachmentIndifferent", "Value": "", "Docs": "" }, { "Name": "AttachmentNone", "Value": "none", "Docs": "" }, { "Name": "AttachmentAny", "Value": "any", "Docs": "" }, { "Name": "AttachmentImage", "Value": "image", "Docs": "" }, { "Name": "AttachmentPDF", "Value": "pdf", "Docs": "" }, { "Name": "AttachmentArchive", "Value": "archive", "Docs": "" }, { "Name": "AttachmentSpreadsheet", "Value": "spreadsheet", "Docs": "" }, { "Name": "AttachmentDocument", "Value": "document", "Docs": "" }, { "Name": "AttachmentPresentation", "Value": "presentation", "Docs": "" }] },
 		"ViewMode": { "Name": "ViewMode", "Docs": "", "Values": [{ "Name": "ModeDefault", "Value": "", "Docs": "" }, { "Name": "ModeText", "Value": "text", "Docs": "" }, { "Name": "ModeHTML", "Value": "html", "Docs": "" }, { "Name": "ModeHTMLExt", "Value": "htmlext", "Docs": "" }] },
+		"CryptoKind": { "Name": "CryptoKind", "Docs": "", "Values": [{ "Name": "CryptoSMIME", "Value": "smime", "Docs": "" }, { "Name": "CryptoOpenPGP", "Value": "openpgp", "Docs": "" }] },
+		"Localpart": { "Name": "Localpart", "Docs": "", "Values": null },
 		"SecurityResult": { "Name": "SecurityResult", "Docs": "", "Values": [{ "Name": "SecurityResultError", "Value": "error", "Docs": "" }, { "Name": "SecurityResultNo", "Value": "no", "Docs": "" }, { "Name": "SecurityResultYes", "Value": "yes", "Docs": "" }, { "Name": "SecurityResultUnknown", "Value": "unknown", "Docs": "" }] },
 		"Quoting": { "Name": "Quoting", "Docs": "", "Values": [{ "Name": "Default", "Value": "", "Docs": "" }, { "Name": "Bottom", "Value": "bottom", "Docs": "" }, { "Name": "Top", "Value": "top", "Docs": "" }] },
-		"Localpart": { "Name": "Localpart", "Docs": "", "Values": null },
 	};
 	api.parser = {
 		Request: (v) => api.parse("Request", v),
@@ -359,12 +370,20 @@ var api;
 		Address: (v) => api.parse("Address", v),
 		MessageAddress: (v) => api.parse("MessageAddress", v),
 		Domain: (v) => api.parse("Domain", v),
+		MessageCrypto: (v) => api.parse("MessageCrypto", v),
 		FromAddressSettings: (v) => api.parse("FromAddressSettings", v),
 		ComposeMessage: (v) => api.parse("ComposeMessage", v),
 		SubmitMessage: (v) => api.parse("SubmitMessage", v),
 		File: (v) => api.parse("File", v),
 		ForwardAttachments: (v) => api.parse("ForwardAttachments", v),
+		ScheduledMessage: (v) => api.parse("ScheduledMessage", v),
+		MessageItem: (v) => api.parse("MessageItem", v),
+		Message: (v) => api.parse("Message", v),
+		MessageEnvelope: (v) => api.parse("MessageEnvelope", v),
+		Attachment: (v) => api.parse("Attachment", v),
 		Mailbox: (v) => api.parse("Mailbox", v),
+		MailboxACL: (v) => api.parse("MailboxACL", v),
+		SharedMailbox: (v) => api.parse("SharedMailbox", v),
 		RecipientSecurity: (v) => api.parse("RecipientSecurity", v),
 		Settings: (v) => api.parse("Settings", v),
 		Ruleset: (v) => api.parse("Ruleset", v),
@@ -373,10 +392,6 @@ var api;
 		EventViewErr: (v) => api.parse("EventViewErr", v),
 		EventViewReset: (v) => api.parse("EventViewReset", v),
 		EventViewMsgs: (v) => api.parse("EventViewMsgs", v),
-		MessageItem: (v) => api.parse("MessageItem", v),
-		Message: (v) => api.parse("Message", v),
-		MessageEnvelope: (v) => api.parse("MessageEnvelope", v),
-		Attachment: (v) => api.parse("Attachment", v),
 		EventViewChanges: (v) => api.parse("EventViewChanges", v),
 		ChangeMsgAdd: (v) => api.parse("ChangeMsgAdd", v),
 		Flags: (v) => api.parse("Flags", v),
@@ -397,9 +412,10 @@ var api;
 		ThreadMode: (v) => api.parse("ThreadMode", v),
 		AttachmentType: (v) => api.parse("AttachmentType", v),
 		ViewMode: (v) => api.parse("ViewMode", v),
+		CryptoKind: (v) => api.parse("CryptoKind", v),
+		Localpart: (v) => api.parse("Localpart", v),
 		SecurityResult: (v) => api.parse("SecurityResult", v),
 		Quoting: (v) => api.parse("Quoting", v),
-		Localpart: (v) => api.parse("Localpart", v),
 	};
 	let defaultOptions = { slicesNullable: true, mapsNullable: true, nullableOptional: true };
 	class Client {
@@ -441,6 +457,45 @@ var api;
 			const params = [loginToken, username, password];
 			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
 		}
+		// LoginTOTP completes a login for which Login failed with error code
+		// "user:totpRequired", with a code from an authenticator app or a recovery code.
+		// Fails with error code "user:loginFailed" for a bad code.
+		async LoginTOTP(loginToken, code) {
+			const fn = "LoginTOTP";
+			const paramTypes = [["string"], ["string"]];
+			const returnTypes = [["CSRFToken"]];
+			const params = [loginToken, code];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// LoginOIDCEnabled returns whether logging in through an OpenID Connect identity
+		// provider (single sign-on) is available.
+		async LoginOIDCEnabled() {
+			const fn = "LoginOIDCEnabled";
+			const paramTypes = [];
+			const returnTypes = [["bool"]];
+			const params = [];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// LoginOIDCStart starts a login through the identity provider, returning the URL
+		// to navigate to. Call LoginPrep to get a loginToken. After logging in at the
+		// identity provider, the browser returns with an "oidc" query string parameter,
+		// which must be passed to LoginOIDC.
+		async LoginOIDCStart(loginToken) {
+			const fn = "LoginOIDCStart";
+			const paramTypes = [["string"]];
+			const returnTypes = [["string"]];
+			const params = [loginToken];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// LoginOIDC completes a login through the identity provider, returning a session
+		// token like Login, and the address the user logged in with.
+		async LoginOIDC(state) {
+			const fn = "LoginOIDC";
+			const paramTypes = [["string"]];
+			const returnTypes = [["CSRFToken"], ["string"]];
+			const params = [state];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
 		// Logout invalidates the session token.
 		async Logout() {
 			const fn = "Logout";
@@ -515,13 +570,49 @@ var api;
 		// If a Sent mailbox is configured, messages are added to it after submitting
 		// to the delivery queue. If Bcc addresses were present, a header is prepended
 		// to the message stored in the Sent mailbox.
+		// 
+		// The IDs of the messages added to the queue are returned, one for each
+		// recipient, e.g. for canceling with ScheduledCancel during an "undo send" grace
+		// period.
 		async MessageSubmit(m) {
 			const fn = "MessageSubmit";
 			const paramTypes = [["SubmitMessage"]];
-			const returnTypes = [];
+			const returnTypes = [["[]", "int64"]];
 			const params = [m];
 			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
 		}
+		// ScheduledList returns the submitted messages of the account that are scheduled
+		// for later delivery, ordered by time of delivery.
+		async ScheduledList() {
+			const fn = "ScheduledList";
+			const paramTypes = [];
+			const returnTypes = [["[]", "ScheduledMessage"]];
+			const params = [];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// ScheduledCancel removes scheduled messages from the queue before their first
+		// delivery attempt, e.g. to undo sending. Either all messages are canceled, or
+		// none.
+		// 
+		// If the message was stored in the Sent mailbox and a Drafts mailbox is
+		// configured, the message is moved to the Drafts mailbox and returned, for
+		// continued editing. Otherwise, nil is returned.
+		async ScheduledCancel(queueMsgIDs) {
+			const fn = "ScheduledCancel";
+			const paramTypes = [["[]", "int64"]];
+			const returnTypes = [["nullable", "MessageItem"]];
+			const params = [queueMsgIDs];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// ScheduledReschedule changes the time of the first delivery attempt of
+		// scheduled messages.
+		async ScheduledReschedule(queueMsgIDs, sendAt) {
+			const fn = "ScheduledReschedule";
+			const paramTypes = [["[]", "int64"], ["timestamp"]];
+			const returnTypes = [];
+			const params = [queueMsgIDs, sendAt];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
 		// MessageMove moves messages to another mailbox. If the message is already in
 		// the mailbox an error is returned.
 		async MessageMove(messageIDs, mailboxID) {
@@ -591,8 +682,9 @@ var api;
 			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
 		}
 		// CompleteRecipient returns autocomplete matches for a recipient, returning the
-		// matches, most recently used first, and whether this is the full list and further
-		// requests for longer prefixes aren't necessary.
+		// matches, first from contacts in the address books, then from recipients of sent
+		// messages, most recently used first, and whether this is the full list and
+		// further requests for longer prefixes aren't necessary.
 		async CompleteRecipient(search) {
 			const fn = "CompleteRecipient";
 			const paramTypes = [["string"]];
@@ -608,6 +700,35 @@ var api;
 			const params = [mb];
 			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
 		}
+		// MailboxACL returns the access control list of a mailbox: the rights other
+		// accounts have been given on the mailbox.
+		async MailboxACL(mailboxID) {
+			const fn = "MailboxACL";
+			const paramTypes = [["int64"]];
+			const returnTypes = [["[]", "MailboxACL"]];
+			const params = [mailboxID];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// MailboxACLSet sets the rights of another account, or "anyone" for all
+		// accounts, on a mailbox. Rights are letters as used in IMAP ACL, e.g. "lr" for
+		// read-only access. Empty rights remove the entry.
+		async MailboxACLSet(mailboxID, identifier, rights) {
+			const fn = "MailboxACLSet";
+			const paramTypes = [["int64"], ["string"], ["string"]];
+			const returnTypes = [];
+			const params = [mailboxID, identifier, rights];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
+		// SharedMailboxes returns the mailboxes of other accounts that this account has
+		// been given access to. They can be accessed through IMAP, in the "Other Users"
+		// and "Shared" namespaces.
+		async SharedMailboxes() {
+			const fn = "SharedMailboxes";
+			const paramTypes = [];
+			const returnTypes = [["[]", "SharedMailbox"]];
+			const params = [];
+			return await _sherpaCall(this.baseURL, this.authState, { ...this.options }, paramTypes, returnTypes, fn, params);
+		}
 		// ThreadCollapse saves the ThreadCollapse field for the messages and its
 		// children. The messageIDs are typically thread roots. But not all roots
 		// (without parent) of a thread need to have the same collapsed state.
@@ -1635,6 +1756,11 @@ const login = async (reason) => {
 		let autosize;
 		let username;
 		let password;
+		let totpBox;
+		let totp;
+		let oidcBox;
+		// Set after a valid password when a TOTP code is required for the login.
+		let totpLoginToken = '';
 		const root = dom.div(css('loginOverlay', { position: 'absolute', top: 0, right: 0, bottom: 0, left: 0, backgroundColor: styles.overlayOpaqueBackgroundColor, display: 'flex', alignItems: 'center', justifyContent: 'center', zIndex: zindexes.login, animation: 'fadein .15s ease-in' }), dom.div(reasonElem = reason ? dom.div(css('sessionError', { marginBottom: '2ex', textAlign: 'center' }), reason) : dom.div(), dom.div(css('loginPopup', {
 			backgroundColor: styles.popupBackgroundColor,
 			boxShadow: styles.boxShadow,
@@ -1653,8 +1779,26 @@ const login = async (reason) => {
 			reasonElem.remove();
 			try {
 				fieldset.disabled = true;
-				const loginToken = await client.LoginPrep();
-				const token = await client.Login(loginToken, username.value, password.value);
+				let token;
+				if (totpLoginToken) {
+					token = await client.LoginTOTP(totpLoginToken, totp.value);
+				}
+				else {
+					const loginToken = await client.LoginPrep();
+					try {
+						token = await client.Login(loginToken, username.value, password.value);
+					}
+					catch (err) {
+						if (err.code !== 'user:totpRequired') {
+							throw err;
+						}
+						// Password is valid, a code from the authenticator app is needed too.
+						totpLoginToken = loginToken;
+						totpBox.style.display = 'block';
+						totp.required = true;
+						return;
+					}
+				}
 				try {
 					window.localStorage.setItem('webmailcsrftoken', token);
 				}
@@ -1670,13 +1814,41 @@ const login = async (reason) => {
 			catch (err) {
 				console.log('login error', err);
 				window.alert('Error: ' + errmsg(err));
+				if (totpLoginToken && err.code !== 'user:loginFailed') {
+					// Login expired, start again with the password.
+					totpLoginToken = '';
+					totpBox.style.display = 'none';
+					totp.required = false;
+				}
 			}
 			finally {
 				fieldset.disabled = false;
+				if (totpLoginToken) {
+					totp.focus();
+				}
 			}
-		}, fieldset = dom.fieldset(dom.h1('Mail'), dom.label(style({ display: 'block', marginBottom: '2ex' }), dom.div('Email address', style({ marginBottom: '.5ex' })), autosize = dom.span(dom._class('autosize'), username = dom.input(attr.required(''), attr.placeholder('jane@example.org'), function change() { autosize.dataset.value = username.value; }, function input() { autosize.dataset.value = username.value; }))), dom.label(style({ display: 'block', marginBottom: '2ex' }), dom.div('Password', style({ marginBottom: '.5ex' })), password = dom.input(attr.type('password'), attr.required(''))), dom.div(style({ textAlign: 'center' }), dom.submitbutton('Login')))))));
+		}, fieldset = dom.fieldset(dom.h1('Mail'), dom.label(style({ display: 'block', marginBottom: '2ex' }), dom.div('Email address', style({ marginBottom: '.5ex' })), autosize = dom.span(dom._class('autosize'), username = dom.input(attr.required(''), attr.placeholder('jane@example.org'), function change() { autosize.dataset.value = username.value; }, function input() { autosize.dataset.value = username.value; }))), dom.label(style({ display: 'block', marginBottom: '2ex' }), dom.div('Password', style({ marginBottom: '.5ex' })), password = dom.input(attr.type('password'), attr.required(''))), totpBox = dom.label(style({ display: 'none', marginBottom: '2ex' }), dom.div('Two-factor authentication code', style({ marginBottom: '.5ex' })), totp = dom.input(attr.autocomplete('one-time-code')), dom.div('From your authenticator app, or a recovery code.', style({ marginTop: '.5ex', fontSize: '.9em' }))), dom.div(style({ textAlign: 'center' }), dom.submitbutton('Login')), oidcBox = dom.div(style({ display: 'none', textAlign: 'center', marginTop: '2ex' }), dom.clickbutton('Login with single sign-on', async function click() {
+			try {
+				fieldset.disabled = true;
+				const loginToken = await client.LoginPrep();
+				// The identity provider redirects back to us, init completes the login.
+				window.location.href = await client.LoginOIDCStart(loginToken);
+			}
+			catch (err) {
+				console.log('login error', err);
+				window.alert('Error: ' + errmsg(err));
+				fieldset.disabled = false;
+			}
+		})))))));
 		document.body.appendChild(root);
 		username.focus();
+		client.LoginOIDCEnabled()
+			.then(enabled => {
+			if (enabled) {
+				oidcBox.style.display = 'block';
+			}
+		})
+			.catch(err => console.log('checking for single sign-on', err));
 	});
 };
 const localStorageGet = (k) => {
@@ -2386,6 +2558,7 @@ const cmdSettings = async () => {
 	let signature;
 	let quoting;
 	let showAddressSecurity;
+	let undoSendSeconds;
 	if (!accountSettings) {
 		window.alert('No account settings fetched yet.');
 	}
@@ -2397,11 +2570,84 @@ const cmdSettings = async () => {
 			Signature: signature.value,
 			Quoting: quoting.value,
 			ShowAddressSecurity: showAddressSecurity.checked,
+			UndoSendSeconds: parseInt(undoSendSeconds.value) || 0,
 		};
 		await withDisabled(fieldset, client.SettingsSave(accSet));
 		accountSettings = accSet;
 		remove();
-	}, fieldset = dom.fieldset(dom.label(style({ margin: '1ex 0', display: 'block' }), dom.div('Signature'), signature = dom.textarea(new String(accountSettings.Signature), style({ width: '100%' }), attr.rows('' + Math.max(3, 1 + accountSettings.Signature.split('\n').length)))), dom.label(style({ margin: '1ex 0', display: 'block' }), dom.div('Reply above/below original'), attr.title('Auto: If text is selected, only the replied text is quoted and editing starts below. Otherwise, the full message is quoted and editing starts at the top.'), quoting = dom.select(dom.option(attr.value(''), 'Auto'), dom.option(attr.value('bottom'), 'Bottom', accountSettings.Quoting === api.Quoting.Bottom ? attr.selected('') : []), dom.option(attr.value('top'), 'Top', accountSettings.Quoting === api.Quoting.Top ? attr.selected('') : []))), dom.label(style({ margin: '1ex 0', display: 'block' }), showAddressSecurity = dom.input(attr.type('checkbox'), accountSettings.ShowAddressSecurity ? attr.checked('') : []), ' Show address security indications', attr.title('Show bars underneath address input fields, indicating support for STARTTLS/DNSSEC/DANE/MTA-STS/RequireTLS.')), dom.br(), dom.div(dom.submitbutton('Save')))));
+	}, fieldset = dom.fieldset(dom.label(style({ margin: '1ex 0', display: 'block' }), dom.div('Signature'), signature = dom.textarea(new String(accountSettings.Signature), style({ width: '100%' }), attr.rows('' + Math.max(3, 1 + accountSettings.Signature.split('\n').length)))), dom.label(style({ margin: '1ex 0', display: 'block' }), dom.div('Reply above/below original'), attr.title('Auto: If text is selected, only the replied text is quoted and editing starts below. Otherwise, the full message is quoted and editing starts at the top.'), quoting = dom.select(dom.option(attr.value(''), 'Auto'), dom.option(attr.value('bottom'), 'Bottom', accountSettings.Quoting === api.Quoting.Bottom ? attr.selected('') : []), dom.option(attr.value('top'), 'Top', accountSettings.Quoting === api.Quoting.Top ? attr.selected('') : []))), dom.label(style({ margin: '1ex 0', display: 'block' }), showAddressSecurity = dom.input(attr.type('checkbox'), accountSettings.ShowAddressSecurity ? attr.checked('') : []), ' Show address security indications', attr.title('Show bars underneath address input fields, indicating support for STARTTLS/DNSSEC/DANE/MTA-STS/RequireTLS.')), dom.label(style({ margin: '1ex 0', display: 'block' }), dom.div('Undo send period (seconds)'), attr.title('Messages sent without a scheduled time are held for this many seconds, during which sending can be undone. Zero disables undo send. At most 600 seconds.'), undoSendSeconds = dom.input(attr.type('number'), attr.min('0'), attr.max('600'), attr.value('' + (accountSettings.UndoSendSeconds || 0)))), dom.br(), dom.div(dom.submitbutton('Save')))));
+};
+// Compose a message based on a draft, e.g. a scheduled message that was canceled
+// and moved to the Drafts mailbox for further editing.
+const composeDraft = async (mi, listMailboxes) => {
+	const env = mi.Envelope;
+	let refMsgID = 0;
+	if (env.InReplyTo) {
+		refMsgID = await withStatus('Looking up referenced message', client.MessageFindMessageID(env.InReplyTo));
+	}
+	const pm = await withStatus('Fetching draft message', client.ParsedMessage(mi.Message.ID));
+	const isForward = !!env.Subject.match(/^\[?fwd?:/i) || !!env.Subject.match(/\(fwd\)[ \t]*$/i);
+	const opts = {
+		from: (env.From || []),
+		to: (env.To || []).map(a => formatAddress(a)),
+		cc: (env.CC || []).map(a => formatAddress(a)),
+		bcc: (env.BCC || []).map(a => formatAddress(a)),
+		replyto: env.ReplyTo && env.ReplyTo.length > 0 ? formatAddress(env.ReplyTo[0]) : '',
+		subject: env.Subject,
+		isForward: isForward,
+		body: pm.Texts && pm.Texts.length > 0 ? pm.Texts[0].replace(/\r/g, '') : '',
+		responseMessageID: refMsgID,
+		draftMessageID: mi.Message.ID,
+	};
+	compose(opts, listMailboxes);
+};
+// Show a notice in the status bar during the "undo send" period of a just
+// submitted message, with a button to cancel delivery and continue editing.
+const undoSendNotice = (queueMsgIDs, seconds, listMailboxes) => {
+	let undoButton;
+	const elem = dom.span('Message sent. ', undoButton = dom.clickbutton('Undo', attr.title('Cancel delivery of the message and continue editing it.'), async function click() {
+		const draft = await withStatus('Canceling delivery', client.ScheduledCancel(queueMsgIDs), undoButton);
+		window.clearTimeout(id);
+		elem.remove();
+		if (draft) {
+			await composeDraft(draft, listMailboxes);
+		}
+	}), ' ');
+	const id = window.setTimeout(() => elem.remove(), seconds * 1000);
+	statusElem.appendChild(elem);
+};
+// Show popup with messages scheduled for later delivery, or still in their "undo
+// send" period, with buttons to cancel, edit and reschedule.
+const cmdScheduled = async (listMailboxes) => {
+	const scheduled = await withStatus('Listing scheduled messages', client.ScheduledList()) || [];
+	// Cancel delivery and remove the row, returning the message moved to the Drafts
+	// mailbox, if any.
+	const cancel = async (sm, tr, fieldset) => {
+		const draft = await withStatus('Canceling delivery', client.ScheduledCancel(sm.QueueMsgIDs || []), fieldset);
+		tr.remove();
+		return draft;
+	};
+	const remove = popup(css('popupScheduled', { padding: '1em 1em 2em 1em', minWidth: '30em' }), dom.h1('Scheduled messages'), dom.p('Messages scheduled for later delivery, or still in their undo send period. Canceled messages are moved to the Drafts mailbox.'), dom.table(dom.thead(dom.tr(dom.th('Send at'), dom.th('Recipients'), dom.th('Subject'), dom.th('Actions'))), dom.tbody(scheduled.length === 0 ? dom.tr(dom.td(attr.colspan('4'), 'No scheduled messages.')) : [], scheduled.map(sm => {
+		let sendAtCell;
+		let fieldset;
+		let sendAt;
+		const tr = dom.tr(sendAtCell = dom.td(sm.SendAt.toLocaleString(), sm.UndoSend ? ' (undo send period)' : []), dom.td((sm.Recipients || []).join(', ')), dom.td(sm.Subject), dom.td(fieldset = dom.fieldset(dom.clickbutton('Cancel', attr.title('Cancel delivery, moving the message to the Drafts mailbox.'), async function click() {
+			await cancel(sm, tr, fieldset);
+		}), ' ', dom.clickbutton('Edit', attr.title('Cancel delivery and continue editing the message.'), async function click() {
+			const draft = await cancel(sm, tr, fieldset);
+			if (draft) {
+				remove();
+				await composeDraft(draft, listMailboxes);
+			}
+		}), ' ', dom.form(style({ display: 'inline' }), async function submit(e) {
+			e.preventDefault();
+			e.stopPropagation();
+			const t = new Date(sendAt.value);
+			await withStatus('Rescheduling delivery', client.ScheduledReschedule(sm.QueueMsgIDs || [], t), fieldset);
+			dom._kids(sendAtCell, t.toLocaleString());
+		}, sendAt = dom.input(attr.type('datetime-local'), attr.required('')), ' ', dom.submitbutton('Reschedule')))));
+		return tr;
+	}))));
 };
 // Show help popup, with shortcuts and basic explanation.
 const cmdHelp = async () => {
@@ -2564,6 +2810,7 @@ const compose = (opts, listMailboxes) => {
 	let body;
 	let attachments;
 	let requiretls;
+	let cryptoSelect;
 	let toBtn, ccBtn, bccBtn, replyToBtn, customFromBtn;
 	let replyToCell, toCell, ccCell, bccCell; // Where we append new address views.
 	let toRow, replyToRow, ccRow, bccRow; // We show/hide rows as needed.
@@ -2705,13 +2952,20 @@ const compose = (opts, listMailboxes) => {
 			IsForward: opts.isForward || false,
 			ResponseMessageID: opts.responseMessageID || 0,
 			RequireTLS: requiretls.value === '' ? null : requiretls.value === 'yes',
+			Crypto: (cryptoSelect.value.split(' ')[0] || ''),
+			Sign: cryptoSelect.value.includes('sign'),
+			Encrypt: cryptoSelect.value.includes('encrypt'),
 			FutureRelease: scheduleTime.value ? new Date(scheduleTime.value) : null,
+			UndoSendSeconds: scheduleTime.value ? 0 : (accountSettings?.UndoSendSeconds || 0),
 			ArchiveThread: archive,
 			DraftMessageID: draftMessageID,
 		};
-		await client.MessageSubmit(message);
+		const queueMsgIDs = await client.MessageSubmit(message);
 		composeElem.remove();
 		composeView = null;
+		if (message.UndoSendSeconds > 0 && queueMsgIDs && queueMsgIDs.length > 0) {
+			undoSendNotice(queueMsgIDs, message.UndoSendSeconds, listMailboxes);
+		}
 	};
 	const cmdSend = async () => {
 		await withStatus('Sending email', submit(false), fieldset);
@@ -3034,7 +3288,7 @@ const compose = (opts, listMailboxes) => {
 		return v;
 	}), dom.label(styleClasses.textMild, dom.input(attr.type('checkbox'), function change(e) {
 		forwardAttachmentViews.forEach(v => v.checkbox.checked = e.target.checked);
-	}), ' (Toggle all)')), noAttachmentsWarning = dom.div(style({ display: 'none' }), css('composeNoAttachmentsWarning', { backgroundColor: styles.warningBackgroundColor, padding: '0.15em .25em', margin: '.5em 0' }), 'Message mentions attachments, but no files are attached.'), dom.label(style({ margin: '1ex 0', display: 'block' }), 'Attachments ', attachments = dom.input(attr.type('file'), attr.multiple(''), function change() { checkAttachments(); })), dom.label(style({ margin: '1ex 0', display: 'block' }), attr.title('How to use TLS for message delivery over SMTP:\n\nDefault: Delivery attempts follow the policies published by the recipient domain: Verification with MTA-STS and/or DANE, or optional opportunistic unverified STARTTLS if the domain does not specify a policy.\n\nWith RequireTLS: For sensitive messages, you may want to require verified TLS. The recipient destination domain SMTP server must support the REQUIRETLS SMTP extension for delivery to succeed. It is automatically chosen when the destination domain mail servers of all recipients are known to support it.\n\nFallback to insecure: If delivery fails due to MTA-STS and/or DANE policies specified by the recipient domain, and the content is not sensitive, you may choose to ignore the recipient domain TLS policies so delivery can succeed.'), 'TLS ', requiretls = dom.select(dom.option(attr.value(''), 'Default'), dom.option(attr.value('yes'), 'With RequireTLS'), dom.option(attr.value('no'), 'Fallback to insecure'))), dom.div(scheduleLink = dom.a(attr.href(''), 'Schedule', function click(e) {
+	}), ' (Toggle all)')), noAttachmentsWarning = dom.div(style({ display: 'none' }), css('composeNoAttachmentsWarning', { backgroundColor: styles.warningBackgroundColor, padding: '0.15em .25em', margin: '.5em 0' }), 'Message mentions attachments, but no files are attached.'), dom.label(style({ margin: '1ex 0', display: 'block' }), 'Attachments ', attachments = dom.input(attr.type('file'), attr.multiple(''), function change() { checkAttachments(); })), dom.label(style({ margin: '1ex 0', display: 'block' }), attr.title('How to use TLS for message delivery over SMTP:\n\nDefault: Delivery attempts follow the policies published by the recipient domain: Verification with MTA-STS and/or DANE, or optional opportunistic unverified STARTTLS if the domain does not specify a policy.\n\nWith RequireTLS: For sensitive messages, you may want to require verified TLS. The recipient destination domain SMTP server must support the REQUIRETLS SMTP extension for delivery to succeed. It is automatically chosen when the destination domain mail servers of all recipients are known to support it.\n\nFallback to insecure: If delivery fails due to MTA-STS and/or DANE policies specified by the recipient domain, and the content is not sensitive, you may choose to ignore the recipient domain TLS policies so delivery can succeed.'), 'TLS ', requiretls = dom.select(dom.option(attr.value(''), 'Default'), dom.option(attr.value('yes'), 'With RequireTLS'), dom.option(attr.value('no'), 'Fallback to insecure'))), dom.label(style({ margin: '1ex 0', display: 'block' }), attr.title('Sign and/or encrypt the message with S/MIME or OpenPGP. Signing requires a key for the From address. Encrypting requires a key for each recipient, messages are also encrypted to the key of the From address. Keys are managed in the account settings.'), 'Signing and encryption ', cryptoSelect = dom.select(dom.option(attr.value(''), 'None'), dom.option(attr.value('openpgp sign'), 'OpenPGP, sign'), dom.option(attr.value('openpgp encrypt'), 'OpenPGP, encrypt'), dom.option(attr.value('openpgp sign encrypt'), 'OpenPGP, sign and encrypt'), dom.option(attr.value('smime sign'), 'S/MIME, sign'), dom.option(attr.value('smime encrypt'), 'S/MIME, encrypt'), dom.option(attr.value('smime sign encrypt'), 'S/MIME, sign and encrypt'))), dom.div(scheduleLink = dom.a(attr.href(''), 'Schedule', function click(e) {
 		e.preventDefault();
 		scheduleTime.value = localdatetime(new Date());
 		scheduleTimeChanged();
@@ -3814,9 +4068,9 @@ const newMsgView = (miv, msglistView, listMailboxes, possibleLabels, messageLoad
 		M: msglistView.cmdMarkUnread,
 	};
 	let urlType; // text, html, htmlexternal; for opening in new tab/print
-	let msgbuttonElem, msgheaderElem, msgattachmentElem, msgmodeElem;
+	let msgbuttonElem, msgheaderElem, msgcryptoElem, msgattachmentElem, msgmodeElem;
 	let msgheaderdetailsElem = null; // When full headers are visible, or some headers are requested through settings.
-	const msgmetaElem = dom.div(css('msgmeta', { backgroundColor: styles.backgroundColorMild, borderBottom: '5px solid', borderBottomColor: ['white', 'black'], maxHeight: '90%', overflowY: 'auto' }), attr.role('region'), attr.arialabel('Buttons and headers for message'), msgbuttonElem = dom.div(), dom.div(attr.arialive('assertive'), msgheaderElem = dom.table(styleClasses.msgHeaders), msgattachmentElem = dom.div(), msgmodeElem = dom.div()), 
+	const msgmetaElem = dom.div(css('msgmeta', { backgroundColor: styles.backgroundColorMild, borderBottom: '5px solid', borderBottomColor: ['white', 'black'], maxHeight: '90%', overflowY: 'auto' }), attr.role('region'), attr.arialabel('Buttons and headers for message'), msgbuttonElem = dom.div(), dom.div(attr.arialive('assertive'), msgheaderElem = dom.table(styleClasses.msgHeaders), msgcryptoElem = dom.div(), msgattachmentElem = dom.div(), msgmodeElem = dom.div()), 
 	// Explicit separator that separates headers from body, to
 	// prevent HTML messages from faking UI elements.
 	dom.div(css('headerBodySeparator', { height: '2px', backgroundColor: styles.borderColor })));
@@ -3997,6 +4251,18 @@ const newMsgView = (miv, msglistView, listMailboxes, possibleLabels, messageLoad
 			});
 		});
 	};
+	// Show result of decrypting and verifying signatures of S/MIME and OpenPGP messages.
+	const loadCrypto = (pm) => {
+		const mc = pm.Crypto;
+		if (!mc) {
+			return;
+		}
+		const okStyle = css('msgCryptoOK', { backgroundColor: styles.successBackground, padding: '0 .15em', borderRadius: '.15em' });
+		const warnStyle = css('msgCryptoWarning', { backgroundColor: styles.warningBackgroundColor, padding: '0 .15em', borderRadius: '.15em' });
+		dom._kids(msgcryptoElem, dom.div(css('msgCrypto', { margin: '.5ex 0' }), mc.Kind === api.CryptoKind.CryptoSMIME ? 'S/MIME: ' : 'OpenPGP: ', mc.Encrypted ? (mc.Decrypted ? dom.span(okStyle, 'Decrypted') : dom.span(warnStyle, 'Could not decrypt: ' + mc.DecryptError)) : [], mc.Encrypted && mc.Signed ? ', ' : [], mc.Signed ? (mc.SignatureValid ?
+			dom.span(mc.SignerTrusted && mc.SignerMatchesFrom ? okStyle : warnStyle, attr.title('Fingerprint of key: ' + mc.SignerFingerprint), 'Valid signature by ' + (mc.SignerAddresses || []).join(', '), mc.SignerTrusted ? [] : ', key not verified', mc.SignerMatchesFrom ? [] : ', not matching From address') :
+			dom.span(warnStyle, 'Bad signature: ' + mc.SignatureError)) : []));
+	};
 	const mv = {
 		root: root,
 		messageitem: mi,
@@ -4034,6 +4300,7 @@ const newMsgView = (miv, msglistView, listMailboxes, possibleLabels, messageLoad
 		loadButtons(pm);
 		loadHeaderDetails(pm);
 		loadMoreHeaders(pm);
+		loadCrypto(pm);
 		const msgHeaderSeparatorStyle = css('msgHeaderSeparator', { borderTop: '1px solid', borderTopColor: styles.borderColor });
 		const msgModeWarningStyle = css('msgModeWarning', { backgroundColor: styles.warningBackgroundColor, padding: '0 .15em' });
 		const htmlNote = 'In the HTML viewer, the following potentially dangerous functionality is disabled: submitting forms, starting a download from a link, navigating away from this page by clicking a link. If a link does not work, try explicitly opening it in a new tab.';
@@ -5374,6 +5641,39 @@ const popoverExport = (reference, mailboxName) => {
 		window.setTimeout(() => removeExport(), 100);
 	}, attr.target('_blank'), attr.method('POST'), attr.action('export'), dom.input(attr.type('hidden'), attr.name('csrf'), attr.value(localStorageGet('webmailcsrftoken') || '')), dom.input(attr.type('hidden'), attr.name('mailbox'), attr.value(mailboxName)), dom.div(css('exportFields', { display: 'flex', flexDirection: 'column', gap: '.5ex' }), dom.div(dom.label(dom.input(attr.type('radio'), attr.name('format'), attr.value('maildir'), attr.checked('')), ' Maildir'), ' ', dom.label(dom.input(attr.type('radio'), attr.name('format'), attr.value('mbox')), ' Mbox')), dom.div(dom.label(dom.input(attr.type('radio'), attr.name('archive'), attr.value('tar')), ' Tar'), ' ', dom.label(dom.input(attr.type('radio'), attr.name('archive'), attr.value('tgz'), attr.checked('')), ' Tgz'), ' ', dom.label(dom.input(attr.type('radio'), attr.name('archive'), attr.value('zip')), ' Zip'), ' ', dom.label(dom.input(attr.type('radio'), attr.name('archive'), attr.value('none')), ' None')), dom.div(dom.label(dom.input(attr.type('checkbox'), attr.checked(''), attr.name('recursive'), attr.value('on')), ' Recursive')), dom.div(style({ marginTop: '1ex' }), dom.submitbutton('Export')))));
 };
+// Rights on shared mailboxes, as used by IMAP ACL.
+const sharingRights = [
+	['lr', 'Read'],
+	['lrsw', 'Read and flag'],
+	['lrswite', 'Read, flag, add and remove messages'],
+];
+const popoverSharing = async (reference, mb) => {
+	const tbody = dom.tbody();
+	let fieldset, identifier, rights;
+	const rightsText = (s) => {
+		const r = sharingRights.find(t => t[0] === s);
+		return r ? r[1] + ' (' + s + ')' : s;
+	};
+	const render = async () => {
+		const acls = await withStatus('Fetching access control list', client.MailboxACL(mb.ID));
+		dom._kids(tbody, (acls || []).length === 0 ? dom.tr(dom.td(attr.colspan('3'), 'Not shared.')) : [], (acls || []).map(acl => dom.tr(dom.td(acl.Identifier === 'anyone' ? 'Anyone (all accounts)' : acl.Identifier), dom.td(rightsText(acl.Rights)), dom.td(dom.clickbutton('Remove', async function click(e) {
+			await withStatus('Removing access', client.MailboxACLSet(mb.ID, acl.Identifier, ''), e.target);
+			await render();
+		})))));
+	};
+	await render();
+	popover(reference, {}, dom.h1('Share ', mb.Name), dom.p('Other accounts on this server can be given access to this mailbox. They will see it in their IMAP email client, in the "Other Users" folder, or in the "Shared" folder when giving access to anyone.'), dom.table(dom.thead(dom.tr(dom.th('Account'), dom.th('Rights'), dom.th())), tbody), dom.br(), dom.form(async function submit(e) {
+		e.preventDefault();
+		await withStatus('Sharing mailbox', client.MailboxACLSet(mb.ID, identifier.value, rights.value), fieldset);
+		identifier.value = '';
+		await render();
+	}, fieldset = dom.fieldset(dom.label('Account ', identifier = dom.input(attr.required(''), attr.title('Name of an account, or "anyone" for all accounts.'), focusPlaceholder('anyone'))), ' ', dom.label('Rights ', rights = dom.select(sharingRights.map(t => dom.option(attr.value(t[0]), t[1])))), ' ', dom.submitbutton('Share'))));
+};
+const popoverSharedMailboxes = async (reference) => {
+	const l = await withStatus('Fetching shared mailboxes', client.SharedMailboxes());
+	popover(reference, {}, dom.h1('Shared mailboxes'), dom.p('Mailboxes of other accounts shared with you. They can be accessed with an IMAP email client.'), (l || []).length === 0 ? dom.p('No mailboxes have been shared with you.') :
+		dom.table(dom.thead(dom.tr(dom.th('IMAP mailbox'), dom.th('Rights'))), dom.tbody((l || []).map(sm => dom.tr(dom.td((sm.Direct ? 'Other Users/' : 'Shared/') + sm.Account + '/' + sm.Mailbox.Name), dom.td(sm.Rights))))));
+};
 const newMailboxView = (xmb, mailboxlistView, otherMailbox) => {
 	const plusbox = '⊞';
 	const minusbox = '⊟';
@@ -5440,6 +5740,9 @@ const newMailboxView = (xmb, mailboxlistView, otherMailbox) => {
 				await withStatus('Marking mailbox as special use', client.MailboxSetSpecialUse(mb));
 			};
 			popover(actionBtn, { transparent: true }, dom.div(style({ display: 'flex', flexDirection: 'column', gap: '.5ex' }), dom.div(dom.clickbutton('Archive', async function click() { await setUse((mb) => { mb.Archive = true; }); })), dom.div(dom.clickbutton('Draft', async function click() { await setUse((mb) => { mb.Draft = true; }); })), dom.div(dom.clickbutton('Junk', async function click() { await setUse((mb) => { mb.Junk = true; }); })), dom.div(dom.clickbutton('Sent', async function click() { await setUse((mb) => { mb.Sent = true; }); })), dom.div(dom.clickbutton('Trash', async function click() { await setUse((mb) => { mb.Trash = true; }); }))));
+		})), dom.div(dom.clickbutton('Share...', attr.title('Give other accounts access to this mailbox, through IMAP.'), async function click() {
+			remove();
+			await popoverSharing(actionBtn, mbv.mailbox);
 		})), dom.div(dom.clickbutton('Export', function click() {
 			popoverExport(actionBtn, mbv.mailbox.Name);
 			remove();
@@ -5690,6 +5993,10 @@ const newMailboxlistView = (msglistView, requestNewView, updatePageTitle, setLoc
 			const ref = e.target;
 			popoverExport(ref, '');
 			remove();
+		})), dom.div(dom.clickbutton('Shared mailboxes', attr.title('List mailboxes of other accounts shared with you.'), async function click(e) {
+			const ref = e.target;
+			await popoverSharedMailboxes(ref);
+			remove();
 		}))));
 	})), mailboxesElem));
 	const loadMailboxes = (mailboxes, mbnameOpt) => {
@@ -6153,6 +6460,24 @@ const parseComposeMailto = (mailto) => {
 	return opts;
 };
 const init = async () => {
+	// Back from a login at the identity provider.
+	const oidcState = new URLSearchParams(window.location.search).get('oidc');
+	if (oidcState) {
+		try {
+			const [token] = await client.LoginOIDC(oidcState);
+			try {
+				window.localStorage.setItem('webmailcsrftoken', token);
+			}
+			catch (err) {
+				console.log('saving csrf token in localStorage', err);
+			}
+		}
+		catch (err) {
+			window.alert('Error: ' + errmsg(err));
+		}
+		window.location.replace(window.location.pathname + window.location.hash);
+		return;
+	}
 	let connectionElem; // SSE connection status/error. Empty when connected.
 	let layoutElem; // Select dropdown for layout.
 	let accountElem;
@@ -6477,6 +6802,7 @@ const init = async () => {
 		}
 		compose({ body: body, editOffset: 0 }, listMailboxes);
 	};
+	const cmdScheduledMessages = async () => cmdScheduled(listMailboxes);
 	const cmdOpenInbox = async () => {
 		const mb = mailboxlistView.findMailboxByName('Inbox');
 		if (mb) {
@@ -6558,7 +6884,7 @@ const init = async () => {
 		else {
 			selectLayout(layoutElem.value);
 		}
-	}), ' ', dom.clickbutton('Tooltip', attr.title('Show tooltips, based on the title attributes (underdotted text) for the focused element and all user interface elements below it. Use the keyboard shortcut "ctrl ?" instead of clicking on the tooltip button, which changes focus to the tooltip button.'), clickCmd(cmdTooltip, shortcuts)), ' ', dom.clickbutton('Help', attr.title('Show popup with basic usage information and a keyboard shortcuts.'), clickCmd(cmdHelp, shortcuts)), ' ', dom.clickbutton('Settings', attr.title('Change settings for composing messages.'), clickCmd(cmdSettings, shortcuts)), ' ', accountElem = dom.span(), ' ', loginAddressElem = dom.span(), ' ', dom.clickbutton('Logout', attr.title('Logout, invalidating this session.'), async function click(e) {
+	}), ' ', dom.clickbutton('Tooltip', attr.title('Show tooltips, based on the title attributes (underdotted text) for the focused element and all user interface elements below it. Use the keyboard shortcut "ctrl ?" instead of clicking on the tooltip button, which changes focus to the tooltip button.'), clickCmd(cmdTooltip, shortcuts)), ' ', dom.clickbutton('Help', attr.title('Show popup with basic usage information and a keyboard shortcuts.'), clickCmd(cmdHelp, shortcuts)), ' ', dom.clickbutton('Settings', attr.title('Change settings for composing messages.'), clickCmd(cmdSettings, shortcuts)), ' ', dom.clickbutton('Scheduled', attr.title('Show messages scheduled for later delivery, to cancel, edit or reschedule them.'), clickCmd(cmdScheduledMessages, shortcuts)), ' ', accountElem = dom.span(), ' ', loginAddressElem = dom.span(), ' ', dom.clickbutton('Logout', attr.title('Logout, invalidating this session.'), async function click(e) {
 		await withStatus('Logging out', client.Logout(), e.target);
 		localStorageRemove('webmailcsrftoken');
 		if (eventSource) {
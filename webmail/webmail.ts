@@ -271,6 +271,11 @@ const login = async (reason: string) => {
 		let autosize: HTMLElement
 		let username: HTMLInputElement
 		let password: HTMLInputElement
+		let totpBox: HTMLElement
+		let totp: HTMLInputElement
+		let oidcBox: HTMLElement
+		// Set after a valid password when a TOTP code is required for the login.
+		let totpLoginToken = ''
 		const root = dom.div(
 			css('loginOverlay', {position: 'absolute', top: 0, right: 0, bottom: 0, left: 0, backgroundColor: styles.overlayOpaqueBackgroundColor, display: 'flex', alignItems: 'center', justifyContent: 'center', zIndex: zindexes.login, animation: 'fadein .15s ease-in'}),
 			dom.div(
@@ -298,8 +303,24 @@ const login = async (reason: string) => {
 
 							try {
 								fieldset.disabled = true
-								const loginToken = await client.LoginPrep()
-								const token = await client.Login(loginToken, username.value, password.value)
+								let token: string
+								if (totpLoginToken) {
+									token = await client.LoginTOTP(totpLoginToken, totp.value)
+								} else {
+									const loginToken = await client.LoginPrep()
+									try {
+										token = await client.Login(loginToken, username.value, password.value)
+									} catch (err) {
+										if ((err as any).code !== 'user:totpRequired') {
+											throw err
+										}
+										// Password is valid, a code from the authenticator app is needed too.
+										totpLoginToken = loginToken
+										totpBox.style.display = 'block'
+										totp.required = true
+										return
+									}
+								}
 								try {
 									window.localStorage.setItem('webmailcsrftoken', token)
 								} catch (err) {
@@ -313,8 +334,17 @@ const login = async (reason: string) => {
 							} catch (err) {
 								console.log('login error', err)
 								window.alert('Error: ' + errmsg(err))
+								if (totpLoginToken && (err as any).code !== 'user:loginFailed') {
+									// Login expired, start again with the password.
+									totpLoginToken = ''
+									totpBox.style.display = 'none'
+									totp.required = false
+								}
 							} finally {
 								fieldset.disabled = false
+								if (totpLoginToken) {
+									totp.focus()
+								}
 							}
 						},
 						fieldset=dom.fieldset(
@@ -336,10 +366,31 @@ const login = async (reason: string) => {
 								dom.div('Password', style({marginBottom: '.5ex'})),
 								password=dom.input(attr.type('password'), attr.required('')),
 							),
+							totpBox=dom.label(
+								style({display: 'none', marginBottom: '2ex'}),
+								dom.div('Two-factor authentication code', style({marginBottom: '.5ex'})),
+								totp=dom.input(attr.autocomplete('one-time-code')),
+								dom.div('From your authenticator app, or a recovery code.', style({marginTop: '.5ex', fontSize: '.9em'})),
+							),
 							dom.div(
 								style({textAlign: 'center'}),
 								dom.submitbutton('Login'),
 							),
+							oidcBox=dom.div(
+								style({display: 'none', textAlign: 'center', marginTop: '2ex'}),
+								dom.clickbutton('Login with single sign-on', async function click() {
+									try {
+										fieldset.disabled = true
+										const loginToken = await client.LoginPrep()
+										// The identity provider redirects back to us, init completes the login.
+										window.location.href = await client.LoginOIDCStart(loginToken)
+									} catch (err) {
+										console.log('login error', err)
+										window.alert('Error: ' + errmsg(err))
+										fieldset.disabled = false
+									}
+								}),
+							),
 						),
 					)
 				)
@@ -347,6 +398,13 @@ const login = async (reason: string) => {
 		)
 		document.body.appendChild(root)
 		username.focus()
+		client.LoginOIDCEnabled()
+			.then(enabled => {
+				if (enabled) {
+					oidcBox.style.display = 'block'
+				}
+			})
+			.catch(err => console.log('checking for single sign-on', err))
 	})
 }
 
@@ -1110,6 +1168,7 @@ const cmdSettings = async () => {
 	let signature: HTMLTextAreaElement
 	let quoting: HTMLSelectElement
 	let showAddressSecurity: HTMLInputElement
+	let undoSendSeconds: HTMLInputElement
 
 	if (!accountSettings) {
 		window.alert('No account settings fetched yet.')
@@ -1127,6 +1186,7 @@ const cmdSettings = async () => {
 					Signature: signature.value,
 					Quoting: quoting.value as api.Quoting,
 					ShowAddressSecurity: showAddressSecurity.checked,
+					UndoSendSeconds: parseInt(undoSendSeconds.value) || 0,
 				}
 				await withDisabled(fieldset, client.SettingsSave(accSet))
 				accountSettings = accSet
@@ -1158,6 +1218,12 @@ const cmdSettings = async () => {
 					' Show address security indications',
 					attr.title('Show bars underneath address input fields, indicating support for STARTTLS/DNSSEC/DANE/MTA-STS/RequireTLS.'),
 				),
+				dom.label(
+					style({margin: '1ex 0', display: 'block'}),
+					dom.div('Undo send period (seconds)'),
+					attr.title('Messages sent without a scheduled time are held for this many seconds, during which sending can be undone. Zero disables undo send. At most 600 seconds.'),
+					undoSendSeconds=dom.input(attr.type('number'), attr.min('0'), attr.max('600'), attr.value(''+(accountSettings.UndoSendSeconds || 0))),
+				),
 				dom.br(),
 				dom.div(
 					dom.submitbutton('Save'),
@@ -1167,6 +1233,121 @@ const cmdSettings = async () => {
 	)
 }
 
+// Compose a message based on a draft, e.g. a scheduled message that was canceled
+// and moved to the Drafts mailbox for further editing.
+const composeDraft = async (mi: api.MessageItem, listMailboxes: listMailboxes) => {
+	const env = mi.Envelope
+	let refMsgID = 0
+	if (env.InReplyTo) {
+		refMsgID = await withStatus('Looking up referenced message', client.MessageFindMessageID(env.InReplyTo))
+	}
+	const pm = await withStatus('Fetching draft message', client.ParsedMessage(mi.Message.ID))
+	const isForward = !!env.Subject.match(/^\[?fwd?:/i) || !!env.Subject.match(/\(fwd\)[ \t]*$/i)
+	const opts: ComposeOptions = {
+		from: (env.From || []),
+		to: (env.To || []).map(a => formatAddress(a)),
+		cc: (env.CC || []).map(a => formatAddress(a)),
+		bcc: (env.BCC || []).map(a => formatAddress(a)),
+		replyto: env.ReplyTo && env.ReplyTo.length > 0 ? formatAddress(env.ReplyTo[0]) : '',
+		subject: env.Subject,
+		isForward: isForward,
+		body: pm.Texts && pm.Texts.length > 0 ? pm.Texts[0].replace(/\r/g, '') : '',
+		responseMessageID: refMsgID,
+		draftMessageID: mi.Message.ID,
+	}
+	compose(opts, listMailboxes)
+}
+
+// Show a notice in the status bar during the "undo send" period of a just
+// submitted message, with a button to cancel delivery and continue editing.
+const undoSendNotice = (queueMsgIDs: number[], seconds: number, listMailboxes: listMailboxes) => {
+	let undoButton: HTMLButtonElement
+	const elem = dom.span(
+		'Message sent. ',
+		undoButton=dom.clickbutton('Undo', attr.title('Cancel delivery of the message and continue editing it.'), async function click() {
+			const draft = await withStatus('Canceling delivery', client.ScheduledCancel(queueMsgIDs), undoButton)
+			window.clearTimeout(id)
+			elem.remove()
+			if (draft) {
+				await composeDraft(draft, listMailboxes)
+			}
+		}),
+		' ',
+	)
+	const id = window.setTimeout(() => elem.remove(), seconds*1000)
+	statusElem.appendChild(elem)
+}
+
+// Show popup with messages scheduled for later delivery, or still in their "undo
+// send" period, with buttons to cancel, edit and reschedule.
+const cmdScheduled = async (listMailboxes: listMailboxes) => {
+	const scheduled = await withStatus('Listing scheduled messages', client.ScheduledList()) || []
+
+	// Cancel delivery and remove the row, returning the message moved to the Drafts
+	// mailbox, if any.
+	const cancel = async (sm: api.ScheduledMessage, tr: HTMLElement, fieldset: HTMLFieldSetElement): Promise<api.MessageItem | null> => {
+		const draft = await withStatus('Canceling delivery', client.ScheduledCancel(sm.QueueMsgIDs || []), fieldset)
+		tr.remove()
+		return draft
+	}
+
+	const remove = popup(
+		css('popupScheduled', {padding: '1em 1em 2em 1em', minWidth: '30em'}),
+		dom.h1('Scheduled messages'),
+		dom.p('Messages scheduled for later delivery, or still in their undo send period. Canceled messages are moved to the Drafts mailbox.'),
+		dom.table(
+			dom.thead(
+				dom.tr(
+					dom.th('Send at'),
+					dom.th('Recipients'),
+					dom.th('Subject'),
+					dom.th('Actions'),
+				),
+			),
+			dom.tbody(
+				scheduled.length === 0 ? dom.tr(dom.td(attr.colspan('4'), 'No scheduled messages.')) : [],
+				scheduled.map(sm => {
+					let sendAtCell: HTMLElement
+					let fieldset: HTMLFieldSetElement
+					let sendAt: HTMLInputElement
+					const tr = dom.tr(
+						sendAtCell=dom.td(sm.SendAt.toLocaleString(), sm.UndoSend ? ' (undo send period)' : []),
+						dom.td((sm.Recipients || []).join(', ')),
+						dom.td(sm.Subject),
+						dom.td(
+							fieldset=dom.fieldset(
+								dom.clickbutton('Cancel', attr.title('Cancel delivery, moving the message to the Drafts mailbox.'), async function click() {
+									await cancel(sm, tr, fieldset)
+								}), ' ',
+								dom.clickbutton('Edit', attr.title('Cancel delivery and continue editing the message.'), async function click() {
+									const draft = await cancel(sm, tr, fieldset)
+									if (draft) {
+										remove()
+										await composeDraft(draft, listMailboxes)
+									}
+								}), ' ',
+								dom.form(
+									style({display: 'inline'}),
+									async function submit(e: SubmitEvent) {
+										e.preventDefault()
+										e.stopPropagation()
+										const t = new Date(sendAt.value)
+										await withStatus('Rescheduling delivery', client.ScheduledReschedule(sm.QueueMsgIDs || [], t), fieldset)
+										dom._kids(sendAtCell, t.toLocaleString())
+									},
+									sendAt=dom.input(attr.type('datetime-local'), attr.required('')), ' ',
+									dom.submitbutton('Reschedule'),
+								),
+							),
+						),
+					)
+					return tr
+				}),
+			),
+		),
+	)
+}
+
 // Show help popup, with shortcuts and basic explanation.
 const cmdHelp = async () => {
 	const remove = popup(
@@ -1437,6 +1618,7 @@ const compose = (opts: ComposeOptions, listMailboxes: listMailboxes) => {
 	let body: HTMLTextAreaElement
 	let attachments: HTMLInputElement
 	let requiretls: HTMLSelectElement
+	let cryptoSelect: HTMLSelectElement
 
 	let toBtn: HTMLButtonElement, ccBtn: HTMLButtonElement, bccBtn: HTMLButtonElement, replyToBtn: HTMLButtonElement, customFromBtn: HTMLButtonElement
 	let replyToCell: HTMLElement, toCell: HTMLElement, ccCell: HTMLElement, bccCell: HTMLElement // Where we append new address views.
@@ -1600,13 +1782,20 @@ const compose = (opts: ComposeOptions, listMailboxes: listMailboxes) => {
 			IsForward: opts.isForward || false,
 			ResponseMessageID: opts.responseMessageID || 0,
 			RequireTLS: requiretls.value === '' ? null : requiretls.value === 'yes',
+			Crypto: (cryptoSelect.value.split(' ')[0] || '') as api.CryptoKind,
+			Sign: cryptoSelect.value.includes('sign'),
+			Encrypt: cryptoSelect.value.includes('encrypt'),
 			FutureRelease: scheduleTime.value ? new Date(scheduleTime.value) : null,
+			UndoSendSeconds: scheduleTime.value ? 0 : (accountSettings?.UndoSendSeconds || 0),
 			ArchiveThread: archive,
 			DraftMessageID: draftMessageID,
 		}
-		await client.MessageSubmit(message)
+		const queueMsgIDs = await client.MessageSubmit(message)
 		composeElem.remove()
 		composeView = null
+		if (message.UndoSendSeconds > 0 && queueMsgIDs && queueMsgIDs.length > 0) {
+			undoSendNotice(queueMsgIDs, message.UndoSendSeconds, listMailboxes)
+		}
 	}
 
 	const cmdSend = async () => {
@@ -2070,6 +2259,20 @@ const compose = (opts: ComposeOptions, listMailboxes: listMailboxes) => {
 						dom.option(attr.value('no'), 'Fallback to insecure'),
 					),
 				),
+				dom.label(
+					style({margin: '1ex 0', display: 'block'}),
+					attr.title('Sign and/or encrypt the message with S/MIME or OpenPGP. Signing requires a key for the From address. Encrypting requires a key for each recipient, messages are also encrypted to the key of the From address. Keys are managed in the account settings.'),
+					'Signing and encryption ',
+					cryptoSelect=dom.select(
+						dom.option(attr.value(''), 'None'),
+						dom.option(attr.value('openpgp sign'), 'OpenPGP, sign'),
+						dom.option(attr.value('openpgp encrypt'), 'OpenPGP, encrypt'),
+						dom.option(attr.value('openpgp sign encrypt'), 'OpenPGP, sign and encrypt'),
+						dom.option(attr.value('smime sign'), 'S/MIME, sign'),
+						dom.option(attr.value('smime encrypt'), 'S/MIME, encrypt'),
+						dom.option(attr.value('smime sign encrypt'), 'S/MIME, sign and encrypt'),
+					),
+				),
 				dom.div(
 					scheduleLink=dom.a(attr.href(''), 'Schedule', function click(e: MouseEvent) {
 						e.preventDefault()
@@ -3125,7 +3328,7 @@ const newMsgView = (miv: MsgitemView, msglistView: MsglistView, listMailboxes: l
 
 	let urlType: string // text, html, htmlexternal; for opening in new tab/print
 
-	let msgbuttonElem: HTMLElement, msgheaderElem: HTMLElement, msgattachmentElem: HTMLElement, msgmodeElem: HTMLElement
+	let msgbuttonElem: HTMLElement, msgheaderElem: HTMLElement, msgcryptoElem: HTMLElement, msgattachmentElem: HTMLElement, msgmodeElem: HTMLElement
 	let msgheaderdetailsElem: HTMLElement | null = null // When full headers are visible, or some headers are requested through settings.
 
 	const msgmetaElem = dom.div(
@@ -3135,6 +3338,7 @@ const newMsgView = (miv: MsgitemView, msglistView: MsglistView, listMailboxes: l
 		dom.div(
 			attr.arialive('assertive'),
 			msgheaderElem=dom.table(styleClasses.msgHeaders),
+			msgcryptoElem=dom.div(),
 			msgattachmentElem=dom.div(),
 			msgmodeElem=dom.div(),
 		),
@@ -3478,6 +3682,32 @@ const newMsgView = (miv: MsgitemView, msglistView: MsglistView, listMailboxes: l
 		})
 	}
 
+	// Show result of decrypting and verifying signatures of S/MIME and OpenPGP messages.
+	const loadCrypto = (pm: api.ParsedMessage) => {
+		const mc = pm.Crypto
+		if (!mc) {
+			return
+		}
+		const okStyle = css('msgCryptoOK', {backgroundColor: styles.successBackground, padding: '0 .15em', borderRadius: '.15em'})
+		const warnStyle = css('msgCryptoWarning', {backgroundColor: styles.warningBackgroundColor, padding: '0 .15em', borderRadius: '.15em'})
+		dom._kids(msgcryptoElem,
+			dom.div(css('msgCrypto', {margin: '.5ex 0'}),
+				mc.Kind === api.CryptoKind.CryptoSMIME ? 'S/MIME: ' : 'OpenPGP: ',
+				mc.Encrypted ? (mc.Decrypted ? dom.span(okStyle, 'Decrypted') : dom.span(warnStyle, 'Could not decrypt: '+mc.DecryptError)) : [],
+				mc.Encrypted && mc.Signed ? ', ' : [],
+				mc.Signed ? (mc.SignatureValid ?
+					dom.span(mc.SignerTrusted && mc.SignerMatchesFrom ? okStyle : warnStyle,
+						attr.title('Fingerprint of key: '+mc.SignerFingerprint),
+						'Valid signature by '+(mc.SignerAddresses || []).join(', '),
+						mc.SignerTrusted ? [] : ', key not verified',
+						mc.SignerMatchesFrom ? [] : ', not matching From address',
+					) :
+					dom.span(warnStyle, 'Bad signature: '+mc.SignatureError)
+				) : [],
+			),
+		)
+	}
+
 	const mv: MsgView = {
 		root: root,
 		messageitem: mi,
@@ -3514,6 +3744,7 @@ const newMsgView = (miv: MsgitemView, msglistView: MsglistView, listMailboxes: l
 		loadButtons(pm)
 		loadHeaderDetails(pm)
 		loadMoreHeaders(pm)
+		loadCrypto(pm)
 
 		const msgHeaderSeparatorStyle = css('msgHeaderSeparator', {borderTop: '1px solid', borderTopColor: styles.borderColor})
 		const msgModeWarningStyle = css('msgModeWarning', {backgroundColor: styles.warningBackgroundColor, padding: '0 .15em'})
@@ -5055,6 +5286,94 @@ const popoverExport = (reference: HTMLElement, mailboxName: string) => {
 	)
 }
 
+// Rights on shared mailboxes, as used by IMAP ACL.
+const sharingRights: [string, string][] = [
+	['lr', 'Read'],
+	['lrsw', 'Read and flag'],
+	['lrswite', 'Read, flag, add and remove messages'],
+]
+
+const popoverSharing = async (reference: HTMLElement, mb: api.Mailbox) => {
+	const tbody = dom.tbody()
+	let fieldset: HTMLFieldSetElement, identifier: HTMLInputElement, rights: HTMLSelectElement
+
+	const rightsText = (s: string) => {
+		const r = sharingRights.find(t => t[0] === s)
+		return r ? r[1] + ' (' + s + ')' : s
+	}
+
+	const render = async () => {
+		const acls = await withStatus('Fetching access control list', client.MailboxACL(mb.ID))
+		dom._kids(tbody,
+			(acls || []).length === 0 ? dom.tr(dom.td(attr.colspan('3'), 'Not shared.')) : [],
+			(acls || []).map(acl =>
+				dom.tr(
+					dom.td(acl.Identifier === 'anyone' ? 'Anyone (all accounts)' : acl.Identifier),
+					dom.td(rightsText(acl.Rights)),
+					dom.td(
+						dom.clickbutton('Remove', async function click(e: MouseEvent) {
+							await withStatus('Removing access', client.MailboxACLSet(mb.ID, acl.Identifier, ''), e.target! as HTMLButtonElement)
+							await render()
+						}),
+					),
+				)
+			),
+		)
+	}
+	await render()
+
+	popover(reference, {},
+		dom.h1('Share ', mb.Name),
+		dom.p('Other accounts on this server can be given access to this mailbox. They will see it in their IMAP email client, in the "Other Users" folder, or in the "Shared" folder when giving access to anyone.'),
+		dom.table(
+			dom.thead(dom.tr(dom.th('Account'), dom.th('Rights'), dom.th())),
+			tbody,
+		),
+		dom.br(),
+		dom.form(
+			async function submit(e: SubmitEvent) {
+				e.preventDefault()
+				await withStatus('Sharing mailbox', client.MailboxACLSet(mb.ID, identifier.value, rights.value), fieldset)
+				identifier.value = ''
+				await render()
+			},
+			fieldset=dom.fieldset(
+				dom.label(
+					'Account ',
+					identifier=dom.input(attr.required(''), attr.title('Name of an account, or "anyone" for all accounts.'), focusPlaceholder('anyone')),
+				),
+				' ',
+				dom.label(
+					'Rights ',
+					rights=dom.select(sharingRights.map(t => dom.option(attr.value(t[0]), t[1]))),
+				),
+				' ',
+				dom.submitbutton('Share'),
+			),
+		),
+	)
+}
+
+const popoverSharedMailboxes = async (reference: HTMLElement) => {
+	const l = await withStatus('Fetching shared mailboxes', client.SharedMailboxes())
+	popover(reference, {},
+		dom.h1('Shared mailboxes'),
+		dom.p('Mailboxes of other accounts shared with you. They can be accessed with an IMAP email client.'),
+		(l || []).length === 0 ? dom.p('No mailboxes have been shared with you.') :
+			dom.table(
+				dom.thead(dom.tr(dom.th('IMAP mailbox'), dom.th('Rights'))),
+				dom.tbody(
+					(l || []).map(sm =>
+						dom.tr(
+							dom.td((sm.Direct ? 'Other Users/' : 'Shared/') + sm.Account + '/' + sm.Mailbox.Name),
+							dom.td(sm.Rights),
+						)
+					),
+				),
+			),
+	)
+}
+
 const newMailboxView = (xmb: api.Mailbox, mailboxlistView: MailboxlistView, otherMailbox: otherMailbox): MailboxView => {
 	const plusbox = '⊞'
 	const minusbox = '⊟'
@@ -5164,6 +5483,12 @@ const newMailboxView = (xmb: api.Mailbox, mailboxlistView: MailboxlistView, othe
 						)
 					}),
 				),
+				dom.div(
+					dom.clickbutton('Share...', attr.title('Give other accounts access to this mailbox, through IMAP.'), async function click() {
+						remove()
+						await popoverSharing(actionBtn, mbv.mailbox)
+					}),
+				),
 				dom.div(
 					dom.clickbutton('Export', function click() {
 						popoverExport(actionBtn, mbv.mailbox.Name)
@@ -5509,6 +5834,13 @@ const newMailboxlistView = (msglistView: MsglistView, requestNewView: requestNew
 										remove()
 									}),
 								),
+								dom.div(
+									dom.clickbutton('Shared mailboxes', attr.title('List mailboxes of other accounts shared with you.'), async function click(e: MouseEvent) {
+										const ref = e.target! as HTMLElement
+										await popoverSharedMailboxes(ref)
+										remove()
+									}),
+								),
 							)
 						)
 					},
@@ -6169,6 +6501,23 @@ type possibleLabels = () => string[]
 type listMailboxes = () => api.Mailbox[]
 
 const init = async () => {
+	// Back from a login at the identity provider.
+	const oidcState = new URLSearchParams(window.location.search).get('oidc')
+	if (oidcState) {
+		try {
+			const [token] = await client.LoginOIDC(oidcState)
+			try {
+				window.localStorage.setItem('webmailcsrftoken', token)
+			} catch (err) {
+				console.log('saving csrf token in localStorage', err)
+			}
+		} catch (err) {
+			window.alert('Error: ' + errmsg(err))
+		}
+		window.location.replace(window.location.pathname + window.location.hash)
+		return
+	}
+
 	let connectionElem: HTMLElement // SSE connection status/error. Empty when connected.
 	let layoutElem: HTMLSelectElement // Select dropdown for layout.
 	let accountElem: HTMLElement
@@ -6615,6 +6964,7 @@ const init = async () => {
 		}
 		compose({body: body, editOffset: 0}, listMailboxes)
 	}
+	const cmdScheduledMessages = async () => cmdScheduled(listMailboxes)
 	const cmdOpenInbox = async () => {
 		const mb = mailboxlistView.findMailboxByName('Inbox')
 		if (mb) {
@@ -6751,6 +7101,8 @@ const init = async () => {
 					' ',
 					dom.clickbutton('Settings', attr.title('Change settings for composing messages.'), clickCmd(cmdSettings, shortcuts)),
 					' ',
+					dom.clickbutton('Scheduled', attr.title('Show messages scheduled for later delivery, to cancel, edit or reschedule them.'), clickCmd(cmdScheduledMessages, shortcuts)),
+					' ',
 					accountElem=dom.span(),
 					' ',
 					loginAddressElem=dom.span(),
@@ -99,6 +99,9 @@ func (x XOps) MessageDeleteTx(ctx context.Context, log mlog.Log, tx *bstore.Tx,
 		_, err := qmr.Delete()
 		x.Checkf(ctx, err, "removing message recipients")
 
+		err = store.TextIndexRemove(tx, m.ID)
+		x.Checkf(ctx, err, "removing message from full-text index")
+
 		mb.Sub(m.MailboxCounts())
 
 		if modseq == 0 {